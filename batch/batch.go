@@ -0,0 +1,55 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package batch provides the per-item results of operations on multiple images.
+package batch
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Result is the result of an operation on a single item of a batch.
+type Result struct {
+	// Name identifies the item, e.g. a reference or an image digest.
+	Name string
+	// Digest is the digest of the image the item refers to, if known.
+	Digest digest.Digest
+	// Bytes is the number of bytes transferred or freed for the item.
+	Bytes int64
+	// Err is the error that occurred for the item. If nil, the operation succeeded.
+	Err error
+}
+
+// Failed returns the results whose operation failed.
+func Failed(results []Result) []Result {
+	var failed []Result
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// Err returns an error joining the errors of all failed results, or nil if all succeeded.
+func Err(results []Result) error {
+	var errs []error
+	for _, result := range Failed(results) {
+		errs = append(errs, fmt.Errorf("%s: %w", result.Name, result.Err))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package batch_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+
+	"github.com/onmetal/onmetal-image/batch"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Batch", func() {
+	Describe("ParseFile", func() {
+		It("should parse references, destinations and comments, marking malformed lines", func() {
+			entries, err := batch.ParseFile(strings.NewReader(`# images to mirror
+ghcr.io/onmetal/a:v1
+
+ghcr.io/onmetal/b:v1 => registry.local/b:v1 # mirrored
+=> registry.local/c:v1
+ghcr.io/onmetal/d:v1 =>
+ghcr.io/onmetal/e:v1 ghcr.io/onmetal/f:v1
+`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(5))
+
+			Expect(entries[0]).To(Equal(batch.Entry{Line: 2, Ref: "ghcr.io/onmetal/a:v1"}))
+			Expect(entries[1]).To(Equal(batch.Entry{Line: 4, Ref: "ghcr.io/onmetal/b:v1", Destination: "registry.local/b:v1"}))
+			Expect(entries[1].Name()).To(Equal("ghcr.io/onmetal/b:v1 => registry.local/b:v1"))
+			for _, entry := range entries[2:] {
+				Expect(entry.Err).To(HaveOccurred())
+			}
+			Expect(entries[2].Name()).To(Equal("line 5"))
+		})
+	})
+
+	Describe("Run", func() {
+		names := []string{"a", "b", "c", "d", "e", "f"}
+
+		It("should run all items with bounded concurrency and return their results in order", func() {
+			var running, peak int32
+			results := batch.Run(context.Background(), names, 2, false, func(ctx context.Context, i int) batch.Result {
+				n := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+						break
+					}
+				}
+				if names[i] == "c" {
+					return batch.Result{Err: errors.New("bad item")}
+				}
+				return batch.Result{Bytes: int64(i)}
+			})
+
+			Expect(peak).To(BeNumerically("<=", 2))
+			Expect(results).To(HaveLen(len(names)))
+			for i, result := range results {
+				Expect(result.Name).To(Equal(names[i]))
+			}
+			Expect(batch.Failed(results)).To(ConsistOf(HaveField("Name", "c")))
+			Expect(results[5].Bytes).To(Equal(int64(5)))
+		})
+
+		It("should skip the remaining items after a failure if failing fast", func() {
+			results := batch.Run(context.Background(), names, 1, true, func(ctx context.Context, i int) batch.Result {
+				if names[i] == "b" {
+					return batch.Result{Err: errors.New("bad item")}
+				}
+				return batch.Result{}
+			})
+
+			Expect(results[0].Err).NotTo(HaveOccurred())
+			Expect(results[1].Err).To(MatchError("bad item"))
+			for _, result := range results[2:] {
+				Expect(result.Err).To(MatchError(batch.ErrSkipped))
+			}
+		})
+	})
+})
@@ -0,0 +1,83 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package batch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Entry is a line of a batch file.
+type Entry struct {
+	// Line is the line number of the entry, starting at one.
+	Line int
+	// Ref is the reference of the line.
+	Ref string
+	// Destination is the reference given after "=>", if any.
+	Destination string
+	// Err is set if the line is malformed, so it can be reported and skipped.
+	Err error
+}
+
+// Name returns the name of the entry in results: its reference, with its destination if it has one,
+// or its line if it has no reference.
+func (e Entry) Name() string {
+	switch {
+	case e.Ref == "":
+		return fmt.Sprintf("line %d", e.Line)
+	case e.Destination != "":
+		return fmt.Sprintf("%s => %s", e.Ref, e.Destination)
+	default:
+		return e.Ref
+	}
+}
+
+// ParseFile parses a batch file of one reference per line, optionally followed by "=> destination".
+// Text after '#' is a comment, blank lines are skipped. Malformed lines are returned with Err set
+// instead of failing the whole file; only read errors are returned as error.
+func ParseFile(r io.Reader) ([]Entry, error) {
+	var (
+		entries []Entry
+		scanner = bufio.NewScanner(r)
+		line    int
+	)
+	for scanner.Scan() {
+		line++
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		entry := Entry{Line: line}
+		ref, dest, hasDest := strings.Cut(text, "=>")
+		entry.Ref, entry.Destination = strings.TrimSpace(ref), strings.TrimSpace(dest)
+		switch {
+		case entry.Ref == "":
+			entry.Err = fmt.Errorf("line %d: missing reference", line)
+		case hasDest && entry.Destination == "":
+			entry.Err = fmt.Errorf("line %d: missing destination after =>", line)
+		case strings.ContainsAny(entry.Ref, " \t") || strings.ContainsAny(entry.Destination, " \t"):
+			entry.Err = fmt.Errorf("line %d: expected a single reference, optionally followed by => destination", line)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading batch file: %w", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package batch
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrSkipped is the error of the items Run did not start because an earlier item failed with failFast.
+var ErrSkipped = errors.New("skipped after an earlier failure")
+
+// Run runs fn for the items with the given names with at most jobs of them at a time and returns their
+// results in item order, named after the item unless fn names them. If failFast is set, the first
+// failure cancels the context of the running items and the items not started yet fail with ErrSkipped.
+// A jobs value below one runs the items one by one.
+func Run(ctx context.Context, names []string, jobs int, failFast bool, fn func(ctx context.Context, i int) Result) []Result {
+	if jobs < 1 {
+		jobs = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		results = make([]Result, len(names))
+		started = make([]bool, len(names))
+		sem     = make(chan struct{}, jobs)
+		wg      sync.WaitGroup
+	)
+	for i := range names {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		started[i] = true
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			res := fn(ctx, i)
+			if res.Err != nil && failFast {
+				cancel()
+			}
+			results[i] = res
+		}(i)
+	}
+	wg.Wait()
+
+	for i, name := range names {
+		if results[i].Name == "" {
+			results[i].Name = name
+		}
+		if started[i] {
+			continue
+		}
+		results[i].Err = ErrSkipped
+		if !failFast {
+			results[i].Err = ctx.Err()
+		}
+	}
+	return results
+}
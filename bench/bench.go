@@ -0,0 +1,148 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bench measures the throughput of the store and transfer paths on the local machine: ingesting
+// images into a store, reading blobs with and without verifying their digest, extracting layers and,
+// optionally, pulling from a registry. Reports are comparable across hosts and releases, e.g. for CI to
+// track the numbers over time. Each measurement can be run on its own; Run runs all of them.
+package bench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/onmetal/onmetal-image/client"
+	"github.com/onmetal/onmetal-image/utils/fsutil"
+	"github.com/onmetal/onmetal-image/version"
+)
+
+// DefaultSizes are the blob sizes measured if none are given.
+var DefaultSizes = []int64{1 << 20, 64 << 20}
+
+// DefaultIterations is the number of iterations of each measurement if none is given.
+const DefaultIterations = 3
+
+// Result is the result of a single measurement.
+type Result struct {
+	// Name is the name of the measurement, e.g. ingest.
+	Name string `json:"name"`
+	// Size is the number of bytes processed per iteration.
+	Size int64 `json:"size"`
+	// Iterations is the number of iterations measured.
+	Iterations int `json:"iterations"`
+	// NsPerOp is the average duration of an iteration in nanoseconds.
+	NsPerOp int64 `json:"nsPerOp"`
+	// BytesPerSecond is the throughput of the iterations.
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+	// Details holds additional information on the measurement, e.g. the image pulled.
+	Details map[string]string `json:"details,omitempty"`
+	// Error is set if the measurement failed. The iterations measured before are still reported.
+	Error string `json:"error,omitempty"`
+}
+
+// Report is the result of Run.
+type Report struct {
+	// Version is the version of onmetal-image measured.
+	Version version.Info `json:"version"`
+	// CPUs is the number of logical CPUs of the host.
+	CPUs int `json:"cpus"`
+	// Dir is the directory the stores of the measurements were created in.
+	Dir string `json:"dir"`
+	// FileSystem describes the capabilities of the file system of Dir, see fsutil.Capabilities.
+	FileSystem string `json:"fileSystem,omitempty"`
+	// StartedAt is when the measurements started.
+	StartedAt time.Time `json:"startedAt"`
+	// Results are the results of the measurements, in the order they ran.
+	Results []Result `json:"results"`
+}
+
+// PullOptions are options for measuring pulls, see Pull.
+type PullOptions struct {
+	// Config configures the clients pushing and pulling. Its store path is replaced by a new store for
+	// every iteration, so every pull transfers the whole image.
+	Config client.Config
+	// Ref is the image to pull. If empty, a synthetic image of each size is pushed to Repository first.
+	Ref string
+	// Repository is the repository to push synthetic images to if Ref is empty.
+	Repository string
+}
+
+// Options are options for running all measurements.
+type Options struct {
+	// Dir is the directory to create the stores of the measurements in, which determines the file system
+	// measured. Required.
+	Dir string
+	// Sizes are the blob sizes to measure. Defaults to DefaultSizes.
+	Sizes []int64
+	// Iterations is the number of iterations of each measurement. Defaults to DefaultIterations.
+	Iterations int
+	// Pull measures pulls if set, see Pull.
+	Pull *PullOptions
+}
+
+// Run runs all measurements for every size and returns their results. Failing measurements are reported
+// in their result instead of aborting the others.
+func Run(ctx context.Context, o Options) (*Report, error) {
+	if o.Dir == "" {
+		return nil, fmt.Errorf("must specify a directory")
+	}
+	if len(o.Sizes) == 0 {
+		o.Sizes = DefaultSizes
+	}
+	if o.Iterations <= 0 {
+		o.Iterations = DefaultIterations
+	}
+	if err := os.MkdirAll(o.Dir, 0777); err != nil {
+		return nil, fmt.Errorf("error creating directory: %w", err)
+	}
+
+	report := &Report{
+		Version:   version.Get(),
+		CPUs:      runtime.NumCPU(),
+		Dir:       o.Dir,
+		StartedAt: time.Now().UTC(),
+	}
+	if capabilities, err := fsutil.Probe(o.Dir); err == nil {
+		report.FileSystem = capabilities.String()
+	}
+
+	for _, size := range o.Sizes {
+		read := Read(ctx, o.Dir, size, o.Iterations)
+		verified := ReadVerified(ctx, o.Dir, size, o.Iterations)
+		if read.Error == "" && verified.Error == "" && read.NsPerOp > 0 {
+			overhead := (float64(verified.NsPerOp)/float64(read.NsPerOp) - 1) * 100
+			verified.Details = map[string]string{"overhead": fmt.Sprintf("%.1f%%", overhead)}
+		}
+		report.Results = append(report.Results,
+			Ingest(ctx, o.Dir, size, o.Iterations),
+			read,
+			verified,
+			ExtractLayer(ctx, o.Dir, size, o.Iterations),
+			UnpackRootFS(ctx, o.Dir, size, o.Iterations),
+		)
+		if o.Pull != nil && o.Pull.Ref == "" {
+			report.Results = append(report.Results, Pull(ctx, o.Dir, size, o.Iterations, *o.Pull))
+		}
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+	}
+	if o.Pull != nil && o.Pull.Ref != "" {
+		report.Results = append(report.Results, Pull(ctx, o.Dir, 0, o.Iterations, *o.Pull))
+	}
+	return report, ctx.Err()
+}
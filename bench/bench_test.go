@@ -0,0 +1,122 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/onmetal/onmetal-image/bench"
+	"github.com/onmetal/onmetal-image/client"
+	"github.com/onmetal/onmetal-image/testing/registryharness"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Bench", func() {
+	var (
+		ctx = context.Background()
+		dir string
+	)
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	expectMeasured := func(res bench.Result, iterations int) {
+		GinkgoHelper()
+		Expect(res.Error).To(BeEmpty(), res.Name)
+		Expect(res.Iterations).To(Equal(iterations), res.Name)
+		Expect(res.Size).To(BeNumerically(">", 0), res.Name)
+		Expect(res.NsPerOp).To(BeNumerically(">", 0), res.Name)
+		Expect(res.BytesPerSecond).To(BeNumerically(">", 0), res.Name)
+	}
+
+	It("should run all local measurements for every size and clean up after them", func() {
+		report, err := bench.Run(ctx, bench.Options{Dir: dir, Sizes: []int64{4 << 10, 256 << 10}, Iterations: 2})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(report.CPUs).To(BeNumerically(">", 0))
+		Expect(report.Version.GoVersion).NotTo(BeEmpty())
+		Expect(report.FileSystem).NotTo(BeEmpty())
+
+		var names []string
+		for _, res := range report.Results {
+			expectMeasured(res, 2)
+			names = append(names, res.Name)
+		}
+		Expect(names).To(Equal([]string{
+			"ingest", "read", "read-verified", "extract-layer", "unpack-rootfs",
+			"ingest", "read", "read-verified", "extract-layer", "unpack-rootfs",
+		}))
+		Expect(report.Results[2].Details).To(HaveKey("overhead"))
+
+		By("serializing the report as JSON")
+		data, err := json.Marshal(report)
+		Expect(err).NotTo(HaveOccurred())
+		var decoded bench.Report
+		Expect(json.Unmarshal(data, &decoded)).To(Succeed())
+		Expect(decoded.Results).To(Equal(report.Results))
+
+		By("leaving no stores behind")
+		Expect(os.ReadDir(dir)).To(BeEmpty())
+	})
+
+	It("should report failing measurements without aborting the others", func() {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		res := bench.Ingest(canceled, dir, 4<<10, 2)
+		Expect(res.Error).NotTo(BeEmpty())
+		Expect(res.Iterations).To(BeZero())
+
+		res = bench.Read(ctx, dir, 4<<10, 1)
+		expectMeasured(res, 1)
+	})
+
+	Context("pulling", func() {
+		var (
+			harness *registryharness.Registry
+			config  client.Config
+		)
+
+		BeforeEach(func() {
+			harness = registryharness.New()
+			DeferCleanup(harness.Close)
+
+			configPath := filepath.Join(GinkgoT().TempDir(), "config.json")
+			Expect(os.WriteFile(configPath, []byte("{}"), 0666)).To(Succeed())
+			config = client.Config{DockerConfigPaths: []string{configPath}}
+		})
+
+		It("should pull a synthetic image of the given size", func() {
+			res := bench.Pull(ctx, dir, 64<<10, 2, bench.PullOptions{Config: config, Repository: harness.Host() + "/bench"})
+			expectMeasured(res, 2)
+			Expect(res.Size).To(BeNumerically(">", 64<<10))
+			Expect(res.Details["ref"]).To(HaveSuffix(":bench-65536"))
+		})
+
+		It("should pull a specified image", func() {
+			synthetic := bench.Pull(ctx, dir, 4<<10, 1, bench.PullOptions{Config: config, Repository: harness.Host() + "/bench"})
+			expectMeasured(synthetic, 1)
+
+			res := bench.Pull(ctx, dir, 0, 1, bench.PullOptions{Config: config, Ref: synthetic.Details["ref"]})
+			expectMeasured(res, 1)
+			Expect(res.Size).To(Equal(synthetic.Size))
+		})
+	})
+})
@@ -0,0 +1,334 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/onmetal/onmetal-image/client"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	"github.com/onmetal/onmetal-image/unpack"
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// unpackFileSize is the size of the files of the rootfs unpacked by UnpackRootFS.
+const unpackFileSize = 64 << 10
+
+// timer accumulates the durations of the measured parts of iterations.
+type timer struct {
+	total   time.Duration
+	started time.Time
+}
+
+func (t *timer) start() {
+	t.started = time.Now()
+}
+
+func (t *timer) stop() {
+	t.total += time.Since(t.started)
+}
+
+// measure runs iterations of op, which times its measured part with the timer and returns the number of
+// bytes it processed.
+func measure(ctx context.Context, name string, iterations int, op func(i int, t *timer) (int64, error)) Result {
+	var (
+		res   = Result{Name: name}
+		t     timer
+		total int64
+	)
+	for i := 0; i < iterations; i++ {
+		if err := ctx.Err(); err != nil {
+			res.Error = err.Error()
+			break
+		}
+		n, err := op(i, &t)
+		if err != nil {
+			res.Error = err.Error()
+			break
+		}
+		res.Size = n
+		res.Iterations++
+		total += n
+	}
+	if res.Iterations > 0 {
+		res.NsPerOp = int64(t.total) / int64(res.Iterations)
+	}
+	if t.total > 0 {
+		res.BytesPerSecond = float64(total) / t.total.Seconds()
+	}
+	return res
+}
+
+func failed(name string, size int64, err error) Result {
+	return Result{Name: name, Size: size, Error: err.Error()}
+}
+
+// newLayout creates a layout in a new directory below dir. The returned function removes it.
+func newLayout(dir string) (*layout.Layout, func(), error) {
+	path, err := os.MkdirTemp(dir, "bench-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(path) }
+	l, err := layout.New(path)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return l, cleanup, nil
+}
+
+// storeBlob writes data as blob into the store of the layout.
+func storeBlob(ctx context.Context, l *layout.Layout, data []byte) (ocispec.Descriptor, error) {
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	if err := content.WriteBlob(ctx, l.Store(), "bench-"+desc.Digest.Encoded(), bytes.NewReader(data), desc); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("error storing blob: %w", err)
+	}
+	return desc, nil
+}
+
+// rootFSImage returns a synthetic image with a rootfs layer of the given size.
+func rootFSImage(seed string, size int64) fixtures.Image {
+	return fixtures.Image{Seed: seed, Layers: []fixtures.Layer{{Role: "rootfs", Size: int(size)}}}
+}
+
+// Ingest measures adding images with a rootfs layer of the given size to a new store in dir, including
+// committing the blobs and updating the index.
+func Ingest(ctx context.Context, dir string, size int64, iterations int) Result {
+	const name = "ingest"
+	l, cleanup, err := newLayout(dir)
+	if err != nil {
+		return failed(name, size, err)
+	}
+	defer cleanup()
+
+	return measure(ctx, name, iterations, func(i int, t *timer) (int64, error) {
+		img, err := rootFSImage(fmt.Sprintf("ingest-%d", i), size).Build()
+		if err != nil {
+			return 0, err
+		}
+		t.start()
+		err = l.AddImage(ctx, img)
+		t.stop()
+		return size, err
+	})
+}
+
+// Read measures reading a blob of the given size from a store in dir without verifying its digest. As the
+// blob was just written, it is usually read from the page cache.
+func Read(ctx context.Context, dir string, size int64, iterations int) Result {
+	return read(ctx, "read", dir, size, iterations, func(r io.Reader, desc ocispec.Descriptor) error {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	})
+}
+
+// ReadVerified measures reading a blob like Read while verifying its digest and size, as pulls, pushes and
+// extracts do. Compared to Read, it shows the overhead of verifying on read.
+func ReadVerified(ctx context.Context, dir string, size int64, iterations int) Result {
+	return read(ctx, "read-verified", dir, size, iterations, func(r io.Reader, desc ocispec.Descriptor) error {
+		_, err := ioutils.CopyVerify(ctx, io.Discard, r, desc)
+		return err
+	})
+}
+
+func read(ctx context.Context, name, dir string, size int64, iterations int, consume func(r io.Reader, desc ocispec.Descriptor) error) Result {
+	l, cleanup, err := newLayout(dir)
+	if err != nil {
+		return failed(name, size, err)
+	}
+	defer cleanup()
+	desc, err := storeBlob(ctx, l, fixtures.Content(name, int(size)))
+	if err != nil {
+		return failed(name, size, err)
+	}
+
+	return measure(ctx, name, iterations, func(i int, t *timer) (int64, error) {
+		t.start()
+		defer t.stop()
+		ra, err := l.Store().ReaderAt(ctx, desc)
+		if err != nil {
+			return 0, err
+		}
+		defer func() { _ = ra.Close() }()
+		return size, consume(content.NewReader(ra), desc)
+	})
+}
+
+// ExtractLayer measures writing a stored layer of the given size to a file in dir, verifying it like
+// extract --layer does. The store does not reflink blobs, so this copies the whole layer.
+func ExtractLayer(ctx context.Context, dir string, size int64, iterations int) Result {
+	const name = "extract-layer"
+	l, cleanup, err := newLayout(dir)
+	if err != nil {
+		return failed(name, size, err)
+	}
+	defer cleanup()
+	desc, err := storeBlob(ctx, l, fixtures.Content(name, int(size)))
+	if err != nil {
+		return failed(name, size, err)
+	}
+
+	return measure(ctx, name, iterations, func(i int, t *timer) (int64, error) {
+		output := filepath.Join(l.Path(), fmt.Sprintf("extracted-%d", i))
+		defer func() { _ = os.Remove(output) }()
+
+		t.start()
+		defer t.stop()
+		ra, err := l.Store().ReaderAt(ctx, desc)
+		if err != nil {
+			return 0, err
+		}
+		defer func() { _ = ra.Close() }()
+		f, err := os.Create(output)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := ioutils.CopyVerify(ctx, f, content.NewReader(ra), desc); err != nil {
+			_ = f.Close()
+			return 0, err
+		}
+		return size, f.Close()
+	})
+}
+
+// UnpackRootFS measures unpacking a stored tar rootfs layer of about the given size, made of files of
+// 64 KiB, into a directory in dir.
+func UnpackRootFS(ctx context.Context, dir string, size int64, iterations int) Result {
+	const name = "unpack-rootfs"
+	l, cleanup, err := newLayout(dir)
+	if err != nil {
+		return failed(name, size, err)
+	}
+	defer cleanup()
+
+	files := int(size / unpackFileSize)
+	if files < 1 {
+		files = 1
+	}
+	data, err := fixtures.TarContent(name, int(size), files)
+	if err != nil {
+		return failed(name, size, err)
+	}
+	desc, err := storeBlob(ctx, l, data)
+	if err != nil {
+		return failed(name, size, err)
+	}
+
+	return measure(ctx, name, iterations, func(i int, t *timer) (int64, error) {
+		target := filepath.Join(l.Path(), fmt.Sprintf("rootfs-%d", i))
+		defer func() { _ = os.RemoveAll(target) }()
+		if err := os.Mkdir(target, 0777); err != nil {
+			return 0, err
+		}
+
+		t.start()
+		defer t.stop()
+		ra, err := l.Store().ReaderAt(ctx, desc)
+		if err != nil {
+			return 0, err
+		}
+		defer func() { _ = ra.Close() }()
+		return desc.Size, unpack.Tar(ctx, content.NewReader(ra), target)
+	})
+}
+
+// Pull measures pulling an image into a new store in dir per iteration. If o.Ref is empty, a synthetic
+// image with a rootfs layer of the given size is pushed to o.Repository first, otherwise size is unused.
+// The processed bytes are the sizes of the config and layers of the pulled image.
+func Pull(ctx context.Context, dir string, size int64, iterations int, o PullOptions) Result {
+	const name = "pull"
+	newClient := func() (*client.Client, func(), error) {
+		path, err := os.MkdirTemp(dir, "bench-")
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanup := func() { _ = os.RemoveAll(path) }
+		config := o.Config
+		config.StorePath, config.StoreBlobDir = path, ""
+		c, err := client.New(config)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		return c, cleanup, nil
+	}
+
+	ref := o.Ref
+	if ref == "" {
+		if o.Repository == "" {
+			return failed(name, size, fmt.Errorf("must specify an image or a repository to push to"))
+		}
+		ref = fmt.Sprintf("%s:bench-%d", o.Repository, size)
+		if err := pushSynthetic(ctx, newClient, ref, size); err != nil {
+			return failed(name, size, fmt.Errorf("error pushing synthetic image: %w", err))
+		}
+	}
+
+	res := measure(ctx, name, iterations, func(i int, t *timer) (int64, error) {
+		c, cleanup, err := newClient()
+		if err != nil {
+			return 0, err
+		}
+		defer cleanup()
+
+		t.start()
+		img, err := c.Pull(ctx, ref)
+		t.stop()
+		if err != nil {
+			return 0, err
+		}
+		manifest, err := img.Manifest(ctx)
+		if err != nil {
+			return 0, err
+		}
+		n := manifest.Config.Size
+		for _, layer := range manifest.Layers {
+			n += layer.Size
+		}
+		return n, nil
+	})
+	res.Details = map[string]string{"ref": ref}
+	return res
+}
+
+func pushSynthetic(ctx context.Context, newClient func() (*client.Client, func(), error), ref string, size int64) error {
+	c, cleanup, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	// A new seed per run, so the registry does not already hold the blobs of earlier runs.
+	img, err := rootFSImage(fmt.Sprintf("pull-%d", time.Now().UnixNano()), size).Build()
+	if err != nil {
+		return err
+	}
+	if err := c.Store().Push(ctx, ref, img); err != nil {
+		return err
+	}
+	_, err = c.Push(ctx, ref)
+	return err
+}
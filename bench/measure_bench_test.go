@@ -0,0 +1,60 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/go-units"
+	"github.com/onmetal/onmetal-image/bench"
+)
+
+type measurement func(ctx context.Context, dir string, size int64, iterations int) bench.Result
+
+// benchmark runs the measurement for b.N iterations per default size, reporting the time and throughput of
+// the measured parts only, so that setting up the stores and blobs does not skew them.
+func benchmark(b *testing.B, m measurement) {
+	for _, size := range bench.DefaultSizes {
+		b.Run(units.BytesSize(float64(size)), func(b *testing.B) {
+			res := m(context.Background(), b.TempDir(), size, b.N)
+			if res.Error != "" {
+				b.Fatal(res.Error)
+			}
+			b.ReportMetric(float64(res.NsPerOp), "ns/op")
+			b.ReportMetric(res.BytesPerSecond/1e6, "MB/s")
+		})
+	}
+}
+
+func BenchmarkIngest(b *testing.B) {
+	benchmark(b, bench.Ingest)
+}
+
+func BenchmarkRead(b *testing.B) {
+	benchmark(b, bench.Read)
+}
+
+func BenchmarkReadVerified(b *testing.B) {
+	benchmark(b, bench.ReadVerified)
+}
+
+func BenchmarkExtractLayer(b *testing.B) {
+	benchmark(b, bench.ExtractLayer)
+}
+
+func BenchmarkUnpackRootFS(b *testing.B) {
+	benchmark(b, bench.UnpackRootFS)
+}
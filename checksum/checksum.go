@@ -0,0 +1,180 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package checksum implements checksum manifests for files produced from images, and their verification.
+package checksum
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Version is the version of the checksum manifest format. It is changed on incompatible changes only.
+const Version = "v1"
+
+// Manifest is a checksum manifest listing produced files together with their origin.
+// Its JSON form is stable and meant to be consumed by downstream tools.
+type Manifest struct {
+	// Version is the version of the manifest format, see Version.
+	Version string `json:"version"`
+	// Root is the absolute directory the files were written to when the manifest was created.
+	Root string `json:"root"`
+	// Files are the produced files, sorted by path.
+	Files []File `json:"files"`
+}
+
+// File is a single produced file.
+type File struct {
+	// Path is the slash-separated path of the file relative to the manifest root.
+	Path string `json:"path"`
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+	// SHA256 is the hex-encoded sha256 checksum of the file content.
+	SHA256 string `json:"sha256"`
+	// LayerDigest is the digest of the layer the file was produced from.
+	LayerDigest digest.Digest `json:"layerDigest"`
+	// ImageDigest is the digest of the image manifest the layer belongs to.
+	ImageDigest digest.Digest `json:"imageDigest"`
+}
+
+// Recorder collects files for a Manifest. The last recorded file for a path wins.
+type Recorder struct {
+	root  string
+	files map[string]File
+}
+
+// NewRecorder returns a new Recorder for files written below root.
+func NewRecorder(root string) (*Recorder, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("error making root absolute: %w", err)
+	}
+	return &Recorder{root: root, files: make(map[string]File)}, nil
+}
+
+// Record records a file.
+func (r *Recorder) Record(f File) {
+	r.files[f.Path] = f
+}
+
+// RecordFile hashes the file at the slash-separated path below the recorder root and records it as produced
+// from the given layer and image.
+func (r *Recorder) RecordFile(path string, layerDigest, imageDigest digest.Digest) error {
+	size, dgst, err := hashFile(filepath.Join(r.root, filepath.FromSlash(path)))
+	if err != nil {
+		return fmt.Errorf("error hashing %s: %w", path, err)
+	}
+	r.Record(File{
+		Path:        path,
+		Size:        size,
+		SHA256:      dgst.Encoded(),
+		LayerDigest: layerDigest,
+		ImageDigest: imageDigest,
+	})
+	return nil
+}
+
+// Manifest returns the manifest of all recorded files.
+func (r *Recorder) Manifest() *Manifest {
+	files := make([]File, 0, len(r.files))
+	for _, f := range r.files {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return &Manifest{Version: Version, Root: r.root, Files: files}
+}
+
+// WriteFile writes the manifest as JSON to the given file.
+func WriteFile(filename string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling checksum manifest: %w", err)
+	}
+	if err := os.WriteFile(filename, append(data, '\n'), 0666); err != nil {
+		return fmt.Errorf("error writing checksum manifest: %w", err)
+	}
+	return nil
+}
+
+// ReadFile reads a manifest from the given file.
+func ReadFile(filename string) (*Manifest, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading checksum manifest: %w", err)
+	}
+
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("error decoding checksum manifest: %w", err)
+	}
+	if m.Version != Version {
+		return nil, fmt.Errorf("unsupported checksum manifest version %q", m.Version)
+	}
+	return m, nil
+}
+
+// Mismatch is a file that does not match its manifest entry.
+type Mismatch struct {
+	File
+	// Reason describes the mismatch.
+	Reason string `json:"reason"`
+}
+
+// Verify re-hashes all files of the manifest below root and returns the files not matching their entries.
+// If root is empty, the manifest root is used.
+func Verify(m *Manifest, root string) ([]Mismatch, error) {
+	if root == "" {
+		root = m.Root
+	}
+
+	var mismatches []Mismatch
+	for _, f := range m.Files {
+		size, dgst, err := hashFile(filepath.Join(root, filepath.FromSlash(f.Path)))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			mismatches = append(mismatches, Mismatch{File: f, Reason: "missing"})
+		case err != nil:
+			return nil, fmt.Errorf("error hashing %s: %w", f.Path, err)
+		case size != f.Size:
+			mismatches = append(mismatches, Mismatch{File: f, Reason: fmt.Sprintf("size %d, expected %d", size, f.Size)})
+		case dgst.Encoded() != f.SHA256:
+			mismatches = append(mismatches, Mismatch{File: f, Reason: fmt.Sprintf("sha256 %s, expected %s", dgst.Encoded(), f.SHA256)})
+		}
+	}
+	return mismatches, nil
+}
+
+func hashFile(filename string) (int64, digest.Digest, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	hashed, err := ioutils.CopyVerify(context.Background(), io.Discard, f, ocispec.Descriptor{}, ioutils.WithAlgorithm(digest.SHA256))
+	if err != nil {
+		return 0, "", err
+	}
+	return hashed.Size, hashed.Digest, nil
+}
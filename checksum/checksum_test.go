@@ -0,0 +1,94 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package checksum_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onmetal/onmetal-image/checksum"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+)
+
+var _ = Describe("Checksum", func() {
+	var root string
+
+	BeforeEach(func() {
+		root = GinkgoT().TempDir()
+	})
+
+	record := func(r *Recorder, path, content string) {
+		Expect(os.MkdirAll(filepath.Dir(filepath.Join(root, path)), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(root, path), []byte(content), 0644)).To(Succeed())
+		r.Record(File{
+			Path:        path,
+			Size:        int64(len(content)),
+			SHA256:      digest.FromString(content).Encoded(),
+			LayerDigest: digest.FromString("layer"),
+			ImageDigest: digest.FromString("image"),
+		})
+	}
+
+	It("should round-trip the manifest and report mismatches", func() {
+		r, err := NewRecorder(root)
+		Expect(err).NotTo(HaveOccurred())
+		record(r, "b/modified", "original")
+		record(r, "a/intact", "intact")
+		record(r, "missing", "missing")
+
+		filename := filepath.Join(GinkgoT().TempDir(), "sums.json")
+		Expect(WriteFile(filename, r.Manifest())).To(Succeed())
+
+		m, err := ReadFile(filename)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.Version).To(Equal(Version))
+		Expect(m.Root).To(Equal(root))
+		Expect(m.Files).To(HaveLen(3))
+		Expect(m.Files[0].Path).To(Equal("a/intact"))
+
+		mismatches, err := Verify(m, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mismatches).To(BeEmpty())
+
+		Expect(os.WriteFile(filepath.Join(root, "b/modified"), []byte("modified"), 0644)).To(Succeed())
+		Expect(os.Remove(filepath.Join(root, "missing"))).To(Succeed())
+
+		mismatches, err = Verify(m, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mismatches).To(HaveLen(2))
+		Expect(mismatches[0].Path).To(Equal("b/modified"))
+		Expect(mismatches[1].Path).To(Equal("missing"))
+		Expect(mismatches[1].Reason).To(Equal("missing"))
+	})
+
+	It("should hash and record written files", func() {
+		Expect(os.WriteFile(filepath.Join(root, "disk.qcow2"), []byte("disk"), 0644)).To(Succeed())
+
+		r, err := NewRecorder(root)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.RecordFile("disk.qcow2", digest.FromString("layer"), digest.FromString("image"))).To(Succeed())
+		Expect(r.RecordFile("missing", digest.FromString("layer"), digest.FromString("image"))).To(MatchError(os.ErrNotExist))
+
+		Expect(r.Manifest().Files).To(Equal([]File{{
+			Path:        "disk.qcow2",
+			Size:        4,
+			SHA256:      digest.FromString("disk").Encoded(),
+			LayerDigest: digest.FromString("layer"),
+			ImageDigest: digest.FromString("image"),
+		}}))
+	})
+})
@@ -0,0 +1,418 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client provides Client, the stable API for embedding onmetal-image: It bundles the local
+// store, the remote registry and the helpers operating on them behind the operations controllers need.
+// The onmetal-image CLI is implemented on top of it.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/batch"
+	"github.com/onmetal/onmetal-image/docker"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/local"
+	"github.com/onmetal/onmetal-image/oci/remote"
+	"github.com/onmetal/onmetal-image/oci/store"
+	"github.com/onmetal/onmetal-image/progress"
+	onmetalref "github.com/onmetal/onmetal-image/ref"
+	"github.com/onmetal/onmetal-image/refmap"
+	"github.com/onmetal/onmetal-image/unpack"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/pkg/auth"
+)
+
+// ResolveCacheFileName is the name of the resolve cache file in the store directory.
+const ResolveCacheFileName = "resolve-cache.json"
+
+// Config is the configuration of a Client.
+type Config struct {
+	// StorePath is the directory of the local store. Required.
+	StorePath string
+	// StoreBlobDir is the directory to keep the blobs of the store in instead of StorePath, see
+	// layout.WithBlobDir. Empty means the recorded blob directory, if any.
+	StoreBlobDir string
+	// StoreMaxSize is the maximum size in bytes of all blobs in the store, see layout.WithMaxSize.
+	// Zero means no limit.
+	StoreMaxSize int64
+	// StoreEncryptionKey is the AES key new blobs are encrypted with, see local.WithEncryption.
+	// If nil, new blobs are stored as plaintext.
+	StoreEncryptionKey []byte
+	// StoreNoSync disables syncing committed blobs to disk, see local.WithNoSync.
+	StoreNoSync bool
+	// StoreProtectBlobs protects committed blobs against tampering with fsverity or the immutable
+	// attribute, see local.WithProtection.
+	StoreProtectBlobs bool
+	// StoreAutoMigrate migrates stores of an older format version when opening them, see layout.WithAutoMigrate.
+	StoreAutoMigrate bool
+	// NoUsageTracking disables recording when and how often images are used, see layout.WithoutUsageTracking.
+	NoUsageTracking bool
+	// StoreNoAudit disables the audit log of the store, see layout.WithAuditDisabled.
+	StoreNoAudit bool
+	// StoreGracePeriod is the duration after which images condemned by tag updates are removed when
+	// adding images to the store, see layout.WithCondemnedGracePeriod. Zero disables removing them.
+	StoreGracePeriod time.Duration
+	// CommitHooks decide whether images may be added to the store, see layout.WithCommitHook.
+	CommitHooks []layout.CommitHook
+	// VerifyHooks are called for each blob verified, e.g. when pulling a reference translated by a ref
+	// map, see layout.WithVerifyHook.
+	VerifyHooks []layout.VerifyHook
+
+	// DockerConfigPaths are the docker configuration files registry credentials are read from.
+	// If empty, the default location is used.
+	DockerConfigPaths []string
+	// NoAnonymousFallback disables retrying pulls anonymously if the stored credentials are rejected.
+	NoAnonymousFallback bool
+	// DefaultRegistry is the registry applied to references without a registry. See ref.Parser.
+	DefaultRegistry string
+	// ConnectTimeout bounds establishing connections to a registry and resolving a reference.
+	// Zero means no limit.
+	ConnectTimeout time.Duration
+	// ResolveCacheTTL is the duration the digests tags resolved to are cached for in the store directory.
+	// Zero disables the cache.
+	ResolveCacheTTL time.Duration
+	// Hosts holds per-registry-host limits of concurrent blob transfers and idle connections, see
+	// remote.HostSettings. If nil, nothing is limited.
+	Hosts *remote.HostsConfig
+	// NoExternalBlobs forbids fetching blobs from the external URLs of their descriptors, see
+	// remote.WithNoExternalBlobs.
+	NoExternalBlobs bool
+	// BandwidthLimiter caps the rate of all downloads of the connections of the configuration, see
+	// remote.BandwidthTransport. If nil, downloads are not throttled.
+	BandwidthLimiter *remote.BandwidthLimiter
+	// Limits cap decoding the manifests and indexes of registries, see remote.WithLimits. If nil,
+	// ociimage.DefaultLimits apply.
+	Limits *ociimage.Limits
+	// RefResolvers translate references to images already in the store before pulling them, consulted
+	// in order (see refmap.Chain). A translated reference is pulled without any network access.
+	RefResolvers []refmap.Resolver
+
+	// Logger is the logger of all operations, overriding the one of their context. If unset, the logger
+	// of the context is used.
+	Logger logr.Logger
+	// Progress receives the progress events of all operations, overriding the reporter of their context.
+	// If nil, the reporter of the context is used.
+	Progress progress.Reporter
+}
+
+// Client is the entry point for embedding onmetal-image. It is safe for concurrent use.
+type Client struct {
+	config Config
+	store  *store.Store
+
+	mu              sync.Mutex
+	registry        *remote.Registry
+	requestResolver *docker.RequestResolver
+}
+
+// New returns a new Client for the given configuration, creating the store if it does not exist yet.
+// Connections to registries are only set up by the first operation needing one.
+func New(config Config) (*Client, error) {
+	if config.StorePath == "" {
+		return nil, fmt.Errorf("store path must not be empty")
+	}
+
+	opts := []store.Option{store.WithDefaultRegistry(config.DefaultRegistry)}
+	if config.StoreMaxSize > 0 {
+		opts = append(opts, store.WithLayoutOptions(layout.WithMaxSize(config.StoreMaxSize)))
+	}
+	if config.StoreBlobDir != "" {
+		opts = append(opts, store.WithLayoutOptions(layout.WithBlobDir(config.StoreBlobDir)))
+	}
+	if config.StoreEncryptionKey != nil {
+		opts = append(opts, store.WithLayoutOptions(layout.WithStoreOptions(local.WithEncryption(config.StoreEncryptionKey))))
+	}
+	if config.StoreNoSync {
+		opts = append(opts, store.WithLayoutOptions(layout.WithStoreOptions(local.WithNoSync())))
+	}
+	if config.StoreProtectBlobs {
+		opts = append(opts, store.WithLayoutOptions(layout.WithStoreOptions(local.WithProtection())))
+	}
+	if config.StoreAutoMigrate {
+		opts = append(opts, store.WithLayoutOptions(layout.WithAutoMigrate()))
+	}
+	if config.NoUsageTracking {
+		opts = append(opts, store.WithLayoutOptions(layout.WithoutUsageTracking()))
+	}
+	if config.StoreNoAudit {
+		opts = append(opts, store.WithLayoutOptions(layout.WithAuditDisabled()))
+	}
+	if config.StoreGracePeriod > 0 {
+		opts = append(opts, store.WithLayoutOptions(layout.WithCondemnedGracePeriod(config.StoreGracePeriod)))
+	}
+	for _, hook := range config.CommitHooks {
+		opts = append(opts, store.WithLayoutOptions(layout.WithCommitHook(hook)))
+	}
+	for _, hook := range config.VerifyHooks {
+		opts = append(opts, store.WithLayoutOptions(layout.WithVerifyHook(hook)))
+	}
+	s, err := store.New(config.StorePath, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating store: %w", err)
+	}
+	return &Client{config: config, store: s}, nil
+}
+
+// Config returns the configuration of the client.
+func (c *Client) Config() Config {
+	return c.config
+}
+
+// Store returns the local store of the client, for operations not covered by the client.
+func (c *Client) Store() *store.Store {
+	return c.store
+}
+
+// NewHTTPClient returns the http.Client for registry access and other downloads, e.g. self-updates, for
+// the configuration. It honors the proxy environment variables, establishing connections (dial and
+// TLS handshake) is bounded by ConnectTimeout, the idle connections per host are limited as
+// configured in Hosts and downloads are throttled by the BandwidthLimiter.
+func NewHTTPClient(config Config) *http.Client {
+	if config.ConnectTimeout <= 0 && config.Hosts == nil && config.BandwidthLimiter == nil {
+		return http.DefaultClient
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.ConnectTimeout > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   config.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		transport.TLSHandshakeTimeout = config.ConnectTimeout
+	}
+	return &http.Client{Transport: remote.BandwidthTransport(remote.HostsTransport(transport, config.Hosts), config.BandwidthLimiter)}
+}
+
+// NewRegistry returns a new remote registry for the registry settings of the configuration. It does not
+// need a store, the resolve cache is only persisted if StorePath is set.
+func NewRegistry(config Config) (*remote.Registry, error) {
+	opts := []remote.Option{remote.WithHostsConfig(config.Hosts)}
+	if config.Limits != nil {
+		opts = append(opts, remote.WithLimits(*config.Limits))
+	}
+	if config.NoExternalBlobs {
+		opts = append(opts, remote.WithNoExternalBlobs())
+	}
+	if config.ResolveCacheTTL > 0 {
+		opts = append(opts, remote.WithResolveCache(config.ResolveCacheTTL))
+		if config.StorePath != "" {
+			opts = append(opts, remote.WithResolveCachePath(filepath.Join(config.StorePath, ResolveCacheFileName)))
+		}
+	}
+
+	registry, err := remote.NewDockerRegistry(remote.DockerRegistryOptions{
+		ConfigPaths:         config.DockerConfigPaths,
+		ResolverOptions:     []auth.ResolverOption{auth.WithResolverClient(NewHTTPClient(config))},
+		NoAnonymousFallback: config.NoAnonymousFallback,
+		DefaultRegistry:     config.DefaultRegistry,
+		ConnectTimeout:      config.ConnectTimeout,
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating remote registry: %w", err)
+	}
+	return registry, nil
+}
+
+// NewRequestResolver returns a new resolver for direct registry API requests (listing tags, deleting
+// manifests) for the registry settings of the configuration.
+func NewRequestResolver(config Config) (*docker.RequestResolver, error) {
+	resolver, err := docker.NewRequestResolver(docker.RequestResolverOptions{
+		ConfigPaths:     config.DockerConfigPaths,
+		Client:          NewHTTPClient(config),
+		DefaultRegistry: config.DefaultRegistry,
+		ConnectTimeout:  config.ConnectTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating request resolver: %w", err)
+	}
+	return resolver, nil
+}
+
+// Registry returns the remote registry of the client, for operations not covered by the client.
+func (c *Client) Registry() (*remote.Registry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.registry == nil {
+		registry, err := NewRegistry(c.config)
+		if err != nil {
+			return nil, err
+		}
+		c.registry = registry
+	}
+	return c.registry, nil
+}
+
+// RequestResolver returns the request resolver of the client, for operations not covered by the client.
+func (c *Client) RequestResolver() (*docker.RequestResolver, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.requestResolver == nil {
+		resolver, err := NewRequestResolver(c.config)
+		if err != nil {
+			return nil, err
+		}
+		c.requestResolver = resolver
+	}
+	return c.requestResolver, nil
+}
+
+// context returns the context with the logger and progress reporter of the configuration, if set.
+func (c *Client) context(ctx context.Context) context.Context {
+	if c.config.Logger.GetSink() != nil {
+		ctx = logr.NewContext(ctx, c.config.Logger)
+	}
+	if c.config.Progress != nil {
+		ctx = progress.NewContext(ctx, c.config.Progress)
+	}
+	return ctx
+}
+
+var hexPrefixRegexp = regexp.MustCompile(`^[a-f0-9]+$`)
+
+// FuzzyResolveRef resolves an (abbreviated) image id of the store to its digest. Other refs are returned
+// as-is if they are valid references.
+func FuzzyResolveRef(ctx context.Context, s *store.Store, ref string) (string, error) {
+	if hexPrefixRegexp.MatchString(ref) {
+		if dsc, err := s.Layout().Indexer().Find(ctx, descriptormatcher.EncodedDigestPrefix(ref)); err == nil {
+			return dsc.Digest.String(), nil
+		}
+	}
+
+	if _, err := onmetalref.ParseAny(ref); err != nil {
+		return "", fmt.Errorf("ref %s is neither a valid reference nor a known image id: %w", ref, err)
+	}
+	return ref, nil
+}
+
+// ResolveRef resolves an (abbreviated) image id of the store to its digest, see FuzzyResolveRef.
+func (c *Client) ResolveRef(ctx context.Context, ref string) (string, error) {
+	return FuzzyResolveRef(c.context(ctx), c.store, ref)
+}
+
+// Resolve resolves the given reference or (abbreviated) image id to an image of the store.
+func (c *Client) Resolve(ctx context.Context, ref string) (ociimage.Image, error) {
+	ctx = c.context(ctx)
+	resolved, err := c.ResolveRef(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	img, err := c.store.Resolve(ctx, resolved)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %s: %w", ref, err)
+	}
+	return img, nil
+}
+
+// List returns the index entries of all images of the store matching the matcher, most recently added
+// first. Pass descriptormatcher.Every to list all images, and indexer.WithLimit to limit the number.
+func (c *Client) List(ctx context.Context, match descriptormatcher.Matcher, opts ...indexer.ListOption) ([]ocispec.Descriptor, error) {
+	ctx = c.context(ctx)
+	descs, err := c.store.Layout().Indexer().List(ctx,
+		descriptormatcher.And(descriptormatcher.MediaTypes(ocispec.MediaTypeImageManifest), match),
+		opts...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error listing images: %w", err)
+	}
+	return descs, nil
+}
+
+// Delete deletes the given references or (abbreviated) image ids from the store. Failing to delete
+// one does not prevent deleting the others, the returned results correspond to refs.
+func (c *Client) Delete(ctx context.Context, refs ...string) []batch.Result {
+	ctx = c.context(ctx)
+	results := make([]batch.Result, len(refs))
+	for i, ref := range refs {
+		results[i] = c.delete(ctx, ref)
+	}
+	return results
+}
+
+func (c *Client) delete(ctx context.Context, ref string) batch.Result {
+	result := batch.Result{Name: ref}
+
+	resolved, err := c.ResolveRef(ctx, ref)
+	if err != nil {
+		result.Err = fmt.Errorf("error resolving source: %w", err)
+		return result
+	}
+
+	desc, err := c.store.Descriptor(ctx, resolved)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Digest = desc.Digest
+
+	if err := c.store.Delete(ctx, resolved); err != nil {
+		result.Err = fmt.Errorf("error deleting ref %s: %w", resolved, err)
+	}
+	return result
+}
+
+// ErrNotTar is returned by Extract if the rootfs layer of the image is no tar archive, e.g. a disk image.
+var ErrNotTar = unpack.ErrNotTar
+
+// Extract unpacks the tar rootfs layer of the image of the store with the given reference or
+// (abbreviated) image id onto the directory. It fails with an *ociimage.IncompleteImageError if blobs of
+// the image are missing. The image is leased while it is extracted, so pruning or eviction does not remove
+// it meanwhile, see layout.Layout.Lease.
+func (c *Client) Extract(ctx context.Context, ref, dir string, opts ...unpack.Option) error {
+	ctx = c.context(ctx)
+	ociImg, err := c.Resolve(ctx, ref)
+	if err != nil {
+		return err
+	}
+	if err := ociimage.CheckComplete(ctx, ociImg); err != nil {
+		return err
+	}
+	lease, err := c.store.Layout().Lease(ctx, ociImg.Descriptor(), layout.DefaultLeaseTTL)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = lease.Release() }()
+
+	img, err := onmetalimage.ResolveImage(ctx, ociImg)
+	if err != nil {
+		return fmt.Errorf("error resolving onmetal image: %w", err)
+	}
+	if img.RootFS == nil {
+		return fmt.Errorf("%s has no rootfs layer", ref)
+	}
+	for _, warning := range img.Warnings {
+		logr.FromContextOrDiscard(ctx).Info("Ambiguous image", "Ref", ref, "Warning", warning)
+	}
+
+	if err := unpack.Layer(ctx, img.RootFS, dir, opts...); err != nil {
+		if errors.Is(err, unpack.ErrNotTar) {
+			return fmt.Errorf("rootfs layer of %s is not a tar archive: %w", ref, err)
+		}
+		return fmt.Errorf("error unpacking rootfs: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,818 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/docker/docker/api/types"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/batch"
+	. "github.com/onmetal/onmetal-image/client"
+	"github.com/onmetal/onmetal-image/delta"
+	"github.com/onmetal/onmetal-image/mediatypes"
+	"github.com/onmetal/onmetal-image/oci/daemon"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/remote"
+	"github.com/onmetal/onmetal-image/progress"
+	onmetalref "github.com/onmetal/onmetal-image/ref"
+	"github.com/onmetal/onmetal-image/refmap"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	"github.com/onmetal/onmetal-image/testing/registryharness"
+	"github.com/onmetal/onmetal-image/unpack"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+)
+
+// firmwareLayerMediaType is a custom layer media type registered the way embedders would.
+const firmwareLayerMediaType = "application/vnd.example.firmware.v1"
+
+func init() {
+	mediatypes.MustRegister(mediatypes.MediaTypeInfo{
+		MediaType:   firmwareLayerMediaType,
+		Role:        "firmware",
+		Description: "firmware bundle",
+	})
+}
+
+type fakeDockerClient struct {
+	archive []byte
+}
+
+func (c *fakeDockerClient) ImageInspectWithRaw(_ context.Context, _ string) (types.ImageInspect, []byte, error) {
+	return types.ImageInspect{Os: "linux"}, nil, nil
+}
+
+func (c *fakeDockerClient) ImageSave(_ context.Context, _ []string) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(c.archive)), nil
+}
+
+var _ = Describe("Client", func() {
+	var (
+		ctx        = context.Background()
+		harness    *registryharness.Registry
+		configPath string
+	)
+
+	BeforeEach(func() {
+		harness = registryharness.New()
+		DeferCleanup(harness.Close)
+
+		configPath = filepath.Join(GinkgoT().TempDir(), "config.json")
+		Expect(os.WriteFile(configPath, []byte("{}"), 0666)).To(Succeed())
+	})
+
+	newClient := func(modify ...func(config *Config)) *Client {
+		config := Config{
+			StorePath:         GinkgoT().TempDir(),
+			DockerConfigPaths: []string{configPath},
+		}
+		for _, m := range modify {
+			m(&config)
+		}
+		c, err := New(config)
+		Expect(err).NotTo(HaveOccurred())
+		return c
+	}
+
+	newImage := func(addLayers ...func(b *imageutil.Builder)) ociimage.Image {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		Expect(tw.WriteHeader(&tar.Header{Name: "hello", Mode: 0644, Size: 5, Typeflag: tar.TypeReg})).To(Succeed())
+		_, err := tw.Write([]byte("hello"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tw.Close()).To(Succeed())
+
+		b := imageutil.NewJSONConfigBuilder(&onmetalimage.Config{}, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).
+			BytesLayer([]byte("kernel"), imageutil.WithMediaType(onmetalimage.KernelLayerMediaType)).
+			BytesLayer([]byte("initramfs"), imageutil.WithMediaType(onmetalimage.InitRAMFSLayerMediaType)).
+			BytesLayer(buf.Bytes(), imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType))
+		for _, add := range addLayers {
+			add(b)
+		}
+		img, err := b.Complete()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	It("should push, pull, list, extract and delete an image", func() {
+		var (
+			ref = harness.Reference("repo", "latest")
+			img = newImage()
+			src = newClient()
+		)
+		Expect(src.Store().Push(ctx, ref, img)).To(Succeed())
+
+		By("pushing the image")
+		res, err := src.Push(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Digest).To(Equal(img.Descriptor().Digest))
+		Expect(res.UpToDate).To(BeFalse())
+
+		By("pulling it into another store")
+		var (
+			mu     sync.Mutex
+			events []progress.EventType
+		)
+		dst := newClient(func(config *Config) {
+			config.Progress = progress.ReporterFunc(func(event progress.Event) {
+				mu.Lock()
+				defer mu.Unlock()
+				events = append(events, event.Type())
+			})
+		})
+		pulled, err := dst.Pull(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pulled.Descriptor().Digest).To(Equal(img.Descriptor().Digest))
+		Expect(len(events)).To(BeNumerically(">", 2))
+		Expect(events[0]).To(Equal(progress.EventTypeOperationStarted))
+		Expect(events[len(events)-1]).To(Equal(progress.EventTypeSummary))
+
+		By("listing it")
+		descs, err := dst.List(ctx, descriptormatcher.Every)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(descs).NotTo(BeEmpty())
+		for _, desc := range descs {
+			Expect(desc.Digest).To(Equal(img.Descriptor().Digest))
+			Expect(desc.Annotations).To(HaveKey(indexer.PulledAtAnnotation))
+		}
+
+		By("resolving it by its abbreviated id")
+		resolved, err := dst.Resolve(ctx, img.Descriptor().Digest.Encoded()[:12])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resolved.Descriptor().Digest).To(Equal(img.Descriptor().Digest))
+
+		By("extracting its rootfs")
+		dir := GinkgoT().TempDir()
+		Expect(dst.Extract(ctx, ref, dir)).To(Succeed())
+		Expect(os.ReadFile(filepath.Join(dir, "hello"))).To(Equal([]byte("hello")))
+
+		By("deleting it")
+		results := dst.Delete(ctx, ref, "unknown:latest")
+		Expect(results).To(HaveLen(2))
+		Expect(results[0].Err).NotTo(HaveOccurred())
+		Expect(results[0].Digest).To(Equal(img.Descriptor().Digest))
+		Expect(results[1].Err).To(HaveOccurred())
+		_, err = dst.Resolve(ctx, ref)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should push, pull and extract an image with a layer of a custom media type", func() {
+		var (
+			ref = harness.Reference("repo", "firmware")
+			src = newClient()
+			img = newImage(func(b *imageutil.Builder) {
+				b.BytesLayer([]byte("firmware"), imageutil.WithMediaType(firmwareLayerMediaType))
+			})
+		)
+		Expect(src.Store().Push(ctx, ref, img)).To(Succeed())
+		_, err := src.Push(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+
+		dst := newClient()
+		pulled, err := dst.Pull(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("resolving the custom layer by its role")
+		resolved, err := onmetalimage.ResolveImage(ctx, pulled)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resolved.LayersByRole("firmware")).To(HaveLen(1))
+		layer, err := onmetalimage.LayerByRole(ctx, pulled, "firmware")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imageutil.ReadLayerContent(ctx, layer)).To(Equal([]byte("firmware")))
+
+		By("extracting the rootfs next to it")
+		dir := GinkgoT().TempDir()
+		Expect(dst.Extract(ctx, ref, dir)).To(Succeed())
+		Expect(os.ReadFile(filepath.Join(dir, "hello"))).To(Equal([]byte("hello")))
+	})
+
+	It("should annotate the pushed image", func() {
+		var (
+			ref = harness.Reference("repo", "latest")
+			img = newImage()
+			c   = newClient()
+		)
+		Expect(c.Store().Push(ctx, ref, img)).To(Succeed())
+
+		res, err := c.Push(ctx, ref, WithAnnotations(map[string]string{"foo": "bar"}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Digest).NotTo(Equal(img.Descriptor().Digest))
+		Expect(res.LocalDigest).To(Equal(res.Digest))
+
+		By("storing the annotated image under the local reference")
+		local, err := c.Store().Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(local.Descriptor().Digest).To(Equal(res.Digest))
+		localManifest, err := local.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(localManifest.Annotations).To(HaveKeyWithValue("foo", "bar"))
+
+		pulled, err := newClient().Pull(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		manifest, err := pulled.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest.Annotations).To(HaveKeyWithValue("foo", "bar"))
+	})
+
+	It("should push the image to the destination", func() {
+		var (
+			ref = harness.Reference("repo", "latest")
+			dst = harness.Reference("mirror", "v1")
+			img = newImage()
+			c   = newClient()
+		)
+		Expect(c.Store().Push(ctx, ref, img)).To(Succeed())
+
+		res, err := c.Push(ctx, ref, WithDestination(dst))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Digest).To(Equal(img.Descriptor().Digest))
+
+		desc, ok := harness.Manifest("mirror", "v1")
+		Expect(ok).To(BeTrue())
+		Expect(desc.Digest).To(Equal(img.Descriptor().Digest))
+		_, ok = harness.Manifest("repo", "latest")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should record the transfer statistics of pushes and pulls per registry host", func() {
+		var (
+			ref = harness.Reference("repo", "latest")
+			img = newImage()
+			c   = newClient()
+		)
+		Expect(c.Store().Push(ctx, ref, img)).To(Succeed())
+		manifest, err := img.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		blobs := 2 + len(manifest.Layers)
+
+		res, err := c.Push(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Stats.Host).To(Equal(harness.Host()))
+		Expect(res.Stats.BlobsUploaded).To(Equal(blobs))
+		Expect(res.Stats.BytesUploaded).To(BeNumerically(">", 0))
+
+		var stats layout.TransferStats
+		_, err = c.Pull(ctx, ref, WithTransferStats(&stats))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stats.BlobsDownloaded).To(BeZero())
+		Expect(stats.CacheHits).To(BeNumerically(">", 0))
+
+		report, err := c.Store().Layout().TransferStats(ctx, time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Hosts).To(HaveLen(1))
+		Expect(report.Hosts[0].Operations).To(Equal(2))
+		Expect(report.Hosts[0].BytesUploaded).To(Equal(res.Stats.BytesUploaded))
+		Expect(report.Total.CacheHits).To(Equal(stats.CacheHits))
+
+		By("limiting them to a period and resetting them")
+		report, err = c.Store().Layout().TransferStats(ctx, time.Now().Add(48*time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Hosts).To(BeEmpty())
+		Expect(c.Store().Layout().ResetTransferStats(ctx)).To(Succeed())
+		report, err = c.Store().Layout().TransferStats(ctx, time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Hosts).To(BeEmpty())
+	})
+
+	It("should suggest similar local repositories for references not found on the registry", func() {
+		var (
+			ref = harness.Reference("onmetal/gardenlinux", "v1")
+			c   = newClient()
+		)
+		Expect(c.Store().Push(ctx, ref, newImage())).To(Succeed())
+
+		_, err := c.Pull(ctx, harness.Reference("onmetal/gardenlinx", "v1"))
+		var notFound *NotFoundError
+		Expect(errors.As(err, &notFound)).To(BeTrue())
+		Expect(errdefs.IsNotFound(err)).To(BeTrue())
+		Expect(notFound.Suggestions).To(Equal([]string{ref}))
+		Expect(err).To(MatchError(ContainSubstring("did you mean " + ref)))
+
+		harness.ResetStats()
+		_, err = c.Pull(ctx, harness.Host()+"/invalid//ref")
+		Expect(err).To(MatchError(ContainSubstring("invalid reference")))
+		Expect(harness.Stats().Requests).To(BeZero())
+	})
+
+	It("should refuse pushes exceeding the project quota or the maximum push size", func() {
+		var (
+			ref = harness.Reference("project/app", "v1")
+			img = newImage()
+			c   = newClient()
+		)
+		Expect(c.Store().Push(ctx, ref, img)).To(Succeed())
+
+		By("pushing to a project with too little quota left")
+		harness.SetQuota("project", 1000, 990)
+		_, err := c.Push(ctx, ref)
+		Expect(err).To(MatchError(ErrQuotaExceeded))
+		Expect(err).To(MatchError(ContainSubstring("has 10 of 1000 bytes available")))
+		Expect(harness.Stats().Uploaded).To(BeEmpty())
+
+		By("pushing to a project without quota but exceeding the maximum push size")
+		dst := harness.Reference("other/app", "v1")
+		_, err = c.Push(ctx, ref, WithDestination(dst), WithMaxPushSize(10))
+		Expect(err).To(MatchError(ErrQuotaExceeded))
+		Expect(harness.Stats().Uploaded).To(BeEmpty())
+
+		By("skipping the preflight")
+		_, err = c.Push(ctx, ref, WithoutPreflight())
+		Expect(err).NotTo(HaveOccurred())
+		_, ok := harness.Manifest("project/app", "v1")
+		Expect(ok).To(BeTrue())
+	})
+
+	It("should report stale, up to date and missing tags", func() {
+		var (
+			img = newImage()
+			c   = newClient()
+		)
+		Expect(harness.Seed(ctx, "repo", "stale", img)).To(Succeed())
+		Expect(harness.Seed(ctx, "repo", "current", img)).To(Succeed())
+		for _, tag := range []string{"stale", "current", "gone"} {
+			Expect(c.Store().Push(ctx, harness.Reference("repo", tag), img)).To(Succeed())
+		}
+		Expect(c.Store().Push(ctx, harness.Reference("repo", img.Descriptor().Digest.String()), img)).To(Succeed())
+
+		updated, err := imageutil.WithManifestAnnotations(ctx, img, map[string]string{"foo": "bar"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(harness.Seed(ctx, "repo", "stale", updated)).To(Succeed())
+
+		results, err := c.Outdated(ctx, 2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(3))
+		Expect(results[0]).To(Equal(OutdatedResult{
+			Reference: harness.Reference("repo", "current"),
+			Local:     img.Descriptor().Digest,
+			Remote:    img.Descriptor().Digest,
+			Status:    OutdatedStatusUpToDate,
+		}))
+		Expect(results[1]).To(Equal(OutdatedResult{
+			Reference: harness.Reference("repo", "gone"),
+			Local:     img.Descriptor().Digest,
+			Status:    OutdatedStatusMissing,
+		}))
+		Expect(results[2]).To(Equal(OutdatedResult{
+			Reference: harness.Reference("repo", "stale"),
+			Local:     img.Descriptor().Digest,
+			Remote:    updated.Descriptor().Digest,
+			Status:    OutdatedStatusStale,
+		}))
+		Expect(harness.Stats().BlobFetches).To(BeEmpty())
+	})
+
+	It("should report the partial progress of a cancelled pull and resume it", func() {
+		rootFS := fixtures.Content("rootfs", 4*progress.ReportInterval)
+		img, err := fixtures.Image{Layers: []fixtures.Layer{
+			{Role: "kernel", Content: []byte("kernel")},
+			{Role: "rootfs", Content: rootFS},
+		}}.Build()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(harness.Seed(ctx, "repo", "latest", img)).To(Succeed())
+		ref := harness.Reference("repo", "latest")
+		rootFSDigest := digest.FromBytes(rootFS)
+
+		By("cancelling the pull once the rootfs is partially downloaded")
+		pullCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		var (
+			mu     sync.Mutex
+			events []progress.Event
+		)
+		storePath := GinkgoT().TempDir()
+		c := newClient(func(config *Config) {
+			config.StorePath = storePath
+			config.Progress = progress.ReporterFunc(func(event progress.Event) {
+				mu.Lock()
+				defer mu.Unlock()
+				events = append(events, event)
+				if p, ok := event.(progress.BlobProgress); ok && p.Digest == rootFSDigest {
+					cancel()
+				}
+			})
+		})
+		_, err = c.Pull(pullCtx, ref)
+		Expect(err).To(MatchError(context.Canceled))
+		var transferErr *TransferError
+		Expect(errors.As(err, &transferErr)).To(BeTrue())
+		Expect(transferErr.Operation).To(Equal("pull"))
+		Expect(transferErr.Progress.Resumable).To(ConsistOf(HaveField("Expected", rootFSDigest)))
+		Expect(transferErr.Progress.Blobs).To(ContainElement(And(
+			HaveField("Digest", rootFSDigest),
+			HaveField("Done", false),
+			HaveField("Offset", BeNumerically(">=", progress.ReportInterval)),
+		)))
+		completed := make(map[digest.Digest]bool)
+		for _, blob := range transferErr.Progress.Blobs {
+			if blob.Done && !blob.Skipped {
+				completed[blob.Digest] = true
+			}
+		}
+
+		By("retrying the pull")
+		harness.ResetStats()
+		mu.Lock()
+		events = nil
+		mu.Unlock()
+		pulled, err := c.Pull(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pulled.Descriptor().Digest).To(Equal(img.Descriptor().Digest))
+		for _, fetched := range harness.Stats().BlobFetches {
+			Expect(completed).NotTo(HaveKey(fetched))
+		}
+		Expect(harness.Stats().RangeRequests).To(Equal(1))
+		Expect(events).To(ContainElement(And(
+			BeAssignableToTypeOf(progress.BlobResumed{}),
+			HaveField("Offset", BeNumerically(">=", progress.ReportInterval)),
+		)))
+	})
+
+	It("should reject invalid annotations unless normalizing them", func() {
+		var (
+			ref = harness.Reference("repo", "latest")
+			img = newImage()
+			c   = newClient()
+		)
+		Expect(c.Store().Push(ctx, ref, img)).To(Succeed())
+
+		annotations := map[string]string{"Com.Example.Key": "value", "org.opencontainers.image.created": "now"}
+		_, err := c.Push(ctx, ref, WithAnnotations(annotations))
+		Expect(err).To(MatchError(ContainSubstring(`manifest "Com.Example.Key": key contains uppercase characters; manifest "org.opencontainers.image.created"`)))
+		Expect(harness.Stats().Requests).To(BeZero())
+		desc, err := c.Store().Descriptor(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(desc.Digest).To(Equal(img.Descriptor().Digest))
+
+		delete(annotations, "org.opencontainers.image.created")
+		res, err := c.Push(ctx, ref, WithAnnotations(annotations), WithNormalizedAnnotations())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.AnnotationChanges).To(Equal([]imageutil.AnnotationChange{
+			{Scope: "manifest", Key: "Com.Example.Key", NormalizedKey: "com.example.key"},
+		}))
+	})
+
+	It("should only pull the metadata", func() {
+		var (
+			ref = harness.Reference("repo", "latest")
+			img = newImage()
+			src = newClient()
+		)
+		Expect(src.Store().Push(ctx, ref, img)).To(Succeed())
+		_, err := src.Push(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+
+		dst := newClient()
+		_, err = dst.Pull(ctx, ref, WithMetadataOnly())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dst.Extract(ctx, ref, GinkgoT().TempDir())).NotTo(Succeed())
+	})
+
+	It("should stream the rootfs to a file and only store the metadata", func() {
+		var (
+			ref = harness.Reference("repo", "latest")
+			img = newImage()
+		)
+		Expect(harness.Seed(ctx, "repo", "latest", img)).To(Succeed())
+
+		c := newClient()
+		var buf bytes.Buffer
+		res, err := c.StreamLayer(ctx, ref, remote.RoleSelector("rootfs"), &buf)
+		Expect(err).NotTo(HaveOccurred())
+		rootFS, err := onmetalimage.LayerByRole(ctx, img, "rootfs")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imageutil.ReadLayerContent(ctx, rootFS)).To(Equal(buf.Bytes()))
+		Expect(res.Written).To(BeEquivalentTo(buf.Len()))
+
+		stored, err := c.Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stored.Descriptor().Digest).To(Equal(img.Descriptor().Digest))
+		Expect(layout.IsPartial(stored.Descriptor())).To(BeTrue())
+		Expect(c.Store().Layout().Store().Info(ctx, rootFS.Descriptor().Digest)).Error().To(HaveOccurred())
+	})
+
+	It("should reject unsupported image types unless accepting them as opaque artifacts", func() {
+		const helmConfigMediaType = "application/vnd.cncf.helm.config.v1+json"
+		chart, err := imageutil.NewBytesConfigBuilder([]byte(`{"name":"chart"}`), imageutil.WithMediaType(helmConfigMediaType)).
+			BytesLayer([]byte("chart"), imageutil.WithMediaType("application/vnd.cncf.helm.chart.content.v1.tar+gzip")).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(harness.Seed(ctx, "repo", "chart", chart)).To(Succeed())
+		artifact, err := imageutil.NewArtifactBuilder("application/vnd.onmetal.example").
+			BytesLayer([]byte("data")).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(harness.Seed(ctx, "repo", "artifact", artifact)).To(Succeed())
+
+		c := newClient()
+		_, err = c.Pull(ctx, harness.Reference("repo", "chart"))
+		Expect(err).To(MatchError(ErrUnsupportedImageType))
+		Expect(err).To(MatchError(ContainSubstring(helmConfigMediaType)))
+		Expect(harness.Stats().BlobFetches).To(BeEmpty())
+
+		By("accepting the chart as opaque artifact")
+		_, err = c.Pull(ctx, harness.Reference("repo", "chart"), WithAcceptArtifacts())
+		Expect(err).NotTo(HaveOccurred())
+		img, err := c.Resolve(ctx, harness.Reference("repo", "chart"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(img.Descriptor().ArtifactType).To(Equal(helmConfigMediaType))
+
+		By("pulling onmetal artifacts as before")
+		_, err = c.Pull(ctx, harness.Reference("repo", "artifact"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should estimate the bytes a pull transfers without storing anything", func() {
+		payload := make([]byte, 1<<20)
+		_, err := rand.New(rand.NewSource(1)).Read(payload)
+		Expect(err).NotTo(HaveOccurred())
+		var (
+			ref = harness.Reference("repo", "latest")
+			img = newImage(func(b *imageutil.Builder) {
+				b.BytesLayer(payload, imageutil.WithMediaType(firmwareLayerMediaType))
+			})
+			src = newClient()
+		)
+		Expect(src.Store().Push(ctx, ref, img)).To(Succeed())
+		_, err = src.Push(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+
+		manifest, err := img.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		layersSize := int64(0)
+		for _, desc := range manifest.Layers {
+			layersSize += desc.Size
+		}
+
+		By("estimating the pull into an empty store")
+		dst := newClient()
+		estimate, err := dst.EstimatePull(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(estimate.Digest).To(Equal(img.Descriptor().Digest))
+		Expect(estimate.Blobs).To(Equal(6))
+		Expect(estimate.MissingBlobs).To(Equal(6))
+		Expect(estimate.Bytes).To(Equal(layersSize + manifest.Config.Size + img.Descriptor().Size))
+		Expect(estimate.Probe).To(BeNil())
+		Expect(estimate.ETA).To(BeZero())
+		_, err = dst.Resolve(ctx, ref)
+		Expect(err).To(HaveOccurred())
+
+		By("only counting the blobs missing after pulling the metadata")
+		_, err = dst.Pull(ctx, ref, WithMetadataOnly())
+		Expect(err).NotTo(HaveOccurred())
+		estimate, err = dst.EstimatePull(ctx, ref, WithProbe(256<<10))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(estimate.MissingBlobs).To(Equal(4))
+		Expect(estimate.Bytes).To(Equal(layersSize))
+
+		By("probing the throughput with the largest missing blob")
+		Expect(estimate.Probe).NotTo(BeNil())
+		Expect(estimate.Probe.Digest).To(Equal(manifest.Layers[3].Digest))
+		Expect(estimate.Probe.Bytes).To(BeEquivalentTo(256 << 10))
+		Expect(estimate.Probe.BytesPerSecond).To(BeNumerically(">", 0))
+		Expect(estimate.ETA).To(BeNumerically(">", 0))
+	})
+
+	Describe("delta pulls", func() {
+		var (
+			oldRootFS, newRootFS []byte
+			oldImg, newImg       ociimage.Image
+		)
+
+		newRootFSImage := func(rootFS []byte) ociimage.Image {
+			img, err := fixtures.Image{Layers: []fixtures.Layer{
+				{Role: "kernel", Content: []byte("kernel")},
+				{Role: "rootfs", Content: rootFS},
+			}}.Build()
+			Expect(err).NotTo(HaveOccurred())
+			return img
+		}
+
+		rootFSDigest := func(img ociimage.Image) digest.Digest {
+			rootFS, err := delta.RootFS(ctx, img)
+			Expect(err).NotTo(HaveOccurred())
+			return rootFS.Descriptor().Digest
+		}
+
+		seedDelta := func(tag string, from, to ociimage.Image) {
+			artifact, _, err := delta.Build(ctx, newClient().Store().Layout().Store(), from, to)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(harness.Seed(ctx, "repo", tag, artifact)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			oldRootFS = make([]byte, 1<<20)
+			_, _ = rand.New(rand.NewSource(1)).Read(oldRootFS)
+			newRootFS = append(append(append([]byte{}, oldRootFS[:1<<19]...), "update"...), oldRootFS[1<<19:]...)
+			oldImg, newImg = newRootFSImage(oldRootFS), newRootFSImage(newRootFS)
+
+			Expect(harness.Seed(ctx, "repo", "v1", oldImg)).To(Succeed())
+			Expect(harness.Seed(ctx, "repo", "v2", newImg)).To(Succeed())
+		})
+
+		It("should reconstruct the rootfs from the delta and the old rootfs", func() {
+			seedDelta("v2-delta", oldImg, newImg)
+			c := newClient()
+			_, err := c.Pull(ctx, harness.Reference("repo", "v1"))
+			Expect(err).NotTo(HaveOccurred())
+			harness.ResetStats()
+
+			pulled, err := c.Pull(ctx, harness.Reference("repo", "v2"), WithDelta(harness.Reference("repo", "v2-delta")))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pulled.Descriptor().Digest).To(Equal(newImg.Descriptor().Digest))
+			Expect(harness.Stats().BlobFetches).NotTo(ContainElement(rootFSDigest(newImg)))
+
+			img, err := c.Resolve(ctx, harness.Reference("repo", "v2"))
+			Expect(err).NotTo(HaveOccurred())
+			rootFS, err := delta.RootFS(ctx, img)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(imageutil.ReadLayerContent(ctx, rootFS)).To(Equal(newRootFS))
+		})
+
+		It("should pull the full image if the old rootfs is missing", func() {
+			seedDelta("v2-delta", oldImg, newImg)
+			c := newClient()
+
+			_, err := c.Pull(ctx, harness.Reference("repo", "v2"), WithDelta(harness.Reference("repo", "v2-delta")))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(harness.Stats().BlobFetches).To(ContainElement(rootFSDigest(newImg)))
+		})
+
+		It("should pull the full image if the reconstructed rootfs does not verify", func() {
+			By("seeding a delta claiming to result in the new rootfs but resulting in another one")
+			otherImg := newRootFSImage(append(append([]byte{}, newRootFS...), "other"...))
+			artifact, _, err := delta.Build(ctx, newClient().Store().Layout().Store(), oldImg, otherImg)
+			Expect(err).NotTo(HaveOccurred())
+			parsed, err := delta.Parse(ctx, artifact)
+			Expect(err).NotTo(HaveOccurred())
+			forged, err := imageutil.NewArtifactBuilder(delta.ArtifactType).
+				Layers(parsed.Layer).
+				Annotations(map[string]string{
+					delta.SourceAnnotation:      parsed.Source.String(),
+					delta.TargetAnnotation:      rootFSDigest(newImg).String(),
+					delta.TargetImageAnnotation: newImg.Descriptor().Digest.String(),
+				}).
+				Complete()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(harness.Seed(ctx, "repo", "v2-delta", forged)).To(Succeed())
+
+			c := newClient()
+			_, err = c.Pull(ctx, harness.Reference("repo", "v1"))
+			Expect(err).NotTo(HaveOccurred())
+			harness.ResetStats()
+
+			_, err = c.Pull(ctx, harness.Reference("repo", "v2"), WithDelta(harness.Reference("repo", "v2-delta")))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(harness.Stats().BlobFetches).To(ContainElements(parsed.Layer.Descriptor().Digest, rootFSDigest(newImg)))
+
+			img, err := c.Resolve(ctx, harness.Reference("repo", "v2"))
+			Expect(err).NotTo(HaveOccurred())
+			rootFS, err := delta.RootFS(ctx, img)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(imageutil.ReadLayerContent(ctx, rootFS)).To(Equal(newRootFS))
+		})
+	})
+
+	It("should import an image from the docker daemon and record its source", func() {
+		var (
+			config = []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`)
+			layer  = []byte("layer")
+			buf    bytes.Buffer
+			tw     = tar.NewWriter(&buf)
+		)
+		for _, file := range []struct {
+			name string
+			data []byte
+		}{
+			{"layer/layer.tar", layer},
+			{"config.json", config},
+			{"manifest.json", []byte(`[{"Config":"config.json","RepoTags":["myimage:tag"],"Layers":["layer/layer.tar"]}]`)},
+		} {
+			Expect(tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.data)), Typeflag: tar.TypeReg})).To(Succeed())
+			_, err := tw.Write(file.data)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(tw.Close()).To(Succeed())
+
+		c := newClient()
+		img, err := c.Import(ctx, "docker-daemon:myimage:tag", "", WithDockerClient(&fakeDockerClient{archive: buf.Bytes()}))
+		Expect(err).NotTo(HaveOccurred())
+
+		descs, err := c.List(ctx, descriptormatcher.Name("docker.io/library/myimage:tag"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(descs).To(HaveLen(1))
+		Expect(descs[0].Digest).To(Equal(img.Descriptor().Digest))
+		Expect(descs[0].Annotations).To(HaveKeyWithValue(daemon.ImportedFromAnnotation, "docker-daemon:myimage:tag"))
+		Expect(descs[0].Annotations).To(HaveKeyWithValue(daemon.ImportedDigestAnnotation, digest.FromBytes(config).String()))
+
+		stored, err := c.Resolve(ctx, "myimage:tag")
+		Expect(err).NotTo(HaveOccurred())
+		layers, err := stored.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layers).To(HaveLen(1))
+		Expect(layers[0].Descriptor().Digest).To(Equal(digest.FromBytes(layer)))
+	})
+
+	It("should not prune an image while it is extracted", func() {
+		c := newClient()
+		img, err := imageutil.WithManifestAnnotations(ctx, newImage(), map[string]string{
+			imageutil.ExpiresAtAnnotation: time.Now().Add(-time.Hour).Format(time.RFC3339),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Store().Push(ctx, "expired:latest", img)).To(Succeed())
+
+		var pruned []batch.Result
+		dir := GinkgoT().TempDir()
+		Expect(c.Extract(ctx, "expired:latest", dir, unpack.WithOnFile(func(unpack.File) {
+			pruned, err = c.Store().Layout().PruneExpired(ctx, time.Now())
+			Expect(err).NotTo(HaveOccurred())
+		}))).To(Succeed())
+		Expect(pruned).To(BeEmpty())
+		Expect(os.ReadFile(filepath.Join(dir, "hello"))).To(Equal([]byte("hello")))
+
+		By("pruning it after the extraction")
+		pruned, err = c.Store().Layout().PruneExpired(ctx, time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pruned).To(HaveLen(1))
+		Expect(pruned[0].Digest).To(Equal(img.Descriptor().Digest))
+	})
+
+	It("should pull a reference translated by a ref map from the local store without network access", func() {
+		var (
+			ref = harness.Reference("repo", "v1")
+			img = newImage()
+		)
+		refs, err := refmap.Parse([]byte(ref+": "+img.Descriptor().Digest.String()+"\n"), "refs.yaml", onmetalref.Parser{})
+		Expect(err).NotTo(HaveOccurred())
+		c := newClient(func(config *Config) {
+			config.RefResolvers = []refmap.Resolver{refs}
+		})
+		Expect(c.Store().Push(ctx, "mirrored/repo:v1", img)).To(Succeed())
+
+		pulled, err := c.Pull(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pulled.Descriptor().Digest).To(Equal(img.Descriptor().Digest))
+		Expect(harness.Stats().Requests).To(BeZero())
+
+		desc, err := c.Store().Descriptor(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(desc.Digest).To(Equal(img.Descriptor().Digest))
+		Expect(desc.Annotations).To(HaveKeyWithValue(refmap.ResolvedFromAnnotation, "refs.yaml"))
+
+		By("failing if the local content does not match its digest")
+		manifest, err := img.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		rootfs := manifest.Layers[len(manifest.Layers)-1].Digest
+		blobPath := filepath.Join(c.Store().Layout().Path(), "blobs", rootfs.Algorithm().String(), rootfs.Encoded())
+		Expect(os.Chmod(blobPath, 0644)).To(Succeed())
+		Expect(os.WriteFile(blobPath, []byte("corrupt"), 0644)).To(Succeed())
+		_, err = c.Pull(ctx, ref)
+		Expect(err).To(MatchError(ContainSubstring("does not match its digest")))
+		Expect(harness.Stats().Requests).To(BeZero())
+	})
+
+	It("should fail pulling a translated reference whose image is not in the local store", func() {
+		ref := harness.Reference("repo", "v1")
+		refs, err := refmap.Parse([]byte(ref+": "+newImage().Descriptor().Digest.String()+"\n"), "refs.yaml", onmetalref.Parser{})
+		Expect(err).NotTo(HaveOccurred())
+		c := newClient(func(config *Config) {
+			config.RefResolvers = []refmap.Resolver{refs}
+		})
+
+		_, err = c.Pull(ctx, ref)
+		Expect(err).To(MatchError(ContainSubstring("not in the local store")))
+		Expect(harness.Stats().Requests).To(BeZero())
+	})
+
+	It("should fail creating a client without store path", func() {
+		_, err := New(Config{})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,213 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/refmap"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// DefaultProbeSize is the number of bytes WithProbe samples by default.
+	DefaultProbeSize = 8 << 20
+	// DefaultProbeTimeout bounds the duration of the sample download of WithProbe.
+	DefaultProbeTimeout = 10 * time.Second
+)
+
+// PullEstimate is the estimated cost of pulling an image into the store of a client, see Client.EstimatePull.
+type PullEstimate struct {
+	// Ref is the estimated reference.
+	Ref string `json:"ref"`
+	// Digest is the digest of the manifest the reference resolves to.
+	Digest digest.Digest `json:"digest"`
+	// Blobs is the number of blobs a pull writes, including the manifest and config.
+	Blobs int `json:"blobs"`
+	// MissingBlobs is the number of those blobs not yet in the store.
+	MissingBlobs int `json:"missingBlobs"`
+	// Bytes is the total compressed size of the missing blobs with known size.
+	Bytes int64 `json:"bytes"`
+	// UnknownSizeBlobs is the number of missing blobs whose size is not known in advance and thus not
+	// part of Bytes, see WithAllowUnknownSize.
+	UnknownSizeBlobs int `json:"unknownSizeBlobs,omitempty"`
+	// Probe is the result of the sample download, if requested with WithProbe and anything is missing.
+	Probe *ProbeResult `json:"probe,omitempty"`
+	// ETA is the estimated duration of transferring Bytes at the probed throughput. It is zero if
+	// nothing is missing or the throughput is unknown.
+	ETA time.Duration `json:"eta,omitempty"`
+}
+
+// ProbeResult is the outcome of sampling the throughput to the registry.
+type ProbeResult struct {
+	// Digest is the blob that was sampled.
+	Digest digest.Digest `json:"digest"`
+	// Bytes is the number of bytes received.
+	Bytes int64 `json:"bytes"`
+	// Duration is the time it took to receive them, excluding the time until the transfer started.
+	Duration time.Duration `json:"duration"`
+	// BytesPerSecond is the measured throughput.
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+}
+
+// EstimateOptions are options for estimating a pull.
+type EstimateOptions struct {
+	// ProbeSize is the number of bytes to sample the throughput with. If zero, no sample is downloaded.
+	ProbeSize int64
+	// ProbeTimeout bounds the sample download. If zero, DefaultProbeTimeout is used.
+	ProbeTimeout time.Duration
+	// PullOptions are the options of the pull to estimate. Only the ones affecting which blobs are
+	// written are considered, e.g. WithMetadataOnly, WithAllowUnknownSize and WithDecryptionKeys.
+	PullOptions []PullOption
+}
+
+// EstimateOption is an option for estimating a pull.
+type EstimateOption func(o *EstimateOptions)
+
+// WithProbe measures the throughput to the registry by downloading the first size bytes of the
+// largest missing blob, yielding an ETA. If size is 0, DefaultProbeSize is used.
+func WithProbe(size int64) EstimateOption {
+	return func(o *EstimateOptions) {
+		if size <= 0 {
+			size = DefaultProbeSize
+		}
+		o.ProbeSize = size
+	}
+}
+
+// WithProbeTimeout bounds the sample download of WithProbe.
+func WithProbeTimeout(timeout time.Duration) EstimateOption {
+	return func(o *EstimateOptions) {
+		o.ProbeTimeout = timeout
+	}
+}
+
+// WithEstimatedPullOptions estimates the pull with the given options.
+func WithEstimatedPullOptions(opts ...PullOption) EstimateOption {
+	return func(o *EstimateOptions) {
+		o.PullOptions = append(o.PullOptions, opts...)
+	}
+}
+
+// EstimatePull resolves ref and reports which of the blobs a pull writes are missing from the store and
+// their total size, without storing anything. With WithProbe, it additionally samples the throughput
+// to the registry to estimate the duration of the transfer. References translated by the ref resolvers
+// of the client are pulled from the local store and thus cost nothing.
+func (c *Client) EstimatePull(ctx context.Context, ref string, opts ...EstimateOption) (*PullEstimate, error) {
+	o := &EstimateOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	po := &PullOptions{}
+	for _, opt := range o.PullOptions {
+		opt(po)
+	}
+
+	ctx = c.context(ctx)
+
+	res, ok, err := refmap.Chain(c.config.RefResolvers).Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("error translating ref %s: %w", ref, err)
+	}
+	if ok {
+		return &PullEstimate{Ref: ref, Digest: res.Digest}, nil
+	}
+
+	img, err := c.resolveRemote(ctx, ref, po)
+	if err != nil {
+		return nil, err
+	}
+
+	layers, err := ociimage.AsWriteLayers(ctx, img)
+	if err != nil {
+		return nil, fmt.Errorf("error getting image layers: %w", err)
+	}
+
+	estimate := &PullEstimate{Ref: ref, Digest: img.Descriptor().Digest, Blobs: len(layers)}
+	var largest ociimage.Layer
+	for _, layer := range layers {
+		desc := layer.Descriptor()
+		if _, err := c.store.Layout().Store().Info(ctx, desc.Digest); err == nil {
+			continue
+		}
+		estimate.MissingBlobs++
+		if !imageutil.HasKnownSize(desc) {
+			estimate.UnknownSizeBlobs++
+			continue
+		}
+		estimate.Bytes += desc.Size
+		if largest == nil || desc.Size > largest.Descriptor().Size {
+			largest = layer
+		}
+	}
+
+	if o.ProbeSize > 0 && largest != nil {
+		timeout := o.ProbeTimeout
+		if timeout == 0 {
+			timeout = DefaultProbeTimeout
+		}
+		probe, err := probeThroughput(ctx, largest, o.ProbeSize, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("error probing throughput with blob %s: %w", largest.Descriptor().Digest, err)
+		}
+		estimate.Probe = probe
+		if probe.BytesPerSecond > 0 {
+			estimate.ETA = time.Duration(float64(estimate.Bytes) / probe.BytesPerSecond * float64(time.Second))
+		}
+	}
+	return estimate, nil
+}
+
+// probeThroughput downloads up to size bytes of the layer within the timeout and measures the
+// throughput of the transfer. The transfer is aborted afterwards.
+func probeThroughput(ctx context.Context, layer ociimage.Layer, size int64, timeout time.Duration) (*ProbeResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	rc, err := layer.Content(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rc.Close() }()
+
+	// Only time the transfer itself, not waiting for a transfer slot or the registry to respond.
+	buf := make([]byte, 32*1024)
+	if int64(len(buf)) > size {
+		buf = buf[:size]
+	}
+	n, err := rc.Read(buf)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	start := time.Now()
+	rest, err := io.CopyBuffer(io.Discard, io.LimitReader(rc, size-int64(n)), buf)
+	// Running out of time still yields a valid sample.
+	if err != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, err
+	}
+	elapsed := time.Since(start)
+
+	res := &ProbeResult{Digest: layer.Descriptor().Digest, Bytes: int64(n) + rest, Duration: elapsed}
+	if rest > 0 && elapsed > 0 {
+		res.BytesPerSecond = float64(rest) / elapsed.Seconds()
+	}
+	return res, nil
+}
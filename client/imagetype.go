@@ -0,0 +1,137 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/images"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/store"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// SupportedArtifactTypePrefix is the prefix of the artifact types Pull accepts, e.g. of artifacts pushed with
+// push-artifact or delta artifacts.
+const SupportedArtifactTypePrefix = "application/vnd.onmetal."
+
+var (
+	// SupportedManifestMediaTypes are the manifest media types Pull accepts.
+	SupportedManifestMediaTypes = []string{ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest}
+	// SupportedConfigMediaTypes are the config media types of the images Pull accepts.
+	SupportedConfigMediaTypes = []string{onmetalimage.ConfigMediaType, ocispec.MediaTypeImageConfig, images.MediaTypeDockerSchema2Config}
+)
+
+// ErrUnsupportedImageType is matched by UnsupportedImageTypeError.
+var ErrUnsupportedImageType = errors.New("unsupported image type")
+
+// UnsupportedImageTypeError is returned by Pull if a reference resolves to something other than an image or
+// an onmetal artifact, e.g. a Helm chart, an image index or a foreign OCI artifact. Unless the manifest media
+// type is unsupported, WithAcceptArtifacts stores it as an opaque artifact instead.
+type UnsupportedImageTypeError struct {
+	Ref string
+	// MediaType is the media type of the manifest.
+	MediaType string
+	// ArtifactType is the artifact type of the manifest, if any.
+	ArtifactType string
+	// ConfigMediaType is the media type of the config of the manifest, empty if the manifest media type is
+	// not supported.
+	ConfigMediaType string
+	// Supported are the supported types of the kind that did not match.
+	Supported []string
+}
+
+func (e *UnsupportedImageTypeError) Error() string {
+	var found string
+	switch {
+	case e.ConfigMediaType == "":
+		found = "media type " + e.MediaType
+	case e.ArtifactType != "":
+		found = "artifact type " + e.ArtifactType
+	default:
+		found = "config media type " + e.ConfigMediaType
+	}
+	return fmt.Sprintf("%s: %s has %s, supported are %s", ErrUnsupportedImageType, e.Ref, found, strings.Join(e.Supported, ", "))
+}
+
+func (e *UnsupportedImageTypeError) Is(target error) bool {
+	return target == ErrUnsupportedImageType
+}
+
+// opaque reports whether the error may be resolved by storing the manifest as an opaque artifact.
+func (e *UnsupportedImageTypeError) opaque() bool {
+	return e.ConfigMediaType != ""
+}
+
+// checkImageType fails with an *UnsupportedImageTypeError if the image is neither an image nor an onmetal
+// artifact. Only the manifest is read.
+func checkImageType(ctx context.Context, ref string, img ociimage.Image) error {
+	mediaType := img.Descriptor().MediaType
+	if !contains(SupportedManifestMediaTypes, mediaType) {
+		return &UnsupportedImageTypeError{Ref: ref, MediaType: mediaType, Supported: SupportedManifestMediaTypes}
+	}
+
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading manifest of %s: %w", ref, err)
+	}
+	if manifest.ArtifactType != "" {
+		if strings.HasPrefix(manifest.ArtifactType, SupportedArtifactTypePrefix) {
+			return nil
+		}
+	} else if contains(SupportedConfigMediaTypes, manifest.Config.MediaType) {
+		return nil
+	}
+	return &UnsupportedImageTypeError{
+		Ref:             ref,
+		MediaType:       mediaType,
+		ArtifactType:    manifest.ArtifactType,
+		ConfigMediaType: manifest.Config.MediaType,
+		Supported:       append(append([]string{}, SupportedConfigMediaTypes...), SupportedArtifactTypePrefix+"*"),
+	}
+}
+
+// recordOpaqueArtifact sets the artifact type of the index entries of an image stored as opaque artifact
+// without artifact type to its config media type, as the OCI image spec suggests, so it is listed as such.
+func recordOpaqueArtifact(ctx context.Context, s *store.Store, img ociimage.Image) error {
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading manifest: %w", err)
+	}
+	if manifest.ArtifactType != "" {
+		return nil
+	}
+	if err := s.Layout().Indexer().Update(ctx, descriptormatcher.Digests(img.Descriptor().Digest), func(desc ocispec.Descriptor) ocispec.Descriptor {
+		desc.ArtifactType = manifest.Config.MediaType
+		return desc
+	}); err != nil {
+		return fmt.Errorf("error recording artifact type: %w", err)
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	dockerclient "github.com/docker/docker/client"
+	"github.com/onmetal/onmetal-image/oci/daemon"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/opencontainers/go-digest"
+)
+
+// DefaultContainerdAddress is the address of the containerd socket images are imported from by default.
+const DefaultContainerdAddress = "/run/containerd/containerd.sock"
+
+// ImportOptions are options for importing an image from a container engine of the host.
+type ImportOptions struct {
+	// ContainerdAddress is the address of the containerd socket. Defaults to DefaultContainerdAddress.
+	ContainerdAddress string
+	// DockerClient is the client of the docker daemon. If nil, a client is created from the environment
+	// (DOCKER_HOST and friends).
+	DockerClient daemon.DockerClient
+}
+
+// ImportOption is an option for importing an image.
+type ImportOption func(o *ImportOptions)
+
+// WithContainerdAddress imports containerd images via the socket at the given address.
+func WithContainerdAddress(address string) ImportOption {
+	return func(o *ImportOptions) {
+		o.ContainerdAddress = address
+	}
+}
+
+// WithDockerClient imports docker daemon images via the given client.
+func WithDockerClient(client daemon.DockerClient) ImportOption {
+	return func(o *ImportOptions) {
+		o.DockerClient = client
+	}
+}
+
+// Import imports the image of the source (see daemon.ParseSource) into the store and tags it with ref, or
+// with the name of the source image if ref is empty. The index entry records the source and the digest of
+// the image there, see daemon.ImportedFromAnnotation.
+func (c *Client) Import(ctx context.Context, source, ref string, opts ...ImportOption) (img ociimage.Image, retErr error) {
+	o := &ImportOptions{ContainerdAddress: DefaultContainerdAddress}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	src, err := daemon.ParseSource(source)
+	if err != nil {
+		return nil, err
+	}
+	if ref == "" {
+		ref = src.Name
+	}
+
+	ctx, done := progress.StartOperation(c.context(ctx), "import", ref)
+	var dgst digest.Digest
+	defer func() { done(dgst, retErr) }()
+
+	err = c.withSourceImage(ctx, src, o, func(ctx context.Context, srcImg ociimage.Image, sourceDigest digest.Digest) error {
+		if err := c.store.Push(ctx, ref, srcImg); err != nil {
+			return fmt.Errorf("error storing %s: %w", ref, err)
+		}
+		if err := c.store.Annotate(ctx, ref, map[string]string{
+			daemon.ImportedFromAnnotation:   src.String(),
+			daemon.ImportedDigestAnnotation: sourceDigest.String(),
+		}, nil); err != nil {
+			return fmt.Errorf("error recording import source: %w", err)
+		}
+		img = srcImg
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error importing %s: %w", src, err)
+	}
+	dgst = img.Descriptor().Digest
+	return img, nil
+}
+
+// withSourceImage calls fn with the image of the source while the connection to its container engine is
+// open. The context passed to fn carries the containerd namespace of the source, if any.
+func (c *Client) withSourceImage(
+	ctx context.Context,
+	src daemon.Source,
+	o *ImportOptions,
+	fn func(ctx context.Context, img ociimage.Image, sourceDigest digest.Digest) error,
+) error {
+	switch src.Type {
+	case daemon.SourceDockerDaemon:
+		client := o.DockerClient
+		if client == nil {
+			dc, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
+			if err != nil {
+				return fmt.Errorf("error creating docker client: %w", err)
+			}
+			defer func() { _ = dc.Close() }()
+			client = dc
+		}
+		img, sourceDigest, err := daemon.DockerImage(ctx, client, src.Name, c.store.Layout().Store())
+		if err != nil {
+			return err
+		}
+		return fn(ctx, img, sourceDigest)
+	case daemon.SourceContainerd:
+		cc, err := containerd.New(o.ContainerdAddress)
+		if err != nil {
+			return fmt.Errorf("error connecting to containerd at %s: %w", o.ContainerdAddress, err)
+		}
+		defer func() { _ = cc.Close() }()
+		ctx = namespaces.WithNamespace(ctx, src.Namespace)
+		img, sourceDigest, err := daemon.ContainerdImage(ctx, cc.ImageService(), cc.ContentStore(), src.Name, platforms.Default())
+		if err != nil {
+			return err
+		}
+		return fn(ctx, img, sourceDigest)
+	default:
+		return fmt.Errorf("unknown import source type %q", src.Type)
+	}
+}
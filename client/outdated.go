@@ -0,0 +1,142 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/distribution/reference"
+	"github.com/onmetal/onmetal-image/batch"
+	"github.com/onmetal/onmetal-image/docker"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	"github.com/onmetal/onmetal-image/oci/store"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// OutdatedStatus describes how a local image relates to what its tag currently points to remotely.
+type OutdatedStatus string
+
+const (
+	// OutdatedStatusUpToDate means the tag still points to the local image.
+	OutdatedStatusUpToDate OutdatedStatus = "up-to-date"
+	// OutdatedStatusStale means the tag points to another image by now.
+	OutdatedStatusStale OutdatedStatus = "stale"
+	// OutdatedStatusMissing means the tag does not exist remotely anymore.
+	OutdatedStatusMissing OutdatedStatus = "missing"
+	// OutdatedStatusError means the tag could not be resolved, see OutdatedResult.Err.
+	OutdatedStatusError OutdatedStatus = "error"
+)
+
+// OutdatedResult is the result of checking a tagged local image against its registry.
+type OutdatedResult struct {
+	// Reference is the tagged reference of the local image.
+	Reference string
+	// Local is the digest of the local image.
+	Local digest.Digest
+	// Remote is the digest the tag currently points to remotely, if it could be resolved.
+	Remote digest.Digest
+	Status OutdatedStatus
+	// Err is the error resolving the tag if Status is OutdatedStatusError.
+	Err error
+}
+
+// Outdated checks the tagged images of the store against their registries, see CheckOutdated.
+func (c *Client) Outdated(ctx context.Context, concurrency int) ([]OutdatedResult, error) {
+	resolver, err := c.RequestResolver()
+	if err != nil {
+		return nil, err
+	}
+	return CheckOutdated(c.context(ctx), c.store, resolver, concurrency)
+}
+
+// CheckOutdated re-resolves the tag of every tagged image of the store at its registry, bypassing any
+// resolve cache, and reports whether the local image is stale, up to date or its tag no longer exists.
+// The tags are resolved with manifest HEAD requests only. They are grouped by registry, with at most
+// concurrency requests per registry at a time, and all requests share the resolver and its tokens.
+// The results are ordered by reference.
+func CheckOutdated(ctx context.Context, s *store.Store, resolver *docker.RequestResolver, concurrency int) ([]OutdatedResult, error) {
+	descs, err := s.Layout().Indexer().List(ctx, descriptormatcher.HasAnnotation(ocispec.AnnotationRefName))
+	if err != nil {
+		return nil, fmt.Errorf("error listing images: %w", err)
+	}
+
+	var (
+		results  []OutdatedResult
+		registry = make(map[string][]int)
+		parser   = s.Parser()
+	)
+	for _, desc := range descs {
+		named, err := parser.ParseNamed(desc.Annotations[ocispec.AnnotationRefName])
+		if err != nil {
+			continue
+		}
+		// Digests cannot drift, only tags are checked.
+		if _, ok := named.(reference.Digested); ok {
+			continue
+		}
+		if _, ok := named.(reference.Tagged); !ok {
+			continue
+		}
+		results = append(results, OutdatedResult{Reference: named.String(), Local: desc.Digest})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Reference < results[j].Reference })
+	for i, result := range results {
+		named, _ := parser.ParseNamed(result.Reference)
+		domain := reference.Domain(named)
+		registry[domain] = append(registry[domain], i)
+	}
+
+	var wg sync.WaitGroup
+	for _, indices := range registry {
+		wg.Add(1)
+		go func(indices []int) {
+			defer wg.Done()
+			names := make([]string, len(indices))
+			for i, idx := range indices {
+				names[i] = results[idx].Reference
+			}
+			batch.Run(ctx, names, concurrency, false, func(ctx context.Context, i int) batch.Result {
+				result := &results[indices[i]]
+				remote, err := resolver.ResolveDigest(ctx, result.Reference)
+				switch {
+				case errdefs.IsNotFound(err):
+					result.Status = OutdatedStatusMissing
+				case err != nil:
+					result.Status = OutdatedStatusError
+					result.Err = err
+				case remote == result.Local:
+					result.Remote, result.Status = remote, OutdatedStatusUpToDate
+				default:
+					result.Remote, result.Status = remote, OutdatedStatusStale
+				}
+				return batch.Result{}
+			})
+		}(indices)
+	}
+	wg.Wait()
+
+	for i := range results {
+		// Items batch.Run did not start because ctx is done.
+		if results[i].Status == "" {
+			results[i].Status, results[i].Err = OutdatedStatusError, ctx.Err()
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,483 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/docker/go-units"
+	"github.com/go-logr/logr"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/delta"
+	"github.com/onmetal/onmetal-image/doctor"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/oci/layercrypt"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/processor"
+	"github.com/onmetal/onmetal-image/oci/store"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/onmetal/onmetal-image/refmap"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PullOptions are options for pulling an image.
+type PullOptions struct {
+	// MetadataOnly only pulls the manifest and config, marking the image partial until its layers are pulled.
+	MetadataOnly bool
+	// AllowUnknownSize allows pulling legacy images whose manifest has no size information for some blobs.
+	AllowUnknownSize bool
+	// AcceptArtifacts stores manifests of unsupported types as opaque artifacts instead of failing with an
+	// *UnsupportedImageTypeError.
+	AcceptArtifacts bool
+	// DecryptionKeys are the keys encrypted layers are decrypted with.
+	DecryptionKeys []*rsa.PrivateKey
+	// Processors are additionally run on the matching layers while pulling them.
+	Processors []processor.LayerProcessor
+	// NoPreflightSpaceCheck disables checking for sufficient free disk space before downloading.
+	NoPreflightSpaceCheck bool
+	// LayerPriority orders the transfer of the blobs, see layout.PrioritizeLayers. If nil,
+	// onmetalimage.LayerPriority is used.
+	LayerPriority layout.LayerPriority
+	// DeltaRef is the reference of a delta artifact (see delta.Build) to reconstruct the rootfs with.
+	DeltaRef string
+	// Stats receives the transfer statistics of the pull if not nil.
+	Stats *layout.TransferStats
+}
+
+// PullOption is an option for pulling an image.
+type PullOption func(o *PullOptions)
+
+// WithMetadataOnly only pulls the manifest and config of the image. See layout.MetadataOnly.
+func WithMetadataOnly() PullOption {
+	return func(o *PullOptions) {
+		o.MetadataOnly = true
+	}
+}
+
+// WithAllowUnknownSize allows pulling legacy images whose manifest has no size information for some
+// blobs. Their digests are still verified.
+func WithAllowUnknownSize() PullOption {
+	return func(o *PullOptions) {
+		o.AllowUnknownSize = true
+	}
+}
+
+// WithAcceptArtifacts stores manifests of unsupported types, e.g. Helm charts, as opaque artifacts instead of
+// failing with an *UnsupportedImageTypeError. Their config and layers are stored verbatim and the index
+// entries record the config media type as artifact type if the manifest has none.
+func WithAcceptArtifacts() PullOption {
+	return func(o *PullOptions) {
+		o.AcceptArtifacts = true
+	}
+}
+
+// WithDecryptionKeys decrypts the encrypted layers of the image with the given keys while pulling.
+func WithDecryptionKeys(keys ...*rsa.PrivateKey) PullOption {
+	return func(o *PullOptions) {
+		o.DecryptionKeys = append(o.DecryptionKeys, keys...)
+	}
+}
+
+// WithLayerProcessors runs the processors on the matching layers while pulling. See store.WithLayerProcessors.
+func WithLayerProcessors(processors ...processor.LayerProcessor) PullOption {
+	return func(o *PullOptions) {
+		o.Processors = append(o.Processors, processors...)
+	}
+}
+
+// WithoutPreflightSpaceCheck disables checking for sufficient free disk space before downloading.
+func WithoutPreflightSpaceCheck() PullOption {
+	return func(o *PullOptions) {
+		o.NoPreflightSpaceCheck = true
+	}
+}
+
+// WithLayerPriority transfers the blobs in the order of the given priority instead of ranking the config,
+// kernel and initramfs above the rootfs (see onmetalimage.LayerPriority).
+func WithLayerPriority(priority layout.LayerPriority) PullOption {
+	return func(o *PullOptions) {
+		o.LayerPriority = priority
+	}
+}
+
+// WithDelta reconstructs the rootfs of the image from the delta artifact with the given reference and
+// the rootfs it applies to, if that is in the store, instead of downloading it. If the source rootfs is
+// missing, the delta does not result in the rootfs of the image or the reconstructed rootfs fails
+// verification, the full image is pulled instead.
+func WithDelta(ref string) PullOption {
+	return func(o *PullOptions) {
+		o.DeltaRef = ref
+	}
+}
+
+// WithTransferStats stores the transfer statistics of the pull, as recorded in the store, in stats.
+// Failed pulls carry them in TransferError.Stats, too.
+func WithTransferStats(stats *layout.TransferStats) PullOption {
+	return func(o *PullOptions) {
+		o.Stats = stats
+	}
+}
+
+// layerPriority returns the configured layer priority or the default.
+func (o *PullOptions) layerPriority() layout.LayerPriority {
+	if o.LayerPriority != nil {
+		return o.LayerPriority
+	}
+	return onmetalimage.LayerPriority
+}
+
+// InsufficientSpaceError is returned if a store does not have enough free space for an image, either
+// detected before downloading or by running out of space while writing.
+type InsufficientSpaceError struct {
+	// Path is the path of the store.
+	Path string
+	// Needed is the number of bytes that are missing.
+	Needed int64
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	msg := fmt.Sprintf("not enough space in store %s: %s more needed", e.Path, units.BytesSize(float64(e.Needed)))
+	if free, err := doctor.FreeBytes(e.Path); err == nil {
+		msg += fmt.Sprintf(", %s free", units.BytesSize(float64(free)))
+	}
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+func (e *InsufficientSpaceError) Unwrap() error {
+	return e.Err
+}
+
+// Pull pulls the image with the given reference from its registry into the store and returns it.
+// If one of the RefResolvers of the configuration translates the reference, the image it translates to
+// is tagged instead, see pullResolved. Errors are returned as *TransferError carrying what was transferred.
+// The transfer statistics of the pull are recorded in the store, see layout.Layout.RecordTransfer.
+func (c *Client) Pull(ctx context.Context, ref string, opts ...PullOption) (img ociimage.Image, retErr error) {
+	o := &PullOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	ctx, done := progress.StartOperation(c.context(ctx), "pull", ref)
+	var dgst digest.Digest
+	defer func() {
+		done(dgst, retErr)
+		stats := c.transferStats(ctx, "pull", ref)
+		c.recordTransfer(ctx, stats)
+		if o.Stats != nil {
+			*o.Stats = stats
+		}
+		if retErr != nil {
+			retErr = c.transferError(ctx, "pull", ref, retErr)
+		}
+	}()
+
+	res, ok, err := refmap.Chain(c.config.RefResolvers).Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("error translating ref %s: %w", ref, err)
+	}
+	if ok {
+		dgst = res.Digest
+		return c.pullResolved(ctx, ref, res)
+	}
+
+	img, err = c.resolveRemote(ctx, ref, o)
+	if err != nil {
+		return nil, err
+	}
+	dgst = img.Descriptor().Digest
+
+	if !o.NoPreflightSpaceCheck {
+		if err := CheckSpace(ctx, c.store, img); err != nil {
+			return nil, err
+		}
+	}
+
+	pulled := false
+	if o.DeltaRef != "" {
+		log := logr.FromContextOrDiscard(ctx)
+		if err := c.pullDelta(ctx, ref, img, o); err != nil {
+			log.Info("Could not apply delta, pulling full image", "Ref", ref, "Delta", o.DeltaRef, "Reason", err.Error())
+		} else {
+			log.Info("Applied delta", "Ref", ref, "Delta", o.DeltaRef)
+			pulled = true
+		}
+	}
+	if !pulled {
+		if err := c.pullImage(ctx, ref, img, o); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := RecordPull(ctx, c.store, img); err != nil {
+		return nil, err
+	}
+	if o.AcceptArtifacts && errors.Is(checkImageType(ctx, ref, img), ErrUnsupportedImageType) {
+		if err := recordOpaqueArtifact(ctx, c.store, img); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// pullImage stores the image. A failing blob does not stop the others from being transferred, so pulling
+// the image again only transfers the blobs named by the returned error.
+func (c *Client) pullImage(ctx context.Context, ref string, img ociimage.Image, o *PullOptions) error {
+	if err := c.store.Pull(ctx, ref, img,
+		store.WithLayerProcessors(o.Processors...),
+		store.WithLayerPriority(o.layerPriority()),
+		store.WithContinueOnError(),
+	); err != nil {
+		var noSpaceErr *ocicontent.NoSpaceError
+		if errors.As(err, &noSpaceErr) {
+			return &InsufficientSpaceError{Path: c.store.Layout().Path(), Needed: noSpaceErr.Needed, Err: err}
+		}
+		return fmt.Errorf("error pulling ref %s: %w", ref, err)
+	}
+	return nil
+}
+
+// pullDelta pulls img, reconstructing its rootfs with the delta artifact of the options, see WithDelta.
+// If this fails, the ingest of the reconstructed rootfs is removed so pulling the full image does not
+// resume it.
+func (c *Client) pullDelta(ctx context.Context, ref string, img ociimage.Image, o *PullOptions) error {
+	registry, err := c.Registry()
+	if err != nil {
+		return err
+	}
+
+	deltaImg, err := registry.Resolve(ctx, o.DeltaRef)
+	if err != nil {
+		return fmt.Errorf("error resolving delta %s: %w", o.DeltaRef, err)
+	}
+	artifact, err := delta.Parse(ctx, deltaImg)
+	if err != nil {
+		return fmt.Errorf("error parsing delta %s: %w", o.DeltaRef, err)
+	}
+
+	blobs := c.store.Layout().Store()
+	info, err := blobs.Info(ctx, artifact.Source)
+	if err != nil {
+		return fmt.Errorf("source rootfs %s is not in the local store: %w", artifact.Source, err)
+	}
+	source := ocicontent.Layer(blobs, ocispec.Descriptor{Digest: artifact.Source, Size: info.Size})
+
+	applied, err := delta.ApplyImage(ctx, img, artifact, source)
+	if err != nil {
+		return err
+	}
+	if err := c.pullImage(ctx, ref, applied, o); err != nil {
+		if abortErr := abortIngests(ctx, blobs, artifact.Target); abortErr != nil {
+			return fmt.Errorf("%w (error removing reconstructed rootfs: %v)", err, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// abortIngests aborts all ingests of the blob with the given digest.
+func abortIngests(ctx context.Context, blobs content.Store, dgst digest.Digest) error {
+	statuses, err := blobs.ListStatuses(ctx)
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		if ocicontent.ExpectedDigest(status.Ref) != dgst {
+			continue
+		}
+		if err := blobs.Abort(ctx, status.Ref); err != nil && !errdefs.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// pullResolved tags ref with the image of the store the reference was translated to, recording the
+// source of the translation (see refmap.ResolvedFromAnnotation). The registry is not contacted, instead
+// the digests of the local manifest, config and layers are verified.
+func (c *Client) pullResolved(ctx context.Context, ref string, res refmap.Resolution) (ociimage.Image, error) {
+	descs, err := c.store.Layout().Indexer().List(ctx, descriptormatcher.Digests(res.Digest))
+	if err != nil {
+		return nil, fmt.Errorf("error looking up %s: %w", res.Digest, err)
+	}
+	if len(descs) == 0 {
+		return nil, fmt.Errorf("%s translates %s to %s, which is not in the local store", res.Source, ref, res.Digest)
+	}
+
+	img := c.store.Layout().View(descs[0])
+	if err := verifyContent(ctx, c.store, img); err != nil {
+		return nil, fmt.Errorf("error verifying %s translated from %s: %w", res.Digest, ref, err)
+	}
+	if err := c.store.Tag(ctx, res.Digest.String(), ref); err != nil {
+		return nil, fmt.Errorf("error tagging %s: %w", ref, err)
+	}
+	if err := c.store.Annotate(ctx, ref, map[string]string{refmap.ResolvedFromAnnotation: res.Source}, nil); err != nil {
+		return nil, fmt.Errorf("error recording translation source: %w", err)
+	}
+	return img, nil
+}
+
+// verifyContent verifies the manifest, config and layers of the image in the store against their digests.
+// Blobs unchanged since they were last verified are not hashed again, see layout.Layout.Verify.
+func verifyContent(ctx context.Context, s *store.Store, img ociimage.Image) error {
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	descs := append([]ocispec.Descriptor{img.Descriptor(), manifest.Config}, manifest.Layers...)
+	return s.Layout().Verify(ctx, descs)
+}
+
+// ResolveRemote resolves the given reference at its registry to the image Pull would write with the
+// given options, without writing anything. Use it to pull an image into several stores with store.PushAll.
+// Processors are not applied.
+func (c *Client) ResolveRemote(ctx context.Context, ref string, opts ...PullOption) (ociimage.Image, error) {
+	o := &PullOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	img, err := c.resolveRemote(c.context(ctx), ref, o)
+	if err != nil {
+		return nil, err
+	}
+	return layout.PrioritizeLayers(img, o.layerPriority()), nil
+}
+
+// ResolveRemoteIndex resolves the ref to an image index of its registry, whose children are walked lazily
+// so even indexes with many thousands of children are listed with bounded memory.
+func (c *Client) ResolveRemoteIndex(ctx context.Context, ref string) (ociimage.Index, error) {
+	registry, err := c.Registry()
+	if err != nil {
+		return nil, err
+	}
+	idx, err := registry.ResolveIndex(c.context(ctx), ref)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving index %s: %w", ref, err)
+	}
+	return idx, nil
+}
+
+// resolveRemote resolves the ref at its registry. The ref is validated before connecting to the registry,
+// references not found are returned as *NotFoundError.
+func (c *Client) resolveRemote(ctx context.Context, ref string, o *PullOptions) (ociimage.Image, error) {
+	named, err := c.store.Parser().ParseNamed(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	registry, err := c.Registry()
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := registry.Resolve(ctx, ref)
+	if err != nil {
+		err = fmt.Errorf("error resolving ref %s: %w", ref, err)
+		if errdefs.IsNotFound(err) {
+			return nil, c.notFound(ctx, named, err)
+		}
+		return nil, err
+	}
+	if err := checkImageType(ctx, ref, img); err != nil {
+		var typeErr *UnsupportedImageTypeError
+		if !o.AcceptArtifacts || !errors.As(err, &typeErr) || !typeErr.opaque() {
+			return nil, err
+		}
+	}
+	if !o.AllowUnknownSize {
+		if err := imageutil.CheckSizes(ctx, img); err != nil {
+			return nil, fmt.Errorf("error checking blob sizes of %s: %w", ref, err)
+		}
+	}
+
+	// Encrypted layers are decrypted while being written to the store, where their plaintext digest is verified.
+	img, err = layercrypt.DecryptImage(ctx, img, o.DecryptionKeys)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting %s: %w", ref, err)
+	}
+	if o.MetadataOnly {
+		img = layout.MetadataOnly(img)
+	}
+	return img, nil
+}
+
+// RecordPull records the current time as pull time on all index entries of the image.
+func RecordPull(ctx context.Context, s *store.Store, img ociimage.Image) error {
+	pulledAt := time.Now().UTC().Format(time.RFC3339)
+	if err := s.Layout().Indexer().Update(ctx, descriptormatcher.Digests(img.Descriptor().Digest), func(desc ocispec.Descriptor) ocispec.Descriptor {
+		return indexer.WithAnnotation(desc, indexer.PulledAtAnnotation, pulledAt)
+	}); err != nil {
+		return fmt.Errorf("error recording pull time: %w", err)
+	}
+	return nil
+}
+
+// missingSize returns the total size of all blobs of the image not yet present in the store.
+func missingSize(ctx context.Context, s *store.Store, img ociimage.Image) (int64, error) {
+	layers, err := ociimage.AsWriteLayers(ctx, img)
+	if err != nil {
+		return 0, fmt.Errorf("error getting image layers: %w", err)
+	}
+
+	var size int64
+	for _, layer := range layers {
+		desc := layer.Descriptor()
+		if _, err := s.Layout().Store().Info(ctx, desc.Digest); err == nil {
+			continue
+		}
+		// Blobs without size information cannot be accounted for in advance.
+		if imageutil.HasKnownSize(desc) {
+			size += desc.Size
+		}
+	}
+	return size, nil
+}
+
+// CheckSpace checks that the store has enough free space for the blobs of the image not yet present,
+// returning an *InsufficientSpaceError otherwise.
+func CheckSpace(ctx context.Context, s *store.Store, img ociimage.Image) error {
+	needed, err := missingSize(ctx, s, img)
+	if err != nil {
+		return err
+	}
+
+	path := s.Layout().Path()
+	free, err := doctor.FreeBytes(path)
+	if err != nil {
+		// Not being able to determine the free space should not prevent pulling.
+		return nil
+	}
+	if uint64(needed) > free {
+		return &InsufficientSpaceError{
+			Path:   path,
+			Needed: needed - int64(free),
+			Err:    fmt.Errorf("image needs %s but only %s are free", units.BytesSize(float64(needed)), units.BytesSize(float64(free))),
+		}
+	}
+	return nil
+}
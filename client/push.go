@@ -0,0 +1,280 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/layercrypt"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/remote"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PushOptions are options for pushing an image.
+type PushOptions struct {
+	// Annotations are added to the manifest of the image before pushing it, changing its digest. The
+	// annotated image is also stored locally, see WithAnnotations.
+	Annotations map[string]string
+	// EncryptMediaTypes are the media types of the layers to encrypt for EncryptRecipients before pushing.
+	EncryptMediaTypes []string
+	// EncryptRecipients are the recipients to encrypt the layers for.
+	EncryptRecipients []*rsa.PublicKey
+	// NormalizeAnnotations normalizes the annotation keys and values of the pushed image instead of
+	// rejecting them, see imageutil.NormalizeImageAnnotations.
+	NormalizeAnnotations bool
+	// Destination is the reference to push the image to instead of its local reference.
+	Destination string
+	// NoPreflight skips checking the size of the push against the registry quota and MaxPushSize.
+	NoPreflight bool
+	// MaxPushSize is the maximum number of bytes a push may upload, e.g. for registries without a quota
+	// API. Zero means no limit.
+	MaxPushSize int64
+	// ManifestTransforms rewrite the manifest just before it is pushed, in order, see
+	// imageutil.TransformManifest. The store keeps the original manifest.
+	ManifestTransforms []imageutil.ManifestTransform
+}
+
+// PushOption is an option for pushing an image.
+type PushOption func(o *PushOptions)
+
+// WithAnnotations adds the annotations to the manifest of the image before pushing it, changing its digest.
+// The annotated image is stored and the local reference name is moved to it, so the local image carries
+// the annotations, e.g. an expiry, and has the pushed digest unless the image is also encrypted or
+// transformed.
+func WithAnnotations(annotations map[string]string) PushOption {
+	return func(o *PushOptions) {
+		if o.Annotations == nil {
+			o.Annotations = make(map[string]string, len(annotations))
+		}
+		for key, value := range annotations {
+			o.Annotations[key] = value
+		}
+	}
+}
+
+// WithEncryption encrypts the layers with the given media types for the recipients before pushing.
+// See layercrypt.EncryptImage.
+func WithEncryption(mediaTypes []string, recipients []*rsa.PublicKey) PushOption {
+	return func(o *PushOptions) {
+		o.EncryptMediaTypes = mediaTypes
+		o.EncryptRecipients = recipients
+	}
+}
+
+// WithNormalizedAnnotations normalizes the annotations of the pushed image instead of rejecting them,
+// changing its digest if any annotation is not normalized yet.
+func WithNormalizedAnnotations() PushOption {
+	return func(o *PushOptions) {
+		o.NormalizeAnnotations = true
+	}
+}
+
+// WithDestination pushes the image to the given reference instead of the reference it has in the store.
+func WithDestination(ref string) PushOption {
+	return func(o *PushOptions) {
+		o.Destination = ref
+	}
+}
+
+// WithoutPreflight skips checking the size of the push before uploading, see Client.Push.
+func WithoutPreflight() PushOption {
+	return func(o *PushOptions) {
+		o.NoPreflight = true
+	}
+}
+
+// WithMaxPushSize fails pushes uploading more than size bytes before uploading anything.
+func WithMaxPushSize(size int64) PushOption {
+	return func(o *PushOptions) {
+		o.MaxPushSize = size
+	}
+}
+
+// WithManifestTransform rewrites the manifest of the pushed image just before uploading it, changing its
+// digest if the manifest changes. The image in the store is left untouched. Can be given multiple times,
+// the transforms are applied in order.
+func WithManifestTransform(transform imageutil.ManifestTransform) PushOption {
+	return func(o *PushOptions) {
+		o.ManifestTransforms = append(o.ManifestTransforms, transform)
+	}
+}
+
+// ErrQuotaExceeded is returned by Push if the push would exceed the registry quota or the maximum push size.
+var ErrQuotaExceeded = remote.ErrQuotaExceeded
+
+// PushResult is the result of pushing an image.
+type PushResult struct {
+	remote.PushResult
+	// Digest is the digest of the pushed manifest, which differs from LocalDigest if it was encrypted or
+	// transformed, or if its annotations were normalized without adding any.
+	Digest digest.Digest
+	// LocalDigest is the digest of the image in the store, the annotated one if annotations were added.
+	LocalDigest digest.Digest
+	// AnnotationChanges are the changes made by normalizing the annotations.
+	AnnotationChanges []imageutil.AnnotationChange
+	// Stats are the transfer statistics of the push, as recorded in the store.
+	Stats layout.TransferStats
+}
+
+// Push pushes the image of the store with the given reference to its registry, or to
+// PushOptions.Destination if set. Errors are returned as *TransferError carrying what was transferred.
+// Unless disabled with WithoutPreflight, the size of the blobs missing on the registry is checked against
+// the storage quota of its project (Harbor only) and PushOptions.MaxPushSize before uploading any of them,
+// failing with an error wrapping ErrQuotaExceeded.
+// The transfer statistics of the push are recorded in the store, see layout.Layout.RecordTransfer.
+func (c *Client) Push(ctx context.Context, ref string, opts ...PushOption) (res *PushResult, retErr error) {
+	o := &PushOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	destination := ref
+	if o.Destination != "" {
+		destination = o.Destination
+	}
+
+	ctx, done := progress.StartOperation(c.context(ctx), "push", destination)
+	var dgst digest.Digest
+	defer func() {
+		done(dgst, retErr)
+		stats := c.transferStats(ctx, "push", destination)
+		c.recordTransfer(ctx, stats)
+		if retErr != nil {
+			retErr = c.transferError(ctx, "push", destination, retErr)
+			return
+		}
+		res.Stats = stats
+	}()
+
+	registry, err := c.Registry()
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := c.store.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving ref %s: %w", ref, err)
+	}
+	localDigest := img.Descriptor().Digest
+
+	if len(o.Annotations) > 0 {
+		img, err = imageutil.WithManifestAnnotations(ctx, img, o.Annotations)
+		if err != nil {
+			return nil, fmt.Errorf("error annotating image: %w", err)
+		}
+	}
+
+	var changes []imageutil.AnnotationChange
+	if o.NormalizeAnnotations {
+		img, changes, err = imageutil.NormalizeImageAnnotations(ctx, img)
+		if err != nil {
+			return nil, fmt.Errorf("error normalizing annotations: %w", err)
+		}
+	}
+	var annotated image.Image
+	if len(o.Annotations) > 0 {
+		annotated = img
+	}
+
+	if len(o.EncryptMediaTypes) > 0 {
+		img, err = layercrypt.EncryptImage(ctx, img, o.EncryptMediaTypes, o.EncryptRecipients)
+		if err != nil {
+			return nil, fmt.Errorf("error encrypting image: %w", err)
+		}
+	}
+
+	if len(o.ManifestTransforms) > 0 {
+		img, err = imageutil.TransformManifest(ctx, img, o.ManifestTransforms...)
+		if err != nil {
+			return nil, fmt.Errorf("error transforming manifest: %w", err)
+		}
+	}
+
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting manifest: %w", err)
+	}
+	if err := imageutil.ValidateManifestAnnotations(manifest); err != nil {
+		return nil, err
+	}
+	if annotated != nil {
+		if err := c.storeAnnotated(ctx, ref, annotated); err != nil {
+			return nil, err
+		}
+		localDigest = annotated.Descriptor().Digest
+	}
+
+	var pushOpts []remote.PushOption
+	if !o.NoPreflight {
+		pushOpts = append(pushOpts, remote.WithPreflight(c.preflight(o.MaxPushSize)))
+	}
+
+	dgst = img.Descriptor().Digest
+	pushRes, err := registry.PushImage(ctx, destination, img, pushOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("error pushing image to %s: %w", destination, err)
+	}
+	return &PushResult{PushResult: *pushRes, Digest: dgst, LocalDigest: localDigest, AnnotationChanges: changes}, nil
+}
+
+// storeAnnotated stores the annotated image and moves the reference name the local image of ref has, if
+// any, to it.
+func (c *Client) storeAnnotated(ctx context.Context, ref string, img image.Image) error {
+	desc, err := c.store.Descriptor(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("error resolving ref %s: %w", ref, err)
+	}
+	if name := desc.Annotations[ocispec.AnnotationRefName]; name != "" {
+		err = c.store.Push(ctx, name, img)
+	} else {
+		err = c.store.Put(ctx, img)
+	}
+	if err != nil {
+		return fmt.Errorf("error storing annotated image: %w", err)
+	}
+	return nil
+}
+
+// preflight returns the preflight checking pushes against maxSize, if positive, and the storage quota of
+// the registry. Failing to determine the quota does not fail the push.
+func (c *Client) preflight(maxSize int64) remote.PreflightFunc {
+	return func(ctx context.Context, ref string, size int64) error {
+		if maxSize > 0 && size > maxSize {
+			return fmt.Errorf("%w: push to %s requires %d bytes, the maximum push size is %d bytes", ErrQuotaExceeded, ref, size, maxSize)
+		}
+
+		resolver, err := c.RequestResolver()
+		if err != nil {
+			return err
+		}
+		quota, err := resolver.Quota(ctx, ref)
+		if err != nil {
+			logr.FromContextOrDiscard(ctx).Info("Could not determine registry quota, pushing anyway", "Ref", ref, "Error", err.Error())
+			return nil
+		}
+		if quota != nil && size > quota.Available() {
+			return fmt.Errorf("%w: push to %s requires %d bytes, project %s has %d of %d bytes available",
+				ErrQuotaExceeded, ref, size, quota.Project, quota.Available(), quota.Limit)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/onmetal/onmetal-image/oci/remote"
+)
+
+// StreamLayer streams the selected layer of the image at ref from the registry straight to dst, e.g. the
+// rootfs onto a block device, without storing the layer, see remote.Registry.StreamLayer. Once the layer
+// is verified, the manifest and config are stored like WithMetadataOnly does, so the store records what
+// was deployed.
+func (c *Client) StreamLayer(ctx context.Context, ref string, selector remote.LayerSelector, dst io.Writer) (*remote.StreamResult, error) {
+	registry, err := c.Registry()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := registry.StreamLayer(ctx, ref, selector, dst)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.store.PushMetadata(ctx, ref, res.Image); err != nil {
+		return nil, fmt.Errorf("error storing metadata of %s: %w", ref, err)
+	}
+	if err := RecordPull(ctx, c.store, res.Image); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/go-logr/logr"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	"github.com/onmetal/onmetal-image/oci/remote"
+	onmetalref "github.com/onmetal/onmetal-image/ref"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// NotFoundError is returned by Pull and ResolveRemote if the repository or tag of a reference does not
+// exist on its registry. It wraps the error of the registry, so errdefs.IsNotFound keeps working.
+type NotFoundError struct {
+	// Ref is the reference that was not found.
+	Ref string
+	// Suggestions are references to similar repositories known locally, with the tag or digest of Ref,
+	// see KnownRepositories and ref.SuggestRepositories.
+	Suggestions []string
+	// Err is the error of the registry.
+	Err error
+}
+
+func (e *NotFoundError) Error() string {
+	if len(e.Suggestions) == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s (did you mean %s?)", e.Err, strings.Join(e.Suggestions, " or "))
+}
+
+func (e *NotFoundError) Unwrap() error {
+	return e.Err
+}
+
+// KnownRepositories returns the repositories known without network access: those of the references of
+// the images in the store and those of the references recently resolved, as recorded by the resolve
+// cache (see Config.ResolveCacheTTL).
+func (c *Client) KnownRepositories(ctx context.Context) ([]string, error) {
+	descs, err := c.store.Layout().Indexer().List(ctx, descriptormatcher.Every)
+	if err != nil {
+		return nil, fmt.Errorf("error listing images: %w", err)
+	}
+	refs := make([]string, 0, len(descs))
+	for _, desc := range descs {
+		if name := desc.Annotations[ocispec.AnnotationRefName]; name != "" {
+			refs = append(refs, name)
+		}
+	}
+	cached, err := remote.ResolveCacheRefs(filepath.Join(c.config.StorePath, ResolveCacheFileName))
+	if err != nil {
+		return nil, err
+	}
+	refs = append(refs, cached...)
+
+	var (
+		parser = c.store.Parser()
+		seen   = make(map[string]bool)
+		res    []string
+	)
+	for _, ref := range refs {
+		named, err := parser.ParseNamed(ref)
+		if err != nil {
+			continue
+		}
+		repository := named.Name()
+		if !seen[repository] {
+			seen[repository] = true
+			res = append(res, repository)
+		}
+	}
+	return res, nil
+}
+
+// notFound returns err, the registry not finding named, as NotFoundError with suggestions of similar
+// repositories known locally. Failing to determine them only omits the suggestions.
+func (c *Client) notFound(ctx context.Context, named reference.Named, err error) error {
+	res := &NotFoundError{Ref: named.String(), Err: err}
+	known, knownErr := c.KnownRepositories(ctx)
+	if knownErr != nil {
+		logr.FromContextOrDiscard(ctx).V(1).Info("Could not determine known repositories", "Error", knownErr.Error())
+		return res
+	}
+
+	var suffix string
+	if tagged, ok := named.(reference.Tagged); ok {
+		suffix = ":" + tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		suffix += "@" + digested.Digest().String()
+	}
+	for _, repository := range onmetalref.SuggestRepositories(named.Name(), known) {
+		res.Suggestions = append(res.Suggestions, repository+suffix)
+	}
+	return res
+}
@@ -0,0 +1,425 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/distribution/reference"
+	"github.com/onmetal/onmetal-image/batch"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	"github.com/onmetal/onmetal-image/utils/sets"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// syncLockName is the name of the layout lock held while syncing, see layout.Layout.TryLock.
+const syncLockName = "sync"
+
+// ErrSyncInProgress is returned by Client.Sync if another sync of the store is in progress.
+var ErrSyncInProgress = errors.New("another sync of the store is in progress")
+
+// DesiredState lists the images that must exist in a store, see Client.Sync.
+type DesiredState struct {
+	Images []DesiredImage `yaml:"images"`
+}
+
+// DesiredImage is an image of a DesiredState.
+type DesiredImage struct {
+	// Ref is the reference of the image including its digest, e.g. ghcr.io/onmetal/gardenlinux:v1@sha256:....
+	// If it has a tag, the tag is made to point to the digest, too.
+	Ref string `yaml:"ref"`
+}
+
+// ParseDesiredState parses a desired state in YAML and checks that each of its images has a reference.
+// Whether the references are valid and digested is checked by Client.Sync.
+func ParseDesiredState(data []byte) (*DesiredState, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	state := &DesiredState{}
+	if err := dec.Decode(state); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error decoding desired state: %w", err)
+	}
+	for i, img := range state.Images {
+		if img.Ref == "" {
+			return nil, fmt.Errorf("image %d has no reference", i)
+		}
+	}
+	return state, nil
+}
+
+// SyncDrift is a deviation of the store from the desired state.
+type SyncDrift string
+
+const (
+	// SyncDriftMissing means the image or some of its blobs are not in the store.
+	SyncDriftMissing SyncDrift = "missing"
+	// SyncDriftCorrupt means blobs of the image do not match their digests.
+	SyncDriftCorrupt SyncDrift = "corrupt"
+	// SyncDriftTag means the tag of the image does not exist locally or points to another image.
+	SyncDriftTag SyncDrift = "tag"
+	// SyncDriftExtra means the image is in the store but not in the desired state.
+	SyncDriftExtra SyncDrift = "extra"
+)
+
+// SyncAction is an action Client.Sync took to resolve drift.
+type SyncAction string
+
+const (
+	// SyncActionPulled means the image was pulled because it was missing.
+	SyncActionPulled SyncAction = "pulled"
+	// SyncActionRepaired means the missing or corrupt blobs of the image were pulled again.
+	SyncActionRepaired SyncAction = "repaired"
+	// SyncActionTagged means the tag was made to point to the image.
+	SyncActionTagged SyncAction = "tagged"
+	// SyncActionRemoved means the extra image was removed, see WithPruneExtra.
+	SyncActionRemoved SyncAction = "removed"
+	// SyncActionRetained means the extra image was kept because it is pinned or leased.
+	SyncActionRetained SyncAction = "retained"
+)
+
+// SyncItem is the outcome of syncing an image.
+type SyncItem struct {
+	// Ref is the reference of the desired image. For extra images, it is one of their names or their digest.
+	Ref    string
+	Digest digest.Digest
+	// Drift are the deviations found, empty if the image was as desired.
+	Drift []SyncDrift
+	// Actions are the actions taken to resolve them.
+	Actions []SyncAction
+	// Err is the error syncing the image. Drift may then be unresolved.
+	Err error
+}
+
+// SyncReport is the result of Client.Sync.
+type SyncReport struct {
+	// Items are the results of the desired images in the order of the desired state, followed by the
+	// extra images if pruning them was requested.
+	Items []SyncItem
+	// PruneSkipped is set if removing extra images was skipped because syncing a desired image failed.
+	PruneSkipped bool
+}
+
+// Err returns the errors of all failed items, nil if all succeeded.
+func (r *SyncReport) Err() error {
+	var errs []error
+	for _, item := range r.Items {
+		if item.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", item.Ref, item.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SyncOptions are options for Client.Sync.
+type SyncOptions struct {
+	// PruneExtra removes the unpinned, unleased images not in the desired state.
+	PruneExtra bool
+	// Jobs is the number of images synced concurrently. Values below 1 sync one at a time.
+	Jobs int
+	// PullOptions are the options images are pulled with.
+	PullOptions []PullOption
+}
+
+// SyncOption is an option for Client.Sync.
+type SyncOption func(o *SyncOptions)
+
+// WithPruneExtra removes the unpinned, unleased images not in the desired state.
+func WithPruneExtra() SyncOption {
+	return func(o *SyncOptions) {
+		o.PruneExtra = true
+	}
+}
+
+// WithSyncJobs syncs up to jobs images concurrently.
+func WithSyncJobs(jobs int) SyncOption {
+	return func(o *SyncOptions) {
+		o.Jobs = jobs
+	}
+}
+
+// WithSyncPullOptions pulls the images with the given options.
+func WithSyncPullOptions(opts ...PullOption) SyncOption {
+	return func(o *SyncOptions) {
+		o.PullOptions = append(o.PullOptions, opts...)
+	}
+}
+
+// desiredImage is a parsed DesiredImage.
+type desiredImage struct {
+	ref    string
+	digest digest.Digest
+	// pullRef is the digested reference without tag the image is pulled with.
+	pullRef string
+	// tag is the tagged reference without digest, empty if the reference has no tag.
+	tag string
+}
+
+// Sync makes the store match the desired state: images missing from the store are pulled, the blobs of
+// present ones are verified against their digests and pulled again if missing or corrupt, and tags are
+// moved to the desired digests. With WithPruneExtra, images not in the desired state are removed unless
+// pinned or leased, which is skipped if any desired image failed to sync so a failed update does not
+// leave the store without any image. Running it again on a synced store changes nothing.
+// Only one sync of a store runs at a time, across processes; concurrent calls return ErrSyncInProgress.
+// The returned error is only non-nil if the store could not be synced at all, failures of single images
+// are reported in their SyncItem.
+func (c *Client) Sync(ctx context.Context, state *DesiredState, opts ...SyncOption) (*SyncReport, error) {
+	o := &SyncOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	ctx = c.context(ctx)
+
+	desired, err := c.parseDesiredState(state)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, ok, err := c.store.Layout().TryLock(syncLockName)
+	if err != nil {
+		return nil, fmt.Errorf("error locking store: %w", err)
+	}
+	if !ok {
+		return nil, ErrSyncInProgress
+	}
+	defer func() { _ = unlock() }()
+
+	var (
+		report = &SyncReport{Items: make([]SyncItem, len(desired))}
+		refs   = make([]string, 0, len(desired))
+	)
+	for _, d := range desired {
+		refs = append(refs, d.ref)
+	}
+	batch.Run(ctx, refs, o.Jobs, false, func(ctx context.Context, i int) batch.Result {
+		report.Items[i] = c.syncImage(ctx, desired[i], o)
+		return batch.Result{Err: report.Items[i].Err}
+	})
+
+	if !o.PruneExtra {
+		return report, nil
+	}
+	if report.Err() != nil {
+		report.PruneSkipped = true
+		return report, nil
+	}
+	extra, err := c.pruneExtra(ctx, desired)
+	if err != nil {
+		return nil, err
+	}
+	report.Items = append(report.Items, extra...)
+	return report, nil
+}
+
+// parseDesiredState parses the references of the desired images, rejecting undigested references and
+// tags desired to point to several digests.
+func (c *Client) parseDesiredState(state *DesiredState) ([]desiredImage, error) {
+	var (
+		res  = make([]desiredImage, 0, len(state.Images))
+		tags = make(map[string]digest.Digest)
+	)
+	for _, img := range state.Images {
+		named, err := c.store.Parser().ParseNamed(img.Ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reference %s: %w", img.Ref, err)
+		}
+		digested, ok := named.(reference.Digested)
+		if !ok {
+			return nil, fmt.Errorf("reference %s has no digest", img.Ref)
+		}
+
+		d := desiredImage{ref: img.Ref, digest: digested.Digest()}
+		repository := reference.TrimNamed(named)
+		pullRef, err := reference.WithDigest(repository, d.digest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reference %s: %w", img.Ref, err)
+		}
+		d.pullRef = pullRef.String()
+		if tagged, ok := named.(reference.Tagged); ok {
+			tagRef, err := reference.WithTag(repository, tagged.Tag())
+			if err != nil {
+				return nil, fmt.Errorf("invalid reference %s: %w", img.Ref, err)
+			}
+			d.tag = tagRef.String()
+			if other, ok := tags[d.tag]; ok && other != d.digest {
+				return nil, fmt.Errorf("tag %s is desired to point to both %s and %s", d.tag, other, d.digest)
+			}
+			tags[d.tag] = d.digest
+		}
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+// syncImage makes the store contain the intact desired image and points its tag to it.
+func (c *Client) syncImage(ctx context.Context, d desiredImage, o *SyncOptions) SyncItem {
+	item := SyncItem{Ref: d.ref, Digest: d.digest}
+
+	present, drift, err := c.checkImage(ctx, d.digest)
+	if err != nil {
+		item.Err = err
+		return item
+	}
+	item.Drift = drift
+	if len(drift) > 0 {
+		if _, err := c.Pull(ctx, d.pullRef, o.PullOptions...); err != nil {
+			item.Err = err
+			return item
+		}
+		if present {
+			item.Actions = append(item.Actions, SyncActionRepaired)
+		} else {
+			item.Actions = append(item.Actions, SyncActionPulled)
+		}
+	}
+
+	if d.tag == "" {
+		return item
+	}
+	descs, err := c.store.Layout().Indexer().List(ctx, descriptormatcher.Name(d.tag))
+	if err != nil {
+		item.Err = fmt.Errorf("error looking up %s: %w", d.tag, err)
+		return item
+	}
+	if len(descs) == 1 && descs[0].Digest == d.digest {
+		return item
+	}
+	item.Drift = append(item.Drift, SyncDriftTag)
+	if err := c.store.Tag(ctx, d.digest.String(), d.tag); err != nil {
+		item.Err = fmt.Errorf("error tagging %s: %w", d.tag, err)
+		return item
+	}
+	item.Actions = append(item.Actions, SyncActionTagged)
+	return item
+}
+
+// checkImage reports whether the image is in the store and whether any of its blobs are missing or do
+// not match their digest. Corrupt blobs are removed so pulling the image writes them again.
+func (c *Client) checkImage(ctx context.Context, dgst digest.Digest) (bool, []SyncDrift, error) {
+	l := c.store.Layout()
+	descs, err := l.Indexer().List(ctx, descriptormatcher.Digests(dgst))
+	if err != nil {
+		return false, nil, fmt.Errorf("error looking up %s: %w", dgst, err)
+	}
+	if len(descs) == 0 {
+		return false, []SyncDrift{SyncDriftMissing}, nil
+	}
+
+	var drift []SyncDrift
+	addDrift := func(d SyncDrift) {
+		for _, existing := range drift {
+			if existing == d {
+				return
+			}
+		}
+		drift = append(drift, d)
+	}
+	// checkBlob verifies the blob, reporting false if it is missing or was removed as corrupt.
+	checkBlob := func(desc ocispec.Descriptor) (bool, error) {
+		err := l.Verify(ctx, []ocispec.Descriptor{desc})
+		switch {
+		case err == nil:
+			return true, nil
+		case errors.Is(err, os.ErrNotExist):
+			addDrift(SyncDriftMissing)
+			return false, nil
+		case errors.Is(err, ioutils.ErrDigestMismatch) || errors.Is(err, ioutils.ErrSizeMismatch):
+			addDrift(SyncDriftCorrupt)
+			if err := l.Store().Delete(ctx, desc.Digest); err != nil {
+				return false, fmt.Errorf("error removing corrupt blob %s: %w", desc.Digest, err)
+			}
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	img := l.View(descs[0])
+	if ok, err := checkBlob(img.Descriptor()); err != nil || !ok {
+		return true, drift, err
+	}
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return true, nil, fmt.Errorf("error reading manifest of %s: %w", dgst, err)
+	}
+	for _, desc := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		if _, err := checkBlob(desc); err != nil {
+			return true, nil, err
+		}
+	}
+	return true, drift, nil
+}
+
+// pruneExtra removes the images of the store not in desired, see layout.Layout.PruneUnlisted.
+func (c *Client) pruneExtra(ctx context.Context, desired []desiredImage) ([]SyncItem, error) {
+	l := c.store.Layout()
+
+	keep := sets.New[digest.Digest]()
+	for _, d := range desired {
+		keep.Insert(d.digest)
+	}
+
+	// The names of the images are gone once they are removed.
+	descs, err := l.Indexer().List(ctx, descriptormatcher.Every)
+	if err != nil {
+		return nil, fmt.Errorf("error listing images: %w", err)
+	}
+	names := make(map[digest.Digest]string)
+	for _, desc := range descs {
+		if name, ok := desc.Annotations[ocispec.AnnotationRefName]; ok {
+			if _, ok := names[desc.Digest]; !ok {
+				names[desc.Digest] = name
+			}
+		}
+	}
+	nameOf := func(dgst digest.Digest) string {
+		if name, ok := names[dgst]; ok {
+			return name
+		}
+		return dgst.String()
+	}
+
+	results, retained, err := l.PruneUnlisted(ctx, keep)
+	if err != nil {
+		return nil, fmt.Errorf("error removing extra images: %w", err)
+	}
+	var items []SyncItem
+	for _, res := range results {
+		items = append(items, SyncItem{
+			Ref:     nameOf(res.Digest),
+			Digest:  res.Digest,
+			Drift:   []SyncDrift{SyncDriftExtra},
+			Actions: []SyncAction{SyncActionRemoved},
+			Err:     res.Err,
+		})
+	}
+	for _, dgst := range retained {
+		items = append(items, SyncItem{
+			Ref:     nameOf(dgst),
+			Digest:  dgst,
+			Drift:   []SyncDrift{SyncDriftExtra},
+			Actions: []SyncAction{SyncActionRetained},
+		})
+	}
+	return items, nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	. "github.com/onmetal/onmetal-image/client"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	"github.com/onmetal/onmetal-image/testing/registryharness"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sync", func() {
+	var (
+		ctx        = context.Background()
+		harness    *registryharness.Registry
+		configPath string
+	)
+
+	BeforeEach(func() {
+		harness = registryharness.New()
+		DeferCleanup(harness.Close)
+
+		configPath = filepath.Join(GinkgoT().TempDir(), "config.json")
+		Expect(os.WriteFile(configPath, []byte("{}"), 0666)).To(Succeed())
+	})
+
+	newClient := func() *Client {
+		c, err := New(Config{StorePath: GinkgoT().TempDir(), DockerConfigPaths: []string{configPath}})
+		Expect(err).NotTo(HaveOccurred())
+		return c
+	}
+
+	newImage := func(kernel string) ociimage.Image {
+		img, err := fixtures.Image{Layers: []fixtures.Layer{{Role: "kernel", Content: []byte(kernel)}}}.Build()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	It("should pull missing images, repair corrupt ones, move tags and remove extra images", func() {
+		var (
+			ref = harness.Reference("repo", "v1")
+			img = newImage("kernel-v1")
+		)
+		Expect(harness.Seed(ctx, "repo", "v1", img)).To(Succeed())
+		desired := ref + "@" + img.Descriptor().Digest.String()
+		state := &DesiredState{Images: []DesiredImage{{Ref: desired}}}
+
+		dst := newClient()
+		extra := newImage("extra")
+		Expect(dst.Store().Push(ctx, "extra:latest", extra)).To(Succeed())
+
+		By("pulling the missing image and removing the extra one")
+		report, err := dst.Sync(ctx, state, WithPruneExtra())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Err()).NotTo(HaveOccurred())
+		Expect(report.Items).To(HaveLen(2))
+		Expect(report.Items[0].Ref).To(Equal(desired))
+		Expect(report.Items[0].Drift).To(Equal([]SyncDrift{SyncDriftMissing, SyncDriftTag}))
+		Expect(report.Items[0].Actions).To(Equal([]SyncAction{SyncActionPulled, SyncActionTagged}))
+		Expect(report.Items[1].Digest).To(Equal(extra.Descriptor().Digest))
+		Expect(report.Items[1].Actions).To(Equal([]SyncAction{SyncActionRemoved}))
+
+		descs, err := dst.List(ctx, descriptormatcher.Name(ref))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(descs).To(ConsistOf(HaveField("Digest", img.Descriptor().Digest)))
+		_, err = dst.Resolve(ctx, "extra:latest")
+		Expect(err).To(HaveOccurred())
+
+		By("changing nothing when syncing again")
+		report, err = dst.Sync(ctx, state, WithPruneExtra())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Items).To(HaveLen(1))
+		Expect(report.Items[0].Drift).To(BeEmpty())
+		Expect(report.Items[0].Actions).To(BeEmpty())
+
+		By("repairing a corrupt blob")
+		manifest, err := img.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		blobPath, err := dst.Store().Layout().Store().BlobPath(manifest.Layers[0].Digest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Chmod(blobPath, 0666)).To(Succeed())
+		Expect(os.WriteFile(blobPath, []byte("kernel-xx"), 0666)).To(Succeed())
+
+		report, err = dst.Sync(ctx, state)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Err()).NotTo(HaveOccurred())
+		Expect(report.Items[0].Drift).To(Equal([]SyncDrift{SyncDriftCorrupt}))
+		Expect(report.Items[0].Actions).To(Equal([]SyncAction{SyncActionRepaired}))
+		Expect(os.ReadFile(blobPath)).To(Equal([]byte("kernel-v1")))
+
+		By("moving a tag pointing to another image back")
+		Expect(dst.Store().Push(ctx, ref, newImage("kernel-local"))).To(Succeed())
+		report, err = dst.Sync(ctx, state)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Items[0].Drift).To(Equal([]SyncDrift{SyncDriftTag}))
+		Expect(report.Items[0].Actions).To(Equal([]SyncAction{SyncActionTagged}))
+	})
+
+	It("should not remove extra images if syncing a desired image fails", func() {
+		dst := newClient()
+		extra := newImage("extra")
+		Expect(dst.Store().Push(ctx, "extra:latest", extra)).To(Succeed())
+
+		missing := harness.Reference("repo", "v1") + "@" + newImage("missing").Descriptor().Digest.String()
+		report, err := dst.Sync(ctx, &DesiredState{Images: []DesiredImage{{Ref: missing}}}, WithPruneExtra())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Err()).To(HaveOccurred())
+		Expect(report.PruneSkipped).To(BeTrue())
+		Expect(report.Items).To(HaveLen(1))
+		_, err = dst.Resolve(ctx, "extra:latest")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should reject undigested references and concurrent syncs", func() {
+		dst := newClient()
+		_, err := dst.Sync(ctx, &DesiredState{Images: []DesiredImage{{Ref: harness.Reference("repo", "v1")}}})
+		Expect(err).To(MatchError(ContainSubstring("has no digest")))
+
+		unlock, ok, err := dst.Store().Layout().TryLock("sync")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		DeferCleanup(unlock)
+		_, err = dst.Sync(ctx, &DesiredState{})
+		Expect(err).To(MatchError(ErrSyncInProgress))
+	})
+
+	It("should parse a desired state", func() {
+		state, err := ParseDesiredState([]byte("images:\n- ref: ghcr.io/onmetal/a:v1@sha256:0123\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state.Images).To(Equal([]DesiredImage{{Ref: "ghcr.io/onmetal/a:v1@sha256:0123"}}))
+
+		_, err = ParseDesiredState([]byte("images:\n- reference: ghcr.io/onmetal/a:v1\n"))
+		Expect(err).To(HaveOccurred())
+		_, err = ParseDesiredState([]byte("images:\n- {}\n"))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,149 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/go-logr/logr"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/opencontainers/go-digest"
+)
+
+// TransferProgress is what a failed or cancelled pull or push transferred until it stopped.
+type TransferProgress struct {
+	// Blobs are the transfers of the blobs started or skipped, in the order they were started.
+	Blobs []progress.BlobTransfer
+	// Completed is the number of blobs transferred completely.
+	Completed int
+	// Skipped is the number of blobs that already existed at the destination.
+	Skipped int
+	// Bytes is the number of bytes transferred, excluding bytes of resumed transfers.
+	Bytes int64
+	// Resumable are the interrupted downloads of the image the next pull resumes instead of restarting them.
+	// Only set for pulls.
+	Resumable []layout.IngestStatus
+}
+
+// TransferError is returned by Pull and Push if they fail or are cancelled, carrying the progress until then.
+// It wraps the cause, so checks like errors.Is(err, context.Canceled) keep working.
+type TransferError struct {
+	// Operation is the failed operation, pull or push.
+	Operation string
+	// Ref is the reference of the transferred image.
+	Ref string
+	// Progress is what was transferred before the operation stopped.
+	Progress TransferProgress
+	// Stats are the transfer statistics of the operation, as recorded in the store.
+	Stats layout.TransferStats
+	// Err is the cause.
+	Err error
+}
+
+func (e *TransferError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+// transferError returns err as a TransferError with the progress recorded in the context of the operation.
+// Interrupted downloads are only looked up in the store for pulls.
+func (c *Client) transferError(ctx context.Context, operation, ref string, err error) error {
+	res := &TransferError{Operation: operation, Ref: ref, Stats: c.transferStats(ctx, operation, ref), Err: err}
+	recorder, ok := progress.RecorderFromContext(ctx)
+	if !ok {
+		return res
+	}
+
+	started := make(map[digest.Digest]int)
+	for i, blob := range recorder.Transfers() {
+		res.Progress.Blobs = append(res.Progress.Blobs, blob)
+		res.Progress.Bytes += blob.Transferred
+		switch {
+		case blob.Skipped:
+			res.Progress.Skipped++
+		case blob.Done:
+			res.Progress.Completed++
+		default:
+			started[blob.Digest] = i
+		}
+	}
+
+	if operation != "pull" || len(started) == 0 {
+		return res
+	}
+	// The context of the operation is likely cancelled, reading the ingests must not depend on it.
+	statuses, statusErr := c.store.Layout().IngestStatus(context.Background())
+	if statusErr != nil {
+		return res
+	}
+	for _, status := range statuses {
+		i, ok := started[status.Expected]
+		if !ok || status.Offset <= 0 || status.Stale || status.InFlight {
+			continue
+		}
+		// Progress events are only reported every progress.ReportInterval bytes, the ingest is exact.
+		res.Progress.Blobs[i].Offset = status.Offset
+		res.Progress.Resumable = append(res.Progress.Resumable, status)
+	}
+	return res
+}
+
+// transferStats returns the transfer statistics of the operation from the progress recorded in its
+// context. Pulls count as downloads, pushes as uploads.
+func (c *Client) transferStats(ctx context.Context, operation, ref string) layout.TransferStats {
+	stats := layout.TransferStats{Operations: 1}
+	if named, err := c.store.Parser().ParseNamed(ref); err == nil {
+		stats.Host = reference.Domain(named)
+	}
+	recorder, ok := progress.RecorderFromContext(ctx)
+	if !ok {
+		return stats
+	}
+	for _, blob := range recorder.Transfers() {
+		switch {
+		case blob.Skipped:
+			stats.CacheHits++
+		case operation == "push":
+			stats.BytesUploaded += blob.Transferred
+			if blob.Done {
+				stats.BlobsUploaded++
+			}
+		default:
+			stats.BytesDownloaded += blob.Transferred
+			if blob.Done {
+				stats.BlobsDownloaded++
+			}
+		}
+	}
+	return stats
+}
+
+// recordTransfer records the transfer statistics of an operation in the store. Failing to record them
+// does not fail the operation, it is only logged.
+func (c *Client) recordTransfer(ctx context.Context, stats layout.TransferStats) {
+	if stats.Host == "" {
+		return
+	}
+	// The context of the operation may be cancelled, its statistics are still recorded.
+	if err := c.store.Layout().RecordTransfer(context.Background(), stats, time.Now()); err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "Error recording transfer statistics", "Host", stats.Host)
+	}
+}
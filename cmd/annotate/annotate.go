@@ -0,0 +1,141 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package annotate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	onmetalref "github.com/onmetal/onmetal-image/ref"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory) *cobra.Command {
+	var (
+		manifest  bool
+		normalize bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "annotate image[:tag] key=value... [key-]...",
+		Short: "Add (key=value) or remove (key-) annotations of a local image.",
+		Long: `Add (key=value) or remove (key-) annotations of a local image.
+
+By default, the annotations of the local index entry are edited. They are kept when the entry is replaced
+(e.g. by pulling the image again). With --manifest, the image manifest is rewritten to carry the annotations
+instead, which produces an image with a new digest.`,
+		Args: cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			set, remove, err := ParseAnnotations(args[1:])
+			if err != nil {
+				return err
+			}
+			if normalize {
+				var changes []imageutil.AnnotationChange
+				if set, changes, err = imageutil.NormalizeAnnotations(set); err != nil {
+					return err
+				}
+				for i, key := range remove {
+					remove[i] = imageutil.NormalizeAnnotationKey(key)
+				}
+				common.PrintAnnotationChanges(cmd.OutOrStdout(), changes)
+			}
+			if err := imageutil.ValidateAnnotations(set); err != nil {
+				return err
+			}
+			return Run(ctx, storeFactory, args[0], set, remove, manifest)
+		},
+	}
+
+	cmd.Flags().BoolVar(&manifest, "manifest", false, "Rewrite the image manifest to carry the annotations, producing a new digest.")
+	cmd.Flags().BoolVar(&normalize, common.RecommendedNormalizeAnnotationsFlagName, false, common.RecommendedNormalizeAnnotationsFlagUsage)
+
+	return cmd
+}
+
+// ParseAnnotations parses annotation expressions of the form key=value (set) and key- (remove).
+func ParseAnnotations(exprs []string) (set map[string]string, remove []string, err error) {
+	set = make(map[string]string)
+	for _, expr := range exprs {
+		if key, ok := strings.CutSuffix(expr, "-"); ok && !strings.Contains(expr, "=") {
+			if key == "" {
+				return nil, nil, fmt.Errorf("invalid annotation removal %q", expr)
+			}
+			remove = append(remove, key)
+			continue
+		}
+
+		key, value, err := common.ParseKeyValue(expr)
+		if err != nil {
+			return nil, nil, err
+		}
+		set[key] = value
+	}
+	return set, remove, nil
+}
+
+func Run(ctx context.Context, storeFactory common.StoreFactory, srcImage string, set map[string]string, remove []string, manifest bool) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	ref, err := common.FuzzyResolveRef(ctx, s, srcImage)
+	if err != nil {
+		return fmt.Errorf("error resolving source: %w", err)
+	}
+
+	if !manifest {
+		if err := s.Annotate(ctx, ref, set, remove); err != nil {
+			return fmt.Errorf("error annotating %s: %w", ref, err)
+		}
+		fmt.Println("Successfully annotated", ref)
+		return nil
+	}
+
+	img, err := s.Resolve(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("error getting image: %w", err)
+	}
+
+	annotated, err := imageutil.EditManifestAnnotations(ctx, img, set, remove)
+	if err != nil {
+		return fmt.Errorf("error rewriting manifest: %w", err)
+	}
+
+	r, err := onmetalref.ParseAny(ref)
+	if err != nil {
+		return fmt.Errorf("invalid ref %s: %w", ref, err)
+	}
+
+	// Move the tag to the annotated image if the image was referenced by tag.
+	if _, ok := r.(reference.NamedTagged); ok {
+		if err := s.Push(ctx, ref, annotated); err != nil {
+			return fmt.Errorf("error storing annotated image as %s: %w", ref, err)
+		}
+	} else {
+		if err := s.Put(ctx, annotated); err != nil {
+			return fmt.Errorf("error storing annotated image: %w", err)
+		}
+	}
+
+	fmt.Println("Successfully annotated", ref, annotated.Descriptor().Digest.Encoded())
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory) *cobra.Command {
+	var (
+		since      string
+		jsonOutput bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "audit [--since 7d]",
+		Short: "Show the audit log of the mutating operations (add, tag, delete, prune, pin, ...) on the local store.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var sinceDuration time.Duration
+			if since != "" {
+				var err error
+				if sinceDuration, err = common.ParseSince(since); err != nil {
+					return err
+				}
+			}
+			return Run(cmd.Context(), storeFactory, sinceDuration, jsonOutput)
+		},
+	}
+
+	cmd.Flags().StringVar(&since, "since", "", "Only show the operations of the given period, e.g. 7d or 12h.")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the audit entries as JSON.")
+
+	return cmd
+}
+
+// Run prints the entries of the audit log of the store recorded within the given period, all of them
+// if since is zero.
+func Run(ctx context.Context, storeFactory common.StoreFactory, since time.Duration, jsonOutput bool) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	var sinceTime time.Time
+	if since > 0 {
+		sinceTime = time.Now().Add(-since)
+	}
+	entries, err := s.Layout().AuditLog(ctx, sinceTime)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		if entries == nil {
+			entries = []layout.AuditEntry{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("No operations recorded")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 12, 0, 1, ' ', 0)
+	_, _ = fmt.Fprintln(w, "TIME\tOPERATION\tREFERENCE\tUSER\tOUTCOME\tIMAGES")
+	for _, entry := range entries {
+		outcome := string(entry.Outcome)
+		if entry.Error != "" {
+			outcome = fmt.Sprintf("%s: %s", outcome, entry.Error)
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.Time.Local().Format(time.RFC3339), entry.Operation,
+			entry.Reference, entry.User, outcome, images(entry))
+	}
+	return w.Flush()
+}
+
+// images returns the short digests of the images involved in the entry, deduplicated.
+func images(entry layout.AuditEntry) string {
+	var (
+		res  []string
+		seen = make(map[string]bool)
+	)
+	for _, dgst := range entry.Digests() {
+		short := dgst.Encoded()
+		if len(short) > 12 {
+			short = short[:12]
+		}
+		if !seen[short] {
+			seen[short] = true
+			res = append(res, short)
+		}
+	}
+	return strings.Join(res, ",")
+}
@@ -0,0 +1,159 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/onmetal/onmetal-image/bench"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/spf13/cobra"
+)
+
+func Command(storePath *string, configFactory common.ClientConfigFactory) *cobra.Command {
+	var (
+		sizes          []string
+		iterations     int
+		dir            string
+		pullRef        string
+		pullRepository string
+		jsonOutput     bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Short: "Measure the throughput of ingesting, reading, extracting and, optionally, pulling images on this machine.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			return Run(ctx, configFactory, *storePath, dir, sizes, iterations, pullRef, pullRepository, jsonOutput)
+		},
+	}
+
+	cmd.Flags().StringArrayVar(&sizes, "size", nil, "Blob size to measure, e.g. 1MiB or 1GiB. May be specified multiple times. Defaults to 1MiB and 64MiB.")
+	cmd.Flags().IntVar(&iterations, "iterations", bench.DefaultIterations, "Number of iterations of each measurement.")
+	cmd.Flags().StringVar(&dir, "dir", "", "Directory to create the stores of the measurements in. Defaults to a temporary directory in the store path, so the file system of the store is measured.")
+	cmd.Flags().StringVar(&pullRef, "pull-ref", "", "Image to measure pulling.")
+	cmd.Flags().StringVar(&pullRepository, "pull-repository", "", "Repository to push synthetic images of each size to and measure pulling them.")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Output the report as JSON.")
+	cmd.MarkFlagsMutuallyExclusive("pull-ref", "pull-repository")
+
+	return cmd
+}
+
+func Run(
+	ctx context.Context,
+	configFactory common.ClientConfigFactory,
+	storePath, dir string,
+	sizes []string,
+	iterations int,
+	pullRef, pullRepository string,
+	jsonOutput bool,
+) error {
+	o := bench.Options{Dir: dir, Iterations: iterations}
+	for _, size := range sizes {
+		n, err := units.RAMInBytes(size)
+		if err != nil {
+			return fmt.Errorf("error parsing size %q: %w", size, err)
+		}
+		if n <= 0 {
+			return fmt.Errorf("size %q must be positive", size)
+		}
+		o.Sizes = append(o.Sizes, n)
+	}
+
+	if pullRef != "" || pullRepository != "" {
+		config, err := configFactory(storePath)
+		if err != nil {
+			return fmt.Errorf("error getting client config: %w", err)
+		}
+		o.Pull = &bench.PullOptions{Config: config, Ref: pullRef, Repository: pullRepository}
+	}
+
+	if o.Dir == "" {
+		if err := os.MkdirAll(storePath, 0777); err != nil {
+			return fmt.Errorf("error creating store directory: %w", err)
+		}
+		tmp, err := os.MkdirTemp(storePath, ".bench-")
+		if err != nil {
+			return fmt.Errorf("error creating temporary directory: %w", err)
+		}
+		defer func() { _ = os.RemoveAll(tmp) }()
+		o.Dir = tmp
+	}
+
+	report, err := bench.Run(ctx, o)
+	if err != nil {
+		return err
+	}
+
+	if err := printReport(report, jsonOutput); err != nil {
+		return err
+	}
+
+	var failed int
+	for _, res := range report.Results {
+		if res.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d measurement(s) failed", failed)
+	}
+	return nil
+}
+
+func printReport(report *bench.Report, jsonOutput bool) error {
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	fmt.Printf("Version %s, %s, %d CPU(s), file system: %s\n", report.Version.Version, report.Version.Platform, report.CPUs, report.FileSystem)
+	w := tabwriter.NewWriter(os.Stdout, 12, 0, 1, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NAME\tSIZE\tITERATIONS\tTIME/OP\tTHROUGHPUT\tDETAILS")
+	for _, res := range report.Results {
+		details := res.Error
+		if details == "" {
+			keys := make([]string, 0, len(res.Details))
+			for key := range res.Details {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for i, key := range keys {
+				keys[i] = fmt.Sprintf("%s: %s", key, res.Details[key])
+			}
+			details = strings.Join(keys, ", ")
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s/s\t%s\n",
+			res.Name,
+			units.BytesSize(float64(res.Size)),
+			res.Iterations,
+			time.Duration(res.NsPerOp).Round(time.Microsecond),
+			units.BytesSize(res.BytesPerSecond),
+			details,
+		)
+	}
+	return w.Flush()
+}
@@ -16,23 +16,68 @@ package build
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/containerd/containerd/content"
+	"github.com/distribution/reference"
 	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/mediatypes"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/oci/store"
+	onmetalref "github.com/onmetal/onmetal-image/ref"
 
 	onmetalimage "github.com/onmetal/onmetal-image"
 
 	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/unpack"
 	"github.com/spf13/cobra"
 )
 
-func Command(storeFactory common.StoreFactory) *cobra.Command {
+func Command(storeFactory common.StoreFactory, registryFactory common.RemoteRegistryFactory, httpClientFactory common.HTTPClientFactory) *cobra.Command {
 	var (
 		tagName       string
 		rootFSPath    string
 		initRAMFSPath string
 		kernelPath    string
 		commandLine   string
+		ignitionPath  string
+		cloudInitPath string
+		ukiPath       string
+		espPath       string
+		bootMethod    string
+		defaultRootFS string
+
+		commandLineAppend []string
+
+		layerAnnotationExprs []string
+		layerFromImageExprs  []string
+		layerURLExprs        []string
+		layerExprs           []string
+		inputDigestExprs     []string
+
+		expiresIn time.Duration
+		expiresAt string
+
+		keepCompressed       bool
+		normalizeAnnotations bool
+		reproducible         bool
+		noCache              bool
+		fastCache            bool
+		allowHTTPInputs      bool
+		format               string
 	)
 
 	cmd := &cobra.Command{
@@ -40,52 +85,939 @@ func Command(storeFactory common.StoreFactory) *cobra.Command {
 		Short: "Build an image and store it to the local store with an optional tag.",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
-			return Run(ctx, storeFactory, tagName, rootFSPath, initRAMFSPath, kernelPath, commandLine)
+			if err := common.ValidateFormat(format); err != nil {
+				return err
+			}
+			info, _ := common.FormatOutputs(format, os.Stdout)
+			layerAnnotations, err := ParseLayerAnnotations(layerAnnotationExprs)
+			if err != nil {
+				return err
+			}
+			if normalizeAnnotations {
+				var changes []imageutil.AnnotationChange
+				if layerAnnotations, changes, err = layerAnnotations.Normalize(); err != nil {
+					return err
+				}
+				common.PrintAnnotationChanges(info, changes)
+			}
+			if err := layerAnnotations.Validate(); err != nil {
+				return err
+			}
+			fromImages, err := ParseLayersFromImages(layerFromImageExprs)
+			if err != nil {
+				return err
+			}
+			layerURLs, err := ParseLayerURLs(layerURLExprs)
+			if err != nil {
+				return err
+			}
+			roleLayers, err := ParseRoleLayers(layerExprs)
+			if err != nil {
+				return err
+			}
+			annotations, err := common.ExpiryAnnotations(time.Now(), expiresIn, expiresAt)
+			if err != nil {
+				return err
+			}
+			created, err := CreatedTime(time.Now(), reproducible)
+			if err != nil {
+				return err
+			}
+			commandLine := onmetalimage.AppendCommandLine(commandLine, commandLineAppend...)
+			if err := onmetalimage.ValidateCommandLine(commandLine); err != nil {
+				return err
+			}
+			provisioning := Provisioning{Path: ignitionPath, System: onmetalimage.ProvisioningIgnition}
+			if cloudInitPath != "" {
+				provisioning = Provisioning{Path: cloudInitPath, System: onmetalimage.ProvisioningCloudInit}
+			}
+			uefi := UEFI{Path: ukiPath, BootMethod: onmetalimage.BootMethod(bootMethod)}
+			if espPath != "" {
+				uefi.Path, uefi.ESP = espPath, true
+			}
+			digests, err := ParseInputDigests(inputDigestExprs)
+			if err != nil {
+				return err
+			}
+			inputs := &Inputs{
+				Stdin:             cmd.InOrStdin(),
+				HTTPClientFactory: httpClientFactory,
+				AllowHTTP:         allowHTTPInputs,
+				Digests:           digests,
+			}
+			cacheMode := CacheContent
+			switch {
+			case noCache:
+				cacheMode = CacheNone
+			case fastCache:
+				cacheMode = CacheStat
+			}
+			return Run(ctx, storeFactory, tagName, rootFSPath, initRAMFSPath, kernelPath, commandLine, provisioning, uefi, layerAnnotations, annotations, keepCompressed, fromImages, registryFactory, layerURLs, httpClientFactory, roleLayers, defaultRootFS, created, cacheMode, format, inputs)
 		},
 	}
 
 	cmd.Flags().StringVar(&tagName, "tag", "", "Optional tag of image.")
-	cmd.Flags().StringVar(&rootFSPath, "rootfs-file", "", "Path pointing to a root fs file.")
-	cmd.Flags().StringVar(&initRAMFSPath, "initramfs-file", "", "Path pointing to an initram fs file.")
-	cmd.Flags().StringVar(&kernelPath, "kernel-file", "", "Path pointing to a kernel file (usually ending with 'vmlinuz').")
+	cmd.Flags().StringVar(&format, common.RecommendedFormatFlagName, common.FormatText, common.RecommendedFormatFlagUsage)
+	_ = cmd.RegisterFlagCompletionFunc(common.RecommendedFormatFlagName, common.CompleteFixed(common.FormatText, common.FormatJSON, common.FormatPinned))
+	cmd.Flags().StringVar(&rootFSPath, "rootfs-file", "", "Path pointing to a root fs file, - to read it from stdin or an https URL to fetch it from.")
+	cmd.Flags().StringVar(&initRAMFSPath, "initramfs-file", "", "Path pointing to an initram fs file, - to read it from stdin or an https URL to fetch it from.")
+	cmd.Flags().StringVar(&kernelPath, "kernel-file", "", "Path pointing to a kernel file (usually ending with 'vmlinuz'), - to read it from stdin or an https URL to fetch it from.")
 	cmd.Flags().StringVar(&commandLine, "command-line", "", "Command line arguments to supply to the kernel.")
+	cmd.Flags().StringArrayVar(&commandLineAppend, "command-line-append", nil, "Arguments to append to --command-line. Can be specified multiple times.")
+	cmd.Flags().StringVar(&ignitionPath, "ignition", "", "Optional path to an ignition config to attach as provisioning layer.")
+	cmd.Flags().StringVar(&cloudInitPath, "cloud-init", "", "Optional path to cloud-init user-data to attach as provisioning layer.")
+	cmd.MarkFlagsMutuallyExclusive("ignition", "cloud-init")
+	cmd.Flags().StringVar(&ukiPath, "uki", "", "Optional path to a unified kernel image or EFI bootloader (PE/COFF EFI binary) to attach as uefi layer.")
+	cmd.Flags().StringVar(&espPath, "esp", "", "Optional path to an EFI system partition image (FAT) to attach as uefi layer.")
+	cmd.MarkFlagsMutuallyExclusive("uki", "esp")
+	cmd.Flags().StringVar(&bootMethod, "boot-method", "", "Boot method to record in the config. One of kernel, uki or esp. Defaults to uki or esp if --uki or --esp is given, the kernel and initramfs files are only required for kernel.")
+	cmd.Flags().StringArrayVar(&layerExprs, "layer", nil, "Additional layer in the form role=<role>,file=<path>, where role is rootfs, initramfs or kernel with a suffix, e.g. rootfs-a, or a registered custom layer kind, and path may be - or an https URL like for --rootfs-file. Layers are applied in the given order. Can be specified multiple times.")
+	cmd.Flags().StringVar(&defaultRootFS, "default-rootfs", "", "Role of the rootfs layer consumers use by default if the image has several, e.g. rootfs-a.")
+	cmd.Flags().StringArrayVar(&layerAnnotationExprs, "layer-annotation", nil, "Annotation to set on a layer in the form <layer>:<key>=<value>, where layer is one of rootfs, initramfs, kernel, ignition, cloud-init, uki, esp or the role of a --layer. Can be specified multiple times.")
+	cmd.Flags().StringArrayVar(&layerFromImageExprs, "layer-from-image", nil, "Layer to take verbatim from another image in the form <layer>=<image>, where layer is one of rootfs, initramfs or kernel. The image is resolved locally or else from its registry. Can be specified multiple times.")
+	cmd.Flags().StringArrayVar(&layerURLExprs, "layer-url", nil, "External URL to serve a layer from in the form <layer>=<url>, where layer is one of rootfs, initramfs or kernel. The content is streamed once to compute its digest and size, registries do not store it. Can be specified multiple times.")
+	cmd.Flags().StringArrayVar(&inputDigestExprs, "input-sha256", nil, "Expected sha256 digest of the input of a layer in the form <layer>=<hex>, where layer is one of rootfs, initramfs, kernel, ignition, cloud-init, uki, esp or the role of a --layer. The build fails without storing the layer if the input does not match. Can be specified multiple times.")
+	cmd.Flags().BoolVar(&allowHTTPInputs, "allow-http-inputs", false, "Allow fetching inputs from plain http URLs.")
+	cmd.Flags().DurationVar(&expiresIn, "expires-in", 0, "Duration after which the image expires (e.g. 168h). Expired images can be removed via prune.")
+	cmd.Flags().StringVar(&expiresAt, "expires-at", "", "Time in RFC 3339 format at which the image expires. Expired images can be removed via prune.")
+	cmd.Flags().BoolVar(&normalizeAnnotations, common.RecommendedNormalizeAnnotationsFlagName, false, common.RecommendedNormalizeAnnotationsFlagUsage)
+	cmd.Flags().BoolVar(&reproducible, "reproducible", false, "Record the time given by the SOURCE_DATE_EPOCH environment variable (seconds since the Unix epoch) as created time of the image instead of the build time.")
+	cmd.Flags().BoolVar(&keepCompressed, "keep-compressed", false, "Store gzip, zstd or xz compressed rootfs, initramfs, kernel and provisioning files as-is with a compression suffix on their media type instead of decompressing them.")
+	cmd.Flags().BoolVar(&noCache, "no-cache", false, "Do not reuse layers previous builds produced of the same input files, and do not record the layers of this build.")
+	cmd.Flags().BoolVar(&fastCache, "fast-cache", false, "Identify unchanged input files by their path, size and modification time instead of hashing their content when looking up the build cache.")
+	cmd.MarkFlagsMutuallyExclusive("no-cache", "fast-cache")
+	_ = cmd.RegisterFlagCompletionFunc("boot-method", common.CompleteFixed(
+		string(onmetalimage.BootMethodKernel), string(onmetalimage.BootMethodUKI), string(onmetalimage.BootMethodESP),
+	))
 
 	return cmd
 }
 
+// LayerAnnotations maps a layer name (rootfs, initramfs, kernel, ignition, cloud-init) or the role of a
+// RoleLayer to the annotations to set on it.
+type LayerAnnotations map[string]map[string]string
+
+// Provisioning is the optional provisioning config to attach to the image.
+type Provisioning struct {
+	// Path is the path of the config file. If empty, no provisioning layer is attached.
+	Path string
+	// System is the provisioning system the config is for.
+	System onmetalimage.Provisioning
+}
+
+// UEFI is the optional UEFI payload to attach to the image.
+type UEFI struct {
+	// Path is the path of the unified kernel image or EFI system partition image. If empty, no UEFI
+	// layer is attached.
+	Path string
+	// ESP denotes that the file is an EFI system partition image instead of a unified kernel image.
+	ESP bool
+	// BootMethod is the boot method to record in the config. If empty, it is derived from the payload.
+	BootMethod onmetalimage.BootMethod
+}
+
+// name returns the layer name of the payload.
+func (u UEFI) name() string {
+	if u.ESP {
+		return "esp"
+	}
+	return "uki"
+}
+
+// bootMethod returns the boot method to record in the config, checking it matches the payload.
+func (u UEFI) bootMethod() (onmetalimage.BootMethod, error) {
+	method := u.BootMethod
+	if method == "" && u.Path != "" {
+		method = onmetalimage.BootMethodUKI
+		if u.ESP {
+			method = onmetalimage.BootMethodESP
+		}
+	}
+
+	switch method {
+	case "", onmetalimage.BootMethodKernel:
+	case onmetalimage.BootMethodUKI:
+		if u.Path == "" || u.ESP {
+			return "", fmt.Errorf("boot method %s requires --uki", method)
+		}
+	case onmetalimage.BootMethodESP:
+		if u.Path == "" || !u.ESP {
+			return "", fmt.Errorf("boot method %s requires --esp", method)
+		}
+	default:
+		return "", fmt.Errorf("unknown boot method %q", method)
+	}
+	return method, nil
+}
+
+// validateRoleLayers checks that the default rootfs names one of the rootfs layers and warns if there
+// are several without one. It returns the kinds given with explicit roles.
+func validateRoleLayers(roleLayers []RoleLayer, defaultRootFS string, hasRootFS bool) (map[string]bool, error) {
+	var (
+		kinds   = make(map[string]bool)
+		rootFSs []string
+	)
+	if hasRootFS {
+		rootFSs = append(rootFSs, "rootfs")
+	}
+	for _, l := range roleLayers {
+		kind, _ := onmetalimage.RoleKind(l.Role)
+		kinds[kind] = true
+		if kind == "rootfs" {
+			if l.Role == "rootfs" && hasRootFS {
+				return nil, fmt.Errorf("--layer role=rootfs and --rootfs-file are mutually exclusive")
+			}
+			rootFSs = append(rootFSs, l.Role)
+		}
+	}
+
+	switch {
+	case defaultRootFS != "":
+		for _, role := range rootFSs {
+			if role == defaultRootFS {
+				return kinds, nil
+			}
+		}
+		return nil, fmt.Errorf("default rootfs %s is none of the rootfs layers %s", defaultRootFS, strings.Join(rootFSs, ", "))
+	case len(rootFSs) > 1:
+		fmt.Fprintf(os.Stderr, "Warning: the image has several rootfs layers (%s) but no --default-rootfs, consumers expecting a single rootfs use the last one\n", strings.Join(rootFSs, ", "))
+	}
+	return kinds, nil
+}
+
+// validateUEFI checks that the file at the given path is a PE/COFF EFI binary or, for an ESP, a FAT image.
+func validateUEFI(uefi UEFI) error {
+	f, err := os.Open(uefi.Path)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	return uefi.validate(f)
+}
+
+// validateUEFILayer checks the stored layer of a streamed UEFI input like validateUEFI, since streamed
+// inputs can only be read once.
+func validateUEFILayer(ctx context.Context, store content.Store, uefi UEFI, layer image.Layer) error {
+	ra, err := store.ReaderAt(ctx, layer.Descriptor())
+	if err != nil {
+		return fmt.Errorf("error opening layer: %w", err)
+	}
+	defer func() { _ = ra.Close() }()
+
+	return uefi.validate(ra)
+}
+
+func (u UEFI) validate(r io.ReaderAt) error {
+	if u.ESP {
+		return onmetalimage.ValidateESP(r)
+	}
+	return onmetalimage.ValidateUKI(r)
+}
+
+// layerNames returns the names of the layers with annotations in order.
+func (a LayerAnnotations) layerNames() []string {
+	names := make([]string, 0, len(a))
+	for name := range a {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate validates the annotations of all layers at once, see imageutil.ValidateAnnotations.
+func (a LayerAnnotations) Validate() error {
+	var invalid []imageutil.InvalidAnnotation
+	for _, name := range a.layerNames() {
+		var invalidErr *imageutil.InvalidAnnotationsError
+		if err := imageutil.ValidateAnnotations(a[name]); errors.As(err, &invalidErr) {
+			for _, annotation := range invalidErr.Annotations {
+				annotation.Scope = name + " layer"
+				invalid = append(invalid, annotation)
+			}
+		}
+	}
+	if len(invalid) > 0 {
+		return &imageutil.InvalidAnnotationsError{Annotations: invalid}
+	}
+	return nil
+}
+
+// Normalize returns a copy with the annotations of all layers normalized, see imageutil.NormalizeAnnotations.
+func (a LayerAnnotations) Normalize() (LayerAnnotations, []imageutil.AnnotationChange, error) {
+	var (
+		res     = make(LayerAnnotations, len(a))
+		changes []imageutil.AnnotationChange
+	)
+	for _, name := range a.layerNames() {
+		annotations, layerChanges, err := imageutil.NormalizeAnnotations(a[name])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s layer: %w", name, err)
+		}
+		for _, change := range layerChanges {
+			change.Scope = name + " layer"
+			changes = append(changes, change)
+		}
+		res[name] = annotations
+	}
+	return res, changes, nil
+}
+
+// ParseLayerAnnotations parses expressions of the form <layer>:<key>=<value> into LayerAnnotations.
+func ParseLayerAnnotations(exprs []string) (LayerAnnotations, error) {
+	res := make(LayerAnnotations)
+	for _, expr := range exprs {
+		layer, keyValue, ok := strings.Cut(expr, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid layer annotation %q: expected <layer>:<key>=<value>", expr)
+		}
+		if _, ok := onmetalimage.RoleKind(layer); !ok {
+			return nil, fmt.Errorf("invalid layer annotation %q: unknown layer %q", expr, layer)
+		}
+
+		key, value, err := common.ParseKeyValue(keyValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid layer annotation %q: %w", expr, err)
+		}
+
+		if res[layer] == nil {
+			res[layer] = make(map[string]string)
+		}
+		res[layer][key] = value
+	}
+	return res, nil
+}
+
+// sourceLayerNames are the layers that can be taken from other images or external URLs instead of files.
+var sourceLayerNames = map[string]struct{}{
+	"rootfs":    {},
+	"initramfs": {},
+	"kernel":    {},
+}
+
+// parseLayerSources parses expressions of the form <layer>=<value> into a map of layer name to value.
+// what names the kind of value in error messages.
+func parseLayerSources(exprs []string, what string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, expr := range exprs {
+		layer, value, err := common.ParseKeyValue(expr)
+		if err != nil || value == "" {
+			return nil, fmt.Errorf("invalid layer %s %q: expected <layer>=<%s>", what, expr, what)
+		}
+		if _, ok := sourceLayerNames[layer]; !ok {
+			return nil, fmt.Errorf("invalid layer %s %q: layer must be one of rootfs, initramfs or kernel", what, expr)
+		}
+		if _, ok := res[layer]; ok {
+			return nil, fmt.Errorf("invalid layer %s %q: %s layer specified multiple times", what, expr, layer)
+		}
+		res[layer] = value
+	}
+	return res, nil
+}
+
+// RoleLayer is an additional layer of the image with an explicit role, see onmetalimage.RoleAnnotation.
+type RoleLayer struct {
+	// Role is the role of the layer, e.g. rootfs-a.
+	Role string
+	// Path is the path of the file to ingest.
+	Path string
+}
+
+// ParseRoleLayers parses expressions of the form role=<role>,file=<path> into RoleLayers, keeping their
+// order. Roles must be of kind rootfs, initramfs or kernel or of a custom layer kind registered via
+// mediatypes.Register.
+func ParseRoleLayers(exprs []string) ([]RoleLayer, error) {
+	var (
+		res  []RoleLayer
+		seen = make(map[string]bool)
+	)
+	for _, expr := range exprs {
+		var layer RoleLayer
+		for _, part := range strings.Split(expr, ",") {
+			key, value, err := common.ParseKeyValue(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid layer %q: expected role=<role>,file=<path>", expr)
+			}
+			switch key {
+			case "role":
+				layer.Role = value
+			case "file":
+				layer.Path = value
+			default:
+				return nil, fmt.Errorf("invalid layer %q: unknown key %q", expr, key)
+			}
+		}
+		if layer.Role == "" || layer.Path == "" {
+			return nil, fmt.Errorf("invalid layer %q: expected role=<role>,file=<path>", expr)
+		}
+		kind, _ := onmetalimage.RoleKind(layer.Role)
+		info, _ := mediatypes.LookupRole(kind)
+		if _, ok := sourceLayerNames[kind]; !ok && (info.Role == "" || mediatypes.IsBuiltin(info.MediaType)) {
+			return nil, fmt.Errorf("invalid layer %q: role must be of kind rootfs, initramfs, kernel or of a registered custom layer kind", expr)
+		}
+		if seen[layer.Role] {
+			return nil, fmt.Errorf("invalid layer %q: %s layer specified multiple times", expr, layer.Role)
+		}
+		seen[layer.Role] = true
+		res = append(res, layer)
+	}
+	return res, nil
+}
+
+// ParseLayersFromImages parses expressions of the form <layer>=<image> into a map of layer name to the
+// image to take the layer from.
+func ParseLayersFromImages(exprs []string) (map[string]string, error) {
+	return parseLayerSources(exprs, "image")
+}
+
+// ParseLayerURLs parses expressions of the form <layer>=<url> into a map of layer name to the external
+// http(s) URL to serve the layer from.
+func ParseLayerURLs(exprs []string) (map[string]string, error) {
+	res, err := parseLayerSources(exprs, "url")
+	if err != nil {
+		return nil, err
+	}
+	for layer, rawURL := range res {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid %s layer url %q: must be an absolute http(s) url", layer, rawURL)
+		}
+	}
+	return res, nil
+}
+
+// ingestURLLayer streams the content at the external URL into the store verbatim as layer of the given
+// media type, with a compression suffix if it is compressed. The returned layer carries the URL, so
+// pushes skip its blob and pulls fetch it from there.
+func ingestURLLayer(
+	ctx context.Context,
+	info io.Writer,
+	client *http.Client,
+	store content.Store,
+	tx *layout.Transaction,
+	name, rawURL, mediaType string,
+	annotations map[string]string,
+) (image.Layer, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s: %w", rawURL, err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("erroneous response status: %s for url %s", res.Status, rawURL)
+	}
+
+	// The content has to be stored as served, as pulls verify it against the digest.
+	r, compression, err := unpack.DetectCompression(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error detecting compression: %w", err)
+	}
+	if compression != unpack.CompressionNone {
+		mediaType += compressionMediaTypeSuffixes[compression]
+		fmt.Fprintf(info, "Using %s compressed %s url %s as-is with media type %s\n", compression, name, rawURL, mediaType)
+	}
+
+	ref := fmt.Sprintf("build-%s-url-%d", name, time.Now().UnixNano())
+	layer, err := ingestLayer(ctx, store, tx, name, ref, r, res.ContentLength, compression,
+		imageutil.WithMediaType(mediaType),
+		imageutil.WithAnnotations(annotations),
+	)
+	if err != nil {
+		return nil, err
+	}
+	desc := layer.Descriptor()
+	desc.URLs = []string{rawURL}
+	return ocicontent.Layer(store, desc), nil
+}
+
+// resolveSourceImage resolves the image to take a layer from, preferring the local store over the
+// registry. It also returns the digest-pinned reference of the image.
+func resolveSourceImage(ctx context.Context, s *store.Store, registryFactory common.RemoteRegistryFactory, srcRef string) (image.Image, string, error) {
+	resolved, err := common.FuzzyResolveRef(ctx, s, srcRef)
+	if err != nil {
+		return nil, "", err
+	}
+
+	img, err := s.Resolve(ctx, resolved)
+	if errors.Is(err, indexer.ErrNotFound) {
+		registry, err := registryFactory()
+		if err != nil {
+			return nil, "", fmt.Errorf("could not create remote registry: %w", err)
+		}
+		if img, err = registry.Resolve(ctx, resolved); err != nil {
+			return nil, "", fmt.Errorf("error resolving %s: %w", srcRef, err)
+		}
+	} else if err != nil {
+		return nil, "", fmt.Errorf("error resolving %s: %w", srcRef, err)
+	}
+
+	dgst := img.Descriptor().Digest
+	named, err := onmetalref.ParseNamed(resolved)
+	if err != nil {
+		// An image id of the local store, there is no name to record.
+		return img, dgst.String(), nil
+	}
+	pinned, err := reference.WithDigest(named, dgst)
+	if err != nil {
+		return nil, "", err
+	}
+	return img, pinned.String(), nil
+}
+
+// sameReference reports whether the source reference denotes the target image, i.e. has the same name
+// and tag.
+func sameReference(target reference.Named, source string) bool {
+	named, err := reference.ParseNamed(source)
+	if err != nil {
+		return false
+	}
+	tagged, ok := named.(reference.Tagged)
+	targetTagged, targetOK := target.(reference.Tagged)
+	return named.Name() == target.Name() && ok && targetOK && tagged.Tag() == targetTagged.Tag()
+}
+
+// layerFromImage returns the layer with the given name and media type of the image srcRef verbatim,
+// together with the chain of images the layer was taken from, nearest first. The chain must not contain
+// the image being built, target.
+func layerFromImage(
+	ctx context.Context,
+	s *store.Store,
+	registryFactory common.RemoteRegistryFactory,
+	target, srcRef, name, mediaType string,
+) (image.Layer, []string, error) {
+	img, pinned, err := resolveSourceImage(ctx, s, registryFactory, srcRef)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest, err := image.Access(img, image.DefaultLimits).Manifest(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting manifest of %s: %w", srcRef, err)
+	}
+	if manifest.Config.MediaType != onmetalimage.ConfigMediaType {
+		return nil, nil, fmt.Errorf("%s is no onmetal image (config media type %s)", srcRef, manifest.Config.MediaType)
+	}
+
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting layers of %s: %w", srcRef, err)
+	}
+	var layer image.Layer
+	for _, l := range layers {
+		if onmetalimage.LayerMediaType(l.Descriptor().MediaType) == mediaType {
+			layer = l
+			break
+		}
+	}
+	if layer == nil {
+		return nil, nil, fmt.Errorf("%s has no %s layer", srcRef, name)
+	}
+
+	sources, err := imageutil.ParseLayerSources(manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting layer sources of %s: %w", srcRef, err)
+	}
+	chain := append([]string{pinned}, sources[layer.Descriptor().Digest]...)
+
+	if target != "" {
+		targetNamed, err := onmetalref.ParseNamed(target)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, source := range chain {
+			if sameReference(targetNamed, source) {
+				return nil, nil, fmt.Errorf("circular reference: %s layer of %s would be taken from itself via %s", name, targetNamed, strings.Join(chain, " <- "))
+			}
+		}
+	}
+	return layer, chain, nil
+}
+
+// ingestFileLayer streams the input at the given path directly into the store as layer of the given media
+// type, unless the build cache has a layer of it.
+func ingestFileLayer(
+	ctx context.Context,
+	store content.Store,
+	tx *layout.Transaction,
+	inputs *Inputs,
+	cache *buildCache,
+	name, path, mediaType string,
+	annotations map[string]string,
+) (image.Layer, error) {
+	if isStreamed(path) {
+		cache = nil
+	}
+	key, cached, err := cache.lookup(ctx, store, name, path, layout.BuildCacheKey{MediaType: mediaType}, annotations)
+	if err != nil || cached != nil {
+		return cached, err
+	}
+
+	r, source, err := inputs.Open(ctx, name, path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+
+	layer, err := ingestLayer(ctx, store, tx, name, ingestRef(name, path), r, inputSize(path), unpack.CompressionNone,
+		imageutil.WithMediaType(mediaType),
+		imageutil.WithAnnotations(withInputSource(annotations, source)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	cache.add(ctx, key, layer)
+	return layer, nil
+}
+
+// ingestRef returns the ingest ref to stream the input of the named layer at path into the store with.
+func ingestRef(name, path string) string {
+	if isStreamed(path) {
+		return fmt.Sprintf("build-%s-input-%d", name, time.Now().UnixNano())
+	}
+	return fmt.Sprintf("build-%s-%d", filepath.Base(path), time.Now().UnixNano())
+}
+
+// withInputSource returns the annotations with the imageutil.InputSourceAnnotation set to source, if
+// not empty. The given annotations are not modified.
+func withInputSource(annotations map[string]string, source string) map[string]string {
+	if source == "" {
+		return annotations
+	}
+	res := make(map[string]string, len(annotations)+1)
+	for k, v := range annotations {
+		res[k] = v
+	}
+	res[imageutil.InputSourceAnnotation] = source
+	return res
+}
+
+// compressionMediaTypeSuffixes maps the compressions of input files to the suffix of their media type
+// when kept compressed.
+var compressionMediaTypeSuffixes = map[unpack.Compression]string{
+	unpack.CompressionGzip: onmetalimage.GzipMediaTypeSuffix,
+	unpack.CompressionZstd: onmetalimage.ZstdMediaTypeSuffix,
+	unpack.CompressionXz:   onmetalimage.XzMediaTypeSuffix,
+}
+
+// ingestInputLayer streams the input at the given path into the store as layer of the given media type,
+// decompressing it on the fly if it is compressed. If keepCompressed is set, compressed files are stored
+// as-is with a compression suffix on the media type instead. The digest and size of the returned layer
+// always reflect the stored content. Layers found in the build cache are neither decompressed nor stored
+// again. Streamed inputs (see Inputs) bypass the build cache.
+func ingestInputLayer(
+	ctx context.Context,
+	info io.Writer,
+	store content.Store,
+	tx *layout.Transaction,
+	inputs *Inputs,
+	cache *buildCache,
+	name, path, mediaType string,
+	keepCompressed bool,
+	annotations map[string]string,
+) (image.Layer, error) {
+	if isStreamed(path) {
+		cache = nil
+	}
+	in, source, err := inputs.Open(ctx, name, path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = in.Close() }()
+	annotations = withInputSource(annotations, source)
+
+	r, compression, err := unpack.DetectCompression(in)
+	if err != nil {
+		return nil, fmt.Errorf("error detecting compression: %w", err)
+	}
+
+	// Uncompressed files are stored as-is either way.
+	key, cached, err := cache.lookup(ctx, store, name, path, layout.BuildCacheKey{
+		MediaType:      mediaType,
+		Compression:    string(compression),
+		KeepCompressed: keepCompressed && compression != unpack.CompressionNone,
+	}, annotations)
+	if err != nil || cached != nil {
+		return cached, err
+	}
+
+	size := inputSize(path)
+	switch {
+	case compression == unpack.CompressionNone:
+	case keepCompressed:
+		mediaType += compressionMediaTypeSuffixes[compression]
+		fmt.Fprintf(info, "Storing %s compressed %s file %s as-is with media type %s\n", compression, name, path, mediaType)
+	case compression == unpack.CompressionXz:
+		return nil, fmt.Errorf("%s file %s is xz compressed, which cannot be decompressed: decompress it beforehand or use --keep-compressed", name, path)
+	default:
+		fmt.Fprintf(info, "Decompressing %s compressed %s file %s\n", compression, name, path)
+		rc, err := unpack.Decompress(r)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing %s file: %w", name, err)
+		}
+		defer func() { _ = rc.Close() }()
+		r, size = rc, -1
+	}
+
+	if !keepCompressed {
+		compression = unpack.CompressionNone
+	}
+	layer, err := ingestLayer(ctx, store, tx, name, ingestRef(name, path), r, size, compression,
+		imageutil.WithMediaType(mediaType),
+		imageutil.WithAnnotations(annotations),
+	)
+	if err != nil {
+		return nil, err
+	}
+	cache.add(ctx, key, layer)
+	return layer, nil
+}
+
+// SourceDateEpochEnv is the environment variable reproducible builds take the created time of the image from,
+// see https://reproducible-builds.org/specs/source-date-epoch/.
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// CreatedTime returns the created time to record for an image built at now. For reproducible builds, it is
+// the time given by SourceDateEpochEnv, which then has to be set.
+func CreatedTime(now time.Time, reproducible bool) (time.Time, error) {
+	if !reproducible {
+		return now, nil
+	}
+	v, ok := os.LookupEnv(SourceDateEpochEnv)
+	if !ok || v == "" {
+		return time.Time{}, fmt.Errorf("--reproducible requires %s to be set", SourceDateEpochEnv)
+	}
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || secs < 0 {
+		return time.Time{}, fmt.Errorf("invalid %s %q, expected seconds since the Unix epoch", SourceDateEpochEnv, v)
+	}
+	return time.Unix(secs, 0), nil
+}
+
 func Run(
 	ctx context.Context,
 	storeFactory common.StoreFactory,
 	ref, rootFSPath, initRAMFSPath, kernelPath, commandLine string,
+	provisioning Provisioning,
+	uefi UEFI,
+	layerAnnotations LayerAnnotations,
+	annotations map[string]string,
+	keepCompressed bool,
+	fromImages map[string]string,
+	registryFactory common.RemoteRegistryFactory,
+	layerURLs map[string]string,
+	httpClientFactory common.HTTPClientFactory,
+	roleLayers []RoleLayer,
+	defaultRootFS string,
+	created time.Time,
+	cacheMode CacheMode,
+	format string,
+	inputs *Inputs,
 ) error {
+	if format == common.FormatPinned && ref == "" {
+		return fmt.Errorf("--%s %s requires --tag", common.RecommendedFormatFlagName, common.FormatPinned)
+	}
+	info, result := common.FormatOutputs(format, os.Stdout)
+
+	bootMethod, err := uefi.bootMethod()
+	if err != nil {
+		return err
+	}
+	for name := range layerURLs {
+		if _, ok := fromImages[name]; ok {
+			return fmt.Errorf("--layer-url %s and --layer-from-image %s are mutually exclusive", name, name)
+		}
+	}
+	paths := map[string]string{
+		"rootfs":                    rootFSPath,
+		"initramfs":                 initRAMFSPath,
+		"kernel":                    kernelPath,
+		string(provisioning.System): provisioning.Path,
+		uefi.name():                 uefi.Path,
+	}
+	for _, l := range roleLayers {
+		paths[l.Role] = l.Path
+	}
+	if err := inputs.Validate(paths); err != nil {
+		return err
+	}
+	if uefi.Path != "" && !isStreamed(uefi.Path) {
+		if err := validateUEFI(uefi); err != nil {
+			return fmt.Errorf("invalid %s file %s: %w", uefi.name(), uefi.Path, err)
+		}
+	}
+	roleKinds, err := validateRoleLayers(roleLayers, defaultRootFS, rootFSPath != "" || fromImages["rootfs"] != "" || layerURLs["rootfs"] != "")
+	if err != nil {
+		return err
+	}
+
 	s, err := storeFactory()
 	if err != nil {
 		return fmt.Errorf("could not create store: %w", err)
 	}
 
+	// The layers are ingested within a transaction, so their blobs are removed again if the build fails.
+	tx := s.Layout().Begin(ctx)
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var (
+		store   = s.Layout().Store()
+		cache   = newBuildCache(s.Layout(), cacheMode)
+		layers  = make([]image.Layer, 0, 3)
+		sources imageutil.LayerSources
+	)
+	for _, l := range []struct {
+		name      string
+		path      string
+		mediaType string
+	}{
+		{"rootfs", rootFSPath, onmetalimage.RootFSLayerMediaType},
+		{"initramfs", initRAMFSPath, onmetalimage.InitRAMFSLayerMediaType},
+		{"kernel", kernelPath, onmetalimage.KernelLayerMediaType},
+	} {
+		if srcRef, ok := fromImages[l.name]; ok {
+			if l.path != "" {
+				return fmt.Errorf("--%s-file and --layer-from-image %s=%s are mutually exclusive", l.name, l.name, srcRef)
+			}
+			if len(layerAnnotations[l.name]) > 0 {
+				return fmt.Errorf("cannot set annotations on %s layer taken verbatim from %s", l.name, srcRef)
+			}
+			layer, chain, err := layerFromImage(ctx, s, registryFactory, ref, srcRef, l.name, l.mediaType)
+			if err != nil {
+				return fmt.Errorf("error getting %s layer from image: %w", l.name, err)
+			}
+			fmt.Fprintf(info, "Using %s layer %s of %s\n", l.name, layer.Descriptor().Digest, chain[0])
+			if sources == nil {
+				sources = make(imageutil.LayerSources)
+			}
+			sources[layer.Descriptor().Digest] = chain
+			layers = append(layers, layer)
+			continue
+		}
+		if rawURL, ok := layerURLs[l.name]; ok {
+			if l.path != "" {
+				return fmt.Errorf("--%s-file and --layer-url %s=%s are mutually exclusive", l.name, l.name, rawURL)
+			}
+			client, err := httpClientFactory()
+			if err != nil {
+				return fmt.Errorf("could not create http client: %w", err)
+			}
+			layer, err := ingestURLLayer(ctx, info, client, store, tx, l.name, rawURL, l.mediaType, layerAnnotations[l.name])
+			if err != nil {
+				return fmt.Errorf("error ingesting %s layer from url: %w", l.name, err)
+			}
+			layers = append(layers, layer)
+			continue
+		}
+		// The kernel and initramfs are bundled into the UEFI payload if it is booted.
+		if l.path == "" && l.name != "rootfs" && bootMethod != "" && bootMethod != onmetalimage.BootMethodKernel {
+			continue
+		}
+		// The layers of this kind are given with explicit roles only.
+		if l.path == "" && roleKinds[l.name] {
+			continue
+		}
+		layer, err := ingestInputLayer(ctx, info, store, tx, inputs, cache, l.name, l.path, l.mediaType, keepCompressed, layerAnnotations[l.name])
+		if err != nil {
+			return fmt.Errorf("error ingesting %s layer: %w", l.name, err)
+		}
+		layers = append(layers, layer)
+	}
+	for _, l := range roleLayers {
+		kind, _ := onmetalimage.RoleKind(l.Role)
+		mediaTypeInfo, _ := mediatypes.LookupRole(kind)
+		annotations := map[string]string{onmetalimage.RoleAnnotation: l.Role}
+		for key, value := range layerAnnotations[l.Role] {
+			annotations[key] = value
+		}
+		var layer image.Layer
+		if mediaTypeInfo.Compressed {
+			layer, err = ingestInputLayer(ctx, info, store, tx, inputs, cache, l.Role, l.Path, mediaTypeInfo.MediaType, keepCompressed, annotations)
+		} else {
+			layer, err = ingestFileLayer(ctx, store, tx, inputs, cache, l.Role, l.Path, mediaTypeInfo.MediaType, annotations)
+		}
+		if err != nil {
+			return fmt.Errorf("error ingesting %s layer: %w", l.Role, err)
+		}
+		layers = append(layers, layer)
+	}
+
+	created = created.UTC()
+	config := &onmetalimage.Config{SchemaVersion: onmetalimage.ConfigSchemaVersion, CommandLine: commandLine, BootMethod: bootMethod, DefaultRootFS: defaultRootFS, Created: &created}
+	if provisioning.Path != "" {
+		mediaType, ok := onmetalimage.ProvisioningLayerMediaType(provisioning.System)
+		if !ok {
+			return fmt.Errorf("unknown provisioning system %q", provisioning.System)
+		}
+		layer, err := ingestInputLayer(ctx, info, store, tx, inputs, cache, string(provisioning.System), provisioning.Path, mediaType, keepCompressed, layerAnnotations[string(provisioning.System)])
+		if err != nil {
+			return fmt.Errorf("error ingesting %s layer: %w", provisioning.System, err)
+		}
+		layers = append(layers, layer)
+		config.Provisioning = provisioning.System
+	}
+
+	if uefi.Path != "" {
+		mediaType := onmetalimage.UKILayerMediaType
+		if uefi.ESP {
+			mediaType = onmetalimage.ESPLayerMediaType
+		}
+		layer, err := ingestFileLayer(ctx, store, tx, inputs, cache, uefi.name(), uefi.Path, mediaType, layerAnnotations[uefi.name()])
+		if err != nil {
+			return fmt.Errorf("error ingesting %s layer: %w", uefi.name(), err)
+		}
+		if isStreamed(uefi.Path) {
+			if err := validateUEFILayer(ctx, store, uefi, layer); err != nil {
+				return fmt.Errorf("invalid %s input %s: %w", uefi.name(), uefi.Path, err)
+			}
+		}
+		layers = append(layers, layer)
+	}
+
+	if err := onmetalimage.ValidateConfig(config); err != nil {
+		return err
+	}
+
+	sourceAnnotations, err := sources.Annotations()
+	if err != nil {
+		return err
+	}
+
 	img, err :=
 		imageutil.NewJSONConfigBuilder(
-			&onmetalimage.Config{CommandLine: commandLine},
+			config,
 			imageutil.WithMediaType(onmetalimage.ConfigMediaType),
 		).
-			FileLayer(rootFSPath, imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType)).
-			FileLayer(initRAMFSPath, imageutil.WithMediaType(onmetalimage.InitRAMFSLayerMediaType)).
-			FileLayer(kernelPath, imageutil.WithMediaType(onmetalimage.KernelLayerMediaType)).
+			Layers(layers...).
+			Annotations(annotations).
+			Annotations(sourceAnnotations).
 			Complete()
 	if err != nil {
 		return fmt.Errorf("error building image: %w", err)
 	}
 
+	cache.printSummary(info)
 	if ref != "" {
 		if err := s.Push(ctx, ref, img); err != nil {
 			return fmt.Errorf("error pushing to ref %s: %w", ref, err)
 		}
-		fmt.Println("Successfully built", ref, img.Descriptor().Digest.Encoded())
+		fmt.Fprintln(info, "Successfully built", ref, img.Descriptor().Digest.Encoded())
 	} else {
 		if err := s.Put(ctx, img); err != nil {
 			return fmt.Errorf("error putting image: %w", err)
 		}
-		fmt.Println("Successfully built", img.Descriptor().Digest.Encoded())
+		fmt.Fprintln(info, "Successfully built", img.Descriptor().Digest.Encoded())
 	}
-	return nil
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	pinned, err := common.NewPinnedResult(s.Parser(), ref, img.Descriptor().Digest)
+	if err != nil {
+		return err
+	}
+	return common.PrintPinned(result, format, pinned)
 }
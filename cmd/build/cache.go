@@ -0,0 +1,162 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/opencontainers/go-digest"
+)
+
+// CacheMode is how build looks up the layers produced of input files by previous builds, see
+// layout.Layout.LookupBuildCache.
+type CacheMode string
+
+const (
+	// CacheContent keys layers by the digest of their input file. Input files are still hashed, but not
+	// decompressed and stored again.
+	CacheContent CacheMode = "content"
+	// CacheStat keys layers by the path, size and modification time of their input file, so unchanged
+	// input files are not even read. Only use it if files are never modified in place keeping these.
+	CacheStat CacheMode = "stat"
+	// CacheNone bypasses the build cache.
+	CacheNone CacheMode = "none"
+)
+
+// buildCache looks up and records the layers of input files in the build cache of the store. A nil
+// buildCache bypasses the cache.
+type buildCache struct {
+	layout *layout.Layout
+	mode   CacheMode
+	// layers are the names of the layers looked up.
+	layers []string
+	// hits are the names of the layers found in the cache.
+	hits []string
+}
+
+func newBuildCache(l *layout.Layout, mode CacheMode) *buildCache {
+	if mode == CacheNone {
+		return nil
+	}
+	return &buildCache{layout: l, mode: mode}
+}
+
+// source identifies the content of the input file at path according to the cache mode.
+func (c *buildCache) source(path string) (string, error) {
+	if c.mode == CacheStat {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return "", err
+		}
+		fi, err := os.Stat(abs)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("stat:%s:%d:%d:%s", abs, fi.Size(), fi.ModTime().UnixNano(), fi.Mode()), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	dgst, err := digest.FromReader(f)
+	if err != nil {
+		return "", err
+	}
+	return dgst.String(), nil
+}
+
+// lookup completes the key with the source of the input file at path and looks it up. On a hit, it returns
+// the cached layer with the given annotations.
+func (c *buildCache) lookup(
+	ctx context.Context,
+	store content.Store,
+	name, path string,
+	key layout.BuildCacheKey,
+	annotations map[string]string,
+) (layout.BuildCacheKey, image.Layer, error) {
+	if c == nil {
+		return key, nil, nil
+	}
+	c.layers = append(c.layers, name)
+
+	source, err := c.source(path)
+	if err != nil {
+		return key, nil, fmt.Errorf("error determining build cache key of %s file: %w", name, err)
+	}
+	key.Source = source
+
+	desc, ok, err := c.layout.LookupBuildCache(ctx, key)
+	if err != nil || !ok {
+		return key, nil, err
+	}
+	c.hits = append(c.hits, name)
+	if len(annotations) > 0 {
+		merged := make(map[string]string, len(desc.Annotations)+len(annotations))
+		for k, v := range desc.Annotations {
+			merged[k] = v
+		}
+		for k, v := range annotations {
+			merged[k] = v
+		}
+		desc.Annotations = merged
+	}
+	return key, ocicontent.Layer(store, desc), nil
+}
+
+// add records the layer produced for the key, without the annotations given by the user. Failing to
+// record it only warns, the build itself succeeded.
+func (c *buildCache) add(ctx context.Context, key layout.BuildCacheKey, layer image.Layer) {
+	if c == nil {
+		return
+	}
+	desc := layer.Descriptor()
+	var annotations map[string]string
+	for _, k := range []string{onmetalimage.UncompressedSizeAnnotation, onmetalimage.DiffIDAnnotation} {
+		if v, ok := desc.Annotations[k]; ok {
+			if annotations == nil {
+				annotations = make(map[string]string)
+			}
+			annotations[k] = v
+		}
+	}
+	desc.Annotations = annotations
+	if err := c.layout.AddBuildCache(ctx, key, desc); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: error recording layer in build cache: %v\n", err)
+	}
+}
+
+// printSummary prints which layers were found in the cache.
+func (c *buildCache) printSummary(out io.Writer) {
+	if c == nil || len(c.layers) == 0 {
+		return
+	}
+	if len(c.hits) == 0 {
+		fmt.Fprintf(out, "Build cache: 0 of %d layer(s) cached\n", len(c.layers))
+		return
+	}
+	fmt.Fprintf(out, "Build cache: %d of %d layer(s) cached (%s)\n", len(c.hits), len(c.layers), strings.Join(c.hits, ", "))
+}
@@ -0,0 +1,296 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// StdinInput is the input path denoting the content of stdin.
+const StdinInput = "-"
+
+const (
+	// maxInputResumes is how often reading a URL input is resumed after the connection failed.
+	maxInputResumes = 5
+	// inputResumeBackoff is the delay before the first resume of a URL input, growing linearly.
+	inputResumeBackoff = 500 * time.Millisecond
+)
+
+// Inputs opens the input files of a build. Besides local files, inputs may be StdinInput (for at most one
+// layer) and http(s) URLs, which are streamed into the store without touching the disk otherwise.
+type Inputs struct {
+	// Stdin is read for the StdinInput.
+	Stdin io.Reader
+	// HTTPClientFactory creates the client fetching URL inputs.
+	HTTPClientFactory common.HTTPClientFactory
+	// AllowHTTP allows fetching inputs over plain http instead of only https.
+	AllowHTTP bool
+	// Digests are the expected sha256 digests of the inputs by layer name, see ParseInputDigests.
+	Digests map[string]digest.Digest
+
+	client *http.Client
+}
+
+// isStreamed reports whether the input path denotes stdin or a URL rather than a local file. Streamed
+// inputs can only be read once, so they bypass the build cache.
+func isStreamed(path string) bool {
+	return path == StdinInput || isURLInput(path)
+}
+
+// inputSize returns the size of the input at path if it is a regular file, otherwise -1.
+func inputSize(path string) int64 {
+	if isStreamed(path) {
+		return -1
+	}
+	fi, err := os.Stat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return -1
+	}
+	return fi.Size()
+}
+
+func isURLInput(path string) bool {
+	return strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://")
+}
+
+// ParseInputDigests parses expressions of the form <layer>=<sha256 hex> into a map of layer name to the
+// expected digest of its input.
+func ParseInputDigests(exprs []string) (map[string]digest.Digest, error) {
+	sources, err := parseLayerSources(exprs, "sha256")
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]digest.Digest, len(sources))
+	for layer, hex := range sources {
+		dgst := digest.NewDigestFromEncoded(digest.SHA256, strings.TrimPrefix(hex, "sha256:"))
+		if err := dgst.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid %s input sha256 %q: %w", layer, hex, err)
+		}
+		res[layer] = dgst
+	}
+	return res, nil
+}
+
+// Validate checks the input paths by layer name: At most one layer may be read from stdin, URLs have to
+// be absolute and use https unless AllowHTTP is set, and every expected digest needs an input.
+func (in *Inputs) Validate(paths map[string]string) error {
+	var stdin []string
+	for name, path := range paths {
+		switch {
+		case path == StdinInput:
+			stdin = append(stdin, name)
+		case isURLInput(path):
+			u, err := url.Parse(path)
+			if err != nil || u.Host == "" {
+				return fmt.Errorf("invalid %s input url %q: must be an absolute http(s) url", name, path)
+			}
+			if u.Scheme == "http" && !in.AllowHTTP {
+				return fmt.Errorf("%s input %s is fetched over plain http, which requires --allow-http-inputs", name, path)
+			}
+		}
+	}
+	if len(stdin) > 1 {
+		sort.Strings(stdin)
+		return fmt.Errorf("only one layer can be read from stdin, got %s", strings.Join(stdin, ", "))
+	}
+	for name := range in.Digests {
+		if paths[name] == "" {
+			return fmt.Errorf("--input-sha256 given for %s, which has no input", name)
+		}
+	}
+	return nil
+}
+
+// Open opens the input of the named layer at path. For streamed inputs, it also returns the value of the
+// imageutil.InputSourceAnnotation to record on the layer. If an expected digest is given for the layer,
+// reading the end of the returned content fails unless it matches, so the content is never committed.
+func (in *Inputs) Open(ctx context.Context, name, path string) (io.ReadCloser, string, error) {
+	var (
+		rc     io.ReadCloser
+		source string
+	)
+	switch {
+	case path == StdinInput:
+		rc, source = io.NopCloser(in.Stdin), imageutil.StdinInputSource
+	case isURLInput(path):
+		r, err := in.openURL(ctx, path)
+		if err != nil {
+			return nil, "", err
+		}
+		rc, source = r, path
+	default:
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("error opening file: %w", err)
+		}
+		rc = f
+	}
+
+	expected, ok := in.Digests[name]
+	if !ok {
+		return rc, source, nil
+	}
+	r, err := ioutils.NewReader(ctx, rc, ocispec.Descriptor{Digest: expected})
+	if err != nil {
+		_ = rc.Close()
+		return nil, "", err
+	}
+	return verifiedInput{r, rc}, source, nil
+}
+
+// verifiedInput reads an input verified against its expected digest and closes the underlying input.
+type verifiedInput struct {
+	io.Reader
+	io.Closer
+}
+
+func (in *Inputs) openURL(ctx context.Context, rawURL string) (*urlInput, error) {
+	if in.client == nil {
+		client, err := in.HTTPClientFactory()
+		if err != nil {
+			return nil, fmt.Errorf("could not create http client: %w", err)
+		}
+		in.client = client
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := in.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s: %w", rawURL, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("erroneous response status: %s for url %s", res.Status, rawURL)
+	}
+
+	// Resuming only continues the same content, so it requires a validator of it.
+	validator := res.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = res.Header.Get("Last-Modified")
+	}
+	return &urlInput{
+		ctx:       ctx,
+		client:    in.client,
+		url:       rawURL,
+		body:      res.Body,
+		size:      res.ContentLength,
+		validator: validator,
+		resumable: validator != "" && res.Header.Get("Accept-Ranges") == "bytes",
+	}, nil
+}
+
+// urlInput reads the content at a URL, resuming with a range request where it left off if the
+// connection fails or the content ends before its announced length.
+type urlInput struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+	body   io.ReadCloser
+	// size is the announced length of the content, -1 if unknown, in which case the size is only known
+	// at EOF.
+	size int64
+	// validator is the ETag or Last-Modified time the content is resumed with, see If-Range.
+	validator string
+	resumable bool
+
+	offset  int64
+	resumes int
+	err     error
+}
+
+func (r *urlInput) Read(p []byte) (int, error) {
+	for {
+		if r.err == nil {
+			n, err := r.body.Read(p)
+			r.offset += int64(n)
+			if errors.Is(err, io.EOF) && r.size >= 0 && r.offset < r.size {
+				err = io.ErrUnexpectedEOF
+			}
+			if err == nil || errors.Is(err, io.EOF) {
+				return n, err
+			}
+			r.err = err
+			if n > 0 {
+				return n, nil
+			}
+		}
+		if err := r.resume(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// resume requests the rest of the content after a failed read.
+func (r *urlInput) resume() error {
+	cause := r.err
+	if !r.resumable || r.resumes >= maxInputResumes || r.ctx.Err() != nil {
+		return fmt.Errorf("error reading %s at offset %d: %w", r.url, r.offset, cause)
+	}
+	r.resumes++
+	_ = r.body.Close()
+	r.body = http.NoBody
+
+	select {
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	case <-time.After(time.Duration(r.resumes) * inputResumeBackoff):
+	}
+
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+	req.Header.Set("If-Range", r.validator)
+	res, err := r.client.Do(req)
+	if err != nil {
+		// Counts as another failed attempt.
+		r.err = err
+		return nil
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		_ = res.Body.Close()
+		return fmt.Errorf("error resuming %s at offset %d after %v: erroneous response status: %s", r.url, r.offset, cause, res.Status)
+	}
+	var start int64
+	if _, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != r.offset {
+		_ = res.Body.Close()
+		return fmt.Errorf("error resuming %s at offset %d: unexpected content range %q", r.url, r.offset, res.Header.Get("Content-Range"))
+	}
+	r.body, r.err = res.Body, nil
+	return nil
+}
+
+func (r *urlInput) Close() error {
+	return r.body.Close()
+}
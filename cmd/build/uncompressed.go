@@ -0,0 +1,116 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/content"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/unpack"
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// uncompressedMeter measures the uncompressed size and diff ID of compressed content while it is read,
+// decompressing a copy of it in the background.
+type uncompressedMeter struct {
+	pw           *io.PipeWriter
+	done         chan struct{}
+	uncompressed onmetalimage.Uncompressed
+	err          error
+}
+
+// newUncompressedMeter returns a reader reading r through a new meter.
+func newUncompressedMeter(ctx context.Context, r io.Reader) (io.Reader, *uncompressedMeter) {
+	pr, pw := io.Pipe()
+	m := &uncompressedMeter{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(m.done)
+		// Drain the rest, e.g. trailing data after the compressed stream, so reading through the meter never
+		// blocks.
+		defer func() { _, _ = io.Copy(io.Discard, pr) }()
+
+		dr, err := unpack.Decompress(pr)
+		if err != nil {
+			m.err = err
+			return
+		}
+		defer func() { _ = dr.Close() }()
+
+		measured, err := ioutils.CopyVerify(ctx, io.Discard, dr, ocispec.Descriptor{})
+		if err != nil {
+			m.err = err
+			return
+		}
+		m.uncompressed = onmetalimage.Uncompressed{Size: measured.Size, DiffID: measured.Digest}
+	}()
+	return io.TeeReader(r, pw), m
+}
+
+// result ends the measurement after reading through the meter stopped with the given error, nil if all
+// content was read, and returns the measured values.
+func (m *uncompressedMeter) result(err error) (onmetalimage.Uncompressed, error) {
+	_ = m.pw.CloseWithError(err)
+	<-m.done
+	return m.uncompressed, m.err
+}
+
+// ingestLayer streams the content stored with the given compression into the store of the transaction as
+// layer (see layout.Transaction.IngestLayer) and records its uncompressed size and diff ID for capacity
+// planning. Those of compressed content are measured while it is ingested, except for xz, which cannot be
+// decompressed; xz compressed layers keep the uncompressed size annotation given by the user, if any.
+func ingestLayer(
+	ctx context.Context,
+	store content.Store,
+	tx *layout.Transaction,
+	name, ref string,
+	r io.Reader,
+	size int64,
+	compression unpack.Compression,
+	opts ...imageutil.DescriptorOpt,
+) (image.Layer, error) {
+	var meter *uncompressedMeter
+	if compression != unpack.CompressionNone && compression != unpack.CompressionXz {
+		r, meter = newUncompressedMeter(ctx, r)
+	}
+
+	layer, err := tx.IngestLayer(ctx, ref, r, size, opts...)
+	if meter != nil {
+		uncompressed, measureErr := meter.result(err)
+		if err == nil && measureErr != nil {
+			return nil, fmt.Errorf("error determining uncompressed size of %s layer: %w", name, measureErr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return ocicontent.Layer(store, onmetalimage.WithUncompressed(layer.Descriptor(), uncompressed)), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	desc := layer.Descriptor()
+	if compression == unpack.CompressionXz {
+		return layer, nil
+	}
+	return ocicontent.Layer(store, onmetalimage.WithUncompressed(desc, onmetalimage.Uncompressed{Size: desc.Size, DiffID: desc.Digest})), nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builddelta
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/go-units"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/delta"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory) *cobra.Command {
+	var (
+		from string
+		to   string
+		tag  string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "build-delta --from <old-ref> --to <new-ref> --tag <delta-ref>",
+		Short: "Build a delta artifact updating the rootfs of a local image to the rootfs of a newer one.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			return Run(ctx, storeFactory, from, to, tag)
+		},
+	}
+
+	cmd.Flags().StringVar(&from, "from", "", "Local image whose rootfs the delta applies to.")
+	cmd.Flags().StringVar(&to, "to", "", "Local image whose rootfs the delta results in.")
+	cmd.Flags().StringVar(&tag, "tag", "", "Reference to tag the delta artifact with, push it to make it available to pull --apply-delta.")
+	_ = cmd.MarkFlagRequired("from")
+	_ = cmd.MarkFlagRequired("to")
+	_ = cmd.MarkFlagRequired("tag")
+
+	return cmd
+}
+
+func Run(ctx context.Context, storeFactory common.StoreFactory, from, to, tag string) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	fromRef, err := common.FuzzyResolveRef(ctx, s, from)
+	if err != nil {
+		return fmt.Errorf("error resolving source: %w", err)
+	}
+	fromImg, err := s.Resolve(ctx, fromRef)
+	if err != nil {
+		return fmt.Errorf("error getting source image: %w", err)
+	}
+
+	toRef, err := common.FuzzyResolveRef(ctx, s, to)
+	if err != nil {
+		return fmt.Errorf("error resolving target: %w", err)
+	}
+	toImg, err := s.Resolve(ctx, toRef)
+	if err != nil {
+		return fmt.Errorf("error getting target image: %w", err)
+	}
+
+	img, stats, err := delta.Build(ctx, s.Layout().Store(), fromImg, toImg)
+	if err != nil {
+		return fmt.Errorf("error building delta: %w", err)
+	}
+	if err := s.Push(ctx, tag, img); err != nil {
+		return fmt.Errorf("error pushing to ref %s: %w", tag, err)
+	}
+
+	fmt.Printf("Successfully built delta %s %s: %s of %s are new\n", tag, img.Descriptor().Digest.Encoded(),
+		units.BytesSize(float64(stats.Added)), units.BytesSize(float64(stats.TargetSize)))
+	return nil
+}
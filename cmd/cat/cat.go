@@ -0,0 +1,78 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cat
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/layerfs"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory) *cobra.Command {
+	var (
+		filePath string
+		role     string
+		output   string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "cat image[:tag] --path /etc/os-release",
+		Short: "Print a file of the rootfs of a local image without extracting it.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			srcImage := args[0]
+			return Run(ctx, storeFactory, srcImage, role, filePath, output)
+		},
+	}
+
+	cmd.Flags().StringVar(&filePath, "path", "", "Path of the file within the layer. Symbolic links are followed within the layer.")
+	cmd.Flags().StringVar(&role, "role", "rootfs", "Role of the layer to read the file from, e.g. rootfs-b.")
+	cmd.Flags().StringVarP(&output, "output", "o", "-", "File to write the content to. Use - for stdout.")
+	_ = cmd.MarkFlagRequired("path")
+	_ = cmd.RegisterFlagCompletionFunc("role", common.CompleteFixed("rootfs", "initramfs", "kernel"))
+
+	return cmd
+}
+
+// Run writes the content of the file at filePath of the layer with the given role to output, or to
+// stdout if output is "-".
+func Run(ctx context.Context, storeFactory common.StoreFactory, srcImage, role, filePath, output string) error {
+	layer, ref, release, err := common.LeaseRoleLayer(ctx, storeFactory, srcImage, role)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("error creating output file: %w", err)
+		}
+		defer func() { _ = f.Close() }()
+		w = f
+	}
+
+	if err := layerfs.Cat(ctx, layer, filePath, w); err != nil {
+		return fmt.Errorf("error reading %s of %s: %w", filePath, ref, err)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+)
+
+const (
+	RecommendedNormalizeAnnotationsFlagName  = "normalize-annotations"
+	RecommendedNormalizeAnnotationsFlagUsage = "Lowercase annotation keys and trim whitespace around keys and values instead of rejecting them, reporting every change."
+)
+
+// PrintAnnotationChanges reports the changes made by normalizing annotations.
+func PrintAnnotationChanges(w io.Writer, changes []imageutil.AnnotationChange) {
+	for _, change := range changes {
+		fmt.Fprintln(w, "Normalized annotation", change)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/go-units"
+)
+
+const (
+	RecommendedLimitBandwidthFlagName  = "limit-bandwidth"
+	RecommendedLimitBandwidthFlagUsage = "Maximum download rate (e.g. 20MiB/s). If empty, downloads are not throttled."
+)
+
+// ParseBandwidth parses a download rate in bytes per second like 20MiB/s, the /s suffix is optional.
+func ParseBandwidth(s string) (int64, error) {
+	n, err := units.RAMInBytes(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth %q: %w", s, err)
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q: must be positive", s)
+	}
+	return n, nil
+}
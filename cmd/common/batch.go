@@ -0,0 +1,219 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+	"github.com/onmetal/onmetal-image/batch"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	RecommendedBatchFlagName    = "batch"
+	RecommendedJobsFlagName     = "jobs"
+	RecommendedFailFastFlagName = "fail-fast"
+
+	RecommendedJobsFlagUsage     = "Number of references of --batch to transfer concurrently."
+	RecommendedFailFastFlagUsage = "Stop the --batch at the first failed reference instead of reporting it and continuing."
+
+	// DefaultJobs is the default number of references of a batch file transferred concurrently.
+	DefaultJobs = 4
+)
+
+const (
+	// ExitCodeFailure is the exit code if a command failed.
+	ExitCodeFailure = 1
+	// ExitCodePartialFailure is the exit code if a command operating on multiple items failed for
+	// some but not all of them.
+	ExitCodePartialFailure = 2
+	// ExitCodeOutdated is the exit code of outdated if any local image is stale or missing remotely and
+	// of ref resolve-and-update --check if any reference is not up to date.
+	ExitCodeOutdated = 3
+	// ExitCodeUpdateAvailable is the exit code of self-update --check if a newer version is available.
+	ExitCodeUpdateAvailable = 8
+)
+
+// ExitError is an error with a specific exit code.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the exit code for the given error: 0 if it is nil, the code of an ExitError and
+// ExitCodeFailure otherwise.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	return ExitCodeFailure
+}
+
+// BatchStatus is the status of a single item of a batch operation.
+type BatchStatus string
+
+const (
+	BatchStatusSucceeded BatchStatus = "succeeded"
+	BatchStatusFailed    BatchStatus = "failed"
+)
+
+// BatchItem is the result of a batch operation for a single item. Its JSON form is meant to be consumed by scripts.
+type BatchItem struct {
+	Name   string        `json:"name"`
+	Status BatchStatus   `json:"status"`
+	Error  string        `json:"error,omitempty"`
+	Digest digest.Digest `json:"digest,omitempty"`
+	Bytes  int64         `json:"bytes"`
+}
+
+// BatchResult collects the per-item results of a batch operation.
+type BatchResult struct {
+	Items []BatchItem `json:"items"`
+
+	failed int
+}
+
+// Add adds the given results.
+func (b *BatchResult) Add(results ...batch.Result) {
+	for _, result := range results {
+		item := BatchItem{
+			Name:   result.Name,
+			Status: BatchStatusSucceeded,
+			Digest: result.Digest,
+			Bytes:  result.Bytes,
+		}
+		if result.Err != nil {
+			item.Status = BatchStatusFailed
+			item.Error = result.Err.Error()
+			b.failed++
+		}
+		b.Items = append(b.Items, item)
+	}
+}
+
+// Failed returns the number of failed items.
+func (b *BatchResult) Failed() int {
+	return b.failed
+}
+
+// Print writes the results as a table followed by a summary line, or as JSON.
+func (b *BatchResult) Print(w io.Writer, jsonOutput bool) error {
+	if jsonOutput {
+		if b.Items == nil {
+			b.Items = []BatchItem{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(b)
+	}
+
+	if len(b.Items) > 0 {
+		tw := tabwriter.NewWriter(w, 12, 0, 1, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "NAME\tSTATUS\tDIGEST\tSIZE\tERROR")
+		for _, item := range b.Items {
+			dgst := "<none>"
+			if item.Digest != "" {
+				dgst = item.Digest.Encoded()
+			}
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", item.Name, item.Status, dgst, units.HumanSize(float64(item.Bytes)), item.Error)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d succeeded, %d failed\n", len(b.Items)-b.Failed(), b.Failed())
+	return err
+}
+
+// Err returns nil if all items succeeded. Otherwise, it returns an ExitError with ExitCodePartialFailure
+// if some items succeeded or ExitCodeFailure if all failed.
+func (b *BatchResult) Err() error {
+	if b.failed == 0 {
+		return nil
+	}
+
+	code := ExitCodePartialFailure
+	if b.failed == len(b.Items) {
+		code = ExitCodeFailure
+	}
+	return &ExitError{
+		Code: code,
+		// The individual errors are part of the printed results, so only summarize them.
+		Err: fmt.Errorf("%d of %d item(s) failed", b.failed, len(b.Items)),
+	}
+}
+
+// RunBatchFile runs fn for the entries of the batch file at path (see batch.ParseFile) with at most jobs
+// of them at a time. Malformed entries and, unless allowDestination is set, entries with a destination
+// are reported as failed without running fn for them. If failFast is set, the first failure skips the
+// remaining entries. The returned result has an item per entry, in file order.
+func RunBatchFile(
+	ctx context.Context,
+	path string,
+	jobs int,
+	failFast bool,
+	allowDestination bool,
+	fn func(ctx context.Context, entry batch.Entry) batch.Result,
+) (*BatchResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening batch file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	entries, err := batch.ParseFile(f)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if entry.Err == nil && entry.Destination != "" && !allowDestination {
+			entries[i].Err = fmt.Errorf("line %d: destinations are not supported", entry.Line)
+		}
+	}
+
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	results := batch.Run(ctx, names, jobs, failFast, func(ctx context.Context, i int) batch.Result {
+		if err := entries[i].Err; err != nil {
+			return batch.Result{Err: err}
+		}
+		return fn(ctx, entries[i])
+	})
+
+	res := &BatchResult{}
+	res.Add(results...)
+	return res, nil
+}
@@ -0,0 +1,40 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"path/filepath"
+
+	"github.com/onmetal/onmetal-image/checksum"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	RecommendedWriteChecksumsFlagName  = "write-checksums"
+	RecommendedWriteChecksumsFlagUsage = "Write a checksum manifest (JSON) of the written files to the given file. Verify it with verify-files."
+)
+
+// WriteFileChecksums writes a checksum manifest to filename that lists the single file output, produced from
+// the given layer and image. The manifest root is the directory of output.
+func WriteFileChecksums(filename, output string, layerDigest, imageDigest digest.Digest) error {
+	recorder, err := checksum.NewRecorder(filepath.Dir(output))
+	if err != nil {
+		return err
+	}
+	if err := recorder.RecordFile(filepath.Base(output), layerDigest, imageDigest); err != nil {
+		return err
+	}
+	return checksum.WriteFile(filename, recorder.Manifest())
+}
@@ -16,31 +16,83 @@ package common
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
-
+	"github.com/docker/go-units"
+	"github.com/onmetal/onmetal-image/client"
 	"github.com/onmetal/onmetal-image/docker"
-
-	"github.com/distribution/reference"
-
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/local"
 	"github.com/onmetal/onmetal-image/oci/remote"
-
 	"github.com/onmetal/onmetal-image/oci/store"
+	"github.com/onmetal/onmetal-image/ref"
+	"github.com/onmetal/onmetal-image/refmap"
 )
 
 const (
-	RecommendedStorePathFlagName         = "store-path"
-	RecommendedDockerConfigPathsFlagName = "docker-config-path"
+	RecommendedStorePathFlagName           = "store-path"
+	RecommendedStoreMaxSizeFlagName        = "store-max-size"
+	RecommendedStoreBlobDirFlagName        = "store-blob-dir"
+	RecommendedDockerConfigPathsFlagName   = "docker-config-path"
+	RecommendedNoAnonymousFallbackFlagName = "no-anonymous-fallback"
+	RecommendedDefaultRegistryFlagName     = "default-registry"
+	RecommendedStoreEncryptionKeyFlagName  = "store-encryption-key-file"
+	RecommendedStoreNoSyncFlagName         = "store-no-sync"
+	RecommendedStoreProtectBlobsFlagName   = "store-protect-blobs"
+	RecommendedNoUsageTrackingFlagName     = "no-usage-tracking"
+	RecommendedStoreNoAuditFlagName        = "store-no-audit"
+	RecommendedStoreGracePeriodFlagName    = "store-grace-period"
+	RecommendedTimeoutFlagName             = "timeout"
+	RecommendedConnectTimeoutFlagName      = "connect-timeout"
+	RecommendedResolveCacheTTLFlagName     = "resolve-cache-ttl"
+	RecommendedNoResolveCacheFlagName      = "no-resolve-cache"
+	RecommendedRegistriesConfigFlagName    = "registries-config"
+	RecommendedAutoMigrateFlagName         = "auto-migrate"
+	RecommendedNoExternalBlobsFlagName     = "no-external-blobs"
+	RecommendedCommitHookFlagName          = "commit-hook"
+	RecommendedRefMapFlagName              = "ref-map"
 )
 
 const (
-	RecommendedStorePathFlagUsage         = "Path where to store all local images and index information (such as tags)."
-	RecommendedDockerConfigPathsFlagUsage = "Paths to look up for docker configuration. Leave empty for default location."
+	RecommendedStorePathFlagUsage           = "Path where to store all local images and index information (such as tags)."
+	RecommendedStoreMaxSizeFlagUsage        = "Maximum size of the local store (e.g. 200Gi). If exceeded, least recently used unpinned images are evicted. Leave empty for no limit."
+	RecommendedStoreBlobDirFlagUsage        = "Directory to keep the blobs of the local store in, e.g. on a larger disk than the index. Recorded in the store, so only needed when creating it."
+	RecommendedDockerConfigPathsFlagUsage   = "Paths to look up for docker configuration. Leave empty for default location."
+	RecommendedNoAnonymousFallbackFlagUsage = "Do not retry pulls anonymously if the stored registry credentials are rejected."
+	RecommendedDefaultRegistryFlagUsage     = "Registry to use for image references that do not specify a registry."
+	RecommendedStoreEncryptionKeyFlagUsage  = "File containing a hex-encoded AES key to encrypt new blobs in the local store with. Leave empty to store blobs as plaintext."
+	RecommendedStoreNoSyncFlagUsage         = "Do not sync committed blobs to disk. Faster, but blobs may be lost on power loss, only use for throwaway stores."
+	RecommendedStoreProtectBlobsFlagUsage   = "Make committed blobs tamper-evident by enabling fsverity on them or, where the file system does not support it, setting the immutable attribute (linux only). Falls back to unprotected blobs, see doctor."
+	RecommendedNoUsageTrackingFlagUsage     = "Do not record when and how often local images are used (e.g. extracted). Eviction then falls back to when images were last accessed."
+	RecommendedStoreNoAuditFlagUsage        = "Do not append the mutating operations on the local store to its audit log, e.g. for ephemeral CI stores. See audit."
+	RecommendedStoreGracePeriodFlagUsage    = "Remove images whose tags were all moved to other images (e.g. by a pull updating the tag) once they were condemned this long, whenever an image is added to the local store. Zero leaves them to prune --condemned."
+	RecommendedTimeoutFlagUsage             = "Maximum duration of the whole command (e.g. 10m). Zero means no limit."
+	RecommendedConnectTimeoutFlagUsage      = "Maximum duration for connecting to a registry and resolving a reference (e.g. 30s). Zero means no limit."
+	RecommendedResolveCacheTTLFlagUsage     = "Duration for which the digests tags resolved to are cached in the store directory. References with a digest are never cached."
+	RecommendedNoResolveCacheFlagUsage      = "Always resolve tags at the registry instead of using cached digests."
+	RecommendedAutoMigrateFlagUsage         = "Migrate a store of an older format version when opening it instead of failing. See migrate-store."
+	RecommendedNoExternalBlobsFlagUsage     = "Never fetch blobs from the external URLs of their descriptors, only from the registry, and upload such blobs on push."
+	RecommendedRegistriesConfigFlagUsage    = "YAML file with per-registry-host limits of concurrent blob transfers and idle connections. Defaults to registries.yaml in the store directory, if present. Its hosts override the registries of the configuration files."
+	RecommendedCommitHookFlagUsage          = "Executable deciding whether an image may be added to the store. It gets the image manifest on stdin, a nonzero exit status rejects the image. Can be repeated."
+	RecommendedRefMapFlagUsage              = "Ref map (YAML) translating references to digests of images in the local store, which are then pulled without network access. Can be repeated, the first translation wins."
 )
 
+// RegistriesConfigFileName is the name of the per-registry-host settings file in the store directory that
+// is used if no other file is given.
+const RegistriesConfigFileName = "registries.yaml"
+
+// DefaultResolveCacheTTL is the default duration tag resolutions are cached for.
+const DefaultResolveCacheTTL = 60 * time.Second
+
 var (
 	// DefaultStorePath is the default store path. If your user does not have a home directory,
 	// this is empty and needs to be passed in as a flag.
@@ -53,44 +105,304 @@ func init() {
 	}
 }
 
+// ClientConfigFactory is a factory for the configuration of a client.Client with the store at the given path.
+type ClientConfigFactory func(storePath string) (client.Config, error)
+
+// DefaultClientConfigFactory returns a new ClientConfigFactory that dereferences the flag values at invocation time.
+func DefaultClientConfigFactory(
+	storeMaxSize, storeEncryptionKeyFile *string,
+	storeNoSync, storeProtectBlobs, storeAutoMigrate, storeNoUsageTracking, storeNoAudit *bool,
+	storeGracePeriod *time.Duration,
+	configPaths *[]string,
+	noAnonymousFallback *bool,
+	defaultRegistry *string,
+	connectTimeout *time.Duration,
+	resolveCacheTTL *time.Duration,
+	noResolveCache *bool,
+	registriesConfig *string,
+	noExternalBlobs *bool,
+	configHosts *remote.HostsConfig,
+	commitHooks *[]string,
+	refMaps *[]string,
+) ClientConfigFactory {
+	return func(storePath string) (client.Config, error) {
+		config := client.Config{
+			StorePath:           storePath,
+			StoreNoSync:         *storeNoSync,
+			StoreProtectBlobs:   *storeProtectBlobs,
+			StoreAutoMigrate:    *storeAutoMigrate,
+			NoUsageTracking:     *storeNoUsageTracking,
+			StoreNoAudit:        *storeNoAudit,
+			StoreGracePeriod:    *storeGracePeriod,
+			DockerConfigPaths:   *configPaths,
+			NoAnonymousFallback: *noAnonymousFallback,
+			DefaultRegistry:     *defaultRegistry,
+			ConnectTimeout:      *connectTimeout,
+			NoExternalBlobs:     *noExternalBlobs,
+		}
+		if !*noResolveCache {
+			config.ResolveCacheTTL = *resolveCacheTTL
+		}
+		if *storeMaxSize != "" {
+			maxSize, err := units.RAMInBytes(*storeMaxSize)
+			if err != nil {
+				return client.Config{}, fmt.Errorf("invalid store max size %q: %w", *storeMaxSize, err)
+			}
+			config.StoreMaxSize = maxSize
+		}
+		if *storeEncryptionKeyFile != "" {
+			key, err := local.ReadKeyFile(*storeEncryptionKeyFile)
+			if err != nil {
+				return client.Config{}, err
+			}
+			config.StoreEncryptionKey = key
+		}
+		hosts, err := readHostsConfig(*registriesConfig, storePath, configHosts)
+		if err != nil {
+			return client.Config{}, err
+		}
+		config.Hosts = hosts
+		for _, path := range *commitHooks {
+			config.CommitHooks = append(config.CommitHooks, layout.ExecCommitHook(path))
+		}
+		for _, path := range *refMaps {
+			f, err := refmap.ReadFile(path, ref.Parser{DefaultRegistry: *defaultRegistry})
+			if err != nil {
+				return client.Config{}, err
+			}
+			config.RefResolvers = append(config.RefResolvers, f)
+		}
+		return config, nil
+	}
+}
+
+// readHostsConfig reads the per-registry-host settings from path or, if empty, from the optional
+// RegistriesConfigFileName in the store directory. Their hosts override those of the registries of the
+// configuration files in base.
+func readHostsConfig(path, storePath string, base *remote.HostsConfig) (*remote.HostsConfig, error) {
+	optional := path == ""
+	if optional {
+		if storePath == "" {
+			return mergeHostsConfig(base, nil), nil
+		}
+		path = filepath.Join(storePath, RegistriesConfigFileName)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if optional && errors.Is(err, os.ErrNotExist) {
+			return mergeHostsConfig(base, nil), nil
+		}
+		return nil, fmt.Errorf("error reading registries config: %w", err)
+	}
+	hosts, err := remote.ParseHostsConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registries config %s: %w", path, err)
+	}
+	return mergeHostsConfig(base, hosts), nil
+}
+
+// mergeHostsConfig returns the settings of base with the hosts of override replaced, nil if both have none.
+func mergeHostsConfig(base, override *remote.HostsConfig) *remote.HostsConfig {
+	if base == nil || len(base.Hosts) == 0 {
+		return override
+	}
+	res := &remote.HostsConfig{Hosts: make(map[string]remote.HostSettings)}
+	for host, settings := range base.Hosts {
+		res.Hosts[host] = settings
+	}
+	if override != nil {
+		for host, settings := range override.Hosts {
+			res.Hosts[host] = settings
+		}
+	}
+	return res
+}
+
+// ClientFactory is a factory for a client.Client.
+type ClientFactory func() (*client.Client, error)
+
+// DefaultClientFactory returns a new ClientFactory for the store at the flag value of storePath, keeping
+// its blobs in the flag value of storeBlobDir if set.
+func DefaultClientFactory(storePath, storeBlobDir *string, configFactory ClientConfigFactory) ClientFactory {
+	return func() (*client.Client, error) {
+		config, err := configFactory(*storePath)
+		if err != nil {
+			return nil, err
+		}
+		config.StoreBlobDir = *storeBlobDir
+		c, err := client.New(config)
+		if err != nil {
+			return nil, err
+		}
+		warnStoreLimitations(c.Store())
+		warnStoreAdoption(c.Store())
+		return c, nil
+	}
+}
+
+// warnedStorePaths are the store paths the file system limitations have been warned about.
+var warnedStorePaths sync.Map
+
+// warnStoreLimitations warns once per store path if the file system of the store lacks capabilities
+// the store degrades for, see fsutil.Capabilities.
+func warnStoreLimitations(s *store.Store) {
+	limitations := s.Layout().Capabilities().Limitations()
+	if len(limitations) == 0 {
+		return
+	}
+	if _, warned := warnedStorePaths.LoadOrStore(s.Layout().Path(), struct{}{}); warned {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Warning: the file system of store %s is limited: %s\n", s.Layout().Path(), strings.Join(limitations, ", "))
+}
+
+// warnStoreAdoption warns if the store was an OCI layout created by another tool and adopted when opening
+// it, listing the index entries that could not be classified as onmetal images in a single warning.
+func warnStoreAdoption(s *store.Store) {
+	adoption := s.Layout().Adoption()
+	if adoption == nil {
+		return
+	}
+	if len(adoption.Unclassified) == 0 {
+		fmt.Fprintf(os.Stderr, "Warning: adopted OCI layout %s created by another tool (%d entries)\n", adoption.Path, adoption.Entries)
+		return
+	}
+	unclassified := make([]string, 0, len(adoption.Unclassified))
+	for _, entry := range adoption.Unclassified {
+		unclassified = append(unclassified, entry.String())
+	}
+	fmt.Fprintf(os.Stderr, "Warning: adopted OCI layout %s created by another tool (%d entries), %d could not be classified: %s\n",
+		adoption.Path, adoption.Entries, len(adoption.Unclassified), strings.Join(unclassified, "; "))
+}
+
 // StoreFactory is a factory for a store.Store.
 type StoreFactory func() (*store.Store, error)
 
-// DefaultStoreFactory returns a new StoreFactory that dereferences the store path at invocation time.
-func DefaultStoreFactory(storePath *string) StoreFactory {
+// StoreAtFactory is a factory for a store.Store at the given path.
+type StoreAtFactory func(path string) (*store.Store, error)
+
+// DefaultStoreFactory returns a new StoreFactory returning the store of the clients of clientFactory.
+func DefaultStoreFactory(clientFactory ClientFactory) StoreFactory {
 	return func() (*store.Store, error) {
-		return store.New(*storePath)
+		c, err := clientFactory()
+		if err != nil {
+			return nil, err
+		}
+		return c.Store(), nil
+	}
+}
+
+// DefaultStoreAtFactory returns a new StoreAtFactory returning the store of a client for the given path.
+func DefaultStoreAtFactory(configFactory ClientConfigFactory) StoreAtFactory {
+	return func(path string) (*store.Store, error) {
+		config, err := configFactory(path)
+		if err != nil {
+			return nil, err
+		}
+		c, err := client.New(config)
+		if err != nil {
+			return nil, err
+		}
+		warnStoreLimitations(c.Store())
+		warnStoreAdoption(c.Store())
+		return c.Store(), nil
 	}
 }
 
 // RemoteRegistryFactory is a factory for a remote.Registry.
 type RemoteRegistryFactory func() (*remote.Registry, error)
 
-func DefaultRemoteRegistryFactory(configPaths []string) RemoteRegistryFactory {
+// DefaultRemoteRegistryFactory returns a new RemoteRegistryFactory for the registry settings of the client
+// configuration. It does not create the store.
+func DefaultRemoteRegistryFactory(storePath *string, configFactory ClientConfigFactory) RemoteRegistryFactory {
 	return func() (*remote.Registry, error) {
-		return remote.DockerRegistry(configPaths)
+		config, err := configFactory(*storePath)
+		if err != nil {
+			return nil, err
+		}
+		return client.NewRegistry(config)
 	}
 }
 
+// RequestResolverFactory is a factory for a docker.RequestResolver.
 type RequestResolverFactory func() (*docker.RequestResolver, error)
 
-func DefaultRequestResolverFactory(configPaths []string) RequestResolverFactory {
+// DefaultRequestResolverFactory returns a new RequestResolverFactory for the registry settings of the client
+// configuration. It does not create the store.
+func DefaultRequestResolverFactory(storePath *string, configFactory ClientConfigFactory) RequestResolverFactory {
 	return func() (*docker.RequestResolver, error) {
-		return docker.NewRequestResolver(docker.RequestResolverOptions{
-			ConfigPaths: configPaths,
-		})
+		config, err := configFactory(*storePath)
+		if err != nil {
+			return nil, err
+		}
+		return client.NewRequestResolver(config)
 	}
 }
 
-func FuzzyResolveRef(ctx context.Context, store *store.Store, ref string) (string, error) {
-	if _, err := reference.ParseAnyReference(ref); err == nil {
-		return ref, nil
+// HTTPClientFactory is a factory for an http.Client for downloads other than registry access.
+type HTTPClientFactory func() (*http.Client, error)
+
+// DefaultHTTPClientFactory returns a new HTTPClientFactory for the transport settings of the client
+// configuration, so downloads use the same proxy and timeouts as registry access.
+func DefaultHTTPClientFactory(storePath *string, configFactory ClientConfigFactory) HTTPClientFactory {
+	return func() (*http.Client, error) {
+		config, err := configFactory(*storePath)
+		if err != nil {
+			return nil, err
+		}
+		return client.NewHTTPClient(config), nil
 	}
+}
 
-	dsc, err := store.Layout().Indexer().Find(ctx, descriptormatcher.EncodedDigestPrefix(ref))
-	if err != nil {
-		return "", fmt.Errorf("error looking up ref %s as digest: %w", ref, err)
+// FuzzyResolveRef resolves an (abbreviated) image id to its digest. Other refs are returned as-is.
+func FuzzyResolveRef(ctx context.Context, s *store.Store, ref string) (string, error) {
+	return client.FuzzyResolveRef(ctx, s, ref)
+}
+
+// ParseKeyValue parses an expression of the form key=value.
+func ParseKeyValue(expr string) (key, value string, err error) {
+	key, value, ok := strings.Cut(expr, "=")
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("invalid key=value expression %q", expr)
 	}
+	return key, value, nil
+}
+
+// ParseLayerSelectors parses layer selectors of the form key=value into a matcher of the layer descriptors
+// having all the annotations. It returns nil if no selectors are given.
+func ParseLayerSelectors(exprs []string) (descriptormatcher.Matcher, error) {
+	if len(exprs) == 0 {
+		return nil, nil
+	}
+	matchers := make([]descriptormatcher.Matcher, 0, len(exprs))
+	for _, expr := range exprs {
+		key, value, err := ParseKeyValue(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid layer selector: %w", err)
+		}
+		matchers = append(matchers, descriptormatcher.Annotation(key, value))
+	}
+	return descriptormatcher.And(matchers...), nil
+}
 
-	return dsc.Digest.String(), nil
+// ExpiryAnnotations returns the manifest annotations for an image expiring after expiresIn or at expiresAt
+// (in RFC 3339 format). If neither is set, no annotations are returned.
+func ExpiryAnnotations(now time.Time, expiresIn time.Duration, expiresAt string) (map[string]string, error) {
+	switch {
+	case expiresIn != 0 && expiresAt != "":
+		return nil, fmt.Errorf("must specify at most one of expires-in and expires-at")
+	case expiresIn < 0:
+		return nil, fmt.Errorf("expires-in must not be negative")
+	case expiresIn > 0:
+		return map[string]string{imageutil.ExpiresAtAnnotation: now.Add(expiresIn).UTC().Format(time.RFC3339)}, nil
+	case expiresAt != "":
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing expires-at: %w", err)
+		}
+		return map[string]string{imageutil.ExpiresAtAnnotation: t.UTC().Format(time.RFC3339)}, nil
+	default:
+		return nil, nil
+	}
 }
@@ -0,0 +1,36 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PrintCompactResult prints the entries dropped when compacting the index and a summary.
+func PrintCompactResult(out io.Writer, res *indexer.CompactResult) {
+	for _, desc := range res.Dropped {
+		if name, ok := desc.Annotations[ocispec.AnnotationRefName]; ok {
+			fmt.Fprintf(out, "Dropped %s (%s): manifest missing\n", name, desc.Digest)
+			continue
+		}
+		fmt.Fprintf(out, "Dropped %s: manifest missing\n", desc.Digest)
+	}
+	fmt.Fprintf(out, "Compacted index to %d entries: merged %d duplicate(s), dropped %d with missing manifest(s)\n",
+		res.Entries, res.Merged, len(res.Dropped))
+}
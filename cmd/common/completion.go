@@ -0,0 +1,166 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/ref"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+)
+
+// shortIDLength is the length of the abbreviated image ids printed by list and accepted in place of references.
+const shortIDLength = 12
+
+// CompletionFunc completes the positional arguments or a flag value of a command.
+type CompletionFunc = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective)
+
+// CompleteLocalRefs returns a completion function completing the references and abbreviated image ids of
+// the local store at storePath for up to maxArgs positional arguments (unlimited if negative).
+//
+// The completion only reads the index of the store once; it neither creates the store nor accesses any blob,
+// so it stays fast for large stores. References under the default registry are also completed in their short
+// form, e.g. ubuntu:22.04 for docker.io/library/ubuntu:22.04.
+func CompleteLocalRefs(storePath, defaultRegistry *string, maxArgs int) CompletionFunc {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if maxArgs >= 0 && len(args) >= maxArgs {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+
+		index, err := readIndex(*storePath)
+		if err != nil {
+			cobra.CompDebugln(fmt.Sprintf("error reading index: %v", err), false)
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		return localRefCompletions(index, *defaultRegistry, toComplete), cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// readIndex reads the index of the store at storePath. A missing store has an empty index.
+func readIndex(storePath string) (*ocispec.Index, error) {
+	data, err := os.ReadFile(filepath.Join(storePath, indexer.Filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &ocispec.Index{}, nil
+		}
+		return nil, err
+	}
+
+	index := &ocispec.Index{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("error decoding index: %w", err)
+	}
+	return index, nil
+}
+
+// localRefCompletions returns the references and abbreviated image ids of the index starting with toComplete,
+// each with a description in the form cobra expects ("<completion>\t<description>").
+func localRefCompletions(index *ocispec.Index, defaultRegistry, toComplete string) []string {
+	var (
+		namesByID  = make(map[string][]string)
+		idsByShort = make(map[string]map[string]struct{})
+		seen       = make(map[string]struct{})
+		res        []string
+	)
+	for _, desc := range index.Manifests {
+		id := desc.Digest.Encoded()
+		if len(id) < shortIDLength {
+			continue
+		}
+		short := id[:shortIDLength]
+		if idsByShort[short] == nil {
+			idsByShort[short] = make(map[string]struct{})
+		}
+		idsByShort[short][id] = struct{}{}
+
+		name := desc.Annotations[ocispec.AnnotationRefName]
+		if name == "" {
+			continue
+		}
+		namesByID[id] = append(namesByID[id], name)
+
+		for _, candidate := range []string{name, shortName(name, defaultRegistry)} {
+			if _, ok := seen[candidate]; ok || !strings.HasPrefix(candidate, toComplete) {
+				continue
+			}
+			seen[candidate] = struct{}{}
+			res = append(res, candidate+"\t"+short)
+		}
+	}
+
+	for short, ids := range idsByShort {
+		for id := range ids {
+			completion := short
+			if len(ids) > 1 {
+				// The abbreviated id is ambiguous, only the full one identifies the image.
+				completion = id
+			}
+			if _, ok := seen[completion]; ok || !strings.HasPrefix(completion, toComplete) {
+				continue
+			}
+			seen[completion] = struct{}{}
+
+			names := namesByID[id]
+			if len(names) == 0 {
+				res = append(res, completion)
+				continue
+			}
+			sort.Strings(names)
+			res = append(res, completion+"\t"+strings.Join(names, ", "))
+		}
+	}
+
+	sort.Strings(res)
+	return res
+}
+
+// shortName returns the shortest form of the fully qualified name that still resolves to it,
+// omitting the default registry and, for docker.io, the library/ prefix of official images.
+func shortName(name, defaultRegistry string) string {
+	if defaultRegistry == "" {
+		defaultRegistry = ref.DefaultRegistry
+	}
+	remainder, ok := strings.CutPrefix(name, defaultRegistry+"/")
+	if !ok {
+		return name
+	}
+	if defaultRegistry == ref.DefaultRegistry {
+		if official, ok := strings.CutPrefix(remainder, "library/"); ok && !strings.Contains(official, "/") {
+			return official
+		}
+	}
+	// Names whose first component looks like a registry would be parsed as such without the default registry.
+	if first, _, ok := strings.Cut(remainder, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		return name
+	}
+	// Single-component names of docker.io are resolved below library/ and must keep their registry.
+	if defaultRegistry == ref.DefaultRegistry && !strings.Contains(remainder, "/") {
+		return name
+	}
+	return remainder
+}
+
+// CompleteFixed returns a completion function completing one of the given values without falling back
+// to file completion.
+func CompleteFixed(values ...string) CompletionFunc {
+	return cobra.FixedCompletions(values, cobra.ShellCompDirectiveNoFileComp)
+}
@@ -0,0 +1,125 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/ref"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+)
+
+var _ = Describe("Completion", func() {
+	var (
+		ctx             context.Context
+		storePath       string
+		defaultRegistry string
+		idx             *indexer.Indexer
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		storePath = GinkgoT().TempDir()
+		defaultRegistry = ref.DefaultRegistry
+
+		i, err := indexer.New(filepath.Join(storePath, indexer.Filename))
+		Expect(err).NotTo(HaveOccurred())
+		idx = i
+	})
+
+	add := func(encoded, name string) {
+		desc := ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.NewDigestFromEncoded(digest.SHA256, encoded),
+			Size:      1,
+		}
+		if name != "" {
+			desc.Annotations = map[string]string{ocispec.AnnotationRefName: name}
+		}
+		Expect(idx.Add(ctx, desc)).To(Succeed())
+	}
+
+	complete := func(maxArgs int, args []string, toComplete string) []string {
+		completions, directive := CompleteLocalRefs(&storePath, &defaultRegistry, maxArgs)(&cobra.Command{}, args, toComplete)
+		Expect(directive).To(Equal(cobra.ShellCompDirectiveNoFileComp))
+		return completions
+	}
+
+	encoded := func(prefix string) string {
+		return prefix + strings.Repeat("0", 64-len(prefix))
+	}
+
+	It("should complete local references in their full and short form", func() {
+		add(encoded("aaaaaaaaaaaa1"), "docker.io/library/ubuntu:22.04")
+		add(encoded("bbbbbbbbbbbb"), "docker.io/onmetal/gardenlinux:1")
+		add(encoded("cccccccccccc"), "ghcr.io/onmetal/debian:12")
+
+		Expect(complete(1, nil, "u")).To(ConsistOf("ubuntu:22.04\taaaaaaaaaaaa"))
+		Expect(complete(1, nil, "onmetal/")).To(ConsistOf("onmetal/gardenlinux:1\tbbbbbbbbbbbb"))
+		Expect(complete(1, nil, "docker.io/")).To(ConsistOf(
+			"docker.io/library/ubuntu:22.04\taaaaaaaaaaaa",
+			"docker.io/onmetal/gardenlinux:1\tbbbbbbbbbbbb",
+		))
+		Expect(complete(1, nil, "ghcr.io/o")).To(ConsistOf("ghcr.io/onmetal/debian:12\tcccccccccccc"))
+	})
+
+	It("should complete short names relative to a custom default registry", func() {
+		defaultRegistry = "ghcr.io"
+		add(encoded("cccccccccccc"), "ghcr.io/debian:12")
+
+		Expect(complete(1, nil, "deb")).To(ConsistOf("debian:12\tcccccccccccc"))
+	})
+
+	It("should complete abbreviated image ids described by their names", func() {
+		add(encoded("abcdef012345"), "docker.io/library/ubuntu:22.04")
+		add(encoded("abcdef012345"), "docker.io/library/ubuntu:latest")
+		add(encoded("abc999999999"), "")
+
+		Expect(complete(1, nil, "abcd")).To(ConsistOf(
+			"abcdef012345\tdocker.io/library/ubuntu:22.04, docker.io/library/ubuntu:latest",
+		))
+		Expect(complete(1, nil, "abc9")).To(ConsistOf("abc999999999"))
+	})
+
+	It("should complete full image ids if the abbreviated ones are ambiguous", func() {
+		add(encoded("dddddddddddd1"), "")
+		add(encoded("dddddddddddd2"), "")
+
+		Expect(complete(1, nil, "ddd")).To(ConsistOf(encoded("dddddddddddd1"), encoded("dddddddddddd2")))
+	})
+
+	It("should only complete up to the maximum number of arguments", func() {
+		add(encoded("aaaaaaaaaaaa"), "docker.io/library/ubuntu:22.04")
+
+		Expect(complete(1, []string{"ubuntu:22.04"}, "u")).To(BeEmpty())
+		Expect(complete(2, []string{"ubuntu:22.04"}, "u")).To(ConsistOf("ubuntu:22.04\taaaaaaaaaaaa"))
+		Expect(complete(-1, []string{"a", "b", "c"}, "u")).To(ConsistOf("ubuntu:22.04\taaaaaaaaaaaa"))
+	})
+
+	It("should not complete or create a missing store", func() {
+		storePath = filepath.Join(GinkgoT().TempDir(), "missing")
+
+		Expect(complete(1, nil, "")).To(BeEmpty())
+		Expect(storePath).NotTo(BeADirectory())
+	})
+})
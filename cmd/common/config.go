@@ -0,0 +1,104 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/onmetal/onmetal-image/config"
+	"github.com/onmetal/onmetal-image/oci/remote"
+	"github.com/spf13/pflag"
+)
+
+const (
+	RecommendedConfigFlagName  = "config"
+	RecommendedConfigFlagUsage = "Configuration files to merge in order, later files winning. Flags override them. Defaults to /etc/onmetal-image/config.yaml and onmetal-image/config.yaml in the user configuration directory."
+)
+
+// configFlags maps the keys of the configuration file to the persistent flags they provide defaults for.
+var configFlags = []struct {
+	key   string
+	flag  string
+	value func(c *config.Config) string
+}{
+	{"store.path", RecommendedStorePathFlagName, func(c *config.Config) string { return c.Store.Path }},
+	{"store.blobDir", RecommendedStoreBlobDirFlagName, func(c *config.Config) string { return c.Store.BlobDir }},
+	{"store.maxSize", RecommendedStoreMaxSizeFlagName, func(c *config.Config) string { return c.Store.MaxSize }},
+	{"store.encryptionKeyFile", RecommendedStoreEncryptionKeyFlagName, func(c *config.Config) string { return c.Store.EncryptionKeyFile }},
+	{"store.noSync", RecommendedStoreNoSyncFlagName, func(c *config.Config) string { return strconv.FormatBool(c.Store.NoSync) }},
+	{"store.protectBlobs", RecommendedStoreProtectBlobsFlagName, func(c *config.Config) string { return strconv.FormatBool(c.Store.ProtectBlobs) }},
+	{"store.autoMigrate", RecommendedAutoMigrateFlagName, func(c *config.Config) string { return strconv.FormatBool(c.Store.AutoMigrate) }},
+	{"store.noUsageTracking", RecommendedNoUsageTrackingFlagName, func(c *config.Config) string { return strconv.FormatBool(c.Store.NoUsageTracking) }},
+	{"store.noAudit", RecommendedStoreNoAuditFlagName, func(c *config.Config) string { return strconv.FormatBool(c.Store.NoAudit) }},
+	{"store.gracePeriod", RecommendedStoreGracePeriodFlagName, func(c *config.Config) string { return time.Duration(c.Store.GracePeriod).String() }},
+	{"defaultRegistry", RecommendedDefaultRegistryFlagName, func(c *config.Config) string { return c.DefaultRegistry }},
+	{"dockerConfigPaths", RecommendedDockerConfigPathsFlagName, func(c *config.Config) string { return strings.Join(c.DockerConfigPaths, ",") }},
+	{"noAnonymousFallback", RecommendedNoAnonymousFallbackFlagName, func(c *config.Config) string { return strconv.FormatBool(c.NoAnonymousFallback) }},
+	{"noExternalBlobs", RecommendedNoExternalBlobsFlagName, func(c *config.Config) string { return strconv.FormatBool(c.NoExternalBlobs) }},
+	{"timeout", RecommendedTimeoutFlagName, func(c *config.Config) string { return time.Duration(c.Timeout).String() }},
+	{"connectTimeout", RecommendedConnectTimeoutFlagName, func(c *config.Config) string { return time.Duration(c.ConnectTimeout).String() }},
+	{"resolveCacheTTL", RecommendedResolveCacheTTLFlagName, func(c *config.Config) string { return time.Duration(c.ResolveCacheTTL).String() }},
+	{"noResolveCache", RecommendedNoResolveCacheFlagName, func(c *config.Config) string { return strconv.FormatBool(c.NoResolveCache) }},
+}
+
+// ConfigPaths returns the configuration files to load: config.DefaultPaths if paths is empty, otherwise
+// paths, which then all have to exist.
+func ConfigPaths(paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return config.DefaultPaths(), nil
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("error reading config: %w", err)
+		}
+	}
+	return paths, nil
+}
+
+// ApplyConfig loads the configuration files at paths (see ConfigPaths) and sets the flags not changed on
+// the command line to the values of the configuration. The registry settings are stored in hosts.
+func ApplyConfig(flags *pflag.FlagSet, paths []string, hosts *remote.HostsConfig) error {
+	paths, err := ConfigPaths(paths)
+	if err != nil {
+		return err
+	}
+	c, err := config.Load(paths...)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range configFlags {
+		origin, ok := c.Origin(f.key)
+		if !ok {
+			continue
+		}
+		flag := flags.Lookup(f.flag)
+		if flag == nil || flag.Changed {
+			continue
+		}
+		if err := flag.Value.Set(f.value(c)); err != nil {
+			return fmt.Errorf("invalid %s at %s: %w", f.key, origin, err)
+		}
+	}
+
+	if hostsConfig := c.HostsConfig(); hostsConfig != nil {
+		*hosts = *hostsConfig
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/onmetal/onmetal-image/daemon"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const (
+	RecommendedViaDaemonFlagName  = "via-daemon"
+	RecommendedViaDaemonFlagUsage = "Address of an onmetal-image daemon (e.g. unix:///run/onmetal-image.sock) to perform pull, list, extract and prune --expired through if its socket exists, instead of opening the store. The store flags are ignored then."
+)
+
+// DaemonClientFactory is a factory for a daemon.Client. It returns a nil client if no daemon is to be used.
+type DaemonClientFactory func() (*daemon.Client, error)
+
+// DefaultDaemonClientFactory returns a new DaemonClientFactory for the daemon at the flag value of address.
+// It returns a nil client if address is empty or nothing exists at its socket path, so commands fall back to
+// opening the store.
+func DefaultDaemonClientFactory(address *string) DaemonClientFactory {
+	return func() (*daemon.Client, error) {
+		if *address == "" {
+			return nil, nil
+		}
+		path, err := daemon.SocketPath(*address)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("error checking daemon socket: %w", err)
+		}
+		return daemon.Dial(*address)
+	}
+}
+
+// ViaDaemon returns the client of the daemon to run the command through, or nil if the command is to run
+// locally. That is also the case if any flag of the command other than the supported ones is set, as the
+// daemon API does not cover it, which is warned about.
+func ViaDaemon(cmd *cobra.Command, daemonClientFactory DaemonClientFactory, supported ...string) (*daemon.Client, error) {
+	c, err := daemonClientFactory()
+	if err != nil || c == nil {
+		return nil, err
+	}
+
+	var (
+		local       = cmd.LocalNonPersistentFlags()
+		unsupported []string
+	)
+	// Only the flags of cmd.Flags() are marked as set, not those of the flag set of the local flags.
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		if local.Lookup(f.Name) == nil {
+			return
+		}
+		for _, name := range supported {
+			if f.Name == name {
+				return
+			}
+		}
+		unsupported = append(unsupported, "--"+f.Name)
+	})
+	if len(unsupported) > 0 {
+		_ = c.Close()
+		sort.Strings(unsupported)
+		fmt.Fprintf(os.Stderr, "Warning: %s not supported via the daemon, running %s locally\n", strings.Join(unsupported, ", "), cmd.Name())
+		return nil, nil
+	}
+	return c, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/layout"
+)
+
+// LeaseRoleLayer resolves the local image srcImage and returns its layer with the given role (see
+// onmetalimage.LayerByRole) along with the resolved reference. The image is leased until release is called,
+// so it is not pruned or evicted while the layer is read.
+func LeaseRoleLayer(ctx context.Context, storeFactory StoreFactory, srcImage, role string) (layer ociimage.Layer, ref string, release func(), err error) {
+	if _, ok := onmetalimage.RoleKind(role); !ok {
+		return nil, "", nil, fmt.Errorf("unknown layer role %q", role)
+	}
+
+	s, err := storeFactory()
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("could not create store: %w", err)
+	}
+
+	ref, err = FuzzyResolveRef(ctx, s, srcImage)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error resolving source: %w", err)
+	}
+	img, err := s.Resolve(ctx, ref)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error getting image: %w", err)
+	}
+
+	lease, err := s.Layout().Lease(ctx, img.Descriptor(), layout.DefaultLeaseTTL)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	release = func() { _ = lease.Release() }
+
+	layer, err = onmetalimage.LayerByRole(ctx, img, role)
+	if err != nil {
+		release()
+		if errors.Is(err, ociimage.ErrLayerNotPresent) {
+			return nil, "", nil, fmt.Errorf("%s: %w", ref, err)
+		}
+		return nil, "", nil, fmt.Errorf("error selecting %s layer of %s: %w", role, ref, err)
+	}
+	return layer, ref, release, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/distribution/reference"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/store"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PartialImageHandler is called before operations needing the layers of the image ref resolves to,
+// to handle partial images (see layout.PartialAnnotation).
+type PartialImageHandler func(ctx context.Context, s *store.Store, ref string) error
+
+// FailPartialImage is a PartialImageHandler failing with layout.ErrPartialImage if the image is partial
+// and with an *ociimage.IncompleteImageError if blobs of it are missing otherwise, e.g. after deleting
+// them manually.
+func FailPartialImage(ctx context.Context, s *store.Store, ref string) error {
+	desc, err := s.Descriptor(ctx, ref)
+	if err != nil {
+		return err
+	}
+	if layout.IsPartial(desc) {
+		return fmt.Errorf("%w: only the metadata of %s was pulled, pass --complete to download its layers", layout.ErrPartialImage, ref)
+	}
+	return ociimage.CheckComplete(ctx, ocicontent.Image(s.Layout().Store(), desc))
+}
+
+// CompletePartialImage returns a PartialImageHandler downloading the missing layers of partial and
+// otherwise incomplete images from the registry of their reference name.
+func CompletePartialImage(registryFactory RemoteRegistryFactory) PartialImageHandler {
+	return func(ctx context.Context, s *store.Store, ref string) error {
+		desc, err := s.Descriptor(ctx, ref)
+		if err != nil {
+			return err
+		}
+		if !layout.IsPartial(desc) {
+			complete, _, err := ocicontent.Image(s.Layout().Store(), desc).Complete(ctx)
+			if err != nil || complete {
+				return err
+			}
+		}
+
+		entries, err := s.Layout().Indexer().List(ctx, descriptormatcher.Digests(desc.Digest))
+		if err != nil {
+			return fmt.Errorf("error listing index entries: %w", err)
+		}
+		var name string
+		for _, entry := range entries {
+			if name = entry.Annotations[ocispec.AnnotationRefName]; name != "" {
+				break
+			}
+		}
+		if name == "" {
+			return fmt.Errorf("%w: cannot complete %s, it has no reference name to pull from", layout.ErrPartialImage, ref)
+		}
+
+		named, err := reference.ParseNamed(name)
+		if err != nil {
+			return fmt.Errorf("error parsing reference name %s: %w", name, err)
+		}
+		pinned, err := reference.WithDigest(reference.TrimNamed(named), desc.Digest)
+		if err != nil {
+			return err
+		}
+
+		registry, err := registryFactory()
+		if err != nil {
+			return fmt.Errorf("could not create remote registry: %w", err)
+		}
+		img, err := registry.Resolve(ctx, pinned.String())
+		if err != nil {
+			return fmt.Errorf("error resolving %s: %w", pinned, err)
+		}
+		if err := s.Push(ctx, name, img); err != nil {
+			return fmt.Errorf("error downloading layers of %s: %w", name, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/onmetal/onmetal-image/ref"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// FormatText prints human-readable output including the pinned references.
+	FormatText = "text"
+	// FormatJSON prints a PinnedResult as JSON.
+	FormatJSON = "json"
+	// FormatPinned only prints the pinned references, one per line.
+	FormatPinned = "pinned"
+
+	RecommendedFormatFlagName  = "format"
+	RecommendedFormatFlagUsage = "Output format. One of text, json (reference, digest and pinned references as JSON) or pinned (only the pinned references, one per line). Other output goes to stderr unless text."
+)
+
+// ValidateFormat checks that format is one of FormatText, FormatJSON and FormatPinned.
+func ValidateFormat(format string) error {
+	switch format {
+	case FormatText, FormatJSON, FormatPinned:
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q, expected %s, %s or %s", format, FormatText, FormatJSON, FormatPinned)
+	}
+}
+
+// FormatOutputs returns the writers human-readable output and the result have to be written to for the
+// given format: both are out for FormatText. Otherwise the result goes to stdout and everything else to
+// stderr, so stdout stays parseable.
+func FormatOutputs(format string, out io.Writer) (info, result io.Writer) {
+	if format == FormatText {
+		return out, out
+	}
+	return os.Stderr, os.Stdout
+}
+
+// ValidateFormatWithProgress validates the format (see ValidateFormat) and rejects formats printing
+// to stdout if the progress mode does so as well.
+func ValidateFormatWithProgress(format, progressMode string) error {
+	if err := ValidateFormat(format); err != nil {
+		return err
+	}
+	if format != FormatText && progressMode == ProgressJSON {
+		return fmt.Errorf("--%s %s cannot be combined with --progress %s", RecommendedFormatFlagName, format, ProgressJSON)
+	}
+	return nil
+}
+
+// PinnedResult is the result of a command producing or resolving an image. Its JSON form is meant to be
+// consumed by scripts.
+type PinnedResult struct {
+	// Reference is the reference as given to the command.
+	Reference string `json:"reference,omitempty"`
+	// Digest is the digest of the image manifest.
+	Digest digest.Digest `json:"digest"`
+	// Pinned is the pinned reference without tag, see ref.Pinned. It is empty for images without reference.
+	Pinned string `json:"pinned,omitempty"`
+	// PinnedTag is the pinned reference including its tag, if any.
+	PinnedTag string `json:"pinnedTag,omitempty"`
+}
+
+// NewPinnedResult pins the reference (if not empty) to dgst with the given parser.
+func NewPinnedResult(parser ref.Parser, reference string, dgst digest.Digest) (*PinnedResult, error) {
+	res := &PinnedResult{Reference: reference, Digest: dgst}
+	if reference == "" {
+		return res, nil
+	}
+	pinned, err := parser.Pin(reference, dgst)
+	if err != nil {
+		return nil, fmt.Errorf("error pinning %s: %w", reference, err)
+	}
+	res.Pinned, res.PinnedTag = pinned.Digested, pinned.Tagged
+	return res, nil
+}
+
+// PrintPinned prints the pinned references of the result in the given format. Use it as the last output
+// of every command producing or resolving an image, so they all print the same form.
+func PrintPinned(out io.Writer, format string, res *PinnedResult) error {
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	case FormatPinned:
+		for _, pinned := range []string{res.Pinned, res.PinnedTag} {
+			if pinned != "" {
+				fmt.Fprintln(out, pinned)
+			}
+		}
+		return nil
+	default:
+		if res.Pinned != "" {
+			fmt.Fprintln(out, "Pinned:", res.Pinned)
+		}
+		if res.PinnedTag != "" {
+			fmt.Fprintln(out, "Pinned tag:", res.PinnedTag)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common_test
+
+import (
+	"bytes"
+	"encoding/json"
+
+	. "github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/ref"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+)
+
+var _ = Describe("Pinned", func() {
+	const dgst = digest.Digest("sha256:a1db18dba462bcb46990df82ec6caad910753052714f83dff63a34a4e85958c9")
+	parser := ref.Parser{DefaultRegistry: "ghcr.io"}
+
+	It("should print the pinned references in all formats", func() {
+		res, err := NewPinnedResult(parser, "onmetal/foo:v1", dgst)
+		Expect(err).NotTo(HaveOccurred())
+
+		var buf bytes.Buffer
+		Expect(PrintPinned(&buf, FormatText, res)).To(Succeed())
+		Expect(buf.String()).To(Equal("Pinned: ghcr.io/onmetal/foo@" + dgst.String() + "\nPinned tag: ghcr.io/onmetal/foo:v1@" + dgst.String() + "\n"))
+
+		buf.Reset()
+		Expect(PrintPinned(&buf, FormatPinned, res)).To(Succeed())
+		Expect(buf.String()).To(Equal("ghcr.io/onmetal/foo@" + dgst.String() + "\nghcr.io/onmetal/foo:v1@" + dgst.String() + "\n"))
+
+		buf.Reset()
+		Expect(PrintPinned(&buf, FormatJSON, res)).To(Succeed())
+		var decoded PinnedResult
+		Expect(json.Unmarshal(buf.Bytes(), &decoded)).To(Succeed())
+		Expect(decoded).To(Equal(*res))
+	})
+
+	It("should only print the digest of images without reference", func() {
+		res, err := NewPinnedResult(parser, "", dgst)
+		Expect(err).NotTo(HaveOccurred())
+
+		var buf bytes.Buffer
+		Expect(PrintPinned(&buf, FormatText, res)).To(Succeed())
+		Expect(buf.String()).To(BeEmpty())
+		Expect(res.Digest).To(Equal(dgst))
+	})
+
+	It("should reject unknown formats and JSON progress on stdout", func() {
+		Expect(ValidateFormat("yaml")).To(HaveOccurred())
+		Expect(ValidateFormatWithProgress(FormatJSON, ProgressJSON)).To(HaveOccurred())
+		Expect(ValidateFormatWithProgress(FormatText, ProgressJSON)).To(Succeed())
+	})
+})
@@ -0,0 +1,76 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/docker/go-units"
+	"github.com/onmetal/onmetal-image/client"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// ProgressNone disables progress reporting.
+	ProgressNone = "none"
+	// ProgressJSON writes progress events as newline-delimited JSON to stdout.
+	ProgressJSON = "json"
+)
+
+// RecommendedProgressFlagUsage is the usage of the --progress flag.
+const RecommendedProgressFlagUsage = "Progress output. One of none or json (newline-delimited JSON events on stdout, other output goes to stderr)."
+
+// ProgressContext sets up progress reporting for the given --progress mode. It returns a context carrying
+// the progress reporter and the writer human-readable output has to be written to.
+func ProgressContext(ctx context.Context, mode string) (context.Context, io.Writer, error) {
+	switch mode {
+	case ProgressNone, "":
+		return ctx, os.Stdout, nil
+	case ProgressJSON:
+		return progress.NewContext(ctx, progress.NewJSONReporter(os.Stdout)), os.Stderr, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown progress mode %q, expected %s or %s", mode, ProgressNone, ProgressJSON)
+	}
+}
+
+// StartOperation reports the start of the operation to the progress reporter of the context, see
+// progress.StartOperation.
+func StartOperation(ctx context.Context, operation, ref string) (context.Context, func(dgst digest.Digest, err error)) {
+	return progress.StartOperation(ctx, operation, ref)
+}
+
+// PrintTransferProgress prints what a pull or push transferred before it failed or was interrupted, if
+// err is a client.TransferError that transferred anything.
+func PrintTransferProgress(out io.Writer, err error) {
+	var transferErr *client.TransferError
+	if !errors.As(err, &transferErr) || len(transferErr.Progress.Blobs) == 0 {
+		return
+	}
+	p := transferErr.Progress
+	fmt.Fprintf(out, "%s of %s stopped after %d of %d blob(s) (%d already present, %s transferred)\n",
+		transferErr.Operation, transferErr.Ref, p.Completed, len(p.Blobs)-p.Skipped, p.Skipped, units.HumanSize(float64(p.Bytes)))
+	for _, status := range p.Resumable {
+		fmt.Fprintf(out, "Download of %s resumable at %s of %s\n",
+			status.Expected.Encoded()[:12], units.HumanSize(float64(status.Offset)), units.HumanSize(float64(status.Total)))
+	}
+	if len(p.Resumable) > 0 {
+		fmt.Fprintf(out, "Run the %s again to resume\n", transferErr.Operation)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/mediatypes"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LayerSize is the size of a layer as stored and after decompression.
+type LayerSize struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+	// Role is the role of the layer, see onmetalimage.LayerRole. It is omitted for unknown media types.
+	Role string `json:"role,omitempty"`
+	// Description describes the content of the layer according to its registered media type, see
+	// mediatypes.MediaTypeInfo. It is omitted for unknown media types.
+	Description string `json:"description,omitempty"`
+	Size        int64  `json:"size"`
+	// UncompressedSize is omitted if it could not be determined, e.g. because the layer is missing.
+	UncompressedSize *int64        `json:"uncompressedSize,omitempty"`
+	DiffID           digest.Digest `json:"diffID,omitempty"`
+}
+
+// LayerSizes determines the sizes of the layers of the image. Layers without a recorded uncompressed size
+// are decompressed to measure them, warning about the cost, and their diff IDs are validated against the
+// image config. The missing layers are left without uncompressed size.
+func LayerSizes(ctx context.Context, img ociimage.Image, missing []ocispec.Descriptor) ([]LayerSize, error) {
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting layers: %w", err)
+	}
+
+	isMissing := make(map[digest.Digest]bool, len(missing))
+	for _, desc := range missing {
+		isMissing[desc.Digest] = true
+	}
+
+	var (
+		res     = make([]LayerSize, 0, len(layers))
+		diffIDs = make(map[digest.Digest]digest.Digest)
+	)
+	for _, layer := range layers {
+		desc := layer.Descriptor()
+		size := LayerSize{Digest: desc.Digest, MediaType: desc.MediaType, Role: onmetalimage.LayerRole(desc), Size: desc.Size}
+		if info, ok := mediatypes.Lookup(desc.MediaType); ok {
+			size.Description = info.Description
+		}
+
+		uncompressed, ok := onmetalimage.UncompressedFromAnnotations(desc)
+		if !ok && !isMissing[desc.Digest] {
+			fmt.Fprintf(os.Stderr, "Warning: no uncompressed size recorded for layer %s, decompressing it to measure it\n", desc.Digest)
+			if uncompressed, err = onmetalimage.MeasureUncompressed(ctx, layer); err != nil {
+				return nil, err
+			}
+			diffIDs[desc.Digest] = uncompressed.DiffID
+			ok = true
+		}
+		if ok {
+			size.UncompressedSize = &uncompressed.Size
+			size.DiffID = uncompressed.DiffID
+		}
+		res = append(res, size)
+	}
+
+	if err := onmetalimage.ValidateDiffIDs(ctx, img, diffIDs); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,29 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// FormatLastUsed formats when an image was last used for tables, see layout.Usage.
+func FormatLastUsed(lastUsedAt *time.Time) string {
+	if lastUsedAt == nil {
+		return "<never>"
+	}
+	return units.HumanDuration(time.Since(*lastUsedAt)) + " ago"
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package completion
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+type Shell string
+
+const (
+	Bash Shell = "bash"
+	Zsh  Shell = "zsh"
+	Fish Shell = "fish"
+)
+
+func Command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "completion bash|zsh|fish",
+		Short: "Generate the shell completion script for onmetal-image.",
+		Long: `Generate the shell completion script for onmetal-image.
+
+Besides commands and flags, local references and image ids are completed by reading the index of the store.
+
+To load the completion in the current bash session, run:
+
+	source <(onmetal-image completion bash)
+
+For zsh and fish, write the script to a directory of your fpath or to ~/.config/fish/completions respectively.`,
+		ValidArgs: []string{string(Bash), string(Zsh), string(Fish)},
+		Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return Run(cmd.Root(), os.Stdout, Shell(args[0]))
+		},
+	}
+
+	return cmd
+}
+
+// Run writes the completion script of the root command for the given shell to out.
+func Run(root *cobra.Command, out io.Writer, shell Shell) error {
+	switch shell {
+	case Bash:
+		return root.GenBashCompletionV2(out, true)
+	case Zsh:
+		return root.GenZshCompletion(out)
+	case Fish:
+		return root.GenFishCompletion(out, true)
+	default:
+		return fmt.Errorf("unsupported shell %q", shell)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	onmetalconfig "github.com/onmetal/onmetal-image/config"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/spf13/cobra"
+)
+
+func Command(configFiles *[]string, storeFactory common.StoreFactory) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the layered configuration files and validate onmetal image configs.",
+	}
+
+	cmd.AddCommand(
+		ViewCommand(configFiles),
+		ValidateCommand(storeFactory),
+		SchemaCommand(),
+	)
+
+	return cmd
+}
+
+func ViewCommand(configFiles *[]string) *cobra.Command {
+	var showOrigin bool
+
+	cmd := &cobra.Command{
+		Use:   "view",
+		Short: "Print the effective configuration merged from all configuration files.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return RunView(*configFiles, showOrigin)
+		},
+	}
+
+	cmd.Flags().BoolVar(&showOrigin, "show-origin", false, "Annotate each value with the file and line it was set at.")
+
+	return cmd
+}
+
+func RunView(configFiles []string, showOrigin bool) error {
+	paths, err := common.ConfigPaths(configFiles)
+	if err != nil {
+		return err
+	}
+	c, err := onmetalconfig.Load(paths...)
+	if err != nil {
+		return err
+	}
+	return c.Encode(os.Stdout, showOrigin)
+}
+
+func ValidateCommand(storeFactory common.StoreFactory) *cobra.Command {
+	var (
+		file string
+		ref  string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "validate --file config.json | --ref image[:tag]",
+		Short: "Validate an onmetal image config document or the config of a local image against the config schema.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			return RunValidate(ctx, storeFactory, file, ref)
+		},
+	}
+
+	cmd.Flags().StringVar(&file, "file", "", "Config document to validate, - for stdin.")
+	cmd.Flags().StringVar(&ref, "ref", "", "Local image whose config to validate.")
+	cmd.MarkFlagsOneRequired("file", "ref")
+	cmd.MarkFlagsMutuallyExclusive("file", "ref")
+
+	return cmd
+}
+
+// RunValidate validates the config document at file or the config of the local image ref, printing each
+// violation with the JSON pointer to the offending field.
+func RunValidate(ctx context.Context, storeFactory common.StoreFactory, file, ref string) error {
+	var (
+		data []byte
+		err  error
+	)
+	if ref != "" {
+		data, err = readImageConfig(ctx, storeFactory, ref)
+	} else {
+		data, err = readFile(file)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = onmetalimage.ValidateConfigJSON(data)
+	var validationErr *onmetalimage.ConfigValidationError
+	if !errors.As(err, &validationErr) {
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Config is valid (schema version %d)\n", onmetalimage.ConfigSchemaVersion)
+		return nil
+	}
+	for _, fieldErr := range validationErr.Errors {
+		fmt.Println(fieldErr.Error())
+	}
+	return fmt.Errorf("config violates schema version %d in %d place(s)", onmetalimage.ConfigSchemaVersion, len(validationErr.Errors))
+}
+
+func readFile(file string) ([]byte, error) {
+	if file == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config from stdin: %w", err)
+		}
+		return data, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+	return data, nil
+}
+
+// readImageConfig reads the raw config blob of the given local image, so fields the Config struct does not
+// know are validated as well.
+func readImageConfig(ctx context.Context, storeFactory common.StoreFactory, srcImage string) ([]byte, error) {
+	s, err := storeFactory()
+	if err != nil {
+		return nil, fmt.Errorf("could not create store: %w", err)
+	}
+
+	ref, err := common.FuzzyResolveRef(ctx, s, srcImage)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving image: %w", err)
+	}
+
+	img, err := s.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("error getting image: %w", err)
+	}
+
+	a := ociimage.Access(img, ociimage.DefaultLimits)
+	configDesc, err := a.ConfigDescriptor(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting config descriptor: %w", err)
+	}
+	if configDesc.MediaType != onmetalimage.ConfigMediaType {
+		return nil, fmt.Errorf("image config has media type %q, expected %q", configDesc.MediaType, onmetalimage.ConfigMediaType)
+	}
+
+	data, err := a.RawConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+	return data, nil
+}
+
+func SchemaCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "schema",
+		Short: "Print the JSON Schema of onmetal image configs validate checks against.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, err := os.Stdout.Write(onmetalimage.ConfigSchema())
+			return err
+		},
+	}
+
+	return cmd
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/daemon"
+	"github.com/spf13/cobra"
+)
+
+func Command(clientFactory common.ClientFactory) *cobra.Command {
+	var listen string
+
+	cmd := &cobra.Command{
+		Use:   "daemon [--listen unix:///run/onmetal-image.sock]",
+		Short: "Serve pull, list, inspect, extract, pin, unpin and prune of the local store on a unix socket.",
+		Long: `Serve pull, list, inspect, extract, pin, unpin and prune of the local store on a unix socket.
+
+Co-located agents then go through the daemon instead of opening the store themselves, so only the daemon
+holds the store lock. The API is gRPC, see daemon/daemon.proto; Go programs use the daemon package, the CLI
+the --via-daemon flag.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			return Run(ctx, clientFactory, listen)
+		},
+	}
+
+	cmd.Flags().StringVar(&listen, "listen", "unix://"+daemon.DefaultSocket, "Address to listen on, a unix socket path or unix:// URL.")
+
+	return cmd
+}
+
+func Run(ctx context.Context, clientFactory common.ClientFactory, listen string) error {
+	path, err := daemon.SocketPath(listen)
+	if err != nil {
+		return err
+	}
+	c, err := clientFactory()
+	if err != nil {
+		return fmt.Errorf("error creating client: %w", err)
+	}
+
+	defer func() {
+		// Only remove the socket, Serve refuses to replace anything else at path.
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(path)
+		}
+	}()
+	fmt.Fprintln(os.Stderr, "Serving the store", c.Store().Layout().Path(), "on", path)
+	return daemon.NewServer(c).Serve(ctx, path)
+}
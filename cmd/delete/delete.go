@@ -1,4 +1,4 @@
-// Copyright 2021 OnMetal authors
+// Copyright 2023 OnMetal authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -17,46 +17,138 @@ package delete
 import (
 	"context"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 
+	"github.com/onmetal/onmetal-image/batch"
 	"github.com/onmetal/onmetal-image/cmd/common"
-
+	"github.com/onmetal/onmetal-image/docker"
+	"github.com/opencontainers/go-digest"
 	"github.com/spf13/cobra"
 )
 
-func Command(storeFactory common.StoreFactory) *cobra.Command {
+func Command(clientFactory common.ClientFactory, requestResolverFactory common.RequestResolverFactory) *cobra.Command {
+	var (
+		jsonOutput bool
+		remote     bool
+		dryRun     bool
+		yes        bool
+	)
+
 	cmd := &cobra.Command{
-		Use:   "delete image[:tag]",
-		Short: "Delete a local image.",
-		Args:  cobra.ExactArgs(1),
+		Use:   "delete image[:tag|@digest]...",
+		Short: "Delete local images, or tags and manifests of a remote registry.",
+		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
-			srcImage := args[0]
-			return Run(ctx, storeFactory, srcImage)
+			if remote {
+				return RunRemote(ctx, requestResolverFactory, args, dryRun, yes, jsonOutput, cmd.InOrStdin())
+			}
+			if dryRun || yes {
+				return fmt.Errorf("--dry-run and --yes are only supported with --remote")
+			}
+			return Run(ctx, clientFactory, args, jsonOutput)
 		},
 	}
 
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the per-image results as JSON.")
+	cmd.Flags().BoolVar(&remote, "remote", false, "Delete the manifests the given references point to from their registry instead of the local store.")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only print the remote manifests that would be deleted.")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Delete remote manifests without asking for confirmation.")
+
 	return cmd
 }
 
-func Run(ctx context.Context, storeFactory common.StoreFactory, ref string) error {
-	s, err := storeFactory()
+// Run deletes all given refs. Failing to delete one ref does not prevent deleting the others.
+func Run(ctx context.Context, clientFactory common.ClientFactory, refs []string, jsonOutput bool) error {
+	c, err := clientFactory()
 	if err != nil {
-		return fmt.Errorf("could not create store: %w", err)
+		return fmt.Errorf("could not create client: %w", err)
 	}
 
-	if err := s.Delete(ctx, ref); err != nil {
-		return fmt.Errorf("error deleting ref %s: %w", ref, err)
+	res := &common.BatchResult{}
+	res.Add(c.Delete(ctx, refs...)...)
+	if err := res.Print(os.Stdout, jsonOutput); err != nil {
+		return err
 	}
+	return res.Err()
+}
 
-	ref, err = common.FuzzyResolveRef(ctx, s, ref)
+// RunRemote deletes the manifests the given refs point to from their registries, see
+// docker.RequestResolver.Delete. It warns about other tags pointing to the same manifest since the
+// registry removes them as well.
+func RunRemote(
+	ctx context.Context,
+	requestResolverFactory common.RequestResolverFactory,
+	refs []string,
+	dryRun, yes, jsonOutput bool,
+	in io.Reader,
+) error {
+	resolver, err := requestResolverFactory()
 	if err != nil {
-		return fmt.Errorf("error resolving source: %w", err)
+		return fmt.Errorf("error creating request resolver: %w", err)
+	}
+
+	// Keep stdout parseable if the results are printed as JSON.
+	out := io.Writer(os.Stdout)
+	if jsonOutput {
+		out = os.Stderr
+	}
+
+	var (
+		res     = &common.BatchResult{}
+		deletes []string
+	)
+	for _, ref := range refs {
+		dgst, err := resolver.ResolveDigest(ctx, ref)
+		if err != nil {
+			res.Add(batch.Result{Name: ref, Err: err})
+			continue
+		}
+		fmt.Fprintf(out, "%s resolves to %s\n", ref, dgst)
+		warnOtherTags(ctx, out, resolver, ref, dgst)
+		deletes = append(deletes, ref)
+	}
+
+	switch {
+	case len(deletes) == 0:
+	case dryRun:
+		fmt.Fprintf(out, "Would delete %d manifest(s)\n", len(deletes))
+		deletes = nil
+	case !yes && !common.Confirm(in, out, fmt.Sprintf("Delete %d manifest(s)?", len(deletes))):
+		fmt.Fprintln(out, "Aborted")
+		deletes = nil
 	}
 
-	if err := s.Delete(ctx, ref); err != nil {
-		return fmt.Errorf("error deleting ref %s: %w", ref, err)
+	for _, ref := range deletes {
+		res.Add(batch.Result{Name: ref, Err: resolver.Delete(ctx, ref)})
+	}
+	if len(res.Items) == 0 && !jsonOutput {
+		return nil
+	}
+	if err := res.Print(os.Stdout, jsonOutput); err != nil {
+		return err
 	}
+	return res.Err()
+}
 
-	fmt.Println("Successfully deleted", ref)
-	return nil
+// warnOtherTags warns if tags other than the one of ref point to the manifest with the given digest.
+// Failing to list the tags only warns as well, not all registries support listing them.
+func warnOtherTags(ctx context.Context, out io.Writer, resolver *docker.RequestResolver, ref string, dgst digest.Digest) {
+	tags, err := resolver.TagsOf(ctx, ref, dgst)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not check for other tags pointing to %s: %v\n", dgst, err)
+		return
+	}
+
+	var other []string
+	for _, tag := range tags {
+		if !strings.HasSuffix(ref, ":"+tag) {
+			other = append(other, tag)
+		}
+	}
+	if len(other) > 0 {
+		fmt.Fprintf(out, "Warning: %s is also tagged %s, deleting the manifest removes these tags as well\n", dgst, strings.Join(other, ", "))
+	}
 }
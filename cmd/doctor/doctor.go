@@ -0,0 +1,81 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doctor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/doctor"
+	"github.com/spf13/cobra"
+)
+
+func Command(storePath *string, configPaths *[]string, configFactory common.ClientConfigFactory) *cobra.Command {
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check the environment and report details useful for support requests.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			return Run(ctx, configFactory, *storePath, *configPaths, jsonOutput)
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Output the results as JSON.")
+
+	return cmd
+}
+
+func Run(ctx context.Context, configFactory common.ClientConfigFactory, storePath string, configPaths []string, jsonOutput bool) error {
+	// A broken configuration is reported as a result of its own instead of preventing all other checks.
+	config, err := configFactory(storePath)
+	results := doctor.Run(ctx, doctor.Options{
+		StorePath:    storePath,
+		ConfigPaths:  configPaths,
+		Hosts:        config.Hosts,
+		ProtectBlobs: config.StoreProtectBlobs,
+	})
+	if err != nil {
+		results = append(results, doctor.Result{Name: "config", Status: doctor.StatusError, Message: err.Error()})
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 0, 1, ' ', 0)
+	_, _ = fmt.Fprintln(w, "CHECK\tSTATUS\tMESSAGE")
+	for _, result := range results {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", result.Name, result.Status, result.Message)
+
+		keys := make([]string, 0, len(result.Details))
+		for key := range result.Details {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			_, _ = fmt.Fprintf(w, "\t\t  %s: %s\n", key, result.Details[key])
+		}
+	}
+	return w.Flush()
+}
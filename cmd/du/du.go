@@ -0,0 +1,173 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package du
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/store"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory) *cobra.Command {
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "du [image[:tag]...]",
+		Short: "Show the compressed and uncompressed disk usage of local images, of all images if none are given.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			return Run(ctx, storeFactory, args, jsonOutput)
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the usage including the sizes of each layer as JSON.")
+
+	return cmd
+}
+
+// Usage is the disk usage of an image.
+type Usage struct {
+	Name string `json:"name"`
+	// Size is the total size of the layers as stored.
+	Size int64 `json:"size"`
+	// UncompressedSize is the total size of the layers after decompression. It is omitted if the
+	// uncompressed size of a layer could not be determined.
+	UncompressedSize *int64             `json:"uncompressedSize,omitempty"`
+	Layers           []common.LayerSize `json:"layers"`
+	// LastUsedAt is the time the image was last used, see layout.LastUsedAtAnnotation. It is omitted if
+	// no use was recorded.
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	// UseCount is how often the image was used.
+	UseCount int `json:"useCount"`
+}
+
+func Run(ctx context.Context, storeFactory common.StoreFactory, srcImages []string, jsonOutput bool) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	imgs, err := images(ctx, s, srcImages)
+	if err != nil {
+		return err
+	}
+
+	usages := make([]Usage, 0, len(imgs))
+	for _, img := range imgs {
+		usage, err := imageUsage(ctx, img)
+		if err != nil {
+			return fmt.Errorf("error determining disk usage of %s: %w", imageName(img.Descriptor()), err)
+		}
+		usages = append(usages, usage)
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(usages)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 0, 1, ' ', 0)
+	_, _ = fmt.Fprintln(w, "IMAGE\tSIZE\tUNCOMPRESSED\tLAST USED\tUSES")
+	for _, usage := range usages {
+		uncompressed := "<unknown>"
+		if usage.UncompressedSize != nil {
+			uncompressed = units.HumanSize(float64(*usage.UncompressedSize))
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", usage.Name, units.HumanSize(float64(usage.Size)), uncompressed,
+			common.FormatLastUsed(usage.LastUsedAt), usage.UseCount)
+	}
+	return w.Flush()
+}
+
+// images returns the given images or, if none are given, all images of the store. Listing all images
+// does not count as an access of them.
+func images(ctx context.Context, s *store.Store, srcImages []string) ([]ociimage.Image, error) {
+	if len(srcImages) == 0 {
+		descs, err := s.Layout().Indexer().List(ctx, descriptormatcher.MediaTypes(ocispec.MediaTypeImageManifest))
+		if err != nil {
+			return nil, fmt.Errorf("error listing images: %w", err)
+		}
+		imgs := make([]ociimage.Image, 0, len(descs))
+		for _, desc := range descs {
+			imgs = append(imgs, s.Layout().View(desc))
+		}
+		return imgs, nil
+	}
+
+	imgs := make([]ociimage.Image, 0, len(srcImages))
+	for _, srcImage := range srcImages {
+		ref, err := common.FuzzyResolveRef(ctx, s, srcImage)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving %s: %w", srcImage, err)
+		}
+		img, err := s.Resolve(ctx, ref)
+		if err != nil {
+			return nil, fmt.Errorf("error getting image %s: %w", ref, err)
+		}
+		imgs = append(imgs, img)
+	}
+	return imgs, nil
+}
+
+func imageUsage(ctx context.Context, img ociimage.Image) (Usage, error) {
+	_, missing, err := img.Complete(ctx)
+	if err != nil {
+		return Usage{}, fmt.Errorf("error checking image completeness: %w", err)
+	}
+	layers, err := common.LayerSizes(ctx, img, missing)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	var (
+		imgUsage     = layout.ImageUsage([]ocispec.Descriptor{img.Descriptor()})
+		usage        = Usage{Name: imageName(img.Descriptor()), Layers: layers, LastUsedAt: imgUsage.LastUsedAt, UseCount: imgUsage.UseCount}
+		uncompressed int64
+		known        = true
+	)
+	for _, layer := range layers {
+		usage.Size += layer.Size
+		if layer.UncompressedSize == nil {
+			known = false
+			continue
+		}
+		uncompressed += *layer.UncompressedSize
+	}
+	if known {
+		usage.UncompressedSize = &uncompressed
+	}
+	return usage, nil
+}
+
+// imageName returns the reference name of the index entry, or its abbreviated image id if it has none.
+func imageName(desc ocispec.Descriptor) string {
+	if name, ok := desc.Annotations[ocispec.AnnotationRefName]; ok {
+		return name
+	}
+	return desc.Digest.Encoded()[:12]
+}
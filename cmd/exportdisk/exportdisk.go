@@ -0,0 +1,122 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exportdisk
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/disk"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory) *cobra.Command {
+	var (
+		output         string
+		format         string
+		writeChecksums string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "export-disk image[:tag] -o file",
+		Short: "Export a local image to a raw or qcow2 disk image, e.g. to boot it in a local VM.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			srcImage := args[0]
+			diskFormat, err := disk.ParseFormat(format)
+			if err != nil {
+				return err
+			}
+			return Run(ctx, storeFactory, srcImage, output, diskFormat, writeChecksums)
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "", "File to write the disk image to.")
+	cmd.Flags().StringVar(&format, "format", string(disk.FormatQCOW2), "Format of the disk image. One of raw or qcow2.")
+	cmd.Flags().StringVar(&writeChecksums, common.RecommendedWriteChecksumsFlagName, "", common.RecommendedWriteChecksumsFlagUsage)
+	_ = cmd.RegisterFlagCompletionFunc("format", common.CompleteFixed(string(disk.FormatRaw), string(disk.FormatQCOW2)))
+	_ = cmd.MarkFlagRequired("output")
+
+	return cmd
+}
+
+func Run(ctx context.Context, storeFactory common.StoreFactory, srcImage, output string, format disk.Format, writeChecksums string) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	ref, err := common.FuzzyResolveRef(ctx, s, srcImage)
+	if err != nil {
+		return fmt.Errorf("error resolving source: %w", err)
+	}
+
+	ociImg, err := s.Resolve(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("error getting image: %w", err)
+	}
+	if err := ociimage.CheckComplete(ctx, ociImg); err != nil {
+		return err
+	}
+	lease, err := s.Layout().Lease(ctx, ociImg.Descriptor(), layout.DefaultLeaseTTL)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = lease.Release() }()
+
+	img, err := onmetalimage.ResolveImage(ctx, ociImg)
+	if err != nil {
+		return fmt.Errorf("error resolving onmetal image: %w", err)
+	}
+	if img.RootFS == nil {
+		return fmt.Errorf("%s has no rootfs layer to export", ref)
+	}
+	for _, warning := range img.Warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("error creating output file: %w", err)
+	}
+	src := disk.Source{
+		RootFS:      img.RootFS,
+		Kernel:      img.Kernel,
+		InitRAMFs:   img.InitRAMFs,
+		CommandLine: img.Config.CommandLine,
+	}
+	if err := disk.Export(ctx, src, f, format); err != nil {
+		_ = f.Close()
+		_ = os.Remove(output)
+		return fmt.Errorf("error exporting %s: %w", ref, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing output file: %w", err)
+	}
+	if writeChecksums != "" {
+		if err := common.WriteFileChecksums(writeChecksums, output, img.RootFS.Descriptor().Digest, ociImg.Descriptor().Digest); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("Successfully exported", ref, "to", format, "disk", output)
+	return nil
+}
@@ -0,0 +1,446 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extract
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/checksum"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/daemon"
+	"github.com/onmetal/onmetal-image/mediatypes"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/unpack"
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func Command(clientFactory common.ClientFactory, registryFactory common.RemoteRegistryFactory, daemonClientFactory common.DaemonClientFactory) *cobra.Command {
+	storeFactory := common.DefaultStoreFactory(clientFactory)
+	var (
+		rootFSUnpackTo string
+		fsType         string
+		numericIDs     bool
+		whiteoutMode   string
+		strict         bool
+		writeChecksums string
+		layer          int
+		role           string
+		layerSelectors []string
+		output         string
+		complete       bool
+		ukiTo          string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "extract image[:tag]",
+		Short: "Extract the contents of a local image or artifact.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			srcImage := args[0]
+			dc, err := common.ViaDaemon(cmd, daemonClientFactory, "rootfs-unpack-to", "numeric-ids", "whiteouts", "strict")
+			if err != nil {
+				return err
+			}
+			if dc != nil {
+				defer func() { _ = dc.Close() }()
+				if rootFSUnpackTo != "" {
+					return RunViaDaemon(ctx, dc, srcImage, rootFSUnpackTo, numericIDs, unpack.WhiteoutMode(whiteoutMode), strict)
+				}
+			}
+			handlePartial := common.PartialImageHandler(common.FailPartialImage)
+			if complete {
+				handlePartial = common.CompletePartialImage(registryFactory)
+			}
+
+			if cmd.Flags().Changed("layer") || role != "" || len(layerSelectors) > 0 {
+				if output == "" {
+					return fmt.Errorf("--output is required when extracting a single layer")
+				}
+				if role != "" || len(layerSelectors) > 0 {
+					return RunRole(ctx, storeFactory, handlePartial, srcImage, role, layerSelectors, output)
+				}
+				return RunLayer(ctx, storeFactory, handlePartial, srcImage, layer, output)
+			}
+			if rootFSUnpackTo == "" {
+				if ukiTo != "" {
+					return RunRole(ctx, storeFactory, handlePartial, srcImage, "uki", nil, ukiTo)
+				}
+				return fmt.Errorf("either --rootfs-unpack-to, --uki-to, --layer, --role or --layer-selector has to be specified")
+			}
+
+			opts := []unpack.Option{unpack.WithWhiteoutMode(unpack.WhiteoutMode(whiteoutMode))}
+			if numericIDs {
+				opts = append(opts, unpack.WithNumericIDs())
+			}
+			if strict {
+				opts = append(opts, unpack.WithStrict())
+			}
+			if err := Run(ctx, clientFactory, handlePartial, srcImage, rootFSUnpackTo, fsType, writeChecksums, opts...); err != nil {
+				return err
+			}
+			if ukiTo != "" {
+				return RunRole(ctx, storeFactory, handlePartial, srcImage, "uki", nil, ukiTo)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&rootFSUnpackTo, "rootfs-unpack-to", "", "Directory or block device to unpack the tar rootfs layer onto.")
+	cmd.Flags().StringVar(&fsType, "fs-type", "ext4", "File system type to mount the target with if it is a block device.")
+	cmd.Flags().BoolVar(&numericIDs, "numeric-ids", false, "Use the numeric user and group ids of the archive instead of looking up their names.")
+	cmd.Flags().StringVar(&whiteoutMode, "whiteouts", string(unpack.WhiteoutModeApply), "How to handle whiteouts. One of apply (remove whited-out files) or overlay (create overlayfs whiteouts).")
+	cmd.Flags().BoolVar(&strict, "strict", false, "Fail instead of skipping operations that require root, such as changing ownership.")
+	cmd.Flags().StringVar(&writeChecksums, common.RecommendedWriteChecksumsFlagName, "", common.RecommendedWriteChecksumsFlagUsage)
+	cmd.Flags().IntVar(&layer, "layer", 0, "Index of a single layer to write verbatim to --output, e.g. the payload of an artifact.")
+	cmd.Flags().StringVar(&role, "role", "", "Role of a single layer to write verbatim to --output. One of rootfs, initramfs, kernel, ignition, cloud-init, uki, esp or another registered layer kind, or a role with a suffix such as rootfs-b.")
+	cmd.Flags().StringSliceVar(&layerSelectors, "layer-selector", nil, "Select the single layer to write verbatim to --output by annotation in the form key=value. Can be specified multiple times and combined with --role.")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "File to write the layer selected with --layer, --role or --layer-selector to. Use - for stdout. Also accepted as --to.")
+	cmd.Flags().BoolVar(&complete, "complete", false, "Download the missing layers of an image pulled with --metadata-only instead of failing.")
+	cmd.Flags().StringVar(&ukiTo, "uki-to", "", "File to write the unified kernel image to. Can be combined with --rootfs-unpack-to.")
+	_ = cmd.RegisterFlagCompletionFunc("whiteouts", common.CompleteFixed(string(unpack.WhiteoutModeApply), string(unpack.WhiteoutModeOverlay)))
+	_ = cmd.RegisterFlagCompletionFunc("role", common.CompleteFixed(mediatypes.Roles()...))
+	cmd.MarkFlagsMutuallyExclusive("rootfs-unpack-to", "layer", "role")
+	cmd.MarkFlagsMutuallyExclusive("uki-to", "layer", "role")
+	cmd.MarkFlagsMutuallyExclusive("rootfs-unpack-to", "layer", "layer-selector")
+	cmd.MarkFlagsMutuallyExclusive("uki-to", "layer-selector")
+	cmd.Flags().SetNormalizeFunc(func(f *pflag.FlagSet, name string) pflag.NormalizedName {
+		if name == "to" {
+			name = "output"
+		}
+		return pflag.NormalizedName(name)
+	})
+
+	return cmd
+}
+
+func Run(
+	ctx context.Context,
+	clientFactory common.ClientFactory,
+	handlePartial common.PartialImageHandler,
+	srcImage, rootFSUnpackTo, fsType, writeChecksums string,
+	opts ...unpack.Option,
+) error {
+	c, err := clientFactory()
+	if err != nil {
+		return fmt.Errorf("could not create client: %w", err)
+	}
+
+	ref, err := c.ResolveRef(ctx, srcImage)
+	if err != nil {
+		return fmt.Errorf("error resolving source: %w", err)
+	}
+	if err := handlePartial(ctx, c.Store(), ref); err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(rootFSUnpackTo)
+	if err != nil {
+		return fmt.Errorf("error checking target: %w", err)
+	}
+
+	dir := rootFSUnpackTo
+	switch {
+	case fi.IsDir():
+	case fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0:
+		mountDir, unmount, err := unpack.MountDevice(rootFSUnpackTo, fsType)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := unmount(); err != nil {
+				fmt.Fprintln(os.Stderr, "Error unmounting target:", err)
+			}
+		}()
+		dir = mountDir
+	default:
+		return fmt.Errorf("target %s is neither a directory nor a block device", rootFSUnpackTo)
+	}
+
+	ociImg, err := c.Resolve(ctx, ref)
+	if err != nil {
+		return err
+	}
+	img, err := onmetalimage.ResolveImage(ctx, ociImg)
+	if err != nil {
+		return fmt.Errorf("error resolving onmetal image: %w", err)
+	}
+	for _, warning := range img.Warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+
+	var recorder *checksum.Recorder
+	if writeChecksums != "" {
+		recorder, err = checksum.NewRecorder(rootFSUnpackTo)
+		if err != nil {
+			return err
+		}
+		if img.RootFS == nil {
+			return fmt.Errorf("%s has no rootfs layer", ref)
+		}
+		var (
+			imageDigest = ociImg.Descriptor().Digest
+			layerDigest = img.RootFS.Descriptor().Digest
+		)
+		opts = append(opts, unpack.WithOnFile(func(f unpack.File) {
+			recorder.Record(checksum.File{
+				Path:        f.Name,
+				Size:        f.Size,
+				SHA256:      f.Digest.Encoded(),
+				LayerDigest: layerDigest,
+				ImageDigest: imageDigest,
+			})
+		}))
+	}
+
+	if err := c.Extract(ctx, ref, dir, opts...); err != nil {
+		return err
+	}
+
+	if recorder != nil {
+		if err := checksum.WriteFile(writeChecksums, recorder.Manifest()); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("Successfully unpacked rootfs of", ref, "to", rootFSUnpackTo)
+	return nil
+}
+
+// RunViaDaemon unpacks the tar rootfs layer of the image of the store of the daemon onto the directory
+// rootFSUnpackTo, see the daemon command. Unlike Run, it does not mount block devices.
+func RunViaDaemon(
+	ctx context.Context,
+	dc *daemon.Client,
+	srcImage, rootFSUnpackTo string,
+	numericIDs bool,
+	whiteoutMode unpack.WhiteoutMode,
+	strict bool,
+) error {
+	// The daemon resolves the path, which is relative to its working directory otherwise.
+	dir, err := filepath.Abs(rootFSUnpackTo)
+	if err != nil {
+		return fmt.Errorf("error making target absolute: %w", err)
+	}
+
+	opts := []daemon.ExtractOption{daemon.WithWhiteoutMode(whiteoutMode)}
+	if numericIDs {
+		opts = append(opts, daemon.WithNumericIDs())
+	}
+	if strict {
+		opts = append(opts, daemon.WithStrict())
+	}
+	if err := dc.Extract(ctx, srcImage, dir, opts...); err != nil {
+		return fmt.Errorf("error extracting %s via the daemon: %w", srcImage, err)
+	}
+
+	fmt.Println("Successfully unpacked rootfs of", srcImage, "to", rootFSUnpackTo)
+	return nil
+}
+
+// RunLayer writes the content of the layer with the given index to output, or to stdout if output is "-".
+func RunLayer(ctx context.Context, storeFactory common.StoreFactory, handlePartial common.PartialImageHandler, srcImage string, layer int, output string) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	ref, err := common.FuzzyResolveRef(ctx, s, srcImage)
+	if err != nil {
+		return fmt.Errorf("error resolving source: %w", err)
+	}
+	if err := handlePartial(ctx, s, ref); err != nil {
+		return err
+	}
+
+	img, err := s.Resolve(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("error getting image: %w", err)
+	}
+	lease, err := s.Layout().Lease(ctx, img.Descriptor(), layout.DefaultLeaseTTL)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = lease.Release() }()
+
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting layers: %w", err)
+	}
+	if layer < 0 || layer >= len(layers) {
+		return fmt.Errorf("layer index %d out of range, %s has %d layer(s)", layer, ref, len(layers))
+	}
+
+	if err := writeLayer(ctx, layers[layer], output); err != nil {
+		return err
+	}
+
+	if output != "-" {
+		fmt.Println("Successfully extracted layer", layer, "of", ref, "to", output)
+	}
+	return nil
+}
+
+// RunRole writes the content of the layer with the given role to output, or to stdout if output is "-".
+// See onmetalimage.LayerByRole for how roles select layers. Layer selectors of the form key=value (see
+// common.ParseLayerSelectors) select the single layer with these annotations instead, among those with the
+// role if not empty.
+func RunRole(ctx context.Context, storeFactory common.StoreFactory, handlePartial common.PartialImageHandler, srcImage, role string, layerSelectors []string, output string) error {
+	if _, ok := onmetalimage.RoleKind(role); !ok && (role != "" || len(layerSelectors) == 0) {
+		return fmt.Errorf("unknown layer role %q", role)
+	}
+	match, err := common.ParseLayerSelectors(layerSelectors)
+	if err != nil {
+		return err
+	}
+
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	ref, err := common.FuzzyResolveRef(ctx, s, srcImage)
+	if err != nil {
+		return fmt.Errorf("error resolving source: %w", err)
+	}
+	if err := handlePartial(ctx, s, ref); err != nil {
+		return err
+	}
+
+	img, err := s.Resolve(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("error getting image: %w", err)
+	}
+	lease, err := s.Layout().Lease(ctx, img.Descriptor(), layout.DefaultLeaseTTL)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = lease.Release() }()
+
+	var layer image.Layer
+	if match != nil {
+		layer, err = selectLayer(ctx, img, role, match, layerSelectors)
+	} else {
+		layer, err = onmetalimage.LayerByRole(ctx, img, role)
+	}
+	if errors.Is(err, image.ErrLayerNotPresent) {
+		return fmt.Errorf("%s: %w", ref, err)
+	}
+	if err != nil {
+		return fmt.Errorf("error selecting %s layer of %s: %w", describeSelection(role, layerSelectors), ref, err)
+	}
+
+	if err := writeLayer(ctx, layer, output); err != nil {
+		return err
+	}
+
+	if output != "-" {
+		fmt.Println("Successfully extracted", describeSelection(role, layerSelectors), "layer of", ref, "to", output)
+	}
+	return nil
+}
+
+// describeSelection describes the layer selected by role and layer selectors in messages, e.g.
+// "rootfs (fs-type=squashfs)".
+func describeSelection(role string, layerSelectors []string) string {
+	if len(layerSelectors) == 0 {
+		return role
+	}
+	selectors := "(" + strings.Join(layerSelectors, ", ") + ")"
+	if role == "" {
+		return selectors
+	}
+	return role + " " + selectors
+}
+
+// selectLayer returns the single layer of the image matching the layer selectors and, if not empty, the
+// role. Like for LayerByRole, a kind without suffix also matches suffixed roles, e.g. rootfs matches
+// rootfs-b.
+func selectLayer(ctx context.Context, img image.Image, role string, match descriptormatcher.Matcher, layerSelectors []string) (image.Layer, error) {
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting image layers: %w", err)
+	}
+
+	var (
+		candidates []image.Layer
+		roles      []string
+		available  []ocispec.Descriptor
+	)
+	for _, layer := range layers {
+		desc := layer.Descriptor()
+		available = append(available, desc)
+		layerRole := onmetalimage.LayerRole(desc)
+		if kind, _ := onmetalimage.RoleKind(layerRole); role != "" && layerRole != role && kind != role {
+			continue
+		}
+		if match(desc) {
+			candidates = append(candidates, layer)
+			roles = append(roles, layerRole)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, &image.LayerNotPresentError{
+			Digest:    img.Descriptor().Digest,
+			Role:      describeSelection(role, layerSelectors),
+			Available: onmetalimage.AvailableRoles(available),
+		}
+	case 1:
+		return candidates[0], nil
+	default:
+		return nil, &image.AmbiguousLayerError{Digest: img.Descriptor().Digest, Role: describeSelection(role, layerSelectors), Candidates: roles}
+	}
+}
+
+// writeLayer writes the content of the layer to the file at output, or to stdout if output is "-".
+func writeLayer(ctx context.Context, layer image.Layer, output string) error {
+	rc, err := layer.Content(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting layer content: %w", err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	if output == "-" {
+		if _, err := ioutils.CopyVerify(ctx, os.Stdout, rc, layer.Descriptor()); err != nil {
+			return fmt.Errorf("error writing layer: %w", err)
+		}
+		return nil
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("error creating output file: %w", err)
+	}
+	if _, err := ioutils.CopyVerify(ctx, f, rc, layer.Descriptor()); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("error writing layer: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing output file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fixplatforms
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/onmetal/onmetal-image/batch"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/store"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "fix-platforms image[:tag]...",
+		Short: "Set the platform of local index entries from the config of their images.",
+		Long: `Set the platform of local index entries from the config of their images.
+
+The operating system, architecture and variant are read from the OCI or docker image config and set on all
+local index entries of the image. No blobs are rewritten. Images whose config carries no platform
+information (such as onmetal images) are reported and left as-is.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			return Run(ctx, storeFactory, args, os.Stdout)
+		},
+	}
+
+	return cmd
+}
+
+// Run sets the platform of the index entries of all given refs. Failing to fix one ref does not prevent
+// fixing the others.
+func Run(ctx context.Context, storeFactory common.StoreFactory, refs []string, out io.Writer) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	var results []batch.Result
+	for _, ref := range refs {
+		result := fixPlatform(ctx, s, ref, out)
+		if result.Err != nil {
+			fmt.Fprintf(out, "%s: %v\n", ref, result.Err)
+		}
+		results = append(results, result)
+	}
+	return batch.Err(results)
+}
+
+func fixPlatform(ctx context.Context, s *store.Store, ref string, out io.Writer) batch.Result {
+	result := batch.Result{Name: ref}
+
+	resolved, err := common.FuzzyResolveRef(ctx, s, ref)
+	if err != nil {
+		result.Err = fmt.Errorf("error resolving source: %w", err)
+		return result
+	}
+
+	img, err := s.Resolve(ctx, resolved)
+	if err != nil {
+		result.Err = fmt.Errorf("error getting image: %w", err)
+		return result
+	}
+	desc := img.Descriptor()
+	result.Digest = desc.Digest
+
+	platform, err := imageutil.ConfigPlatform(ctx, img)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if platform == nil {
+		fmt.Fprintln(out, resolved, "has no platform information in its config, skipping")
+		return result
+	}
+	if desc.Platform != nil && reflect.DeepEqual(*desc.Platform, *platform) {
+		fmt.Fprintln(out, resolved, "already has the correct platform", platforms.Format(*platform))
+		return result
+	}
+
+	if err := s.Layout().Indexer().Update(ctx, descriptormatcher.Digests(desc.Digest), func(desc ocispec.Descriptor) ocispec.Descriptor {
+		desc.Platform = platform
+		return desc
+	}); err != nil {
+		result.Err = fmt.Errorf("error updating index entries: %w", err)
+		return result
+	}
+
+	old := "<none>"
+	if desc.Platform != nil {
+		old = platforms.Format(*desc.Platform)
+	}
+	fmt.Fprintf(out, "Fixed platform of %s: %s -> %s\n", resolved, old, platforms.Format(*platform))
+	return result
+}
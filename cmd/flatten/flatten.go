@@ -0,0 +1,83 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flatten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/mutate"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory) *cobra.Command {
+	var tag string
+
+	cmd := &cobra.Command{
+		Use:   "flatten image[:tag]",
+		Short: "Flatten the tar rootfs layers of a local image into a single uncompressed layer.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			srcImage := args[0]
+			return Run(ctx, storeFactory, srcImage, tag)
+		},
+	}
+
+	cmd.Flags().StringVar(&tag, "tag", "", "Reference to tag the flattened image with. If empty, the image is only stored by its id.")
+
+	return cmd
+}
+
+func Run(ctx context.Context, storeFactory common.StoreFactory, srcImage, tag string) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	ref, err := common.FuzzyResolveRef(ctx, s, srcImage)
+	if err != nil {
+		return fmt.Errorf("error resolving source: %w", err)
+	}
+
+	img, err := s.Resolve(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("error getting image: %w", err)
+	}
+
+	flattened, err := mutate.Flatten(ctx, s.Layout().Store(), img)
+	if err != nil {
+		if errors.Is(err, mutate.ErrAlreadyFlat) {
+			fmt.Println("The rootfs of", ref, "is not a tar archive but a single blob (e.g. a disk image), nothing to flatten")
+			return nil
+		}
+		return fmt.Errorf("error flattening image: %w", err)
+	}
+
+	if tag != "" {
+		if err := s.Push(ctx, tag, flattened); err != nil {
+			return fmt.Errorf("error pushing to ref %s: %w", tag, err)
+		}
+		fmt.Println("Successfully flattened", ref, "to", tag, flattened.Descriptor().Digest.Encoded())
+	} else {
+		if err := s.Put(ctx, flattened); err != nil {
+			return fmt.Errorf("error putting image: %w", err)
+		}
+		fmt.Println("Successfully flattened", ref, "to", flattened.Descriptor().Digest.Encoded())
+	}
+	return nil
+}
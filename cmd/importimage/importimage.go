@@ -0,0 +1,72 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package importimage
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/onmetal/onmetal-image/client"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/spf13/cobra"
+)
+
+func Command(clientFactory common.ClientFactory) *cobra.Command {
+	var (
+		from              string
+		containerdAddress string
+		progress          string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "import --from docker-daemon:image[:tag] | containerd:namespace/image[:tag] [image[:tag]]",
+		Short: "Import an image from the docker daemon or containerd of the host, tagging it with the given or its source name.",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, out, err := common.ProgressContext(cmd.Context(), progress)
+			if err != nil {
+				return err
+			}
+			var ref string
+			if len(args) > 0 {
+				ref = args[0]
+			}
+			return Run(ctx, clientFactory, from, ref, containerdAddress, out)
+		},
+	}
+
+	cmd.Flags().StringVar(&from, "from", "", "Image to import, either docker-daemon:image[:tag] or containerd:namespace/image[:tag].")
+	cmd.Flags().StringVar(&containerdAddress, "containerd-address", client.DefaultContainerdAddress, "Address of the containerd socket to import containerd images from.")
+	cmd.Flags().StringVar(&progress, "progress", common.ProgressNone, common.RecommendedProgressFlagUsage)
+	_ = cmd.MarkFlagRequired("from")
+
+	return cmd
+}
+
+func Run(ctx context.Context, clientFactory common.ClientFactory, from, ref, containerdAddress string, out io.Writer) error {
+	c, err := clientFactory()
+	if err != nil {
+		return fmt.Errorf("error creating client: %w", err)
+	}
+
+	img, err := c.Import(ctx, from, ref, client.WithContainerdAddress(containerdAddress))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "Successfully imported", from, img.Descriptor().Digest.Encoded())
+	return nil
+}
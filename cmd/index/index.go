@@ -0,0 +1,199 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/remote"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory, registryFactory common.RemoteRegistryFactory) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "index",
+		Short: "Manage image indexes.",
+	}
+
+	cmd.AddCommand(
+		CreateCommand(storeFactory, registryFactory),
+	)
+
+	return cmd
+}
+
+func CreateCommand(storeFactory common.StoreFactory, registryFactory common.RemoteRegistryFactory) *cobra.Command {
+	var (
+		manifests      []string
+		localManifests []string
+		push           bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "create dst-ref --manifest ref[=platform]... [--local-manifest ref[=platform]...] [--push]",
+		Short: "Assemble an image index from remote and local manifests.",
+		Long: `Assemble an image index from remote and local manifests.
+
+Remote manifests (--manifest) are only resolved, their platform is read from their config. Only the index
+itself is stored locally and tagged with dst-ref. Local manifests (--local-manifest) are taken from the
+local store. The platform of a manifest can be given explicitly as os/arch[/variant] after a '=',
+e.g. for onmetal images, whose config carries no platform.
+
+With --push, the index is pushed to dst-ref. Local manifests are pushed along with it, remote manifests
+of other repositories of the same registry are copied by mounting their blobs. Remote manifests of other
+registries are refused before anything is pushed.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			return RunCreate(ctx, storeFactory, registryFactory, args[0], manifests, localManifests, push, os.Stdout)
+		},
+	}
+
+	cmd.Flags().StringArrayVar(&manifests, "manifest", nil, "Remote manifest to reference, optionally followed by =os/arch[/variant]. Can be specified multiple times.")
+	cmd.Flags().StringArrayVar(&localManifests, "local-manifest", nil, "Local manifest to reference, optionally followed by =os/arch[/variant]. Can be specified multiple times.")
+	cmd.Flags().BoolVar(&push, "push", false, "Push the index and its local manifests to dst-ref.")
+	cmd.MarkFlagsOneRequired("manifest", "local-manifest")
+
+	return cmd
+}
+
+// parseChild splits a child argument into its reference and the explicitly given platform, if any.
+func parseChild(arg string) (string, *ocispec.Platform, error) {
+	ref, spec, ok := strings.Cut(arg, "=")
+	if !ok {
+		return ref, nil, nil
+	}
+	platform, err := platforms.Parse(spec)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid platform of %s: %w", ref, err)
+	}
+	return ref, &platform, nil
+}
+
+// childPlatform returns the explicit platform, or else the one of the index entry or config of the image.
+func childPlatform(ctx context.Context, ref string, img ociimage.Image, explicit *ocispec.Platform) (*ocispec.Platform, error) {
+	if explicit != nil {
+		return explicit, nil
+	}
+	if platform := img.Descriptor().Platform; platform != nil {
+		return platform, nil
+	}
+	platform, err := imageutil.ConfigPlatform(ctx, img)
+	if err != nil {
+		return nil, fmt.Errorf("error getting platform of %s: %w", ref, err)
+	}
+	if platform == nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s has no platform information, referencing it without platform\n", ref)
+	}
+	return platform, nil
+}
+
+func RunCreate(
+	ctx context.Context,
+	storeFactory common.StoreFactory,
+	registryFactory common.RemoteRegistryFactory,
+	dstRef string,
+	manifests, localManifests []string,
+	push bool,
+	out io.Writer,
+) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+	registry, err := registryFactory()
+	if err != nil {
+		return fmt.Errorf("error creating remote registry: %w", err)
+	}
+
+	var (
+		children []remote.IndexChild
+		descs    []ocispec.Descriptor
+	)
+	add := func(ref string, img ociimage.Image, source string, explicit *ocispec.Platform) error {
+		platform, err := childPlatform(ctx, ref, img, explicit)
+		if err != nil {
+			return err
+		}
+		desc := img.Descriptor()
+		desc.Platform = platform
+		children = append(children, remote.IndexChild{Image: img, Source: source})
+		descs = append(descs, desc)
+		return nil
+	}
+
+	for _, arg := range manifests {
+		ref, platform, err := parseChild(arg)
+		if err != nil {
+			return err
+		}
+		img, err := registry.Resolve(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("error resolving %s: %w", ref, err)
+		}
+		if err := add(ref, img, ref, platform); err != nil {
+			return err
+		}
+	}
+	for _, arg := range localManifests {
+		ref, platform, err := parseChild(arg)
+		if err != nil {
+			return err
+		}
+		resolved, err := common.FuzzyResolveRef(ctx, s, ref)
+		if err != nil {
+			return fmt.Errorf("error resolving %s: %w", ref, err)
+		}
+		img, err := s.Resolve(ctx, resolved)
+		if err != nil {
+			return fmt.Errorf("error getting image %s: %w", resolved, err)
+		}
+		if err := add(resolved, img, "", platform); err != nil {
+			return err
+		}
+	}
+
+	index, err := imageutil.IndexLayer(descs, nil)
+	if err != nil {
+		return err
+	}
+	if err := s.PushIndex(ctx, dstRef, index); err != nil {
+		return fmt.Errorf("error storing index: %w", err)
+	}
+	fmt.Fprintf(out, "Created index %s of %d manifest(s) as %s\n", index.Descriptor().Digest, len(descs), dstRef)
+
+	if !push {
+		return nil
+	}
+	res, err := registry.PushIndex(ctx, dstRef, index, children)
+	if err != nil {
+		return fmt.Errorf("error pushing index to %s: %w", dstRef, err)
+	}
+	if res.UpToDate {
+		fmt.Fprintln(out, dstRef, "is up to date")
+		return nil
+	}
+	fmt.Fprintf(out, "Pushed index to %s (%d blob(s) uploaded, %d already present)\n", dstRef, res.Uploaded, res.Skipped)
+	return nil
+}
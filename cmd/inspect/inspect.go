@@ -22,6 +22,9 @@ import (
 
 	onmetalimage "github.com/onmetal/onmetal-image"
 	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/refmap"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/onmetal/onmetal-image/cmd/common"
@@ -29,7 +32,9 @@ import (
 	"github.com/spf13/cobra"
 )
 
-func Command(storeFactory common.StoreFactory) *cobra.Command {
+func Command(storeFactory common.StoreFactory, registryFactory common.RemoteRegistryFactory) *cobra.Command {
+	var remote bool
+
 	cmd := &cobra.Command{
 		Use:   "inspect image[:tag]",
 		Short: "Inspect a local image, i.e. get its manifest and some of its metadata.",
@@ -37,36 +42,43 @@ func Command(storeFactory common.StoreFactory) *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
 			srcImage := args[0]
+			if remote {
+				return RunRemote(ctx, registryFactory, srcImage)
+			}
 			return Run(ctx, storeFactory, srcImage)
 		},
 	}
 
+	cmd.Flags().BoolVar(&remote, "remote", false, "Inspect the reference at its registry without pulling it. Works for any manifest, e.g. Helm charts or image indexes, and never downloads layers.")
+
 	return cmd
 }
 
 type Output struct {
-	Descriptor ocispec.Descriptor  `json:"descriptor"`
-	Manifest   ocispec.Manifest    `json:"manifest"`
-	Config     onmetalimage.Config `json:"config"`
-}
-
-func readImageConfig(ctx context.Context, img ociimage.Image) (*onmetalimage.Config, error) {
-	configLayer, err := img.Config(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("error getting config layer: %w", err)
-	}
-
-	rc, err := configLayer.Content(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("error getting config content: %w", err)
-	}
-	defer func() { _ = rc.Close() }()
-
-	config := &onmetalimage.Config{}
-	if err := json.NewDecoder(rc).Decode(config); err != nil {
-		return nil, fmt.Errorf("error decoding config: %w", err)
-	}
-	return config, nil
+	Descriptor ocispec.Descriptor `json:"descriptor"`
+	// Manifest is the image manifest. It is omitted for image indexes, see Manifests.
+	Manifest *ocispec.Manifest `json:"manifest,omitempty"`
+	// Manifests are the child manifests of an image index, only inspected with --remote.
+	Manifests []ocispec.Descriptor `json:"manifests,omitempty"`
+	// Config is the onmetal image config. It is omitted for artifacts, which have no runnable config.
+	Config *onmetalimage.Config `json:"config,omitempty"`
+	// Created is when the image was created, see layout.Layout.CreatedAt. It is omitted if unknown.
+	Created *layout.CreatedAt `json:"created,omitempty"`
+	// Partial is set if only the metadata of the image was pulled, see layout.PartialAnnotation.
+	Partial bool `json:"partial,omitempty"`
+	// ResolvedFrom is the source of the translation the image was pulled with, e.g. the ref map file,
+	// if it was not pulled from its registry. See refmap.ResolvedFromAnnotation.
+	ResolvedFrom string `json:"resolvedFrom,omitempty"`
+	// Complete reports whether the config and all layers are present in the local store, see Missing.
+	// Remote images are always complete.
+	Complete bool `json:"complete"`
+	// Missing are the blobs missing from the local store, which have to be pulled again.
+	Missing []ocispec.Descriptor `json:"missing,omitempty"`
+	// Roles are the roles of the layers in manifest order, or their media type for layers of unknown
+	// media types, see onmetalimage.AvailableRoles.
+	Roles []string `json:"roles"`
+	// Layers are the sizes of the layers as stored and after decompression.
+	Layers []common.LayerSize `json:"layers"`
 }
 
 func Run(ctx context.Context, storeFactory common.StoreFactory, srcImage string) error {
@@ -85,21 +97,104 @@ func Run(ctx context.Context, storeFactory common.StoreFactory, srcImage string)
 		return fmt.Errorf("error getting image: %w", err)
 	}
 
-	manifest, err := img.Manifest(ctx)
+	a := ociimage.Access(img, ociimage.DefaultLimits)
+	manifest, err := a.Manifest(ctx)
 	if err != nil {
 		return fmt.Errorf("error reading image manifest: %w", err)
 	}
 
-	config, err := readImageConfig(ctx, img)
+	complete, missing, err := img.Complete(ctx)
+	if err != nil {
+		return fmt.Errorf("error checking image completeness: %w", err)
+	}
+
+	out := Output{
+		Descriptor:   img.Descriptor(),
+		Manifest:     manifest,
+		Partial:      layout.IsPartial(img.Descriptor()),
+		ResolvedFrom: img.Descriptor().Annotations[refmap.ResolvedFromAnnotation],
+		Complete:     complete,
+		Missing:      missing,
+		Roles:        onmetalimage.AvailableRoles(manifest.Layers),
+	}
+	if created, ok := s.Layout().CreatedAt(ctx, img.Descriptor()); ok {
+		out.Created = &created
+	}
+	if out.Layers, err = common.LayerSizes(ctx, img, missing); err != nil {
+		return fmt.Errorf("error determining layer sizes: %w", err)
+	}
+	var configMissing bool
+	for _, desc := range missing {
+		configMissing = configMissing || desc.Digest == manifest.Config.Digest
+	}
+	if hasOnmetalConfig(manifest) && !configMissing {
+		config, err := onmetalimage.ReadConfig(ctx, a)
+		if err != nil {
+			return fmt.Errorf("error reading image config: %w", err)
+		}
+		out.Config = config
+	}
+
+	return printOutput(out)
+}
+
+// RunRemote inspects the reference at its registry. Unlike Run, it accepts any manifest or index, so it can
+// be used to find out what a reference that cannot be pulled points to. No layers are downloaded.
+func RunRemote(ctx context.Context, registryFactory common.RemoteRegistryFactory, ref string) error {
+	registry, err := registryFactory()
 	if err != nil {
-		return fmt.Errorf("error reading image config: %w", err)
+		return fmt.Errorf("error creating registry: %w", err)
+	}
+
+	img, err := registry.Resolve(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("error resolving %s: %w", ref, err)
+	}
+	out := Output{Descriptor: img.Descriptor(), Complete: true}
+
+	if ociimage.IsIndexMediaType(img.Descriptor().MediaType) {
+		index, err := registry.ResolveIndex(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("error resolving index %s: %w", ref, err)
+		}
+		if err := index.Walk(ctx, func(desc ocispec.Descriptor) error {
+			out.Manifests = append(out.Manifests, desc)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("error reading index %s: %w", ref, err)
+		}
+		return printOutput(out)
 	}
 
+	a := ociimage.Access(img, ociimage.DefaultLimits)
+	manifest, err := a.Manifest(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading manifest of %s: %w", ref, err)
+	}
+	out.Manifest = manifest
+	out.Roles = onmetalimage.AvailableRoles(manifest.Layers)
+	// Treating all layers as missing keeps LayerSizes from downloading them to measure them.
+	if out.Layers, err = common.LayerSizes(ctx, img, manifest.Layers); err != nil {
+		return fmt.Errorf("error determining layer sizes: %w", err)
+	}
+	if hasOnmetalConfig(manifest) {
+		config, err := onmetalimage.ReadConfig(ctx, a)
+		if err != nil {
+			return fmt.Errorf("error reading image config: %w", err)
+		}
+		out.Config = config
+	}
+	return printOutput(out)
+}
+
+// hasOnmetalConfig reports whether the manifest is the one of an onmetal image, whose config can be read
+// as onmetalimage.Config.
+func hasOnmetalConfig(manifest *ocispec.Manifest) bool {
+	return !imageutil.IsArtifact(manifest) && manifest.Config.MediaType == onmetalimage.ConfigMediaType
+}
+
+func printOutput(out Output) error {
 	enc := json.NewEncoder(os.Stdout)
 	enc.SetIndent("", "  ")
-	return enc.Encode(Output{
-		Descriptor: img.Descriptor(),
-		Manifest:   *manifest,
-		Config:     *config,
-	})
+	return enc.Encode(out)
 }
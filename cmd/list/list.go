@@ -21,11 +21,21 @@ import (
 	"sort"
 	"strings"
 	"text/tabwriter"
+	"time"
 
+	"github.com/docker/go-units"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
 	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/store"
 
 	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/daemon"
 
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/distribution/reference"
@@ -33,42 +43,218 @@ import (
 	"github.com/spf13/cobra"
 )
 
-func Command(storeFactory common.StoreFactory) *cobra.Command {
+func Command(clientFactory common.ClientFactory, daemonClientFactory common.DaemonClientFactory) *cobra.Command {
+	var (
+		latest      int
+		filters     []string
+		selector    string
+		verifyLocal bool
+		sortBy      string
+		condemned   bool
+		gracePeriod time.Duration
+	)
+
 	cmd := &cobra.Command{
 		Use:   "list",
-		Short: "List all images that are available locally.",
+		Short: "List all images that are available locally, most recently added first.",
+		Long: `List all images that are available locally, most recently added first.
+
+The CREATED column shows when each image was created according to its config. For images whose config
+records no created time, the time they were last pulled is shown instead, marked with a leading ~.
+
+With --condemned, only images whose tags were all moved to other images (e.g. by a pull updating the tag)
+are listed, with a REMOVABLE column showing when their grace period expires, see prune --condemned.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
-			return Run(ctx, storeFactory)
+			match, err := ParseFilters(filters)
+			if err != nil {
+				return err
+			}
+			if !condemned {
+				gracePeriod = 0
+			} else {
+				match = descriptormatcher.And(match, descriptormatcher.HasAnnotation(layout.CondemnedAtAnnotation))
+			}
+			if sortBy != SortAdded && sortBy != SortUsed && sortBy != SortCreated {
+				return fmt.Errorf("unknown sort order %q, expected %s, %s or %s", sortBy, SortAdded, SortUsed, SortCreated)
+			}
+			dc, err := common.ViaDaemon(cmd, daemonClientFactory, "latest", "sort")
+			if err != nil {
+				return err
+			}
+			if dc != nil {
+				defer func() { _ = dc.Close() }()
+				return RunViaDaemon(ctx, dc, latest, sortBy)
+			}
+			return Run(ctx, clientFactory, latest, match, selector, verifyLocal, sortBy, gracePeriod)
 		},
 	}
 
+	cmd.Flags().IntVar(&latest, "latest", 0, "Only list the first N images in sort order.")
+	cmd.Flags().StringArrayVar(&filters, "filter", nil, "Only list images matching the filter. Supported: annotation=<key>[=<value>]. Can be specified multiple times.")
+	cmd.Flags().StringVarP(&selector, "selector", "l", "", "Only list images matching the label selector, e.g. 'channel in (stable,beta),arch=amd64'. Keys are index annotations, except arch and os, which are read from the image config.")
+	cmd.Flags().BoolVar(&verifyLocal, "verify-local", false, "Add a COMPLETE column reporting whether all blobs of each image are present locally. Only stats the blobs.")
+	cmd.Flags().StringVar(&sortBy, "sort", SortAdded, "Sort order, either added (most recently added first), used (most recently used first, adding LAST USED and USES columns) or created (most recently created first, see CREATED).")
+	cmd.Flags().BoolVar(&condemned, "condemned", false, "Only list condemned images, adding a REMOVABLE column with the time remaining until prune --condemned removes them.")
+	cmd.Flags().DurationVar(&gracePeriod, "grace-period", layout.DefaultGracePeriod, "Grace period of condemned images the REMOVABLE column is computed with, see --condemned.")
+	_ = cmd.RegisterFlagCompletionFunc("sort", common.CompleteFixed(SortAdded, SortUsed, SortCreated))
+
 	return cmd
 }
 
-func Run(ctx context.Context, storeFactory common.StoreFactory) error {
-	s, err := storeFactory()
+const (
+	// SortAdded lists the most recently added images first.
+	SortAdded = "added"
+	// SortUsed lists the most recently used images first, never used ones last, see layout.LastUsedAt.
+	SortUsed = "used"
+	// SortCreated lists the most recently created images first, see layout.Layout.CreatedAt. Images whose
+	// creation time is unknown come last in the order they were added.
+	SortCreated = "created"
+)
+
+// ParseFilters parses list filters of the form <type>=<expression> into a matcher matching all of them.
+func ParseFilters(filters []string) (descriptormatcher.Matcher, error) {
+	matchers := make([]descriptormatcher.Matcher, 0, len(filters))
+	for _, filter := range filters {
+		typ, expr, ok := strings.Cut(filter, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid filter %q, expected <type>=<expression>", filter)
+		}
+
+		switch typ {
+		case "annotation":
+			if key, value, ok := strings.Cut(expr, "="); ok {
+				matchers = append(matchers, descriptormatcher.Annotation(key, value))
+			} else {
+				matchers = append(matchers, descriptormatcher.HasAnnotation(expr))
+			}
+		default:
+			return nil, fmt.Errorf("unknown filter type %q", typ)
+		}
+	}
+	return descriptormatcher.And(matchers...), nil
+}
+
+func Run(ctx context.Context, clientFactory common.ClientFactory, latest int, match descriptormatcher.Matcher, selector string, verifyLocal bool, sortBy string, gracePeriod time.Duration) error {
+	c, err := clientFactory()
 	if err != nil {
-		return fmt.Errorf("could not create layout: %w", err)
+		return fmt.Errorf("could not create client: %w", err)
 	}
+	s := c.Store()
 
-	descs, err := s.Layout().Indexer().List(ctx, descriptormatcher.MediaTypes(ocispec.MediaTypeImageManifest))
+	// Sorting by use or creation requires all images, the limit is applied afterwards.
+	limit := latest
+	if sortBy != SortAdded {
+		limit = 0
+	}
+
+	var descs []ocispec.Descriptor
+	if selector != "" {
+		descs, err = selectDescriptors(ctx, s, limit, match, selector)
+	} else {
+		descs, err = c.List(ctx, match, indexer.WithLimit(limit))
+	}
 	if err != nil {
-		return fmt.Errorf("error listing images: %w", err)
+		return err
+	}
+	created := make(map[digest.Digest]createdAt, len(descs))
+	for _, desc := range descs {
+		if _, ok := created[desc.Digest]; !ok {
+			t, ok := s.Layout().CreatedAt(ctx, desc)
+			created[desc.Digest] = createdAt{t, ok}
+		}
+	}
+	info := func(desc ocispec.Descriptor) imageInfo {
+		var info imageInfo
+		// Read the manifest directly from the content store to not count listing as an access.
+		if manifest, err := ociimage.Access(ocicontent.Image(s.Layout().Store(), desc), ociimage.DefaultLimits).Manifest(ctx); err == nil {
+			if imageutil.IsArtifact(manifest) {
+				info.artifactType = manifest.ArtifactType
+			}
+			info.expiresAt, _ = imageutil.ExpiresAt(manifest)
+		}
+		return info
+	}
+	var complete func(desc ocispec.Descriptor) string
+	if verifyLocal {
+		complete = func(desc ocispec.Descriptor) string {
+			return formatComplete(ctx, ocicontent.Image(s.Layout().Store(), desc))
+		}
+	}
+	return printImages(descs, created, info, complete, latest, sortBy, gracePeriod)
+}
+
+// RunViaDaemon lists the images of the store of the daemon, see the daemon command.
+func RunViaDaemon(ctx context.Context, dc *daemon.Client, latest int, sortBy string) error {
+	// Sorting by use or creation requires all images, the limit is applied afterwards.
+	limit := latest
+	if sortBy != SortAdded {
+		limit = 0
+	}
+	imgs, err := dc.List(ctx, daemon.WithLimit(limit))
+	if err != nil {
+		return fmt.Errorf("error listing images via the daemon: %w", err)
 	}
 
-	// Sort for some deterministic output
-	sort.Slice(descs, func(i, j int) bool {
-		r1 := descs[i].Annotations[ocispec.AnnotationRefName]
-		r2 := descs[i].Annotations[ocispec.AnnotationRefName]
-		if res := strings.Compare(r1, r2); res != 0 {
-			return res < 0
+	var (
+		descs   = make([]ocispec.Descriptor, 0, len(imgs))
+		created = make(map[digest.Digest]createdAt, len(imgs))
+		infos   = make(map[digest.Digest]imageInfo, len(imgs))
+	)
+	for _, img := range imgs {
+		descs = append(descs, img.Descriptor)
+		if img.Created != nil {
+			created[img.Descriptor.Digest] = createdAt{*img.Created, true}
 		}
-		return descs[i].Digest > descs[j].Digest
-	})
+		infos[img.Descriptor.Digest] = imageInfo{artifactType: img.ArtifactType, expiresAt: img.ExpiresAt}
+	}
+	info := func(desc ocispec.Descriptor) imageInfo { return infos[desc.Digest] }
+	return printImages(descs, created, info, nil, latest, sortBy, 0)
+}
+
+// imageInfo is what the list shows of the manifest of an image.
+type imageInfo struct {
+	// artifactType is the artifact type of an artifact, empty for images.
+	artifactType string
+	// expiresAt is when the image expires, zero if it does not.
+	expiresAt time.Time
+}
+
+// printImages sorts the index entries and prints the first latest ones, if positive. If complete is not
+// nil, it adds a COMPLETE column with its result. If gracePeriod is positive, it adds a REMOVABLE column
+// with the time remaining until condemned images may be removed.
+func printImages(
+	descs []ocispec.Descriptor,
+	created map[digest.Digest]createdAt,
+	info func(desc ocispec.Descriptor) imageInfo,
+	complete func(desc ocispec.Descriptor) string,
+	latest int,
+	sortBy string,
+	gracePeriod time.Duration,
+) error {
+	switch sortBy {
+	case SortUsed:
+		sortByUse(descs)
+	case SortCreated:
+		sortByCreated(descs, created)
+	}
+	if latest > 0 && len(descs) > latest {
+		descs = descs[:latest]
+	}
 
 	w := tabwriter.NewWriter(os.Stdout, 12, 0, 1, ' ', 0)
-	_, _ = fmt.Fprintln(w, "REPOSITORY\tTAG\tIMAGE ID")
+	header := "REPOSITORY\tTAG\tIMAGE ID\tARTIFACT TYPE\tCREATED\tEXPIRES"
+	if complete != nil {
+		header += "\tCOMPLETE"
+	}
+	if sortBy == SortUsed {
+		header += "\tLAST USED\tUSES"
+	}
+	if gracePeriod > 0 {
+		header += "\tREMOVABLE"
+	}
+	_, _ = fmt.Fprintln(w, header)
+	now := time.Now()
 	for _, item := range descs {
 		repo := "<none>"
 		tag := "<none>"
@@ -79,7 +265,124 @@ func Run(ctx context.Context, storeFactory common.StoreFactory) error {
 				tag = tagged.Tag()
 			}
 		}
-		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", repo, tag, item.Digest.Encoded()[:12])
+		manifestInfo := info(item)
+		artifactType := "<none>"
+		if manifestInfo.artifactType != "" {
+			artifactType = manifestInfo.artifactType
+		}
+		expires := "<none>"
+		if !manifestInfo.expiresAt.IsZero() {
+			expires = formatRemaining(manifestInfo.expiresAt.Sub(now))
+		}
+		row := fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s", repo, tag, item.Digest.Encoded()[:12], artifactType, created[item.Digest].format(now), expires)
+		if complete != nil {
+			row += "\t" + complete(item)
+		}
+		if sortBy == SortUsed {
+			usage := layout.ImageUsage([]ocispec.Descriptor{item})
+			row += fmt.Sprintf("\t%s\t%d", common.FormatLastUsed(usage.LastUsedAt), usage.UseCount)
+		}
+		if gracePeriod > 0 {
+			row += "\t" + formatRemovable(item, gracePeriod, now)
+		}
+		_, _ = fmt.Fprintln(w, row)
 	}
 	return w.Flush()
 }
+
+// selectDescriptors returns the descriptors of the images matching both the selector and match,
+// limited to the latest ones if latest is positive.
+func selectDescriptors(ctx context.Context, s *store.Store, latest int, match descriptormatcher.Matcher, selector string) ([]ocispec.Descriptor, error) {
+	imgs, err := s.Layout().Select(ctx, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	match = descriptormatcher.And(descriptormatcher.MediaTypes(ocispec.MediaTypeImageManifest), match)
+	var descs []ocispec.Descriptor
+	for _, img := range imgs {
+		if latest > 0 && len(descs) == latest {
+			break
+		}
+		if desc := img.Descriptor(); match(desc) {
+			descs = append(descs, desc)
+		}
+	}
+	return descs, nil
+}
+
+// sortByUse sorts the index entries most recently used first. Entries never used keep their order and
+// come last.
+func sortByUse(descs []ocispec.Descriptor) {
+	sort.SliceStable(descs, func(i, j int) bool {
+		ti, oki := layout.LastUsedAt(descs[i])
+		tj, okj := layout.LastUsedAt(descs[j])
+		if !oki || !okj {
+			return oki && !okj
+		}
+		return ti.After(tj)
+	})
+}
+
+// createdAt is the creation time of an image, if known, see layout.Layout.CreatedAt.
+type createdAt struct {
+	layout.CreatedAt
+	ok bool
+}
+
+// format formats how long ago the image was created, with a leading ~ if that is approximate.
+func (c createdAt) format(now time.Time) string {
+	if !c.ok {
+		return "<none>"
+	}
+	s := units.HumanDuration(now.Sub(c.Time)) + " ago"
+	if c.Approximate {
+		s = "~" + s
+	}
+	return s
+}
+
+// sortByCreated sorts the index entries most recently created first. Entries whose creation time is unknown
+// keep their order and come last.
+func sortByCreated(descs []ocispec.Descriptor, created map[digest.Digest]createdAt) {
+	sort.SliceStable(descs, func(i, j int) bool {
+		ci, cj := created[descs[i].Digest], created[descs[j].Digest]
+		if !ci.ok || !cj.ok {
+			return ci.ok && !cj.ok
+		}
+		return ci.Time.After(cj.Time)
+	})
+}
+
+// formatComplete formats whether all blobs of the image are present locally.
+func formatComplete(ctx context.Context, img ociimage.Image) string {
+	complete, missing, err := img.Complete(ctx)
+	switch {
+	case err != nil:
+		return "<unknown>"
+	case complete:
+		return "yes"
+	default:
+		return fmt.Sprintf("no (%d missing)", len(missing))
+	}
+}
+
+// formatRemovable formats when the condemned image of the index entry may be removed, see layout.CondemnedAt.
+func formatRemovable(desc ocispec.Descriptor, gracePeriod time.Duration, now time.Time) string {
+	condemnedAt, ok := layout.CondemnedAt(desc)
+	if !ok {
+		return "<none>"
+	}
+	if d := condemnedAt.Add(gracePeriod).Sub(now); d > 0 {
+		return "in " + units.HumanDuration(d)
+	}
+	return "now"
+}
+
+// formatRemaining formats the remaining lifetime of an image.
+func formatRemaining(d time.Duration) string {
+	if d <= 0 {
+		return "expired"
+	}
+	return "in " + units.HumanDuration(d)
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/layerfs"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory) *cobra.Command {
+	var (
+		dirPath    string
+		role       string
+		jsonOutput bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "ls image[:tag] [--path /etc]",
+		Short: "List a directory of the rootfs of a local image without extracting it.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			srcImage := args[0]
+			return Run(ctx, storeFactory, srcImage, role, dirPath, jsonOutput)
+		},
+	}
+
+	cmd.Flags().StringVar(&dirPath, "path", "/", "Path of the directory within the layer. Symbolic links are followed within the layer.")
+	cmd.Flags().StringVar(&role, "role", "rootfs", "Role of the layer to list the directory of, e.g. rootfs-b.")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the entries as JSON.")
+	_ = cmd.RegisterFlagCompletionFunc("role", common.CompleteFixed("rootfs", "initramfs", "kernel"))
+
+	return cmd
+}
+
+// entry is the JSON representation of a layerfs.Entry.
+type entry struct {
+	Name     string    `json:"name"`
+	Mode     string    `json:"mode"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	UID      int       `json:"uid"`
+	GID      int       `json:"gid"`
+	Linkname string    `json:"linkname,omitempty"`
+}
+
+// Run prints the entries of the directory at dirPath of the layer with the given role.
+func Run(ctx context.Context, storeFactory common.StoreFactory, srcImage, role, dirPath string, jsonOutput bool) error {
+	layer, ref, release, err := common.LeaseRoleLayer(ctx, storeFactory, srcImage, role)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	entries, err := layerfs.List(ctx, layer, dirPath)
+	if err != nil {
+		return fmt.Errorf("error listing %s of %s: %w", dirPath, ref, err)
+	}
+
+	if jsonOutput {
+		res := make([]entry, 0, len(entries))
+		for _, e := range entries {
+			res = append(res, entry{
+				Name:     e.Name,
+				Mode:     e.Mode.String(),
+				Size:     e.Size,
+				ModTime:  e.ModTime.UTC(),
+				UID:      e.UID,
+				GID:      e.GID,
+				Linkname: e.Linkname,
+			})
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	for _, e := range entries {
+		name := e.Name
+		if e.Mode&fs.ModeSymlink != 0 {
+			name += " -> " + e.Linkname
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\n", e.Mode, e.UID, e.GID, e.Size, e.ModTime.UTC().Format("2006-01-02 15:04"), name)
+	}
+	return w.Flush()
+}
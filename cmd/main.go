@@ -22,6 +22,7 @@ import (
 
 	"github.com/go-logr/zapr"
 	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/cmd/common"
 	cmdonmetalimage "github.com/onmetal/onmetal-image/cmd/onmetal-image"
 
 	"go.uber.org/zap"
@@ -32,6 +33,12 @@ import (
 func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
+	go func() {
+		// The first signal cancels the context, letting transfers stop after their current chunk with their
+		// ingests resumable and report their progress. Restore the default handling so a second one exits.
+		<-ctx.Done()
+		cancel()
+	}()
 
 	ctx = onmetalimage.SetupContext(ctx)
 
@@ -44,6 +51,6 @@ func main() {
 	ctx = logr.NewContext(ctx, log)
 	if err := cmdonmetalimage.Command().ExecuteContext(ctx); err != nil {
 		log.Error(err, "Error running command")
-		os.Exit(1)
+		os.Exit(common.ExitCode(err))
 	}
 }
@@ -0,0 +1,197 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package maintenance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/local"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "maintenance",
+		Short: "Maintenance tasks for the local store.",
+	}
+
+	cmd.AddCommand(
+		CompactCommand(storeFactory),
+		CleanupIngestsCommand(storeFactory),
+		RebuildRefCountsCommand(storeFactory),
+	)
+
+	return cmd
+}
+
+func CompactCommand(storeFactory common.StoreFactory) *cobra.Command {
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "compact",
+		Short: "Merge duplicate index entries and drop entries whose manifest no longer exists.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			return RunCompact(ctx, storeFactory, jsonOutput, os.Stdout)
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the result as JSON.")
+
+	return cmd
+}
+
+// RunCompact compacts the index of the local store, see layout.Layout.Compact.
+func RunCompact(ctx context.Context, storeFactory common.StoreFactory, jsonOutput bool, out io.Writer) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	res, err := s.Layout().Compact(ctx)
+	if err != nil {
+		return fmt.Errorf("error compacting index: %w", err)
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	common.PrintCompactResult(out, res)
+	return nil
+}
+
+func CleanupIngestsCommand(storeFactory common.StoreFactory) *cobra.Command {
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "cleanup-ingests",
+		Short: "Remove interrupted downloads that were not resumed for too long, see status.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			return RunCleanupIngests(ctx, storeFactory, jsonOutput, os.Stdout)
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the removed ingests as JSON.")
+
+	return cmd
+}
+
+// RunCleanupIngests removes the stale ingests of the local store, see local.Store.CleanupIngests.
+func RunCleanupIngests(ctx context.Context, storeFactory common.StoreFactory, jsonOutput bool, out io.Writer) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	removed, err := s.Layout().Store().CleanupIngests(ctx)
+	if err != nil {
+		return fmt.Errorf("error cleaning up ingests: %w", err)
+	}
+
+	if jsonOutput {
+		if removed == nil {
+			removed = []local.IngestInfo{}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(removed)
+	}
+	for _, info := range removed {
+		fmt.Fprintf(out, "Removed stale ingest %s (%s written, last updated %s)\n", info.Ref, units.HumanSize(float64(info.Offset)), info.UpdatedAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(out, "Removed %d stale ingest(s)\n", len(removed))
+	return nil
+}
+
+func RebuildRefCountsCommand(storeFactory common.StoreFactory) *cobra.Command {
+	var (
+		verify     bool
+		jsonOutput bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "rebuild-refcounts",
+		Short: "Recompute the blob reference counts of the store by reading all manifests.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			return RunRebuildRefCounts(ctx, storeFactory, verify, jsonOutput, os.Stdout)
+		},
+	}
+
+	cmd.Flags().BoolVar(&verify, "verify", false, "Only compare the recorded reference counts with the recomputed ones, without changing them.")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the result as JSON.")
+
+	return cmd
+}
+
+// RunRebuildRefCounts rebuilds or, if verify is set, verifies the reference counts of the local store,
+// see layout.Layout.RebuildRefCounts. Verifying fails if the reference counts are wrong.
+func RunRebuildRefCounts(ctx context.Context, storeFactory common.StoreFactory, verify, jsonOutput bool, out io.Writer) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	var res *layout.RefCountsResult
+	if verify {
+		res, err = s.Layout().VerifyRefCounts(ctx)
+	} else {
+		res, err = s.Layout().RebuildRefCounts(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		if res.Mismatches == nil {
+			res.Mismatches = []layout.RefCountMismatch{}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(res); err != nil {
+			return err
+		}
+	} else {
+		for _, m := range res.Mismatches {
+			fmt.Fprintf(out, "Blob %s: recorded %d reference(s), actually %d\n", m.Digest, m.Recorded, m.Actual)
+		}
+		switch {
+		case res.Stale:
+			fmt.Fprintln(out, "Recorded reference counts were stale")
+		case len(res.Mismatches) == 0:
+			fmt.Fprintln(out, "Recorded reference counts are correct")
+		}
+		fmt.Fprintf(out, "%d image(s) reference %d blob(s)\n", res.Images, res.Blobs)
+	}
+
+	if verify && (res.Stale || len(res.Mismatches) > 0) {
+		return fmt.Errorf("recorded reference counts are wrong, run maintenance rebuild-refcounts")
+	}
+	return nil
+}
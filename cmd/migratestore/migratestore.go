@@ -0,0 +1,103 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migratestore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/migration"
+	"github.com/spf13/cobra"
+)
+
+func Command(storePath *string) *cobra.Command {
+	var (
+		to         int
+		dryRun     bool
+		splitBlobs string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "migrate-store [--to <version>] [--dry-run] | --split-blobs <path>",
+		Short: "Migrate the local store to a newer format version in place or move its blobs to a separate directory.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if splitBlobs != "" {
+				return RunSplitBlobs(ctx, *storePath, splitBlobs)
+			}
+			return Run(ctx, *storePath, to, dryRun)
+		},
+	}
+
+	cmd.Flags().IntVar(&to, "to", migration.CurrentVersion, "Format version to migrate the store to.")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only print the migration steps that would run.")
+	cmd.Flags().StringVar(&splitBlobs, "split-blobs", "", "Move the blobs of the store to the given directory, keeping the index and metadata in place.")
+	cmd.MarkFlagsMutuallyExclusive("split-blobs", "dry-run")
+	cmd.MarkFlagsMutuallyExclusive("split-blobs", "to")
+	_ = cmd.MarkFlagDirname("split-blobs")
+
+	return cmd
+}
+
+func Run(ctx context.Context, storePath string, to int, dryRun bool) error {
+	from, ok, err := migration.ReadVersion(storePath)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s contains no store", storePath)
+	}
+
+	var opts []migration.Option
+	if dryRun {
+		opts = append(opts, migration.WithDryRun())
+	}
+	steps, err := migration.Migrate(ctx, storePath, to, opts...)
+	for _, step := range steps {
+		verb := "Migrated"
+		if dryRun {
+			verb = "Would migrate"
+		}
+		fmt.Printf("%s from version %d to %d: %s\n", verb, step.From, step.From+1, step.Description)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(steps) == 0:
+		fmt.Printf("Store %s already has format version %d\n", storePath, from)
+	case !dryRun:
+		fmt.Printf("Successfully migrated store %s to format version %d\n", storePath, to)
+	}
+	return nil
+}
+
+// RunSplitBlobs moves the blobs of the store to blobDir without hashing them again, see layout.SplitBlobs.
+func RunSplitBlobs(ctx context.Context, storePath, blobDir string) error {
+	if _, ok, err := migration.ReadVersion(storePath); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s contains no store", storePath)
+	}
+
+	if err := layout.SplitBlobs(ctx, storePath, blobDir); err != nil {
+		return fmt.Errorf("error moving blobs of store %s: %w", storePath, err)
+	}
+	fmt.Printf("Store %s keeps its blobs in %s\n", storePath, blobDir)
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"context"
+	"fmt"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	imagemutate "github.com/onmetal/onmetal-image/mutate"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory) *cobra.Command {
+	var (
+		tag               string
+		commandLine       string
+		commandLineAppend []string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "mutate image[:tag]",
+		Short: "Change the config of a local image, reusing all of its layers.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			srcImage := args[0]
+			if !cmd.Flags().Changed("command-line") && len(commandLineAppend) == 0 {
+				return fmt.Errorf("nothing to change, specify --command-line or --command-line-append")
+			}
+
+			var setCommandLine *string
+			if cmd.Flags().Changed("command-line") {
+				setCommandLine = &commandLine
+			}
+			return Run(ctx, storeFactory, srcImage, tag, setCommandLine, commandLineAppend)
+		},
+	}
+
+	cmd.Flags().StringVar(&tag, "tag", "", "Reference to tag the mutated image with. If empty, the image is only stored by its id.")
+	cmd.Flags().StringVar(&commandLine, "command-line", "", "Kernel command line to replace the one of the image with.")
+	cmd.Flags().StringArrayVar(&commandLineAppend, "command-line-append", nil, "Arguments to append to the kernel command line. Can be specified multiple times.")
+
+	return cmd
+}
+
+// Run replaces the kernel command line of the image if commandLine is not nil and then appends commandLineAppend.
+func Run(ctx context.Context, storeFactory common.StoreFactory, srcImage, tag string, commandLine *string, commandLineAppend []string) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	ref, err := common.FuzzyResolveRef(ctx, s, srcImage)
+	if err != nil {
+		return fmt.Errorf("error resolving source: %w", err)
+	}
+
+	img, err := s.Resolve(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("error getting image: %w", err)
+	}
+
+	mutated, err := imagemutate.EditConfig(ctx, img, func(config *onmetalimage.Config) error {
+		if commandLine != nil {
+			config.CommandLine = *commandLine
+		}
+		config.CommandLine = onmetalimage.AppendCommandLine(config.CommandLine, commandLineAppend...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error mutating image: %w", err)
+	}
+
+	if tag != "" {
+		if err := s.Push(ctx, tag, mutated); err != nil {
+			return fmt.Errorf("error pushing to ref %s: %w", tag, err)
+		}
+		fmt.Println("Successfully mutated", ref, "to", tag, mutated.Descriptor().Digest.Encoded())
+	} else {
+		if err := s.Put(ctx, mutated); err != nil {
+			return fmt.Errorf("error putting image: %w", err)
+		}
+		fmt.Println("Successfully mutated", ref, "to", mutated.Descriptor().Digest.Encoded())
+	}
+	return nil
+}
@@ -15,48 +15,236 @@
 package onmetalimage
 
 import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/onmetal/onmetal-image/cmd/annotate"
+	"github.com/onmetal/onmetal-image/cmd/audit"
+	"github.com/onmetal/onmetal-image/cmd/bench"
 	"github.com/onmetal/onmetal-image/cmd/build"
+	"github.com/onmetal/onmetal-image/cmd/builddelta"
+	"github.com/onmetal/onmetal-image/cmd/cat"
 	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/cmd/completion"
+	"github.com/onmetal/onmetal-image/cmd/config"
+	"github.com/onmetal/onmetal-image/cmd/daemon"
 	"github.com/onmetal/onmetal-image/cmd/delete"
+	"github.com/onmetal/onmetal-image/cmd/doctor"
+	"github.com/onmetal/onmetal-image/cmd/du"
+	"github.com/onmetal/onmetal-image/cmd/exportdisk"
+	"github.com/onmetal/onmetal-image/cmd/extract"
+	"github.com/onmetal/onmetal-image/cmd/fixplatforms"
+	"github.com/onmetal/onmetal-image/cmd/flatten"
+	"github.com/onmetal/onmetal-image/cmd/importimage"
+	"github.com/onmetal/onmetal-image/cmd/index"
 	"github.com/onmetal/onmetal-image/cmd/inspect"
 	"github.com/onmetal/onmetal-image/cmd/list"
+	"github.com/onmetal/onmetal-image/cmd/ls"
+	"github.com/onmetal/onmetal-image/cmd/maintenance"
+	"github.com/onmetal/onmetal-image/cmd/migratestore"
+	"github.com/onmetal/onmetal-image/cmd/mutate"
+	"github.com/onmetal/onmetal-image/cmd/outdated"
+	"github.com/onmetal/onmetal-image/cmd/prefetch"
+	"github.com/onmetal/onmetal-image/cmd/prune"
 	"github.com/onmetal/onmetal-image/cmd/pull"
 	"github.com/onmetal/onmetal-image/cmd/push"
+	"github.com/onmetal/onmetal-image/cmd/pushartifact"
+	"github.com/onmetal/onmetal-image/cmd/recompress"
+	"github.com/onmetal/onmetal-image/cmd/reference"
+	"github.com/onmetal/onmetal-image/cmd/rewrap"
+	"github.com/onmetal/onmetal-image/cmd/selfupdate"
+	"github.com/onmetal/onmetal-image/cmd/stats"
+	"github.com/onmetal/onmetal-image/cmd/status"
+	"github.com/onmetal/onmetal-image/cmd/sync"
 	"github.com/onmetal/onmetal-image/cmd/tag"
 	"github.com/onmetal/onmetal-image/cmd/url"
+	"github.com/onmetal/onmetal-image/cmd/verify"
+	"github.com/onmetal/onmetal-image/cmd/verifyfiles"
+	"github.com/onmetal/onmetal-image/cmd/version"
+	"github.com/onmetal/onmetal-image/oci/remote"
+	"github.com/onmetal/onmetal-image/ref"
 	"github.com/spf13/cobra"
 )
 
 func Command() *cobra.Command {
 	var (
-		storePath   string
-		configPaths []string
+		storePath              string
+		storeBlobDir           string
+		storeMaxSize           string
+		storeEncryptionKeyFile string
+		storeNoSync            bool
+		storeProtectBlobs      bool
+		configPaths            []string
+		noAnonymousFallback    bool
+		defaultRegistry        string
+		timeout                time.Duration
+		connectTimeout         time.Duration
+		resolveCacheTTL        time.Duration
+		noResolveCache         bool
+		registriesConfig       string
+		autoMigrate            bool
+		noUsageTracking        bool
+		storeNoAudit           bool
+		storeGracePeriod       time.Duration
+		noExternalBlobs        bool
+		configFiles            []string
+		configHosts            remote.HostsConfig
+		commitHooks            []string
+		refMaps                []string
+		viaDaemon              string
+		cancelTimeout          context.CancelFunc
 	)
 
 	var (
-		storeFactory           = common.DefaultStoreFactory(&storePath)
-		registryFactory        = common.DefaultRemoteRegistryFactory(configPaths)
-		requestResolverFactory = common.DefaultRequestResolverFactory(configPaths)
+		clientConfigFactory = common.DefaultClientConfigFactory(
+			&storeMaxSize, &storeEncryptionKeyFile, &storeNoSync, &storeProtectBlobs, &autoMigrate, &noUsageTracking, &storeNoAudit, &storeGracePeriod,
+			&configPaths, &noAnonymousFallback, &defaultRegistry, &connectTimeout, &resolveCacheTTL, &noResolveCache,
+			&registriesConfig, &noExternalBlobs, &configHosts, &commitHooks, &refMaps,
+		)
+		clientFactory          = common.DefaultClientFactory(&storePath, &storeBlobDir, clientConfigFactory)
+		storeFactory           = common.DefaultStoreFactory(clientFactory)
+		storeAtFactory         = common.DefaultStoreAtFactory(clientConfigFactory)
+		registryFactory        = common.DefaultRemoteRegistryFactory(&storePath, clientConfigFactory)
+		requestResolverFactory = common.DefaultRequestResolverFactory(&storePath, clientConfigFactory)
+		httpClientFactory      = common.DefaultHTTPClientFactory(&storePath, clientConfigFactory)
+		daemonClientFactory    = common.DefaultDaemonClientFactory(&viaDaemon)
 	)
 
 	cmd := &cobra.Command{
 		Use:   "onmetal-image",
 		Short: "Commands to interface with onmetal images.",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := common.ApplyConfig(cmd.Flags(), configFiles, &configHosts); err != nil {
+				return err
+			}
+			if timeout > 0 {
+				var ctx context.Context
+				ctx, cancelTimeout = context.WithTimeout(cmd.Context(), timeout)
+				cmd.SetContext(ctx)
+			}
+			return nil
+		},
+		PersistentPostRun: func(cmd *cobra.Command, args []string) {
+			if cancelTimeout != nil {
+				cancelTimeout()
+			}
+		},
 	}
 
 	cmd.AddCommand(
-		build.Command(storeFactory),
-		push.Command(storeFactory, registryFactory),
-		pull.Command(storeFactory, registryFactory),
+		build.Command(storeFactory, registryFactory, httpClientFactory),
+		push.Command(clientFactory),
+		pushartifact.Command(registryFactory),
+		index.Command(storeFactory, registryFactory),
+		pull.Command(clientFactory, storeAtFactory, daemonClientFactory),
+		prefetch.Command(&storePath, clientConfigFactory),
+		sync.Command(&storePath, clientConfigFactory),
+		daemon.Command(clientFactory),
+		importimage.Command(clientFactory),
 		tag.Command(storeFactory),
-		list.Command(storeFactory),
-		inspect.Command(storeFactory),
-		delete.Command(storeFactory),
+		annotate.Command(storeFactory),
+		list.Command(clientFactory, daemonClientFactory),
+		inspect.Command(storeFactory, registryFactory),
+		du.Command(storeFactory),
+		status.Command(storeFactory),
+		stats.Command(storeFactory),
+		audit.Command(storeFactory),
+		outdated.Command(storeFactory, storeAtFactory, requestResolverFactory),
+		delete.Command(clientFactory, requestResolverFactory),
+		extract.Command(clientFactory, registryFactory, daemonClientFactory),
+		exportdisk.Command(storeFactory),
+		cat.Command(storeFactory),
+		ls.Command(storeFactory),
+		flatten.Command(storeFactory),
+		builddelta.Command(storeFactory),
+		fixplatforms.Command(storeFactory),
+		mutate.Command(storeFactory),
+		verifyfiles.Command(),
+		verify.Command(storeFactory),
+		prune.Command(storeFactory, requestResolverFactory, daemonClientFactory),
+		maintenance.Command(storeFactory),
+		recompress.Command(storeFactory),
 		url.Command(requestResolverFactory),
+		reference.Command(requestResolverFactory),
+		doctor.Command(&storePath, &configPaths, clientConfigFactory),
+		bench.Command(&storePath, clientConfigFactory),
+		rewrap.Command(&storePath),
+		version.Command(),
+		selfupdate.Command(httpClientFactory),
+		migratestore.Command(&storePath),
+		config.Command(&configFiles, storeFactory),
+		completion.Command(),
 	)
+	cmd.CompletionOptions.DisableDefaultCmd = true
 
+	cmd.PersistentFlags().StringSliceVar(&configFiles, common.RecommendedConfigFlagName, nil, common.RecommendedConfigFlagUsage)
 	cmd.PersistentFlags().StringVar(&storePath, common.RecommendedStorePathFlagName, common.DefaultStorePath, common.RecommendedStorePathFlagUsage)
+	cmd.PersistentFlags().StringVar(&storeBlobDir, common.RecommendedStoreBlobDirFlagName, "", common.RecommendedStoreBlobDirFlagUsage)
+	cmd.PersistentFlags().StringVar(&storeMaxSize, common.RecommendedStoreMaxSizeFlagName, "", common.RecommendedStoreMaxSizeFlagUsage)
+	cmd.PersistentFlags().StringVar(&storeEncryptionKeyFile, common.RecommendedStoreEncryptionKeyFlagName, "", common.RecommendedStoreEncryptionKeyFlagUsage)
+	cmd.PersistentFlags().BoolVar(&storeNoSync, common.RecommendedStoreNoSyncFlagName, false, common.RecommendedStoreNoSyncFlagUsage)
+	cmd.PersistentFlags().BoolVar(&storeProtectBlobs, common.RecommendedStoreProtectBlobsFlagName, false, common.RecommendedStoreProtectBlobsFlagUsage)
+	cmd.PersistentFlags().BoolVar(&autoMigrate, common.RecommendedAutoMigrateFlagName, false, common.RecommendedAutoMigrateFlagUsage)
+	cmd.PersistentFlags().BoolVar(&noUsageTracking, common.RecommendedNoUsageTrackingFlagName, false, common.RecommendedNoUsageTrackingFlagUsage)
+	cmd.PersistentFlags().BoolVar(&storeNoAudit, common.RecommendedStoreNoAuditFlagName, false, common.RecommendedStoreNoAuditFlagUsage)
+	cmd.PersistentFlags().DurationVar(&storeGracePeriod, common.RecommendedStoreGracePeriodFlagName, 0, common.RecommendedStoreGracePeriodFlagUsage)
 	cmd.PersistentFlags().StringSliceVar(&configPaths, common.RecommendedDockerConfigPathsFlagName, nil, common.RecommendedDockerConfigPathsFlagName)
+	cmd.PersistentFlags().StringVar(&defaultRegistry, common.RecommendedDefaultRegistryFlagName, ref.DefaultRegistry, common.RecommendedDefaultRegistryFlagUsage)
+	cmd.PersistentFlags().DurationVar(&timeout, common.RecommendedTimeoutFlagName, 0, common.RecommendedTimeoutFlagUsage)
+	cmd.PersistentFlags().DurationVar(&connectTimeout, common.RecommendedConnectTimeoutFlagName, 0, common.RecommendedConnectTimeoutFlagUsage)
+	cmd.PersistentFlags().DurationVar(&resolveCacheTTL, common.RecommendedResolveCacheTTLFlagName, common.DefaultResolveCacheTTL, common.RecommendedResolveCacheTTLFlagUsage)
+	cmd.PersistentFlags().BoolVar(&noResolveCache, common.RecommendedNoResolveCacheFlagName, false, common.RecommendedNoResolveCacheFlagUsage)
+	cmd.PersistentFlags().StringVar(&registriesConfig, common.RecommendedRegistriesConfigFlagName, "", common.RecommendedRegistriesConfigFlagUsage)
+	cmd.PersistentFlags().BoolVar(&noExternalBlobs, common.RecommendedNoExternalBlobsFlagName, false, common.RecommendedNoExternalBlobsFlagUsage)
+	cmd.PersistentFlags().StringArrayVar(&commitHooks, common.RecommendedCommitHookFlagName, nil, common.RecommendedCommitHookFlagUsage)
+	cmd.PersistentFlags().StringArrayVar(&refMaps, common.RecommendedRefMapFlagName, nil, common.RecommendedRefMapFlagUsage)
+	cmd.PersistentFlags().BoolVar(&noAnonymousFallback, common.RecommendedNoAnonymousFallbackFlagName, false, common.RecommendedNoAnonymousFallbackFlagUsage)
+	cmd.PersistentFlags().StringVar(&viaDaemon, common.RecommendedViaDaemonFlagName, "", common.RecommendedViaDaemonFlagUsage)
+	_ = cmd.MarkPersistentFlagDirname(common.RecommendedStorePathFlagName)
+	_ = cmd.MarkPersistentFlagDirname(common.RecommendedStoreBlobDirFlagName)
+
+	registerRefCompletions(cmd, func(maxArgs int) common.CompletionFunc {
+		complete := common.CompleteLocalRefs(&storePath, &defaultRegistry, maxArgs)
+		return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			// Completions run without the persistent pre-run, apply the configuration files for the store path.
+			if err := common.ApplyConfig(cmd.Flags(), configFiles, &configHosts); err != nil {
+				cobra.CompDebugln(fmt.Sprintf("error applying configuration: %v", err), false)
+			}
+			return complete(cmd, args, toComplete)
+		}
+	})
 
 	return cmd
 }
+
+// refArgs maps the commands taking local references as positional arguments to the number of those
+// arguments (unlimited if negative).
+var refArgs = map[string]int{
+	"annotate":      1,
+	"cat":           1,
+	"delete":        -1,
+	"du":            -1,
+	"export-disk":   1,
+	"extract":       1,
+	"fix-platforms": -1,
+	"flatten":       1,
+	"inspect":       1,
+	"ls":            1,
+	"mutate":        1,
+	"push":          1,
+	"tag":           2,
+	"verify":        1,
+}
+
+// registerRefCompletions registers the completion of local references for the subcommands of cmd.
+func registerRefCompletions(cmd *cobra.Command, complete func(maxArgs int) common.CompletionFunc) {
+	for _, sub := range cmd.Commands() {
+		if maxArgs, ok := refArgs[sub.Name()]; ok {
+			sub.ValidArgsFunction = complete(maxArgs)
+		}
+	}
+	if recompressCmd, _, err := cmd.Find([]string{"recompress"}); err == nil {
+		_ = recompressCmd.RegisterFlagCompletionFunc("ref", complete(-1))
+	}
+}
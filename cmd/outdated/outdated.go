@@ -0,0 +1,154 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package outdated
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/onmetal/onmetal-image/client"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/oci/store"
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+func Command(
+	storeFactory common.StoreFactory,
+	storeAtFactory common.StoreAtFactory,
+	requestResolverFactory common.RequestResolverFactory,
+) *cobra.Command {
+	var (
+		storePath   string
+		concurrency int
+		jsonOutput  bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "outdated",
+		Short: "Report which tagged local images are stale compared to what their tags point to remotely.",
+		Long: fmt.Sprintf(`Re-resolve the tag of every tagged local image at its registry and report whether the image is
+stale, up to date or its tag no longer exists remotely. Exits with code %d if any image is stale or missing.`, common.ExitCodeOutdated),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			factory := storeFactory
+			if storePath != "" {
+				factory = func() (*store.Store, error) { return storeAtFactory(storePath) }
+			}
+			return Run(ctx, factory, requestResolverFactory, concurrency, jsonOutput)
+		},
+	}
+
+	cmd.Flags().StringVar(&storePath, "store", "", "Path of the store to check instead of the default store.")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 4, "Maximum number of tags resolved concurrently per registry.")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the per-image results as JSON.")
+
+	return cmd
+}
+
+// Result is the JSON form of a client.OutdatedResult.
+type Result struct {
+	Reference string                `json:"reference"`
+	Status    client.OutdatedStatus `json:"status"`
+	Local     digest.Digest         `json:"local"`
+	Remote    digest.Digest         `json:"remote,omitempty"`
+	Error     string                `json:"error,omitempty"`
+}
+
+func Run(
+	ctx context.Context,
+	storeFactory common.StoreFactory,
+	requestResolverFactory common.RequestResolverFactory,
+	concurrency int,
+	jsonOutput bool,
+) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+	resolver, err := requestResolverFactory()
+	if err != nil {
+		return fmt.Errorf("error creating request resolver: %w", err)
+	}
+
+	outdated, err := client.CheckOutdated(ctx, s, resolver, concurrency)
+	if err != nil {
+		return err
+	}
+
+	var (
+		results = make([]Result, 0, len(outdated))
+		counts  = make(map[client.OutdatedStatus]int)
+	)
+	for _, o := range outdated {
+		result := Result{Reference: o.Reference, Status: o.Status, Local: o.Local, Remote: o.Remote}
+		if o.Err != nil {
+			result.Error = o.Err.Error()
+		}
+		results = append(results, result)
+		counts[o.Status]++
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		if err := printResults(results); err != nil {
+			return err
+		}
+		fmt.Printf("%d stale, %d missing, %d up to date, %d failed\n",
+			counts[client.OutdatedStatusStale],
+			counts[client.OutdatedStatusMissing],
+			counts[client.OutdatedStatusUpToDate],
+			counts[client.OutdatedStatusError],
+		)
+	}
+
+	// Stale images take precedence over errors, so alerting on them is not masked by a flaky registry.
+	switch {
+	case counts[client.OutdatedStatusStale] > 0 || counts[client.OutdatedStatusMissing] > 0:
+		return &common.ExitError{
+			Code: common.ExitCodeOutdated,
+			Err:  fmt.Errorf("%d of %d image(s) outdated", counts[client.OutdatedStatusStale]+counts[client.OutdatedStatusMissing], len(results)),
+		}
+	case counts[client.OutdatedStatusError] > 0:
+		return fmt.Errorf("could not check %d of %d image(s)", counts[client.OutdatedStatusError], len(results))
+	default:
+		return nil
+	}
+}
+
+func printResults(results []Result) error {
+	if len(results) == 0 {
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 12, 0, 1, ' ', 0)
+	_, _ = fmt.Fprintln(w, "REFERENCE\tSTATUS\tLOCAL\tREMOTE\tERROR")
+	for _, result := range results {
+		remote := "<none>"
+		if result.Remote != "" {
+			remote = result.Remote.Encoded()[:12]
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", result.Reference, result.Status, result.Local.Encoded()[:12], remote, result.Error)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prefetch
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/go-logr/logr"
+	"github.com/onmetal/onmetal-image/client"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/remote"
+	"github.com/onmetal/onmetal-image/prefetch"
+	"github.com/spf13/cobra"
+)
+
+// StatusSocketFileName is the name of the default status socket in the store directory.
+const StatusSocketFileName = "prefetch.sock"
+
+func Command(storePath *string, configFactory common.ClientConfigFactory) *cobra.Command {
+	var (
+		manifestFile   string
+		schedule       string
+		limitBandwidth string
+		daemon         bool
+		interval       time.Duration
+		policy         string
+		statusSocket   string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "prefetch --manifest prefetch.yaml",
+		Short: "Pull the images listed in a manifest in the background, within a time window and bandwidth cap.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			return Run(ctx, configFactory, *storePath, Options{
+				ManifestFile:   manifestFile,
+				Schedule:       schedule,
+				LimitBandwidth: limitBandwidth,
+				Daemon:         daemon,
+				Interval:       interval,
+				PolicyFile:     policy,
+				StatusSocket:   statusSocket,
+			})
+		},
+	}
+
+	cmd.Flags().StringVar(&manifestFile, "manifest", "", "Manifest (YAML) listing the references to prefetch, optionally with platform and priority.")
+	cmd.Flags().StringVar(&schedule, "schedule", "", "Daily time window (local time, e.g. 02:00-05:00) to pull in. Pulls still running when it closes are resumed in the next one. If empty, pull right away.")
+	cmd.Flags().StringVar(&limitBandwidth, common.RecommendedLimitBandwidthFlagName, "", common.RecommendedLimitBandwidthFlagUsage)
+	cmd.Flags().BoolVar(&daemon, "daemon", false, "Keep running and prefetch in every window, or every --interval without --schedule, instead of once.")
+	cmd.Flags().DurationVar(&interval, "interval", prefetch.DefaultInterval, "Time between two cycles in daemon mode without --schedule.")
+	cmd.Flags().StringVar(&policy, "policy", "", "Retention policy (YAML, see prune --policy) applied to the local store after every cycle.")
+	cmd.Flags().StringVar(&statusSocket, "status-socket", "", fmt.Sprintf("Unix socket serving the prefetch status as JSON. Defaults to %s in the store directory.", StatusSocketFileName))
+	_ = cmd.MarkFlagRequired("manifest")
+	_ = cmd.MarkFlagFilename("manifest", "yaml", "yml")
+	_ = cmd.MarkFlagFilename("policy", "yaml", "yml")
+
+	return cmd
+}
+
+// Options are the options of the prefetch command.
+type Options struct {
+	ManifestFile   string
+	Schedule       string
+	LimitBandwidth string
+	Daemon         bool
+	Interval       time.Duration
+	PolicyFile     string
+	StatusSocket   string
+}
+
+func Run(ctx context.Context, configFactory common.ClientConfigFactory, storePath string, o Options) error {
+	manifest, err := prefetch.ReadManifest(o.ManifestFile)
+	if err != nil {
+		return err
+	}
+
+	opts := prefetch.Options{Interval: o.Interval}
+	if o.Schedule != "" {
+		window, err := prefetch.ParseWindow(o.Schedule)
+		if err != nil {
+			return err
+		}
+		opts.Window = &window
+	}
+	if o.PolicyFile != "" {
+		data, err := os.ReadFile(o.PolicyFile)
+		if err != nil {
+			return fmt.Errorf("error reading retention policy: %w", err)
+		}
+		if opts.RetentionPolicy, err = layout.ParseRetentionPolicy(data); err != nil {
+			return err
+		}
+	}
+
+	config, err := configFactory(storePath)
+	if err != nil {
+		return err
+	}
+	if o.LimitBandwidth != "" {
+		bytesPerSecond, err := common.ParseBandwidth(o.LimitBandwidth)
+		if err != nil {
+			return err
+		}
+		config.BandwidthLimiter = remote.NewBandwidthLimiter(bytesPerSecond)
+	}
+	c, err := client.New(config)
+	if err != nil {
+		return fmt.Errorf("error creating client: %w", err)
+	}
+
+	p := prefetch.New(c, manifest, opts)
+
+	statusSocket := o.StatusSocket
+	if statusSocket == "" {
+		statusSocket = filepath.Join(storePath, StatusSocketFileName)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := p.ServeStatus(ctx, statusSocket); err != nil {
+			logr.FromContextOrDiscard(ctx).Error(err, "Error serving prefetch status", "Socket", statusSocket)
+		}
+	}()
+	defer func() {
+		cancel()
+		<-served
+		_ = os.Remove(statusSocket)
+	}()
+
+	if o.Daemon {
+		return p.Run(ctx)
+	}
+	err = p.RunOnce(ctx)
+	printStatus(p.Status())
+	return err
+}
+
+func printStatus(status prefetch.Status) {
+	for _, img := range status.Images {
+		switch img.State {
+		case prefetch.ImageStatePulled:
+			fmt.Println("Prefetched", img.Ref, img.Digest.Encoded())
+		case prefetch.ImageStateUpToDate:
+			fmt.Println(img.Ref, "is up to date")
+		case prefetch.ImageStateDeferred:
+			fmt.Println("Deferred", img.Ref, "to the next window")
+		}
+	}
+	if status.Pruned != nil && status.Pruned.Images > 0 {
+		fmt.Printf("Removed %d image(s) condemned by the retention policy, freeing %s\n", status.Pruned.Images, units.BytesSize(float64(status.Pruned.Bytes)))
+	}
+}
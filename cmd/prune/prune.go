@@ -0,0 +1,303 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prune
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/onmetal/onmetal-image/batch"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/daemon"
+	"github.com/onmetal/onmetal-image/docker"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/store"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory, requestResolverFactory common.RequestResolverFactory, daemonClientFactory common.DaemonClientFactory) *cobra.Command {
+	var (
+		expired     bool
+		condemned   bool
+		gracePeriod time.Duration
+		policy      string
+		remote      string
+		dryRun      bool
+		yes         bool
+		jsonOutput  bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "prune --expired | --condemned | --policy policy.yaml",
+		Short: "Remove expired images, images displaced by tag updates or images condemned by a retention policy from the local store or a remote repository.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if policy != "" {
+				if remote != "" {
+					return fmt.Errorf("--policy is only supported for the local store")
+				}
+				return RunPolicy(ctx, storeFactory, policy, dryRun, jsonOutput)
+			}
+			if remote != "" {
+				if condemned {
+					return fmt.Errorf("--condemned is only supported for the local store")
+				}
+				return RunRemote(ctx, requestResolverFactory, remote, dryRun, yes, jsonOutput, cmd.InOrStdin())
+			}
+			dc, err := common.ViaDaemon(cmd, daemonClientFactory, "expired", "json")
+			if err != nil {
+				return err
+			}
+			if dc != nil {
+				defer func() { _ = dc.Close() }()
+				return RunViaDaemon(ctx, dc, jsonOutput)
+			}
+			return Run(ctx, storeFactory, expired, condemned, gracePeriod, jsonOutput)
+		},
+	}
+
+	cmd.Flags().BoolVar(&expired, "expired", false, "Remove images whose expiry has passed.")
+	cmd.Flags().BoolVar(&condemned, "condemned", false, "Remove images whose tags were all moved to other images (e.g. by a pull updating the tag) longer than the grace period ago.")
+	cmd.Flags().DurationVar(&gracePeriod, "grace-period", layout.DefaultGracePeriod, "Duration condemned images are kept for, see --condemned.")
+	cmd.Flags().StringVar(&policy, "policy", "", "Retention policy (YAML) deciding which images of the local store to remove.")
+	cmd.Flags().StringVar(&remote, "remote", "", "Remote repository to prune instead of the local store.")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only print the remote tags or images condemned by the policy that would be deleted.")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Delete remote tags without asking for confirmation.")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the per-image results as JSON.")
+	cmd.MarkFlagsOneRequired("expired", "condemned", "policy")
+	cmd.MarkFlagsMutuallyExclusive("expired", "policy")
+	cmd.MarkFlagsMutuallyExclusive("condemned", "policy")
+
+	return cmd
+}
+
+// Run removes the expired images and, if condemned is set, the images condemned longer than the grace period
+// from the local store.
+func Run(ctx context.Context, storeFactory common.StoreFactory, expired, condemned bool, gracePeriod time.Duration, jsonOutput bool) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	var (
+		now     = time.Now()
+		results []batch.Result
+	)
+	if expired {
+		res, err := s.Layout().PruneExpired(ctx, now)
+		if err != nil {
+			return fmt.Errorf("error pruning expired images: %w", err)
+		}
+		results = append(results, res...)
+	}
+	if condemned {
+		res, err := s.Layout().PruneCondemned(ctx, now, gracePeriod)
+		if err != nil {
+			return fmt.Errorf("error pruning condemned images: %w", err)
+		}
+		results = append(results, res...)
+	}
+
+	// Keep stdout parseable if the results are printed as JSON.
+	out := io.Writer(os.Stdout)
+	if jsonOutput {
+		out = os.Stderr
+	}
+	compact(ctx, s, out)
+
+	res := &common.BatchResult{}
+	res.Add(results...)
+	if err := res.Print(os.Stdout, jsonOutput); err != nil {
+		return err
+	}
+	return res.Err()
+}
+
+// RunViaDaemon removes the expired images of the store of the daemon, see the daemon command.
+func RunViaDaemon(ctx context.Context, dc *daemon.Client, jsonOutput bool) error {
+	results, err := dc.Prune(ctx)
+	if err != nil {
+		return fmt.Errorf("error pruning expired images via the daemon: %w", err)
+	}
+
+	res := &common.BatchResult{}
+	res.Add(results...)
+	if err := res.Print(os.Stdout, jsonOutput); err != nil {
+		return err
+	}
+	return res.Err()
+}
+
+// RunPolicy removes the images of the local store condemned by the retention policy at policyPath,
+// printing which rule condemned each of them.
+func RunPolicy(ctx context.Context, storeFactory common.StoreFactory, policyPath string, dryRun, jsonOutput bool) error {
+	data, err := os.ReadFile(policyPath)
+	if err != nil {
+		return fmt.Errorf("error reading retention policy: %w", err)
+	}
+	policy, err := layout.ParseRetentionPolicy(data)
+	if err != nil {
+		return err
+	}
+
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	plan, err := s.Layout().ApplyRetention(ctx, policy, time.Now())
+	if err != nil {
+		return fmt.Errorf("error applying retention policy: %w", err)
+	}
+
+	// Keep stdout parseable if the results are printed as JSON.
+	out := io.Writer(os.Stdout)
+	if jsonOutput {
+		out = os.Stderr
+	}
+	for _, removal := range plan.Remove {
+		fmt.Fprintf(out, "%s condemned by rule %q: %s (%s)\n", removal.Name(), removal.Rule, removal.Reason, removal.Usage)
+	}
+
+	switch {
+	case dryRun && jsonOutput:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	case dryRun:
+		fmt.Fprintf(out, "Would remove %d of %d image(s)\n", len(plan.Remove), len(plan.Remove)+plan.Kept)
+		return nil
+	case len(plan.Remove) == 0 && !jsonOutput:
+		fmt.Fprintln(out, "No images condemned by the retention policy")
+		return nil
+	}
+
+	results, err := s.Layout().PruneRetention(ctx, plan)
+	if err != nil {
+		return fmt.Errorf("error pruning images: %w", err)
+	}
+	compact(ctx, s, out)
+
+	res := &common.BatchResult{}
+	res.Add(results...)
+	if err := res.Print(os.Stdout, jsonOutput); err != nil {
+		return err
+	}
+	return res.Err()
+}
+
+// compact opportunistically compacts the index after pruning, only reporting if it changed anything.
+// Failing to compact does not fail the prune.
+func compact(ctx context.Context, s *store.Store, out io.Writer) {
+	res, err := s.Layout().Compact(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error compacting index:", err)
+		return
+	}
+	if res.Merged > 0 || len(res.Dropped) > 0 {
+		common.PrintCompactResult(out, res)
+	}
+}
+
+func RunRemote(
+	ctx context.Context,
+	requestResolverFactory common.RequestResolverFactory,
+	repository string,
+	dryRun, yes, jsonOutput bool,
+	in io.Reader,
+) error {
+	resolver, err := requestResolverFactory()
+	if err != nil {
+		return fmt.Errorf("error creating request resolver: %w", err)
+	}
+
+	tags, err := resolver.Tags(ctx, repository)
+	if err != nil {
+		return fmt.Errorf("error listing tags of %s: %w", repository, err)
+	}
+
+	// Keep stdout parseable if the results are printed as JSON.
+	out := io.Writer(os.Stdout)
+	if jsonOutput {
+		out = os.Stderr
+	}
+
+	var (
+		now     = time.Now()
+		expired []string
+		res     = &common.BatchResult{}
+	)
+	for _, tag := range tags {
+		ref := fmt.Sprintf("%s:%s", repository, tag)
+		expiresAt, ok, err := remoteExpiresAt(ctx, resolver, ref)
+		if err != nil {
+			res.Add(batch.Result{Name: ref, Err: err})
+			continue
+		}
+		if ok && expiresAt.Before(now) {
+			fmt.Fprintf(out, "%s expired at %s\n", ref, expiresAt.Format(time.RFC3339))
+			expired = append(expired, ref)
+		}
+	}
+
+	switch {
+	case len(expired) == 0:
+		fmt.Fprintln(out, "No expired tags found in", repository)
+	case dryRun:
+		fmt.Fprintf(out, "Would delete %d expired tag(s)\n", len(expired))
+		expired = nil
+	case !yes && !common.Confirm(in, out, fmt.Sprintf("Delete %d expired tag(s) from %s?", len(expired), repository)):
+		fmt.Fprintln(out, "Aborted")
+		return nil
+	}
+
+	for _, ref := range expired {
+		err := resolver.Delete(ctx, ref)
+		// Deleting a manifest removes all tags pointing to it, so a tag may already be gone.
+		if errdefs.IsNotFound(err) {
+			err = nil
+		}
+		res.Add(batch.Result{Name: ref, Err: err})
+	}
+	if len(res.Items) == 0 && !jsonOutput {
+		return nil
+	}
+	if err := res.Print(os.Stdout, jsonOutput); err != nil {
+		return err
+	}
+	return res.Err()
+}
+
+func remoteExpiresAt(ctx context.Context, resolver *docker.RequestResolver, ref string) (time.Time, bool, error) {
+	info, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error resolving %s: %w", ref, err)
+	}
+
+	manifest, err := info.Manifest(ctx)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error getting manifest of %s: %w", ref, err)
+	}
+
+	expiresAt, ok := imageutil.ExpiresAt(manifest)
+	return expiresAt, ok, nil
+}
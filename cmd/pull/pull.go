@@ -16,51 +16,488 @@ package pull
 
 import (
 	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
 
-	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/docker/go-units"
 
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/batch"
+	"github.com/onmetal/onmetal-image/client"
 	"github.com/onmetal/onmetal-image/cmd/common"
-
+	"github.com/onmetal/onmetal-image/daemon"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/layercrypt"
+	"github.com/onmetal/onmetal-image/oci/processor"
+	"github.com/onmetal/onmetal-image/oci/remote"
+	"github.com/onmetal/onmetal-image/oci/store"
+	"github.com/opencontainers/go-digest"
 	"github.com/spf13/cobra"
 )
 
-func Command(storeFactory common.StoreFactory, registryFactory common.RemoteRegistryFactory) *cobra.Command {
+func Command(clientFactory common.ClientFactory, storeAtFactory common.StoreAtFactory, daemonClientFactory common.DaemonClientFactory) *cobra.Command {
+	var (
+		noPreflightSpaceCheck bool
+		decryptKeys           []string
+		storePaths            []string
+		jsonOutput            bool
+		progress              string
+		metadataOnly          bool
+		allowUnknownSize      bool
+		acceptArtifacts       bool
+		decompressRootFS      bool
+		deltaRef              string
+		format                string
+		batchFile             string
+		jobs                  int
+		failFast              bool
+		estimate              bool
+		probe                 bool
+		streamRootFSTo        string
+	)
+
 	cmd := &cobra.Command{
-		Use:   "pull image[:tag]",
+		Use:   "pull image[:tag] | --batch refs.txt",
 		Short: "Pull an image from a remote registry determined by the image name.",
-		Args:  cobra.ExactArgs(1),
+		Args:  cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			ctx := cmd.Context()
+			if (batchFile != "") == (len(args) == 1) {
+				return fmt.Errorf("expected either an image reference or --%s", common.RecommendedBatchFlagName)
+			}
+			if err := common.ValidateFormatWithProgress(format, progress); err != nil {
+				return err
+			}
+			if probe && !estimate {
+				return fmt.Errorf("--probe is only supported with --estimate")
+			}
+			if estimate {
+				if format == common.FormatPinned {
+					return fmt.Errorf("--estimate does not support --%s %s", common.RecommendedFormatFlagName, common.FormatPinned)
+				}
+				keys, err := readDecryptKeys(decryptKeys)
+				if err != nil {
+					return err
+				}
+				return RunEstimate(cmd.Context(), clientFactory, args[0], probe, metadataOnly, allowUnknownSize, acceptArtifacts, keys, format, os.Stdout)
+			}
+			ctx, out, err := common.ProgressContext(cmd.Context(), progress)
+			if err != nil {
+				return err
+			}
+			if streamRootFSTo != "" {
+				return RunStream(ctx, clientFactory, args[0], streamRootFSTo, format, out)
+			}
+			dc, err := common.ViaDaemon(cmd, daemonClientFactory, "metadata-only", "allow-unknown-size", "no-preflight-space-check", "progress")
+			if err != nil {
+				return err
+			}
+			if dc != nil {
+				defer func() { _ = dc.Close() }()
+				return RunViaDaemon(ctx, dc, args[0], !noPreflightSpaceCheck, metadataOnly, allowUnknownSize, out)
+			}
+			keys, err := readDecryptKeys(decryptKeys)
+			if err != nil {
+				return err
+			}
+			if batchFile != "" {
+				return RunBatch(ctx, clientFactory, batchFile, jobs, failFast, !noPreflightSpaceCheck, metadataOnly, allowUnknownSize, acceptArtifacts, keys, jsonOutput, out)
+			}
 			ref := args[0]
-			return Run(ctx, storeFactory, registryFactory, ref)
+			if len(storePaths) > 0 {
+				return RunMulti(ctx, clientFactory, storeAtFactory, ref, storePaths, !noPreflightSpaceCheck, metadataOnly, allowUnknownSize, acceptArtifacts, keys, jsonOutput, out)
+			}
+			var processors []processor.LayerProcessor
+			if decompressRootFS {
+				processors = append(processors, processor.Decompress(onmetalimage.RootFSLayerMediaType))
+			}
+			return Run(ctx, clientFactory, ref, !noPreflightSpaceCheck, metadataOnly, allowUnknownSize, acceptArtifacts, keys, processors, deltaRef, format, out)
 		},
 	}
 
+	cmd.Flags().BoolVar(&noPreflightSpaceCheck, "no-preflight-space-check", false, "Do not check for sufficient free disk space before downloading.")
+	cmd.Flags().StringArrayVar(&decryptKeys, "decrypt-key", nil, "PEM private key file to decrypt encrypted layers with. Can be specified multiple times.")
+	cmd.Flags().StringArrayVar(&storePaths, "store", nil, "Path of a store to pull into instead of the default store. Can be specified multiple times to download the image once into all of them.")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the per-store or per-reference results as JSON. Only used with --store or --batch.")
+	cmd.Flags().StringVar(&progress, "progress", common.ProgressNone, common.RecommendedProgressFlagUsage)
+	cmd.Flags().StringVar(&format, common.RecommendedFormatFlagName, common.FormatText, common.RecommendedFormatFlagUsage)
+	_ = cmd.RegisterFlagCompletionFunc(common.RecommendedFormatFlagName, common.CompleteFixed(common.FormatText, common.FormatJSON, common.FormatPinned))
+	cmd.MarkFlagsMutuallyExclusive(common.RecommendedFormatFlagName, "store")
+	cmd.Flags().BoolVar(&metadataOnly, "metadata-only", false, "Only pull the manifest and config. The image is marked partial until its layers are pulled.")
+	// Decryption changes the manifest, so the layers of the decrypted image could not be completed later on.
+	cmd.MarkFlagsMutuallyExclusive("metadata-only", "decrypt-key")
+	cmd.Flags().BoolVar(&decompressRootFS, "decompress-rootfs", false, "Additionally store the decompressed content of a gzip or zstd compressed rootfs layer while pulling it.")
+	cmd.MarkFlagsMutuallyExclusive("decompress-rootfs", "store")
+	cmd.MarkFlagsMutuallyExclusive("decompress-rootfs", "metadata-only")
+	cmd.Flags().StringVar(&deltaRef, "apply-delta", "", "Delta artifact (see build-delta) to reconstruct the rootfs with from an older version in the local store. Falls back to pulling the full image if that version is missing or the result does not verify.")
+	cmd.MarkFlagsMutuallyExclusive("apply-delta", "store")
+	cmd.MarkFlagsMutuallyExclusive("apply-delta", "metadata-only")
+	cmd.Flags().StringVar(&batchFile, common.RecommendedBatchFlagName, "", "File of references to pull, one per line, '#' starting a comment. Blobs shared by the images are downloaded once.")
+	cmd.Flags().IntVar(&jobs, common.RecommendedJobsFlagName, common.DefaultJobs, common.RecommendedJobsFlagUsage)
+	cmd.Flags().BoolVar(&failFast, common.RecommendedFailFastFlagName, false, common.RecommendedFailFastFlagUsage)
+	cmd.MarkFlagsMutuallyExclusive(common.RecommendedBatchFlagName, "store")
+	cmd.MarkFlagsMutuallyExclusive(common.RecommendedBatchFlagName, "apply-delta")
+	cmd.MarkFlagsMutuallyExclusive(common.RecommendedBatchFlagName, "decompress-rootfs")
+	cmd.MarkFlagsMutuallyExclusive(common.RecommendedBatchFlagName, common.RecommendedFormatFlagName)
+	cmd.Flags().BoolVar(&allowUnknownSize, "allow-unknown-size", false, "Pull legacy images whose manifest has no size information for some blobs. Their digests are still verified.")
+	cmd.Flags().BoolVar(&acceptArtifacts, "accept-artifacts", false, "Store references of unsupported types, e.g. Helm charts or foreign OCI artifacts, as opaque artifacts instead of failing.")
+	cmd.Flags().BoolVar(&estimate, "estimate", false, "Only print the number of bytes a pull would transfer into the store, without pulling anything.")
+	cmd.Flags().BoolVar(&probe, "probe", false, "With --estimate, sample the throughput to the registry with a short download to estimate the transfer duration.")
+	cmd.MarkFlagsMutuallyExclusive("estimate", "store")
+	cmd.MarkFlagsMutuallyExclusive("estimate", common.RecommendedBatchFlagName)
+	cmd.MarkFlagsMutuallyExclusive("estimate", "apply-delta")
+	cmd.MarkFlagsMutuallyExclusive("estimate", "decompress-rootfs")
+	cmd.Flags().StringVar(&streamRootFSTo, "stream-rootfs-to", "", "Stream the rootfs layer from the registry straight to the given block device or file, decompressing and verifying it on the way, instead of storing it. Only the manifest and config are stored. The head of the target is poisoned until the rootfs is verified.")
+	for _, flag := range []string{"store", common.RecommendedBatchFlagName, "estimate", "metadata-only", "decompress-rootfs", "apply-delta", "decrypt-key"} {
+		cmd.MarkFlagsMutuallyExclusive("stream-rootfs-to", flag)
+	}
+
 	return cmd
 }
 
 func Run(
 	ctx context.Context,
-	storeFactory common.StoreFactory,
-	registryFactory common.RemoteRegistryFactory,
+	clientFactory common.ClientFactory,
 	ref string,
+	preflightSpaceCheck bool,
+	metadataOnly bool,
+	allowUnknownSize bool,
+	acceptArtifacts bool,
+	decryptKeys []*rsa.PrivateKey,
+	processors []processor.LayerProcessor,
+	deltaRef string,
+	format string,
+	out io.Writer,
 ) error {
-	s, err := storeFactory()
+	c, err := clientFactory()
+	if err != nil {
+		return fmt.Errorf("error creating client: %w", err)
+	}
+
+	opts := pullOptions(preflightSpaceCheck, metadataOnly, allowUnknownSize, acceptArtifacts, decryptKeys, processors)
+	if deltaRef != "" {
+		opts = append(opts, client.WithDelta(deltaRef))
+	}
+	img, err := c.Pull(ctx, ref, opts...)
+	if err != nil {
+		common.PrintTransferProgress(os.Stderr, err)
+		return pullError(ref, err)
+	}
+
+	pinned, err := common.NewPinnedResult(c.Store().Parser(), ref, img.Descriptor().Digest)
+	if err != nil {
+		return err
+	}
+
+	info, result := common.FormatOutputs(format, out)
+	if metadataOnly {
+		fmt.Fprintln(info, "Successfully pulled metadata of", ref, img.Descriptor().Digest.Encoded())
+	} else {
+		fmt.Fprintln(info, "Successfully pulled", ref, img.Descriptor().Digest.Encoded())
+	}
+	return common.PrintPinned(result, format, pinned)
+}
+
+// RunStream streams the rootfs layer of ref to the block device or file at target, see
+// client.Client.StreamLayer. Regular files are truncated to the streamed content.
+func RunStream(ctx context.Context, clientFactory common.ClientFactory, ref, target, format string, out io.Writer) error {
+	c, err := clientFactory()
+	if err != nil {
+		return fmt.Errorf("error creating client: %w", err)
+	}
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", target, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	res, err := c.StreamLayer(ctx, ref, remote.RoleSelector("rootfs"), f)
 	if err != nil {
-		return fmt.Errorf("error creating store: %w", err)
+		if errors.Is(err, remote.ErrStreamPoisoned) {
+			return fmt.Errorf("%w; %s starts with %q and must not be booted", err, target, strings.TrimSpace(remote.StreamPoisonMarker))
+		}
+		return pullError(ref, err)
 	}
+	if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+		if err := f.Truncate(res.Written); err != nil {
+			return fmt.Errorf("error truncating %s: %w", target, err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error syncing %s: %w", target, err)
+	}
+
+	pinned, err := common.NewPinnedResult(c.Store().Parser(), ref, res.Image.Descriptor().Digest)
+	if err != nil {
+		return err
+	}
+	compression := string(res.Compression)
+	if compression == "" {
+		compression = "uncompressed"
+	}
+	info, result := common.FormatOutputs(format, out)
+	fmt.Fprintf(info, "Successfully streamed rootfs %s of %s (%d bytes, %s) to %s\n", res.Layer.Digest.Encoded(), ref, res.Written, compression, target)
+	return common.PrintPinned(result, format, pinned)
+}
 
-	registry, err := registryFactory()
+// RunEstimate prints how many bytes pulling ref would transfer and, if probe is set, how long that
+// would take at the current throughput to the registry. Nothing is stored.
+func RunEstimate(
+	ctx context.Context,
+	clientFactory common.ClientFactory,
+	ref string,
+	probe bool,
+	metadataOnly bool,
+	allowUnknownSize bool,
+	acceptArtifacts bool,
+	decryptKeys []*rsa.PrivateKey,
+	format string,
+	out io.Writer,
+) error {
+	c, err := clientFactory()
 	if err != nil {
-		return fmt.Errorf("could not create remote registry: %w", err)
+		return fmt.Errorf("error creating client: %w", err)
 	}
 
-	img, err := image.Copy(ctx, s, registry, ref)
+	opts := []client.EstimateOption{
+		client.WithEstimatedPullOptions(pullOptions(true, metadataOnly, allowUnknownSize, acceptArtifacts, decryptKeys, nil)...),
+	}
+	if probe {
+		opts = append(opts, client.WithProbe(client.DefaultProbeSize))
+	}
+	estimate, err := c.EstimatePull(ctx, ref, opts...)
 	if err != nil {
-		return fmt.Errorf("error pulling ref %s: %w", ref, err)
+		return pullError(ref, err)
 	}
 
-	fmt.Println("Successfully pulled", ref, img.Descriptor().Digest.Encoded())
+	if format == common.FormatJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(estimate)
+	}
+
+	fmt.Fprintf(out, "%s %s: %d of %d blob(s) missing, %s to transfer\n",
+		ref, estimate.Digest.Encoded(), estimate.MissingBlobs, estimate.Blobs, units.HumanSize(float64(estimate.Bytes)))
+	if estimate.UnknownSizeBlobs > 0 {
+		fmt.Fprintf(out, "%d missing blob(s) of unknown size are not included\n", estimate.UnknownSizeBlobs)
+	}
+	switch {
+	case estimate.Bytes == 0:
+	case estimate.Probe != nil && estimate.Probe.BytesPerSecond > 0:
+		fmt.Fprintf(out, "ETA: %s at %s/s\n", estimate.ETA.Round(time.Second), units.HumanSize(estimate.Probe.BytesPerSecond))
+	case probe:
+		fmt.Fprintln(out, "ETA: unknown (the probe received no data)")
+	default:
+		fmt.Fprintln(out, "ETA: unknown (pass --probe to measure the throughput)")
+	}
 	return nil
 }
+
+// readDecryptKeys reads the PEM private keys of the given files.
+func readDecryptKeys(filenames []string) ([]*rsa.PrivateKey, error) {
+	var keys []*rsa.PrivateKey
+	for _, filename := range filenames {
+		key, err := layercrypt.ReadPrivateKeyFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// RunViaDaemon pulls the image into the store of the daemon, see the daemon command.
+func RunViaDaemon(
+	ctx context.Context,
+	dc *daemon.Client,
+	ref string,
+	preflightSpaceCheck bool,
+	metadataOnly bool,
+	allowUnknownSize bool,
+	out io.Writer,
+) error {
+	var opts []daemon.PullOption
+	if !preflightSpaceCheck {
+		opts = append(opts, daemon.WithoutPreflightSpaceCheck())
+	}
+	if metadataOnly {
+		opts = append(opts, daemon.WithMetadataOnly())
+	}
+	if allowUnknownSize {
+		opts = append(opts, daemon.WithAllowUnknownSize())
+	}
+	dgst, err := dc.Pull(ctx, ref, opts...)
+	if err != nil {
+		return fmt.Errorf("error pulling %s via the daemon: %w", ref, err)
+	}
+
+	if metadataOnly {
+		fmt.Fprintln(out, "Successfully pulled metadata of", ref, dgst.Encoded())
+	} else {
+		fmt.Fprintln(out, "Successfully pulled", ref, dgst.Encoded())
+	}
+	return nil
+}
+
+func pullOptions(
+	preflightSpaceCheck bool,
+	metadataOnly bool,
+	allowUnknownSize bool,
+	acceptArtifacts bool,
+	decryptKeys []*rsa.PrivateKey,
+	processors []processor.LayerProcessor,
+) []client.PullOption {
+	opts := []client.PullOption{client.WithDecryptionKeys(decryptKeys...), client.WithLayerProcessors(processors...)}
+	if !preflightSpaceCheck {
+		opts = append(opts, client.WithoutPreflightSpaceCheck())
+	}
+	if metadataOnly {
+		opts = append(opts, client.WithMetadataOnly())
+	}
+	if allowUnknownSize {
+		opts = append(opts, client.WithAllowUnknownSize())
+	}
+	if acceptArtifacts {
+		opts = append(opts, client.WithAcceptArtifacts())
+	}
+	return opts
+}
+
+// RunMulti pulls the image into all stores at the given paths, downloading each blob only once.
+// A store failing does not prevent pulling into the others, the results are reported per store.
+func RunMulti(
+	ctx context.Context,
+	clientFactory common.ClientFactory,
+	storeAtFactory common.StoreAtFactory,
+	ref string,
+	storePaths []string,
+	preflightSpaceCheck bool,
+	metadataOnly bool,
+	allowUnknownSize bool,
+	acceptArtifacts bool,
+	decryptKeys []*rsa.PrivateKey,
+	jsonOutput bool,
+	out io.Writer,
+) (retErr error) {
+	ctx, done := common.StartOperation(ctx, "pull", ref)
+	var dgst digest.Digest
+	defer func() { done(dgst, retErr) }()
+
+	c, err := clientFactory()
+	if err != nil {
+		return fmt.Errorf("error creating client: %w", err)
+	}
+
+	img, err := c.ResolveRemote(ctx, ref, pullOptions(preflightSpaceCheck, metadataOnly, allowUnknownSize, acceptArtifacts, decryptKeys, nil)...)
+	if err != nil {
+		return pullError(ref, err)
+	}
+	dgst = img.Descriptor().Digest
+
+	var (
+		res    = &common.BatchResult{}
+		stores []*store.Store
+	)
+	for _, path := range storePaths {
+		s, err := storeAtFactory(path)
+		if err != nil {
+			res.Add(batch.Result{Name: path, Err: fmt.Errorf("error creating store: %w", err)})
+			continue
+		}
+		if preflightSpaceCheck {
+			if err := client.CheckSpace(ctx, s, img); err != nil {
+				res.Add(batch.Result{Name: path, Err: pullError(ref, err)})
+				continue
+			}
+		}
+		stores = append(stores, s)
+	}
+
+	for i, result := range store.PushAll(ctx, ref, img, stores...) {
+		s := stores[i]
+		var noSpaceErr *ocicontent.NoSpaceError
+		switch {
+		case errors.As(result.Err, &noSpaceErr):
+			result.Err = pullError(ref, &client.InsufficientSpaceError{Path: s.Layout().Path(), Needed: noSpaceErr.Needed, Err: result.Err})
+		case result.Err == nil:
+			result.Err = client.RecordPull(ctx, s, img)
+		}
+		res.Add(result)
+	}
+
+	if err := res.Print(out, jsonOutput); err != nil {
+		return err
+	}
+	return res.Err()
+}
+
+// RunBatch pulls the references of the batch file at path with at most jobs of them at a time.
+// Blobs shared by the images are only downloaded once, as the store coalesces concurrent writes of a blob.
+// A reference failing does not prevent pulling the others unless failFast is set, the results are
+// reported per reference.
+func RunBatch(
+	ctx context.Context,
+	clientFactory common.ClientFactory,
+	path string,
+	jobs int,
+	failFast bool,
+	preflightSpaceCheck bool,
+	metadataOnly bool,
+	allowUnknownSize bool,
+	acceptArtifacts bool,
+	decryptKeys []*rsa.PrivateKey,
+	jsonOutput bool,
+	out io.Writer,
+) error {
+	c, err := clientFactory()
+	if err != nil {
+		return fmt.Errorf("error creating client: %w", err)
+	}
+
+	opts := pullOptions(preflightSpaceCheck, metadataOnly, allowUnknownSize, acceptArtifacts, decryptKeys, nil)
+	res, err := common.RunBatchFile(ctx, path, jobs, failFast, false, func(ctx context.Context, entry batch.Entry) batch.Result {
+		img, err := c.Pull(ctx, entry.Ref, opts...)
+		if err != nil {
+			return batch.Result{Err: pullError(entry.Ref, err)}
+		}
+		return batch.Result{Digest: img.Descriptor().Digest}
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := res.Print(out, jsonOutput); err != nil {
+		return err
+	}
+	return res.Err()
+}
+
+// pullError adds hints how to resolve the error to errors caused by blobs without size information,
+// unsupported image types or by a store running out of space.
+func pullError(ref string, err error) error {
+	var (
+		spaceErr *client.InsufficientSpaceError
+		typeErr  *client.UnsupportedImageTypeError
+	)
+	switch {
+	case errors.Is(err, imageutil.ErrUnknownSize):
+		return fmt.Errorf("%s was likely produced by a legacy tool: %w; pass --allow-unknown-size to pull it anyway, verifying only the digests", ref, err)
+	case errors.As(err, &typeErr) && typeErr.ConfigMediaType != "":
+		return fmt.Errorf("%w; inspect it with 'onmetal-image inspect --remote %s' or pass --accept-artifacts to store it as opaque artifact", err, ref)
+	case errors.As(err, &typeErr):
+		return fmt.Errorf("%w; inspect it with 'onmetal-image inspect --remote %s'", err, ref)
+	case errors.As(err, &spaceErr):
+		return fmt.Errorf("%w (run 'onmetal-image prune --expired' or delete unused images to free space)", err)
+	case len(ocicontent.FailedBlobs(err)) > 0:
+		return fmt.Errorf("%w\n%d blob(s) failed; pulling %s again only transfers those", err, len(ocicontent.FailedBlobs(err)), ref)
+	default:
+		return err
+	}
+}
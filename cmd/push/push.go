@@ -16,53 +16,266 @@ package push
 
 import (
 	"context"
+	"crypto/rsa"
 	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/docker/go-units"
+	"github.com/onmetal/onmetal-image/batch"
+	"github.com/onmetal/onmetal-image/client"
 	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/mediatypes"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/layercrypt"
+	"github.com/onmetal/onmetal-image/oci/remote"
 
 	"github.com/spf13/cobra"
 )
 
-func Command(storeFactory common.StoreFactory, registryFactory common.RemoteRegistryFactory) *cobra.Command {
+func Command(clientFactory common.ClientFactory) *cobra.Command {
+	var (
+		expiresIn time.Duration
+		expiresAt string
+		encrypt   []string
+		recipient []string
+		progress  string
+		normalize bool
+		format    string
+		batchFile string
+		jobs      int
+		failFast  bool
+		jsonOut   bool
+
+		stripAnnotations []string
+
+		noPreflight bool
+		maxSize     string
+	)
+
 	cmd := &cobra.Command{
-		Use:   "push image[:tag]",
+		Use:   "push image[:tag] | --batch refs.txt",
 		Short: "Push a local image to a remote registry determined by the image name.",
-		Args:  cobra.ExactArgs(1),
+		Args:  cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			ctx := cmd.Context()
-			name := args[0]
-			return Run(ctx, storeFactory, registryFactory, name)
+			if (batchFile != "") == (len(args) == 1) {
+				return fmt.Errorf("expected either an image reference or --%s", common.RecommendedBatchFlagName)
+			}
+			if err := common.ValidateFormatWithProgress(format, progress); err != nil {
+				return err
+			}
+			ctx, out, err := common.ProgressContext(cmd.Context(), progress)
+			if err != nil {
+				return err
+			}
+			annotations, err := common.ExpiryAnnotations(time.Now(), expiresIn, expiresAt)
+			if err != nil {
+				return err
+			}
+			encryption, err := parseEncryption(encrypt, recipient)
+			if err != nil {
+				return err
+			}
+			var transform imageutil.ManifestTransform
+			if len(stripAnnotations) > 0 {
+				if transform, err = imageutil.StripAnnotations(stripAnnotations...); err != nil {
+					return err
+				}
+			}
+			preflight := Preflight{Disabled: noPreflight}
+			if maxSize != "" {
+				if preflight.MaxSize, err = units.RAMInBytes(maxSize); err != nil {
+					return fmt.Errorf("invalid max push size %q: %w", maxSize, err)
+				}
+			}
+			if batchFile != "" {
+				return RunBatch(ctx, clientFactory, batchFile, jobs, failFast, annotations, encryption, normalize, transform, preflight, jsonOut, out)
+			}
+			return Run(ctx, clientFactory, args[0], annotations, encryption, normalize, transform, preflight, format, out)
 		},
 	}
 
+	cmd.Flags().DurationVar(&expiresIn, "expires-in", 0, "Duration after which the pushed image expires (e.g. 168h). The local image is annotated as well and gets the pushed digest.")
+	cmd.Flags().StringVar(&expiresAt, "expires-at", "", "Time in RFC 3339 format at which the pushed image expires. The local image is annotated as well and gets the pushed digest.")
+	cmd.Flags().StringSliceVar(&encrypt, "encrypt-layer", nil, "Layers to encrypt before pushing. Any of rootfs, initramfs, kernel, ignition, cloud-init, uki, esp or another registered layer kind. Requires --recipient.")
+	cmd.Flags().StringArrayVar(&stripAnnotations, "strip-annotation", nil, "Remove the annotations with keys matching the glob (e.g. 'com.example.build.*') from the pushed manifest and its descriptors. The local image is left untouched, so the pushed digest differs from the local one. Can be specified multiple times.")
+	cmd.Flags().BoolVar(&normalize, common.RecommendedNormalizeAnnotationsFlagName, false, common.RecommendedNormalizeAnnotationsFlagUsage)
+	cmd.Flags().StringVar(&progress, "progress", common.ProgressNone, common.RecommendedProgressFlagUsage)
+	cmd.Flags().StringVar(&format, common.RecommendedFormatFlagName, common.FormatText, common.RecommendedFormatFlagUsage)
+	_ = cmd.RegisterFlagCompletionFunc(common.RecommendedFormatFlagName, common.CompleteFixed(common.FormatText, common.FormatJSON, common.FormatPinned))
+	cmd.Flags().StringArrayVar(&recipient, "recipient", nil, "Recipient to encrypt the layers for, in the form jwe:<public key pem file>. Can be specified multiple times.")
+	cmd.Flags().StringVar(&batchFile, common.RecommendedBatchFlagName, "", "File of local references to push, one per line, optionally followed by '=> destination' to push to another reference. '#' starts a comment. Blobs shared by the images are uploaded once per repository and mounted into the others.")
+	cmd.Flags().IntVar(&jobs, common.RecommendedJobsFlagName, common.DefaultJobs, common.RecommendedJobsFlagUsage)
+	cmd.Flags().BoolVar(&failFast, common.RecommendedFailFastFlagName, false, common.RecommendedFailFastFlagUsage)
+	cmd.Flags().BoolVar(&jsonOut, "json", false, "Print the per-reference results as JSON. Only used with --batch.")
+	cmd.Flags().BoolVar(&noPreflight, "no-preflight", false, "Do not check the size of the blobs to upload against the registry quota (Harbor) and --max-push-size before uploading.")
+	cmd.Flags().StringVar(&maxSize, "max-push-size", "", "Fail a push before uploading anything if the blobs missing on the registry exceed this size (e.g. 10Gi).")
+	cmd.MarkFlagsMutuallyExclusive(common.RecommendedBatchFlagName, common.RecommendedFormatFlagName)
+	cmd.MarkFlagsMutuallyExclusive("no-preflight", "max-push-size")
+
 	return cmd
 }
 
+// Encryption describes which layers of the image to encrypt for whom.
+type Encryption struct {
+	MediaTypes []string
+	Recipients []*rsa.PublicKey
+}
+
+func parseEncryption(layers, recipients []string) (*Encryption, error) {
+	if len(layers) == 0 && len(recipients) == 0 {
+		return nil, nil
+	}
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("--recipient requires --encrypt-layer")
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("--encrypt-layer requires at least one --recipient")
+	}
+
+	encryption := &Encryption{}
+	for _, layer := range layers {
+		info, ok := mediatypes.LookupRole(layer)
+		if !ok {
+			return nil, fmt.Errorf("unknown layer %s to encrypt", layer)
+		}
+		encryption.MediaTypes = append(encryption.MediaTypes, info.MediaType)
+	}
+	for _, recipient := range recipients {
+		scheme, filename, ok := strings.Cut(recipient, ":")
+		if !ok || scheme != "jwe" {
+			return nil, fmt.Errorf("unsupported recipient %q, only jwe:<public key pem file> is supported", recipient)
+		}
+		pub, err := layercrypt.ReadPublicKeyFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		encryption.Recipients = append(encryption.Recipients, pub)
+	}
+	return encryption, nil
+}
+
+// Preflight configures the size check done before uploading anything, see client.Client.Push.
+type Preflight struct {
+	// Disabled skips the check.
+	Disabled bool
+	// MaxSize is the maximum size of the blobs to upload. Zero means no limit.
+	MaxSize int64
+}
+
+func pushOptions(annotations map[string]string, encryption *Encryption, normalizeAnnotations bool, transform imageutil.ManifestTransform, preflight Preflight) []client.PushOption {
+	opts := []client.PushOption{client.WithAnnotations(annotations)}
+	if encryption != nil {
+		opts = append(opts, client.WithEncryption(encryption.MediaTypes, encryption.Recipients))
+	}
+	if normalizeAnnotations {
+		opts = append(opts, client.WithNormalizedAnnotations())
+	}
+	if transform != nil {
+		opts = append(opts, client.WithManifestTransform(transform))
+	}
+	if preflight.Disabled {
+		opts = append(opts, client.WithoutPreflight())
+	}
+	if preflight.MaxSize > 0 {
+		opts = append(opts, client.WithMaxPushSize(preflight.MaxSize))
+	}
+	return opts
+}
+
 func Run(
 	ctx context.Context,
-	storeFactory common.StoreFactory,
-	registryFactory common.RemoteRegistryFactory,
+	clientFactory common.ClientFactory,
 	ref string,
+	annotations map[string]string,
+	encryption *Encryption,
+	normalizeAnnotations bool,
+	transform imageutil.ManifestTransform,
+	preflight Preflight,
+	format string,
+	out io.Writer,
 ) error {
-	store, err := storeFactory()
+	c, err := clientFactory()
+	if err != nil {
+		return fmt.Errorf("error creating client: %w", err)
+	}
+
+	res, err := c.Push(ctx, ref, pushOptions(annotations, encryption, normalizeAnnotations, transform, preflight)...)
+	if err != nil {
+		common.PrintTransferProgress(os.Stderr, err)
+		return err
+	}
+	pinned, err := common.NewPinnedResult(c.Store().Parser(), ref, res.Digest)
 	if err != nil {
-		return fmt.Errorf("error creating store: %w", err)
+		return err
+	}
+
+	info, result := common.FormatOutputs(format, out)
+	common.PrintAnnotationChanges(info, res.AnnotationChanges)
+	if transform != nil {
+		warnTransformed(ref, res)
 	}
+	if res.UpToDate {
+		fmt.Fprintln(info, ref, "is already up to date", res.Digest.Encoded())
+	} else {
+		fmt.Fprintln(info, "Successfully pushed", ref, res.Digest.Encoded())
+	}
+	return common.PrintPinned(result, format, pinned)
+}
 
-	registry, err := registryFactory()
+// RunBatch pushes the references of the batch file at path, each to its destination if it has one, with
+// at most jobs of them at a time. Blobs shared by the images are uploaded once per repository and mounted
+// into the other repositories of the same registry. A reference failing does not prevent pushing the
+// others unless failFast is set, the results are reported per reference.
+func RunBatch(
+	ctx context.Context,
+	clientFactory common.ClientFactory,
+	path string,
+	jobs int,
+	failFast bool,
+	annotations map[string]string,
+	encryption *Encryption,
+	normalizeAnnotations bool,
+	transform imageutil.ManifestTransform,
+	preflight Preflight,
+	jsonOutput bool,
+	out io.Writer,
+) error {
+	c, err := clientFactory()
 	if err != nil {
-		return fmt.Errorf("error creating remote registry: %w", err)
+		return fmt.Errorf("error creating client: %w", err)
 	}
 
-	img, err := store.Resolve(ctx, ref)
+	ctx = remote.WithBlobTracker(ctx, remote.NewBlobTracker())
+	res, err := common.RunBatchFile(ctx, path, jobs, failFast, true, func(ctx context.Context, entry batch.Entry) batch.Result {
+		opts := pushOptions(annotations, encryption, normalizeAnnotations, transform, preflight)
+		if entry.Destination != "" {
+			opts = append(opts, client.WithDestination(entry.Destination))
+		}
+		pushRes, err := c.Push(ctx, entry.Ref, opts...)
+		if err != nil {
+			return batch.Result{Err: err}
+		}
+		if transform != nil {
+			warnTransformed(entry.Ref, pushRes)
+		}
+		return batch.Result{Digest: pushRes.Digest}
+	})
 	if err != nil {
-		return fmt.Errorf("error resolving ref %s: %w", ref, err)
+		return err
 	}
 
-	if err := registry.Push(ctx, ref, img); err != nil {
-		return fmt.Errorf("error pushing image to %s: %w", ref, err)
+	if err := res.Print(out, jsonOutput); err != nil {
+		return err
 	}
+	return res.Err()
+}
 
-	fmt.Println("Successfully pushed", ref, img.Descriptor().Digest.Encoded())
-	return nil
+// warnTransformed warns if transforming the manifest made the pushed digest differ from the local one.
+func warnTransformed(ref string, res *client.PushResult) {
+	if res.Digest != res.LocalDigest {
+		fmt.Fprintf(os.Stderr, "Warning: the manifest of %s was rewritten for the push, the remote digest %s differs from the local digest %s\n", ref, res.Digest, res.LocalDigest)
+	}
 }
@@ -0,0 +1,96 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushartifact
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/containerd/containerd/remotes"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+)
+
+// DefaultLayerMediaType is the media type of artifact layers if none is specified.
+const DefaultLayerMediaType = "application/octet-stream"
+
+func Command(registryFactory common.RemoteRegistryFactory) *cobra.Command {
+	var (
+		artifactType   string
+		files          []string
+		layerMediaType string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "push-artifact image[:tag] --type <artifact-type> --file <file>...",
+		Short: "Push files as an OCI artifact, e.g. an ignition config or a firmware bundle, to a remote registry.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			ref := args[0]
+			return Run(ctx, registryFactory, ref, artifactType, layerMediaType, files)
+		},
+	}
+
+	cmd.Flags().StringVar(&artifactType, "type", "", "Artifact type, e.g. application/vnd.onmetal.ignition.v1.")
+	cmd.Flags().StringArrayVar(&files, "file", nil, "File to add as layer. Can be specified multiple times, layers are added in order.")
+	cmd.Flags().StringVar(&layerMediaType, "layer-media-type", DefaultLayerMediaType, "Media type of the layers.")
+	_ = cmd.RegisterFlagCompletionFunc("layer-media-type", common.CompleteFixed(
+		DefaultLayerMediaType, onmetalimage.IgnitionLayerMediaType, onmetalimage.CloudInitLayerMediaType,
+	))
+	_ = cmd.MarkFlagRequired("type")
+	_ = cmd.MarkFlagRequired("file")
+
+	return cmd
+}
+
+func Run(
+	ctx context.Context,
+	registryFactory common.RemoteRegistryFactory,
+	ref, artifactType, layerMediaType string,
+	files []string,
+) error {
+	registry, err := registryFactory()
+	if err != nil {
+		return fmt.Errorf("error creating remote registry: %w", err)
+	}
+
+	b := imageutil.NewArtifactBuilder(artifactType)
+	for _, file := range files {
+		b = b.FileLayer(file,
+			imageutil.WithMediaType(layerMediaType),
+			imageutil.WithAnnotations(map[string]string{
+				ocispec.AnnotationTitle: filepath.Base(file),
+			}),
+		)
+	}
+	img, err := b.Complete()
+	if err != nil {
+		return fmt.Errorf("error building artifact: %w", err)
+	}
+
+	ctx = remotes.WithMediaTypeKeyPrefix(ctx, ocispec.MediaTypeEmptyJSON, "config-")
+	ctx = remotes.WithMediaTypeKeyPrefix(ctx, layerMediaType, "layer-")
+	if err := registry.Push(ctx, ref, img); err != nil {
+		return fmt.Errorf("error pushing artifact to %s: %w", ref, err)
+	}
+
+	fmt.Println("Successfully pushed", ref, img.Descriptor().Digest.Encoded())
+	return nil
+}
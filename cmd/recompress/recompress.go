@@ -0,0 +1,116 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recompress
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/onmetal/onmetal-image/batch"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/mutate"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory) *cobra.Command {
+	var (
+		to         string
+		refs       []string
+		all        bool
+		jsonOutput bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "recompress --to zstd --ref image[:tag]... | --all",
+		Short: "Recompress the gzip compressed rootfs layers of local images in place.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			compression, err := mutate.ParseCompression(to)
+			if err != nil {
+				return err
+			}
+			return Run(ctx, storeFactory, compression, refs, all, jsonOutput)
+		},
+	}
+
+	cmd.Flags().StringVar(&to, "to", string(mutate.CompressionZstd), "Compression to recompress the layers with. Currently only zstd.")
+	_ = cmd.RegisterFlagCompletionFunc("to", common.CompleteFixed(string(mutate.CompressionZstd)))
+	cmd.Flags().StringArrayVar(&refs, "ref", nil, "Image to recompress. Can be specified multiple times.")
+	cmd.Flags().BoolVar(&all, "all", false, "Recompress all images of the local store.")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the per-image results as JSON.")
+	cmd.MarkFlagsOneRequired("ref", "all")
+	cmd.MarkFlagsMutuallyExclusive("ref", "all")
+
+	return cmd
+}
+
+// Run recompresses the images of the given refs or, if all is set, all images of the store, printing
+// the bytes saved per image. Failing to recompress one image does not prevent recompressing the others.
+func Run(ctx context.Context, storeFactory common.StoreFactory, compression mutate.Compression, refs []string, all, jsonOutput bool) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	type target struct {
+		name   string
+		digest digest.Digest
+	}
+	var (
+		targets []target
+		res     = &common.BatchResult{}
+	)
+	if all {
+		descs, err := s.Layout().Indexer().List(ctx, descriptormatcher.Every)
+		if err != nil {
+			return fmt.Errorf("error listing images: %w", err)
+		}
+		seen := make(map[digest.Digest]struct{})
+		for _, desc := range descs {
+			if _, ok := seen[desc.Digest]; ok {
+				continue
+			}
+			seen[desc.Digest] = struct{}{}
+			targets = append(targets, target{desc.Digest.String(), desc.Digest})
+		}
+	}
+	for _, ref := range refs {
+		resolved, err := common.FuzzyResolveRef(ctx, s, ref)
+		if err != nil {
+			res.Add(batch.Result{Name: ref, Err: fmt.Errorf("error resolving source: %w", err)})
+			continue
+		}
+		desc, err := s.Descriptor(ctx, resolved)
+		if err != nil {
+			res.Add(batch.Result{Name: ref, Err: err})
+			continue
+		}
+		targets = append(targets, target{ref, desc.Digest})
+	}
+
+	for _, t := range targets {
+		result := s.Layout().RecompressImage(ctx, t.digest, compression)
+		result.Name = t.name
+		res.Add(result)
+	}
+	if err := res.Print(os.Stdout, jsonOutput); err != nil {
+		return err
+	}
+	return res.Err()
+}
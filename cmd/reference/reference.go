@@ -0,0 +1,80 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reference
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/spf13/cobra"
+)
+
+func Command(requestResolverFactory common.RequestResolverFactory) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ref",
+		Short: "Commands for image references.",
+	}
+
+	cmd.AddCommand(
+		PinCommand(requestResolverFactory),
+		ResolveAndUpdateCommand(requestResolverFactory),
+	)
+
+	return cmd
+}
+
+func PinCommand(requestResolverFactory common.RequestResolverFactory) *cobra.Command {
+	var format string
+
+	cmd := &cobra.Command{
+		Use:   "pin image[:tag]",
+		Short: "Resolve a reference at its registry and print its digest-pinned form without pulling the image.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := common.ValidateFormat(format); err != nil {
+				return err
+			}
+			ctx := cmd.Context()
+			return RunPin(ctx, requestResolverFactory, args[0], format, os.Stdout)
+		},
+	}
+
+	cmd.Flags().StringVar(&format, common.RecommendedFormatFlagName, common.FormatText, common.RecommendedFormatFlagUsage)
+	_ = cmd.RegisterFlagCompletionFunc(common.RecommendedFormatFlagName, common.CompleteFixed(common.FormatText, common.FormatJSON, common.FormatPinned))
+
+	return cmd
+}
+
+// RunPin resolves the reference at its registry and prints it pinned to the digest it points to.
+func RunPin(ctx context.Context, requestResolverFactory common.RequestResolverFactory, ref, format string, out io.Writer) error {
+	resolver, err := requestResolverFactory()
+	if err != nil {
+		return fmt.Errorf("error creating request resolver: %w", err)
+	}
+
+	dgst, err := resolver.ResolveDigest(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	pinned, err := common.NewPinnedResult(resolver.Parser(), ref, dgst)
+	if err != nil {
+		return err
+	}
+	return common.PrintPinned(out, format, pinned)
+}
@@ -0,0 +1,223 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reference
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/utils/yamlpath"
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+func ResolveAndUpdateCommand(requestResolverFactory common.RequestResolverFactory) *cobra.Command {
+	var (
+		file       string
+		paths      []string
+		check      bool
+		jsonOutput bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "resolve-and-update --file file.yaml --path .spec.image",
+		Short: "Pin the floating references at the given paths of a YAML or JSON file to the digests they currently point to.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			return RunResolveAndUpdate(ctx, requestResolverFactory, file, paths, check, jsonOutput)
+		},
+	}
+
+	cmd.Flags().StringVarP(&file, "file", "f", "", "YAML or JSON file to update in place.")
+	cmd.Flags().StringArrayVar(&paths, "path", nil, "Path of the references in the file, e.g. .spec.image or .items[].image. Can be repeated.")
+	cmd.Flags().BoolVar(&check, "check", false, "Only check whether the references are up to date, exiting with 3 if not, without writing the file.")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the updates as JSON.")
+	_ = cmd.MarkFlagRequired("file")
+	_ = cmd.MarkFlagRequired("path")
+
+	return cmd
+}
+
+// Update is the update of a reference in a file.
+type Update struct {
+	// Line is the line of the reference in the file.
+	Line int `json:"line"`
+	// Reference is the floating part of the reference, i.e. without digest.
+	Reference string `json:"reference"`
+	// Old is the digest the reference was pinned to before, if any.
+	Old digest.Digest `json:"old,omitempty"`
+	// New is the digest the reference is pinned to now.
+	New digest.Digest `json:"new"`
+}
+
+// RunResolveAndUpdate resolves the floating references at the paths of the file at their registries and
+// pins them to the digests they currently point to, only rewriting the file if any of them changed.
+// References that are only given by digest are left alone. If check is set, the file is never written and
+// an error with common.ExitCodeOutdated is returned if any reference is not up to date.
+func RunResolveAndUpdate(
+	ctx context.Context,
+	requestResolverFactory common.RequestResolverFactory,
+	file string,
+	exprs []string,
+	check, jsonOutput bool,
+) error {
+	paths := make([]yamlpath.Path, 0, len(exprs))
+	for _, expr := range exprs {
+		path, err := yamlpath.Parse(expr)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", file, err)
+	}
+	scalars, err := yamlpath.Find(data, paths...)
+	if err != nil {
+		return fmt.Errorf("error finding references in %s: %w", file, err)
+	}
+	if len(scalars) == 0 {
+		return fmt.Errorf("no references found at %s in %s", strings.Join(exprs, ", "), file)
+	}
+
+	resolver, err := requestResolverFactory()
+	if err != nil {
+		return fmt.Errorf("error creating request resolver: %w", err)
+	}
+
+	var (
+		resolved = make(map[string]digest.Digest)
+		values   = make([]string, len(scalars))
+		updates  = []Update{}
+	)
+	for i, scalar := range scalars {
+		values[i] = scalar.Value
+
+		floating, old, err := splitPinned(scalar.Value)
+		if err != nil {
+			return fmt.Errorf("invalid reference %q at line %d: %w", scalar.Value, scalar.Line, err)
+		}
+		named, err := resolver.Parser().ParseNamed(floating)
+		if err != nil {
+			return fmt.Errorf("invalid reference %q at line %d: %w", scalar.Value, scalar.Line, err)
+		}
+		if reference.IsNameOnly(named) {
+			if old != "" {
+				// Only pinned by digest, so there is no tag to follow.
+				continue
+			}
+			floating += ":latest"
+		}
+
+		dgst, ok := resolved[floating]
+		if !ok {
+			dgst, err = resolver.ResolveDigest(ctx, floating)
+			if err != nil {
+				return err
+			}
+			resolved[floating] = dgst
+		}
+		if dgst == old {
+			continue
+		}
+		values[i] = floating + "@" + dgst.String()
+		updates = append(updates, Update{Line: scalar.Line, Reference: floating, Old: old, New: dgst})
+	}
+
+	// Keep stdout parseable if the updates are printed as JSON.
+	out := io.Writer(os.Stdout)
+	if jsonOutput {
+		out = os.Stderr
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(updates); err != nil {
+			return err
+		}
+	}
+	for _, update := range updates {
+		old := "none"
+		if update.Old != "" {
+			old = update.Old.String()
+		}
+		fmt.Fprintf(out, "%s:%d %s: %s -> %s\n", file, update.Line, update.Reference, old, update.New)
+	}
+
+	switch {
+	case len(updates) == 0:
+		fmt.Fprintf(out, "All %d reference(s) in %s are up to date\n", len(scalars), file)
+		return nil
+	case check:
+		return &common.ExitError{Code: common.ExitCodeOutdated, Err: fmt.Errorf("%d reference(s) in %s are not up to date", len(updates), file)}
+	}
+
+	updated, err := yamlpath.Replace(data, scalars, values)
+	if err != nil {
+		return fmt.Errorf("error updating references in %s: %w", file, err)
+	}
+	if err := writeFile(file, updated); err != nil {
+		return fmt.Errorf("error writing %s: %w", file, err)
+	}
+	fmt.Fprintf(out, "Updated %d reference(s) in %s\n", len(updates), file)
+	return nil
+}
+
+// splitPinned splits a reference into its floating part and the digest it is pinned to, if any.
+func splitPinned(s string) (string, digest.Digest, error) {
+	floating, dgst, ok := strings.Cut(s, "@")
+	if !ok {
+		return s, "", nil
+	}
+	if err := digest.Digest(dgst).Validate(); err != nil {
+		return "", "", err
+	}
+	return floating, digest.Digest(dgst), nil
+}
+
+// writeFile atomically replaces the file with the data, keeping its mode.
+func writeFile(filename string, data []byte) error {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
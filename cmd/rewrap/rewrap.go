@@ -0,0 +1,79 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rewrap
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/onmetal/onmetal-image/oci/local"
+	"github.com/spf13/cobra"
+)
+
+func Command(storePath *string) *cobra.Command {
+	var (
+		oldKeyFile string
+		newKeyFile string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "rewrap --new-key <file> [--old-key <file>]",
+		Short: "Re-encrypt all blobs of the local store with a new key.",
+		Long: `Re-encrypt all blobs of the local store with a new key.
+
+Blobs encrypted with the old key are decrypted, verified against their digest and encrypted with the new key.
+Plaintext blobs are encrypted as well, so rewrap can also be used to migrate an existing store to encryption.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			return Run(ctx, *storePath, oldKeyFile, newKeyFile)
+		},
+	}
+
+	cmd.Flags().StringVar(&oldKeyFile, "old-key", "", "File containing the hex-encoded key the blobs are currently encrypted with. Leave empty if the store is not encrypted yet.")
+	cmd.Flags().StringVar(&newKeyFile, "new-key", "", "File containing the hex-encoded key to encrypt the blobs with.")
+	_ = cmd.MarkFlagRequired("new-key")
+
+	return cmd
+}
+
+func Run(ctx context.Context, storePath, oldKeyFile, newKeyFile string) error {
+	newKey, err := local.ReadKeyFile(newKeyFile)
+	if err != nil {
+		return err
+	}
+
+	opts := []local.Option{local.WithEncryption(newKey)}
+	if oldKeyFile != "" {
+		oldKey, err := local.ReadKeyFile(oldKeyFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, local.WithDecryptionKeys(oldKey))
+	}
+
+	s, err := local.NewStore(storePath, opts...)
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	n, err := s.Rewrap(ctx)
+	if err != nil {
+		return fmt.Errorf("error rewrapping blobs (%d rewrapped so far): %w", n, err)
+	}
+
+	fmt.Printf("Rewrapped %d blob(s) with key %s\n", n, local.KeyID(newKey))
+	return nil
+}
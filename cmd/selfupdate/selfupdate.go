@@ -0,0 +1,154 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selfupdate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/selfupdate"
+	"github.com/onmetal/onmetal-image/version"
+	"github.com/spf13/cobra"
+)
+
+// checkTimeout bounds running the new executable to verify it.
+const checkTimeout = 30 * time.Second
+
+func Command(httpClientFactory common.HTTPClientFactory) *cobra.Command {
+	var (
+		channel       string
+		targetVersion string
+		baseURL       string
+		check         bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "self-update [--channel stable] [--version vX.Y.Z]",
+		Short: "Replace the onmetal-image binary with a verified release binary.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return Run(cmd.Context(), httpClientFactory, baseURL, channel, targetVersion, check, cmd.OutOrStdout())
+		},
+	}
+
+	cmd.Flags().StringVar(&channel, "channel", selfupdate.DefaultChannel, "Release channel to update from.")
+	cmd.Flags().StringVar(&targetVersion, "version", "", "Release to update to instead of the one the channel points to. Allows downgrades.")
+	cmd.Flags().StringVar(&baseURL, "url", selfupdate.DefaultBaseURL, "URL to fetch releases from, laid out like GitHub releases.")
+	cmd.Flags().BoolVar(&check, "check", false, fmt.Sprintf("Only report whether an update is available, exiting with code %d if so.", common.ExitCodeUpdateAvailable))
+	cmd.MarkFlagsMutuallyExclusive("channel", "version")
+
+	return cmd
+}
+
+func Run(
+	ctx context.Context,
+	httpClientFactory common.HTTPClientFactory,
+	baseURL, channel, targetVersion string,
+	check bool,
+	out io.Writer,
+) error {
+	httpClient, err := httpClientFactory()
+	if err != nil {
+		return fmt.Errorf("error creating http client: %w", err)
+	}
+	updater := &selfupdate.Updater{BaseURL: baseURL, Client: httpClient}
+
+	current := version.Get().Version
+	target := targetVersion
+	if target == "" {
+		if target, err = updater.Latest(ctx, channel); err != nil {
+			return err
+		}
+	}
+
+	// An explicit version is installed even if it is older than the current one.
+	available := selfupdate.Newer(target, current)
+	if targetVersion != "" {
+		available = strings.TrimPrefix(target, "v") != strings.TrimPrefix(current, "v")
+	}
+	if !available {
+		fmt.Fprintln(out, "onmetal-image is up to date", current)
+		return nil
+	}
+	if check {
+		fmt.Fprintln(out, "Update available:", current, "->", target)
+		return &common.ExitError{
+			Code: common.ExitCodeUpdateAvailable,
+			Err:  fmt.Errorf("update available: %s -> %s", current, target),
+		}
+	}
+
+	publicKey, err := selfupdate.ParsePublicKey(selfupdate.PublicKey)
+	if err != nil {
+		return fmt.Errorf("this build cannot verify releases: %w", err)
+	}
+	updater.PublicKey = publicKey
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error determining executable: %w", err)
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return fmt.Errorf("error resolving executable: %w", err)
+	}
+
+	// Download next to the executable so it can be renamed over it atomically.
+	path, err := updater.Download(ctx, target, filepath.Dir(executable))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(path) }()
+
+	if err := selfupdate.Replace(executable, path, func(executable string) error {
+		return checkVersion(ctx, executable, target)
+	}); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "Successfully updated onmetal-image from", current, "to", target)
+	return nil
+}
+
+// checkVersion runs the version command of the executable and checks that it reports the expected version.
+func checkVersion(ctx context.Context, executable, expected string) error {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, executable, "version", "--json")
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("error running %s version: %w: %s", executable, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var info version.Info
+	if err := json.Unmarshal(output, &info); err != nil {
+		return fmt.Errorf("error decoding version of %s: %w", executable, err)
+	}
+	if strings.TrimPrefix(info.Version, "v") != strings.TrimPrefix(expected, "v") {
+		return fmt.Errorf("new executable reports version %s, expected %s", info.Version, expected)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory) *cobra.Command {
+	var (
+		since      string
+		jsonOutput bool
+		reset      bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "stats [--since 7d]",
+		Short: "Show the bytes and blobs transferred from and to each registry host by pulls and pushes.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if reset {
+				return RunReset(ctx, storeFactory)
+			}
+			var sinceDuration time.Duration
+			if since != "" {
+				var err error
+				if sinceDuration, err = common.ParseSince(since); err != nil {
+					return err
+				}
+			}
+			return Run(ctx, storeFactory, sinceDuration, jsonOutput)
+		},
+	}
+
+	cmd.Flags().StringVar(&since, "since", "", "Only show the statistics of the given period, e.g. 7d or 12h. Statistics are recorded per day.")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the statistics as JSON.")
+	cmd.Flags().BoolVar(&reset, "reset", false, "Remove all recorded statistics.")
+	cmd.MarkFlagsMutuallyExclusive("reset", "since")
+	cmd.MarkFlagsMutuallyExclusive("reset", "json")
+
+	return cmd
+}
+
+// Run prints the transfer statistics recorded in the store within the given period, all of them if
+// since is zero.
+func Run(ctx context.Context, storeFactory common.StoreFactory, since time.Duration, jsonOutput bool) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	var sinceTime time.Time
+	if since > 0 {
+		sinceTime = time.Now().Add(-since)
+	}
+	report, err := s.Layout().TransferStats(ctx, sinceTime)
+	if err != nil {
+		return fmt.Errorf("error reading transfer statistics: %w", err)
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	if len(report.Hosts) == 0 {
+		fmt.Println("No transfers recorded")
+		return nil
+	}
+	fmt.Printf("Transfers since %s\n", report.Since.Format(time.RFC3339))
+	w := tabwriter.NewWriter(os.Stdout, 12, 0, 1, ' ', 0)
+	_, _ = fmt.Fprintln(w, "HOST\tOPERATIONS\tDOWNLOADED\tUPLOADED\tBLOBS DOWN\tBLOBS UP\tCACHE HITS")
+	for _, stats := range report.Hosts {
+		printStats(w, stats.Host, stats)
+	}
+	printStats(w, "TOTAL", report.Total)
+	return w.Flush()
+}
+
+func printStats(w *tabwriter.Writer, name string, stats layout.TransferStats) {
+	_, _ = fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%d\t%d\t%d\n", name, stats.Operations,
+		units.HumanSize(float64(stats.BytesDownloaded)), units.HumanSize(float64(stats.BytesUploaded)),
+		stats.BlobsDownloaded, stats.BlobsUploaded, stats.CacheHits)
+}
+
+// RunReset removes all transfer statistics recorded in the store.
+func RunReset(ctx context.Context, storeFactory common.StoreFactory) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+	if err := s.Layout().ResetTransferStats(ctx); err != nil {
+		return err
+	}
+	fmt.Println("Reset transfer statistics")
+	return nil
+}
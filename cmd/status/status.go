@@ -0,0 +1,118 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory) *cobra.Command {
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the in-flight and interrupted downloads of the local store.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			return Run(ctx, storeFactory, jsonOutput)
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the ingests as JSON.")
+
+	return cmd
+}
+
+func Run(ctx context.Context, storeFactory common.StoreFactory, jsonOutput bool) error {
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	statuses, err := s.Layout().IngestStatus(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting ingest status: %w", err)
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(statuses)
+	}
+
+	if len(statuses) == 0 {
+		fmt.Println("No in-flight or interrupted downloads")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 0, 1, ' ', 0)
+	_, _ = fmt.Fprintln(w, "BLOB\tSOURCE\tPROGRESS\tSTATE\tUPDATED")
+	for _, status := range statuses {
+		blob := status.Ref
+		if status.Expected != "" {
+			blob = status.Expected.Encoded()[:12]
+		}
+		source := status.Source
+		if source == "" {
+			source = "<unknown>"
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			blob,
+			source,
+			progress(status),
+			state(status),
+			units.HumanDuration(time.Since(status.UpdatedAt))+" ago",
+		)
+	}
+	return w.Flush()
+}
+
+func progress(status layout.IngestStatus) string {
+	if status.Total <= 0 {
+		return units.HumanSize(float64(status.Offset))
+	}
+	return fmt.Sprintf("%s / %s (%d%%)",
+		units.HumanSize(float64(status.Offset)),
+		units.HumanSize(float64(status.Total)),
+		status.Offset*100/status.Total,
+	)
+}
+
+// state describes what happens to the ingest: in-flight ingests are being written, resumable ones continue
+// at their offset on the next pull of the blob, stale ones restart from scratch and are removed by
+// maintenance cleanup-ingests.
+func state(status layout.IngestStatus) string {
+	switch {
+	case status.InFlight:
+		return "in-flight"
+	case status.Stale:
+		return "stale"
+	case status.Offset > 0 && status.Total > 0:
+		return "resumable"
+	default:
+		return "restart"
+	}
+}
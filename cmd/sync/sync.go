@@ -0,0 +1,209 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/onmetal/onmetal-image/client"
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/oci/remote"
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+func Command(storePath *string, configFactory common.ClientConfigFactory) *cobra.Command {
+	var (
+		file                  string
+		pruneExtra            bool
+		jobs                  int
+		limitBandwidth        string
+		noPreflightSpaceCheck bool
+		allowUnknownSize      bool
+		jsonOutput            bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "sync --file desired.yaml",
+		Short: "Make the local store contain exactly the images listed in a desired state file.",
+		Long: `Pull the images of the desired state missing from the local store, verify the blobs of the present
+ones against their digests, pulling missing or corrupt ones again, and move their tags to the desired
+digests. With --prune-extra, unpinned images not in the desired state are removed. Only one sync of a
+store runs at a time.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			return Run(ctx, configFactory, *storePath, file, pruneExtra, jobs, limitBandwidth, !noPreflightSpaceCheck, allowUnknownSize, jsonOutput)
+		},
+	}
+
+	cmd.Flags().StringVarP(&file, "file", "f", "", "Desired state (YAML) listing the digested references that must exist in the store.")
+	cmd.Flags().BoolVar(&pruneExtra, "prune-extra", false, "Remove the images not in the desired state, except pinned and leased ones. Skipped if syncing any desired image fails.")
+	cmd.Flags().IntVar(&jobs, common.RecommendedJobsFlagName, common.DefaultJobs, "Number of images to sync concurrently.")
+	cmd.Flags().StringVar(&limitBandwidth, common.RecommendedLimitBandwidthFlagName, "", common.RecommendedLimitBandwidthFlagUsage)
+	cmd.Flags().BoolVar(&noPreflightSpaceCheck, "no-preflight-space-check", false, "Do not check for sufficient free disk space before downloading.")
+	cmd.Flags().BoolVar(&allowUnknownSize, "allow-unknown-size", false, "Pull legacy images whose manifest has no size information for some blobs. Their digests are still verified.")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the report of drift found and actions taken as JSON.")
+	_ = cmd.MarkFlagRequired("file")
+	_ = cmd.MarkFlagFilename("file", "yaml", "yml")
+
+	return cmd
+}
+
+// Result is the JSON form of a client.SyncItem.
+type Result struct {
+	Reference string              `json:"reference"`
+	Digest    digest.Digest       `json:"digest"`
+	Drift     []client.SyncDrift  `json:"drift"`
+	Actions   []client.SyncAction `json:"actions"`
+	Error     string              `json:"error,omitempty"`
+}
+
+// Report is the JSON form of a client.SyncReport.
+type Report struct {
+	Images       []Result `json:"images"`
+	PruneSkipped bool     `json:"pruneSkipped,omitempty"`
+}
+
+func Run(
+	ctx context.Context,
+	configFactory common.ClientConfigFactory,
+	storePath string,
+	file string,
+	pruneExtra bool,
+	jobs int,
+	limitBandwidth string,
+	preflightSpaceCheck bool,
+	allowUnknownSize bool,
+	jsonOutput bool,
+) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("error reading desired state: %w", err)
+	}
+	state, err := client.ParseDesiredState(data)
+	if err != nil {
+		return err
+	}
+
+	config, err := configFactory(storePath)
+	if err != nil {
+		return err
+	}
+	if limitBandwidth != "" {
+		bytesPerSecond, err := common.ParseBandwidth(limitBandwidth)
+		if err != nil {
+			return err
+		}
+		config.BandwidthLimiter = remote.NewBandwidthLimiter(bytesPerSecond)
+	}
+	c, err := client.New(config)
+	if err != nil {
+		return fmt.Errorf("error creating client: %w", err)
+	}
+
+	var pullOpts []client.PullOption
+	if !preflightSpaceCheck {
+		pullOpts = append(pullOpts, client.WithoutPreflightSpaceCheck())
+	}
+	if allowUnknownSize {
+		pullOpts = append(pullOpts, client.WithAllowUnknownSize())
+	}
+	opts := []client.SyncOption{client.WithSyncJobs(jobs), client.WithSyncPullOptions(pullOpts...)}
+	if pruneExtra {
+		opts = append(opts, client.WithPruneExtra())
+	}
+	report, err := c.Sync(ctx, state, opts...)
+	if err != nil {
+		return err
+	}
+
+	res := Report{Images: make([]Result, 0, len(report.Items)), PruneSkipped: report.PruneSkipped}
+	var drifted, failed int
+	for _, item := range report.Items {
+		result := Result{Reference: item.Ref, Digest: item.Digest, Drift: item.Drift, Actions: item.Actions}
+		if result.Drift == nil {
+			result.Drift = []client.SyncDrift{}
+		}
+		if result.Actions == nil {
+			result.Actions = []client.SyncAction{}
+		}
+		if item.Err != nil {
+			result.Error = item.Err.Error()
+			failed++
+		}
+		if len(item.Drift) > 0 {
+			drifted++
+		}
+		res.Images = append(res.Images, result)
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(res); err != nil {
+			return err
+		}
+	} else {
+		if err := printReport(res); err != nil {
+			return err
+		}
+		fmt.Printf("%d image(s) in sync, %d drifted, %d failed\n", len(res.Images)-drifted, drifted, failed)
+		if res.PruneSkipped {
+			fmt.Fprintln(os.Stderr, "Warning: not removing extra images because syncing desired images failed")
+		}
+	}
+
+	if failed == 0 {
+		return nil
+	}
+	code := common.ExitCodePartialFailure
+	if failed == len(res.Images) {
+		code = common.ExitCodeFailure
+	}
+	return &common.ExitError{
+		Code: code,
+		Err:  fmt.Errorf("%d of %d image(s) failed to sync", failed, len(res.Images)),
+	}
+}
+
+func printReport(report Report) error {
+	if len(report.Images) == 0 {
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 12, 0, 1, ' ', 0)
+	_, _ = fmt.Fprintln(w, "REFERENCE\tDIGEST\tDRIFT\tACTIONS\tERROR")
+	for _, result := range report.Images {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", result.Reference, result.Digest.Encoded()[:12], join(result.Drift), join(result.Actions), result.Error)
+	}
+	return w.Flush()
+}
+
+// join joins the values with commas, returning "-" if there are none.
+func join[T ~string](values []T) string {
+	if len(values) == 0 {
+		return "-"
+	}
+	s := make([]string, 0, len(values))
+	for _, v := range values {
+		s = append(s, string(v))
+	}
+	return strings.Join(s, ",")
+}
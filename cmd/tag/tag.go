@@ -17,6 +17,8 @@ package tag
 import (
 	"context"
 	"fmt"
+	"io"
+	"os"
 
 	"github.com/onmetal/onmetal-image/cmd/common"
 
@@ -24,22 +26,30 @@ import (
 )
 
 func Command(storeFactory common.StoreFactory) *cobra.Command {
+	var format string
+
 	cmd := &cobra.Command{
 		Use:   "tag source-image[:tag] target-image[:tag]",
 		Short: "Tag a local image with a given name (and optional tag).",
 		Args:  cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := common.ValidateFormat(format); err != nil {
+				return err
+			}
 			ctx := cmd.Context()
 			srcImage := args[0]
 			tgtImage := args[1]
-			return Run(ctx, storeFactory, srcImage, tgtImage)
+			return Run(ctx, storeFactory, srcImage, tgtImage, format, os.Stdout)
 		},
 	}
 
+	cmd.Flags().StringVar(&format, common.RecommendedFormatFlagName, common.FormatText, common.RecommendedFormatFlagUsage)
+	_ = cmd.RegisterFlagCompletionFunc(common.RecommendedFormatFlagName, common.CompleteFixed(common.FormatText, common.FormatJSON, common.FormatPinned))
+
 	return cmd
 }
 
-func Run(ctx context.Context, storeFactory common.StoreFactory, srcImage, tgtImage string) error {
+func Run(ctx context.Context, storeFactory common.StoreFactory, srcImage, tgtImage, format string, out io.Writer) error {
 	s, err := storeFactory()
 	if err != nil {
 		return fmt.Errorf("could not create store: %w", err)
@@ -54,6 +64,16 @@ func Run(ctx context.Context, storeFactory common.StoreFactory, srcImage, tgtIma
 		return fmt.Errorf("error tagging image: %w", err)
 	}
 
-	fmt.Println("Successfully tagged", tgtImage, "with", desc)
-	return nil
+	tagged, err := s.Descriptor(ctx, tgtImage)
+	if err != nil {
+		return fmt.Errorf("error resolving tagged image: %w", err)
+	}
+	pinned, err := common.NewPinnedResult(s.Parser(), tgtImage, tagged.Digest)
+	if err != nil {
+		return err
+	}
+
+	info, result := common.FormatOutputs(format, out)
+	fmt.Fprintln(info, "Successfully tagged", tgtImage, "with", desc)
+	return common.PrintPinned(result, format, pinned)
 }
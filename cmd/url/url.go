@@ -20,11 +20,13 @@ import (
 	"fmt"
 	"os"
 
+	onmetalimage "github.com/onmetal/onmetal-image"
 	"github.com/onmetal/onmetal-image/docker"
+	"github.com/onmetal/onmetal-image/mediatypes"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 
-	onmetalimage "github.com/onmetal/onmetal-image"
-
 	"github.com/onmetal/onmetal-image/cmd/common"
 
 	"github.com/spf13/cobra"
@@ -36,10 +38,17 @@ const (
 	Kernel    LayerType = "kernel"
 	RootFS    LayerType = "rootfs"
 	InitRAMFS LayerType = "initramfs"
+	Ignition  LayerType = "ignition"
+	CloudInit LayerType = "cloud-init"
+	UKI       LayerType = "uki"
+	ESP       LayerType = "esp"
 )
 
 func Command(requestResolverFactory common.RequestResolverFactory) *cobra.Command {
-	var layer LayerType
+	var (
+		layer          LayerType
+		layerSelectors []string
+	)
 	cmd := &cobra.Command{
 		Use:   "url image[:tag] [layer-media-type]",
 		Short: "Compute the URL for retrieving a remote image manifest or a layer.",
@@ -47,21 +56,58 @@ func Command(requestResolverFactory common.RequestResolverFactory) *cobra.Comman
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
 			ref := args[0]
-			return Run(ctx, requestResolverFactory, ref, layer)
+			return Run(ctx, requestResolverFactory, ref, layer, layerSelectors)
 		},
 	}
 	cmd.Flags().StringVar((*string)(&layer), "layer", "", "Specify to get the URL to a specific layer.")
+	cmd.Flags().StringSliceVar(&layerSelectors, "layer-selector", nil, "Select the layer by annotation in the form key=value. Can be combined with --layer.")
+	_ = cmd.RegisterFlagCompletionFunc("layer", common.CompleteFixed(mediatypes.Roles()...))
 
 	return cmd
 }
 
-var layerTypeToMediaType = map[LayerType]string{
-	RootFS:    onmetalimage.RootFSLayerMediaType,
-	InitRAMFS: onmetalimage.InitRAMFSLayerMediaType,
-	Kernel:    onmetalimage.KernelLayerMediaType,
+func layerMatcher(layer LayerType, layerSelectors []string) (descriptormatcher.Matcher, error) {
+	var matchers []descriptormatcher.Matcher
+	if layer != "" {
+		info, ok := mediatypes.LookupRole(string(layer))
+		if !ok {
+			return nil, fmt.Errorf("unknown layer type %s", layer)
+		}
+		matchers = append(matchers, descriptormatcher.MediaTypes(info.MediaType))
+	}
+	selected, err := common.ParseLayerSelectors(layerSelectors)
+	if err != nil {
+		return nil, err
+	}
+	if selected != nil {
+		matchers = append(matchers, selected)
+	}
+	if len(matchers) == 0 {
+		return nil, nil
+	}
+	return descriptormatcher.And(matchers...), nil
+}
+
+// layerNotPresent returns the error reporting that the image of ref has no layer of the given type,
+// listing the layers it has.
+func layerNotPresent(ctx context.Context, resolver *docker.RequestResolver, ref string, layer LayerType, manifest *ocispec.Manifest) error {
+	info, _ := mediatypes.LookupRole(string(layer))
+	// The digest only completes the message, failing to resolve it must not hide the actual error.
+	dgst, _ := resolver.ResolveDigest(ctx, ref)
+	return fmt.Errorf("%s: %w", ref, &ociimage.LayerNotPresentError{
+		Digest:    dgst,
+		Role:      string(layer),
+		MediaType: info.MediaType,
+		Available: onmetalimage.AvailableRoles(manifest.Layers),
+	})
 }
 
-func Run(ctx context.Context, requestResolverFactory common.RequestResolverFactory, ref string, layer LayerType) error {
+func Run(ctx context.Context, requestResolverFactory common.RequestResolverFactory, ref string, layer LayerType, layerSelectors []string) error {
+	match, err := layerMatcher(layer, layerSelectors)
+	if err != nil {
+		return err
+	}
+
 	resolver, err := requestResolverFactory()
 	if err != nil {
 		return fmt.Errorf("error creating request resolver: %w", err)
@@ -73,25 +119,25 @@ func Run(ctx context.Context, requestResolverFactory common.RequestResolverFacto
 	}
 
 	var request docker.Request
-	if layer != "" {
+	if match != nil {
 		manifest, err := info.Manifest(ctx)
 		if err != nil {
 			return fmt.Errorf("could not resolve manifest: %w", err)
 		}
 
-		var (
-			mediaType = layerTypeToMediaType[layer]
-			desc      *ocispec.Descriptor
-		)
+		var desc *ocispec.Descriptor
 		for _, layer := range manifest.Layers {
-			if layer.MediaType == mediaType {
+			if match(layer) {
 				layer := layer
 				desc = &layer
 				break
 			}
 		}
+		if desc == nil && len(layerSelectors) == 0 {
+			return layerNotPresent(ctx, resolver, ref, layer, manifest)
+		}
 		if desc == nil {
-			return fmt.Errorf("no layer with type %s found", layer)
+			return fmt.Errorf("no layer matching type %q and selectors %v found", layer, layerSelectors)
 		}
 
 		layerInfo, err := info.Layer(ctx, *desc)
@@ -0,0 +1,94 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/onmetal/onmetal-image/cmd/common"
+	"github.com/onmetal/onmetal-image/receipt"
+	"github.com/spf13/cobra"
+)
+
+func Command(storeFactory common.StoreFactory) *cobra.Command {
+	var (
+		receiptFile string
+		keyFile     string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "verify --receipt receipt.json --key log.pub image[:tag]",
+		Short: "Verify a local image against a signed transparency log receipt without network access.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			srcImage := args[0]
+			return Run(ctx, storeFactory, srcImage, receiptFile, keyFile)
+		},
+	}
+
+	cmd.Flags().StringVar(&receiptFile, "receipt", "", "Receipt (JSON) stating the manifest digest, log index, timestamp and signature.")
+	cmd.Flags().StringVar(&keyFile, "key", "", "PEM public key (ed25519 or ECDSA) of the transparency log the receipt is signed with.")
+	_ = cmd.MarkFlagRequired("receipt")
+	_ = cmd.MarkFlagRequired("key")
+
+	return cmd
+}
+
+// Run verifies the local image against the receipt and prints the verification report as JSON.
+// Blobs protected with fsverity are checked against their recorded fsverity digest instead of re-hashing
+// them. It fails if the image does not verify.
+func Run(ctx context.Context, storeFactory common.StoreFactory, srcImage, receiptFile, keyFile string) error {
+	r, err := receipt.ReadFile(receiptFile)
+	if err != nil {
+		return err
+	}
+	pub, err := receipt.ReadPublicKeyFile(keyFile)
+	if err != nil {
+		return err
+	}
+
+	s, err := storeFactory()
+	if err != nil {
+		return fmt.Errorf("could not create store: %w", err)
+	}
+
+	ref, err := common.FuzzyResolveRef(ctx, s, srcImage)
+	if err != nil {
+		return fmt.Errorf("error resolving source: %w", err)
+	}
+	img, err := s.Resolve(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("error getting image: %w", err)
+	}
+
+	report, err := receipt.VerifyImage(ctx, ref, img, r, pub, receipt.WithVerityVerified(s.Layout().VerityVerified))
+	if err != nil {
+		return fmt.Errorf("error verifying %s: %w", ref, err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	if !report.Verified {
+		return fmt.Errorf("%s does not verify against the receipt", ref)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verifyfiles
+
+import (
+	"fmt"
+
+	"github.com/onmetal/onmetal-image/checksum"
+	"github.com/spf13/cobra"
+)
+
+func Command() *cobra.Command {
+	var root string
+
+	cmd := &cobra.Command{
+		Use:   "verify-files checksums.json",
+		Short: "Verify files against a checksum manifest written by extract --write-checksums.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			filename := args[0]
+			return Run(filename, root)
+		},
+	}
+
+	cmd.Flags().StringVar(&root, "root", "", "Directory the manifest paths are relative to. Defaults to the root recorded in the manifest.")
+
+	return cmd
+}
+
+func Run(filename, root string) error {
+	m, err := checksum.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	mismatches, err := checksum.Verify(m, root)
+	if err != nil {
+		return fmt.Errorf("error verifying files: %w", err)
+	}
+
+	for _, mismatch := range mismatches {
+		fmt.Printf("%s: %s\n", mismatch.Path, mismatch.Reason)
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%d of %d file(s) do not match", len(mismatches), len(m.Files))
+	}
+
+	fmt.Printf("All %d file(s) match\n", len(m.Files))
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/onmetal/onmetal-image/version"
+	"github.com/spf13/cobra"
+)
+
+func Command() *cobra.Command {
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print the version, build information and supported features.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return Run(jsonOutput)
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the information as JSON.")
+
+	return cmd
+}
+
+func Run(jsonOutput bool) error {
+	info := version.Get()
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+
+	fmt.Println("Version:   ", info.Version)
+	if info.GitCommit != "" {
+		fmt.Println("Git commit:", info.GitCommit)
+	}
+	if info.BuildDate != "" {
+		fmt.Println("Build date:", info.BuildDate)
+	}
+	fmt.Println("Go version:", info.GoVersion)
+	fmt.Println("Platform:  ", info.Platform)
+	fmt.Println("Features:  ", strings.Join(info.Features, ", "))
+	return nil
+}
@@ -0,0 +1,416 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config implements the layered onmetal-image configuration file.
+//
+// Configuration files are YAML documents merged in the order they are given, e.g. a host-level file
+// shipped by fleet management first and a user-level file with personal overrides second:
+//
+//	store:
+//	  path: /var/lib/onmetal-image
+//	  maxSize: 200G
+//	defaultRegistry: harbor.example.com
+//	connectTimeout: 30s
+//	registries:
+//	  - host: harbor.example.com
+//	    maxConcurrentTransfers: 4
+//	    maxIdleConns: 8
+//
+// Mappings (such as store) merge key-wise, the entries of registries merge by host with the fields of
+// later entries winning, and all other values (scalars and other lists) of later files override those of
+// earlier ones.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/onmetal/onmetal-image/oci/remote"
+	"gopkg.in/yaml.v3"
+)
+
+// SystemPath is the host-level configuration file.
+const SystemPath = "/etc/onmetal-image/config.yaml"
+
+// DefaultPaths returns the default configuration files in merge order: SystemPath and the user-level
+// onmetal-image/config.yaml in the user configuration directory (e.g. ~/.config).
+func DefaultPaths() []string {
+	paths := []string{SystemPath}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "onmetal-image", "config.yaml"))
+	}
+	return paths
+}
+
+// Config is the effective configuration of all loaded files.
+type Config struct {
+	Store Store `yaml:"store,omitempty"`
+
+	// DefaultRegistry is the registry applied to references without a registry.
+	DefaultRegistry string `yaml:"defaultRegistry,omitempty"`
+	// DockerConfigPaths are the docker configuration files registry credentials are read from.
+	DockerConfigPaths []string `yaml:"dockerConfigPaths,omitempty"`
+	// NoAnonymousFallback disables retrying pulls anonymously if the stored credentials are rejected.
+	NoAnonymousFallback bool `yaml:"noAnonymousFallback,omitempty"`
+	// NoExternalBlobs forbids fetching blobs from the external URLs of their descriptors.
+	NoExternalBlobs bool `yaml:"noExternalBlobs,omitempty"`
+
+	// Timeout bounds whole commands.
+	Timeout Duration `yaml:"timeout,omitempty"`
+	// ConnectTimeout bounds establishing connections to a registry and resolving a reference.
+	ConnectTimeout Duration `yaml:"connectTimeout,omitempty"`
+	// ResolveCacheTTL is the duration the digests tags resolved to are cached for.
+	ResolveCacheTTL Duration `yaml:"resolveCacheTTL,omitempty"`
+	// NoResolveCache disables the resolve cache.
+	NoResolveCache bool `yaml:"noResolveCache,omitempty"`
+
+	// Registries are the per-registry-host settings.
+	Registries []Registry `yaml:"registries,omitempty"`
+
+	node    *yaml.Node
+	origins map[string]Origin
+}
+
+// Store configures the local store.
+type Store struct {
+	// Path is the directory of the local store.
+	Path string `yaml:"path,omitempty"`
+	// BlobDir is the directory to keep the blobs of the local store in instead of Path.
+	BlobDir string `yaml:"blobDir,omitempty"`
+	// MaxSize is the maximum size of the store, e.g. 200G.
+	MaxSize string `yaml:"maxSize,omitempty"`
+	// EncryptionKeyFile is the file with the hex-encoded AES key new blobs are encrypted with.
+	EncryptionKeyFile string `yaml:"encryptionKeyFile,omitempty"`
+	// NoSync disables syncing committed blobs to disk.
+	NoSync bool `yaml:"noSync,omitempty"`
+	// ProtectBlobs protects committed blobs against tampering with fsverity or the immutable attribute.
+	ProtectBlobs bool `yaml:"protectBlobs,omitempty"`
+	// AutoMigrate migrates stores of an older format version when opening them.
+	AutoMigrate bool `yaml:"autoMigrate,omitempty"`
+	// NoUsageTracking disables recording when and how often images are used.
+	NoUsageTracking bool `yaml:"noUsageTracking,omitempty"`
+	// NoAudit disables the audit log of the store.
+	NoAudit bool `yaml:"noAudit,omitempty"`
+	// GracePeriod is the duration after which images condemned by tag updates are removed.
+	GracePeriod Duration `yaml:"gracePeriod,omitempty"`
+}
+
+// Registry holds the settings of a registry host, see remote.HostSettings.
+type Registry struct {
+	// Host is the registry host, e.g. harbor.example.com or localhost:5000.
+	Host                string `yaml:"host"`
+	remote.HostSettings `yaml:",inline"`
+}
+
+// Duration is a time.Duration written as a string, e.g. 30s or 10m.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid duration %q: %w", value.Line, s, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// Origin is the location a configuration value was set at.
+type Origin struct {
+	File string
+	Line int
+}
+
+func (o Origin) String() string {
+	return fmt.Sprintf("%s:%d", o.File, o.Line)
+}
+
+// Origin returns where the value with the given key was set, if it was set by any file. Keys are the
+// dot-separated YAML keys, with registry settings keyed by host, e.g. store.maxSize or
+// registries[harbor.example.com].maxIdleConns.
+func (c *Config) Origin(key string) (Origin, bool) {
+	origin, ok := c.origins[key]
+	return origin, ok
+}
+
+// HostsConfig returns the registry settings as remote.HostsConfig, nil if there are none.
+func (c *Config) HostsConfig() *remote.HostsConfig {
+	if len(c.Registries) == 0 {
+		return nil
+	}
+	hosts := &remote.HostsConfig{Hosts: make(map[string]remote.HostSettings, len(c.Registries))}
+	for _, registry := range c.Registries {
+		hosts.Hosts[registry.Host] = registry.HostSettings
+	}
+	return hosts
+}
+
+// Encode writes the effective configuration as YAML to w. If showOrigin is set, each value is annotated
+// with the file and line it was set at.
+func (c *Config) Encode(w io.Writer, showOrigin bool) error {
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if c.node != nil {
+		node = copyNode(c.node)
+	}
+	walk("", node, func(key string, keyNode, valueNode *yaml.Node) {
+		if !showOrigin {
+			return
+		}
+		comment := "from " + c.origins[key].String()
+		if valueNode.Kind == yaml.ScalarNode {
+			valueNode.LineComment = comment
+		} else {
+			keyNode.LineComment = comment
+		}
+	})
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return fmt.Errorf("error encoding config: %w", err)
+	}
+	return enc.Close()
+}
+
+// Load loads and merges the configuration files at the given paths in order, see the package
+// documentation for the merge semantics. Files that do not exist are skipped, so the default paths can be
+// passed unconditionally. Errors in a file name the file and the offending line.
+func Load(paths ...string) (*Config, error) {
+	var (
+		merged *yaml.Node
+		files  = make(map[*yaml.Node]string)
+	)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("error reading config: %w", err)
+		}
+
+		node, err := parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config %s: %w", path, err)
+		}
+		if node == nil {
+			continue
+		}
+		setFile(files, node, path)
+
+		if merged == nil {
+			merged = node
+		} else {
+			merged = merge("", merged, node)
+		}
+	}
+
+	c := &Config{origins: make(map[string]Origin)}
+	if merged == nil {
+		return c, nil
+	}
+	if err := merged.Decode(c); err != nil {
+		return nil, fmt.Errorf("error decoding config: %w", err)
+	}
+	c.node = merged
+	walk("", merged, func(key string, _, value *yaml.Node) {
+		c.origins[key] = Origin{File: files[value], Line: value.Line}
+	})
+	return c, nil
+}
+
+// parse parses and validates a single configuration file, returning its root mapping or nil if it is empty.
+func parse(data []byte) (*yaml.Node, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&Config{}); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: config must be a mapping", root.Line)
+	}
+	if err := validate(root); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// validate checks the values the YAML decoder cannot check itself.
+func validate(root *yaml.Node) error {
+	if store := mappingValue(root, "store"); store != nil {
+		if maxSize := mappingValue(store, "maxSize"); maxSize != nil {
+			if _, err := units.RAMInBytes(maxSize.Value); err != nil {
+				return fmt.Errorf("line %d: invalid store max size %q: %w", maxSize.Line, maxSize.Value, err)
+			}
+		}
+	}
+
+	registries := mappingValue(root, "registries")
+	if registries == nil {
+		return nil
+	}
+	hosts := make(map[string]int)
+	for _, entry := range registries.Content {
+		var registry Registry
+		if err := entry.Decode(&registry); err != nil {
+			return err
+		}
+		switch {
+		case registry.Host == "":
+			return fmt.Errorf("line %d: registry has no host", entry.Line)
+		case hosts[registry.Host] != 0:
+			return fmt.Errorf("line %d: registry %s is already configured at line %d", entry.Line, registry.Host, hosts[registry.Host])
+		case registry.MaxConcurrentTransfers < 0:
+			return fmt.Errorf("line %d: registry %s: maxConcurrentTransfers must not be negative", entry.Line, registry.Host)
+		case registry.MaxIdleConns < 0:
+			return fmt.Errorf("line %d: registry %s: maxIdleConns must not be negative", entry.Line, registry.Host)
+		}
+		hosts[registry.Host] = entry.Line
+	}
+	return nil
+}
+
+// merge merges src into dst, both being the nodes of the given key, and returns the result.
+func merge(key string, dst, src *yaml.Node) *yaml.Node {
+	switch {
+	case dst.Kind == yaml.MappingNode && src.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(src.Content); i += 2 {
+			k, v := src.Content[i], src.Content[i+1]
+			if j := mappingIndex(dst, k.Value); j >= 0 {
+				dst.Content[j+1] = merge(join(key, k.Value), dst.Content[j+1], v)
+			} else {
+				dst.Content = append(dst.Content, k, v)
+			}
+		}
+		return dst
+	case key == "registries" && dst.Kind == yaml.SequenceNode && src.Kind == yaml.SequenceNode:
+		for _, entry := range src.Content {
+			host := registryHost(entry)
+			if j := registryIndex(dst, host); j >= 0 {
+				dst.Content[j] = merge(registryKey(host), dst.Content[j], entry)
+			} else {
+				dst.Content = append(dst.Content, entry)
+			}
+		}
+		return dst
+	default:
+		return src
+	}
+}
+
+// walk calls fn with the key and nodes of every value of the config, descending into mappings and
+// registry entries.
+func walk(key string, node *yaml.Node, fn func(key string, keyNode, valueNode *yaml.Node)) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		path := join(key, k.Value)
+		switch {
+		case v.Kind == yaml.MappingNode:
+			walk(path, v, fn)
+		case path == "registries" && v.Kind == yaml.SequenceNode:
+			for _, entry := range v.Content {
+				walk(registryKey(registryHost(entry)), entry, fn)
+			}
+		default:
+			fn(path, k, v)
+		}
+	}
+}
+
+func join(key, name string) string {
+	if key == "" {
+		return name
+	}
+	return key + "." + name
+}
+
+func registryKey(host string) string {
+	return fmt.Sprintf("registries[%s]", host)
+}
+
+func mappingIndex(node *yaml.Node, name string) int {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func mappingValue(node *yaml.Node, name string) *yaml.Node {
+	if i := mappingIndex(node, name); i >= 0 {
+		return node.Content[i+1]
+	}
+	return nil
+}
+
+func registryHost(entry *yaml.Node) string {
+	if host := mappingValue(entry, "host"); host != nil {
+		return host.Value
+	}
+	return ""
+}
+
+func registryIndex(node *yaml.Node, host string) int {
+	for i, entry := range node.Content {
+		if registryHost(entry) == host {
+			return i
+		}
+	}
+	return -1
+}
+
+// setFile records the file of the node and all its descendants.
+func setFile(files map[*yaml.Node]string, node *yaml.Node, file string) {
+	files[node] = file
+	for _, child := range node.Content {
+		setFile(files, child, file)
+	}
+}
+
+// copyNode deeply copies the node without its comments.
+func copyNode(node *yaml.Node) *yaml.Node {
+	res := *node
+	res.HeadComment, res.LineComment, res.FootComment = "", "", ""
+	res.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		res.Content[i] = copyNode(child)
+	}
+	return &res
+}
@@ -0,0 +1,136 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onmetal/onmetal-image/config"
+	"github.com/onmetal/onmetal-image/oci/remote"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	var dir string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	origin := func(c *Config, key string) Origin {
+		origin, ok := c.Origin(key)
+		Expect(ok).To(BeTrue(), "no origin for %s", key)
+		return origin
+	}
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		Expect(os.WriteFile(path, []byte(content), 0644)).To(Succeed())
+		return path
+	}
+
+	It("should merge the files in order", func() {
+		system := write("system.yaml", `store:
+  path: /var/lib/onmetal-image
+  maxSize: 200G
+defaultRegistry: harbor.example.com
+dockerConfigPaths:
+  - /etc/docker/config.json
+connectTimeout: 30s
+registries:
+  - host: harbor.example.com
+    maxConcurrentTransfers: 4
+    maxIdleConns: 8
+  - host: localhost:5000
+    shared: true
+`)
+		user := write("user.yaml", `store:
+  maxSize: 10G
+dockerConfigPaths:
+  - /home/user/.docker/config.json
+registries:
+  - host: harbor.example.com
+    maxConcurrentTransfers: 2
+  - host: ghcr.io
+    maxIdleConns: 1
+`)
+
+		c, err := Load(system, filepath.Join(dir, "missing.yaml"), user)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Store).To(Equal(Store{Path: "/var/lib/onmetal-image", MaxSize: "10G"}))
+		Expect(c.DefaultRegistry).To(Equal("harbor.example.com"))
+		Expect(c.DockerConfigPaths).To(Equal([]string{"/home/user/.docker/config.json"}))
+		Expect(time.Duration(c.ConnectTimeout)).To(Equal(30 * time.Second))
+		Expect(c.Registries).To(Equal([]Registry{
+			{Host: "harbor.example.com", HostSettings: remote.HostSettings{MaxConcurrentTransfers: 2, MaxIdleConns: 8}},
+			{Host: "localhost:5000", HostSettings: remote.HostSettings{Shared: true}},
+			{Host: "ghcr.io", HostSettings: remote.HostSettings{MaxIdleConns: 1}},
+		}))
+		Expect(c.HostsConfig().Settings("harbor.example.com")).To(Equal(remote.HostSettings{MaxConcurrentTransfers: 2, MaxIdleConns: 8}))
+
+		Expect(origin(c, "store.path")).To(Equal(Origin{File: system, Line: 2}))
+		Expect(origin(c, "store.maxSize")).To(Equal(Origin{File: user, Line: 2}))
+		Expect(origin(c, "registries[harbor.example.com].maxIdleConns")).To(Equal(Origin{File: system, Line: 11}))
+		Expect(origin(c, "registries[harbor.example.com].maxConcurrentTransfers")).To(Equal(Origin{File: user, Line: 7}))
+		_, ok := c.Origin("timeout")
+		Expect(ok).To(BeFalse())
+
+		var buf bytes.Buffer
+		Expect(c.Encode(&buf, true)).To(Succeed())
+		Expect(buf.String()).To(ContainSubstring("maxSize: 10G # from " + user + ":2\n"))
+		Expect(buf.String()).To(ContainSubstring("dockerConfigPaths: # from " + user + ":4\n"))
+		Expect(buf.String()).To(ContainSubstring("shared: true # from " + system + ":13\n"))
+	})
+
+	It("should let later files reset scalars to their zero value", func() {
+		system := write("system.yaml", "store:\n  noSync: true\n")
+		user := write("user.yaml", "store:\n  noSync: false\n")
+
+		c, err := Load(system, user)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Store.NoSync).To(BeFalse())
+		Expect(origin(c, "store.noSync")).To(Equal(Origin{File: user, Line: 2}))
+	})
+
+	It("should load no files to an empty config", func() {
+		c, err := Load(write("empty.yaml", ""))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Registries).To(BeEmpty())
+		Expect(c.HostsConfig()).To(BeNil())
+
+		var buf bytes.Buffer
+		Expect(c.Encode(&buf, true)).To(Succeed())
+		Expect(buf.String()).To(Equal("{}\n"))
+	})
+
+	DescribeTable("should name file and line of invalid values",
+		func(content, message string) {
+			path := write("config.yaml", content)
+			_, err := Load(path)
+			Expect(err).To(MatchError(ContainSubstring(path)))
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("unknown field", "store:\n  pth: /tmp\n", "line 2: field pth not found"),
+		Entry("invalid duration", "timeout: 10m\nconnectTimeout: soon\n", "line 2: invalid duration"),
+		Entry("invalid max size", "store:\n  maxSize: huge\n", "line 2: invalid store max size"),
+		Entry("missing host", "registries:\n  - maxIdleConns: 1\n", "line 2: registry has no host"),
+		Entry("duplicate host", "registries:\n  - host: a\n  - host: a\n", "line 3: registry a is already configured at line 2"),
+		Entry("negative limit", "registries:\n  - host: a\n    maxIdleConns: -1\n", "line 2: registry a: maxIdleConns must not be negative"),
+	)
+})
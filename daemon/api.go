@@ -0,0 +1,365 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The messages of daemon.proto. Keep the field numbers in sync with it.
+
+type descriptorMessage struct {
+	mediaType    string
+	digest       string
+	size         int64
+	annotations  map[string]string
+	artifactType string
+}
+
+func newDescriptorMessage(desc ocispec.Descriptor) *descriptorMessage {
+	return &descriptorMessage{
+		mediaType:    desc.MediaType,
+		digest:       desc.Digest.String(),
+		size:         desc.Size,
+		annotations:  desc.Annotations,
+		artifactType: desc.ArtifactType,
+	}
+}
+
+func (m *descriptorMessage) descriptor() ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType:    m.mediaType,
+		Digest:       digest.Digest(m.digest),
+		Size:         m.size,
+		Annotations:  m.annotations,
+		ArtifactType: m.artifactType,
+	}
+}
+
+func (m *descriptorMessage) marshal(e *encoder) {
+	e.string(1, m.mediaType)
+	e.string(2, m.digest)
+	e.int64(3, m.size)
+	e.stringMap(4, m.annotations)
+	e.string(5, m.artifactType)
+}
+
+func (m *descriptorMessage) unmarshal(d *decoder) error {
+	return d.each(func(f field) error {
+		switch f.num {
+		case 1:
+			m.mediaType = f.string()
+		case 2:
+			m.digest = f.string()
+		case 3:
+			m.size = f.int64()
+		case 4:
+			if m.annotations == nil {
+				m.annotations = make(map[string]string)
+			}
+			return f.mapEntry(m.annotations)
+		case 5:
+			m.artifactType = f.string()
+		}
+		return nil
+	})
+}
+
+type pullRequest struct {
+	ref                   string
+	metadataOnly          bool
+	allowUnknownSize      bool
+	noPreflightSpaceCheck bool
+}
+
+func (m *pullRequest) marshal(e *encoder) {
+	e.string(1, m.ref)
+	e.bool(2, m.metadataOnly)
+	e.bool(3, m.allowUnknownSize)
+	e.bool(4, m.noPreflightSpaceCheck)
+}
+
+func (m *pullRequest) unmarshal(d *decoder) error {
+	return d.each(func(f field) error {
+		switch f.num {
+		case 1:
+			m.ref = f.string()
+		case 2:
+			m.metadataOnly = f.bool()
+		case 3:
+			m.allowUnknownSize = f.bool()
+		case 4:
+			m.noPreflightSpaceCheck = f.bool()
+		}
+		return nil
+	})
+}
+
+type pullResponse struct {
+	event  []byte
+	digest string
+}
+
+func (m *pullResponse) marshal(e *encoder) {
+	e.bytes(1, m.event)
+	e.string(2, m.digest)
+}
+
+func (m *pullResponse) unmarshal(d *decoder) error {
+	return d.each(func(f field) error {
+		switch f.num {
+		case 1:
+			m.event = f.bytes
+		case 2:
+			m.digest = f.string()
+		}
+		return nil
+	})
+}
+
+type listRequest struct {
+	annotations map[string]string
+	limit       int64
+}
+
+func (m *listRequest) marshal(e *encoder) {
+	e.stringMap(1, m.annotations)
+	e.int64(2, m.limit)
+}
+
+func (m *listRequest) unmarshal(d *decoder) error {
+	return d.each(func(f field) error {
+		switch f.num {
+		case 1:
+			if m.annotations == nil {
+				m.annotations = make(map[string]string)
+			}
+			return f.mapEntry(m.annotations)
+		case 2:
+			m.limit = f.int64()
+		}
+		return nil
+	})
+}
+
+type listResponse struct {
+	images []*imageMessage
+}
+
+func (m *listResponse) marshal(e *encoder) {
+	for _, img := range m.images {
+		e.message(1, img)
+	}
+}
+
+func (m *listResponse) unmarshal(d *decoder) error {
+	return d.each(func(f field) error {
+		if f.num == 1 {
+			img := &imageMessage{}
+			if err := f.message(img); err != nil {
+				return err
+			}
+			m.images = append(m.images, img)
+		}
+		return nil
+	})
+}
+
+type imageMessage struct {
+	descriptor         *descriptorMessage
+	artifactType       string
+	created            int64
+	createdApproximate bool
+	expiresAt          int64
+}
+
+func (m *imageMessage) marshal(e *encoder) {
+	if m.descriptor != nil {
+		e.message(1, m.descriptor)
+	}
+	e.string(2, m.artifactType)
+	e.int64(3, m.created)
+	e.bool(4, m.createdApproximate)
+	e.int64(5, m.expiresAt)
+}
+
+func (m *imageMessage) unmarshal(d *decoder) error {
+	return d.each(func(f field) error {
+		switch f.num {
+		case 1:
+			m.descriptor = &descriptorMessage{}
+			return f.message(m.descriptor)
+		case 2:
+			m.artifactType = f.string()
+		case 3:
+			m.created = f.int64()
+		case 4:
+			m.createdApproximate = f.bool()
+		case 5:
+			m.expiresAt = f.int64()
+		}
+		return nil
+	})
+}
+
+// refRequest is the InspectRequest and PinRequest, which only consist of the reference.
+type refRequest struct {
+	ref string
+}
+
+func (m *refRequest) marshal(e *encoder) {
+	e.string(1, m.ref)
+}
+
+func (m *refRequest) unmarshal(d *decoder) error {
+	return d.each(func(f field) error {
+		if f.num == 1 {
+			m.ref = f.string()
+		}
+		return nil
+	})
+}
+
+type inspectResponse struct {
+	descriptor *descriptorMessage
+	manifest   []byte
+	config     []byte
+	roles      []string
+}
+
+func (m *inspectResponse) marshal(e *encoder) {
+	if m.descriptor != nil {
+		e.message(1, m.descriptor)
+	}
+	e.bytes(2, m.manifest)
+	e.bytes(3, m.config)
+	for _, role := range m.roles {
+		e.string(4, role)
+	}
+}
+
+func (m *inspectResponse) unmarshal(d *decoder) error {
+	return d.each(func(f field) error {
+		switch f.num {
+		case 1:
+			m.descriptor = &descriptorMessage{}
+			return f.message(m.descriptor)
+		case 2:
+			m.manifest = f.bytes
+		case 3:
+			m.config = f.bytes
+		case 4:
+			m.roles = append(m.roles, f.string())
+		}
+		return nil
+	})
+}
+
+type extractRequest struct {
+	ref          string
+	path         string
+	numericIDs   bool
+	whiteoutMode string
+	strict       bool
+}
+
+func (m *extractRequest) marshal(e *encoder) {
+	e.string(1, m.ref)
+	e.string(2, m.path)
+	e.bool(3, m.numericIDs)
+	e.string(4, m.whiteoutMode)
+	e.bool(5, m.strict)
+}
+
+func (m *extractRequest) unmarshal(d *decoder) error {
+	return d.each(func(f field) error {
+		switch f.num {
+		case 1:
+			m.ref = f.string()
+		case 2:
+			m.path = f.string()
+		case 3:
+			m.numericIDs = f.bool()
+		case 4:
+			m.whiteoutMode = f.string()
+		case 5:
+			m.strict = f.bool()
+		}
+		return nil
+	})
+}
+
+// empty is the ExtractResponse, PinResponse and PruneRequest, which have no fields.
+type empty struct{}
+
+func (*empty) marshal(*encoder) {}
+
+func (*empty) unmarshal(d *decoder) error {
+	return d.each(func(field) error { return nil })
+}
+
+type pruneResponse struct {
+	results []*pruneResult
+}
+
+func (m *pruneResponse) marshal(e *encoder) {
+	for _, result := range m.results {
+		e.message(1, result)
+	}
+}
+
+func (m *pruneResponse) unmarshal(d *decoder) error {
+	return d.each(func(f field) error {
+		if f.num == 1 {
+			result := &pruneResult{}
+			if err := f.message(result); err != nil {
+				return err
+			}
+			m.results = append(m.results, result)
+		}
+		return nil
+	})
+}
+
+type pruneResult struct {
+	name   string
+	digest string
+	bytes  int64
+	err    string
+}
+
+func (m *pruneResult) marshal(e *encoder) {
+	e.string(1, m.name)
+	e.string(2, m.digest)
+	e.int64(3, m.bytes)
+	e.string(4, m.err)
+}
+
+func (m *pruneResult) unmarshal(d *decoder) error {
+	return d.each(func(f field) error {
+		switch f.num {
+		case 1:
+			m.name = f.string()
+		case 2:
+			m.digest = f.string()
+		case 3:
+			m.bytes = f.int64()
+		case 4:
+			m.err = f.string()
+		}
+		return nil
+	})
+}
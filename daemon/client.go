@@ -0,0 +1,347 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/batch"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/onmetal/onmetal-image/unpack"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// SocketPath returns the path of the unix socket of a daemon address, either a path or a unix:// URL.
+func SocketPath(address string) (string, error) {
+	if path, ok := strings.CutPrefix(address, "unix://"); ok {
+		address = path
+	} else if strings.Contains(address, "://") {
+		return "", fmt.Errorf("unsupported daemon address %s, expected a unix socket", address)
+	}
+	if address == "" {
+		return "", fmt.Errorf("empty daemon socket path")
+	}
+	return address, nil
+}
+
+// Error is an error returned by the daemon. It matches the errdefs error of its code, so e.g.
+// errdefs.IsNotFound reports images missing from the store of the daemon.
+type Error struct {
+	Code    codes.Code
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Is(target error) bool {
+	switch e.Code {
+	case codes.NotFound:
+		return target == errdefs.ErrNotFound
+	case codes.InvalidArgument:
+		return target == errdefs.ErrInvalidArgument
+	case codes.AlreadyExists:
+		return target == errdefs.ErrAlreadyExists
+	case codes.FailedPrecondition:
+		return target == errdefs.ErrFailedPrecondition
+	case codes.Canceled:
+		return target == context.Canceled
+	case codes.DeadlineExceeded:
+		return target == context.DeadlineExceeded
+	default:
+		return false
+	}
+}
+
+// clientError converts a gRPC status returned by a call to an *Error.
+func clientError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	return &Error{Code: st.Code(), Message: st.Message()}
+}
+
+// Client is a client of the daemon API.
+type Client struct {
+	conn *grpc.ClientConn
+}
+
+// Dial creates a client of the daemon listening at address, either a socket path or a unix:// URL. The
+// connection is established lazily, calls fail if no daemon is listening.
+func Dial(address string) (*Client, error) {
+	path, err := SocketPath(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.Dial("unix://"+path,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing daemon at %s: %w", path, err)
+	}
+	return &Client{conn: conn}, nil
+}
+
+// Close closes the connection to the daemon.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) invoke(ctx context.Context, method string, req, res message) error {
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/"+method, req, res); err != nil {
+		return clientError(err)
+	}
+	return nil
+}
+
+// PullOption is an option of Client.Pull.
+type PullOption func(req *pullRequest)
+
+// WithMetadataOnly only pulls the manifest and config, see client.WithMetadataOnly.
+func WithMetadataOnly() PullOption {
+	return func(req *pullRequest) {
+		req.metadataOnly = true
+	}
+}
+
+// WithAllowUnknownSize pulls legacy images without size information, see client.WithAllowUnknownSize.
+func WithAllowUnknownSize() PullOption {
+	return func(req *pullRequest) {
+		req.allowUnknownSize = true
+	}
+}
+
+// WithoutPreflightSpaceCheck skips checking for free disk space, see client.WithoutPreflightSpaceCheck.
+func WithoutPreflightSpaceCheck() PullOption {
+	return func(req *pullRequest) {
+		req.noPreflightSpaceCheck = true
+	}
+}
+
+var pullStreamDesc = &grpc.StreamDesc{StreamName: "Pull", ServerStreams: true}
+
+// Pull pulls the image with the given reference into the store of the daemon and returns its digest. The
+// progress events of the pull are reported to the progress reporter of the context.
+func (c *Client) Pull(ctx context.Context, ref string, opts ...PullOption) (digest.Digest, error) {
+	req := &pullRequest{ref: ref}
+	for _, opt := range opts {
+		opt(req)
+	}
+
+	stream, err := c.conn.NewStream(ctx, pullStreamDesc, "/"+serviceName+"/Pull")
+	if err != nil {
+		return "", clientError(err)
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return "", clientError(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return "", clientError(err)
+	}
+
+	reporter := progress.FromContext(ctx)
+	for {
+		res := &pullResponse{}
+		if err := stream.RecvMsg(res); err != nil {
+			if errors.Is(err, io.EOF) {
+				return "", fmt.Errorf("daemon did not report the digest of %s", ref)
+			}
+			return "", clientError(err)
+		}
+		if len(res.event) > 0 {
+			if event, err := progress.Unmarshal(res.event); err == nil {
+				reporter.Report(event)
+			}
+		}
+		if res.digest != "" {
+			return digest.Parse(res.digest)
+		}
+	}
+}
+
+// Image is an image of the store of the daemon, as listed by Client.List.
+type Image struct {
+	// Descriptor is the index entry of the image.
+	Descriptor ocispec.Descriptor
+	// ArtifactType is the artifact type of the manifest, if the image is an artifact.
+	ArtifactType string
+	// Created is when the image was created, see layout.Layout.CreatedAt. It is nil if unknown.
+	Created *layout.CreatedAt
+	// ExpiresAt is when the image expires, zero if it does not.
+	ExpiresAt time.Time
+}
+
+// ListOption is an option of Client.List.
+type ListOption func(req *listRequest)
+
+// WithAnnotation only lists images whose index entry has the annotation with the given value.
+func WithAnnotation(key, value string) ListOption {
+	return func(req *listRequest) {
+		if req.annotations == nil {
+			req.annotations = make(map[string]string)
+		}
+		req.annotations[key] = value
+	}
+}
+
+// WithLimit limits the number of listed images if positive.
+func WithLimit(limit int) ListOption {
+	return func(req *listRequest) {
+		req.limit = int64(limit)
+	}
+}
+
+// List lists the images of the store of the daemon, most recently added first.
+func (c *Client) List(ctx context.Context, opts ...ListOption) ([]Image, error) {
+	req := &listRequest{}
+	for _, opt := range opts {
+		opt(req)
+	}
+	res := &listResponse{}
+	if err := c.invoke(ctx, "List", req, res); err != nil {
+		return nil, err
+	}
+
+	imgs := make([]Image, 0, len(res.images))
+	for _, msg := range res.images {
+		img := Image{ArtifactType: msg.artifactType}
+		if msg.descriptor != nil {
+			img.Descriptor = msg.descriptor.descriptor()
+		}
+		if msg.created != 0 {
+			img.Created = &layout.CreatedAt{Time: time.Unix(0, msg.created), Approximate: msg.createdApproximate}
+		}
+		if msg.expiresAt != 0 {
+			img.ExpiresAt = time.Unix(0, msg.expiresAt)
+		}
+		imgs = append(imgs, img)
+	}
+	return imgs, nil
+}
+
+// InspectResult is an image of the store of the daemon, as inspected by Client.Inspect.
+type InspectResult struct {
+	// Descriptor is the index entry of the image.
+	Descriptor ocispec.Descriptor
+	Manifest   ocispec.Manifest
+	// Config is the onmetal image config. It is nil for artifacts and partial images.
+	Config *onmetalimage.Config
+	// Roles are the roles of the layers in manifest order, see onmetalimage.AvailableRoles.
+	Roles []string
+}
+
+// Inspect returns the manifest and config of the image of the store of the daemon with the given
+// reference or (abbreviated) image id.
+func (c *Client) Inspect(ctx context.Context, ref string) (*InspectResult, error) {
+	res := &inspectResponse{}
+	if err := c.invoke(ctx, "Inspect", &refRequest{ref: ref}, res); err != nil {
+		return nil, err
+	}
+
+	result := &InspectResult{Roles: res.roles}
+	if res.descriptor != nil {
+		result.Descriptor = res.descriptor.descriptor()
+	}
+	if err := json.Unmarshal(res.manifest, &result.Manifest); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %w", err)
+	}
+	if len(res.config) > 0 {
+		result.Config = &onmetalimage.Config{}
+		if err := json.Unmarshal(res.config, result.Config); err != nil {
+			return nil, fmt.Errorf("error decoding config: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// ExtractOption is an option of Client.Extract.
+type ExtractOption func(req *extractRequest)
+
+// WithNumericIDs uses the numeric ids of the archive, see unpack.WithNumericIDs.
+func WithNumericIDs() ExtractOption {
+	return func(req *extractRequest) {
+		req.numericIDs = true
+	}
+}
+
+// WithWhiteoutMode sets how whiteouts are handled, see unpack.WithWhiteoutMode.
+func WithWhiteoutMode(mode unpack.WhiteoutMode) ExtractOption {
+	return func(req *extractRequest) {
+		req.whiteoutMode = string(mode)
+	}
+}
+
+// WithStrict fails instead of skipping operations that require root, see unpack.WithStrict.
+func WithStrict() ExtractOption {
+	return func(req *extractRequest) {
+		req.strict = true
+	}
+}
+
+// Extract unpacks the tar rootfs layer of the image of the store of the daemon onto the directory at the
+// absolute path dir, which is resolved on the host of the daemon. See client.Client.Extract.
+func (c *Client) Extract(ctx context.Context, ref, dir string, opts ...ExtractOption) error {
+	req := &extractRequest{ref: ref, path: dir}
+	for _, opt := range opts {
+		opt(req)
+	}
+	return c.invoke(ctx, "Extract", req, &empty{})
+}
+
+// Pin exempts the image with the given reference or (abbreviated) image id from eviction, see
+// layout.PinnedAnnotation.
+func (c *Client) Pin(ctx context.Context, ref string) error {
+	return c.invoke(ctx, "Pin", &refRequest{ref: ref}, &empty{})
+}
+
+// Unpin makes the pinned image with the given reference or (abbreviated) image id evictable again.
+func (c *Client) Unpin(ctx context.Context, ref string) error {
+	return c.invoke(ctx, "Unpin", &refRequest{ref: ref}, &empty{})
+}
+
+// Prune removes the expired images of the store of the daemon, see layout.Layout.PruneExpired.
+func (c *Client) Prune(ctx context.Context) ([]batch.Result, error) {
+	res := &pruneResponse{}
+	if err := c.invoke(ctx, "Prune", &empty{}, res); err != nil {
+		return nil, err
+	}
+
+	results := make([]batch.Result, 0, len(res.results))
+	for _, msg := range res.results {
+		result := batch.Result{Name: msg.name, Digest: digest.Digest(msg.digest), Bytes: msg.bytes}
+		if msg.err != "" {
+			result.Err = errors.New(msg.err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/client"
+	. "github.com/onmetal/onmetal-image/daemon"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	"github.com/onmetal/onmetal-image/testing/registryharness"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Daemon", func() {
+	var (
+		ctx     context.Context
+		harness *registryharness.Registry
+		local   *client.Client
+		c       *Client
+	)
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		harness = registryharness.New()
+		DeferCleanup(harness.Close)
+
+		configPath := filepath.Join(GinkgoT().TempDir(), "config.json")
+		Expect(os.WriteFile(configPath, []byte("{}"), 0666)).To(Succeed())
+		var err error
+		local, err = client.New(client.Config{
+			StorePath:         GinkgoT().TempDir(),
+			DockerConfigPaths: []string{configPath},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		socket := filepath.Join(GinkgoT().TempDir(), "daemon.sock")
+		served := make(chan error, 1)
+		go func() {
+			defer GinkgoRecover()
+			served <- NewServer(local).Serve(ctx, socket)
+		}()
+		DeferCleanup(func() {
+			cancel()
+			Eventually(served).Should(Receive(BeNil()))
+		})
+		Eventually(func() error {
+			_, err := os.Stat(socket)
+			return err
+		}).Should(Succeed())
+
+		c, err = Dial("unix://" + socket)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(c.Close)
+	})
+
+	// newImage builds a bootable image whose rootfs is a tar archive with the single file dir-0/file-0,
+	// see fixtures.TarContent.
+	newImage := func() ociimage.Image {
+		rootFS, err := fixtures.TarContent("daemon", 5, 1)
+		Expect(err).NotTo(HaveOccurred())
+		img, err := fixtures.Image{
+			Seed:   "daemon",
+			Config: onmetalimage.Config{CommandLine: "root=/dev/sda1"},
+			Layers: []fixtures.Layer{
+				{Role: "kernel", Size: 1 << 10},
+				{Role: "initramfs", Size: 1 << 10},
+				{Role: "rootfs", Content: rootFS},
+			},
+		}.Build()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	It("should pull, list, inspect, pin, extract and prune images of the store of the daemon", func() {
+		img := newImage()
+		Expect(harness.Seed(ctx, "repo", "latest", img)).To(Succeed())
+		ref := harness.Reference("repo", "latest")
+
+		By("pulling the image, streaming the progress")
+		var (
+			mu     sync.Mutex
+			events []progress.EventType
+		)
+		pullCtx := progress.NewContext(ctx, progress.ReporterFunc(func(event progress.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, event.Type())
+		}))
+		dgst, err := c.Pull(pullCtx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dgst).To(Equal(img.Descriptor().Digest))
+		Expect(events).To(ContainElement(progress.EventTypeBlobDone))
+		Expect(events[len(events)-1]).To(Equal(progress.EventTypeSummary))
+
+		By("listing it")
+		imgs, err := c.List(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imgs).NotTo(BeEmpty())
+		for _, img := range imgs {
+			Expect(img.Descriptor.Digest).To(Equal(dgst))
+			Expect(img.Created).NotTo(BeNil())
+		}
+		Expect(c.List(ctx, WithAnnotation("unknown", "value"))).To(BeEmpty())
+
+		By("inspecting it")
+		res, err := c.Inspect(ctx, dgst.Encoded()[:12])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Descriptor.Digest).To(Equal(dgst))
+		Expect(res.Manifest.Layers).To(HaveLen(3))
+		Expect(res.Roles).To(Equal([]string{"kernel", "initramfs", "rootfs"}))
+		Expect(res.Config).NotTo(BeNil())
+		Expect(res.Config.CommandLine).To(Equal("root=/dev/sda1"))
+
+		By("pinning and unpinning it")
+		Expect(c.Pin(ctx, ref)).To(Succeed())
+		desc, err := local.Store().Descriptor(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layout.IsPinned(desc)).To(BeTrue())
+		Expect(c.Unpin(ctx, ref)).To(Succeed())
+		desc, err = local.Store().Descriptor(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layout.IsPinned(desc)).To(BeFalse())
+
+		By("extracting its rootfs")
+		dir := GinkgoT().TempDir()
+		Expect(c.Extract(ctx, ref, dir)).To(Succeed())
+		Expect(os.ReadFile(filepath.Join(dir, "dir-0", "file-0"))).To(Equal(fixtures.Content("daemon/dir-0/file-0", 5)))
+		Expect(errdefs.IsInvalidArgument(c.Extract(ctx, ref, "relative"))).To(BeTrue())
+
+		By("pruning the store, which has no expired images")
+		results, err := c.Prune(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(BeEmpty())
+	})
+
+	It("should report images missing from the store as not found", func() {
+		_, err := c.Inspect(ctx, "example.org/unknown:latest")
+		Expect(errdefs.IsNotFound(err)).To(BeTrue(), "%v", err)
+
+		_, err = c.Pull(ctx, harness.Reference("unknown", "latest"))
+		Expect(errdefs.IsNotFound(err)).To(BeTrue(), "%v", err)
+	})
+})
@@ -0,0 +1,354 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/go-logr/logr"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/client"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/onmetal/onmetal-image/unpack"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultSocket is the default path of the daemon socket.
+const DefaultSocket = "/run/onmetal-image.sock"
+
+// Server serves the daemon API (see daemon.proto) for the store of a client.
+type Server struct {
+	client *client.Client
+	server *grpc.Server
+	log    logr.Logger
+}
+
+// NewServer creates a new Server performing the operations with the given client.
+func NewServer(c *client.Client) *Server {
+	s := &Server{
+		client: c,
+		server: grpc.NewServer(grpc.ForceServerCodec(codec{})),
+	}
+	s.server.RegisterService(&serviceDesc, s)
+	return s
+}
+
+// Serve serves the daemon API on the unix socket at path until ctx is done, replacing a stale socket left
+// behind there. Operations in flight are canceled once ctx is done. Failed operations are logged to the
+// logger of ctx.
+func (s *Server) Serve(ctx context.Context, path string) error {
+	s.log = logr.FromContextOrDiscard(ctx)
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("daemon socket path %s exists and is no socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("error removing stale daemon socket: %w", err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("error listening on daemon socket: %w", err)
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		_ = l.Close()
+		return fmt.Errorf("error setting daemon socket permissions: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		s.server.Stop()
+	}()
+	if err := s.server.Serve(l); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return fmt.Errorf("error serving daemon api: %w", err)
+	}
+	return nil
+}
+
+// handlers are the handlers of the Daemon service. The service description requires an interface type.
+type handlers interface {
+	pull(req *pullRequest, stream grpc.ServerStream) error
+	list(ctx context.Context, req *listRequest) (*listResponse, error)
+	inspect(ctx context.Context, req *refRequest) (*inspectResponse, error)
+	extract(ctx context.Context, req *extractRequest) (*empty, error)
+	pin(ctx context.Context, req *refRequest) (*empty, error)
+	unpin(ctx context.Context, req *refRequest) (*empty, error)
+	prune(ctx context.Context, req *empty) (*pruneResponse, error)
+}
+
+const serviceName = "onmetal.image.daemon.v1.Daemon"
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*handlers)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryMethod("List", handlers.list),
+		unaryMethod("Inspect", handlers.inspect),
+		unaryMethod("Extract", handlers.extract),
+		unaryMethod("Pin", handlers.pin),
+		unaryMethod("Unpin", handlers.unpin),
+		unaryMethod("Prune", handlers.prune),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Pull",
+			ServerStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				req := &pullRequest{}
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(handlers).pull(req, stream)
+			},
+		},
+	},
+	Metadata: "daemon.proto",
+}
+
+// unaryMethod describes the unary method with the given name, decoding its request and encoding errors
+// returned by handle as gRPC statuses.
+func unaryMethod[Req any, PReq interface {
+	*Req
+	message
+}, Res message](name string, handle func(h handlers, ctx context.Context, req PReq) (Res, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := PReq(new(Req))
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			call := func(ctx context.Context, req any) (any, error) {
+				res, err := handle(srv.(handlers), ctx, req.(PReq))
+				if err != nil {
+					return nil, statusError(err)
+				}
+				return res, nil
+			}
+			if interceptor == nil {
+				return call(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/" + name}, call)
+		},
+	}
+}
+
+// statusError converts err to a gRPC status, keeping the error classes of errdefs, see Error.
+func statusError(err error) error {
+	code := codes.Unknown
+	switch {
+	case errdefs.IsNotFound(err), errors.Is(err, indexer.ErrNotFound):
+		code = codes.NotFound
+	case errdefs.IsInvalidArgument(err):
+		code = codes.InvalidArgument
+	case errdefs.IsAlreadyExists(err):
+		code = codes.AlreadyExists
+	case errdefs.IsFailedPrecondition(err):
+		code = codes.FailedPrecondition
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, err.Error())
+}
+
+func (s *Server) pull(req *pullRequest, stream grpc.ServerStream) error {
+	var (
+		mu      sync.Mutex
+		sendErr error
+	)
+	ctx := progress.NewContext(stream.Context(), progress.ReporterFunc(func(event progress.Event) {
+		data, err := progress.Marshal(event)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		// Keep pulling if the client stopped receiving, it is canceled with the stream anyway.
+		if sendErr == nil {
+			sendErr = stream.SendMsg(&pullResponse{event: data})
+		}
+	}))
+
+	var opts []client.PullOption
+	if req.metadataOnly {
+		opts = append(opts, client.WithMetadataOnly())
+	}
+	if req.allowUnknownSize {
+		opts = append(opts, client.WithAllowUnknownSize())
+	}
+	if req.noPreflightSpaceCheck {
+		opts = append(opts, client.WithoutPreflightSpaceCheck())
+	}
+	img, err := s.client.Pull(ctx, req.ref, opts...)
+	if err != nil {
+		s.log.Error(err, "Error pulling image", "Ref", req.ref)
+		return statusError(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return stream.SendMsg(&pullResponse{digest: img.Descriptor().Digest.String()})
+}
+
+func (s *Server) list(ctx context.Context, req *listRequest) (*listResponse, error) {
+	matchers := make([]descriptormatcher.Matcher, 0, len(req.annotations))
+	for key, value := range req.annotations {
+		matchers = append(matchers, descriptormatcher.Annotation(key, value))
+	}
+	descs, err := s.client.List(ctx, descriptormatcher.And(matchers...), indexer.WithLimit(int(req.limit)))
+	if err != nil {
+		return nil, err
+	}
+
+	l := s.client.Store().Layout()
+	res := &listResponse{images: make([]*imageMessage, 0, len(descs))}
+	for _, desc := range descs {
+		img := &imageMessage{descriptor: newDescriptorMessage(desc)}
+		if created, ok := l.CreatedAt(ctx, desc); ok {
+			img.created = created.Time.UnixNano()
+			img.createdApproximate = created.Approximate
+		}
+		// Read the manifest directly from the content store to not count listing as an access.
+		if manifest, err := ocicontent.Image(l.Store(), desc).Manifest(ctx); err == nil {
+			if imageutil.IsArtifact(manifest) {
+				img.artifactType = manifest.ArtifactType
+			}
+			if expiresAt, ok := imageutil.ExpiresAt(manifest); ok {
+				img.expiresAt = expiresAt.UnixNano()
+			}
+		}
+		res.images = append(res.images, img)
+	}
+	return res, nil
+}
+
+func (s *Server) inspect(ctx context.Context, req *refRequest) (*inspectResponse, error) {
+	img, err := s.client.Resolve(ctx, req.ref)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading image manifest: %w", err)
+	}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding image manifest: %w", err)
+	}
+
+	res := &inspectResponse{
+		descriptor: newDescriptorMessage(img.Descriptor()),
+		manifest:   manifestData,
+		roles:      onmetalimage.AvailableRoles(manifest.Layers),
+	}
+	if imageutil.IsArtifact(manifest) || layout.IsPartial(img.Descriptor()) {
+		return res, nil
+	}
+	config, err := onmetalimage.ReadConfig(ctx, img)
+	if err != nil {
+		return nil, fmt.Errorf("error reading image config: %w", err)
+	}
+	if res.config, err = json.Marshal(config); err != nil {
+		return nil, fmt.Errorf("error encoding image config: %w", err)
+	}
+	return res, nil
+}
+
+func (s *Server) extract(ctx context.Context, req *extractRequest) (*empty, error) {
+	if !filepath.IsAbs(req.path) {
+		return nil, fmt.Errorf("extract path %s is not absolute: %w", req.path, errdefs.ErrInvalidArgument)
+	}
+	fi, err := os.Stat(req.path)
+	if err != nil {
+		return nil, fmt.Errorf("error checking target: %w", err)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("target %s is no directory: %w", req.path, errdefs.ErrInvalidArgument)
+	}
+
+	var opts []unpack.Option
+	if req.numericIDs {
+		opts = append(opts, unpack.WithNumericIDs())
+	}
+	if req.whiteoutMode != "" {
+		opts = append(opts, unpack.WithWhiteoutMode(unpack.WhiteoutMode(req.whiteoutMode)))
+	}
+	if req.strict {
+		opts = append(opts, unpack.WithStrict())
+	}
+	if err := s.client.Extract(ctx, req.ref, req.path, opts...); err != nil {
+		return nil, err
+	}
+	return &empty{}, nil
+}
+
+func (s *Server) pin(ctx context.Context, req *refRequest) (*empty, error) {
+	return s.annotate(ctx, req.ref, map[string]string{layout.PinnedAnnotation: "true"}, nil)
+}
+
+func (s *Server) unpin(ctx context.Context, req *refRequest) (*empty, error) {
+	return s.annotate(ctx, req.ref, nil, []string{layout.PinnedAnnotation})
+}
+
+func (s *Server) annotate(ctx context.Context, ref string, set map[string]string, remove []string) (*empty, error) {
+	resolved, err := s.client.ResolveRef(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.client.Store().Annotate(ctx, resolved, set, remove); err != nil {
+		return nil, err
+	}
+	return &empty{}, nil
+}
+
+func (s *Server) prune(ctx context.Context, _ *empty) (*pruneResponse, error) {
+	l := s.client.Store().Layout()
+	results, err := l.PruneExpired(ctx, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("error pruning expired images: %w", err)
+	}
+	// Failing to compact does not fail the prune, as for the prune command.
+	if _, err := l.Compact(ctx); err != nil {
+		s.log.Error(err, "Error compacting index")
+	}
+
+	res := &pruneResponse{results: make([]*pruneResult, 0, len(results))}
+	for _, result := range results {
+		r := &pruneResult{name: result.Name, digest: result.Digest.String(), bytes: result.Bytes}
+		if result.Err != nil {
+			r.err = result.Err.Error()
+		}
+		res.results = append(res.results, r)
+	}
+	return res, nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// message is a message of daemon.proto. The messages are encoded by hand in the protobuf wire format, so
+// building the module does not need protoc while clients generated from daemon.proto interoperate.
+type message interface {
+	marshal(e *encoder)
+	unmarshal(d *decoder) error
+}
+
+// codec marshals the messages of daemon.proto. It is forced on the server and the client connections
+// instead of replacing the global proto codec, which other gRPC users of the process (e.g. the containerd
+// client) rely on.
+type codec struct{}
+
+// Name returns the name of the proto codec, so the content subtype on the wire is the standard one.
+func (codec) Name() string { return "proto" }
+
+func (codec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(message)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T: no daemon message", v)
+	}
+	e := &encoder{}
+	m.marshal(e)
+	return e.buf, nil
+}
+
+func (codec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(message)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal %T: no daemon message", v)
+	}
+	// Decoded byte fields alias the buffer, which gRPC may reuse once the message is decoded.
+	return m.unmarshal(&decoder{buf: append([]byte(nil), data...)})
+}
+
+// encoder appends fields in the protobuf wire format. Fields with zero values are omitted as in proto3.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) string(num protowire.Number, v string) {
+	if v == "" {
+		return
+	}
+	e.buf = protowire.AppendTag(e.buf, num, protowire.BytesType)
+	e.buf = protowire.AppendString(e.buf, v)
+}
+
+func (e *encoder) bytes(num protowire.Number, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	e.buf = protowire.AppendTag(e.buf, num, protowire.BytesType)
+	e.buf = protowire.AppendBytes(e.buf, v)
+}
+
+func (e *encoder) int64(num protowire.Number, v int64) {
+	if v == 0 {
+		return
+	}
+	e.buf = protowire.AppendTag(e.buf, num, protowire.VarintType)
+	e.buf = protowire.AppendVarint(e.buf, uint64(v))
+}
+
+func (e *encoder) bool(num protowire.Number, v bool) {
+	if !v {
+		return
+	}
+	e.buf = protowire.AppendTag(e.buf, num, protowire.VarintType)
+	e.buf = protowire.AppendVarint(e.buf, protowire.EncodeBool(v))
+}
+
+// message appends the embedded message. Unlike scalars, it is always appended, as it may be an element
+// of a repeated field.
+func (e *encoder) message(num protowire.Number, m message) {
+	inner := &encoder{}
+	m.marshal(inner)
+	e.buf = protowire.AppendTag(e.buf, num, protowire.BytesType)
+	e.buf = protowire.AppendBytes(e.buf, inner.buf)
+}
+
+// stringMap appends a map<string, string> field, sorted by key for a deterministic encoding.
+func (e *encoder) stringMap(num protowire.Number, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entry := &encoder{}
+		entry.string(1, key)
+		entry.string(2, m[key])
+		e.buf = protowire.AppendTag(e.buf, num, protowire.BytesType)
+		e.buf = protowire.AppendBytes(e.buf, entry.buf)
+	}
+}
+
+// decoder consumes fields in the protobuf wire format.
+type decoder struct {
+	buf []byte
+}
+
+// field is a decoded field. Only one of varint and bytes is set, depending on its wire type.
+type field struct {
+	num    protowire.Number
+	varint uint64
+	bytes  []byte
+}
+
+func (f field) string() string { return string(f.bytes) }
+func (f field) int64() int64   { return int64(f.varint) }
+func (f field) bool() bool     { return protowire.DecodeBool(f.varint) }
+
+func (f field) message(m message) error {
+	return m.unmarshal(&decoder{buf: f.bytes})
+}
+
+// mapEntry decodes an entry of a map<string, string> field into m.
+func (f field) mapEntry(m map[string]string) error {
+	var key, value string
+	if err := (&decoder{buf: f.bytes}).each(func(f field) error {
+		switch f.num {
+		case 1:
+			key = f.string()
+		case 2:
+			value = f.string()
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	m[key] = value
+	return nil
+}
+
+// each calls fn for all varint and length-delimited fields, skipping fields of other wire types.
+func (d *decoder) each(fn func(f field) error) error {
+	b := d.buf
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := field{num: num}
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.VarintType && typ != protowire.BytesType {
+			continue
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package delta
+
+import (
+	"io"
+)
+
+const (
+	// minChunkSize, maxChunkSize and chunkMask bound the content defined chunks to 4 KiB - 64 KiB with
+	// an average of about 20 KiB, so even a rootfs of several GiB is indexed with a few MiB of memory.
+	minChunkSize = 4 << 10
+	maxChunkSize = 64 << 10
+	chunkMask    = 1<<14 - 1
+)
+
+// gear maps every byte to a pseudo random value for the rolling gear hash. It is derived from a fixed
+// seed, so chunk boundaries never change between versions.
+var gear = func() [256]uint64 {
+	var (
+		table [256]uint64
+		state uint64 = 0x6f6e6d6574616c // "onmetal"
+	)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// cut returns the length of the first chunk of data. Boundaries only depend on the content preceding
+// them, so an insertion or removal only changes the chunks around it.
+func cut(data []byte) int {
+	if len(data) <= minChunkSize {
+		return len(data)
+	}
+	var h uint64
+	for i := minChunkSize; i < len(data); i++ {
+		h = h<<1 + gear[data[i]]
+		if h&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// chunk splits the content of r into content defined chunks, calling fn with each of them in order.
+// The chunk passed to fn is only valid until fn returns.
+func chunk(r io.Reader, fn func(data []byte) error) error {
+	var (
+		buf = make([]byte, maxChunkSize)
+		n   int
+		eof bool
+	)
+	for {
+		for !eof && n < len(buf) {
+			m, err := r.Read(buf[n:])
+			n += m
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+
+		size := cut(buf[:n])
+		if err := fn(buf[:size]); err != nil {
+			return err
+		}
+		n = copy(buf, buf[size:n])
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package delta computes and applies binary deltas between rootfs blobs, so an image can be updated by
+// only downloading what changed since a version that is already in the local store.
+//
+// Both blobs are split into content defined chunks. A delta is a gzip compressed stream of operations
+// reconstructing the target blob, either copying a chunk of the source blob or adding new data.
+package delta
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// magic starts every (uncompressed) delta stream, its last byte is the format version.
+const magic = "OMDELTA\x01"
+
+const (
+	opCopy = 'C'
+	opData = 'D'
+	opEnd  = 'E'
+)
+
+// ErrInvalidDelta is returned if a delta is malformed, truncated or does not fit its source.
+var ErrInvalidDelta = errors.New("invalid delta")
+
+// Stats describe a computed delta.
+type Stats struct {
+	// SourceSize is the size of the source blob.
+	SourceSize int64
+	// TargetSize is the size of the target blob.
+	TargetSize int64
+	// Copied is the number of bytes of the target copied from the source.
+	Copied int64
+	// Added is the number of bytes of the target contained in the delta.
+	Added int64
+}
+
+type span struct {
+	offset int64
+	size   int
+}
+
+// Diff writes the delta reconstructing target from source to w. Both are read once from start to end;
+// only the chunk digests of source are kept in memory.
+func Diff(source, target io.Reader, w io.Writer) (*Stats, error) {
+	stats := &Stats{}
+	chunks := make(map[[sha256.Size]byte]span)
+	if err := chunk(source, func(data []byte) error {
+		sum := sha256.Sum256(data)
+		if _, ok := chunks[sum]; !ok {
+			chunks[sum] = span{offset: stats.SourceSize, size: len(data)}
+		}
+		stats.SourceSize += int64(len(data))
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("error reading source: %w", err)
+	}
+
+	zw := gzip.NewWriter(w)
+	e := &encoder{w: bufio.NewWriter(zw)}
+	if _, err := e.w.WriteString(magic); err != nil {
+		return nil, err
+	}
+	if err := chunk(target, func(data []byte) error {
+		stats.TargetSize += int64(len(data))
+		if s, ok := chunks[sha256.Sum256(data)]; ok && s.size == len(data) {
+			stats.Copied += int64(len(data))
+			return e.copy(s)
+		}
+		stats.Added += int64(len(data))
+		return e.data(data)
+	}); err != nil {
+		return nil, fmt.Errorf("error reading target: %w", err)
+	}
+	if err := e.end(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// encoder writes delta operations, merging copies of adjacent source chunks.
+type encoder struct {
+	w       *bufio.Writer
+	pending span
+	buf     [binary.MaxVarintLen64]byte
+}
+
+func (e *encoder) op(op byte, values ...uint64) error {
+	if err := e.w.WriteByte(op); err != nil {
+		return err
+	}
+	for _, v := range values {
+		n := binary.PutUvarint(e.buf[:], v)
+		if _, err := e.w.Write(e.buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) copy(s span) error {
+	if e.pending.size > 0 && e.pending.offset+int64(e.pending.size) == s.offset {
+		e.pending.size += s.size
+		return nil
+	}
+	if err := e.flush(); err != nil {
+		return err
+	}
+	e.pending = s
+	return nil
+}
+
+func (e *encoder) flush() error {
+	if e.pending.size == 0 {
+		return nil
+	}
+	err := e.op(opCopy, uint64(e.pending.offset), uint64(e.pending.size))
+	e.pending = span{}
+	return err
+}
+
+func (e *encoder) data(data []byte) error {
+	if err := e.flush(); err != nil {
+		return err
+	}
+	if err := e.op(opData, uint64(len(data))); err != nil {
+		return err
+	}
+	_, err := e.w.Write(data)
+	return err
+}
+
+func (e *encoder) end() error {
+	if err := e.flush(); err != nil {
+		return err
+	}
+	if err := e.op(opEnd); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+// Apply returns the target blob reconstructed from source and the delta, which is streamed while reading.
+// Malformed or truncated deltas and copies beyond the end of source fail reading with ErrInvalidDelta.
+// The reconstructed content is not verified, callers have to check it against the target digest.
+func Apply(source io.ReaderAt, delta io.Reader) (io.ReadCloser, error) {
+	zr, err := gzip.NewReader(delta)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDelta, err)
+	}
+	d := &decoder{source: source, zr: zr, r: bufio.NewReader(zr)}
+
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(d.r, header); err != nil || string(header) != magic {
+		_ = zr.Close()
+		return nil, fmt.Errorf("%w: unknown format", ErrInvalidDelta)
+	}
+	return d, nil
+}
+
+type decoder struct {
+	source io.ReaderAt
+	zr     *gzip.Reader
+	r      *bufio.Reader
+	// cur is the remaining content of the current operation.
+	cur  io.Reader
+	left int64
+	done bool
+}
+
+func (d *decoder) Read(p []byte) (int, error) {
+	for {
+		if d.left > 0 {
+			if int64(len(p)) > d.left {
+				p = p[:d.left]
+			}
+			n, err := d.cur.Read(p)
+			d.left -= int64(n)
+			if err == io.EOF && d.left > 0 {
+				return n, fmt.Errorf("%w: unexpected end of data", ErrInvalidDelta)
+			}
+			if err != nil && err != io.EOF {
+				return n, err
+			}
+			return n, nil
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// next decodes the next operation.
+func (d *decoder) next() error {
+	op, err := d.r.ReadByte()
+	if err != nil {
+		return d.invalid(err)
+	}
+	switch op {
+	case opCopy:
+		offset, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return d.invalid(err)
+		}
+		size, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return d.invalid(err)
+		}
+		if size > math.MaxInt64 || offset > math.MaxInt64-size {
+			return fmt.Errorf("%w: copy out of range", ErrInvalidDelta)
+		}
+		d.cur, d.left = io.NewSectionReader(d.source, int64(offset), int64(size)), int64(size)
+	case opData:
+		size, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return d.invalid(err)
+		}
+		if size > math.MaxInt64 {
+			return fmt.Errorf("%w: data out of range", ErrInvalidDelta)
+		}
+		d.cur, d.left = d.r, int64(size)
+	case opEnd:
+		d.done = true
+	default:
+		return fmt.Errorf("%w: unknown operation %q", ErrInvalidDelta, op)
+	}
+	return nil
+}
+
+func (d *decoder) invalid(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("%w: %v", ErrInvalidDelta, err)
+}
+
+func (d *decoder) Close() error {
+	return d.zr.Close()
+}
@@ -0,0 +1,153 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package delta_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	. "github.com/onmetal/onmetal-image/delta"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/local"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Delta", func() {
+	ctx := context.Background()
+
+	randomBytes := func(seed int64, n int) []byte {
+		data := make([]byte, n)
+		_, _ = rand.New(rand.NewSource(seed)).Read(data)
+		return data
+	}
+
+	// update returns source with some bytes inserted, some removed and some changed.
+	update := func(source []byte) []byte {
+		var target []byte
+		target = append(target, source[:100<<10]...)
+		target = append(target, randomBytes(2, 3000)...)
+		target = append(target, source[100<<10:300<<10]...)
+		target = append(target, source[320<<10:]...)
+		target[600<<10] ^= 0xff
+		return target
+	}
+
+	diff := func(source, target []byte) ([]byte, *Stats) {
+		var buf bytes.Buffer
+		stats, err := Diff(bytes.NewReader(source), bytes.NewReader(target), &buf)
+		Expect(err).NotTo(HaveOccurred())
+		return buf.Bytes(), stats
+	}
+
+	apply := func(source, delta []byte) ([]byte, error) {
+		rc, err := Apply(bytes.NewReader(source), bytes.NewReader(delta))
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = rc.Close() }()
+		return io.ReadAll(rc)
+	}
+
+	It("should reconstruct the target, only containing the changed chunks", func() {
+		source := randomBytes(1, 1<<20)
+		target := update(source)
+
+		delta, stats := diff(source, target)
+		Expect(stats.SourceSize).To(Equal(int64(len(source))))
+		Expect(stats.TargetSize).To(Equal(int64(len(target))))
+		Expect(stats.Copied + stats.Added).To(Equal(stats.TargetSize))
+		Expect(stats.Added).To(BeNumerically("<", stats.TargetSize/5))
+		Expect(len(delta)).To(BeNumerically("<", len(target)/5))
+
+		Expect(apply(source, delta)).To(Equal(target))
+	})
+
+	It("should reconstruct targets unrelated to the source and empty targets", func() {
+		source := randomBytes(1, 100<<10)
+		for _, target := range [][]byte{randomBytes(3, 50<<10), nil} {
+			delta, stats := diff(source, target)
+			Expect(stats.Copied).To(BeZero())
+			Expect(apply(source, delta)).To(Equal(target))
+		}
+	})
+
+	It("should reject malformed and truncated deltas and deltas of other sources", func() {
+		source := randomBytes(1, 1<<20)
+		delta, _ := diff(source, update(source))
+
+		_, err := apply(source, []byte("no delta"))
+		Expect(err).To(MatchError(ErrInvalidDelta))
+
+		_, err = apply(source, delta[:len(delta)/2])
+		Expect(err).To(HaveOccurred())
+
+		_, err = apply(source[:512<<10], delta)
+		Expect(err).To(MatchError(ErrInvalidDelta))
+	})
+
+	It("should build, parse and apply delta artifacts", func() {
+		store, err := local.NewStore(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+
+		newImage := func(rootFS []byte) ociimage.Image {
+			img, err := imageutil.NewJSONConfigBuilder(&onmetalimage.Config{}, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).
+				BytesLayer([]byte("kernel"), imageutil.WithMediaType(onmetalimage.KernelLayerMediaType)).
+				BytesLayer(rootFS, imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType)).
+				Complete()
+			Expect(err).NotTo(HaveOccurred())
+			return img
+		}
+		source := randomBytes(1, 1<<20)
+		target := update(source)
+		from, to := newImage(source), newImage(target)
+
+		artifact, stats, err := Build(ctx, store, from, to)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stats.TargetSize).To(Equal(int64(len(target))))
+
+		parsed, err := Parse(ctx, artifact)
+		Expect(err).NotTo(HaveOccurred())
+		fromRootFS, err := RootFS(ctx, from)
+		Expect(err).NotTo(HaveOccurred())
+		toRootFS, err := RootFS(ctx, to)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed.Source).To(Equal(fromRootFS.Descriptor().Digest))
+		Expect(parsed.Target).To(Equal(toRootFS.Descriptor().Digest))
+		Expect(parsed.TargetImage).To(Equal(to.Descriptor().Digest))
+
+		By("applying it to the target image")
+		applied, err := ApplyImage(ctx, to, parsed, fromRootFS)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(applied.Descriptor()).To(Equal(to.Descriptor()))
+		rootFS, err := RootFS(ctx, applied)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imageutil.ReadLayerContent(ctx, rootFS)).To(Equal(target))
+
+		By("refusing to apply it to other images")
+		_, err = ApplyImage(ctx, from, parsed, fromRootFS)
+		Expect(err).To(MatchError(ContainSubstring("delta results in rootfs")))
+		_, err = ApplyImage(ctx, to, parsed, toRootFS)
+		Expect(err).To(MatchError(ContainSubstring("delta applies to rootfs")))
+
+		By("refusing to parse other images")
+		_, err = Parse(ctx, from)
+		Expect(err).To(MatchError(ErrNotDelta))
+	})
+})
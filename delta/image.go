@@ -0,0 +1,263 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package delta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// ArtifactType is the artifact type of delta artifacts.
+	ArtifactType = "application/vnd.onmetal.image.delta.v1alpha1"
+	// LayerMediaType is the media type of the delta layer of a delta artifact.
+	LayerMediaType = "application/vnd.onmetal.image.delta.v1alpha1.rootfs"
+
+	// SourceAnnotation is the manifest annotation holding the digest of the rootfs a delta applies to.
+	SourceAnnotation = "image.onmetal.de/delta-source"
+	// TargetAnnotation is the manifest annotation holding the digest of the rootfs a delta results in.
+	TargetAnnotation = "image.onmetal.de/delta-target"
+	// TargetImageAnnotation is the manifest annotation holding the digest of the image the target
+	// rootfs belongs to.
+	TargetImageAnnotation = "image.onmetal.de/delta-target-image"
+)
+
+// ErrNotDelta is returned by Parse if an image is no delta artifact.
+var ErrNotDelta = errors.New("image is no delta artifact")
+
+// RootFS returns the rootfs layer of the image, failing unless there is exactly one.
+func RootFS(ctx context.Context, img ociimage.Image) (ociimage.Layer, error) {
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting layers: %w", err)
+	}
+
+	var rootFS ociimage.Layer
+	for _, layer := range layers {
+		if onmetalimage.LayerMediaType(layer.Descriptor().MediaType) != onmetalimage.RootFSLayerMediaType {
+			continue
+		}
+		if rootFS != nil {
+			return nil, fmt.Errorf("image has more than one rootfs layer")
+		}
+		rootFS = layer
+	}
+	if rootFS == nil {
+		return nil, fmt.Errorf("image has no rootfs layer")
+	}
+	return rootFS, nil
+}
+
+// Build computes the delta from the rootfs of the image from to the rootfs of the image to and returns
+// an artifact of type ArtifactType holding it. The delta is streamed into the given store.
+func Build(ctx context.Context, store content.Store, from, to ociimage.Image) (ociimage.Image, *Stats, error) {
+	source, err := RootFS(ctx, from)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting source rootfs: %w", err)
+	}
+	target, err := RootFS(ctx, to)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting target rootfs: %w", err)
+	}
+
+	sourceRC, err := source.Content(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening source rootfs: %w", err)
+	}
+	defer func() { _ = sourceRC.Close() }()
+
+	targetRC, err := target.Content(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening target rootfs: %w", err)
+	}
+	defer func() { _ = targetRC.Close() }()
+
+	var stats *Stats
+	pr, pw := io.Pipe()
+	go func() {
+		var err error
+		stats, err = Diff(sourceRC, targetRC, pw)
+		_ = pw.CloseWithError(err)
+	}()
+
+	sourceDesc, targetDesc := source.Descriptor(), target.Descriptor()
+	ref := fmt.Sprintf("delta-%s-%s-%d", sourceDesc.Digest.Encoded(), targetDesc.Digest.Encoded(), time.Now().UnixNano())
+	layer, err := ocicontent.IngestLayer(ctx, store, ref, pr, imageutil.WithMediaType(LayerMediaType))
+	_ = pr.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error writing delta: %w", err)
+	}
+
+	img, err := imageutil.NewArtifactBuilder(ArtifactType).
+		Layers(layer).
+		Annotations(map[string]string{
+			SourceAnnotation:      sourceDesc.Digest.String(),
+			TargetAnnotation:      targetDesc.Digest.String(),
+			TargetImageAnnotation: to.Descriptor().Digest.String(),
+		}).
+		Complete()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error building delta artifact: %w", err)
+	}
+	return img, stats, nil
+}
+
+// Artifact is a parsed delta artifact.
+type Artifact struct {
+	// Source is the digest of the rootfs the delta applies to.
+	Source digest.Digest
+	// Target is the digest of the rootfs the delta results in.
+	Target digest.Digest
+	// TargetImage is the digest of the image the target rootfs belongs to.
+	TargetImage digest.Digest
+	// Layer is the layer containing the delta.
+	Layer ociimage.Layer
+}
+
+// Parse parses the delta artifact img. Images of another artifact type fail with ErrNotDelta.
+func Parse(ctx context.Context, img ociimage.Image) (*Artifact, error) {
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting manifest: %w", err)
+	}
+	if manifest.ArtifactType != ArtifactType {
+		return nil, fmt.Errorf("%w: artifact type %q", ErrNotDelta, manifest.ArtifactType)
+	}
+
+	a := &Artifact{}
+	for key, dgst := range map[string]*digest.Digest{
+		SourceAnnotation:      &a.Source,
+		TargetAnnotation:      &a.Target,
+		TargetImageAnnotation: &a.TargetImage,
+	} {
+		if *dgst, err = digest.Parse(manifest.Annotations[key]); err != nil {
+			return nil, fmt.Errorf("invalid annotation %s: %w", key, err)
+		}
+	}
+
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting layers: %w", err)
+	}
+	if len(layers) != 1 || layers[0].Descriptor().MediaType != LayerMediaType {
+		return nil, fmt.Errorf("delta artifact has to have exactly one layer of media type %s", LayerMediaType)
+	}
+	a.Layer = layers[0]
+	return a, nil
+}
+
+// ApplyImage returns the image target whose rootfs layer is reconstructed from the given source rootfs
+// and the delta of the artifact instead of being read from target. Writing the image to a store thus
+// only reads the delta and the other layers of target; the store verifies the reconstructed rootfs
+// against its digest.
+// The artifact has to result in the rootfs of target and source has to be the rootfs it applies to
+// and support random access.
+func ApplyImage(ctx context.Context, target ociimage.Image, artifact *Artifact, source ociimage.Layer) (ociimage.Image, error) {
+	rootFS, err := RootFS(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	if dgst := rootFS.Descriptor().Digest; dgst != artifact.Target {
+		return nil, fmt.Errorf("delta results in rootfs %s instead of %s", artifact.Target, dgst)
+	}
+	if dgst := source.Descriptor().Digest; dgst != artifact.Source {
+		return nil, fmt.Errorf("delta applies to rootfs %s instead of %s", artifact.Source, dgst)
+	}
+	randomAccess, ok := source.(ociimage.RandomAccessLayer)
+	if !ok {
+		return nil, fmt.Errorf("source rootfs %s does not support random access", artifact.Source)
+	}
+
+	return &image{
+		Image:  target,
+		rootFS: rootFS,
+		layer:  &layer{Layer: rootFS, source: randomAccess, delta: artifact.Layer},
+	}, nil
+}
+
+type image struct {
+	ociimage.Image
+	rootFS ociimage.Layer
+	layer  ociimage.Layer
+}
+
+func (i *image) Layers(ctx context.Context) ([]ociimage.Layer, error) {
+	layers, err := i.Image.Layers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]ociimage.Layer, len(layers))
+	for j, layer := range layers {
+		if layer.Descriptor().Digest == i.rootFS.Descriptor().Digest {
+			layer = i.layer
+		}
+		res[j] = layer
+	}
+	return res, nil
+}
+
+// layer is a rootfs layer whose content is reconstructed from a source rootfs and a delta.
+type layer struct {
+	ociimage.Layer
+	source ociimage.RandomAccessLayer
+	delta  ociimage.Layer
+}
+
+func (l *layer) Content(ctx context.Context) (io.ReadCloser, error) {
+	source, err := l.source.ReaderAt(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error opening source rootfs: %w", err)
+	}
+
+	deltaRC, err := l.delta.Content(ctx)
+	if err != nil {
+		_ = source.Close()
+		return nil, fmt.Errorf("error opening delta: %w", err)
+	}
+
+	rc, err := Apply(source, deltaRC)
+	if err != nil {
+		_ = deltaRC.Close()
+		_ = source.Close()
+		return nil, err
+	}
+	return &appliedReadCloser{ReadCloser: rc, closers: []io.Closer{deltaRC, source}}, nil
+}
+
+type appliedReadCloser struct {
+	io.ReadCloser
+	closers []io.Closer
+}
+
+func (a *appliedReadCloser) Close() error {
+	err := a.ReadCloser.Close()
+	for _, c := range a.closers {
+		if cErr := c.Close(); err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,185 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package disk implements exporting images to bootable disk images, see Export.
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/unpack"
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+)
+
+// ErrUnsupported is returned if the rootfs of an image cannot be exported (yet).
+var ErrUnsupported = errors.New("unsupported rootfs")
+
+// Format is the format of an exported disk image.
+type Format string
+
+const (
+	// FormatRaw is a raw disk image. Zero blocks are skipped, so the file is sparse.
+	FormatRaw Format = "raw"
+	// FormatQCOW2 is a QEMU copy-on-write (version 3) disk image.
+	FormatQCOW2 Format = "qcow2"
+)
+
+// ParseFormat parses the given disk image format.
+func ParseFormat(s string) (Format, error) {
+	switch format := Format(s); format {
+	case FormatRaw, FormatQCOW2:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown disk format %q, expected one of %s or %s", s, FormatRaw, FormatQCOW2)
+	}
+}
+
+// Kind is the kind of content of a rootfs layer.
+type Kind string
+
+const (
+	// KindDisk is a full disk image with an MBR or GPT partition table.
+	KindDisk Kind = "disk"
+	// KindFileSystem is a partitionless file system image.
+	KindFileSystem Kind = "file system"
+	// KindArchive is a tar archive.
+	KindArchive Kind = "tar archive"
+	// KindUnknown is content of unknown kind.
+	KindUnknown Kind = "unknown"
+)
+
+// headerSize is the number of leading bytes Detect needs to tell the kinds apart.
+const headerSize = 68 * 1024
+
+// Detect returns the kind of content starting with the given header and, for file systems, the file
+// system type.
+func Detect(header []byte) (Kind, string) {
+	at := func(offset int, magic string) bool {
+		return len(header) >= offset+len(magic) && string(header[offset:offset+len(magic)]) == magic
+	}
+
+	switch {
+	case at(512, "EFI PART"):
+		return KindDisk, ""
+	case at(1080, "\x53\xef"):
+		return KindFileSystem, "ext4"
+	case at(0, "hsqs"):
+		return KindFileSystem, "squashfs"
+	case at(0, "XFSB"):
+		return KindFileSystem, "xfs"
+	case at(0x10040, "_BHRfS_M"):
+		return KindFileSystem, "btrfs"
+	case at(257, "ustar"):
+		return KindArchive, ""
+	case !at(510, "\x55\xaa"):
+		return KindUnknown, ""
+	case at(54, "FAT") || at(82, "FAT32"):
+		return KindFileSystem, "vfat"
+	case at(3, "NTFS"):
+		return KindFileSystem, "ntfs"
+	case hasMBRPartitions(header):
+		return KindDisk, ""
+	default:
+		return KindUnknown, ""
+	}
+}
+
+// hasMBRPartitions reports whether the MBR in the header has at least one partition entry.
+func hasMBRPartitions(header []byte) bool {
+	for i := 0; i < 4; i++ {
+		entry := header[446+16*i : 446+16*(i+1)]
+		// Entries have a partition type and a non-zero size.
+		if entry[4] != 0 && binary.LittleEndian.Uint32(entry[12:16]) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Source is what a disk is exported from.
+type Source struct {
+	// RootFS is the rootfs layer. If it is a disk image, it is exported as-is.
+	RootFS image.Layer
+	// Kernel and InitRAMFs are the kernel and initramfs layers to boot a partitionless rootfs with.
+	Kernel, InitRAMFs image.Layer
+	// CommandLine is the kernel command line of the boot entry for a partitionless rootfs.
+	CommandLine string
+}
+
+// Export writes a disk image of the given format built from the source to out.
+//
+// Rootfs layers (optionally gzip or zstd compressed) that are full disk images are converted as-is.
+// Wrapping partitionless file systems into a GPT disk with an EFI system partition holding the kernel,
+// initramfs and a boot entry is not implemented yet and fails with ErrUnsupported, as do tar archives.
+func Export(ctx context.Context, src Source, out File, format Format) error {
+	rc, err := src.RootFS.Content(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting rootfs content: %w", err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	vr, err := ioutils.NewReader(ctx, rc, src.RootFS.Descriptor())
+	if err != nil {
+		return err
+	}
+	dr, err := unpack.Decompress(vr)
+	if err != nil {
+		return fmt.Errorf("error decompressing rootfs: %w", err)
+	}
+	defer func() { _ = dr.Close() }()
+
+	br := bufio.NewReaderSize(dr, headerSize)
+	header, err := br.Peek(headerSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error reading rootfs: %w", err)
+	}
+
+	switch kind, fsType := Detect(header); kind {
+	case KindDisk:
+	case KindFileSystem:
+		return fmt.Errorf("%w: rootfs is a partitionless %s file system, wrapping it into a GPT disk is not implemented yet", ErrUnsupported, fsType)
+	case KindArchive:
+		return fmt.Errorf("%w: rootfs is a tar archive, only disk images can be exported", ErrUnsupported)
+	default:
+		return fmt.Errorf("%w: rootfs is neither a disk nor a file system image", ErrUnsupported)
+	}
+
+	w, err := NewWriter(out, format)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, br); err != nil {
+		return fmt.Errorf("error writing disk: %w", err)
+	}
+	// Decompressors may stop before the end of the rootfs, which has to be read fully to verify it.
+	if _, err := io.Copy(io.Discard, vr); err != nil {
+		return fmt.Errorf("error verifying rootfs: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error finishing disk: %w", err)
+	}
+	return nil
+}
+
+// isZero reports whether all bytes of b are zero.
+func isZero(b []byte) bool {
+	return len(bytes.Trim(b, "\x00")) == 0
+}
@@ -0,0 +1,178 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+
+	. "github.com/onmetal/onmetal-image/disk"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// gptDisk returns a disk of the given size with a GPT header and data at its start and end.
+func gptDisk(size int) []byte {
+	data := make([]byte, size)
+	data[510], data[511] = 0x55, 0xaa
+	copy(data[512:], "EFI PART")
+	copy(data[size-16:], "end of the disk")
+	return data
+}
+
+// readQCOW2 reads the guest content of the QCOW2 image at path.
+func readQCOW2(path string) []byte {
+	data, err := os.ReadFile(path)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(string(data[:4])).To(Equal("QFI\xfb"))
+	Expect(binary.BigEndian.Uint32(data[4:])).To(Equal(uint32(3)))
+
+	var (
+		clusterSize = int64(1) << binary.BigEndian.Uint32(data[20:])
+		size        = int64(binary.BigEndian.Uint64(data[24:]))
+		l1Size      = int64(binary.BigEndian.Uint32(data[36:]))
+		l1Offset    = int64(binary.BigEndian.Uint64(data[40:]))
+		entries     = clusterSize / 8
+		offsetMask  = uint64(1)<<62 - 1
+	)
+	Expect(int64(len(data)) % clusterSize).To(BeZero())
+
+	guest := make([]byte, size)
+	for i := int64(0); i < l1Size; i++ {
+		l2Offset := int64(binary.BigEndian.Uint64(data[l1Offset+8*i:]) & offsetMask)
+		if l2Offset == 0 {
+			continue
+		}
+		for j := int64(0); j < entries; j++ {
+			hostOffset := int64(binary.BigEndian.Uint64(data[l2Offset+8*j:]) & offsetMask)
+			if hostOffset == 0 {
+				continue
+			}
+			guestOffset := (i*entries + j) * clusterSize
+			copy(guest[guestOffset:], data[hostOffset:hostOffset+clusterSize])
+		}
+	}
+	return guest
+}
+
+var _ = Describe("Disk", func() {
+	var (
+		ctx = context.Background()
+		dir string
+	)
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	Describe("Detect", func() {
+		It("should detect GPT disks", func() {
+			Expect(Detect(gptDisk(4096))).To(Equal(KindDisk))
+		})
+
+		It("should detect MBR disks", func() {
+			header := make([]byte, 512)
+			header[510], header[511] = 0x55, 0xaa
+			header[446+4] = 0x83
+			binary.LittleEndian.PutUint32(header[446+12:], 2048)
+			Expect(Detect(header)).To(Equal(KindDisk))
+		})
+
+		It("should detect file systems and archives", func() {
+			ext4 := make([]byte, 2048)
+			ext4[1080], ext4[1081] = 0x53, 0xef
+			kind, fsType := Detect(ext4)
+			Expect(kind).To(Equal(KindFileSystem))
+			Expect(fsType).To(Equal("ext4"))
+
+			tar := make([]byte, 512)
+			copy(tar[257:], "ustar")
+			Expect(Detect(tar)).To(Equal(KindArchive))
+
+			Expect(Detect([]byte("some content"))).To(Equal(KindUnknown))
+		})
+	})
+
+	Describe("NewWriter", func() {
+		write := func(format Format, data []byte) string {
+			path := filepath.Join(dir, "disk."+string(format))
+			f, err := os.Create(path)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { _ = f.Close() }()
+
+			w, err := NewWriter(f, format)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = io.Copy(w, bytes.NewReader(data))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w.Close()).To(Succeed())
+			return path
+		}
+
+		It("should write sparse raw disks", func() {
+			data := gptDisk(3*1024*1024 + 1000)
+			path := write(FormatRaw, data)
+
+			Expect(os.ReadFile(path)).To(Equal(data))
+		})
+
+		It("should write qcow2 disks", func() {
+			data := gptDisk(3*1024*1024 + 1000)
+			path := write(FormatQCOW2, data)
+
+			guest := readQCOW2(path)
+			Expect(guest).To(HaveLen(3*1024*1024 + 1024))
+			Expect(guest[:len(data)]).To(Equal(data))
+
+			// Only the two non-zero clusters are stored next to the header, l1, l2 and refcount tables.
+			fi, err := os.Stat(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fi.Size()).To(Equal(int64(7 * 64 * 1024)))
+		})
+
+		It("should reject unknown formats", func() {
+			_, err := ParseFormat("vmdk")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Export", func() {
+		It("should export disk images", func() {
+			data := gptDisk(1024 * 1024)
+			path := filepath.Join(dir, "disk.qcow2")
+			f, err := os.Create(path)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { _ = f.Close() }()
+
+			Expect(Export(ctx, Source{RootFS: imageutil.BytesLayer(data)}, f, FormatQCOW2)).To(Succeed())
+			Expect(readQCOW2(path)).To(Equal(data))
+		})
+
+		It("should fail clearly for partitionless file systems", func() {
+			ext4 := make([]byte, 4096)
+			ext4[1080], ext4[1081] = 0x53, 0xef
+			f, err := os.Create(filepath.Join(dir, "disk.raw"))
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { _ = f.Close() }()
+
+			err = Export(ctx, Source{RootFS: imageutil.BytesLayer(ext4)}, f, FormatRaw)
+			Expect(err).To(MatchError(ErrUnsupported))
+			Expect(err).To(MatchError(ContainSubstring("ext4")))
+		})
+	})
+})
@@ -0,0 +1,263 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// File is the file a disk image is written to.
+type File interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+}
+
+// NewWriter returns a writer writing the raw disk content written to it to f in the given format.
+// The disk image is only complete after closing the writer, which does not close f.
+func NewWriter(f File, format Format) (io.WriteCloser, error) {
+	switch format {
+	case FormatRaw:
+		return &rawWriter{clusterWriter{f: f, write: writeRawCluster}}, nil
+	case FormatQCOW2:
+		w := &qcow2Writer{mapping: make(map[int64]int64)}
+		w.clusterWriter = clusterWriter{f: f, write: w.writeCluster}
+		// The first cluster holds the header, which is written on close.
+		w.next = 1
+		return w, nil
+	default:
+		return nil, fmt.Errorf("unknown disk format %q", format)
+	}
+}
+
+// clusterSize is the unit disk content is written in. Clusters of zeros are not written.
+const clusterSize = 64 * 1024
+
+// clusterWriter splits the written content into clusters.
+type clusterWriter struct {
+	f     File
+	write func(w *clusterWriter, index int64, cluster []byte) error
+
+	buf   []byte
+	index int64
+	size  int64
+}
+
+func (w *clusterWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, clusterSize)
+		}
+		c := copy(w.buf[len(w.buf):clusterSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+		w.size += int64(c)
+
+		if len(w.buf) == clusterSize {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush writes the buffered cluster, padding it with zeros.
+func (w *clusterWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	cluster := w.buf[:clusterSize]
+	for i := len(w.buf); i < clusterSize; i++ {
+		cluster[i] = 0
+	}
+	if !isZero(cluster) {
+		if err := w.write(w, w.index, cluster); err != nil {
+			return err
+		}
+	}
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// rawWriter writes a sparse raw disk image: Zero clusters are seeked over instead of written.
+type rawWriter struct {
+	clusterWriter
+}
+
+func writeRawCluster(w *clusterWriter, index int64, cluster []byte) error {
+	if _, err := w.f.Seek(index*clusterSize, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := w.f.Write(cluster)
+	return err
+}
+
+func (w *rawWriter) Close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	// Truncating sets the size if the disk ends with zeros and drops the padding of the last cluster.
+	return w.f.Truncate(w.size)
+}
+
+const (
+	qcow2Magic        = 0x514649fb // QFI\xfb
+	qcow2Version      = 3
+	qcow2ClusterBits  = 16
+	qcow2HeaderLength = 104
+	// qcow2RefcountOrder denotes 16 bit refcounts.
+	qcow2RefcountOrder = 4
+	// qcow2Copied is the flag of L1 and L2 entries denoting a refcount of exactly one.
+	qcow2Copied = 1 << 63
+
+	qcow2L2Entries       = clusterSize / 8
+	qcow2RefcountEntries = clusterSize / 2
+)
+
+// qcow2Writer writes a QCOW2 image. Data clusters are appended as they are written, the lookup and
+// refcount tables are written after them on close, followed by the header.
+type qcow2Writer struct {
+	clusterWriter
+	// mapping maps the indices of guest clusters to the indices of their host clusters.
+	mapping map[int64]int64
+	// next is the index of the next free host cluster.
+	next int64
+}
+
+func (w *qcow2Writer) writeCluster(cw *clusterWriter, index int64, cluster []byte) error {
+	if _, err := w.f.Seek(w.next*clusterSize, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := w.f.Write(cluster); err != nil {
+		return err
+	}
+	w.mapping[index] = w.next
+	w.next++
+	return nil
+}
+
+func ceilDiv(a, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+func (w *qcow2Writer) Close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	// Each L2 table is a cluster, the L1 table is contiguous.
+	var (
+		virtualSize = ceilDiv(w.size, 512) * 512
+		l1Size      = ceilDiv(ceilDiv(virtualSize, clusterSize), qcow2L2Entries)
+		l1          = make([]uint64, l1Size)
+	)
+	for l1Index := int64(0); l1Index < l1Size; l1Index++ {
+		l2 := make([]uint64, qcow2L2Entries)
+		var used bool
+		for i := range l2 {
+			if host, ok := w.mapping[l1Index*qcow2L2Entries+int64(i)]; ok {
+				l2[i] = uint64(host*clusterSize) | qcow2Copied
+				used = true
+			}
+		}
+		if !used {
+			continue
+		}
+		l1[l1Index] = uint64(w.next*clusterSize) | qcow2Copied
+		if err := w.writeTable(w.next, l2); err != nil {
+			return fmt.Errorf("error writing l2 table: %w", err)
+		}
+		w.next++
+	}
+
+	l1Offset := w.next * clusterSize
+	if err := w.writeTable(w.next, l1); err != nil {
+		return fmt.Errorf("error writing l1 table: %w", err)
+	}
+	w.next += ceilDiv(l1Size*8, clusterSize)
+	if l1Size == 0 {
+		w.next++
+	}
+
+	// The refcount blocks and table need refcounts themselves, so grow them until they cover all clusters.
+	var blocks, tableClusters int64 = 1, 1
+	for {
+		total := w.next + blocks + tableClusters
+		needBlocks := ceilDiv(total, qcow2RefcountEntries)
+		needTableClusters := ceilDiv(needBlocks*8, clusterSize)
+		if needBlocks == blocks && needTableClusters == tableClusters {
+			break
+		}
+		blocks, tableClusters = needBlocks, needTableClusters
+	}
+
+	var (
+		total       = w.next + blocks + tableClusters
+		table       = make([]uint64, blocks)
+		tableOffset = (w.next + blocks) * clusterSize
+	)
+	for b := int64(0); b < blocks; b++ {
+		block := make([]uint16, qcow2RefcountEntries)
+		for i := range block {
+			if b*qcow2RefcountEntries+int64(i) < total {
+				block[i] = 1
+			}
+		}
+		table[b] = uint64((w.next + b) * clusterSize)
+		if err := w.writeTable(w.next+b, block); err != nil {
+			return fmt.Errorf("error writing refcount block: %w", err)
+		}
+	}
+	if err := w.writeTable(w.next+blocks, table); err != nil {
+		return fmt.Errorf("error writing refcount table: %w", err)
+	}
+	// Make the file cover the last table cluster completely.
+	if err := w.f.Truncate(total * clusterSize); err != nil {
+		return err
+	}
+
+	header := make([]byte, qcow2HeaderLength+8)
+	binary.BigEndian.PutUint32(header[0:], qcow2Magic)
+	binary.BigEndian.PutUint32(header[4:], qcow2Version)
+	binary.BigEndian.PutUint32(header[20:], qcow2ClusterBits)
+	binary.BigEndian.PutUint64(header[24:], uint64(virtualSize))
+	binary.BigEndian.PutUint32(header[36:], uint32(l1Size))
+	binary.BigEndian.PutUint64(header[40:], uint64(l1Offset))
+	binary.BigEndian.PutUint64(header[48:], uint64(tableOffset))
+	binary.BigEndian.PutUint32(header[56:], uint32(tableClusters))
+	binary.BigEndian.PutUint32(header[96:], qcow2RefcountOrder)
+	binary.BigEndian.PutUint32(header[100:], qcow2HeaderLength)
+	// The header extensions end with an end marker of zeros.
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := w.f.Write(header); err != nil {
+		return fmt.Errorf("error writing header: %w", err)
+	}
+	return nil
+}
+
+// writeTable writes the big endian entries to the file, starting at the given cluster.
+func (w *qcow2Writer) writeTable(cluster int64, entries interface{}) error {
+	if _, err := w.f.Seek(cluster*clusterSize, io.SeekStart); err != nil {
+		return err
+	}
+	return binary.Write(w.f, binary.BigEndian, entries)
+}
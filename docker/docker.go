@@ -21,6 +21,7 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 
 	"github.com/containerd/containerd/remotes/docker"
 
@@ -29,12 +30,23 @@ import (
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/distribution/reference"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/ref"
+	"github.com/onmetal/onmetal-image/version"
+	"oras.land/oras-go/pkg/auth"
 	dockerauth "oras.land/oras-go/pkg/auth/docker"
 )
 
 type RequestResolver struct {
-	resolver remotes.Resolver
-	hosts    docker.RegistryHosts
+	resolver       remotes.Resolver
+	hosts          docker.RegistryHosts
+	client         *http.Client
+	parser         ref.Parser
+	connectTimeout time.Duration
+
+	// harborHosts remembers whether the registry hosts serve the Harbor API, see isHarbor.
+	harborHosts sync.Map
 }
 
 type Info interface {
@@ -171,6 +183,10 @@ func (i *manifestInfo) Manifest(ctx context.Context) (*ocispec.Manifest, error)
 			return
 		}
 
+		if err := ociimage.CheckManifestSize(desc, ociimage.DefaultLimits); err != nil {
+			i.err = fmt.Errorf("error getting manifest of ref %s: %w", i.ref, err)
+			return
+		}
 		rc, err := fetcher.Fetch(ctx, desc)
 		if err != nil {
 			i.err = fmt.Errorf("error opening fetch for ref %s digest %s: %w", i.ref, desc.Digest, err)
@@ -178,8 +194,8 @@ func (i *manifestInfo) Manifest(ctx context.Context) (*ocispec.Manifest, error)
 		}
 		defer func() { _ = rc.Close() }()
 
-		manifest := &ocispec.Manifest{}
-		if err := json.NewDecoder(rc).Decode(manifest); err != nil {
+		manifest, err := ociimage.DecodeManifest(rc, desc, ociimage.DefaultLimits)
+		if err != nil {
 			i.err = fmt.Errorf("error decoding manifest: %w", err)
 			return
 		}
@@ -239,32 +255,40 @@ func (i *layerInfo) Descriptor() ocispec.Descriptor {
 	return i.desc
 }
 
+// registryHost returns the first registry host for the given host name that provides the capability.
+func (u *RequestResolver) registryHost(host string, capability docker.HostCapabilities) (docker.RegistryHost, error) {
+	regs, err := u.hosts(host)
+	if err != nil {
+		return docker.RegistryHost{}, fmt.Errorf("error getting host for %s", host)
+	}
+	for _, reg := range regs {
+		if reg.Capabilities.Has(capability) {
+			return reg, nil
+		}
+	}
+	return docker.RegistryHost{}, fmt.Errorf("no registry providing capability %d for host %s", capability, host)
+}
+
+// Parser returns the parser the resolver normalizes references with.
+func (u *RequestResolver) Parser() ref.Parser {
+	return u.parser
+}
+
 func (u *RequestResolver) Resolve(ctx context.Context, ref string) (ManifestInfo, error) {
-	r, err := reference.ParseNamed(ref)
+	r, err := u.parser.ParseNamed(ref)
 	if err != nil {
 		return nil, fmt.Errorf("ref %s is no named reference: %w", ref, err)
 	}
+	ref = r.String()
 
 	tag := "latest"
 	if tagged, ok := r.(reference.Tagged); ok {
 		tag = tagged.Tag()
 	}
 
-	host := reference.Domain(r)
-	regs, err := u.hosts(host)
+	found, err := u.registryHost(reference.Domain(r), docker.HostCapabilityPull)
 	if err != nil {
-		return nil, fmt.Errorf("error getting host for %s", host)
-	}
-	var found *docker.RegistryHost
-	for _, reg := range regs {
-		if reg.Capabilities.Has(docker.HostCapabilityPull) {
-			reg := reg
-			found = &reg
-			break
-		}
-	}
-	if found == nil {
-		return nil, fmt.Errorf("no registry providing pull capability for host %s", host)
+		return nil, err
 	}
 
 	info := &manifestInfo{
@@ -273,12 +297,18 @@ func (u *RequestResolver) Resolve(ctx context.Context, ref string) (ManifestInfo
 		resolver: u.resolver,
 		baseInfo: baseInfo{
 			name:     reference.Path(r),
-			client:   http.DefaultClient,
-			registry: *found,
+			client:   u.client,
+			registry: found,
 		},
 	}
-	if err := info.init(ctx); err != nil {
-		return nil, fmt.Errorf("error initializing: %w", err)
+	initCtx := ctx
+	if u.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		initCtx, cancel = context.WithTimeout(ctx, u.connectTimeout)
+		defer cancel()
+	}
+	if err := info.init(initCtx); err != nil {
+		return nil, fmt.Errorf("error initializing: %w", ocicontent.WithPhase(initCtx, "resolve "+ref, err))
 	}
 	return info, nil
 }
@@ -287,16 +317,50 @@ type RequestResolverOptions struct {
 	ConfigPaths []string
 	Client      *http.Client
 	Header      http.Header
+	// DefaultRegistry is the registry applied to references without a registry. See ref.Parser.
+	DefaultRegistry string
+	// ConnectTimeout bounds the initial round-trips to the registry when resolving a reference.
+	// If zero, only the context deadline applies.
+	ConnectTimeout time.Duration
+	// UserAgent is sent with every request. If empty, version.UserAgent is used.
+	UserAgent string
 }
 
 func (o *RequestResolverOptions) SetDefaults() {
 	if o.Client == nil {
 		o.Client = http.DefaultClient
 	}
+	if o.UserAgent == "" {
+		o.UserAgent = version.UserAgent()
+	}
+}
+
+// userAgentTransport sets the User-Agent header of all requests.
+type userAgentTransport struct {
+	userAgent string
+	base      http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(req)
+}
+
+// withUserAgent returns a copy of the client that sets the given User-Agent on all requests.
+func withUserAgent(client *http.Client, userAgent string) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	res := *client
+	res.Transport = &userAgentTransport{userAgent: userAgent, base: base}
+	return &res
 }
 
 func NewRequestResolver(o RequestResolverOptions) (*RequestResolver, error) {
 	o.SetDefaults()
+	o.Client = withUserAgent(o.Client, o.UserAgent)
 
 	authC, err := dockerauth.NewClient(o.ConfigPaths...)
 	if err != nil {
@@ -305,7 +369,7 @@ func NewRequestResolver(o RequestResolverOptions) (*RequestResolver, error) {
 
 	c := authC.(*dockerauth.Client)
 
-	resolver, err := c.ResolverWithOpts()
+	resolver, err := c.ResolverWithOpts(auth.WithResolverClient(o.Client))
 	if err != nil {
 		return nil, fmt.Errorf("error instantiating resolver: %w", err)
 	}
@@ -322,7 +386,10 @@ func NewRequestResolver(o RequestResolverOptions) (*RequestResolver, error) {
 	)
 
 	return &RequestResolver{
-		resolver: resolver,
-		hosts:    hosts,
+		resolver:       resolver,
+		hosts:          hosts,
+		client:         o.Client,
+		parser:         ref.Parser{DefaultRegistry: o.DefaultRegistry},
+		connectTimeout: o.ConnectTimeout,
 	}, nil
 }
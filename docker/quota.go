@@ -0,0 +1,126 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/distribution/reference"
+)
+
+// Quota is the storage quota of the registry project a repository belongs to.
+type Quota struct {
+	// Project is the registry project the quota applies to.
+	Project string `json:"project"`
+	// Limit is the number of bytes the project may store.
+	Limit int64 `json:"limit"`
+	// Used is the number of bytes the project stores.
+	Used int64 `json:"used"`
+}
+
+// Available returns the number of bytes the project may store in addition.
+func (q *Quota) Available() int64 {
+	if q.Used >= q.Limit {
+		return 0
+	}
+	return q.Limit - q.Used
+}
+
+// harborAPIPath is the base path of the Harbor v2 API.
+const harborAPIPath = "/api/v2.0"
+
+// Quota returns the storage quota of the project of the given repository or reference.
+// It returns nil if the registry offers no quota API or the project has no storage limit.
+// Harbor is the only registry whose quota API is supported, it is detected by its ping endpoint.
+func (u *RequestResolver) Quota(ctx context.Context, repository string) (*Quota, error) {
+	named, err := u.parser.ParseNamed(repository)
+	if err != nil {
+		return nil, fmt.Errorf("repository %s is no named reference: %w", repository, err)
+	}
+
+	registry, err := u.registryHost(reference.Domain(named), docker.HostCapabilityPush)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := u.isHarbor(ctx, registry)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	project, _, _ := strings.Cut(reference.Path(named), "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s%s/projects/%s/summary", registry.Scheme, registry.Host, harborAPIPath, url.PathEscape(project)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := do(ctx, u.client, registry, req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("erroneous response status: %s for url %s", res.Status, req.URL)
+	}
+
+	var summary struct {
+		Quota *struct {
+			Hard struct {
+				Storage int64 `json:"storage"`
+			} `json:"hard"`
+			Used struct {
+				Storage int64 `json:"storage"`
+			} `json:"used"`
+		} `json:"quota"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&summary); err != nil {
+		return nil, fmt.Errorf("error decoding project summary: %w", err)
+	}
+	// Harbor reports unlimited storage as a hard limit of -1.
+	if summary.Quota == nil || summary.Quota.Hard.Storage < 0 {
+		return nil, nil
+	}
+	return &Quota{Project: project, Limit: summary.Quota.Hard.Storage, Used: summary.Quota.Used.Storage}, nil
+}
+
+// isHarbor probes whether the registry serves the Harbor API, remembering the answer per host.
+func (u *RequestResolver) isHarbor(ctx context.Context, registry docker.RegistryHost) (bool, error) {
+	if ok, found := u.harborHosts.Load(registry.Host); found {
+		return ok.(bool), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s%s/ping", registry.Scheme, registry.Host, harborAPIPath), nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := do(ctx, u.client, registry, req)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64))
+	ok := res.StatusCode == http.StatusOK && strings.TrimSpace(strings.Trim(string(body), `"`)) == "Pong"
+	u.harborHosts.Store(registry.Host, ok)
+	return ok, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	. "github.com/onmetal/onmetal-image/docker"
+	"github.com/onmetal/onmetal-image/testing/registryharness"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Quota", func() {
+	var (
+		ctx      = context.Background()
+		harness  *registryharness.Registry
+		resolver *RequestResolver
+	)
+
+	BeforeEach(func() {
+		harness = registryharness.New()
+		DeferCleanup(harness.Close)
+
+		configPath := filepath.Join(GinkgoT().TempDir(), "config.json")
+		Expect(os.WriteFile(configPath, []byte("{}"), 0666)).To(Succeed())
+		var err error
+		resolver, err = NewRequestResolver(RequestResolverOptions{ConfigPaths: []string{configPath}})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should report the quota of the Harbor project of a repository", func() {
+		harness.SetQuota("project", 1000, 400)
+
+		quota, err := resolver.Quota(ctx, harness.Reference("project/app", "v1"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(quota).To(Equal(&Quota{Project: "project", Limit: 1000, Used: 400}))
+		Expect(quota.Available()).To(Equal(int64(600)))
+	})
+
+	It("should report no quota for unlimited projects", func() {
+		harness.SetQuota("project", -1, 400)
+
+		Expect(resolver.Quota(ctx, harness.Reference("project/app", "v1"))).To(BeNil())
+	})
+
+	It("should report no quota for registries without a quota API", func() {
+		Expect(resolver.Quota(ctx, harness.Reference("project/app", "v1"))).To(BeNil())
+	})
+})
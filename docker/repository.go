@@ -0,0 +1,283 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	containerdreference "github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// do sends the request to the registry, authorizing it and retrying on authentication challenges.
+// The caller is responsible for closing the body of the returned response.
+func do(ctx context.Context, client *http.Client, registry docker.RegistryHost, req *http.Request) (*http.Response, error) {
+	var responses []*http.Response
+	for {
+		if err := registry.Authorizer.Authorize(ctx, req); err != nil {
+			return nil, fmt.Errorf("error authorizing request: %w", err)
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusUnauthorized || len(responses) >= 5 {
+			return res, nil
+		}
+		_ = res.Body.Close()
+
+		responses = append(responses, res)
+		if err := registry.Authorizer.AddResponses(ctx, responses); err != nil {
+			return nil, fmt.Errorf("error adding responses: %w", err)
+		}
+	}
+}
+
+// nextLink returns the target of the rel="next" entry of the given Link header, if any.
+func nextLink(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		target := strings.TrimSpace(parts[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+		for _, param := range parts[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.TrimSuffix(strings.TrimPrefix(target, "<"), ">")
+			}
+		}
+	}
+	return ""
+}
+
+// Tags lists all tags of the given repository.
+func (u *RequestResolver) Tags(ctx context.Context, repository string) ([]string, error) {
+	named, err := u.parser.ParseNamed(repository)
+	if err != nil {
+		return nil, fmt.Errorf("repository %s is no named reference: %w", repository, err)
+	}
+	named = reference.TrimNamed(named)
+
+	registry, err := u.registryHost(reference.Domain(named), docker.HostCapabilityPull)
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := url.Parse(fmt.Sprintf("%s://%s%s/%s/tags/list", registry.Scheme, registry.Host, registry.Path, reference.Path(named)))
+	if err != nil {
+		return nil, fmt.Errorf("error building tags url: %w", err)
+	}
+
+	var tags []string
+	for next != nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+
+		res, err := do(ctx, u.client, registry, req)
+		if err != nil {
+			return nil, err
+		}
+
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		err = func() error {
+			defer func() { _ = res.Body.Close() }()
+			if res.StatusCode != http.StatusOK {
+				return fmt.Errorf("erroneous response status: %s for url %s", res.Status, req.URL)
+			}
+			if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+				return fmt.Errorf("error decoding tag list: %w", err)
+			}
+			return nil
+		}()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, list.Tags...)
+
+		link := nextLink(res.Header.Get("Link"))
+		if link == "" {
+			break
+		}
+		linkURL, err := url.Parse(link)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing next link %q: %w", link, err)
+		}
+		next = next.ResolveReference(linkURL)
+	}
+	return tags, nil
+}
+
+// ErrDeletionDisabled is returned by Delete if the registry does not allow deleting manifests or tags,
+// e.g. distribution registries without REGISTRY_STORAGE_DELETE_ENABLED.
+var ErrDeletionDisabled = errors.New("deletion is disabled on the registry")
+
+// ResolveDigest returns the digest of the manifest the given reference points to.
+func (u *RequestResolver) ResolveDigest(ctx context.Context, ref string) (digest.Digest, error) {
+	named, err := u.parseDeleteRef(ref)
+	if err != nil {
+		return "", err
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		return digested.Digest(), nil
+	}
+	_, desc, err := u.resolver.Resolve(ctx, named.String())
+	if err != nil {
+		return "", fmt.Errorf("error resolving %s: %w", named, err)
+	}
+	return desc.Digest, nil
+}
+
+// TagsOf returns the tags of the repository of the given reference pointing to the manifest with the
+// given digest.
+func (u *RequestResolver) TagsOf(ctx context.Context, ref string, dgst digest.Digest) ([]string, error) {
+	named, err := u.parser.ParseNamed(ref)
+	if err != nil {
+		return nil, fmt.Errorf("ref %s is no named reference: %w", ref, err)
+	}
+	repository := reference.TrimNamed(named).String()
+
+	tags, err := u.Tags(ctx, repository)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tags of %s: %w", repository, err)
+	}
+
+	var res []string
+	for _, tag := range tags {
+		_, desc, err := u.resolver.Resolve(ctx, fmt.Sprintf("%s:%s", repository, tag))
+		if err != nil {
+			// The tag may have been deleted after listing it.
+			if errdefs.IsNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("error resolving tag %s: %w", tag, err)
+		}
+		if desc.Digest == dgst {
+			res = append(res, tag)
+		}
+	}
+	return res, nil
+}
+
+// Delete deletes the manifest the given reference points to from its registry.
+// Note that this removes the manifest for all tags pointing to it.
+// If the registry refuses to delete manifests and ref is tagged, only the tag is deleted if the
+// registry supports deleting tags (OCI distribution spec 1.1, e.g. Harbor). If it supports neither,
+// the returned error wraps ErrDeletionDisabled.
+func (u *RequestResolver) Delete(ctx context.Context, ref string) error {
+	named, err := u.parseDeleteRef(ref)
+	if err != nil {
+		return err
+	}
+	ref = named.String()
+
+	spec, err := containerdreference.Parse(ref)
+	if err != nil {
+		return fmt.Errorf("error parsing reference spec: %w", err)
+	}
+	ctx, err = docker.ContextWithRepositoryScope(ctx, spec, true)
+	if err != nil {
+		return fmt.Errorf("error setting repository scope: %w", err)
+	}
+
+	dgst, err := u.ResolveDigest(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	registry, err := u.registryHost(reference.Domain(named), docker.HostCapabilityResolve)
+	if err != nil {
+		return err
+	}
+
+	err = u.deleteManifest(ctx, registry, named, dgst.String())
+	if !errors.Is(err, ErrDeletionDisabled) {
+		return err
+	}
+	tagged, ok := named.(reference.Tagged)
+	if !ok {
+		return err
+	}
+	return u.deleteManifest(ctx, registry, named, tagged.Tag())
+}
+
+// parseDeleteRef parses ref, defaulting to the latest tag if it has neither a tag nor a digest.
+func (u *RequestResolver) parseDeleteRef(ref string) (reference.Named, error) {
+	named, err := u.parser.ParseNamed(ref)
+	if err != nil {
+		return nil, fmt.Errorf("ref %s is no named reference: %w", ref, err)
+	}
+	return reference.TagNameOnly(named), nil
+}
+
+// deleteManifest deletes the manifest or tag of the named repository identified by the given tag or digest.
+func (u *RequestResolver) deleteManifest(ctx context.Context, registry docker.RegistryHost, named reference.Named, tagOrDigest string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fmt.Sprintf("%s://%s%s/%s/manifests/%s", registry.Scheme, registry.Host, registry.Path, reference.Path(named), tagOrDigest), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := do(ctx, u.client, registry, req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return nil
+	case unsupported(res):
+		return fmt.Errorf("error deleting %s: %w (%s for url %s)", tagOrDigest, ErrDeletionDisabled, res.Status, req.URL)
+	default:
+		return fmt.Errorf("erroneous response status: %s for url %s", res.Status, req.URL)
+	}
+}
+
+// unsupported reports whether the response rejects the request as unsupported, either by its
+// status or by an UNSUPPORTED error code in its body.
+func unsupported(res *http.Response) bool {
+	if res.StatusCode == http.StatusMethodNotAllowed {
+		return true
+	}
+	var body struct {
+		Errors []struct {
+			Code string `json:"code"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body); err != nil {
+		return false
+	}
+	for _, e := range body.Errors {
+		if e.Code == "UNSUPPORTED" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	. "github.com/onmetal/onmetal-image/docker"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/testing/registryharness"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+)
+
+var _ = Describe("Repository", func() {
+	var (
+		ctx      = context.Background()
+		harness  *registryharness.Registry
+		resolver *RequestResolver
+		dgst     digest.Digest
+	)
+
+	BeforeEach(func() {
+		harness = registryharness.New()
+		DeferCleanup(harness.Close)
+
+		configPath := filepath.Join(GinkgoT().TempDir(), "config.json")
+		Expect(os.WriteFile(configPath, []byte("{}"), 0666)).To(Succeed())
+		var err error
+		resolver, err = NewRequestResolver(RequestResolverOptions{ConfigPaths: []string{configPath}})
+		Expect(err).NotTo(HaveOccurred())
+
+		img, err := imageutil.NewJSONConfigBuilder(&onmetalimage.Config{}, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).
+			BytesLayer([]byte("rootfs"), imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		dgst = img.Descriptor().Digest
+		for _, tag := range []string{"nightly-1", "stable"} {
+			Expect(harness.Seed(ctx, "repo", tag, img)).To(Succeed())
+		}
+	})
+
+	It("should resolve digests and the tags pointing to them", func() {
+		Expect(resolver.ResolveDigest(ctx, harness.Reference("repo", "nightly-1"))).To(Equal(dgst))
+		Expect(resolver.ResolveDigest(ctx, harness.Reference("repo", dgst.String()))).To(Equal(dgst))
+		Expect(resolver.TagsOf(ctx, harness.Reference("repo", "nightly-1"), dgst)).To(ConsistOf("nightly-1", "stable"))
+	})
+
+	It("should delete the manifest a tag points to", func() {
+		Expect(resolver.Delete(ctx, harness.Reference("repo", "nightly-1"))).To(Succeed())
+
+		_, ok := harness.Manifest("repo", dgst.String())
+		Expect(ok).To(BeFalse())
+		Expect(harness.Tags("repo")).To(BeEmpty())
+	})
+
+	It("should delete a manifest by digest", func() {
+		Expect(resolver.Delete(ctx, harness.Reference("repo", dgst.String()))).To(Succeed())
+
+		_, ok := harness.Manifest("repo", dgst.String())
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should fall back to deleting the tag if deleting manifests is disabled", func() {
+		harness.Disable(registryharness.APIManifestDelete)
+
+		Expect(resolver.Delete(ctx, harness.Reference("repo", "nightly-1"))).To(Succeed())
+
+		_, ok := harness.Manifest("repo", dgst.String())
+		Expect(ok).To(BeTrue())
+		Expect(harness.Tags("repo")).To(ConsistOf("stable"))
+	})
+
+	It("should report if deletion is disabled", func() {
+		harness.Disable(registryharness.APIManifestDelete, registryharness.APITagDelete)
+
+		err := resolver.Delete(ctx, harness.Reference("repo", "nightly-1"))
+		Expect(err).To(MatchError(ErrDeletionDisabled))
+		Expect(harness.Tags("repo")).To(ConsistOf("nightly-1", "stable"))
+
+		err = resolver.Delete(ctx, harness.Reference("repo", dgst.String()))
+		Expect(err).To(MatchError(ErrDeletionDisabled))
+	})
+})
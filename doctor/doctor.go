@@ -0,0 +1,88 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package doctor implements sanity checks of the environment onmetal-image is running in.
+// Each check can be run on its own; Run runs all of them.
+package doctor
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/onmetal/onmetal-image/oci/remote"
+)
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	StatusOK      Status = "ok"
+	StatusWarning Status = "warning"
+	StatusError   Status = "error"
+)
+
+// Result is the result of a single check.
+type Result struct {
+	// Name is the name of the check.
+	Name string `json:"name"`
+	// Status is the outcome of the check.
+	Status Status `json:"status"`
+	// Message is a human-readable summary of the outcome.
+	Message string `json:"message,omitempty"`
+	// Details holds additional machine-readable information gathered by the check.
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func ok(name, message string, details map[string]string) Result {
+	return Result{Name: name, Status: StatusOK, Message: message, Details: details}
+}
+
+func warning(name, message string, details map[string]string) Result {
+	return Result{Name: name, Status: StatusWarning, Message: message, Details: details}
+}
+
+func failed(name, message string, details map[string]string) Result {
+	return Result{Name: name, Status: StatusError, Message: message, Details: details}
+}
+
+// Options are options for running all checks.
+type Options struct {
+	// StorePath is the path of the local store.
+	StorePath string
+	// ConfigPaths are the docker config paths to look up registries from. If empty, the default location is used.
+	ConfigPaths []string
+	// Client is the http.Client to use for registry checks. Defaults to http.DefaultClient.
+	Client *http.Client
+	// Hosts holds the per-registry-host settings to report, see remote.HostSettings.
+	Hosts *remote.HostsConfig
+	// ProtectBlobs reports whether the store protects committed blobs, see local.WithProtection.
+	ProtectBlobs bool
+}
+
+// Run runs all checks and returns their results.
+func Run(ctx context.Context, o Options) []Result {
+	res := []Result{
+		CheckVersion(),
+		CheckStorePath(o.StorePath),
+		CheckFileSystem(o.StorePath),
+		CheckStoreVersion(o.StorePath),
+		CheckDiskSpace(o.StorePath),
+		CheckIndex(o.StorePath),
+		CheckLock(o.StorePath),
+		CheckContent(o.StorePath),
+		CheckBlobProtection(o.StorePath, o.ProtectBlobs),
+		CheckProxy(),
+	}
+	return append(res, CheckRegistries(ctx, o.ConfigPaths, o.Hosts, o.Client)...)
+}
@@ -0,0 +1,414 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doctor_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	. "github.com/onmetal/onmetal-image/doctor"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/migration"
+	"github.com/onmetal/onmetal-image/oci/remote"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	"github.com/onmetal/onmetal-image/utils/fsutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Doctor", func() {
+	var (
+		ctx context.Context
+		dir string
+	)
+	BeforeEach(func() {
+		ctx = context.Background()
+		dir = GinkgoT().TempDir()
+	})
+
+	newStore := func() *layout.Layout {
+		l, err := layout.New(dir)
+		Expect(err).NotTo(HaveOccurred())
+		img, err := fixtures.RootFS("doctor").Build()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fixtures.AddToLayout(ctx, l, "registry.example.com/image:v1", img)).To(Succeed())
+		return l
+	}
+
+	Describe("CheckVersion", func() {
+		It("should report the go version and platform", func() {
+			result := CheckVersion()
+			Expect(result.Name).To(Equal("version"))
+			Expect(result.Details).To(HaveKey("goVersion"))
+			Expect(result.Details).To(HaveKey("platform"))
+		})
+	})
+
+	Describe("CheckProxy", func() {
+		BeforeEach(func() {
+			for _, key := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy"} {
+				GinkgoT().Setenv(key, "")
+				Expect(os.Unsetenv(key)).To(Succeed())
+			}
+		})
+
+		It("should report that no proxy is configured", func() {
+			Expect(CheckProxy()).To(Equal(Result{Name: "proxy", Status: StatusOK, Message: "no proxy configured"}))
+		})
+
+		It("should report the configured proxy", func() {
+			GinkgoT().Setenv("HTTPS_PROXY", "http://proxy.example.com:3128")
+			result := CheckProxy()
+			Expect(result.Status).To(Equal(StatusOK))
+			Expect(result.Details).To(Equal(map[string]string{"HTTPS_PROXY": "http://proxy.example.com:3128"}))
+		})
+	})
+
+	Describe("CheckStorePath", func() {
+		It("should fail if no store path is configured", func() {
+			Expect(CheckStorePath("").Status).To(Equal(StatusError))
+		})
+
+		It("should warn if the store path does not exist yet", func() {
+			Expect(CheckStorePath(filepath.Join(dir, "store")).Status).To(Equal(StatusWarning))
+		})
+
+		It("should fail if the store path is no directory", func() {
+			path := filepath.Join(dir, "store")
+			Expect(os.WriteFile(path, nil, 0644)).To(Succeed())
+			Expect(CheckStorePath(path).Status).To(Equal(StatusError))
+		})
+
+		It("should accept a directory", func() {
+			Expect(CheckStorePath(dir).Status).To(Equal(StatusOK))
+		})
+	})
+
+	Describe("CheckFileSystem", func() {
+		It("should warn if the store path does not exist", func() {
+			Expect(CheckFileSystem(filepath.Join(dir, "store")).Status).To(Equal(StatusWarning))
+		})
+
+		It("should report the capabilities of the file system", func() {
+			result := CheckFileSystem(dir)
+			Expect(result.Status).NotTo(Equal(StatusError))
+			Expect(result.Details).To(HaveKey("flock"))
+			Expect(result.Details).To(HaveKey("atomicRename"))
+			Expect(result.Details).To(HaveKey("tmpFile"))
+		})
+	})
+
+	Describe("CheckStoreVersion", func() {
+		It("should accept a missing store", func() {
+			Expect(CheckStoreVersion(dir)).To(Equal(Result{Name: "store-version", Status: StatusOK, Message: "no store yet"}))
+		})
+
+		It("should accept the current version", func() {
+			newStore()
+			result := CheckStoreVersion(dir)
+			Expect(result.Status).To(Equal(StatusOK))
+			Expect(result.Details).To(HaveKeyWithValue("version", strconv.Itoa(migration.CurrentVersion)))
+		})
+
+		It("should warn about an older version", func() {
+			Expect(migration.WriteVersion(dir, migration.CurrentVersion-1)).To(Succeed())
+			Expect(CheckStoreVersion(dir).Status).To(Equal(StatusWarning))
+		})
+
+		It("should fail on a newer version", func() {
+			Expect(migration.WriteVersion(dir, migration.CurrentVersion+1)).To(Succeed())
+			Expect(CheckStoreVersion(dir).Status).To(Equal(StatusError))
+		})
+	})
+
+	Describe("CheckDiskSpace", func() {
+		It("should report the free disk space of the first existing parent", func() {
+			result := CheckDiskSpace(filepath.Join(dir, "store", "not", "created"))
+			Expect(result.Status).To(Equal(StatusOK))
+			Expect(result.Details).To(HaveKey("freeBytes"))
+		})
+	})
+
+	Describe("CheckIndex", func() {
+		It("should warn if the index does not exist yet", func() {
+			Expect(CheckIndex(dir).Status).To(Equal(StatusWarning))
+		})
+
+		It("should fail on an invalid index", func() {
+			Expect(os.WriteFile(filepath.Join(dir, indexer.Filename), []byte("{"), 0644)).To(Succeed())
+			Expect(CheckIndex(dir).Status).To(Equal(StatusError))
+		})
+
+		It("should fail on an invalid digest", func() {
+			Expect(os.WriteFile(filepath.Join(dir, indexer.Filename), []byte(`{"schemaVersion":2,"manifests":[{"digest":"sha256:invalid"}]}`), 0644)).To(Succeed())
+			result := CheckIndex(dir)
+			Expect(result.Status).To(Equal(StatusError))
+			Expect(result.Message).To(ContainSubstring("sha256:invalid"))
+		})
+
+		It("should accept a valid index", func() {
+			newStore()
+			result := CheckIndex(dir)
+			Expect(result.Status).To(Equal(StatusOK))
+			Expect(result.Details).To(HaveKeyWithValue("entries", "1"))
+		})
+	})
+
+	Describe("CheckLock", func() {
+		It("should accept a store without a lock file", func() {
+			Expect(CheckLock(dir).Status).To(Equal(StatusOK))
+		})
+
+		It("should accept a store whose lock is released", func() {
+			newStore()
+			Expect(filepath.Join(dir, indexer.LockFilename)).To(BeAnExistingFile())
+			Expect(CheckLock(dir)).To(Equal(Result{
+				Name:    "lock",
+				Status:  StatusOK,
+				Message: "index is not locked",
+				Details: map[string]string{"path": filepath.Join(dir, indexer.LockFilename)},
+			}))
+		})
+
+		It("should report the process holding the lock", func() {
+			if !fsutil.FlockSupported {
+				Skip("advisory file locks are not supported")
+			}
+			l := newStore()
+
+			var result Result
+			Expect(l.Indexer().Modify(ctx, func(*ocispec.Index) error {
+				result = CheckLock(dir)
+				return nil
+			})).To(Succeed())
+			Expect(result.Status).To(Equal(StatusWarning))
+			Expect(result.Message).To(HavePrefix(fmt.Sprintf("index is locked by process %d", os.Getpid())))
+			Expect(result.Details).To(HaveKeyWithValue("pid", strconv.Itoa(os.Getpid())))
+
+			By("releasing the lock afterwards")
+			Expect(CheckLock(dir).Status).To(Equal(StatusOK))
+		})
+
+		It("should report an unknown holder of the lock", func() {
+			if !fsutil.FlockSupported {
+				Skip("advisory file locks are not supported")
+			}
+			f, err := os.Create(filepath.Join(dir, indexer.LockFilename))
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(f.Close)
+			locked, err := fsutil.TryFlock(f)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(locked).To(BeTrue())
+			DeferCleanup(fsutil.Funlock, f)
+
+			result := CheckLock(dir)
+			Expect(result.Status).To(Equal(StatusWarning))
+			Expect(result.Message).To(Equal("index is locked by an unknown process"))
+		})
+	})
+
+	Describe("CheckContent", func() {
+		It("should warn if the index does not exist yet", func() {
+			Expect(CheckContent(dir).Status).To(Equal(StatusWarning))
+		})
+
+		It("should report images and unreferenced blobs", func() {
+			newStore()
+			unreferenced := filepath.Join(dir, "blobs", "sha256", "0000000000000000000000000000000000000000000000000000000000000000")
+			Expect(os.WriteFile(unreferenced, nil, 0644)).To(Succeed())
+
+			result := CheckContent(dir)
+			Expect(result.Status).To(Equal(StatusOK))
+			Expect(result.Details).To(HaveKeyWithValue("images", "1"))
+			Expect(result.Details).To(HaveKeyWithValue("unreferencedBlobs", "1"))
+			Expect(result.Details).To(HaveKeyWithValue("missingManifests", "0"))
+		})
+
+		It("should fail on missing manifests", func() {
+			l := newStore()
+			index, err := l.Indexer().Index(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			dgst := index.Manifests[0].Digest
+			path := filepath.Join(dir, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+			Expect(os.Chmod(path, 0644)).To(Succeed())
+			Expect(os.Remove(path)).To(Succeed())
+
+			result := CheckContent(dir)
+			Expect(result.Status).To(Equal(StatusError))
+			Expect(result.Details).To(HaveKeyWithValue("missingManifests", "1"))
+		})
+	})
+
+	Describe("CheckBlobProtection", func() {
+		It("should report disabled blob protection", func() {
+			newStore()
+			result := CheckBlobProtection(dir, false)
+			Expect(result.Status).To(Equal(StatusOK))
+			Expect(result.Details).To(HaveKeyWithValue("enabled", "false"))
+			Expect(result.Details).To(HaveKeyWithValue("unprotectedBlobs", "0"))
+		})
+
+		It("should report the supported protections", func() {
+			newStore()
+			result := CheckBlobProtection(dir, true)
+			Expect(result.Status).NotTo(Equal(StatusError))
+			Expect(result.Details).To(HaveKey("fsverity"))
+			Expect(result.Details).To(HaveKey("immutable"))
+		})
+	})
+
+	Describe("registries", func() {
+		const (
+			username = "user"
+			password = "secret"
+		)
+		var (
+			registry   *httptest.Server
+			host       string
+			configPath string
+		)
+		BeforeEach(func() {
+			registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch user, pass, ok := r.BasicAuth(); {
+				case r.URL.Path != "/v2/":
+					w.WriteHeader(http.StatusNotFound)
+				case !ok || user != username || pass != password:
+					w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+					w.WriteHeader(http.StatusUnauthorized)
+				default:
+					w.WriteHeader(http.StatusOK)
+				}
+			}))
+			DeferCleanup(registry.Close)
+			u, err := url.Parse(registry.URL)
+			Expect(err).NotTo(HaveOccurred())
+			host = u.Host
+			configPath = filepath.Join(dir, "config.json")
+		})
+
+		writeConfig := func(host, username, password string) {
+			auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+			Expect(os.WriteFile(configPath, []byte(fmt.Sprintf(`{"auths":{%q:{"auth":%q}}}`, host, auth)), 0600)).To(Succeed())
+		}
+		credential := func(username, password string) func(string) (string, string, error) {
+			return func(string) (string, string, error) { return username, password, nil }
+		}
+
+		Describe("CheckRegistry", func() {
+			It("should accept a reachable registry accepting the credentials", func() {
+				result := CheckRegistry(ctx, host, credential(username, password), registry.Client())
+				Expect(result.Status).To(Equal(StatusOK))
+				Expect(result.Details).To(HaveKeyWithValue("url", registry.URL+"/v2/"))
+			})
+
+			It("should fail if the credentials are rejected", func() {
+				result := CheckRegistry(ctx, host, credential(username, "wrong"), registry.Client())
+				Expect(result.Status).To(Equal(StatusError))
+				Expect(result.Details).To(HaveKeyWithValue("status", "401 Unauthorized"))
+			})
+
+			It("should warn on unexpected responses", func() {
+				broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusInternalServerError)
+				}))
+				defer broken.Close()
+				u, err := url.Parse(broken.URL)
+				Expect(err).NotTo(HaveOccurred())
+
+				result := CheckRegistry(ctx, u.Host, credential("", ""), broken.Client())
+				Expect(result.Status).To(Equal(StatusWarning))
+				Expect(result.Message).To(ContainSubstring("500"))
+			})
+
+			It("should fail if the registry is not reachable", func() {
+				registry.Close()
+				result := CheckRegistry(ctx, host, credential(username, password), registry.Client())
+				Expect(result.Status).To(Equal(StatusError))
+				Expect(result.Message).To(HavePrefix("registry is not reachable"))
+			})
+		})
+
+		Describe("CheckRegistries", func() {
+			It("should report that no registries are configured", func() {
+				Expect(os.WriteFile(configPath, []byte(`{}`), 0600)).To(Succeed())
+				Expect(CheckRegistries(ctx, []string{configPath}, nil, registry.Client())).To(Equal([]Result{
+					{Name: "registries", Status: StatusOK, Message: "no registries configured"},
+				}))
+			})
+
+			It("should warn if the docker config cannot be loaded", func() {
+				Expect(os.WriteFile(configPath, []byte(`{`), 0600)).To(Succeed())
+				results := CheckRegistries(ctx, []string{configPath}, nil, registry.Client())
+				Expect(results).To(HaveLen(1))
+				Expect(results[0].Status).To(Equal(StatusWarning))
+			})
+
+			It("should check the configured registries with their credentials and settings", func() {
+				writeConfig(host, username, password)
+				results := CheckRegistries(ctx, []string{configPath}, &remote.HostsConfig{
+					Hosts: map[string]remote.HostSettings{"registry.invalid": {MaxConcurrentTransfers: 2}},
+				}, registry.Client())
+				Expect(results).To(HaveLen(2))
+
+				byName := make(map[string]Result)
+				for _, result := range results {
+					byName[result.Name] = result
+				}
+				Expect(byName).To(HaveKey("registry/" + host))
+				Expect(byName["registry/"+host].Status).To(Equal(StatusOK))
+				Expect(byName).To(HaveKey("registry/registry.invalid"))
+				Expect(byName["registry/registry.invalid"].Status).To(Equal(StatusError))
+				Expect(byName["registry/registry.invalid"].Details).To(HaveKeyWithValue("maxConcurrentTransfers", "2"))
+			})
+
+			It("should fail for registries rejecting the configured credentials", func() {
+				writeConfig(host, username, "wrong")
+				results := CheckRegistries(ctx, []string{configPath}, nil, registry.Client())
+				Expect(results).To(HaveLen(1))
+				Expect(results[0].Name).To(Equal("registry/" + host))
+				Expect(results[0].Status).To(Equal(StatusError))
+			})
+		})
+
+		Describe("Run", func() {
+			It("should run all checks", func() {
+				newStore()
+				writeConfig(host, username, password)
+				results := Run(ctx, Options{StorePath: dir, ConfigPaths: []string{configPath}, Client: registry.Client()})
+
+				var names []string
+				for _, result := range results {
+					names = append(names, result.Name)
+					if result.Name != "version" && result.Name != "file-system" && result.Name != "blob-protection" && result.Name != "proxy" {
+						Expect(result.Status).To(Equal(StatusOK), "%s: %s", result.Name, result.Message)
+					}
+				}
+				Expect(names).To(Equal([]string{
+					"version", "store-path", "file-system", "store-version", "disk-space", "index", "lock", "content",
+					"blob-protection", "proxy", "registry/" + host,
+				}))
+			})
+		})
+	})
+})
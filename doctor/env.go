@@ -0,0 +1,65 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doctor
+
+import (
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// CheckVersion reports version information of the running binary.
+func CheckVersion() Result {
+	const name = "version"
+	details := map[string]string{
+		"goVersion": runtime.Version(),
+		"platform":  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return warning(name, "no build information available", details)
+	}
+
+	details["module"] = info.Main.Path
+	details["version"] = info.Main.Version
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision", "vcs.time", "vcs.modified":
+			details[setting.Key] = setting.Value
+		}
+	}
+	return Result{Name: name, Status: StatusOK, Message: info.Main.Version, Details: details}
+}
+
+var proxyEnvVars = []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"}
+
+// CheckProxy reports the proxy settings in effect.
+func CheckProxy() Result {
+	const name = "proxy"
+	details := make(map[string]string)
+	for _, key := range proxyEnvVars {
+		for _, k := range []string{key, strings.ToLower(key)} {
+			if v, ok := os.LookupEnv(k); ok {
+				details[k] = v
+			}
+		}
+	}
+	if len(details) == 0 {
+		return ok(name, "no proxy configured", nil)
+	}
+	return ok(name, "proxy configured", details)
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doctor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/utils/fsutil"
+)
+
+// CheckLock reports whether the index of the store is locked and by which process. A lock that stays
+// held, e.g. by a hung process, blocks all modifications of the store.
+func CheckLock(storePath string) Result {
+	const name = "lock"
+	path := filepath.Join(storePath, indexer.LockFilename)
+	details := map[string]string{"path": path}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ok(name, "index is not locked", details)
+		}
+		return warning(name, fmt.Sprintf("could not open lock file: %v", err), details)
+	}
+	defer func() { _ = f.Close() }()
+
+	locked, err := fsutil.TryFlock(f)
+	switch {
+	case errors.Is(err, fsutil.ErrFlockNotSupported):
+		// The store falls back to lock files (see fsutil.TryLockFile), which are held while they exist.
+		holder := lockHolder(f, details)
+		stat, err := f.Stat()
+		if err != nil {
+			return warning(name, fmt.Sprintf("index is locked by %s", holder), details)
+		}
+		age := time.Since(stat.ModTime()).Round(time.Second)
+		details["age"] = age.String()
+		if age >= indexer.LockFileStaleAfter {
+			return warning(name, fmt.Sprintf("index is locked by %s for %s, the lock file is stale and will be taken over", holder, age), details)
+		}
+		return warning(name, fmt.Sprintf("index is locked by %s", holder), details)
+	case err != nil:
+		return warning(name, fmt.Sprintf("could not check lock: %v", err), details)
+	case locked:
+		_ = fsutil.Funlock(f)
+		return ok(name, "index is not locked", details)
+	default:
+		return warning(name, fmt.Sprintf("index is locked by %s", lockHolder(f, details)), details)
+	}
+}
+
+// lockHolder describes the process whose pid is recorded in the lock file and adds it to the details.
+func lockHolder(f *os.File, details map[string]string) string {
+	data, err := io.ReadAll(io.LimitReader(f, 64))
+	if err != nil {
+		return "an unknown process"
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return "an unknown process"
+	}
+	details["pid"] = strconv.Itoa(pid)
+
+	// Only available on Linux, and only for processes of the same pid namespace.
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil || len(cmdline) == 0 {
+		return fmt.Sprintf("process %d", pid)
+	}
+	command := strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	details["command"] = command
+	return fmt.Sprintf("process %d (%s)", pid, command)
+}
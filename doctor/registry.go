@@ -0,0 +1,215 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/remotes/docker"
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/onmetal/onmetal-image/oci/remote"
+	"github.com/onmetal/onmetal-image/utils/sets"
+	dockerauth "oras.land/oras-go/pkg/auth/docker"
+)
+
+func loadConfigFiles(configPaths []string) ([]*configfile.ConfigFile, error) {
+	if len(configPaths) == 0 {
+		return []*configfile.ConfigFile{dockerconfig.LoadDefaultConfigFile(io.Discard)}, nil
+	}
+
+	var res []*configfile.ConfigFile
+	for _, path := range configPaths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg, err := dockerconfig.LoadFromReader(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error loading docker config %s: %w", path, err)
+		}
+		res = append(res, cfg)
+	}
+	return res, nil
+}
+
+// normalizeHost converts a docker config server address to a registry host.
+func normalizeHost(address string) string {
+	address = strings.TrimPrefix(address, "https://")
+	address = strings.TrimPrefix(address, "http://")
+	host, _, _ := strings.Cut(address, "/")
+	if host == "index.docker.io" {
+		return "docker.io"
+	}
+	return host
+}
+
+// ConfiguredRegistries returns the registry hosts found in the given docker config paths.
+func ConfiguredRegistries(configPaths []string) ([]string, error) {
+	cfgs, err := loadConfigFiles(configPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := sets.New[string]()
+	for _, cfg := range cfgs {
+		for address := range cfg.AuthConfigs {
+			hosts.Insert(normalizeHost(address))
+		}
+		for address := range cfg.CredentialHelpers {
+			hosts.Insert(normalizeHost(address))
+		}
+	}
+
+	res := make([]string, 0, len(hosts))
+	for host := range hosts {
+		res = append(res, host)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// HostSettingsDetails returns the effective settings of the host as result details.
+func HostSettingsDetails(settings remote.HostSettings) map[string]string {
+	details := map[string]string{
+		"maxConcurrentTransfers": "unlimited",
+		"maxIdleConns":           "default",
+		"sharedTransferLimit":    strconv.FormatBool(settings.Shared),
+	}
+	if settings.MaxConcurrentTransfers > 0 {
+		details["maxConcurrentTransfers"] = strconv.Itoa(settings.MaxConcurrentTransfers)
+	}
+	if settings.MaxIdleConns > 0 {
+		details["maxIdleConns"] = strconv.Itoa(settings.MaxIdleConns)
+	}
+	return details
+}
+
+// CheckRegistries checks reachability and authentication of all registries found in the docker config
+// and the hosts config, reporting the effective settings of each of them.
+func CheckRegistries(ctx context.Context, configPaths []string, hostsConfig *remote.HostsConfig, client *http.Client) []Result {
+	const name = "registries"
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	hosts, err := ConfiguredRegistries(configPaths)
+	if err != nil {
+		return []Result{warning(name, fmt.Sprintf("could not load docker config: %v", err), nil)}
+	}
+	if hostsConfig != nil {
+		all := sets.New(hosts...)
+		for host := range hostsConfig.Hosts {
+			all.Insert(host)
+		}
+		hosts = make([]string, 0, len(all))
+		for host := range all {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+	}
+	if len(hosts) == 0 {
+		return []Result{ok(name, "no registries configured", nil)}
+	}
+
+	authClient, err := dockerauth.NewClient(configPaths...)
+	if err != nil {
+		return []Result{warning(name, fmt.Sprintf("could not create docker auth client: %v", err), nil)}
+	}
+	dockerClient, ok := authClient.(*dockerauth.Client)
+	if !ok {
+		return []Result{warning(name, fmt.Sprintf("unsupported docker auth client %T", authClient), nil)}
+	}
+	credential := dockerClient.Credential
+
+	res := make([]Result, 0, len(hosts))
+	for _, host := range hosts {
+		result := CheckRegistry(ctx, host, credential, client)
+		if result.Details == nil {
+			result.Details = make(map[string]string)
+		}
+		for key, value := range HostSettingsDetails(hostsConfig.Settings(host)) {
+			result.Details[key] = value
+		}
+		res = append(res, result)
+	}
+	return res
+}
+
+// CheckRegistry checks that the registry at the given host is reachable via HEAD /v2/ and that
+// the given credentials (if any) are accepted.
+func CheckRegistry(ctx context.Context, host string, credential func(host string) (string, string, error), client *http.Client) Result {
+	name := fmt.Sprintf("registry/%s", host)
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	authorizer := docker.NewDockerAuthorizer(
+		docker.WithAuthClient(client),
+		docker.WithAuthCreds(credential),
+	)
+	regs, err := docker.ConfigureDefaultRegistries(
+		docker.WithPlainHTTP(docker.MatchLocalhost),
+		docker.WithAuthorizer(authorizer),
+		docker.WithClient(client),
+	)(host)
+	if err != nil || len(regs) == 0 {
+		return failed(name, fmt.Sprintf("could not configure registry host: %v", err), nil)
+	}
+	reg := regs[0]
+
+	u := fmt.Sprintf("%s://%s%s/", reg.Scheme, reg.Host, reg.Path)
+	details := map[string]string{"url": u}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return failed(name, fmt.Sprintf("error creating request: %v", err), details)
+	}
+
+	var responses []*http.Response
+	for len(responses) < 2 {
+		if err := authorizer.Authorize(ctx, req); err != nil {
+			return failed(name, fmt.Sprintf("error authorizing request: %v", err), details)
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			return failed(name, fmt.Sprintf("registry is not reachable: %v", err), details)
+		}
+		_ = res.Body.Close()
+		details["status"] = res.Status
+
+		if res.StatusCode >= 200 && res.StatusCode < 300 {
+			return ok(name, "registry is reachable and credentials are accepted", details)
+		}
+		if res.StatusCode != http.StatusUnauthorized {
+			return warning(name, fmt.Sprintf("unexpected response status %s", res.Status), details)
+		}
+
+		responses = append(responses, res)
+		if err := authorizer.AddResponses(ctx, responses); err != nil {
+			return failed(name, fmt.Sprintf("registry is reachable but authentication failed: %v", err), details)
+		}
+	}
+	return failed(name, "registry is reachable but credentials were rejected", details)
+}
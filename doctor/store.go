@@ -0,0 +1,294 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doctor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/local"
+	"github.com/onmetal/onmetal-image/oci/migration"
+	"github.com/onmetal/onmetal-image/utils/fsutil"
+	"github.com/onmetal/onmetal-image/utils/sets"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// CheckStorePath checks that the store path is set and is a directory.
+func CheckStorePath(storePath string) Result {
+	const name = "store-path"
+	details := map[string]string{"path": storePath}
+	if storePath == "" {
+		return failed(name, "no store path configured", details)
+	}
+
+	stat, err := os.Stat(storePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return warning(name, "store path does not exist yet", details)
+		}
+		return failed(name, fmt.Sprintf("error statting store path: %v", err), details)
+	}
+	if !stat.IsDir() {
+		return failed(name, "store path is not a directory", details)
+	}
+	return ok(name, "store path is a directory", details)
+}
+
+// CheckFileSystem probes the capabilities of the file system of the store path the store relies on, see
+// fsutil.Probe.
+func CheckFileSystem(storePath string) Result {
+	const name = "file-system"
+	if _, err := os.Stat(storePath); err != nil {
+		return warning(name, fmt.Sprintf("could not probe file system: %v", err), nil)
+	}
+
+	capabilities, err := fsutil.Probe(storePath)
+	if err != nil {
+		return warning(name, fmt.Sprintf("could not probe file system: %v", err), nil)
+	}
+	details := map[string]string{
+		"flock":        strconv.FormatBool(capabilities.Flock),
+		"atomicRename": strconv.FormatBool(capabilities.AtomicRename),
+		"tmpFile":      strconv.FormatBool(capabilities.TmpFile),
+	}
+	if err := capabilities.Check(); err != nil {
+		return failed(name, fmt.Sprintf("file system cannot host a store: %v", err), details)
+	}
+	if limitations := capabilities.Limitations(); len(limitations) > 0 {
+		return warning(name, strings.Join(limitations, ", "), details)
+	}
+	return ok(name, capabilities.String(), details)
+}
+
+// CheckStoreVersion checks that the store has the format version of this release, see migration.Check.
+func CheckStoreVersion(storePath string) Result {
+	const name = "store-version"
+	version, exists, err := migration.ReadVersion(storePath)
+	if err != nil {
+		return failed(name, err.Error(), nil)
+	}
+	if !exists {
+		return ok(name, "no store yet", nil)
+	}
+
+	details := map[string]string{
+		"version":        strconv.Itoa(version),
+		"currentVersion": strconv.Itoa(migration.CurrentVersion),
+	}
+	switch {
+	case version > migration.CurrentVersion:
+		return failed(name, (&migration.VersionError{Path: storePath, Version: version}).Error(), details)
+	case version < migration.CurrentVersion:
+		return warning(name, (&migration.VersionError{Path: storePath, Version: version}).Error(), details)
+	default:
+		return ok(name, fmt.Sprintf("store has format version %d", version), details)
+	}
+}
+
+// CheckDiskSpace reports the free disk space available at the store path.
+func CheckDiskSpace(storePath string) Result {
+	const name = "disk-space"
+	path := storePath
+	// Walk up to the first existing directory, the store might not have been created yet.
+	for {
+		if _, err := os.Stat(path); err == nil || filepath.Dir(path) == path {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+
+	free, err := FreeBytes(path)
+	if err != nil {
+		return warning(name, fmt.Sprintf("could not determine free disk space: %v", err), nil)
+	}
+	return ok(name, fmt.Sprintf("%d bytes free", free), map[string]string{"freeBytes": strconv.FormatUint(free, 10)})
+}
+
+func readIndex(storePath string) (*ocispec.Index, error) {
+	data, err := os.ReadFile(filepath.Join(storePath, indexer.Filename))
+	if err != nil {
+		return nil, err
+	}
+
+	index := &ocispec.Index{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// CheckIndex checks that the index of the store is valid.
+func CheckIndex(storePath string) Result {
+	const name = "index"
+	index, err := readIndex(storePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return warning(name, "index does not exist yet", nil)
+		}
+		return failed(name, fmt.Sprintf("invalid index: %v", err), nil)
+	}
+
+	for _, desc := range index.Manifests {
+		if err := desc.Digest.Validate(); err != nil {
+			return failed(name, fmt.Sprintf("index contains invalid digest %q: %v", desc.Digest, err), nil)
+		}
+	}
+	return ok(name, "index is valid", map[string]string{"entries": strconv.Itoa(len(index.Manifests))})
+}
+
+func blobPath(blobDir string, dgst digest.Digest) string {
+	return filepath.Join(blobDir, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// CheckContent reports the number of images and unreferenced blobs in the store.
+func CheckContent(storePath string) Result {
+	const name = "content"
+	index, err := readIndex(storePath)
+	if err != nil {
+		return warning(name, fmt.Sprintf("could not read index: %v", err), nil)
+	}
+	blobDir, err := layout.BlobDir(storePath)
+	if err != nil {
+		return failed(name, fmt.Sprintf("invalid blob directory: %v", err), nil)
+	}
+
+	var (
+		images     = sets.New[digest.Digest]()
+		referenced = sets.New[digest.Digest]()
+		missing    int
+	)
+	for _, desc := range index.Manifests {
+		images.Insert(desc.Digest)
+		referenced.Insert(desc.Digest)
+
+		data, err := os.ReadFile(blobPath(blobDir, desc.Digest))
+		if err != nil {
+			missing++
+			continue
+		}
+
+		manifest := &ocispec.Manifest{}
+		if err := json.Unmarshal(data, manifest); err != nil {
+			continue
+		}
+		referenced.Insert(manifest.Config.Digest)
+		for _, layer := range manifest.Layers {
+			referenced.Insert(layer.Digest)
+		}
+	}
+
+	var unreferenced int
+	blobsDir := filepath.Join(blobDir, "blobs")
+	if err := filepath.WalkDir(blobsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == local.RelocatedIngestDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		alg := filepath.Base(filepath.Dir(path))
+		if !referenced.Has(digest.NewDigestFromEncoded(digest.Algorithm(alg), d.Name())) {
+			unreferenced++
+		}
+		return nil
+	}); err != nil && !os.IsNotExist(err) {
+		return warning(name, fmt.Sprintf("error walking blobs: %v", err), nil)
+	}
+
+	details := map[string]string{
+		"images":            strconv.Itoa(len(images)),
+		"unreferencedBlobs": strconv.Itoa(unreferenced),
+		"missingManifests":  strconv.Itoa(missing),
+	}
+	if path, err := fsutil.CanonicalPath(storePath); err == nil && blobDir != path {
+		details["blobDir"] = blobDir
+	}
+	if missing > 0 {
+		return failed(name, fmt.Sprintf("%d image manifests are missing from the store", missing), details)
+	}
+	return ok(name, fmt.Sprintf("%d images, %d unreferenced blobs", len(images), unreferenced), details)
+}
+
+// CheckBlobProtection reports how many blobs were committed with which protection and, if the store
+// protects committed blobs (see local.WithProtection), which protections the file system of the blob
+// directory supports. Since protecting blobs falls back silently, this is where a store whose blobs stay
+// unprotected shows up.
+func CheckBlobProtection(storePath string, enabled bool) Result {
+	const name = "blob-protection"
+	blobDir, err := layout.BlobDir(storePath)
+	if err != nil {
+		return failed(name, fmt.Sprintf("invalid blob directory: %v", err), nil)
+	}
+
+	counts := make(map[local.Protection]int)
+	if err := filepath.WalkDir(filepath.Join(blobDir, local.ProtectionRecordDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var info local.ProtectionInfo
+		if err := json.Unmarshal(data, &info); err == nil {
+			counts[info.Protection]++
+		}
+		return nil
+	}); err != nil && !os.IsNotExist(err) {
+		return warning(name, fmt.Sprintf("error walking protection records: %v", err), nil)
+	}
+	details := map[string]string{
+		"enabled":          strconv.FormatBool(enabled),
+		"fsverityBlobs":    strconv.Itoa(counts[local.ProtectionFSVerity]),
+		"immutableBlobs":   strconv.Itoa(counts[local.ProtectionImmutable]),
+		"unprotectedBlobs": strconv.Itoa(counts[local.ProtectionNone]),
+	}
+	if !enabled {
+		return ok(name, "blob protection is disabled", details)
+	}
+
+	if _, err := os.Stat(blobDir); err != nil {
+		return warning(name, fmt.Sprintf("could not probe file system: %v", err), details)
+	}
+	support, err := fsutil.ProbeProtection(blobDir)
+	if err != nil {
+		return warning(name, fmt.Sprintf("could not probe file system: %v", err), details)
+	}
+	details["fsverity"] = strconv.FormatBool(support.Verity)
+	details["immutable"] = strconv.FormatBool(support.Immutable)
+	switch {
+	case support.Verity && counts[local.ProtectionNone] == 0:
+		return ok(name, "committed blobs are protected with fsverity", details)
+	case support.Verity || support.Immutable:
+		if n := counts[local.ProtectionNone]; n > 0 {
+			return warning(name, fmt.Sprintf("%d blobs could not be protected", n), details)
+		}
+		return warning(name, "fsverity is not supported, committed blobs are only made immutable", details)
+	default:
+		return warning(name, "neither fsverity nor the immutable attribute are supported (or permitted), committed blobs are not protected", details)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// genschema generates the JSON Schema of the onmetal image config from onmetalimage.Config.
+// Field types and names are taken from the struct, descriptions from the doc comments of its fields and
+// constraints that cannot be expressed in Go types from the constraints table below.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+)
+
+type property struct {
+	Description string      `json:"description,omitempty"`
+	Type        string      `json:"type"`
+	Format      string      `json:"format,omitempty"`
+	Const       interface{} `json:"const,omitempty"`
+	Enum        []string    `json:"enum,omitempty"`
+	Pattern     string      `json:"pattern,omitempty"`
+	MaxLength   int         `json:"maxLength,omitempty"`
+}
+
+type document struct {
+	Schema               string               `json:"$schema"`
+	Title                string               `json:"title"`
+	Description          string               `json:"description"`
+	Type                 string               `json:"type"`
+	Properties           map[string]*property `json:"properties"`
+	AdditionalProperties bool                 `json:"additionalProperties"`
+}
+
+// constraints are the constraints of the config fields by JSON name beyond their type.
+// Empty values are allowed where the runtime treats them as unset.
+var constraints = map[string]property{
+	"schemaVersion": {Const: onmetalimage.ConfigSchemaVersion},
+	// The command line is additionally limited to onmetalimage.MaxCommandLineLength bytes, which
+	// maxLength cannot express as it counts characters.
+	"commandLine":   {Pattern: `^\P{Cc}*$`, MaxLength: onmetalimage.MaxCommandLineLength},
+	"provisioning":  {Enum: []string{"", string(onmetalimage.ProvisioningIgnition), string(onmetalimage.ProvisioningCloudInit)}},
+	"bootMethod":    {Enum: []string{"", string(onmetalimage.BootMethodKernel), string(onmetalimage.BootMethodUKI), string(onmetalimage.BootMethodESP)}},
+	"defaultRootFS": {Pattern: `^(rootfs(-.+)?)?$`},
+}
+
+func main() {
+	var (
+		output string
+		source string
+	)
+	flag.StringVar(&output, "o", "config.schema.json", "File to write the schema to.")
+	flag.StringVar(&source, "source", "image.go", "Go file declaring onmetalimage.Config, read for the field descriptions.")
+	flag.Parse()
+
+	if err := run(output, source); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(output, source string) error {
+	descriptions, err := fieldDescriptions(source, "Config")
+	if err != nil {
+		return err
+	}
+
+	doc := document{
+		Schema:      "https://json-schema.org/draft/2020-12/schema",
+		Title:       fmt.Sprintf("onmetal image config (schema version %d)", onmetalimage.ConfigSchemaVersion),
+		Description: fmt.Sprintf("Config blob of onmetal images (media type %s). Configs without schemaVersion are of schema version 1.", onmetalimage.ConfigMediaType),
+		Type:        "object",
+		Properties:  make(map[string]*property),
+	}
+
+	typ := reflect.TypeOf(onmetalimage.Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		prop := constraints[name]
+		prop.Description = descriptions[field.Name]
+		if prop.Type, prop.Format, err = jsonType(field.Type); err != nil {
+			return fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		doc.Properties[name] = &prop
+	}
+	for name := range constraints {
+		if _, ok := doc.Properties[name]; !ok {
+			return fmt.Errorf("constraints of unknown field %s", name)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("error encoding schema: %w", err)
+	}
+	return os.WriteFile(output, buf.Bytes(), 0644)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonType returns the JSON Schema type and format of values of the given Go type.
+func jsonType(typ reflect.Type) (string, string, error) {
+	if typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	switch {
+	case typ == timeType:
+		return "string", "date-time", nil
+	case typ.Kind() == reflect.String:
+		return "string", "", nil
+	case typ.Kind() >= reflect.Int && typ.Kind() <= reflect.Uint64:
+		return "integer", "", nil
+	case typ.Kind() == reflect.Bool:
+		return "boolean", "", nil
+	default:
+		return "", "", fmt.Errorf("unsupported type %s", typ)
+	}
+}
+
+// fieldDescriptions returns the doc comments of the fields of the named struct declared in the given file,
+// joined into single lines.
+func fieldDescriptions(filename, typeName string) (map[string]string, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), filename, nil, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", filename, err)
+	}
+
+	res := make(map[string]string)
+	ast.Inspect(file, func(node ast.Node) bool {
+		spec, ok := node.(*ast.TypeSpec)
+		if !ok || spec.Name.Name != typeName {
+			return true
+		}
+		st, ok := spec.Type.(*ast.StructType)
+		if !ok {
+			return false
+		}
+		for _, field := range st.Fields.List {
+			for _, name := range field.Names {
+				res[name.Name] = strings.Join(strings.Fields(field.Doc.Text()), " ")
+			}
+		}
+		return false
+	})
+	if len(res) == 0 {
+		return nil, fmt.Errorf("struct %s not found in %s", typeName, filename)
+	}
+	return res, nil
+}
@@ -16,40 +16,156 @@ package onmetalimage
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/containerd/containerd/remotes"
+	"github.com/onmetal/onmetal-image/mediatypes"
 	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 const (
 	ConfigMediaType         = "application/vnd.onmetal.image.config.v1alpha1+json"
-	RootFSLayerMediaType    = "application/vnd.onmetal.image.rootfs.v1alpha1.rootfs"
-	InitRAMFSLayerMediaType = "application/vnd.onmetal.image.initramfs.v1alpha1.initramfs"
-	KernelLayerMediaType    = "application/vnd.onmetal.image.vmlinuz.v1alpha1.vmlinuz"
+	RootFSLayerMediaType    = mediatypes.RootFSLayer
+	InitRAMFSLayerMediaType = mediatypes.InitRAMFSLayer
+	KernelLayerMediaType    = mediatypes.KernelLayer
+	// IgnitionLayerMediaType is the media type of an ignition config provisioning the machine.
+	IgnitionLayerMediaType = mediatypes.IgnitionLayer
+	// CloudInitLayerMediaType is the media type of cloud-init user-data provisioning the machine.
+	CloudInitLayerMediaType = mediatypes.CloudInitLayer
+	// UKILayerMediaType is the media type of a unified kernel image (a PE/COFF EFI binary bundling kernel,
+	// initramfs and command line) or another EFI bootloader, see ValidateUKI.
+	UKILayerMediaType = mediatypes.UKILayer
+	// ESPLayerMediaType is the media type of an EFI system partition image (FAT), see ValidateESP.
+	ESPLayerMediaType = mediatypes.ESPLayer
 )
 
+// Suffixes of layer media types denoting layers stored compressed, e.g. a rootfs built with
+// --keep-compressed from a .tar.gz has media type RootFSLayerMediaType + GzipMediaTypeSuffix.
+const (
+	GzipMediaTypeSuffix = "+gzip"
+	ZstdMediaTypeSuffix = "+zstd"
+	XzMediaTypeSuffix   = "+xz"
+)
+
+// LayerMediaType returns the given layer media type without its compression suffix, if any.
+func LayerMediaType(mediaType string) string {
+	for _, suffix := range []string{GzipMediaTypeSuffix, ZstdMediaTypeSuffix, XzMediaTypeSuffix} {
+		if strings.HasSuffix(mediaType, suffix) {
+			return strings.TrimSuffix(mediaType, suffix)
+		}
+	}
+	return mediaType
+}
+
+// BootMethod is the way an image expects to be booted.
+type BootMethod string
+
+const (
+	// BootMethodKernel denotes booting the kernel and initramfs layers directly. It is the default if
+	// the config denotes no boot method.
+	BootMethodKernel BootMethod = "kernel"
+	// BootMethodUKI denotes booting the EFI binary of the UKI layer, see UKILayerMediaType.
+	BootMethodUKI BootMethod = "uki"
+	// BootMethodESP denotes booting from the EFI system partition of the ESP layer, see ESPLayerMediaType.
+	BootMethodESP BootMethod = "esp"
+)
+
+// ErrNoUEFILayer is matched by the image.LayerNotPresentError returned if an image has no UEFI layer of
+// the requested kind.
+var ErrNoUEFILayer = errors.New("image has no uefi layer")
+
+// Provisioning is a provisioning system a provisioning layer of an image targets.
+type Provisioning string
+
+const (
+	// ProvisioningIgnition denotes an ignition config, see IgnitionLayerMediaType.
+	ProvisioningIgnition Provisioning = "ignition"
+	// ProvisioningCloudInit denotes cloud-init user-data, see CloudInitLayerMediaType.
+	ProvisioningCloudInit Provisioning = "cloud-init"
+)
+
+// provisioningMediaTypes maps the provisioning systems to the media types of their layers.
+var provisioningMediaTypes = map[Provisioning]string{
+	ProvisioningIgnition:  IgnitionLayerMediaType,
+	ProvisioningCloudInit: CloudInitLayerMediaType,
+}
+
+// ProvisioningLayerMediaType returns the layer media type of the given provisioning system.
+func ProvisioningLayerMediaType(provisioning Provisioning) (string, bool) {
+	mediaType, ok := provisioningMediaTypes[provisioning]
+	return mediaType, ok
+}
+
+// ErrNoProvisioningLayer is matched by the image.LayerNotPresentError returned if an image has no
+// provisioning layer of the requested kind.
+var ErrNoProvisioningLayer = errors.New("image has no provisioning layer")
+
+const (
+	// FSTypeAnnotation is the layer annotation denoting the file system type of the layer content (e.g. squashfs).
+	FSTypeAnnotation = "image.onmetal.de/fs-type"
+	// UncompressedSizeAnnotation is the layer annotation denoting the size of the layer content after decompression.
+	UncompressedSizeAnnotation = "image.onmetal.de/uncompressed-size"
+)
+
+// MaxCommandLineLength is the maximum length of a kernel command line in bytes (COMMAND_LINE_SIZE on x86).
+const MaxCommandLineLength = 2048
+
 type Config struct {
+	// SchemaVersion is the version of the config schema the config conforms to, see ConfigSchemaVersion.
+	// Configs without one are of schema version 1.
+	SchemaVersion int `json:"schemaVersion,omitempty"`
+	// CommandLine are the arguments to supply to the kernel. See ValidateCommandLine.
 	CommandLine string `json:"commandLine,omitempty"`
+	// Provisioning is the provisioning system the provisioning layer of the image targets, if it has one.
+	Provisioning Provisioning `json:"provisioning,omitempty"`
+	// BootMethod is the way the image expects to be booted. Empty means BootMethodKernel.
+	BootMethod BootMethod `json:"bootMethod,omitempty"`
+	// DefaultRootFS is the role of the rootfs layer consumers use by default if the image has several,
+	// e.g. rootfs-a of an image for an A/B partition scheme. See RoleAnnotation.
+	DefaultRootFS string `json:"defaultRootFS,omitempty"`
+	// Created is the time the image was built, like the created field of OCI image configs.
+	// Images built by older versions may not record it, see imageutil.ConfigCreated.
+	Created *time.Time `json:"created,omitempty"`
 }
 
-func readImageConfig(ctx context.Context, img image.Image) (*Config, error) {
-	configLayer, err := img.Config(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("error getting config layer: %w", err)
+// ValidateCommandLine checks that the kernel command line contains no control characters and does not exceed
+// MaxCommandLineLength.
+func ValidateCommandLine(commandLine string) error {
+	if len(commandLine) > MaxCommandLineLength {
+		return fmt.Errorf("command line is %d bytes long, at most %d are allowed", len(commandLine), MaxCommandLineLength)
+	}
+	for i, r := range commandLine {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("command line contains control character %U at offset %d", r, i)
+		}
 	}
+	return nil
+}
 
-	rc, err := configLayer.Content(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("error getting config content: %w", err)
+// AppendCommandLine appends the given arguments to the kernel command line, separated by single spaces.
+func AppendCommandLine(commandLine string, args ...string) string {
+	parts := make([]string, 0, len(args)+1)
+	for _, part := range append([]string{commandLine}, args...) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
 	}
-	defer func() { _ = rc.Close() }()
+	return strings.Join(parts, " ")
+}
 
-	// TODO: Parse Config depending on configLayer.Descriptor().MediaType
+// ReadConfig reads the onmetal image config of the given image via an image.Accessor, verifying it against
+// its descriptor and image.DefaultLimits. Pass an image.Accessor to share its cache.
+func ReadConfig(ctx context.Context, img image.Image) (*Config, error) {
+	// TODO: Parse Config depending on the media type of the config descriptor
 	config := &Config{}
-	if err := json.NewDecoder(rc).Decode(config); err != nil {
-		return nil, fmt.Errorf("error decoding config: %w", err)
+	if err := image.Access(img, image.DefaultLimits).DecodeConfig(ctx, config); err != nil {
+		return nil, err
 	}
 	return config, nil
 }
@@ -60,6 +176,10 @@ func SetupContext(ctx context.Context) context.Context {
 	ctx = remotes.WithMediaTypeKeyPrefix(ctx, RootFSLayerMediaType, "layer-")
 	ctx = remotes.WithMediaTypeKeyPrefix(ctx, InitRAMFSLayerMediaType, "layer-")
 	ctx = remotes.WithMediaTypeKeyPrefix(ctx, KernelLayerMediaType, "layer-")
+	ctx = remotes.WithMediaTypeKeyPrefix(ctx, IgnitionLayerMediaType, "layer-")
+	ctx = remotes.WithMediaTypeKeyPrefix(ctx, CloudInitLayerMediaType, "layer-")
+	ctx = remotes.WithMediaTypeKeyPrefix(ctx, UKILayerMediaType, "layer-")
+	ctx = remotes.WithMediaTypeKeyPrefix(ctx, ESPLayerMediaType, "layer-")
 	return ctx
 }
 
@@ -67,7 +187,7 @@ func SetupContext(ctx context.Context) context.Context {
 func ResolveImage(ctx context.Context, ociImg image.Image) (*Image, error) {
 	ctx = SetupContext(ctx)
 
-	config, err := readImageConfig(ctx, ociImg)
+	config, err := ReadConfig(ctx, ociImg)
 	if err != nil {
 		return nil, err
 	}
@@ -77,44 +197,269 @@ func ResolveImage(ctx context.Context, ociImg image.Image) (*Image, error) {
 		return nil, fmt.Errorf("error getting image layers: %w", err)
 	}
 
-	img := Image{Config: *config}
+	var (
+		dgst    = ociImg.Descriptor().Digest
+		img     = Image{Digest: dgst, Config: *config}
+		rootFSs []RoleLayer
+		seen    = make(map[string]bool)
+	)
+	// set sets the single layer of the given kind, failing if the image has several.
+	set := func(field *image.Layer, kind string, layer image.Layer) error {
+		role := LayerRole(layer.Descriptor())
+		if *field != nil {
+			return &image.AmbiguousLayerError{Digest: dgst, Role: kind, Candidates: []string{LayerRole((*field).Descriptor()), role}}
+		}
+		*field = layer
+		return nil
+	}
 	for _, layer := range layers {
-		switch layer.Descriptor().MediaType {
+		role := LayerRole(layer.Descriptor())
+		if annotated := layer.Descriptor().Annotations[RoleAnnotation]; annotated != "" {
+			mediaType, ok := RoleMediaType(annotated)
+			if !ok || mediaType != LayerMediaType(layer.Descriptor().MediaType) {
+				return nil, fmt.Errorf("role %q of layer %s does not match its media type %s", annotated, layer.Descriptor().Digest, layer.Descriptor().MediaType)
+			}
+			if seen[annotated] {
+				return nil, &image.AmbiguousLayerError{Digest: dgst, Role: annotated, Candidates: []string{annotated, annotated}}
+			}
+			seen[annotated] = true
+		}
+		if role != "" {
+			img.Layers = append(img.Layers, RoleLayer{Role: role, Layer: layer})
+		}
+
+		var err error
+		switch LayerMediaType(layer.Descriptor().MediaType) {
 		case InitRAMFSLayerMediaType:
-			img.InitRAMFs = layer
+			err = set(&img.InitRAMFs, "initramfs", layer)
 		case KernelLayerMediaType:
-			img.Kernel = layer
+			err = set(&img.Kernel, "kernel", layer)
 		case RootFSLayerMediaType:
-			img.RootFS = layer
+			rootFSs = append(rootFSs, RoleLayer{Role: role, Layer: layer})
+		case IgnitionLayerMediaType, CloudInitLayerMediaType:
+			err = set(&img.Provisioning, "provisioning", layer)
+		case UKILayerMediaType, ESPLayerMediaType:
+			err = set(&img.UEFI, "uefi", layer)
 		default:
-			return nil, fmt.Errorf("unknown layer type %q", layer.Descriptor().MediaType)
+			// Layers of custom registered media types are only accessible by their role.
+			if _, ok := mediatypes.Lookup(layer.Descriptor().MediaType); !ok {
+				return nil, fmt.Errorf("unknown layer type %q", layer.Descriptor().MediaType)
+			}
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
+	if err := validateBootMethod(img.Config.BootMethod, img.UEFI); err != nil {
+		return nil, err
+	}
+	rootFS, warning, err := resolveRootFS(img.Config, rootFSs)
+	if err != nil {
+		return nil, err
+	}
+	img.RootFS = rootFS
+	if warning != "" {
+		img.Warnings = append(img.Warnings, warning)
+	}
 	var missing []string
 	if img.RootFS == nil {
 		missing = append(missing, "rootfs")
 	}
-	if img.Kernel == nil {
-		missing = append(missing, "kernel")
-	}
-	if img.InitRAMFs == nil {
-		missing = append(missing, "initramfs")
+	// Kernel and initramfs are bundled into the UEFI payload when booting it.
+	if img.BootMethod() == BootMethodKernel {
+		if img.Kernel == nil {
+			missing = append(missing, "kernel")
+		}
+		if img.InitRAMFs == nil {
+			missing = append(missing, "initramfs")
+		}
 	}
 	if len(missing) > 0 {
-		return nil, fmt.Errorf("incomplete image: components are missing: %v", missing)
+		errs := make([]error, 0, len(missing))
+		for _, role := range missing {
+			info, _ := mediatypes.LookupRole(role)
+			errs = append(errs, &image.LayerNotPresentError{Digest: dgst, Role: role, MediaType: info.MediaType, Available: img.roles()})
+		}
+		return nil, fmt.Errorf("incomplete image: %w", errors.Join(errs...))
+	}
+	if err := validateProvisioning(img.Config.Provisioning, img.Provisioning); err != nil {
+		return nil, err
 	}
 
 	return &img, nil
 }
 
+// validateProvisioning checks that the provisioning system of the config matches the provisioning layer.
+func validateProvisioning(provisioning Provisioning, layer image.Layer) error {
+	if provisioning == "" {
+		return nil
+	}
+	mediaType, ok := ProvisioningLayerMediaType(provisioning)
+	if !ok {
+		return fmt.Errorf("unknown provisioning system %q", provisioning)
+	}
+	if layer == nil {
+		return fmt.Errorf("config denotes provisioning via %s but the image has no provisioning layer", provisioning)
+	}
+	if LayerMediaType(layer.Descriptor().MediaType) != mediaType {
+		return fmt.Errorf("config denotes provisioning via %s but the provisioning layer has media type %s", provisioning, layer.Descriptor().MediaType)
+	}
+	return nil
+}
+
+// validateBootMethod checks that the UEFI layer matches the boot method of the config.
+// Images booting the kernel directly may carry a UEFI layer as additional payload.
+func validateBootMethod(method BootMethod, layer image.Layer) error {
+	var mediaType string
+	switch method {
+	case "", BootMethodKernel:
+		return nil
+	case BootMethodUKI:
+		mediaType = UKILayerMediaType
+	case BootMethodESP:
+		mediaType = ESPLayerMediaType
+	default:
+		return fmt.Errorf("unknown boot method %q", method)
+	}
+	if layer == nil {
+		return fmt.Errorf("config denotes boot method %s but the image has no uefi layer", method)
+	}
+	if LayerMediaType(layer.Descriptor().MediaType) != mediaType {
+		return fmt.Errorf("config denotes boot method %s but the uefi layer has media type %s", method, layer.Descriptor().MediaType)
+	}
+	return nil
+}
+
+// ProvisioningLayer returns the ignition or cloud-init layer of the given image. It fails with an
+// image.LayerNotPresentError matching ErrNoProvisioningLayer if it has none and with an
+// image.AmbiguousLayerError if it has several. Unlike ResolveImage, the image does not need to be a
+// complete onmetal image.
+func ProvisioningLayer(ctx context.Context, img image.Image) (image.Layer, error) {
+	return findLayer(ctx, img, "provisioning", ErrNoProvisioningLayer, IgnitionLayerMediaType, CloudInitLayerMediaType)
+}
+
+// IgnitionLayer returns the ignition layer of the given image, see ProvisioningLayer.
+func IgnitionLayer(ctx context.Context, img image.Image) (image.Layer, error) {
+	return findLayer(ctx, img, "ignition", ErrNoProvisioningLayer, IgnitionLayerMediaType)
+}
+
+// UKILayer returns the unified kernel image layer of the given image. It fails with an
+// image.LayerNotPresentError matching ErrNoUEFILayer if it has none and with an image.AmbiguousLayerError
+// if it has several.
+func UKILayer(ctx context.Context, img image.Image) (image.Layer, error) {
+	return findLayer(ctx, img, "uki", ErrNoUEFILayer, UKILayerMediaType)
+}
+
+// ESPLayer returns the EFI system partition layer of the given image, see UKILayer.
+func ESPLayer(ctx context.Context, img image.Image) (image.Layer, error) {
+	return findLayer(ctx, img, "esp", ErrNoUEFILayer, ESPLayerMediaType)
+}
+
+// findLayer returns the single layer of the image with one of the given media types. If there is none,
+// it fails with an image.LayerNotPresentError for the role matching notPresent, if there are several with
+// an image.AmbiguousLayerError.
+func findLayer(ctx context.Context, img image.Image, role string, notPresent error, mediaTypes ...string) (image.Layer, error) {
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting image layers: %w", err)
+	}
+	var found []RoleLayer
+	for _, layer := range layers {
+		for _, mediaType := range mediaTypes {
+			if LayerMediaType(layer.Descriptor().MediaType) == mediaType {
+				found = append(found, RoleLayer{Role: LayerRole(layer.Descriptor()), Layer: layer})
+			}
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		err := &image.LayerNotPresentError{
+			Digest:    img.Descriptor().Digest,
+			Role:      role,
+			Available: AvailableRoles(layerDescriptors(layers)),
+			Err:       notPresent,
+		}
+		if len(mediaTypes) == 1 {
+			err.MediaType = mediaTypes[0]
+		}
+		return nil, err
+	case 1:
+		return found[0].Layer, nil
+	}
+	return nil, &image.AmbiguousLayerError{Digest: img.Descriptor().Digest, Role: role, Candidates: roles(found)}
+}
+
 // Image is an onmetal image.
 type Image struct {
+	// Digest is the digest of the manifest the image was resolved from.
+	Digest digest.Digest
 	// Config holds additional configuration for a machine / machine pool using the image.
 	Config Config
-	// RootFS is the layer containing the root file system.
+	// RootFS is the layer containing the root file system. If the image has several, it is the one denoted
+	// by Config.DefaultRootFS, see LayersByRole for all of them.
 	RootFS image.Layer
 	// InitRAMFs is the layer containing the initramfs / initrd.
 	InitRAMFs image.Layer
 	// Kernel is the layer containing the kernel.
 	Kernel image.Layer
+	// Provisioning is the optional layer containing an ignition config or cloud-init user-data, see
+	// Config.Provisioning. Nil if the image has none.
+	Provisioning image.Layer
+	// UEFI is the optional layer containing a unified kernel image or an EFI system partition, see
+	// Config.BootMethod. Nil if the image has none.
+	UEFI image.Layer
+	// Layers are all layers of the image with their role in the order of the manifest, which is the order
+	// consumers apply them in.
+	Layers []RoleLayer
+	// Warnings are ambiguities consumers of the single-layer fields run into, e.g. several rootfs layers
+	// without a default rootfs.
+	Warnings []string
+}
+
+// BootMethod returns the way the image expects to be booted, defaulting to BootMethodKernel.
+func (i *Image) BootMethod() BootMethod {
+	if i.Config.BootMethod == "" {
+		return BootMethodKernel
+	}
+	return i.Config.BootMethod
+}
+
+// UKILayer returns the unified kernel image layer of the image, or an image.LayerNotPresentError matching
+// ErrNoUEFILayer if it has none.
+func (i *Image) UKILayer(ctx context.Context) (image.Layer, error) {
+	if i.UEFI == nil || LayerMediaType(i.UEFI.Descriptor().MediaType) != UKILayerMediaType {
+		return nil, &image.LayerNotPresentError{
+			Digest:    i.Digest,
+			Role:      "uki",
+			MediaType: UKILayerMediaType,
+			Available: i.roles(),
+			Err:       ErrNoUEFILayer,
+		}
+	}
+	return i.UEFI, nil
+}
+
+// roles returns the roles of the layers of the image in order.
+func (i *Image) roles() []string {
+	res := make([]string, 0, len(i.Layers))
+	for _, layer := range i.Layers {
+		res = append(res, layer.Role)
+	}
+	return res
+}
+
+// LayerPriority ranks the blobs of an image for transfer when pulling, higher first: The config and the
+// small boot-critical kernel, initramfs and UKI layers come before provisioning and ESP layers, which in
+// turn come before the large rootfs layer, so a consumer can start preparing the boot while the rootfs
+// is still transferring.
+func LayerPriority(desc ocispec.Descriptor) int {
+	switch LayerMediaType(desc.MediaType) {
+	case ConfigMediaType, KernelLayerMediaType, InitRAMFSLayerMediaType, UKILayerMediaType:
+		return 2
+	case RootFSLayerMediaType:
+		return 0
+	default:
+		return 1
+	}
 }
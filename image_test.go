@@ -74,6 +74,40 @@ var _ = Describe("Image", func() {
 			Expect(imageutil.ReadLayerContent(ctx, res.InitRAMFs)).To(Equal(initramfsData))
 		})
 
+		It("should preserve layer annotations", func() {
+			By("creating an image with an annotated rootfs layer")
+			annotations := map[string]string{FSTypeAnnotation: "squashfs"}
+			annotatedRootFSLayer := imageutil.BytesLayer(rootfsData,
+				imageutil.WithMediaType(RootFSLayerMediaType),
+				imageutil.WithAnnotations(annotations),
+			)
+			img, err := imageutil.NewBuilder(configLayer).
+				Layers(kernelLayer, initramfsLayer, annotatedRootFSLayer).
+				Complete()
+			Expect(err).NotTo(HaveOccurred())
+
+			By("resolving the image")
+			res, err := ResolveImage(ctx, img)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("inspecting the rootfs layer annotations")
+			Expect(res.RootFS.Descriptor().Annotations).To(Equal(annotations))
+		})
+
+		It("should resolve layers stored compressed", func() {
+			By("creating an image with a gzip compressed rootfs layer")
+			compressedRootFSLayer := imageutil.BytesLayer(rootfsData, imageutil.WithMediaType(RootFSLayerMediaType+GzipMediaTypeSuffix))
+			img, err := imageutil.NewBuilder(configLayer).
+				Layers(kernelLayer, initramfsLayer, compressedRootFSLayer).
+				Complete()
+			Expect(err).NotTo(HaveOccurred())
+
+			By("resolving the image")
+			res, err := ResolveImage(ctx, img)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.RootFS.Descriptor().MediaType).To(Equal(RootFSLayerMediaType + GzipMediaTypeSuffix))
+		})
+
 		It("should error if the image contains invalid layers", func() {
 			By("creating an image with an additional invalid layer")
 			invalidLayer := imageutil.BytesLayer([]byte("invalid"))
@@ -87,6 +121,95 @@ var _ = Describe("Image", func() {
 			Expect(err).To(HaveOccurred())
 		})
 
+		It("should resolve an optional provisioning layer", func() {
+			By("resolving an image without provisioning layer")
+			res, err := ResolveImage(ctx, img)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Provisioning).To(BeNil())
+
+			By("creating an image with an ignition layer")
+			c, err := imageutil.JSONValueLayer(Config{Provisioning: ProvisioningIgnition}, imageutil.WithMediaType(ConfigMediaType))
+			Expect(err).NotTo(HaveOccurred())
+			ignitionLayer := imageutil.BytesLayer([]byte(`{"ignition":{}}`), imageutil.WithMediaType(IgnitionLayerMediaType))
+			img, err := imageutil.NewBuilder(c).
+				Layers(kernelLayer, initramfsLayer, rootfsLayer, ignitionLayer).
+				Complete()
+			Expect(err).NotTo(HaveOccurred())
+
+			res, err = ResolveImage(ctx, img)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Config.Provisioning).To(Equal(ProvisioningIgnition))
+			Expect(imageutil.ReadLayerContent(ctx, res.Provisioning)).To(Equal([]byte(`{"ignition":{}}`)))
+
+			By("getting the ignition layer via the accessor")
+			layer, err := IgnitionLayer(ctx, img)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(layer.Descriptor()).To(Equal(ignitionLayer.Descriptor()))
+		})
+
+		It("should error if the provisioning layer does not match the config", func() {
+			c, err := imageutil.JSONValueLayer(Config{Provisioning: ProvisioningIgnition}, imageutil.WithMediaType(ConfigMediaType))
+			Expect(err).NotTo(HaveOccurred())
+			cloudInitLayer := imageutil.BytesLayer([]byte("#cloud-config"), imageutil.WithMediaType(CloudInitLayerMediaType))
+			img, err := imageutil.NewBuilder(c).
+				Layers(kernelLayer, initramfsLayer, rootfsLayer, cloudInitLayer).
+				Complete()
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = ResolveImage(ctx, img)
+			Expect(err).To(HaveOccurred())
+
+			_, err = IgnitionLayer(ctx, img)
+			Expect(err).To(MatchError(ErrNoProvisioningLayer))
+			layer, err := ProvisioningLayer(ctx, img)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(layer.Descriptor().MediaType).To(Equal(CloudInitLayerMediaType))
+		})
+
+		It("should resolve an image booting a unified kernel image", func() {
+			c, err := imageutil.JSONValueLayer(Config{BootMethod: BootMethodUKI}, imageutil.WithMediaType(ConfigMediaType))
+			Expect(err).NotTo(HaveOccurred())
+			ukiLayer := imageutil.BytesLayer([]byte("uki"), imageutil.WithMediaType(UKILayerMediaType))
+			ukiImg, err := imageutil.NewBuilder(c).
+				Layers(rootfsLayer, ukiLayer).
+				Complete()
+			Expect(err).NotTo(HaveOccurred())
+
+			res, err := ResolveImage(ctx, ukiImg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.BootMethod()).To(Equal(BootMethodUKI))
+			Expect(res.Kernel).To(BeNil())
+			layer, err := res.UKILayer(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(imageutil.ReadLayerContent(ctx, layer)).To(Equal([]byte("uki")))
+
+			By("resolving an image without uefi layer")
+			res, err = ResolveImage(ctx, img)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.BootMethod()).To(Equal(BootMethodKernel))
+			_, err = res.UKILayer(ctx)
+			Expect(err).To(MatchError(ErrNoUEFILayer))
+		})
+
+		It("should error if the uefi layer does not match the boot method", func() {
+			c, err := imageutil.JSONValueLayer(Config{BootMethod: BootMethodUKI}, imageutil.WithMediaType(ConfigMediaType))
+			Expect(err).NotTo(HaveOccurred())
+			espLayer := imageutil.BytesLayer([]byte("esp"), imageutil.WithMediaType(ESPLayerMediaType))
+			img, err := imageutil.NewBuilder(c).
+				Layers(rootfsLayer, espLayer).
+				Complete()
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = ResolveImage(ctx, img)
+			Expect(err).To(HaveOccurred())
+
+			_, err = UKILayer(ctx, img)
+			Expect(err).To(MatchError(ErrNoUEFILayer))
+			layer, err := ESPLayer(ctx, img)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(layer.Descriptor().MediaType).To(Equal(ESPLayerMediaType))
+		})
+
 		It("should error if the image is missing layers", func() {
 			By("creating an image with the kernel layer missing")
 			img, err := imageutil.NewBuilder(configLayer).
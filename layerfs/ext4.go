@@ -0,0 +1,410 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layerfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+const (
+	ext4SuperblockOffset = 1024
+	ext4Magic            = 0xef53
+	ext4RootInode        = 2
+
+	ext4IncompatCompression = 0x1
+	ext4IncompatMetaBG      = 0x10
+	ext4Incompat64Bit       = 0x80
+	ext4IncompatEncrypt     = 0x10000
+
+	ext4FlagExtents    = 0x80000
+	ext4FlagInlineData = 0x10000000
+
+	ext4ExtentMagic = 0xf30a
+	// ext4InlineSize is the size of the block map or extent tree root in the inode, which also holds
+	// fast symbolic links and inline data.
+	ext4InlineSize = 60
+)
+
+// ext4 reads an ext2, ext3 or ext4 file system image.
+type ext4 struct {
+	r              io.ReaderAt
+	blockSize      int64
+	inodeSize      int64
+	inodesPerGroup uint32
+	groupDescSize  int64
+	groupDescStart int64
+	is64Bit        bool
+}
+
+// ext4Inode is the file system specific information of a node of an ext4 file system.
+type ext4Inode struct {
+	flags uint32
+	block [ext4InlineSize]byte
+}
+
+func newExt4(r io.ReaderAt) (*inodeFileSystem, error) {
+	sb := make([]byte, 1024)
+	if err := readFull(r, sb, ext4SuperblockOffset); err != nil {
+		return nil, fmt.Errorf("error reading ext4 superblock: %w", err)
+	}
+	if binary.LittleEndian.Uint16(sb[56:]) != ext4Magic {
+		return nil, fmt.Errorf("invalid ext4 superblock magic")
+	}
+
+	incompat := binary.LittleEndian.Uint32(sb[96:])
+	for feature, name := range map[uint32]string{
+		ext4IncompatCompression: "compression",
+		ext4IncompatMetaBG:      "meta_bg",
+		ext4IncompatEncrypt:     "encrypt",
+	} {
+		if incompat&feature != 0 {
+			return nil, fmt.Errorf("%w: ext4 file system with feature %s", ErrUnsupportedFormat, name)
+		}
+	}
+
+	logBlockSize := binary.LittleEndian.Uint32(sb[24:])
+	if logBlockSize > 6 {
+		return nil, fmt.Errorf("invalid ext4 block size 2^%d KiB", logBlockSize)
+	}
+	e := &ext4{
+		r:              r,
+		blockSize:      1024 << logBlockSize,
+		inodeSize:      128,
+		inodesPerGroup: binary.LittleEndian.Uint32(sb[40:]),
+		groupDescSize:  32,
+		is64Bit:        incompat&ext4Incompat64Bit != 0,
+	}
+	if e.inodesPerGroup == 0 {
+		return nil, fmt.Errorf("invalid ext4 superblock: no inodes per group")
+	}
+	if binary.LittleEndian.Uint32(sb[76:]) >= 1 {
+		e.inodeSize = int64(binary.LittleEndian.Uint16(sb[88:]))
+	}
+	if e.is64Bit {
+		if size := int64(binary.LittleEndian.Uint16(sb[254:])); size >= 32 {
+			e.groupDescSize = size
+		}
+	}
+	// The group descriptors start in the block following the superblock.
+	firstDataBlock := int64(binary.LittleEndian.Uint32(sb[20:]))
+	e.groupDescStart = (firstDataBlock + 1) * e.blockSize
+	return &inodeFileSystem{e}, nil
+}
+
+func (e *ext4) rootID() uint64 {
+	return ext4RootInode
+}
+
+func (e *ext4) stat(id uint64) (*node, error) {
+	if id == 0 || id > uint64(^uint32(0)) {
+		return nil, fmt.Errorf("invalid inode number %d", id)
+	}
+	ino := uint32(id)
+
+	group, index := int64((ino-1)/e.inodesPerGroup), int64((ino-1)%e.inodesPerGroup)
+	desc := make([]byte, e.groupDescSize)
+	if err := readFull(e.r, desc, e.groupDescStart+group*e.groupDescSize); err != nil {
+		return nil, fmt.Errorf("error reading group descriptor %d: %w", group, err)
+	}
+	table := int64(binary.LittleEndian.Uint32(desc[8:]))
+	if e.is64Bit && e.groupDescSize >= 64 {
+		table |= int64(binary.LittleEndian.Uint32(desc[0x28:])) << 32
+	}
+
+	raw := make([]byte, e.inodeSize)
+	if err := readFull(e.r, raw, table*e.blockSize+index*e.inodeSize); err != nil {
+		return nil, fmt.Errorf("error reading inode %d: %w", ino, err)
+	}
+
+	in := &ext4Inode{flags: binary.LittleEndian.Uint32(raw[32:])}
+	copy(in.block[:], raw[40:40+ext4InlineSize])
+	n := &node{
+		Entry: Entry{
+			Mode:    fileMode(uint32(binary.LittleEndian.Uint16(raw[0:]))),
+			Size:    int64(binary.LittleEndian.Uint32(raw[4:])) | int64(binary.LittleEndian.Uint32(raw[108:]))<<32,
+			ModTime: time.Unix(int64(binary.LittleEndian.Uint32(raw[16:])), 0),
+			UID:     int(binary.LittleEndian.Uint16(raw[2:])) | int(binary.LittleEndian.Uint16(raw[120:]))<<16,
+			GID:     int(binary.LittleEndian.Uint16(raw[24:])) | int(binary.LittleEndian.Uint16(raw[122:]))<<16,
+		},
+		sys: in,
+	}
+	if n.Mode&fs.ModeSymlink != 0 {
+		target, err := e.readLink(n)
+		if err != nil {
+			return nil, err
+		}
+		n.Linkname = target
+	}
+	return n, nil
+}
+
+func (e *ext4) readDir(dir *node) ([]dirent, error) {
+	in := dir.sys.(*ext4Inode)
+
+	var data []byte
+	if in.flags&ext4FlagInlineData != 0 {
+		// Inline directories start with the inode number of the parent instead of . and .. entries.
+		data = in.block[4:]
+	} else {
+		r, err := e.open(dir)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(r); err != nil {
+			return nil, fmt.Errorf("error reading directory: %w", err)
+		}
+	}
+
+	var dirents []dirent
+	for off := 0; off+8 <= len(data); {
+		var (
+			ino     = binary.LittleEndian.Uint32(data[off:])
+			recLen  = int(binary.LittleEndian.Uint16(data[off+4:]))
+			nameLen = int(data[off+6])
+		)
+		if recLen < 8 || off+recLen > len(data) || 8+nameLen > recLen {
+			return nil, fmt.Errorf("corrupt directory entry at offset %d", off)
+		}
+		// Entries of removed files, htree index nodes and checksum tails have inode number 0.
+		if name := string(data[off+8 : off+8+nameLen]); ino != 0 && name != "." && name != ".." {
+			dirents = append(dirents, dirent{name: name, id: uint64(ino)})
+		}
+		off += recLen
+	}
+	return dirents, nil
+}
+
+func (e *ext4) readLink(n *node) (string, error) {
+	in := n.sys.(*ext4Inode)
+	// Fast symbolic links store their target in place of the block map.
+	if in.flags&ext4FlagExtents == 0 && n.Size < ext4InlineSize {
+		return string(in.block[:n.Size]), nil
+	}
+
+	r, err := e.open(n)
+	if err != nil {
+		return "", err
+	}
+	target, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("error reading symbolic link: %w", err)
+	}
+	return string(target), nil
+}
+
+func (e *ext4) open(n *node) (io.Reader, error) {
+	in := n.sys.(*ext4Inode)
+	if in.flags&ext4FlagInlineData != 0 {
+		if n.Size > ext4InlineSize {
+			return nil, fmt.Errorf("%w: inline data exceeding the inode", ErrUnsupportedFormat)
+		}
+		return bytes.NewReader(in.block[:n.Size]), nil
+	}
+
+	var (
+		segments []segment
+		err      error
+	)
+	if in.flags&ext4FlagExtents != 0 {
+		segments, err = e.extents(in.block[:], 0)
+	} else {
+		segments, err = e.blockMap(in, (n.Size+e.blockSize-1)/e.blockSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &segmentReader{r: e.r, segments: segments, size: n.Size}, nil
+}
+
+// extents returns the segments of the extent tree node.
+func (e *ext4) extents(data []byte, depth int) ([]segment, error) {
+	if depth > 5 {
+		return nil, fmt.Errorf("extent tree too deep")
+	}
+	if len(data) < 12 || binary.LittleEndian.Uint16(data[0:]) != ext4ExtentMagic {
+		return nil, fmt.Errorf("invalid extent header")
+	}
+	entries := int(binary.LittleEndian.Uint16(data[2:]))
+	if 12+12*entries > len(data) {
+		return nil, fmt.Errorf("invalid extent header: %d entries exceed the node", entries)
+	}
+
+	var (
+		leaf     = binary.LittleEndian.Uint16(data[6:]) == 0
+		segments []segment
+	)
+	for i := 0; i < entries; i++ {
+		entry := data[12+12*i : 24+12*i]
+		if leaf {
+			length := int64(binary.LittleEndian.Uint16(entry[4:]))
+			if length > 32768 {
+				// Uninitialized extents read as zeros, like holes.
+				continue
+			}
+			start := int64(binary.LittleEndian.Uint16(entry[6:]))<<32 | int64(binary.LittleEndian.Uint32(entry[8:]))
+			segments = append(segments, segment{
+				logical:  int64(binary.LittleEndian.Uint32(entry[0:])) * e.blockSize,
+				physical: start * e.blockSize,
+				length:   length * e.blockSize,
+			})
+			continue
+		}
+
+		block := int64(binary.LittleEndian.Uint16(entry[8:]))<<32 | int64(binary.LittleEndian.Uint32(entry[4:]))
+		child := make([]byte, e.blockSize)
+		if err := readFull(e.r, child, block*e.blockSize); err != nil {
+			return nil, fmt.Errorf("error reading extent tree node: %w", err)
+		}
+		childSegments, err := e.extents(child, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, childSegments...)
+	}
+	return segments, nil
+}
+
+// blockMap returns the segments of the first blocks of the (ext2 and ext3 style) block map of the inode.
+func (e *ext4) blockMap(in *ext4Inode, blocks int64) ([]segment, error) {
+	var (
+		segments []segment
+		logical  int64
+	)
+	add := func(physical int64) {
+		if physical != 0 {
+			if last := len(segments) - 1; last >= 0 &&
+				segments[last].logical+segments[last].length == logical*e.blockSize &&
+				segments[last].physical+segments[last].length == physical*e.blockSize {
+				segments[last].length += e.blockSize
+			} else {
+				segments = append(segments, segment{logical: logical * e.blockSize, physical: physical * e.blockSize, length: e.blockSize})
+			}
+		}
+		logical++
+	}
+
+	perBlock := e.blockSize / 4
+	var walk func(block int64, level int) error
+	walk = func(block int64, level int) error {
+		span := int64(1)
+		for i := 0; i < level; i++ {
+			span *= perBlock
+		}
+		if block == 0 {
+			// A hole covering all blocks referenced by the indirect block.
+			logical += span
+			return nil
+		}
+		if level == 0 {
+			add(block)
+			return nil
+		}
+
+		data := make([]byte, e.blockSize)
+		if err := readFull(e.r, data, block*e.blockSize); err != nil {
+			return fmt.Errorf("error reading indirect block: %w", err)
+		}
+		for i := int64(0); i < perBlock && logical < blocks; i++ {
+			if err := walk(int64(binary.LittleEndian.Uint32(data[4*i:])), level-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i := 0; i < 15 && logical < blocks; i++ {
+		level := 0
+		if i >= 12 {
+			level = i - 11
+		}
+		if err := walk(int64(binary.LittleEndian.Uint32(in.block[4*i:])), level); err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
+
+// segment maps a range of the content of a file to its location in the image.
+type segment struct {
+	logical, physical, length int64
+}
+
+// segmentReader reads a file consisting of the given segments, sorted by their logical offset.
+// Ranges not covered by a segment read as zeros.
+type segmentReader struct {
+	r        io.ReaderAt
+	segments []segment
+	size     int64
+	off      int64
+}
+
+func (s *segmentReader) Read(p []byte) (int, error) {
+	if s.off >= s.size {
+		return 0, io.EOF
+	}
+	if remaining := s.size - s.off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	for len(s.segments) > 0 && s.segments[0].logical+s.segments[0].length <= s.off {
+		s.segments = s.segments[1:]
+	}
+
+	if len(s.segments) == 0 || s.segments[0].logical > s.off {
+		end := s.size
+		if len(s.segments) > 0 && s.segments[0].logical < end {
+			end = s.segments[0].logical
+		}
+		if hole := end - s.off; int64(len(p)) > hole {
+			p = p[:hole]
+		}
+		for i := range p {
+			p[i] = 0
+		}
+		s.off += int64(len(p))
+		return len(p), nil
+	}
+
+	seg := s.segments[0]
+	if remaining := seg.logical + seg.length - s.off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := s.r.ReadAt(p, seg.physical+s.off-seg.logical)
+	s.off += int64(n)
+	if errors.Is(err, io.EOF) {
+		if n < len(p) {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// readFull reads len(p) bytes at off, failing if the image ends before.
+func readFull(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
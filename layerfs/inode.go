@@ -0,0 +1,217 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layerfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+// node is a file of an inode based file system image.
+type node struct {
+	Entry
+	// sys is the file system specific information needed to read the file.
+	sys interface{}
+}
+
+// dirent is a directory entry of an inode based file system image.
+type dirent struct {
+	name string
+	id   uint64
+}
+
+// inodeFS is an inode based file system image, such as ext4 or squashfs.
+type inodeFS interface {
+	// rootID returns the id of the root directory.
+	rootID() uint64
+	// stat returns the file with the given id.
+	stat(id uint64) (*node, error)
+	// readDir returns the entries of the directory, excluding . and ...
+	readDir(dir *node) ([]dirent, error)
+	// readLink returns the target of the symbolic link.
+	readLink(n *node) (string, error)
+	// open returns a reader for the content of the regular file.
+	open(n *node) (io.Reader, error)
+}
+
+// inodeFileSystem implements fileSystem for an inodeFS.
+type inodeFileSystem struct {
+	fsys inodeFS
+}
+
+func (f *inodeFileSystem) cat(ctx context.Context, name string, w io.Writer) error {
+	n, err := f.resolve(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case n.Mode.IsDir():
+		return pathError("cat", name, ErrIsDir)
+	case !n.Mode.IsRegular():
+		return pathError("cat", name, fmt.Errorf("not a regular file (%s)", n.Mode.Type()))
+	}
+
+	r, err := f.fsys.open(n)
+	if err != nil {
+		return pathError("cat", name, err)
+	}
+	if _, err := io.Copy(w, contextReader{ctx, r}); err != nil {
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+	return nil
+}
+
+func (f *inodeFileSystem) list(ctx context.Context, name string) ([]Entry, error) {
+	n, err := f.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.Mode.IsDir() {
+		n.Name = path.Base(name)
+		return []Entry{n.Entry}, nil
+	}
+
+	dirents, err := f.fsys.readDir(n)
+	if err != nil {
+		return nil, pathError("list", name, err)
+	}
+	entries := make([]Entry, 0, len(dirents))
+	for _, d := range dirents {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		child, err := f.fsys.stat(d.id)
+		if err != nil {
+			return nil, pathError("list", name, fmt.Errorf("error reading %s: %w", d.name, err))
+		}
+		child.Name = d.name
+		entries = append(entries, child.Entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// resolve returns the file at name, following symbolic links including the last component.
+func (f *inodeFileSystem) resolve(name string) (*node, error) {
+	root, err := f.fsys.stat(f.fsys.rootID())
+	if err != nil {
+		return nil, fmt.Errorf("error reading root directory: %w", err)
+	}
+
+	var (
+		// dirs are the directories from the root to the current one, for resolving "..".
+		dirs  = []*node{root}
+		parts = splitPath(name)
+		links int
+	)
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+
+		cur := dirs[len(dirs)-1]
+		if part == ".." {
+			if len(dirs) > 1 {
+				dirs = dirs[:len(dirs)-1]
+			}
+			continue
+		}
+		if !cur.Mode.IsDir() {
+			return nil, pathError("open", name, ErrNotDir)
+		}
+
+		child, err := f.lookup(cur, part)
+		if err != nil {
+			return nil, pathError("open", name, err)
+		}
+		if child.Mode&fs.ModeSymlink == 0 {
+			dirs = append(dirs, child)
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return nil, pathError("open", name, fmt.Errorf("too many levels of symbolic links"))
+		}
+		target, err := f.fsys.readLink(child)
+		if err != nil {
+			return nil, pathError("open", name, err)
+		}
+		if len(target) > 0 && target[0] == '/' {
+			dirs = dirs[:1]
+		}
+		parts = append(splitPath(target), parts...)
+	}
+	return dirs[len(dirs)-1], nil
+}
+
+// lookup returns the entry of the directory with the given name.
+func (f *inodeFileSystem) lookup(dir *node, name string) (*node, error) {
+	dirents, err := f.fsys.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirents {
+		if d.name == name {
+			return f.fsys.stat(d.id)
+		}
+	}
+	return nil, fs.ErrNotExist
+}
+
+// fileMode converts the type and permission bits of a unix mode to a fs.FileMode.
+func fileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0o777)
+	if mode&0o4000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		m |= fs.ModeSticky
+	}
+
+	switch mode & 0o170000 {
+	case 0o040000:
+		m |= fs.ModeDir
+	case 0o120000:
+		m |= fs.ModeSymlink
+	case 0o020000:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case 0o060000:
+		m |= fs.ModeDevice
+	case 0o010000:
+		m |= fs.ModeNamedPipe
+	case 0o140000:
+		m |= fs.ModeSocket
+	}
+	return m
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
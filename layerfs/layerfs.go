@@ -0,0 +1,201 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package layerfs reads single files and directory listings from rootfs layers without extracting them.
+//
+// Tar archives (optionally gzip or zstd compressed) are streamed until the requested entry is found.
+// Uncompressed ext4 and squashfs images are read in place, fetching only the blocks needed from the
+// blob, if the layer supports random access (see image.RandomAccessLayer).
+package layerfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/onmetal/onmetal-image/disk"
+	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/unpack"
+)
+
+var (
+	// ErrUnsupportedFormat is returned if the content of a layer is in a format that cannot be read.
+	ErrUnsupportedFormat = errors.New("unsupported layer format")
+	// ErrIsDir is returned by Cat if the path names a directory.
+	ErrIsDir = errors.New("is a directory")
+	// ErrNotDir is returned if a path component other than the last is not a directory.
+	ErrNotDir = errors.New("not a directory")
+)
+
+// maxSymlinks is the maximum number of symbolic links followed when resolving a path.
+const maxSymlinks = 40
+
+// headerSize is the number of leading bytes needed to detect the format of a layer, see disk.Detect.
+const headerSize = 68 * 1024
+
+// Entry describes a file of a layer.
+type Entry struct {
+	// Name is the base name of the file.
+	Name string
+	// Mode are the type and permission bits of the file.
+	Mode fs.FileMode
+	// Size is the size of a regular file or symbolic link in bytes.
+	Size int64
+	// ModTime is the modification time of the file.
+	ModTime time.Time
+	// UID and GID are the numeric owner and group of the file.
+	UID, GID int
+	// Linkname is the target of a symbolic link.
+	Linkname string
+}
+
+// Cat writes the content of the regular file at name to w. Symbolic links are followed within the layer.
+func Cat(ctx context.Context, layer image.Layer, name string, w io.Writer) error {
+	return withFileSystem(ctx, layer, func(fsys fileSystem) error {
+		return fsys.cat(ctx, clean(name), w)
+	})
+}
+
+// List returns the entries of the directory at name sorted by name. If name is no directory, only
+// its own entry is returned. Symbolic links are followed within the layer.
+func List(ctx context.Context, layer image.Layer, name string) ([]Entry, error) {
+	var entries []Entry
+	err := withFileSystem(ctx, layer, func(fsys fileSystem) error {
+		var err error
+		entries, err = fsys.list(ctx, clean(name))
+		return err
+	})
+	return entries, err
+}
+
+// fileSystem is the content of a layer in one of the supported formats.
+type fileSystem interface {
+	cat(ctx context.Context, name string, w io.Writer) error
+	list(ctx context.Context, name string) ([]Entry, error)
+}
+
+// clean returns the absolute, lexically cleaned form of the path name.
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+// withFileSystem detects the format of the layer and calls fn with a fileSystem reading it.
+func withFileSystem(ctx context.Context, layer image.Layer, fn func(fsys fileSystem) error) error {
+	if layer, ok := layer.(image.RandomAccessLayer); ok {
+		ra, err := layer.ReaderAt(ctx)
+		if err != nil {
+			return fmt.Errorf("error opening layer: %w", err)
+		}
+		defer func() { _ = ra.Close() }()
+
+		header := make([]byte, headerSize)
+		n, err := ra.ReadAt(header, 0)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("error reading layer: %w", err)
+		}
+		header = header[:n]
+
+		if _, compression, err := unpack.DetectCompression(bytes.NewReader(header)); err == nil && compression == unpack.CompressionNone {
+			switch kind, fsType := disk.Detect(header); {
+			case kind == disk.KindFileSystem && fsType == "ext4":
+				fsys, err := newExt4(ra)
+				if err != nil {
+					return err
+				}
+				return fn(fsys)
+			case kind == disk.KindFileSystem && fsType == "squashfs":
+				fsys, err := newSquashFS(ra)
+				if err != nil {
+					return err
+				}
+				return fn(fsys)
+			}
+		}
+	}
+
+	open := func() (io.ReadCloser, error) {
+		rc, err := layer.Content(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error getting layer content: %w", err)
+		}
+		return rc, nil
+	}
+	if err := detectTar(open); err != nil {
+		return err
+	}
+	return fn(&tarFS{open: open})
+}
+
+// detectTar returns an error naming the detected format if the content is no (compressed) tar archive.
+func detectTar(open func() (io.ReadCloser, error)) error {
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rc.Close() }()
+
+	r, compression, err := unpack.DetectCompression(rc)
+	if err != nil {
+		return err
+	}
+	dr, err := unpack.Decompress(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
+	}
+	defer func() { _ = dr.Close() }()
+
+	br := bufio.NewReaderSize(dr, headerSize)
+	header, err := br.Peek(headerSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error reading layer: %w", err)
+	}
+
+	switch kind, fsType := disk.Detect(header); {
+	case kind == disk.KindArchive:
+		return nil
+	case kind == disk.KindFileSystem && compression != unpack.CompressionNone:
+		return fmt.Errorf("%w: %s compressed %s file system, only uncompressed file system images can be read in place", ErrUnsupportedFormat, compression, fsType)
+	case kind == disk.KindFileSystem && (fsType == "ext4" || fsType == "squashfs"):
+		return fmt.Errorf("%w: %s file system in a layer without random access", ErrUnsupportedFormat, fsType)
+	case kind == disk.KindFileSystem:
+		return fmt.Errorf("%w: %s file system, only ext4 and squashfs are supported", ErrUnsupportedFormat, fsType)
+	case kind == disk.KindDisk:
+		return fmt.Errorf("%w: partitioned disk image", ErrUnsupportedFormat)
+	default:
+		return fmt.Errorf("%w: neither a tar archive nor a file system image", ErrUnsupportedFormat)
+	}
+}
+
+// pathError returns an *fs.PathError for the operation on name.
+func pathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// splitPath splits the path name into its non-empty components.
+func splitPath(name string) []string {
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
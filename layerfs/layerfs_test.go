@@ -0,0 +1,256 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layerfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/fs"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/onmetal/onmetal-image/layerfs"
+	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// big is the content of a file spanning several blocks.
+var big = func() []byte {
+	data := make([]byte, 20000)
+	_, _ = rand.New(rand.NewSource(1)).Read(data)
+	return data
+}()
+
+var _ = Describe("LayerFS", func() {
+	var ctx context.Context
+
+	BeforeEach(func() {
+		ctx = context.Background()
+	})
+
+	cat := func(layer image.Layer, name string) ([]byte, error) {
+		var buf bytes.Buffer
+		err := layerfs.Cat(ctx, layer, name, &buf)
+		return buf.Bytes(), err
+	}
+
+	names := func(entries []layerfs.Entry) []string {
+		res := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			res = append(res, entry.Name)
+		}
+		return res
+	}
+
+	// itReadsTheTree checks reading the tree of files all layer formats are built from:
+	// /big, /etc/os-release -> ../usr/lib/os-release, /lib -> usr/lib and /usr/lib/os-release.
+	itReadsTheTree := func(layer func() image.Layer) {
+		It("should read files and follow symbolic links", func() {
+			Expect(cat(layer(), "/usr/lib/os-release")).To(Equal([]byte("NAME=Test\n")))
+			Expect(cat(layer(), "etc/os-release")).To(Equal([]byte("NAME=Test\n")))
+			Expect(cat(layer(), "/lib/os-release")).To(Equal([]byte("NAME=Test\n")))
+			Expect(cat(layer(), "/big")).To(Equal(big))
+		})
+
+		It("should list directories", func() {
+			entries, err := layerfs.List(ctx, layer(), "/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names(entries)).To(ContainElements("big", "etc", "lib", "usr"))
+
+			entries, err = layerfs.List(ctx, layer(), "/etc")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Name).To(Equal("os-release"))
+			Expect(entries[0].Mode & fs.ModeSymlink).NotTo(BeZero())
+			Expect(entries[0].Linkname).To(Equal("../usr/lib/os-release"))
+
+			entries, err = layerfs.List(ctx, layer(), "/lib")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names(entries)).To(Equal([]string{"os-release"}))
+			Expect(entries[0].Size).To(BeEquivalentTo(len("NAME=Test\n")))
+		})
+
+		It("should list the entry of a file", func() {
+			entries, err := layerfs.List(ctx, layer(), "/big")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Name).To(Equal("big"))
+			Expect(entries[0].Mode.IsRegular()).To(BeTrue())
+			Expect(entries[0].Size).To(BeEquivalentTo(len(big)))
+		})
+
+		It("should fail for missing files and directories", func() {
+			_, err := cat(layer(), "/etc/missing")
+			Expect(err).To(MatchError(fs.ErrNotExist))
+			_, err = cat(layer(), "/etc")
+			Expect(err).To(MatchError(layerfs.ErrIsDir))
+			_, err = cat(layer(), "/big/file")
+			Expect(err).To(HaveOccurred())
+			_, err = layerfs.List(ctx, layer(), "/missing")
+			Expect(err).To(MatchError(fs.ErrNotExist))
+		})
+	}
+
+	Context("tar archives", func() {
+		var data []byte
+
+		BeforeEach(func() {
+			var buf bytes.Buffer
+			gw := gzip.NewWriter(&buf)
+			tw := tar.NewWriter(gw)
+			for _, hdr := range []*tar.Header{
+				{Name: "./", Typeflag: tar.TypeDir, Mode: 0o755},
+				{Name: "./big", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(big))},
+				{Name: "./etc/os-release", Typeflag: tar.TypeSymlink, Linkname: "../usr/lib/os-release"},
+				{Name: "./lib", Typeflag: tar.TypeSymlink, Linkname: "usr/lib"},
+				{Name: "./usr/lib/release", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len("NAME=Test\n"))},
+				{Name: "./usr/lib/os-release", Typeflag: tar.TypeLink, Linkname: "./usr/lib/release"},
+			} {
+				Expect(tw.WriteHeader(hdr)).To(Succeed())
+				switch hdr.Name {
+				case "./big":
+					_, _ = tw.Write(big)
+				case "./usr/lib/release":
+					_, _ = tw.Write([]byte("NAME=Test\n"))
+				}
+			}
+			Expect(tw.Close()).To(Succeed())
+			Expect(gw.Close()).To(Succeed())
+			data = buf.Bytes()
+		})
+
+		It("should read files and follow symbolic and hard links", func() {
+			layer := imageutil.BytesLayer(data)
+			Expect(cat(layer, "/usr/lib/os-release")).To(Equal([]byte("NAME=Test\n")))
+			Expect(cat(layer, "etc/os-release")).To(Equal([]byte("NAME=Test\n")))
+			Expect(cat(layer, "/lib/os-release")).To(Equal([]byte("NAME=Test\n")))
+			Expect(cat(layer, "/big")).To(Equal(big))
+		})
+
+		It("should list directories without entries of their own", func() {
+			entries, err := layerfs.List(ctx, imageutil.BytesLayer(data), "/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names(entries)).To(Equal([]string{"big", "etc", "lib", "usr"}))
+			Expect(entries[1].Mode.IsDir()).To(BeTrue())
+
+			entries, err = layerfs.List(ctx, imageutil.BytesLayer(data), "/lib")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names(entries)).To(Equal([]string{"os-release", "release"}))
+		})
+
+		It("should fail for missing files and directories", func() {
+			layer := imageutil.BytesLayer(data)
+			_, err := cat(layer, "/etc/missing")
+			Expect(err).To(MatchError(fs.ErrNotExist))
+			_, err = cat(layer, "/usr")
+			Expect(err).To(MatchError(layerfs.ErrIsDir))
+			_, err = layerfs.List(ctx, layer, "/missing")
+			Expect(err).To(MatchError(fs.ErrNotExist))
+		})
+	})
+
+	Context("ext4 images", func() {
+		var path string
+
+		BeforeEach(func() {
+			mkfs, err := exec.LookPath("mkfs.ext4")
+			if err != nil {
+				Skip("requires mkfs.ext4")
+			}
+
+			dir := GinkgoT().TempDir()
+			root := filepath.Join(dir, "root")
+			Expect(os.MkdirAll(filepath.Join(root, "etc"), 0o755)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(root, "usr", "lib"), 0o755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(root, "usr", "lib", "os-release"), []byte("NAME=Test\n"), 0o644)).To(Succeed())
+			Expect(os.Symlink("../usr/lib/os-release", filepath.Join(root, "etc", "os-release"))).To(Succeed())
+			Expect(os.Symlink("usr/lib", filepath.Join(root, "lib"))).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(root, "big"), big, 0o644)).To(Succeed())
+
+			path = filepath.Join(dir, "rootfs.ext4")
+			Expect(os.WriteFile(path, nil, 0o644)).To(Succeed())
+			Expect(os.Truncate(path, 4<<20)).To(Succeed())
+			out, err := exec.Command(mkfs, "-q", "-F", "-d", root, path).CombinedOutput()
+			Expect(err).NotTo(HaveOccurred(), string(out))
+		})
+
+		itReadsTheTree(func() image.Layer {
+			layer, err := imageutil.FileLayer(path)
+			Expect(err).NotTo(HaveOccurred())
+			return layer
+		})
+
+		It("should not read compressed file system images", func() {
+			data, err := os.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			var buf bytes.Buffer
+			gw := gzip.NewWriter(&buf)
+			_, _ = gw.Write(data)
+			Expect(gw.Close()).To(Succeed())
+
+			_, err = cat(imageutil.BytesLayer(buf.Bytes()), "/big")
+			Expect(err).To(MatchError(layerfs.ErrUnsupportedFormat))
+			Expect(err.Error()).To(ContainSubstring("gzip compressed ext4"))
+		})
+	})
+
+	Context("squashfs images", func() {
+		var data []byte
+
+		BeforeEach(func() {
+			bigFile := squashFSFile(big)
+			bigFile.fragment = true
+			bigFile.uid = 1
+			data = buildSquashFS(squashFSDir(map[string]*squashFSNode{
+				"big": bigFile,
+				"etc": squashFSDir(map[string]*squashFSNode{
+					"os-release": squashFSSymlink("../usr/lib/os-release"),
+				}),
+				"lib": squashFSSymlink("usr/lib"),
+				"usr": squashFSDir(map[string]*squashFSNode{
+					"lib": squashFSDir(map[string]*squashFSNode{
+						"os-release": squashFSFile([]byte("NAME=Test\n")),
+					}),
+				}),
+			}), 4096)
+		})
+
+		itReadsTheTree(func() image.Layer {
+			return imageutil.BytesLayer(data)
+		})
+
+		It("should map the owner of files by the id table", func() {
+			entries, err := layerfs.List(ctx, imageutil.BytesLayer(data), "/big")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries[0].UID).To(Equal(1000))
+			Expect(entries[0].GID).To(Equal(0))
+		})
+	})
+
+	It("should name unsupported file systems", func() {
+		data := make([]byte, 128*1024)
+		copy(data, "XFSB")
+
+		_, err := cat(imageutil.BytesLayer(data), "/etc/os-release")
+		Expect(err).To(MatchError(layerfs.ErrUnsupportedFormat))
+		Expect(err.Error()).To(ContainSubstring("xfs file system"))
+	})
+})
@@ -0,0 +1,484 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layerfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	squashFSMagic        = 0x73717368
+	squashFSMetadataSize = 8192
+
+	squashFSCompressionGzip = 1
+	squashFSCompressionZstd = 6
+
+	squashFSUncompressedMetadata = 0x8000
+	squashFSUncompressedBlock    = 1 << 24
+	squashFSNoFragment           = 0xffffffff
+)
+
+// squashFSCompressions are the names of the squashfs compression algorithms by their id.
+var squashFSCompressions = map[uint16]string{
+	1: "gzip",
+	2: "lzma",
+	3: "lzo",
+	4: "xz",
+	5: "lz4",
+	6: "zstd",
+}
+
+// squashFSTypes maps the squashfs inode types (basic and extended) to the unix file type bits.
+var squashFSTypes = map[uint16]uint32{
+	1: 0o040000, 8: 0o040000,
+	2: 0o100000, 9: 0o100000,
+	3: 0o120000, 10: 0o120000,
+	4: 0o060000, 11: 0o060000,
+	5: 0o020000, 12: 0o020000,
+	6: 0o010000, 13: 0o010000,
+	7: 0o140000, 14: 0o140000,
+}
+
+// squashFS reads a squashfs (version 4) file system image.
+type squashFS struct {
+	r           io.ReaderAt
+	blockSize   int64
+	compression uint16
+	root        uint64
+	inodeTable  int64
+	dirTable    int64
+	fragTable   int64
+	fragCount   uint32
+	ids         []uint32
+	fragments   []byte
+	metadata    map[int64]*metadataBlock
+	zstd        *zstd.Decoder
+}
+
+// squashFSDir is the file system specific information of a directory of a squashfs file system.
+type squashFSDir struct {
+	start  int64
+	offset int
+	size   int64
+}
+
+// squashFSFile is the file system specific information of a regular file of a squashfs file system.
+type squashFSFile struct {
+	start      int64
+	fragment   uint32
+	fragOffset int64
+	blocks     []uint32
+}
+
+// squashFSSymlink is the file system specific information of a symbolic link of a squashfs file system.
+type squashFSSymlink struct {
+	target string
+}
+
+func newSquashFS(r io.ReaderAt) (*inodeFileSystem, error) {
+	sb := make([]byte, 96)
+	if err := readFull(r, sb, 0); err != nil {
+		return nil, fmt.Errorf("error reading squashfs superblock: %w", err)
+	}
+	if binary.LittleEndian.Uint32(sb[0:]) != squashFSMagic {
+		return nil, fmt.Errorf("invalid squashfs superblock magic")
+	}
+	if major, minor := binary.LittleEndian.Uint16(sb[28:]), binary.LittleEndian.Uint16(sb[30:]); major != 4 || minor != 0 {
+		return nil, fmt.Errorf("%w: squashfs version %d.%d", ErrUnsupportedFormat, major, minor)
+	}
+
+	s := &squashFS{
+		r:           r,
+		blockSize:   int64(binary.LittleEndian.Uint32(sb[12:])),
+		compression: binary.LittleEndian.Uint16(sb[20:]),
+		root:        binary.LittleEndian.Uint64(sb[32:]),
+		inodeTable:  int64(binary.LittleEndian.Uint64(sb[64:])),
+		dirTable:    int64(binary.LittleEndian.Uint64(sb[72:])),
+		fragTable:   int64(binary.LittleEndian.Uint64(sb[80:])),
+		fragCount:   binary.LittleEndian.Uint32(sb[16:]),
+		metadata:    make(map[int64]*metadataBlock),
+	}
+	switch s.compression {
+	case squashFSCompressionGzip:
+	case squashFSCompressionZstd:
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		s.zstd = dec
+	default:
+		name, ok := squashFSCompressions[s.compression]
+		if !ok {
+			name = fmt.Sprintf("unknown (%d)", s.compression)
+		}
+		return nil, fmt.Errorf("%w: squashfs file system with %s compression, only gzip and zstd are supported", ErrUnsupportedFormat, name)
+	}
+
+	idCount := int(binary.LittleEndian.Uint16(sb[26:]))
+	ids, err := s.table(int64(binary.LittleEndian.Uint64(sb[48:])), idCount, 4)
+	if err != nil {
+		return nil, fmt.Errorf("error reading squashfs id table: %w", err)
+	}
+	for i := 0; i < idCount; i++ {
+		s.ids = append(s.ids, binary.LittleEndian.Uint32(ids[4*i:]))
+	}
+	return &inodeFileSystem{s}, nil
+}
+
+func (s *squashFS) rootID() uint64 {
+	return s.root
+}
+
+func (s *squashFS) stat(id uint64) (*node, error) {
+	m := s.metadataReader(s.inodeTable+int64(id>>16), int(id&0xffff))
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(m, header); err != nil {
+		return nil, fmt.Errorf("error reading inode: %w", err)
+	}
+
+	typ := binary.LittleEndian.Uint16(header[0:])
+	fileType, ok := squashFSTypes[typ]
+	if !ok {
+		return nil, fmt.Errorf("invalid inode type %d", typ)
+	}
+	n := &node{Entry: Entry{
+		Mode:    fileMode(fileType | uint32(binary.LittleEndian.Uint16(header[2:]))&0o7777),
+		ModTime: time.Unix(int64(binary.LittleEndian.Uint32(header[8:])), 0),
+		UID:     s.id(binary.LittleEndian.Uint16(header[4:])),
+		GID:     s.id(binary.LittleEndian.Uint16(header[6:])),
+	}}
+
+	var err error
+	switch typ {
+	case 1:
+		var b [16]byte
+		if _, err = io.ReadFull(m, b[:]); err == nil {
+			n.Size = int64(binary.LittleEndian.Uint16(b[8:]))
+			n.sys = &squashFSDir{
+				start:  int64(binary.LittleEndian.Uint32(b[0:])),
+				offset: int(binary.LittleEndian.Uint16(b[10:])),
+				size:   n.Size,
+			}
+		}
+	case 8:
+		var b [24]byte
+		if _, err = io.ReadFull(m, b[:]); err == nil {
+			n.Size = int64(binary.LittleEndian.Uint32(b[4:]))
+			n.sys = &squashFSDir{
+				start:  int64(binary.LittleEndian.Uint32(b[8:])),
+				offset: int(binary.LittleEndian.Uint16(b[18:])),
+				size:   n.Size,
+			}
+		}
+	case 2:
+		var b [16]byte
+		if _, err = io.ReadFull(m, b[:]); err == nil {
+			n.Size = int64(binary.LittleEndian.Uint32(b[12:]))
+			n.sys, err = s.file(m, n.Size, int64(binary.LittleEndian.Uint32(b[0:])), binary.LittleEndian.Uint32(b[4:]), int64(binary.LittleEndian.Uint32(b[8:])))
+		}
+	case 9:
+		var b [40]byte
+		if _, err = io.ReadFull(m, b[:]); err == nil {
+			n.Size = int64(binary.LittleEndian.Uint64(b[8:]))
+			n.sys, err = s.file(m, n.Size, int64(binary.LittleEndian.Uint64(b[0:])), binary.LittleEndian.Uint32(b[28:]), int64(binary.LittleEndian.Uint32(b[32:])))
+		}
+	case 3, 10:
+		var b [8]byte
+		if _, err = io.ReadFull(m, b[:]); err == nil {
+			target := make([]byte, binary.LittleEndian.Uint32(b[4:]))
+			if _, err = io.ReadFull(m, target); err == nil {
+				n.Size = int64(len(target))
+				n.Linkname = string(target)
+				n.sys = &squashFSSymlink{target: n.Linkname}
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading inode: %w", err)
+	}
+	return n, nil
+}
+
+// file reads the block list of a regular file of the given size from the inode.
+func (s *squashFS) file(m io.Reader, size, start int64, fragment uint32, fragOffset int64) (*squashFSFile, error) {
+	count := size / s.blockSize
+	if fragment == squashFSNoFragment && size%s.blockSize != 0 {
+		count++
+	}
+	raw := make([]byte, 4*count)
+	if _, err := io.ReadFull(m, raw); err != nil {
+		return nil, err
+	}
+
+	f := &squashFSFile{start: start, fragment: fragment, fragOffset: fragOffset, blocks: make([]uint32, count)}
+	for i := range f.blocks {
+		f.blocks[i] = binary.LittleEndian.Uint32(raw[4*i:])
+	}
+	return f, nil
+}
+
+// id returns the uid or gid with the given index of the id table.
+func (s *squashFS) id(idx uint16) int {
+	if int(idx) >= len(s.ids) {
+		return 0
+	}
+	return int(s.ids[idx])
+}
+
+func (s *squashFS) readDir(dir *node) ([]dirent, error) {
+	d := dir.sys.(*squashFSDir)
+	// The size includes the . and .. entries, which are not stored.
+	remaining := d.size - 3
+	m := s.metadataReader(s.dirTable+d.start, d.offset)
+
+	var dirents []dirent
+	for remaining > 0 {
+		var header [12]byte
+		if _, err := io.ReadFull(m, header[:]); err != nil {
+			return nil, fmt.Errorf("error reading directory header: %w", err)
+		}
+		remaining -= 12
+
+		var (
+			count = binary.LittleEndian.Uint32(header[0:]) + 1
+			start = uint64(binary.LittleEndian.Uint32(header[4:]))
+		)
+		if count > 256 {
+			return nil, fmt.Errorf("corrupt directory header with %d entries", count)
+		}
+		for i := uint32(0); i < count; i++ {
+			var entry [8]byte
+			if _, err := io.ReadFull(m, entry[:]); err != nil {
+				return nil, fmt.Errorf("error reading directory entry: %w", err)
+			}
+			name := make([]byte, int(binary.LittleEndian.Uint16(entry[6:]))+1)
+			if _, err := io.ReadFull(m, name); err != nil {
+				return nil, fmt.Errorf("error reading directory entry: %w", err)
+			}
+			remaining -= int64(8 + len(name))
+			dirents = append(dirents, dirent{name: string(name), id: start<<16 | uint64(binary.LittleEndian.Uint16(entry[0:]))})
+		}
+	}
+	return dirents, nil
+}
+
+func (s *squashFS) readLink(n *node) (string, error) {
+	return n.sys.(*squashFSSymlink).target, nil
+}
+
+func (s *squashFS) open(n *node) (io.Reader, error) {
+	return &squashFSReader{fs: s, file: n.sys.(*squashFSFile), pos: n.sys.(*squashFSFile).start, remaining: n.Size}, nil
+}
+
+// squashFSReader reads the content of a regular file block by block.
+type squashFSReader struct {
+	fs        *squashFS
+	file      *squashFSFile
+	block     int
+	pos       int64
+	remaining int64
+	buf       []byte
+}
+
+func (r *squashFSReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.remaining <= 0 {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next reads the next data block or the fragment holding the tail of the file.
+func (r *squashFSReader) next() error {
+	length := r.fs.blockSize
+	if r.remaining < length {
+		length = r.remaining
+	}
+
+	if r.block < len(r.file.blocks) {
+		size := r.file.blocks[r.block]
+		r.block++
+		if size == 0 {
+			// Sparse block.
+			r.buf = make([]byte, length)
+		} else {
+			data, err := r.fs.readBlock(r.pos, size&^squashFSUncompressedBlock, size&squashFSUncompressedBlock == 0)
+			if err != nil {
+				return fmt.Errorf("error reading data block: %w", err)
+			}
+			r.pos += int64(size &^ squashFSUncompressedBlock)
+			if int64(len(data)) < length {
+				return fmt.Errorf("data block has %d bytes, expected %d", len(data), length)
+			}
+			r.buf = data[:length]
+		}
+		r.remaining -= length
+		return nil
+	}
+
+	if r.file.fragment == squashFSNoFragment {
+		return io.ErrUnexpectedEOF
+	}
+	data, err := r.fs.fragment(r.file.fragment)
+	if err != nil {
+		return err
+	}
+	if r.file.fragOffset+length > int64(len(data)) {
+		return fmt.Errorf("fragment %d has %d bytes, expected at least %d", r.file.fragment, len(data), r.file.fragOffset+length)
+	}
+	r.buf = data[r.file.fragOffset : r.file.fragOffset+length]
+	r.remaining -= length
+	return nil
+}
+
+// fragment returns the content of the fragment block with the given index.
+func (s *squashFS) fragment(idx uint32) ([]byte, error) {
+	if idx >= s.fragCount {
+		return nil, fmt.Errorf("invalid fragment index %d", idx)
+	}
+	if s.fragments == nil {
+		fragments, err := s.table(s.fragTable, int(s.fragCount), 16)
+		if err != nil {
+			return nil, fmt.Errorf("error reading fragment table: %w", err)
+		}
+		s.fragments = fragments
+	}
+
+	entry := s.fragments[16*idx : 16*(idx+1)]
+	size := binary.LittleEndian.Uint32(entry[8:])
+	data, err := s.readBlock(int64(binary.LittleEndian.Uint64(entry[0:])), size&^squashFSUncompressedBlock, size&squashFSUncompressedBlock == 0)
+	if err != nil {
+		return nil, fmt.Errorf("error reading fragment %d: %w", idx, err)
+	}
+	return data, nil
+}
+
+// table reads count entries of the given size of a table whose metadata blocks are listed at start.
+func (s *squashFS) table(start int64, count, size int) ([]byte, error) {
+	if count == 0 {
+		return nil, nil
+	}
+	// The metadata blocks of a table are consecutive, so reading from the first one suffices.
+	var first [8]byte
+	if err := readFull(s.r, first[:], start); err != nil {
+		return nil, err
+	}
+	data := make([]byte, count*size)
+	if _, err := io.ReadFull(s.metadataReader(int64(binary.LittleEndian.Uint64(first[:])), 0), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readBlock reads the block of the given size at pos, decompressing it if needed.
+func (s *squashFS) readBlock(pos int64, size uint32, compressed bool) ([]byte, error) {
+	raw := make([]byte, size)
+	if err := readFull(s.r, raw, pos); err != nil {
+		return nil, err
+	}
+	if !compressed {
+		return raw, nil
+	}
+
+	switch s.compression {
+	case squashFSCompressionZstd:
+		return s.zstd.DecodeAll(raw, nil)
+	default:
+		zr, err := zlib.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = zr.Close() }()
+		return io.ReadAll(io.LimitReader(zr, s.blockSize+1))
+	}
+}
+
+// metadataBlock is a decompressed metadata block along with the position of the following one.
+type metadataBlock struct {
+	data []byte
+	next int64
+}
+
+func (s *squashFS) metadataBlock(pos int64) (*metadataBlock, error) {
+	if b, ok := s.metadata[pos]; ok {
+		return b, nil
+	}
+
+	var header [2]byte
+	if err := readFull(s.r, header[:], pos); err != nil {
+		return nil, err
+	}
+	h := binary.LittleEndian.Uint16(header[:])
+	size := uint32(h &^ squashFSUncompressedMetadata)
+	if size > squashFSMetadataSize {
+		return nil, fmt.Errorf("metadata block at %d exceeds %d bytes", pos, squashFSMetadataSize)
+	}
+	data, err := s.readBlock(pos+2, size, h&squashFSUncompressedMetadata == 0)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata block at %d: %w", pos, err)
+	}
+
+	b := &metadataBlock{data: data, next: pos + 2 + int64(size)}
+	s.metadata[pos] = b
+	return b, nil
+}
+
+func (s *squashFS) metadataReader(pos int64, offset int) *metadataReader {
+	return &metadataReader{fs: s, pos: pos, offset: offset}
+}
+
+// metadataReader reads consecutive metadata starting at an offset into the metadata block at pos.
+type metadataReader struct {
+	fs     *squashFS
+	pos    int64
+	offset int
+	block  *metadataBlock
+}
+
+func (m *metadataReader) Read(p []byte) (int, error) {
+	if m.block == nil || m.offset >= len(m.block.data) {
+		if m.block != nil {
+			m.pos, m.offset = m.block.next, m.offset-len(m.block.data)
+		}
+		b, err := m.fs.metadataBlock(m.pos)
+		if err != nil {
+			return 0, err
+		}
+		if len(b.data) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		m.block = b
+		if m.offset >= len(b.data) {
+			return 0, fmt.Errorf("metadata offset %d exceeds block of %d bytes", m.offset, len(b.data))
+		}
+	}
+
+	n := copy(p, m.block.data[m.offset:])
+	m.offset += n
+	return n, nil
+}
@@ -0,0 +1,229 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layerfs_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"sort"
+
+	. "github.com/onsi/gomega"
+)
+
+// squashFSNode is a file of a squashfs image built by buildSquashFS.
+type squashFSNode struct {
+	mode     uint16
+	data     []byte
+	target   string
+	children map[string]*squashFSNode
+	// fragment stores the tail of the file in a fragment block.
+	fragment bool
+	uid      uint16
+}
+
+func squashFSDir(children map[string]*squashFSNode) *squashFSNode {
+	return &squashFSNode{mode: 0o755, children: children}
+}
+
+func squashFSFile(data []byte) *squashFSNode {
+	return &squashFSNode{mode: 0o644, data: data}
+}
+
+func squashFSSymlink(target string) *squashFSNode {
+	return &squashFSNode{mode: 0o777, target: target}
+}
+
+// buildSquashFS builds a squashfs image of the tree below root. Data blocks are zlib compressed, the
+// inode and directory tables have to fit into single uncompressed metadata blocks.
+func buildSquashFS(root *squashFSNode, blockSize int) []byte {
+	const (
+		noFragment = 0xffffffff
+		noTable    = 0xffffffffffffffff
+		mtime      = 1700000000
+	)
+	var (
+		// The superblock is written last, once the positions of the tables are known.
+		image        = bytes.NewBuffer(make([]byte, 96))
+		inodes, dirs bytes.Buffer
+		fragment     bytes.Buffer
+		inodeNumber  uint32
+		write        func(n *squashFSNode, parent uint32) (ref uint16, typ uint16, number uint32)
+	)
+	u16 := func(b *bytes.Buffer, v uint16) { _ = binary.Write(b, binary.LittleEndian, v) }
+	u32 := func(b *bytes.Buffer, v uint32) { _ = binary.Write(b, binary.LittleEndian, v) }
+	u64 := func(b *bytes.Buffer, v uint64) { _ = binary.Write(b, binary.LittleEndian, v) }
+	header := func(typ, mode, uid uint16, number uint32) {
+		u16(&inodes, typ)
+		u16(&inodes, mode)
+		u16(&inodes, uid)
+		u16(&inodes, 0)
+		u32(&inodes, mtime)
+		u32(&inodes, number)
+	}
+	// metadata writes data as a single uncompressed metadata block.
+	metadata := func(b *bytes.Buffer, data []byte) {
+		u16(b, uint16(len(data))|0x8000)
+		b.Write(data)
+	}
+
+	write = func(n *squashFSNode, parent uint32) (uint16, uint16, uint32) {
+		inodeNumber++
+		number := inodeNumber
+		switch {
+		case n.children != nil:
+			type entry struct {
+				name   string
+				ref    uint16
+				typ    uint16
+				number uint32
+			}
+			names := make([]string, 0, len(n.children))
+			for name := range n.children {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			var entries []entry
+			for _, name := range names {
+				ref, typ, childNumber := write(n.children[name], number)
+				entries = append(entries, entry{name, ref, typ, childNumber})
+			}
+
+			offset := dirs.Len()
+			if len(entries) > 0 {
+				u32(&dirs, uint32(len(entries)-1))
+				u32(&dirs, 0)
+				u32(&dirs, entries[0].number)
+				for _, e := range entries {
+					u16(&dirs, e.ref)
+					u16(&dirs, uint16(int16(e.number-entries[0].number)))
+					u16(&dirs, e.typ)
+					u16(&dirs, uint16(len(e.name)-1))
+					dirs.WriteString(e.name)
+				}
+			}
+
+			ref := uint16(inodes.Len())
+			header(1, n.mode, n.uid, number)
+			u32(&inodes, 0)
+			u32(&inodes, uint32(len(entries)+2))
+			u16(&inodes, uint16(dirs.Len()-offset+3))
+			u16(&inodes, uint16(offset))
+			u32(&inodes, parent)
+			return ref, 1, number
+		case n.target != "":
+			ref := uint16(inodes.Len())
+			header(3, n.mode, n.uid, number)
+			u32(&inodes, 1)
+			u32(&inodes, uint32(len(n.target)))
+			inodes.WriteString(n.target)
+			return ref, 3, number
+		default:
+			start := image.Len()
+			var sizes []uint32
+			data, fragOffset, frag := n.data, uint32(0), uint32(noFragment)
+			if n.fragment && len(data)%blockSize != 0 {
+				tail := len(data) - len(data)%blockSize
+				fragOffset, frag = uint32(fragment.Len()), 0
+				fragment.Write(data[tail:])
+				data = data[:tail]
+			}
+			for off := 0; off < len(data); off += blockSize {
+				end := off + blockSize
+				if end > len(data) {
+					end = len(data)
+				}
+				var compressed bytes.Buffer
+				zw := zlib.NewWriter(&compressed)
+				_, _ = zw.Write(data[off:end])
+				Expect(zw.Close()).To(Succeed())
+				image.Write(compressed.Bytes())
+				sizes = append(sizes, uint32(compressed.Len()))
+			}
+
+			ref := uint16(inodes.Len())
+			header(2, n.mode, n.uid, number)
+			u32(&inodes, uint32(start))
+			u32(&inodes, frag)
+			u32(&inodes, fragOffset)
+			u32(&inodes, uint32(len(n.data)))
+			for _, size := range sizes {
+				u32(&inodes, size)
+			}
+			return ref, 2, number
+		}
+	}
+	rootRef, _, _ := write(root, 0)
+	Expect(inodes.Len()).To(BeNumerically("<=", 8192))
+	Expect(dirs.Len()).To(BeNumerically("<=", 8192))
+
+	var fragCount uint32
+	fragBlock := image.Len()
+	if fragment.Len() > 0 {
+		fragCount = 1
+		image.Write(fragment.Bytes())
+	}
+
+	inodeTable := image.Len()
+	metadata(image, inodes.Bytes())
+	dirTable := image.Len()
+	metadata(image, dirs.Bytes())
+
+	var fragEntries bytes.Buffer
+	u64(&fragEntries, uint64(fragBlock))
+	u32(&fragEntries, uint32(fragment.Len())|1<<24)
+	u32(&fragEntries, 0)
+	fragMetadata := image.Len()
+	metadata(image, fragEntries.Bytes())
+	fragTable := image.Len()
+	u64(image, uint64(fragMetadata))
+
+	var ids bytes.Buffer
+	u32(&ids, 0)
+	u32(&ids, 1000)
+	idMetadata := image.Len()
+	metadata(image, ids.Bytes())
+	idTable := image.Len()
+	u64(image, uint64(idMetadata))
+
+	var sb bytes.Buffer
+	u32(&sb, 0x73717368)
+	u32(&sb, inodeNumber)
+	u32(&sb, mtime)
+	u32(&sb, uint32(blockSize))
+	u32(&sb, fragCount)
+	u16(&sb, 1)
+	blockLog := uint16(0)
+	for 1<<blockLog < blockSize {
+		blockLog++
+	}
+	u16(&sb, blockLog)
+	u16(&sb, 0)
+	u16(&sb, 2)
+	u16(&sb, 4)
+	u16(&sb, 0)
+	u64(&sb, uint64(rootRef))
+	u64(&sb, uint64(image.Len()))
+	u64(&sb, uint64(idTable))
+	u64(&sb, noTable)
+	u64(&sb, uint64(inodeTable))
+	u64(&sb, uint64(dirTable))
+	u64(&sb, uint64(fragTable))
+	u64(&sb, noTable)
+
+	res := image.Bytes()
+	copy(res, sb.Bytes())
+	return res
+}
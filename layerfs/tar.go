@@ -0,0 +1,223 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layerfs
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/onmetal/onmetal-image/unpack"
+)
+
+// tarFS reads an (optionally compressed) tar archive by streaming it.
+type tarFS struct {
+	open func() (io.ReadCloser, error)
+}
+
+// errStop stops scanning an archive.
+var errStop = errors.New("stop")
+
+// scan streams the archive, calling fn with the cleaned absolute name of each entry until it returns errStop.
+func (t *tarFS) scan(ctx context.Context, fn func(name string, hdr *tar.Header, r io.Reader) error) error {
+	rc, err := t.open()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rc.Close() }()
+
+	dr, err := unpack.Decompress(rc)
+	if err != nil {
+		return fmt.Errorf("error decompressing layer: %w", err)
+	}
+	defer func() { _ = dr.Close() }()
+
+	tr := tar.NewReader(dr)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("error reading tar archive: %w", err)
+		}
+		if err := fn(clean(hdr.Name), hdr, contextReader{ctx, tr}); err != nil {
+			if errors.Is(err, errStop) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (t *tarFS) cat(ctx context.Context, name string, w io.Writer) error {
+	target := name
+	for links := 0; ; links++ {
+		if links > maxSymlinks {
+			return pathError("cat", name, fmt.Errorf("too many levels of symbolic links"))
+		}
+
+		var (
+			found    *tar.Header
+			isDir    bool
+			symlinks = make(map[string]string)
+		)
+		if err := t.scan(ctx, func(entry string, hdr *tar.Header, r io.Reader) error {
+			if hdr.Typeflag == tar.TypeSymlink {
+				symlinks[entry] = hdr.Linkname
+			}
+			if entry != target {
+				// Archives need not contain entries for all directories.
+				isDir = isDir || strings.HasPrefix(entry, target+"/")
+				return nil
+			}
+			found = hdr
+			if hdr.Typeflag == tar.TypeReg {
+				if _, err := io.Copy(w, r); err != nil {
+					return fmt.Errorf("error writing %s: %w", name, err)
+				}
+			}
+			return errStop
+		}); err != nil {
+			return err
+		}
+
+		if found == nil {
+			if isDir {
+				return pathError("cat", name, ErrIsDir)
+			}
+			// Entries below a symbolic link to a directory are stored below its target.
+			if resolved, ok := resolveLinkedDir(target, symlinks); ok {
+				target = resolved
+				continue
+			}
+			return pathError("cat", name, fs.ErrNotExist)
+		}
+		switch found.Typeflag {
+		case tar.TypeReg:
+			return nil
+		case tar.TypeDir:
+			return pathError("cat", name, ErrIsDir)
+		case tar.TypeSymlink:
+			target = resolveLink(target, found.Linkname)
+		case tar.TypeLink:
+			// Hard links point to an earlier entry, which requires reading the archive again.
+			target = clean(found.Linkname)
+		default:
+			return pathError("cat", name, fmt.Errorf("not a regular file (%s)", found.FileInfo().Mode().Type()))
+		}
+	}
+}
+
+func (t *tarFS) list(ctx context.Context, name string) ([]Entry, error) {
+	dir := name
+	for links := 0; ; links++ {
+		if links > maxSymlinks {
+			return nil, pathError("list", name, fmt.Errorf("too many levels of symbolic links"))
+		}
+
+		var (
+			self     *tar.Header
+			children = make(map[string]Entry)
+			symlinks = make(map[string]string)
+			prefix   = strings.TrimSuffix(dir, "/") + "/"
+		)
+		if err := t.scan(ctx, func(entry string, hdr *tar.Header, r io.Reader) error {
+			if hdr.Typeflag == tar.TypeSymlink {
+				symlinks[entry] = hdr.Linkname
+			}
+			rel, ok := strings.CutPrefix(entry, prefix)
+			switch {
+			case entry == dir:
+				self = hdr
+			case !ok:
+			case !strings.Contains(rel, "/"):
+				children[rel] = tarEntry(rel, hdr)
+			default:
+				// Archives need not contain entries for all directories.
+				child, _, _ := strings.Cut(rel, "/")
+				if _, ok := children[child]; !ok {
+					children[child] = Entry{Name: child, Mode: fs.ModeDir | 0o755}
+				}
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case self != nil && self.Typeflag == tar.TypeSymlink:
+			dir = resolveLink(dir, self.Linkname)
+			continue
+		case self != nil && self.Typeflag != tar.TypeDir:
+			return []Entry{tarEntry(path.Base(dir), self)}, nil
+		case self == nil && len(children) == 0 && dir != "/":
+			if resolved, ok := resolveLinkedDir(dir, symlinks); ok {
+				dir = resolved
+				continue
+			}
+			return nil, pathError("list", name, fs.ErrNotExist)
+		}
+
+		entries := make([]Entry, 0, len(children))
+		for _, entry := range children {
+			entries = append(entries, entry)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		return entries, nil
+	}
+}
+
+// tarEntry returns the Entry of the tar header with the given name.
+func tarEntry(name string, hdr *tar.Header) Entry {
+	return Entry{
+		Name:     name,
+		Mode:     hdr.FileInfo().Mode(),
+		Size:     hdr.Size,
+		ModTime:  hdr.ModTime,
+		UID:      hdr.Uid,
+		GID:      hdr.Gid,
+		Linkname: hdr.Linkname,
+	}
+}
+
+// resolveLink returns the path the symbolic link at name pointing to target resolves to.
+func resolveLink(name, target string) string {
+	if path.IsAbs(target) {
+		return clean(target)
+	}
+	return path.Join(path.Dir(name), target)
+}
+
+// resolveLinkedDir replaces the first ancestor of name that is a symbolic link by its target.
+func resolveLinkedDir(name string, symlinks map[string]string) (string, bool) {
+	parts := splitPath(name)
+	for i := 1; i < len(parts); i++ {
+		dir := "/" + strings.Join(parts[:i], "/")
+		if target, ok := symlinks[dir]; ok {
+			return path.Join(resolveLink(dir, target), strings.Join(parts[i:], "/")), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,201 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mediatypes is the registry of the layer media types of onmetal images. Each media type is
+// registered with the role (kind) its layers have, whether their content may be compressed and a
+// human-readable description. The built-in media types are pre-registered, embedders can add their own
+// layer kinds (e.g. firmware bundles) via Register, typically from an init function. Layers of media
+// types that are not registered are handled as opaque blobs.
+package mediatypes
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// The media types of the built-in layer kinds.
+const (
+	RootFSLayer    = "application/vnd.onmetal.image.rootfs.v1alpha1.rootfs"
+	InitRAMFSLayer = "application/vnd.onmetal.image.initramfs.v1alpha1.initramfs"
+	KernelLayer    = "application/vnd.onmetal.image.vmlinuz.v1alpha1.vmlinuz"
+	IgnitionLayer  = "application/vnd.onmetal.image.ignition.v1alpha1.ignition"
+	CloudInitLayer = "application/vnd.onmetal.image.cloudinit.v1alpha1.userdata"
+	UKILayer       = "application/vnd.onmetal.image.uki.v1alpha1.efi"
+	ESPLayer       = "application/vnd.onmetal.image.esp.v1alpha1.fat"
+)
+
+// MediaTypeInfo describes a layer media type.
+type MediaTypeInfo struct {
+	// MediaType is the media type, without compression suffix.
+	MediaType string `json:"mediaType"`
+	// Role is the role of the layers of the media type, also called its kind, e.g. rootfs. Layers of an
+	// image with several layers of a kind are told apart by a suffix on the role, e.g. rootfs-b.
+	Role string `json:"role"`
+	// Compressed reports whether the layer content may be compressed: compressed files are decompressed
+	// when building or, with --keep-compressed, stored with a compression suffix on the media type.
+	// Content of other media types is stored verbatim.
+	Compressed bool `json:"compressed"`
+	// Description is a human-readable description of the layer content.
+	Description string `json:"description"`
+}
+
+// builtins are the built-in media types, in the order they are listed.
+var builtins = []MediaTypeInfo{
+	{MediaType: RootFSLayer, Role: "rootfs", Compressed: true, Description: "root file system"},
+	{MediaType: InitRAMFSLayer, Role: "initramfs", Compressed: true, Description: "initramfs"},
+	{MediaType: KernelLayer, Role: "kernel", Compressed: true, Description: "kernel"},
+	{MediaType: IgnitionLayer, Role: "ignition", Compressed: true, Description: "ignition config"},
+	{MediaType: CloudInitLayer, Role: "cloud-init", Compressed: true, Description: "cloud-init user-data"},
+	{MediaType: UKILayer, Role: "uki", Description: "unified kernel image"},
+	{MediaType: ESPLayer, Role: "esp", Description: "EFI system partition"},
+}
+
+// ErrInvalid is returned by Register if the media type info is incomplete or malformed.
+var ErrInvalid = errors.New("invalid media type info")
+
+// ErrConflict is returned by Register if the media type or role is already registered.
+var ErrConflict = errors.New("media type conflicts with a registered one")
+
+// roleRegexp matches valid roles: lowercase alphanumeric words separated by dashes.
+var roleRegexp = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// compressionSuffixes are the media type suffixes denoting compressed layers.
+var compressionSuffixes = []string{"+gzip", "+zstd", "+xz"}
+
+type registry struct {
+	mu     sync.RWMutex
+	infos  []MediaTypeInfo
+	byType map[string]int
+	byRole map[string]int
+}
+
+// registered is initialized along with its declaration, so Register may be called from init functions of
+// any package.
+var registered = newRegistry()
+
+func newRegistry() *registry {
+	r := &registry{byType: make(map[string]int), byRole: make(map[string]int)}
+	for _, info := range builtins {
+		if err := r.register(info); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+func (r *registry) register(info MediaTypeInfo) error {
+	if info.MediaType == "" || info.Role == "" {
+		return fmt.Errorf("%w: media type and role are required", ErrInvalid)
+	}
+	for _, suffix := range compressionSuffixes {
+		if strings.HasSuffix(info.MediaType, suffix) {
+			return fmt.Errorf("%w: media type %s has compression suffix %s", ErrInvalid, info.MediaType, suffix)
+		}
+	}
+	if !roleRegexp.MatchString(info.Role) {
+		return fmt.Errorf("%w: role %q has to consist of lowercase alphanumeric words separated by dashes", ErrInvalid, info.Role)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.byType[info.MediaType]; ok {
+		return fmt.Errorf("%w: media type %s is already registered", ErrConflict, info.MediaType)
+	}
+	for _, existing := range r.infos {
+		// A role extending another with a dash would be read as that role with a suffix.
+		if existing.Role == info.Role || strings.HasPrefix(info.Role, existing.Role+"-") || strings.HasPrefix(existing.Role, info.Role+"-") {
+			return fmt.Errorf("%w: role %s conflicts with role %s of media type %s", ErrConflict, info.Role, existing.Role, existing.MediaType)
+		}
+	}
+	r.byType[info.MediaType] = len(r.infos)
+	r.byRole[info.Role] = len(r.infos)
+	r.infos = append(r.infos, info)
+	return nil
+}
+
+// Register registers a layer media type. It fails with ErrInvalid if the info lacks a media type or role,
+// if the media type has a compression suffix or if the role is malformed, and with ErrConflict if the
+// media type or role is already registered or the role extends a registered one with a dash (or vice
+// versa), as it could not be told apart from a suffixed role. It is safe for concurrent use.
+func Register(info MediaTypeInfo) error {
+	return registered.register(info)
+}
+
+// MustRegister is like Register but panics on failure, for registering from init functions.
+func MustRegister(info MediaTypeInfo) {
+	if err := Register(info); err != nil {
+		panic(err)
+	}
+}
+
+// Lookup returns the info of the registered media type, ignoring a compression suffix (e.g. +gzip).
+func Lookup(mediaType string) (MediaTypeInfo, bool) {
+	for _, suffix := range compressionSuffixes {
+		if base, ok := strings.CutSuffix(mediaType, suffix); ok {
+			mediaType = base
+			break
+		}
+	}
+
+	registered.mu.RLock()
+	defer registered.mu.RUnlock()
+	i, ok := registered.byType[mediaType]
+	if !ok {
+		return MediaTypeInfo{}, false
+	}
+	return registered.infos[i], true
+}
+
+// LookupRole returns the info of the media type registered with the given role (without suffix).
+func LookupRole(role string) (MediaTypeInfo, bool) {
+	registered.mu.RLock()
+	defer registered.mu.RUnlock()
+	i, ok := registered.byRole[role]
+	if !ok {
+		return MediaTypeInfo{}, false
+	}
+	return registered.infos[i], true
+}
+
+// IsBuiltin reports whether the media type is one of the built-in ones.
+func IsBuiltin(mediaType string) bool {
+	for _, info := range builtins {
+		if info.MediaType == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// All returns the registered media types, the built-in ones first and the others in registration order.
+func All() []MediaTypeInfo {
+	registered.mu.RLock()
+	defer registered.mu.RUnlock()
+	res := make([]MediaTypeInfo, len(registered.infos))
+	copy(res, registered.infos)
+	return res
+}
+
+// Roles returns the roles of the registered media types in the order of All.
+func Roles() []string {
+	infos := All()
+	res := make([]string, 0, len(infos))
+	for _, info := range infos {
+		res = append(res, info.Role)
+	}
+	return res
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mediatypes_test
+
+import (
+	"sync"
+
+	. "github.com/onmetal/onmetal-image/mediatypes"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registry", func() {
+	It("should pre-register the built-in media types", func() {
+		info, ok := Lookup(RootFSLayer + "+zstd")
+		Expect(ok).To(BeTrue())
+		Expect(info).To(Equal(MediaTypeInfo{MediaType: RootFSLayer, Role: "rootfs", Compressed: true, Description: "root file system"}))
+		Expect(IsBuiltin(RootFSLayer)).To(BeTrue())
+
+		info, ok = LookupRole("uki")
+		Expect(ok).To(BeTrue())
+		Expect(info.MediaType).To(Equal(UKILayer))
+		Expect(info.Compressed).To(BeFalse())
+
+		Expect(Roles()[:7]).To(Equal([]string{"rootfs", "initramfs", "kernel", "ignition", "cloud-init", "uki", "esp"}))
+		_, ok = Lookup("application/octet-stream")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should register custom media types, also concurrently", func() {
+		var wg sync.WaitGroup
+		for _, role := range []string{"tpm-policy", "bmc"} {
+			role := role
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				Expect(Register(MediaTypeInfo{MediaType: "application/vnd.example." + role, Role: role})).To(Succeed())
+			}()
+		}
+		wg.Wait()
+
+		info, ok := LookupRole("tpm-policy")
+		Expect(ok).To(BeTrue())
+		Expect(info.MediaType).To(Equal("application/vnd.example.tpm-policy"))
+		Expect(IsBuiltin(info.MediaType)).To(BeFalse())
+		Expect(Roles()).To(ContainElements("tpm-policy", "bmc"))
+	})
+
+	It("should reject invalid and conflicting media types", func() {
+		Expect(Register(MediaTypeInfo{MediaType: "application/vnd.example.blob"})).To(MatchError(ErrInvalid))
+		Expect(Register(MediaTypeInfo{MediaType: "application/vnd.example.blob+gzip", Role: "blob"})).To(MatchError(ErrInvalid))
+		Expect(Register(MediaTypeInfo{MediaType: "application/vnd.example.blob", Role: "Blob"})).To(MatchError(ErrInvalid))
+
+		Expect(Register(MediaTypeInfo{MediaType: RootFSLayer, Role: "other"})).To(MatchError(ErrConflict))
+		Expect(Register(MediaTypeInfo{MediaType: "application/vnd.example.kernel", Role: "kernel"})).To(MatchError(ErrConflict))
+		Expect(Register(MediaTypeInfo{MediaType: "application/vnd.example.rootfs-extra", Role: "rootfs-extra"})).To(MatchError(ErrConflict))
+
+		Expect(func() { MustRegister(MediaTypeInfo{MediaType: ESPLayer, Role: "esp"}) }).To(Panic())
+	})
+})
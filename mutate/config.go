@@ -0,0 +1,79 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"context"
+	"fmt"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// EditConfig returns an image with the onmetal config of the given image modified by edit.
+// Only the config blob and the manifest change, all layers are reused as-is.
+// The edited config has to have a valid command line, see onmetalimage.ValidateCommandLine.
+func EditConfig(ctx context.Context, img ociimage.Image, edit func(config *onmetalimage.Config) error) (ociimage.Image, error) {
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting manifest: %w", err)
+	}
+	if manifest.Config.MediaType != onmetalimage.ConfigMediaType {
+		return nil, fmt.Errorf("image config has media type %q, expected %q", manifest.Config.MediaType, onmetalimage.ConfigMediaType)
+	}
+
+	config, err := onmetalimage.ReadConfig(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+	if err := edit(config); err != nil {
+		return nil, err
+	}
+	if err := onmetalimage.ValidateCommandLine(config.CommandLine); err != nil {
+		return nil, err
+	}
+
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting layers: %w", err)
+	}
+
+	return imageutil.NewJSONConfigBuilder(config, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).
+		Layers(layers...).
+		Annotations(manifest.Annotations).
+		Complete(func(desc *ocispec.Descriptor) {
+			desc.Platform = img.Descriptor().Platform
+		})
+}
+
+// SetCommandLine returns an image with the kernel command line of the given image replaced.
+// See EditConfig.
+func SetCommandLine(ctx context.Context, img ociimage.Image, commandLine string) (ociimage.Image, error) {
+	return EditConfig(ctx, img, func(config *onmetalimage.Config) error {
+		config.CommandLine = commandLine
+		return nil
+	})
+}
+
+// AppendCommandLine returns an image with the given arguments appended to the kernel command line of the
+// given image. See EditConfig.
+func AppendCommandLine(ctx context.Context, img ociimage.Image, args ...string) (ociimage.Image, error) {
+	return EditConfig(ctx, img, func(config *onmetalimage.Config) error {
+		config.CommandLine = onmetalimage.AppendCommandLine(config.CommandLine, args...)
+		return nil
+	})
+}
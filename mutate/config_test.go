@@ -0,0 +1,79 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate_test
+
+import (
+	"context"
+	"strings"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	. "github.com/onmetal/onmetal-image/mutate"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	var ctx = context.Background()
+
+	newImage := func(commandLine string) ociimage.Image {
+		img, err := imageutil.NewJSONConfigBuilder(&onmetalimage.Config{CommandLine: commandLine}, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).
+			BytesLayer([]byte("kernel"), imageutil.WithMediaType(onmetalimage.KernelLayerMediaType)).
+			BytesLayer([]byte("rootfs"), imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType)).
+			BytesLayer([]byte("initramfs"), imageutil.WithMediaType(onmetalimage.InitRAMFSLayerMediaType)).
+			Annotations(map[string]string{"foo": "bar"}).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	It("should only change the config and manifest when setting the command line", func() {
+		img := newImage("console=ttyS0")
+		mutated, err := SetCommandLine(ctx, img, "quiet")
+		Expect(err).NotTo(HaveOccurred())
+
+		config, err := onmetalimage.ReadConfig(ctx, mutated)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.CommandLine).To(Equal("quiet"))
+
+		original, err := img.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		manifest, err := mutated.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest.Layers).To(Equal(original.Layers))
+		Expect(manifest.Annotations).To(Equal(original.Annotations))
+		Expect(manifest.Config.MediaType).To(Equal(onmetalimage.ConfigMediaType))
+		Expect(manifest.Config.Digest).NotTo(Equal(original.Config.Digest))
+		Expect(mutated.Descriptor().Digest).NotTo(Equal(img.Descriptor().Digest))
+	})
+
+	It("should append to the command line", func() {
+		mutated, err := AppendCommandLine(ctx, newImage("console=ttyS0"), "quiet", " ip=dhcp ")
+		Expect(err).NotTo(HaveOccurred())
+
+		config, err := onmetalimage.ReadConfig(ctx, mutated)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.CommandLine).To(Equal("console=ttyS0 quiet ip=dhcp"))
+	})
+
+	It("should reject invalid command lines", func() {
+		_, err := SetCommandLine(ctx, newImage(""), "quiet\ninit=/bin/sh")
+		Expect(err).To(MatchError(ContainSubstring("control character")))
+
+		_, err = AppendCommandLine(ctx, newImage("console=ttyS0"), strings.Repeat("a", onmetalimage.MaxCommandLineLength))
+		Expect(err).To(MatchError(ContainSubstring("at most")))
+	})
+})
@@ -0,0 +1,261 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mutate provides helpers deriving variants of onmetal images.
+package mutate
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/unpack"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrAlreadyFlat is returned by Flatten if the rootfs of the image is a single blob that is no tar archive,
+// e.g. a disk image, and thus there is nothing to flatten.
+var ErrAlreadyFlat = errors.New("rootfs is already a single blob")
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// Flatten applies the tar rootfs layers of the image in order, including their whiteouts, into a single
+// uncompressed tar layer and returns an image with that layer in place of the original rootfs layers.
+// The flattened layer is streamed into the given store; all other layers and the config are reused unchanged.
+// The output only depends on the input layers, so flattening the same image twice yields the same digest.
+func Flatten(ctx context.Context, store content.Store, img ociimage.Image) (ociimage.Image, error) {
+	config, err := img.Config(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting config: %w", err)
+	}
+
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting layers: %w", err)
+	}
+
+	var rootFS []ociimage.Layer
+	for _, layer := range layers {
+		if onmetalimage.LayerMediaType(layer.Descriptor().MediaType) == onmetalimage.RootFSLayerMediaType {
+			rootFS = append(rootFS, layer)
+		}
+	}
+	if len(rootFS) == 0 {
+		return nil, fmt.Errorf("image has no rootfs layer")
+	}
+
+	f := &flattener{layers: rootFS, entries: make(map[string]entry)}
+	if err := f.scan(ctx); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(f.write(ctx, pw))
+	}()
+
+	ref := fmt.Sprintf("flatten-%s-%d", img.Descriptor().Digest.Encoded(), time.Now().UnixNano())
+	flattened, err := ocicontent.IngestLayer(ctx, store, ref, pr, imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType))
+	_ = pr.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error writing flattened rootfs: %w", err)
+	}
+
+	desc := flattened.Descriptor()
+	flattened = ocicontent.Layer(store, onmetalimage.WithUncompressed(desc, onmetalimage.Uncompressed{Size: desc.Size, DiffID: desc.Digest}))
+
+	res := make([]ociimage.Layer, 0, len(layers)-len(rootFS)+1)
+	for _, layer := range layers {
+		if layer.Descriptor().MediaType != onmetalimage.RootFSLayerMediaType {
+			res = append(res, layer)
+			continue
+		}
+		if layer == rootFS[0] {
+			res = append(res, flattened)
+		}
+	}
+
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting manifest: %w", err)
+	}
+
+	return imageutil.NewBuilder(config).
+		ArtifactType(manifest.ArtifactType).
+		Layers(res...).
+		Annotations(manifest.Annotations).
+		Complete(func(desc *ocispec.Descriptor) {
+			desc.Platform = img.Descriptor().Platform
+		})
+}
+
+// entry is the tar entry that provides a path in the flattened layer.
+type entry struct {
+	// layer is the index of the layer containing the entry.
+	layer int
+	// seq is the position of the entry across all layers.
+	seq int
+	dir bool
+}
+
+// flattener flattens layers in two passes: scan determines the entry providing each path of the result,
+// write then streams all layers again and only emits those entries. Only tar headers are kept in memory.
+type flattener struct {
+	layers  []ociimage.Layer
+	entries map[string]entry
+}
+
+func cleanName(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+// isBelow reports whether p is located below the directory dir.
+func isBelow(p, dir string) bool {
+	if dir == "" {
+		return p != ""
+	}
+	return strings.HasPrefix(p, dir+"/")
+}
+
+// remove removes p (if self is set) and everything below it provided by layers lower than the given one.
+func (f *flattener) remove(p string, layer int, self bool) {
+	for name, e := range f.entries {
+		if e.layer < layer && (isBelow(name, p) || (self && name == p)) {
+			delete(f.entries, name)
+		}
+	}
+}
+
+// walk calls fn for all tar entries of all layers in order.
+func (f *flattener) walk(ctx context.Context, fn func(layer, seq int, hdr *tar.Header, r io.Reader) error) error {
+	var seq int
+	for i, layer := range f.layers {
+		err := func() error {
+			rc, err := layer.Content(ctx)
+			if err != nil {
+				return fmt.Errorf("error getting layer content: %w", err)
+			}
+			defer func() { _ = rc.Close() }()
+
+			dr, err := unpack.Decompress(rc)
+			if err != nil {
+				return fmt.Errorf("error decompressing: %w", err)
+			}
+			defer func() { _ = dr.Close() }()
+
+			r, ok, err := unpack.IsTar(dr)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				if len(f.layers) == 1 {
+					return ErrAlreadyFlat
+				}
+				return unpack.ErrNotTar
+			}
+
+			tr := tar.NewReader(r)
+			for {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				hdr, err := tr.Next()
+				if err != nil {
+					if errors.Is(err, io.EOF) {
+						return nil
+					}
+					return fmt.Errorf("error reading tar entry: %w", err)
+				}
+
+				if err := fn(i, seq, hdr, tr); err != nil {
+					return fmt.Errorf("error handling %s: %w", hdr.Name, err)
+				}
+				seq++
+			}
+		}()
+		if err != nil {
+			if errors.Is(err, ErrAlreadyFlat) {
+				return err
+			}
+			return fmt.Errorf("error reading rootfs layer %s: %w", layer.Descriptor().Digest, err)
+		}
+	}
+	return nil
+}
+
+func (f *flattener) scan(ctx context.Context) error {
+	return f.walk(ctx, func(layer, seq int, hdr *tar.Header, _ io.Reader) error {
+		name := cleanName(hdr.Name)
+		parent, base := path.Split(name)
+		parent = strings.TrimSuffix(parent, "/")
+
+		switch {
+		case base == whiteoutOpaque:
+			f.remove(parent, layer, false)
+			return nil
+		case strings.HasPrefix(base, whiteoutPrefix):
+			f.remove(path.Join(parent, strings.TrimPrefix(base, whiteoutPrefix)), layer, true)
+			return nil
+		}
+
+		dir := hdr.Typeflag == tar.TypeDir
+		if old, ok := f.entries[name]; ok && old.dir && !dir {
+			f.remove(name, layer, false)
+		}
+		f.entries[name] = entry{layer: layer, seq: seq, dir: dir}
+		return nil
+	})
+}
+
+func (f *flattener) write(ctx context.Context, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	if err := f.walk(ctx, func(_, seq int, hdr *tar.Header, r io.Reader) error {
+		name := cleanName(hdr.Name)
+		if e, ok := f.entries[name]; !ok || e.seq != seq {
+			return nil
+		}
+
+		if hdr.Typeflag == tar.TypeLink {
+			target, ok := f.entries[cleanName(hdr.Linkname)]
+			if !ok || target.seq > seq {
+				return fmt.Errorf("hardlink target %s is removed or replaced by a later layer", hdr.Linkname)
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("error writing header: %w", err)
+		}
+		if _, err := io.Copy(tw, r); err != nil {
+			return fmt.Errorf("error writing content: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,199 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	. "github.com/onmetal/onmetal-image/mutate"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/local"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type entry struct {
+	hdr  tar.Header
+	data string
+}
+
+func archive(entries ...entry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		Expect(tw.WriteHeader(&hdr)).To(Succeed())
+		_, err := io.WriteString(tw, e.data)
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(tw.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+func gzipped(data []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write(data)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(gw.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+func file(name, data string) entry {
+	return entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: name}, data: data}
+}
+
+func dir(name string) entry {
+	return entry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0755}}
+}
+
+func link(name, target string) entry {
+	return entry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: name, Linkname: target}}
+}
+
+// contents reads the names and contents of all entries of the tar layer.
+func contents(ctx context.Context, layer ociimage.Layer) map[string]string {
+	data, err := imageutil.ReadLayerContent(ctx, layer)
+	Expect(err).NotTo(HaveOccurred())
+
+	res := make(map[string]string)
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return res
+		}
+		Expect(err).NotTo(HaveOccurred())
+		data, err := io.ReadAll(tr)
+		Expect(err).NotTo(HaveOccurred())
+		res[hdr.Name] = string(data)
+	}
+}
+
+var _ = Describe("Flatten", func() {
+	var (
+		ctx   context.Context
+		store *local.Store
+	)
+
+	newImage := func(rootFS ...[]byte) ociimage.Image {
+		b := imageutil.NewJSONConfigBuilder(&onmetalimage.Config{}, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).
+			BytesLayer([]byte("kernel"), imageutil.WithMediaType(onmetalimage.KernelLayerMediaType))
+		for _, data := range rootFS {
+			b = b.BytesLayer(data, imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType))
+		}
+		img, err := b.BytesLayer([]byte("initramfs"), imageutil.WithMediaType(onmetalimage.InitRAMFSLayerMediaType)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		s, err := local.NewStore(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		store = s
+	})
+
+	It("should apply the rootfs layers in order into a single layer", func() {
+		img := newImage(
+			gzipped(archive(
+				dir("etc/"),
+				file("etc/hostname", "lower"),
+				file("etc/removed", "removed"),
+				dir("var/"),
+				file("var/old", "old"),
+				file("bin", "file"),
+			)),
+			archive(
+				file("etc/hostname", "upper"),
+				file("etc/.wh.removed", ""),
+				dir("var/"),
+				file("var/.wh..wh..opq", ""),
+				file("var/new", "new"),
+				link("etc/hostlink", "etc/hostname"),
+			),
+		)
+
+		flattened, err := Flatten(ctx, store, img)
+		Expect(err).NotTo(HaveOccurred())
+
+		layers, err := flattened.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layers).To(HaveLen(3))
+
+		original, err := img.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layers[0].Descriptor()).To(Equal(original[0].Descriptor()))
+		Expect(layers[2].Descriptor()).To(Equal(original[3].Descriptor()))
+
+		Expect(layers[1].Descriptor().MediaType).To(Equal(onmetalimage.RootFSLayerMediaType))
+		Expect(contents(ctx, layers[1])).To(Equal(map[string]string{
+			"etc/":         "",
+			"etc/hostname": "upper",
+			"var/":         "",
+			"var/new":      "new",
+			"bin":          "file",
+			"etc/hostlink": "",
+		}))
+
+		By("flattening again")
+		again, err := Flatten(ctx, store, img)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again.Descriptor().Digest).To(Equal(flattened.Descriptor().Digest))
+	})
+
+	It("should remove the content of directories replaced by files", func() {
+		img := newImage(
+			archive(dir("opt/"), file("opt/tool", "tool")),
+			archive(file("opt", "not a dir anymore")),
+		)
+
+		flattened, err := Flatten(ctx, store, img)
+		Expect(err).NotTo(HaveOccurred())
+
+		layers, err := flattened.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contents(ctx, layers[1])).To(Equal(map[string]string{"opt": "not a dir anymore"}))
+	})
+
+	It("should fail on hardlinks to paths replaced by a later layer", func() {
+		img := newImage(
+			archive(file("a", "old"), link("b", "a")),
+			archive(file("a", "new")),
+		)
+
+		_, err := Flatten(ctx, store, img)
+		Expect(err).To(MatchError(ContainSubstring("hardlink target")))
+	})
+
+	It("should return ErrAlreadyFlat for disk image rootfs layers", func() {
+		img := newImage([]byte("not a tar archive, but a disk image"))
+
+		_, err := Flatten(ctx, store, img)
+		Expect(err).To(MatchError(ErrAlreadyFlat))
+	})
+})
@@ -0,0 +1,165 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/klauspost/compress/zstd"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrNothingToRecompress is returned by Recompress if the image has no layer to recompress.
+var ErrNothingToRecompress = errors.New("no layer to recompress")
+
+// Compression is a compression algorithm layers can be recompressed with.
+type Compression string
+
+// CompressionZstd is zstd compression.
+const CompressionZstd Compression = "zstd"
+
+// ParseCompression parses the given compression algorithm.
+func ParseCompression(s string) (Compression, error) {
+	switch compression := Compression(s); compression {
+	case CompressionZstd:
+		return compression, nil
+	default:
+		return "", fmt.Errorf("unsupported compression %q, expected %s", s, CompressionZstd)
+	}
+}
+
+// Recompress recompresses the gzip compressed rootfs layers of the image with the given compression and
+// returns an image with the recompressed layers in their place. The recompressed layers are streamed into
+// the given store; all other layers and the config are reused unchanged, as are the media types and
+// annotations of the recompressed layers since the rootfs media type does not encode a compression.
+// If no layer is gzip compressed, ErrNothingToRecompress is returned.
+func Recompress(ctx context.Context, store content.Store, img ociimage.Image, compression Compression) (ociimage.Image, error) {
+	if compression != CompressionZstd {
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+
+	config, err := img.Config(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting config: %w", err)
+	}
+
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting layers: %w", err)
+	}
+
+	var (
+		res          = make([]ociimage.Layer, 0, len(layers))
+		recompressed int
+	)
+	for _, layer := range layers {
+		if layer.Descriptor().MediaType != onmetalimage.RootFSLayerMediaType {
+			res = append(res, layer)
+			continue
+		}
+
+		newLayer, err := recompressLayer(ctx, store, layer)
+		if err != nil {
+			return nil, fmt.Errorf("error recompressing layer %s: %w", layer.Descriptor().Digest, err)
+		}
+		if newLayer == nil {
+			res = append(res, layer)
+			continue
+		}
+		res = append(res, newLayer)
+		recompressed++
+	}
+	if recompressed == 0 {
+		return nil, ErrNothingToRecompress
+	}
+
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting manifest: %w", err)
+	}
+
+	return imageutil.NewBuilder(config).
+		ArtifactType(manifest.ArtifactType).
+		Layers(res...).
+		Annotations(manifest.Annotations).
+		Complete(func(desc *ocispec.Descriptor) {
+			desc.Platform = img.Descriptor().Platform
+		})
+}
+
+// recompressLayer streams the zstd compressed content of the gzip compressed layer into the store.
+// It returns nil if the layer is not gzip compressed.
+func recompressLayer(ctx context.Context, store content.Store, layer ociimage.Layer) (ociimage.Layer, error) {
+	rc, err := layer.Content(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting content: %w", err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	br := bufio.NewReader(rc)
+	magic, err := br.Peek(2)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error reading magic: %w", err)
+	}
+	if !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return nil, nil
+	}
+
+	gr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("error opening gzip stream: %w", err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(compressZstd(pw, gr))
+	}()
+
+	desc := layer.Descriptor()
+	ref := fmt.Sprintf("recompress-%s-%d", desc.Digest.Encoded(), time.Now().UnixNano())
+	recompressed, err := ocicontent.IngestLayer(ctx, store, ref, pr, func(d *ocispec.Descriptor) {
+		d.MediaType = desc.MediaType
+		d.Annotations = desc.Annotations
+	})
+	_ = pr.Close()
+	if err != nil {
+		return nil, err
+	}
+	return recompressed, nil
+}
+
+func compressZstd(w io.Writer, r io.Reader) error {
+	enc, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(enc, r); err != nil {
+		_ = enc.Close()
+		return err
+	}
+	return enc.Close()
+}
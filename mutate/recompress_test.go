@@ -0,0 +1,101 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	. "github.com/onmetal/onmetal-image/mutate"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/local"
+	"github.com/onmetal/onmetal-image/unpack"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Recompress", func() {
+	var (
+		ctx   context.Context
+		store *local.Store
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		s, err := local.NewStore(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		store = s
+	})
+
+	decompressed := func(layer ociimage.Layer) []byte {
+		data, err := imageutil.ReadLayerContent(ctx, layer)
+		Expect(err).NotTo(HaveOccurred())
+		rc, err := unpack.Decompress(bytes.NewReader(data))
+		Expect(err).NotTo(HaveOccurred())
+		defer func() { _ = rc.Close() }()
+		res, err := io.ReadAll(rc)
+		Expect(err).NotTo(HaveOccurred())
+		return res
+	}
+
+	It("should recompress gzip rootfs layers to zstd", func() {
+		rootFS := archive(file("etc/hostname", "machine"))
+		img, err := imageutil.NewJSONConfigBuilder(&onmetalimage.Config{}, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).
+			BytesLayer([]byte("kernel"), imageutil.WithMediaType(onmetalimage.KernelLayerMediaType)).
+			BytesLayer(gzipped(rootFS), imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType),
+				imageutil.WithAnnotations(map[string]string{onmetalimage.UncompressedSizeAnnotation: "1024"})).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+
+		recompressed, err := Recompress(ctx, store, img, CompressionZstd)
+		Expect(err).NotTo(HaveOccurred())
+
+		oldConfig, err := img.Config(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		newConfig, err := recompressed.Config(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(newConfig.Descriptor().Digest).To(Equal(oldConfig.Descriptor().Digest))
+
+		oldLayers, err := img.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		layers, err := recompressed.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layers).To(HaveLen(2))
+		Expect(layers[0].Descriptor()).To(Equal(oldLayers[0].Descriptor()))
+
+		desc := layers[1].Descriptor()
+		Expect(desc.Digest).NotTo(Equal(oldLayers[1].Descriptor().Digest))
+		Expect(desc.MediaType).To(Equal(onmetalimage.RootFSLayerMediaType))
+		Expect(desc.Annotations).To(HaveKeyWithValue(onmetalimage.UncompressedSizeAnnotation, "1024"))
+
+		data, err := imageutil.ReadLayerContent(ctx, layers[1])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data[:4]).To(Equal([]byte{0x28, 0xb5, 0x2f, 0xfd}))
+		Expect(decompressed(layers[1])).To(Equal(rootFS))
+	})
+
+	It("should return ErrNothingToRecompress if no layer is gzip compressed", func() {
+		img, err := imageutil.NewJSONConfigBuilder(&onmetalimage.Config{}, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).
+			BytesLayer(archive(file("etc/hostname", "machine")), imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = Recompress(ctx, store, img, CompressionZstd)
+		Expect(err).To(MatchError(ErrNothingToRecompress))
+	})
+})
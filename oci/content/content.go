@@ -17,13 +17,20 @@ package content
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 
 	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/onmetal/onmetal-image/utils/fsutil"
+	"github.com/onmetal/onmetal-image/utils/ioutils"
 
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -43,34 +50,382 @@ func ReaderAtReadCloser(at content.ReaderAt) io.ReadCloser {
 	}
 }
 
-func WriteLayerToIngester(ctx context.Context, ingester content.Ingester, obj ociimage.Layer) error {
+// ErrNoSpace is returned if content could not be written because the device ran out of space.
+// Use errors.As with *NoSpaceError to get details.
+var ErrNoSpace = errors.New("no space left on device")
+
+// NoSpaceError is the error returned if writing a blob failed because the device ran out of space.
+type NoSpaceError struct {
+	// Digest is the digest of the blob that could not be written.
+	Digest digest.Digest
+	// Needed is the number of bytes of the blob that were still to be written (descriptor size minus written).
+	Needed int64
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *NoSpaceError) Error() string {
+	return fmt.Sprintf("no space left on device writing %s: %d more bytes needed", e.Digest, e.Needed)
+}
+
+func (e *NoSpaceError) Is(target error) bool {
+	return target == ErrNoSpace
+}
+
+func (e *NoSpaceError) Unwrap() error {
+	return e.Err
+}
+
+// noSpaceError converts an error writing the blob of desc due to a full device into a *NoSpaceError,
+// removing the partial ingest. Other errors are returned as-is.
+func noSpaceError(ctx context.Context, ingester content.Ingester, ref string, desc ocispec.Descriptor, err error) error {
+	if !fsutil.IsNoSpace(err) {
+		return err
+	}
+
+	var written int64
+	if manager, ok := ingester.(content.IngestManager); ok {
+		if status, statusErr := manager.Status(ctx, ref); statusErr == nil {
+			written = status.Offset
+		}
+		_ = manager.Abort(ctx, ref)
+	}
+
+	needed := desc.Size - written
+	if needed < 0 {
+		needed = 0
+	}
+	return &NoSpaceError{Digest: desc.Digest, Needed: needed, Err: err}
+}
+
+// WriteOptions are options for writing layers to an ingester.
+type WriteOptions struct {
+	// ForceRewrite writes layers even if the ingester already has a blob with their digest and size.
+	ForceRewrite bool
+	// ContinueOnError writes the remaining blobs of an image if one of them fails, see
+	// WriteImageToIngesterWithReport.
+	ContinueOnError bool
+	// Retry is the report of an earlier attempt. Only its failed blobs are written again.
+	Retry *WriteReport
+}
+
+// WriteOption is an option for writing layers to an ingester.
+type WriteOption func(o *WriteOptions)
+
+// WithForceRewrite removes and rewrites blobs that already exist, e.g. to repair a store.
+func WithForceRewrite() WriteOption {
+	return func(o *WriteOptions) {
+		o.ForceRewrite = true
+	}
+}
+
+// WithContinueOnError writes the remaining blobs of an image if one of them fails instead of stopping at
+// the first failure. The manifest is not written unless all other blobs were.
+func WithContinueOnError() WriteOption {
+	return func(o *WriteOptions) {
+		o.ContinueOnError = true
+	}
+}
+
+// WithRetryFailed only writes the blobs that failed in the given report of an earlier attempt, carrying
+// over the outcome of all others.
+func WithRetryFailed(report *WriteReport) WriteOption {
+	return func(o *WriteOptions) {
+		o.Retry = report
+	}
+}
+
+// BlobOutcome is the outcome of writing a single blob of an image.
+type BlobOutcome string
+
+const (
+	// BlobWritten denotes a blob that was written.
+	BlobWritten BlobOutcome = "written"
+	// BlobSkipped denotes a blob that was not written because the ingester already had it.
+	BlobSkipped BlobOutcome = "skipped"
+	// BlobFailed denotes a blob that could not be written, see BlobReport.Err.
+	BlobFailed BlobOutcome = "failed"
+)
+
+// ErrIncompleteImage is the error of the manifest of an image if it was not written because other blobs of
+// the image failed.
+var ErrIncompleteImage = errors.New("not all blobs of the image were written")
+
+// BlobError is the error of writing a single blob, naming the blob by digest, media type and size.
+type BlobError struct {
+	Descriptor ocispec.Descriptor
+	Err        error
+}
+
+func (e *BlobError) Error() string {
+	return fmt.Sprintf("error writing blob %s (%s, %d bytes): %v", e.Descriptor.Digest, e.Descriptor.MediaType, e.Descriptor.Size, e.Err)
+}
+
+func (e *BlobError) Unwrap() error {
+	return e.Err
+}
+
+// FailedBlobs returns the descriptors of all *BlobError in the tree of err, e.g. of an error joined by
+// WriteReport.Err.
+func FailedBlobs(err error) []ocispec.Descriptor {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *BlobError:
+		return []ocispec.Descriptor{e.Descriptor}
+	case interface{ Unwrap() []error }:
+		var descs []ocispec.Descriptor
+		for _, err := range e.Unwrap() {
+			descs = append(descs, FailedBlobs(err)...)
+		}
+		return descs
+	case interface{ Unwrap() error }:
+		return FailedBlobs(e.Unwrap())
+	default:
+		return nil
+	}
+}
+
+// BlobReport is the outcome of writing a single blob.
+type BlobReport struct {
+	Descriptor ocispec.Descriptor
+	Outcome    BlobOutcome
+	// Err is the *BlobError the blob failed with, if Outcome is BlobFailed.
+	Err error
+}
+
+// WriteReport reports the outcome of writing each blob of an image, in write order.
+type WriteReport struct {
+	Blobs []BlobReport
+}
+
+// Add records the outcome of writing the blob of desc, wrapping err into a *BlobError.
+func (r *WriteReport) Add(desc ocispec.Descriptor, err error, skipped bool) {
+	switch {
+	case err != nil:
+		r.Blobs = append(r.Blobs, BlobReport{Descriptor: desc, Outcome: BlobFailed, Err: &BlobError{Descriptor: desc, Err: err}})
+	case skipped:
+		r.Blobs = append(r.Blobs, BlobReport{Descriptor: desc, Outcome: BlobSkipped})
+	default:
+		r.Blobs = append(r.Blobs, BlobReport{Descriptor: desc, Outcome: BlobWritten})
+	}
+}
+
+// Failed returns the descriptors of the blobs that failed.
+func (r *WriteReport) Failed() []ocispec.Descriptor {
+	var failed []ocispec.Descriptor
+	for _, blob := range r.Blobs {
+		if blob.Outcome == BlobFailed {
+			failed = append(failed, blob.Descriptor)
+		}
+	}
+	return failed
+}
+
+// Err joins the errors of all failed blobs, or returns nil if none failed.
+func (r *WriteReport) Err() error {
+	var errs []error
+	for _, blob := range r.Blobs {
+		if blob.Outcome == BlobFailed {
+			errs = append(errs, blob.Err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// outcome returns the report of the blob with the given digest, if any.
+func (r *WriteReport) outcome(dgst digest.Digest) (BlobReport, bool) {
+	for _, blob := range r.Blobs {
+		if blob.Descriptor.Digest == dgst {
+			return blob, true
+		}
+	}
+	return BlobReport{}, false
+}
+
+// Exists reports whether the provider has a blob with the digest and size of the descriptor.
+// For descriptors without size information (see imageutil.HasKnownSize) only the digest is compared.
+func Exists(ctx context.Context, provider content.InfoProvider, desc ocispec.Descriptor) bool {
+	info, err := provider.Info(ctx, desc.Digest)
+	return err == nil && matchesSize(info, desc)
+}
+
+// matchesSize reports whether the blob info matches the size of the descriptor, if known.
+func matchesSize(info content.Info, desc ocispec.Descriptor) bool {
+	return !imageutil.HasKnownSize(desc) || info.Size == desc.Size
+}
+
+// WriteLayerToIngester writes the layer to the ingester.
+// An interrupted ingest of the layer, e.g. of a previous process, is resumed if the content of the layer
+// can be read from its offset (see OpenContentAt) and restarted from scratch otherwise.
+// If the ingester can provide blob info and already has the blob with the right size, the layer is not read
+// at all. A blob with the right digest but the wrong size is removed and rewritten, as is any existing blob
+// if WithForceRewrite is passed.
+// If the device runs out of space, the partial ingest is removed and a *NoSpaceError is returned.
+// If the context expires, a *PhaseError denoting whether the download or the commit was in progress is returned.
+// Layers without size information (see imageutil.HasKnownSize) are only verified against their digest.
+func WriteLayerToIngester(ctx context.Context, ingester content.Ingester, obj ociimage.Layer, opts ...WriteOption) error {
+	o := &WriteOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	_, err := writeLayer(ctx, ingester, obj, o)
+	return err
+}
+
+// writeLayer writes the layer like WriteLayerToIngester, reporting whether it was skipped because the
+// ingester already had it.
+func writeLayer(ctx context.Context, ingester content.Ingester, obj ociimage.Layer, o *WriteOptions) (skipped bool, err error) {
 	desc := obj.Descriptor()
-	rc, err := obj.Content(ctx)
+	ref := remotes.MakeRefKey(ctx, desc)
+	downloadPhase := fmt.Sprintf("download layer %s", desc.Digest)
+	reporter := progress.FromContext(ctx)
+
+	if provider, ok := ingester.(content.InfoProvider); ok {
+		if info, err := provider.Info(ctx, desc.Digest); err == nil {
+			if !o.ForceRewrite && matchesSize(info, desc) {
+				reporter.Report(progress.BlobDone{Digest: desc.Digest, Total: info.Size, Skipped: true})
+				return true, nil
+			}
+			// Existing blobs would make opening the writer fail with already exists.
+			if manager, ok := ingester.(content.Manager); ok {
+				if err := manager.Delete(ctx, desc.Digest); err != nil && !errdefs.IsNotFound(err) {
+					return false, fmt.Errorf("error removing existing blob: %w", err)
+				}
+			}
+		}
+	}
+
+	w, err := content.OpenWriter(ctx, ingester, content.WithRef(ref), content.WithDescriptor(desc))
 	if err != nil {
-		return fmt.Errorf("error opening content: %w", err)
+		if errdefs.IsAlreadyExists(err) {
+			reporter.Report(progress.BlobDone{Digest: desc.Digest, Total: progress.Total(desc), Skipped: true})
+			return true, nil
+		}
+		return false, fmt.Errorf("error opening writer: %w", WithPhase(ctx, downloadPhase, err))
+	}
+	defer func() { _ = w.Close() }()
+	RecordIngest(ctx, ingester, ref, desc)
+
+	reporter.Report(progress.BlobStarted{Digest: desc.Digest, MediaType: desc.MediaType, Total: progress.Total(desc)})
+	rc, offset, err := resumeIngest(ctx, w, obj)
+	if err != nil {
+		return false, fmt.Errorf("error opening content: %w", WithPhase(ctx, downloadPhase, err))
 	}
 	defer func() { _ = rc.Close() }()
 
-	ref := remotes.MakeRefKey(ctx, desc)
-	if err := content.WriteBlob(ctx, ingester, ref, rc, desc); err != nil {
-		return fmt.Errorf("error writing data: %w", err)
+	// The digest of resumed ingests covers content read by an earlier process, it is verified on commit.
+	copied, err := ioutils.CopyVerify(ctx, w, rc, desc,
+		ioutils.WithOffset(offset, nil),
+		ioutils.WithProgress(progress.ReportInterval, progress.BlobProgressFunc(reporter, desc)),
+	)
+	written := copied.Size
+	if err != nil {
+		err = noSpaceError(ctx, ingester, ref, desc, WithPhase(ctx, downloadPhase, err))
+		return false, fmt.Errorf("error writing data: %w", err)
+	}
+
+	// A commit size of zero skips the size validation, the digest is always verified.
+	var size int64
+	if imageutil.HasKnownSize(desc) {
+		size = desc.Size
+	}
+	if err := w.Commit(ctx, size, desc.Digest); err != nil && !errdefs.IsAlreadyExists(err) {
+		err = noSpaceError(ctx, ingester, ref, desc, WithPhase(ctx, fmt.Sprintf("commit layer %s", desc.Digest), err))
+		return false, fmt.Errorf("error committing data: %w", err)
 	}
-	return nil
+	reporter.Report(progress.BlobDone{Digest: desc.Digest, Total: written})
+	return false, nil
+}
+
+// WriteImageToIngester writes all layers of the image to the ingester, see WriteLayerToIngester.
+// It stops at the first blob that fails, returning its *BlobError.
+func WriteImageToIngester(ctx context.Context, ingester content.Ingester, img ociimage.Image, opts ...WriteOption) error {
+	_, err := WriteImageToIngesterWithReport(ctx, ingester, img, opts...)
+	return err
 }
 
-func WriteImageToIngester(ctx context.Context, ingester content.Ingester, img ociimage.Image) error {
+// WriteImageToIngesterWithReport writes all layers of the image to the ingester like WriteImageToIngester
+// and reports the outcome of each blob. Unless WithContinueOnError is passed, it stops at the first blob
+// that fails and the report only covers the blobs up to it. Otherwise all other blobs are still written,
+// except for the manifest, which fails with ErrIncompleteImage. Running out of space or the context being
+// done always stops writing. Pass the report to WithRetryFailed to only write the failed blobs again.
+// The returned error is the error of the report (see WriteReport.Err) or the error getting the blobs of
+// the image, in which case the report is nil.
+func WriteImageToIngesterWithReport(ctx context.Context, ingester content.Ingester, img ociimage.Image, opts ...WriteOption) (*WriteReport, error) {
+	o := &WriteOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	layers, err := ociimage.AsWriteLayers(ctx, img)
 	if err != nil {
-		return fmt.Errorf("error getting image write layers: %w", err)
+		return nil, fmt.Errorf("error getting image write layers: %w", err)
+	}
+
+	report := &WriteReport{}
+	for i, layer := range layers {
+		desc := layer.Descriptor()
+		if o.Retry != nil {
+			if prev, ok := o.Retry.outcome(desc.Digest); ok && prev.Outcome != BlobFailed {
+				report.Blobs = append(report.Blobs, prev)
+				continue
+			}
+		}
+		// AsWriteLayers returns the blobs followed by the manifest.
+		if i == len(layers)-1 && len(report.Failed()) > 0 {
+			report.Add(desc, ErrIncompleteImage, false)
+			break
+		}
+
+		skipped, err := writeLayer(ctx, ingester, layer, o)
+		report.Add(desc, err, skipped)
+		if err != nil && (!o.ContinueOnError || errors.Is(err, ErrNoSpace) || ctx.Err() != nil) {
+			break
+		}
+	}
+	return report, report.Err()
+}
+
+// IngestLayer streams the content of the reader into the store under the given ingest ref, computing digest
+// and size on the fly, and returns a layer backed by the committed blob.
+// The descriptor options are applied before digest and size are set.
+// If reading, writing or committing fails (e.g. because the context is cancelled), the ingest is aborted.
+func IngestLayer(ctx context.Context, store content.Store, ref string, r io.Reader, opts ...imageutil.DescriptorOpt) (ociimage.Layer, error) {
+	w, err := content.OpenWriter(ctx, store, content.WithRef(ref))
+	if err != nil {
+		return nil, fmt.Errorf("error opening writer: %w", err)
 	}
 
-	for _, layer := range layers {
-		if err := WriteLayerToIngester(ctx, ingester, layer); err != nil {
-			return fmt.Errorf("error writing layer %s: %w", layer.Descriptor().Digest, err)
+	ingested, err := ingest(ctx, w, r)
+	_ = w.Close()
+	if err != nil {
+		if abortErr := store.Abort(ctx, ref); abortErr != nil && !errdefs.IsNotFound(abortErr) {
+			return nil, fmt.Errorf("error aborting ingest %s after error %v: %w", ref, err, abortErr)
 		}
+		return nil, err
+	}
+
+	desc := ocispec.Descriptor{}
+	for _, opt := range opts {
+		opt(&desc)
+	}
+	desc.Digest = ingested.Digest
+	desc.Size = ingested.Size
+	return Layer(store, desc), nil
+}
+
+func ingest(ctx context.Context, w content.Writer, r io.Reader) (ocispec.Descriptor, error) {
+	ingested, err := ioutils.CopyVerify(ctx, w, r, ocispec.Descriptor{})
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("error writing data: %w", err)
 	}
 
-	return nil
+	if err := w.Commit(ctx, ingested.Size, ingested.Digest); err != nil && !errdefs.IsAlreadyExists(err) {
+		return ocispec.Descriptor{}, fmt.Errorf("error committing data: %w", err)
+	}
+	return ingested, nil
 }
 
 type layer struct {
@@ -91,6 +446,11 @@ func (o *layer) Content(ctx context.Context) (io.ReadCloser, error) {
 	return ReaderAtReadCloser(readerAt), nil
 }
 
+// ReaderAt implements ociimage.RandomAccessLayer.
+func (o *layer) ReaderAt(ctx context.Context) (ociimage.ReaderAt, error) {
+	return o.provider.ReaderAt(ctx, o.descriptor)
+}
+
 func Layer(provider content.Provider, descriptor ocispec.Descriptor) ociimage.Layer {
 	return &layer{provider, descriptor}
 }
@@ -134,6 +494,47 @@ func (i *image) Layers(ctx context.Context) ([]ociimage.Layer, error) {
 	return layers, nil
 }
 
+func (i *image) Complete(ctx context.Context) (bool, []ocispec.Descriptor, error) {
+	manifest, err := i.Manifest(ctx)
+	if err != nil {
+		return false, nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	missing, err := Missing(ctx, i.provider, append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...)...)
+	if err != nil {
+		return false, nil, err
+	}
+	return len(missing) == 0, missing, nil
+}
+
+// Missing returns the descriptors whose blobs are not present in the provider with the right size. If
+// the provider can provide blob info, the blobs are only stat'ed, otherwise they are opened but not read.
+func Missing(ctx context.Context, provider content.Provider, descs ...ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	var missing []ocispec.Descriptor
+	for _, desc := range descs {
+		if infoProvider, ok := provider.(content.InfoProvider); ok {
+			if !Exists(ctx, infoProvider, desc) {
+				missing = append(missing, desc)
+			}
+			continue
+		}
+
+		ra, err := provider.ReaderAt(ctx, desc)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				missing = append(missing, desc)
+				continue
+			}
+			return nil, fmt.Errorf("error opening blob %s: %w", desc.Digest, err)
+		}
+		if imageutil.HasKnownSize(desc) && ra.Size() != desc.Size {
+			missing = append(missing, desc)
+		}
+		_ = ra.Close()
+	}
+	return missing, nil
+}
+
 func Image(provider content.Provider, desc ocispec.Descriptor) ociimage.Image {
 	return &image{layer{provider, desc}}
 }
@@ -0,0 +1,151 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package content_test
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/local"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const benchLayerSize = 64 << 20
+
+// diskUsage returns the total size of all files below the given root.
+func diskUsage(root string) int64 {
+	var total int64
+	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// peakReader samples the disk usage of root while being read and records the peak.
+type peakReader struct {
+	r     io.Reader
+	root  string
+	read  int64
+	peak  int64
+	total int64
+}
+
+func (p *peakReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	p.total += int64(n)
+	if p.read >= 4<<20 || err == io.EOF {
+		p.read = 0
+		if usage := diskUsage(p.root); usage > p.peak {
+			p.peak = usage
+		}
+	}
+	return n, err
+}
+
+func benchLayerFile(b *testing.B) string {
+	path := filepath.Join(b.TempDir(), "rootfs")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if _, err := io.CopyN(f, rand.Reader, benchLayerSize); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+func reportPeak(b *testing.B, peak, read int64) {
+	b.ReportMetric(float64(peak)/benchLayerSize, "peak-disk/layer-size")
+	b.ReportMetric(float64(read)/float64(b.N)/benchLayerSize, "source-reads/op")
+}
+
+// BenchmarkFileLayer benchmarks the previous build path of hashing the file and then writing it to the store.
+func BenchmarkFileLayer(b *testing.B) {
+	ctx := context.Background()
+	path := benchLayerFile(b)
+	b.SetBytes(benchLayerSize)
+
+	var peak, read int64
+	for i := 0; i < b.N; i++ {
+		root := filepath.Join(b.TempDir(), fmt.Sprint(i))
+		store, err := local.NewStore(root)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		// FileLayer reads the file once for hashing, writing it reads the file a second time.
+		layer, err := imageutil.FileLayer(path, imageutil.WithMediaType(ocispec.MediaTypeImageLayer))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := WriteLayerToIngester(ctx, store, layer); err != nil {
+			b.Fatal(err)
+		}
+		read += 2 * benchLayerSize
+		if usage := diskUsage(root); usage > peak {
+			peak = usage
+		}
+	}
+	reportPeak(b, peak, read)
+}
+
+// BenchmarkIngestLayer benchmarks streaming the file directly into the store.
+func BenchmarkIngestLayer(b *testing.B) {
+	ctx := context.Background()
+	path := benchLayerFile(b)
+	b.SetBytes(benchLayerSize)
+
+	var peak, read int64
+	for i := 0; i < b.N; i++ {
+		root := filepath.Join(b.TempDir(), fmt.Sprint(i))
+		store, err := local.NewStore(root)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		pr := &peakReader{r: f, root: root}
+		if _, err := IngestLayer(ctx, store, "bench", pr, imageutil.WithMediaType(ocispec.MediaTypeImageLayer)); err != nil {
+			b.Fatal(err)
+		}
+		_ = f.Close()
+
+		read += pr.total
+		if pr.peak > peak {
+			peak = pr.peak
+		}
+	}
+	reportPeak(b, peak, read)
+}
@@ -0,0 +1,357 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package content_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/content"
+
+	. "github.com/onmetal/onmetal-image/oci/content"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/local"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type cancelReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.cancel()
+	return n, err
+}
+
+// fullStore is a store that runs out of space after limit bytes were written to a writer.
+type fullStore struct {
+	*local.Store
+	limit int64
+}
+
+func (s *fullStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	w, err := s.Store.Writer(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &fullWriter{Writer: w, remaining: s.limit}, nil
+}
+
+type fullWriter struct {
+	content.Writer
+	remaining int64
+}
+
+func (w *fullWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.remaining {
+		n, err := w.Writer.Write(p[:w.remaining])
+		w.remaining -= int64(n)
+		if err != nil {
+			return n, err
+		}
+		return n, &os.PathError{Op: "write", Path: "data", Err: syscall.ENOSPC}
+	}
+	n, err := w.Writer.Write(p)
+	w.remaining -= int64(n)
+	return n, err
+}
+
+// hangingLayer is a layer whose content blocks after the first read until the context is done.
+type hangingLayer struct {
+	desc ocispec.Descriptor
+}
+
+func (l *hangingLayer) Descriptor() ocispec.Descriptor {
+	return l.desc
+}
+
+func (l *hangingLayer) Content(ctx context.Context) (io.ReadCloser, error) {
+	return io.NopCloser(&hangingReader{ctx: ctx}), nil
+}
+
+type hangingReader struct {
+	ctx  context.Context
+	read bool
+}
+
+func (r *hangingReader) Read(p []byte) (int, error) {
+	if !r.read {
+		r.read = true
+		return copy(p, "partial"), nil
+	}
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+// countingLayer counts how often its content is opened.
+type countingLayer struct {
+	ociimage.Layer
+	opens int
+}
+
+func (l *countingLayer) Content(ctx context.Context) (io.ReadCloser, error) {
+	l.opens++
+	return l.Layer.Content(ctx)
+}
+
+var _ = Describe("WriteLayerToIngester", func() {
+	It("should skip existing blobs unless forced to rewrite them", func() {
+		ctx := context.Background()
+		s, err := local.NewStore(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+
+		layer := &countingLayer{Layer: imageutil.BytesLayer([]byte("layer"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer))}
+		Expect(WriteLayerToIngester(ctx, s, layer)).To(Succeed())
+		Expect(layer.opens).To(Equal(1))
+
+		By("writing the layer again")
+		Expect(WriteLayerToIngester(ctx, s, layer)).To(Succeed())
+		Expect(layer.opens).To(Equal(1))
+
+		By("forcing a rewrite")
+		Expect(WriteLayerToIngester(ctx, s, layer, WithForceRewrite())).To(Succeed())
+		Expect(layer.opens).To(Equal(2))
+		Expect(content.ReadBlob(ctx, s, layer.Descriptor())).To(Equal([]byte("layer")))
+	})
+
+	It("should report the phase in progress when the context deadline is exceeded", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		s, err := local.NewStore(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+
+		layer := &hangingLayer{desc: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayer,
+			Digest:    digest.FromString("never completed"),
+			Size:      1000,
+		}}
+
+		err = WriteLayerToIngester(ctx, s, layer)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+		var phaseErr *PhaseError
+		Expect(errors.As(err, &phaseErr)).To(BeTrue())
+		Expect(phaseErr.Phase).To(Equal("download layer " + layer.desc.Digest.String()))
+		Expect(err.Error()).To(ContainSubstring("timed out during download layer"))
+	})
+
+	It("should report the missing bytes and clean up the ingest when running out of space", func() {
+		ctx := context.Background()
+		s, err := local.NewStore(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		store := &fullStore{Store: s, limit: 100}
+
+		layer := imageutil.BytesLayer(make([]byte, 1000), imageutil.WithMediaType(ocispec.MediaTypeImageLayer))
+
+		err = WriteLayerToIngester(ctx, store, layer)
+		Expect(err).To(MatchError(ErrNoSpace))
+		var noSpaceErr *NoSpaceError
+		Expect(errors.As(err, &noSpaceErr)).To(BeTrue())
+		Expect(noSpaceErr.Needed).To(BeEquivalentTo(900))
+
+		statuses, err := s.ListStatuses(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(statuses).To(BeEmpty())
+	})
+})
+
+// flakyLayer is a layer whose content fails to open the first failures times.
+type flakyLayer struct {
+	ociimage.Layer
+	failures int
+}
+
+func (l *flakyLayer) Content(ctx context.Context) (io.ReadCloser, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, errors.New("connection reset")
+	}
+	return l.Layer.Content(ctx)
+}
+
+var _ = Describe("WriteImageToIngesterWithReport", func() {
+	var (
+		ctx    = context.Background()
+		config = imageutil.BytesLayer([]byte("{}"), imageutil.WithMediaType(ocispec.MediaTypeImageConfig))
+		first  = imageutil.BytesLayer([]byte("first"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer))
+		last   = imageutil.BytesLayer([]byte("last"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer))
+		flaky  *flakyLayer
+		img    ociimage.Image
+		s      *local.Store
+	)
+
+	BeforeEach(func() {
+		flaky = &flakyLayer{Layer: imageutil.BytesLayer([]byte("flaky"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)), failures: 1}
+		var err error
+		img, err = imageutil.NewBuilder(config).Layers(first, flaky, last).Complete()
+		Expect(err).NotTo(HaveOccurred())
+		s, err = local.NewStore(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	outcomes := func(report *WriteReport) []BlobOutcome {
+		var res []BlobOutcome
+		for _, blob := range report.Blobs {
+			res = append(res, blob.Outcome)
+		}
+		return res
+	}
+
+	It("should stop at the first failing blob and name it", func() {
+		report, err := WriteImageToIngesterWithReport(ctx, s, img)
+		var blobErr *BlobError
+		Expect(errors.As(err, &blobErr)).To(BeTrue())
+		Expect(blobErr.Descriptor.Digest).To(Equal(flaky.Descriptor().Digest))
+		Expect(err).To(MatchError(ContainSubstring(flaky.Descriptor().Digest.String())))
+		Expect(outcomes(report)).To(Equal([]BlobOutcome{BlobWritten, BlobWritten, BlobFailed}))
+	})
+
+	It("should continue past failing blobs and only retry those", func() {
+		report, err := WriteImageToIngesterWithReport(ctx, s, img, WithContinueOnError())
+		Expect(err).To(HaveOccurred())
+		Expect(outcomes(report)).To(Equal([]BlobOutcome{BlobWritten, BlobWritten, BlobFailed, BlobWritten, BlobFailed}))
+		Expect(report.Err()).To(MatchError(ErrIncompleteImage))
+		Expect(report.Failed()).To(Equal([]ocispec.Descriptor{flaky.Descriptor(), img.Descriptor()}))
+		Expect(FailedBlobs(err)).To(Equal(report.Failed()))
+		Expect(Exists(ctx, s, last.Descriptor())).To(BeTrue())
+		Expect(Exists(ctx, s, img.Descriptor())).To(BeFalse())
+
+		By("retrying the failed blobs")
+		report, err = WriteImageToIngesterWithReport(ctx, s, img, WithRetryFailed(report))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(outcomes(report)).To(Equal([]BlobOutcome{BlobWritten, BlobWritten, BlobWritten, BlobWritten, BlobWritten}))
+		Expect(Exists(ctx, s, img.Descriptor())).To(BeTrue())
+	})
+})
+
+// manifestOnlyStore is a store that only allows reading the blob of the manifest.
+type manifestOnlyStore struct {
+	*local.Store
+	manifest digest.Digest
+}
+
+func (s *manifestOnlyStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	if desc.Digest != s.manifest {
+		return nil, errors.New("unexpected read of blob " + desc.Digest.String())
+	}
+	return s.Store.ReaderAt(ctx, desc)
+}
+
+var _ = Describe("IngestLayer", func() {
+	var (
+		ctx   context.Context
+		store *local.Store
+	)
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		s, err := local.NewStore(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		store = s
+	})
+
+	It("should stream the content into the store and compute the descriptor", func() {
+		data := []byte("rootfs")
+		layer, err := IngestLayer(ctx, store, "test", bytes.NewReader(data), imageutil.WithMediaType(ocispec.MediaTypeImageLayer))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(layer.Descriptor()).To(Equal(ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayer,
+			Digest:    digest.FromBytes(data),
+			Size:      int64(len(data)),
+		}))
+		Expect(imageutil.ReadLayerContent(ctx, layer)).To(Equal(data))
+	})
+
+	It("should abort the ingest if the context is cancelled", func() {
+		cancelCtx, cancel := context.WithCancel(ctx)
+		r := &cancelReader{r: bytes.NewReader(make([]byte, 1<<20)), cancel: cancel}
+
+		_, err := IngestLayer(cancelCtx, store, "test", r)
+		Expect(err).To(MatchError(context.Canceled))
+
+		statuses, err := store.ListStatuses(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(statuses).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Image", func() {
+	It("should keep the original bytes of manifests not generated by this module", func() {
+		ctx := context.Background()
+		s, err := local.NewStore(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+
+		data := []byte("{\n  \"schemaVersion\": 2,\n  \"mediaType\": \"application/vnd.oci.image.manifest.v1+json\",\n  \"config\": {\"mediaType\": \"application/vnd.oci.empty.v1+json\", \"digest\": \"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a\", \"size\": 2},\n  \"layers\": []\n}\n")
+		desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(data), Size: int64(len(data))}
+		Expect(content.WriteBlob(ctx, s, "manifest", bytes.NewReader(data), desc)).To(Succeed())
+
+		img := Image(s, desc)
+		manifest, err := img.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest.Config.Size).To(Equal(int64(2)))
+		Expect(imageutil.ReadLayerContent(ctx, img)).To(Equal(data))
+		Expect(img.Descriptor().Digest).To(Equal(desc.Digest))
+	})
+
+	It("should report missing blobs without reading them", func() {
+		ctx := context.Background()
+		s, err := local.NewStore(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+
+		config := imageutil.BytesLayer([]byte("{}"), imageutil.WithMediaType(ocispec.MediaTypeImageConfig))
+		kept := imageutil.BytesLayer([]byte("kept"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer))
+		deleted := imageutil.BytesLayer([]byte("deleted"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer))
+		built, err := imageutil.NewBuilder(config).Layers(kept, deleted).Complete()
+		Expect(err).NotTo(HaveOccurred())
+		layers, err := ociimage.AsWriteLayers(ctx, built)
+		Expect(err).NotTo(HaveOccurred())
+		for _, layer := range layers {
+			Expect(WriteLayerToIngester(ctx, s, layer)).To(Succeed())
+		}
+
+		img := Image(&manifestOnlyStore{s, built.Descriptor().Digest}, built.Descriptor())
+		complete, missing, err := img.Complete(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(complete).To(BeTrue())
+		Expect(missing).To(BeEmpty())
+
+		Expect(s.Delete(ctx, deleted.Descriptor().Digest)).To(Succeed())
+		complete, missing, err = img.Complete(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(complete).To(BeFalse())
+		Expect(missing).To(ConsistOf(deleted.Descriptor()))
+
+		err = ociimage.CheckComplete(ctx, img)
+		Expect(err).To(MatchError(ociimage.ErrIncompleteImage))
+		Expect(err).To(MatchError(ContainSubstring(deleted.Descriptor().Digest.String())))
+		var incomplete *ociimage.IncompleteImageError
+		Expect(errors.As(err, &incomplete)).To(BeTrue())
+		Expect(incomplete.Missing).To(ConsistOf(deleted.Descriptor()))
+	})
+})
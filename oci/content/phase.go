@@ -0,0 +1,57 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package content
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// PhaseError is returned if an operation was aborted because its context expired or was cancelled.
+// It records the phase that was in progress, e.g. "download layer sha256:...".
+type PhaseError struct {
+	// Phase is the phase that was in progress.
+	Phase string
+	// Cause is the context error, i.e. context.DeadlineExceeded or context.Canceled.
+	Cause error
+	// Err is the error the aborted operation failed with.
+	Err error
+}
+
+func (e *PhaseError) Error() string {
+	if errors.Is(e.Cause, context.DeadlineExceeded) {
+		return fmt.Sprintf("timed out during %s: %v", e.Phase, e.Err)
+	}
+	return fmt.Sprintf("aborted during %s: %v", e.Phase, e.Err)
+}
+
+func (e *PhaseError) Unwrap() []error {
+	return []error{e.Cause, e.Err}
+}
+
+// WithPhase wraps err into a *PhaseError for the given phase if the context is done.
+// Errors that already contain a *PhaseError are returned as-is, so the innermost phase is reported.
+func WithPhase(ctx context.Context, phase string, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+
+	var phaseErr *PhaseError
+	if errors.As(err, &phaseErr) {
+		return err
+	}
+	return &PhaseError{Phase: phase, Cause: ctx.Err(), Err: err}
+}
@@ -0,0 +1,148 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package content
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/go-logr/logr"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// IngestStaleAfter is the age after which an interrupted ingest is considered abandoned: it is restarted
+// from scratch instead of being resumed, and local.Store.CleanupIngests removes it.
+const IngestStaleAfter = 24 * time.Hour
+
+type ingestSourceKey struct{}
+
+// WithIngestSource returns a context recording ref as the image the blobs ingested with it originate from,
+// see IngestRecorder.
+func WithIngestSource(ctx context.Context, ref string) context.Context {
+	return context.WithValue(ctx, ingestSourceKey{}, ref)
+}
+
+// IngestSource returns the image reference recorded with WithIngestSource, if any.
+func IngestSource(ctx context.Context) string {
+	ref, _ := ctx.Value(ingestSourceKey{}).(string)
+	return ref
+}
+
+// IngestRecorder is implemented by ingesters that record the expected digest and the originating image
+// of their ingests, so they can be reported while in flight or after an interruption.
+type IngestRecorder interface {
+	RecordIngest(ref string, expected digest.Digest, source string) error
+}
+
+// RecordIngest records the ingest of desc under ref at the ingester, if it is an IngestRecorder.
+// Failing to record only loses status information, so it is logged instead of returned.
+func RecordIngest(ctx context.Context, ingester content.Ingester, ref string, desc ocispec.Descriptor) {
+	recorder, ok := ingester.(IngestRecorder)
+	if !ok {
+		return
+	}
+	if err := recorder.RecordIngest(ref, desc.Digest, IngestSource(ctx)); err != nil {
+		logr.FromContextOrDiscard(ctx).V(1).Info("Error recording ingest", "Ref", ref, "Error", err.Error())
+	}
+}
+
+// ExpectedDigest returns the digest of the blob an ingest ref made by remotes.MakeRefKey (optionally with
+// a suffix) is for, or an empty digest if the ref has another format.
+func ExpectedDigest(ref string) digest.Digest {
+	_, rest, ok := strings.Cut(ref, "-")
+	if !ok {
+		return ""
+	}
+	rest, _, _ = strings.Cut(rest, "-")
+	dgst, err := digest.Parse(rest)
+	if err != nil {
+		return ""
+	}
+	return dgst
+}
+
+// ResumeOffset returns the offset an interrupted ingest with the given status can be resumed at for the
+// blob of desc, or zero if it has to start from scratch: if nothing was written yet, the blob has no
+// known size, the ingest is complete or oversized or it is stale (see IngestStaleAfter).
+func ResumeOffset(status content.Status, desc ocispec.Descriptor) int64 {
+	switch {
+	case status.Offset <= 0,
+		!imageutil.HasKnownSize(desc),
+		status.Offset >= desc.Size,
+		time.Since(status.UpdatedAt) > IngestStaleAfter:
+		return 0
+	default:
+		return status.Offset
+	}
+}
+
+// OpenContentAt opens the content of the layer at the given offset. If the content cannot be read from
+// the offset, it is returned from the start and resumed is false.
+func OpenContentAt(ctx context.Context, layer ociimage.Layer, offset int64) (rc io.ReadCloser, resumed bool, err error) {
+	rc, err = layer.Content(ctx)
+	if err != nil || offset == 0 {
+		return rc, false, err
+	}
+
+	seeker, ok := rc.(io.Seeker)
+	if !ok {
+		return rc, false, nil
+	}
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		// Seeking may have consumed the content already, start over.
+		_ = rc.Close()
+		rc, err = layer.Content(ctx)
+		return rc, false, err
+	}
+	return rc, true, nil
+}
+
+// resumeIngest prepares the writer of an ingest for writing the content of the layer: an interrupted
+// ingest is resumed if possible and truncated otherwise. It returns the content to write, positioned at
+// the returned offset, and reports a progress.BlobResumed event when resuming.
+func resumeIngest(ctx context.Context, w content.Writer, layer ociimage.Layer) (io.ReadCloser, int64, error) {
+	desc := layer.Descriptor()
+	status, err := w.Status()
+	if err != nil {
+		status = content.Status{}
+	}
+
+	rc, resumed, err := OpenContentAt(ctx, layer, ResumeOffset(status, desc))
+	if err != nil {
+		return nil, 0, err
+	}
+	if !resumed {
+		// Restart interrupted ingests from scratch if they cannot be resumed.
+		if status.Offset > 0 {
+			if err := w.Truncate(0); err != nil {
+				_ = rc.Close()
+				return nil, 0, fmt.Errorf("error truncating ingest: %w", err)
+			}
+		}
+		return rc, 0, nil
+	}
+
+	logr.FromContextOrDiscard(ctx).Info("Resuming interrupted download", "Digest", desc.Digest, "Offset", status.Offset, "Total", desc.Size)
+	progress.FromContext(ctx).Report(progress.BlobResumed{Digest: desc.Digest, Offset: status.Offset, Total: desc.Size})
+	return rc, status.Offset, nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/opencontainers/go-digest"
+)
+
+// ImageGetter gets images by name, e.g. the images.Store of a containerd client.
+type ImageGetter interface {
+	Get(ctx context.Context, name string) (images.Image, error)
+}
+
+// ContainerdImage returns the image with the given name of the containerd image store, reading its blobs
+// from the content provider. If the image is an index, the manifest matching the platform is imported.
+// The context has to carry the namespace of the image. The digest of the image target is returned as well.
+func ContainerdImage(
+	ctx context.Context,
+	getter ImageGetter,
+	provider content.Provider,
+	name string,
+	platform platforms.MatchComparer,
+) (ociimage.Image, digest.Digest, error) {
+	image, err := getter.Get(ctx, name)
+	if err != nil {
+		return nil, "", fmt.Errorf("error getting image %s: %w", name, err)
+	}
+
+	manifest, err := images.Manifest(ctx, provider, image.Target, platform)
+	if err != nil {
+		return nil, "", fmt.Errorf("error getting manifest of %s: %w", name, err)
+	}
+
+	img, err := Convert(ctx, provider, manifest)
+	if err != nil {
+		return nil, "", err
+	}
+	return img, image.Target.Digest, nil
+}
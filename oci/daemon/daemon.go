@@ -0,0 +1,171 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package daemon imports images from the image stores of container engines running on the host, i.e.
+// the docker daemon and containerd.
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/onmetal/onmetal-image/mediatypes"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// ImportedFromAnnotation is the index entry annotation recording the source an image was imported from,
+	// e.g. "docker-daemon:myimage:tag".
+	ImportedFromAnnotation = "image.onmetal.de/imported-from"
+	// ImportedDigestAnnotation is the index entry annotation recording the digest of the image in its source,
+	// i.e. the image id for the docker daemon and the manifest or index digest for containerd.
+	ImportedDigestAnnotation = "image.onmetal.de/imported-digest"
+)
+
+// ErrUnsupportedImage is returned for images that cannot be imported completely, i.e. Windows images and
+// images with foreign layers whose content is not part of the image store.
+var ErrUnsupportedImage = errors.New("unsupported image")
+
+// SourceType is the type of image store an image is imported from.
+type SourceType string
+
+const (
+	// SourceDockerDaemon imports from the image store of the docker daemon.
+	SourceDockerDaemon SourceType = "docker-daemon"
+	// SourceContainerd imports from the image store of containerd.
+	SourceContainerd SourceType = "containerd"
+)
+
+// Source is an image of the image store of a container engine.
+type Source struct {
+	Type SourceType
+	// Namespace is the containerd namespace of the image. It is empty for the docker daemon.
+	Namespace string
+	// Name is the name of the image in the image store.
+	Name string
+}
+
+// ParseSource parses a source of the form "docker-daemon:image[:tag]" or "containerd:namespace/image[:tag]".
+func ParseSource(s string) (Source, error) {
+	typ, name, ok := strings.Cut(s, ":")
+	if !ok || name == "" {
+		return Source{}, fmt.Errorf("invalid import source %q, expected docker-daemon:image[:tag] or containerd:namespace/image[:tag]", s)
+	}
+
+	switch SourceType(typ) {
+	case SourceDockerDaemon:
+		return Source{Type: SourceDockerDaemon, Name: name}, nil
+	case SourceContainerd:
+		namespace, name, ok := strings.Cut(name, "/")
+		if !ok || namespace == "" || name == "" {
+			return Source{}, fmt.Errorf("invalid containerd import source %q, expected containerd:namespace/image[:tag]", s)
+		}
+		return Source{Type: SourceContainerd, Namespace: namespace, Name: name}, nil
+	default:
+		return Source{}, fmt.Errorf("unknown import source type %q, expected %s or %s", typ, SourceDockerDaemon, SourceContainerd)
+	}
+}
+
+func (s Source) String() string {
+	if s.Namespace != "" {
+		return fmt.Sprintf("%s:%s/%s", s.Type, s.Namespace, s.Name)
+	}
+	return fmt.Sprintf("%s:%s", s.Type, s.Name)
+}
+
+// ociMediaType returns the OCI media type of a config or layer with the given media type. Docker media types
+// describe the same bytes as their OCI counterparts, so converting them keeps the digests.
+func ociMediaType(mediaType string) (string, error) {
+	// Layers of registered onmetal media types have no Docker counterpart and are kept as-is.
+	if _, ok := mediatypes.Lookup(mediaType); ok {
+		return mediaType, nil
+	}
+	switch mediaType {
+	case images.MediaTypeDockerSchema2Config:
+		return ocispec.MediaTypeImageConfig, nil
+	case images.MediaTypeDockerSchema2Layer:
+		return ocispec.MediaTypeImageLayer, nil
+	case images.MediaTypeDockerSchema2LayerGzip:
+		return ocispec.MediaTypeImageLayerGzip, nil
+	case images.MediaTypeDockerSchema2LayerForeign,
+		images.MediaTypeDockerSchema2LayerForeignGzip,
+		ocispec.MediaTypeImageLayerNonDistributable,
+		ocispec.MediaTypeImageLayerNonDistributableGzip,
+		ocispec.MediaTypeImageLayerNonDistributableZstd:
+		return "", fmt.Errorf("%w: foreign layer media type %s", ErrUnsupportedImage, mediaType)
+	default:
+		return mediaType, nil
+	}
+}
+
+// Convert returns an OCI image of the manifest whose blobs are served by the provider. Docker media types
+// are translated to their OCI equivalents, preserving the config and layer digests. The manifest itself is
+// rewritten and gets a new digest.
+// Windows images, images with foreign layers and images with layers missing from the provider are rejected
+// before any of their blobs is written.
+func Convert(ctx context.Context, provider content.Provider, manifest ocispec.Manifest) (ociimage.Image, error) {
+	config := manifest.Config
+	mediaType, err := ociMediaType(config.MediaType)
+	if err != nil {
+		return nil, err
+	}
+	config.MediaType = mediaType
+
+	if config.MediaType == ocispec.MediaTypeImageConfig {
+		data, err := content.ReadBlob(ctx, provider, config)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config: %w", err)
+		}
+		var imageConfig ocispec.Image
+		if err := json.Unmarshal(data, &imageConfig); err != nil {
+			return nil, fmt.Errorf("error decoding config: %w", err)
+		}
+		if imageConfig.OS == "windows" {
+			return nil, fmt.Errorf("%w: windows images are not supported", ErrUnsupportedImage)
+		}
+	}
+
+	layers := make([]ociimage.Layer, 0, len(manifest.Layers))
+	descs := make([]ocispec.Descriptor, 0, len(manifest.Layers))
+	for _, desc := range manifest.Layers {
+		mediaType, err := ociMediaType(desc.MediaType)
+		if err != nil {
+			return nil, fmt.Errorf("error converting layer %s: %w", desc.Digest, err)
+		}
+		desc.MediaType = mediaType
+		layers = append(layers, ocicontent.Layer(provider, desc))
+		descs = append(descs, desc)
+	}
+
+	missing, err := ocicontent.Missing(ctx, provider, descs...)
+	if err != nil {
+		return nil, fmt.Errorf("error checking layers: %w", err)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("layer %s is not in the image store, it may not have been unpacked or fully pulled", missing[0].Digest)
+	}
+
+	return imageutil.NewBuilder(ocicontent.Layer(provider, config)).
+		Layers(layers...).
+		Annotations(manifest.Annotations).
+		Complete()
+}
@@ -0,0 +1,264 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/docker/api/types"
+	. "github.com/onmetal/onmetal-image/oci/daemon"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/local"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type fakeDockerClient struct {
+	os      string
+	archive []byte
+}
+
+func (c *fakeDockerClient) ImageInspectWithRaw(_ context.Context, _ string) (types.ImageInspect, []byte, error) {
+	return types.ImageInspect{Os: c.os}, nil, nil
+}
+
+func (c *fakeDockerClient) ImageSave(_ context.Context, _ []string) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(c.archive)), nil
+}
+
+type fakeImageGetter map[string]images.Image
+
+func (g fakeImageGetter) Get(_ context.Context, name string) (images.Image, error) {
+	image, ok := g[name]
+	if !ok {
+		return images.Image{}, errdefs.ErrNotFound
+	}
+	return image, nil
+}
+
+var _ = Describe("Daemon", func() {
+	var (
+		ctx   = context.Background()
+		store *local.Store
+	)
+
+	BeforeEach(func() {
+		var err error
+		store, err = local.NewStore(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(zw.Close()).To(Succeed())
+		return buf.Bytes()
+	}
+
+	configJSON := func(os string) []byte {
+		data, err := json.Marshal(ocispec.Image{Platform: ocispec.Platform{OS: os, Architecture: "amd64"}})
+		Expect(err).NotTo(HaveOccurred())
+		return data
+	}
+
+	DescribeTable("should parse sources",
+		func(s string, expected Source) {
+			Expect(ParseSource(s)).To(Equal(expected))
+		},
+		Entry("docker daemon", "docker-daemon:myimage:tag", Source{Type: SourceDockerDaemon, Name: "myimage:tag"}),
+		Entry("containerd", "containerd:k8s.io/docker.io/library/alpine:3", Source{Type: SourceContainerd, Namespace: "k8s.io", Name: "docker.io/library/alpine:3"}),
+	)
+
+	DescribeTable("should reject invalid sources",
+		func(s string) {
+			_, err := ParseSource(s)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("no type", "myimage"),
+		Entry("unknown type", "podman:myimage"),
+		Entry("containerd without namespace", "containerd:myimage"),
+	)
+
+	Describe("DockerImage", func() {
+		var (
+			config = configJSON("linux")
+			// The large layer exceeds the size kept in memory and is ingested into the store.
+			large = bytes.Repeat([]byte("large layer "), 200<<10)
+			small = gzipped([]byte("small layer"))
+		)
+
+		// save returns a docker save archive with the given manifest.json entry, the config and the layers,
+		// the small one linked from a second location.
+		save := func(m map[string]any) []byte {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			add := func(name string, data []byte) {
+				Expect(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})).To(Succeed())
+				_, err := tw.Write(data)
+				Expect(err).NotTo(HaveOccurred())
+			}
+			add("large/layer.tar", large)
+			add("small/layer.tar", small)
+			Expect(tw.WriteHeader(&tar.Header{Name: "linked/layer.tar", Linkname: "../small/layer.tar", Typeflag: tar.TypeSymlink})).To(Succeed())
+			add("config.json", config)
+			data, err := json.Marshal([]map[string]any{m})
+			Expect(err).NotTo(HaveOccurred())
+			add("manifest.json", data)
+			Expect(tw.Close()).To(Succeed())
+			return buf.Bytes()
+		}
+
+		It("should convert a saved image preserving the blob digests", func() {
+			client := &fakeDockerClient{
+				os:      "linux",
+				archive: save(map[string]any{"Config": "config.json", "Layers": []string{"large/layer.tar", "linked/layer.tar"}}),
+			}
+
+			img, id, err := DockerImage(ctx, client, "myimage:tag", store)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id).To(Equal(digest.FromBytes(config)))
+
+			manifest, err := img.Manifest(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(manifest.Config.MediaType).To(Equal(ocispec.MediaTypeImageConfig))
+			Expect(manifest.Config.Digest).To(Equal(digest.FromBytes(config)))
+			Expect(manifest.Layers).To(HaveLen(2))
+			Expect(manifest.Layers[0].MediaType).To(Equal(ocispec.MediaTypeImageLayer))
+			Expect(manifest.Layers[0].Digest).To(Equal(digest.FromBytes(large)))
+			Expect(manifest.Layers[1].MediaType).To(Equal(ocispec.MediaTypeImageLayerGzip))
+			Expect(manifest.Layers[1].Digest).To(Equal(digest.FromBytes(small)))
+
+			By("reading the ingested large layer from the store")
+			Expect(content.ReadBlob(ctx, store, manifest.Layers[0])).To(Equal(large))
+			layers, err := img.Layers(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(imageutil.ReadLayerContent(ctx, layers[1])).To(Equal(small))
+		})
+
+		It("should reject windows images", func() {
+			client := &fakeDockerClient{os: "windows"}
+
+			_, _, err := DockerImage(ctx, client, "myimage:tag", store)
+			Expect(err).To(MatchError(ErrUnsupportedImage))
+		})
+
+		It("should reject images with foreign layers", func() {
+			client := &fakeDockerClient{
+				os: "linux",
+				archive: save(map[string]any{
+					"Config": "config.json",
+					"Layers": []string{"large/layer.tar"},
+					"LayerSources": map[string]ocispec.Descriptor{
+						digest.FromString("foreign").String(): {MediaType: images.MediaTypeDockerSchema2LayerForeignGzip},
+					},
+				}),
+			}
+
+			_, _, err := DockerImage(ctx, client, "myimage:tag", store)
+			Expect(err).To(MatchError(ErrUnsupportedImage))
+		})
+	})
+
+	Describe("ContainerdImage", func() {
+		// put writes the blob into the store and returns its descriptor.
+		put := func(mediaType string, data []byte) ocispec.Descriptor {
+			desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+			Expect(content.WriteBlob(ctx, store, desc.Digest.String(), bytes.NewReader(data), desc)).To(Succeed())
+			return desc
+		}
+
+		// manifest writes a docker schema 2 manifest with the config and layers and returns its descriptor.
+		manifest := func(config ocispec.Descriptor, layers ...ocispec.Descriptor) ocispec.Descriptor {
+			data, err := json.Marshal(map[string]any{
+				"schemaVersion": 2,
+				"mediaType":     images.MediaTypeDockerSchema2Manifest,
+				"config":        config,
+				"layers":        layers,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return put(images.MediaTypeDockerSchema2Manifest, data)
+		}
+
+		It("should convert docker media types preserving the blob digests", func() {
+			var (
+				config = put(images.MediaTypeDockerSchema2Config, configJSON("linux"))
+				layer  = put(images.MediaTypeDockerSchema2LayerGzip, gzipped([]byte("layer")))
+				target = manifest(config, layer)
+				getter = fakeImageGetter{"docker.io/library/myimage:tag": {Name: "docker.io/library/myimage:tag", Target: target}}
+			)
+
+			img, dgst, err := ContainerdImage(ctx, getter, store, "docker.io/library/myimage:tag", platforms.Default())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dgst).To(Equal(target.Digest))
+
+			m, err := img.Manifest(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m.Config.MediaType).To(Equal(ocispec.MediaTypeImageConfig))
+			Expect(m.Config.Digest).To(Equal(config.Digest))
+			Expect(m.Layers).To(HaveLen(1))
+			Expect(m.Layers[0].MediaType).To(Equal(ocispec.MediaTypeImageLayerGzip))
+			Expect(m.Layers[0].Digest).To(Equal(layer.Digest))
+		})
+
+		It("should reject foreign layers", func() {
+			var (
+				config  = put(images.MediaTypeDockerSchema2Config, configJSON("linux"))
+				foreign = put(images.MediaTypeDockerSchema2LayerForeignGzip, gzipped([]byte("foreign")))
+				getter  = fakeImageGetter{"myimage": {Name: "myimage", Target: manifest(config, foreign)}}
+			)
+
+			_, _, err := ContainerdImage(ctx, getter, store, "myimage", platforms.Default())
+			Expect(err).To(MatchError(ErrUnsupportedImage))
+		})
+
+		It("should reject windows images", func() {
+			var (
+				config = put(images.MediaTypeDockerSchema2Config, configJSON("windows"))
+				layer  = put(images.MediaTypeDockerSchema2LayerGzip, gzipped([]byte("layer")))
+				getter = fakeImageGetter{"myimage": {Name: "myimage", Target: manifest(config, layer)}}
+			)
+
+			_, _, err := ContainerdImage(ctx, getter, store, "myimage", platforms.Only(platforms.MustParse("windows/amd64")))
+			Expect(err).To(MatchError(ErrUnsupportedImage))
+		})
+
+		It("should fail if layers are missing from the content store", func() {
+			var (
+				config  = put(images.MediaTypeDockerSchema2Config, configJSON("linux"))
+				layer   = []byte("not stored")
+				missing = ocispec.Descriptor{MediaType: images.MediaTypeDockerSchema2Layer, Digest: digest.FromBytes(layer), Size: int64(len(layer))}
+				getter  = fakeImageGetter{"myimage": {Name: "myimage", Target: manifest(config, missing)}}
+			)
+
+			_, _, err := ContainerdImage(ctx, getter, store, "myimage", platforms.Default())
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, ErrUnsupportedImage)).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,232 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/docker/docker/api/types"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DockerClient is the part of the docker client API used to import images.
+type DockerClient interface {
+	ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
+	ImageSave(ctx context.Context, imageIDs []string) (io.ReadCloser, error)
+}
+
+// smallFileSize is the size up to which files of a saved image are kept in memory instead of being ingested
+// into the store, so metadata files of the archive do not end up as unreferenced blobs.
+const smallFileSize = 1 << 20
+
+// archiveManifest is an entry of the manifest.json of an image saved by the docker daemon.
+type archiveManifest struct {
+	Config       string
+	RepoTags     []string
+	Layers       []string
+	LayerSources map[digest.Digest]ocispec.Descriptor `json:",omitempty"`
+}
+
+// DockerImage returns the image with the given name of the docker daemon. It streams the image as saved by
+// the daemon, ingesting its layers into the store, which the returned image reads them from.
+// The image id, i.e. the config digest, is returned as well.
+func DockerImage(ctx context.Context, client DockerClient, name string, store content.Store) (ociimage.Image, digest.Digest, error) {
+	inspect, _, err := client.ImageInspectWithRaw(ctx, name)
+	if err != nil {
+		return nil, "", fmt.Errorf("error inspecting image %s: %w", name, err)
+	}
+	if inspect.Os == "windows" {
+		return nil, "", fmt.Errorf("%w: %s is a windows image", ErrUnsupportedImage, name)
+	}
+
+	rc, err := client.ImageSave(ctx, []string{name})
+	if err != nil {
+		return nil, "", fmt.Errorf("error saving image %s: %w", name, err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	archive, err := readArchive(ctx, rc, store)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading saved image %s: %w", name, err)
+	}
+
+	var manifests []archiveManifest
+	data, ok := archive.small["manifest.json"]
+	if !ok {
+		return nil, "", fmt.Errorf("saved image %s has no manifest.json", name)
+	}
+	if err := json.Unmarshal(data, &manifests); err != nil {
+		return nil, "", fmt.Errorf("error decoding manifest.json: %w", err)
+	}
+	if len(manifests) != 1 {
+		return nil, "", fmt.Errorf("expected a single image in the saved image %s, got %d", name, len(manifests))
+	}
+	m := manifests[0]
+	if len(m.LayerSources) > 0 {
+		return nil, "", fmt.Errorf("%w: %s has foreign layers", ErrUnsupportedImage, name)
+	}
+
+	config, err := archive.descriptor(m.Config)
+	if err != nil {
+		return nil, "", fmt.Errorf("error getting config: %w", err)
+	}
+	config.MediaType = ocispec.MediaTypeImageConfig
+
+	manifest := ocispec.Manifest{Config: config}
+	for _, file := range m.Layers {
+		desc, err := archive.descriptor(file)
+		if err != nil {
+			return nil, "", fmt.Errorf("error getting layer: %w", err)
+		}
+		desc.MediaType, err = archive.layerMediaType(ctx, desc)
+		if err != nil {
+			return nil, "", fmt.Errorf("error detecting compression of layer %s: %w", file, err)
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+	}
+
+	img, err := Convert(ctx, archive, manifest)
+	if err != nil {
+		return nil, "", err
+	}
+	return img, config.Digest, nil
+}
+
+// savedArchive holds the files of an image saved by the docker daemon. Small files are kept in memory, the
+// others are ingested into the store. It serves the blobs of both as content.Provider.
+type savedArchive struct {
+	store content.Store
+	// files are the descriptors of the regular files by name.
+	files map[string]ocispec.Descriptor
+	// links are the targets of the symbolic links by name, the daemon links layers shared between images.
+	links map[string]string
+	// small is the content of the small files by name.
+	small map[string][]byte
+	// blobs is the content of the small files by digest.
+	blobs map[digest.Digest][]byte
+}
+
+func readArchive(ctx context.Context, r io.Reader, store content.Store) (*savedArchive, error) {
+	archive := &savedArchive{
+		store: store,
+		files: make(map[string]ocispec.Descriptor),
+		links: make(map[string]string),
+		small: make(map[string][]byte),
+		blobs: make(map[digest.Digest][]byte),
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return archive, nil
+			}
+			return nil, err
+		}
+		name := path.Clean(hdr.Name)
+
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			archive.links[name] = path.Join(path.Dir(name), hdr.Linkname)
+		case tar.TypeReg:
+			if hdr.Size <= smallFileSize {
+				data, err := io.ReadAll(tr)
+				if err != nil {
+					return nil, fmt.Errorf("error reading %s: %w", name, err)
+				}
+				dgst := digest.FromBytes(data)
+				archive.small[name] = data
+				archive.blobs[dgst] = data
+				archive.files[name] = ocispec.Descriptor{Digest: dgst, Size: int64(len(data))}
+				continue
+			}
+
+			layer, err := ocicontent.IngestLayer(ctx, store, "import-"+digest.FromString(name).Encoded(), tr)
+			if err != nil {
+				return nil, fmt.Errorf("error ingesting %s: %w", name, err)
+			}
+			archive.files[name] = layer.Descriptor()
+		}
+	}
+}
+
+// descriptor returns the descriptor of the file with the given name, following symbolic links.
+func (a *savedArchive) descriptor(name string) (ocispec.Descriptor, error) {
+	name = path.Clean(name)
+	for i := 0; i < 16; i++ {
+		if target, ok := a.links[name]; ok {
+			name = target
+			continue
+		}
+		desc, ok := a.files[name]
+		if !ok {
+			return ocispec.Descriptor{}, fmt.Errorf("file %s is missing in the saved image", name)
+		}
+		return desc, nil
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("too many levels of symbolic links resolving %s", name)
+}
+
+// layerMediaType returns the OCI media type of the layer according to the compression of its content.
+func (a *savedArchive) layerMediaType(ctx context.Context, desc ocispec.Descriptor) (string, error) {
+	ra, err := a.ReaderAt(ctx, desc)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = ra.Close() }()
+
+	head := make([]byte, 16)
+	n, err := ra.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	switch compression.DetectCompression(head[:n]) {
+	case compression.Gzip:
+		return ocispec.MediaTypeImageLayerGzip, nil
+	case compression.Zstd:
+		return ocispec.MediaTypeImageLayerZstd, nil
+	default:
+		return ocispec.MediaTypeImageLayer, nil
+	}
+}
+
+// ReaderAt implements content.Provider.
+func (a *savedArchive) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	if data, ok := a.blobs[desc.Digest]; ok {
+		return bytesReaderAt{bytes.NewReader(data)}, nil
+	}
+	return a.store.ReaderAt(ctx, desc)
+}
+
+type bytesReaderAt struct {
+	*bytes.Reader
+}
+
+func (bytesReaderAt) Close() error {
+	return nil
+}
@@ -68,6 +68,20 @@ func Annotation(key, value string) Matcher {
 	}
 }
 
+// HasAnnotation matches descriptors having the annotation with the given key, regardless of its value.
+func HasAnnotation(key string) Matcher {
+	return func(descriptor ocispec.Descriptor) bool {
+		_, ok := descriptor.Annotations[key]
+		return ok
+	}
+}
+
+// Unnamed matches descriptors without a reference name annotation.
+func Unnamed(descriptor ocispec.Descriptor) bool {
+	_, ok := descriptor.Annotations[ocispec.AnnotationRefName]
+	return !ok
+}
+
 func MediaTypes(mediaTypes ...string) Matcher {
 	s := sets.New[string](mediaTypes...)
 	return func(descriptor ocispec.Descriptor) bool {
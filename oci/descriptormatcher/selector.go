@@ -0,0 +1,314 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package descriptormatcher
+
+import (
+	"fmt"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Operator is the operator of a selector Requirement.
+type Operator string
+
+const (
+	// Equals requires the label to have the value.
+	Equals Operator = "="
+	// NotEquals requires the label to be absent or differ from the value.
+	NotEquals Operator = "!="
+	// In requires the label to have one of the values.
+	In Operator = "in"
+	// NotIn requires the label to be absent or have none of the values.
+	NotIn Operator = "notin"
+	// Exists requires the label to be present.
+	Exists Operator = "exists"
+	// DoesNotExist requires the label to be absent.
+	DoesNotExist Operator = "!"
+)
+
+// Requirement is a single condition of a Selector.
+type Requirement struct {
+	Key      string
+	Operator Operator
+	Values   []string
+}
+
+// Matches reports whether the labels satisfy the requirement.
+func (r Requirement) Matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	switch r.Operator {
+	case Equals, In:
+		return ok && contains(r.Values, value)
+	case NotEquals, NotIn:
+		return !ok || !contains(r.Values, value)
+	case Exists:
+		return ok
+	case DoesNotExist:
+		return !ok
+	default:
+		return false
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Selector is a Kubernetes-style label selector, requiring all of its requirements to match.
+// The empty selector matches everything.
+type Selector []Requirement
+
+// Matches reports whether the labels satisfy all requirements of the selector.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Partition splits the selector into the requirements on the given keys and all others.
+func (s Selector) Partition(keys ...string) (matching, others Selector) {
+	for _, r := range s {
+		if contains(keys, r.Key) {
+			matching = append(matching, r)
+		} else {
+			others = append(others, r)
+		}
+	}
+	return matching, others
+}
+
+// Matcher returns a Matcher evaluating the selector against the annotations of descriptors.
+func (s Selector) Matcher() Matcher {
+	return func(descriptor ocispec.Descriptor) bool {
+		return s.Matches(descriptor.Annotations)
+	}
+}
+
+// SelectorError is a syntax error of a selector, pointing at the offending token.
+type SelectorError struct {
+	// Selector is the complete selector.
+	Selector string
+	// Pos is the byte offset of the offending token in Selector.
+	Pos int
+	// Token is the offending token, empty at the end of the selector.
+	Token string
+	// Message describes what was expected instead.
+	Message string
+}
+
+func (e *SelectorError) Error() string {
+	token := "end of selector"
+	if e.Token != "" {
+		token = fmt.Sprintf("%q", e.Token)
+	}
+	return fmt.Sprintf("invalid selector %q: %s at position %d: %s", e.Selector, token, e.Pos, e.Message)
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenIdentifier
+	tokenEquals
+	tokenNotEquals
+	tokenNot
+	tokenComma
+	tokenOpen
+	tokenClose
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// tokenize splits the selector into tokens. Identifiers are runs of characters other than whitespace
+// and the operator characters =!,().
+func tokenize(selector string) []token {
+	var tokens []token
+	for i := 0; i < len(selector); {
+		c := selector[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '=':
+			n := 1
+			if strings.HasPrefix(selector[i:], "==") {
+				n = 2
+			}
+			tokens = append(tokens, token{tokenEquals, selector[i : i+n], i})
+			i += n
+		case c == '!':
+			if strings.HasPrefix(selector[i:], "!=") {
+				tokens = append(tokens, token{tokenNotEquals, "!=", i})
+				i += 2
+			} else {
+				tokens = append(tokens, token{tokenNot, "!", i})
+				i++
+			}
+		case c == ',':
+			tokens = append(tokens, token{tokenComma, ",", i})
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokenOpen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokenClose, ")", i})
+			i++
+		default:
+			start := i
+			for i < len(selector) && !strings.ContainsRune(" \t\n\r=!,()", rune(selector[i])) {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdentifier, selector[start:i], start})
+		}
+	}
+	return append(tokens, token{kind: tokenEnd, pos: len(selector)})
+}
+
+type selectorParser struct {
+	selector string
+	tokens   []token
+}
+
+func (p *selectorParser) peek() token {
+	return p.tokens[0]
+}
+
+func (p *selectorParser) next() token {
+	t := p.tokens[0]
+	if t.kind != tokenEnd {
+		p.tokens = p.tokens[1:]
+	}
+	return t
+}
+
+func (p *selectorParser) errorf(t token, format string, args ...any) error {
+	return &SelectorError{Selector: p.selector, Pos: t.pos, Token: t.text, Message: fmt.Sprintf(format, args...)}
+}
+
+// ParseSelector parses a comma-separated list of requirements, each one of
+//
+//	key=value, key==value, key!=value
+//	key in (value1,value2), key notin (value1,value2)
+//	key, !key
+//
+// Syntax errors are returned as *SelectorError.
+func ParseSelector(selector string) (Selector, error) {
+	p := &selectorParser{selector: selector, tokens: tokenize(selector)}
+	if p.peek().kind == tokenEnd {
+		return nil, nil
+	}
+
+	var sel Selector
+	for {
+		r, err := p.parseRequirement()
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, r)
+
+		switch t := p.next(); t.kind {
+		case tokenEnd:
+			return sel, nil
+		case tokenComma:
+		default:
+			return nil, p.errorf(t, "expected ',' or end of selector")
+		}
+	}
+}
+
+func (p *selectorParser) parseRequirement() (Requirement, error) {
+	if p.peek().kind == tokenNot {
+		p.next()
+		key, err := p.parseKey()
+		if err != nil {
+			return Requirement{}, err
+		}
+		return Requirement{Key: key, Operator: DoesNotExist}, nil
+	}
+
+	key, err := p.parseKey()
+	if err != nil {
+		return Requirement{}, err
+	}
+
+	switch t := p.peek(); {
+	case t.kind == tokenEnd || t.kind == tokenComma:
+		return Requirement{Key: key, Operator: Exists}, nil
+	case t.kind == tokenEquals || t.kind == tokenNotEquals:
+		p.next()
+		op := Equals
+		if t.kind == tokenNotEquals {
+			op = NotEquals
+		}
+		// An omitted value selects the empty value.
+		value := ""
+		if v := p.peek(); v.kind == tokenIdentifier {
+			value = p.next().text
+		}
+		return Requirement{Key: key, Operator: op, Values: []string{value}}, nil
+	case t.kind == tokenIdentifier && (t.text == string(In) || t.text == string(NotIn)):
+		p.next()
+		values, err := p.parseValues()
+		if err != nil {
+			return Requirement{}, err
+		}
+		return Requirement{Key: key, Operator: Operator(t.text), Values: values}, nil
+	default:
+		return Requirement{}, p.errorf(t, "expected one of =, ==, !=, in, notin, ',' or end of selector after key %q", key)
+	}
+}
+
+func (p *selectorParser) parseKey() (string, error) {
+	t := p.next()
+	if t.kind != tokenIdentifier {
+		return "", p.errorf(t, "expected key")
+	}
+	return t.text, nil
+}
+
+func (p *selectorParser) parseValues() ([]string, error) {
+	if t := p.next(); t.kind != tokenOpen {
+		return nil, p.errorf(t, "expected '('")
+	}
+
+	var values []string
+	for {
+		t := p.next()
+		if t.kind != tokenIdentifier {
+			return nil, p.errorf(t, "expected value")
+		}
+		values = append(values, t.text)
+
+		switch t := p.next(); t.kind {
+		case tokenClose:
+			return values, nil
+		case tokenComma:
+		default:
+			return nil, p.errorf(t, "expected ',' or ')'")
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package descriptormatcher_test
+
+import (
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("descriptormatcher.ParseSelector", func() {
+	It("should parse all requirement forms", func() {
+		sel, err := descriptormatcher.ParseSelector("a=1, b==2, c!=3, d in (4,5), e notin (6), f, !g, h=")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sel).To(Equal(descriptormatcher.Selector{
+			{Key: "a", Operator: descriptormatcher.Equals, Values: []string{"1"}},
+			{Key: "b", Operator: descriptormatcher.Equals, Values: []string{"2"}},
+			{Key: "c", Operator: descriptormatcher.NotEquals, Values: []string{"3"}},
+			{Key: "d", Operator: descriptormatcher.In, Values: []string{"4", "5"}},
+			{Key: "e", Operator: descriptormatcher.NotIn, Values: []string{"6"}},
+			{Key: "f", Operator: descriptormatcher.Exists},
+			{Key: "g", Operator: descriptormatcher.DoesNotExist},
+			{Key: "h", Operator: descriptormatcher.Equals, Values: []string{""}},
+		}))
+	})
+
+	It("should evaluate the requirements against labels", func() {
+		sel, err := descriptormatcher.ParseSelector("channel in (stable,beta),arch=amd64,!deprecated")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sel.Matches(map[string]string{"channel": "beta", "arch": "amd64"})).To(BeTrue())
+		Expect(sel.Matches(map[string]string{"channel": "alpha", "arch": "amd64"})).To(BeFalse())
+		Expect(sel.Matches(map[string]string{"channel": "beta", "arch": "amd64", "deprecated": ""})).To(BeFalse())
+
+		sel, err = descriptormatcher.ParseSelector("channel!=stable")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sel.Matches(nil)).To(BeTrue())
+	})
+
+	DescribeTable("should point errors at the offending token",
+		func(selector string, pos int, token string) {
+			_, err := descriptormatcher.ParseSelector(selector)
+			Expect(err).To(BeAssignableToTypeOf(&descriptormatcher.SelectorError{}))
+			selErr := err.(*descriptormatcher.SelectorError)
+			Expect(selErr.Pos).To(Equal(pos))
+			Expect(selErr.Token).To(Equal(token))
+		},
+		Entry("missing key", "=stable", 0, "="),
+		Entry("unknown operator", "channel stable", 8, "stable"),
+		Entry("unclosed values", "channel in (stable", 18, ""),
+		Entry("missing parenthesis", "channel in stable", 11, "stable"),
+		Entry("trailing comma", "channel=stable,", 15, ""),
+	)
+})
@@ -0,0 +1,199 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Accessor wraps an Image with typed accessors for its manifest and config, so callers do not have to
+// fetch and decode them themselves. The manifest and the raw config are read once, checked against the
+// Limits and the size and digest of the descriptors referencing them, and then cached. Since images are
+// content-addressed, the cache is never invalidated. All accessors return copies, so callers may modify
+// the results. An Accessor is safe for concurrent use.
+type Accessor struct {
+	Image
+	limits Limits
+
+	mu        sync.Mutex
+	manifest  *ocispec.Manifest
+	rawConfig []byte
+}
+
+// Access returns an Accessor for the image, applying the given limits. If img already is an *Accessor,
+// it is returned as is, so wrapping an image twice shares the cache.
+func Access(img Image, limits Limits) *Accessor {
+	if a, ok := img.(*Accessor); ok {
+		return a
+	}
+	return &Accessor{Image: img, limits: limits}
+}
+
+// Manifest returns the manifest of the image. Unlike the Manifest of the wrapped image, it reads the raw
+// manifest and verifies it against the descriptor of the image. It fails with a *LimitError if the
+// manifest is larger than Limits.MaxManifestSize.
+func (a *Accessor) Manifest(ctx context.Context) (*ocispec.Manifest, error) {
+	manifest, err := a.cachedManifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cloneManifest(manifest), nil
+}
+
+func (a *Accessor) cachedManifest(ctx context.Context) (*ocispec.Manifest, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.manifest != nil {
+		return a.manifest, nil
+	}
+
+	desc := a.Descriptor()
+	data, err := a.read(ctx, a.Image, desc, "manifest", a.limits.MaxManifestSize)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := DecodeManifest(bytes.NewReader(data), desc, a.limits)
+	if err != nil {
+		return nil, err
+	}
+	a.manifest = manifest
+	return manifest, nil
+}
+
+// ConfigDescriptor returns the descriptor of the config of the image.
+func (a *Accessor) ConfigDescriptor(ctx context.Context) (ocispec.Descriptor, error) {
+	manifest, err := a.cachedManifest(ctx)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return cloneDescriptor(manifest.Config), nil
+}
+
+// RawConfig returns the content of the config blob of the image, verified against the config descriptor.
+// It fails with a *LimitError if the config is larger than Limits.MaxConfigSize.
+func (a *Accessor) RawConfig(ctx context.Context) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.rawConfig == nil {
+		config, err := a.Image.Config(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error getting config layer: %w", err)
+		}
+		data, err := a.read(ctx, config, config.Descriptor(), "config", a.limits.MaxConfigSize)
+		if err != nil {
+			return nil, err
+		}
+		a.rawConfig = data
+	}
+	return append([]byte(nil), a.rawConfig...), nil
+}
+
+// DecodeConfig decodes the raw config of the image into v, see RawConfig.
+func (a *Accessor) DecodeConfig(ctx context.Context, v any) error {
+	data, err := a.RawConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error decoding config: %w", err)
+	}
+	return nil
+}
+
+// Annotations returns the annotations of the manifest of the image. Unlike the annotations of the
+// descriptor of the image, e.g. its index entry, they are part of the content.
+func (a *Accessor) Annotations(ctx context.Context) (map[string]string, error) {
+	manifest, err := a.cachedManifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cloneAnnotations(manifest.Annotations), nil
+}
+
+// read reads the content of the layer, verifying it against desc and failing with a *LimitError if it
+// is larger than max. Zero means no limit.
+func (a *Accessor) read(ctx context.Context, layer Layer, desc ocispec.Descriptor, name string, max int64) ([]byte, error) {
+	if max > 0 && desc.Size > max {
+		return nil, &LimitError{Digest: desc.Digest, Limit: name + " size", Max: max}
+	}
+	rc, err := layer.Content(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting %s content: %w", name, err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	var buf bytes.Buffer
+	lr := &limitedReader{r: rc, max: max}
+	if _, err := ioutils.CopyVerify(ctx, &buf, lr, desc); err != nil {
+		if lr.exceeded {
+			return nil, &LimitError{Digest: desc.Digest, Limit: name + " size", Max: max}
+		}
+		return nil, fmt.Errorf("error reading %s %s: %w", name, desc.Digest, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func cloneAnnotations(annotations map[string]string) map[string]string {
+	if annotations == nil {
+		return nil
+	}
+	res := make(map[string]string, len(annotations))
+	for key, value := range annotations {
+		res[key] = value
+	}
+	return res
+}
+
+func cloneDescriptor(desc ocispec.Descriptor) ocispec.Descriptor {
+	desc.Annotations = cloneAnnotations(desc.Annotations)
+	if desc.URLs != nil {
+		desc.URLs = append([]string(nil), desc.URLs...)
+	}
+	if desc.Data != nil {
+		desc.Data = append([]byte(nil), desc.Data...)
+	}
+	if desc.Platform != nil {
+		platform := *desc.Platform
+		if platform.OSFeatures != nil {
+			platform.OSFeatures = append([]string(nil), platform.OSFeatures...)
+		}
+		desc.Platform = &platform
+	}
+	return desc
+}
+
+func cloneManifest(manifest *ocispec.Manifest) *ocispec.Manifest {
+	res := *manifest
+	res.Config = cloneDescriptor(manifest.Config)
+	if manifest.Layers != nil {
+		res.Layers = make([]ocispec.Descriptor, len(manifest.Layers))
+		for i, layer := range manifest.Layers {
+			res.Layers[i] = cloneDescriptor(layer)
+		}
+	}
+	if manifest.Subject != nil {
+		subject := cloneDescriptor(*manifest.Subject)
+		res.Subject = &subject
+	}
+	res.Annotations = cloneAnnotations(manifest.Annotations)
+	return &res
+}
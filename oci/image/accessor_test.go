@@ -0,0 +1,145 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image_test
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	. "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// countingImage counts the reads of the manifest and config content of the wrapped image and may
+// replace the config layer.
+type countingImage struct {
+	Image
+	config        Layer
+	manifestReads int
+	configReads   int
+}
+
+func (i *countingImage) Content(ctx context.Context) (io.ReadCloser, error) {
+	i.manifestReads++
+	return i.Image.Content(ctx)
+}
+
+func (i *countingImage) Config(ctx context.Context) (Layer, error) {
+	config := i.config
+	if config == nil {
+		var err error
+		if config, err = i.Image.Config(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return &countingLayer{Layer: config, reads: &i.configReads}, nil
+}
+
+type countingLayer struct {
+	Layer
+	reads *int
+}
+
+func (l *countingLayer) Content(ctx context.Context) (io.ReadCloser, error) {
+	*l.reads++
+	return l.Layer.Content(ctx)
+}
+
+var _ = Describe("Accessor", func() {
+	var (
+		ctx context.Context
+		img *countingImage
+	)
+	BeforeEach(func() {
+		ctx = context.Background()
+		built, err := imageutil.NewBytesConfigBuilder([]byte(`{"key":"value"}`)).
+			BytesLayer([]byte("layer")).
+			Annotations(map[string]string{"com.example.key": "value"}).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		img = &countingImage{Image: built}
+	})
+
+	It("should read the manifest and config once and return copies", func() {
+		a := Access(img, DefaultLimits)
+
+		manifest, err := a.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest.Layers).To(HaveLen(1))
+		manifest.Annotations["com.example.key"] = "changed"
+
+		annotations, err := a.Annotations(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(annotations).To(Equal(map[string]string{"com.example.key": "value"}))
+
+		configDesc, err := a.ConfigDescriptor(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configDesc).To(Equal(manifest.Config))
+
+		raw, err := a.RawConfig(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(raw)).To(Equal(`{"key":"value"}`))
+		raw[0] = 'x'
+
+		var config map[string]string
+		Expect(a.DecodeConfig(ctx, &config)).To(Succeed())
+		Expect(config).To(Equal(map[string]string{"key": "value"}))
+
+		Expect(img.manifestReads).To(Equal(1))
+		Expect(img.configReads).To(Equal(1))
+	})
+
+	It("should share the cache when wrapping an accessor", func() {
+		a := Access(img, DefaultLimits)
+		Expect(Access(a, Limits{})).To(BeIdenticalTo(a))
+	})
+
+	It("should fail if the config does not match its descriptor", func() {
+		config, err := img.Image.Config(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		img.config = &tamperedLayer{desc: config.Descriptor(), data: `{"key":"other"}`}
+
+		_, err = Access(img, DefaultLimits).RawConfig(ctx)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail with a typed error if the config exceeds the limit", func() {
+		_, err := Access(img, Limits{MaxConfigSize: 4}).RawConfig(ctx)
+		Expect(err).To(MatchError(ErrLimitExceeded))
+		Expect(img.configReads).To(BeZero())
+	})
+
+	It("should fail with a typed error if the manifest exceeds the limit", func() {
+		_, err := Access(img, Limits{MaxManifestSize: 4}).Annotations(ctx)
+		Expect(err).To(MatchError(ErrLimitExceeded))
+	})
+})
+
+type tamperedLayer struct {
+	desc ocispec.Descriptor
+	data string
+}
+
+func (l *tamperedLayer) Descriptor() ocispec.Descriptor {
+	return l.desc
+}
+
+func (l *tamperedLayer) Content(ctx context.Context) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(l.data)), nil
+}
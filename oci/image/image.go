@@ -16,9 +16,12 @@ package image
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -27,11 +30,120 @@ type Layer interface {
 	Content(ctx context.Context) (io.ReadCloser, error)
 }
 
+// ReaderAt reads the content of a layer at arbitrary offsets.
+type ReaderAt interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// RandomAccessLayer is a Layer whose content can be read at arbitrary offsets without reading it from
+// the start, e.g. a blob of the local store.
+type RandomAccessLayer interface {
+	Layer
+	ReaderAt(ctx context.Context) (ReaderAt, error)
+}
+
 type Image interface {
 	Layer
 	Manifest(ctx context.Context) (*ocispec.Manifest, error)
 	Config(ctx context.Context) (Layer, error)
 	Layers(ctx context.Context) ([]Layer, error)
+	// Complete reports whether the config and all layers referenced by the manifest are present, along
+	// with the missing ones. Implementations only stat blobs and never read their content. Images whose
+	// content is fetched on demand, e.g. from a registry or built in memory, are always complete.
+	Complete(ctx context.Context) (bool, []ocispec.Descriptor, error)
+}
+
+// ErrIncompleteImage is matched by IncompleteImageError.
+var ErrIncompleteImage = errors.New("incomplete image")
+
+// IncompleteImageError is returned by CheckComplete if blobs of an image are missing.
+type IncompleteImageError struct {
+	// Digest is the digest of the image.
+	Digest digest.Digest
+	// Missing are the descriptors of the missing blobs, which have to be pulled again.
+	Missing []ocispec.Descriptor
+}
+
+func (e *IncompleteImageError) Error() string {
+	digests := make([]string, 0, len(e.Missing))
+	for _, desc := range e.Missing {
+		digests = append(digests, desc.Digest.String())
+	}
+	return fmt.Sprintf("%s: image %s is missing %d blob(s), pull it again to restore them: %s", ErrIncompleteImage, e.Digest, len(e.Missing), strings.Join(digests, ", "))
+}
+
+func (e *IncompleteImageError) Is(target error) bool {
+	return target == ErrIncompleteImage
+}
+
+// ErrLayerNotPresent is matched by LayerNotPresentError.
+var ErrLayerNotPresent = errors.New("layer not present")
+
+// LayerNotPresentError is returned by the typed layer accessors if the manifest of an image has no layer
+// of the requested role. Unlike an IncompleteImageError, no blob is missing: the image lacks the layer.
+type LayerNotPresentError struct {
+	// Digest is the digest of the image.
+	Digest digest.Digest
+	// Role is the requested role, e.g. initramfs.
+	Role string
+	// MediaType is the media type of layers of the role. It is empty if several media types qualify.
+	MediaType string
+	// Available are the roles of the layers the image has, in manifest order.
+	Available []string
+	// Err is an additional error the error matches, e.g. the sentinel error of the accessor.
+	Err error
+}
+
+func (e *LayerNotPresentError) Error() string {
+	available := "none"
+	if len(e.Available) > 0 {
+		available = strings.Join(e.Available, ", ")
+	}
+	return fmt.Sprintf("image %s has no %s layer; available layers: %s", e.Digest, e.Role, available)
+}
+
+func (e *LayerNotPresentError) Is(target error) bool {
+	return target == ErrLayerNotPresent
+}
+
+func (e *LayerNotPresentError) Unwrap() error {
+	return e.Err
+}
+
+// ErrAmbiguousLayer is matched by AmbiguousLayerError.
+var ErrAmbiguousLayer = errors.New("ambiguous layer")
+
+// AmbiguousLayerError is returned by the typed layer accessors if several layers of an image qualify for
+// the requested role, instead of picking one of them.
+type AmbiguousLayerError struct {
+	// Digest is the digest of the image.
+	Digest digest.Digest
+	// Role is the requested role, e.g. kernel.
+	Role string
+	// Candidates are the roles of the qualifying layers.
+	Candidates []string
+}
+
+func (e *AmbiguousLayerError) Error() string {
+	return fmt.Sprintf("%s: image %s has %d %s layers (%s)", ErrAmbiguousLayer, e.Digest, len(e.Candidates), e.Role, strings.Join(e.Candidates, ", "))
+}
+
+func (e *AmbiguousLayerError) Is(target error) bool {
+	return target == ErrAmbiguousLayer
+}
+
+// CheckComplete returns an *IncompleteImageError listing the missing blobs if the image is not complete.
+func CheckComplete(ctx context.Context, img Image) error {
+	complete, missing, err := img.Complete(ctx)
+	if err != nil {
+		return fmt.Errorf("error checking completeness of image %s: %w", img.Descriptor().Digest, err)
+	}
+	if !complete {
+		return &IncompleteImageError{Digest: img.Descriptor().Digest, Missing: missing}
+	}
+	return nil
 }
 
 // AsWriteLayers spreads the given Image to all layers.
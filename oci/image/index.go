@@ -0,0 +1,233 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Index is an image index whose child manifests are iterated lazily instead of being held in memory, so
+// indexes with many thousands of children can be listed with bounded memory.
+type Index interface {
+	Layer
+	// Walk calls fn with the descriptor of each child manifest in order, decoding them one at a time
+	// while streaming the index document. If fn returns an error, the walk stops and returns it.
+	Walk(ctx context.Context, fn func(desc ocispec.Descriptor) error) error
+}
+
+// IsIndexMediaType reports whether the media type is the one of an OCI image index or a docker manifest list.
+func IsIndexMediaType(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageIndex || mediaType == images.MediaTypeDockerSchema2ManifestList
+}
+
+// Limits cap the resources spent on decoding manifests and indexes of untrusted sources, e.g. registries.
+type Limits struct {
+	// MaxManifestSize is the maximum size in bytes of an image manifest. Zero means no limit.
+	MaxManifestSize int64
+	// MaxIndexEntries is the maximum number of child manifests of an image index. Zero means no limit.
+	MaxIndexEntries int
+	// MaxConfigSize is the maximum size in bytes of an image config read by an Accessor. Zero means no
+	// limit.
+	MaxConfigSize int64
+}
+
+// DefaultMaxManifestSize is the default of Limits.MaxManifestSize, the size registries are recommended to
+// accept manifests up to by the OCI distribution spec.
+const DefaultMaxManifestSize = 4 << 20
+
+// DefaultMaxConfigSize is the default of Limits.MaxConfigSize. Configs are small JSON documents like
+// manifests, so the same limit applies.
+const DefaultMaxConfigSize = DefaultMaxManifestSize
+
+// DefaultLimits are the limits applied if none are configured. Indexes are streamed, so the number of
+// their entries is not limited by default.
+var DefaultLimits = Limits{MaxManifestSize: DefaultMaxManifestSize, MaxConfigSize: DefaultMaxConfigSize}
+
+// ErrLimitExceeded is matched by LimitError.
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+// LimitError is returned if a manifest or index exceeds the Limits.
+type LimitError struct {
+	// Digest is the digest of the manifest or index.
+	Digest digest.Digest
+	// Limit names the exceeded limit.
+	Limit string
+	// Max is the configured maximum.
+	Max int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: %s %s exceeds the maximum of %d", ErrLimitExceeded, e.Digest, e.Limit, e.Max)
+}
+
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// CheckManifestSize fails with a *LimitError if the descriptor announces a manifest larger than
+// limits.MaxManifestSize, so it does not have to be fetched to find out.
+func CheckManifestSize(desc ocispec.Descriptor, limits Limits) error {
+	if limits.MaxManifestSize > 0 && desc.Size > limits.MaxManifestSize {
+		return &LimitError{Digest: desc.Digest, Limit: "manifest size", Max: limits.MaxManifestSize}
+	}
+	return nil
+}
+
+// DecodeManifest decodes the manifest of the descriptor from r. It fails with a *LimitError if the
+// manifest is larger than limits.MaxManifestSize, reading at most one byte more than that, and refuses
+// image indexes, which have to be walked instead, see WalkIndex.
+func DecodeManifest(r io.Reader, desc ocispec.Descriptor, limits Limits) (*ocispec.Manifest, error) {
+	if IsIndexMediaType(desc.MediaType) {
+		return nil, fmt.Errorf("%s is an image index (%s), not a manifest", desc.Digest, desc.MediaType)
+	}
+	if err := CheckManifestSize(desc, limits); err != nil {
+		return nil, err
+	}
+
+	lr := &limitedReader{r: r, max: limits.MaxManifestSize}
+	manifest := &ocispec.Manifest{}
+	if err := json.NewDecoder(lr).Decode(manifest); err != nil {
+		if lr.exceeded {
+			return nil, &LimitError{Digest: desc.Digest, Limit: "manifest size", Max: limits.MaxManifestSize}
+		}
+		return nil, fmt.Errorf("could not decode manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// limitedReader fails reads after max bytes, recording that the limit was exceeded. Zero means no limit.
+type limitedReader struct {
+	r        io.Reader
+	max      int64
+	n        int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.max <= 0 {
+		return l.r.Read(p)
+	}
+	if l.n >= l.max {
+		// Only fail if there is more content, a document of exactly max bytes is fine.
+		var b [1]byte
+		if n, err := l.r.Read(b[:]); n == 0 {
+			return 0, err
+		}
+		l.exceeded = true
+		return 0, ErrLimitExceeded
+	}
+	if int64(len(p)) > l.max-l.n {
+		p = p[:l.max-l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	return n, err
+}
+
+// WalkIndex streams the image index of the descriptor from r, calling fn with each child manifest
+// descriptor as it is decoded, so the children are never held in memory at once. It returns the index
+// without its manifests. If the index has more than limits.MaxIndexEntries children, it fails with a
+// *LimitError once the limit is exceeded, after calling fn with the allowed ones.
+func WalkIndex(r io.Reader, desc ocispec.Descriptor, limits Limits, fn func(desc ocispec.Descriptor) error) (*ocispec.Index, error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("could not decode index: %w", err)
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, fmt.Errorf("could not decode index: unexpected token %v", tok)
+		}
+
+		if key != "manifests" {
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return nil, fmt.Errorf("could not decode index field %s: %w", key, err)
+			}
+			fields[key] = value
+			continue
+		}
+
+		if err := walkManifests(dec, desc, limits, fn); err != nil {
+			return nil, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding index fields: %w", err)
+	}
+	index := &ocispec.Index{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("could not decode index: %w", err)
+	}
+	return index, nil
+}
+
+func walkManifests(dec *json.Decoder, desc ocispec.Descriptor, limits Limits, fn func(desc ocispec.Descriptor) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("could not decode index manifests: %w", err)
+	}
+	if tok == nil {
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("could not decode index manifests: expected array but got %v", tok)
+	}
+
+	var n int
+	for dec.More() {
+		if n++; limits.MaxIndexEntries > 0 && n > limits.MaxIndexEntries {
+			return &LimitError{Digest: desc.Digest, Limit: "number of index entries", Max: int64(limits.MaxIndexEntries)}
+		}
+		var child ocispec.Descriptor
+		if err := dec.Decode(&child); err != nil {
+			return fmt.Errorf("could not decode index entry %d: %w", n-1, err)
+		}
+		if err := fn(child); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("could not decode index: %w", err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("could not decode index: expected %v but got %v", want, tok)
+	}
+	return nil
+}
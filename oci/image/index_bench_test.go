@@ -0,0 +1,114 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"testing"
+
+	. "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const benchIndexEntries = 10000
+
+// benchIndex returns a synthetic image index with benchIndexEntries child manifests.
+func benchIndex(b *testing.B) []byte {
+	index := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex}
+	index.SchemaVersion = 2
+	for i := 0; i < benchIndexEntries; i++ {
+		index.Manifests = append(index.Manifests, ocispec.Descriptor{
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Digest:      digest.FromString(fmt.Sprint(i)),
+			Size:        1024,
+			Platform:    &ocispec.Platform{OS: "linux", Architecture: "amd64"},
+			Annotations: map[string]string{"com.example.build": fmt.Sprint(i)},
+		})
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return data
+}
+
+// liveHeap returns the bytes of live heap objects after a garbage collection.
+func liveHeap() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// reportLiveHeap reports the live heap measured at the last entry relative to before as live-B/op,
+// which stays bounded for streaming but grows with the number of entries for materializing.
+func reportLiveHeap(b *testing.B, before, atLastEntry uint64) {
+	var live float64
+	if atLastEntry > before {
+		live = float64(atLastEntry - before)
+	}
+	b.ReportMetric(live, "live-B/op")
+}
+
+// BenchmarkWalkIndex streams the index, measuring the live heap while the last entry is visited.
+func BenchmarkWalkIndex(b *testing.B) {
+	data := benchIndex(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var before, atLastEntry uint64
+	for i := 0; i < b.N; i++ {
+		r := bytes.NewReader(data)
+		before = liveHeap()
+		var n int
+		if _, err := WalkIndex(r, ocispec.Descriptor{}, Limits{}, func(desc ocispec.Descriptor) error {
+			if n++; n == benchIndexEntries {
+				atLastEntry = liveHeap()
+			}
+			return nil
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	reportLiveHeap(b, before, atLastEntry)
+}
+
+// BenchmarkDecodeIndex decodes the whole index at once for comparison.
+func BenchmarkDecodeIndex(b *testing.B) {
+	data := benchIndex(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var before, atLastEntry uint64
+	for i := 0; i < b.N; i++ {
+		r := bytes.NewReader(data)
+		before = liveHeap()
+		index := &ocispec.Index{}
+		if err := json.NewDecoder(r).Decode(index); err != nil {
+			b.Fatal(err)
+		}
+		for n := range index.Manifests {
+			if n == benchIndexEntries-1 {
+				atLastEntry = liveHeap()
+			}
+		}
+		runtime.KeepAlive(index)
+	}
+	reportLiveHeap(b, before, atLastEntry)
+}
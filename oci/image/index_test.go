@@ -0,0 +1,125 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	. "github.com/onmetal/onmetal-image/oci/image"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("WalkIndex", func() {
+	newIndex := func(n int) (ocispec.Index, []byte) {
+		index := ocispec.Index{
+			MediaType:   ocispec.MediaTypeImageIndex,
+			Annotations: map[string]string{"com.example.key": "value"},
+		}
+		index.SchemaVersion = 2
+		for i := 0; i < n; i++ {
+			index.Manifests = append(index.Manifests, ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Digest:    digest.FromString(strings.Repeat("x", i)),
+				Size:      int64(i),
+			})
+		}
+		data, err := json.Marshal(index)
+		Expect(err).NotTo(HaveOccurred())
+		return index, data
+	}
+
+	It("should stream the child manifests and return the rest of the index", func() {
+		index, data := newIndex(3)
+
+		var children []ocispec.Descriptor
+		walked, err := WalkIndex(bytes.NewReader(data), ocispec.Descriptor{}, Limits{}, func(desc ocispec.Descriptor) error {
+			children = append(children, desc)
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(children).To(Equal(index.Manifests))
+
+		index.Manifests = nil
+		Expect(walked).To(Equal(&index))
+	})
+
+	It("should stop if the callback fails", func() {
+		_, data := newIndex(3)
+		stop := errors.New("stop")
+
+		var n int
+		_, err := WalkIndex(bytes.NewReader(data), ocispec.Descriptor{}, Limits{}, func(desc ocispec.Descriptor) error {
+			n++
+			return stop
+		})
+		Expect(err).To(MatchError(stop))
+		Expect(n).To(Equal(1))
+	})
+
+	It("should fail with a typed error once the number of entries is exceeded", func() {
+		_, data := newIndex(3)
+		desc := ocispec.Descriptor{Digest: digest.FromBytes(data)}
+
+		var n int
+		_, err := WalkIndex(bytes.NewReader(data), desc, Limits{MaxIndexEntries: 2}, func(desc ocispec.Descriptor) error {
+			n++
+			return nil
+		})
+		Expect(err).To(MatchError(ErrLimitExceeded))
+		Expect(err).To(Equal(&LimitError{Digest: desc.Digest, Limit: "number of index entries", Max: 2}))
+		Expect(n).To(Equal(2))
+	})
+
+	It("should reject malformed indexes", func() {
+		for _, data := range []string{`[]`, `{"manifests": {}}`, `{"manifests": [1]}`, `{"manifests": [`} {
+			_, err := WalkIndex(strings.NewReader(data), ocispec.Descriptor{}, Limits{}, func(desc ocispec.Descriptor) error { return nil })
+			Expect(err).To(HaveOccurred(), data)
+		}
+	})
+})
+
+var _ = Describe("DecodeManifest", func() {
+	manifest := ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Config: ocispec.Descriptor{Digest: digest.FromString("config")}}
+	manifest.SchemaVersion = 2
+	data, _ := json.Marshal(manifest)
+
+	It("should decode manifests up to the maximum size", func() {
+		decoded, err := DecodeManifest(bytes.NewReader(data), ocispec.Descriptor{}, Limits{MaxManifestSize: int64(len(data))})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(Equal(&manifest))
+	})
+
+	It("should fail with a typed error if the manifest is too large", func() {
+		By("announcing the size in the descriptor")
+		_, err := DecodeManifest(bytes.NewReader(data), ocispec.Descriptor{Size: int64(len(data))}, Limits{MaxManifestSize: 10})
+		Expect(err).To(MatchError(ErrLimitExceeded))
+
+		By("not announcing the size")
+		_, err = DecodeManifest(bytes.NewReader(data), ocispec.Descriptor{}, Limits{MaxManifestSize: 10})
+		Expect(err).To(MatchError(ErrLimitExceeded))
+		Expect(err).To(MatchError(ContainSubstring("manifest size exceeds the maximum of 10")))
+	})
+
+	It("should refuse image indexes", func() {
+		_, err := DecodeManifest(bytes.NewReader(data), ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex}, DefaultLimits)
+		Expect(err).To(MatchError(ContainSubstring("is an image index")))
+	})
+})
@@ -0,0 +1,340 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageutil
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ReservedAnnotationPrefix is the prefix of the annotation keys reserved for the OCI specifications.
+const ReservedAnnotationPrefix = "org.opencontainers."
+
+// encryptionAnnotationPrefix is the prefix of the keys of encrypted layers defined by ocicrypt.
+const encryptionAnnotationPrefix = "org.opencontainers.image.enc."
+
+// ociAnnotations maps the annotation keys defined by the OCI specifications to a check of their value,
+// nil if any value is allowed.
+var ociAnnotations = map[string]func(value string) string{
+	ocispec.AnnotationCreated:                 checkTimestamp,
+	ocispec.AnnotationAuthors:                 nil,
+	ocispec.AnnotationURL:                     checkURL,
+	ocispec.AnnotationDocumentation:           checkURL,
+	ocispec.AnnotationSource:                  checkURL,
+	ocispec.AnnotationVersion:                 nil,
+	ocispec.AnnotationRevision:                nil,
+	ocispec.AnnotationVendor:                  nil,
+	ocispec.AnnotationLicenses:                nil,
+	ocispec.AnnotationRefName:                 nil,
+	ocispec.AnnotationTitle:                   nil,
+	ocispec.AnnotationDescription:             nil,
+	ocispec.AnnotationBaseImageDigest:         checkDigest,
+	ocispec.AnnotationBaseImageName:           nil,
+	"org.opencontainers.artifact.created":     checkTimestamp,
+	"org.opencontainers.artifact.description": nil,
+	// Annotations of images converted from OCI runtime configs, see the conversion section of the image spec.
+	"org.opencontainers.image.exposedPorts": nil,
+	"org.opencontainers.image.stopSignal":   nil,
+	"org.opencontainers.image.os":           nil,
+	"org.opencontainers.image.architecture": nil,
+	"org.opencontainers.image.variant":      nil,
+	"org.opencontainers.image.os.version":   nil,
+	"org.opencontainers.image.os.features":  nil,
+}
+
+func checkTimestamp(value string) string {
+	if _, err := time.Parse(time.RFC3339, value); err != nil {
+		return fmt.Sprintf("value %q is no RFC 3339 timestamp", value)
+	}
+	return ""
+}
+
+func checkURL(value string) string {
+	if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Sprintf("value %q is no absolute URL", value)
+	}
+	return ""
+}
+
+func checkDigest(value string) string {
+	if _, err := digest.Parse(value); err != nil {
+		return fmt.Sprintf("value %q is no digest", value)
+	}
+	return ""
+}
+
+// InvalidAnnotation is an annotation failing validation, see ValidateAnnotations.
+type InvalidAnnotation struct {
+	// Scope is where the annotation is set, e.g. manifest or layer 2. Empty for plain annotation maps.
+	Scope  string
+	Key    string
+	Reason string
+}
+
+func (a InvalidAnnotation) String() string {
+	if a.Scope == "" {
+		return fmt.Sprintf("%q: %s", a.Key, a.Reason)
+	}
+	return fmt.Sprintf("%s %q: %s", a.Scope, a.Key, a.Reason)
+}
+
+// InvalidAnnotationsError lists all annotations failing validation.
+type InvalidAnnotationsError struct {
+	Annotations []InvalidAnnotation
+}
+
+func (e *InvalidAnnotationsError) Error() string {
+	msgs := make([]string, len(e.Annotations))
+	for i, a := range e.Annotations {
+		msgs[i] = a.String()
+	}
+	return fmt.Sprintf("invalid annotations: %s", strings.Join(msgs, "; "))
+}
+
+// annotationProblem returns why the annotation is invalid, or an empty string if it is valid.
+func annotationProblem(key, value string) string {
+	if check, ok := ociAnnotations[key]; ok {
+		if check == nil {
+			return ""
+		}
+		return check(value)
+	}
+	if strings.HasPrefix(key, encryptionAnnotationPrefix) {
+		return ""
+	}
+
+	switch {
+	case key == "":
+		return "key is empty"
+	case strings.IndexFunc(key, unicode.IsSpace) >= 0:
+		return "key contains whitespace"
+	case strings.IndexFunc(key, unicode.IsUpper) >= 0:
+		return "key contains uppercase characters"
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("._-/", r)) {
+			return fmt.Sprintf("key contains invalid character %q", r)
+		}
+	}
+
+	// Namespaced keys are either in reverse domain notation (com.example.key) or prefixed by a domain
+	// (example.com/key), neither may have empty components.
+	domain, name, prefixed := strings.Cut(key, "/")
+	if prefixed && (strings.Contains(name, "/") || name == "" || !strings.Contains(domain, ".")) {
+		return "key is no reverse domain name or domain prefixed name"
+	}
+	for _, component := range strings.Split(domain, ".") {
+		if component == "" {
+			return "key has an empty domain component"
+		}
+	}
+	if strings.HasPrefix(key, ReservedAnnotationPrefix) {
+		return fmt.Sprintf("key has the reserved prefix %s but is not defined by the OCI specifications", ReservedAnnotationPrefix)
+	}
+	return ""
+}
+
+// validateAnnotations appends the invalid annotations of the given scope to invalid, sorted by key.
+func validateAnnotations(invalid []InvalidAnnotation, scope string, annotations map[string]string) []InvalidAnnotation {
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if reason := annotationProblem(key, annotations[key]); reason != "" {
+			invalid = append(invalid, InvalidAnnotation{Scope: scope, Key: key, Reason: reason})
+		}
+	}
+	return invalid
+}
+
+// ValidateAnnotations checks that the annotation keys only consist of lowercase letters, digits and
+// ._-/ and are reverse domain names or domain prefixed names if namespaced. Keys with the
+// ReservedAnnotationPrefix have to be defined by the OCI specifications and carry a valid value, e.g.
+// an RFC 3339 timestamp for org.opencontainers.image.created. All invalid annotations are reported at
+// once with an *InvalidAnnotationsError.
+func ValidateAnnotations(annotations map[string]string) error {
+	if invalid := validateAnnotations(nil, "", annotations); len(invalid) > 0 {
+		return &InvalidAnnotationsError{Annotations: invalid}
+	}
+	return nil
+}
+
+// ValidateManifestAnnotations validates the annotations of the manifest and of its config and layer
+// descriptors like ValidateAnnotations.
+func ValidateManifestAnnotations(manifest *ocispec.Manifest) error {
+	invalid := validateAnnotations(nil, "manifest", manifest.Annotations)
+	invalid = validateAnnotations(invalid, "config", manifest.Config.Annotations)
+	for i, layer := range manifest.Layers {
+		invalid = validateAnnotations(invalid, fmt.Sprintf("layer %d", i), layer.Annotations)
+	}
+	if len(invalid) > 0 {
+		return &InvalidAnnotationsError{Annotations: invalid}
+	}
+	return nil
+}
+
+// AnnotationChange is a change made by NormalizeAnnotations.
+type AnnotationChange struct {
+	// Scope is where the annotation is set, see InvalidAnnotation.
+	Scope string `json:"scope,omitempty"`
+	// Key is the original key.
+	Key string `json:"key"`
+	// NormalizedKey is the key after normalization, equal to Key if only the value was trimmed.
+	NormalizedKey string `json:"normalizedKey"`
+	// ValueTrimmed is set if whitespace was trimmed from the value.
+	ValueTrimmed bool `json:"valueTrimmed,omitempty"`
+}
+
+func (c AnnotationChange) String() string {
+	var s string
+	if c.Key != c.NormalizedKey {
+		s = fmt.Sprintf("%q -> %q", c.Key, c.NormalizedKey)
+	} else {
+		s = fmt.Sprintf("%q", c.Key)
+	}
+	if c.ValueTrimmed {
+		s += " (value trimmed)"
+	}
+	if c.Scope != "" {
+		s = c.Scope + " " + s
+	}
+	return s
+}
+
+// NormalizeAnnotationKey trims the whitespace around the key and lowercases it, unless it is defined
+// by the OCI specifications.
+func NormalizeAnnotationKey(key string) string {
+	key = strings.TrimSpace(key)
+	if _, ok := ociAnnotations[key]; ok {
+		return key
+	}
+	return strings.ToLower(key)
+}
+
+// NormalizeAnnotations returns a copy of the annotations with normalized keys (see
+// NormalizeAnnotationKey) and whitespace trimmed around the values, and the changes made sorted by key.
+// It fails if several keys normalize to the same key with different values.
+func NormalizeAnnotations(annotations map[string]string) (map[string]string, []AnnotationChange, error) {
+	return normalizeAnnotations("", annotations)
+}
+
+func normalizeAnnotations(scope string, annotations map[string]string) (map[string]string, []AnnotationChange, error) {
+	if annotations == nil {
+		return nil, nil, nil
+	}
+
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var (
+		res     = make(map[string]string, len(annotations))
+		origin  = make(map[string]string, len(annotations))
+		changes []AnnotationChange
+	)
+	for _, key := range keys {
+		value := annotations[key]
+		normalizedKey, normalizedValue := NormalizeAnnotationKey(key), strings.TrimSpace(value)
+		if other, ok := origin[normalizedKey]; ok && res[normalizedKey] != normalizedValue {
+			return nil, nil, fmt.Errorf("annotations %q and %q both normalize to %q with different values", other, key, normalizedKey)
+		}
+		res[normalizedKey] = normalizedValue
+		origin[normalizedKey] = key
+		if normalizedKey != key || normalizedValue != value {
+			changes = append(changes, AnnotationChange{Scope: scope, Key: key, NormalizedKey: normalizedKey, ValueTrimmed: normalizedValue != value})
+		}
+	}
+	return res, changes, nil
+}
+
+// NormalizeImageAnnotations normalizes the annotations of the manifest and of the config and layer
+// descriptors of the image like NormalizeAnnotations. If anything changed, it returns a copy of the
+// image with a rewritten manifest and thus a different digest, otherwise the image itself.
+func NormalizeImageAnnotations(ctx context.Context, img image.Image) (image.Image, []AnnotationChange, error) {
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting manifest: %w", err)
+	}
+	config, err := img.Config(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting config: %w", err)
+	}
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting layers: %w", err)
+	}
+
+	annotations, changes, err := normalizeAnnotations("manifest", manifest.Annotations)
+	if err != nil {
+		return nil, nil, err
+	}
+	normalizeLayer := func(scope string, layer image.Layer) (image.Layer, error) {
+		desc := layer.Descriptor()
+		layerAnnotations, layerChanges, err := normalizeAnnotations(scope, desc.Annotations)
+		if err != nil || len(layerChanges) == 0 {
+			return layer, err
+		}
+		changes = append(changes, layerChanges...)
+		desc.Annotations = layerAnnotations
+		return describedLayer{Layer: layer, desc: desc}, nil
+	}
+	if config, err = normalizeLayer("config", config); err != nil {
+		return nil, nil, err
+	}
+	normalizedLayers := make([]image.Layer, len(layers))
+	for i, layer := range layers {
+		if normalizedLayers[i], err = normalizeLayer(fmt.Sprintf("layer %d", i), layer); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(changes) == 0 {
+		return img, nil, nil
+	}
+
+	normalized, err := NewBuilder(config).
+		ArtifactType(manifest.ArtifactType).
+		Layers(normalizedLayers...).
+		Annotations(annotations).
+		Complete(func(desc *ocispec.Descriptor) {
+			desc.Platform = img.Descriptor().Platform
+		})
+	if err != nil {
+		return nil, nil, err
+	}
+	return normalized, changes, nil
+}
+
+// describedLayer is a layer with a modified descriptor, e.g. with other annotations.
+type describedLayer struct {
+	image.Layer
+	desc ocispec.Descriptor
+}
+
+func (l describedLayer) Descriptor() ocispec.Descriptor {
+	return l.desc
+}
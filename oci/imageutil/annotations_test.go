@@ -0,0 +1,144 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageutil_test
+
+import (
+	"context"
+
+	. "github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("ValidateAnnotations", func() {
+	It("should accept namespaced, prefixed and OCI defined keys", func() {
+		Expect(ValidateAnnotations(map[string]string{
+			"image.onmetal.de/expires-at":            "2024-01-01T00:00:00Z",
+			"com.example.build-id":                   "42",
+			ocispec.AnnotationCreated:                "2023-01-01T00:00:00Z",
+			"org.opencontainers.image.exposedPorts":  "80/tcp",
+			"org.opencontainers.image.enc.keys.jwe":  "key",
+			ocispec.AnnotationSource:                 "https://github.com/onmetal/onmetal-image",
+			ocispec.AnnotationBaseImageDigest:        "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			"org.opencontainers.image.enc.pubopts":   "opts",
+			"org.opencontainers.artifact.created":    "2023-01-01T00:00:00+02:00",
+			"org.opencontainers.image.ref.name":      "v1",
+			"org.opencontainers.image.title":         "rootfs",
+			"org.opencontainers.image.stopSignal":    "SIGTERM",
+			"org.opencontainers.image.os.features":   "win32k",
+			"org.opencontainers.image.documentation": "https://onmetal.de",
+		})).To(Succeed())
+	})
+
+	It("should list every invalid annotation at once", func() {
+		err := ValidateAnnotations(map[string]string{
+			"com.example.ok":                  "ok",
+			"Com.Example.Key":                 "upper",
+			" com.example.space":              "space",
+			"example.com/a/b":                 "nested",
+			"com..example":                    "empty component",
+			"com.example.key!":                "character",
+			ocispec.AnnotationCreated:         "yesterday",
+			ocispec.AnnotationURL:             "onmetal.de",
+			"org.opencontainers.image.custom": "reserved",
+		})
+
+		var invalidErr *InvalidAnnotationsError
+		Expect(err).To(BeAssignableToTypeOf(invalidErr))
+		invalidErr = err.(*InvalidAnnotationsError)
+		Expect(invalidErr.Annotations).To(Equal([]InvalidAnnotation{
+			{Key: " com.example.space", Reason: "key contains whitespace"},
+			{Key: "Com.Example.Key", Reason: "key contains uppercase characters"},
+			{Key: "com..example", Reason: "key has an empty domain component"},
+			{Key: "com.example.key!", Reason: `key contains invalid character '!'`},
+			{Key: "example.com/a/b", Reason: "key is no reverse domain name or domain prefixed name"},
+			{Key: ocispec.AnnotationCreated, Reason: `value "yesterday" is no RFC 3339 timestamp`},
+			{Key: "org.opencontainers.image.custom", Reason: "key has the reserved prefix org.opencontainers. but is not defined by the OCI specifications"},
+			{Key: ocispec.AnnotationURL, Reason: `value "onmetal.de" is no absolute URL`},
+		}))
+		Expect(err).To(MatchError(ContainSubstring(`"Com.Example.Key": key contains uppercase characters; "com..example"`)))
+	})
+
+	It("should scope the invalid annotations of a manifest", func() {
+		err := ValidateManifestAnnotations(&ocispec.Manifest{
+			Annotations: map[string]string{"Key": "value"},
+			Config:      ocispec.Descriptor{Annotations: map[string]string{"com.example.ok": "ok"}},
+			Layers:      []ocispec.Descriptor{{}, {Annotations: map[string]string{ocispec.AnnotationCreated: "now"}}},
+		})
+		Expect(err).To(MatchError(`invalid annotations: manifest "Key": key contains uppercase characters; layer 1 "org.opencontainers.image.created": value "now" is no RFC 3339 timestamp`))
+	})
+})
+
+var _ = Describe("NormalizeAnnotations", func() {
+	It("should lowercase keys and trim whitespace, reporting the changes", func() {
+		normalized, changes, err := NormalizeAnnotations(map[string]string{
+			" Com.Example.Key ":                   "value",
+			"com.example.trimmed":                 " value\n",
+			"com.example.ok":                      "ok",
+			"org.opencontainers.image.stopSignal": "SIGTERM",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(normalized).To(Equal(map[string]string{
+			"com.example.key":                     "value",
+			"com.example.trimmed":                 "value",
+			"com.example.ok":                      "ok",
+			"org.opencontainers.image.stopSignal": "SIGTERM",
+		}))
+		Expect(changes).To(Equal([]AnnotationChange{
+			{Key: " Com.Example.Key ", NormalizedKey: "com.example.key"},
+			{Key: "com.example.trimmed", NormalizedKey: "com.example.trimmed", ValueTrimmed: true},
+		}))
+		Expect(ValidateAnnotations(normalized)).To(Succeed())
+	})
+
+	It("should fail if keys collide with different values", func() {
+		_, _, err := NormalizeAnnotations(map[string]string{"com.example.key": "a", "Com.Example.Key": "b"})
+		Expect(err).To(MatchError(ContainSubstring(`both normalize to "com.example.key"`)))
+
+		normalized, _, err := NormalizeAnnotations(map[string]string{"com.example.key": "a", "Com.Example.Key": " a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(normalized).To(Equal(map[string]string{"com.example.key": "a"}))
+	})
+
+	It("should rewrite the manifest of an image only if anything changed", func() {
+		ctx := context.Background()
+		img, err := NewJSONConfigBuilder(map[string]interface{}{}).
+			BytesLayer([]byte("rootfs"), WithAnnotations(map[string]string{"Com.Example.Layer": "rootfs"})).
+			Annotations(map[string]string{"com.example.key": " value "}).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+
+		normalized, changes, err := NormalizeImageAnnotations(ctx, img)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changes).To(Equal([]AnnotationChange{
+			{Scope: "manifest", Key: "com.example.key", NormalizedKey: "com.example.key", ValueTrimmed: true},
+			{Scope: "layer 0", Key: "Com.Example.Layer", NormalizedKey: "com.example.layer"},
+		}))
+		Expect(normalized.Descriptor().Digest).NotTo(Equal(img.Descriptor().Digest))
+
+		manifest, err := normalized.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ValidateManifestAnnotations(manifest)).To(Succeed())
+		Expect(manifest.Annotations).To(HaveKeyWithValue("com.example.key", "value"))
+		Expect(manifest.Layers[0].Annotations).To(HaveKeyWithValue("com.example.layer", "rootfs"))
+
+		By("checking a normalized image is returned as is")
+		again, changes, err := NormalizeImageAnnotations(ctx, normalized)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changes).To(BeEmpty())
+		Expect(again.Descriptor().Digest).To(Equal(normalized.Descriptor().Digest))
+	})
+})
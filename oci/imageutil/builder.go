@@ -17,7 +17,6 @@ package imageutil
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 
@@ -30,9 +29,11 @@ import (
 )
 
 type Builder struct {
-	err    error
-	config image.Layer
-	layers []image.Layer
+	err          error
+	config       image.Layer
+	layers       []image.Layer
+	annotations  map[string]string
+	artifactType string
 }
 
 func NewBuilder(config image.Layer) *Builder {
@@ -45,6 +46,12 @@ func NewBytesConfigBuilder(data []byte, opts ...DescriptorOpt) *Builder {
 	return NewBuilder(BytesLayer(data, opts...))
 }
 
+// NewArtifactBuilder creates a Builder for an artifact of the given type.
+// Artifacts have no runnable config, their config is the empty JSON descriptor (see ocispec.DescriptorEmptyJSON).
+func NewArtifactBuilder(artifactType string) *Builder {
+	return NewBytesConfigBuilder([]byte("{}"), WithMediaType(ocispec.MediaTypeEmptyJSON)).ArtifactType(artifactType)
+}
+
 func NewJSONConfigBuilder(v interface{}, opts ...DescriptorOpt) *Builder {
 	config, err := JSONValueLayer(v, opts...)
 	if err != nil {
@@ -87,6 +94,31 @@ func (b *Builder) Layers(layers ...image.Layer) *Builder {
 	return b
 }
 
+// Annotations adds the given annotations to the image manifest.
+func (b *Builder) Annotations(annotations map[string]string) *Builder {
+	if b.err != nil {
+		return b
+	}
+
+	if b.annotations == nil {
+		b.annotations = make(map[string]string, len(annotations))
+	}
+	for k, v := range annotations {
+		b.annotations[k] = v
+	}
+	return b
+}
+
+// ArtifactType sets the artifact type of the image manifest.
+func (b *Builder) ArtifactType(artifactType string) *Builder {
+	if b.err != nil {
+		return b
+	}
+
+	b.artifactType = artifactType
+	return b
+}
+
 func (b *Builder) Complete(opts ...DescriptorOpt) (image.Image, error) {
 	if b.err != nil {
 		return nil, b.err
@@ -104,10 +136,12 @@ func (b *Builder) Complete(opts ...DescriptorOpt) (image.Image, error) {
 		Versioned: specs.Versioned{
 			SchemaVersion: 2,
 		},
-		Config: b.config.Descriptor(),
-		Layers: layerDescriptors,
+		ArtifactType: b.artifactType,
+		Config:       b.config.Descriptor(),
+		Layers:       layerDescriptors,
+		Annotations:  b.annotations,
 	}
-	data, err := json.Marshal(manifest)
+	data, err := MarshalCanonical(manifest)
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling image manifest: %w", err)
 	}
@@ -117,11 +151,13 @@ func (b *Builder) Complete(opts ...DescriptorOpt) (image.Image, error) {
 		opt(&desc)
 	}
 	desc.MediaType = ocispec.MediaTypeImageManifest
+	desc.ArtifactType = b.artifactType
 	desc.Digest = digest.FromBytes(data)
 	desc.Size = int64(len(data))
 
 	return &composite{
 		descriptor: desc,
+		data:       data,
 		manifest:   manifest,
 		config:     b.config,
 		layers:     layers,
@@ -130,9 +166,11 @@ func (b *Builder) Complete(opts ...DescriptorOpt) (image.Image, error) {
 
 type composite struct {
 	descriptor ocispec.Descriptor
-	manifest   ocispec.Manifest
-	config     image.Layer
-	layers     []image.Layer
+	// data is the marshaled manifest the digest of the descriptor was computed over.
+	data     []byte
+	manifest ocispec.Manifest
+	config   image.Layer
+	layers   []image.Layer
 }
 
 func (c *composite) Descriptor() ocispec.Descriptor {
@@ -140,12 +178,7 @@ func (c *composite) Descriptor() ocispec.Descriptor {
 }
 
 func (c *composite) Content(ctx context.Context) (io.ReadCloser, error) {
-	data, err := json.Marshal(c.manifest)
-	if err != nil {
-		return nil, fmt.Errorf("error marshaling image manifest: %w", err)
-	}
-
-	return io.NopCloser(bytes.NewReader(data)), nil
+	return io.NopCloser(bytes.NewReader(c.data)), nil
 }
 
 func (c *composite) Manifest(ctx context.Context) (*ocispec.Manifest, error) {
@@ -159,3 +192,7 @@ func (c *composite) Config(ctx context.Context) (image.Layer, error) {
 func (c *composite) Layers(ctx context.Context) ([]image.Layer, error) {
 	return c.layers, nil
 }
+
+func (c *composite) Complete(ctx context.Context) (bool, []ocispec.Descriptor, error) {
+	return true, nil, nil
+}
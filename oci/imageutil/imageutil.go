@@ -18,10 +18,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"time"
 
+	"github.com/containerd/containerd/images"
 	"github.com/onmetal/onmetal-image/oci/image"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -47,8 +50,9 @@ func WithPlatform(platform ocispec.Platform) DescriptorOpt {
 	}
 }
 
+// JSONValueLayer creates a new image.Layer from the canonical JSON of v, see MarshalCanonical.
 func JSONValueLayer(v interface{}, opts ...DescriptorOpt) (image.Layer, error) {
-	data, err := json.Marshal(v)
+	data, err := MarshalCanonical(v)
 	if err != nil {
 		return nil, fmt.Errorf("could not marshal to json: %w", err)
 	}
@@ -69,6 +73,19 @@ func (b *bytesLayer) Content(ctx context.Context) (io.ReadCloser, error) {
 	return io.NopCloser(bytes.NewReader(b.data)), nil
 }
 
+// ReaderAt implements image.RandomAccessLayer.
+func (b *bytesLayer) ReaderAt(ctx context.Context) (image.ReaderAt, error) {
+	return bytesReaderAt{bytes.NewReader(b.data)}, nil
+}
+
+type bytesReaderAt struct {
+	*bytes.Reader
+}
+
+func (bytesReaderAt) Close() error {
+	return nil
+}
+
 // BytesLayer creates a new image.Layer from the given data.
 // The descriptor digest will be overwritten with the digest obtained from the bytes.
 // The descriptor size will be overwritten with the length of the data.
@@ -98,6 +115,29 @@ func (f *fileLayer) Descriptor() ocispec.Descriptor {
 	return f.desc
 }
 
+// ReaderAt implements image.RandomAccessLayer.
+func (f *fileLayer) ReaderAt(ctx context.Context) (image.ReaderAt, error) {
+	fp, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fp.Stat()
+	if err != nil {
+		_ = fp.Close()
+		return nil, fmt.Errorf("error statting file: %w", err)
+	}
+	return fileReaderAt{fp, stat.Size()}, nil
+}
+
+type fileReaderAt struct {
+	*os.File
+	size int64
+}
+
+func (f fileReaderAt) Size() int64 {
+	return f.size
+}
+
 func FileLayer(path string, opts ...DescriptorOpt) (image.Layer, error) {
 	desc := ocispec.Descriptor{}
 	for _, opt := range opts {
@@ -139,3 +179,181 @@ func ReadLayerContent(ctx context.Context, layer image.Layer) ([]byte, error) {
 
 	return io.ReadAll(rc)
 }
+
+// IsArtifact reports whether the manifest describes an artifact, i.e. a non-image payload with an artifact type.
+func IsArtifact(manifest *ocispec.Manifest) bool {
+	return manifest.ArtifactType != ""
+}
+
+// ErrUnknownSize is returned for descriptors without size information, see HasKnownSize.
+var ErrUnknownSize = errors.New("unknown size")
+
+// emptyDigest is the digest of the empty blob, the only blob that legitimately has size zero.
+var emptyDigest = digest.FromBytes(nil)
+
+// HasKnownSize reports whether the descriptor has size information. Some legacy tools wrote descriptors
+// with a zero or negative size despite non-empty content.
+func HasKnownSize(desc ocispec.Descriptor) bool {
+	return desc.Size > 0 || (desc.Size == 0 && desc.Digest == emptyDigest)
+}
+
+// CheckSizes returns an error wrapping ErrUnknownSize if the config or any layer of the image has no size
+// information, see HasKnownSize.
+func CheckSizes(ctx context.Context, img image.Image) error {
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting manifest: %w", err)
+	}
+
+	for _, desc := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		if !HasKnownSize(desc) {
+			return fmt.Errorf("%w: blob %s of image %s has size %d", ErrUnknownSize, desc.Digest, img.Descriptor().Digest, desc.Size)
+		}
+	}
+	return nil
+}
+
+// ExpiresAtAnnotation is the manifest annotation denoting when an image expires, in RFC 3339 format.
+const ExpiresAtAnnotation = "image.onmetal.de/expires-at"
+
+// ExpiresAt returns the expiry time recorded in the manifest, if any.
+func ExpiresAt(manifest *ocispec.Manifest) (time.Time, bool) {
+	v, ok := manifest.Annotations[ExpiresAtAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// ConfigCreated returns the created time recorded in the config of the image, if any. Like the created field
+// of OCI image configs, it is read from the top-level created field of any JSON config.
+func ConfigCreated(ctx context.Context, img image.Image) (time.Time, bool, error) {
+	config, err := img.Config(ctx)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error getting config: %w", err)
+	}
+	rc, err := config.Content(ctx)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error getting config content: %w", err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	var v struct {
+		Created *time.Time `json:"created"`
+	}
+	if err := json.NewDecoder(rc).Decode(&v); err != nil {
+		// Configs need not be JSON, e.g. for artifacts.
+		return time.Time{}, false, nil
+	}
+	if v.Created == nil || v.Created.IsZero() {
+		return time.Time{}, false, nil
+	}
+	return *v.Created, true, nil
+}
+
+// WithManifestAnnotations returns a copy of the image with the given annotations added to its manifest.
+// As the manifest changes, the returned image has a different digest.
+func WithManifestAnnotations(ctx context.Context, img image.Image, annotations map[string]string) (image.Image, error) {
+	return EditManifestAnnotations(ctx, img, annotations, nil)
+}
+
+// EditManifestAnnotations returns a copy of the image with the given annotations set on and the given
+// keys removed from its manifest. As the manifest changes, the returned image has a different digest.
+func EditManifestAnnotations(ctx context.Context, img image.Image, set map[string]string, remove []string) (image.Image, error) {
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting manifest: %w", err)
+	}
+
+	config, err := img.Config(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting config: %w", err)
+	}
+
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting layers: %w", err)
+	}
+
+	annotations := make(map[string]string, len(manifest.Annotations)+len(set))
+	for k, v := range manifest.Annotations {
+		annotations[k] = v
+	}
+	for k, v := range set {
+		annotations[k] = v
+	}
+	for _, k := range remove {
+		delete(annotations, k)
+	}
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+
+	return NewBuilder(config).
+		ArtifactType(manifest.ArtifactType).
+		Layers(layers...).
+		Annotations(annotations).
+		Complete(func(desc *ocispec.Descriptor) {
+			desc.Platform = img.Descriptor().Platform
+		})
+}
+
+// ConfigPlatform returns the platform recorded in the config of the image, or nil if its config is no
+// OCI or docker image config or does not specify an operating system and architecture.
+func ConfigPlatform(ctx context.Context, img image.Image) (*ocispec.Platform, error) {
+	config, err := img.Config(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting config: %w", err)
+	}
+
+	switch config.Descriptor().MediaType {
+	case ocispec.MediaTypeImageConfig, images.MediaTypeDockerSchema2Config:
+	default:
+		return nil, nil
+	}
+
+	data, err := ReadLayerContent(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+
+	imageConfig := &ocispec.Image{}
+	if err := json.Unmarshal(data, imageConfig); err != nil {
+		return nil, fmt.Errorf("error decoding config: %w", err)
+	}
+	if imageConfig.OS == "" || imageConfig.Architecture == "" {
+		return nil, nil
+	}
+	platform := imageConfig.Platform
+	return &platform, nil
+}
+
+// ConfigDiffIDs returns the rootfs.diff_ids recorded in the config of the image, or nil if its config is
+// no OCI or docker image config.
+func ConfigDiffIDs(ctx context.Context, img image.Image) ([]digest.Digest, error) {
+	config, err := img.Config(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting config: %w", err)
+	}
+
+	switch config.Descriptor().MediaType {
+	case ocispec.MediaTypeImageConfig, images.MediaTypeDockerSchema2Config:
+	default:
+		return nil, nil
+	}
+
+	data, err := ReadLayerContent(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+
+	imageConfig := &ocispec.Image{}
+	if err := json.Unmarshal(data, imageConfig); err != nil {
+		return nil, fmt.Errorf("error decoding config: %w", err)
+	}
+	return imageConfig.RootFS.DiffIDs, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageutil
+
+import (
+	"fmt"
+
+	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// IndexLayer returns the canonical OCI image index referencing the given manifests in order. Only the
+// media type, artifact type, digest, size and platform of the manifests are kept, their annotations are
+// local bookkeeping (e.g. index entry annotations) and not part of the index.
+func IndexLayer(manifests []ocispec.Descriptor, annotations map[string]string) (image.Layer, error) {
+	index := ocispec.Index{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispec.MediaTypeImageIndex,
+		Manifests:   make([]ocispec.Descriptor, 0, len(manifests)),
+		Annotations: annotations,
+	}
+	for _, manifest := range manifests {
+		index.Manifests = append(index.Manifests, ocispec.Descriptor{
+			MediaType:    manifest.MediaType,
+			ArtifactType: manifest.ArtifactType,
+			Digest:       manifest.Digest,
+			Size:         manifest.Size,
+			Platform:     manifest.Platform,
+		})
+	}
+
+	data, err := MarshalCanonical(index)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling index: %w", err)
+	}
+	return BytesLayer(data, WithMediaType(ocispec.MediaTypeImageIndex)), nil
+}
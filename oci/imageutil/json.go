@@ -0,0 +1,73 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// MarshalCanonical marshals v to canonical JSON: Object keys are sorted, members with a null value are
+// omitted, numbers keep their literal representation and there is no insignificant whitespace or HTML
+// escaping. All manifests and configs generated by this module are marshaled with it, so their digests
+// only depend on their content.
+func MarshalCanonical(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return Canonicalize(data)
+}
+
+// Canonicalize returns the canonical form of the given JSON, see MarshalCanonical.
+// Only use it for JSON this module generates: JSON read from elsewhere has to be kept byte for byte, as
+// its digest is computed over the original bytes.
+func Canonicalize(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("error decoding json: %w", err)
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	// Maps are encoded with sorted keys.
+	if err := enc.Encode(dropNulls(v)); err != nil {
+		return nil, fmt.Errorf("error encoding json: %w", err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// dropNulls removes all object members with a null value, recursively.
+func dropNulls(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if value == nil {
+				delete(v, key)
+				continue
+			}
+			v[key] = dropNulls(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = dropNulls(value)
+		}
+	}
+	return v
+}
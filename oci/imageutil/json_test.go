@@ -0,0 +1,88 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageutil_test
+
+import (
+	"context"
+
+	. "github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("MarshalCanonical", func() {
+	It("should sort keys, drop nulls and keep number literals", func() {
+		data, err := Canonicalize([]byte(`{ "b": 1, "a": {"d": null, "c": "<x>"}, "n": 12345678901234567890, "l": [null, {}] }`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(`{"a":{"c":"<x>"},"b":1,"l":[null,{}],"n":12345678901234567890}`))
+	})
+
+	It("should marshal struct fields in sorted order", func() {
+		data, err := MarshalCanonical(ocispec.Descriptor{MediaType: "m", Digest: "sha256:0", Size: 1})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(`{"digest":"sha256:0","mediaType":"m","size":1}`))
+	})
+
+	// The golden digests must only change on intended changes of the serialization, as they change the
+	// digest of every image built.
+	It("should produce the golden digests for a built image", func() {
+		ctx := context.Background()
+		img, err := NewJSONConfigBuilder(
+			map[string]interface{}{"commandLine": "console=ttyS0 root=/dev/vda", "provisioning": "ignition"},
+			WithMediaType("application/vnd.onmetal.image.config.v1alpha1+json"),
+		).
+			BytesLayer([]byte("rootfs"),
+				WithMediaType("application/vnd.onmetal.image.rootfs.v1alpha1.rootfs"),
+				WithAnnotations(map[string]string{"b": "2", "a": "<1>"}),
+			).
+			Annotations(map[string]string{"org.opencontainers.image.created": "2023-01-01T00:00:00Z", "image.onmetal.de/expires-at": "2024-01-01T00:00:00Z"}).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+
+		config, err := img.Config(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Descriptor().Digest.String()).To(Equal("sha256:cb339dbb3141d4bda5e5b75f380b6e264c285bbf107b101349321274b1117c24"))
+		Expect(img.Descriptor().Digest.String()).To(Equal("sha256:17d7b6b02a1f610e473756115879bba2ef1a36edfed40d6b2d94e76198ff882c"))
+
+		By("checking the content matches the digest")
+		data, err := ReadLayerContent(ctx, img)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(digest.FromBytes(data)).To(Equal(img.Descriptor().Digest))
+	})
+})
+
+var _ = Describe("LayerSources", func() {
+	It("should round-trip through the manifest annotations", func() {
+		sources := LayerSources{"sha256:0": {"ghcr.io/onmetal/gardenlinux:v1@sha256:1", "ghcr.io/onmetal/base:v1@sha256:2"}}
+		annotations, err := sources.Annotations()
+		Expect(err).NotTo(HaveOccurred())
+
+		parsed, err := ParseLayerSources(&ocispec.Manifest{Annotations: annotations})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed).To(Equal(sources))
+	})
+
+	It("should return nil if no sources are recorded", func() {
+		annotations, err := LayerSources(nil).Annotations()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(annotations).To(BeNil())
+
+		parsed, err := ParseLayerSources(&ocispec.Manifest{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed).To(BeNil())
+	})
+})
@@ -0,0 +1,64 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageutil
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LayerSourcesAnnotation is the manifest annotation recording the layers taken from other images.
+// Its value is a JSON object mapping layer digests to the digest-pinned references of the images the
+// layer was taken from, nearest first.
+const LayerSourcesAnnotation = "image.onmetal.de/layer-sources"
+
+// InputSourceAnnotation is the layer annotation recording where build streamed the content of a layer
+// from if it was no local file: the URL it was fetched from or StdinInputSource.
+const InputSourceAnnotation = "image.onmetal.de/input-source"
+
+// StdinInputSource is the InputSourceAnnotation value of layers read from stdin.
+const StdinInputSource = "stdin"
+
+// LayerSources maps layer digests to the references of the images they were taken from, nearest first.
+type LayerSources map[digest.Digest][]string
+
+// ParseLayerSources returns the layer sources recorded in the manifest. If there are none, it returns nil.
+func ParseLayerSources(manifest *ocispec.Manifest) (LayerSources, error) {
+	v, ok := manifest.Annotations[LayerSourcesAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var sources LayerSources
+	if err := json.Unmarshal([]byte(v), &sources); err != nil {
+		return nil, fmt.Errorf("error parsing %s annotation: %w", LayerSourcesAnnotation, err)
+	}
+	return sources, nil
+}
+
+// Annotations returns the manifest annotations recording the layer sources. If there are none, it
+// returns nil.
+func (s LayerSources) Annotations() (map[string]string, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding layer sources: %w", err)
+	}
+	return map[string]string{LayerSourcesAnnotation: string(data)}, nil
+}
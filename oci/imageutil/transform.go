@@ -0,0 +1,160 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ManifestTransform rewrites a manifest, e.g. to strip annotations before pushing it. It may change any
+// metadata of the manifest and its descriptors, but has to keep referencing the blobs of the image.
+type ManifestTransform func(manifest ocispec.Manifest) (ocispec.Manifest, error)
+
+// TransformManifest returns a copy of the image with the manifest rewritten by the transforms, in order.
+// The transforms get a deep copy of the manifest, so they cannot modify the image. Transformed config and
+// layer descriptors have to reference blobs of the image with their original size. As the manifest changes,
+// the returned image has a different digest unless the transforms changed nothing.
+func TransformManifest(ctx context.Context, img image.Image, transforms ...ManifestTransform) (image.Image, error) {
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting manifest: %w", err)
+	}
+	config, err := img.Config(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting config: %w", err)
+	}
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting layers: %w", err)
+	}
+
+	original, err := MarshalCanonical(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling manifest: %w", err)
+	}
+	transformed := *manifest
+	for i, transform := range transforms {
+		in, err := copyManifest(transformed)
+		if err != nil {
+			return nil, err
+		}
+		if transformed, err = transform(in); err != nil {
+			return nil, fmt.Errorf("error applying manifest transform %d: %w", i, err)
+		}
+	}
+	data, err := MarshalCanonical(transformed)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling transformed manifest: %w", err)
+	}
+	if bytes.Equal(data, original) {
+		return img, nil
+	}
+
+	blobs := make(map[blob]image.Layer, len(layers)+1)
+	for _, layer := range append([]image.Layer{config}, layers...) {
+		blobs[blobKey(layer.Descriptor())] = layer
+	}
+	describe := func(desc ocispec.Descriptor) (image.Layer, error) {
+		layer, ok := blobs[blobKey(desc)]
+		if !ok {
+			return nil, fmt.Errorf("transformed manifest references blob %s of size %d, which is not part of the image", desc.Digest, desc.Size)
+		}
+		return describedLayer{Layer: layer, desc: desc}, nil
+	}
+
+	res := &composite{manifest: transformed, data: data}
+	if res.config, err = describe(transformed.Config); err != nil {
+		return nil, err
+	}
+	for _, desc := range transformed.Layers {
+		layer, err := describe(desc)
+		if err != nil {
+			return nil, err
+		}
+		res.layers = append(res.layers, layer)
+	}
+
+	res.descriptor = ocispec.Descriptor{
+		MediaType:    img.Descriptor().MediaType,
+		ArtifactType: transformed.ArtifactType,
+		Digest:       digest.FromBytes(data),
+		Size:         int64(len(data)),
+		Platform:     img.Descriptor().Platform,
+	}
+	return res, nil
+}
+
+// blob identifies the blob a descriptor references.
+type blob struct {
+	digest digest.Digest
+	size   int64
+}
+
+func blobKey(desc ocispec.Descriptor) blob {
+	return blob{desc.Digest, desc.Size}
+}
+
+// copyManifest returns a deep copy of the manifest.
+func copyManifest(manifest ocispec.Manifest) (ocispec.Manifest, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return ocispec.Manifest{}, fmt.Errorf("error copying manifest: %w", err)
+	}
+	var res ocispec.Manifest
+	if err := json.Unmarshal(data, &res); err != nil {
+		return ocispec.Manifest{}, fmt.Errorf("error copying manifest: %w", err)
+	}
+	return res, nil
+}
+
+// StripAnnotations returns a ManifestTransform removing the annotations with keys matching any of the
+// patterns (see path.Match) from the manifest and its config and layer descriptors.
+func StripAnnotations(patterns ...string) (ManifestTransform, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid annotation key pattern %q: %w", pattern, err)
+		}
+	}
+	strip := func(annotations map[string]string) map[string]string {
+		for key := range annotations {
+			for _, pattern := range patterns {
+				if ok, _ := path.Match(pattern, key); ok {
+					delete(annotations, key)
+					break
+				}
+			}
+		}
+		if len(annotations) == 0 {
+			return nil
+		}
+		return annotations
+	}
+	return func(manifest ocispec.Manifest) (ocispec.Manifest, error) {
+		manifest.Annotations = strip(manifest.Annotations)
+		manifest.Config.Annotations = strip(manifest.Config.Annotations)
+		for i := range manifest.Layers {
+			manifest.Layers[i].Annotations = strip(manifest.Layers[i].Annotations)
+		}
+		return manifest, nil
+	}, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageutil_test
+
+import (
+	"context"
+	"io"
+
+	. "github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("TransformManifest", func() {
+	var ctx context.Context
+
+	BeforeEach(func() {
+		ctx = context.Background()
+	})
+
+	It("should strip matching annotations without modifying the image", func() {
+		img, err := NewJSONConfigBuilder(map[string]interface{}{}).
+			BytesLayer([]byte("rootfs"), WithAnnotations(map[string]string{"com.example.build.path": "/src/rootfs", "com.example.layer": "rootfs"})).
+			Annotations(map[string]string{"com.example.build.host": "builder.internal", "com.example.key": "value"}).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+
+		strip, err := StripAnnotations("com.example.build.*")
+		Expect(err).NotTo(HaveOccurred())
+		transformed, err := TransformManifest(ctx, img, strip)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(transformed.Descriptor().Digest).NotTo(Equal(img.Descriptor().Digest))
+
+		rc, err := transformed.Content(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		data, err := io.ReadAll(rc)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rc.Close()).To(Succeed())
+		Expect(transformed.Descriptor().Digest).To(Equal(digest.FromBytes(data)))
+
+		manifest, err := transformed.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest.Annotations).To(Equal(map[string]string{"com.example.key": "value"}))
+		Expect(manifest.Layers[0].Annotations).To(Equal(map[string]string{"com.example.layer": "rootfs"}))
+
+		layers, err := transformed.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layers[0].Descriptor()).To(Equal(manifest.Layers[0]))
+		content, err := ReadLayerContent(ctx, layers[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(content).To(Equal([]byte("rootfs")))
+
+		By("checking the original image is unchanged")
+		original, err := img.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(original.Annotations).To(HaveKey("com.example.build.host"))
+		Expect(original.Layers[0].Annotations).To(HaveKey("com.example.build.path"))
+
+		By("checking an image without matching annotations is returned as is")
+		again, err := TransformManifest(ctx, transformed, strip)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again).To(BeIdenticalTo(transformed))
+	})
+
+	It("should reject manifests referencing blobs not part of the image", func() {
+		img, err := NewJSONConfigBuilder(map[string]interface{}{}).BytesLayer([]byte("rootfs")).Complete()
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = TransformManifest(ctx, img, func(manifest ocispec.Manifest) (ocispec.Manifest, error) {
+			manifest.Layers[0].Size++
+			return manifest, nil
+		})
+		Expect(err).To(MatchError(ContainSubstring("not part of the image")))
+	})
+
+	It("should reject invalid annotation key patterns", func() {
+		_, err := StripAnnotations("com.example.[")
+		Expect(err).To(HaveOccurred())
+	})
+})
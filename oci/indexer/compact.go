@@ -0,0 +1,132 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// CompactOptions are options for compacting the index.
+type CompactOptions struct {
+	// Exists reports whether the manifest an entry points to still exists.
+	// Entries whose manifest does not exist are dropped. If unset, no entries are dropped.
+	Exists func(ctx context.Context, dgst digest.Digest) (bool, error)
+}
+
+// CompactOption is an option for compacting the index.
+type CompactOption func(o *CompactOptions)
+
+// WithExists drops entries for which exists reports that their manifest no longer exists.
+func WithExists(exists func(ctx context.Context, dgst digest.Digest) (bool, error)) CompactOption {
+	return func(o *CompactOptions) {
+		o.Exists = exists
+	}
+}
+
+// CompactResult is the result of compacting the index.
+type CompactResult struct {
+	// Merged is the number of duplicate entries merged into another entry.
+	Merged int `json:"merged"`
+	// Dropped are the entries removed because their manifest no longer exists.
+	Dropped []ocispec.Descriptor `json:"dropped,omitempty"`
+	// Entries is the number of entries remaining.
+	Entries int `json:"entries"`
+}
+
+// entryKey identifies equal entries, see sameEntry.
+type entryKey struct {
+	digest digest.Digest
+	named  bool
+	name   string
+}
+
+func keyOf(desc ocispec.Descriptor) entryKey {
+	name, named := desc.Annotations[ocispec.AnnotationRefName]
+	return entryKey{digest: desc.Digest, named: named, name: name}
+}
+
+// mergeDuplicate merges two equal entries the same way Add does: The annotations of the more recently
+// added entry take precedence, but the earlier added-at time is kept. The platform of the earlier entry
+// is kept unless it has none.
+func mergeDuplicate(a, b ocispec.Descriptor) ocispec.Descriptor {
+	descs := []ocispec.Descriptor{a, b}
+	sortDescriptors(descs, true)
+	older, newer := descs[0], descs[1]
+
+	merged := merge(older, newer)
+	if merged.Platform == nil && newer.Platform != nil {
+		p := *newer.Platform
+		merged.Platform = &p
+	}
+	return merged
+}
+
+// Compact merges duplicate entries (same digest and reference name, which older versions of Add created),
+// drops entries whose manifest no longer exists if WithExists is passed, and rewrites the index file.
+// Merged entries keep the position of the first of them.
+func (f *Indexer) Compact(ctx context.Context, opts ...CompactOption) (*CompactResult, error) {
+	o := &CompactOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	res := &CompactResult{}
+	err := f.modify(ctx, func(index *ocispec.Index) error {
+		*res = CompactResult{}
+
+		var (
+			exists    = make(map[digest.Digest]bool)
+			positions = make(map[entryKey]int)
+			compacted = make([]ocispec.Descriptor, 0, len(index.Manifests))
+		)
+		for _, desc := range index.Manifests {
+			if o.Exists != nil {
+				ok, checked := exists[desc.Digest]
+				if !checked {
+					var err error
+					if ok, err = o.Exists(ctx, desc.Digest); err != nil {
+						return fmt.Errorf("error checking manifest %s: %w", desc.Digest, err)
+					}
+					exists[desc.Digest] = ok
+				}
+				if !ok {
+					res.Dropped = append(res.Dropped, desc)
+					continue
+				}
+			}
+
+			key := keyOf(desc)
+			if i, ok := positions[key]; ok {
+				compacted[i] = mergeDuplicate(compacted[i], desc)
+				res.Merged++
+				continue
+			}
+			positions[key] = len(compacted)
+			compacted = append(compacted, desc)
+		}
+
+		index.Manifests = compacted
+		res.Entries = len(compacted)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -19,25 +19,139 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	"github.com/onmetal/onmetal-image/utils/fsutil"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 const Filename = "index.json"
 
+// AddedAtAnnotation is the annotation recording when an entry was added to the index, in RFC 3339 format.
+const AddedAtAnnotation = "image.onmetal.de/added-at"
+
+// PulledAtAnnotation is the annotation recording when an entry was last pulled from a registry, in RFC 3339 format.
+const PulledAtAnnotation = "image.onmetal.de/pulled-at"
+
+// PinnedAnnotation is the annotation marking an entry as pinned, see layout.PinnedAnnotation.
+const PinnedAnnotation = "image.onmetal.de/pinned"
+
+// StoreAnnotationPrefix is the prefix of the annotations the store records on the index and its entries.
+// Most of them describe the image an entry refers to, e.g. its processed layers or use count, and are
+// not carried over to an entry of another digest, see carryOver.
+const StoreAnnotationPrefix = "image.onmetal.de/"
+
+// provenanceAnnotations are annotations describing how an entry got into the index.
+// They are refreshed instead of carried over when an entry is replaced.
+var provenanceAnnotations = []string{AddedAtAnnotation, PulledAtAnnotation}
+
+// portableAnnotations are the store annotations describing the entry rather than the image it refers to.
+// They are carried over to an entry of another digest.
+var portableAnnotations = []string{PinnedAnnotation}
+
 var ErrNotFound = errors.New("not found")
 
+// ErrAlreadyExists is returned by Add in strict mode if an equal entry already exists, see WithStrict.
+var ErrAlreadyExists = errors.New("already exists")
+
+// ErrConflict is returned by conditional modifications if the index entry changed concurrently.
+var ErrConflict = errors.New("conflict")
+
+// ErrNoReplaceTarget is returned by Replace with WithSingleTarget if no entry matches.
+var ErrNoReplaceTarget = errors.New("no entry to replace")
+
+// ErrAmbiguousReplaceTarget is matched by AmbiguousReplaceTargetError.
+var ErrAmbiguousReplaceTarget = errors.New("ambiguous entry to replace")
+
+// AmbiguousReplaceTargetError is returned by Replace with WithSingleTarget if several entries match.
+type AmbiguousReplaceTargetError struct {
+	// Candidates are the matching entries.
+	Candidates []ocispec.Descriptor
+}
+
+func (e *AmbiguousReplaceTargetError) Error() string {
+	candidates := make([]string, 0, len(e.Candidates))
+	for _, desc := range e.Candidates {
+		if name, ok := desc.Annotations[ocispec.AnnotationRefName]; ok {
+			candidates = append(candidates, fmt.Sprintf("%s (%s)", name, desc.Digest))
+		} else {
+			candidates = append(candidates, desc.Digest.String())
+		}
+	}
+	return fmt.Sprintf("%s: %d entries match: %s", ErrAmbiguousReplaceTarget, len(e.Candidates), strings.Join(candidates, ", "))
+}
+
+func (e *AmbiguousReplaceTargetError) Is(target error) bool {
+	return target == ErrAmbiguousReplaceTarget
+}
+
 type Indexer struct {
-	path string
+	path       string
+	lockFiles  bool
+	modifyHook ModifyHook
+	doneHook   DoneHook
+
+	mu    sync.Mutex
+	cache *cachedIndex
 }
 
-func (f *Indexer) readIndex() (*ocispec.Index, error) {
-	data, err := os.ReadFile(f.path)
+// cachedIndex is the parsed index file along with the file info it was read with and the positions
+// of its entries by digest.
+type cachedIndex struct {
+	info     os.FileInfo
+	index    *ocispec.Index
+	byDigest map[digest.Digest][]int
+}
+
+func newCachedIndex(info os.FileInfo, index *ocispec.Index) *cachedIndex {
+	byDigest := make(map[digest.Digest][]int)
+	for i, desc := range index.Manifests {
+		byDigest[desc.Digest] = append(byDigest[desc.Digest], i)
+	}
+	return &cachedIndex{info: info, index: index, byDigest: byDigest}
+}
+
+// valid reports whether the cached index still reflects the index file with the given info.
+// The index file is always replaced by renaming, so any modification changes the file identity.
+func (c *cachedIndex) valid(info os.FileInfo) bool {
+	return os.SameFile(c.info, info) && c.info.ModTime().Equal(info.ModTime()) && c.info.Size() == info.Size()
+}
+
+// cached returns the parsed index, only re-reading the index file if it changed since it was last read.
+// The returned index must not be modified, see readIndex.
+func (f *Indexer) cached() (*cachedIndex, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading index file: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cache != nil && f.cache.valid(info) {
+		return f.cache, nil
+	}
+
+	// Stat the opened file, so the cached file info belongs to the content that was read.
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading index file: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	if info, err = file.Stat(); err != nil {
+		return nil, fmt.Errorf("error reading index file: %w", err)
+	}
+	data, err := io.ReadAll(file)
 	if err != nil {
 		return nil, fmt.Errorf("error reading index file: %w", err)
 	}
@@ -47,7 +161,26 @@ func (f *Indexer) readIndex() (*ocispec.Index, error) {
 		return nil, fmt.Errorf("error reading index: %w", err)
 	}
 
-	return index, nil
+	f.cache = newCachedIndex(info, index)
+	return f.cache, nil
+}
+
+// readIndex returns a copy of the index that may be modified.
+func (f *Indexer) readIndex() (*ocispec.Index, error) {
+	c, err := f.cached()
+	if err != nil {
+		return nil, err
+	}
+
+	index := *c.index
+	index.Manifests = append([]ocispec.Descriptor(nil), c.index.Manifests...)
+	if c.index.Annotations != nil {
+		index.Annotations = make(map[string]string, len(c.index.Annotations))
+		for k, v := range c.index.Annotations {
+			index.Annotations[k] = v
+		}
+	}
+	return &index, nil
 }
 
 func (f *Indexer) writeIndex(index *ocispec.Index) error {
@@ -56,31 +189,278 @@ func (f *Indexer) writeIndex(index *ocispec.Index) error {
 		return fmt.Errorf("could not convert index to json: %w", err)
 	}
 
-	if err := os.WriteFile(f.path, data, 0666); err != nil {
+	// Write to a temporary file first and rename it so readers never observe a partially written index.
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), "."+filepath.Base(f.path)+".*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary index file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error writing index: %w", err)
+	}
+	if err := tmp.Chmod(0666); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error setting index file mode: %w", err)
+	}
+	// Sync before renaming, so a power loss cannot leave an empty index behind.
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error syncing index: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary index file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
 		return fmt.Errorf("error writing index: %w", err)
 	}
+	if err := fsutil.SyncDir(filepath.Dir(f.path)); err != nil {
+		return fmt.Errorf("error syncing index directory: %w", err)
+	}
 
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if info, err := os.Stat(f.path); err == nil {
+		f.cache = newCachedIndex(info, index)
+	} else {
+		f.cache = nil
+	}
 	return nil
 }
 
-func (f *Indexer) Add(ctx context.Context, desc ocispec.Descriptor) error {
+// modify reads the index, applies the modification and writes it back while holding the index file lock,
+// so concurrent modifications (also from other processes) do not overwrite each other.
+func (f *Indexer) modify(ctx context.Context, fn func(index *ocispec.Index) error) (retErr error) {
+	unlock, err := f.lock()
+	if err != nil {
+		return fmt.Errorf("error locking index: %w", err)
+	}
+	defer func() {
+		if err := unlock(); err != nil && retErr == nil {
+			retErr = fmt.Errorf("error unlocking index: %w", err)
+		}
+	}()
+
 	index, err := f.readIndex()
 	if err != nil {
 		return err
 	}
+	var old *ocispec.Index
+	if f.modifyHook != nil || f.doneHook != nil {
+		if old, err = f.readIndex(); err != nil {
+			return err
+		}
+	}
 
-	index.Manifests = append(index.Manifests, desc)
+	err = f.apply(ctx, fn, old, index)
+	if f.doneHook != nil {
+		if err != nil {
+			f.doneHook(ctx, old, nil, err)
+		} else {
+			f.doneHook(ctx, old, index, nil)
+		}
+	}
+	return err
+}
 
+// apply applies fn and the modify hook to the index and writes it.
+func (f *Indexer) apply(ctx context.Context, fn func(index *ocispec.Index) error, old, index *ocispec.Index) error {
+	if err := fn(index); err != nil {
+		return err
+	}
+	if f.modifyHook != nil {
+		if err := f.modifyHook(ctx, old, index); err != nil {
+			return err
+		}
+	}
 	return f.writeIndex(index)
 }
 
-func (f *Indexer) Find(ctx context.Context, match descriptormatcher.Matcher) (ocispec.Descriptor, error) {
+// Modify applies fn to the index and writes it back while holding the index lock, for modifications not
+// covered by the other methods. fn may modify the index in place.
+func (f *Indexer) Modify(ctx context.Context, fn func(index *ocispec.Index) error) error {
+	return f.modify(ctx, fn)
+}
+
+// Mutation is a modification of the index in place, see Apply.
+type Mutation func(index *ocispec.Index) error
+
+// Apply applies the mutations in order with a single write of the index while holding the index lock.
+// If any mutation fails, none of them are applied.
+func (f *Indexer) Apply(ctx context.Context, mutations ...Mutation) error {
+	return f.modify(ctx, func(index *ocispec.Index) error {
+		for _, mutation := range mutations {
+			if err := mutation(index); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Read applies fn to the index while holding the index lock without writing it back, e.g. to record
+// state that has to be consistent with the index. fn must not modify the index.
+func (f *Indexer) Read(ctx context.Context, fn func(index *ocispec.Index) error) (retErr error) {
+	unlock, err := f.lock()
+	if err != nil {
+		return fmt.Errorf("error locking index: %w", err)
+	}
+	defer func() {
+		if err := unlock(); err != nil && retErr == nil {
+			retErr = fmt.Errorf("error unlocking index: %w", err)
+		}
+	}()
+
 	index, err := f.readIndex()
+	if err != nil {
+		return err
+	}
+	return fn(index)
+}
+
+// Index returns a copy of the index.
+func (f *Indexer) Index(ctx context.Context) (*ocispec.Index, error) {
+	return f.readIndex()
+}
+
+// WithAnnotation returns a copy of the descriptor with the given annotation set.
+// The annotations of the original descriptor are not modified.
+func WithAnnotation(desc ocispec.Descriptor, key, value string) ocispec.Descriptor {
+	annotations := make(map[string]string, len(desc.Annotations)+1)
+	for k, v := range desc.Annotations {
+		annotations[k] = v
+	}
+	annotations[key] = value
+	desc.Annotations = annotations
+	return desc
+}
+
+// WithoutAnnotation returns a copy of the descriptor without the given annotation.
+// The annotations of the original descriptor are not modified.
+func WithoutAnnotation(desc ocispec.Descriptor, key string) ocispec.Descriptor {
+	annotations := make(map[string]string, len(desc.Annotations))
+	for k, v := range desc.Annotations {
+		if k != key {
+			annotations[k] = v
+		}
+	}
+	desc.Annotations = annotations
+	return desc
+}
+
+// withAddedAt returns a copy of the descriptor with the AddedAtAnnotation set to the current time.
+func withAddedAt(desc ocispec.Descriptor) ocispec.Descriptor {
+	return WithAnnotation(desc, AddedAtAnnotation, time.Now().UTC().Format(time.RFC3339Nano))
+}
+
+// AddedAt returns the time the descriptor was added to the index, if recorded.
+func AddedAt(desc ocispec.Descriptor) (time.Time, bool) {
+	v, ok := desc.Annotations[AddedAtAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// PulledAt returns the time the descriptor was last pulled from a registry, if recorded.
+func PulledAt(desc ocispec.Descriptor) (time.Time, bool) {
+	v, ok := desc.Annotations[PulledAtAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// AddOptions are options for adding index entries.
+type AddOptions struct {
+	// Strict makes adding an entry that already exists fail with ErrAlreadyExists.
+	Strict bool
+}
+
+// AddOption is an option for adding index entries.
+type AddOption func(o *AddOptions)
+
+// WithStrict makes Add fail with ErrAlreadyExists instead of merging into an existing entry.
+func WithStrict() AddOption {
+	return func(o *AddOptions) {
+		o.Strict = true
+	}
+}
+
+// sameEntry returns a matcher for entries equal to the descriptor: Entries with the same digest and
+// the same reference name, or no reference name if the descriptor has none.
+func sameEntry(desc ocispec.Descriptor) descriptormatcher.Matcher {
+	if name, ok := desc.Annotations[ocispec.AnnotationRefName]; ok {
+		return descriptormatcher.And(descriptormatcher.Name(name), descriptormatcher.Digests(desc.Digest))
+	}
+	return descriptormatcher.And(descriptormatcher.Unnamed, descriptormatcher.Digests(desc.Digest))
+}
+
+// merge returns a copy of the existing entry with the annotations of the descriptor merged in.
+// Annotations set on the descriptor take precedence, except for the AddedAtAnnotation of the existing entry.
+func merge(existing, desc ocispec.Descriptor) ocispec.Descriptor {
+	for k, v := range desc.Annotations {
+		if k == AddedAtAnnotation {
+			if _, ok := existing.Annotations[k]; ok {
+				continue
+			}
+		}
+		existing = WithAnnotation(existing, k, v)
+	}
+	return existing
+}
+
+// Add adds the descriptor to the index.
+// Adding a descriptor equal to an existing entry (same digest and reference name, see sameEntry) is
+// idempotent: Instead of adding a duplicate, its annotations are merged into the existing entry, which
+// keeps its position and added-at time. Pass WithStrict to fail with ErrAlreadyExists instead.
+func (f *Indexer) Add(ctx context.Context, desc ocispec.Descriptor, opts ...AddOption) error {
+	return f.modify(ctx, AddMutation(desc, opts...))
+}
+
+// AddMutation returns the Mutation of Add, e.g. to apply it along with others, see Apply.
+func AddMutation(desc ocispec.Descriptor, opts ...AddOption) Mutation {
+	o := &AddOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	match := sameEntry(desc)
+	return func(index *ocispec.Index) error {
+		var found bool
+		for i, manifest := range index.Manifests {
+			if !match(manifest) {
+				continue
+			}
+			if o.Strict {
+				return fmt.Errorf("%w: entry with digest %s", ErrAlreadyExists, desc.Digest)
+			}
+			index.Manifests[i] = merge(manifest, desc)
+			found = true
+		}
+		if !found {
+			index.Manifests = append(index.Manifests, withAddedAt(desc))
+		}
+		return nil
+	}
+}
+
+func (f *Indexer) Find(ctx context.Context, match descriptormatcher.Matcher) (ocispec.Descriptor, error) {
+	c, err := f.cached()
 	if err != nil {
 		return ocispec.Descriptor{}, err
 	}
 
-	for _, manifest := range index.Manifests {
+	for _, manifest := range c.index.Manifests {
 		if match(manifest) {
 			return manifest, nil
 		}
@@ -88,82 +468,462 @@ func (f *Indexer) Find(ctx context.Context, match descriptormatcher.Matcher) (oc
 	return ocispec.Descriptor{}, fmt.Errorf("%w: no index matching", ErrNotFound)
 }
 
-func (f *Indexer) List(ctx context.Context, match descriptormatcher.Matcher) ([]ocispec.Descriptor, error) {
-	index, err := f.readIndex()
+// FindDigest returns the first entry with the given digest.
+// Unlike Find with descriptormatcher.Digests, it looks the entry up without scanning the index.
+func (f *Indexer) FindDigest(ctx context.Context, dgst digest.Digest) (ocispec.Descriptor, error) {
+	c, err := f.cached()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	positions := c.byDigest[dgst]
+	if len(positions) == 0 {
+		return ocispec.Descriptor{}, fmt.Errorf("%w: no index with digest %s", ErrNotFound, dgst)
+	}
+	return c.index.Manifests[positions[0]], nil
+}
+
+// ListOptions are options for listing index entries.
+type ListOptions struct {
+	// Ascending sorts the entries by added-at ascending instead of descending.
+	Ascending bool
+	// Limit limits the number of returned entries. Zero means no limit.
+	Limit int
+}
+
+// ListOption is an option for listing index entries.
+type ListOption func(o *ListOptions)
+
+// WithAscending sorts the listed entries oldest first.
+func WithAscending() ListOption {
+	return func(o *ListOptions) {
+		o.Ascending = true
+	}
+}
+
+// WithLimit limits the number of listed entries.
+func WithLimit(limit int) ListOption {
+	return func(o *ListOptions) {
+		o.Limit = limit
+	}
+}
+
+// sortDescriptors sorts the descriptors by their added-at time (descending unless ascending is set),
+// using the digest as tiebreaker. Descriptors without an added-at time are sorted last.
+func sortDescriptors(descs []ocispec.Descriptor, ascending bool) {
+	sort.SliceStable(descs, func(i, j int) bool {
+		t1, ok1 := AddedAt(descs[i])
+		t2, ok2 := AddedAt(descs[j])
+		if ok1 != ok2 {
+			return ok1
+		}
+		if !t1.Equal(t2) {
+			if ascending {
+				return t1.Before(t2)
+			}
+			return t1.After(t2)
+		}
+		return descs[i].Digest < descs[j].Digest
+	})
+}
+
+// List lists all entries matching the given matcher.
+// By default, the entries are sorted by the time they were added, most recent first.
+func (f *Indexer) List(ctx context.Context, match descriptormatcher.Matcher, opts ...ListOption) ([]ocispec.Descriptor, error) {
+	o := &ListOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	c, err := f.cached()
 	if err != nil {
 		return nil, err
 	}
 
 	var res []ocispec.Descriptor
-	for _, desc := range index.Manifests {
+	for _, desc := range c.index.Manifests {
 		if match(desc) {
 			res = append(res, desc)
 		}
 	}
+
+	sortDescriptors(res, o.Ascending)
+	if o.Limit > 0 && len(res) > o.Limit {
+		res = res[:o.Limit]
+	}
 	return res, nil
 }
 
-func (f *Indexer) Replace(ctx context.Context, desc ocispec.Descriptor, match descriptormatcher.Matcher) error {
-	index, err := f.readIndex()
-	if err != nil {
-		return err
+// ReplaceOptions are options for replacing index entries.
+type ReplaceOptions struct {
+	// ExpectedDigest, if set, is the digest all replaced entries are expected to have.
+	// If it points to an empty digest, no entry is expected to match.
+	ExpectedDigest *digest.Digest
+	// NoCarryOver disables carrying over annotations from the replaced entries.
+	NoCarryOver bool
+	// SingleTarget requires exactly one entry to match, see WithSingleTarget.
+	SingleTarget bool
+}
+
+// ReplaceOption is an option for replacing index entries.
+type ReplaceOption func(o *ReplaceOptions)
+
+// WithExpectedDigest makes the replacement fail with ErrConflict unless all replaced entries have the given digest.
+// An empty digest expects that no entry matches. This allows implementing safe read-modify-write loops.
+func WithExpectedDigest(dgst digest.Digest) ReplaceOption {
+	return func(o *ReplaceOptions) {
+		o.ExpectedDigest = &dgst
 	}
+}
 
-	var remaining []ocispec.Descriptor
-	for _, manifest := range index.Manifests {
-		if !match(manifest) {
-			remaining = append(remaining, manifest)
+// WithoutCarryOver makes the replacement not carry over any annotations from the replaced entries.
+func WithoutCarryOver() ReplaceOption {
+	return func(o *ReplaceOptions) {
+		o.NoCarryOver = true
+	}
+}
+
+// WithSingleTarget makes the replacement fail with ErrNoReplaceTarget if no entry matches and with an
+// *AmbiguousReplaceTargetError listing the candidates if several do, instead of adding the descriptor or
+// replacing all of them, e.g. to replace "the image annotated channel=stable".
+func WithSingleTarget() ReplaceOption {
+	return func(o *ReplaceOptions) {
+		o.SingleTarget = true
+	}
+}
+
+// carryOver returns a copy of the descriptor with the annotations of the replaced entries merged in.
+// Annotations explicitly set on the descriptor take precedence, followed by those of the most recently
+// added replaced entry. Provenance annotations are never carried over. Replaced entries of another
+// digest only carry over the reference name, user annotations and the portable store annotations, the
+// others describe the image they refer to, see StoreAnnotationPrefix.
+// If the descriptor has no platform, the platform of a replaced entry with the same digest is carried over.
+func carryOver(desc ocispec.Descriptor, replaced []ocispec.Descriptor) ocispec.Descriptor {
+	replaced = append([]ocispec.Descriptor(nil), replaced...)
+	sortDescriptors(replaced, true)
+
+	var (
+		annotations = make(map[string]string)
+		platform    *ocispec.Platform
+	)
+	for _, old := range replaced {
+		for k, v := range old.Annotations {
+			if old.Digest != desc.Digest && !isPortableAnnotation(k) {
+				continue
+			}
+			annotations[k] = v
+		}
+		if old.Platform != nil && old.Digest == desc.Digest {
+			platform = old.Platform
 		}
 	}
+	if desc.Platform == nil && platform != nil {
+		p := *platform
+		desc.Platform = &p
+	}
+	for _, key := range provenanceAnnotations {
+		delete(annotations, key)
+	}
+	if len(annotations) == 0 {
+		return desc
+	}
 
-	index.Manifests = append(remaining, desc)
-	if err := f.writeIndex(index); err != nil {
-		return err
+	for k, v := range desc.Annotations {
+		annotations[k] = v
 	}
-	return nil
+	desc.Annotations = annotations
+	return desc
 }
 
-func (f *Indexer) Delete(ctx context.Context, match descriptormatcher.Matcher) error {
-	index, err := f.readIndex()
-	if err != nil {
-		return err
+// isPortableAnnotation reports whether the annotation is carried over to an entry of another digest.
+func isPortableAnnotation(key string) bool {
+	if !strings.HasPrefix(key, StoreAnnotationPrefix) {
+		return true
+	}
+	for _, portable := range portableAnnotations {
+		if key == portable {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace replaces all entries matching the given matcher with the descriptor. The matcher is evaluated
+// against the full index entries, including their annotations, so e.g. descriptormatcher.Name replaces
+// whatever entry holds a reference name and descriptormatcher.Annotation matches by any entry annotation.
+// If no entry matches, the descriptor is added, pass WithSingleTarget to require exactly one match.
+// Unless WithoutCarryOver is specified, annotations of the replaced entries (such as the reference name)
+// are carried over if not explicitly set on the descriptor, see carryOver.
+func (f *Indexer) Replace(ctx context.Context, desc ocispec.Descriptor, match descriptormatcher.Matcher, opts ...ReplaceOption) error {
+	return f.modify(ctx, ReplaceMutation(desc, match, opts...))
+}
+
+// ReplaceMutation returns the Mutation of Replace, e.g. to apply it along with others, see Apply.
+func ReplaceMutation(desc ocispec.Descriptor, match descriptormatcher.Matcher, opts ...ReplaceOption) Mutation {
+	o := &ReplaceOptions{}
+	for _, opt := range opts {
+		opt(o)
 	}
 
-	var remaining []ocispec.Descriptor
-	for _, manifest := range index.Manifests {
-		if !match(manifest) {
-			remaining = append(remaining, manifest)
+	return func(index *ocispec.Index) error {
+		var (
+			remaining []ocispec.Descriptor
+			replaced  []ocispec.Descriptor
+		)
+		for _, manifest := range index.Manifests {
+			if match(manifest) {
+				replaced = append(replaced, manifest)
+			} else {
+				remaining = append(remaining, manifest)
+			}
 		}
+
+		if o.SingleTarget {
+			if err := checkSingleTarget(replaced); err != nil {
+				return err
+			}
+		}
+		if o.ExpectedDigest != nil {
+			if err := checkExpectedDigest(replaced, *o.ExpectedDigest); err != nil {
+				return err
+			}
+		}
+
+		desc := desc
+		if !o.NoCarryOver {
+			desc = carryOver(desc, replaced)
+		}
+		index.Manifests = append(remaining, withAddedAt(desc))
+		return nil
 	}
+}
 
-	index.Manifests = remaining
-	if err := f.writeIndex(index); err != nil {
-		return err
+// CheckReplaceTarget checks whether Replace with the given matcher and options would currently find its
+// target, without modifying the index, e.g. to fail before writing the blobs of a replacing image.
+// Only WithSingleTarget and WithExpectedDigest are checked.
+func (f *Indexer) CheckReplaceTarget(ctx context.Context, match descriptormatcher.Matcher, opts ...ReplaceOption) error {
+	o := &ReplaceOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return f.Read(ctx, func(index *ocispec.Index) error {
+		var replaced []ocispec.Descriptor
+		for _, manifest := range index.Manifests {
+			if match(manifest) {
+				replaced = append(replaced, manifest)
+			}
+		}
+		if o.SingleTarget {
+			if err := checkSingleTarget(replaced); err != nil {
+				return err
+			}
+		}
+		if o.ExpectedDigest != nil {
+			return checkExpectedDigest(replaced, *o.ExpectedDigest)
+		}
+		return nil
+	})
+}
+
+// checkSingleTarget checks that exactly one entry is replaced, see WithSingleTarget.
+func checkSingleTarget(replaced []ocispec.Descriptor) error {
+	switch {
+	case len(replaced) == 0:
+		return ErrNoReplaceTarget
+	case len(replaced) > 1:
+		return &AmbiguousReplaceTargetError{Candidates: replaced}
+	default:
+		return nil
+	}
+}
+
+// checkExpectedDigest checks that the descriptors have the expected digest. An empty digest expects no descriptors.
+func checkExpectedDigest(descs []ocispec.Descriptor, expected digest.Digest) error {
+	if expected == "" {
+		if len(descs) > 0 {
+			return fmt.Errorf("%w: expected no entry but found %s", ErrConflict, descs[0].Digest)
+		}
+		return nil
+	}
+
+	if len(descs) == 0 {
+		return fmt.Errorf("%w: expected entry with digest %s but found none", ErrConflict, expected)
+	}
+	for _, desc := range descs {
+		if desc.Digest != expected {
+			return fmt.Errorf("%w: expected digest %s but found %s", ErrConflict, expected, desc.Digest)
+		}
 	}
 	return nil
 }
 
-func New(path string) (*Indexer, error) {
+// identity returns a matcher for the entry the descriptor would replace: Entries with the same
+// reference name or, for descriptors without a reference name, unnamed entries with the expected digest.
+func identity(desc ocispec.Descriptor, expected digest.Digest) descriptormatcher.Matcher {
+	if name, ok := desc.Annotations[ocispec.AnnotationRefName]; ok {
+		return descriptormatcher.Name(name)
+	}
+
+	if expected == "" {
+		expected = desc.Digest
+	}
+	return descriptormatcher.And(descriptormatcher.Unnamed, descriptormatcher.Digests(expected))
+}
+
+// ReplaceIf atomically replaces the entry identified by the descriptor's reference name if it still
+// has the expected digest, failing with ErrConflict otherwise. An empty expected digest requires
+// that no such entry exists yet.
+func (f *Indexer) ReplaceIf(ctx context.Context, desc ocispec.Descriptor, expectedOld digest.Digest) error {
+	return f.Replace(ctx, desc, identity(desc, expectedOld), WithExpectedDigest(expectedOld))
+}
+
+// Update applies the update function to all entries matching the given matcher.
+// The update function must not modify the annotations map of the descriptor in place, see WithAnnotation.
+func (f *Indexer) Update(ctx context.Context, match descriptormatcher.Matcher, update func(desc ocispec.Descriptor) ocispec.Descriptor) error {
+	return f.modify(ctx, func(index *ocispec.Index) error {
+		for i, manifest := range index.Manifests {
+			if match(manifest) {
+				index.Manifests[i] = update(manifest)
+			}
+		}
+		return nil
+	})
+}
+
+func (f *Indexer) Delete(ctx context.Context, match descriptormatcher.Matcher) error {
+	return f.modify(ctx, func(index *ocispec.Index) error {
+		var remaining []ocispec.Descriptor
+		for _, manifest := range index.Manifests {
+			if !match(manifest) {
+				remaining = append(remaining, manifest)
+			}
+		}
+
+		index.Manifests = remaining
+		return nil
+	})
+}
+
+// LockFilename is the name of the file next to the index of a store (see Filename) that is locked while
+// modifying the index. It holds the pid of the process holding the lock.
+const LockFilename = Filename + ".lock"
+
+// LockFileStaleAfter is the age after which a lock file of the index is considered abandoned, see
+// fsutil.TryLockFile. Index modifications take far less.
+const LockFileStaleAfter = time.Minute
+
+// lockFilePollInterval is how often taking a held lock file of the index is retried.
+const lockFilePollInterval = 10 * time.Millisecond
+
+// ModifyHook is called with the index before and after each modification while the index lock is held,
+// before the modified index is written. It may set annotations of the modified index and adjust its
+// entries. If it fails, the modification is aborted.
+type ModifyHook func(ctx context.Context, old, new *ocispec.Index) error
+
+// DoneHook is called with the index before and after each modification once it was written or failed,
+// while the index lock is still held, so the calls are ordered like the modifications, also across
+// processes. If the modification failed, new is nil and err is the error it failed with. The hook must
+// not modify the index.
+type DoneHook func(ctx context.Context, old, new *ocispec.Index, err error)
+
+// Options are options for creating an Indexer.
+type Options struct {
+	// LockFiles denotes locking the index via lock files instead of flock, for file systems without flock
+	// support, see fsutil.Capabilities.
+	LockFiles bool
+	// ModifyHook is called on each modification of the index, see ModifyHook.
+	ModifyHook ModifyHook
+	// DoneHook is called after each modification of the index, see DoneHook.
+	DoneHook DoneHook
+}
+
+// Option is an option for creating an Indexer.
+type Option func(o *Options)
+
+// WithLockFiles locks the index via lock files instead of flock.
+func WithLockFiles() Option {
+	return func(o *Options) {
+		o.LockFiles = true
+	}
+}
+
+// WithModifyHook calls the hook on each modification of the index, see ModifyHook.
+func WithModifyHook(hook ModifyHook) Option {
+	return func(o *Options) {
+		o.ModifyHook = hook
+	}
+}
+
+// WithDoneHook calls the hook after each modification of the index, see DoneHook.
+func WithDoneHook(hook DoneHook) Option {
+	return func(o *Options) {
+		o.DoneHook = hook
+	}
+}
+
+// lock takes the index file lock, blocking until it is available.
+func (f *Indexer) lock() (func() error, error) {
+	path := f.path + ".lock"
+	if !f.lockFiles {
+		return lockFile(path)
+	}
+	for {
+		unlock, ok, err := fsutil.TryLockFile(path, LockFileStaleAfter)
+		if err != nil || ok {
+			return unlock, err
+		}
+		time.Sleep(lockFilePollInterval)
+	}
+}
+
+func New(path string, opts ...Option) (*Indexer, error) {
+	o := &Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
 		return nil, fmt.Errorf("error creating base directory: %w", err)
 	}
 
 	indexer := &Indexer{
-		path: path,
+		path:       path,
+		lockFiles:  o.LockFiles,
+		modifyHook: o.ModifyHook,
+		doneHook:   o.DoneHook,
+	}
+	if err := indexer.init(); err != nil {
+		return nil, err
+	}
+	return indexer, nil
+}
+
+// init writes an initial empty index if none exists yet.
+func (f *Indexer) init() (retErr error) {
+	unlock, err := f.lock()
+	if err != nil {
+		return fmt.Errorf("error locking index: %w", err)
 	}
-	if _, err := indexer.readIndex(); err != nil {
+	defer func() {
+		if err := unlock(); err != nil && retErr == nil {
+			retErr = fmt.Errorf("error unlocking index: %w", err)
+		}
+	}()
+
+	if _, err := f.readIndex(); err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
-			return nil, fmt.Errorf("error checking for index: %w", err)
+			return fmt.Errorf("error checking for index: %w", err)
 		}
 
-		if err := indexer.writeIndex(&ocispec.Index{
+		if err := f.writeIndex(&ocispec.Index{
 			Versioned: specs.Versioned{
 				SchemaVersion: 2,
 			},
 			Manifests: make([]ocispec.Descriptor, 0),
 		}); err != nil {
-			return nil, fmt.Errorf("error writing initial index: %w", err)
+			return fmt.Errorf("error writing initial index: %w", err)
 		}
 	}
-	return indexer, nil
+	return nil
 }
@@ -0,0 +1,470 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexer_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	. "github.com/onmetal/onmetal-image/oci/indexer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Indexer", func() {
+	var (
+		ctx  context.Context
+		path string
+		idx  *Indexer
+	)
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		path = filepath.Join(GinkgoT().TempDir(), Filename)
+		i, err := New(path)
+		Expect(err).NotTo(HaveOccurred())
+		idx = i
+	})
+
+	descriptor := func(data string) ocispec.Descriptor {
+		return ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromString(data),
+			Size:      int64(len(data)),
+		}
+	}
+
+	digests := func(descs []ocispec.Descriptor) []digest.Digest {
+		res := make([]digest.Digest, 0, len(descs))
+		for _, desc := range descs {
+			res = append(res, desc.Digest)
+		}
+		return res
+	}
+
+	Describe("Add", func() {
+		It("should not add duplicate entries and merge their annotations", func() {
+			desc := descriptor("image")
+			Expect(idx.Add(ctx, desc)).To(Succeed())
+			added, err := idx.Find(ctx, descriptormatcher.Digests(desc.Digest))
+			Expect(err).NotTo(HaveOccurred())
+
+			By("adding the same descriptor again with an additional annotation")
+			Expect(idx.Add(ctx, WithAnnotation(desc, "foo", "bar"))).To(Succeed())
+			Expect(idx.Add(ctx, desc)).To(Succeed())
+
+			descs, err := idx.List(ctx, descriptormatcher.Every)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(descs).To(HaveLen(1))
+			Expect(descs[0].Annotations).To(HaveKeyWithValue("foo", "bar"))
+			Expect(descs[0].Annotations).To(HaveKeyWithValue(AddedAtAnnotation, added.Annotations[AddedAtAnnotation]))
+		})
+
+		It("should add entries with the same digest but different reference names", func() {
+			desc := descriptor("image")
+			Expect(idx.Add(ctx, desc)).To(Succeed())
+			Expect(idx.Add(ctx, WithAnnotation(desc, ocispec.AnnotationRefName, "foo"))).To(Succeed())
+			Expect(idx.Add(ctx, WithAnnotation(desc, ocispec.AnnotationRefName, "bar"))).To(Succeed())
+
+			descs, err := idx.List(ctx, descriptormatcher.Every)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(descs).To(HaveLen(3))
+		})
+
+		It("should fail adding an existing entry in strict mode", func() {
+			desc := descriptor("image")
+			Expect(idx.Add(ctx, desc, WithStrict())).To(Succeed())
+			Expect(idx.Add(ctx, desc, WithStrict())).To(MatchError(ErrAlreadyExists))
+
+			descs, err := idx.List(ctx, descriptormatcher.Every)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(descs).To(HaveLen(1))
+		})
+	})
+
+	Describe("List", func() {
+		var first, second, third ocispec.Descriptor
+
+		BeforeEach(func() {
+			first, second, third = descriptor("first"), descriptor("second"), descriptor("third")
+			for _, desc := range []ocispec.Descriptor{first, second, third} {
+				Expect(idx.Add(ctx, desc)).To(Succeed())
+			}
+		})
+
+		It("should record the added-at annotation", func() {
+			descs, err := idx.List(ctx, descriptormatcher.Every)
+			Expect(err).NotTo(HaveOccurred())
+			for _, desc := range descs {
+				_, ok := AddedAt(desc)
+				Expect(ok).To(BeTrue())
+			}
+		})
+
+		It("should list the most recently added entries first", func() {
+			descs, err := idx.List(ctx, descriptormatcher.Every)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digests(descs)).To(Equal([]digest.Digest{third.Digest, second.Digest, first.Digest}))
+		})
+
+		It("should list in ascending order and limit the entries", func() {
+			descs, err := idx.List(ctx, descriptormatcher.Every, WithAscending(), WithLimit(2))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digests(descs)).To(Equal([]digest.Digest{first.Digest, second.Digest}))
+		})
+
+		It("should move replaced entries to the front", func() {
+			Expect(idx.Replace(ctx, first, descriptormatcher.Digests(first.Digest))).To(Succeed())
+
+			descs, err := idx.List(ctx, descriptormatcher.Every, WithLimit(1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digests(descs)).To(Equal([]digest.Digest{first.Digest}))
+		})
+
+		It("should sort entries without added-at annotation last", func() {
+			By("writing an index containing entries without added-at annotation")
+			legacy1, legacy2 := descriptor("legacy-1"), descriptor("legacy-2")
+			Expect(os.WriteFile(path, []byte(`{"schemaVersion":2,"manifests":[`+
+				`{"mediaType":"`+ocispec.MediaTypeImageManifest+`","digest":"`+legacy1.Digest.String()+`","size":8},`+
+				`{"mediaType":"`+ocispec.MediaTypeImageManifest+`","digest":"`+legacy2.Digest.String()+`","size":8}`+
+				`]}`), 0666)).To(Succeed())
+			Expect(idx.Add(ctx, first)).To(Succeed())
+
+			descs, err := idx.List(ctx, descriptormatcher.Every)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digests(descs)[0]).To(Equal(first.Digest))
+			Expect(digests(descs)[1:]).To(ConsistOf(legacy1.Digest, legacy2.Digest))
+
+			By("listing again and expecting the same order")
+			again, err := idx.List(ctx, descriptormatcher.Every)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digests(again)).To(Equal(digests(descs)))
+		})
+	})
+
+	Describe("ReplaceIf", func() {
+		named := func(desc ocispec.Descriptor, name string) ocispec.Descriptor {
+			return WithAnnotation(desc, ocispec.AnnotationRefName, name)
+		}
+
+		It("should replace the entry if it has the expected digest", func() {
+			old, updated := named(descriptor("old"), "foo:latest"), named(descriptor("new"), "foo:latest")
+			Expect(idx.Add(ctx, old)).To(Succeed())
+
+			Expect(idx.ReplaceIf(ctx, updated, old.Digest)).To(Succeed())
+
+			descs, err := idx.List(ctx, descriptormatcher.Name("foo:latest"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digests(descs)).To(Equal([]digest.Digest{updated.Digest}))
+		})
+
+		It("should fail with a conflict if the entry was changed concurrently", func() {
+			old, concurrent, updated := named(descriptor("old"), "foo:latest"), named(descriptor("concurrent"), "foo:latest"), named(descriptor("new"), "foo:latest")
+			Expect(idx.Add(ctx, old)).To(Succeed())
+			Expect(idx.ReplaceIf(ctx, concurrent, old.Digest)).To(Succeed())
+
+			Expect(idx.ReplaceIf(ctx, updated, old.Digest)).To(MatchError(ErrConflict))
+
+			descs, err := idx.List(ctx, descriptormatcher.Name("foo:latest"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digests(descs)).To(Equal([]digest.Digest{concurrent.Digest}))
+		})
+
+		It("should only create an entry if none exists when expecting no digest", func() {
+			first, second := named(descriptor("first"), "foo:latest"), named(descriptor("second"), "foo:latest")
+			Expect(idx.ReplaceIf(ctx, first, "")).To(Succeed())
+			Expect(idx.ReplaceIf(ctx, second, "")).To(MatchError(ErrConflict))
+		})
+
+		It("should let exactly one of many concurrent replacements win", func() {
+			old := named(descriptor("old"), "foo:latest")
+			Expect(idx.Add(ctx, old)).To(Succeed())
+
+			const n = 10
+			errs := make(chan error, n)
+			for i := 0; i < n; i++ {
+				go func(i int) {
+					defer GinkgoRecover()
+					errs <- idx.ReplaceIf(ctx, named(descriptor(fmt.Sprintf("new-%d", i)), "foo:latest"), old.Digest)
+				}(i)
+			}
+
+			var succeeded int
+			for i := 0; i < n; i++ {
+				if err := <-errs; err == nil {
+					succeeded++
+				} else {
+					Expect(err).To(MatchError(ErrConflict))
+				}
+			}
+			Expect(succeeded).To(Equal(1))
+
+			descs, err := idx.List(ctx, descriptormatcher.Name("foo:latest"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(descs).To(HaveLen(1))
+		})
+	})
+
+	Describe("Replace", func() {
+		It("should carry over annotations not set on the new descriptor", func() {
+			old := WithAnnotation(WithAnnotation(descriptor("old"), ocispec.AnnotationRefName, "foo:latest"), "example.org/owner", "me")
+			old = WithAnnotation(old, PulledAtAnnotation, "2023-01-01T00:00:00Z")
+			Expect(idx.Add(ctx, old)).To(Succeed())
+
+			updated := WithAnnotation(descriptor("new"), "example.org/owner", "you")
+			Expect(idx.Replace(ctx, updated, descriptormatcher.Name("foo:latest"))).To(Succeed())
+
+			desc, err := idx.Find(ctx, descriptormatcher.Digests(updated.Digest))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(desc.Annotations).To(HaveKeyWithValue(ocispec.AnnotationRefName, "foo:latest"))
+			Expect(desc.Annotations).To(HaveKeyWithValue("example.org/owner", "you"))
+			Expect(desc.Annotations).NotTo(HaveKey(PulledAtAnnotation))
+			Expect(desc.Annotations).To(HaveKey(AddedAtAnnotation))
+		})
+
+		It("should not carry over the store annotations describing another image", func() {
+			old := WithAnnotation(WithAnnotation(descriptor("old"), ocispec.AnnotationRefName, "foo:latest"), "example.org/owner", "me")
+			old = WithAnnotation(WithAnnotation(old, PinnedAnnotation, "true"), "image.onmetal.de/use-count", "7")
+			old = WithAnnotation(old, "image.onmetal.de/processed-layers", "{}")
+			Expect(idx.Add(ctx, old)).To(Succeed())
+
+			By("replacing the entry with one of the same digest")
+			Expect(idx.Replace(ctx, descriptor("old"), descriptormatcher.Name("foo:latest"))).To(Succeed())
+			desc, err := idx.Find(ctx, descriptormatcher.Name("foo:latest"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(desc.Annotations).To(HaveKeyWithValue("image.onmetal.de/use-count", "7"))
+			Expect(desc.Annotations).To(HaveKey("image.onmetal.de/processed-layers"))
+
+			By("moving the tag to another digest")
+			updated := descriptor("new")
+			Expect(idx.Replace(ctx, updated, descriptormatcher.Name("foo:latest"))).To(Succeed())
+			desc, err = idx.Find(ctx, descriptormatcher.Name("foo:latest"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(desc.Digest).To(Equal(updated.Digest))
+			Expect(desc.Annotations).To(HaveKeyWithValue(ocispec.AnnotationRefName, "foo:latest"))
+			Expect(desc.Annotations).To(HaveKeyWithValue("example.org/owner", "me"))
+			Expect(desc.Annotations).To(HaveKeyWithValue(PinnedAnnotation, "true"))
+			Expect(desc.Annotations).NotTo(HaveKey("image.onmetal.de/use-count"))
+			Expect(desc.Annotations).NotTo(HaveKey("image.onmetal.de/processed-layers"))
+		})
+
+		It("should not carry over annotations when opting out", func() {
+			old := WithAnnotation(descriptor("old"), ocispec.AnnotationRefName, "foo:latest")
+			Expect(idx.Add(ctx, old)).To(Succeed())
+
+			updated := descriptor("new")
+			Expect(idx.Replace(ctx, updated, descriptormatcher.Name("foo:latest"), WithoutCarryOver())).To(Succeed())
+
+			desc, err := idx.Find(ctx, descriptormatcher.Digests(updated.Digest))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(desc.Annotations).NotTo(HaveKey(ocispec.AnnotationRefName))
+		})
+
+		It("should match the annotations of the full index entries", func() {
+			stable := WithAnnotation(WithAnnotation(descriptor("stable"), ocispec.AnnotationRefName, "foo:v1"), "example.org/channel", "stable")
+			beta := WithAnnotation(WithAnnotation(descriptor("beta"), ocispec.AnnotationRefName, "foo:v2"), "example.org/channel", "beta")
+			Expect(idx.Add(ctx, stable)).To(Succeed())
+			Expect(idx.Add(ctx, beta)).To(Succeed())
+
+			updated := descriptor("new")
+			Expect(idx.Replace(ctx, updated, descriptormatcher.Annotation("example.org/channel", "stable"), WithSingleTarget())).To(Succeed())
+
+			index, err := idx.Index(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digests(index.Manifests)).To(ConsistOf(beta.Digest, updated.Digest))
+			desc, err := idx.Find(ctx, descriptormatcher.Digests(updated.Digest))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(desc.Annotations).To(HaveKeyWithValue(ocispec.AnnotationRefName, "foo:v1"))
+		})
+
+		It("should require exactly one target if asked to", func() {
+			for _, name := range []string{"foo:v1", "foo:v2"} {
+				Expect(idx.Add(ctx, WithAnnotation(WithAnnotation(descriptor(name), ocispec.AnnotationRefName, name), "example.org/channel", "stable"))).To(Succeed())
+			}
+
+			By("matching no entry")
+			err := idx.Replace(ctx, descriptor("new"), descriptormatcher.Annotation("example.org/channel", "beta"), WithSingleTarget())
+			Expect(err).To(MatchError(ErrNoReplaceTarget))
+			Expect(idx.CheckReplaceTarget(ctx, descriptormatcher.Annotation("example.org/channel", "beta"), WithSingleTarget())).To(MatchError(ErrNoReplaceTarget))
+
+			By("matching several entries")
+			err = idx.Replace(ctx, descriptor("new"), descriptormatcher.Annotation("example.org/channel", "stable"), WithSingleTarget())
+			Expect(err).To(MatchError(ErrAmbiguousReplaceTarget))
+			var ambiguousErr *AmbiguousReplaceTargetError
+			Expect(errors.As(err, &ambiguousErr)).To(BeTrue())
+			Expect(ambiguousErr.Candidates).To(HaveLen(2))
+			Expect(err).To(MatchError(And(ContainSubstring("foo:v1"), ContainSubstring("foo:v2"))))
+
+			index, err := idx.Index(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(index.Manifests).To(HaveLen(2))
+		})
+	})
+
+	Describe("Compact", func() {
+		writeIndex := func(descs ...ocispec.Descriptor) {
+			data, err := json.Marshal(ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}, Manifests: descs})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.WriteFile(path, data, 0666)).To(Succeed())
+		}
+
+		It("should merge duplicate entries keeping the earliest added-at time", func() {
+			var (
+				desc  = WithAnnotation(descriptor("image"), ocispec.AnnotationRefName, "foo:latest")
+				older = WithAnnotation(WithAnnotation(desc, AddedAtAnnotation, "2023-01-01T00:00:00Z"), "example.org/owner", "me")
+				newer = WithAnnotation(WithAnnotation(desc, AddedAtAnnotation, "2023-02-01T00:00:00Z"), "example.org/owner", "you")
+				other = WithAnnotation(WithAnnotation(descriptor("image"), ocispec.AnnotationRefName, "foo:stable"), AddedAtAnnotation, "2023-01-15T00:00:00Z")
+			)
+			newer = WithAnnotation(newer, "example.org/team", "a")
+			writeIndex(older, other, newer)
+
+			res, err := idx.Compact(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Merged).To(Equal(1))
+			Expect(res.Entries).To(Equal(2))
+
+			descs, err := idx.List(ctx, descriptormatcher.Name("foo:latest"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(descs).To(HaveLen(1))
+			Expect(descs[0].Annotations).To(HaveKeyWithValue(AddedAtAnnotation, "2023-01-01T00:00:00Z"))
+			Expect(descs[0].Annotations).To(HaveKeyWithValue("example.org/owner", "you"))
+			Expect(descs[0].Annotations).To(HaveKeyWithValue("example.org/team", "a"))
+		})
+
+		It("should drop entries whose manifest no longer exists", func() {
+			kept, missing := descriptor("kept"), descriptor("missing")
+			Expect(idx.Add(ctx, kept)).To(Succeed())
+			Expect(idx.Add(ctx, missing)).To(Succeed())
+
+			res, err := idx.Compact(ctx, WithExists(func(ctx context.Context, dgst digest.Digest) (bool, error) {
+				return dgst != missing.Digest, nil
+			}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digests(res.Dropped)).To(ConsistOf(missing.Digest))
+
+			descs, err := idx.List(ctx, descriptormatcher.Every)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digests(descs)).To(ConsistOf(kept.Digest))
+		})
+	})
+
+	Describe("caching", func() {
+		It("should observe modifications by other indexers of the same file", func() {
+			desc := descriptor("image")
+			_, err := idx.FindDigest(ctx, desc.Digest)
+			Expect(err).To(MatchError(ErrNotFound))
+
+			other, err := New(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(other.Add(ctx, desc)).To(Succeed())
+
+			found, err := idx.FindDigest(ctx, desc.Digest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found.Digest).To(Equal(desc.Digest))
+		})
+	})
+
+	Describe("modify hook", func() {
+		It("should see each modification and annotate or abort it", func() {
+			var calls [][2][]digest.Digest
+			hooked, err := New(path, WithModifyHook(func(ctx context.Context, old, new *ocispec.Index) error {
+				calls = append(calls, [2][]digest.Digest{digests(old.Manifests), digests(new.Manifests)})
+				if len(new.Manifests) > 1 {
+					return fmt.Errorf("too many images")
+				}
+				new.Annotations = map[string]string{"generation": fmt.Sprint(len(calls))}
+				return nil
+			}))
+			Expect(err).NotTo(HaveOccurred())
+
+			desc := descriptor("image")
+			Expect(hooked.Add(ctx, desc)).To(Succeed())
+			Expect(hooked.Add(ctx, descriptor("other"))).To(MatchError("too many images"))
+			Expect(calls).To(Equal([][2][]digest.Digest{
+				{{}, {desc.Digest}},
+				{{desc.Digest}, {desc.Digest, descriptor("other").Digest}},
+			}))
+
+			index, err := idx.Index(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digests(index.Manifests)).To(Equal([]digest.Digest{desc.Digest}))
+			Expect(index.Annotations).To(Equal(map[string]string{"generation": "1"}))
+		})
+	})
+
+	Describe("done hook", func() {
+		It("should see each written and failed modification", func() {
+			type call struct {
+				old, new []digest.Digest
+				err      error
+			}
+			var calls []call
+			hooked, err := New(path, WithDoneHook(func(ctx context.Context, old, new *ocispec.Index, err error) {
+				c := call{old: digests(old.Manifests), err: err}
+				if new != nil {
+					c.new = digests(new.Manifests)
+				}
+				calls = append(calls, c)
+			}))
+			Expect(err).NotTo(HaveOccurred())
+
+			desc := descriptor("image")
+			Expect(hooked.Add(ctx, desc)).To(Succeed())
+			Expect(hooked.Add(ctx, desc, WithStrict())).To(MatchError(ErrAlreadyExists))
+			Expect(calls).To(HaveLen(2))
+			Expect(calls[0]).To(Equal(call{old: []digest.Digest{}, new: []digest.Digest{desc.Digest}}))
+			Expect(calls[1].old).To(Equal([]digest.Digest{desc.Digest}))
+			Expect(calls[1].new).To(BeNil())
+			Expect(calls[1].err).To(MatchError(ErrAlreadyExists))
+		})
+	})
+
+	Describe("lock files", func() {
+		It("should serialize concurrent modifications of indexers locking via lock files", func() {
+			const n = 10
+			errs := make(chan error, n)
+			for i := 0; i < n; i++ {
+				go func(i int) {
+					defer GinkgoRecover()
+					other, err := New(path, WithLockFiles())
+					if err != nil {
+						errs <- err
+						return
+					}
+					errs <- other.Add(ctx, descriptor(fmt.Sprintf("image-%d", i)))
+				}(i)
+			}
+			for i := 0; i < n; i++ {
+				Expect(<-errs).To(Succeed())
+			}
+
+			descs, err := idx.List(ctx, descriptormatcher.Every)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(descs).To(HaveLen(n))
+			Expect(path + ".lock").NotTo(BeAnExistingFile())
+		})
+	})
+})
@@ -0,0 +1,86 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexer
+
+import (
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/onmetal/onmetal-image/utils/fsutil"
+)
+
+// processLocks serialize index modifications within the process on platforms without file locking
+// support. They are keyed by the identity of the lock file, so an index reached via different paths (e.g.
+// a symlinked store) shares one lock.
+var (
+	processLocksMu sync.Mutex
+	processLocks   = make(map[fsutil.FileKey]*sync.Mutex)
+)
+
+// processLock returns the process-local lock of the lock file at path.
+func processLock(path string) (*sync.Mutex, error) {
+	key, err := fsutil.KeyOf(path)
+	if err != nil {
+		return nil, err
+	}
+
+	processLocksMu.Lock()
+	defer processLocksMu.Unlock()
+	mu, ok := processLocks[key]
+	if !ok {
+		mu = &sync.Mutex{}
+		processLocks[key] = mu
+	}
+	return mu, nil
+}
+
+// lockFile acquires an exclusive advisory lock on the file at the given path, creating it if necessary.
+// On platforms without file locking support, it acquires a process-local lock instead.
+// The returned function releases the lock.
+func lockFile(path string) (func() error, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fsutil.FlockSupported {
+		_ = f.Close()
+		mu, err := processLock(path)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		return func() error {
+			mu.Unlock()
+			return nil
+		}, nil
+	}
+
+	if err := fsutil.Flock(f); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	// Record the holder like lock files do (see fsutil.TryLockFile), e.g. for doctor to report it.
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	return func() error {
+		defer func() { _ = f.Close() }()
+		_ = f.Truncate(0)
+		return fsutil.Funlock(f)
+	}, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layercrypt
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// EncryptImage returns a copy of the image with all layers whose media type is in mediaTypes encrypted
+// for the given recipients. All other layers and the config are kept as-is.
+func EncryptImage(ctx context.Context, img ociimage.Image, mediaTypes []string, recipients []*rsa.PublicKey) (ociimage.Image, error) {
+	encrypt := make(map[string]bool, len(mediaTypes))
+	for _, mediaType := range mediaTypes {
+		encrypt[mediaType] = true
+	}
+
+	return mapLayers(ctx, img, func(layer ociimage.Layer) (ociimage.Layer, error) {
+		if !encrypt[layer.Descriptor().MediaType] {
+			return layer, nil
+		}
+		return EncryptLayer(ctx, layer, recipients)
+	})
+}
+
+// DecryptImage returns a copy of the image with all encrypted layers decrypted with the given keys.
+// If the image has no encrypted layers, it is returned as-is.
+// If no key matches an encrypted layer, a *MissingKeyError is returned.
+func DecryptImage(ctx context.Context, img ociimage.Image, keys []*rsa.PrivateKey) (ociimage.Image, error) {
+	encrypted, err := IsImageEncrypted(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypted {
+		return img, nil
+	}
+
+	return mapLayers(ctx, img, func(layer ociimage.Layer) (ociimage.Layer, error) {
+		return DecryptLayer(layer, keys)
+	})
+}
+
+// IsImageEncrypted reports whether any layer of the image is encrypted.
+func IsImageEncrypted(ctx context.Context, img ociimage.Image) (bool, error) {
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error getting manifest: %w", err)
+	}
+	for _, layer := range manifest.Layers {
+		if IsEncrypted(layer) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func mapLayers(ctx context.Context, img ociimage.Image, f func(layer ociimage.Layer) (ociimage.Layer, error)) (ociimage.Image, error) {
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting manifest: %w", err)
+	}
+
+	config, err := img.Config(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting config: %w", err)
+	}
+
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting layers: %w", err)
+	}
+
+	mapped := make([]ociimage.Layer, 0, len(layers))
+	for _, layer := range layers {
+		layer, err := f(layer)
+		if err != nil {
+			return nil, err
+		}
+		mapped = append(mapped, layer)
+	}
+
+	return imageutil.NewBuilder(config).
+		ArtifactType(manifest.ArtifactType).
+		Layers(mapped...).
+		Annotations(manifest.Annotations).
+		Complete(func(desc *ocispec.Descriptor) {
+			desc.Platform = img.Descriptor().Platform
+		})
+}
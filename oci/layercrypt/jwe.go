@@ -0,0 +1,112 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layercrypt
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/go-jose/go-jose/v3"
+)
+
+var errNoMatchingKey = errors.New("no matching key")
+
+// wrapJWE encrypts the payload with A256GCM under a random content encryption key which is wrapped
+// with RSA-OAEP for each recipient, like the JWE key wrapper of ocicrypt does. Each recipient carries
+// its KeyID, which lets DecryptLayer report the recipients if no key matches.
+func wrapJWE(payload []byte, recipients []*rsa.PublicKey) ([]byte, error) {
+	joseRecipients := make([]jose.Recipient, 0, len(recipients))
+	for _, pub := range recipients {
+		kid, err := KeyID(pub)
+		if err != nil {
+			return nil, err
+		}
+		joseRecipients = append(joseRecipients, jose.Recipient{Algorithm: jose.RSA_OAEP, Key: pub, KeyID: kid})
+	}
+
+	encrypter, err := jose.NewMultiEncrypter(jose.A256GCM, joseRecipients, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating jwe encrypter: %w", err)
+	}
+	jwe, err := encrypter.Encrypt(payload)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(jwe.FullSerialize()), nil
+}
+
+// unwrapJWE decrypts the payload of the JWE with the first matching key. If no key matches, it returns
+// errNoMatchingKey and the ids of the recipients of the JWE.
+func unwrapJWE(data []byte, keys []*rsa.PrivateKey) ([]byte, []string, error) {
+	jwe, err := jose.ParseEncrypted(string(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing jwe: %w", err)
+	}
+	for _, key := range keys {
+		if _, _, payload, err := jwe.DecryptMulti(key); err == nil {
+			return payload, nil, nil
+		}
+	}
+	return nil, recipientIDs(data), errNoMatchingKey
+}
+
+// recipientIDs returns the key ids of the recipients of the JSON serialized JWE, "unknown" for recipients
+// without key id. go-jose does not expose the per-recipient headers, so they are decoded here.
+func recipientIDs(data []byte) []string {
+	type header struct {
+		Kid string `json:"kid"`
+	}
+	var jwe struct {
+		Protected   string  `json:"protected"`
+		Unprotected *header `json:"unprotected"`
+		Header      *header `json:"header"`
+		Recipients  []struct {
+			Header *header `json:"header"`
+		} `json:"recipients"`
+	}
+	if err := json.Unmarshal(data, &jwe); err != nil {
+		return []string{"unknown"}
+	}
+
+	var shared header
+	if protected, err := base64.RawURLEncoding.DecodeString(jwe.Protected); err == nil {
+		_ = json.Unmarshal(protected, &shared)
+	}
+	if jwe.Unprotected != nil && jwe.Unprotected.Kid != "" {
+		shared.Kid = jwe.Unprotected.Kid
+	}
+	// The flattened syntax has a single recipient with its header at the top level.
+	if len(jwe.Recipients) == 0 {
+		jwe.Recipients = append(jwe.Recipients, struct {
+			Header *header `json:"header"`
+		}{Header: jwe.Header})
+	}
+
+	ids := make([]string, 0, len(jwe.Recipients))
+	for _, r := range jwe.Recipients {
+		kid := shared.Kid
+		if r.Header != nil && r.Header.Kid != "" {
+			kid = r.Header.Kid
+		}
+		if kid == "" {
+			kid = "unknown"
+		}
+		ids = append(ids, kid)
+	}
+	return ids
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layercrypt
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// KeyID returns the id of the given public key, the digest of its PKIX encoding.
+func KeyID(pub *rsa.PublicKey) (string, error) {
+	data, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling public key: %w", err)
+	}
+	return digest.FromBytes(data).String(), nil
+}
+
+// ReadPublicKeyFile reads a PEM encoded PKIX or PKCS #1 RSA public key from the given file.
+func ReadPublicKeyFile(filename string) (*rsa.PublicKey, error) {
+	block, err := readPEMFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing public key %s: %w", filename, err)
+		}
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key %s is no rsa key but %T", filename, key)
+		}
+		return pub, nil
+	case "RSA PUBLIC KEY":
+		pub, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing public key %s: %w", filename, err)
+		}
+		return pub, nil
+	default:
+		return nil, fmt.Errorf("unsupported pem block type %q in %s", block.Type, filename)
+	}
+}
+
+// ReadPrivateKeyFile reads a PEM encoded PKCS #8 or PKCS #1 RSA private key from the given file.
+func ReadPrivateKeyFile(filename string) (*rsa.PrivateKey, error) {
+	block, err := readPEMFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing private key %s: %w", filename, err)
+		}
+		priv, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key %s is no rsa key but %T", filename, key)
+		}
+		return priv, nil
+	case "RSA PRIVATE KEY":
+		priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing private key %s: %w", filename, err)
+		}
+		return priv, nil
+	default:
+		return nil, fmt.Errorf("unsupported pem block type %q in %s", block.Type, filename)
+	}
+}
+
+func readPEMFile(filename string) (*pem.Block, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no pem data found in %s", filename)
+	}
+	return block, nil
+}
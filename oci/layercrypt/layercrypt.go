@@ -0,0 +1,326 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package layercrypt encrypts and decrypts image layers in the format of ocicrypt
+// (https://github.com/containers/ocicrypt): Layers are encrypted with AES-256-CTR and authenticated with
+// HMAC-SHA256 by the block cipher of ocicrypt, their media type gets the +encrypted suffix and the
+// symmetric key is wrapped for each recipient with JWE (RSA-OAEP, A256GCM) in the layer annotations.
+package layercrypt
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/containers/ocicrypt/blockcipher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// MediaTypeSuffix is the suffix appended to the media type of encrypted layers.
+	MediaTypeSuffix = "+encrypted"
+
+	// KeysJWEAnnotation is the layer annotation holding the JWE-wrapped layer keys.
+	KeysJWEAnnotation = "org.opencontainers.image.enc.keys.jwe"
+	// PubOptsAnnotation is the layer annotation holding the public encryption options, e.g. the HMAC.
+	PubOptsAnnotation = "org.opencontainers.image.enc.pubopts"
+)
+
+// ErrDecryptionKeyRequired is returned if no given key can decrypt an encrypted layer.
+var ErrDecryptionKeyRequired = errors.New("decryption key required")
+
+// ErrIntegrity is returned if the content of an encrypted layer does not match its HMAC.
+var ErrIntegrity = errors.New("encrypted layer integrity check failed")
+
+// MissingKeyError is returned if no given key can decrypt an encrypted layer.
+type MissingKeyError struct {
+	// Digest is the digest of the encrypted layer.
+	Digest digest.Digest
+	// Recipients are the key ids of the recipients the layer key is wrapped for (see KeyID).
+	// Recipients without key id, e.g. of layers encrypted by other tools, are listed as "unknown".
+	Recipients []string
+}
+
+func (e *MissingKeyError) Error() string {
+	return fmt.Sprintf("%v for layer %s, it can be decrypted by the keys of recipients [%s]", ErrDecryptionKeyRequired, e.Digest, strings.Join(e.Recipients, ", "))
+}
+
+func (e *MissingKeyError) Is(target error) bool {
+	return target == ErrDecryptionKeyRequired
+}
+
+// IsEncrypted reports whether the descriptor describes an encrypted layer.
+func IsEncrypted(desc ocispec.Descriptor) bool {
+	return strings.HasSuffix(desc.MediaType, MediaTypeSuffix)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type encryptedLayer struct {
+	src  ociimage.Layer
+	desc ocispec.Descriptor
+	opts blockcipher.LayerBlockCipherOptions
+}
+
+func (l *encryptedLayer) Descriptor() ocispec.Descriptor {
+	return l.desc
+}
+
+func (l *encryptedLayer) Content(ctx context.Context) (io.ReadCloser, error) {
+	rc, _, err := l.encrypt(ctx)
+	return rc, err
+}
+
+// encrypt returns the encrypted content of the layer, using the key and nonce of l.opts.
+func (l *encryptedLayer) encrypt(ctx context.Context) (io.ReadCloser, blockcipher.Finalizer, error) {
+	rc, err := l.src.Content(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bc, err := blockcipher.NewAESCTRLayerBlockCipher(256)
+	if err != nil {
+		_ = rc.Close()
+		return nil, nil, err
+	}
+	r, finalize, err := bc.Encrypt(rc, l.opts)
+	if err != nil {
+		_ = rc.Close()
+		return nil, nil, fmt.Errorf("error setting up encryption: %w", err)
+	}
+	return readCloser{Reader: r, Closer: rc}, finalize, nil
+}
+
+// EncryptLayer returns the layer encrypted for the given recipients.
+// The content is encrypted twice in a streaming fashion with the same key and nonce: once to compute the
+// digest and HMAC of the encrypted content upfront and once when the content of the returned layer is read.
+func EncryptLayer(ctx context.Context, layer ociimage.Layer, recipients []*rsa.PublicKey) (ociimage.Layer, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("at least one recipient is required")
+	}
+	src := layer.Descriptor()
+	if IsEncrypted(src) {
+		return nil, fmt.Errorf("layer %s is already encrypted", src.Digest)
+	}
+
+	bc, err := blockcipher.NewAESCTRLayerBlockCipher(256)
+	if err != nil {
+		return nil, err
+	}
+	key, err := bc.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("error generating key: %w", err)
+	}
+
+	encrypted := &encryptedLayer{
+		src:  layer,
+		opts: blockcipher.LayerBlockCipherOptions{Private: blockcipher.PrivateLayerBlockCipherOptions{SymmetricKey: key}},
+	}
+	rc, finalize, err := encrypted.encrypt(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting layer content: %w", err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	encryptedDesc, err := ioutils.CopyVerify(ctx, io.Discard, rc, ocispec.Descriptor{})
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting layer: %w", err)
+	}
+	opts, err := finalize()
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting layer: %w", err)
+	}
+	opts.Public.CipherType = blockcipher.AES256CTR
+	opts.Private.Digest = src.Digest
+	// Later reads of the content must generate the same ciphertext, so reuse the generated nonce.
+	encrypted.opts.Private.CipherOptions = opts.Private.CipherOptions
+
+	pubOpts, err := json.Marshal(opts.Public)
+	if err != nil {
+		return nil, err
+	}
+	privOpts, err := json.Marshal(opts.Private)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := wrapJWE(privOpts, recipients)
+	if err != nil {
+		return nil, fmt.Errorf("error wrapping layer key: %w", err)
+	}
+
+	annotations := make(map[string]string, len(src.Annotations)+2)
+	for k, v := range src.Annotations {
+		annotations[k] = v
+	}
+	annotations[KeysJWEAnnotation] = base64.StdEncoding.EncodeToString(wrapped)
+	annotations[PubOptsAnnotation] = base64.StdEncoding.EncodeToString(pubOpts)
+
+	encrypted.desc = ocispec.Descriptor{
+		MediaType:   src.MediaType + MediaTypeSuffix,
+		Digest:      encryptedDesc.Digest,
+		Size:        encryptedDesc.Size,
+		Annotations: annotations,
+	}
+	return encrypted, nil
+}
+
+type decryptedLayer struct {
+	src  ociimage.Layer
+	desc ocispec.Descriptor
+	opts blockcipher.LayerBlockCipherOptions
+}
+
+func (l *decryptedLayer) Descriptor() ocispec.Descriptor {
+	return l.desc
+}
+
+func (l *decryptedLayer) Content(ctx context.Context) (io.ReadCloser, error) {
+	rc, err := l.src.Content(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lbch, err := blockcipher.NewLayerBlockCipherHandler()
+	if err != nil {
+		_ = rc.Close()
+		return nil, err
+	}
+	src := &errorRecordingReader{r: rc}
+	r, _, err := lbch.Decrypt(src, l.opts)
+	if err != nil {
+		_ = rc.Close()
+		return nil, fmt.Errorf("error setting up decryption: %w", err)
+	}
+	return readCloser{Reader: &integrityReader{r: r, src: src}, Closer: rc}, nil
+}
+
+// errorRecordingReader records the last error reading the encrypted content.
+type errorRecordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errorRecordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// integrityReader reports errors of the decrypting reader that do not stem from reading the encrypted
+// content, i.e. HMAC mismatches, as ErrIntegrity.
+type integrityReader struct {
+	r   io.Reader
+	src *errorRecordingReader
+}
+
+func (r *integrityReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) && (r.src.err == nil || errors.Is(r.src.err, io.EOF)) {
+		return n, fmt.Errorf("%w: %v", ErrIntegrity, err)
+	}
+	return n, err
+}
+
+// DecryptLayer returns the decrypted layer if it is encrypted and one of the given keys can unwrap its key.
+// The returned layer has the plaintext digest recorded on encryption, which is verified when its content is
+// committed to a store. Unencrypted layers are returned as-is.
+// If no key matches, a *MissingKeyError is returned.
+func DecryptLayer(layer ociimage.Layer, keys []*rsa.PrivateKey) (ociimage.Layer, error) {
+	desc := layer.Descriptor()
+	if !IsEncrypted(desc) {
+		return layer, nil
+	}
+
+	wrappedKeys := desc.Annotations[KeysJWEAnnotation]
+	if wrappedKeys == "" {
+		return nil, fmt.Errorf("layer %s has no %s annotation", desc.Digest, KeysJWEAnnotation)
+	}
+	pubOptsData, err := base64.StdEncoding.DecodeString(desc.Annotations[PubOptsAnnotation])
+	if err != nil {
+		return nil, fmt.Errorf("layer %s has no valid %s annotation", desc.Digest, PubOptsAnnotation)
+	}
+	opts := blockcipher.LayerBlockCipherOptions{}
+	if err := json.Unmarshal(pubOptsData, &opts.Public); err != nil {
+		return nil, fmt.Errorf("error decoding public options of layer %s: %w", desc.Digest, err)
+	}
+
+	// Like ocicrypt, multiple wrapped keys are base64 encoded separately and joined by comma.
+	var (
+		privOptsData []byte
+		recipients   []string
+	)
+	for _, part := range strings.Split(wrappedKeys, ",") {
+		wrapped, err := base64.StdEncoding.DecodeString(part)
+		if err != nil {
+			return nil, fmt.Errorf("layer %s has an invalid %s annotation: %w", desc.Digest, KeysJWEAnnotation, err)
+		}
+		var ids []string
+		privOptsData, ids, err = unwrapJWE(wrapped, keys)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errNoMatchingKey) {
+			return nil, fmt.Errorf("error unwrapping keys of layer %s: %w", desc.Digest, err)
+		}
+		recipients = append(recipients, ids...)
+	}
+	if privOptsData == nil {
+		return nil, &MissingKeyError{Digest: desc.Digest, Recipients: recipients}
+	}
+
+	if err := json.Unmarshal(privOptsData, &opts.Private); err != nil {
+		return nil, fmt.Errorf("error decoding private options of layer %s: %w", desc.Digest, err)
+	}
+	if opts.Public.CipherType != blockcipher.AES256CTR {
+		return nil, fmt.Errorf("layer %s uses unsupported cipher %q", desc.Digest, opts.Public.CipherType)
+	}
+	if err := opts.Private.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("layer %s has an invalid plaintext digest: %w", desc.Digest, err)
+	}
+
+	annotations := make(map[string]string, len(desc.Annotations))
+	for k, v := range desc.Annotations {
+		if strings.HasPrefix(k, "org.opencontainers.image.enc.") {
+			continue
+		}
+		annotations[k] = v
+	}
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+
+	return &decryptedLayer{
+		src: layer,
+		desc: ocispec.Descriptor{
+			MediaType:   strings.TrimSuffix(desc.MediaType, MediaTypeSuffix),
+			Digest:      opts.Private.Digest,
+			Size:        desc.Size,
+			Annotations: annotations,
+		},
+		opts: opts,
+	}, nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layercrypt_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+
+	"github.com/containers/ocicrypt"
+	ocicryptconfig "github.com/containers/ocicrypt/config"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/layercrypt"
+	"github.com/onmetal/onmetal-image/oci/local"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type tamperedLayer struct {
+	ociimage.Layer
+}
+
+func (l tamperedLayer) Content(ctx context.Context) (io.ReadCloser, error) {
+	data, err := imageutil.ReadLayerContent(ctx, l.Layer)
+	if err != nil {
+		return nil, err
+	}
+	data[0] ^= 0xff
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+var _ = Describe("Layercrypt", func() {
+	var (
+		ctx        = context.Background()
+		key, other *rsa.PrivateKey
+		rootFS     = bytes.Repeat([]byte("rootfs"), 50000)
+	)
+
+	BeforeEach(func() {
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+		other, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	newImage := func() ociimage.Image {
+		img, err := imageutil.NewJSONConfigBuilder(&onmetalimage.Config{}, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).
+			BytesLayer(rootFS, imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType)).
+			BytesLayer([]byte("kernel"), imageutil.WithMediaType(onmetalimage.KernelLayerMediaType)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	// roundTrip stores the image and returns it as read back from the store, like a registry would serve it.
+	roundTrip := func(img ociimage.Image) ociimage.Image {
+		s, err := local.NewStore(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ocicontent.WriteImageToIngester(ctx, s, img)).To(Succeed())
+		return ocicontent.Image(s, img.Descriptor())
+	}
+
+	It("should encrypt the selected layers and decrypt them to their original content", func() {
+		img := newImage()
+		original, err := img.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		encrypted, err := EncryptImage(ctx, img, []string{onmetalimage.RootFSLayerMediaType}, []*rsa.PublicKey{&other.PublicKey, &key.PublicKey})
+		Expect(err).NotTo(HaveOccurred())
+		encrypted = roundTrip(encrypted)
+
+		manifest, err := encrypted.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest.Layers[0].MediaType).To(Equal(onmetalimage.RootFSLayerMediaType + MediaTypeSuffix))
+		Expect(manifest.Layers[0].Digest).NotTo(Equal(original.Layers[0].Digest))
+		Expect(manifest.Layers[0].Annotations).To(HaveKey(KeysJWEAnnotation))
+		Expect(manifest.Layers[0].Annotations).To(HaveKey(PubOptsAnnotation))
+		By("leaving unencrypted layers untouched")
+		Expect(manifest.Layers[1]).To(Equal(original.Layers[1]))
+
+		layers, err := encrypted.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		ciphertext, err := imageutil.ReadLayerContent(ctx, layers[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Contains(ciphertext, []byte("rootfsrootfs"))).To(BeFalse())
+
+		decrypted, err := DecryptImage(ctx, encrypted, []*rsa.PrivateKey{key})
+		Expect(err).NotTo(HaveOccurred())
+		decrypted = roundTrip(decrypted)
+
+		manifest, err = decrypted.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest.Layers).To(Equal(original.Layers))
+		Expect(decrypted.Descriptor().Digest).To(Equal(img.Descriptor().Digest))
+
+		layers, err = decrypted.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imageutil.ReadLayerContent(ctx, layers[0])).To(Equal(rootFS))
+	})
+
+	It("should return images without encrypted layers as-is", func() {
+		img := newImage()
+		decrypted, err := DecryptImage(ctx, img, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decrypted).To(BeIdenticalTo(img))
+	})
+
+	It("should report the recipients if no key matches", func() {
+		encrypted, err := EncryptImage(ctx, newImage(), []string{onmetalimage.RootFSLayerMediaType}, []*rsa.PublicKey{&key.PublicKey})
+		Expect(err).NotTo(HaveOccurred())
+
+		kid, err := KeyID(&key.PublicKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, keys := range [][]*rsa.PrivateKey{nil, {other}} {
+			_, err = DecryptImage(ctx, encrypted, keys)
+			Expect(err).To(MatchError(ErrDecryptionKeyRequired))
+			var missingKeyErr *MissingKeyError
+			Expect(errors.As(err, &missingKeyErr)).To(BeTrue())
+			Expect(missingKeyErr.Recipients).To(ConsistOf(kid))
+		}
+	})
+
+	It("should fail if the encrypted content was tampered with", func() {
+		img := newImage()
+		layers, err := img.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		encrypted, err := EncryptLayer(ctx, layers[0], []*rsa.PublicKey{&key.PublicKey})
+		Expect(err).NotTo(HaveOccurred())
+
+		decrypted, err := DecryptLayer(tamperedLayer{encrypted}, []*rsa.PrivateKey{key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decrypted.Descriptor().Digest).To(Equal(digest.FromBytes(rootFS)))
+		Expect(decrypted.Descriptor().MediaType).To(Equal(onmetalimage.RootFSLayerMediaType))
+
+		_, err = imageutil.ReadLayerContent(ctx, decrypted)
+		Expect(err).To(MatchError(ErrIntegrity))
+	})
+
+	Context("interoperability with ocicrypt", func() {
+		It("should encrypt layers ocicrypt can decrypt", func() {
+			layer := imageutil.BytesLayer(rootFS, imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType))
+			encrypted, err := EncryptLayer(ctx, layer, []*rsa.PublicKey{&other.PublicKey, &key.PublicKey})
+			Expect(err).NotTo(HaveOccurred())
+			ciphertext, err := imageutil.ReadLayerContent(ctx, encrypted)
+			Expect(err).NotTo(HaveOccurred())
+
+			cc, err := ocicryptconfig.DecryptWithPrivKeys([][]byte{pem.EncodeToMemory(&pem.Block{
+				Type:  "RSA PRIVATE KEY",
+				Bytes: x509.MarshalPKCS1PrivateKey(key),
+			})}, [][]byte{nil})
+			Expect(err).NotTo(HaveOccurred())
+			r, _, err := ocicrypt.DecryptLayer(cc.DecryptConfig, bytes.NewReader(ciphertext), encrypted.Descriptor(), false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(io.ReadAll(r)).To(Equal(rootFS))
+		})
+
+		It("should decrypt layers encrypted by ocicrypt", func() {
+			pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+			Expect(err).NotTo(HaveOccurred())
+			cc, err := ocicryptconfig.EncryptWithJwe([][]byte{pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})})
+			Expect(err).NotTo(HaveOccurred())
+
+			plain := ocispec.Descriptor{MediaType: onmetalimage.RootFSLayerMediaType, Digest: digest.FromBytes(rootFS), Size: int64(len(rootFS))}
+			r, finalize, err := ocicrypt.EncryptLayer(cc.EncryptConfig, bytes.NewReader(rootFS), plain)
+			Expect(err).NotTo(HaveOccurred())
+			ciphertext, err := io.ReadAll(r)
+			Expect(err).NotTo(HaveOccurred())
+			annotations, err := finalize()
+			Expect(err).NotTo(HaveOccurred())
+			layer := imageutil.BytesLayer(ciphertext,
+				imageutil.WithMediaType(plain.MediaType+MediaTypeSuffix),
+				imageutil.WithAnnotations(annotations),
+			)
+
+			decrypted, err := DecryptLayer(layer, []*rsa.PrivateKey{other, key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decrypted.Descriptor().Digest).To(Equal(plain.Digest))
+			Expect(decrypted.Descriptor().MediaType).To(Equal(plain.MediaType))
+			Expect(imageutil.ReadLayerContent(ctx, decrypted)).To(Equal(rootFS))
+
+			By("reporting recipients without key id as unknown")
+			_, err = DecryptLayer(layer, []*rsa.PrivateKey{other})
+			var missingKeyErr *MissingKeyError
+			Expect(errors.As(err, &missingKeyErr)).To(BeTrue())
+			Expect(missingKeyErr.Recipients).To(ConsistOf("unknown"))
+		})
+	})
+
+	It("should not encrypt layers twice", func() {
+		layer := imageutil.BytesLayer([]byte("foo"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer+MediaTypeSuffix))
+		_, err := EncryptLayer(ctx, layer, []*rsa.PublicKey{&key.PublicKey})
+		Expect(err).To(HaveOccurred())
+	})
+})
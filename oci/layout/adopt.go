@@ -0,0 +1,198 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/onmetal/onmetal-image/mediatypes"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/oci/migration"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// AdoptedAtAnnotation is the index annotation recording when an OCI layout created by another tool, e.g.
+// skopeo or buildah, was adopted as a store, see Layout.Adoption.
+const AdoptedAtAnnotation = "image.onmetal.de/adopted-at"
+
+// RolesAnnotation is the index entry annotation listing the roles of the layers of an adopted image,
+// comma-separated, as inferred from their media types. Layers of unknown media types are left out.
+const RolesAnnotation = "image.onmetal.de/roles"
+
+// onmetalAnnotationPrefix is the prefix of the annotations the store records on the index and its entries.
+const onmetalAnnotationPrefix = indexer.StoreAnnotationPrefix
+
+// storeFiles are the files and directories the store keeps in the layout directory besides the OCI
+// layout itself.
+var storeFiles = []string{
+	migration.VersionFilename, RefCountsFileName, StorageFileName, VerifiedBlobsFileName, TransferStatsFileName, BuildCacheFileName,
+	LeasesDir, "tmp", "ingest-locks", "ingest-encrypted",
+}
+
+// UnclassifiedEntry is an index entry of an adopted layout that could not be classified as an onmetal image.
+type UnclassifiedEntry struct {
+	Name      string        `json:"name,omitempty"`
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+	Reason    string        `json:"reason"`
+}
+
+func (e UnclassifiedEntry) String() string {
+	name := e.Digest.String()
+	if e.Name != "" {
+		name = fmt.Sprintf("%s (%s)", e.Name, e.Digest)
+	}
+	return fmt.Sprintf("%s: %s", name, e.Reason)
+}
+
+// Adoption is the result of adopting an OCI layout created by another tool when opening it.
+type Adoption struct {
+	// Path is the path of the layout.
+	Path string `json:"path"`
+	// Entries is the number of index entries adopted.
+	Entries int `json:"entries"`
+	// Unclassified are the index entries that are no onmetal images, e.g. container images.
+	Unclassified []UnclassifiedEntry `json:"unclassified,omitempty"`
+}
+
+// isForeign reports whether the directory holds an OCI layout created by another tool: an index without
+// any of the annotations or files the store records. Stores created before format versions were recorded
+// have some of them and are migrated instead, see migration.Migrate.
+func isForeign(path string) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(path, indexer.Filename))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, name := range storeFiles {
+		if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+			return false, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return false, err
+		}
+	}
+
+	index := &ocispec.Index{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return false, fmt.Errorf("error decoding index: %w", err)
+	}
+	hasOnmetalAnnotation := func(annotations map[string]string) bool {
+		for key := range annotations {
+			if strings.HasPrefix(key, onmetalAnnotationPrefix) {
+				return true
+			}
+		}
+		return false
+	}
+	if hasOnmetalAnnotation(index.Annotations) {
+		return false, nil
+	}
+	for _, entry := range index.Manifests {
+		if hasOnmetalAnnotation(entry.Annotations) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// adopt adds the annotations the store relies on to the index entries of a foreign layout, as far as
+// they can be inferred, and records the adoption along with the current format version, so the layout
+// is a regular store afterwards. ref.name annotations are kept as they are.
+func (l *Layout) adopt(ctx context.Context) (*Adoption, error) {
+	res := &Adoption{Path: l.path}
+	now := time.Now().UTC()
+	if err := l.indexer.Modify(ctx, func(index *ocispec.Index) error {
+		res.Entries = len(index.Manifests)
+		for i, entry := range index.Manifests {
+			entry, reason := l.adoptEntry(ctx, entry, now)
+			index.Manifests[i] = entry
+			if reason != "" {
+				res.Unclassified = append(res.Unclassified, UnclassifiedEntry{
+					Name:      entry.Annotations[ocispec.AnnotationRefName],
+					Digest:    entry.Digest,
+					MediaType: entry.MediaType,
+					Reason:    reason,
+				})
+			}
+		}
+		if index.Annotations == nil {
+			index.Annotations = make(map[string]string)
+		}
+		index.Annotations[AdoptedAtAnnotation] = now.Format(time.RFC3339)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := migration.WriteVersion(l.path, migration.CurrentVersion); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// adoptEntry returns the index entry with the inferred annotations: when it was added, when its image was
+// created (from the config) and the roles of its layers (from their media types). The reason is set if
+// the entry is no onmetal image.
+func (l *Layout) adoptEntry(ctx context.Context, entry ocispec.Descriptor, now time.Time) (ocispec.Descriptor, string) {
+	if _, ok := entry.Annotations[indexer.AddedAtAnnotation]; !ok {
+		entry = indexer.WithAnnotation(entry, indexer.AddedAtAnnotation, now.Format(time.RFC3339Nano))
+	}
+	switch entry.MediaType {
+	case ocispec.MediaTypeImageIndex:
+		return entry, ""
+	case ocispec.MediaTypeImageManifest:
+	default:
+		return entry, fmt.Sprintf("unsupported media type %s", entry.MediaType)
+	}
+
+	img := ocicontent.Image(l.store, entry)
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return entry, fmt.Sprintf("unreadable manifest: %v", err)
+	}
+	if _, ok := entry.Annotations[ocispec.AnnotationCreated]; !ok {
+		if created, ok, err := imageutil.ConfigCreated(ctx, img); err == nil && ok {
+			entry = indexer.WithAnnotation(entry, ocispec.AnnotationCreated, created.UTC().Format(time.RFC3339))
+		}
+	}
+
+	var roles []string
+	for _, layer := range manifest.Layers {
+		if info, ok := mediatypes.Lookup(layer.MediaType); ok {
+			roles = append(roles, info.Role)
+		}
+	}
+	if len(roles) == 0 {
+		return entry, "no layers of onmetal media types"
+	}
+	return indexer.WithAnnotation(entry, RolesAnnotation, strings.Join(roles, ",")), ""
+}
+
+// Adoption returns the result of adopting the layout if it was created by another tool and adopted when
+// opening it, nil otherwise.
+func (l *Layout) Adoption() *Adoption {
+	return l.adoption
+}
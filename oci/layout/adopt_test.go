@@ -0,0 +1,104 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/migration"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Adoption", func() {
+	var ctx context.Context
+
+	BeforeEach(func() {
+		ctx = context.Background()
+	})
+
+	It("should adopt a layout created by another tool, reporting entries that are no onmetal images", func() {
+		dir := GinkgoT().TempDir()
+		bootable, err := fixtures.Bootable().Build()
+		Expect(err).NotTo(HaveOccurred())
+		created := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+		container, err := fixtures.ContainerImage("container", created)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fixtures.WriteForeignLayout(ctx, dir,
+			fixtures.ForeignEntry{Name: "v1", Image: bootable},
+			fixtures.ForeignEntry{Name: "latest", Image: container},
+		)).To(Succeed())
+
+		layout, err := New(dir)
+		Expect(err).NotTo(HaveOccurred())
+		adoption := layout.Adoption()
+		Expect(adoption).NotTo(BeNil())
+		Expect(adoption.Entries).To(Equal(2))
+		Expect(adoption.Unclassified).To(HaveLen(1))
+		Expect(adoption.Unclassified[0].Name).To(Equal("latest"))
+		Expect(adoption.Unclassified[0].Digest).To(Equal(container.Descriptor().Digest))
+
+		By("inferring the annotations of the entries")
+		entry, err := layout.Indexer().Find(ctx, descriptormatcher.Digests(bootable.Descriptor().Digest))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.Annotations).To(HaveKeyWithValue(ocispec.AnnotationRefName, "v1"))
+		Expect(entry.Annotations).To(HaveKeyWithValue(RolesAnnotation, "kernel,initramfs,rootfs"))
+		Expect(entry.Annotations).To(HaveKey(indexer.AddedAtAnnotation))
+		entry, err = layout.Indexer().Find(ctx, descriptormatcher.Digests(container.Descriptor().Digest))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.Annotations).To(HaveKeyWithValue(ocispec.AnnotationCreated, created.Format(time.RFC3339)))
+
+		By("recording the adoption")
+		index, err := layout.Indexer().Index(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(index.Annotations).To(HaveKey(AdoptedAtAnnotation))
+		version, ok, err := migration.ReadVersion(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(version).To(Equal(migration.CurrentVersion))
+
+		By("reading and modifying it as a regular store")
+		_, err = layout.Image(ctx, entry)
+		Expect(err).NotTo(HaveOccurred())
+		other, err := fixtures.RootFS("v1").Build()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fixtures.AddToLayout(ctx, layout, "registry.example.com/other:v1", other)).To(Succeed())
+
+		layout, err = New(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layout.Adoption()).To(BeNil())
+	})
+
+	It("should not adopt stores", func() {
+		dir := GinkgoT().TempDir()
+		layout, err := New(dir)
+		Expect(err).NotTo(HaveOccurred())
+		img, err := fixtures.RootFS("v1").Build()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fixtures.AddToLayout(ctx, layout, "registry.example.com/image:v1", img)).To(Succeed())
+		Expect(os.Remove(filepath.Join(dir, migration.VersionFilename))).To(Succeed())
+
+		_, err = New(dir)
+		Expect(err).To(MatchError(migration.ErrMigrationRequired))
+	})
+})
@@ -0,0 +1,320 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// AuditFileName is the name of the file in the layout directory the audit log is appended to, see
+// AuditEntry. Rotated files get the suffixes .1 (most recent) to .AuditRotations.
+const AuditFileName = "audit.jsonl"
+
+const (
+	// AuditMaxSize is the size in bytes after which the audit log is rotated.
+	AuditMaxSize = 16 << 20
+	// AuditRotations is the number of rotated audit log files kept.
+	AuditRotations = 3
+)
+
+// AuditOperation is the operation an AuditEntry records.
+type AuditOperation string
+
+const (
+	AuditAdd         AuditOperation = "add"
+	AuditReplace     AuditOperation = "replace"
+	AuditTag         AuditOperation = "tag"
+	AuditUntag       AuditOperation = "untag"
+	AuditDelete      AuditOperation = "delete"
+	AuditPrune       AuditOperation = "prune"
+	AuditEvict       AuditOperation = "evict"
+	AuditPin         AuditOperation = "pin"
+	AuditUnpin       AuditOperation = "unpin"
+	AuditAnnotate    AuditOperation = "annotate"
+	AuditTransaction AuditOperation = "transaction"
+)
+
+// AuditOutcome is the outcome of an audited operation.
+type AuditOutcome string
+
+const (
+	AuditSucceeded AuditOutcome = "succeeded"
+	AuditFailed    AuditOutcome = "failed"
+)
+
+// AuditEntry is a line of the audit log, recording a mutating operation on the index of the layout.
+// Entries are appended while the index lock is held, so they are ordered like the modifications of the
+// index, also across processes.
+type AuditEntry struct {
+	// Time is when the operation finished.
+	Time time.Time `json:"time"`
+	// Operation is the operation.
+	Operation AuditOperation `json:"operation"`
+	// Reference is the reference the operation originated from, if any.
+	Reference string `json:"reference,omitempty"`
+	// User is the user of the process performing the operation.
+	User string `json:"user,omitempty"`
+	// PID is the id of the process performing the operation.
+	PID int `json:"pid,omitempty"`
+	// Outcome is whether the modification of the index was written.
+	Outcome AuditOutcome `json:"outcome"`
+	// Error is the error the operation failed with.
+	Error string `json:"error,omitempty"`
+	// Added are the index entries added by the operation.
+	Added []ocispec.Descriptor `json:"added,omitempty"`
+	// Removed are the index entries removed by the operation.
+	Removed []ocispec.Descriptor `json:"removed,omitempty"`
+	// Updated are the index entries whose annotations the operation changed, as updated.
+	Updated []ocispec.Descriptor `json:"updated,omitempty"`
+}
+
+type auditOperationKey struct{}
+
+type auditOperation struct {
+	operation AuditOperation
+	ref       string
+}
+
+// WithAuditOperation returns a context recording the index modifications made with it as the given
+// operation originating from ref (if not empty) in the audit log, see AuditEntry. Index modifications
+// made without an operation, e.g. recording the usage of images, are not audited.
+func WithAuditOperation(ctx context.Context, operation AuditOperation, ref string) context.Context {
+	return context.WithValue(ctx, auditOperationKey{}, auditOperation{operation, ref})
+}
+
+// withDefaultAuditOperation is like WithAuditOperation with the reference recorded with
+// ocicontent.WithIngestSource, but keeps an operation already set on ctx by the caller.
+func withDefaultAuditOperation(ctx context.Context, operation AuditOperation) context.Context {
+	if _, ok := ctx.Value(auditOperationKey{}).(auditOperation); ok {
+		return ctx
+	}
+	return WithAuditOperation(ctx, operation, ocicontent.IngestSource(ctx))
+}
+
+var (
+	auditUserOnce sync.Once
+	auditUser     string
+)
+
+// processUser returns the name of the user of the process, falling back to its uid.
+func processUser() string {
+	auditUserOnce.Do(func() {
+		auditUser = strconv.Itoa(os.Getuid())
+		if u, err := user.Current(); err == nil {
+			auditUser = u.Username
+		}
+	})
+	return auditUser
+}
+
+// auditHook is the indexer.DoneHook of the layout, appending an AuditEntry for each modification made with
+// an audit operation, see WithAuditOperation. Failing to write the audit log is logged, but never fails
+// the operation.
+func (l *Layout) auditHook(ctx context.Context, old, new *ocispec.Index, err error) {
+	op, ok := ctx.Value(auditOperationKey{}).(auditOperation)
+	if !ok {
+		return
+	}
+	entry := AuditEntry{
+		Time:      time.Now().UTC(),
+		Operation: op.operation,
+		Reference: op.ref,
+		User:      processUser(),
+		PID:       os.Getpid(),
+		Outcome:   AuditSucceeded,
+	}
+	if err != nil {
+		entry.Outcome = AuditFailed
+		entry.Error = err.Error()
+	} else {
+		entry.Added, entry.Removed, entry.Updated = diffIndex(old, new)
+	}
+	if err := l.appendAudit(entry); err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "Error writing audit log", "Operation", op.operation)
+	}
+}
+
+// auditEntryKey identifies an index entry by digest and reference name.
+func auditEntryKey(desc ocispec.Descriptor) string {
+	return desc.Digest.String() + "\x00" + desc.Annotations[ocispec.AnnotationRefName]
+}
+
+// diffIndex returns the entries of new not in old, those of old not in new and those in both whose
+// annotations differ.
+func diffIndex(old, new *ocispec.Index) (added, removed, updated []ocispec.Descriptor) {
+	before := make(map[string]ocispec.Descriptor, len(old.Manifests))
+	for _, entry := range old.Manifests {
+		before[auditEntryKey(entry)] = entry
+	}
+	after := make(map[string]struct{}, len(new.Manifests))
+	for _, entry := range new.Manifests {
+		key := auditEntryKey(entry)
+		after[key] = struct{}{}
+		prev, ok := before[key]
+		switch {
+		case !ok:
+			added = append(added, entry)
+		case !equalAnnotations(prev.Annotations, entry.Annotations):
+			updated = append(updated, entry)
+		}
+	}
+	for _, entry := range old.Manifests {
+		if _, ok := after[auditEntryKey(entry)]; !ok {
+			removed = append(removed, entry)
+		}
+	}
+	return added, removed, updated
+}
+
+func equalAnnotations(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *Layout) auditPath(rotation int) string {
+	path := filepath.Join(l.path, AuditFileName)
+	if rotation > 0 {
+		path += "." + strconv.Itoa(rotation)
+	}
+	return path
+}
+
+// appendAudit appends the entry to the audit log, rotating it first if it would exceed AuditMaxSize.
+// Callers hold the index lock.
+func (l *Layout) appendAudit(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error encoding audit entry: %w", err)
+	}
+	data = append(data, '\n')
+
+	path := l.auditPath(0)
+	if info, err := os.Stat(path); err == nil && info.Size() > 0 && info.Size()+int64(len(data)) > AuditMaxSize {
+		if err := l.rotateAudit(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("error opening audit log: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("error writing audit log: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("error syncing audit log: %w", err)
+	}
+	return f.Close()
+}
+
+// rotateAudit shifts the audit log files by one, dropping the oldest one beyond AuditRotations.
+func (l *Layout) rotateAudit() error {
+	for i := AuditRotations; i > 0; i-- {
+		if err := os.Rename(l.auditPath(i-1), l.auditPath(i)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error rotating audit log: %w", err)
+		}
+	}
+	return nil
+}
+
+// AuditLog returns the entries of the audit log (including the rotated files) that were recorded at or
+// after since, oldest first. Zero since returns all entries. Lines that cannot be decoded, e.g. because a
+// file was truncated, are skipped, and missing files are treated as empty. The files are read while
+// holding the index lock, so a concurrent rotation cannot drop or duplicate entries.
+func (l *Layout) AuditLog(ctx context.Context, since time.Time) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	if err := l.indexer.Read(ctx, func(*ocispec.Index) error {
+		for i := AuditRotations; i >= 0; i-- {
+			read, err := readAuditFile(l.auditPath(i), since)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, read...)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("error reading audit log: %w", err)
+	}
+	return entries, nil
+}
+
+func readAuditFile(path string, since time.Time) ([]AuditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var (
+		entries []AuditEntry
+		r       = bufio.NewReader(f)
+	)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var entry AuditEntry
+			if json.Unmarshal(line, &entry) == nil && !entry.Time.Before(since) {
+				entries = append(entries, entry)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Digests returns the digests of all index entries the audit entry involves.
+func (e AuditEntry) Digests() []digest.Digest {
+	var res []digest.Digest
+	for _, descs := range [][]ocispec.Descriptor{e.Added, e.Removed, e.Updated} {
+		for _, desc := range descs {
+			res = append(res, desc.Digest)
+		}
+	}
+	return res
+}
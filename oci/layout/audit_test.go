@@ -0,0 +1,151 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Audit log", func() {
+	var (
+		ctx    context.Context
+		path   string
+		layout *Layout
+	)
+
+	newImage := func(name string) ociimage.Image {
+		img, err := fixtures.RootFS(name).Build()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		path = GinkgoT().TempDir()
+		l, err := New(path)
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+	})
+
+	operations := func(entries []AuditEntry) []AuditOperation {
+		var res []AuditOperation
+		for _, entry := range entries {
+			res = append(res, entry.Operation)
+		}
+		return res
+	}
+
+	It("should record mutating operations in order with their outcome", func() {
+		img := newImage("image")
+		dgst := img.Descriptor().Digest
+		Expect(layout.AddImage(ocicontent.WithIngestSource(ctx, "example.org/image:v1"), img)).To(Succeed())
+
+		pinCtx := WithAuditOperation(ctx, AuditPin, "example.org/image:v1")
+		Expect(layout.Indexer().Update(pinCtx, descriptormatcher.Digests(dgst), func(desc ocispec.Descriptor) ocispec.Descriptor {
+			return indexer.WithAnnotation(desc, PinnedAnnotation, "true")
+		})).To(Succeed())
+
+		addCtx := WithAuditOperation(ctx, AuditAdd, "")
+		Expect(layout.Indexer().Add(addCtx, img.Descriptor(), indexer.WithStrict())).To(MatchError(indexer.ErrAlreadyExists))
+
+		// Bookkeeping without an audit operation is not audited.
+		Expect(layout.RecordSizes(ctx, dgst)).To(Succeed())
+
+		entries, err := layout.AuditLog(ctx, time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(operations(entries)).To(Equal([]AuditOperation{AuditAdd, AuditPin, AuditAdd}))
+
+		Expect(entries[0].Reference).To(Equal("example.org/image:v1"))
+		Expect(entries[0].Outcome).To(Equal(AuditSucceeded))
+		Expect(entries[0].Added).To(HaveLen(1))
+		Expect(entries[0].Added[0].Digest).To(Equal(dgst))
+		Expect(entries[0].User).NotTo(BeEmpty())
+		Expect(entries[0].PID).To(Equal(os.Getpid()))
+
+		Expect(entries[1].Updated).To(HaveLen(1))
+		Expect(IsPinned(entries[1].Updated[0])).To(BeTrue())
+
+		Expect(entries[2].Outcome).To(Equal(AuditFailed))
+		Expect(entries[2].Error).To(ContainSubstring(indexer.ErrAlreadyExists.Error()))
+		Expect(entries[2].Digests()).To(BeEmpty())
+
+		later, err := layout.AuditLog(ctx, entries[2].Time.Add(time.Nanosecond))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(later).To(BeEmpty())
+	})
+
+	It("should record pruned images", func() {
+		expired := fixtures.RootFS("expired")
+		expired.Annotations = map[string]string{imageutil.ExpiresAtAnnotation: time.Now().Add(-time.Hour).Format(time.RFC3339)}
+		img, err := expired.Build()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+
+		_, err = layout.PruneExpired(ctx, time.Now())
+		Expect(err).NotTo(HaveOccurred())
+
+		entries, err := layout.AuditLog(ctx, time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(operations(entries)).To(Equal([]AuditOperation{AuditAdd, AuditPrune}))
+		Expect(entries[1].Removed).To(HaveLen(1))
+		Expect(entries[1].Removed[0].Digest).To(Equal(img.Descriptor().Digest))
+	})
+
+	It("should rotate the log and skip corrupt lines", func() {
+		Expect(layout.AddImage(ctx, newImage("first"))).To(Succeed())
+		logPath := filepath.Join(path, AuditFileName)
+		f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = f.WriteString("{corrupt\n" + strings.Repeat(" ", AuditMaxSize) + "\n")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		Expect(layout.AddImage(ctx, newImage("second"))).To(Succeed())
+		Expect(logPath + ".1").To(BeARegularFile())
+
+		entries, err := layout.AuditLog(ctx, time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].Added[0].Digest).To(Equal(newImage("first").Descriptor().Digest))
+		Expect(entries[1].Added[0].Digest).To(Equal(newImage("second").Descriptor().Digest))
+	})
+
+	It("should not block operations if the log cannot be written", func() {
+		Expect(os.Mkdir(filepath.Join(path, AuditFileName), 0777)).To(Succeed())
+		Expect(layout.AddImage(ctx, newImage("image"))).To(Succeed())
+	})
+
+	It("should not record anything if disabled", func() {
+		l, err := New(GinkgoT().TempDir(), WithAuditDisabled())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(l.AddImage(ctx, newImage("image"))).To(Succeed())
+		Expect(filepath.Join(l.Path(), AuditFileName)).NotTo(BeAnExistingFile())
+	})
+})
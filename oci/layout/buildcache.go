@@ -0,0 +1,163 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// BuildCacheFileName is the name of the file in the layout directory mapping the inputs of built layers to
+// the layers produced of them, see LookupBuildCache.
+const BuildCacheFileName = "build-cache.json"
+
+// MaxBuildCacheEntries is the maximum number of entries of the build cache. Beyond it, the least recently
+// used entries are evicted.
+const MaxBuildCacheEntries = 512
+
+// BuildCacheKey are the inputs determining the layer a build produces of an input file. Builds with
+// different compression settings have different keys, so their layers are never mixed up.
+type BuildCacheKey struct {
+	// Source identifies the content of the input file, either its digest or a signature of its file
+	// metadata for builds trusting that the content did not change if the metadata did not.
+	Source string `json:"source"`
+	// MediaType is the media type of the layer before adding a compression suffix.
+	MediaType string `json:"mediaType"`
+	// Compression is the compression detected of the input file.
+	Compression string `json:"compression"`
+	// KeepCompressed is set if compressed input is stored as-is instead of decompressed.
+	KeepCompressed bool `json:"keepCompressed"`
+}
+
+// Digest returns the digest identifying the key.
+func (k BuildCacheKey) Digest() digest.Digest {
+	data, _ := json.Marshal(k)
+	return digest.FromBytes(data)
+}
+
+// buildCacheEntry is a layer produced by a build.
+type buildCacheEntry struct {
+	Descriptor ocispec.Descriptor `json:"descriptor"`
+	LastUsedAt time.Time          `json:"lastUsedAt"`
+}
+
+// buildCacheFile is the content of the build cache file.
+type buildCacheFile struct {
+	// Entries are the produced layers by the digest of their key.
+	Entries map[digest.Digest]buildCacheEntry `json:"entries"`
+}
+
+// readBuildCache reads the build cache file. A missing or unreadable cache is empty.
+func (l *Layout) readBuildCache() *buildCacheFile {
+	cache := &buildCacheFile{}
+	data, err := os.ReadFile(filepath.Join(l.path, BuildCacheFileName))
+	if err != nil || json.Unmarshal(data, cache) != nil {
+		cache = &buildCacheFile{}
+	}
+	if cache.Entries == nil {
+		cache.Entries = make(map[digest.Digest]buildCacheEntry)
+	}
+	return cache
+}
+
+// writeBuildCache replaces the build cache file, evicting the least recently used entries beyond
+// MaxBuildCacheEntries. It is not synced, losing the cache only costs rebuilding the layers.
+func (l *Layout) writeBuildCache(cache *buildCacheFile) error {
+	if len(cache.Entries) > MaxBuildCacheEntries {
+		keys := make([]digest.Digest, 0, len(cache.Entries))
+		for key := range cache.Entries {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return cache.Entries[keys[i]].LastUsedAt.Before(cache.Entries[keys[j]].LastUsedAt)
+		})
+		for _, key := range keys[:len(keys)-MaxBuildCacheEntries] {
+			delete(cache.Entries, key)
+		}
+	}
+
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return fmt.Errorf("error marshaling build cache: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(l.path, "."+BuildCacheFileName+".*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary build cache file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error writing build cache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary build cache file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(l.path, BuildCacheFileName)); err != nil {
+		return fmt.Errorf("error writing build cache: %w", err)
+	}
+	return nil
+}
+
+// LookupBuildCache returns the descriptor of the layer a previous build produced for the key, if its blob
+// is still in the store. Entries whose blob was removed meanwhile are dropped.
+func (l *Layout) LookupBuildCache(ctx context.Context, key BuildCacheKey) (ocispec.Descriptor, bool, error) {
+	var (
+		desc ocispec.Descriptor
+		ok   bool
+	)
+	err := l.indexer.Read(ctx, func(*ocispec.Index) error {
+		cache := l.readBuildCache()
+		dgst := key.Digest()
+		entry, found := cache.Entries[dgst]
+		if !found {
+			return nil
+		}
+
+		if _, err := l.store.Info(ctx, entry.Descriptor.Digest); err != nil {
+			if !errdefs.IsNotFound(err) {
+				return fmt.Errorf("error checking cached layer %s: %w", entry.Descriptor.Digest, err)
+			}
+			delete(cache.Entries, dgst)
+			return l.writeBuildCache(cache)
+		}
+
+		desc, ok = entry.Descriptor, true
+		entry.LastUsedAt = time.Now()
+		cache.Entries[dgst] = entry
+		return l.writeBuildCache(cache)
+	})
+	return desc, ok, err
+}
+
+// AddBuildCache records that a build produced the layer with the given descriptor for the key. The
+// descriptor should only carry annotations derived from the content of the layer.
+func (l *Layout) AddBuildCache(ctx context.Context, key BuildCacheKey, desc ocispec.Descriptor) error {
+	return l.indexer.Read(ctx, func(*ocispec.Index) error {
+		cache := l.readBuildCache()
+		cache.Entries[key.Digest()] = buildCacheEntry{Descriptor: desc, LastUsedAt: time.Now()}
+		return l.writeBuildCache(cache)
+	})
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("BuildCache", func() {
+	var (
+		ctx    context.Context
+		layout *Layout
+	)
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		l, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+	})
+
+	writeLayer := func(data []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayer,
+			Digest:    digest.FromBytes(data),
+			Size:      int64(len(data)),
+		}
+		Expect(content.WriteBlob(ctx, layout.Store(), desc.Digest.String(), bytes.NewReader(data), desc)).To(Succeed())
+		return desc
+	}
+
+	It("should only return cached layers for the same source and compression settings", func() {
+		var (
+			desc = writeLayer([]byte("rootfs"))
+			key  = BuildCacheKey{
+				Source:      digest.FromString("input").String(),
+				MediaType:   ocispec.MediaTypeImageLayer,
+				Compression: "gzip",
+			}
+		)
+		Expect(layout.AddBuildCache(ctx, key, desc)).To(Succeed())
+
+		cached, ok, err := layout.LookupBuildCache(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(cached).To(Equal(desc))
+
+		for _, other := range []BuildCacheKey{
+			{Source: key.Source, MediaType: key.MediaType, Compression: "gzip", KeepCompressed: true},
+			{Source: key.Source, MediaType: key.MediaType, Compression: "zstd"},
+			{Source: digest.FromString("other").String(), MediaType: key.MediaType, Compression: "gzip"},
+		} {
+			_, ok, err := layout.LookupBuildCache(ctx, other)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeFalse(), "%+v", other)
+		}
+	})
+
+	It("should drop entries whose layer was removed from the store", func() {
+		var (
+			desc = writeLayer([]byte("removed"))
+			key  = BuildCacheKey{Source: "input", MediaType: ocispec.MediaTypeImageLayer}
+		)
+		Expect(layout.AddBuildCache(ctx, key, desc)).To(Succeed())
+		Expect(layout.Store().Delete(ctx, desc.Digest)).To(Succeed())
+
+		_, ok, err := layout.LookupBuildCache(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should evict the least recently used entries beyond the maximum", func() {
+		desc := writeLayer([]byte("shared"))
+		keyOf := func(i int) BuildCacheKey {
+			return BuildCacheKey{Source: fmt.Sprint("input-", i), MediaType: ocispec.MediaTypeImageLayer}
+		}
+		for i := 0; i < MaxBuildCacheEntries; i++ {
+			Expect(layout.AddBuildCache(ctx, keyOf(i), desc)).To(Succeed())
+		}
+		// Using the first entry makes the second one the least recently used.
+		_, ok, err := layout.LookupBuildCache(ctx, keyOf(0))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(layout.AddBuildCache(ctx, keyOf(MaxBuildCacheEntries), desc)).To(Succeed())
+
+		for i, expected := range map[int]bool{0: true, 1: false, 2: true, MaxBuildCacheEntries: true} {
+			_, ok, err := layout.LookupBuildCache(ctx, keyOf(i))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(Equal(expected), "entry %d", i)
+		}
+	})
+})
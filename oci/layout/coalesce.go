@@ -0,0 +1,177 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/go-logr/logr"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/onmetal/onmetal-image/utils/fsutil"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// lockDir is the directory of the layout holding the lock files of blobs being written, see
+// migration.Steps.
+const lockDir = "tmp/ingest-locks"
+
+// blobPollInterval is how often a caller waiting for another process to write a blob checks whether
+// it is done.
+const blobPollInterval = 50 * time.Millisecond
+
+// blobLockStaleAfter is the age after which the lock file of a blob is considered abandoned on file
+// systems without flock support, see fsutil.TryLockFile. It bounds how long a crashed writer delays
+// others, at the risk of a second writer for blobs taking longer to write.
+const blobLockStaleAfter = time.Hour
+
+// blobFlight is a write of a blob by a caller of this process other callers wait for.
+type blobFlight struct {
+	done chan struct{}
+}
+
+// blobClaim is the exclusive right to write a blob to the layout, see claimBlob.
+type blobClaim struct {
+	layout *Layout
+	digest digest.Digest
+	flight *blobFlight
+	unlock func() error
+}
+
+// claimBlob claims writing the blob of the descriptor, both within the process and across processes
+// via a lock file, without blocking. If another caller of this process is writing the blob, its flight
+// is returned to wait for. If another process is writing it, both are nil.
+func (l *Layout) claimBlob(ctx context.Context, desc ocispec.Descriptor) (*blobClaim, *blobFlight, error) {
+	l.flightsMu.Lock()
+	if flight, ok := l.flights[desc.Digest]; ok {
+		l.flightsMu.Unlock()
+		return nil, flight, nil
+	}
+	flight := &blobFlight{done: make(chan struct{})}
+	l.flights[desc.Digest] = flight
+	l.flightsMu.Unlock()
+
+	claim := &blobClaim{layout: l, digest: desc.Digest, flight: flight}
+	path := filepath.Join(l.path, filepath.FromSlash(lockDir), desc.Digest.Encoded()+".lock")
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		claim.release(ctx)
+		return nil, nil, fmt.Errorf("error creating lock directory: %w", err)
+	}
+	var (
+		unlock func() error
+		ok     bool
+		err    error
+	)
+	if l.capabilities.Flock {
+		unlock, ok, err = tryLockFile(path)
+	} else {
+		unlock, ok, err = fsutil.TryLockFile(path, blobLockStaleAfter)
+	}
+	if err != nil || !ok {
+		claim.release(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error locking blob %s: %w", desc.Digest, err)
+		}
+		return nil, nil, nil
+	}
+	claim.unlock = unlock
+	return claim, nil, nil
+}
+
+// release releases the claim, waking up all callers waiting for it.
+func (c *blobClaim) release(ctx context.Context) {
+	if c.unlock != nil {
+		if err := c.unlock(); err != nil {
+			logr.FromContextOrDiscard(ctx).Error(err, "Error unlocking blob", "Digest", c.digest)
+		}
+	}
+	c.layout.flightsMu.Lock()
+	delete(c.layout.flights, c.digest)
+	c.layout.flightsMu.Unlock()
+	close(c.flight.done)
+}
+
+// waitBlob waits for the flight of another caller of this process or, if nil, until it is time to
+// check again whether another process finished writing the blob.
+func (l *Layout) waitBlob(ctx context.Context, desc ocispec.Descriptor, flight *blobFlight) error {
+	if flight != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-flight.done:
+			return nil
+		}
+	}
+
+	if status, err := l.store.Status(ctx, remotes.MakeRefKey(ctx, desc)); err == nil {
+		logr.FromContextOrDiscard(ctx).V(2).Info("Another process is writing blob", "Digest", desc.Digest, "Offset", status.Offset, "Total", status.Total)
+	}
+	timer := time.NewTimer(blobPollInterval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// writeBlob writes the layer to the store, coalescing concurrent writes of the same blob: Within the
+// process, the first caller writes the blob while all others wait for it. Across processes, the writer
+// holds a lock file, and the others poll until they can take the lock. Callers that waited only write
+// the blob if it is still missing then, so if the writer failed, one of them retries.
+// It reports whether this call wrote the blob.
+func (l *Layout) writeBlob(ctx context.Context, layer ociimage.Layer, opts ...ocicontent.WriteOption) (bool, error) {
+	var (
+		log    = logr.FromContextOrDiscard(ctx)
+		desc   = layer.Descriptor()
+		waited bool
+	)
+	for {
+		claim, flight, err := l.claimBlob(ctx, desc)
+		if err != nil {
+			return false, err
+		}
+		if claim == nil {
+			if !waited {
+				log.V(1).Info("Waiting for concurrent write of blob", "Digest", desc.Digest)
+				waited = true
+			}
+			if err := l.waitBlob(ctx, desc, flight); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		if waited && ocicontent.Exists(ctx, l.store, desc) {
+			claim.release(ctx)
+			progress.FromContext(ctx).Report(progress.BlobDone{Digest: desc.Digest, Total: progress.Total(desc), Skipped: true})
+			return false, nil
+		}
+		if waited {
+			log.V(1).Info("Concurrent write of blob failed, retrying", "Digest", desc.Digest)
+		}
+		err = ocicontent.WriteLayerToIngester(ctx, l.store, layer, opts...)
+		claim.release(ctx)
+		return true, err
+	}
+}
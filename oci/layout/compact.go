@@ -0,0 +1,49 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/go-logr/logr"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Compact compacts the index of the layout, merging duplicate entries and dropping entries whose
+// manifest blob no longer exists, see indexer.Indexer.Compact.
+func (l *Layout) Compact(ctx context.Context) (*indexer.CompactResult, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	res, err := l.indexer.Compact(ctx, indexer.WithExists(func(ctx context.Context, dgst digest.Digest) (bool, error) {
+		if _, err := l.store.Info(ctx, dgst); err != nil {
+			if errdefs.IsNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, desc := range res.Dropped {
+		log.Info("Dropped index entry with missing manifest", "Digest", desc.Digest, "Name", desc.Annotations[ocispec.AnnotationRefName])
+	}
+	return res, nil
+}
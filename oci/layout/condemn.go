@@ -0,0 +1,160 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/onmetal/onmetal-image/batch"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/utils/sets"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// CondemnedAtAnnotation is the index entry annotation recording when an image was condemned, in RFC 3339
+	// format: when the last of its reference names was moved to another image, e.g. by a pull updating the
+	// tag. Condemned images are removed by PruneCondemned once their grace period expired, unless they are
+	// tagged again before.
+	CondemnedAtAnnotation = "image.onmetal.de/condemned-at"
+
+	// DefaultGracePeriod is the default duration condemned images are kept for, protecting e.g. machines
+	// started from an image moments before its tag was updated.
+	DefaultGracePeriod = 24 * time.Hour
+)
+
+// CondemnedAt returns when the image of the index entry was condemned, see CondemnedAtAnnotation.
+func CondemnedAt(desc ocispec.Descriptor) (time.Time, bool) {
+	v, ok := desc.Annotations[CondemnedAtAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// condemnDisplaced condemns the images of the modified index that lost their last reference name to
+// another image, and acquits condemned images that have a reference name again. Images whose entries were
+// all replaced, e.g. by RecompressImage, are gone and not condemned.
+func condemnDisplaced(old, new *ocispec.Index, now time.Time) {
+	var (
+		named    = sets.New[digest.Digest]()
+		newNames = make(map[string]digest.Digest)
+	)
+	for _, entry := range new.Manifests {
+		if name, ok := entry.Annotations[ocispec.AnnotationRefName]; ok {
+			named.Insert(entry.Digest)
+			newNames[name] = entry.Digest
+		}
+	}
+
+	displaced := sets.New[digest.Digest]()
+	for _, entry := range old.Manifests {
+		name, ok := entry.Annotations[ocispec.AnnotationRefName]
+		if !ok || named.Has(entry.Digest) {
+			continue
+		}
+		if dgst, ok := newNames[name]; ok && dgst != entry.Digest {
+			displaced.Insert(entry.Digest)
+		}
+	}
+
+	condemnedAt := now.UTC().Format(time.RFC3339)
+	for i, entry := range new.Manifests {
+		_, condemned := entry.Annotations[CondemnedAtAnnotation]
+		switch {
+		case condemned && named.Has(entry.Digest):
+			new.Manifests[i] = indexer.WithoutAnnotation(entry, CondemnedAtAnnotation)
+		case !condemned && displaced.Has(entry.Digest):
+			new.Manifests[i] = indexer.WithAnnotation(entry, CondemnedAtAnnotation, condemnedAt)
+		}
+	}
+}
+
+// modifyHook is the indexer.ModifyHook of the layout, condemning displaced images (see condemnDisplaced)
+// and updating the reference counts (see updateRefCounts).
+func (l *Layout) modifyHook(ctx context.Context, old, new *ocispec.Index) error {
+	condemnDisplaced(old, new, time.Now())
+	return l.updateRefCounts(ctx, old, new)
+}
+
+// PruneCondemned removes all unpinned, unleased images condemned (see CondemnedAtAnnotation) longer than the
+// grace period before the given time, along with all blobs not referenced by any remaining image.
+// It returns a result per removed image like PruneExpired.
+func (l *Layout) PruneCondemned(ctx context.Context, now time.Time, gracePeriod time.Duration) ([]batch.Result, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	candidates, refs, err := l.evictionCandidates(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []batch.Result
+	for _, c := range candidates {
+		if c.pinned || c.leased {
+			continue
+		}
+		condemnedAt, ok := candidateCondemnedAt(c)
+		if !ok || !condemnedAt.Add(gracePeriod).Before(now) {
+			continue
+		}
+
+		log.Info("Pruning condemned image", "Digest", c.digest, "CondemnedAt", condemnedAt)
+		results = append(results, l.pruneImage(ctx, c, refs))
+	}
+	return results, nil
+}
+
+// candidateCondemnedAt returns when the image was condemned: the latest time any of its entries was
+// condemned at, if none of them has a reference name.
+func candidateCondemnedAt(c *evictionCandidate) (time.Time, bool) {
+	var res time.Time
+	for _, entry := range c.entries {
+		if _, ok := entry.Annotations[ocispec.AnnotationRefName]; ok {
+			return time.Time{}, false
+		}
+		if t, ok := CondemnedAt(entry); ok && t.After(res) {
+			res = t
+		}
+	}
+	return res, !res.IsZero()
+}
+
+// pruneCondemned removes the condemned images whose grace period expired if the layout was opened with
+// WithCondemnedGracePeriod. Failing to do so does not fail the caller.
+func (l *Layout) pruneCondemned(ctx context.Context) {
+	if l.condemnedGracePeriod <= 0 {
+		return
+	}
+	log := logr.FromContextOrDiscard(ctx)
+
+	results, err := l.PruneCondemned(ctx, time.Now(), l.condemnedGracePeriod)
+	if err != nil {
+		log.Error(err, "Error pruning condemned images")
+		return
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			log.Error(fmt.Errorf("error pruning condemned image %s: %w", result.Digest, result.Err), "Error pruning condemned image")
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Condemned images", func() {
+	const name = "example.org/image:latest"
+
+	var (
+		ctx    context.Context
+		layout *Layout
+	)
+
+	newImage := func(content string) ociimage.Image {
+		img, err := fixtures.RootFS(content).Build()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	// pull adds the image like store.Store.Push: an unnamed entry and the tag moved to it.
+	pull := func(l *Layout, img ociimage.Image, ref string) {
+		unnamed := descriptormatcher.And(descriptormatcher.Unnamed, descriptormatcher.Digests(img.Descriptor().Digest))
+		Expect(l.ReplaceImage(ctx, img, unnamed)).To(Succeed())
+		tag := indexer.WithAnnotation(img.Descriptor(), ocispec.AnnotationRefName, ref)
+		Expect(l.Indexer().Replace(ctx, tag, descriptormatcher.Name(ref))).To(Succeed())
+	}
+
+	entries := func(img ociimage.Image) []ocispec.Descriptor {
+		descs, err := layout.Indexer().List(ctx, descriptormatcher.Digests(img.Descriptor().Digest))
+		Expect(err).NotTo(HaveOccurred())
+		return descs
+	}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		l, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+	})
+
+	It("should condemn images whose tag moved and remove them after the grace period", func() {
+		old, current := newImage("old"), newImage("current")
+		pull(layout, old, name)
+		pull(layout, current, name)
+
+		Expect(entries(old)).To(ConsistOf(HaveField("Annotations", HaveKey(CondemnedAtAnnotation))))
+		for _, entry := range entries(current) {
+			Expect(entry.Annotations).NotTo(HaveKey(CondemnedAtAnnotation))
+		}
+		condemnedAt, ok := CondemnedAt(entries(old)[0])
+		Expect(ok).To(BeTrue())
+
+		results, err := layout.PruneCondemned(ctx, condemnedAt.Add(time.Hour), DefaultGracePeriod)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(BeEmpty())
+
+		results, err = layout.PruneCondemned(ctx, condemnedAt.Add(DefaultGracePeriod+time.Second), DefaultGracePeriod)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(ConsistOf(HaveField("Digest", old.Descriptor().Digest)))
+		Expect(results[0].Err).NotTo(HaveOccurred())
+		Expect(entries(old)).To(BeEmpty())
+		_, err = layout.Store().Info(ctx, old.Descriptor().Digest)
+		Expect(err).To(HaveOccurred())
+		Expect(entries(current)).To(HaveLen(2))
+	})
+
+	It("should acquit condemned images that are tagged again", func() {
+		old, current := newImage("old"), newImage("current")
+		pull(layout, old, name)
+		pull(layout, current, name)
+
+		tag := indexer.WithAnnotation(old.Descriptor(), ocispec.AnnotationRefName, "example.org/image:previous")
+		Expect(layout.Indexer().Replace(ctx, tag, descriptormatcher.Name("example.org/image:previous"))).To(Succeed())
+		for _, entry := range entries(old) {
+			Expect(entry.Annotations).NotTo(HaveKey(CondemnedAtAnnotation))
+		}
+
+		results, err := layout.PruneCondemned(ctx, time.Now().Add(2*DefaultGracePeriod), DefaultGracePeriod)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(BeEmpty())
+	})
+
+	It("should keep pinned and leased condemned images", func() {
+		pinned, leased := newImage("pinned"), newImage("leased")
+		pull(layout, pinned, name)
+		pull(layout, leased, name)
+		pull(layout, newImage("current"), name)
+
+		Expect(layout.Indexer().Modify(ctx, func(index *ocispec.Index) error {
+			for i, entry := range index.Manifests {
+				if entry.Digest == pinned.Descriptor().Digest {
+					index.Manifests[i] = indexer.WithAnnotation(entry, PinnedAnnotation, "true")
+				}
+			}
+			return nil
+		})).To(Succeed())
+		lease, err := layout.Lease(ctx, leased.Descriptor(), time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(lease.Release)
+
+		results, err := layout.PruneCondemned(ctx, time.Now().Add(2*DefaultGracePeriod), DefaultGracePeriod)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(BeEmpty())
+	})
+
+	It("should remove condemned images when adding images with a grace period", func() {
+		l, err := New(GinkgoT().TempDir(), WithCondemnedGracePeriod(time.Nanosecond))
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+
+		old := newImage("old")
+		pull(layout, old, name)
+		pull(layout, newImage("current"), name)
+		Expect(entries(old)).To(HaveLen(1))
+
+		Expect(layout.AddImage(ctx, newImage("other"))).To(Succeed())
+		Expect(entries(old)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,39 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+)
+
+// ContinueOnError returns the image with a failing blob not stopping AddImage and ReplaceImage from writing
+// its other blobs, like ocicontent.WithContinueOnError. The image is still not indexed and the returned
+// error joins the *ocicontent.BlobError of every failed blob, so adding the image again only writes those.
+// Wrap the result of PrioritizeLayers, not the other way round, to keep the priority.
+func ContinueOnError(img ociimage.Image) ociimage.Image {
+	return continuingImage{img}
+}
+
+type continuingImage struct {
+	ociimage.Image
+}
+
+// unwrapContinuing returns the image wrapped by ContinueOnError, if any, and whether it was wrapped.
+func unwrapContinuing(img ociimage.Image) (ociimage.Image, bool) {
+	if c, ok := img.(continuingImage); ok {
+		return c.Image, true
+	}
+	return img, false
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// brokenLayer is a layer whose content cannot be opened.
+type brokenLayer struct {
+	ociimage.Layer
+}
+
+func (brokenLayer) Content(context.Context) (io.ReadCloser, error) {
+	return nil, errors.New("connection reset")
+}
+
+// brokenImage is an image whose layer with the given digest is a brokenLayer.
+type brokenImage struct {
+	ociimage.Image
+	broken digest.Digest
+}
+
+func (i brokenImage) Layers(ctx context.Context) ([]ociimage.Layer, error) {
+	layers, err := i.Image.Layers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]ociimage.Layer, len(layers))
+	for j, layer := range layers {
+		if layer.Descriptor().Digest == i.broken {
+			layer = brokenLayer{layer}
+		}
+		res[j] = layer
+	}
+	return res, nil
+}
+
+var _ = Describe("ContinueOnError", func() {
+	ctx := context.Background()
+
+	// newImage returns a bootable image whose initramfs layer cannot be read, along with the descriptors
+	// of its kernel, initramfs and rootfs layers.
+	newImage := func() (img ociimage.Image, kernel, broken, rootFS ocispec.Descriptor) {
+		built, err := fixtures.Bootable().Build()
+		Expect(err).NotTo(HaveOccurred())
+		layers, err := built.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		kernel, broken, rootFS = layers[0].Descriptor(), layers[1].Descriptor(), layers[2].Descriptor()
+		return brokenImage{built, broken.Digest}, kernel, broken, rootFS
+	}
+
+	It("should stop at the first failing blob without it", func() {
+		l, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+
+		img, _, broken, rootFS := newImage()
+		err = l.AddImage(ctx, img)
+		Expect(ocicontent.FailedBlobs(err)).To(Equal([]ocispec.Descriptor{broken}))
+		Expect(ocicontent.Exists(ctx, l.Store(), rootFS)).To(BeFalse())
+	})
+
+	It("should write the other blobs and name all failed ones", func() {
+		l, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+
+		img, kernel, broken, rootFS := newImage()
+		err = l.AddImage(ctx, ContinueOnError(PrioritizeLayers(img, onmetalimage.LayerPriority)))
+		Expect(err).To(MatchError(ocicontent.ErrIncompleteImage))
+		Expect(ocicontent.FailedBlobs(err)).To(Equal([]ocispec.Descriptor{broken, img.Descriptor()}))
+		Expect(ocicontent.Exists(ctx, l.Store(), kernel)).To(BeTrue())
+		Expect(ocicontent.Exists(ctx, l.Store(), rootFS)).To(BeTrue())
+		Expect(ocicontent.Exists(ctx, l.Store(), img.Descriptor())).To(BeFalse())
+
+		_, err = l.Indexer().FindDigest(ctx, img.Descriptor().Digest)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,57 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"time"
+
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// CreatedAt is when an image was created, see Layout.CreatedAt.
+type CreatedAt struct {
+	Time time.Time `json:"time"`
+	// Approximate is set if the config of the image records no created time and Time is the time the
+	// image was last pulled instead, see indexer.PulledAt.
+	Approximate bool `json:"approximate,omitempty"`
+}
+
+// CreatedAt returns when the image of the given index entries was created: the created time of its config
+// or, if it records none, the time it was last pulled, marked as approximate. It returns false if neither is
+// known, e.g. for images built locally before created times were recorded.
+// The config is read directly from the content store, so this does not count as an access.
+func (l *Layout) CreatedAt(ctx context.Context, entries ...ocispec.Descriptor) (CreatedAt, bool) {
+	if len(entries) == 0 {
+		return CreatedAt{}, false
+	}
+	if t, ok, err := imageutil.ConfigCreated(ctx, ocicontent.Image(l.store, entries[0])); err == nil && ok {
+		return CreatedAt{Time: t}, true
+	}
+
+	var pulledAt time.Time
+	for _, entry := range entries {
+		if t, ok := indexer.PulledAt(entry); ok && t.After(pulledAt) {
+			pulledAt = t
+		}
+	}
+	if pulledAt.IsZero() {
+		return CreatedAt{}, false
+	}
+	return CreatedAt{Time: pulledAt, Approximate: true}, true
+}
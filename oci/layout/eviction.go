@@ -0,0 +1,295 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/go-logr/logr"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/utils/sets"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// LastAccessedAtAnnotation is the index entry annotation recording when an image was last accessed,
+	// in RFC 3339 format.
+	LastAccessedAtAnnotation = "image.onmetal.de/last-accessed-at"
+	// PinnedAnnotation is the index entry annotation marking an image as pinned.
+	// An image with at least one pinned index entry is never evicted.
+	PinnedAnnotation = indexer.PinnedAnnotation
+)
+
+// ErrInsufficientCapacity is returned if an image does not fit into the layout, even after evicting images.
+var ErrInsufficientCapacity = errors.New("insufficient layout capacity")
+
+// IsPinned reports whether the index entry is pinned.
+func IsPinned(desc ocispec.Descriptor) bool {
+	return desc.Annotations[PinnedAnnotation] == "true"
+}
+
+// LastAccessedAt returns the time the image of the index entry was last accessed.
+// If no access was recorded, the time it was added to the index is returned.
+func LastAccessedAt(desc ocispec.Descriptor) time.Time {
+	if v, ok := desc.Annotations[LastAccessedAtAnnotation]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t
+		}
+	}
+	t, _ := indexer.AddedAt(desc)
+	return t
+}
+
+type evictionCandidate struct {
+	digest         digest.Digest
+	lastAccessedAt time.Time
+	// lastUsedAt is the time the image was last used, zero if no use was recorded, see LastUsedAt.
+	lastUsedAt time.Time
+	pinned     bool
+	// leased is set if the image is leased, see Layout.Lease.
+	leased bool
+	// blobs are the blobs referenced by the image, see refCounts.
+	blobs []digest.Digest
+	// manifest is the manifest of the image. It is nil if the manifest could not be read or was not
+	// requested.
+	manifest *ocispec.Manifest
+	// entries are the index entries of the image.
+	entries []ocispec.Descriptor
+}
+
+// recency returns the time eviction orders the image by: when it was last used if any use was recorded,
+// otherwise when it was last accessed.
+func (c *evictionCandidate) recency() time.Time {
+	if !c.lastUsedAt.IsZero() {
+		return c.lastUsedAt
+	}
+	return c.lastAccessedAt
+}
+
+// evictionCandidates returns the images of the layout, least recently used first, along with the number of
+// images referencing each blob. Only if withManifests is set, the manifests of the images are read.
+func (l *Layout) evictionCandidates(ctx context.Context, withManifests bool) ([]*evictionCandidate, map[digest.Digest]int, error) {
+	descs, err := l.indexer.List(ctx, descriptormatcher.Every)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listing index entries: %w", err)
+	}
+	refs, err := l.currentRefCounts(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l.candidatesOf(ctx, descs, refs, withManifests)
+}
+
+// lockedEvictionCandidates returns the eviction candidates of the index like evictionCandidates. It is
+// called while holding the index lock, so it neither reads the index nor records stale reference counts.
+func (l *Layout) lockedEvictionCandidates(ctx context.Context, index *ocispec.Index) ([]*evictionCandidate, map[digest.Digest]int, error) {
+	refs, _ := l.loadRefCounts(indexGeneration(index))
+	if refs == nil {
+		refs = l.computeRefCounts(ctx, index.Manifests)
+	}
+	return l.candidatesOf(ctx, index.Manifests, refs, false)
+}
+
+// candidatesOf returns the eviction candidates of the given index entries, see evictionCandidates.
+func (l *Layout) candidatesOf(ctx context.Context, descs []ocispec.Descriptor, refs *refCounts, withManifests bool) ([]*evictionCandidate, map[digest.Digest]int, error) {
+	leased, _, err := l.leased()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byDigest := make(map[digest.Digest]*evictionCandidate)
+	var candidates []*evictionCandidate
+	for _, desc := range descs {
+		c, ok := byDigest[desc.Digest]
+		if !ok {
+			c = &evictionCandidate{digest: desc.Digest, blobs: refs.Images[desc.Digest], leased: leased.Has(desc.Digest)}
+			if c.blobs == nil {
+				// The image was added after the reference counts were read.
+				c.blobs = l.imageRefs(ctx, []ocispec.Descriptor{desc})
+			}
+			if withManifests {
+				c.manifest, _ = ocicontent.Image(l.store, desc).Manifest(ctx)
+			}
+			byDigest[desc.Digest] = c
+			candidates = append(candidates, c)
+		}
+
+		c.entries = append(c.entries, desc)
+		c.pinned = c.pinned || IsPinned(desc)
+		if t := LastAccessedAt(desc); t.After(c.lastAccessedAt) {
+			c.lastAccessedAt = t
+		}
+		if t, ok := LastUsedAt(desc); ok && t.After(c.lastUsedAt) {
+			c.lastUsedAt = t
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].recency().Before(candidates[j].recency())
+	})
+	return candidates, refs.counts(), nil
+}
+
+// ensureCapacity evicts the least recently used, unpinned images until the given image fits into the layout.
+// If evicting all eligible images would not free enough space, nothing is evicted and ErrInsufficientCapacity
+// is returned.
+func (l *Layout) ensureCapacity(ctx context.Context, image ociimage.Image) error {
+	if l.maxSize <= 0 {
+		return nil
+	}
+	writeLayers, err := ociimage.AsWriteLayers(ctx, image)
+	if err != nil {
+		return fmt.Errorf("error getting image write layers: %w", err)
+	}
+	descs := make([]ocispec.Descriptor, len(writeLayers))
+	for i, layer := range writeLayers {
+		descs[i] = layer.Descriptor()
+	}
+	return l.ensureBlobCapacity(ctx, fmt.Sprintf("image %s", image.Descriptor().Digest), image.Descriptor().Digest, descs)
+}
+
+// ensureBlobCapacity evicts images like ensureCapacity until the blobs with the given descriptors fit into
+// the layout. The image with the digest keep, if any, is never evicted. Blobs that are already stored are
+// accounted for as well, so calling it after writing a blob of unknown size evicts until the layout is
+// within its maximum size again.
+func (l *Layout) ensureBlobCapacity(ctx context.Context, what string, keep digest.Digest, descs []ocispec.Descriptor) error {
+	if l.maxSize <= 0 {
+		return nil
+	}
+	log := logr.FromContextOrDiscard(ctx)
+
+	sizes, used, required, newBlobs, err := l.capacityUsage(ctx, descs)
+	if err != nil {
+		return err
+	}
+	if used+required <= l.maxSize {
+		return nil
+	}
+
+	// Candidates are selected and removed from the index while holding the index lock, so images added,
+	// tagged or leased meanwhile are accounted for and no blob of them is freed.
+	var (
+		evict []*evictionCandidate
+		free  []digest.Digest
+		freed int64
+	)
+	if err := l.indexer.Modify(WithAuditOperation(ctx, AuditEvict, ""), func(index *ocispec.Index) error {
+		// Other processes may have written or evicted content while waiting for the lock.
+		if sizes, used, required, newBlobs, err = l.capacityUsage(ctx, descs); err != nil {
+			return err
+		}
+		candidates, refs, err := l.lockedEvictionCandidates(ctx, index)
+		if err != nil {
+			return err
+		}
+
+		evict, free, freed = nil, nil, 0
+		evicted := sets.New[digest.Digest]()
+		for _, c := range candidates {
+			if used+required-freed <= l.maxSize {
+				break
+			}
+			if c.pinned || c.leased || c.digest == keep {
+				continue
+			}
+
+			evict = append(evict, c)
+			evicted.Insert(c.digest)
+			for _, blob := range c.blobs {
+				refs[blob]--
+				if refs[blob] == 0 && !newBlobs.Has(blob) {
+					free = append(free, blob)
+					freed += sizes[blob]
+				}
+			}
+		}
+		if used+required-freed > l.maxSize {
+			return fmt.Errorf("%w: %s requires %d bytes, layout uses %d of at most %d bytes and eviction can only free %d bytes",
+				ErrInsufficientCapacity, what, required, used, l.maxSize, freed)
+		}
+
+		var remaining []ocispec.Descriptor
+		for _, entry := range index.Manifests {
+			if !evicted.Has(entry.Digest) {
+				remaining = append(remaining, entry)
+			}
+		}
+		index.Manifests = remaining
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, c := range evict {
+		log.Info("Evicted least recently used image", "Digest", c.digest, "LastAccessedAt", c.lastAccessedAt, "LastUsedAt", c.lastUsedAt)
+	}
+	if err := l.deleteUnleasedBlobs(ctx, free); err != nil {
+		return err
+	}
+	log.Info("Evicted images to fit new content", "Images", len(evict), "FreedBytes", freed)
+	return nil
+}
+
+// capacityUsage returns the sizes of the stored blobs, the bytes they use and the bytes required to
+// additionally store the blobs with the given descriptors, along with their digests.
+func (l *Layout) capacityUsage(ctx context.Context, descs []ocispec.Descriptor) (sizes map[digest.Digest]int64, used, required int64, newBlobs sets.Set[digest.Digest], err error) {
+	sizes = make(map[digest.Digest]int64)
+	if err := l.store.Walk(ctx, func(info content.Info) error {
+		sizes[info.Digest] = info.Size
+		used += info.Size
+		return nil
+	}); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, 0, 0, nil, fmt.Errorf("error computing layout size: %w", err)
+	}
+
+	newBlobs = sets.New[digest.Digest]()
+	for _, desc := range descs {
+		// Blobs without size information cannot be accounted for before they are written.
+		if _, ok := sizes[desc.Digest]; !ok && !newBlobs.Has(desc.Digest) && imageutil.HasKnownSize(desc) {
+			required += desc.Size
+		}
+		newBlobs.Insert(desc.Digest)
+	}
+	return sizes, used, required, newBlobs, nil
+}
+
+// deleteUnleasedBlobs deletes the given blobs, except the ones leased meanwhile.
+func (l *Layout) deleteUnleasedBlobs(ctx context.Context, blobs []digest.Digest) error {
+	_, leased, err := l.leased()
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if leased.Has(blob) {
+			continue
+		}
+		if err := l.store.Delete(ctx, blob); err != nil && !errdefs.IsNotFound(err) {
+			return fmt.Errorf("error deleting blob %s: %w", blob, err)
+		}
+	}
+	return nil
+}
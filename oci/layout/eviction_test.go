@@ -0,0 +1,133 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Eviction", func() {
+	var (
+		ctx    context.Context
+		layout *Layout
+	)
+
+	// newImage creates an image with a single layer of the given size.
+	newImage := func(name string, size int) ociimage.Image {
+		data := make([]byte, size)
+		copy(data, name)
+		img, err := imageutil.NewBytesConfigBuilder([]byte(name), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer(data, imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	indexedDigests := func() []digest.Digest {
+		descs, err := layout.Indexer().List(ctx, descriptormatcher.Every)
+		Expect(err).NotTo(HaveOccurred())
+		var res []digest.Digest
+		for _, desc := range descs {
+			res = append(res, desc.Digest)
+		}
+		return res
+	}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		l, err := New(GinkgoT().TempDir(), WithMaxSize(3500))
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+	})
+
+	It("should evict the least recently used image", func() {
+		first, second, third := newImage("first", 1000), newImage("second", 1000), newImage("third", 1000)
+		Expect(layout.AddImage(ctx, first)).To(Succeed())
+		Expect(layout.AddImage(ctx, second)).To(Succeed())
+
+		By("accessing the first image")
+		desc, err := layout.Indexer().Find(ctx, descriptormatcher.Digests(first.Descriptor().Digest))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = layout.Image(ctx, desc)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("adding a third image exceeding the max size")
+		Expect(layout.AddImage(ctx, third)).To(Succeed())
+		Expect(indexedDigests()).To(ConsistOf(first.Descriptor().Digest, third.Descriptor().Digest))
+
+		_, err = layout.Store().Info(ctx, second.Descriptor().Digest)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should never evict pinned images and fail if the image does not fit", func() {
+		first, second := newImage("first", 1500), newImage("second", 1500)
+		Expect(layout.AddImage(ctx, first)).To(Succeed())
+		Expect(layout.Indexer().Update(ctx, descriptormatcher.Every, func(desc ocispec.Descriptor) ocispec.Descriptor {
+			return indexer.WithAnnotation(desc, PinnedAnnotation, "true")
+		})).To(Succeed())
+
+		Expect(layout.AddImage(ctx, second)).To(MatchError(ErrInsufficientCapacity))
+		Expect(indexedDigests()).To(ConsistOf(first.Descriptor().Digest))
+	})
+
+	It("should record accesses at most once per interval", func() {
+		img := newImage("image", 1000)
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+
+		access := func() string {
+			desc, err := layout.Indexer().Find(ctx, descriptormatcher.Digests(img.Descriptor().Digest))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = layout.Image(ctx, desc)
+			Expect(err).NotTo(HaveOccurred())
+
+			desc, err = layout.Indexer().Find(ctx, descriptormatcher.Digests(img.Descriptor().Digest))
+			Expect(err).NotTo(HaveOccurred())
+			return desc.Annotations[LastAccessedAtAnnotation]
+		}
+		first := access()
+		Expect(first).NotTo(BeEmpty())
+		Expect(access()).To(Equal(first))
+	})
+
+	It("should return images if recording the access fails", func() {
+		img := newImage("image", 1000)
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+		desc, err := layout.Indexer().Find(ctx, descriptormatcher.Digests(img.Descriptor().Digest))
+		Expect(err).NotTo(HaveOccurred())
+
+		By("making the index lock unavailable")
+		lockPath := filepath.Join(layout.Path(), indexer.LockFilename)
+		Expect(os.Remove(lockPath)).To(Succeed())
+		Expect(os.Mkdir(lockPath, 0755)).To(Succeed())
+
+		_, err = layout.Image(ctx, desc)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
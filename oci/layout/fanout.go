@@ -0,0 +1,365 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/go-logr/logr"
+	"github.com/onmetal/onmetal-image/batch"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/onmetal/onmetal-image/utils/fsutil"
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	"github.com/opencontainers/go-digest"
+)
+
+// fanOutBufferSize is the size of the chunks read from the source and written to all destinations.
+const fanOutBufferSize = 1 << 20
+
+// WriteImage writes all blobs of the image to each of the destination layouts, reading each blob from
+// the image only once and writing it to all destinations lacking it concurrently. Destinations another
+// caller or process is already writing a blob to wait for that write instead, see writeBlob. The content is verified
+// against its descriptor once while reading, before any destination commits it.
+// No index entries are added, see AddImage. The returned results correspond to dests: a destination
+// failing does not prevent writing to the others, and the bytes of a result are the bytes written to it.
+func WriteImage(ctx context.Context, image ociimage.Image, dests ...*Layout) []batch.Result {
+	results := make([]batch.Result, len(dests))
+	seen := make(map[string]struct{}, len(dests))
+	for i, dest := range dests {
+		results[i] = batch.Result{Name: dest.path, Digest: image.Descriptor().Digest}
+		if _, ok := seen[dest.path]; ok {
+			results[i].Err = fmt.Errorf("duplicate destination layout %s", dest.path)
+			continue
+		}
+		seen[dest.path] = struct{}{}
+
+		if err := dest.ensureCapacity(ctx, image); err != nil {
+			results[i].Err = err
+		}
+	}
+
+	layers, err := writeLayers(ctx, image)
+	if err != nil {
+		for i := range results {
+			if results[i].Err == nil {
+				results[i].Err = fmt.Errorf("error getting image write layers: %w", err)
+			}
+		}
+		return results
+	}
+
+	var (
+		written  = make([][]digest.Digest, len(dests))
+		reporter = progress.FromContext(ctx)
+	)
+	for _, layer := range layers {
+		desc := layer.Descriptor()
+
+		var targets []*Layout
+		var indices []int
+		for i, dest := range dests {
+			if results[i].Err != nil {
+				continue
+			}
+			if ocicontent.Exists(ctx, dest.store, desc) {
+				continue
+			}
+			targets = append(targets, dest)
+			indices = append(indices, i)
+		}
+		if len(targets) == 0 {
+			reporter.Report(progress.BlobDone{Digest: desc.Digest, Total: progress.Total(desc), Skipped: true})
+			continue
+		}
+
+		// Destinations another caller is writing the blob to wait for it instead, see writeBlob.
+		var (
+			claims         []*blobClaim
+			claimed        []*Layout
+			claimedIndices []int
+			busy           []int
+		)
+		for j, dest := range targets {
+			i := indices[j]
+			claim, _, err := dest.claimBlob(ctx, desc)
+			switch {
+			case err != nil:
+				results[i].Err = err
+			case claim == nil:
+				busy = append(busy, i)
+			default:
+				claims = append(claims, claim)
+				claimed = append(claimed, dest)
+				claimedIndices = append(claimedIndices, i)
+			}
+		}
+
+		var committed bool
+		if len(claimed) > 0 {
+			size, errs := fanOutLayer(ctx, layer, claimed)
+			for _, claim := range claims {
+				claim.release(ctx)
+			}
+			for j, err := range errs {
+				i := claimedIndices[j]
+				if err != nil {
+					if errors.Is(err, ocicontent.ErrNoSpace) {
+						dests[i].removeBlobs(ctx, written[i])
+					}
+					results[i].Err = &ocicontent.BlobError{Descriptor: desc, Err: err}
+					continue
+				}
+				written[i] = append(written[i], desc.Digest)
+				results[i].Bytes += size
+				committed = true
+			}
+			if committed {
+				reporter.Report(progress.BlobDone{Digest: desc.Digest, Total: size})
+			}
+		}
+
+		for _, i := range busy {
+			wrote, err := dests[i].writeBlob(ctx, layer)
+			if err != nil {
+				if errors.Is(err, ocicontent.ErrNoSpace) {
+					dests[i].removeBlobs(ctx, written[i])
+				}
+				results[i].Err = &ocicontent.BlobError{Descriptor: desc, Err: err}
+				continue
+			}
+			if wrote {
+				written[i] = append(written[i], desc.Digest)
+				results[i].Bytes += desc.Size
+			}
+		}
+	}
+	return results
+}
+
+// fanOutLayer writes the content of the layer to the stores of all given layouts. It returns the number of
+// bytes read and an error per layout, nil if the layer was committed to it. Layers without size information
+// (see imageutil.HasKnownSize) are only verified against their digest.
+func fanOutLayer(ctx context.Context, layer ociimage.Layer, dests []*Layout) (int64, []error) {
+	var (
+		desc    = layer.Descriptor()
+		refs    = make([]string, len(dests))
+		errs    = make([]error, len(dests))
+		writers = make([]content.Writer, len(dests))
+		active  int
+	)
+	defer func() {
+		for _, w := range writers {
+			if w != nil {
+				_ = w.Close()
+			}
+		}
+	}()
+
+	// fail records the error for the destination and discards its partial ingest.
+	var written int64
+	fail := func(i int, err error) {
+		if fsutil.IsNoSpace(err) {
+			needed := desc.Size - written
+			if needed < 0 {
+				needed = 0
+			}
+			err = &ocicontent.NoSpaceError{Digest: desc.Digest, Needed: needed, Err: err}
+		}
+		errs[i] = err
+		if writers[i] != nil {
+			_ = writers[i].Close()
+			writers[i] = nil
+			active--
+		}
+		_ = dests[i].store.Abort(ctx, refs[i])
+	}
+
+	for i, dest := range dests {
+		// Ingest locks are held per ref across all stores of the process, so each destination needs its own.
+		refs[i] = fmt.Sprintf("%s-%s", remotes.MakeRefKey(ctx, desc), digest.FromString(dest.path).Encoded()[:12])
+		w, err := content.OpenWriter(ctx, dest.store, content.WithRef(refs[i]), content.WithDescriptor(desc))
+		if err != nil {
+			if !errdefs.IsAlreadyExists(err) {
+				errs[i] = fmt.Errorf("error opening writer: %w", err)
+			}
+			continue
+		}
+		writers[i] = w
+		active++
+		ocicontent.RecordIngest(ctx, dest.store, refs[i], desc)
+	}
+	if active == 0 {
+		return 0, errs
+	}
+
+	// Interrupted ingests are resumed if all destinations stopped at the same offset, which is the common
+	// case of a single destination, and restarted from scratch otherwise.
+	var offsets []int64
+	for _, w := range writers {
+		if w == nil {
+			continue
+		}
+		var offset int64
+		if status, err := w.Status(); err == nil {
+			offset = ocicontent.ResumeOffset(status, desc)
+		}
+		offsets = append(offsets, offset)
+	}
+	resumeAt := offsets[0]
+	for _, offset := range offsets[1:] {
+		if offset != resumeAt {
+			resumeAt = 0
+		}
+	}
+
+	failActive := func(err error) {
+		for i, w := range writers {
+			if w != nil {
+				fail(i, err)
+			}
+		}
+	}
+
+	rc, resumed, err := ocicontent.OpenContentAt(ctx, layer, resumeAt)
+	if err != nil {
+		failActive(fmt.Errorf("error opening content: %w", err))
+		return 0, errs
+	}
+	defer func() { _ = rc.Close() }()
+	if !resumed {
+		resumeAt = 0
+		for i, w := range writers {
+			if w == nil {
+				continue
+			}
+			if status, err := w.Status(); err == nil && status.Offset > 0 {
+				if err := w.Truncate(0); err != nil {
+					fail(i, fmt.Errorf("error truncating ingest: %w", err))
+				}
+			}
+		}
+		if active == 0 {
+			return 0, errs
+		}
+	}
+
+	reporter := progress.FromContext(ctx)
+	reporter.Report(progress.BlobStarted{Digest: desc.Digest, MediaType: desc.MediaType, Total: progress.Total(desc)})
+	if resumed {
+		logr.FromContextOrDiscard(ctx).Info("Resuming interrupted download", "Digest", desc.Digest, "Offset", resumeAt, "Total", desc.Size)
+		reporter.Report(progress.BlobResumed{Digest: desc.Digest, Offset: resumeAt, Total: desc.Size})
+	}
+	// The digest of resumed ingests covers content read by an earlier process, it is verified on commit.
+	r, err := ioutils.NewReader(ctx, rc, desc,
+		ioutils.WithOffset(resumeAt, nil),
+		ioutils.WithProgress(progress.ReportInterval, progress.BlobProgressFunc(reporter, desc)),
+	)
+	if err != nil {
+		failActive(fmt.Errorf("error reading content: %w", err))
+		return resumeAt, errs
+	}
+
+	buf := make([]byte, fanOutBufferSize)
+	written = resumeAt
+	for active > 0 {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			chunk := buf[:n]
+			writeErrs := forEachWriter(writers, func(w content.Writer) error {
+				_, err := w.Write(chunk)
+				return err
+			})
+			for i, err := range writeErrs {
+				if err != nil {
+					fail(i, fmt.Errorf("error writing data: %w", err))
+				}
+			}
+			written += int64(n)
+		}
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if errors.Is(readErr, ioutils.ErrSizeMismatch) || errors.Is(readErr, ioutils.ErrDigestMismatch) {
+			failActive(fmt.Errorf("content does not match descriptor: %w", readErr))
+			return written, errs
+		}
+		if readErr != nil {
+			failActive(fmt.Errorf("error reading content: %w", readErr))
+			return written, errs
+		}
+	}
+	if active == 0 {
+		return written, errs
+	}
+
+	// Without size information only the digest can be verified. A commit size of zero skips the size validation.
+	var size int64
+	if imageutil.HasKnownSize(desc) {
+		size = desc.Size
+	}
+
+	commitErrs := forEachWriter(writers, func(w content.Writer) error {
+		if err := w.Commit(ctx, size, desc.Digest); err != nil && !errdefs.IsAlreadyExists(err) {
+			return err
+		}
+		return nil
+	})
+	for i, err := range commitErrs {
+		if err != nil {
+			fail(i, fmt.Errorf("error committing data: %w", err))
+		}
+	}
+	return written, errs
+}
+
+// forEachWriter concurrently calls fn for all non-nil writers and returns the errors by writer index.
+func forEachWriter(writers []content.Writer, fn func(w content.Writer) error) []error {
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(writers))
+	)
+	for i, w := range writers {
+		if w == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, w content.Writer) {
+			defer wg.Done()
+			errs[i] = fn(w)
+		}(i, w)
+	}
+	wg.Wait()
+	return errs
+}
+
+// removeBlobs removes the given blobs from the store, e.g. after running out of space.
+func (l *Layout) removeBlobs(ctx context.Context, dgsts []digest.Digest) {
+	log := logr.FromContextOrDiscard(ctx)
+	for _, dgst := range dgsts {
+		if err := l.store.Delete(ctx, dgst); err != nil && !errdefs.IsNotFound(err) {
+			log.Error(err, "Error removing blob after running out of space", "Digest", dgst)
+		}
+	}
+}
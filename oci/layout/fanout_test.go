@@ -0,0 +1,162 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync/atomic"
+
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// countingImage counts how often the content of its layers is opened.
+type countingImage struct {
+	ociimage.Image
+	opens   *atomic.Int32
+	corrupt bool
+}
+
+func (i countingImage) Layers(ctx context.Context) ([]ociimage.Layer, error) {
+	layers, err := i.Image.Layers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]ociimage.Layer, len(layers))
+	for j, layer := range layers {
+		res[j] = countingLayer{layer, i.opens, i.corrupt}
+	}
+	return res, nil
+}
+
+type countingLayer struct {
+	ociimage.Layer
+	opens   *atomic.Int32
+	corrupt bool
+}
+
+func (l countingLayer) Content(ctx context.Context) (io.ReadCloser, error) {
+	l.opens.Add(1)
+	if l.corrupt {
+		return io.NopCloser(bytes.NewReader(make([]byte, l.Descriptor().Size))), nil
+	}
+	return l.Layer.Content(ctx)
+}
+
+var _ = Describe("WriteImage", func() {
+	var (
+		ctx          context.Context
+		first, other *Layout
+		opens        *atomic.Int32
+	)
+
+	newImage := func(corrupt bool) ociimage.Image {
+		img, err := imageutil.NewBytesConfigBuilder([]byte("config"), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer(bytes.Repeat([]byte("layer"), 1000), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		return countingImage{img, opens, corrupt}
+	}
+
+	layerDigest := func(img ociimage.Image) ocispec.Descriptor {
+		layers, err := img.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		return layers[0].Descriptor()
+	}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		var err error
+		first, err = New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		other, err = New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		opens = &atomic.Int32{}
+	})
+
+	It("should read each blob once and write it to all destinations", func() {
+		img := newImage(false)
+		results := WriteImage(ctx, img, first, other)
+		Expect(results).To(HaveLen(2))
+		for _, result := range results {
+			Expect(result.Err).NotTo(HaveOccurred())
+			Expect(result.Digest).To(Equal(img.Descriptor().Digest))
+		}
+		Expect(results[0].Name).To(Equal(first.Path()))
+		Expect(results[1].Name).To(Equal(other.Path()))
+		Expect(opens.Load()).To(BeEquivalentTo(1))
+
+		for _, l := range []*Layout{first, other} {
+			_, err := l.Store().Info(ctx, layerDigest(img).Digest)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = l.Store().Info(ctx, img.Descriptor().Digest)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("not indexing the image")
+			descs, err := l.Indexer().List(ctx, descriptormatcher.Every)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(descs).To(BeEmpty())
+		}
+	})
+
+	It("should only write blobs to the destinations lacking them", func() {
+		img := newImage(false)
+		Expect(first.AddImage(ctx, img)).To(Succeed())
+		opens.Store(0)
+
+		results := WriteImage(ctx, img, first, other)
+		Expect(results[0].Err).NotTo(HaveOccurred())
+		Expect(results[0].Bytes).To(BeZero())
+		Expect(results[1].Err).NotTo(HaveOccurred())
+		Expect(results[1].Bytes).To(BeNumerically(">", layerDigest(img).Size))
+		Expect(opens.Load()).To(BeEquivalentTo(1))
+	})
+
+	It("should report failing destinations independently", func() {
+		full, err := New(GinkgoT().TempDir(), WithMaxSize(100))
+		Expect(err).NotTo(HaveOccurred())
+
+		results := WriteImage(ctx, newImage(false), full, other)
+		Expect(results[0].Err).To(MatchError(ErrInsufficientCapacity))
+		Expect(results[1].Err).NotTo(HaveOccurred())
+	})
+
+	It("should reject the same destination twice", func() {
+		results := WriteImage(ctx, newImage(false), first, first)
+		Expect(results[0].Err).NotTo(HaveOccurred())
+		Expect(results[1].Err).To(HaveOccurred())
+	})
+
+	It("should not commit content not matching its digest to any destination", func() {
+		img := newImage(true)
+		results := WriteImage(ctx, img, first, other)
+		Expect(opens.Load()).To(BeEquivalentTo(1))
+		for i, l := range []*Layout{first, other} {
+			Expect(results[i].Err).To(MatchError(ContainSubstring("does not match descriptor")))
+			_, err := l.Store().Info(ctx, layerDigest(img).Digest)
+			Expect(err).To(HaveOccurred())
+		}
+	})
+})
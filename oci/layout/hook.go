@@ -0,0 +1,131 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/go-logr/logr"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/opencontainers/go-digest"
+)
+
+// CommitHook decides whether an image may be added to the layout, e.g. to enforce an admission policy
+// on signatures, labels or base images. It is called with the image as read from the layout after all
+// of its blobs were written and before it is added to the index. Returning an error rejects the image.
+type CommitHook func(ctx context.Context, img ociimage.Image) error
+
+// ErrRejected is wrapped by the errors of AddImage and ReplaceImage if a CommitHook rejected the image.
+var ErrRejected = errors.New("image rejected by commit hook")
+
+// WithCommitHook adds a hook deciding whether images may be added to the layout.
+// Hooks run in the order they were added, the first one rejecting an image stops the others.
+func WithCommitHook(hook CommitHook) Option {
+	return func(o *Options) {
+		o.CommitHooks = append(o.CommitHooks, hook)
+	}
+}
+
+// ExecCommitHook returns a CommitHook running the executable at path with the manifest of the image on
+// its stdin. The image digest is passed in the ONMETAL_IMAGE_DIGEST environment variable. A nonzero exit
+// status rejects the image, the output of the executable is included in the error.
+func ExecCommitHook(path string, args ...string) CommitHook {
+	return func(ctx context.Context, img ociimage.Image) error {
+		rc, err := img.Content(ctx)
+		if err != nil {
+			return fmt.Errorf("error getting manifest: %w", err)
+		}
+		data, err := io.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			return fmt.Errorf("error reading manifest: %w", err)
+		}
+
+		var out bytes.Buffer
+		cmd := exec.CommandContext(ctx, path, args...)
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		cmd.Env = append(cmd.Environ(), "ONMETAL_IMAGE_DIGEST="+img.Descriptor().Digest.String())
+		if err := cmd.Run(); err != nil {
+			if msg := strings.TrimSpace(out.String()); msg != "" {
+				return fmt.Errorf("%s: %w: %s", path, err, msg)
+			}
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	}
+}
+
+// commit runs the commit hooks on the image written to the layout. If one rejects it, the blobs of the
+// image not referenced by any image of the index are removed again.
+func (l *Layout) commit(ctx context.Context, image ociimage.Image) error {
+	if err := l.runCommitHooks(ctx, image); err != nil {
+		l.removeUnreferenced(ctx, image)
+		return err
+	}
+	return nil
+}
+
+// runCommitHooks runs the commit hooks on the image written to the layout.
+func (l *Layout) runCommitHooks(ctx context.Context, image ociimage.Image) error {
+	if len(l.commitHooks) == 0 {
+		return nil
+	}
+
+	img := l.View(image.Descriptor())
+	for _, hook := range l.commitHooks {
+		if err := hook(ctx, img); err != nil {
+			return fmt.Errorf("%w %s: %w", ErrRejected, image.Descriptor().Digest, err)
+		}
+	}
+	return nil
+}
+
+// removeUnreferenced removes the blobs of the image that no image of the index references and that are
+// not being written concurrently. Failing to remove them is only logged, they are garbage collected later.
+func (l *Layout) removeUnreferenced(ctx context.Context, image ociimage.Image) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	layers, err := writeLayers(ctx, image)
+	if err != nil {
+		log.Error(err, "Error getting blobs of rejected image", "Digest", image.Descriptor().Digest)
+		return
+	}
+	refs, err := l.RefCounts(ctx)
+	if err != nil {
+		log.Error(err, "Error getting reference counts to remove blobs of rejected image", "Digest", image.Descriptor().Digest)
+		return
+	}
+
+	removed := make(map[digest.Digest]bool)
+	for _, layer := range layers {
+		dgst := layer.Descriptor().Digest
+		if removed[dgst] || refs[dgst] > 0 || l.blobBusy(dgst) {
+			continue
+		}
+		removed[dgst] = true
+		if err := l.store.Delete(ctx, dgst); err != nil && !errdefs.IsNotFound(err) {
+			log.Error(err, "Error removing blob of rejected image", "Digest", dgst)
+		}
+	}
+}
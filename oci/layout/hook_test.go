@@ -0,0 +1,123 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("CommitHook", func() {
+	var (
+		ctx    context.Context
+		shared = []byte("shared-layer")
+	)
+
+	newImage := func(name string) ociimage.Image {
+		img, err := imageutil.NewBytesConfigBuilder([]byte(name), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer(shared, imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			BytesLayer([]byte(name+"-layer"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	exists := func(layout *Layout, dgst digest.Digest) bool {
+		_, err := layout.Store().Info(ctx, dgst)
+		if errdefs.IsNotFound(err) {
+			return false
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return true
+	}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+	})
+
+	It("should reject images and remove their blobs not referenced by other images", func() {
+		errDenied := errors.New("denied")
+		layout, err := New(GinkgoT().TempDir(), WithCommitHook(func(ctx context.Context, img ociimage.Image) error {
+			config, err := img.Config(ctx)
+			if err != nil {
+				return err
+			}
+			rc, err := config.Content(ctx)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = rc.Close() }()
+			data, err := io.ReadAll(rc)
+			if err != nil {
+				return err
+			}
+			if string(data) == "rejected" {
+				return errDenied
+			}
+			return nil
+		}))
+		Expect(err).NotTo(HaveOccurred())
+
+		accepted, rejected := newImage("accepted"), newImage("rejected")
+		Expect(layout.AddImage(ctx, accepted)).To(Succeed())
+
+		err = layout.ReplaceImage(ctx, rejected, descriptormatcher.Name("rejected"))
+		Expect(err).To(MatchError(ErrRejected))
+		Expect(err).To(MatchError(errDenied))
+
+		_, err = layout.Indexer().Find(ctx, descriptormatcher.Digests(rejected.Descriptor().Digest))
+		Expect(err).To(HaveOccurred())
+
+		layers, err := rejected.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exists(layout, rejected.Descriptor().Digest)).To(BeFalse())
+		Expect(exists(layout, layers[1].Descriptor().Digest)).To(BeFalse())
+		Expect(exists(layout, digest.FromBytes(shared))).To(BeTrue(), "the layer shared with the accepted image must be kept")
+	})
+
+	It("should run an executable hook with the manifest on stdin", func() {
+		dir := GinkgoT().TempDir()
+		manifestFile := filepath.Join(dir, "manifest.json")
+		hook := filepath.Join(dir, "hook")
+		Expect(os.WriteFile(hook, []byte("#!/bin/sh\ncat > "+manifestFile+"\necho \"$ONMETAL_IMAGE_DIGEST denied\" >&2\nexit 1\n"), 0755)).To(Succeed())
+
+		layout, err := New(filepath.Join(dir, "store"), WithCommitHook(ExecCommitHook(hook)))
+		Expect(err).NotTo(HaveOccurred())
+
+		img := newImage("image")
+		err = layout.AddImage(ctx, img)
+		Expect(err).To(MatchError(ErrRejected))
+		Expect(err).To(MatchError(ContainSubstring(img.Descriptor().Digest.String() + " denied")))
+
+		manifest, err := os.ReadFile(manifestFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(digest.FromBytes(manifest)).To(Equal(img.Descriptor().Digest))
+	})
+})
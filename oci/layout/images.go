@@ -0,0 +1,198 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Resolve determines which parts of the images are read eagerly when listing images.
+type Resolve int
+
+const (
+	// ResolveNone returns lazy images that read their manifest on each access.
+	ResolveNone Resolve = iota
+	// ResolveManifest reads and caches the manifest of each image.
+	ResolveManifest
+	// ResolveManifestAndConfig reads and caches the manifest and config of each image.
+	ResolveManifestAndConfig
+)
+
+// DefaultImagesConcurrency is the default number of images resolved concurrently.
+const DefaultImagesConcurrency = 8
+
+// ImagesOptions are options for listing images.
+type ImagesOptions struct {
+	// Resolve determines which parts of the images are read eagerly. Defaults to ResolveNone.
+	Resolve Resolve
+	// Concurrency is the maximum number of images resolved concurrently. Defaults to DefaultImagesConcurrency.
+	Concurrency int
+}
+
+// ImagesOption is an option for listing images.
+type ImagesOption func(o *ImagesOptions)
+
+// WithResolve sets which parts of the images are read eagerly.
+func WithResolve(resolve Resolve) ImagesOption {
+	return func(o *ImagesOptions) {
+		o.Resolve = resolve
+	}
+}
+
+// WithConcurrency sets the maximum number of images resolved concurrently.
+func WithConcurrency(concurrency int) ImagesOption {
+	return func(o *ImagesOptions) {
+		o.Concurrency = concurrency
+	}
+}
+
+// Images lists all images.
+// With WithResolve, manifests (and configs) are read upfront by a bounded pool of workers and cached on the
+// returned images. Errors resolving an individual image do not fail the listing but are returned when
+// accessing the affected part of that image.
+func (l *Layout) Images(ctx context.Context, opts ...ImagesOption) ([]ociimage.Image, error) {
+	o := &ImagesOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultImagesConcurrency
+	}
+
+	descs, err := l.indexer.List(ctx, descriptormatcher.Every)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]ociimage.Image, len(descs))
+	if o.Resolve == ResolveNone {
+		for i, desc := range descs {
+			res[i] = ocicontent.Image(l.store, desc)
+		}
+		return res, nil
+	}
+
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, o.Concurrency)
+	)
+	for i, desc := range descs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, desc ocispec.Descriptor) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			res[i] = resolveImage(ctx, l.store, desc, o.Resolve)
+		}(i, desc)
+	}
+	wg.Wait()
+	return res, nil
+}
+
+// resolvedImage is an image whose manifest and optionally config were read upfront.
+type resolvedImage struct {
+	provider   content.Provider
+	descriptor ocispec.Descriptor
+
+	manifest *ocispec.Manifest
+	config   ociimage.Layer
+	err      error
+}
+
+func resolveImage(ctx context.Context, provider content.Provider, desc ocispec.Descriptor, resolve Resolve) *resolvedImage {
+	img := &resolvedImage{provider: provider, descriptor: desc}
+
+	manifest, err := ocicontent.Image(provider, desc).Manifest(ctx)
+	if err != nil {
+		img.err = err
+		return img
+	}
+	img.manifest = manifest
+
+	if resolve >= ResolveManifestAndConfig {
+		data, err := content.ReadBlob(ctx, provider, manifest.Config)
+		if err != nil {
+			img.err = fmt.Errorf("error reading config %s: %w", manifest.Config.Digest, err)
+			return img
+		}
+		img.config = imageutil.BytesLayer(data, func(d *ocispec.Descriptor) {
+			*d = manifest.Config
+		})
+	}
+	return img
+}
+
+func (i *resolvedImage) Descriptor() ocispec.Descriptor {
+	return i.descriptor
+}
+
+func (i *resolvedImage) Content(ctx context.Context) (io.ReadCloser, error) {
+	return ocicontent.Image(i.provider, i.descriptor).Content(ctx)
+}
+
+func (i *resolvedImage) Manifest(ctx context.Context) (*ocispec.Manifest, error) {
+	if i.manifest == nil {
+		return nil, i.err
+	}
+	return i.manifest, nil
+}
+
+func (i *resolvedImage) Config(ctx context.Context) (ociimage.Layer, error) {
+	if i.manifest == nil {
+		return nil, i.err
+	}
+	if i.config == nil {
+		if i.err != nil {
+			return nil, i.err
+		}
+		return ocicontent.Layer(i.provider, i.manifest.Config), nil
+	}
+	return i.config, nil
+}
+
+func (i *resolvedImage) Layers(ctx context.Context) ([]ociimage.Layer, error) {
+	if i.manifest == nil {
+		return nil, i.err
+	}
+
+	layers := make([]ociimage.Layer, 0, len(i.manifest.Layers))
+	for _, desc := range i.manifest.Layers {
+		layers = append(layers, ocicontent.Layer(i.provider, desc))
+	}
+	return layers, nil
+}
+
+func (i *resolvedImage) Complete(ctx context.Context) (bool, []ocispec.Descriptor, error) {
+	if i.manifest == nil {
+		return false, nil, i.err
+	}
+	missing, err := ocicontent.Missing(ctx, i.provider, append([]ocispec.Descriptor{i.manifest.Config}, i.manifest.Layers...)...)
+	if err != nil {
+		return false, nil, err
+	}
+	return len(missing) == 0, missing, nil
+}
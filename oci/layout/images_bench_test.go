@@ -0,0 +1,80 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const benchImages = 500
+
+func benchLayout(b *testing.B) *Layout {
+	ctx := context.Background()
+	l, err := New(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < benchImages; i++ {
+		name := fmt.Sprintf("image-%d", i)
+		img, err := imageutil.NewBytesConfigBuilder([]byte(name), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer([]byte(name+"-layer"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Complete()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := l.AddImage(ctx, img); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return l
+}
+
+func benchmarkImages(b *testing.B, opts ...ImagesOption) {
+	ctx := context.Background()
+	l := benchLayout(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		imgs, err := l.Images(ctx, opts...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, img := range imgs {
+			if _, err := img.Manifest(ctx); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := img.Config(ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkImagesSequential reads manifests and configs on access, one image after another.
+func BenchmarkImagesSequential(b *testing.B) {
+	benchmarkImages(b)
+}
+
+// BenchmarkImagesConcurrent resolves manifests and configs upfront with a pool of workers.
+func BenchmarkImagesConcurrent(b *testing.B) {
+	benchmarkImages(b, WithResolve(ResolveManifestAndConfig), WithConcurrency(8))
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Images", func() {
+	var (
+		ctx    context.Context
+		layout *Layout
+	)
+
+	newImage := func(name string) ociimage.Image {
+		img, err := imageutil.NewBytesConfigBuilder([]byte(name), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer([]byte(name+"-layer"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		l, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+	})
+
+	It("should keep a single index entry when adding the same image repeatedly", func() {
+		img := newImage("repeated")
+		for i := 0; i < 3; i++ {
+			Expect(layout.AddImage(ctx, img)).To(Succeed())
+		}
+
+		descs, err := layout.Indexer().List(ctx, descriptormatcher.Every)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(descs).To(HaveLen(1))
+	})
+
+	It("should look up images by digest and reference name", func() {
+		img := newImage("named")
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+		named := img.Descriptor()
+		named.Annotations = map[string]string{ocispec.AnnotationRefName: "foo:latest"}
+		Expect(layout.Indexer().Add(ctx, named)).To(Succeed())
+
+		desc, err := layout.Indexer().Find(ctx, descriptormatcher.Name("foo:latest"))
+		Expect(err).NotTo(HaveOccurred())
+
+		By("changing the annotations of the index entry")
+		Expect(layout.Indexer().Update(ctx, descriptormatcher.Digests(desc.Digest), func(desc ocispec.Descriptor) ocispec.Descriptor {
+			return indexer.WithAnnotation(desc, "example.com/note", "changed")
+		})).To(Succeed())
+
+		resolved, err := layout.Image(ctx, desc)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resolved.Descriptor().Digest).To(Equal(desc.Digest))
+
+		_, err = layout.Image(ctx, img.Descriptor())
+		Expect(err).NotTo(HaveOccurred())
+
+		other := img.Descriptor()
+		other.Annotations = map[string]string{ocispec.AnnotationRefName: "bar:latest"}
+		_, err = layout.Image(ctx, other)
+		Expect(err).To(MatchError(indexer.ErrNotFound))
+	})
+
+	It("should resolve manifests and configs concurrently", func() {
+		for i := 0; i < 20; i++ {
+			Expect(layout.AddImage(ctx, newImage(fmt.Sprintf("image-%d", i)))).To(Succeed())
+		}
+
+		imgs, err := layout.Images(ctx, WithResolve(ResolveManifestAndConfig), WithConcurrency(4))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imgs).To(HaveLen(20))
+
+		for _, img := range imgs {
+			manifest, err := img.Manifest(ctx)
+			Expect(err).NotTo(HaveOccurred())
+
+			config, err := img.Config(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Descriptor()).To(Equal(manifest.Config))
+
+			rc, err := config.Content(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			data, err := io.ReadAll(rc)
+			Expect(rc.Close()).To(Succeed())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(HavePrefix("image-"))
+
+			layers, err := img.Layers(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(layers).To(HaveLen(1))
+		}
+	})
+
+	It("should attach errors to the affected image only", func() {
+		broken := newImage("broken")
+		Expect(layout.AddImage(ctx, broken)).To(Succeed())
+		Expect(layout.AddImage(ctx, newImage("intact"))).To(Succeed())
+
+		manifest, err := broken.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layout.Store().Delete(ctx, manifest.Config.Digest)).To(Succeed())
+
+		imgs, err := layout.Images(ctx, WithResolve(ResolveManifestAndConfig))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imgs).To(HaveLen(2))
+
+		for _, img := range imgs {
+			_, err := img.Config(ctx)
+			if img.Descriptor().Digest == broken.Descriptor().Digest {
+				Expect(err).To(HaveOccurred())
+			} else {
+				Expect(err).NotTo(HaveOccurred())
+			}
+		}
+	})
+
+	It("should only read the manifest with ResolveManifest", func() {
+		img := newImage("manifest-only")
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+
+		imgs, err := layout.Images(ctx, WithResolve(ResolveManifest))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imgs).To(HaveLen(1))
+
+		manifest, err := imgs[0].Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		config, err := imgs[0].Config(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		data, err := content.ReadBlob(ctx, layout.Store(), manifest.Config)
+		Expect(err).NotTo(HaveOccurred())
+		rc, err := config.Content(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		defer func() { _ = rc.Close() }()
+		Expect(io.ReadAll(rc)).To(Equal(data))
+	})
+})
@@ -0,0 +1,79 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/onmetal/onmetal-image/oci/local"
+	"github.com/opencontainers/go-digest"
+)
+
+// IngestStatus is the status of an ingest of the layout.
+type IngestStatus struct {
+	local.IngestInfo
+	// InFlight is set if a writer of this or another process currently holds the blob, otherwise the ingest
+	// was interrupted and is resumed by the next write of the blob unless it is stale.
+	InFlight bool `json:"inFlight"`
+}
+
+// IngestStatus returns the in-flight and interrupted ingests of the store of the layout, see
+// local.Store.IngestStatus.
+func (l *Layout) IngestStatus(ctx context.Context) ([]IngestStatus, error) {
+	infos, err := l.store.IngestStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]IngestStatus, 0, len(infos))
+	for _, info := range infos {
+		res = append(res, IngestStatus{
+			IngestInfo: info,
+			InFlight:   info.Expected != "" && l.blobBusy(info.Expected),
+		})
+	}
+	return res, nil
+}
+
+// blobBusy reports whether a caller of this or another process holds the claim on the blob, see claimBlob.
+func (l *Layout) blobBusy(dgst digest.Digest) bool {
+	l.flightsMu.Lock()
+	_, ok := l.flights[dgst]
+	l.flightsMu.Unlock()
+	if ok {
+		return true
+	}
+
+	path := filepath.Join(l.path, filepath.FromSlash(lockDir), dgst.Encoded()+".lock")
+	if !l.capabilities.Flock {
+		fi, err := os.Stat(path)
+		return err == nil && time.Since(fi.ModTime()) < blobLockStaleAfter
+	}
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	unlock, ok, err := tryLockFile(path)
+	if err != nil {
+		return false
+	}
+	if ok {
+		_ = unlock()
+		return false
+	}
+	return true
+}
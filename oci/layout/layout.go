@@ -16,73 +16,249 @@ package layout
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/go-logr/logr"
 	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
 	"github.com/onmetal/onmetal-image/oci/local"
+	"github.com/onmetal/onmetal-image/oci/migration"
 
 	ocicontent "github.com/onmetal/onmetal-image/oci/content"
 
 	ociimage "github.com/onmetal/onmetal-image/oci/image"
 
 	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/onmetal/onmetal-image/utils/fsutil"
 
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type Layout struct {
+	path string
+	// blobDir is the directory holding the blobs of the layout, path unless split off, see WithBlobDir.
+	blobDir string
 	store   *local.Store
 	indexer *indexer.Indexer
+	maxSize int64
+	// condemnedGracePeriod is the duration after which condemned images are removed when adding images, see
+	// WithCondemnedGracePeriod.
+	condemnedGracePeriod time.Duration
+	// capabilities are the capabilities of the file system of the layout, see fsutil.Probe.
+	capabilities fsutil.Capabilities
+	// adoption is the result of adopting a layout created by another tool when opening it, see adopt.
+	adoption *Adoption
+
+	flightsMu sync.Mutex
+	// flights are the blob writes in progress by digest, see writeBlob.
+	flights map[digest.Digest]*blobFlight
+
+	refsMu sync.Mutex
+	// refs are the last recorded reference counts, see updateRefCounts.
+	refs *refCounts
+
+	commitHooks []CommitHook
+
+	verifyMu sync.Mutex
+	// verifyHooks are called for each blob verified, see Verify.
+	verifyHooks []VerifyHook
+
+	// usage batches the recorded uses of images, see recordUse.
+	usage usageTracker
+}
+
+// Options are options for creating a Layout.
+type Options struct {
+	// MaxSize is the maximum size in bytes of all blobs in the layout.
+	// If adding an image would exceed it, least recently used images are evicted.
+	// Zero means no limit.
+	MaxSize int64
+	// StoreOptions are options for the backing local.Store, e.g. local.WithEncryption.
+	StoreOptions []local.Option
+	// AutoMigrate migrates layouts of an older format version instead of failing, see migration.Migrate.
+	AutoMigrate bool
+	// CommitHooks decide whether images may be added to the layout, see WithCommitHook.
+	CommitHooks []CommitHook
+	// VerifyHooks are called for each blob verified by Layout.Verify, see WithVerifyHook.
+	VerifyHooks []VerifyHook
+	// NoUsageTracking disables recording when and how often images are used, see LastUsedAtAnnotation.
+	NoUsageTracking bool
+	// BlobDir is the directory to keep the blobs in instead of the layout directory, see WithBlobDir.
+	BlobDir string
+	// CondemnedGracePeriod is the duration after which condemned images are removed automatically, see
+	// WithCondemnedGracePeriod. Zero disables removing them automatically.
+	CondemnedGracePeriod time.Duration
+	// NoAudit disables the audit log, see WithAuditDisabled.
+	NoAudit bool
+}
+
+// Option is an option for creating a Layout.
+type Option func(o *Options)
+
+// WithMaxSize sets the maximum size in bytes of all blobs in the layout.
+func WithMaxSize(size int64) Option {
+	return func(o *Options) {
+		o.MaxSize = size
+	}
+}
+
+// WithStoreOptions adds options for the backing local.Store.
+func WithStoreOptions(opts ...local.Option) Option {
+	return func(o *Options) {
+		o.StoreOptions = append(o.StoreOptions, opts...)
+	}
+}
+
+// WithAutoMigrate migrates layouts of an older format version to migration.CurrentVersion when opening
+// them. Without it, opening them fails with a *migration.VersionError.
+func WithAutoMigrate() Option {
+	return func(o *Options) {
+		o.AutoMigrate = true
+	}
+}
+
+// WithoutUsageTracking disables recording when and how often images are used, e.g. for read-only
+// consumers that should not modify the index.
+func WithoutUsageTracking() Option {
+	return func(o *Options) {
+		o.NoUsageTracking = true
+	}
+}
+
+// WithCondemnedGracePeriod removes images condemned longer than the given duration (see CondemnedAtAnnotation)
+// whenever an image is added to the layout, instead of leaving them to Layout.PruneCondemned.
+func WithCondemnedGracePeriod(gracePeriod time.Duration) Option {
+	return func(o *Options) {
+		o.CondemnedGracePeriod = gracePeriod
+	}
+}
+
+// WithAuditDisabled disables appending the mutating operations on the layout to its audit log (see
+// AuditEntry), e.g. for ephemeral CI stores.
+func WithAuditDisabled() Option {
+	return func(o *Options) {
+		o.NoAudit = true
+	}
+}
+
+// WithBlobDir keeps the blobs (blobs/<alg>/ and writes in progress) in the given directory instead of
+// the layout directory, e.g. to put the bulky content on a large slow disk and the index and all other
+// metadata on a fast one. Both directories are recorded in StorageFileName files, so the layout can
+// later be opened without the option. Opening it with a different blob directory fails, as does
+// splitting off the blobs of a layout already holding blobs itself, see SplitBlobs for moving them.
+// The locks of the layout stay in the layout directory.
+func WithBlobDir(dir string) Option {
+	return func(o *Options) {
+		o.BlobDir = dir
+	}
 }
 
 // AddImage adds an image to the layout.
-func (l *Layout) AddImage(ctx context.Context, image ociimage.Image) error {
-	if err := ocicontent.WriteImageToIngester(ctx, l.store, image); err != nil {
+// Adding an image already present in the index does not add a duplicate entry, see indexer.Indexer.Add.
+// Blobs already present with the right size are not read again, pass ocicontent.WithForceRewrite to
+// rewrite them, e.g. to repair a layout.
+// If a commit hook rejects the image, the returned error wraps ErrRejected, see WithCommitHook.
+func (l *Layout) AddImage(ctx context.Context, image ociimage.Image, opts ...ocicontent.WriteOption) error {
+	l.pruneCondemned(ctx)
+	if err := l.ensureCapacity(ctx, image); err != nil {
+		return err
+	}
+
+	if _, err := l.writeImage(ctx, image, opts...); err != nil {
 		return fmt.Errorf("error writing image: %w", err)
 	}
+	if err := l.commit(ctx, image); err != nil {
+		return err
+	}
 
-	if err := l.indexer.Add(ctx, image.Descriptor()); err != nil {
+	if err := l.indexer.Add(withDefaultAuditOperation(ctx, AuditAdd), image.Descriptor()); err != nil {
 		return fmt.Errorf("error adding image %s to index: %w", image.Descriptor().Digest, err)
 	}
 	return nil
 }
 
 // ReplaceImage replaces the target image with the new one.
-func (l *Layout) ReplaceImage(ctx context.Context, image ociimage.Image, match descriptormatcher.Matcher) error {
-	if err := ocicontent.WriteImageToIngester(ctx, l.store, image); err != nil {
+// The target is every index entry match selects, see indexer.Indexer.Replace. Matchers see the full
+// entries including their annotations: descriptormatcher.Name replaces whatever image a reference name
+// currently points to, descriptormatcher.Annotation selects by entry annotation and ImageAnnotation and
+// LayerAnnotation by manifest and layer annotations. Without a matching entry, the image is added.
+// Pass indexer.WithSingleTarget to require exactly one target, which is checked before any blob is
+// written, and indexer.WithExpectedDigest to only replace the target if it was not modified concurrently.
+// Like AddImage, it fails with an error wrapping ErrRejected if a commit hook rejects the image.
+func (l *Layout) ReplaceImage(ctx context.Context, image ociimage.Image, match descriptormatcher.Matcher, opts ...indexer.ReplaceOption) error {
+	l.pruneCondemned(ctx)
+	if err := l.indexer.CheckReplaceTarget(ctx, match, opts...); err != nil {
+		return fmt.Errorf("error replacing image with %s: %w", image.Descriptor().Digest, err)
+	}
+	if err := l.ensureCapacity(ctx, image); err != nil {
+		return err
+	}
+
+	if _, err := l.writeImage(ctx, image); err != nil {
 		return fmt.Errorf("error writing image: %w", err)
 	}
+	if err := l.commit(ctx, image); err != nil {
+		return err
+	}
 
-	if err := l.indexer.Replace(ctx, image.Descriptor(), match); err != nil {
+	if err := l.indexer.Replace(withDefaultAuditOperation(ctx, AuditReplace), image.Descriptor(), match, opts...); err != nil {
 		return fmt.Errorf("error adding image %s to index: %w", image.Descriptor().Digest, err)
 	}
 	return nil
 }
 
-// Image returns the image for the given descriptor.
+// Image returns the image for the given descriptor. The index entry is looked up by the digest and, if
+// the descriptor has one, the reference name, so descriptors whose other annotations changed meanwhile,
+// e.g. by recording an access, still resolve.
 func (l *Layout) Image(ctx context.Context, desc ocispec.Descriptor) (ociimage.Image, error) {
-	desc, err := l.indexer.Find(ctx, descriptormatcher.Equal(desc))
+	match := descriptormatcher.Digests(desc.Digest)
+	if name, ok := desc.Annotations[ocispec.AnnotationRefName]; ok {
+		match = descriptormatcher.And(match, descriptormatcher.Name(name))
+	}
+	desc, err := l.indexer.Find(ctx, match)
 	if err != nil {
 		return nil, fmt.Errorf("could not find descriptor in index: %w", err)
 	}
 
-	return ocicontent.Image(l.store, desc), nil
+	// Recording the access is best-effort, so images of stores on read-only file systems or of stores
+	// owned by another user can still be read.
+	if err := l.touch(ctx, desc); err != nil && !fsutil.IsNotWritable(err) {
+		logr.FromContextOrDiscard(ctx).Error(err, "Error recording access of image", "Digest", desc.Digest)
+	}
+	return l.View(desc), nil
 }
 
-// Images lists all images.
-func (l *Layout) Images(ctx context.Context) ([]ociimage.Image, error) {
-	descs, err := l.indexer.List(ctx, descriptormatcher.Every)
-	if err != nil {
-		return nil, err
+// View returns the image for the given index entry like Image, but without looking it up in the index
+// or recording an access, e.g. for reporting on all images.
+func (l *Layout) View(desc ocispec.Descriptor) ociimage.Image {
+	img := ociimage.Image(ocicontent.Image(l.store, desc))
+	if sizes := BlobSizes(desc); len(sizes) > 0 {
+		img = sizedImage{img, sizes}
 	}
-
-	res := make([]ociimage.Image, 0, len(descs))
-	for _, desc := range descs {
-		res = append(res, ocicontent.Image(l.store, desc))
+	if uncompressed := decompressedLayers(desc); len(uncompressed) > 0 {
+		img = uncompressedImage{img, uncompressed}
+	}
+	if IsPartial(desc) {
+		img = partialImage{img, l.store}
 	}
-	return res, nil
+	return img
+}
+
+// Path returns the directory of the oci layout.
+func (l *Layout) Path() string {
+	return l.path
+}
+
+// BlobDir returns the directory holding the blobs of the oci layout, which is Path unless the blobs are
+// kept separately, see WithBlobDir.
+func (l *Layout) BlobDir() string {
+	return l.blobDir
 }
 
 // Indexer returns the indexer.Indexer of the oci layout.
@@ -95,26 +271,204 @@ func (l *Layout) Store() *local.Store {
 	return l.store
 }
 
+// Capabilities returns the capabilities of the file system of the oci layout as probed when creating it.
+func (l *Layout) Capabilities() fsutil.Capabilities {
+	return l.capabilities
+}
+
+// writeImage writes all blobs of the image to the store, coalescing concurrent writes of the same blob
+// (see writeBlob), and returns the blobs written by this call. If the device runs out of space, they are
+// removed again so no unreferenced partial data is left behind.
+func (l *Layout) writeImage(ctx context.Context, image ociimage.Image, opts ...ocicontent.WriteOption) ([]digest.Digest, error) {
+	o := &ocicontent.WriteOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if _, ok := unwrapContinuing(image); ok {
+		o.ContinueOnError = true
+	}
+
+	layers, err := writeLayers(ctx, image)
+	if err != nil {
+		return nil, fmt.Errorf("error getting image write layers: %w", err)
+	}
+
+	var (
+		written  []digest.Digest
+		report   = &ocicontent.WriteReport{}
+		reporter = progress.FromContext(ctx)
+	)
+	for i, layer := range layers {
+		desc := layer.Descriptor()
+		if !o.ForceRewrite && ocicontent.Exists(ctx, l.store, desc) {
+			reporter.Report(progress.BlobDone{Digest: desc.Digest, Total: progress.Total(desc), Skipped: true})
+			report.Add(desc, nil, true)
+			continue
+		}
+		// writeLayers returns the blobs followed by the manifest, which is only written if all blobs are.
+		if i == len(layers)-1 && len(report.Failed()) > 0 {
+			report.Add(desc, ocicontent.ErrIncompleteImage, false)
+			break
+		}
+
+		wrote, err := l.writeBlob(ctx, layer, opts...)
+		report.Add(desc, err, !wrote)
+		if err != nil {
+			if errors.Is(err, ocicontent.ErrNoSpace) {
+				l.removeBlobs(ctx, written)
+			}
+			if !o.ContinueOnError || errors.Is(err, ocicontent.ErrNoSpace) || ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if wrote {
+			written = append(written, desc.Digest)
+		}
+	}
+	if err := report.Err(); err != nil {
+		return nil, err
+	}
+	return written, nil
+}
+
 const ociLayoutContent = `{"imageLayoutVersion":"1.0.0"}`
 
+// touchInterval is the minimum interval between two recorded accesses of an image, so reading images does not
+// rewrite the index every time.
+const touchInterval = time.Minute
+
+// touch records the current time as last access time on all index entries of the image, unless an access
+// of the index entry was recorded within touchInterval.
+func (l *Layout) touch(ctx context.Context, desc ocispec.Descriptor) error {
+	if v, ok := desc.Annotations[LastAccessedAtAnnotation]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil && time.Since(t) >= 0 && time.Since(t) < touchInterval {
+			return nil
+		}
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	return l.indexer.Update(ctx, descriptormatcher.Digests(desc.Digest), func(desc ocispec.Descriptor) ocispec.Descriptor {
+		return indexer.WithAnnotation(desc, LastAccessedAtAnnotation, now)
+	})
+}
+
+// checkVersion ensures the layout at path has the current format version, migrating it if autoMigrate
+// is set. Layouts of a newer format version are always refused.
+func checkVersion(path string, autoMigrate bool) error {
+	err := migration.Check(path)
+	if !autoMigrate || !errors.Is(err, migration.ErrMigrationRequired) {
+		return err
+	}
+	if _, err := migration.Migrate(context.Background(), path, migration.CurrentVersion); err != nil {
+		return fmt.Errorf("error migrating store %s: %w", path, err)
+	}
+	return nil
+}
+
 // New returns a new oci layout.
-func New(path string) (*Layout, error) {
-	store, err := local.NewStore(path)
+// The path is resolved to its canonical path (see fsutil.CanonicalPath), so a store opened via a symlink
+// records and compares the same paths as when opened directly.
+func New(path string, opts ...Option) (*Layout, error) {
+	o := &Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("error determining absolute store path: %w", err)
+	}
+	if err := os.MkdirAll(path, 0777); err != nil {
+		return nil, fmt.Errorf("error creating store directory: %w", err)
+	}
+	if path, err = fsutil.CanonicalPath(path); err != nil {
+		return nil, fmt.Errorf("error resolving store path: %w", err)
+	}
+	// Checked before creating any files of the store.
+	foreign, err := isForeign(path)
+	if err != nil {
+		return nil, fmt.Errorf("error checking store %s: %w", path, err)
+	}
+	blobDir, err := resolveBlobDir(path, o.BlobDir)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := local.NewStore(blobDir, o.StoreOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("error creating store: %w", err)
 	}
 
-	index, err := indexer.New(filepath.Join(path, indexer.Filename))
+	if !foreign {
+		if err := checkVersion(path, o.AutoMigrate); err != nil {
+			return nil, err
+		}
+	}
+
+	capabilities, err := fsutil.Probe(path)
+	if err != nil {
+		return nil, fmt.Errorf("error probing file system of %s: %w", path, err)
+	}
+	if err := capabilities.Check(); err != nil {
+		return nil, fmt.Errorf("store path %s cannot host a store: %w", path, err)
+	}
+	if blobDir != path {
+		// Blobs are written by renames as well, locks stay in the layout directory.
+		blobCapabilities, err := fsutil.Probe(blobDir)
+		if err != nil {
+			return nil, fmt.Errorf("error probing file system of %s: %w", blobDir, err)
+		}
+		if err := blobCapabilities.Check(); err != nil {
+			return nil, fmt.Errorf("blob directory %s cannot host a store: %w", blobDir, err)
+		}
+	}
+
+	l := &Layout{
+		path:    path,
+		blobDir: blobDir,
+		store:   store,
+		maxSize: o.MaxSize,
+		flights: make(map[digest.Digest]*blobFlight),
+
+		condemnedGracePeriod: o.CondemnedGracePeriod,
+
+		commitHooks: o.CommitHooks,
+		verifyHooks: o.VerifyHooks,
+
+		capabilities: capabilities,
+
+		usage: usageTracker{
+			disabled: o.NoUsageTracking,
+			pending:  make(map[digest.Digest]*pendingUse),
+		},
+	}
+
+	indexerOpts := []indexer.Option{indexer.WithModifyHook(l.modifyHook)}
+	if !o.NoAudit {
+		indexerOpts = append(indexerOpts, indexer.WithDoneHook(l.auditHook))
+	}
+	if !capabilities.Flock {
+		indexerOpts = append(indexerOpts, indexer.WithLockFiles())
+	}
+	index, err := indexer.New(filepath.Join(path, indexer.Filename), indexerOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("error creating indexer: %w", err)
 	}
+	l.indexer = index
+
+	if foreign {
+		if l.adoption, err = l.adopt(context.Background()); err != nil {
+			return nil, fmt.Errorf("error adopting OCI layout %s: %w", path, err)
+		}
+	}
 
 	if err := os.WriteFile(filepath.Join(path, "oci-layout"), []byte(ociLayoutContent), 0666); err != nil {
 		return nil, fmt.Errorf("error writing oci layout: %w", err)
 	}
+	if _, err := l.readLeases(time.Now(), true); err != nil {
+		return nil, fmt.Errorf("error removing expired leases: %w", err)
+	}
 
-	return &Layout{
-		indexer: index,
-		store:   store,
-	}, nil
+	return l, nil
 }
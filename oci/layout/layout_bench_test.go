@@ -0,0 +1,95 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const benchHugeLayerSize = 2 << 30
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// zeroLayer is a layer consisting of size zero bytes, generated on every read.
+type zeroLayer struct {
+	desc ocispec.Descriptor
+}
+
+func newZeroLayer(b *testing.B, size int64) *zeroLayer {
+	dgst, err := digest.Canonical.FromReader(io.LimitReader(zeroReader{}, size))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return &zeroLayer{desc: ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: dgst, Size: size}}
+}
+
+func (l *zeroLayer) Descriptor() ocispec.Descriptor {
+	return l.desc
+}
+
+func (l *zeroLayer) Content(ctx context.Context) (io.ReadCloser, error) {
+	return io.NopCloser(io.LimitReader(zeroReader{}, l.desc.Size)), nil
+}
+
+// BenchmarkAddExistingImage re-adds an image with a multi-GB layer to a layout already containing it,
+// once skipping the existing blobs and once rewriting them.
+func BenchmarkAddExistingImage(b *testing.B) {
+	ctx := context.Background()
+	l, err := New(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	img, err := imageutil.NewBytesConfigBuilder([]byte("huge"), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+		Layers(newZeroLayer(b, benchHugeLayerSize)).
+		Complete()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := l.AddImage(ctx, img); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bc := range []struct {
+		name string
+		opts []ocicontent.WriteOption
+	}{
+		{name: "skip-existing"},
+		{name: "force-rewrite", opts: []ocicontent.WriteOption{ocicontent.WithForceRewrite()}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := l.AddImage(ctx, img, bc.opts...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
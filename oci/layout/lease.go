@@ -0,0 +1,332 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/go-logr/logr"
+	"github.com/onmetal/onmetal-image/utils/sets"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LeasesDir is the directory of the layout holding a file per lease, see Layout.Lease.
+const LeasesDir = "leases"
+
+// DefaultLeaseTTL is the time to live of the leases taken internally by long-running reads, e.g. extracting
+// an image. Leases are renewed while they are held, so it only bounds how long the lease of a crashed
+// process blocks removing an image.
+const DefaultLeaseTTL = time.Minute
+
+// ErrLeased is wrapped by the errors of removing an image that is leased.
+var ErrLeased = errors.New("image is leased")
+
+// LeaseInfo is the persisted state of a lease.
+type LeaseInfo struct {
+	// ID identifies the lease.
+	ID string `json:"id"`
+	// Digest is the digest of the leased image, empty if only blobs are leased, e.g. by a Transaction.
+	Digest digest.Digest `json:"digest"`
+	// Blobs are the blobs of the image at the time it was leased, which are kept even if the image is
+	// rewritten meanwhile, e.g. by recompress.
+	Blobs []digest.Digest `json:"blobs"`
+	// ExpiresAt is the time the lease expires at unless renewed.
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Lease protects an image and its blobs from being removed by eviction or pruning while it is being read,
+// e.g. extracted. It is renewed in the background until released.
+type Lease struct {
+	layout *Layout
+	info   LeaseInfo
+	ttl    time.Duration
+	// log receives errors recording the use of the image when the lease is released.
+	log logr.Logger
+
+	mu   sync.Mutex
+	err  error
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Lease leases the image with the given descriptor for ttl. The lease is persisted in LeasesDir, so other
+// processes honor it as well, and renewed every third of ttl until Release is called. If the process dies,
+// the lease expires after ttl; expired leases are removed when opening the layout.
+// It fails with an error matching errdefs.IsNotFound if the image is not in the index.
+func (l *Layout) Lease(ctx context.Context, desc ocispec.Descriptor, ttl time.Duration) (*Lease, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("lease ttl must be positive")
+	}
+	id, err := newLeaseID()
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &Lease{
+		layout: l,
+		info:   LeaseInfo{ID: id, Digest: desc.Digest},
+		ttl:    ttl,
+		log:    logr.FromContextOrDiscard(ctx),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	// Recording the lease while holding the index lock ensures the image is not removed in between, as
+	// removals check for leases while holding it as well, see deleteImage.
+	if err := l.indexer.Read(ctx, func(index *ocispec.Index) error {
+		var entries []ocispec.Descriptor
+		for _, entry := range index.Manifests {
+			if entry.Digest == desc.Digest {
+				entries = append(entries, entry)
+			}
+		}
+		if len(entries) == 0 {
+			return fmt.Errorf("image %s: %w", desc.Digest, errdefs.ErrNotFound)
+		}
+		lease.info.Blobs = l.imageRefs(ctx, entries)
+		return lease.write()
+	}); err != nil {
+		return nil, fmt.Errorf("error leasing image %s: %w", desc.Digest, err)
+	}
+	l.leaseAcquired(ctx, desc.Digest)
+
+	go lease.renew()
+	return lease, nil
+}
+
+// leaseBlobs leases blobs not referenced by any image yet, e.g. the blobs written by a Transaction before
+// it is committed, like Lease does for the blobs of an image. More blobs are leased with addBlobs.
+func (l *Layout) leaseBlobs(ttl time.Duration) (*Lease, error) {
+	id, err := newLeaseID()
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &Lease{
+		layout: l,
+		info:   LeaseInfo{ID: id},
+		ttl:    ttl,
+		log:    logr.Discard(),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if err := lease.write(); err != nil {
+		return nil, fmt.Errorf("error leasing blobs: %w", err)
+	}
+
+	go lease.renew()
+	return lease, nil
+}
+
+// addBlobs adds the blobs to the lease.
+func (le *Lease) addBlobs(blobs ...digest.Digest) error {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	le.info.Blobs = append(le.info.Blobs, blobs...)
+	return le.write()
+}
+
+func newLeaseID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating lease id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Info returns the current state of the lease.
+func (le *Lease) Info() LeaseInfo {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	return le.info
+}
+
+// Err returns the error of the last failed renewal, if any. The lease may have expired since.
+func (le *Lease) Err() error {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	return le.err
+}
+
+// Release stops renewing the lease and removes it. It is safe to call it multiple times.
+// Releasing the last image lease of the layout writes the recorded uses, see FlushUsage.
+func (le *Lease) Release() error {
+	le.mu.Lock()
+	select {
+	case <-le.stop:
+		le.mu.Unlock()
+		<-le.done
+		return nil
+	default:
+		close(le.stop)
+	}
+	le.mu.Unlock()
+	<-le.done
+
+	if le.info.Digest != "" {
+		if err := le.layout.leaseReleased(logr.NewContext(context.Background(), le.log)); err != nil {
+			le.log.Error(err, "Error recording image usage", "Digest", le.info.Digest)
+		}
+	}
+
+	if err := os.Remove(le.layout.leasePath(le.info.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing lease %s: %w", le.info.ID, err)
+	}
+	return nil
+}
+
+func (le *Lease) renew() {
+	defer close(le.done)
+	ticker := time.NewTicker(le.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-le.stop:
+			return
+		case <-ticker.C:
+			le.mu.Lock()
+			le.err = le.write()
+			le.mu.Unlock()
+		}
+	}
+}
+
+// write persists the lease with an expiry of ttl from now. The caller must hold le.mu or own le exclusively.
+func (le *Lease) write() error {
+	le.info.ExpiresAt = time.Now().Add(le.ttl).UTC()
+	data, err := json.Marshal(le.info)
+	if err != nil {
+		return fmt.Errorf("error marshaling lease: %w", err)
+	}
+
+	dir := filepath.Join(le.layout.path, LeasesDir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("error creating leases directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, "."+le.info.ID+".*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary lease file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error writing lease: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary lease file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), le.layout.leasePath(le.info.ID)); err != nil {
+		return fmt.Errorf("error writing lease: %w", err)
+	}
+	return nil
+}
+
+func (l *Layout) leasePath(id string) string {
+	return filepath.Join(l.path, LeasesDir, id+".json")
+}
+
+// Leases returns the unexpired leases of the layout, of this and other processes.
+func (l *Layout) Leases(ctx context.Context) ([]LeaseInfo, error) {
+	return l.readLeases(time.Now(), false)
+}
+
+// readLeases reads the leases unexpired at now. If removeExpired is set, the files of expired and
+// unreadable leases are removed.
+func (l *Layout) readLeases(now time.Time, removeExpired bool) ([]LeaseInfo, error) {
+	dir := filepath.Join(l.path, LeasesDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading leases: %w", err)
+	}
+
+	var res []LeaseInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			// The lease was released meanwhile.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading lease %s: %w", name, err)
+		}
+
+		var info LeaseInfo
+		if err := json.Unmarshal(data, &info); err != nil || !info.ExpiresAt.After(now) {
+			if removeExpired {
+				_ = os.Remove(path)
+			}
+			continue
+		}
+		res = append(res, info)
+	}
+	return res, nil
+}
+
+// leased returns the leased images and their blobs.
+func (l *Layout) leased() (images, blobs sets.Set[digest.Digest], err error) {
+	leases, err := l.readLeases(time.Now(), false)
+	if err != nil {
+		return nil, nil, err
+	}
+	images, blobs = sets.New[digest.Digest](), sets.New[digest.Digest]()
+	for _, lease := range leases {
+		images.Insert(lease.Digest)
+		blobs.Insert(lease.Blobs...)
+	}
+	return images, blobs, nil
+}
+
+// deleteImage removes all index entries of the image unless it is leased, in which case the returned error
+// wraps ErrLeased. Leases are checked while holding the index lock, see Lease.
+func (l *Layout) deleteImage(ctx context.Context, dgst digest.Digest) error {
+	return l.indexer.Modify(ctx, func(index *ocispec.Index) error {
+		images, _, err := l.leased()
+		if err != nil {
+			return err
+		}
+		if images.Has(dgst) {
+			return fmt.Errorf("%w: %s", ErrLeased, dgst)
+		}
+
+		var remaining []ocispec.Descriptor
+		for _, entry := range index.Manifests {
+			if entry.Digest != dgst {
+				remaining = append(remaining, entry)
+			}
+		}
+		index.Manifests = remaining
+		return nil
+	})
+}
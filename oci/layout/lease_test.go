@@ -0,0 +1,127 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Lease", func() {
+	var (
+		ctx    context.Context
+		path   string
+		layout *Layout
+	)
+
+	newExpiredImage := func(name string) ociimage.Image {
+		img, err := imageutil.NewBytesConfigBuilder([]byte(name), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer([]byte(name+"-layer"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Annotations(map[string]string{imageutil.ExpiresAtAnnotation: time.Now().Add(-time.Hour).Format(time.RFC3339)}).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		path = GinkgoT().TempDir()
+		l, err := New(path)
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+	})
+
+	It("should keep leased images and their blobs when pruning", func() {
+		img := newExpiredImage("leased")
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+
+		lease, err := layout.Lease(ctx, img.Descriptor(), time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(lease.Release)
+		Expect(lease.Info().Blobs).To(HaveLen(3))
+
+		results, err := layout.PruneExpired(ctx, time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(BeEmpty())
+		for _, blob := range lease.Info().Blobs {
+			_, err := layout.Store().Info(ctx, blob)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		By("releasing the lease")
+		Expect(lease.Release()).To(Succeed())
+		Expect(layout.Leases(ctx)).To(BeEmpty())
+		results, err = layout.PruneExpired(ctx, time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].Err).NotTo(HaveOccurred())
+	})
+
+	It("should renew leases until they are released", func() {
+		img := newExpiredImage("renewed")
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+
+		lease, err := layout.Lease(ctx, img.Descriptor(), 300*time.Millisecond)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(lease.Release)
+
+		first := lease.Info().ExpiresAt
+		Eventually(func() time.Time { return lease.Info().ExpiresAt }).Should(BeTemporally(">", first))
+		time.Sleep(400 * time.Millisecond)
+		Expect(lease.Err()).NotTo(HaveOccurred())
+		Expect(layout.Leases(ctx)).To(HaveLen(1))
+	})
+
+	It("should remove expired leases when opening the layout", func() {
+		img := newExpiredImage("crashed")
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+
+		lease, err := layout.Lease(ctx, img.Descriptor(), time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(lease.Release)
+
+		stale := filepath.Join(path, LeasesDir, "stale.json")
+		Expect(os.WriteFile(stale, []byte(`{"id":"stale","digest":"`+img.Descriptor().Digest.String()+`","expiresAt":"2020-01-01T00:00:00Z"}`), 0666)).To(Succeed())
+
+		_, err = New(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stale).NotTo(BeAnExistingFile())
+		Expect(layout.Leases(ctx)).To(ConsistOf(lease.Info()))
+	})
+
+	It("should not lease images missing from the index", func() {
+		img := newExpiredImage("missing")
+		_, err := layout.Lease(ctx, img.Descriptor(), time.Minute)
+		Expect(errdefs.IsNotFound(err)).To(BeTrue())
+
+		descs, err := layout.Indexer().List(ctx, descriptormatcher.Every)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(descs).To(BeEmpty())
+	})
+})
@@ -0,0 +1,99 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/onmetal/onmetal-image/utils/fsutil"
+)
+
+// operationLockDir is the directory of the layout holding the locks of TryLock.
+const operationLockDir = "tmp/locks"
+
+// operationLockStaleAfter is the age after which an operation lock is considered abandoned on file systems
+// without flock support, see fsutil.TryLockFile.
+const operationLockStaleAfter = 6 * time.Hour
+
+// TryLock takes the lock of the operation with the given name on the layout without blocking, e.g. to keep
+// invocations of a command run from cron from overlapping. It reports false if another process or another
+// caller of this process holds it.
+func (l *Layout) TryLock(name string) (unlock func() error, ok bool, err error) {
+	path := filepath.Join(l.path, filepath.FromSlash(operationLockDir), name+".lock")
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, false, fmt.Errorf("error creating lock directory: %w", err)
+	}
+	if l.capabilities.Flock {
+		return tryLockFile(path)
+	}
+	return fsutil.TryLockFile(path, operationLockStaleAfter)
+}
+
+// tryLockFile tries to exclusively lock the file at path without blocking. It reports false if another
+// process (or another open file of this process) holds the lock.
+// The returned unlock function removes the file, so lock files do not accumulate. On Windows, where open
+// files cannot be removed, the file is left in place.
+// On platforms without file locking support, it does not lock across processes, concurrent downloads are
+// then only coalesced within a process.
+func tryLockFile(path string) (unlock func() error, ok bool, err error) {
+	if !fsutil.FlockSupported {
+		return func() error { return nil }, true, nil
+	}
+
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+		if err != nil {
+			return nil, false, err
+		}
+
+		ok, err := fsutil.TryFlock(f)
+		if err != nil || !ok {
+			_ = f.Close()
+			return nil, false, err
+		}
+
+		if runtime.GOOS == "windows" {
+			return func() error {
+				defer func() { _ = f.Close() }()
+				return fsutil.Funlock(f)
+			}, true, nil
+		}
+
+		// The previous holder may have removed the file after we opened it, in which case we locked an
+		// orphaned file and have to start over.
+		fi, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, false, err
+		}
+		if current, err := os.Stat(path); err != nil || !os.SameFile(fi, current) {
+			_ = f.Close()
+			continue
+		}
+
+		return func() error {
+			defer func() { _ = f.Close() }()
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			return fsutil.Funlock(f)
+		}, true, nil
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// providerImage returns the image of the manifest descriptor whose blobs are read from the provider.
+func providerImage(desc ocispec.Descriptor, provider content.Provider) (ociimage.Image, error) {
+	if ociimage.IsIndexMediaType(desc.MediaType) {
+		return nil, fmt.Errorf("%s is an image index (%s), add its child manifests instead", desc.Digest, desc.MediaType)
+	}
+	return ocicontent.Image(provider, desc), nil
+}
+
+// AddManifest adds the image of the manifest descriptor like AddImage, reading the manifest and all blobs
+// it references from the provider, e.g. the source of an OCI copy pipeline. The descriptor, including
+// its annotations, becomes the index entry. Image indexes are refused, add their child manifests instead.
+func (l *Layout) AddManifest(ctx context.Context, desc ocispec.Descriptor, provider content.Provider, opts ...ocicontent.WriteOption) error {
+	img, err := providerImage(desc, provider)
+	if err != nil {
+		return err
+	}
+	return l.AddImage(ctx, img, opts...)
+}
+
+// ReplaceManifest replaces the target image with the image of the manifest descriptor like ReplaceImage,
+// reading its blobs from the provider, see AddManifest.
+func (l *Layout) ReplaceManifest(ctx context.Context, desc ocispec.Descriptor, provider content.Provider, match descriptormatcher.Matcher, opts ...indexer.ReplaceOption) error {
+	img, err := providerImage(desc, provider)
+	if err != nil {
+		return err
+	}
+	return l.ReplaceImage(ctx, img, match, opts...)
+}
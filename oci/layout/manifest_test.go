@@ -0,0 +1,80 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("AddManifest", func() {
+	var (
+		ctx      context.Context
+		src, dst *Layout
+	)
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		var err error
+		src, err = New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		dst, err = New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should ingest the blobs of a manifest from a content provider", func() {
+		img, err := fixtures.Bootable().Build()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(src.AddImage(ctx, img)).To(Succeed())
+
+		desc := img.Descriptor()
+		desc.Annotations = map[string]string{ocispec.AnnotationRefName: "example.org/bootable:v1"}
+		Expect(dst.AddManifest(ctx, desc, src.Store())).To(Succeed())
+
+		entry, err := dst.Indexer().Find(ctx, descriptormatcher.Name("example.org/bootable:v1"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.Digest).To(Equal(img.Descriptor().Digest))
+		complete, missing, err := dst.View(entry).Complete(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(missing).To(BeEmpty())
+		Expect(complete).To(BeTrue())
+
+		By("replacing the entry with another manifest")
+		other, err := fixtures.RootFS("other").Build()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(src.AddImage(ctx, other)).To(Succeed())
+		desc = other.Descriptor()
+		desc.Annotations = map[string]string{ocispec.AnnotationRefName: "example.org/bootable:v1"}
+		Expect(dst.ReplaceManifest(ctx, desc, src.Store(), descriptormatcher.Name("example.org/bootable:v1"))).To(Succeed())
+		entry, err = dst.Indexer().Find(ctx, descriptormatcher.Name("example.org/bootable:v1"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.Digest).To(Equal(other.Descriptor().Digest))
+	})
+
+	It("should refuse image indexes", func() {
+		index, err := fixtures.MultiArch(fixtures.Bootable(), ocispec.Platform{OS: "linux", Architecture: "amd64"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dst.AddManifest(ctx, index.Descriptor, src.Store())).To(MatchError(ContainSubstring("is an image index")))
+	})
+})
@@ -0,0 +1,66 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ImageAnnotation returns a matcher for the index entries of images having the annotation with the given
+// value, either on the entry itself or in their manifest, e.g. to replace the image annotated
+// channel=stable with ReplaceImage.
+func (l *Layout) ImageAnnotation(ctx context.Context, key, value string) descriptormatcher.Matcher {
+	entry := descriptormatcher.Annotation(key, value)
+	return l.manifestMatcher(ctx, func(desc ocispec.Descriptor, manifest *ocispec.Manifest) bool {
+		return entry(desc) || hasAnnotation(manifest.Annotations, key, value)
+	})
+}
+
+// LayerAnnotation returns a matcher for the index entries of images with at least one layer having the
+// annotation with the given value, e.g. image.onmetal.de/role=rootfs-b.
+func (l *Layout) LayerAnnotation(ctx context.Context, key, value string) descriptormatcher.Matcher {
+	return l.manifestMatcher(ctx, func(_ ocispec.Descriptor, manifest *ocispec.Manifest) bool {
+		for _, layer := range manifest.Layers {
+			if hasAnnotation(layer.Annotations, key, value) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// manifestMatcher returns a matcher evaluating match on the index entries along with their manifests. Each
+// manifest is read once per matcher. Entries whose manifest cannot be read, e.g. because its blob is
+// missing, do not match.
+func (l *Layout) manifestMatcher(ctx context.Context, match func(desc ocispec.Descriptor, manifest *ocispec.Manifest) bool) descriptormatcher.Matcher {
+	manifests := make(map[digest.Digest]*ocispec.Manifest)
+	return func(desc ocispec.Descriptor) bool {
+		manifest, ok := manifests[desc.Digest]
+		if !ok {
+			manifest, _ = l.View(desc).Manifest(ctx)
+			manifests[desc.Digest] = manifest
+		}
+		return manifest != nil && match(desc, manifest)
+	}
+}
+
+func hasAnnotation(annotations map[string]string, key, value string) bool {
+	actual, ok := annotations[key]
+	return ok && actual == value
+}
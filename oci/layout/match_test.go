@@ -0,0 +1,115 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("ReplaceImage", func() {
+	var (
+		ctx = context.Background()
+		l   *Layout
+	)
+
+	BeforeEach(func() {
+		var err error
+		l, err = New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	// newImage builds an image with a single rootfs layer of the given role and content.
+	newImage := func(role, rootFS string, annotations map[string]string) ociimage.Image {
+		img, err := fixtures.Image{
+			Layers:      []fixtures.Layer{{Role: role, Content: []byte(rootFS)}},
+			Annotations: annotations,
+		}.Build()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	addNamed := func(img ociimage.Image, name string) {
+		Expect(fixtures.AddToLayout(ctx, l, name, img)).To(Succeed())
+	}
+
+	names := func(dgst ocispec.Descriptor) []string {
+		entries, err := l.Indexer().List(ctx, descriptormatcher.Digests(dgst.Digest))
+		Expect(err).NotTo(HaveOccurred())
+		var res []string
+		for _, entry := range entries {
+			res = append(res, entry.Annotations[ocispec.AnnotationRefName])
+		}
+		return res
+	}
+
+	It("should replace whatever image a reference name points to", func() {
+		old := newImage("rootfs", "old", nil)
+		addNamed(old, "foo:latest")
+
+		updated := newImage("rootfs", "new", nil)
+		Expect(l.ReplaceImage(ctx, updated, descriptormatcher.Name("foo:latest"), indexer.WithSingleTarget())).To(Succeed())
+		Expect(names(updated.Descriptor())).To(ConsistOf("foo:latest"))
+		Expect(names(old.Descriptor())).To(BeEmpty())
+	})
+
+	It("should replace the image annotated in its manifest", func() {
+		stable := newImage("rootfs", "stable", map[string]string{"example.org/channel": "stable"})
+		beta := newImage("rootfs", "beta", map[string]string{"example.org/channel": "beta"})
+		addNamed(stable, "foo:v1")
+		addNamed(beta, "foo:v2")
+
+		updated := newImage("rootfs", "new", nil)
+		Expect(l.ReplaceImage(ctx, updated, l.ImageAnnotation(ctx, "example.org/channel", "stable"), indexer.WithSingleTarget())).To(Succeed())
+		Expect(names(updated.Descriptor())).To(ConsistOf("foo:v1"))
+		Expect(names(beta.Descriptor())).To(ConsistOf("foo:v2"))
+	})
+
+	It("should replace the image with an annotated layer", func() {
+		a := newImage("rootfs-a", "a", nil)
+		b := newImage("rootfs-b", "b", nil)
+		addNamed(a, "foo:a")
+		addNamed(b, "foo:b")
+
+		updated := newImage("rootfs", "new", nil)
+		Expect(l.ReplaceImage(ctx, updated, l.LayerAnnotation(ctx, onmetalimage.RoleAnnotation, "rootfs-b"), indexer.WithSingleTarget())).To(Succeed())
+		Expect(names(updated.Descriptor())).To(ConsistOf("foo:b"))
+		Expect(names(a.Descriptor())).To(ConsistOf("foo:a"))
+	})
+
+	It("should fail without writing anything if there is no single target", func() {
+		addNamed(newImage("rootfs", "v1", map[string]string{"example.org/channel": "stable"}), "foo:v1")
+		addNamed(newImage("rootfs", "v2", map[string]string{"example.org/channel": "stable"}), "foo:v2")
+
+		updated := newImage("rootfs", "new", nil)
+		err := l.ReplaceImage(ctx, updated, l.ImageAnnotation(ctx, "example.org/channel", "beta"), indexer.WithSingleTarget())
+		Expect(err).To(MatchError(indexer.ErrNoReplaceTarget))
+
+		err = l.ReplaceImage(ctx, updated, l.ImageAnnotation(ctx, "example.org/channel", "stable"), indexer.WithSingleTarget())
+		Expect(err).To(MatchError(indexer.ErrAmbiguousReplaceTarget))
+		Expect(err).To(MatchError(And(ContainSubstring("foo:v1"), ContainSubstring("foo:v2"))))
+		Expect(ocicontent.Exists(ctx, l.Store(), updated.Descriptor())).To(BeFalse())
+	})
+})
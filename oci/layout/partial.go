@@ -0,0 +1,134 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/oci/local"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PartialAnnotation is the index entry annotation marking an image whose layers are not all present,
+// e.g. because only its metadata was pulled. See MetadataOnly.
+const PartialAnnotation = "image.onmetal.de/partial"
+
+// ErrPartialImage is returned when reading a layer of a partial image that is not present.
+var ErrPartialImage = errors.New("partial image")
+
+// IsPartial reports whether the index entry is marked partial.
+func IsPartial(desc ocispec.Descriptor) bool {
+	return desc.Annotations[PartialAnnotation] == "true"
+}
+
+// MetadataOnly returns the image without its layers, so writing it to a layout only stores its manifest
+// and config. Use RefreshPartial afterwards to mark the index entries as partial.
+func MetadataOnly(img ociimage.Image) ociimage.Image {
+	return metadataOnlyImage{img}
+}
+
+type metadataOnlyImage struct {
+	ociimage.Image
+}
+
+func (metadataOnlyImage) Layers(ctx context.Context) ([]ociimage.Layer, error) {
+	return nil, nil
+}
+
+// RefreshPartial marks all index entries of the image with the given digest as partial if any of its
+// layers is missing and removes the mark otherwise.
+func (l *Layout) RefreshPartial(ctx context.Context, dgst digest.Digest) error {
+	desc, err := l.indexer.FindDigest(ctx, dgst)
+	if err != nil {
+		return fmt.Errorf("error finding image %s: %w", dgst, err)
+	}
+
+	manifest, err := ocicontent.Image(l.store, desc).Manifest(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading manifest of image %s: %w", dgst, err)
+	}
+
+	var partial bool
+	for _, layer := range manifest.Layers {
+		if !ocicontent.Exists(ctx, l.store, layer) {
+			partial = true
+			break
+		}
+	}
+
+	return l.indexer.Update(ctx, descriptormatcher.Digests(dgst), func(desc ocispec.Descriptor) ocispec.Descriptor {
+		switch {
+		case partial && !IsPartial(desc):
+			return indexer.WithAnnotation(desc, PartialAnnotation, "true")
+		case !partial && IsPartial(desc):
+			return indexer.WithoutAnnotation(desc, PartialAnnotation)
+		default:
+			return desc
+		}
+	})
+}
+
+// partialImage is an image of a partial index entry. Reading its missing layers fails with ErrPartialImage.
+type partialImage struct {
+	ociimage.Image
+	store *local.Store
+}
+
+func (i partialImage) Layers(ctx context.Context) ([]ociimage.Layer, error) {
+	layers, err := i.Image.Layers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]ociimage.Layer, len(layers))
+	for idx, layer := range layers {
+		res[idx] = partialLayer{layer, i}
+	}
+	return res, nil
+}
+
+type partialLayer struct {
+	ociimage.Layer
+	image partialImage
+}
+
+func (l partialLayer) Content(ctx context.Context) (io.ReadCloser, error) {
+	desc := l.Descriptor()
+	if !ocicontent.Exists(ctx, l.image.store, desc) {
+		return nil, fmt.Errorf("%w: layer %s of image %s was not downloaded", ErrPartialImage, desc.Digest, l.image.Descriptor().Digest)
+	}
+	return l.Layer.Content(ctx)
+}
+
+// ReaderAt implements ociimage.RandomAccessLayer.
+func (l partialLayer) ReaderAt(ctx context.Context) (ociimage.ReaderAt, error) {
+	desc := l.Descriptor()
+	if !ocicontent.Exists(ctx, l.image.store, desc) {
+		return nil, fmt.Errorf("%w: layer %s of image %s was not downloaded", ErrPartialImage, desc.Digest, l.image.Descriptor().Digest)
+	}
+	layer, ok := l.Layer.(ociimage.RandomAccessLayer)
+	if !ok {
+		return nil, fmt.Errorf("layer %s does not support random access", desc.Digest)
+	}
+	return layer.ReaderAt(ctx)
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"sort"
+
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LayerPriority ranks the blobs of an image for writing, higher first. See onmetalimage.LayerPriority.
+type LayerPriority func(desc ocispec.Descriptor) int
+
+// PrioritizeLayers returns the image with its config and layers written in the order of the priority
+// instead of the manifest order, e.g. so small boot-critical layers complete before a large rootfs.
+// Blobs of equal priority keep their manifest order and the manifest is always written last. The layer
+// order of the image itself does not change. Wrapping the result again, e.g. with MetadataOnly, drops
+// the priority.
+func PrioritizeLayers(img ociimage.Image, priority LayerPriority) ociimage.Image {
+	if priority == nil {
+		return img
+	}
+	return prioritizedImage{img, priority}
+}
+
+type prioritizedImage struct {
+	ociimage.Image
+	priority LayerPriority
+}
+
+// writeLayers returns the blobs of the image in the order they are to be written, see PrioritizeLayers.
+func writeLayers(ctx context.Context, image ociimage.Image) ([]ociimage.Layer, error) {
+	image, _ = unwrapContinuing(image)
+	layers, err := ociimage.AsWriteLayers(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+
+	prioritized, ok := image.(prioritizedImage)
+	if !ok {
+		return layers, nil
+	}
+	blobs := layers[:len(layers)-1]
+	sort.SliceStable(blobs, func(i, j int) bool {
+		return prioritized.priority(blobs[i].Descriptor()) > prioritized.priority(blobs[j].Descriptor())
+	})
+	return layers, nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"sync"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/progress"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("PrioritizeLayers", func() {
+	var (
+		ctx        context.Context
+		mu         sync.Mutex
+		mediaTypes []string
+	)
+
+	BeforeEach(func() {
+		mediaTypes = nil
+		ctx = progress.NewContext(context.Background(), progress.ReporterFunc(func(event progress.Event) {
+			if started, ok := event.(progress.BlobStarted); ok {
+				mu.Lock()
+				defer mu.Unlock()
+				mediaTypes = append(mediaTypes, started.MediaType)
+			}
+		}))
+	})
+
+	newImage := func() ociimage.Image {
+		img, err := imageutil.NewJSONConfigBuilder(&onmetalimage.Config{}, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).
+			BytesLayer([]byte("rootfs"), imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType)).
+			BytesLayer([]byte("ignition"), imageutil.WithMediaType(onmetalimage.IgnitionLayerMediaType)).
+			BytesLayer([]byte("initramfs"), imageutil.WithMediaType(onmetalimage.InitRAMFSLayerMediaType)).
+			BytesLayer([]byte("kernel"), imageutil.WithMediaType(onmetalimage.KernelLayerMediaType)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	prioritized := []string{
+		onmetalimage.ConfigMediaType,
+		onmetalimage.InitRAMFSLayerMediaType,
+		onmetalimage.KernelLayerMediaType,
+		onmetalimage.IgnitionLayerMediaType,
+		onmetalimage.RootFSLayerMediaType,
+		ocispec.MediaTypeImageManifest,
+	}
+
+	It("should write the blobs in manifest order without priority", func() {
+		l, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(l.AddImage(ctx, newImage())).To(Succeed())
+		Expect(mediaTypes).To(Equal([]string{
+			onmetalimage.ConfigMediaType,
+			onmetalimage.RootFSLayerMediaType,
+			onmetalimage.IgnitionLayerMediaType,
+			onmetalimage.InitRAMFSLayerMediaType,
+			onmetalimage.KernelLayerMediaType,
+			ocispec.MediaTypeImageManifest,
+		}))
+	})
+
+	It("should write the blobs in priority order", func() {
+		l, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+
+		img := newImage()
+		Expect(l.AddImage(ctx, PrioritizeLayers(img, onmetalimage.LayerPriority))).To(Succeed())
+		Expect(mediaTypes).To(Equal(prioritized))
+
+		By("keeping the layer order of the image")
+		desc, err := l.Indexer().FindDigest(ctx, img.Descriptor().Digest)
+		Expect(err).NotTo(HaveOccurred())
+		stored, err := l.Image(ctx, desc)
+		Expect(err).NotTo(HaveOccurred())
+		layers, err := stored.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layers[0].Descriptor().MediaType).To(Equal(onmetalimage.RootFSLayerMediaType))
+	})
+
+	It("should write the blobs in priority order to multiple layouts", func() {
+		first, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		other, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, result := range WriteImage(ctx, PrioritizeLayers(newImage(), onmetalimage.LayerPriority), first, other) {
+			Expect(result.Err).NotTo(HaveOccurred())
+		}
+		Expect(mediaTypes).To(Equal(prioritized))
+	})
+})
@@ -0,0 +1,338 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/oci/processor"
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ProcessedLayersAnnotation is the index entry annotation linking layers of an image to the blobs a
+// processor stored for them, as JSON object of original layer digest to processed descriptor.
+// See ProcessImage.
+const ProcessedLayersAnnotation = "image.onmetal.de/processed-layers"
+
+// ProcessedFromAnnotation is the annotation of a processed descriptor denoting the digest of the
+// original layer.
+const ProcessedFromAnnotation = "image.onmetal.de/processed-from"
+
+// ProcessedLayers returns the processed descriptors recorded on the index entry by original layer
+// digest, if any.
+func ProcessedLayers(desc ocispec.Descriptor) map[digest.Digest]ocispec.Descriptor {
+	v, ok := desc.Annotations[ProcessedLayersAnnotation]
+	if !ok {
+		return nil
+	}
+	var processed map[digest.Digest]ocispec.Descriptor
+	if err := json.Unmarshal([]byte(v), &processed); err != nil {
+		return nil
+	}
+	return processed
+}
+
+// ProcessOptions are options for processing the layers of an image.
+type ProcessOptions struct {
+	// SkipOriginals does not store the original of processed layers. The image is partial after
+	// pushing it, see PartialAnnotation.
+	SkipOriginals bool
+}
+
+// ProcessOption is an option for processing the layers of an image.
+type ProcessOption func(o *ProcessOptions)
+
+// WithSkipOriginals only stores the processed content of processed layers.
+func WithSkipOriginals() ProcessOption {
+	return func(o *ProcessOptions) {
+		o.SkipOriginals = true
+	}
+}
+
+// ProcessImage writes the layers of the image matched by one of the processors (see processor.Find) to
+// the layout, storing the processed content as blob of its own while the original is downloaded, so the
+// content is only read once. It returns the image to push afterwards, which omits the layers whose
+// original was skipped (see WithSkipOriginals), and the processed descriptors by original layer digest
+// to record with RecordProcessed after pushing it.
+func (l *Layout) ProcessImage(
+	ctx context.Context,
+	img ociimage.Image,
+	processors []processor.LayerProcessor,
+	opts ...ProcessOption,
+) (ociimage.Image, map[digest.Digest]ocispec.Descriptor, error) {
+	o := &ProcessOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if err := l.ensureCapacity(ctx, img); err != nil {
+		return nil, nil, err
+	}
+
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting image layers: %w", err)
+	}
+	// A prioritized image writes all its blobs in priority order here, so blobs ranked above a
+	// processed layer are not held up by it. The manifest is left to the push afterwards.
+	_, prioritized := img.(prioritizedImage)
+	if prioritized {
+		if layers, err = writeLayers(ctx, img); err != nil {
+			return nil, nil, fmt.Errorf("error getting image write layers: %w", err)
+		}
+		layers = layers[:len(layers)-1]
+	}
+
+	var (
+		processed = make(map[digest.Digest]ocispec.Descriptor)
+		skipped   = make(map[digest.Digest]struct{})
+	)
+	for _, layer := range layers {
+		desc := layer.Descriptor()
+		p := processor.Find(processors, desc)
+		if p == nil {
+			if prioritized && !ocicontent.Exists(ctx, l.store, desc) {
+				if _, err := l.writeBlob(ctx, layer); err != nil {
+					return nil, nil, fmt.Errorf("error writing layer %s: %w", desc.Digest, err)
+				}
+			}
+			continue
+		}
+
+		res, err := l.processLayer(ctx, p, layer, o.SkipOriginals)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error processing layer %s: %w", desc.Digest, err)
+		}
+		processed[desc.Digest] = res
+		if o.SkipOriginals {
+			skipped[desc.Digest] = struct{}{}
+		}
+	}
+
+	// Decompressed layers reveal their diff ID for free, so check it against the config.
+	diffIDs := make(map[digest.Digest]digest.Digest)
+	for dgst, desc := range processed {
+		if processor.IsDecompressed(desc) {
+			diffIDs[dgst] = desc.Digest
+		}
+	}
+	if err := onmetalimage.ValidateDiffIDs(ctx, img, diffIDs); err != nil {
+		return nil, nil, err
+	}
+
+	if len(skipped) > 0 {
+		img = withoutLayers{img, skipped}
+	}
+	return img, processed, nil
+}
+
+// processLayer stores the processed content of the layer. Unless skipOriginal is set, the original is
+// written along the way. Originals already present in the layout are read from it instead.
+func (l *Layout) processLayer(ctx context.Context, p processor.LayerProcessor, layer ociimage.Layer, skipOriginal bool) (ocispec.Descriptor, error) {
+	desc := layer.Descriptor()
+	if ocicontent.Exists(ctx, l.store, desc) {
+		return l.processContent(ctx, p, ocicontent.Layer(l.store, desc))
+	}
+	if skipOriginal {
+		return l.processContent(ctx, p, layer)
+	}
+
+	tee := &teeLayer{Layer: layer, start: func(r io.Reader) (ocispec.Descriptor, error) {
+		return l.process(ctx, p, r, desc)
+	}}
+	if err := ocicontent.WriteLayerToIngester(ctx, l.store, tee); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if tee.result == nil {
+		// The blob appeared concurrently, so its content was not read.
+		return l.processContent(ctx, p, ocicontent.Layer(l.store, desc))
+	}
+	return tee.result.desc, tee.result.err
+}
+
+// processContent reads the content of the layer, verifying its digest, and stores the processed content.
+func (l *Layout) processContent(ctx context.Context, p processor.LayerProcessor, layer ociimage.Layer) (ocispec.Descriptor, error) {
+	desc := layer.Descriptor()
+	rc, err := layer.Content(ctx)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("error opening content: %w", err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	r, err := ioutils.NewReader(ctx, rc, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	res, err := l.process(ctx, p, r, desc)
+	if err == nil {
+		_, err = io.Copy(io.Discard, r)
+	}
+	if errors.Is(err, ioutils.ErrDigestMismatch) || errors.Is(err, ioutils.ErrSizeMismatch) {
+		return ocispec.Descriptor{}, fmt.Errorf("content of layer %s does not match its digest: %w", desc.Digest, err)
+	}
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("error reading content: %w", err)
+	}
+	return res, nil
+}
+
+// process runs the processor on r and stores its output, returning the processed descriptor.
+func (l *Layout) process(ctx context.Context, p processor.LayerProcessor, r io.Reader, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	out, processedDesc, err := p.Process(ctx, r, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("error running processor: %w", err)
+	}
+
+	ref := fmt.Sprintf("process-%s-%d", desc.Digest.Encoded(), time.Now().UnixNano())
+	layer, err := ocicontent.IngestLayer(ctx, l.store, ref, out, func(d *ocispec.Descriptor) {
+		*d = processedDesc
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("error storing processed content: %w", err)
+	}
+	return indexer.WithAnnotation(layer.Descriptor(), ProcessedFromAnnotation, desc.Digest.String()), nil
+}
+
+// RecordProcessed records the processed descriptors returned by ProcessImage on all index entries
+// of the image with the given digest, see ProcessedLayersAnnotation.
+func (l *Layout) RecordProcessed(ctx context.Context, dgst digest.Digest, processed map[digest.Digest]ocispec.Descriptor) error {
+	if len(processed) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(processed)
+	if err != nil {
+		return fmt.Errorf("error encoding processed layers: %w", err)
+	}
+	return l.indexer.Update(ctx, descriptormatcher.Digests(dgst), func(desc ocispec.Descriptor) ocispec.Descriptor {
+		return indexer.WithAnnotation(desc, ProcessedLayersAnnotation, string(data))
+	})
+}
+
+// withoutLayers is an image omitting the given layers when being written.
+// Its manifest is left unchanged, so the image is partial once written.
+type withoutLayers struct {
+	ociimage.Image
+	skipped map[digest.Digest]struct{}
+}
+
+func (i withoutLayers) Layers(ctx context.Context) ([]ociimage.Layer, error) {
+	layers, err := i.Image.Layers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []ociimage.Layer
+	for _, layer := range layers {
+		if _, ok := i.skipped[layer.Descriptor().Digest]; !ok {
+			res = append(res, layer)
+		}
+	}
+	return res, nil
+}
+
+type processResult struct {
+	desc ocispec.Descriptor
+	err  error
+}
+
+// teeLayer is a layer whose content is additionally passed to a processor while being read.
+// Reading the content fails if processing it does.
+type teeLayer struct {
+	ociimage.Layer
+	start  func(r io.Reader) (ocispec.Descriptor, error)
+	result *processResult
+}
+
+func (t *teeLayer) Content(ctx context.Context) (io.ReadCloser, error) {
+	rc, err := t.Layer.Content(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan processResult, 1)
+	go func() {
+		desc, err := t.start(pr)
+		if err != nil {
+			// Make writing the original fail fast instead of blocking on the pipe.
+			_ = pr.CloseWithError(err)
+		} else {
+			// Processors need not consume their whole input.
+			_, _ = io.Copy(io.Discard, pr)
+		}
+		done <- processResult{desc, err}
+	}()
+	return &teeReader{rc: rc, pw: pw, done: done, layer: t}, nil
+}
+
+type teeReader struct {
+	rc    io.ReadCloser
+	pw    *io.PipeWriter
+	done  chan processResult
+	layer *teeLayer
+}
+
+// errContentClosed is passed to the processor if the content is closed before being read completely.
+var errContentClosed = errors.New("content closed before reading it completely")
+
+func (t *teeReader) Read(p []byte) (int, error) {
+	n, err := t.rc.Read(p)
+	if n > 0 {
+		if _, werr := t.pw.Write(p[:n]); werr != nil {
+			return n, t.finish(werr)
+		}
+	}
+	if err != nil {
+		return n, t.finish(err)
+	}
+	return n, nil
+}
+
+// finish closes the input of the processor with err (or cleanly on io.EOF) and waits for it.
+// It returns the processing error, if any, and err otherwise.
+func (t *teeReader) finish(err error) error {
+	if t.done == nil {
+		return err
+	}
+	if errors.Is(err, io.EOF) {
+		_ = t.pw.Close()
+	} else {
+		_ = t.pw.CloseWithError(err)
+	}
+	res := <-t.done
+	t.done = nil
+	t.layer.result = &res
+	if res.err != nil {
+		return res.err
+	}
+	return err
+}
+
+func (t *teeReader) Close() error {
+	_ = t.finish(errContentClosed)
+	return t.rc.Close()
+}
@@ -0,0 +1,169 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/content"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/processor"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const processedMediaType = "application/vnd.example.upper"
+
+// upperProcessor upper-cases the content of layers with the OCI layer media type.
+type upperProcessor struct {
+	err error
+}
+
+func (upperProcessor) Match(desc ocispec.Descriptor) bool {
+	return desc.MediaType == ocispec.MediaTypeImageLayer
+}
+
+func (p upperProcessor) Process(ctx context.Context, r io.Reader, desc ocispec.Descriptor) (io.Reader, ocispec.Descriptor, error) {
+	if p.err != nil {
+		return nil, ocispec.Descriptor{}, p.err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
+	return bytes.NewReader(bytes.ToUpper(data)), ocispec.Descriptor{MediaType: processedMediaType}, nil
+}
+
+var _ = Describe("ProcessImage", func() {
+	var (
+		ctx    context.Context
+		layout *Layout
+		img    ociimage.Image
+		layer  ocispec.Descriptor
+	)
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		l, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+
+		img, err = imageutil.NewBytesConfigBuilder([]byte("config"), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer([]byte("rootfs"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			BytesLayer([]byte("kernel"), imageutil.WithMediaType("application/vnd.example.kernel")).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		layers, err := img.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		layer = layers[0].Descriptor()
+	})
+
+	It("should store the processed content along with the original", func() {
+		processedImg, processed, err := layout.ProcessImage(ctx, img, []processor.LayerProcessor{upperProcessor{}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(processed).To(HaveLen(1))
+		desc := processed[layer.Digest]
+		Expect(desc.MediaType).To(Equal(processedMediaType))
+		Expect(desc.Annotations).To(HaveKeyWithValue(ProcessedFromAnnotation, layer.Digest.String()))
+		Expect(content.ReadBlob(ctx, layout.Store(), desc)).To(Equal([]byte("ROOTFS")))
+		Expect(content.ReadBlob(ctx, layout.Store(), layer)).To(Equal([]byte("rootfs")))
+
+		By("adding the image and recording the processed layers")
+		Expect(layout.AddImage(ctx, processedImg)).To(Succeed())
+		Expect(layout.RecordProcessed(ctx, img.Descriptor().Digest, processed)).To(Succeed())
+		entry, err := layout.Indexer().Find(ctx, descriptormatcher.Digests(img.Descriptor().Digest))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ProcessedLayers(entry)).To(HaveKeyWithValue(layer.Digest, desc))
+		Expect(IsPartial(entry)).To(BeFalse())
+	})
+
+	It("should only store the processed content when skipping originals", func() {
+		processedImg, processed, err := layout.ProcessImage(ctx, img, []processor.LayerProcessor{upperProcessor{}}, WithSkipOriginals())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(content.ReadBlob(ctx, layout.Store(), processed[layer.Digest])).To(Equal([]byte("ROOTFS")))
+
+		Expect(layout.AddImage(ctx, processedImg)).To(Succeed())
+		Expect(layout.RefreshPartial(ctx, img.Descriptor().Digest)).To(Succeed())
+		_, err = layout.Store().Info(ctx, layer.Digest)
+		Expect(err).To(HaveOccurred())
+		entry, err := layout.Indexer().Find(ctx, descriptormatcher.Digests(img.Descriptor().Digest))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(IsPartial(entry)).To(BeTrue())
+	})
+
+	It("should fail if processing fails", func() {
+		processErr := errors.New("cannot process")
+		_, _, err := layout.ProcessImage(ctx, img, []processor.LayerProcessor{upperProcessor{err: processErr}})
+		Expect(err).To(MatchError(processErr))
+	})
+
+	Context("decompressing layers", func() {
+		newGzipImage := func(diffID digest.Digest) ociimage.Image {
+			var buf bytes.Buffer
+			gw := gzip.NewWriter(&buf)
+			_, err := gw.Write([]byte("rootfs"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(gw.Close()).To(Succeed())
+
+			config := fmt.Sprintf(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[%q]}}`, diffID)
+			img, err := imageutil.NewBytesConfigBuilder([]byte(config), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+				BytesLayer(buf.Bytes(), imageutil.WithMediaType(ocispec.MediaTypeImageLayerGzip)).
+				Complete()
+			Expect(err).NotTo(HaveOccurred())
+			return img
+		}
+
+		It("should expose the uncompressed size and diff id of decompressed layers", func() {
+			diffID := digest.FromString("rootfs")
+			img := newGzipImage(diffID)
+			processedImg, processed, err := layout.ProcessImage(ctx, img, []processor.LayerProcessor{processor.Decompress(ocispec.MediaTypeImageLayer)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(layout.AddImage(ctx, processedImg)).To(Succeed())
+			Expect(layout.RecordProcessed(ctx, img.Descriptor().Digest, processed)).To(Succeed())
+
+			entry, err := layout.Indexer().Find(ctx, descriptormatcher.Digests(img.Descriptor().Digest))
+			Expect(err).NotTo(HaveOccurred())
+			layers, err := layout.View(entry).Layers(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			uncompressed, ok := onmetalimage.UncompressedFromAnnotations(layers[0].Descriptor())
+			Expect(ok).To(BeTrue())
+			Expect(uncompressed).To(Equal(onmetalimage.Uncompressed{Size: 6, DiffID: diffID}))
+			size, computed, err := onmetalimage.UncompressedSize(ctx, layers[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(size).To(BeEquivalentTo(6))
+			Expect(computed).To(BeFalse())
+		})
+
+		It("should fail if the diff id does not match the config", func() {
+			img := newGzipImage(digest.FromString("other"))
+			_, _, err := layout.ProcessImage(ctx, img, []processor.LayerProcessor{processor.Decompress(ocispec.MediaTypeImageLayer)})
+			Expect(err).To(MatchError(ContainSubstring("does not match")))
+		})
+	})
+})
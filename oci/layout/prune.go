@@ -0,0 +1,126 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/go-logr/logr"
+	"github.com/onmetal/onmetal-image/batch"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/utils/sets"
+	"github.com/opencontainers/go-digest"
+)
+
+// PruneExpired removes all unpinned, unleased images whose manifest expiry (see imageutil.ExpiresAtAnnotation) is
+// before the given time, along with all blobs not referenced by any remaining image.
+// It returns a result per expired image with the bytes freed by removing it. Failing to remove an image
+// does not prevent removing the others, the returned error is only non-nil if the expired images could not
+// be determined.
+func (l *Layout) PruneExpired(ctx context.Context, now time.Time) ([]batch.Result, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	candidates, refs, err := l.evictionCandidates(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []batch.Result
+	for _, c := range candidates {
+		if c.pinned || c.leased || c.manifest == nil {
+			continue
+		}
+		expiresAt, ok := imageutil.ExpiresAt(c.manifest)
+		if !ok || !expiresAt.Before(now) {
+			continue
+		}
+
+		log.Info("Pruning expired image", "Digest", c.digest, "ExpiresAt", expiresAt)
+		results = append(results, l.pruneImage(ctx, c, refs))
+	}
+	return results, nil
+}
+
+// PruneUnlisted removes all unpinned, unleased images whose digest is not in keep, along with all blobs not
+// referenced by any remaining image. It returns a result per removed image like PruneExpired and the
+// digests of the pinned or leased images not in keep, which are retained.
+func (l *Layout) PruneUnlisted(ctx context.Context, keep sets.Set[digest.Digest]) ([]batch.Result, []digest.Digest, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	candidates, refs, err := l.evictionCandidates(ctx, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		results  []batch.Result
+		retained []digest.Digest
+	)
+	for _, c := range candidates {
+		if keep.Has(c.digest) {
+			continue
+		}
+		if c.pinned || c.leased {
+			retained = append(retained, c.digest)
+			continue
+		}
+
+		log.Info("Pruning unlisted image", "Digest", c.digest)
+		results = append(results, l.pruneImage(ctx, c, refs))
+	}
+	return results, retained, nil
+}
+
+// pruneImage removes the index entries of the image and then deletes its blobs no longer referenced
+// according to refs, except leased ones. If removing the index entries fails, e.g. because the image was
+// leased meanwhile, refs is left untouched.
+func (l *Layout) pruneImage(ctx context.Context, c *evictionCandidate, refs map[digest.Digest]int) batch.Result {
+	result := batch.Result{Name: c.digest.String(), Digest: c.digest}
+	if err := l.deleteImage(WithAuditOperation(ctx, AuditPrune, ""), c.digest); err != nil {
+		result.Err = fmt.Errorf("error removing image from index: %w", err)
+		return result
+	}
+	_, leased, err := l.leased()
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	var errs []error
+	for _, blob := range c.blobs {
+		refs[blob]--
+		if refs[blob] != 0 || leased.Has(blob) {
+			continue
+		}
+
+		var size int64
+		if info, err := l.store.Info(ctx, blob); err == nil {
+			size = info.Size
+		}
+		if err := l.store.Delete(ctx, blob); err != nil {
+			if !errdefs.IsNotFound(err) {
+				errs = append(errs, fmt.Errorf("error deleting blob %s: %w", blob, err))
+			}
+			continue
+		}
+		result.Bytes += size
+	}
+	result.Err = errors.Join(errs...)
+	return result
+}
@@ -0,0 +1,160 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	"github.com/onmetal/onmetal-image/utils/sets"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("PruneExpired", func() {
+	var (
+		ctx    context.Context
+		layout *Layout
+		now    = time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	)
+
+	newImage := func(name string, expiresAt time.Time) ociimage.Image {
+		b := imageutil.NewBytesConfigBuilder([]byte(name), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer([]byte(name+"-layer"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer))
+		if !expiresAt.IsZero() {
+			b = b.Annotations(map[string]string{imageutil.ExpiresAtAnnotation: expiresAt.Format(time.RFC3339)})
+		}
+		img, err := b.Complete()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		l, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+	})
+
+	It("should remove expired images and their blobs", func() {
+		expired := newImage("expired", now.Add(-time.Hour))
+		valid := newImage("valid", now.Add(time.Hour))
+		unlimited := newImage("unlimited", time.Time{})
+		for _, img := range []ociimage.Image{expired, valid, unlimited} {
+			Expect(layout.AddImage(ctx, img)).To(Succeed())
+		}
+
+		results, err := layout.PruneExpired(ctx, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].Digest).To(Equal(expired.Descriptor().Digest))
+		Expect(results[0].Err).NotTo(HaveOccurred())
+		Expect(results[0].Bytes).To(BeNumerically(">", 0))
+
+		descs, err := layout.Indexer().List(ctx, descriptormatcher.Every)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(descs).To(HaveLen(2))
+
+		_, err = layout.Store().Info(ctx, expired.Descriptor().Digest)
+		Expect(err).To(HaveOccurred())
+		_, err = layout.Store().Info(ctx, valid.Descriptor().Digest)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("PruneUnlisted", func() {
+	var (
+		ctx    context.Context
+		layout *Layout
+	)
+
+	newImage := func(name string) ociimage.Image {
+		img, err := fixtures.RootFS(name).Build()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		l, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+	})
+
+	It("should remove unlisted images and retain pinned ones", func() {
+		listed, unlisted, pinned := newImage("listed"), newImage("unlisted"), newImage("pinned")
+		for _, img := range []ociimage.Image{listed, unlisted, pinned} {
+			Expect(layout.AddImage(ctx, img)).To(Succeed())
+		}
+		Expect(layout.Indexer().Modify(ctx, func(index *ocispec.Index) error {
+			for i, entry := range index.Manifests {
+				if entry.Digest == pinned.Descriptor().Digest {
+					index.Manifests[i] = indexer.WithAnnotation(entry, PinnedAnnotation, "true")
+				}
+			}
+			return nil
+		})).To(Succeed())
+
+		results, retained, err := layout.PruneUnlisted(ctx, sets.New(listed.Descriptor().Digest))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(ConsistOf(HaveField("Digest", unlisted.Descriptor().Digest)))
+		Expect(results[0].Err).NotTo(HaveOccurred())
+		Expect(retained).To(ConsistOf(pinned.Descriptor().Digest))
+
+		_, err = layout.Store().Info(ctx, unlisted.Descriptor().Digest)
+		Expect(err).To(HaveOccurred())
+		_, err = layout.Store().Info(ctx, listed.Descriptor().Digest)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("TryLock", func() {
+	It("should only grant the lock of an operation once at a time", func() {
+		layout, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+
+		unlock, ok, err := layout.TryLock("sync")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		_, ok, err = layout.TryLock("sync")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeFalse())
+
+		otherUnlock, ok, err := layout.TryLock("other")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(otherUnlock()).To(Succeed())
+
+		Expect(unlock()).To(Succeed())
+		unlock, ok, err = layout.TryLock("sync")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(unlock()).To(Succeed())
+	})
+})
@@ -0,0 +1,180 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/go-logr/logr"
+	"github.com/onmetal/onmetal-image/batch"
+	"github.com/onmetal/onmetal-image/mutate"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// RecompressImage recompresses the gzip compressed rootfs layers of the image with the given digest in
+// place, see mutate.Recompress. It returns a result with the digest of the recompressed image and the
+// bytes saved by the recompression.
+//
+// The recompressed layers and the new manifest are written before all index entries of the image are
+// switched to the new manifest in a single index write, so an interrupted recompression leaves the image
+// either fully old or fully new. Blobs of the old image no longer referenced by any image are deleted
+// afterwards. Images without gzip compressed layers are left as-is.
+func (l *Layout) RecompressImage(ctx context.Context, dgst digest.Digest, compression mutate.Compression) batch.Result {
+	log := logr.FromContextOrDiscard(ctx)
+	result := batch.Result{Name: dgst.String(), Digest: dgst}
+
+	desc, err := l.indexer.FindDigest(ctx, dgst)
+	if err != nil {
+		result.Err = fmt.Errorf("error finding image: %w", err)
+		return result
+	}
+	if IsPartial(desc) {
+		result.Err = fmt.Errorf("image is partial, complete it before recompressing")
+		return result
+	}
+
+	img := ocicontent.Image(l.store, desc)
+	oldManifest, err := img.Manifest(ctx)
+	if err != nil {
+		result.Err = fmt.Errorf("error reading manifest: %w", err)
+		return result
+	}
+
+	recompressed, err := mutate.Recompress(ctx, l.store, img, compression)
+	if err != nil {
+		if errors.Is(err, mutate.ErrNothingToRecompress) {
+			log.V(1).Info("Image has no layer to recompress", "Digest", dgst)
+			return result
+		}
+		result.Err = err
+		return result
+	}
+	if _, err := l.writeImage(ctx, recompressed); err != nil {
+		result.Err = fmt.Errorf("error writing recompressed image: %w", err)
+		return result
+	}
+
+	newManifest, err := recompressed.Manifest(ctx)
+	if err != nil {
+		result.Err = fmt.Errorf("error reading recompressed manifest: %w", err)
+		return result
+	}
+
+	var (
+		newDesc = recompressed.Descriptor()
+		renamed = make(map[digest.Digest]digest.Digest)
+		added   = newDesc.Size
+		removed = desc.Size
+	)
+	for i, layer := range newManifest.Layers {
+		if old := oldManifest.Layers[i]; old.Digest != layer.Digest {
+			renamed[old.Digest] = layer.Digest
+			added += layer.Size
+			removed += old.Size
+		}
+	}
+
+	log.Info("Switching image to recompressed manifest", "Digest", dgst, "NewDigest", newDesc.Digest)
+	if err := l.indexer.Update(ctx, descriptormatcher.Digests(dgst), func(entry ocispec.Descriptor) ocispec.Descriptor {
+		entry.MediaType = newDesc.MediaType
+		entry.Digest = newDesc.Digest
+		entry.Size = newDesc.Size
+		return renameProcessed(entry, renamed)
+	}); err != nil {
+		result.Err = fmt.Errorf("error switching index entries: %w", err)
+		return result
+	}
+	result.Digest = newDesc.Digest
+
+	freed, err := l.deleteUnreferenced(ctx, []digest.Digest{dgst}, renamed)
+	if err != nil {
+		result.Err = err
+	}
+	log.V(1).Info("Recompressed image", "Digest", newDesc.Digest, "RemovedBytes", removed, "AddedBytes", added, "FreedBytes", freed)
+	// Only count the old blobs actually freed, shared layers stay around for other images.
+	result.Bytes = freed - added
+	return result
+}
+
+// renameProcessed returns the index entry with the keys and origins of its processed layers renamed,
+// see ProcessedLayersAnnotation.
+func renameProcessed(entry ocispec.Descriptor, renamed map[digest.Digest]digest.Digest) ocispec.Descriptor {
+	processed := ProcessedLayers(entry)
+	if len(processed) == 0 {
+		return entry
+	}
+
+	res := make(map[digest.Digest]ocispec.Descriptor, len(processed))
+	for original, desc := range processed {
+		if newDigest, ok := renamed[original]; ok {
+			desc = indexer.WithAnnotation(desc, ProcessedFromAnnotation, newDigest.String())
+			original = newDigest
+		}
+		res[original] = desc
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		return entry
+	}
+	return indexer.WithAnnotation(entry, ProcessedLayersAnnotation, string(data))
+}
+
+// deleteUnreferenced deletes the given manifests and layers that are no longer referenced by any image
+// and not leased, and returns the number of bytes freed.
+func (l *Layout) deleteUnreferenced(ctx context.Context, manifests []digest.Digest, layers map[digest.Digest]digest.Digest) (int64, error) {
+	refs, err := l.RefCounts(ctx)
+	if err != nil {
+		return 0, err
+	}
+	_, leased, err := l.leased()
+	if err != nil {
+		return 0, err
+	}
+
+	blobs := append([]digest.Digest(nil), manifests...)
+	for layer := range layers {
+		blobs = append(blobs, layer)
+	}
+
+	var (
+		freed int64
+		errs  []error
+	)
+	for _, blob := range blobs {
+		if refs[blob] > 0 || leased.Has(blob) {
+			continue
+		}
+		var size int64
+		if info, err := l.store.Info(ctx, blob); err == nil {
+			size = info.Size
+		}
+		if err := l.store.Delete(ctx, blob); err != nil {
+			if !errdefs.IsNotFound(err) {
+				errs = append(errs, fmt.Errorf("error deleting blob %s: %w", blob, err))
+			}
+			continue
+		}
+		freed += size
+	}
+	return freed, errors.Join(errs...)
+}
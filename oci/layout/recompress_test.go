@@ -0,0 +1,136 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+
+	"github.com/containerd/containerd/errdefs"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/mutate"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("RecompressImage", func() {
+	var (
+		ctx    context.Context
+		layout *Layout
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		l, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+	})
+
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		_, err := gw.Write(data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gw.Close()).To(Succeed())
+		return buf.Bytes()
+	}
+
+	newImage := func(rootFS []byte) ociimage.Image {
+		img, err := imageutil.NewJSONConfigBuilder(&onmetalimage.Config{}, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).
+			BytesLayer([]byte("kernel"), imageutil.WithMediaType(onmetalimage.KernelLayerMediaType)).
+			BytesLayer(rootFS, imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	named := func(img ociimage.Image, name string) ocispec.Descriptor {
+		desc := img.Descriptor()
+		desc.Annotations = map[string]string{ocispec.AnnotationRefName: name}
+		return desc
+	}
+
+	It("should switch all index entries to the recompressed image and delete the old blobs", func() {
+		img := newImage(gzipped(bytes.Repeat([]byte("rootfs "), 4096)))
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+		Expect(layout.Indexer().Add(ctx, named(img, "example.org/image:a"))).To(Succeed())
+		Expect(layout.Indexer().Add(ctx, named(img, "example.org/image:b"))).To(Succeed())
+		layers, err := img.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		oldRootFS := layers[1].Descriptor()
+
+		result := layout.RecompressImage(ctx, img.Descriptor().Digest, mutate.CompressionZstd)
+		Expect(result.Err).NotTo(HaveOccurred())
+		Expect(result.Digest).NotTo(Equal(img.Descriptor().Digest))
+
+		descs, err := layout.Indexer().List(ctx, descriptormatcher.Every)
+		Expect(err).NotTo(HaveOccurred())
+		var names []string
+		for _, desc := range descs {
+			Expect(desc.Digest).To(Equal(result.Digest))
+			if name, ok := desc.Annotations[ocispec.AnnotationRefName]; ok {
+				names = append(names, name)
+			}
+		}
+		Expect(names).To(ConsistOf("example.org/image:a", "example.org/image:b"))
+
+		_, err = layout.Store().Info(ctx, oldRootFS.Digest)
+		Expect(errdefs.IsNotFound(err)).To(BeTrue())
+		_, err = layout.Store().Info(ctx, img.Descriptor().Digest)
+		Expect(errdefs.IsNotFound(err)).To(BeTrue())
+
+		recompressed, err := layout.Image(ctx, descs[0])
+		Expect(err).NotTo(HaveOccurred())
+		newLayers, err := recompressed.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(newLayers[0].Descriptor()).To(Equal(layers[0].Descriptor()))
+		Expect(result.Bytes).To(Equal(oldRootFS.Size + img.Descriptor().Size - newLayers[1].Descriptor().Size - recompressed.Descriptor().Size))
+	})
+
+	It("should keep old layers that are still referenced by other images", func() {
+		rootFS := gzipped([]byte("rootfs"))
+		img := newImage(rootFS)
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+		other, err := imageutil.NewBytesConfigBuilder([]byte("other"), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer(rootFS, imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layout.AddImage(ctx, other)).To(Succeed())
+		otherLayers, err := other.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		result := layout.RecompressImage(ctx, img.Descriptor().Digest, mutate.CompressionZstd)
+		Expect(result.Err).NotTo(HaveOccurred())
+
+		_, err = layout.Store().Info(ctx, otherLayers[0].Descriptor().Digest)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should leave images without gzip compressed layers as-is", func() {
+		img := newImage([]byte("rootfs"))
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+
+		result := layout.RecompressImage(ctx, img.Descriptor().Digest, mutate.CompressionZstd)
+		Expect(result.Err).NotTo(HaveOccurred())
+		Expect(result.Bytes).To(BeZero())
+		Expect(layout.Indexer().FindDigest(ctx, img.Descriptor().Digest)).Error().NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,352 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/utils/sets"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// RefCountsFileName is the name of the file in the layout directory recording the blobs referenced by
+// each image of the index.
+const RefCountsFileName = "refcounts.json"
+
+// RefCountsGenerationAnnotation is the index annotation recording the generation of the reference counts
+// the index belongs to. Reference counts of another generation are stale, e.g. because a process crashed
+// between writing them and the index, and are recomputed by walking all manifests.
+const RefCountsGenerationAnnotation = "image.onmetal.de/refcounts-generation"
+
+// refCounts are the blobs referenced by each image of the index. They are updated along with each
+// modification of the index changing them, so removing an image only needs the blobs of that image
+// instead of reading the manifests of all images.
+type refCounts struct {
+	Generation int64 `json:"generation"`
+	// Images are the blobs referenced by each image (manifest digest) of the index: the manifest, config,
+	// layers and processed layers of all of its entries.
+	Images map[digest.Digest][]digest.Digest `json:"images"`
+}
+
+func (r *refCounts) counts() map[digest.Digest]int {
+	counts := make(map[digest.Digest]int)
+	for _, blobs := range r.Images {
+		for _, blob := range blobs {
+			counts[blob]++
+		}
+	}
+	return counts
+}
+
+// RefCountMismatch is a blob whose recorded reference count differs from the one computed by walking all
+// manifests.
+type RefCountMismatch struct {
+	Digest   digest.Digest `json:"digest"`
+	Recorded int           `json:"recorded"`
+	Actual   int           `json:"actual"`
+}
+
+// RefCountsResult is the result of rebuilding or verifying the reference counts.
+type RefCountsResult struct {
+	// Images is the number of images of the index.
+	Images int `json:"images"`
+	// Blobs is the number of blobs referenced by them.
+	Blobs int `json:"blobs"`
+	// Stale is set if the recorded reference counts did not belong to the index.
+	Stale bool `json:"stale"`
+	// Mismatches are the blobs whose recorded reference count was wrong.
+	Mismatches []RefCountMismatch `json:"mismatches"`
+}
+
+// indexGeneration returns the reference counts generation of the index, zero if it has none.
+func indexGeneration(index *ocispec.Index) int64 {
+	gen, err := strconv.ParseInt(index.Annotations[RefCountsGenerationAnnotation], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return gen
+}
+
+// readRefCounts returns the recorded reference counts. They are nil if there are none or they cannot
+// be read, in which case they are recomputed.
+func (l *Layout) readRefCounts() *refCounts {
+	data, err := os.ReadFile(filepath.Join(l.path, RefCountsFileName))
+	if err != nil {
+		return nil
+	}
+	refs := &refCounts{}
+	if err := json.Unmarshal(data, refs); err != nil || refs.Images == nil {
+		return nil
+	}
+	return refs
+}
+
+// loadRefCounts returns the recorded reference counts if they belong to the index generation and also
+// returns the generation of the recorded reference counts.
+func (l *Layout) loadRefCounts(gen int64) (*refCounts, int64) {
+	l.refsMu.Lock()
+	defer l.refsMu.Unlock()
+	if l.refs != nil && gen != 0 && l.refs.Generation == gen {
+		return l.refs, gen
+	}
+
+	refs := l.readRefCounts()
+	if refs == nil {
+		return nil, 0
+	}
+	if gen == 0 || refs.Generation != gen {
+		return nil, refs.Generation
+	}
+	l.refs = refs
+	return refs, gen
+}
+
+// writeRefCounts replaces the recorded reference counts. They are not synced: Reference counts lost or
+// corrupted by a power loss do not belong to the index anymore and are recomputed.
+func (l *Layout) writeRefCounts(refs *refCounts) error {
+	data, err := json.Marshal(refs)
+	if err != nil {
+		return fmt.Errorf("error marshaling reference counts: %w", err)
+	}
+
+	path := filepath.Join(l.path, RefCountsFileName)
+	tmp, err := os.CreateTemp(l.path, "."+RefCountsFileName+".*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary reference counts file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error writing reference counts: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary reference counts file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error writing reference counts: %w", err)
+	}
+
+	l.refsMu.Lock()
+	defer l.refsMu.Unlock()
+	l.refs = refs
+	return nil
+}
+
+// imageRefs returns the blobs referenced by the image with the given index entries.
+func (l *Layout) imageRefs(ctx context.Context, entries []ocispec.Descriptor) []digest.Digest {
+	blobs := sets.New(entries[0].Digest)
+	for _, entry := range entries {
+		for _, processed := range ProcessedLayers(entry) {
+			blobs.Insert(processed.Digest)
+		}
+	}
+	if manifest, err := ocicontent.Image(l.store, entries[0]).Manifest(ctx); err == nil {
+		blobs.Insert(manifest.Config.Digest)
+		for _, layer := range manifest.Layers {
+			blobs.Insert(layer.Digest)
+		}
+	}
+
+	res := make([]digest.Digest, 0, len(blobs))
+	for blob := range blobs {
+		res = append(res, blob)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+func entriesByDigest(descs []ocispec.Descriptor) map[digest.Digest][]ocispec.Descriptor {
+	res := make(map[digest.Digest][]ocispec.Descriptor)
+	for _, desc := range descs {
+		res[desc.Digest] = append(res[desc.Digest], desc)
+	}
+	return res
+}
+
+// sameProcessed reports whether the entries record the same processed layers.
+func sameProcessed(a, b []ocispec.Descriptor) bool {
+	processed := func(entries []ocispec.Descriptor) sets.Set[digest.Digest] {
+		res := sets.New[digest.Digest]()
+		for _, entry := range entries {
+			for _, p := range ProcessedLayers(entry) {
+				res.Insert(p.Digest)
+			}
+		}
+		return res
+	}
+	pa, pb := processed(a), processed(b)
+	if len(pa) != len(pb) {
+		return false
+	}
+	for dgst := range pa {
+		if !pb.Has(dgst) {
+			return false
+		}
+	}
+	return true
+}
+
+// computeRefCounts computes the reference counts of the index entries by reading all manifests.
+func (l *Layout) computeRefCounts(ctx context.Context, descs []ocispec.Descriptor) *refCounts {
+	refs := &refCounts{Images: make(map[digest.Digest][]digest.Digest)}
+	for dgst, entries := range entriesByDigest(descs) {
+		refs.Images[dgst] = l.imageRefs(ctx, entries)
+	}
+	return refs
+}
+
+// updateRefCounts is the indexer.ModifyHook updating the recorded reference counts to the modified index.
+// Only the images added or removed by the modification are looked at, unless the recorded reference
+// counts are stale.
+func (l *Layout) updateRefCounts(ctx context.Context, old, new *ocispec.Index) error {
+	gen := indexGeneration(old)
+	refs, recordedGen := l.loadRefCounts(gen)
+	changed := refs == nil
+	if refs == nil {
+		refs = l.computeRefCounts(ctx, old.Manifests)
+	}
+
+	var (
+		oldEntries = entriesByDigest(old.Manifests)
+		newEntries = entriesByDigest(new.Manifests)
+		images     = make(map[digest.Digest][]digest.Digest, len(newEntries))
+	)
+	for dgst, entries := range newEntries {
+		if blobs, ok := refs.Images[dgst]; ok && sameProcessed(oldEntries[dgst], entries) {
+			images[dgst] = blobs
+			continue
+		}
+		images[dgst] = l.imageRefs(ctx, entries)
+		changed = true
+	}
+	changed = changed || len(images) != len(refs.Images)
+	if !changed {
+		return nil
+	}
+
+	next := &refCounts{Generation: max(gen, recordedGen) + 1, Images: images}
+	if err := l.writeRefCounts(next); err != nil {
+		return err
+	}
+	if new.Annotations == nil {
+		new.Annotations = make(map[string]string)
+	}
+	new.Annotations[RefCountsGenerationAnnotation] = strconv.FormatInt(next.Generation, 10)
+	return nil
+}
+
+func max(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// RefCounts returns the number of images of the index referencing each blob, see RefCountsFileName.
+// If the recorded reference counts are stale, they are computed by reading all manifests.
+func (l *Layout) RefCounts(ctx context.Context) (map[digest.Digest]int, error) {
+	refs, err := l.currentRefCounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return refs.counts(), nil
+}
+
+// currentRefCounts returns the reference counts of the current index.
+func (l *Layout) currentRefCounts(ctx context.Context) (*refCounts, error) {
+	index, err := l.indexer.Index(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading index: %w", err)
+	}
+	if refs, _ := l.loadRefCounts(indexGeneration(index)); refs != nil {
+		return refs, nil
+	}
+
+	// Recompute and record the stale reference counts with an empty modification, see updateRefCounts.
+	if err := l.indexer.Modify(ctx, func(*ocispec.Index) error { return nil }); err != nil {
+		return nil, fmt.Errorf("error recording reference counts: %w", err)
+	}
+	if index, err = l.indexer.Index(ctx); err != nil {
+		return nil, fmt.Errorf("error reading index: %w", err)
+	}
+	if refs, _ := l.loadRefCounts(indexGeneration(index)); refs != nil {
+		return refs, nil
+	}
+	return l.computeRefCounts(ctx, index.Manifests), nil
+}
+
+// VerifyRefCounts compares the recorded reference counts with the ones computed by reading all
+// manifests, without changing them.
+func (l *Layout) VerifyRefCounts(ctx context.Context) (*RefCountsResult, error) {
+	index, err := l.indexer.Index(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading index: %w", err)
+	}
+	recorded, _ := l.loadRefCounts(indexGeneration(index))
+	return compareRefCounts(recorded, l.computeRefCounts(ctx, index.Manifests)), nil
+}
+
+// RebuildRefCounts recomputes the recorded reference counts from scratch by reading all manifests, e.g.
+// to recover from reference counts modified by other tools. It returns the differences to the previously
+// recorded reference counts.
+func (l *Layout) RebuildRefCounts(ctx context.Context) (*RefCountsResult, error) {
+	var res *RefCountsResult
+	if err := l.indexer.Modify(ctx, func(index *ocispec.Index) error {
+		gen := indexGeneration(index)
+		recorded, _ := l.loadRefCounts(gen)
+		actual := l.computeRefCounts(ctx, index.Manifests)
+		res = compareRefCounts(recorded, actual)
+
+		// Record the computed reference counts for the unchanged index, so the modify hook keeps them.
+		actual.Generation = gen
+		return l.writeRefCounts(actual)
+	}); err != nil {
+		return nil, fmt.Errorf("error rebuilding reference counts: %w", err)
+	}
+	return res, nil
+}
+
+func compareRefCounts(recorded, actual *refCounts) *RefCountsResult {
+	actualCounts := actual.counts()
+	res := &RefCountsResult{Images: len(actual.Images), Blobs: len(actualCounts), Stale: recorded == nil}
+	if recorded == nil {
+		return res
+	}
+
+	recordedCounts := recorded.counts()
+	blobs := sets.New[digest.Digest]()
+	for blob := range recordedCounts {
+		blobs.Insert(blob)
+	}
+	for blob := range actualCounts {
+		blobs.Insert(blob)
+	}
+	for blob := range blobs {
+		if recordedCounts[blob] != actualCounts[blob] {
+			res.Mismatches = append(res.Mismatches, RefCountMismatch{Digest: blob, Recorded: recordedCounts[blob], Actual: actualCounts[blob]})
+		}
+	}
+	sort.Slice(res.Mismatches, func(i, j int) bool { return res.Mismatches[i].Digest < res.Mismatches[j].Digest })
+	return res
+}
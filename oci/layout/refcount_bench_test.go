@@ -0,0 +1,115 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/local"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const benchRefCountImages = 5000
+
+// benchRefCountLayout returns a layout with benchRefCountImages images sharing a base layer. The blobs are
+// written directly and the images added to the index with a single modification, which builds the layout
+// in seconds instead of rewriting the index for every image.
+func benchRefCountLayout(b *testing.B) (*Layout, []ocispec.Descriptor) {
+	ctx := context.Background()
+	l, err := New(b.TempDir(), WithStoreOptions(local.WithNoSync()))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	descs := make([]ocispec.Descriptor, 0, benchRefCountImages)
+	for i := 0; i < benchRefCountImages; i++ {
+		name := fmt.Sprintf("image-%d", i)
+		img, err := imageutil.NewBytesConfigBuilder([]byte(name), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer([]byte("base"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			BytesLayer([]byte(name+"-layer"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Complete()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := ocicontent.WriteImageToIngester(ctx, l.Store(), img); err != nil {
+			b.Fatal(err)
+		}
+		descs = append(descs, img.Descriptor())
+	}
+
+	if err := l.Indexer().Modify(ctx, func(index *ocispec.Index) error {
+		index.Manifests = append(index.Manifests, descs...)
+		return nil
+	}); err != nil {
+		b.Fatal(err)
+	}
+	return l, descs
+}
+
+// BenchmarkRefCounts determines the references of all blobs of the layout, once from the recorded
+// reference counts and once by walking all manifests.
+func BenchmarkRefCounts(b *testing.B) {
+	ctx := context.Background()
+	l, _ := benchRefCountLayout(b)
+
+	b.Run("recorded", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := l.RefCounts(ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("walk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := l.VerifyRefCounts(ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkDeleteImage removes one image from the layout and determines the blobs no longer referenced,
+// re-adding it afterwards.
+func BenchmarkDeleteImage(b *testing.B) {
+	ctx := context.Background()
+	l, descs := benchRefCountLayout(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		desc := descs[i%len(descs)]
+		if err := l.Indexer().Delete(ctx, descriptormatcher.Digests(desc.Digest)); err != nil {
+			b.Fatal(err)
+		}
+		refs, err := l.RefCounts(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if refs[desc.Digest] != 0 {
+			b.Fatalf("image %s still referenced", desc.Digest)
+		}
+
+		b.StopTimer()
+		if err := l.Indexer().Add(ctx, desc); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("RefCounts", func() {
+	var (
+		ctx    context.Context
+		layout *Layout
+		shared = []byte("shared-layer")
+	)
+
+	newImage := func(name string) ociimage.Image {
+		img, err := imageutil.NewBytesConfigBuilder([]byte(name), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer(shared, imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	configDigest := func(img ociimage.Image) digest.Digest {
+		config, err := img.Config(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		return config.Descriptor().Digest
+	}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		l, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+	})
+
+	It("should update the reference counts without reading the manifests of other images", func() {
+		a, b := newImage("a"), newImage("b")
+		Expect(layout.AddImage(ctx, a)).To(Succeed())
+		Expect(layout.AddImage(ctx, b)).To(Succeed())
+
+		refs, err := layout.RefCounts(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(refs).To(Equal(map[digest.Digest]int{
+			a.Descriptor().Digest:    1,
+			configDigest(a):          1,
+			b.Descriptor().Digest:    1,
+			configDigest(b):          1,
+			digest.FromBytes(shared): 2,
+		}))
+
+		By("making the manifest of b unreadable and removing a")
+		Expect(layout.Store().Delete(ctx, b.Descriptor().Digest)).To(Succeed())
+		Expect(layout.Indexer().Delete(ctx, descriptormatcher.Digests(a.Descriptor().Digest))).To(Succeed())
+
+		refs, err = layout.RefCounts(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(refs).To(Equal(map[digest.Digest]int{
+			b.Descriptor().Digest:    1,
+			configDigest(b):          1,
+			digest.FromBytes(shared): 1,
+		}))
+
+		By("verifying against a walk of all manifests")
+		res, err := layout.VerifyRefCounts(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Stale).To(BeFalse())
+		Expect(res.Mismatches).To(ConsistOf(
+			RefCountMismatch{Digest: configDigest(b), Recorded: 1, Actual: 0},
+			RefCountMismatch{Digest: digest.FromBytes(shared), Recorded: 1, Actual: 0},
+		))
+	})
+
+	It("should recompute lost reference counts", func() {
+		img := newImage("a")
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+		path := filepath.Join(layout.Path(), RefCountsFileName)
+		Expect(path).To(BeAnExistingFile())
+		Expect(os.Remove(path)).To(Succeed())
+
+		reopened, err := New(layout.Path())
+		Expect(err).NotTo(HaveOccurred())
+		refs, err := reopened.RefCounts(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(refs).To(HaveKeyWithValue(digest.FromBytes(shared), 1))
+		Expect(path).To(BeAnExistingFile())
+
+		res, err := reopened.VerifyRefCounts(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Stale).To(BeFalse())
+		Expect(res.Mismatches).To(BeEmpty())
+	})
+
+	It("should rebuild tampered reference counts", func() {
+		img := newImage("a")
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+
+		path := filepath.Join(layout.Path(), RefCountsFileName)
+		data, err := os.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		var recorded map[string]json.RawMessage
+		Expect(json.Unmarshal(data, &recorded)).To(Succeed())
+		recorded["images"] = json.RawMessage(`{}`)
+		data, err = json.Marshal(recorded)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(path, data, 0666)).To(Succeed())
+
+		reopened, err := New(layout.Path())
+		Expect(err).NotTo(HaveOccurred())
+		res, err := reopened.RebuildRefCounts(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Images).To(Equal(1))
+		Expect(res.Blobs).To(Equal(3))
+		Expect(res.Mismatches).To(ConsistOf(
+			RefCountMismatch{Digest: img.Descriptor().Digest, Recorded: 0, Actual: 1},
+			RefCountMismatch{Digest: configDigest(img), Recorded: 0, Actual: 1},
+			RefCountMismatch{Digest: digest.FromBytes(shared), Recorded: 0, Actual: 1},
+		))
+
+		res, err = reopened.VerifyRefCounts(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Mismatches).To(BeEmpty())
+	})
+})
@@ -0,0 +1,444 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/go-logr/logr"
+	"github.com/onmetal/onmetal-image/batch"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/utils/sets"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// RetentionRule is a rule of a RetentionPolicy.
+// Exactly one of KeepLast, KeepWithin, KeepPinned and KeepAnnotated has to be set.
+type RetentionRule struct {
+	// Name identifies the rule in plans. If empty, the rule is described by its settings.
+	Name string `yaml:"name,omitempty"`
+	// Prefix restricts the rule to images with a reference name starting with it.
+	// If empty, the rule applies to all images, including untagged ones.
+	Prefix string `yaml:"prefix,omitempty"`
+
+	// KeepLast condemns all but the given number of most recent images per repository, see By.
+	KeepLast int `yaml:"keepLast,omitempty"`
+	// KeepWithin condemns images older than the duration, e.g. 720h, see By.
+	KeepWithin time.Duration `yaml:"keepWithin,omitempty"`
+	// By is the time KeepLast and KeepWithin judge the age of images by, either RetentionByPulled (the default)
+	// or RetentionByCreated.
+	By string `yaml:"by,omitempty"`
+	// KeepPinned keeps pinned images regardless of the rules condemning them.
+	KeepPinned bool `yaml:"keepPinned,omitempty"`
+	// KeepAnnotated keeps images with an index entry carrying all the annotations regardless of the rules
+	// condemning them. An empty value matches any value.
+	KeepAnnotated map[string]string `yaml:"keepAnnotated,omitempty"`
+}
+
+const (
+	// RetentionByPulled judges images by the time they were last pulled or, if never pulled, added.
+	RetentionByPulled = "pulled"
+	// RetentionByCreated judges images by the time they were created, see Layout.CreatedAt. Images recording
+	// neither a created nor a pulled time count as older than all others.
+	RetentionByCreated = "created"
+)
+
+func (r RetentionRule) String() string {
+	if r.Name != "" {
+		return r.Name
+	}
+
+	var s string
+	switch {
+	case r.KeepLast > 0:
+		s = fmt.Sprintf("keep-last %d", r.KeepLast)
+	case r.KeepWithin > 0:
+		s = fmt.Sprintf("keep-within %s", r.KeepWithin)
+	case r.KeepPinned:
+		s = "keep-pinned"
+	default:
+		keys := make([]string, 0, len(r.KeepAnnotated))
+		for key, value := range r.KeepAnnotated {
+			keys = append(keys, key+"="+value)
+		}
+		sort.Strings(keys)
+		s = "keep-annotated " + strings.Join(keys, ",")
+	}
+	if r.By == RetentionByCreated {
+		s += " by created"
+	}
+	if r.Prefix != "" {
+		s += " for " + r.Prefix + "*"
+	}
+	return s
+}
+
+func (r RetentionRule) validate() error {
+	var set int
+	for _, ok := range []bool{r.KeepLast != 0, r.KeepWithin != 0, r.KeepPinned, len(r.KeepAnnotated) > 0} {
+		if ok {
+			set++
+		}
+	}
+	switch {
+	case set != 1:
+		return fmt.Errorf("exactly one of keepLast, keepWithin, keepPinned and keepAnnotated has to be set")
+	case r.KeepLast < 0:
+		return fmt.Errorf("keepLast must be positive")
+	case r.KeepWithin < 0:
+		return fmt.Errorf("keepWithin must be positive")
+	case r.By != "" && r.By != RetentionByPulled && r.By != RetentionByCreated:
+		return fmt.Errorf("unknown by %q, expected %s or %s", r.By, RetentionByPulled, RetentionByCreated)
+	case r.By != "" && !r.condemns():
+		return fmt.Errorf("by is only supported for keepLast and keepWithin")
+	}
+	return nil
+}
+
+// byCreated reports whether the rule judges images by their created time.
+func (r RetentionRule) byCreated() bool {
+	return r.By == RetentionByCreated
+}
+
+// condemns reports whether the rule condemns images, as opposed to keeping them.
+func (r RetentionRule) condemns() bool {
+	return r.KeepLast > 0 || r.KeepWithin > 0
+}
+
+// RetentionPolicy decides which images of a layout to remove.
+// An image is removed if any rule condemns it and no rule keeps it.
+type RetentionPolicy struct {
+	Rules []RetentionRule `yaml:"rules"`
+}
+
+// Validate checks that the policy has rules and that each of them is well-formed.
+func (p *RetentionPolicy) Validate() error {
+	if len(p.Rules) == 0 {
+		return fmt.Errorf("retention policy has no rules")
+	}
+	for i, rule := range p.Rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("invalid rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// ParseRetentionPolicy parses and validates a RetentionPolicy in YAML format. Unknown fields are rejected.
+func ParseRetentionPolicy(data []byte) (*RetentionPolicy, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	policy := &RetentionPolicy{}
+	if err := dec.Decode(policy); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error decoding retention policy: %w", err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// RetentionRemoval is an image condemned by a RetentionPolicy.
+type RetentionRemoval struct {
+	Digest digest.Digest `json:"digest"`
+	// Names are the reference names of the index entries of the image.
+	Names []string `json:"names,omitempty"`
+	// Rule describes the first rule condemning the image.
+	Rule string `json:"rule"`
+	// Reason explains why the rule condemned the image.
+	Reason string `json:"reason"`
+	// Usage is the recorded usage of the image, to judge whether removing it is sensible.
+	Usage Usage `json:"usage"`
+}
+
+// Name returns the reference names of the image or its digest, if it is untagged.
+func (r RetentionRemoval) Name() string {
+	if len(r.Names) == 0 {
+		return r.Digest.String()
+	}
+	return strings.Join(r.Names, ", ")
+}
+
+// RetentionPlan lists the images a RetentionPolicy removes from a layout.
+type RetentionPlan struct {
+	Remove []RetentionRemoval `json:"remove"`
+	// Kept is the number of images the policy keeps.
+	Kept int `json:"kept"`
+}
+
+type retentionImage struct {
+	*evictionCandidate
+	names []string
+	// time is the time the image was last pulled or, if never pulled, added.
+	time time.Time
+	// created is when the image was created, only determined if a rule judges images by it.
+	created    CreatedAt
+	hasCreated bool
+}
+
+// age returns the time the rule judges the image by. It is zero for images recording no such time.
+func (i *retentionImage) age(rule RetentionRule) time.Time {
+	if rule.byCreated() {
+		return i.created.Time
+	}
+	return i.time
+}
+
+// describeAge describes the time the rule judges the image by for reasons.
+func (i *retentionImage) describeAge(rule RetentionRule) string {
+	switch {
+	case !rule.byCreated():
+		return "last pulled or added at " + i.time.Format(time.RFC3339)
+	case !i.hasCreated:
+		return "no created or pulled time recorded"
+	case i.created.Approximate:
+		return "no created time recorded, last pulled at " + i.created.Time.Format(time.RFC3339)
+	default:
+		return "created at " + i.created.Time.Format(time.RFC3339)
+	}
+}
+
+func newRetentionImage(c *evictionCandidate) *retentionImage {
+	img := &retentionImage{evictionCandidate: c}
+	for _, entry := range c.entries {
+		if name := entry.Annotations[ocispec.AnnotationRefName]; name != "" {
+			img.names = append(img.names, name)
+		}
+
+		t, ok := indexer.PulledAt(entry)
+		if !ok {
+			t, _ = indexer.AddedAt(entry)
+		}
+		if t.After(img.time) {
+			img.time = t
+		}
+	}
+	sort.Strings(img.names)
+	return img
+}
+
+// repositories returns the repositories of the reference names starting with prefix.
+// Untagged images belong to no repository and only match an empty prefix, they are grouped as "<untagged>".
+func (i *retentionImage) repositories(prefix string) []string {
+	if len(i.names) == 0 {
+		if prefix == "" {
+			return []string{"<untagged>"}
+		}
+		return nil
+	}
+
+	repos := sets.New[string]()
+	var res []string
+	for _, name := range i.names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		repo := name
+		if named, err := reference.ParseNamed(name); err == nil {
+			repo = reference.TrimNamed(named).Name()
+		}
+		if !repos.Has(repo) {
+			repos.Insert(repo)
+			res = append(res, repo)
+		}
+	}
+	return res
+}
+
+func (i *retentionImage) kept(rule RetentionRule) bool {
+	if len(i.repositories(rule.Prefix)) == 0 {
+		return false
+	}
+	if rule.KeepPinned {
+		return i.pinned
+	}
+	for _, entry := range i.entries {
+		if hasAnnotations(entry, rule.KeepAnnotated) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnnotations(desc ocispec.Descriptor, annotations map[string]string) bool {
+	for key, value := range annotations {
+		v, ok := desc.Annotations[key]
+		if !ok || (value != "" && v != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// condemnedByKeepLast returns the reasons the keep-last rule condemns images for, by digest.
+func condemnedByKeepLast(rule RetentionRule, images []*retentionImage) map[digest.Digest]string {
+	byRepo := make(map[string][]*retentionImage)
+	for _, img := range images {
+		for _, repo := range img.repositories(rule.Prefix) {
+			byRepo[repo] = append(byRepo[repo], img)
+		}
+	}
+
+	kept := sets.New[digest.Digest]()
+	for _, repoImages := range byRepo {
+		// Ties, e.g. images recording no created time, are broken by digest to be deterministic.
+		sort.Slice(repoImages, func(i, j int) bool {
+			ti, tj := repoImages[i].age(rule), repoImages[j].age(rule)
+			if !ti.Equal(tj) {
+				return ti.After(tj)
+			}
+			return repoImages[i].digest < repoImages[j].digest
+		})
+		for i := 0; i < rule.KeepLast && i < len(repoImages); i++ {
+			kept.Insert(repoImages[i].digest)
+		}
+	}
+
+	reasons := make(map[digest.Digest]string)
+	for _, img := range images {
+		repos := img.repositories(rule.Prefix)
+		if len(repos) == 0 || kept.Has(img.digest) {
+			continue
+		}
+		reasons[img.digest] = fmt.Sprintf("not among the %d most recent images of %s", rule.KeepLast, strings.Join(repos, ", "))
+	}
+	return reasons
+}
+
+// condemnedByKeepWithin returns the reasons the keep-within rule condemns images for, by digest.
+func condemnedByKeepWithin(rule RetentionRule, images []*retentionImage, now time.Time) map[digest.Digest]string {
+	reasons := make(map[digest.Digest]string)
+	for _, img := range images {
+		if len(img.repositories(rule.Prefix)) == 0 {
+			continue
+		}
+		switch t := img.age(rule); {
+		case t.IsZero():
+			reasons[img.digest] = img.describeAge(rule)
+		case now.Sub(t) > rule.KeepWithin:
+			reasons[img.digest] = fmt.Sprintf("%s, more than %s ago", img.describeAge(rule), rule.KeepWithin)
+		}
+	}
+	return reasons
+}
+
+// ApplyRetention evaluates the policy against the images of the layout, using the time they were last pulled
+// (or added, if never pulled) as their age unless a rule judges them by their created time, see RetentionRule.By.
+// It does not remove anything, pass the plan to PruneRetention to do so.
+func (l *Layout) ApplyRetention(ctx context.Context, policy *RetentionPolicy, now time.Time) (*RetentionPlan, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+
+	candidates, _, err := l.evictionCandidates(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	var byCreated bool
+	for _, rule := range policy.Rules {
+		byCreated = byCreated || rule.byCreated()
+	}
+	images := make([]*retentionImage, 0, len(candidates))
+	for _, c := range candidates {
+		img := newRetentionImage(c)
+		if byCreated {
+			img.created, img.hasCreated = l.CreatedAt(ctx, c.entries...)
+		}
+		images = append(images, img)
+	}
+
+	// reasons are the reasons each condemning rule condemns images for, in rule order.
+	reasons := make([]map[digest.Digest]string, len(policy.Rules))
+	for i, rule := range policy.Rules {
+		switch {
+		case rule.KeepLast > 0:
+			reasons[i] = condemnedByKeepLast(rule, images)
+		case rule.KeepWithin > 0:
+			reasons[i] = condemnedByKeepWithin(rule, images, now)
+		}
+	}
+
+	plan := &RetentionPlan{}
+	for _, img := range images {
+		removal, condemned := img.condemnation(policy, reasons)
+		if !condemned {
+			plan.Kept++
+			continue
+		}
+		plan.Remove = append(plan.Remove, removal)
+	}
+	return plan, nil
+}
+
+// condemnation returns the removal of the image if any rule condemns and no rule keeps it.
+func (i *retentionImage) condemnation(policy *RetentionPolicy, reasons []map[digest.Digest]string) (RetentionRemoval, bool) {
+	for _, rule := range policy.Rules {
+		if !rule.condemns() && i.kept(rule) {
+			return RetentionRemoval{}, false
+		}
+	}
+	for idx, rule := range policy.Rules {
+		if reason, ok := reasons[idx][i.digest]; ok {
+			return RetentionRemoval{Digest: i.digest, Names: i.names, Rule: rule.String(), Reason: reason, Usage: ImageUsage(i.entries)}, true
+		}
+	}
+	return RetentionRemoval{}, false
+}
+
+// PruneRetention removes the images of the plan along with all blobs not referenced by any remaining image.
+// It returns a result per image with the bytes freed by removing it. Images removed since the plan was made
+// are skipped, as are leased ones, see Layout.Lease. Failing to remove an image does not prevent removing
+// the others, the returned error is only non-nil if the images of the layout could not be determined.
+func (l *Layout) PruneRetention(ctx context.Context, plan *RetentionPlan) ([]batch.Result, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	candidates, refs, err := l.evictionCandidates(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	byDigest := make(map[digest.Digest]*evictionCandidate, len(candidates))
+	for _, c := range candidates {
+		byDigest[c.digest] = c
+	}
+
+	var results []batch.Result
+	for _, removal := range plan.Remove {
+		c, ok := byDigest[removal.Digest]
+		if !ok {
+			continue
+		}
+		if c.leased {
+			log.Info("Skipping leased image condemned by retention policy", "Digest", c.digest, "Rule", removal.Rule)
+			continue
+		}
+
+		log.Info("Pruning image condemned by retention policy", "Digest", c.digest, "Rule", removal.Rule, "Reason", removal.Reason)
+		result := l.pruneImage(ctx, c, refs)
+		result.Name = removal.Name()
+		results = append(results, result)
+	}
+	return results, nil
+}
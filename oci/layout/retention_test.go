@@ -0,0 +1,219 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Retention", func() {
+	var (
+		ctx    context.Context
+		layout *Layout
+		now    = time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+		day    = 24 * time.Hour
+	)
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		l, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+	})
+
+	addImage := func(name string, pulledAt time.Time, pinned bool) ociimage.Image {
+		img, err := imageutil.NewBytesConfigBuilder([]byte(name), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer([]byte(name+"-layer"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+
+		Expect(layout.Indexer().Update(ctx, descriptormatcher.Digests(img.Descriptor().Digest), func(desc ocispec.Descriptor) ocispec.Descriptor {
+			desc = indexer.WithAnnotation(desc, ocispec.AnnotationRefName, name)
+			desc = indexer.WithAnnotation(desc, indexer.PulledAtAnnotation, pulledAt.Format(time.RFC3339))
+			if pinned {
+				desc = indexer.WithAnnotation(desc, PinnedAnnotation, "true")
+			}
+			return desc
+		})).To(Succeed())
+		return img
+	}
+
+	It("should condemn images by the first matching rule unless a rule keeps them", func() {
+		var (
+			a1     = addImage("example.org/a:v1", now.Add(-1*day), false)
+			_      = addImage("example.org/a:v2", now.Add(-2*day), false)
+			_      = addImage("example.org/a:v3", now.Add(-3*day), false)
+			a4     = addImage("example.org/a:v4", now.Add(-4*day), false)
+			b1     = addImage("example.org/b:v1", now.Add(-40*day), false)
+			pinned = addImage("example.org/a:pinned", now.Add(-50*day), true)
+		)
+
+		policy, err := ParseRetentionPolicy([]byte(`
+rules:
+- keepLast: 3
+- name: recent
+  keepWithin: 720h
+- keepPinned: true
+`))
+		Expect(err).NotTo(HaveOccurred())
+
+		plan, err := layout.ApplyRetention(ctx, policy, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plan.Kept).To(Equal(4))
+		Expect(plan.Remove).To(ConsistOf(
+			RetentionRemoval{
+				Digest: a4.Descriptor().Digest,
+				Names:  []string{"example.org/a:v4"},
+				Rule:   "keep-last 3",
+				Reason: "not among the 3 most recent images of example.org/a",
+			},
+			RetentionRemoval{
+				Digest: b1.Descriptor().Digest,
+				Names:  []string{"example.org/b:v1"},
+				Rule:   "recent",
+				Reason: "last pulled or added at 2023-04-22T00:00:00Z, more than 720h0m0s ago",
+			},
+		))
+
+		By("pruning the planned images")
+		results, err := layout.PruneRetention(ctx, plan)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(2))
+		for _, result := range results {
+			Expect(result.Err).NotTo(HaveOccurred())
+			Expect(result.Bytes).To(BeNumerically(">", 0))
+		}
+
+		for _, img := range []ociimage.Image{a4, b1} {
+			_, err := layout.Store().Info(ctx, img.Descriptor().Digest)
+			Expect(err).To(HaveOccurred())
+		}
+		for _, img := range []ociimage.Image{a1, pinned} {
+			_, err := layout.Store().Info(ctx, img.Descriptor().Digest)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		By("pruning the stale plan again")
+		results, err = layout.PruneRetention(ctx, plan)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(BeEmpty())
+	})
+
+	It("should restrict rules to reference names with the prefix", func() {
+		addImage("example.org/a:v1", now.Add(-40*day), false)
+		old := addImage("example.org/b:v1", now.Add(-40*day), false)
+		addImage("example.org/b:keep", now.Add(-40*day), false)
+		Expect(layout.Indexer().Update(ctx, descriptormatcher.Name("example.org/b:keep"), func(desc ocispec.Descriptor) ocispec.Descriptor {
+			return indexer.WithAnnotation(desc, "team", "infra")
+		})).To(Succeed())
+
+		plan, err := layout.ApplyRetention(ctx, &RetentionPolicy{Rules: []RetentionRule{
+			{Prefix: "example.org/b", KeepWithin: 30 * day},
+			{KeepAnnotated: map[string]string{"team": ""}},
+		}}, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plan.Kept).To(Equal(2))
+		Expect(plan.Remove).To(HaveLen(1))
+		Expect(plan.Remove[0].Digest).To(Equal(old.Descriptor().Digest))
+		Expect(plan.Remove[0].Rule).To(Equal("keep-within 720h0m0s for example.org/b*"))
+	})
+
+	It("should judge images by their created time if requested", func() {
+		addCreatedImage := func(name string, created *time.Time) ociimage.Image {
+			img, err := imageutil.NewJSONConfigBuilder(map[string]interface{}{"name": name, "created": created}, imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+				Complete()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(layout.AddImage(ctx, img)).To(Succeed())
+			Expect(layout.Indexer().Update(ctx, descriptormatcher.Digests(img.Descriptor().Digest), func(desc ocispec.Descriptor) ocispec.Descriptor {
+				return indexer.WithAnnotation(desc, ocispec.AnnotationRefName, name)
+			})).To(Succeed())
+			return img
+		}
+		createdAt := func(d time.Duration) *time.Time {
+			t := now.Add(-d)
+			return &t
+		}
+
+		var (
+			_      = addCreatedImage("example.org/a:recent", createdAt(1*day))
+			_      = addCreatedImage("example.org/a:old", createdAt(40*day))
+			pulled = addImage("example.org/a:pulled", now.Add(-2*day), false)
+			_      = addImage("example.org/a:stale", now.Add(-50*day), false)
+			_      = addCreatedImage("example.org/a:none", nil)
+		)
+
+		entry, err := layout.Indexer().FindDigest(ctx, pulled.Descriptor().Digest)
+		Expect(err).NotTo(HaveOccurred())
+		created, ok := layout.CreatedAt(ctx, entry)
+		Expect(ok).To(BeTrue())
+		Expect(created).To(Equal(CreatedAt{Time: now.Add(-2 * day), Approximate: true}))
+
+		plan, err := layout.ApplyRetention(ctx, &RetentionPolicy{Rules: []RetentionRule{
+			{KeepWithin: 30 * day, By: RetentionByCreated},
+		}}, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plan.Kept).To(Equal(2))
+		reasons := make(map[string]string)
+		for _, removal := range plan.Remove {
+			Expect(removal.Rule).To(Equal("keep-within 720h0m0s by created"))
+			reasons[removal.Name()] = removal.Reason
+		}
+		Expect(reasons).To(Equal(map[string]string{
+			"example.org/a:old":   "created at 2023-04-22T00:00:00Z, more than 720h0m0s ago",
+			"example.org/a:stale": "no created time recorded, last pulled at 2023-04-12T00:00:00Z, more than 720h0m0s ago",
+			"example.org/a:none":  "no created or pulled time recorded",
+		}))
+
+		By("keeping the most recently created images")
+		plan, err = layout.ApplyRetention(ctx, &RetentionPolicy{Rules: []RetentionRule{
+			{KeepLast: 2, By: RetentionByCreated},
+		}}, now)
+		Expect(err).NotTo(HaveOccurred())
+		var removed []string
+		for _, removal := range plan.Remove {
+			removed = append(removed, removal.Name())
+		}
+		Expect(removed).To(ConsistOf("example.org/a:old", "example.org/a:stale", "example.org/a:none"))
+	})
+
+	DescribeTable("ParseRetentionPolicy errors",
+		func(policy string) {
+			_, err := ParseRetentionPolicy([]byte(policy))
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("empty policy", ``),
+		Entry("unknown field", "rules:\n- keepLatest: 3\n"),
+		Entry("multiple settings", "rules:\n- keepLast: 3\n  keepPinned: true\n"),
+		Entry("no setting", "rules:\n- prefix: example.org/\n"),
+		Entry("negative count", "rules:\n- keepLast: -1\n"),
+		Entry("invalid duration", "rules:\n- keepWithin: 30d\n"),
+		Entry("unknown by", "rules:\n- keepWithin: 720h\n  by: added\n"),
+		Entry("by for a keeping rule", "rules:\n- keepPinned: true\n  by: created\n"),
+	)
+})
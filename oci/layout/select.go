@@ -0,0 +1,95 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"fmt"
+
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// SelectorArchitectureKey selects images by the architecture of their config.
+	SelectorArchitectureKey = "arch"
+	// SelectorOSKey selects images by the operating system of their config.
+	SelectorOSKey = "os"
+)
+
+// Select returns the images matching the label selector, see descriptormatcher.ParseSelector.
+// Keys are evaluated against the annotations of the index entries, except for SelectorArchitectureKey and
+// SelectorOSKey, which are derived from the image config, falling back to the platform of the index entry.
+// The config is only read for entries matching all annotation requirements.
+func (l *Layout) Select(ctx context.Context, selector string) ([]ociimage.Image, error) {
+	sel, err := descriptormatcher.ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	configSel, annotationSel := sel.Partition(SelectorArchitectureKey, SelectorOSKey)
+
+	descs, err := l.indexer.List(ctx, annotationSel.Matcher())
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]ociimage.Image, 0, len(descs))
+	for _, desc := range descs {
+		img := ociimage.Image(ocicontent.Image(l.store, desc))
+		if len(configSel) > 0 {
+			labels, err := configLabels(ctx, img)
+			if err != nil {
+				return nil, fmt.Errorf("error determining labels of image %s: %w", desc.Digest, err)
+			}
+			if !configSel.Matches(labels) {
+				continue
+			}
+		}
+		res = append(res, img)
+	}
+	return res, nil
+}
+
+// configLabels returns the selector labels derived from the config of the image.
+func configLabels(ctx context.Context, img ociimage.Image) (map[string]string, error) {
+	var platform *ocispec.Platform
+	// Entries other than manifests, e.g. indexes, have no config.
+	if img.Descriptor().MediaType == ocispec.MediaTypeImageManifest {
+		p, err := imageutil.ConfigPlatform(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+		platform = p
+	}
+	if platform == nil {
+		platform = img.Descriptor().Platform
+	}
+
+	labels := make(map[string]string)
+	if platform != nil {
+		putNonEmpty(labels, SelectorArchitectureKey, platform.Architecture)
+		putNonEmpty(labels, SelectorOSKey, platform.OS)
+	}
+	return labels, nil
+}
+
+func putNonEmpty(labels map[string]string, key, value string) {
+	if value != "" {
+		labels[key] = value
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Select", func() {
+	var (
+		ctx    context.Context
+		layout *Layout
+	)
+
+	newImage := func(channel, arch string) ociimage.Image {
+		config := fmt.Sprintf(`{"architecture":%q,"os":"linux","rootfs":{"type":"layers"}}`, arch)
+		img, err := imageutil.NewBytesConfigBuilder([]byte(config), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer([]byte(channel+arch), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Complete(func(desc *ocispec.Descriptor) {
+				desc.Annotations = map[string]string{"channel": channel}
+			})
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	digests := func(imgs []ociimage.Image) []string {
+		res := make([]string, 0, len(imgs))
+		for _, img := range imgs {
+			res = append(res, img.Descriptor().Digest.String())
+		}
+		return res
+	}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		l, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+	})
+
+	It("should select images by annotations and config fields", func() {
+		var (
+			stableAMD64 = newImage("stable", "amd64")
+			stableARM64 = newImage("stable", "arm64")
+			betaAMD64   = newImage("beta", "amd64")
+			alphaAMD64  = newImage("alpha", "amd64")
+		)
+		for _, img := range []ociimage.Image{stableAMD64, stableARM64, betaAMD64, alphaAMD64} {
+			Expect(layout.AddImage(ctx, img)).To(Succeed())
+		}
+
+		imgs, err := layout.Select(ctx, "channel=stable,arch=amd64")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(digests(imgs)).To(ConsistOf(stableAMD64.Descriptor().Digest.String()))
+
+		imgs, err = layout.Select(ctx, "channel in (stable,beta), arch!=arm64")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(digests(imgs)).To(ConsistOf(stableAMD64.Descriptor().Digest.String(), betaAMD64.Descriptor().Digest.String()))
+
+		imgs, err = layout.Select(ctx, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imgs).To(HaveLen(4))
+	})
+
+	It("should point parse errors at the offending token", func() {
+		_, err := layout.Select(ctx, "channel in (stable beta)")
+		var selErr *descriptormatcher.SelectorError
+		Expect(errors.As(err, &selErr)).To(BeTrue())
+		Expect(selErr.Pos).To(Equal(19))
+		Expect(selErr.Token).To(Equal("beta"))
+	})
+})
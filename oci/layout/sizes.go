@@ -0,0 +1,133 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// BlobSizesAnnotation is the index entry annotation recording the actual sizes of the config and layers
+// of an image whose manifest has no size information for them, as JSON object of digest to size.
+// See imageutil.HasKnownSize.
+const BlobSizesAnnotation = "image.onmetal.de/blob-sizes"
+
+// BlobSizes returns the blob sizes recorded on the index entry, if any.
+func BlobSizes(desc ocispec.Descriptor) map[digest.Digest]int64 {
+	v, ok := desc.Annotations[BlobSizesAnnotation]
+	if !ok {
+		return nil
+	}
+	var sizes map[digest.Digest]int64
+	if err := json.Unmarshal([]byte(v), &sizes); err != nil {
+		return nil
+	}
+	return sizes
+}
+
+// RecordSizes records the actual sizes of all present blobs of the image with the given digest whose
+// descriptors have no size information on all its index entries, see BlobSizesAnnotation.
+// Images whose manifest has size information for all blobs are left as-is.
+func (l *Layout) RecordSizes(ctx context.Context, dgst digest.Digest) error {
+	desc, err := l.indexer.FindDigest(ctx, dgst)
+	if err != nil {
+		return fmt.Errorf("error finding image %s: %w", dgst, err)
+	}
+
+	manifest, err := ocicontent.Image(l.store, desc).Manifest(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading manifest of image %s: %w", dgst, err)
+	}
+
+	sizes := make(map[digest.Digest]int64)
+	for _, blob := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		if imageutil.HasKnownSize(blob) {
+			continue
+		}
+		info, err := l.store.Info(ctx, blob.Digest)
+		if err != nil {
+			// Missing layers of partial images are recorded once they are pulled.
+			continue
+		}
+		sizes[blob.Digest] = info.Size
+	}
+	if len(sizes) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(sizes)
+	if err != nil {
+		return fmt.Errorf("error encoding blob sizes: %w", err)
+	}
+	return l.indexer.Update(ctx, descriptormatcher.Digests(dgst), func(desc ocispec.Descriptor) ocispec.Descriptor {
+		return indexer.WithAnnotation(desc, BlobSizesAnnotation, string(data))
+	})
+}
+
+// sizedImage is an image whose layer and config descriptors are completed with the recorded sizes.
+// Its manifest is left unchanged, as changing it would change the digest of the image.
+type sizedImage struct {
+	ociimage.Image
+	sizes map[digest.Digest]int64
+}
+
+func (i sizedImage) Config(ctx context.Context) (ociimage.Layer, error) {
+	config, err := i.Image.Config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return i.sized(config), nil
+}
+
+func (i sizedImage) Layers(ctx context.Context) ([]ociimage.Layer, error) {
+	layers, err := i.Image.Layers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]ociimage.Layer, len(layers))
+	for idx, layer := range layers {
+		res[idx] = i.sized(layer)
+	}
+	return res, nil
+}
+
+func (i sizedImage) sized(layer ociimage.Layer) ociimage.Layer {
+	desc := layer.Descriptor()
+	size, ok := i.sizes[desc.Digest]
+	if !ok || imageutil.HasKnownSize(desc) {
+		return layer
+	}
+	desc.Size = size
+	return sizedLayer{layer, desc}
+}
+
+type sizedLayer struct {
+	ociimage.Layer
+	desc ocispec.Descriptor
+}
+
+func (l sizedLayer) Descriptor() ocispec.Descriptor {
+	return l.desc
+}
@@ -0,0 +1,200 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TransferStatsFileName is the name of the file in the layout directory accumulating the transfer
+// statistics of the store, see RecordTransfer.
+const TransferStatsFileName = "transfer-stats.json"
+
+// transferStatsDayFormat is the format of the days the transfer statistics are bucketed by.
+const transferStatsDayFormat = "2006-01-02"
+
+// TransferStats are the statistics of the transfers from and to a registry host.
+type TransferStats struct {
+	// Host is the registry host.
+	Host string `json:"host"`
+	// Operations is the number of pulls and pushes.
+	Operations int `json:"operations"`
+	// BytesDownloaded is the number of bytes downloaded, excluding bytes of resumed downloads.
+	BytesDownloaded int64 `json:"bytesDownloaded"`
+	// BytesUploaded is the number of bytes uploaded.
+	BytesUploaded int64 `json:"bytesUploaded"`
+	// BlobsDownloaded is the number of blobs downloaded completely.
+	BlobsDownloaded int `json:"blobsDownloaded"`
+	// BlobsUploaded is the number of blobs uploaded completely.
+	BlobsUploaded int `json:"blobsUploaded"`
+	// CacheHits is the number of blobs not transferred because they already existed at the destination.
+	CacheHits int `json:"cacheHits"`
+}
+
+// Add adds the statistics of other to s.
+func (s *TransferStats) Add(other TransferStats) {
+	s.Operations += other.Operations
+	s.BytesDownloaded += other.BytesDownloaded
+	s.BytesUploaded += other.BytesUploaded
+	s.BlobsDownloaded += other.BlobsDownloaded
+	s.BlobsUploaded += other.BlobsUploaded
+	s.CacheHits += other.CacheHits
+}
+
+// transferStatsFile is the content of the transfer statistics file.
+type transferStatsFile struct {
+	// Since is when the statistics were first recorded after creating or resetting them.
+	Since time.Time `json:"since"`
+	// Days are the statistics per day (UTC) and host.
+	Days map[string]map[string]TransferStats `json:"days"`
+}
+
+// TransferStatsReport are the accumulated transfer statistics of the store.
+type TransferStatsReport struct {
+	// Since is when recording the statistics started, zero if nothing was recorded yet.
+	Since time.Time `json:"since"`
+	// Hosts are the statistics per registry host, sorted by host.
+	Hosts []TransferStats `json:"hosts"`
+	// Total are the statistics of all hosts.
+	Total TransferStats `json:"total"`
+}
+
+// readTransferStats reads the transfer statistics file. Missing or unreadable statistics are empty.
+func (l *Layout) readTransferStats() *transferStatsFile {
+	stats := &transferStatsFile{}
+	data, err := os.ReadFile(filepath.Join(l.path, TransferStatsFileName))
+	if err != nil || json.Unmarshal(data, stats) != nil {
+		stats = &transferStatsFile{}
+	}
+	if stats.Days == nil {
+		stats.Days = make(map[string]map[string]TransferStats)
+	}
+	return stats
+}
+
+// writeTransferStats replaces the transfer statistics file. It is not synced, the statistics are
+// informational only.
+func (l *Layout) writeTransferStats(stats *transferStatsFile) error {
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return fmt.Errorf("error marshaling transfer statistics: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(l.path, "."+TransferStatsFileName+".*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary transfer statistics file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error writing transfer statistics: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary transfer statistics file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(l.path, TransferStatsFileName)); err != nil {
+		return fmt.Errorf("error writing transfer statistics: %w", err)
+	}
+	return nil
+}
+
+// RecordTransfer adds the statistics of a transfer ending at the given time to the transfer statistics
+// of its host. The statistics file is updated while holding the index lock, so concurrent processes
+// recording transfers do not lose each other's statistics.
+func (l *Layout) RecordTransfer(ctx context.Context, stats TransferStats, at time.Time) error {
+	if stats.Host == "" {
+		return fmt.Errorf("transfer statistics must have a host")
+	}
+	return l.indexer.Read(ctx, func(*ocispec.Index) error {
+		file := l.readTransferStats()
+		if file.Since.IsZero() {
+			file.Since = at.UTC()
+		}
+		day := at.UTC().Format(transferStatsDayFormat)
+		hosts, ok := file.Days[day]
+		if !ok {
+			hosts = make(map[string]TransferStats)
+			file.Days[day] = hosts
+		}
+		total := hosts[stats.Host]
+		total.Host = stats.Host
+		total.Add(stats)
+		hosts[stats.Host] = total
+		return l.writeTransferStats(file)
+	})
+}
+
+// TransferStats returns the transfer statistics recorded on or after the day of since, or all of them if
+// since is zero. Statistics are recorded per day, so since is effectively rounded down to its day (UTC).
+func (l *Layout) TransferStats(ctx context.Context, since time.Time) (*TransferStatsReport, error) {
+	var file *transferStatsFile
+	if err := l.indexer.Read(ctx, func(*ocispec.Index) error {
+		file = l.readTransferStats()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	res := &TransferStatsReport{Since: file.Since}
+	if !since.IsZero() && since.After(res.Since) {
+		res.Since = since
+	}
+	sinceDay := ""
+	if !since.IsZero() {
+		sinceDay = since.UTC().Format(transferStatsDayFormat)
+	}
+
+	hosts := make(map[string]*TransferStats)
+	for day, dayHosts := range file.Days {
+		// The day format sorts lexically.
+		if day < sinceDay {
+			continue
+		}
+		for host, stats := range dayHosts {
+			total, ok := hosts[host]
+			if !ok {
+				total = &TransferStats{Host: host}
+				hosts[host] = total
+			}
+			total.Add(stats)
+		}
+	}
+	for _, stats := range hosts {
+		res.Hosts = append(res.Hosts, *stats)
+		res.Total.Add(*stats)
+	}
+	sort.Slice(res.Hosts, func(i, j int) bool { return res.Hosts[i].Host < res.Hosts[j].Host })
+	return res, nil
+}
+
+// ResetTransferStats removes all recorded transfer statistics.
+func (l *Layout) ResetTransferStats(ctx context.Context) error {
+	return l.indexer.Read(ctx, func(*ocispec.Index) error {
+		if err := os.Remove(filepath.Join(l.path, TransferStatsFileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error removing transfer statistics: %w", err)
+		}
+		return nil
+	})
+}
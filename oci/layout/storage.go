@@ -0,0 +1,366 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/oci/local"
+	"github.com/onmetal/onmetal-image/utils/fsutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// StorageFileName is the name of the file recording the directories of a layout keeping its blobs in a
+// separate blob directory, see WithBlobDir. It is written to both directories, so opening the layout
+// with only its path finds the blob directory and a blob directory is never shared by two layouts.
+const StorageFileName = "storage.json"
+
+// blobContentDirs are the directories of the blob directory, relative to it, holding blobs, the data of
+// blob writes in progress, which have to be on the same file system as the blobs, and the records of the
+// protection of blobs.
+var blobContentDirs = []string{"blobs", "ingest", "tmp/ingest-encrypted", "tmp/ingest-records", local.ProtectionRecordDir}
+
+// storageRecord is the content of the StorageFileName file.
+type storageRecord struct {
+	// Path is the absolute directory of the layout holding the index and all other metadata.
+	Path string `json:"path"`
+	// BlobDir is the absolute directory holding blobs/<alg>/.
+	BlobDir string `json:"blobDir"`
+}
+
+// readStorageRecord returns the storage record in dir, nil if there is none.
+func readStorageRecord(dir string) (*storageRecord, error) {
+	data, err := os.ReadFile(filepath.Join(dir, StorageFileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading storage record: %w", err)
+	}
+	rec := &storageRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, fmt.Errorf("error decoding storage record %s: %w", filepath.Join(dir, StorageFileName), err)
+	}
+	return rec, nil
+}
+
+// writeStorageRecord atomically writes the storage record to dir.
+func writeStorageRecord(dir string, rec *storageRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("error marshaling storage record: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+StorageFileName+".*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary storage record: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error writing storage record: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error syncing storage record: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary storage record: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, StorageFileName)); err != nil {
+		return fmt.Errorf("error writing storage record: %w", err)
+	}
+	return fsutil.SyncDir(dir)
+}
+
+// recordBlobDir records blobDir as the blob directory of the layout at path in both directories. The
+// blob directory is recorded first, so an interrupted call leaves the layout using its own directory.
+func recordBlobDir(path, blobDir string) error {
+	for _, dir := range []string{path, blobDir} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return fmt.Errorf("error creating directory: %w", err)
+		}
+	}
+	rec := &storageRecord{Path: path, BlobDir: blobDir}
+	if err := writeStorageRecord(blobDir, rec); err != nil {
+		return err
+	}
+	return writeStorageRecord(path, rec)
+}
+
+// BlobDir returns the directory holding the blobs of the layout at path, path itself unless the layout
+// keeps its blobs in a separate blob directory, see WithBlobDir.
+func BlobDir(path string) (string, error) {
+	path, err := fsutil.CanonicalPath(path)
+	if err != nil {
+		return "", err
+	}
+	return resolveBlobDir(path, "")
+}
+
+// resolveBlobDir returns the blob directory of the layout at the absolute path, checking it against the
+// requested blobDir, if any. A blob directory is recorded if given for a layout without one, provided the
+// layout keeps no blobs of its own yet. The blob directory has to carry the same record as the layout,
+// so an unmounted blob directory is not mistaken for an empty one.
+func resolveBlobDir(path, blobDir string) (string, error) {
+	if blobDir != "" {
+		var err error
+		if blobDir, err = fsutil.CanonicalPath(blobDir); err != nil {
+			return "", err
+		}
+	}
+
+	rec, err := readStorageRecord(path)
+	if err != nil {
+		return "", err
+	}
+	if rec == nil {
+		if blobDir == "" || blobDir == path {
+			return path, nil
+		}
+		if _, err := os.Stat(filepath.Join(path, "blobs")); err == nil {
+			return "", fmt.Errorf("store %s keeps its blobs in itself, move them to %s with migrate-store --split-blobs", path, blobDir)
+		}
+		if err := checkBlobDirOwner(path, blobDir, true); err != nil {
+			return "", err
+		}
+		if err := recordBlobDir(path, blobDir); err != nil {
+			return "", fmt.Errorf("error recording blob directory of store %s: %w", path, err)
+		}
+		return blobDir, nil
+	}
+
+	recBlobDir, err := fsutil.CanonicalPath(rec.BlobDir)
+	if err != nil {
+		return "", err
+	}
+	if blobDir != "" && blobDir != recBlobDir {
+		return "", fmt.Errorf("store %s keeps its blobs in %s, not in %s", path, rec.BlobDir, blobDir)
+	}
+	if err := checkBlobDirOwner(path, recBlobDir, false); err != nil {
+		return "", err
+	}
+	return recBlobDir, nil
+}
+
+// samePath reports whether the paths lead to the same directory, also if one is reached via symlinks,
+// e.g. if a path was recorded before it was moved behind a symlink.
+func samePath(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ca, err := fsutil.CanonicalPath(a)
+	if err != nil {
+		return false
+	}
+	cb, err := fsutil.CanonicalPath(b)
+	return err == nil && ca == cb
+}
+
+// checkBlobDirOwner checks that the blob directory belongs to the layout at path. If mayBeNew is set, a
+// blob directory without record is accepted if it holds no blobs.
+func checkBlobDirOwner(path, blobDir string, mayBeNew bool) error {
+	rec, err := readStorageRecord(blobDir)
+	if err != nil {
+		return err
+	}
+	switch {
+	case rec != nil && !samePath(rec.Path, path):
+		return fmt.Errorf("blob directory %s belongs to store %s", blobDir, rec.Path)
+	case rec != nil:
+		return nil
+	case !mayBeNew:
+		return fmt.Errorf("blob directory %s of store %s carries no %s, is it mounted?", blobDir, path, StorageFileName)
+	}
+	if _, err := os.Stat(filepath.Join(blobDir, "blobs")); err == nil {
+		return fmt.Errorf("blob directory %s already holds blobs of another store", blobDir)
+	}
+	return nil
+}
+
+// SplitBlobs moves the blobs of the single-directory layout at path to blobDir and records blobDir as its
+// blob directory, see WithBlobDir. Blobs are renamed if both directories are on the same file system and
+// copied otherwise, without hashing them again. The index lock is held while moving, so no images are
+// added or removed meanwhile, but blobs still being written by other processes may be lost, so the layout
+// should not be used. An interrupted move can be resumed by calling SplitBlobs again.
+func SplitBlobs(ctx context.Context, path, blobDir string) error {
+	path, err := fsutil.CanonicalPath(path)
+	if err != nil {
+		return err
+	}
+	if blobDir, err = fsutil.CanonicalPath(blobDir); err != nil {
+		return err
+	}
+	if blobDir == path {
+		return fmt.Errorf("blob directory has to differ from store %s", path)
+	}
+
+	capabilities, err := fsutil.Probe(path)
+	if err != nil {
+		return fmt.Errorf("error probing file system of %s: %w", path, err)
+	}
+	var indexerOpts []indexer.Option
+	if !capabilities.Flock {
+		indexerOpts = append(indexerOpts, indexer.WithLockFiles())
+	}
+	index, err := indexer.New(filepath.Join(path, indexer.Filename), indexerOpts...)
+	if err != nil {
+		return fmt.Errorf("error opening index: %w", err)
+	}
+	return index.Read(ctx, func(*ocispec.Index) error {
+		return splitBlobs(ctx, path, blobDir)
+	})
+}
+
+func splitBlobs(ctx context.Context, path, blobDir string) error {
+	rec, err := readStorageRecord(path)
+	if err != nil {
+		return err
+	}
+	if rec != nil {
+		if samePath(rec.BlobDir, blobDir) {
+			return nil
+		}
+		return fmt.Errorf("store %s already keeps its blobs in %s", path, rec.BlobDir)
+	}
+	if blobRec, err := readStorageRecord(blobDir); err != nil {
+		return err
+	} else if blobRec != nil && !samePath(blobRec.Path, path) {
+		return fmt.Errorf("blob directory %s belongs to store %s", blobDir, blobRec.Path)
+	}
+	if err := os.MkdirAll(blobDir, 0777); err != nil {
+		return fmt.Errorf("error creating blob directory: %w", err)
+	}
+
+	log := logr.FromContextOrDiscard(ctx)
+	for _, dir := range blobContentDirs {
+		src, dst := filepath.Join(path, filepath.FromSlash(dir)), filepath.Join(blobDir, filepath.FromSlash(dir))
+		if _, err := os.Stat(src); errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		log.V(1).Info("Moving blob content", "Source", src, "Destination", dst)
+		if err := moveTree(ctx, src, dst); err != nil {
+			return fmt.Errorf("error moving %s to %s: %w", src, dst, err)
+		}
+	}
+
+	if err := recordBlobDir(path, blobDir); err != nil {
+		return fmt.Errorf("error recording blob directory of store %s: %w", path, err)
+	}
+	return nil
+}
+
+// moveTree moves the files of the directory src into dst, replacing existing files, and then removes src.
+func moveTree(ctx context.Context, src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return err
+	}
+	if _, err := os.Stat(dst); errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(src, dst); err == nil {
+			return nil
+		}
+	}
+
+	// Not on the same file system or partially moved before.
+	if err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0777)
+		}
+		// Immutable blobs (see local.WithProtection) can neither be renamed nor removed, so the attribute
+		// is moved along with them. fsverity is lost when copying, verifying such blobs hashes them again.
+		immutable, _ := fsutil.IsImmutable(p)
+		if immutable {
+			if err := fsutil.SetImmutable(p, false); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(p, target); err != nil {
+			if err := copyFile(p, target); err != nil {
+				return err
+			}
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+		}
+		if immutable {
+			return fsutil.SetImmutable(target, true)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyFile copies the regular file src to dst via a synced temporary file, so dst is either complete or
+// absent.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,155 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/utils/fsutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Storage", func() {
+	var (
+		ctx     = context.Background()
+		path    string
+		blobDir string
+		img     ociimage.Image
+		descs   []ocispec.Descriptor
+	)
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "store")
+		blobDir = filepath.Join(GinkgoT().TempDir(), "blobs")
+
+		var err error
+		img, err = imageutil.NewBytesConfigBuilder([]byte("config"), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer([]byte("layer"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+
+		manifest, err := img.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		descs = append([]ocispec.Descriptor{img.Descriptor(), manifest.Config}, manifest.Layers...)
+	})
+
+	expectBlobsIn := func(l *Layout, dir string) {
+		for _, desc := range descs {
+			blobPath, err := l.Store().BlobPath(desc.Digest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(blobPath).To(HavePrefix(filepath.Join(dir, "blobs") + string(filepath.Separator)))
+			Expect(blobPath).To(BeARegularFile())
+		}
+		Expect(l.Verify(ctx, descs)).To(Succeed())
+	}
+
+	It("should keep blobs in the blob directory and find it when reopened without it", func() {
+		l, err := New(path, WithBlobDir(blobDir))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(l.AddImage(ctx, img)).To(Succeed())
+		Expect(l.BlobDir()).To(Equal(blobDir))
+		Expect(filepath.Join(path, "index.json")).To(BeARegularFile())
+		Expect(filepath.Join(path, "blobs")).NotTo(BeAnExistingFile())
+
+		l, err = New(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(l.BlobDir()).To(Equal(blobDir))
+		_, err = l.Indexer().FindDigest(ctx, img.Descriptor().Digest)
+		Expect(err).NotTo(HaveOccurred())
+		expectBlobsIn(l, blobDir)
+
+		dir, err := BlobDir(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dir).To(Equal(blobDir))
+	})
+
+	It("should refuse conflicting and missing blob directories", func() {
+		_, err := New(path, WithBlobDir(blobDir))
+		Expect(err).NotTo(HaveOccurred())
+
+		By("opening the store with another blob directory")
+		_, err = New(path, WithBlobDir(GinkgoT().TempDir()))
+		Expect(err).To(HaveOccurred())
+
+		By("sharing the blob directory with another store")
+		_, err = New(GinkgoT().TempDir(), WithBlobDir(blobDir))
+		Expect(err).To(HaveOccurred())
+
+		By("opening the store while the blob directory is not mounted")
+		Expect(os.Remove(filepath.Join(blobDir, StorageFileName))).To(Succeed())
+		_, err = New(path)
+		Expect(err).To(MatchError(ContainSubstring("is it mounted?")))
+	})
+
+	It("should split the blobs off an existing store", func() {
+		l, err := New(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(l.AddImage(ctx, img)).To(Succeed())
+
+		By("refusing to open it with a blob directory before moving its blobs")
+		_, err = New(path, WithBlobDir(blobDir))
+		Expect(err).To(MatchError(ContainSubstring("--split-blobs")))
+
+		Expect(SplitBlobs(ctx, path, blobDir)).To(Succeed())
+		Expect(filepath.Join(path, "blobs")).NotTo(BeAnExistingFile())
+		Expect(SplitBlobs(ctx, path, blobDir)).To(Succeed(), "splitting again is a no-op")
+
+		l, err = New(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(l.BlobDir()).To(Equal(blobDir))
+		expectBlobsIn(l, blobDir)
+	})
+
+	It("should resolve symlinked store and blob directories to their canonical paths", func() {
+		links := GinkgoT().TempDir()
+		pathLink, blobDirLink := filepath.Join(links, "store"), filepath.Join(links, "blobs")
+		Expect(os.MkdirAll(path, 0777)).To(Succeed())
+		Expect(os.MkdirAll(blobDir, 0777)).To(Succeed())
+		if err := os.Symlink(path, pathLink); err != nil {
+			Skip(fmt.Sprintf("symlinks are not supported: %v", err))
+		}
+		Expect(os.Symlink(blobDir, blobDirLink)).To(Succeed())
+		canonicalPath, err := fsutil.CanonicalPath(path)
+		Expect(err).NotTo(HaveOccurred())
+		canonicalBlobDir, err := fsutil.CanonicalPath(blobDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		l, err := New(pathLink, WithBlobDir(blobDirLink))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(l.Path()).To(Equal(canonicalPath))
+		Expect(l.BlobDir()).To(Equal(canonicalBlobDir))
+		Expect(l.AddImage(ctx, img)).To(Succeed())
+
+		By("reopening it via its real paths")
+		l, err = New(path, WithBlobDir(blobDir))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(l.Path()).To(Equal(canonicalPath))
+		expectBlobsIn(l, canonicalBlobDir)
+
+		By("reopening it via the symlink without the blob directory")
+		Expect(BlobDir(pathLink)).To(Equal(canonicalBlobDir))
+		l, err = New(pathLink)
+		Expect(err).NotTo(HaveOccurred())
+		expectBlobsIn(l, canonicalBlobDir)
+	})
+})
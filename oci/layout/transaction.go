@@ -0,0 +1,280 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/go-logr/logr"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/utils/sets"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrTxDone is returned by the methods of a Transaction that was already committed or rolled back.
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// Transaction updates several images of the layout at once, e.g. a kernel image along with its matching
+// ignition artifact, so the index never has only some of them updated. The blobs of the images are written
+// eagerly, but the index modifications are only staged and applied with a single write of the index on
+// Commit, while holding the index lock like any other modification. Concurrent transactions thus
+// serialize on commit.
+//
+// The written blobs are leased until the transaction ends, so eviction and pruning keep them although
+// no image of the index references them yet. If the process dies before committing, the index is left
+// unchanged and the lease expires after DefaultLeaseTTL.
+type Transaction struct {
+	layout *Layout
+
+	mu        sync.Mutex
+	done      bool
+	lease     *Lease
+	mutations []indexer.Mutation
+	// written are the blobs written by the transaction, which are removed again on rollback unless
+	// referenced meanwhile.
+	written []digest.Digest
+	// ingested are the layers streamed into the store by IngestLayer.
+	ingested []ocispec.Descriptor
+}
+
+// Begin starts a transaction on the layout. It has to be ended with Commit or Rollback.
+func (l *Layout) Begin(ctx context.Context) *Transaction {
+	return &Transaction{layout: l}
+}
+
+// ingest writes the blobs of the image and runs the commit hooks on it. The caller must hold tx.mu.
+func (tx *Transaction) ingest(ctx context.Context, image ociimage.Image, opts ...ocicontent.WriteOption) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	layers, err := writeLayers(ctx, image)
+	if err != nil {
+		return fmt.Errorf("error getting image write layers: %w", err)
+	}
+	blobs := make([]digest.Digest, len(layers))
+	for i, layer := range layers {
+		blobs[i] = layer.Descriptor().Digest
+	}
+	// Lease the blobs before writing them, so they are not removed before the transaction is committed.
+	if tx.lease == nil {
+		if tx.lease, err = tx.layout.leaseBlobs(DefaultLeaseTTL); err != nil {
+			return err
+		}
+	}
+	if err := tx.lease.addBlobs(blobs...); err != nil {
+		return fmt.Errorf("error leasing blobs of image %s: %w", image.Descriptor().Digest, err)
+	}
+
+	if err := tx.layout.ensureCapacity(ctx, image); err != nil {
+		return err
+	}
+	written, err := tx.layout.writeImage(ctx, image, opts...)
+	if err != nil {
+		return fmt.Errorf("error writing image: %w", err)
+	}
+	tx.written = append(tx.written, written...)
+
+	// Unlike AddImage, the blobs of rejected images are only removed on rollback, as other images of the
+	// transaction may share them.
+	return tx.layout.runCommitHooks(ctx, image)
+}
+
+// IngestLayer streams the content of the reader into the store as layer like ocicontent.IngestLayer, e.g. to
+// build an image of local files, which is then added within or after the transaction. Like the blobs of
+// added images, the blob is leased until the transaction ends and removed on rollback unless referenced
+// meanwhile. If size is known, i.e. not negative, images are evicted to make room for the content
+// beforehand; either way, they are evicted afterwards until the layout is within its maximum size again.
+func (tx *Transaction) IngestLayer(ctx context.Context, ref string, r io.Reader, size int64, opts ...imageutil.DescriptorOpt) (ociimage.Layer, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	if tx.lease == nil {
+		var err error
+		if tx.lease, err = tx.layout.leaseBlobs(DefaultLeaseTTL); err != nil {
+			return nil, err
+		}
+	}
+	if size >= 0 {
+		descs := append([]ocispec.Descriptor{{Size: size}}, tx.ingested...)
+		if err := tx.layout.ensureBlobCapacity(ctx, fmt.Sprintf("layer %s", ref), "", descs); err != nil {
+			return nil, err
+		}
+	}
+
+	layer, err := ocicontent.IngestLayer(ctx, tx.layout.store, ref, r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	desc := layer.Descriptor()
+	tx.written = append(tx.written, desc.Digest)
+	tx.ingested = append(tx.ingested, desc)
+	if err := tx.lease.addBlobs(desc.Digest); err != nil {
+		return nil, fmt.Errorf("error leasing layer %s: %w", desc.Digest, err)
+	}
+	if err := tx.layout.ensureBlobCapacity(ctx, fmt.Sprintf("layer %s", desc.Digest), "", tx.ingested); err != nil {
+		return nil, err
+	}
+	return layer, nil
+}
+
+// AddImage writes the blobs of the image and stages adding it to the index like Layout.AddImage.
+func (tx *Transaction) AddImage(ctx context.Context, image ociimage.Image, opts ...ocicontent.WriteOption) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if err := tx.ingest(ctx, image, opts...); err != nil {
+		return err
+	}
+	tx.mutations = append(tx.mutations, indexer.AddMutation(image.Descriptor()))
+	return nil
+}
+
+// ReplaceImage writes the blobs of the image and stages replacing the matching entries with it like
+// Layout.ReplaceImage. With indexer.WithExpectedDigest, Commit fails if the replaced entries were
+// modified since.
+func (tx *Transaction) ReplaceImage(ctx context.Context, image ociimage.Image, match descriptormatcher.Matcher, opts ...indexer.ReplaceOption) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if err := tx.ingest(ctx, image); err != nil {
+		return err
+	}
+	tx.mutations = append(tx.mutations, indexer.ReplaceMutation(image.Descriptor(), match, opts...))
+	return nil
+}
+
+// Tag stages pointing the reference name to the image with the given digest, replacing the entries with
+// that name. The image has to be in the index on commit, either already or added by this transaction.
+func (tx *Transaction) Tag(dgst digest.Digest, name string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.mutations = append(tx.mutations, func(index *ocispec.Index) error {
+		for _, entry := range index.Manifests {
+			if entry.Digest != dgst {
+				continue
+			}
+			desc := ocispec.Descriptor{
+				MediaType:    entry.MediaType,
+				ArtifactType: entry.ArtifactType,
+				Digest:       entry.Digest,
+				Size:         entry.Size,
+				Platform:     entry.Platform,
+				Annotations:  map[string]string{ocispec.AnnotationRefName: name},
+			}
+			return indexer.ReplaceMutation(desc, descriptormatcher.Name(name))(index)
+		}
+		return fmt.Errorf("error tagging %s as %s: %w: no index with digest %s", dgst, name, indexer.ErrNotFound, dgst)
+	})
+	return nil
+}
+
+// Commit applies all staged index modifications with a single write of the index. If any of them fails,
+// e.g. with indexer.ErrConflict, the index is left unchanged and the transaction is rolled back.
+func (tx *Transaction) Commit(ctx context.Context) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	if len(tx.mutations) > 0 {
+		if err := tx.layout.indexer.Apply(withDefaultAuditOperation(ctx, AuditTransaction), tx.mutations...); err != nil {
+			if rollbackErr := tx.rollback(ctx); rollbackErr != nil {
+				logr.FromContextOrDiscard(ctx).Error(rollbackErr, "Error rolling back failed transaction")
+			}
+			return fmt.Errorf("error committing transaction: %w", err)
+		}
+	}
+	tx.mutations = nil
+	return tx.releaseLease()
+}
+
+// Rollback discards the staged index modifications and removes the blobs written by the transaction that
+// no image of the index references. Calling it after Commit does nothing, so it can be deferred.
+func (tx *Transaction) Rollback(ctx context.Context) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return nil
+	}
+	tx.done = true
+	return tx.rollback(ctx)
+}
+
+// rollback discards the staged modifications and removes the written blobs. The caller must hold tx.mu.
+func (tx *Transaction) rollback(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx)
+	tx.mutations = nil
+	if err := tx.releaseLease(); err != nil {
+		return err
+	}
+	if len(tx.written) == 0 {
+		return nil
+	}
+
+	refs, err := tx.layout.RefCounts(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting reference counts: %w", err)
+	}
+	_, leased, err := tx.layout.leased()
+	if err != nil {
+		return err
+	}
+
+	removed := sets.New[digest.Digest]()
+	for _, dgst := range tx.written {
+		if removed.Has(dgst) || refs[dgst] > 0 || leased.Has(dgst) || tx.layout.blobBusy(dgst) {
+			continue
+		}
+		removed.Insert(dgst)
+		if err := tx.layout.store.Delete(ctx, dgst); err != nil && !errdefs.IsNotFound(err) {
+			log.Error(err, "Error removing blob of rolled back transaction", "Digest", dgst)
+		}
+	}
+	tx.written = nil
+	return nil
+}
+
+func (tx *Transaction) releaseLease() error {
+	if tx.lease == nil {
+		return nil
+	}
+	if err := tx.lease.Release(); err != nil {
+		return fmt.Errorf("error releasing lease of transaction: %w", err)
+	}
+	tx.lease = nil
+	return nil
+}
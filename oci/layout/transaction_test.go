@@ -0,0 +1,310 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// transactionHelperEnv makes the test binary run runTransactionHelper on the layout at its value instead
+// of the tests, see the transaction spec killing the process before committing.
+const transactionHelperEnv = "LAYOUT_TRANSACTION_HELPER"
+
+func init() {
+	if path := os.Getenv(transactionHelperEnv); path != "" {
+		if err := runTransactionHelper(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// runTransactionHelper ingests the updated kernel and ignition images in a transaction, reports it on
+// stdout and then waits to be killed before committing.
+func runTransactionHelper(path string) error {
+	ctx := context.Background()
+	l, err := New(path)
+	if err != nil {
+		return err
+	}
+
+	tx := l.Begin(ctx)
+	for _, name := range []string{"kernel", "ignition"} {
+		img, err := transactionImage(name + "-v2")
+		if err != nil {
+			return err
+		}
+		if err := tx.ReplaceImage(ctx, img, descriptormatcher.Name(name)); err != nil {
+			return err
+		}
+	}
+	fmt.Println("ingested")
+	select {}
+}
+
+func transactionImage(name string) (ociimage.Image, error) {
+	return imageutil.NewBytesConfigBuilder([]byte(name), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+		BytesLayer([]byte("shared-layer"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+		BytesLayer([]byte(name+"-layer"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+		Complete()
+}
+
+var _ = Describe("Transaction", func() {
+	var (
+		ctx    context.Context
+		path   string
+		layout *Layout
+	)
+
+	newImage := func(name string) ociimage.Image {
+		img, err := transactionImage(name)
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	addNamed := func(img ociimage.Image, name string) {
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+		Expect(layout.Indexer().Update(ctx, descriptormatcher.Digests(img.Descriptor().Digest), func(desc ocispec.Descriptor) ocispec.Descriptor {
+			return indexer.WithAnnotation(desc, ocispec.AnnotationRefName, name)
+		})).To(Succeed())
+	}
+
+	exists := func(dgst digest.Digest) bool {
+		_, err := layout.Store().Info(ctx, dgst)
+		if errdefs.IsNotFound(err) {
+			return false
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return true
+	}
+
+	digestOf := func(name string) digest.Digest {
+		desc, err := layout.Indexer().Find(ctx, descriptormatcher.Name(name))
+		Expect(err).NotTo(HaveOccurred())
+		return desc.Digest
+	}
+
+	readIndex := func() []byte {
+		data, err := os.ReadFile(filepath.Join(path, indexer.Filename))
+		Expect(err).NotTo(HaveOccurred())
+		return data
+	}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		path = GinkgoT().TempDir()
+		l, err := New(path)
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+
+		addNamed(newImage("kernel-v1"), "kernel")
+		addNamed(newImage("ignition-v1"), "ignition")
+	})
+
+	It("should stage the index modifications until committing them at once", func() {
+		var (
+			kernel   = newImage("kernel-v2")
+			ignition = newImage("ignition-v2")
+			before   = readIndex()
+		)
+
+		tx := layout.Begin(ctx)
+		Expect(tx.ReplaceImage(ctx, kernel, descriptormatcher.Name("kernel"))).To(Succeed())
+		Expect(tx.AddImage(ctx, ignition)).To(Succeed())
+		Expect(tx.Tag(ignition.Descriptor().Digest, "ignition")).To(Succeed())
+
+		By("checking the blobs are written and leased but the index is unchanged")
+		Expect(exists(kernel.Descriptor().Digest)).To(BeTrue())
+		Expect(exists(ignition.Descriptor().Digest)).To(BeTrue())
+		Expect(layout.Leases(ctx)).To(HaveLen(1))
+		Expect(readIndex()).To(Equal(before))
+
+		By("committing the transaction")
+		Expect(tx.Commit(ctx)).To(Succeed())
+		Expect(digestOf("kernel")).To(Equal(kernel.Descriptor().Digest))
+		Expect(digestOf("ignition")).To(Equal(ignition.Descriptor().Digest))
+		Expect(layout.Leases(ctx)).To(BeEmpty())
+
+		refs, err := layout.RefCounts(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(refs).To(HaveKeyWithValue(kernel.Descriptor().Digest, 1))
+
+		Expect(tx.Commit(ctx)).To(MatchError(ErrTxDone))
+		Expect(tx.Rollback(ctx)).To(Succeed())
+	})
+
+	It("should leave the index unchanged and roll back if a modification fails on commit", func() {
+		var (
+			kernel   = newImage("kernel-v2")
+			ignition = newImage("ignition-v2")
+			before   = readIndex()
+		)
+
+		tx := layout.Begin(ctx)
+		Expect(tx.ReplaceImage(ctx, kernel, descriptormatcher.Name("kernel"))).To(Succeed())
+		Expect(tx.ReplaceImage(ctx, ignition, descriptormatcher.Name("ignition"),
+			indexer.WithExpectedDigest(digestOf("ignition")))).To(Succeed())
+
+		By("updating the ignition image concurrently")
+		concurrent := newImage("ignition-v3")
+		Expect(layout.ReplaceImage(ctx, concurrent, descriptormatcher.Name("ignition"))).To(Succeed())
+		before = readIndex()
+
+		Expect(tx.Commit(ctx)).To(MatchError(ContainSubstring("conflict")))
+		Expect(readIndex()).To(Equal(before))
+		Expect(digestOf("ignition")).To(Equal(concurrent.Descriptor().Digest))
+		Expect(exists(kernel.Descriptor().Digest)).To(BeFalse())
+		Expect(exists(ignition.Descriptor().Digest)).To(BeFalse())
+		Expect(layout.Leases(ctx)).To(BeEmpty())
+	})
+
+	It("should only remove the blobs only the transaction referenced on rollback", func() {
+		var (
+			kernel = newImage("kernel-v2")
+			before = readIndex()
+		)
+		config, err := kernel.Config(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		layers, err := kernel.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		tx := layout.Begin(ctx)
+		Expect(tx.ReplaceImage(ctx, kernel, descriptormatcher.Name("kernel"))).To(Succeed())
+		Expect(tx.Tag(kernel.Descriptor().Digest, "kernel:latest")).To(Succeed())
+		Expect(tx.Rollback(ctx)).To(Succeed())
+
+		Expect(readIndex()).To(Equal(before))
+		Expect(layout.Leases(ctx)).To(BeEmpty())
+		Expect(exists(kernel.Descriptor().Digest)).To(BeFalse())
+		Expect(exists(config.Descriptor().Digest)).To(BeFalse())
+		Expect(exists(layers[1].Descriptor().Digest)).To(BeFalse())
+		By("checking the blob shared with the kernel image of the index is kept")
+		Expect(exists(layers[0].Descriptor().Digest)).To(BeTrue())
+		Expect(tx.AddImage(ctx, kernel)).To(MatchError(ErrTxDone))
+	})
+
+	It("should lease ingested layers and remove them on rollback", func() {
+		tx := layout.Begin(ctx)
+		layer, err := tx.IngestLayer(ctx, "ingest-layer", bytes.NewReader([]byte("ingested-layer")), -1,
+			imageutil.WithMediaType(ocispec.MediaTypeImageLayer))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layer.Descriptor().Digest).To(Equal(digest.FromString("ingested-layer")))
+		Expect(layer.Descriptor().MediaType).To(Equal(ocispec.MediaTypeImageLayer))
+		Expect(exists(layer.Descriptor().Digest)).To(BeTrue())
+		leases, err := layout.Leases(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(leases).To(HaveLen(1))
+		Expect(leases[0].Blobs).To(ConsistOf(layer.Descriptor().Digest))
+
+		Expect(tx.Rollback(ctx)).To(Succeed())
+		Expect(exists(layer.Descriptor().Digest)).To(BeFalse())
+		Expect(layout.Leases(ctx)).To(BeEmpty())
+		_, err = tx.IngestLayer(ctx, "ingest-layer", bytes.NewReader(nil), 0)
+		Expect(err).To(MatchError(ErrTxDone))
+	})
+
+	It("should evict images to make room for ingested layers", func() {
+		var used int64
+		Expect(layout.Store().Walk(ctx, func(info content.Info) error {
+			used += info.Size
+			return nil
+		})).To(Succeed())
+		l, err := New(path, WithMaxSize(used+5))
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+		kernel := digestOf("kernel")
+
+		tx := layout.Begin(ctx)
+		data := bytes.Repeat([]byte("x"), 30)
+		layer, err := tx.IngestLayer(ctx, "ingest-layer", bytes.NewReader(data), int64(len(data)))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exists(layer.Descriptor().Digest)).To(BeTrue())
+		By("checking the least recently used image was evicted")
+		_, err = layout.Indexer().Find(ctx, descriptormatcher.Name("kernel"))
+		Expect(err).To(MatchError(indexer.ErrNotFound))
+		Expect(exists(kernel)).To(BeFalse())
+		Expect(digestOf("ignition")).To(Equal(newImage("ignition-v1").Descriptor().Digest))
+
+		By("refusing layers that do not fit even after evicting all images")
+		_, err = tx.IngestLayer(ctx, "too-large", bytes.NewReader(nil), used*2)
+		Expect(err).To(MatchError(ErrInsufficientCapacity))
+		_, err = tx.IngestLayer(ctx, "too-large", bytes.NewReader(bytes.Repeat([]byte("y"), int(used*2))), -1)
+		Expect(err).To(MatchError(ErrInsufficientCapacity))
+		Expect(digestOf("ignition")).To(Equal(newImage("ignition-v1").Descriptor().Digest))
+
+		Expect(tx.Rollback(ctx)).To(Succeed())
+		Expect(exists(layer.Descriptor().Digest)).To(BeFalse())
+		Expect(exists(digest.FromBytes(bytes.Repeat([]byte("y"), int(used*2))))).To(BeFalse())
+	})
+
+	It("should fail committing a tag of an unknown image", func() {
+		tx := layout.Begin(ctx)
+		Expect(tx.Tag(newImage("unknown").Descriptor().Digest, "unknown")).To(Succeed())
+		Expect(tx.Commit(ctx)).To(MatchError(indexer.ErrNotFound))
+	})
+
+	It("should leave the layout unchanged if the process is killed before committing", func() {
+		before := readIndex()
+		refs, err := layout.RefCounts(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		cmd := exec.Command(os.Args[0], "-test.run=^$")
+		cmd.Env = append(os.Environ(), transactionHelperEnv+"="+path)
+		cmd.Stderr = GinkgoWriter
+		stdout, err := cmd.StdoutPipe()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cmd.Start()).To(Succeed())
+		DeferCleanup(func() { _ = cmd.Process.Kill() })
+
+		line, err := bufio.NewReader(stdout).ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(line).To(Equal("ingested\n"))
+		Expect(exists(newImage("kernel-v2").Descriptor().Digest)).To(BeTrue())
+
+		Expect(cmd.Process.Kill()).To(Succeed())
+		Expect(cmd.Wait()).To(HaveOccurred())
+
+		By("reopening the layout")
+		l, err := New(path)
+		Expect(err).NotTo(HaveOccurred())
+		layout = l
+		Expect(readIndex()).To(Equal(before))
+		Expect(digestOf("kernel")).To(Equal(newImage("kernel-v1").Descriptor().Digest))
+		Expect(digestOf("ignition")).To(Equal(newImage("ignition-v1").Descriptor().Digest))
+		Expect(layout.RefCounts(ctx)).To(Equal(refs))
+		Expect(layout.VerifyRefCounts(ctx)).To(HaveField("Mismatches", BeEmpty()))
+	})
+})
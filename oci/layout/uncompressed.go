@@ -0,0 +1,63 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/processor"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// decompressedLayers returns the uncompressed size and diff ID of the layers of the index entry that
+// were decompressed while pulling them, see processor.Decompress.
+func decompressedLayers(desc ocispec.Descriptor) map[digest.Digest]onmetalimage.Uncompressed {
+	res := make(map[digest.Digest]onmetalimage.Uncompressed)
+	for dgst, processed := range ProcessedLayers(desc) {
+		if processor.IsDecompressed(processed) {
+			res[dgst] = onmetalimage.Uncompressed{Size: processed.Size, DiffID: processed.Digest}
+		}
+	}
+	return res
+}
+
+// uncompressedImage is an image whose layer descriptors are annotated with the uncompressed sizes and diff
+// IDs learned while pulling it, see onmetalimage.UncompressedSize. Its manifest is left unchanged.
+type uncompressedImage struct {
+	ociimage.Image
+	uncompressed map[digest.Digest]onmetalimage.Uncompressed
+}
+
+func (i uncompressedImage) Layers(ctx context.Context) ([]ociimage.Layer, error) {
+	layers, err := i.Image.Layers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]ociimage.Layer, len(layers))
+	for idx, layer := range layers {
+		desc := layer.Descriptor()
+		uncompressed, ok := i.uncompressed[desc.Digest]
+		if _, annotated := onmetalimage.UncompressedFromAnnotations(desc); !ok || annotated {
+			res[idx] = layer
+			continue
+		}
+		res[idx] = sizedLayer{layer, onmetalimage.WithUncompressed(desc, uncompressed)}
+	}
+	return res, nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// LastUsedAtAnnotation is the index entry annotation recording when an image was last used, i.e. leased
+	// for reading its content, in RFC 3339 format. Unlike LastAccessedAtAnnotation, looking an image up
+	// does not count as use.
+	LastUsedAtAnnotation = "image.onmetal.de/last-used-at"
+	// UseCountAnnotation is the index entry annotation counting how often an image was used. Like
+	// LastUsedAtAnnotation, it starts over when the tag of the entry moves to another image.
+	UseCountAnnotation = "image.onmetal.de/use-count"
+)
+
+// UsageFlushDelay is how long recorded uses are batched before they are written to the index, unless
+// the last lease of the layout is released or FlushUsage is called before.
+const UsageFlushDelay = 10 * time.Second
+
+// LastUsedAt returns the time the image of the index entry was last used, if any use was recorded.
+func LastUsedAt(desc ocispec.Descriptor) (time.Time, bool) {
+	v, ok := desc.Annotations[LastUsedAtAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	return t, err == nil
+}
+
+// UseCount returns how often the image of the index entry was used.
+func UseCount(desc ocispec.Descriptor) int {
+	n, _ := strconv.Atoi(desc.Annotations[UseCountAnnotation])
+	return n
+}
+
+// Usage is the recorded usage of an image, aggregated over its index entries.
+type Usage struct {
+	// LastUsedAt is the time the image was last used. It is nil if no use was recorded.
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	// UseCount is how often the image was used.
+	UseCount int `json:"useCount"`
+}
+
+func (u Usage) String() string {
+	if u.LastUsedAt == nil {
+		return "never used"
+	}
+	return fmt.Sprintf("used %d time(s), last at %s", u.UseCount, u.LastUsedAt.Format(time.RFC3339))
+}
+
+// ImageUsage aggregates the recorded usage of the given index entries of an image.
+func ImageUsage(entries []ocispec.Descriptor) Usage {
+	var u Usage
+	for _, entry := range entries {
+		if t, ok := LastUsedAt(entry); ok && (u.LastUsedAt == nil || t.After(*u.LastUsedAt)) {
+			u.LastUsedAt = &t
+		}
+		if n := UseCount(entry); n > u.UseCount {
+			u.UseCount = n
+		}
+	}
+	return u
+}
+
+type pendingUse struct {
+	count int
+	at    time.Time
+}
+
+// usageTracker batches the uses recorded by recordUse until they are written by flush.
+type usageTracker struct {
+	mu       sync.Mutex
+	disabled bool
+	pending  map[digest.Digest]*pendingUse
+	timer    *time.Timer
+	// active is the number of image leases not released yet.
+	active int
+}
+
+// recordUse records a use of the image with the given digest, scheduling a write of the pending uses
+// after UsageFlushDelay.
+func (l *Layout) recordUse(ctx context.Context, dgst digest.Digest) {
+	t := &l.usage
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.disabled {
+		return
+	}
+
+	p, ok := t.pending[dgst]
+	if !ok {
+		p = &pendingUse{}
+		t.pending[dgst] = p
+	}
+	p.count++
+	p.at = time.Now().UTC()
+
+	if t.timer == nil {
+		log := logr.FromContextOrDiscard(ctx)
+		t.timer = time.AfterFunc(UsageFlushDelay, func() {
+			if err := l.FlushUsage(logr.NewContext(context.Background(), log)); err != nil {
+				log.Error(err, "Error recording image usage")
+			}
+		})
+	}
+}
+
+// leaseAcquired records that an image lease was acquired, counting it as use of the image.
+func (l *Layout) leaseAcquired(ctx context.Context, dgst digest.Digest) {
+	l.usage.mu.Lock()
+	l.usage.active++
+	l.usage.mu.Unlock()
+	l.recordUse(ctx, dgst)
+}
+
+// leaseReleased records that an image lease was released, writing the pending uses if it was the last
+// active one.
+func (l *Layout) leaseReleased(ctx context.Context) error {
+	l.usage.mu.Lock()
+	l.usage.active--
+	idle := l.usage.active == 0
+	l.usage.mu.Unlock()
+	if !idle {
+		return nil
+	}
+	return l.FlushUsage(ctx)
+}
+
+// FlushUsage writes the uses recorded since the last flush to the index, see LastUsedAtAnnotation and
+// UseCountAnnotation. Uses of images removed meanwhile are dropped. If writing fails, the uses are kept
+// for the next flush.
+func (l *Layout) FlushUsage(ctx context.Context) error {
+	t := &l.usage
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[digest.Digest]*pendingUse)
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	dgsts := make([]digest.Digest, 0, len(pending))
+	for dgst := range pending {
+		dgsts = append(dgsts, dgst)
+	}
+	if err := l.indexer.Update(ctx, descriptormatcher.Digests(dgsts...), func(desc ocispec.Descriptor) ocispec.Descriptor {
+		p := pending[desc.Digest]
+		desc = indexer.WithAnnotation(desc, UseCountAnnotation, strconv.Itoa(UseCount(desc)+p.count))
+		return indexer.WithAnnotation(desc, LastUsedAtAnnotation, p.at.Format(time.RFC3339Nano))
+	}); err != nil {
+		t.mu.Lock()
+		for dgst, p := range pending {
+			if q, ok := t.pending[dgst]; ok {
+				q.count += p.count
+				continue
+			}
+			t.pending[dgst] = p
+		}
+		t.mu.Unlock()
+		return fmt.Errorf("error recording image usage: %w", err)
+	}
+	return nil
+}
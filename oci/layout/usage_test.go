@@ -0,0 +1,154 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Usage", func() {
+	var ctx context.Context
+
+	newImage := func(name string, size int) ociimage.Image {
+		data := make([]byte, size)
+		copy(data, name)
+		img, err := imageutil.NewBytesConfigBuilder([]byte(name), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer(data, imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	usage := func(layout *Layout, img ociimage.Image) Usage {
+		descs, err := layout.Indexer().List(ctx, descriptormatcher.Digests(img.Descriptor().Digest))
+		Expect(err).NotTo(HaveOccurred())
+		return ImageUsage(descs)
+	}
+
+	use := func(layout *Layout, img ociimage.Image) {
+		lease, err := layout.Lease(ctx, img.Descriptor(), time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lease.Release()).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+	})
+
+	It("should batch the uses of concurrent leases until the last one is released", func() {
+		layout, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		img := newImage("image", 100)
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+		Expect(usage(layout, img).LastUsedAt).To(BeNil())
+
+		first, err := layout.Lease(ctx, img.Descriptor(), time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		second, err := layout.Lease(ctx, img.Descriptor(), time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(first.Release()).To(Succeed())
+		Expect(usage(layout, img).UseCount).To(BeZero())
+
+		Expect(second.Release()).To(Succeed())
+		u := usage(layout, img)
+		Expect(u.UseCount).To(Equal(2))
+		Expect(u.LastUsedAt).NotTo(BeNil())
+		Expect(*u.LastUsedAt).To(BeTemporally("~", time.Now(), 10*time.Second))
+
+		By("using it again")
+		use(layout, img)
+		Expect(usage(layout, img).UseCount).To(Equal(3))
+	})
+
+	It("should write pending uses on flush", func() {
+		layout, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		img := newImage("image", 100)
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+
+		lease, err := layout.Lease(ctx, img.Descriptor(), time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(lease.Release)
+
+		Expect(layout.FlushUsage(ctx)).To(Succeed())
+		Expect(usage(layout, img).UseCount).To(Equal(1))
+	})
+
+	It("should not record uses if usage tracking is disabled", func() {
+		layout, err := New(GinkgoT().TempDir(), WithoutUsageTracking())
+		Expect(err).NotTo(HaveOccurred())
+		img := newImage("image", 100)
+		Expect(layout.AddImage(ctx, img)).To(Succeed())
+
+		use(layout, img)
+		Expect(usage(layout, img)).To(Equal(Usage{}))
+	})
+
+	It("should not carry over the usage when the tag moves to another image", func() {
+		layout, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		first, second := newImage("first", 100), newImage("second", 100)
+		Expect(fixtures.AddToLayout(ctx, layout, "foo:latest", first)).To(Succeed())
+		use(layout, first)
+		Expect(usage(layout, first).UseCount).To(Equal(1))
+
+		Expect(layout.ReplaceImage(ctx, second, descriptormatcher.Name("foo:latest"))).To(Succeed())
+		desc, err := layout.Indexer().Find(ctx, descriptormatcher.Name("foo:latest"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(desc.Digest).To(Equal(second.Descriptor().Digest))
+		Expect(desc.Annotations).NotTo(HaveKey(UseCountAnnotation))
+		Expect(desc.Annotations).NotTo(HaveKey(LastUsedAtAnnotation))
+		Expect(usage(layout, second)).To(Equal(Usage{}))
+	})
+
+	It("should evict the least recently used image rather than the least recently accessed one", func() {
+		layout, err := New(GinkgoT().TempDir(), WithMaxSize(3500))
+		Expect(err).NotTo(HaveOccurred())
+		first, second, third := newImage("first", 1000), newImage("second", 1000), newImage("third", 1000)
+		Expect(layout.AddImage(ctx, first)).To(Succeed())
+		Expect(layout.AddImage(ctx, second)).To(Succeed())
+
+		By("using both images and then accessing the first one")
+		use(layout, first)
+		use(layout, second)
+		desc, err := layout.Indexer().Find(ctx, descriptormatcher.Digests(first.Descriptor().Digest))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = layout.Image(ctx, desc)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("adding a third image exceeding the max size")
+		Expect(layout.AddImage(ctx, third)).To(Succeed())
+		descs, err := layout.Indexer().List(ctx, descriptormatcher.Every)
+		Expect(err).NotTo(HaveOccurred())
+		var digests []string
+		for _, desc := range descs {
+			digests = append(digests, desc.Digest.String())
+		}
+		Expect(digests).To(ConsistOf(second.Descriptor().Digest.String(), third.Descriptor().Digest.String()))
+	})
+})
@@ -0,0 +1,224 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/utils/fsutil"
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// VerifiedBlobsFileName is the name of the file in the layout directory recording the blobs verified
+// against their digest along with the stat signature of their file at that time, see Layout.Verify.
+const VerifiedBlobsFileName = "verified.json"
+
+// VerifyHook is called for each blob verified by Layout.Verify, e.g. to count verification cache hits.
+// cached reports whether the blob was trusted instead of hashing it, because its file did not change since
+// it was last verified or because the kernel verifies it, see local.Store.VerityVerified.
+type VerifyHook func(ctx context.Context, desc ocispec.Descriptor, cached bool)
+
+// WithVerifyHook adds a hook called for each blob verified, see VerifyHook.
+func WithVerifyHook(hook VerifyHook) Option {
+	return func(o *Options) {
+		o.VerifyHooks = append(o.VerifyHooks, hook)
+	}
+}
+
+// VerifyOptions are options for Layout.Verify.
+type VerifyOptions struct {
+	// Deep hashes all blobs, ignoring and refreshing the recorded verifications.
+	Deep bool
+}
+
+// VerifyOption is an option for Layout.Verify.
+type VerifyOption func(o *VerifyOptions)
+
+// WithDeep hashes all blobs instead of trusting those whose file did not change since they were last
+// verified.
+func WithDeep() VerifyOption {
+	return func(o *VerifyOptions) {
+		o.Deep = true
+	}
+}
+
+// blobSignature is the stat signature of a blob file. A blob whose file still has the signature it had
+// when it was verified is trusted without hashing it again. Restoring a corrupted file with its former
+// size and modification time is not detected.
+type blobSignature struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+	Inode   uint64 `json:"inode,omitempty"`
+}
+
+func newBlobSignature(fi os.FileInfo) blobSignature {
+	return blobSignature{Size: fi.Size(), ModTime: fi.ModTime().UnixNano(), Inode: fsutil.FileID(fi)}
+}
+
+// readVerifiedBlobs returns the recorded verifications. They are empty if there are none or they cannot
+// be read, in which case the blobs are hashed again.
+func (l *Layout) readVerifiedBlobs() map[digest.Digest]blobSignature {
+	verified := make(map[digest.Digest]blobSignature)
+	data, err := os.ReadFile(filepath.Join(l.path, VerifiedBlobsFileName))
+	if err != nil {
+		return verified
+	}
+	if err := json.Unmarshal(data, &verified); err != nil {
+		return make(map[digest.Digest]blobSignature)
+	}
+	return verified
+}
+
+// writeVerifiedBlobs replaces the recorded verifications, dropping those of blobs that were removed.
+// Like the reference counts, they are not synced: losing them only costs hashing the blobs again.
+func (l *Layout) writeVerifiedBlobs(verified map[digest.Digest]blobSignature) error {
+	for dgst := range verified {
+		if path, err := l.store.BlobPath(dgst); err != nil || !fileExists(path) {
+			delete(verified, dgst)
+		}
+	}
+
+	data, err := json.Marshal(verified)
+	if err != nil {
+		return fmt.Errorf("error marshaling verified blobs: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(l.path, "."+VerifiedBlobsFileName+".*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary verified blobs file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error writing verified blobs: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary verified blobs file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(l.path, VerifiedBlobsFileName)); err != nil {
+		return fmt.Errorf("error writing verified blobs: %w", err)
+	}
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Verify verifies the blobs of the given descriptors against their digests and sizes. Blobs whose file
+// has the same size, modification time and inode as when it was last verified and blobs protected with
+// fsverity (see local.Store.VerityVerified) are trusted without hashing them again, unless WithDeep is
+// given. Successful verifications are recorded in the
+// VerifiedBlobsFileName file, failing to record them is only logged. Concurrent processes may lose each
+// other's records, which only costs hashing the affected blobs again. The verify hooks are called for each blob, see WithVerifyHook.
+func (l *Layout) Verify(ctx context.Context, descs []ocispec.Descriptor, opts ...VerifyOption) error {
+	o := &VerifyOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	l.verifyMu.Lock()
+	defer l.verifyMu.Unlock()
+
+	var (
+		verified = l.readVerifiedBlobs()
+		changed  bool
+	)
+	for _, desc := range descs {
+		path, err := l.store.BlobPath(desc.Digest)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("error opening blob %s: %w", desc.Digest, err)
+		}
+		signature := newBlobSignature(fi)
+
+		if recorded, ok := verified[desc.Digest]; ok && !o.Deep && recorded == signature {
+			l.verified(ctx, desc, true)
+			continue
+		}
+		if ok, _ := l.VerityVerified(ctx, desc); ok && !o.Deep {
+			l.verified(ctx, desc, true)
+			continue
+		}
+
+		delete(verified, desc.Digest)
+		changed = true
+		if err := l.hashBlob(ctx, desc); err != nil {
+			return err
+		}
+		verified[desc.Digest] = signature
+		l.verified(ctx, desc, false)
+	}
+
+	if changed {
+		if err := l.writeVerifiedBlobs(verified); err != nil {
+			logr.FromContextOrDiscard(ctx).Info("Error recording verified blobs", "Error", err.Error())
+		}
+	}
+	return nil
+}
+
+// VerityVerified reports whether the kernel vouches for the content of the blob of the descriptor (see
+// local.Store.VerityVerified) and the blob has the size of the descriptor, so it need not be hashed to
+// verify it.
+func (l *Layout) VerityVerified(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
+	if ok, err := l.store.VerityVerified(desc.Digest); err != nil || !ok {
+		return false, err
+	}
+	info, err := l.store.Info(ctx, desc.Digest)
+	if err != nil {
+		return false, err
+	}
+	return info.Size == desc.Size, nil
+}
+
+// hashBlob reads the blob fully, verifying its content against the digest and size of the descriptor.
+func (l *Layout) hashBlob(ctx context.Context, desc ocispec.Descriptor) error {
+	rc, err := ocicontent.Layer(l.store, desc).Content(ctx)
+	if err != nil {
+		return fmt.Errorf("error opening blob %s: %w", desc.Digest, err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	_, err = ioutils.CopyVerify(ctx, io.Discard, rc, desc)
+	if errors.Is(err, ioutils.ErrDigestMismatch) || errors.Is(err, ioutils.ErrSizeMismatch) {
+		return fmt.Errorf("content of blob %s does not match its digest: %w", desc.Digest, err)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading blob %s: %w", desc.Digest, err)
+	}
+	return nil
+}
+
+func (l *Layout) verified(ctx context.Context, desc ocispec.Descriptor, cached bool) {
+	for _, hook := range l.verifyHooks {
+		hook(ctx, desc, cached)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout_test
+
+import (
+	"context"
+	"os"
+	"time"
+
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/local"
+	"github.com/onmetal/onmetal-image/utils/sets"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Verify", func() {
+	var (
+		ctx    = context.Background()
+		path   string
+		cached []bool
+		img    ociimage.Image
+		descs  []ocispec.Descriptor
+	)
+
+	open := func() *Layout {
+		l, err := New(path, WithVerifyHook(func(_ context.Context, _ ocispec.Descriptor, hit bool) {
+			cached = append(cached, hit)
+		}))
+		Expect(err).NotTo(HaveOccurred())
+		return l
+	}
+
+	BeforeEach(func() {
+		path = GinkgoT().TempDir()
+		cached = nil
+
+		var err error
+		img, err = imageutil.NewBytesConfigBuilder([]byte("config"), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer([]byte("layer"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(open().AddImage(ctx, img)).To(Succeed())
+
+		manifest, err := img.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		descs = append([]ocispec.Descriptor{img.Descriptor(), manifest.Config}, manifest.Layers...)
+	})
+
+	It("should only hash blobs once until their files change", func() {
+		layout := open()
+		Expect(layout.Verify(ctx, descs)).To(Succeed())
+		Expect(cached).To(Equal([]bool{false, false, false}))
+
+		By("trusting the recorded verifications, also after reopening the layout")
+		cached = nil
+		Expect(open().Verify(ctx, descs)).To(Succeed())
+		Expect(cached).To(Equal([]bool{true, true, true}))
+
+		By("hashing a blob again whose modification time changed")
+		blobPath, err := layout.Store().BlobPath(descs[2].Digest)
+		Expect(err).NotTo(HaveOccurred())
+		later := time.Now().Add(time.Hour)
+		Expect(os.Chtimes(blobPath, later, later)).To(Succeed())
+		cached = nil
+		Expect(layout.Verify(ctx, descs)).To(Succeed())
+		Expect(cached).To(Equal([]bool{true, true, false}))
+
+		By("hashing all blobs if deep")
+		cached = nil
+		Expect(layout.Verify(ctx, descs, WithDeep())).To(Succeed())
+		Expect(cached).To(Equal([]bool{false, false, false}))
+	})
+
+	It("should detect blobs changed after their verification", func() {
+		layout := open()
+		Expect(layout.Verify(ctx, descs)).To(Succeed())
+
+		blobPath, err := layout.Store().BlobPath(descs[2].Digest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(blobPath, []byte("tampered"), 0644)).To(Succeed())
+
+		Expect(layout.Verify(ctx, descs)).To(MatchError(ContainSubstring("does not match its digest")))
+	})
+})
+
+var _ = Describe("Verify protected blobs", func() {
+	It("should verify and remove the blobs of a store protecting them", func() {
+		ctx := context.Background()
+		l, err := New(GinkgoT().TempDir(), WithStoreOptions(local.WithProtection()))
+		Expect(err).NotTo(HaveOccurred())
+
+		img, err := imageutil.NewBytesConfigBuilder([]byte("config"), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer([]byte("layer"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(l.AddImage(ctx, img)).To(Succeed())
+
+		manifest, err := img.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		layer := manifest.Layers[0]
+		info, ok, err := l.Store().Protection(layer.Digest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		verified, err := l.VerityVerified(ctx, layer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(verified).To(Equal(info.Protection == local.ProtectionFSVerity))
+		Expect(l.Verify(ctx, []ocispec.Descriptor{img.Descriptor(), manifest.Config, layer})).To(Succeed())
+
+		By("removing the protected blobs along with the image")
+		results, _, err := l.PruneUnlisted(ctx, sets.New[digest.Digest]())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].Err).NotTo(HaveOccurred())
+		path, err := l.Store().BlobPath(layer.Digest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).NotTo(BeAnExistingFile())
+	})
+})
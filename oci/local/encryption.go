@@ -0,0 +1,561 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrUnknownKey is returned when reading a blob encrypted with a key the store was not configured with.
+var ErrUnknownKey = errors.New("blob is encrypted with an unknown key")
+
+// Encrypted blobs start with a header followed by the AES-GCM sealed chunks of the plaintext.
+//
+//	magic (8) | key id (8) | salt (16) | chunk size (4) | plaintext size (8)
+//
+// Each blob is sealed with its own key, derived from the store key and the random salt via HMAC-SHA256,
+// so the chunk index can be used as nonce. The chunk index and a flag marking the last chunk are used as
+// additional data, which detects reordered and truncated chunks.
+const (
+	encryptionMagic      = "OMIENC01"
+	encryptionChunkSize  = 64 << 10
+	encryptionHeaderSize = len(encryptionMagic) + keyIDSize + saltSize + 4 + 8
+
+	keyIDSize = 8
+	saltSize  = 16
+
+	// encryptedIngestDir holds the encrypted blobs being written, see migration.Steps.
+	encryptedIngestDir = "tmp/ingest-encrypted"
+)
+
+type keyID [keyIDSize]byte
+
+func (id keyID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// KeyID returns the id identifying the key in the header of blobs encrypted with it.
+func KeyID(key []byte) string {
+	return newKeyID(key).String()
+}
+
+func newKeyID(key []byte) keyID {
+	sum := sha256.Sum256(key)
+	var id keyID
+	copy(id[:], sum[:keyIDSize])
+	return id
+}
+
+// ReadKeyFile reads a hex-encoded encryption key (as generated by e.g. `openssl rand -hex 32`) from the given file.
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %w", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("key file %s does not contain a hex-encoded key: %w", path, err)
+	}
+	if err := validateKey(key); err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %w", path, err)
+	}
+	return key, nil
+}
+
+func validateKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	default:
+		return fmt.Errorf("key has to be 16, 24 or 32 bytes long, got %d", len(key))
+	}
+}
+
+// keyring holds the key new blobs are encrypted with and all keys blobs can be decrypted with.
+type keyring struct {
+	current *keyID
+	keys    map[keyID][]byte
+}
+
+func newKeyring(current []byte, decryptionKeys [][]byte) (*keyring, error) {
+	k := &keyring{keys: make(map[keyID][]byte)}
+	for _, key := range append([][]byte{current}, decryptionKeys...) {
+		if key == nil {
+			continue
+		}
+		if err := validateKey(key); err != nil {
+			return nil, err
+		}
+		k.keys[newKeyID(key)] = key
+	}
+	if current != nil {
+		id := newKeyID(current)
+		k.current = &id
+	}
+	return k, nil
+}
+
+func (k *keyring) aead(id keyID, salt []byte) (cipher.AEAD, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownKey, id)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type encryptionHeader struct {
+	keyID     keyID
+	salt      [saltSize]byte
+	chunkSize uint32
+	size      int64
+}
+
+func (h *encryptionHeader) marshal() []byte {
+	buf := make([]byte, 0, encryptionHeaderSize)
+	buf = append(buf, encryptionMagic...)
+	buf = append(buf, h.keyID[:]...)
+	buf = append(buf, h.salt[:]...)
+	buf = binary.BigEndian.AppendUint32(buf, h.chunkSize)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.size))
+	return buf
+}
+
+// readEncryptionHeader reads the encryption header of a blob. If the blob is not encrypted, it returns false.
+func readEncryptionHeader(r io.ReaderAt) (*encryptionHeader, bool, error) {
+	buf := make([]byte, encryptionHeaderSize)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	if !bytes.HasPrefix(buf, []byte(encryptionMagic)) {
+		return nil, false, nil
+	}
+
+	h := &encryptionHeader{}
+	buf = buf[len(encryptionMagic):]
+	copy(h.keyID[:], buf)
+	buf = buf[keyIDSize:]
+	copy(h.salt[:], buf)
+	buf = buf[saltSize:]
+	h.chunkSize = binary.BigEndian.Uint32(buf)
+	h.size = int64(binary.BigEndian.Uint64(buf[4:]))
+	if h.chunkSize == 0 {
+		return nil, false, fmt.Errorf("invalid encryption header: chunk size is zero")
+	}
+	return h, true, nil
+}
+
+func readBlobEncryptionHeader(path string) (*encryptionHeader, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() { _ = f.Close() }()
+	return readEncryptionHeader(f)
+}
+
+func chunkNonce(aead cipher.AEAD, index uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+	return nonce
+}
+
+func chunkAdditionalData(index uint64, last bool) []byte {
+	ad := binary.BigEndian.AppendUint64(nil, index)
+	if last {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// decryptingReaderAt decrypts an encrypted blob chunk-wise on read.
+type decryptingReaderAt struct {
+	f    *os.File
+	aead cipher.AEAD
+	hdr  *encryptionHeader
+
+	mu         sync.Mutex
+	chunk      []byte
+	chunkIndex uint64
+	hasChunk   bool
+}
+
+func (r *decryptingReaderAt) Size() int64 {
+	return r.hdr.size
+}
+
+func (r *decryptingReaderAt) Close() error {
+	return r.f.Close()
+}
+
+func (r *decryptingReaderAt) lastChunk() uint64 {
+	if r.hdr.size == 0 {
+		return 0
+	}
+	return uint64((r.hdr.size - 1) / int64(r.hdr.chunkSize))
+}
+
+// decryptChunk returns the plaintext of the chunk with the given index. The caller has to hold mu.
+func (r *decryptingReaderAt) decryptChunk(index uint64) ([]byte, error) {
+	if r.hasChunk && r.chunkIndex == index {
+		return r.chunk, nil
+	}
+
+	var (
+		chunkSize = int64(r.hdr.chunkSize)
+		overhead  = int64(r.aead.Overhead())
+		last      = index == r.lastChunk()
+		plainLen  = chunkSize
+	)
+	if last {
+		plainLen = r.hdr.size - int64(index)*chunkSize
+	}
+
+	sealed := make([]byte, plainLen+overhead)
+	if _, err := r.f.ReadAt(sealed, int64(encryptionHeaderSize)+int64(index)*(chunkSize+overhead)); err != nil {
+		return nil, fmt.Errorf("error reading chunk %d: %w", index, err)
+	}
+
+	plain, err := r.aead.Open(sealed[:0], chunkNonce(r.aead, index), sealed, chunkAdditionalData(index, last))
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting chunk %d: %w", index, err)
+	}
+
+	r.chunk, r.chunkIndex, r.hasChunk = plain, index, true
+	return plain, nil
+}
+
+func (r *decryptingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %w", errdefs.ErrInvalidArgument)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int
+	for n < len(p) && off < r.hdr.size {
+		index := uint64(off / int64(r.hdr.chunkSize))
+		chunk, err := r.decryptChunk(index)
+		if err != nil {
+			return n, err
+		}
+
+		copied := copy(p[n:], chunk[off-int64(index)*int64(r.hdr.chunkSize):])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// encryptingWriter is a content.Writer writing an encrypted blob.
+// Unlike the plaintext writer, interrupted ingests cannot be resumed and are restarted.
+type encryptingWriter struct {
+	store *Store
+	ref   string
+	dir   string
+	f     *os.File
+	aead  cipher.AEAD
+	hdr   encryptionHeader
+	// replace allows committing over an existing blob, used for re-encrypting blobs.
+	replace bool
+
+	buf      []byte
+	chunk    uint64
+	offset   int64
+	total    int64
+	expected digest.Digest
+	digester digest.Digester
+
+	startedAt time.Time
+	updatedAt time.Time
+}
+
+func (s *Store) encryptedIngestDir(ref string) string {
+	return filepath.Join(s.ingestRoot, filepath.FromSlash(encryptedIngestDir), digest.FromString(ref).Encoded())
+}
+
+func (s *Store) encryptingWriter(ref string, total int64, expected digest.Digest, replace bool) (*encryptingWriter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.writers[ref]; ok {
+		return nil, fmt.Errorf("ref %s locked: %w", ref, errdefs.ErrUnavailable)
+	}
+
+	hdr := encryptionHeader{keyID: *s.keys.current, chunkSize: encryptionChunkSize}
+	if _, err := rand.Read(hdr.salt[:]); err != nil {
+		return nil, fmt.Errorf("error generating salt: %w", err)
+	}
+	aead, err := s.keys.aead(hdr.keyID, hdr.salt[:])
+	if err != nil {
+		return nil, err
+	}
+
+	dir := s.encryptedIngestDir(ref)
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("error removing stale ingest: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating ingest directory: %w", err)
+	}
+	f, err := os.Create(filepath.Join(dir, "data"))
+	if err != nil {
+		return nil, fmt.Errorf("error creating ingest file: %w", err)
+	}
+	if _, err := f.Write(hdr.marshal()); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("error writing header: %w", err)
+	}
+
+	now := time.Now()
+	w := &encryptingWriter{
+		store:     s,
+		ref:       ref,
+		dir:       dir,
+		f:         f,
+		aead:      aead,
+		hdr:       hdr,
+		replace:   replace,
+		buf:       make([]byte, 0, encryptionChunkSize),
+		total:     total,
+		expected:  expected,
+		digester:  digest.Canonical.Digester(),
+		startedAt: now,
+		updatedAt: now,
+	}
+	s.writers[ref] = w
+	return w, nil
+}
+
+func (w *encryptingWriter) flush(last bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.aead, w.chunk), w.buf, chunkAdditionalData(w.chunk, last))
+	if _, err := w.f.Write(sealed); err != nil {
+		return err
+	}
+	w.chunk++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		// Only flush a full chunk once more data arrives, as the last chunk is sealed differently.
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+
+		copied := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+copied]
+		_, _ = w.digester.Hash().Write(p[:copied])
+		p = p[copied:]
+		n += copied
+		w.offset += int64(copied)
+	}
+	w.updatedAt = time.Now()
+	return n, nil
+}
+
+func (w *encryptingWriter) Digest() digest.Digest {
+	return w.digester.Digest()
+}
+
+func (w *encryptingWriter) Status() (content.Status, error) {
+	return content.Status{
+		Ref:       w.ref,
+		Offset:    w.offset,
+		Total:     w.total,
+		Expected:  w.expected,
+		StartedAt: w.startedAt,
+		UpdatedAt: w.updatedAt,
+	}, nil
+}
+
+func (w *encryptingWriter) Truncate(size int64) error {
+	if size != 0 {
+		return fmt.Errorf("encrypted ingests can only be truncated to zero: %w", errdefs.ErrNotImplemented)
+	}
+	if err := w.f.Truncate(int64(encryptionHeaderSize)); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(int64(encryptionHeaderSize), io.SeekStart); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.chunk = 0
+	w.offset = 0
+	w.digester = digest.Canonical.Digester()
+	return nil
+}
+
+func (w *encryptingWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	if w.f == nil {
+		return fmt.Errorf("cannot commit on closed writer: %w", errdefs.ErrFailedPrecondition)
+	}
+	if err := w.flush(true); err != nil {
+		return fmt.Errorf("error writing last chunk: %w", err)
+	}
+
+	if size > 0 && size != w.offset {
+		return fmt.Errorf("unexpected commit size %d, expected %d: %w", w.offset, size, errdefs.ErrFailedPrecondition)
+	}
+	dgst := w.digester.Digest()
+	if expected != "" && expected != dgst {
+		return fmt.Errorf("unexpected commit digest %s, expected %s: %w", dgst, expected, errdefs.ErrFailedPrecondition)
+	}
+
+	w.hdr.size = w.offset
+	if _, err := w.f.WriteAt(w.hdr.marshal(), 0); err != nil {
+		return fmt.Errorf("error writing header: %w", err)
+	}
+	if w.store.sync {
+		if err := w.f.Sync(); err != nil {
+			return fmt.Errorf("error syncing ingest: %w", err)
+		}
+	}
+	if err := w.f.Close(); err != nil {
+		return fmt.Errorf("error closing ingest: %w", err)
+	}
+	w.f = nil
+
+	target, err := w.store.BlobPath(dgst)
+	if err != nil {
+		return err
+	}
+	if !w.replace {
+		if _, err := os.Stat(target); err == nil {
+			return fmt.Errorf("content %v: %w", dgst, errdefs.ErrAlreadyExists)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("error creating blob directory: %w", err)
+	}
+	if w.replace {
+		if err := w.store.unprotect(dgst); err != nil {
+			return err
+		}
+		w.store.removeProtectionRecord(dgst)
+	}
+	if err := os.Rename(filepath.Join(w.dir, "data"), target); err != nil {
+		return fmt.Errorf("error committing blob: %w", w.store.commitError(err))
+	}
+	return w.store.committed(ctx, dgst)
+}
+
+// Close closes the writer. Uncommitted data is removed as encrypted ingests cannot be resumed.
+func (w *encryptingWriter) Close() error {
+	w.store.mu.Lock()
+	delete(w.store.writers, w.ref)
+	w.store.mu.Unlock()
+
+	if w.f != nil {
+		_ = w.f.Close()
+		w.f = nil
+	}
+	return os.RemoveAll(w.dir)
+}
+
+// Rewrap encrypts all blobs that are not yet encrypted with the current encryption key, i.e. blobs encrypted
+// with one of the decryption keys and plaintext blobs. The content is verified against its digest before it
+// is replaced. It returns the number of rewritten blobs.
+func (s *Store) Rewrap(ctx context.Context) (int, error) {
+	if s.keys.current == nil {
+		return 0, fmt.Errorf("store has no encryption key")
+	}
+
+	var infos []content.Info
+	if err := s.store.Walk(ctx, func(info content.Info) error {
+		infos = append(infos, info)
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("error listing blobs: %w", err)
+	}
+
+	var rewrapped int
+	for _, info := range infos {
+		path, err := s.BlobPath(info.Digest)
+		if err != nil {
+			return rewrapped, err
+		}
+		hdr, encrypted, err := readBlobEncryptionHeader(path)
+		if err != nil {
+			return rewrapped, fmt.Errorf("error reading blob %s: %w", info.Digest, err)
+		}
+		if encrypted && hdr.keyID == *s.keys.current {
+			continue
+		}
+
+		if err := s.rewrap(ctx, info.Digest); err != nil {
+			return rewrapped, fmt.Errorf("error rewrapping blob %s: %w", info.Digest, err)
+		}
+		rewrapped++
+	}
+	return rewrapped, nil
+}
+
+func (s *Store) rewrap(ctx context.Context, dgst digest.Digest) error {
+	ra, err := s.ReaderAt(ctx, ocispec.Descriptor{Digest: dgst})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = ra.Close() }()
+
+	w, err := s.encryptingWriter("rewrap-"+dgst.String(), ra.Size(), dgst, true)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = w.Close() }()
+
+	if _, err := io.Copy(w, content.NewReader(ra)); err != nil {
+		return fmt.Errorf("error copying content: %w", err)
+	}
+	return w.Commit(ctx, ra.Size(), dgst)
+}
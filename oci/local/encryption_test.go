@@ -0,0 +1,167 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/content"
+	. "github.com/onmetal/onmetal-image/oci/local"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Encryption", func() {
+	var (
+		ctx    context.Context
+		root   string
+		oldKey = bytes.Repeat([]byte{1}, 32)
+		newKey = bytes.Repeat([]byte{2}, 32)
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		root = GinkgoT().TempDir()
+	})
+
+	newStore := func(opts ...Option) *Store {
+		s, err := NewStore(root, opts...)
+		Expect(err).NotTo(HaveOccurred())
+		return s
+	}
+
+	write := func(s *Store, data []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data))}
+		Expect(content.WriteBlob(ctx, s, "test-"+desc.Digest.Encoded(), bytes.NewReader(data), desc)).To(Succeed())
+		return desc
+	}
+
+	read := func(s *Store, desc ocispec.Descriptor) []byte {
+		data, err := content.ReadBlob(ctx, s, desc)
+		Expect(err).NotTo(HaveOccurred())
+		return data
+	}
+
+	randomData := func(size int) []byte {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		Expect(err).NotTo(HaveOccurred())
+		return data
+	}
+
+	It("should encrypt blobs at rest and decrypt them transparently", func() {
+		s := newStore(WithEncryption(oldKey))
+		data := randomData(200 << 10)
+		desc := write(s, data)
+
+		path, err := s.BlobPath(desc.Digest)
+		Expect(err).NotTo(HaveOccurred())
+		raw, err := os.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Contains(raw, data[:1024])).To(BeFalse())
+
+		info, err := s.Info(ctx, desc.Digest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Size).To(Equal(desc.Size))
+		Expect(read(s, desc)).To(Equal(data))
+
+		By("reading at an offset spanning two chunks")
+		ra, err := s.ReaderAt(ctx, desc)
+		Expect(err).NotTo(HaveOccurred())
+		defer func() { _ = ra.Close() }()
+		buf := make([]byte, 1000)
+		_, err = ra.ReadAt(buf, (64<<10)-500)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(buf).To(Equal(data[(64<<10)-500 : (64<<10)+500]))
+
+		By("reading past the end")
+		n, err := ra.ReadAt(buf, desc.Size-10)
+		Expect(err).To(MatchError(io.EOF))
+		Expect(n).To(Equal(10))
+	})
+
+	It("should encrypt empty blobs", func() {
+		s := newStore(WithEncryption(oldKey))
+		desc := write(s, nil)
+		Expect(read(s, desc)).To(BeEmpty())
+	})
+
+	It("should reject commits with a mismatching digest", func() {
+		s := newStore(WithEncryption(oldKey))
+		desc := ocispec.Descriptor{Digest: digest.FromString("other"), Size: 4}
+		err := content.WriteBlob(ctx, s, "mismatch", bytes.NewReader([]byte("data")), desc)
+		Expect(err).To(HaveOccurred())
+
+		_, err = s.Info(ctx, desc.Digest)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should support plaintext and encrypted blobs in one store", func() {
+		plain := write(newStore(), []byte("plaintext"))
+
+		s := newStore(WithEncryption(oldKey))
+		encrypted := write(s, []byte("encrypted"))
+
+		Expect(read(s, plain)).To(Equal([]byte("plaintext")))
+		Expect(read(s, encrypted)).To(Equal([]byte("encrypted")))
+	})
+
+	It("should fail reading blobs encrypted with an unknown key", func() {
+		desc := write(newStore(WithEncryption(oldKey)), []byte("secret"))
+
+		_, err := newStore(WithEncryption(newKey)).ReaderAt(ctx, desc)
+		Expect(err).To(MatchError(ErrUnknownKey))
+	})
+
+	It("should detect tampered blobs", func() {
+		s := newStore(WithEncryption(oldKey))
+		desc := write(s, []byte("secret"))
+
+		path, err := s.BlobPath(desc.Digest)
+		Expect(err).NotTo(HaveOccurred())
+		raw, err := os.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		raw[len(raw)-1] ^= 0xff
+		Expect(os.Chmod(path, 0644)).To(Succeed())
+		Expect(os.WriteFile(path, raw, 0644)).To(Succeed())
+
+		_, err = content.ReadBlob(ctx, s, desc)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should rewrap blobs with a new key", func() {
+		plain := write(newStore(), []byte("plaintext"))
+		encrypted := write(newStore(WithEncryption(oldKey)), []byte("encrypted"))
+
+		n, err := newStore(WithEncryption(newKey), WithDecryptionKeys(oldKey)).Rewrap(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(2))
+
+		s := newStore(WithEncryption(newKey))
+		Expect(read(s, plain)).To(Equal([]byte("plaintext")))
+		Expect(read(s, encrypted)).To(Equal([]byte("encrypted")))
+
+		By("rewrapping again")
+		n, err = s.Rewrap(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(BeZero())
+	})
+})
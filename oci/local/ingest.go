@@ -0,0 +1,170 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/opencontainers/go-digest"
+)
+
+// ingestRecordDir holds the records of the expected digest and originating image of ingests, see
+// Store.RecordIngest.
+const ingestRecordDir = "tmp/ingest-records"
+
+// IngestInfo describes an ingest of the store, i.e. a blob being written or whose writing was interrupted.
+type IngestInfo struct {
+	// Ref is the ingest ref.
+	Ref string `json:"ref"`
+	// Expected is the digest of the blob being written, if known.
+	Expected digest.Digest `json:"expected,omitempty"`
+	// Offset is the number of bytes written so far.
+	Offset int64 `json:"offset"`
+	// Total is the size of the blob, or zero if it is not known.
+	Total int64 `json:"total,omitempty"`
+	// StartedAt is when the ingest started.
+	StartedAt time.Time `json:"startedAt"`
+	// UpdatedAt is when the ingest was last written to.
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Source is the reference of the image the blob is written for, if known.
+	Source string `json:"source,omitempty"`
+	// Stale is set if the ingest was not updated for longer than ocicontent.IngestStaleAfter. Stale ingests
+	// are restarted from scratch instead of being resumed and removed by Store.CleanupIngests.
+	Stale bool `json:"stale"`
+}
+
+type ingestRecord struct {
+	Ref      string        `json:"ref"`
+	Expected digest.Digest `json:"expected,omitempty"`
+	Source   string        `json:"source,omitempty"`
+}
+
+func (s *Store) ingestRecordPath(ref string) string {
+	return filepath.Join(s.root, filepath.FromSlash(ingestRecordDir), digest.FromString(ref).Encoded()+".json")
+}
+
+// RecordIngest records the expected digest and the originating image reference of the ingest with the
+// given ref, see ocicontent.IngestRecorder.
+func (s *Store) RecordIngest(ref string, expected digest.Digest, source string) error {
+	data, err := json.Marshal(ingestRecord{Ref: ref, Expected: expected, Source: source})
+	if err != nil {
+		return err
+	}
+	path := s.ingestRecordPath(ref)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return fmt.Errorf("error creating ingest record directory: %w", err)
+	}
+	return os.WriteFile(path, data, 0666)
+}
+
+func (s *Store) readIngestRecord(ref string) (ingestRecord, bool) {
+	data, err := os.ReadFile(s.ingestRecordPath(ref))
+	if err != nil {
+		return ingestRecord{}, false
+	}
+	var record ingestRecord
+	if err := json.Unmarshal(data, &record); err != nil || record.Ref != ref {
+		return ingestRecord{}, false
+	}
+	return record, true
+}
+
+func (s *Store) removeIngestRecord(ref string) {
+	_ = os.Remove(s.ingestRecordPath(ref))
+}
+
+// IngestStatus returns all ingests of the store, in-flight and interrupted ones, ordered by ref.
+// The expected digest falls back to the one encoded in the ref, see ocicontent.ExpectedDigest.
+func (s *Store) IngestStatus(ctx context.Context) ([]IngestInfo, error) {
+	statuses, err := s.ListStatuses(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing ingests: %w", err)
+	}
+
+	now := time.Now()
+	infos := make([]IngestInfo, 0, len(statuses))
+	for _, status := range statuses {
+		info := IngestInfo{
+			Ref:       status.Ref,
+			Expected:  status.Expected,
+			Offset:    status.Offset,
+			Total:     status.Total,
+			StartedAt: status.StartedAt,
+			UpdatedAt: status.UpdatedAt,
+			Stale:     now.Sub(status.UpdatedAt) > ocicontent.IngestStaleAfter,
+		}
+		if record, ok := s.readIngestRecord(status.Ref); ok {
+			info.Source = record.Source
+			if info.Expected == "" {
+				info.Expected = record.Expected
+			}
+		}
+		if info.Expected == "" {
+			info.Expected = ocicontent.ExpectedDigest(status.Ref)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Ref < infos[j].Ref })
+	return infos, nil
+}
+
+// CleanupIngests removes the stale ingests of the store (see IngestInfo.Stale) and the records of ingests
+// that no longer exist. It returns the removed ingests.
+func (s *Store) CleanupIngests(ctx context.Context) ([]IngestInfo, error) {
+	infos, err := s.IngestStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		removed []IngestInfo
+		refs    = make(map[string]struct{}, len(infos))
+	)
+	for _, info := range infos {
+		if !info.Stale {
+			refs[info.Ref] = struct{}{}
+			continue
+		}
+		if err := s.Abort(ctx, info.Ref); err != nil && !errdefs.IsNotFound(err) {
+			return removed, fmt.Errorf("error removing ingest %s: %w", info.Ref, err)
+		}
+		removed = append(removed, info)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.root, filepath.FromSlash(ingestRecordDir)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return removed, fmt.Errorf("error listing ingest records: %w", err)
+	}
+	live := make(map[string]struct{}, len(refs))
+	for ref := range refs {
+		live[filepath.Base(s.ingestRecordPath(ref))] = struct{}{}
+	}
+	for _, entry := range entries {
+		if _, ok := live[entry.Name()]; ok {
+			continue
+		}
+		_ = os.Remove(filepath.Join(s.root, filepath.FromSlash(ingestRecordDir), entry.Name()))
+	}
+	return removed, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	. "github.com/onmetal/onmetal-image/oci/local"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Ingests", func() {
+	var (
+		ctx  context.Context
+		root string
+		s    *Store
+		data = []byte("partial blob content")
+		dgst = digest.FromBytes(data)
+	)
+	BeforeEach(func() {
+		ctx = context.Background()
+		root = GinkgoT().TempDir()
+		var err error
+		s, err = NewStore(root)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	// interrupt writes half of the blob to an ingest with the given ref and closes it without committing.
+	interrupt := func(ref string) {
+		w, err := s.Writer(ctx, content.WithRef(ref), content.WithDescriptor(ocispec.Descriptor{Digest: dgst, Size: int64(len(data))}))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = w.Write(data[:len(data)/2])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(w.Close()).To(Succeed())
+	}
+
+	// age sets the update time of the ingest with the given ref into the past.
+	age := func(ref string, d time.Duration) {
+		dir := filepath.Join(root, "ingest", digest.FromString(ref).Encoded())
+		at := time.Now().Add(-d)
+		text, err := at.MarshalText()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(dir, "updatedat"), text, 0666)).To(Succeed())
+		Expect(os.Chtimes(filepath.Join(dir, "data"), at, at)).To(Succeed())
+	}
+
+	It("should report the progress and source of interrupted ingests", func() {
+		ref := "layer-" + dgst.String() + "-abc"
+		Expect(s.RecordIngest(ref, dgst, "example.org/image:v1")).To(Succeed())
+		interrupt(ref)
+
+		infos, err := s.IngestStatus(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(infos).To(HaveLen(1))
+		Expect(infos[0].Ref).To(Equal(ref))
+		Expect(infos[0].Expected).To(Equal(dgst))
+		Expect(infos[0].Offset).To(Equal(int64(len(data) / 2)))
+		Expect(infos[0].Total).To(Equal(int64(len(data))))
+		Expect(infos[0].Source).To(Equal("example.org/image:v1"))
+		Expect(infos[0].Stale).To(BeFalse())
+	})
+
+	It("should fall back to the digest of the ref without a record", func() {
+		ref := "layer-" + dgst.String() + "-abc"
+		interrupt(ref)
+
+		infos, err := s.IngestStatus(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(infos).To(HaveLen(1))
+		Expect(infos[0].Expected).To(Equal(dgst))
+		Expect(infos[0].Source).To(BeEmpty())
+	})
+
+	It("should only clean up stale ingests", func() {
+		var (
+			fresh = "layer-" + dgst.String() + "-fresh"
+			stale = "layer-" + dgst.String() + "-stale"
+		)
+		for _, ref := range []string{fresh, stale} {
+			Expect(s.RecordIngest(ref, dgst, "example.org/image:v1")).To(Succeed())
+			interrupt(ref)
+		}
+		age(stale, ocicontent.IngestStaleAfter+time.Hour)
+		Expect(s.RecordIngest("gone", dgst, "example.org/image:v1")).To(Succeed())
+
+		infos, err := s.IngestStatus(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(infos).To(HaveLen(2))
+		Expect(infos[0].Ref).To(Equal(fresh))
+		Expect(infos[0].Stale).To(BeFalse())
+		Expect(infos[1].Ref).To(Equal(stale))
+		Expect(infos[1].Stale).To(BeTrue())
+
+		removed, err := s.CleanupIngests(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(removed).To(HaveLen(1))
+		Expect(removed[0].Ref).To(Equal(stale))
+
+		infos, err = s.IngestStatus(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(infos).To(HaveLen(1))
+		Expect(infos[0].Ref).To(Equal(fresh))
+		Expect(infos[0].Source).To(Equal("example.org/image:v1"))
+
+		records, err := os.ReadDir(filepath.Join(root, "tmp", "ingest-records"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,168 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	"github.com/onmetal/onmetal-image/utils/fsutil"
+	"github.com/opencontainers/go-digest"
+)
+
+// ProtectionRecordDir holds the records of the protection applied to committed blobs, see
+// Store.Protection.
+const ProtectionRecordDir = "protection"
+
+// Protection is a protection against tampering applied to a committed blob, see WithProtection.
+type Protection string
+
+const (
+	// ProtectionNone means neither fsverity nor the immutable attribute could be applied.
+	ProtectionNone Protection = "none"
+	// ProtectionFSVerity means fsverity is enabled on the blob file: the kernel verifies its content on
+	// every read and rejects writing it.
+	ProtectionFSVerity Protection = "fsverity"
+	// ProtectionImmutable means the blob file has the immutable attribute: it cannot be written, renamed
+	// or removed without clearing the attribute first.
+	ProtectionImmutable Protection = "immutable"
+)
+
+// ProtectionInfo records the protection applied to a committed blob.
+type ProtectionInfo struct {
+	// Protection is the applied protection.
+	Protection Protection `json:"protection"`
+	// VerityDigest is the fsverity digest measured right after enabling fsverity, see
+	// fsutil.MeasureVerity. It is only set for ProtectionFSVerity.
+	VerityDigest string `json:"verityDigest,omitempty"`
+}
+
+func (s *Store) protectionRecordPath(dgst digest.Digest) string {
+	return filepath.Join(s.root, ProtectionRecordDir, dgst.Algorithm().String(), dgst.Encoded()+".json")
+}
+
+// protect protects the committed blob of dgst with fsverity or, if that is not supported, the immutable
+// attribute, and records the applied protection. Failing to protect the blob is only logged, the blob is
+// committed regardless.
+func (s *Store) protect(ctx context.Context, dgst digest.Digest) {
+	log := logr.FromContextOrDiscard(ctx)
+	path, err := s.BlobPath(dgst)
+	if err != nil {
+		return
+	}
+
+	info := ProtectionInfo{Protection: ProtectionNone}
+	if err := fsutil.EnableVerity(path); err != nil {
+		log.V(1).Info("Could not enable fsverity on blob", "Digest", dgst, "Error", err.Error())
+	} else if measured, ok, err := fsutil.MeasureVerity(path); err == nil && ok {
+		info = ProtectionInfo{Protection: ProtectionFSVerity, VerityDigest: measured}
+	}
+	if info.Protection == ProtectionNone {
+		if err := fsutil.SetImmutable(path, true); err != nil {
+			log.V(1).Info("Could not make blob immutable", "Digest", dgst, "Error", err.Error())
+		} else {
+			info.Protection = ProtectionImmutable
+		}
+	}
+
+	if err := s.writeProtectionRecord(dgst, info); err != nil {
+		log.V(1).Info("Error recording blob protection", "Digest", dgst, "Error", err.Error())
+	}
+}
+
+func (s *Store) writeProtectionRecord(dgst digest.Digest, info ProtectionInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	path := s.protectionRecordPath(dgst)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return fmt.Errorf("error creating protection record directory: %w", err)
+	}
+	return os.WriteFile(path, data, 0666)
+}
+
+// Protection returns the recorded protection of the blob of dgst. It reports false if none was recorded,
+// i.e. the blob was committed without WithProtection.
+func (s *Store) Protection(dgst digest.Digest) (ProtectionInfo, bool, error) {
+	if err := dgst.Validate(); err != nil {
+		return ProtectionInfo{}, false, err
+	}
+	data, err := os.ReadFile(s.protectionRecordPath(dgst))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ProtectionInfo{}, false, nil
+		}
+		return ProtectionInfo{}, false, fmt.Errorf("error reading protection record of blob %s: %w", dgst, err)
+	}
+	var info ProtectionInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return ProtectionInfo{}, false, fmt.Errorf("invalid protection record of blob %s: %w", dgst, err)
+	}
+	return info, true, nil
+}
+
+// VerityVerified reports whether the kernel vouches for the content of the blob of dgst: its protection
+// was recorded as ProtectionFSVerity and fsverity is still enabled on its file with the recorded digest.
+// Since the digest of the content was verified when committing the blob and the kernel verifies every
+// read against the fsverity digest, such blobs need not be hashed again to verify them. If the file was
+// replaced or copied without fsverity, this reports false and the blob has to be hashed.
+func (s *Store) VerityVerified(dgst digest.Digest) (bool, error) {
+	info, ok, err := s.Protection(dgst)
+	if err != nil || !ok || info.Protection != ProtectionFSVerity {
+		return false, err
+	}
+	path, err := s.BlobPath(dgst)
+	if err != nil {
+		return false, err
+	}
+	measured, ok, err := fsutil.MeasureVerity(path)
+	if err != nil {
+		return false, fmt.Errorf("error measuring blob %s: %w", dgst, err)
+	}
+	return ok && measured == info.VerityDigest, nil
+}
+
+// unprotect clears the immutable attribute of the blob file of dgst, if it exists, so it can be removed or
+// replaced. fsverity does not prevent either.
+func (s *Store) unprotect(dgst digest.Digest) error {
+	path, err := s.BlobPath(dgst)
+	if err != nil {
+		return err
+	}
+	immutable, err := fsutil.IsImmutable(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, fsutil.ErrProtectionNotSupported) {
+			return nil
+		}
+		return err
+	}
+	if !immutable {
+		return nil
+	}
+	if err := fsutil.SetImmutable(path, false); err != nil {
+		return fmt.Errorf("error clearing immutable attribute of blob %s: %w", dgst, err)
+	}
+	return nil
+}
+
+func (s *Store) removeProtectionRecord(dgst digest.Digest) {
+	_ = os.Remove(s.protectionRecordPath(dgst))
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local_test
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/content"
+	. "github.com/onmetal/onmetal-image/oci/local"
+	"github.com/onmetal/onmetal-image/utils/fsutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Protection", func() {
+	var (
+		ctx     context.Context
+		root    string
+		support fsutil.ProtectionSupport
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		root = GinkgoT().TempDir()
+		// Immutable files would keep the temporary directory from being removed if a spec fails early.
+		DeferCleanup(func() {
+			_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					_ = fsutil.SetImmutable(path, false)
+				}
+				return nil
+			})
+		})
+
+		var err error
+		support, err = fsutil.ProbeProtection(root)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	write := func(s *Store, data []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data))}
+		Expect(content.WriteBlob(ctx, s, "test-"+desc.Digest.Encoded(), bytes.NewReader(data), desc)).To(Succeed())
+		return desc
+	}
+
+	expectedProtection := func() Protection {
+		switch {
+		case support.Verity:
+			return ProtectionFSVerity
+		case support.Immutable:
+			return ProtectionImmutable
+		default:
+			return ProtectionNone
+		}
+	}
+
+	DescribeTable("should protect committed blobs as far as the file system allows and remove them again",
+		func(opts ...Option) {
+			s, err := NewStore(root, append(opts, WithProtection())...)
+			Expect(err).NotTo(HaveOccurred())
+
+			desc := write(s, []byte("blob"))
+			Expect(content.ReadBlob(ctx, s, desc)).To(Equal([]byte("blob")))
+
+			info, ok, err := s.Protection(desc.Digest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(info.Protection).To(Equal(expectedProtection()))
+
+			path, err := s.BlobPath(desc.Digest)
+			Expect(err).NotTo(HaveOccurred())
+			if info.Protection != ProtectionNone {
+				Expect(os.WriteFile(path, []byte("tampered"), 0666)).NotTo(Succeed())
+			}
+			verified, err := s.VerityVerified(desc.Digest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(verified).To(Equal(info.Protection == ProtectionFSVerity))
+
+			Expect(s.Delete(ctx, desc.Digest)).To(Succeed())
+			Expect(path).NotTo(BeAnExistingFile())
+			_, ok, err = s.Protection(desc.Digest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeFalse())
+		},
+		Entry("plaintext"),
+		Entry("encrypted", WithEncryption(bytes.Repeat([]byte{1}, 32))),
+	)
+
+	It("should not record any protection without WithProtection", func() {
+		s, err := NewStore(root)
+		Expect(err).NotTo(HaveOccurred())
+
+		desc := write(s, []byte("blob"))
+		_, ok, err := s.Protection(desc.Digest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeFalse())
+		Expect(s.VerityVerified(desc.Digest)).To(BeFalse())
+	})
+
+	It("should rewrap protected blobs", func() {
+		s, err := NewStore(root, WithProtection())
+		Expect(err).NotTo(HaveOccurred())
+		desc := write(s, []byte("blob"))
+
+		s, err = NewStore(root, WithProtection(), WithEncryption(bytes.Repeat([]byte{1}, 32)))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.Rewrap(ctx)).To(Equal(1))
+		Expect(content.ReadBlob(ctx, s, desc)).To(Equal([]byte("blob")))
+
+		info, ok, err := s.Protection(desc.Digest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(info.Protection).To(Equal(expectedProtection()))
+		Expect(s.Delete(ctx, desc.Digest)).To(Succeed())
+	})
+})
@@ -16,37 +16,213 @@ package local
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/content/local"
 	"github.com/containerd/containerd/errdefs"
+	"github.com/onmetal/onmetal-image/utils/fsutil"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// RelocatedIngestDir is the directory in the blobs directory of a store holding its ingests if its ingest
+// directory is on another file system than its blobs, see NewStore.
+const RelocatedIngestDir = ".ingest"
+
 // Store is a storage backed by the local file system.
 type Store struct {
 	root  string
 	store content.Store
+	// ingestRoot is the directory ingests are written below, root unless they are relocated, see NewStore.
+	ingestRoot string
+	// ingests is the store writing ingests below ingestRoot, store unless they are relocated.
+	ingests content.Store
+	keys    *keyring
+	sync    bool
+	// protectBlobs protects committed blobs, see WithProtection.
+	protectBlobs bool
+
+	mu      sync.Mutex
+	writers map[string]*encryptingWriter
+}
+
+// Options are options for creating a Store.
+type Options struct {
+	// EncryptionKey is the AES key new blobs are encrypted with. If nil, new blobs are stored as plaintext.
+	EncryptionKey []byte
+	// DecryptionKeys are additional keys existing blobs can be decrypted with, e.g. while rotating keys.
+	DecryptionKeys [][]byte
+	// NoSync disables syncing committed blobs and their directory to disk.
+	NoSync bool
+	// Protect protects committed blobs against tampering, see WithProtection.
+	Protect bool
+}
+
+// Option is an option for creating a Store.
+type Option func(o *Options)
+
+// WithEncryption encrypts new blobs at rest with the given AES key (16, 24 or 32 bytes).
+// Blobs are encrypted in chunks with AES-GCM, so random access reads still work. Digests keep referring
+// to the plaintext content. Existing plaintext blobs stay readable, see Store.Rewrap to encrypt them.
+func WithEncryption(key []byte) Option {
+	return func(o *Options) {
+		o.EncryptionKey = key
+	}
+}
+
+// WithDecryptionKeys adds keys existing blobs can be decrypted with.
+func WithDecryptionKeys(keys ...[]byte) Option {
+	return func(o *Options) {
+		o.DecryptionKeys = append(o.DecryptionKeys, keys...)
+	}
+}
+
+// WithNoSync disables syncing committed blobs and their directory to disk, trading durability on power
+// loss for commit speed, e.g. for throwaway stores in CI. Plaintext blob files are still synced by the
+// underlying containerd writer, only the directory sync is skipped for them.
+func WithNoSync() Option {
+	return func(o *Options) {
+		o.NoSync = true
+	}
+}
+
+// WithProtection protects committed blobs against tampering, e.g. on hosts where not every root process
+// can be trusted: fsverity is enabled on the blob file if the file system supports it, otherwise the
+// immutable attribute is set, which requires CAP_LINUX_IMMUTABLE. If neither works, the blob stays
+// unprotected; committing never fails because of it. The applied protection is recorded, see
+// Store.Protection. Only supported on linux.
+func WithProtection() Option {
+	return func(o *Options) {
+		o.Protect = true
+	}
 }
 
 // NewStore returns a new Store.
-func NewStore(root string) (*Store, error) {
+// By default, committing a blob syncs the blob file before renaming it to its digest path and then syncs
+// the blob directory, so a blob is durable before the caller references it in an index.
+// The root is resolved to its canonical path (see fsutil.CanonicalPath). If the ingest or temporary
+// directory of the root is on another file system than its blobs, e.g. because they are bind-mounted
+// separately, ingests are written to RelocatedIngestDir next to the blobs instead, so committing a blob
+// stays an atomic rename.
+func NewStore(root string, opts ...Option) (*Store, error) {
+	o := &Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	keys, err := newKeyring(o.EncryptionKey, o.DecryptionKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+
+	root, err = fsutil.CanonicalPath(root)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving store root: %w", err)
+	}
 	s, err := local.NewStore(root)
 	if err != nil {
 		return nil, err
 	}
+	ingestRoot, err := resolveIngestRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	ingests := s
+	if ingestRoot != root {
+		if ingests, err = local.NewStore(ingestRoot); err != nil {
+			return nil, err
+		}
+	}
 	return &Store{
-		root:  root,
-		store: s,
+		root:         root,
+		store:        s,
+		ingestRoot:   ingestRoot,
+		ingests:      ingests,
+		keys:         keys,
+		sync:         !o.NoSync,
+		protectBlobs: o.Protect,
+		writers:      make(map[string]*encryptingWriter),
 	}, nil
 }
 
+// resolveIngestRoot returns the directory to write the ingests of the store at root below, relocating
+// them to RelocatedIngestDir if the ingest or temporary directory is on another file system than the
+// blobs. The relocated directory links back to the blobs via a blobs symlink, so blobs are committed to
+// the blobs of root while the ingests stay on their file system.
+func resolveIngestRoot(root string) (string, error) {
+	// The blobs directory is created along with the first blob, its parent is where it will be.
+	blobs := filepath.Join(root, "blobs")
+	blobsFS := blobs
+	if _, err := os.Stat(blobs); errors.Is(err, os.ErrNotExist) {
+		blobsFS = root
+	}
+	crossDevice := false
+	for _, dir := range []string{filepath.Join(root, "ingest"), filepath.Join(root, "tmp")} {
+		if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		same, err := fsutil.SameFileSystem(dir, blobsFS)
+		if err != nil {
+			return "", fmt.Errorf("error checking file system of %s: %w", dir, err)
+		}
+		crossDevice = crossDevice || !same
+	}
+	if !crossDevice {
+		return root, nil
+	}
+
+	relocated := filepath.Join(blobs, RelocatedIngestDir)
+	if err := os.MkdirAll(relocated, 0777); err != nil {
+		return "", fmt.Errorf("error creating relocated ingest directory: %w", err)
+	}
+	link := filepath.Join(relocated, "blobs")
+	if target, err := os.Readlink(link); err != nil || target != ".." {
+		_ = os.Remove(link)
+		if err := os.Symlink("..", link); err != nil {
+			return "", fmt.Errorf("error linking relocated ingest directory to blobs: %w", err)
+		}
+	}
+	return relocated, nil
+}
+
+// commitError explains errors renaming the blob the store is committing into place, err otherwise.
+func (s *Store) commitError(err error) error {
+	if !fsutil.IsCrossDevice(err) {
+		return err
+	}
+	return fmt.Errorf("ingest directory %s and blob directory %s are on different file systems, so blobs cannot be renamed into place: %w",
+		s.ingestRoot, filepath.Join(s.root, "blobs"), err)
+}
+
+// plaintextInfo corrects the size of encrypted blobs to the size of their plaintext.
+func (s *Store) plaintextInfo(info content.Info) (content.Info, error) {
+	path, err := s.BlobPath(info.Digest)
+	if err != nil {
+		return content.Info{}, err
+	}
+
+	hdr, encrypted, err := readBlobEncryptionHeader(path)
+	if err != nil {
+		return content.Info{}, fmt.Errorf("error reading blob %s: %w", info.Digest, err)
+	}
+	if encrypted {
+		info.Size = hdr.size
+	}
+	return info, nil
+}
+
 // Info implements content.Store.
 func (s *Store) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
-	return s.store.Info(ctx, dgst)
+	info, err := s.store.Info(ctx, dgst)
+	if err != nil {
+		return content.Info{}, err
+	}
+	return s.plaintextInfo(info)
 }
 
 // BlobPath returns the path where the blob of the digest is located at.
@@ -67,35 +243,163 @@ func (s *Store) Update(ctx context.Context, info content.Info, fieldpaths ...str
 
 // Walk implements content.Store.
 func (s *Store) Walk(ctx context.Context, fn content.WalkFunc, filters ...string) error {
-	return s.store.Walk(ctx, fn, filters...)
+	return s.store.Walk(ctx, func(info content.Info) error {
+		info, err := s.plaintextInfo(info)
+		if err != nil {
+			return err
+		}
+		return fn(info)
+	}, filters...)
 }
 
 // Delete implements content.Store.
+// The immutable attribute of the blob is cleared first, see WithProtection.
 func (s *Store) Delete(ctx context.Context, dgst digest.Digest) error {
-	return s.store.Delete(ctx, dgst)
+	if err := s.unprotect(dgst); err != nil {
+		return err
+	}
+	if err := s.store.Delete(ctx, dgst); err != nil {
+		return err
+	}
+	s.removeProtectionRecord(dgst)
+	return nil
 }
 
 // ReaderAt implements content.Store.
+// Encrypted blobs are transparently decrypted.
 func (s *Store) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
-	return s.store.ReaderAt(ctx, desc)
+	path, err := s.BlobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("blob %s expected at %s: %w", desc.Digest, path, errdefs.ErrNotFound)
+		}
+		return nil, err
+	}
+
+	hdr, encrypted, err := readEncryptionHeader(f)
+	if err != nil || !encrypted {
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading blob %s: %w", desc.Digest, err)
+		}
+		return s.store.ReaderAt(ctx, desc)
+	}
+
+	aead, err := s.keys.aead(hdr.keyID, hdr.salt[:])
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("error decrypting blob %s: %w", desc.Digest, err)
+	}
+	return &decryptingReaderAt{f: f, aead: aead, hdr: hdr}, nil
 }
 
 // Status implements content.Store.
 func (s *Store) Status(ctx context.Context, ref string) (content.Status, error) {
-	return s.store.Status(ctx, ref)
+	s.mu.Lock()
+	w, ok := s.writers[ref]
+	s.mu.Unlock()
+	if ok {
+		return w.Status()
+	}
+	return s.ingests.Status(ctx, ref)
 }
 
 // ListStatuses implements content.Store.
+// Filters only apply to plaintext ingests.
 func (s *Store) ListStatuses(ctx context.Context, filters ...string) ([]content.Status, error) {
-	return s.store.ListStatuses(ctx, filters...)
+	statuses, err := s.ingests.ListStatuses(ctx, filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range s.writers {
+		status, _ := w.Status()
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
 }
 
 // Abort implements content.Store.
 func (s *Store) Abort(ctx context.Context, ref string) error {
-	return s.store.Abort(ctx, ref)
+	s.removeIngestRecord(ref)
+	s.mu.Lock()
+	w, ok := s.writers[ref]
+	s.mu.Unlock()
+	if ok {
+		return w.Close()
+	}
+	return s.ingests.Abort(ctx, ref)
 }
 
 // Writer implements content.Store.
+// If the store has an encryption key, the written blob is encrypted.
 func (s *Store) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
-	return s.store.Writer(ctx, opts...)
+	if s.keys.current == nil {
+		w, err := s.ingests.Writer(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return &committingWriter{Writer: w, store: s}, nil
+	}
+
+	var wOpts content.WriterOpts
+	for _, opt := range opts {
+		if err := opt(&wOpts); err != nil {
+			return nil, err
+		}
+	}
+	if wOpts.Ref == "" {
+		return nil, fmt.Errorf("ref must not be empty: %w", errdefs.ErrInvalidArgument)
+	}
+	if wOpts.Desc.Digest != "" {
+		if _, err := s.store.Info(ctx, wOpts.Desc.Digest); err == nil {
+			return nil, fmt.Errorf("content %v: %w", wOpts.Desc.Digest, errdefs.ErrAlreadyExists)
+		}
+	}
+	return s.encryptingWriter(wOpts.Ref, wOpts.Desc.Size, wOpts.Desc.Digest, false)
+}
+
+// syncBlobDir syncs the directory of blobs with the digest algorithm of dgst, persisting committed renames.
+func (s *Store) syncBlobDir(dgst digest.Digest) error {
+	if err := fsutil.SyncDir(filepath.Join(s.root, "blobs", dgst.Algorithm().String())); err != nil {
+		return fmt.Errorf("error syncing blob directory: %w", err)
+	}
+	return nil
+}
+
+// committed protects the committed blob of dgst if the store protects blobs and syncs its directory
+// unless syncing is disabled.
+func (s *Store) committed(ctx context.Context, dgst digest.Digest) error {
+	if s.protectBlobs {
+		s.protect(ctx, dgst)
+	}
+	if s.sync {
+		return s.syncBlobDir(dgst)
+	}
+	return nil
+}
+
+// committingWriter protects the blob and syncs the blob directory after the wrapped writer committed. It
+// also explains commits failing because ingests and blobs are on different file systems.
+type committingWriter struct {
+	content.Writer
+	store *Store
+}
+
+func (w *committingWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	if err := w.Writer.Commit(ctx, size, expected, opts...); err != nil {
+		return w.store.commitError(err)
+	}
+	dgst := expected
+	if dgst == "" {
+		dgst = w.Writer.Digest()
+	}
+	return w.store.committed(ctx, dgst)
 }
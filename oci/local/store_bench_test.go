@@ -0,0 +1,70 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	. "github.com/onmetal/onmetal-image/oci/local"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const benchBlobSize = 64 << 10
+
+// BenchmarkCommit measures the cost of syncing committed blobs and their directory, for plaintext and
+// encrypted stores. Small blobs are used, as the per-commit syncs dominate for them.
+func BenchmarkCommit(b *testing.B) {
+	key := bytes.Repeat([]byte{1}, 32)
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{name: "plaintext/sync"},
+		{name: "plaintext/no-sync", opts: []Option{WithNoSync()}},
+		{name: "encrypted/sync", opts: []Option{WithEncryption(key)}},
+		{name: "encrypted/no-sync", opts: []Option{WithEncryption(key), WithNoSync()}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ctx := context.Background()
+			s, err := NewStore(b.TempDir(), bc.opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			data := make([]byte, benchBlobSize)
+			b.SetBytes(benchBlobSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Make each blob unique so every iteration commits a new blob.
+				b.StopTimer()
+				if _, err := rand.Read(data[:16]); err != nil {
+					b.Fatal(err)
+				}
+				desc := ocispec.Descriptor{Digest: digest.FromBytes(data), Size: benchBlobSize}
+				b.StartTimer()
+
+				if err := content.WriteBlob(ctx, s, fmt.Sprint("bench-", i), bytes.NewReader(data), desc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/content"
+	. "github.com/onmetal/onmetal-image/oci/local"
+	"github.com/onmetal/onmetal-image/utils/fsutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Store", func() {
+	DescribeTable("should commit readable blobs",
+		func(opts ...Option) {
+			ctx := context.Background()
+			s, err := NewStore(GinkgoT().TempDir(), opts...)
+			Expect(err).NotTo(HaveOccurred())
+
+			data := []byte("blob")
+			desc := ocispec.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data))}
+			Expect(content.WriteBlob(ctx, s, "test", bytes.NewReader(data), desc)).To(Succeed())
+			Expect(content.ReadBlob(ctx, s, desc)).To(Equal(data))
+
+			By("committing without an expected digest")
+			w, err := s.Writer(ctx, content.WithRef("no-digest"))
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { _ = w.Close() }()
+			_, err = w.Write([]byte("other"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w.Commit(ctx, 0, "")).To(Succeed())
+			Expect(content.ReadBlob(ctx, s, ocispec.Descriptor{Digest: digest.FromString("other"), Size: 5})).To(Equal([]byte("other")))
+		},
+		Entry("syncing"),
+		Entry("without syncing", WithNoSync()),
+		Entry("encrypted", WithEncryption(bytes.Repeat([]byte{1}, 32))),
+		Entry("encrypted without syncing", WithEncryption(bytes.Repeat([]byte{1}, 32)), WithNoSync()),
+	)
+
+	Context("with the ingest directory on another file system", func() {
+		var (
+			ctx  = context.Background()
+			root string
+		)
+
+		// linkIngests makes the ingest directory of root a symlink to a directory on another file system
+		// than root, like a separately mounted one.
+		linkIngests := func() {
+			other, err := os.MkdirTemp("/dev/shm", "ingest-")
+			if err != nil {
+				Skip(fmt.Sprintf("no second file system available: %v", err))
+			}
+			DeferCleanup(os.RemoveAll, other)
+			if same, err := fsutil.SameFileSystem(other, root); err != nil || same {
+				Skip("no second file system available")
+			}
+			Expect(os.RemoveAll(filepath.Join(root, "ingest"))).To(Succeed())
+			Expect(os.Symlink(other, filepath.Join(root, "ingest"))).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			root = GinkgoT().TempDir()
+			Expect(os.MkdirAll(filepath.Join(root, "blobs"), 0777)).To(Succeed())
+		})
+
+		It("should place ingests next to the blobs", func() {
+			linkIngests()
+			s, err := NewStore(root)
+			Expect(err).NotTo(HaveOccurred())
+
+			data := []byte("blob")
+			desc := ocispec.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data))}
+			w, err := s.Writer(ctx, content.WithRef("test"), content.WithDescriptor(desc))
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { _ = w.Close() }()
+			_, err = w.Write(data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.ListStatuses(ctx)).To(ConsistOf(HaveField("Ref", "test")))
+			Expect(filepath.Join(root, "blobs", RelocatedIngestDir, "ingest")).To(BeADirectory())
+
+			Expect(w.Commit(ctx, desc.Size, desc.Digest)).To(Succeed())
+			Expect(content.ReadBlob(ctx, s, desc)).To(Equal(data))
+			Expect(s.BlobPath(desc.Digest)).To(BeARegularFile())
+
+			var digests []digest.Digest
+			Expect(s.Walk(ctx, func(info content.Info) error {
+				digests = append(digests, info.Digest)
+				return nil
+			})).To(Succeed())
+			Expect(digests).To(ConsistOf(desc.Digest))
+		})
+
+		It("should explain commits failing to rename blobs across file systems", func() {
+			s, err := NewStore(root)
+			Expect(err).NotTo(HaveOccurred())
+			linkIngests()
+
+			data := []byte("blob")
+			desc := ocispec.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data))}
+			err = content.WriteBlob(ctx, s, "test", bytes.NewReader(data), desc)
+			Expect(err).To(MatchError(ContainSubstring("are on different file systems")))
+			Expect(fsutil.IsCrossDevice(err)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,260 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package migration upgrades the directory structure of stores in place across releases.
+//
+// The format version of a store is recorded in its VersionFilename. Each Step migrates a store from one
+// version to the next. Steps are idempotent and the version is recorded after each completed step, so
+// an interrupted migration is resumed by migrating again.
+package migration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/onmetal/onmetal-image/utils/fsutil"
+)
+
+const (
+	// VersionFilename is the name of the file in the store recording its format version.
+	VersionFilename = "version"
+	// CurrentVersion is the format version of stores created and understood by this release.
+	CurrentVersion = 1
+
+	// lockFilename is the lock file held while migrating.
+	lockFilename = "migration.lock"
+	// lockStaleAfter is the age after which the lock of a crashed migration is taken over.
+	lockStaleAfter = time.Hour
+)
+
+// ErrNewerVersion is returned for stores of a newer format than CurrentVersion.
+var ErrNewerVersion = errors.New("store has a newer format version")
+
+// ErrMigrationRequired is returned for stores of an older format than CurrentVersion.
+var ErrMigrationRequired = errors.New("store has to be migrated")
+
+// VersionError is returned if the format version of a store is not CurrentVersion.
+type VersionError struct {
+	Path    string
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	if e.Version > CurrentVersion {
+		return fmt.Sprintf("%s: store %s has format version %d, this release only supports up to %d: upgrade onmetal-image",
+			ErrNewerVersion, e.Path, e.Version, CurrentVersion)
+	}
+	return fmt.Sprintf("%s: store %s has format version %d, this release needs %d: run onmetal-image migrate-store or pass --auto-migrate",
+		ErrMigrationRequired, e.Path, e.Version, CurrentVersion)
+}
+
+func (e *VersionError) Is(target error) bool {
+	if e.Version > CurrentVersion {
+		return target == ErrNewerVersion
+	}
+	return target == ErrMigrationRequired
+}
+
+// Step migrates a store from version From to From+1.
+type Step struct {
+	// From is the version the step migrates from.
+	From int
+	// Description describes the changes of the step.
+	Description string
+	// Migrate migrates the store at path. It has to be idempotent: it may be run again on a store it
+	// already (partially) migrated if a migration was interrupted.
+	Migrate func(ctx context.Context, path string) error
+}
+
+// Options are options for migrating a store.
+type Options struct {
+	// DryRun only returns the steps that would run.
+	DryRun bool
+	// Steps are the available steps. Defaults to Steps.
+	Steps []Step
+}
+
+// Option is an option for migrating a store.
+type Option func(o *Options)
+
+// WithDryRun only plans the migration without running any step.
+func WithDryRun() Option {
+	return func(o *Options) {
+		o.DryRun = true
+	}
+}
+
+// WithSteps sets the available steps instead of Steps.
+func WithSteps(steps ...Step) Option {
+	return func(o *Options) {
+		o.Steps = steps
+	}
+}
+
+// isStore reports whether the directory contains a store, whose version is 0 if not recorded.
+func isStore(path string) (bool, error) {
+	for _, name := range []string{"index.json", "oci-layout", "blobs"} {
+		if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+			return true, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// ReadVersion returns the format version of the store at path. Stores created before versions were
+// recorded have version 0. ok is false if path contains no store yet.
+func ReadVersion(path string) (version int, ok bool, err error) {
+	data, err := os.ReadFile(filepath.Join(path, VersionFilename))
+	switch {
+	case err == nil:
+		version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || version < 0 {
+			return 0, false, fmt.Errorf("invalid store format version %q in %s", strings.TrimSpace(string(data)), path)
+		}
+		return version, true, nil
+	case errors.Is(err, os.ErrNotExist):
+		exists, err := isStore(path)
+		if err != nil {
+			return 0, false, fmt.Errorf("error checking store %s: %w", path, err)
+		}
+		return 0, exists, nil
+	default:
+		return 0, false, fmt.Errorf("error reading store format version: %w", err)
+	}
+}
+
+// WriteVersion atomically records the format version of the store at path.
+func WriteVersion(path string, version int) error {
+	f, err := os.CreateTemp(path, "."+VersionFilename+"-*")
+	if err != nil {
+		return fmt.Errorf("error creating version file: %w", err)
+	}
+	tmp := f.Name()
+	defer func() { _ = os.Remove(tmp) }()
+
+	_, err = f.WriteString(strconv.Itoa(version) + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing version file: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(path, VersionFilename)); err != nil {
+		return fmt.Errorf("error renaming version file: %w", err)
+	}
+	return nil
+}
+
+// Check returns a *VersionError if the store at path does not have the CurrentVersion. A directory
+// without a store yet is initialized with the CurrentVersion.
+func Check(path string) error {
+	version, ok, err := ReadVersion(path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return WriteVersion(path, CurrentVersion)
+	}
+	if version != CurrentVersion {
+		return &VersionError{Path: path, Version: version}
+	}
+	return nil
+}
+
+// Plan returns the steps migrating a store from version from to version to, in order.
+func Plan(steps []Step, from, to int) ([]Step, error) {
+	if to < from {
+		return nil, fmt.Errorf("cannot migrate from version %d down to %d", from, to)
+	}
+	if to > CurrentVersion {
+		return nil, fmt.Errorf("version %d is newer than the supported version %d", to, CurrentVersion)
+	}
+
+	byFrom := make(map[int]Step, len(steps))
+	for _, step := range steps {
+		byFrom[step.From] = step
+	}
+
+	plan := make([]Step, 0, to-from)
+	for version := from; version < to; version++ {
+		step, ok := byFrom[version]
+		if !ok {
+			return nil, fmt.Errorf("no migration from version %d to %d", version, version+1)
+		}
+		plan = append(plan, step)
+	}
+	return plan, nil
+}
+
+// Migrate migrates the store at path to version to, returning the steps that ran (or would run with
+// WithDryRun). The version is recorded after every step, so an interrupted migration resumes with the
+// step that failed. Only one process migrates a store at a time, others fail until it is done.
+func Migrate(ctx context.Context, path string, to int, opts ...Option) ([]Step, error) {
+	o := &Options{Steps: Steps}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	version, ok, err := ReadVersion(path)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s contains no store", path)
+	}
+	if version > CurrentVersion {
+		return nil, &VersionError{Path: path, Version: version}
+	}
+
+	plan, err := Plan(o.Steps, version, to)
+	if err != nil {
+		return nil, err
+	}
+	if o.DryRun || len(plan) == 0 {
+		return plan, nil
+	}
+
+	unlock, locked, err := fsutil.TryLockFile(filepath.Join(path, lockFilename), lockStaleAfter)
+	if err != nil {
+		return nil, fmt.Errorf("error locking store for migration: %w", err)
+	}
+	if !locked {
+		return nil, fmt.Errorf("store %s is being migrated by another process", path)
+	}
+	defer func() { _ = unlock() }()
+
+	for i, step := range plan {
+		if err := ctx.Err(); err != nil {
+			return plan[:i], err
+		}
+		if err := step.Migrate(ctx, path); err != nil {
+			return plan[:i], fmt.Errorf("error migrating store from version %d to %d: %w", step.From, step.From+1, err)
+		}
+		if err := WriteVersion(path, step.From+1); err != nil {
+			return plan[:i], err
+		}
+	}
+	return plan, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migration_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/onmetal/onmetal-image/oci/layout"
+	. "github.com/onmetal/onmetal-image/oci/migration"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Migration", func() {
+	var (
+		ctx  context.Context
+		path string
+	)
+
+	// newUnversionedStore creates a store as written before format versions were recorded.
+	newUnversionedStore := func() {
+		Expect(os.WriteFile(filepath.Join(path, "index.json"), []byte(`{"schemaVersion":2,"manifests":[]}`), 0666)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(path, "ingest-locks"), 0777)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(path, "ingest-locks", "blob.lock"), nil, 0666)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(path, "ingest-encrypted", "ref"), 0777)).To(Succeed())
+	}
+
+	version := func() int {
+		v, ok, err := ReadVersion(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		return v
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		path = GinkgoT().TempDir()
+	})
+
+	It("should initialize new stores with the current version", func() {
+		Expect(Check(path)).To(Succeed())
+		Expect(version()).To(Equal(CurrentVersion))
+	})
+
+	It("should refuse stores of a newer version", func() {
+		Expect(WriteVersion(path, CurrentVersion+1)).To(Succeed())
+		Expect(Check(path)).To(MatchError(ErrNewerVersion))
+		_, err := Migrate(ctx, path, CurrentVersion)
+		Expect(err).To(MatchError(ErrNewerVersion))
+
+		_, err = layout.New(path, layout.WithAutoMigrate())
+		Expect(err).To(MatchError(ErrNewerVersion))
+	})
+
+	It("should migrate unversioned stores", func() {
+		newUnversionedStore()
+		Expect(Check(path)).To(MatchError(ErrMigrationRequired))
+
+		By("only planning the migration on a dry run")
+		steps, err := Migrate(ctx, path, CurrentVersion, WithDryRun())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(steps).To(HaveLen(1))
+		Expect(version()).To(Equal(0))
+
+		steps, err = Migrate(ctx, path, CurrentVersion)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(steps).To(HaveLen(1))
+		Expect(version()).To(Equal(CurrentVersion))
+		Expect(filepath.Join(path, "ingest-locks")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(path, "tmp", "ingest-locks", "blob.lock")).To(BeAnExistingFile())
+		Expect(filepath.Join(path, "tmp", "ingest-encrypted", "ref")).To(BeADirectory())
+
+		By("not running any step again")
+		steps, err = Migrate(ctx, path, CurrentVersion)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(steps).To(BeEmpty())
+	})
+
+	It("should open unversioned stores only with auto migration", func() {
+		newUnversionedStore()
+		_, err := layout.New(path)
+		Expect(err).To(MatchError(ErrMigrationRequired))
+
+		_, err = layout.New(path, layout.WithAutoMigrate())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(version()).To(Equal(CurrentVersion))
+	})
+
+	It("should resume an interrupted migration", func() {
+		newUnversionedStore()
+		interrupt := errors.New("interrupted")
+		var runs int
+		step := Steps[0]
+		flaky := Step{From: step.From, Description: step.Description, Migrate: func(ctx context.Context, path string) error {
+			runs++
+			if runs == 1 {
+				// Move only one of the directories before failing.
+				Expect(os.MkdirAll(filepath.Join(path, "tmp"), 0777)).To(Succeed())
+				Expect(os.Rename(filepath.Join(path, "ingest-locks"), filepath.Join(path, "tmp", "ingest-locks"))).To(Succeed())
+				return interrupt
+			}
+			return step.Migrate(ctx, path)
+		}}
+
+		steps, err := Migrate(ctx, path, CurrentVersion, WithSteps(flaky))
+		Expect(err).To(MatchError(interrupt))
+		Expect(steps).To(BeEmpty())
+		Expect(version()).To(Equal(0))
+
+		_, err = Migrate(ctx, path, CurrentVersion, WithSteps(flaky))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(runs).To(Equal(2))
+		Expect(version()).To(Equal(CurrentVersion))
+		Expect(filepath.Join(path, "tmp", "ingest-locks", "blob.lock")).To(BeAnExistingFile())
+		Expect(filepath.Join(path, "tmp", "ingest-encrypted")).To(BeADirectory())
+	})
+
+	It("should be idempotent if the target directories already exist", func() {
+		newUnversionedStore()
+		Expect(os.MkdirAll(filepath.Join(path, "tmp", "ingest-encrypted"), 0777)).To(Succeed())
+		Expect(Steps[0].Migrate(ctx, path)).To(Succeed())
+		Expect(Steps[0].Migrate(ctx, path)).To(Succeed())
+		Expect(filepath.Join(path, "ingest-encrypted")).NotTo(BeADirectory())
+	})
+
+	It("should refuse to migrate while another migration holds the lock", func() {
+		newUnversionedStore()
+		Expect(os.WriteFile(filepath.Join(path, "migration.lock"), nil, 0666)).To(Succeed())
+		_, err := Migrate(ctx, path, CurrentVersion)
+		Expect(err).To(MatchError(ContainSubstring("being migrated")))
+	})
+
+	It("should refuse to migrate downwards or beyond the current version", func() {
+		_, err := Plan(Steps, 1, 0)
+		Expect(err).To(HaveOccurred())
+		_, err = Plan(Steps, 0, CurrentVersion+1)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,61 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Steps are the migrations of the store format, ordered by the version they migrate from.
+var Steps = []Step{
+	{
+		From:        0,
+		Description: "move the transient ingest-locks and ingest-encrypted directories into tmp",
+		Migrate:     moveTransientDirs,
+	},
+}
+
+// moveTransientDirs moves the directories only holding data of writes in progress into the tmp
+// directory, so they can be told apart from the layout content.
+func moveTransientDirs(ctx context.Context, path string) error {
+	if err := os.MkdirAll(filepath.Join(path, "tmp"), 0777); err != nil {
+		return fmt.Errorf("error creating tmp directory: %w", err)
+	}
+	for _, name := range []string{"ingest-locks", "ingest-encrypted"} {
+		src, dst := filepath.Join(path, name), filepath.Join(path, "tmp", name)
+		if _, err := os.Stat(src); errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// Writes in progress cannot be resumed across a migration, so stale leftovers are dropped if the
+		// target already exists, e.g. when resuming an interrupted migration.
+		if _, err := os.Stat(dst); err == nil {
+			if err := os.RemoveAll(src); err != nil {
+				return fmt.Errorf("error removing %s: %w", name, err)
+			}
+			continue
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return fmt.Errorf("error moving %s: %w", name, err)
+		}
+	}
+	return nil
+}
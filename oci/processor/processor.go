@@ -0,0 +1,89 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package processor defines hooks transforming layers while they are pulled, see layout.Layout.ProcessImage.
+package processor
+
+import (
+	"context"
+	"io"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/unpack"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LayerProcessor transforms the content of matching layers while they are pulled.
+// The processed content is stored as a blob of its own, next to or instead of the original layer.
+type LayerProcessor interface {
+	// Match reports whether the processor processes the layer with the given descriptor.
+	Match(desc ocispec.Descriptor) bool
+	// Process returns the processed content of the layer read from r and the descriptor for it.
+	// Digest and size of the returned descriptor are ignored, they are computed while storing the processed
+	// content. Process may read r while the returned reader is consumed.
+	Process(ctx context.Context, r io.Reader, desc ocispec.Descriptor) (io.Reader, ocispec.Descriptor, error)
+}
+
+// Find returns the first of the processors matching the descriptor, or nil if none does.
+func Find(processors []LayerProcessor, desc ocispec.Descriptor) LayerProcessor {
+	for _, p := range processors {
+		if p.Match(desc) {
+			return p
+		}
+	}
+	return nil
+}
+
+// DecompressedAnnotation marks processed descriptors holding the decompressed content of their original
+// layer, so their size and digest are the uncompressed size and diff ID of that layer.
+const DecompressedAnnotation = "image.onmetal.de/decompressed"
+
+// IsDecompressed reports whether the processed descriptor holds the decompressed content of its original
+// layer, see DecompressedAnnotation.
+func IsDecompressed(desc ocispec.Descriptor) bool {
+	return desc.Annotations[DecompressedAnnotation] == "true"
+}
+
+type decompress struct {
+	mediaTypes map[string]struct{}
+}
+
+// Decompress returns a processor storing the decompressed content of gzip or zstd compressed layers with
+// one of the given media types, see unpack.Decompress. Uncompressed layers are stored as-is. Media types
+// with a compression suffix match their base media type, which the decompressed layer is stored with.
+func Decompress(mediaTypes ...string) LayerProcessor {
+	d := decompress{mediaTypes: make(map[string]struct{}, len(mediaTypes))}
+	for _, mediaType := range mediaTypes {
+		d.mediaTypes[mediaType] = struct{}{}
+	}
+	return d
+}
+
+func (d decompress) Match(desc ocispec.Descriptor) bool {
+	_, ok := d.mediaTypes[onmetalimage.LayerMediaType(desc.MediaType)]
+	return ok
+}
+
+func (d decompress) Process(ctx context.Context, r io.Reader, desc ocispec.Descriptor) (io.Reader, ocispec.Descriptor, error) {
+	rc, err := unpack.Decompress(r)
+	if err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
+	annotations := make(map[string]string, len(desc.Annotations)+1)
+	for key, value := range desc.Annotations {
+		annotations[key] = value
+	}
+	annotations[DecompressedAnnotation] = "true"
+	return rc, ocispec.Descriptor{MediaType: onmetalimage.LayerMediaType(desc.MediaType), Annotations: annotations}, nil
+}
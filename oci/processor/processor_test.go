@@ -0,0 +1,52 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processor_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+
+	. "github.com/onmetal/onmetal-image/oci/processor"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Decompress", func() {
+	const mediaType = "application/vnd.example.rootfs"
+
+	It("should only match the given media types", func() {
+		p := Decompress(mediaType)
+		Expect(p.Match(ocispec.Descriptor{MediaType: mediaType})).To(BeTrue())
+		Expect(p.Match(ocispec.Descriptor{MediaType: "application/vnd.example.kernel"})).To(BeFalse())
+		Expect(Find([]LayerProcessor{p}, ocispec.Descriptor{MediaType: "application/vnd.example.kernel"})).To(BeNil())
+	})
+
+	It("should decompress gzip content and keep the media type", func() {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		_, err := gw.Write([]byte("rootfs"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gw.Close()).To(Succeed())
+
+		r, desc, err := Decompress(mediaType).Process(context.Background(), &buf, ocispec.Descriptor{MediaType: mediaType})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(desc.MediaType).To(Equal(mediaType))
+		Expect(IsDecompressed(desc)).To(BeTrue())
+		Expect(io.ReadAll(r)).To(Equal([]byte("rootfs")))
+	})
+})
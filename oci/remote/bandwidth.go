@@ -0,0 +1,127 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+)
+
+// BandwidthLimiter limits the rate at which bytes are read by all readers sharing it. It is safe for
+// concurrent use.
+type BandwidthLimiter struct {
+	bytesPerSecond int64
+
+	mu sync.Mutex
+	// next is the time the bytes read so far are paid for. Readers wait for it before reading again.
+	next time.Time
+}
+
+var _ ioutils.Limiter = (*BandwidthLimiter)(nil)
+
+// NewBandwidthLimiter returns a limiter allowing bytesPerSecond bytes per second, which has to be positive.
+func NewBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+	return &BandwidthLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// chunkSize returns the maximum number of bytes read at once, about 1/10 of a second worth of bytes.
+func (l *BandwidthLimiter) chunkSize() int {
+	n := l.bytesPerSecond / 10
+	if n < 1024 {
+		return 1024
+	}
+	return int(n)
+}
+
+// take accounts n bytes read and returns the duration to wait before reading more.
+func (l *BandwidthLimiter) take(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	return l.next.Sub(now)
+}
+
+// Reader returns a reader reading from r at the rate of the limiter. Waiting is aborted when ctx is done.
+func (l *BandwidthLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	return &limitedReader{ctx: ctx, r: r, limiter: l}
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *BandwidthLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if chunk := r.limiter.chunkSize(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if wait := r.limiter.take(n); wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-r.ctx.Done():
+				return n, r.ctx.Err()
+			}
+		}
+	}
+	return n, err
+}
+
+// BandwidthTransport returns a round tripper reading all response bodies at the rate of the limiter,
+// e.g. to cap the bandwidth of background downloads. If limiter is nil, base is returned.
+func BandwidthTransport(base http.RoundTripper, limiter *BandwidthLimiter) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if limiter == nil {
+		return base
+	}
+	return &bandwidthTransport{base: base, limiter: limiter}
+}
+
+type bandwidthTransport struct {
+	base    http.RoundTripper
+	limiter *BandwidthLimiter
+}
+
+func (t *bandwidthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = &limitedBody{
+		Reader: t.limiter.Reader(req.Context(), res.Body),
+		Closer: res.Body,
+	}
+	return res, nil
+}
+
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
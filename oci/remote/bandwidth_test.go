@@ -0,0 +1,62 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onmetal/onmetal-image/oci/remote"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BandwidthTransport", func() {
+	It("should return the base transport without limiter", func() {
+		base := http.DefaultTransport
+		Expect(BandwidthTransport(base, nil)).To(BeIdenticalTo(base))
+	})
+
+	It("should throttle response bodies to the rate of the limiter", func() {
+		data := bytes.Repeat([]byte("x"), 300<<10)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(data)
+		}))
+		DeferCleanup(srv.Close)
+
+		client := &http.Client{Transport: BandwidthTransport(http.DefaultTransport, NewBandwidthLimiter(1<<20))}
+		start := time.Now()
+		res, err := client.Get(srv.URL)
+		Expect(err).NotTo(HaveOccurred())
+		body, err := io.ReadAll(res.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Body.Close()).To(Succeed())
+		Expect(body).To(Equal(data))
+		Expect(time.Since(start)).To(BeNumerically(">=", 250*time.Millisecond))
+	})
+
+	It("should stop waiting when the context is done", func() {
+		limiter := NewBandwidthLimiter(1024)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := io.ReadAll(limiter.Reader(ctx, bytes.NewReader(make([]byte, 4096))))
+		Expect(err).To(MatchError(context.Canceled))
+	})
+})
@@ -0,0 +1,175 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ResolveCache memoizes the descriptors tags resolve to for a TTL.
+// If it has a path, the entries are persisted as JSON so short-lived processes share them.
+// Concurrent processes may overwrite each other's entries, which only causes additional resolves.
+type ResolveCache struct {
+	ttl  time.Duration
+	path string
+
+	mu      sync.Mutex
+	loaded  bool
+	entries map[string]resolveCacheEntry
+}
+
+type resolveCacheEntry struct {
+	Descriptor ocispec.Descriptor `json:"descriptor"`
+	ResolvedAt time.Time          `json:"resolvedAt"`
+}
+
+// NewResolveCache creates a new ResolveCache with the given TTL.
+// If path is not empty, the entries are persisted to it.
+func NewResolveCache(ttl time.Duration, path string) *ResolveCache {
+	return &ResolveCache{
+		ttl:     ttl,
+		path:    path,
+		entries: make(map[string]resolveCacheEntry),
+	}
+}
+
+func (c *ResolveCache) expired(entry resolveCacheEntry, now time.Time) bool {
+	return now.Sub(entry.ResolvedAt) >= c.ttl
+}
+
+// load reads the persisted entries, if any, and merges them with the entries in memory.
+func (c *ResolveCache) load() error {
+	if c.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("error reading resolve cache: %w", err)
+	}
+
+	var entries map[string]resolveCacheEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("error decoding resolve cache %s: %w", c.path, err)
+	}
+	for ref, entry := range entries {
+		if existing, ok := c.entries[ref]; !ok || existing.ResolvedAt.Before(entry.ResolvedAt) {
+			c.entries[ref] = entry
+		}
+	}
+	return nil
+}
+
+// save prunes expired entries and writes the remaining ones to the cache path, if any.
+func (c *ResolveCache) save() error {
+	if c.path == "" {
+		return nil
+	}
+
+	now := time.Now()
+	for ref, entry := range c.entries {
+		if c.expired(entry, now) {
+			delete(c.entries, ref)
+		}
+	}
+
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0777); err != nil {
+		return fmt.Errorf("error creating resolve cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".resolve-cache-*")
+	if err != nil {
+		return fmt.Errorf("error creating resolve cache: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error writing resolve cache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing resolve cache: %w", err)
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// Get returns the cached descriptor of the given normalized ref, if present and not expired.
+func (c *ResolveCache) Get(ref string) (ocispec.Descriptor, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.loaded {
+		// A broken cache only costs a resolve.
+		_ = c.load()
+		c.loaded = true
+	}
+
+	entry, ok := c.entries[ref]
+	if !ok || c.expired(entry, time.Now()) {
+		return ocispec.Descriptor{}, false
+	}
+	return entry.Descriptor, true
+}
+
+// Set caches the descriptor the given normalized ref resolved to.
+func (c *ResolveCache) Set(ref string, desc ocispec.Descriptor) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_ = c.load()
+	c.entries[ref] = resolveCacheEntry{Descriptor: desc, ResolvedAt: time.Now()}
+	return c.save()
+}
+
+// Invalidate removes the given normalized ref from the cache.
+func (c *ResolveCache) Invalidate(ref string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_ = c.load()
+	delete(c.entries, ref)
+	return c.save()
+}
+
+// ResolveCacheRefs returns the normalized refs recorded in the resolve cache persisted at path, including
+// expired ones, e.g. to know which repositories were used recently. A missing cache has no refs.
+func ResolveCacheRefs(path string) ([]string, error) {
+	c := NewResolveCache(0, path)
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	refs := make([]string, 0, len(c.entries))
+	for ref := range c.entries {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/remote"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	"github.com/onmetal/onmetal-image/testing/registryharness"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ResolveCache", func() {
+	var (
+		ctx         = context.Background()
+		harness     *registryharness.Registry
+		host        string
+		configPath  string
+		cachePath   string
+		newRegistry func(opts ...Option) *Registry
+	)
+
+	BeforeEach(func() {
+		harness = registryharness.New()
+		DeferCleanup(harness.Close)
+		host = harness.Host()
+
+		dir := GinkgoT().TempDir()
+		configPath = filepath.Join(dir, "config.json")
+		Expect(os.WriteFile(configPath, []byte("{}"), 0666)).To(Succeed())
+		cachePath = filepath.Join(dir, "resolve-cache.json")
+
+		newRegistry = func(opts ...Option) *Registry {
+			registry, err := NewDockerRegistry(DockerRegistryOptions{ConfigPaths: []string{configPath}}, opts...)
+			Expect(err).NotTo(HaveOccurred())
+			return registry
+		}
+	})
+
+	newImage := func(rootFS string) ociimage.Image {
+		img, err := fixtures.RootFS(rootFS).Build()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	rootFSOf := func(img ociimage.Image) string {
+		layers, err := img.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layers).To(HaveLen(1))
+		data, err := imageutil.ReadLayerContent(ctx, layers[0])
+		Expect(err).NotTo(HaveOccurred())
+		return string(data)
+	}
+
+	It("should cache tag resolutions for the ttl", func() {
+		ref := host + "/repo:latest"
+		Expect(newRegistry().Push(ctx, ref, newImage("v1"))).To(Succeed())
+		pushResolves := harness.Stats().TagResolves
+
+		registry := newRegistry(WithResolveCache(time.Hour))
+		for i := 0; i < 3; i++ {
+			img, err := registry.Resolve(ctx, ref)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rootFSOf(img)).To(Equal("v1"))
+		}
+		Expect(harness.Stats().TagResolves - pushResolves).To(Equal(1))
+	})
+
+	It("should re-resolve expired entries", func() {
+		ref := host + "/repo:latest"
+		Expect(newRegistry().Push(ctx, ref, newImage("v1"))).To(Succeed())
+		pushResolves := harness.Stats().TagResolves
+
+		registry := newRegistry(WithResolveCache(50 * time.Millisecond))
+		_, err := registry.Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		time.Sleep(100 * time.Millisecond)
+		_, err = registry.Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(harness.Stats().TagResolves - pushResolves).To(Equal(2))
+	})
+
+	It("should never serve cached content for digest references", func() {
+		var (
+			ref = host + "/repo:latest"
+			v1  = newImage("v1")
+			v2  = newImage("v2")
+		)
+		Expect(newRegistry().Push(ctx, ref, v1)).To(Succeed())
+
+		registry := newRegistry(WithResolveCache(time.Hour))
+		_, err := registry.Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("pushing a new image to the tag from another process")
+		Expect(newRegistry().Push(ctx, ref, v2)).To(Succeed())
+
+		By("resolving the tag from the stale cache")
+		img, err := registry.Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(img.Descriptor().Digest).To(Equal(v1.Descriptor().Digest))
+
+		By("resolving the new image by digest")
+		img, err = registry.Resolve(ctx, host+"/repo@"+v2.Descriptor().Digest.String())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(img.Descriptor().Digest).To(Equal(v2.Descriptor().Digest))
+		Expect(rootFSOf(img)).To(Equal("v2"))
+
+		By("resolving the tag pinned to the new digest")
+		img, err = registry.Resolve(ctx, ref+"@"+v2.Descriptor().Digest.String())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(img.Descriptor().Digest).To(Equal(v2.Descriptor().Digest))
+		Expect(rootFSOf(img)).To(Equal("v2"))
+	})
+
+	It("should invalidate entries when pushing from the same process", func() {
+		ref := host + "/repo:latest"
+		registry := newRegistry(WithResolveCache(time.Hour))
+		Expect(registry.Push(ctx, ref, newImage("v1"))).To(Succeed())
+
+		img, err := registry.Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rootFSOf(img)).To(Equal("v1"))
+
+		Expect(registry.Push(ctx, ref, newImage("v2"))).To(Succeed())
+		img, err = registry.Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rootFSOf(img)).To(Equal("v2"))
+	})
+
+	It("should share persisted entries between registries", func() {
+		ref := host + "/repo:latest"
+		Expect(newRegistry().Push(ctx, ref, newImage("v1"))).To(Succeed())
+		pushResolves := harness.Stats().TagResolves
+
+		_, err := newRegistry(WithResolveCache(time.Hour), WithResolveCachePath(cachePath)).Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+
+		img, err := newRegistry(WithResolveCache(time.Hour), WithResolveCachePath(cachePath)).Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rootFSOf(img)).To(Equal("v1"))
+		Expect(harness.Stats().TagResolves - pushResolves).To(Equal(1))
+
+		By("invalidating the persisted entry on push")
+		Expect(newRegistry(WithResolveCache(time.Hour), WithResolveCachePath(cachePath)).Push(ctx, ref, newImage("v2"))).To(Succeed())
+		img, err = newRegistry(WithResolveCache(time.Hour), WithResolveCachePath(cachePath)).Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rootFSOf(img)).To(Equal("v2"))
+	})
+})
@@ -0,0 +1,96 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// HasExternalURLs reports whether the blob of the descriptor is served from external URLs, so registries
+// only need to store the manifest referencing it.
+func HasExternalURLs(desc ocispec.Descriptor) bool {
+	return len(desc.URLs) > 0
+}
+
+// blobFetcher fetches blobs from the external URLs of their descriptors, falling back to the registry.
+type blobFetcher struct {
+	registry remotes.Fetcher
+	// client fetches the external URLs. If nil, external URLs are never fetched.
+	client *http.Client
+}
+
+// Fetch fetches the blob from the first of its external http(s) URLs that serves it or else from the
+// registry. The digest and size of the content are verified by whoever consumes it, as for registry blobs.
+func (f *blobFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	var urlErrs []error
+	if f.client != nil {
+		for _, u := range desc.URLs {
+			rc, err := f.fetchURL(ctx, u)
+			if err == nil {
+				return rc, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			urlErrs = append(urlErrs, err)
+		}
+	}
+
+	// The registry fetcher would try the external URLs itself.
+	desc.URLs = nil
+	rc, err := f.registry.Fetch(ctx, desc)
+	if err != nil && len(urlErrs) > 0 {
+		return nil, fmt.Errorf("%w (external urls failed: %v)", err, errors.Join(urlErrs...))
+	}
+	return rc, err
+}
+
+func (f *blobFetcher) fetchURL(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %q: %w", rawURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme of url %s", u.Redacted())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s: %w", u.Redacted(), err)
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, nil
+	case http.StatusNotFound:
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("%s: %w", u.Redacted(), errdefs.ErrNotFound)
+	default:
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("erroneous response status: %s for url %s", res.Status, u.Redacted())
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// HostSettings are the settings for connections and transfers to a registry host. The zero value
+// preserves the default behavior of no limits.
+type HostSettings struct {
+	// MaxConcurrentTransfers limits the blob transfers to or from the host in flight at once. Zero means
+	// no limit. Copying blobs between repositories of the same host needs at least 2, since the download
+	// and the upload of a blob each take a slot.
+	MaxConcurrentTransfers int `yaml:"maxConcurrentTransfers,omitempty" json:"maxConcurrentTransfers,omitempty"`
+	// MaxIdleConns is the maximum number of idle (keep-alive) connections kept to the host. Zero uses the
+	// default of http.Transport.
+	MaxIdleConns int `yaml:"maxIdleConns,omitempty" json:"maxIdleConns,omitempty"`
+	// Shared shares the MaxConcurrentTransfers limit across all registries of the process targeting the
+	// host, so simultaneous operations do not multiply it. Otherwise each Registry has its own limit.
+	Shared bool `yaml:"shared,omitempty" json:"shared,omitempty"`
+}
+
+// HostsConfig holds the settings per registry host (e.g. harbor.example.com or localhost:5000).
+type HostsConfig struct {
+	Hosts map[string]HostSettings `yaml:"hosts"`
+}
+
+// Validate checks that no limit is negative.
+func (c *HostsConfig) Validate() error {
+	for host, settings := range c.Hosts {
+		if settings.MaxConcurrentTransfers < 0 {
+			return fmt.Errorf("host %s: maxConcurrentTransfers must not be negative", host)
+		}
+		if settings.MaxIdleConns < 0 {
+			return fmt.Errorf("host %s: maxIdleConns must not be negative", host)
+		}
+	}
+	return nil
+}
+
+// Settings returns the settings of the given host, the zero value if it has none.
+func (c *HostsConfig) Settings(host string) HostSettings {
+	if c == nil {
+		return HostSettings{}
+	}
+	return c.Hosts[host]
+}
+
+// ParseHostsConfig parses a hosts config from YAML, e.g.
+//
+//	hosts:
+//	  harbor.example.com:
+//	    maxConcurrentTransfers: 4
+//	    maxIdleConns: 8
+//	    shared: true
+func ParseHostsConfig(data []byte) (*HostsConfig, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	config := &HostsConfig{}
+	if err := dec.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error decoding hosts config: %w", err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// WithHostsConfig applies the per-host transfer limits of the config, see HostSettings.
+// Pass HostsTransport as client of the resolver to also apply the connection pooling settings.
+func WithHostsConfig(config *HostsConfig) Option {
+	return func(o *Options) {
+		o.HostsConfig = config
+	}
+}
+
+var (
+	sharedLimitsMu sync.Mutex
+	// sharedLimits are the transfer limits of hosts with HostSettings.Shared by host. The first
+	// registry targeting a host determines the size of its limit.
+	sharedLimits = make(map[string]chan struct{})
+)
+
+// transferLimits limits the concurrent blob transfers per host according to a HostsConfig.
+type transferLimits struct {
+	config *HostsConfig
+
+	mu     sync.Mutex
+	limits map[string]chan struct{}
+}
+
+func newTransferLimits(config *HostsConfig) *transferLimits {
+	return &transferLimits{config: config, limits: make(map[string]chan struct{})}
+}
+
+// limit returns the semaphore of the host, or nil if transfers to it are not limited.
+func (t *transferLimits) limit(host string) chan struct{} {
+	settings := t.config.Settings(host)
+	if settings.MaxConcurrentTransfers <= 0 {
+		return nil
+	}
+
+	mu, limits := &t.mu, t.limits
+	if settings.Shared {
+		mu, limits = &sharedLimitsMu, sharedLimits
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	limit, ok := limits[host]
+	if !ok {
+		limit = make(chan struct{}, settings.MaxConcurrentTransfers)
+		limits[host] = limit
+	}
+	return limit
+}
+
+// acquire waits for a transfer slot of the host. The returned function releases it.
+func (t *transferLimits) acquire(ctx context.Context, host string) (func(), error) {
+	if t == nil {
+		return func() {}, nil
+	}
+	limit := t.limit(host)
+	if limit == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case limit <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-limit }) }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("error waiting for a transfer slot of %s: %w", host, ctx.Err())
+	}
+}
+
+// releasingReadCloser releases a transfer slot when closed.
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releasingReadCloser) Close() error {
+	defer r.release()
+	return r.ReadCloser.Close()
+}
+
+// Seek seeks the wrapped content if it supports it.
+func (r *releasingReadCloser) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := r.ReadCloser.(io.Seeker)
+	if !ok {
+		return 0, errors.New("content does not support seeking")
+	}
+	return seeker.Seek(offset, whence)
+}
+
+// HostsTransport returns a round tripper applying the connection pooling settings of the config: Requests
+// to hosts with HostSettings.MaxIdleConns use a clone of base keeping at most that many idle connections,
+// all other requests use base. If base is nil, http.DefaultTransport is used.
+func HostsTransport(base http.RoundTripper, config *HostsConfig) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	transport, ok := base.(*http.Transport)
+	if !ok || config == nil {
+		return base
+	}
+
+	hosts := make(map[string]http.RoundTripper)
+	for host, settings := range config.Hosts {
+		if settings.MaxIdleConns <= 0 {
+			continue
+		}
+		clone := transport.Clone()
+		clone.MaxIdleConnsPerHost = settings.MaxIdleConns
+		if clone.MaxIdleConns != 0 && clone.MaxIdleConns < settings.MaxIdleConns {
+			clone.MaxIdleConns = settings.MaxIdleConns
+		}
+		hosts[host] = clone
+		// The registry API of docker.io is served from a different host.
+		if host == "docker.io" {
+			hosts["registry-1.docker.io"] = clone
+		}
+	}
+	if len(hosts) == 0 {
+		return base
+	}
+	return &hostsTransport{base: base, hosts: hosts}
+}
+
+type hostsTransport struct {
+	base  http.RoundTripper
+	hosts map[string]http.RoundTripper
+}
+
+func (t *hostsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt, ok := t.hosts[req.URL.Host]; ok {
+		return rt.RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "github.com/onmetal/onmetal-image/oci/remote"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HostsConfig", func() {
+	It("should parse the settings per host", func() {
+		config, err := ParseHostsConfig([]byte(`
+hosts:
+  harbor.example.com:
+    maxConcurrentTransfers: 4
+    maxIdleConns: 8
+    shared: true
+`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Settings("harbor.example.com")).To(Equal(HostSettings{
+			MaxConcurrentTransfers: 4,
+			MaxIdleConns:           8,
+			Shared:                 true,
+		}))
+		Expect(config.Settings("ghcr.io")).To(BeZero())
+	})
+
+	It("should reject negative limits and unknown fields", func() {
+		_, err := ParseHostsConfig([]byte("hosts:\n  ghcr.io:\n    maxConcurrentTransfers: -1\n"))
+		Expect(err).To(MatchError(ContainSubstring("must not be negative")))
+
+		_, err = ParseHostsConfig([]byte("hosts:\n  ghcr.io:\n    maxTransfers: 1\n"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should return the zero settings for a nil config", func() {
+		var config *HostsConfig
+		Expect(config.Settings("ghcr.io")).To(BeZero())
+	})
+})
+
+var _ = Describe("HostsTransport", func() {
+	It("should return the base transport without pooling settings", func() {
+		base := http.DefaultTransport
+		Expect(HostsTransport(base, nil)).To(BeIdenticalTo(base))
+		Expect(HostsTransport(base, &HostsConfig{Hosts: map[string]HostSettings{
+			"ghcr.io": {MaxConcurrentTransfers: 2},
+		}})).To(BeIdenticalTo(base))
+	})
+
+	It("should route requests to configured and other hosts", func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		DeferCleanup(srv.Close)
+		other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		DeferCleanup(other.Close)
+
+		srvURL, err := url.Parse(srv.URL)
+		Expect(err).NotTo(HaveOccurred())
+		client := &http.Client{Transport: HostsTransport(http.DefaultTransport.(*http.Transport).Clone(), &HostsConfig{
+			Hosts: map[string]HostSettings{srvURL.Host: {MaxIdleConns: 1}},
+		})}
+
+		res, err := client.Get(srv.URL)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Body.Close()).To(Succeed())
+		Expect(res.StatusCode).To(Equal(http.StatusNoContent))
+
+		res, err = client.Get(other.URL)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Body.Close()).To(Succeed())
+		Expect(res.StatusCode).To(Equal(http.StatusAccepted))
+	})
+})
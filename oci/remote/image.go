@@ -16,7 +16,6 @@ package remote
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"sync"
@@ -29,14 +28,29 @@ import (
 type layer struct {
 	descriptor ocispec.Descriptor
 	fetcher    remotes.Fetcher
+	// host is the registry host the layer is fetched from, used for error messages and transfer limits.
+	host string
+	// limits limits the concurrent transfers per host. If nil, transfers are not limited.
+	limits *transferLimits
 }
 
 func (l *layer) Descriptor() ocispec.Descriptor {
 	return l.descriptor
 }
 
+// Content returns the content of the layer. Failed transfers are resumed where they stopped, see TransferError.
+// The transfer occupies a slot of the transfer limit of the host until the content is closed, see HostSettings.
 func (l *layer) Content(ctx context.Context) (io.ReadCloser, error) {
-	return l.fetcher.Fetch(ctx, l.descriptor)
+	release, err := l.limits.acquire(ctx, l.host)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := fetchResuming(ctx, l.fetcher, l.descriptor, l.host)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &releasingReadCloser{rc, release}, nil
 }
 
 type image struct {
@@ -44,10 +58,20 @@ type image struct {
 	sync.Once
 	err      error
 	manifest *ocispec.Manifest
+	// limits are the transfer limits of the config and layers. The manifest itself is not subject to them,
+	// so resolving does not wait for blob transfers.
+	limits *transferLimits
+	// decodeLimits cap decoding the manifest.
+	decodeLimits ociimage.Limits
 }
 
 func (i *image) init(ctx context.Context) {
 	i.Once.Do(func() {
+		// Refuse announced oversized manifests before fetching them.
+		if err := ociimage.CheckManifestSize(i.descriptor, i.decodeLimits); err != nil {
+			i.err = err
+			return
+		}
 		rc, err := i.Content(ctx)
 		if err != nil {
 			i.err = fmt.Errorf("error getting content: %w", err)
@@ -55,13 +79,7 @@ func (i *image) init(ctx context.Context) {
 		}
 		defer func() { _ = rc.Close() }()
 
-		manifest := &ocispec.Manifest{}
-		if err := json.NewDecoder(rc).Decode(manifest); err != nil {
-			i.err = fmt.Errorf("could not decode manifest: %w", err)
-			return
-		}
-
-		i.manifest = manifest
+		i.manifest, i.err = ociimage.DecodeManifest(rc, i.descriptor, i.decodeLimits)
 	})
 }
 
@@ -78,6 +96,8 @@ func (i *image) Config(ctx context.Context) (ociimage.Layer, error) {
 	return &layer{
 		descriptor: i.manifest.Config,
 		fetcher:    i.fetcher,
+		host:       i.host,
+		limits:     i.limits,
 	}, nil
 }
 
@@ -92,18 +112,48 @@ func (i *image) Layers(ctx context.Context) ([]ociimage.Layer, error) {
 		layers = append(layers, &layer{
 			descriptor: desc,
 			fetcher:    i.fetcher,
+			host:       i.host,
+			limits:     i.limits,
 		})
 	}
 
 	return layers, nil
 }
 
+func (i *image) Complete(ctx context.Context) (bool, []ocispec.Descriptor, error) {
+	return true, nil, nil
+}
+
 func Image(fetcher remotes.Fetcher, desc ocispec.Descriptor) ociimage.Image {
+	return newImage(fetcher, desc, "", nil, ociimage.DefaultLimits)
+}
+
+func newImage(fetcher remotes.Fetcher, desc ocispec.Descriptor, host string, limits *transferLimits, decodeLimits ociimage.Limits) ociimage.Image {
 	return &image{
 		layer: layer{
 			descriptor: desc,
 			fetcher:    fetcher,
+			host:       host,
 		},
-		Once: sync.Once{},
+		Once:         sync.Once{},
+		limits:       limits,
+		decodeLimits: decodeLimits,
 	}
 }
+
+// index is an image index of a registry, which is streamed on every walk instead of being kept in memory.
+type index struct {
+	layer
+	decodeLimits ociimage.Limits
+}
+
+func (i *index) Walk(ctx context.Context, fn func(desc ocispec.Descriptor) error) error {
+	rc, err := i.Content(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting content: %w", err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	_, err = ociimage.WalkIndex(rc, i.descriptor, i.decodeLimits, fn)
+	return err
+}
@@ -0,0 +1,145 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/distribution/reference"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/opencontainers/go-digest"
+)
+
+// IndexChild is a manifest referenced by an image index pushed with PushIndex.
+type IndexChild struct {
+	// Image is the child manifest.
+	Image ociimage.Image
+	// Source is the reference of the remote repository the child was resolved from. Empty for local
+	// images, which are pushed along with their blobs.
+	Source string
+}
+
+// PushIndex pushes the image index to the reference after making sure all of its children are present
+// in the repository of the reference: local children are pushed, remote children of another repository
+// of the same registry are copied by mounting their blobs and pushing their manifest by digest.
+// Manifests cannot be mounted and blobs not across registries, so children of other registries are
+// refused before anything is pushed.
+// If the reference already points to the index, nothing is transferred and PushResult.UpToDate is set.
+// Otherwise, the result sums up the blobs transferred for all children.
+func (r *Registry) PushIndex(ctx context.Context, ref string, index ociimage.Layer, children []IndexChild, opts ...PushOption) (*PushResult, error) {
+	named, err := r.parser.ParseNamed(ref)
+	if err != nil {
+		return nil, err
+	}
+	ref = named.String()
+	repository := reference.TrimNamed(named)
+
+	sources := make([]reference.Named, len(children))
+	for i, child := range children {
+		if child.Source == "" {
+			continue
+		}
+		source, err := r.parser.ParseNamed(child.Source)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing source %s of child %s: %w", child.Source, child.Image.Descriptor().Digest, err)
+		}
+		if reference.Domain(source) != reference.Domain(named) {
+			return nil, fmt.Errorf("child %s of %s cannot be referenced from %s: manifests cannot be mounted across registries",
+				child.Image.Descriptor().Digest, reference.TrimNamed(source), reference.Domain(named))
+		}
+		sources[i] = source
+	}
+
+	var (
+		desc     = index.Descriptor()
+		reporter = progress.FromContext(ctx)
+	)
+	// Resolve errors are not fatal here, see PushImage.
+	if _, remoteDesc, err := r.resolver.Resolve(ctx, ref); err == nil && remoteDesc.Digest == desc.Digest {
+		reporter.Report(progress.BlobDone{Digest: desc.Digest, Total: desc.Size, Skipped: true})
+		return &PushResult{UpToDate: true}, nil
+	}
+
+	tracker := blobTrackerFromContext(ctx)
+	if tracker == nil {
+		tracker = NewBlobTracker()
+		ctx = WithBlobTracker(ctx, tracker)
+	}
+
+	res := &PushResult{}
+	for i, child := range children {
+		childDesc := child.Image.Descriptor()
+		if source := sources[i]; source != nil {
+			if reference.Path(source) == reference.Path(named) {
+				ok, err := r.blobExists(ctx, named, childDesc)
+				if err != nil {
+					return nil, fmt.Errorf("error checking child %s: %w", childDesc.Digest, err)
+				}
+				if !ok {
+					return nil, fmt.Errorf("child %s not found in %s", childDesc.Digest, repository)
+				}
+				continue
+			}
+
+			blobs, err := blobDigests(ctx, child.Image)
+			if err != nil {
+				return nil, fmt.Errorf("error getting blobs of child %s: %w", childDesc.Digest, err)
+			}
+			tracker.record(source, blobs...)
+		}
+
+		digested, err := reference.WithDigest(repository, childDesc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		childRes, err := r.PushImage(ctx, digested.String(), child.Image, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("error pushing child %s: %w", childDesc.Digest, err)
+		}
+		res.Uploaded += childRes.Uploaded
+		res.Skipped += childRes.Skipped
+		res.External += childRes.External
+	}
+
+	if key, ok := r.cacheKey(ref); ok {
+		_ = r.resolveCache.Invalidate(key)
+		defer func() { _ = r.resolveCache.Invalidate(key) }()
+	}
+
+	pusher, err := r.resolver.Pusher(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("error getting pusher for %s: %w", ref, err)
+	}
+	pusher = repositoryPusher{Pusher: pusher, repository: repository.String()}
+	if err := r.pushLayer(ctx, pusher, index); err != nil {
+		return nil, fmt.Errorf("error pushing index %s: %w", desc.Digest, err)
+	}
+	return res, nil
+}
+
+// blobDigests returns the digests of the config and layers of the image.
+func blobDigests(ctx context.Context, img ociimage.Image) ([]digest.Digest, error) {
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting manifest: %w", err)
+	}
+	res := []digest.Digest{manifest.Config.Digest}
+	for _, layer := range manifest.Layers {
+		res = append(res, layer.Digest)
+	}
+	return res, nil
+}
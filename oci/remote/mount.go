@@ -0,0 +1,115 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/containerd/containerd/labels"
+	"github.com/distribution/reference"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// mountLayer is a layer whose descriptor carries the repositories it can be mounted from.
+type mountLayer struct {
+	ociimage.Layer
+	desc ocispec.Descriptor
+}
+
+func (l *mountLayer) Descriptor() ocispec.Descriptor {
+	return l.desc
+}
+
+// mountRepositories returns the repositories on the host of the named reference that the blob with the
+// given digest can be mounted from, according to the recorded layer sources.
+func mountRepositories(sources imageutil.LayerSources, named reference.Named, dgst digest.Digest) []string {
+	var (
+		host       = reference.Domain(named)
+		repository = reference.Path(named)
+		res        []string
+	)
+	for _, source := range sources[dgst] {
+		sourceNamed, err := reference.ParseNamed(source)
+		if err != nil {
+			continue
+		}
+		if reference.Domain(sourceNamed) == host && reference.Path(sourceNamed) != repository {
+			res = append(res, reference.Path(sourceNamed))
+		}
+	}
+	return res
+}
+
+// withMountSources returns the blobs with the repositories they can be mounted from set as distribution
+// source labels, which makes the pusher try a cross-repository mount before uploading them.
+// The repositories are taken from the recorded layer sources and the blobs the tracker (if any) saw
+// pushed to other repositories. The labels are only passed to the pusher, the pushed manifest is unchanged.
+func withMountSources(ctx context.Context, img ociimage.Image, named reference.Named, blobs []ociimage.Layer, tracker *BlobTracker) ([]ociimage.Layer, error) {
+	manifest, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting manifest: %w", err)
+	}
+	// The sources are only an optimization, an unparseable annotation must not fail the push.
+	sources, _ := imageutil.ParseLayerSources(manifest)
+	if len(sources) == 0 && tracker == nil {
+		return blobs, nil
+	}
+
+	// The pusher looks up the label by host name without port.
+	u, err := url.Parse("dummy://" + reference.Domain(named))
+	if err != nil {
+		return blobs, nil
+	}
+	key := fmt.Sprintf("%s.%s", labels.LabelDistributionSource, u.Hostname())
+
+	res := make([]ociimage.Layer, 0, len(blobs))
+	for _, blob := range blobs {
+		desc := blob.Descriptor()
+		repositories := mountRepositories(sources, named, desc.Digest)
+		for _, repository := range tracker.repositories(named, desc.Digest) {
+			if !containsString(repositories, repository) {
+				repositories = append(repositories, repository)
+			}
+		}
+		if len(repositories) == 0 {
+			res = append(res, blob)
+			continue
+		}
+
+		annotations := make(map[string]string, len(desc.Annotations)+1)
+		for k, v := range desc.Annotations {
+			annotations[k] = v
+		}
+		annotations[key] = strings.Join(repositories, ",")
+		desc.Annotations = annotations
+		res = append(res, &mountLayer{Layer: blob, desc: desc})
+	}
+	return res, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"context"
+	"errors"
+
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+)
+
+// ErrQuotaExceeded is returned by preflights if a push would exceed the storage quota of the registry
+// or the configured maximum push size.
+var ErrQuotaExceeded = errors.New("push exceeds quota")
+
+// PreflightFunc checks whether pushing size bytes to ref may proceed before any blob is uploaded.
+// Returning an error aborts the push.
+type PreflightFunc func(ctx context.Context, ref string, size int64) error
+
+// PushOptions are options for pushing an image.
+type PushOptions struct {
+	// Preflight is called with the size of the blobs missing on the remote and the manifest before
+	// uploading them. If nil, no check is done.
+	Preflight PreflightFunc
+}
+
+// PushOption is an option for pushing an image.
+type PushOption func(o *PushOptions)
+
+// WithPreflight checks the size of the push with the given function before uploading anything.
+func WithPreflight(preflight PreflightFunc) PushOption {
+	return func(o *PushOptions) {
+		o.Preflight = preflight
+	}
+}
+
+// pushSize returns the number of bytes pushing the blobs and the manifest of img adds to the remote.
+// Blobs of unknown size are not accounted for.
+func pushSize(img ociimage.Image, blobs []ociimage.Layer) int64 {
+	size := img.Descriptor().Size
+	for _, blob := range blobs {
+		if desc := blob.Descriptor(); imageutil.HasKnownSize(desc) {
+			size += desc.Size
+		}
+	}
+	return size
+}
@@ -16,9 +16,15 @@ package remote
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/containerd/containerd/errdefs"
+	remoteerrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/distribution/reference"
 
 	"github.com/containerd/containerd/content"
 
@@ -26,83 +32,587 @@ import (
 	"oras.land/oras-go/pkg/auth/docker"
 
 	"github.com/containerd/containerd/remotes"
+	containerddocker "github.com/containerd/containerd/remotes/docker"
+	"github.com/onmetal/onmetal-image/batch"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
 	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/store"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/onmetal/onmetal-image/ref"
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	"github.com/onmetal/onmetal-image/version"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// ErrCredentialsRejected is returned if a registry rejected the stored credentials.
+var ErrCredentialsRejected = errors.New("stored credentials were rejected")
+
 type Registry struct {
 	resolver remotes.Resolver
+	parser   ref.Parser
+
+	// anonymousResolver is used to retry pulls if the stored credentials are rejected.
+	// If nil, no anonymous retry is done.
+	anonymousResolver remotes.Resolver
+	credential        func(host string) (string, string, error)
+	credentialSource  string
+
+	// connectTimeout bounds resolving a reference, i.e. the initial round-trips to the registry.
+	// If zero, only the context deadline applies.
+	connectTimeout time.Duration
+
+	// resolveCache memoizes tag resolutions. If nil, every tag is resolved.
+	resolveCache *ResolveCache
+
+	// limits limits the concurrent blob transfers per host. If nil, transfers are not limited.
+	limits *transferLimits
+
+	// externalClient fetches blobs from the external URLs of their descriptors. If nil, external URLs are
+	// neither fetched from nor relied upon when pushing.
+	externalClient *http.Client
+
+	// decodeLimits cap decoding the manifests and indexes of the registry.
+	decodeLimits ociimage.Limits
 }
 
-func (r *Registry) Resolve(ctx context.Context, ref string) (ociimage.Image, error) {
-	_, desc, err := r.resolver.Resolve(ctx, ref)
+// Options are options for a Registry.
+type Options struct {
+	// ResolveCacheTTL is the duration tag resolutions are cached for. If zero, no cache is used.
+	ResolveCacheTTL time.Duration
+	// ResolveCachePath is the file to persist the resolve cache to. If empty, it is kept in memory only.
+	ResolveCachePath string
+	// HostsConfig holds the per-host transfer limits. If nil, transfers are not limited.
+	HostsConfig *HostsConfig
+	// NoExternalBlobs forbids external blob URLs: blobs are only pulled from the registry and pushes
+	// upload blobs with external URLs like any other blob.
+	NoExternalBlobs bool
+	// Limits cap decoding manifests and indexes. If nil, ociimage.DefaultLimits apply.
+	Limits *ociimage.Limits
+}
+
+// Option is a function that modifies Options.
+type Option func(o *Options)
+
+// WithResolveCache caches the descriptors tags resolve to for the given TTL.
+// References with a digest always bypass the cache, and pushing a reference invalidates its entry.
+func WithResolveCache(ttl time.Duration) Option {
+	return func(o *Options) {
+		o.ResolveCacheTTL = ttl
+	}
+}
+
+// WithResolveCachePath persists the resolve cache to the given file.
+func WithResolveCachePath(path string) Option {
+	return func(o *Options) {
+		o.ResolveCachePath = path
+	}
+}
+
+// WithNoExternalBlobs forbids fetching blobs from the external URLs of their descriptors.
+// See Options.NoExternalBlobs.
+func WithNoExternalBlobs() Option {
+	return func(o *Options) {
+		o.NoExternalBlobs = true
+	}
+}
+
+// WithLimits caps decoding the manifests and indexes of the registry, failing with an *ociimage.LimitError
+// if they are exceeded.
+func WithLimits(limits ociimage.Limits) Option {
+	return func(o *Options) {
+		o.Limits = &limits
+	}
+}
+
+func isUnauthorized(err error) bool {
+	if errors.Is(err, containerddocker.ErrInvalidAuthorization) {
+		return true
+	}
+	var statusErr remoteerrors.ErrUnexpectedStatus
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized
+}
+
+// hasCredential reports whether credentials are configured for the registry host of the given ref.
+func (r *Registry) hasCredential(ref string) (string, bool) {
+	if r.credential == nil {
+		return "", false
+	}
+
+	named, err := r.parser.ParseNamed(ref)
+	if err != nil {
+		return "", false
+	}
+
+	host := reference.Domain(named)
+	username, secret, err := r.credential(host)
+	return host, err == nil && (username != "" || secret != "")
+}
+
+func (r *Registry) resolve(ctx context.Context, resolver remotes.Resolver, ref string) (ociimage.Image, error) {
+	resolveCtx := ctx
+	if r.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		resolveCtx, cancel = context.WithTimeout(ctx, r.connectTimeout)
+		defer cancel()
+	}
+
+	_, desc, err := resolver.Resolve(resolveCtx, ref)
 	if err != nil {
-		return nil, fmt.Errorf("error resolving %s: %w", ref, err)
+		return nil, fmt.Errorf("error resolving %s: %w", ref, ocicontent.WithPhase(resolveCtx, "resolve "+ref, err))
 	}
 
-	fetcher, err := r.resolver.Fetcher(ctx, ref)
+	fetcher, err := r.fetcher(ctx, resolver, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return newImage(fetcher, desc, r.host(ref), r.limits, r.decodeLimits), nil
+}
+
+// fetcher returns the fetcher for the ref, which fetches blobs with external URLs from them if allowed.
+func (r *Registry) fetcher(ctx context.Context, resolver remotes.Resolver, ref string) (remotes.Fetcher, error) {
+	fetcher, err := resolver.Fetcher(ctx, ref)
 	if err != nil {
 		return nil, fmt.Errorf("error getting fetcher for %s: %w", ref, err)
 	}
+	return &blobFetcher{registry: fetcher, client: r.externalClient}, nil
+}
+
+// host returns the registry host of the ref, or an empty string if it cannot be determined.
+func (r *Registry) host(ref string) string {
+	named, err := r.parser.ParseNamed(ref)
+	if err != nil {
+		return ""
+	}
+	return reference.Domain(named)
+}
 
-	return Image(fetcher, desc), nil
+// normalize normalizes the ref into the fully qualified form required by the resolver.
+func (r *Registry) normalize(ref string) (string, error) {
+	named, err := r.parser.ParseNamed(ref)
+	if err != nil {
+		return "", err
+	}
+	return named.String(), nil
+}
+
+// cacheKey returns the key of the ref in the resolve cache, or false if the ref must not be cached.
+func (r *Registry) cacheKey(ref string) (string, bool) {
+	if r.resolveCache == nil {
+		return "", false
+	}
+	named, err := r.parser.ParseNamed(ref)
+	if err != nil {
+		return "", false
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return "", false
+	}
+	return named.String(), true
+}
+
+func (r *Registry) Resolve(ctx context.Context, ref string) (ociimage.Image, error) {
+	ref, err := r.normalize(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	key, cache := r.cacheKey(ref)
+	if cache {
+		if desc, ok := r.resolveCache.Get(key); ok {
+			fetcher, err := r.fetcher(ctx, r.resolver, ref)
+			if err != nil {
+				return nil, err
+			}
+			return newImage(fetcher, desc, r.host(ref), r.limits, r.decodeLimits), nil
+		}
+	}
+
+	img, anonymous, err := r.resolveWithFallback(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cached descriptors are fetched with the regular resolver, so anonymous resolutions are not cached.
+	if cache && !anonymous {
+		// A cache that cannot be persisted only costs future resolves.
+		_ = r.resolveCache.Set(key, img.Descriptor())
+	}
+	return img, nil
+}
+
+// ResolveIndex resolves the ref to an image index (or docker manifest list), whose children are walked
+// lazily, see ociimage.Index. It fails if the ref resolves to anything else.
+func (r *Registry) ResolveIndex(ctx context.Context, ref string) (ociimage.Index, error) {
+	img, err := r.Resolve(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType := img.Descriptor().MediaType; !ociimage.IsIndexMediaType(mediaType) {
+		return nil, fmt.Errorf("%s is no image index but %s", ref, mediaType)
+	}
+	return &index{layer: img.(*image).layer, decodeLimits: r.decodeLimits}, nil
+}
+
+// Pull resolves the ref and writes the image to all destination stores in one pass, downloading each
+// blob only once. See store.PushAll for how the per-store results are reported.
+func (r *Registry) Pull(ctx context.Context, ref string, dests ...*store.Store) ([]batch.Result, error) {
+	img, err := r.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving ref %s: %w", ref, err)
+	}
+	return store.PushAll(ctx, ref, img, dests...), nil
+}
+
+// resolveWithFallback resolves the ref, retrying anonymously if the stored credentials are rejected.
+// It reports whether the anonymous retry was used.
+func (r *Registry) resolveWithFallback(ctx context.Context, ref string) (ociimage.Image, bool, error) {
+	img, err := r.resolve(ctx, r.resolver, ref)
+	if err == nil || !isUnauthorized(err) {
+		return img, false, err
+	}
+
+	host, ok := r.hasCredential(ref)
+	if !ok {
+		return nil, false, err
+	}
+
+	if r.anonymousResolver == nil {
+		return nil, false, fmt.Errorf("%w by registry %s (credentials from %s): %w", ErrCredentialsRejected, host, r.credentialSource, err)
+	}
+
+	img, anonErr := r.resolve(ctx, r.anonymousResolver, ref)
+	if anonErr != nil {
+		return nil, false, fmt.Errorf("%w by registry %s (credentials from %s) and anonymous access failed: %w", ErrCredentialsRejected, host, r.credentialSource, anonErr)
+	}
+	return img, true, nil
+}
+
+// repositoryPusher scopes the pushes of a remotes.Pusher to a repository.
+// The docker pusher tracks its pushes by descriptor only, so without it a blob or manifest pushed to
+// one repository would be treated as already existing in every other repository pushed to later.
+type repositoryPusher struct {
+	remotes.Pusher
+	repository string
+}
+
+func (p repositoryPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	annotations := make(map[string]string, len(desc.Annotations)+1)
+	for k, v := range desc.Annotations {
+		annotations[k] = v
+	}
+	// remotes.MakeRefKey prefixes the tracked key with the ref name annotation.
+	annotations[ocispec.AnnotationRefName] = p.repository
+	desc.Annotations = annotations
+	return p.Pusher.Push(ctx, desc)
 }
 
 func (r *Registry) pushLayer(ctx context.Context, pusher remotes.Pusher, layer ociimage.Layer) error {
-	w, err := pusher.Push(ctx, layer.Descriptor())
+	var (
+		desc     = layer.Descriptor()
+		phase    = fmt.Sprintf("upload layer %s", desc.Digest)
+		reporter = progress.FromContext(ctx)
+	)
+	w, err := pusher.Push(ctx, desc)
 	if err != nil {
 		if !errdefs.IsAlreadyExists(err) {
-			return fmt.Errorf("error getting writer: %w", err)
+			return fmt.Errorf("error getting writer: %w", ocicontent.WithPhase(ctx, phase, err))
 		}
+		reporter.Report(progress.BlobDone{Digest: desc.Digest, Total: desc.Size, Skipped: true})
 		return nil
 	}
 
 	rc, err := layer.Content(ctx)
 	if err != nil {
 		_ = w.Close()
-		return fmt.Errorf("error getting layer content: %w", err)
+		return fmt.Errorf("error getting layer content: %w", ocicontent.WithPhase(ctx, phase, err))
 	}
 	defer func() { _ = rc.Close() }()
 
-	if err := content.Copy(ctx, w, rc, layer.Descriptor().Size, layer.Descriptor().Digest); err != nil {
+	reporter.Report(progress.BlobStarted{Digest: desc.Digest, MediaType: desc.MediaType, Total: desc.Size})
+	if _, err := ioutils.CopyVerify(ctx, w, rc, desc, ioutils.WithProgress(progress.ReportInterval, progress.BlobProgressFunc(reporter, desc))); err != nil {
 		_ = w.Close()
-		return fmt.Errorf("error copying layer: %w", err)
+		return fmt.Errorf("error copying layer: %w", ocicontent.WithPhase(ctx, phase, err))
+	}
+	if err := w.Commit(ctx, desc.Size, desc.Digest); err != nil && !errdefs.IsAlreadyExists(err) {
+		_ = w.Close()
+		return fmt.Errorf("error committing layer: %w", ocicontent.WithPhase(ctx, phase, err))
 	}
 
 	if err := w.Close(); err != nil {
 		return fmt.Errorf("error closing writer: %w", err)
 	}
+	reporter.Report(progress.BlobDone{Digest: desc.Digest, Total: desc.Size})
 	return nil
 }
 
+// PushResult describes what a push transferred.
+type PushResult struct {
+	// UpToDate is set if the reference already pointed to the image and nothing was transferred.
+	UpToDate bool
+	// Uploaded is the number of blobs that were missing on the remote and got uploaded.
+	Uploaded int
+	// Skipped is the number of blobs that already existed on the remote, e.g. from a previous failed push.
+	Skipped int
+	// External is the number of blobs not uploaded because they are served from external URLs.
+	External int
+}
+
 func (r *Registry) Push(ctx context.Context, ref string, img ociimage.Image) error {
+	_, err := r.PushImage(ctx, ref, img)
+	return err
+}
+
+// blobExists reports whether the blob exists with the expected size in the repository of the named reference.
+func (r *Registry) blobExists(ctx context.Context, named reference.Named, desc ocispec.Descriptor) (bool, error) {
+	digested, err := reference.WithDigest(reference.TrimNamed(named), desc.Digest)
+	if err != nil {
+		return false, err
+	}
+
+	_, remoteDesc, err := r.resolver.Resolve(ctx, digested.String())
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return remoteDesc.Size == desc.Size, nil
+}
+
+// PushImage pushes the image to the reference, uploading only the blobs missing on the remote.
+// The manifest is always pushed last so a failed push can simply be retried.
+// If the reference already points to the image, nothing is transferred and PushResult.UpToDate is set.
+// If ctx carries a BlobTracker (see WithBlobTracker), concurrent pushes of the same blobs are coordinated.
+// A preflight (see WithPreflight) is called once the blobs missing on the remote are known.
+func (r *Registry) PushImage(ctx context.Context, ref string, img ociimage.Image, opts ...PushOption) (*PushResult, error) {
+	o := &PushOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	named, err := r.parser.ParseNamed(ref)
+	if err != nil {
+		return nil, err
+	}
+	ref = named.String()
+
+	var (
+		manifest = img.Descriptor()
+		reporter = progress.FromContext(ctx)
+	)
+	// Resolve errors are not fatal here: the registry may e.g. not allow pulls, the push surfaces any real error.
+	if _, desc, err := r.resolver.Resolve(ctx, ref); err == nil && desc.Digest == manifest.Digest {
+		reporter.Report(progress.BlobDone{Digest: manifest.Digest, Total: manifest.Size, Skipped: true})
+		return &PushResult{UpToDate: true}, nil
+	}
+
 	pusher, err := r.resolver.Pusher(ctx, ref)
 	if err != nil {
-		return fmt.Errorf("error getting pusher for %s: %w", ref, err)
+		return nil, fmt.Errorf("error getting pusher for %s: %w", ref, err)
 	}
+	pusher = repositoryPusher{Pusher: pusher, repository: reference.TrimNamed(named).String()}
 
 	layers, err := ociimage.AsWriteLayers(ctx, img)
 	if err != nil {
-		return fmt.Errorf("error transforming image to write layers: %w", err)
+		return nil, fmt.Errorf("error transforming image to write layers: %w", err)
+	}
+	// AsWriteLayers returns the blobs followed by the manifest.
+	blobs := layers[:len(layers)-1]
+
+	if key, ok := r.cacheKey(ref); ok {
+		// Invalidate before and after pushing so neither a failed push nor a resolve during the push
+		// leaves a stale entry.
+		_ = r.resolveCache.Invalidate(key)
+		defer func() { _ = r.resolveCache.Invalidate(key) }()
 	}
 
-	for _, layer := range layers {
-		if err := r.pushLayer(ctx, pusher, layer); err != nil {
-			return fmt.Errorf("error pushing layer %s: %w", layer.Descriptor().Digest, err)
+	var (
+		pushed  []ociimage.Layer
+		missing []ociimage.Layer
+		res     = &PushResult{}
+	)
+	for _, blob := range blobs {
+		desc := blob.Descriptor()
+		if r.externalClient != nil && HasExternalURLs(desc) {
+			reporter.Report(progress.BlobDone{Digest: desc.Digest, Total: desc.Size, Skipped: true})
+			res.External++
+			continue
 		}
+		pushed = append(pushed, blob)
 	}
-	return nil
+
+	// Claim the blobs before checking them so a concurrent push of the same blob is waited for
+	// and then found instead of uploading it again.
+	tracker := blobTrackerFromContext(ctx)
+	dgsts := make([]digest.Digest, 0, len(pushed))
+	for _, blob := range pushed {
+		dgsts = append(dgsts, blob.Descriptor().Digest)
+	}
+	claims, err := tracker.claim(ctx, named, dgsts)
+	if err != nil {
+		return nil, err
+	}
+	defer claims.releaseAll()
+
+	for _, blob := range pushed {
+		desc := blob.Descriptor()
+		ok, err := r.blobExists(ctx, named, desc)
+		if err != nil {
+			return nil, fmt.Errorf("error checking blob %s: %w", desc.Digest, err)
+		}
+		if ok {
+			reporter.Report(progress.BlobDone{Digest: desc.Digest, Total: desc.Size, Skipped: true})
+			res.Skipped++
+			claims.release(desc.Digest, true)
+			continue
+		}
+		missing = append(missing, blob)
+	}
+	if missing, err = withMountSources(ctx, img, named, missing, tracker); err != nil {
+		return nil, err
+	}
+	if o.Preflight != nil {
+		if err := o.Preflight(ctx, ref, pushSize(img, missing)); err != nil {
+			return nil, err
+		}
+	}
+
+	host := reference.Domain(named)
+	for _, blob := range missing {
+		release, err := r.limits.acquire(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		err = r.pushLayer(ctx, pusher, blob)
+		release()
+		if err != nil {
+			return nil, fmt.Errorf("error pushing layer %s: %w", blob.Descriptor().Digest, err)
+		}
+		claims.release(blob.Descriptor().Digest, true)
+		res.Uploaded++
+	}
+
+	if err := r.pushLayer(ctx, pusher, img); err != nil {
+		return nil, fmt.Errorf("error pushing manifest %s: %w", manifest.Digest, err)
+	}
+	return res, nil
+}
+
+// DockerRegistryOptions are options for creating a docker Registry.
+type DockerRegistryOptions struct {
+	// ConfigPaths are the paths to look up docker configuration. If empty, the default location is used.
+	ConfigPaths []string
+	// ResolverOptions are additional options for the underlying resolver.
+	ResolverOptions []auth.ResolverOption
+	// NoAnonymousFallback disables retrying pulls anonymously if the stored credentials are rejected.
+	NoAnonymousFallback bool
+	// DefaultRegistry is the registry applied to references without a registry. See ref.Parser.
+	DefaultRegistry string
+	// ConnectTimeout bounds resolving a reference, i.e. the initial round-trips to the registry.
+	// Pass an http.Client with dial timeouts via ResolverOptions to also bound establishing connections.
+	ConnectTimeout time.Duration
+	// UserAgent is sent with every request unless ResolverOptions set a User-Agent header.
+	// If empty, version.UserAgent is used.
+	UserAgent string
 }
 
 func DockerRegistry(configPaths []string, opts ...auth.ResolverOption) (*Registry, error) {
-	dockerClient, err := docker.NewClient(configPaths...)
+	return NewDockerRegistry(DockerRegistryOptions{
+		ConfigPaths:     configPaths,
+		ResolverOptions: opts,
+	})
+}
+
+func NewDockerRegistry(o DockerRegistryOptions, opts ...Option) (*Registry, error) {
+	options := &Options{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	authClient, err := docker.NewClient(o.ConfigPaths...)
 	if err != nil {
 		return nil, fmt.Errorf("error creating docker client: %w", err)
 	}
 
-	resolver, err := dockerClient.ResolverWithOpts(opts...)
+	userAgent := o.UserAgent
+	if userAgent == "" {
+		userAgent = version.UserAgent()
+	}
+	resolverOptions := append(append([]auth.ResolverOption(nil), o.ResolverOptions...), withDefaultUserAgent(userAgent))
+
+	dockerClient, ok := authClient.(*docker.Client)
+	if !ok {
+		return nil, fmt.Errorf("unsupported docker client %T", authClient)
+	}
+	resolver, err := dockerClient.ResolverWithOpts(resolverOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("error creating resolver: %w", err)
 	}
 
-	return &Registry{resolver}, nil
+	credentialSource := "default docker config"
+	if len(o.ConfigPaths) > 0 {
+		credentialSource = fmt.Sprintf("docker config %s", strings.Join(o.ConfigPaths, ", "))
+	}
+
+	settings := &auth.ResolverSettings{}
+	for _, opt := range resolverOptions {
+		opt(settings)
+	}
+
+	var anonymousResolver remotes.Resolver
+	if !o.NoAnonymousFallback {
+		anonymousResolver = containerddocker.NewResolver(containerddocker.ResolverOptions{
+			Client:    settings.Client,
+			PlainHTTP: settings.PlainHTTP,
+			Headers:   settings.Headers,
+		})
+	}
+
+	var resolveCache *ResolveCache
+	if options.ResolveCacheTTL > 0 {
+		resolveCache = NewResolveCache(options.ResolveCacheTTL, options.ResolveCachePath)
+	}
+
+	var externalClient *http.Client
+	if !options.NoExternalBlobs {
+		externalClient = settings.Client
+		if externalClient == nil {
+			externalClient = http.DefaultClient
+		}
+	}
+
+	decodeLimits := ociimage.DefaultLimits
+	if options.Limits != nil {
+		decodeLimits = *options.Limits
+	}
+
+	return &Registry{
+		resolver:          resolver,
+		parser:            ref.Parser{DefaultRegistry: o.DefaultRegistry},
+		anonymousResolver: anonymousResolver,
+		credential:        dockerClient.Credential,
+		credentialSource:  credentialSource,
+		connectTimeout:    o.ConnectTimeout,
+		resolveCache:      resolveCache,
+		limits:            newTransferLimits(options.HostsConfig),
+		externalClient:    externalClient,
+		decodeLimits:      decodeLimits,
+	}, nil
+}
+
+// withDefaultUserAgent sets the User-Agent header if none of the previous options did.
+func withDefaultUserAgent(userAgent string) auth.ResolverOption {
+	return func(settings *auth.ResolverSettings) {
+		if settings.Headers.Get("User-Agent") != "" {
+			return
+		}
+		headers := settings.Headers.Clone()
+		if headers == nil {
+			headers = http.Header{}
+		}
+		headers.Set("User-Agent", userAgent)
+		settings.Headers = headers
+	}
 }
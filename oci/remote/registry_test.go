@@ -0,0 +1,795 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/remotes"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onmetal/onmetal-image/oci/remote"
+	"github.com/onmetal/onmetal-image/oci/store"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	"github.com/onmetal/onmetal-image/testing/registryharness"
+	"github.com/onmetal/onmetal-image/unpack"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Registry", func() {
+	var (
+		ctx         = context.Background()
+		harness     *registryharness.Registry
+		configPath  string
+		newRegistry func() *Registry
+	)
+
+	BeforeEach(func() {
+		harness = registryharness.New()
+		DeferCleanup(harness.Close)
+
+		configPath = filepath.Join(GinkgoT().TempDir(), "config.json")
+		Expect(os.WriteFile(configPath, []byte("{}"), 0666)).To(Succeed())
+
+		newRegistry = func() *Registry {
+			registry, err := NewDockerRegistry(DockerRegistryOptions{ConfigPaths: []string{configPath}})
+			Expect(err).NotTo(HaveOccurred())
+			return registry
+		}
+	})
+
+	newImage := func() ociimage.Image {
+		img, err := fixtures.Bootable().Build()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	blobDigests := func(img ociimage.Image) []digest.Digest {
+		config, err := img.Config(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		layers, err := img.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		digests := []digest.Digest{config.Descriptor().Digest}
+		for _, layer := range layers {
+			digests = append(digests, layer.Descriptor().Digest)
+		}
+		return digests
+	}
+
+	newStoreAt := func(path string) *store.Store {
+		s, err := store.New(path)
+		Expect(err).NotTo(HaveOccurred())
+		return s
+	}
+
+	newStore := func() *store.Store {
+		return newStoreAt(GinkgoT().TempDir())
+	}
+
+	It("should walk the children of an image index and enforce the limits", func() {
+		children := []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("a"), Size: 1},
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("b"), Size: 2},
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("c"), Size: 3},
+		}
+		data, err := json.Marshal(ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: children})
+		Expect(err).NotTo(HaveOccurred())
+		harness.SeedManifest("repo", "index", ocispec.MediaTypeImageIndex, data)
+		ref := harness.Reference("repo", "index")
+
+		index, err := newRegistry().ResolveIndex(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		var walked []ocispec.Descriptor
+		Expect(index.Walk(ctx, func(desc ocispec.Descriptor) error {
+			walked = append(walked, desc)
+			return nil
+		})).To(Succeed())
+		Expect(walked).To(Equal(children))
+
+		By("limiting the number of index entries")
+		registry, err := NewDockerRegistry(DockerRegistryOptions{ConfigPaths: []string{configPath}}, WithLimits(ociimage.Limits{MaxIndexEntries: 2, MaxManifestSize: 16}))
+		Expect(err).NotTo(HaveOccurred())
+		index, err = registry.ResolveIndex(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(index.Walk(ctx, func(desc ocispec.Descriptor) error { return nil })).To(MatchError(ociimage.ErrLimitExceeded))
+
+		By("limiting the manifest size")
+		Expect(harness.Seed(ctx, "repo", "image", newImage())).To(Succeed())
+		img, err := registry.Resolve(ctx, harness.Reference("repo", "image"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = img.Manifest(ctx)
+		var limitErr *ociimage.LimitError
+		Expect(errors.As(err, &limitErr)).To(BeTrue())
+		Expect(limitErr.Limit).To(Equal("manifest size"))
+
+		By("refusing to resolve manifests as index")
+		_, err = registry.ResolveIndex(ctx, harness.Reference("repo", "image"))
+		Expect(err).To(MatchError(ContainSubstring("is no image index")))
+	})
+
+	It("should abort a push rejected by the preflight before uploading anything", func() {
+		var (
+			ref      = harness.Reference("repo", "latest")
+			img      = newImage()
+			registry = newRegistry()
+			sizes    []int64
+			rejected = errors.New("rejected")
+		)
+		preflight := func(ctx context.Context, ref string, size int64) error {
+			sizes = append(sizes, size)
+			return rejected
+		}
+
+		By("pushing to an empty repository")
+		_, err := registry.PushImage(ctx, ref, img, WithPreflight(preflight))
+		Expect(err).To(MatchError(rejected))
+		Expect(harness.Stats().Uploaded).To(BeEmpty())
+		Expect(harness.Stats().ManifestPuts).To(BeZero())
+
+		manifest, err := img.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		total := img.Descriptor().Size + manifest.Config.Size
+		for _, layer := range manifest.Layers {
+			total += layer.Size
+		}
+		Expect(sizes).To(Equal([]int64{total}))
+
+		By("pushing again with some blobs present")
+		harness.FailUploadsAfter(2)
+		_, err = registry.PushImage(ctx, ref, img)
+		Expect(err).To(HaveOccurred())
+		harness.FailUploadsAfter(-1)
+		uploaded := harness.Stats().Uploaded
+
+		_, err = registry.PushImage(ctx, ref, img, WithPreflight(preflight))
+		Expect(err).To(MatchError(rejected))
+		present := int64(0)
+		for _, desc := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+			for _, dgst := range uploaded {
+				if desc.Digest == dgst {
+					present += desc.Size
+				}
+			}
+		}
+		Expect(sizes[1]).To(Equal(total - present))
+	})
+
+	It("should resume an interrupted push", func() {
+		var (
+			ref      = harness.Reference("repo", "latest")
+			img      = newImage()
+			blobs    = blobDigests(img)
+			registry = newRegistry()
+		)
+
+		By("interrupting the first push after two blobs")
+		harness.FailUploadsAfter(2)
+		_, err := registry.PushImage(ctx, ref, img)
+		Expect(err).To(HaveOccurred())
+		Expect(harness.Stats().Uploaded).To(Equal(blobs[:2]))
+		Expect(harness.Stats().ManifestPuts).To(BeZero())
+
+		By("retrying the push")
+		harness.FailUploadsAfter(-1)
+		harness.ResetStats()
+		res, err := registry.PushImage(ctx, ref, img)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(&PushResult{Uploaded: 2, Skipped: 2}))
+		Expect(harness.Stats().Uploaded).To(Equal(blobs[2:]))
+		Expect(harness.Stats().ManifestPuts).To(Equal(1))
+
+		By("pushing again")
+		harness.ResetStats()
+		res, err = registry.PushImage(ctx, ref, img)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(&PushResult{UpToDate: true}))
+		Expect(harness.Stats().Uploaded).To(BeEmpty())
+		Expect(harness.Stats().ManifestPuts).To(BeZero())
+
+		desc, ok := harness.Manifest("repo", "latest")
+		Expect(ok).To(BeTrue())
+		Expect(desc.Digest).To(Equal(img.Descriptor().Digest))
+	})
+
+	It("should mount layers taken from other images of the same registry", func() {
+		base := newImage()
+		Expect(harness.Seed(ctx, "base", "v1", base)).To(Succeed())
+		baseLayers, err := base.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		rootFS := baseLayers[2]
+
+		sources, err := imageutil.LayerSources{
+			rootFS.Descriptor().Digest: {harness.Reference("base", "v1") + "@" + base.Descriptor().Digest.String()},
+		}.Annotations()
+		Expect(err).NotTo(HaveOccurred())
+		img, err := imageutil.NewJSONConfigBuilder(&onmetalimage.Config{}, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).
+			BytesLayer([]byte("derived kernel"), imageutil.WithMediaType(onmetalimage.KernelLayerMediaType)).
+			BytesLayer([]byte("derived initramfs"), imageutil.WithMediaType(onmetalimage.InitRAMFSLayerMediaType)).
+			Layers(rootFS).
+			Annotations(sources).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+
+		harness.ResetStats()
+		Expect(newRegistry().Push(ctx, harness.Reference("derived", "v1"), img)).To(Succeed())
+		Expect(harness.Stats().Mounted).To(Equal([]digest.Digest{rootFS.Descriptor().Digest}))
+		Expect(harness.Stats().Uploaded).NotTo(ContainElement(rootFS.Descriptor().Digest))
+
+		pulled, err := newRegistry().Resolve(ctx, harness.Reference("derived", "v1"))
+		Expect(err).NotTo(HaveOccurred())
+		manifest, err := pulled.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest.Layers[2]).To(Equal(rootFS.Descriptor()))
+	})
+
+	It("should upload blobs shared by concurrent tracked pushes only once", func() {
+		var (
+			img      = newImage()
+			blobs    = blobDigests(img)
+			registry = newRegistry()
+			trackCtx = WithBlobTracker(ctx, NewBlobTracker())
+		)
+
+		By("pushing the image concurrently to the same repository")
+		var wg sync.WaitGroup
+		errs := make([]error, 3)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				_, errs[i] = registry.PushImage(trackCtx, harness.Reference("repo", fmt.Sprintf("v%d", i)), img)
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(harness.Stats().Uploaded).To(ConsistOf(blobs))
+
+		By("pushing the image to another repository of the registry")
+		harness.ResetStats()
+		Expect(registry.Push(trackCtx, harness.Reference("other", "v1"), img)).To(Succeed())
+		Expect(harness.Stats().Uploaded).To(BeEmpty())
+		Expect(harness.Stats().Mounted).To(ConsistOf(blobs))
+	})
+
+	It("should push an index referencing remote and local manifests", func() {
+		var (
+			registry = newRegistry()
+			inRepo   = newImage()
+		)
+		inOther, err := fixtures.RootFS("other rootfs").Build()
+		Expect(err).NotTo(HaveOccurred())
+		local, err := fixtures.RootFS("local rootfs").Build()
+		Expect(err).NotTo(HaveOccurred())
+		rootFSDigest := func(img ociimage.Image) digest.Digest {
+			layers, err := img.Layers(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			return layers[0].Descriptor().Digest
+		}
+		Expect(harness.Seed(ctx, "repo", "v1", inRepo)).To(Succeed())
+		Expect(harness.Seed(ctx, "other", "v1", inOther)).To(Succeed())
+
+		resolve := func(repository string) IndexChild {
+			ref := harness.Reference(repository, "v1")
+			img, err := registry.Resolve(ctx, ref)
+			Expect(err).NotTo(HaveOccurred())
+			return IndexChild{Image: img, Source: ref}
+		}
+		children := []IndexChild{resolve("repo"), resolve("other"), {Image: local}}
+		index, err := imageutil.IndexLayer([]ocispec.Descriptor{inRepo.Descriptor(), inOther.Descriptor(), local.Descriptor()}, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("refusing children of other registries before pushing anything")
+		foreign := registryharness.New()
+		DeferCleanup(foreign.Close)
+		Expect(foreign.Seed(ctx, "repo", "v1", inOther)).To(Succeed())
+		foreignImg, err := registry.Resolve(ctx, foreign.Reference("repo", "v1"))
+		Expect(err).NotTo(HaveOccurred())
+		harness.ResetStats()
+		_, err = registry.PushIndex(ctx, harness.Reference("repo", "multi"), index,
+			append(children, IndexChild{Image: foreignImg, Source: foreign.Reference("repo", "v1")}))
+		Expect(err).To(MatchError(ContainSubstring("cannot be mounted across registries")))
+		Expect(harness.Stats().Uploaded).To(BeEmpty())
+
+		By("pushing the index")
+		res, err := registry.PushIndex(ctx, harness.Reference("repo", "multi"), index, children)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(harness.Stats().Mounted).To(ContainElement(rootFSDigest(inOther)))
+		Expect(harness.Stats().Uploaded).To(ContainElement(rootFSDigest(local)))
+		Expect(harness.Stats().Uploaded).NotTo(ContainElement(rootFSDigest(inOther)))
+		Expect(res.Uploaded).To(BeNumerically(">", 0))
+
+		desc, ok := harness.Manifest("repo", "multi")
+		Expect(ok).To(BeTrue())
+		Expect(desc.Digest).To(Equal(index.Descriptor().Digest))
+		for _, img := range []ociimage.Image{inRepo, inOther, local} {
+			_, ok := harness.Manifest("repo", img.Descriptor().Digest.String())
+			Expect(ok).To(BeTrue())
+		}
+
+		By("pushing it again")
+		res, err = registry.PushIndex(ctx, harness.Reference("repo", "multi"), index, children)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.UpToDate).To(BeTrue())
+	})
+
+	Describe("external blob urls", func() {
+		var (
+			rootFS        = []byte("external rootfs")
+			rootFSDigest  = digest.FromBytes(rootFS)
+			served        []byte
+			externalFails bool
+			externalHits  int
+			externalURL   string
+		)
+
+		BeforeEach(func() {
+			served, externalFails, externalHits = rootFS, false, 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				externalHits++
+				if externalFails {
+					http.NotFound(w, req)
+					return
+				}
+				_, _ = w.Write(served)
+			}))
+			DeferCleanup(server.Close)
+			externalURL = server.URL + "/rootfs"
+		})
+
+		newExternalImage := func() ociimage.Image {
+			img, err := imageutil.NewJSONConfigBuilder(&onmetalimage.Config{}, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).
+				BytesLayer([]byte("kernel"), imageutil.WithMediaType(onmetalimage.KernelLayerMediaType)).
+				BytesLayer([]byte("initramfs"), imageutil.WithMediaType(onmetalimage.InitRAMFSLayerMediaType)).
+				BytesLayer(rootFS,
+					imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType),
+					func(desc *ocispec.Descriptor) { desc.URLs = []string{externalURL} },
+				).
+				Complete()
+			Expect(err).NotTo(HaveOccurred())
+			return img
+		}
+
+		It("should not upload blobs with external urls and pull them from there", func() {
+			ref := harness.Reference("repo", "latest")
+			res, err := newRegistry().PushImage(ctx, ref, newExternalImage())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.External).To(Equal(1))
+			Expect(harness.Stats().Uploaded).NotTo(ContainElement(rootFSDigest))
+
+			s := newStore()
+			results, err := newRegistry().Pull(ctx, ref, s)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results[0].Err).NotTo(HaveOccurred())
+			Expect(externalHits).To(Equal(1))
+			Expect(harness.Stats().BlobFetches).NotTo(ContainElement(rootFSDigest))
+		})
+
+		It("should fall back to the registry if the external urls fail", func() {
+			ref := harness.Reference("repo", "latest")
+			Expect(harness.Seed(ctx, "repo", "latest", newExternalImage())).To(Succeed())
+			externalFails = true
+
+			results, err := newRegistry().Pull(ctx, ref, newStore())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results[0].Err).NotTo(HaveOccurred())
+			Expect(externalHits).To(Equal(1))
+			Expect(harness.Stats().BlobFetches).To(ContainElement(rootFSDigest))
+		})
+
+		It("should reject external content not matching the digest", func() {
+			ref := harness.Reference("repo", "latest")
+			_, err := newRegistry().PushImage(ctx, ref, newExternalImage())
+			Expect(err).NotTo(HaveOccurred())
+			served = []byte("tampered rootfs")
+
+			results, err := newRegistry().Pull(ctx, ref, newStore())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results[0].Err).To(HaveOccurred())
+		})
+
+		It("should neither use nor rely on external urls if forbidden", func() {
+			registry, err := NewDockerRegistry(DockerRegistryOptions{ConfigPaths: []string{configPath}}, WithNoExternalBlobs())
+			Expect(err).NotTo(HaveOccurred())
+
+			ref := harness.Reference("repo", "latest")
+			res, err := registry.PushImage(ctx, ref, newExternalImage())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.External).To(BeZero())
+			Expect(harness.Stats().Uploaded).To(ContainElement(rootFSDigest))
+
+			results, err := registry.Pull(ctx, ref, newStore())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results[0].Err).NotTo(HaveOccurred())
+			Expect(externalHits).To(BeZero())
+		})
+	})
+
+	It("should pull a seeded image into a store", func() {
+		img := newImage()
+		Expect(harness.Seed(ctx, "repo", "latest", img)).To(Succeed())
+
+		ref := harness.Reference("repo", "latest")
+		s := newStore()
+		results, err := newRegistry().Pull(ctx, ref, s)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].Err).NotTo(HaveOccurred())
+
+		pulled, err := s.Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pulled.Descriptor().Digest).To(Equal(img.Descriptor().Digest))
+		Expect(harness.Stats().BlobFetches).To(ConsistOf(blobDigests(img)))
+	})
+
+	Describe("rejected credentials", func() {
+		var (
+			ref string
+			img ociimage.Image
+		)
+		BeforeEach(func() {
+			img = newImage()
+			Expect(harness.Seed(ctx, "repo", "latest", img)).To(Succeed())
+			ref = harness.Reference("repo", "latest")
+			Expect(harness.WriteDockerConfig(configPath, "user", "wrong")).To(Succeed())
+		})
+
+		newRegistryWithoutFallback := func() *Registry {
+			registry, err := NewDockerRegistry(DockerRegistryOptions{ConfigPaths: []string{configPath}, NoAnonymousFallback: true})
+			Expect(err).NotTo(HaveOccurred())
+			return registry
+		}
+
+		It("should fall back to anonymous pulls", func() {
+			harness.SetAuth(&registryharness.Auth{Scheme: registryharness.AuthSchemeBearer, Username: "user", Password: "secret", AnonymousPull: true})
+
+			resolved, err := newRegistry().Resolve(ctx, ref)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved.Descriptor().Digest).To(Equal(img.Descriptor().Digest))
+
+			s := newStore()
+			results, err := newRegistry().Pull(ctx, ref, s)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(HaveLen(1))
+			Expect(results[0].Err).NotTo(HaveOccurred())
+			pulled, err := s.Resolve(ctx, ref)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pulled.Descriptor().Digest).To(Equal(img.Descriptor().Digest))
+		})
+
+		It("should not fall back to anonymous pulls if disabled", func() {
+			harness.SetAuth(&registryharness.Auth{Scheme: registryharness.AuthSchemeBearer, Username: "user", Password: "secret", AnonymousPull: true})
+
+			_, err := newRegistryWithoutFallback().Resolve(ctx, ref)
+			Expect(err).To(MatchError(ErrCredentialsRejected))
+			Expect(err).To(MatchError(HavePrefix(fmt.Sprintf("stored credentials were rejected by registry %s (credentials from docker config %s): ",
+				harness.Host(), configPath))))
+
+			results, err := newRegistryWithoutFallback().Pull(ctx, ref, newStore())
+			Expect(err).To(MatchError(ErrCredentialsRejected))
+			Expect(results).To(BeEmpty())
+			Expect(harness.Stats().BlobFetches).To(BeEmpty())
+		})
+
+		DescribeTable("should report rejected credentials if anonymous pulls fail as well",
+			func(scheme registryharness.AuthScheme) {
+				harness.SetAuth(&registryharness.Auth{Scheme: scheme, Username: "user", Password: "secret"})
+
+				_, err := newRegistry().Resolve(ctx, ref)
+				Expect(err).To(MatchError(ErrCredentialsRejected))
+				Expect(err).To(MatchError(HavePrefix(fmt.Sprintf("stored credentials were rejected by registry %s (credentials from docker config %s) and anonymous access failed: ",
+					harness.Host(), configPath))))
+			},
+			Entry("basic", registryharness.AuthSchemeBasic),
+			Entry("bearer", registryharness.AuthSchemeBearer),
+		)
+
+		It("should not blame missing credentials on stored ones", func() {
+			harness.SetAuth(&registryharness.Auth{Scheme: registryharness.AuthSchemeBearer, Username: "user", Password: "secret"})
+			Expect(os.WriteFile(configPath, []byte("{}"), 0666)).To(Succeed())
+
+			_, err := newRegistry().Resolve(ctx, ref)
+			Expect(err).To(HaveOccurred())
+			Expect(err).NotTo(MatchError(ErrCredentialsRejected))
+		})
+	})
+
+	It("should push and pull with bearer token authentication", func() {
+		harness.SetAuth(&registryharness.Auth{Scheme: registryharness.AuthSchemeBearer, Username: "user", Password: "secret"})
+		ref := harness.Reference("repo", "latest")
+		img := newImage()
+
+		By("pushing without credentials")
+		Expect(newRegistry().Push(ctx, ref, img)).NotTo(Succeed())
+
+		By("pushing with credentials")
+		Expect(harness.WriteDockerConfig(configPath, "user", "secret")).To(Succeed())
+		Expect(newRegistry().Push(ctx, ref, img)).To(Succeed())
+		Expect(harness.Stats().TokenRequests).NotTo(BeZero())
+
+		By("pulling after the tokens expired")
+		harness.ExpireTokens()
+		results, err := newRegistry().Pull(ctx, ref, newStore())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results[0].Err).NotTo(HaveOccurred())
+	})
+
+	Describe("stream resets", func() {
+		const size = 256 << 10
+
+		var (
+			ref    string
+			img    ociimage.Image
+			data   []byte
+			rootfs digest.Digest
+		)
+
+		BeforeEach(func() {
+			data = make([]byte, size)
+			for i := range data {
+				data[i] = byte(i % 251)
+			}
+			var err error
+			img, err = imageutil.NewJSONConfigBuilder(&onmetalimage.Config{}, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).
+				BytesLayer(data, imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType)).
+				Complete()
+			Expect(err).NotTo(HaveOccurred())
+			rootfs = blobDigests(img)[1]
+
+			ref = harness.Reference("repo", "latest")
+			Expect(harness.Seed(ctx, "repo", "latest", img)).To(Succeed())
+		})
+
+		pullRootFS := func() ([]byte, error) {
+			s := newStore()
+			results, err := newRegistry().Pull(ctx, ref, s)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(HaveLen(1))
+			if results[0].Err != nil {
+				return nil, results[0].Err
+			}
+
+			stored, err := s.Resolve(ctx, ref)
+			Expect(err).NotTo(HaveOccurred())
+			layers, err := stored.Layers(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			return imageutil.ReadLayerContent(ctx, layers[0])
+		}
+
+		DescribeTable("should resume the transfer with a range request",
+			func(offsets ...int64) {
+				harness.ResetBlob(rootfs, offsets...)
+				harness.ResetStats()
+
+				Expect(pullRootFS()).To(Equal(data))
+				Expect(harness.Stats().BlobFetches).To(HaveLen(2 + len(offsets)))
+				Expect(harness.Stats().RangeRequests).To(Equal(len(offsets)))
+			},
+			Entry("right after the start", int64(1)),
+			Entry("in the middle", int64(size/2)),
+			Entry("right before the end", int64(size-1)),
+			Entry("several times", int64(1000), int64(64<<10), int64(200<<10)),
+		)
+
+		It("should restart the transfer if the registry does not support range requests", func() {
+			harness.Disable(registryharness.APIRangeRequests)
+			harness.ResetBlob(rootfs, size/2)
+			harness.ResetStats()
+
+			Expect(pullRootFS()).To(Equal(data))
+			Expect(harness.Stats().BlobFetches).To(HaveLen(3))
+			Expect(harness.Stats().RangeRequests).To(BeZero())
+		})
+
+		It("should resume a download interrupted by an earlier process", func() {
+			var (
+				path = GinkgoT().TempDir()
+				s    = newStoreAt(path)
+				desc = ocispec.Descriptor{MediaType: onmetalimage.RootFSLayerMediaType, Digest: rootfs, Size: size}
+				ref  = remotes.MakeRefKey(ctx, desc) + "-" + digest.FromString(path).Encoded()[:12]
+			)
+
+			By("leaving half of the rootfs in an ingest")
+			w, err := s.Layout().Store().Writer(ctx, content.WithRef(ref), content.WithDescriptor(desc))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = w.Write(data[:size/2])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w.Close()).To(Succeed())
+
+			statuses, err := s.Layout().IngestStatus(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(statuses).To(HaveLen(1))
+			Expect(statuses[0].Expected).To(Equal(rootfs))
+			Expect(statuses[0].Offset).To(Equal(int64(size / 2)))
+			Expect(statuses[0].InFlight).To(BeFalse())
+
+			By("pulling the image")
+			var resumed []progress.BlobResumed
+			pullCtx := progress.NewContext(ctx, progress.ReporterFunc(func(event progress.Event) {
+				if e, ok := event.(progress.BlobResumed); ok {
+					resumed = append(resumed, e)
+				}
+			}))
+			harness.ResetStats()
+			results, err := newRegistry().Pull(pullCtx, harness.Reference("repo", "latest"), s)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(HaveLen(1))
+			Expect(results[0].Err).NotTo(HaveOccurred())
+			Expect(resumed).To(Equal([]progress.BlobResumed{{Digest: rootfs, Offset: size / 2, Total: size}}))
+			Expect(harness.Stats().RangeRequests).To(Equal(1))
+
+			stored, err := s.Resolve(ctx, harness.Reference("repo", "latest"))
+			Expect(err).NotTo(HaveOccurred())
+			layers, err := stored.Layers(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(imageutil.ReadLayerContent(ctx, layers[0])).To(Equal(data))
+
+			statuses, err = s.Layout().IngestStatus(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(statuses).To(BeEmpty())
+		})
+
+		It("should report the blob, progress and host if resuming does not help", func() {
+			harness.ResetBlob(rootfs, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000)
+
+			_, err := pullRootFS()
+			var transferErr *TransferError
+			Expect(errors.As(err, &transferErr)).To(BeTrue())
+			Expect(transferErr.Digest).To(Equal(rootfs))
+			Expect(transferErr.Host).To(Equal(harness.Host()))
+			Expect(transferErr.Received).To(Equal(int64(1000)))
+			Expect(transferErr.Expected).To(Equal(int64(size)))
+		})
+	})
+
+	It("should reject truncated blobs", func() {
+		img := newImage()
+		Expect(harness.Seed(ctx, "repo", "latest", img)).To(Succeed())
+		harness.TruncateBlob(blobDigests(img)[3], 2)
+
+		results, err := newRegistry().Pull(ctx, harness.Reference("repo", "latest"), newStore())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].Err).To(HaveOccurred())
+	})
+
+	It("should fetch each blob only once for concurrent pulls into the same layout", func() {
+		img := newImage()
+		Expect(harness.Seed(ctx, "repo", "latest", img)).To(Succeed())
+		harness.SetLatency(100 * time.Millisecond)
+
+		var (
+			ref    = harness.Reference("repo", "latest")
+			path   = GinkgoT().TempDir()
+			shared = newStoreAt(path)
+			wg     sync.WaitGroup
+		)
+		for i := 0; i < 10; i++ {
+			// Every other pull uses a store of its own, reached via a symlink so nothing is shared in-process,
+			// as separate processes would.
+			s := shared
+			if i%2 == 1 {
+				link := filepath.Join(GinkgoT().TempDir(), "store")
+				Expect(os.Symlink(path, link)).To(Succeed())
+				s = newStoreAt(link)
+			}
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				results, err := newRegistry().Pull(ctx, ref, s)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(results[0].Err).NotTo(HaveOccurred())
+			}()
+		}
+		wg.Wait()
+
+		fetches := make(map[digest.Digest]int)
+		for _, dgst := range harness.Stats().BlobFetches {
+			fetches[dgst]++
+		}
+		layers, err := img.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		for _, layer := range layers {
+			Expect(fetches).To(HaveKeyWithValue(layer.Descriptor().Digest, 1))
+		}
+
+		pulled, err := shared.Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pulled.Descriptor().Digest).To(Equal(img.Descriptor().Digest))
+	})
+
+	Describe("StreamLayer", func() {
+		var (
+			data   = bytes.Repeat([]byte("rootfs"), StreamHeadSize/3)
+			rootFS ociimage.Layer
+			ref    string
+		)
+
+		BeforeEach(func() {
+			var buf bytes.Buffer
+			gw := gzip.NewWriter(&buf)
+			_, err := gw.Write(data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(gw.Close()).To(Succeed())
+			rootFS = imageutil.BytesLayer(buf.Bytes(), imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType))
+
+			img, err := imageutil.NewJSONConfigBuilder(&onmetalimage.Config{}, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).
+				BytesLayer([]byte("kernel"), imageutil.WithMediaType(onmetalimage.KernelLayerMediaType)).
+				Layers(rootFS).
+				Complete()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(harness.Seed(ctx, "repo", "latest", img)).To(Succeed())
+			ref = harness.Reference("repo", "latest")
+		})
+
+		It("should stream the decompressed rootfs to the destination", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "disk")
+			f, err := os.Create(path)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { _ = f.Close() }()
+
+			res, err := newRegistry().StreamLayer(ctx, ref, RoleSelector("rootfs"), f)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Layer.Digest).To(Equal(rootFS.Descriptor().Digest))
+			Expect(res.Compression).To(Equal(unpack.CompressionGzip))
+			Expect(res.Written).To(BeEquivalentTo(len(data)))
+			Expect(os.ReadFile(path)).To(Equal(data))
+		})
+
+		It("should stream to writers without random access", func() {
+			var buf bytes.Buffer
+			_, err := newRegistry().StreamLayer(ctx, ref, RoleSelector("rootfs"), &buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(buf.Bytes()).To(Equal(data))
+		})
+
+		It("should leave the destination poisoned if the layer does not verify", func() {
+			harness.Disable(registryharness.APIRangeRequests)
+			harness.TruncateBlob(rootFS.Descriptor().Digest, rootFS.Descriptor().Size/2)
+			path := filepath.Join(GinkgoT().TempDir(), "disk")
+			Expect(os.WriteFile(path, []byte("bootable"), 0644)).To(Succeed())
+			f, err := os.OpenFile(path, os.O_WRONLY, 0)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { _ = f.Close() }()
+
+			_, err = newRegistry().StreamLayer(ctx, ref, RoleSelector("rootfs"), f)
+			Expect(err).To(MatchError(ErrStreamPoisoned))
+			written, err := os.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(written)).To(HavePrefix(StreamPoisonMarker))
+		})
+	})
+})
@@ -0,0 +1,187 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/onmetal/onmetal-image/unpack"
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// StreamPoisonMarker starts the head of a destination StreamLayer could not verify the content of,
+	// so it is recognizably not a usable disk.
+	StreamPoisonMarker = "ONMETAL-IMAGE-STREAM-UNVERIFIED\n"
+	// StreamHeadSize is the size of the head of the content StreamLayer holds back until the content is
+	// verified. It covers the partition tables and file system superblocks a firmware or kernel looks for.
+	StreamHeadSize = 1 << 20
+)
+
+// ErrStreamPoisoned is wrapped by the error of StreamLayer if the destination was poisoned, see
+// StreamPoisonMarker.
+var ErrStreamPoisoned = errors.New("destination was poisoned")
+
+// LayerSelector selects the layer of the image to stream, see StreamLayer.
+type LayerSelector func(ctx context.Context, img ociimage.Image) (ociimage.Layer, error)
+
+// RoleSelector selects the layer with the given role, see onmetalimage.LayerByRole.
+func RoleSelector(role string) LayerSelector {
+	return func(ctx context.Context, img ociimage.Image) (ociimage.Layer, error) {
+		return onmetalimage.LayerByRole(ctx, img, role)
+	}
+}
+
+// StreamResult is the result of StreamLayer.
+type StreamResult struct {
+	// Image is the resolved image, e.g. to record its metadata.
+	Image ociimage.Image
+	// Layer is the descriptor of the streamed layer.
+	Layer ocispec.Descriptor
+	// Compression is the compression of the layer the content was decompressed from.
+	Compression unpack.Compression
+	// Written is the number of (decompressed) bytes written to the destination.
+	Written int64
+}
+
+// StreamLayer streams the selected layer of the image at ref from the registry to dst, decompressing gzip
+// and zstd compressed layers on the fly and verifying the digest and size of the layer, without storing
+// it anywhere. The transfer is paced by dst: nothing is read from the registry faster than dst accepts it.
+//
+// If dst is an io.WriterAt, e.g. a block device, its head (see StreamHeadSize) is overwritten with the
+// StreamPoisonMarker before streaming and the held back head of the content is only written once the
+// content is verified. If streaming or verification fails, or the process dies, dst is left poisoned and
+// the returned error wraps ErrStreamPoisoned, so partial or corrupt content is never silently usable.
+// Other writers are written sequentially and have to be discarded by the caller on error.
+func (r *Registry) StreamLayer(ctx context.Context, ref string, selector LayerSelector, dst io.Writer) (*StreamResult, error) {
+	img, err := r.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %s: %w", ref, err)
+	}
+	layer, err := selector(ctx, img)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting layer of %s: %w", ref, err)
+	}
+	desc := layer.Descriptor()
+	res := &StreamResult{Image: img, Layer: desc}
+
+	wa, ok := dst.(io.WriterAt)
+	if !ok {
+		written, compression, err := streamLayer(ctx, layer, dst)
+		res.Written, res.Compression = written, compression
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+
+	if err := poison(wa); err != nil {
+		return nil, err
+	}
+	head := &headWriter{dst: wa}
+	written, compression, err := streamLayer(ctx, layer, head)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrStreamPoisoned, err)
+	}
+	if _, err := wa.WriteAt(head.head.Bytes(), 0); err != nil {
+		return nil, fmt.Errorf("%w: error writing head: %w", ErrStreamPoisoned, err)
+	}
+	res.Written, res.Compression = written, compression
+	return res, nil
+}
+
+// streamLayer copies the decompressed content of the layer to w, verifying the compressed content.
+func streamLayer(ctx context.Context, layer ociimage.Layer, w io.Writer) (int64, unpack.Compression, error) {
+	desc := layer.Descriptor()
+	reporter := progress.FromContext(ctx)
+
+	rc, err := layer.Content(ctx)
+	if err != nil {
+		return 0, unpack.CompressionNone, fmt.Errorf("error opening layer %s: %w", desc.Digest, err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	reporter.Report(progress.BlobStarted{Digest: desc.Digest, MediaType: desc.MediaType, Total: progress.Total(desc)})
+	verified, err := ioutils.NewReader(ctx, rc, desc, ioutils.WithProgress(progress.ReportInterval, progress.BlobProgressFunc(reporter, desc)))
+	if err != nil {
+		return 0, unpack.CompressionNone, err
+	}
+	detected, compression, err := unpack.DetectCompression(verified)
+	if err != nil {
+		return 0, compression, fmt.Errorf("error detecting compression of layer %s: %w", desc.Digest, err)
+	}
+	decompressed, err := unpack.Decompress(detected)
+	if err != nil {
+		return 0, compression, fmt.Errorf("error decompressing layer %s: %w", desc.Digest, err)
+	}
+	defer func() { _ = decompressed.Close() }()
+
+	written, err := io.Copy(w, decompressed)
+	if err != nil {
+		return written, compression, fmt.Errorf("error streaming layer %s: %w", desc.Digest, err)
+	}
+	// Decompressors may stop before the end of the content, the digest covers all of it.
+	if _, err := io.Copy(io.Discard, verified); err != nil {
+		return written, compression, fmt.Errorf("error verifying layer %s: %w", desc.Digest, err)
+	}
+	reporter.Report(progress.BlobDone{Digest: desc.Digest, Total: verified.Size()})
+	return written, compression, nil
+}
+
+// poison overwrites the head of w with the StreamPoisonMarker followed by zeros.
+func poison(w io.WriterAt) error {
+	buf := make([]byte, StreamHeadSize)
+	copy(buf, StreamPoisonMarker)
+	if _, err := w.WriteAt(buf, 0); err != nil {
+		return fmt.Errorf("error poisoning destination before streaming: %w", err)
+	}
+	return nil
+}
+
+// headWriter holds back the first StreamHeadSize bytes written to it and writes the rest to dst at their
+// offset.
+type headWriter struct {
+	dst    io.WriterAt
+	head   bytes.Buffer
+	offset int64
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if held := StreamHeadSize - w.head.Len(); held > 0 {
+		if held > len(p) {
+			held = len(p)
+		}
+		w.head.Write(p[:held])
+		w.offset += int64(held)
+		p = p[held:]
+	}
+	if len(p) > 0 {
+		written, err := w.dst.WriteAt(p, w.offset)
+		w.offset += int64(written)
+		if err != nil {
+			return n - len(p) + written, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// BlobTracker coordinates the blob uploads of several pushes of a process, e.g. of a batch: concurrent
+// pushes of a blob to the same repository wait for each other so it is only uploaded once, and blobs
+// already pushed to another repository of the same registry are mounted from there instead of being
+// uploaded again. Pass it to the pushes via WithBlobTracker.
+type BlobTracker struct {
+	mu      sync.Mutex
+	flights map[trackedBlob]chan struct{}
+	// pushed are the repositories (see reference.Path) per host each blob was pushed to or found in.
+	pushed map[digest.Digest]map[string]map[string]struct{}
+}
+
+type trackedBlob struct {
+	repository string
+	digest     digest.Digest
+}
+
+// NewBlobTracker creates a new BlobTracker.
+func NewBlobTracker() *BlobTracker {
+	return &BlobTracker{
+		flights: make(map[trackedBlob]chan struct{}),
+		pushed:  make(map[digest.Digest]map[string]map[string]struct{}),
+	}
+}
+
+type blobTrackerKey struct{}
+
+// WithBlobTracker returns a context making pushes with it coordinate their blob uploads with the tracker.
+func WithBlobTracker(ctx context.Context, tracker *BlobTracker) context.Context {
+	return context.WithValue(ctx, blobTrackerKey{}, tracker)
+}
+
+func blobTrackerFromContext(ctx context.Context) *BlobTracker {
+	tracker, _ := ctx.Value(blobTrackerKey{}).(*BlobTracker)
+	return tracker
+}
+
+// blobClaims are the claims of a push on uploading blobs to a repository, see BlobTracker.claim.
+type blobClaims struct {
+	tracker *BlobTracker
+	named   reference.Named
+	held    map[digest.Digest]chan struct{}
+}
+
+// claim waits until no other push uploads any of the blobs to the repository of named and claims
+// uploading them. The claims are taken in digest order, so pushes sharing blobs cannot deadlock.
+// A nil tracker returns nil claims, whose methods do nothing.
+func (t *BlobTracker) claim(ctx context.Context, named reference.Named, dgsts []digest.Digest) (*blobClaims, error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	sorted := append([]digest.Digest{}, dgsts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	c := &blobClaims{tracker: t, named: named, held: make(map[digest.Digest]chan struct{}, len(sorted))}
+	repository := reference.TrimNamed(named).String()
+	for _, dgst := range sorted {
+		if _, ok := c.held[dgst]; ok {
+			continue
+		}
+		key := trackedBlob{repository: repository, digest: dgst}
+		for {
+			t.mu.Lock()
+			flight, ok := t.flights[key]
+			if !ok {
+				flight = make(chan struct{})
+				t.flights[key] = flight
+				t.mu.Unlock()
+				c.held[dgst] = flight
+				break
+			}
+			t.mu.Unlock()
+
+			select {
+			case <-flight:
+			case <-ctx.Done():
+				c.releaseAll()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return c, nil
+}
+
+// release releases the claim on the blob, recording it as present in the repository if pushed is set.
+func (c *blobClaims) release(dgst digest.Digest, pushed bool) {
+	if c == nil {
+		return
+	}
+	flight, ok := c.held[dgst]
+	if !ok {
+		return
+	}
+	delete(c.held, dgst)
+
+	t := c.tracker
+	t.mu.Lock()
+	delete(t.flights, trackedBlob{repository: reference.TrimNamed(c.named).String(), digest: dgst})
+	if pushed {
+		t.recordLocked(c.named, dgst)
+	}
+	t.mu.Unlock()
+	close(flight)
+}
+
+// record records the blobs as present in the repository of named, e.g. because they belong to a
+// manifest resolved from there, so pushes to other repositories of its host mount them from there.
+func (t *BlobTracker) record(named reference.Named, dgsts ...digest.Digest) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, dgst := range dgsts {
+		t.recordLocked(named, dgst)
+	}
+}
+
+func (t *BlobTracker) recordLocked(named reference.Named, dgst digest.Digest) {
+	host := reference.Domain(named)
+	if t.pushed[dgst] == nil {
+		t.pushed[dgst] = make(map[string]map[string]struct{})
+	}
+	if t.pushed[dgst][host] == nil {
+		t.pushed[dgst][host] = make(map[string]struct{})
+	}
+	t.pushed[dgst][host][reference.Path(named)] = struct{}{}
+}
+
+// releaseAll releases all remaining claims without recording their blobs.
+func (c *blobClaims) releaseAll() {
+	if c == nil {
+		return
+	}
+	for dgst := range c.held {
+		c.release(dgst, false)
+	}
+}
+
+// repositories returns the other repositories of the host of named the blob was pushed to.
+func (t *BlobTracker) repositories(named reference.Named, dgst digest.Digest) []string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var res []string
+	for repository := range t.pushed[dgst][reference.Domain(named)] {
+		if repository != reference.Path(named) {
+			res = append(res, repository)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,177 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxResumesWithoutProgress is the number of times a blob transfer is resumed without receiving any data
+// in between before giving up.
+const maxResumesWithoutProgress = 3
+
+// TransferError is returned if the transfer of a blob from a registry failed midway, e.g. because a load
+// balancer reset the stream.
+type TransferError struct {
+	// Digest is the digest of the blob.
+	Digest digest.Digest
+	// Host is the registry host the blob was fetched from, if known.
+	Host string
+	// Received is the number of bytes received before the transfer failed.
+	Received int64
+	// Expected is the size of the blob, or progress.UnknownTotal if its descriptor has no size information.
+	Expected int64
+	// Resumes is the number of times the transfer was resumed before it failed.
+	Resumes int
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *TransferError) Error() string {
+	expected := "unknown"
+	if e.Expected != progress.UnknownTotal {
+		expected = fmt.Sprint(e.Expected)
+	}
+	host := e.Host
+	if host == "" {
+		host = "registry"
+	}
+	return fmt.Sprintf("error transferring blob %s from %s after receiving %d of %s bytes (resumed %d time(s)): %v",
+		e.Digest, host, e.Received, expected, e.Resumes, e.Err)
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+// resumingReader reads a blob from a fetcher, resuming the transfer at the current offset if reading fails.
+// The fetcher requests the remainder with a Range request; servers ignoring it are handled by discarding
+// the already received prefix, so the content is always continuous.
+type resumingReader struct {
+	ctx     context.Context
+	fetcher remotes.Fetcher
+	desc    ocispec.Descriptor
+	host    string
+
+	rc       io.ReadCloser
+	offset   int64
+	resumes  int
+	attempts int
+}
+
+func fetchResuming(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, host string) (io.ReadCloser, error) {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return &resumingReader{ctx: ctx, fetcher: fetcher, desc: desc, host: host, rc: rc}, nil
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.rc.Read(p)
+		r.offset += int64(n)
+		if n > 0 {
+			r.attempts = 0
+		}
+		if err == nil || errors.Is(err, io.EOF) {
+			return n, err
+		}
+
+		if !r.resumable(err) {
+			return n, r.transferError(err)
+		}
+		if resumeErr := r.resume(); resumeErr != nil {
+			return n, r.transferError(fmt.Errorf("%w, resuming failed: %v", err, resumeErr))
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resumable reports whether the transfer may be resumed after the error.
+func (r *resumingReader) resumable(err error) bool {
+	if r.ctx.Err() != nil || errdefs.IsNotFound(err) {
+		return false
+	}
+	return r.attempts < maxResumesWithoutProgress
+}
+
+// resume fetches the blob again, continuing at the current offset.
+func (r *resumingReader) resume() error {
+	_ = r.rc.Close()
+	r.attempts++
+	r.resumes++
+
+	rc, err := r.fetcher.Fetch(r.ctx, r.desc)
+	if err != nil {
+		return err
+	}
+	r.rc = rc
+	if r.offset == 0 {
+		return nil
+	}
+
+	seeker, ok := rc.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("fetcher does not support resuming at offset %d", r.offset)
+	}
+	if _, err := seeker.Seek(r.offset, io.SeekStart); err != nil {
+		return fmt.Errorf("error seeking to offset %d: %w", r.offset, err)
+	}
+	return nil
+}
+
+// Seek positions the transfer at the given offset from the start, e.g. to resume an interrupted ingest.
+func (r *resumingReader) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return 0, fmt.Errorf("unsupported whence %d", whence)
+	}
+	seeker, ok := r.rc.(io.Seeker)
+	if !ok {
+		return 0, errors.New("fetcher does not support seeking")
+	}
+	n, err := seeker.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	r.offset = n
+	return n, nil
+}
+
+func (r *resumingReader) transferError(err error) error {
+	return &TransferError{
+		Digest:   r.desc.Digest,
+		Host:     r.host,
+		Received: r.offset,
+		Expected: progress.Total(r.desc),
+		Resumes:  r.resumes,
+		Err:      err,
+	}
+}
+
+func (r *resumingReader) Close() error {
+	return r.rc.Close()
+}
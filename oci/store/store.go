@@ -23,34 +23,229 @@ import (
 	"github.com/onmetal/onmetal-image/oci/image"
 
 	"github.com/distribution/reference"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/batch"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/indexer"
 	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/processor"
+	"github.com/onmetal/onmetal-image/ref"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type Store struct {
 	layout *layout.Layout
+	parser ref.Parser
+}
+
+// Options are options for creating a Store.
+type Options struct {
+	// DefaultRegistry is the registry applied to references without a registry. See ref.Parser.
+	DefaultRegistry string
+	// LayoutOptions are options for the backing layout.Layout.
+	LayoutOptions []layout.Option
+}
+
+// Option is an option for creating a Store.
+type Option func(o *Options)
+
+// WithDefaultRegistry sets the registry applied to references without a registry.
+func WithDefaultRegistry(registry string) Option {
+	return func(o *Options) {
+		o.DefaultRegistry = registry
+	}
+}
+
+// WithLayoutOptions adds options for the backing layout.Layout.
+func WithLayoutOptions(opts ...layout.Option) Option {
+	return func(o *Options) {
+		o.LayoutOptions = append(o.LayoutOptions, opts...)
+	}
 }
 
 func (s *Store) Put(ctx context.Context, img image.Image) error {
-	desc := ocispec.Descriptor{MediaType: img.Descriptor().MediaType, Digest: img.Descriptor().Digest}
-	if err := s.layout.ReplaceImage(ctx, img, descriptormatcher.Equal(desc)); err != nil {
+	match := descriptormatcher.And(descriptormatcher.Unnamed, descriptormatcher.Digests(img.Descriptor().Digest))
+	ctx = layout.WithAuditOperation(ctx, layout.AuditAdd, ocicontent.IngestSource(ctx))
+	if err := s.layout.ReplaceImage(ctx, img, match); err != nil {
 		return fmt.Errorf("could not create image: %w", err)
 	}
 	return nil
 }
 
 func (s *Store) Push(ctx context.Context, ref string, img image.Image) error {
+	ctx = ocicontent.WithIngestSource(ctx, ref)
 	if err := s.Put(ctx, img); err != nil {
 		return fmt.Errorf("error putting image: %w", err)
 	}
 	if err := s.Tag(ctx, img.Descriptor().Digest.String(), ref); err != nil {
 		return fmt.Errorf("error tagging image with ref %s: %w", ref, err)
 	}
+	if err := s.layout.RefreshPartial(ctx, img.Descriptor().Digest); err != nil {
+		return fmt.Errorf("error updating partial state: %w", err)
+	}
+	if err := s.layout.RecordSizes(ctx, img.Descriptor().Digest); err != nil {
+		return fmt.Errorf("error recording blob sizes: %w", err)
+	}
+	return nil
+}
+
+// PullOptions are options for pulling an image into the store.
+type PullOptions struct {
+	// Processors are the processors transforming layers while they are written, see layout.Layout.ProcessImage.
+	Processors []processor.LayerProcessor
+	// ProcessOptions are options for processing layers, e.g. layout.WithSkipOriginals.
+	ProcessOptions []layout.ProcessOption
+	// LayerPriority orders the transfer of the blobs, see layout.PrioritizeLayers. Defaults to
+	// onmetalimage.LayerPriority.
+	LayerPriority layout.LayerPriority
+	// ContinueOnError writes the remaining blobs if one fails, see layout.ContinueOnError.
+	ContinueOnError bool
+}
+
+// PullOption is an option for pulling an image into the store.
+type PullOption func(o *PullOptions)
+
+// WithLayerProcessors adds processors transforming matching layers while they are written.
+func WithLayerProcessors(processors ...processor.LayerProcessor) PullOption {
+	return func(o *PullOptions) {
+		o.Processors = append(o.Processors, processors...)
+	}
+}
+
+// WithProcessOptions adds options for processing layers.
+func WithProcessOptions(opts ...layout.ProcessOption) PullOption {
+	return func(o *PullOptions) {
+		o.ProcessOptions = append(o.ProcessOptions, opts...)
+	}
+}
+
+// WithLayerPriority orders the transfer of the blobs by the given priority instead of the default.
+func WithLayerPriority(priority layout.LayerPriority) PullOption {
+	return func(o *PullOptions) {
+		o.LayerPriority = priority
+	}
+}
+
+// WithContinueOnError keeps writing the other blobs of the image if one fails, so pulling it again only
+// transfers the failed ones. The returned error names every failed blob, see layout.ContinueOnError.
+func WithContinueOnError() PullOption {
+	return func(o *PullOptions) {
+		o.ContinueOnError = true
+	}
+}
+
+// Pull stores the image and tags it with ref like Push, running the given layer processors on the way.
+// The processed blobs are linked to the original layers on the index entries, see layout.ProcessedLayers.
+// The blobs are transferred in the order of the layer priority, see WithLayerPriority.
+func (s *Store) Pull(ctx context.Context, ref string, img image.Image, opts ...PullOption) error {
+	o := &PullOptions{LayerPriority: onmetalimage.LayerPriority}
+	for _, opt := range opts {
+		opt(o)
+	}
+	ctx = ocicontent.WithIngestSource(ctx, ref)
+	continuing := func(img image.Image) image.Image {
+		if o.ContinueOnError {
+			return layout.ContinueOnError(img)
+		}
+		return img
+	}
+	if len(o.Processors) == 0 {
+		return s.Push(ctx, ref, continuing(layout.PrioritizeLayers(img, o.LayerPriority)))
+	}
+
+	processedImg, processed, err := s.layout.ProcessImage(ctx, layout.PrioritizeLayers(img, o.LayerPriority), o.Processors, o.ProcessOptions...)
+	if err != nil {
+		return fmt.Errorf("error processing layers: %w", err)
+	}
+	if err := s.Push(ctx, ref, continuing(processedImg)); err != nil {
+		return err
+	}
+	if err := s.layout.RecordProcessed(ctx, img.Descriptor().Digest, processed); err != nil {
+		return fmt.Errorf("error recording processed layers: %w", err)
+	}
+	return nil
+}
+
+// PushMetadata stores only the manifest and config of the image and tags it with ref.
+// Unless all its layers are already present, the image is marked partial (see layout.PartialAnnotation);
+// pushing the full image later completes it.
+func (s *Store) PushMetadata(ctx context.Context, ref string, img image.Image) error {
+	return s.Push(ctx, ref, layout.MetadataOnly(img))
+}
+
+// PushIndex stores only the image index blob and tags it with ref. Its children are not stored, e.g.
+// because they only exist remotely, so the index is not an image of the store and cannot be resolved
+// as one.
+func (s *Store) PushIndex(ctx context.Context, ref string, index image.Layer) error {
+	named, err := s.parser.ParseNamed(ref)
+	if err != nil {
+		return fmt.Errorf("ref has to be a named reference: %w", err)
+	}
+	ref = named.String()
+
+	desc := index.Descriptor()
+	if !ocicontent.Exists(ctx, s.layout.Store(), desc) {
+		if err := ocicontent.WriteLayerToIngester(ctx, s.layout.Store(), index); err != nil {
+			return fmt.Errorf("error writing index %s: %w", desc.Digest, err)
+		}
+	}
+
+	entry := ocispec.Descriptor{
+		MediaType: desc.MediaType,
+		Digest:    desc.Digest,
+		Size:      desc.Size,
+		Annotations: map[string]string{
+			ocispec.AnnotationRefName: ref,
+		},
+	}
+	ctx = layout.WithAuditOperation(ctx, layout.AuditAdd, ref)
+	if err := s.layout.Indexer().Replace(ctx, entry, s.nameMatcher(ref)); err != nil {
+		return fmt.Errorf("error indexing index %s: %w", desc.Digest, err)
+	}
 	return nil
 }
 
+// PushAll writes the image to all destination stores at once and tags it with ref in each of them, see
+// layout.WriteImage. The image is only indexed in a store after all its blobs were written to it.
+// The returned results correspond to dests and are named by store path.
+func PushAll(ctx context.Context, ref string, img image.Image, dests ...*Store) []batch.Result {
+	layouts := make([]*layout.Layout, len(dests))
+	for i, dest := range dests {
+		layouts[i] = dest.layout
+	}
+	ctx = ocicontent.WithIngestSource(ctx, ref)
+
+	results := layout.WriteImage(ctx, img, layouts...)
+	for i, dest := range dests {
+		if results[i].Err != nil {
+			continue
+		}
+		if err := dest.Push(ctx, ref, img); err != nil {
+			results[i].Err = err
+		}
+	}
+	return results
+}
+
+// nameMatcher matches the index entries tagged with the given normalized name. Entries written before
+// reference names were normalized carry the name as given, e.g. my-image:latest, so entries whose name
+// normalizes to the given one match as well. Tagging such entries again replaces them with normalized ones.
+func (s *Store) nameMatcher(name string) descriptormatcher.Matcher {
+	return func(desc ocispec.Descriptor) bool {
+		stored, ok := desc.Annotations[ocispec.AnnotationRefName]
+		if !ok {
+			return false
+		}
+		if stored == name {
+			return true
+		}
+		named, err := s.parser.ParseNamed(stored)
+		return err == nil && named.String() == name
+	}
+}
+
 func (s *Store) referenceToMatcher(ref string) (descriptormatcher.Matcher, error) {
-	r, err := reference.ParseAnyReference(ref)
+	r, err := s.parser.ParseAny(ref)
 	if err != nil {
 		return nil, fmt.Errorf("invalid ref: %w", err)
 	}
@@ -66,7 +261,7 @@ func (s *Store) referenceToMatcher(ref string) (descriptormatcher.Matcher, error
 			name = fmt.Sprintf("%s:%s", name, tagged.Tag())
 		}
 
-		matchers = append(matchers, descriptormatcher.Name(name))
+		matchers = append(matchers, s.nameMatcher(name))
 	}
 
 	if len(matchers) == 0 {
@@ -81,6 +276,7 @@ func (s *Store) Delete(ctx context.Context, ref string) error {
 		return err
 	}
 
+	ctx = layout.WithAuditOperation(ctx, layout.AuditDelete, ref)
 	if err := s.layout.Indexer().Delete(ctx, match); err != nil {
 		return fmt.Errorf("error deleting ref %s from indexer: %w", ref, err)
 	}
@@ -100,6 +296,11 @@ func (s *Store) resolveDescriptor(ctx context.Context, ref string) (ocispec.Desc
 	return desc, nil
 }
 
+// Descriptor returns the index entry the ref resolves to without recording an access of the image.
+func (s *Store) Descriptor(ctx context.Context, ref string) (ocispec.Descriptor, error) {
+	return s.resolveDescriptor(ctx, ref)
+}
+
 func (s *Store) Resolve(ctx context.Context, ref string) (image.Image, error) {
 	desc, err := s.resolveDescriptor(ctx, ref)
 	if err != nil {
@@ -110,9 +311,11 @@ func (s *Store) Resolve(ctx context.Context, ref string) (image.Image, error) {
 }
 
 func (s *Store) Tag(ctx context.Context, srcRef, dstRef string) error {
-	if _, err := reference.ParseNamed(dstRef); err != nil {
+	dst, err := s.parser.ParseNamed(dstRef)
+	if err != nil {
 		return fmt.Errorf("destination has to be a named reference: %w", err)
 	}
+	dstRef = dst.String()
 
 	srcDesc, err := s.resolveDescriptor(ctx, srcRef)
 	if err != nil {
@@ -120,26 +323,87 @@ func (s *Store) Tag(ctx context.Context, srcRef, dstRef string) error {
 	}
 
 	dstDesc := ocispec.Descriptor{
-		MediaType: srcDesc.MediaType,
-		Digest:    srcDesc.Digest,
-		Size:      srcDesc.Size,
-		Platform:  srcDesc.Platform,
+		MediaType:    srcDesc.MediaType,
+		ArtifactType: srcDesc.ArtifactType,
+		Digest:       srcDesc.Digest,
+		Size:         srcDesc.Size,
+		Platform:     srcDesc.Platform,
 		Annotations: map[string]string{
 			ocispec.AnnotationRefName: dstRef,
 		},
 	}
 
-	if err := s.layout.Indexer().Replace(ctx, dstDesc, descriptormatcher.Name(dstRef)); err != nil {
+	ctx = layout.WithAuditOperation(ctx, layout.AuditTag, dstRef)
+	if err := s.layout.Indexer().Replace(ctx, dstDesc, s.nameMatcher(dstRef)); err != nil {
 		return fmt.Errorf("error indexing ref descriptor: %w", err)
 	}
 	return nil
 }
 
+// Annotate sets and removes annotations on all index entries matching the reference.
+// The reference name annotation cannot be edited this way, use Tag and Untag instead.
+func (s *Store) Annotate(ctx context.Context, ref string, set map[string]string, remove []string) error {
+	if _, ok := set[ocispec.AnnotationRefName]; ok {
+		return fmt.Errorf("cannot set annotation %s, use tag instead", ocispec.AnnotationRefName)
+	}
+	for _, key := range remove {
+		if key == ocispec.AnnotationRefName {
+			return fmt.Errorf("cannot remove annotation %s, use untag instead", ocispec.AnnotationRefName)
+		}
+	}
+
+	match, err := s.referenceToMatcher(ref)
+	if err != nil {
+		return err
+	}
+
+	ctx = layout.WithAuditOperation(ctx, annotateOperation(set, remove), ref)
+	var matched int
+	if err := s.layout.Indexer().Update(ctx, match, func(desc ocispec.Descriptor) ocispec.Descriptor {
+		matched++
+		for k, v := range set {
+			desc = indexer.WithAnnotation(desc, k, v)
+		}
+		if len(remove) > 0 {
+			annotations := make(map[string]string, len(desc.Annotations))
+			for k, v := range desc.Annotations {
+				annotations[k] = v
+			}
+			for _, k := range remove {
+				delete(annotations, k)
+			}
+			desc.Annotations = annotations
+		}
+		return desc
+	}); err != nil {
+		return fmt.Errorf("error updating index entries: %w", err)
+	}
+	if matched == 0 {
+		return fmt.Errorf("%w: no index entry for ref %s", indexer.ErrNotFound, ref)
+	}
+	return nil
+}
+
+// annotateOperation returns the audit operation of Annotate, recording only pinning or only unpinning
+// images as such.
+func annotateOperation(set map[string]string, remove []string) layout.AuditOperation {
+	switch {
+	case len(set) == 1 && set[layout.PinnedAnnotation] == "true" && len(remove) == 0:
+		return layout.AuditPin
+	case len(set) == 0 && len(remove) == 1 && remove[0] == layout.PinnedAnnotation:
+		return layout.AuditUnpin
+	default:
+		return layout.AuditAnnotate
+	}
+}
+
 func (s *Store) Untag(ctx context.Context, ref string) error {
-	if _, err := reference.ParseNamed(ref); err != nil {
+	named, err := s.parser.ParseNamed(ref)
+	if err != nil {
 		return fmt.Errorf("ref has to be a named reference: %w", err)
 	}
-	if err := s.layout.Indexer().Delete(ctx, descriptormatcher.Name(ref)); err != nil {
+	ctx = layout.WithAuditOperation(ctx, layout.AuditUntag, named.String())
+	if err := s.layout.Indexer().Delete(ctx, s.nameMatcher(named.String())); err != nil {
 		return fmt.Errorf("error removing index entries: %w", err)
 	}
 	return nil
@@ -149,10 +413,23 @@ func (s *Store) Layout() *layout.Layout {
 	return s.layout
 }
 
-func New(path string) (*Store, error) {
-	l, err := layout.New(path)
+// Parser returns the parser the store normalizes references with.
+func (s *Store) Parser() ref.Parser {
+	return s.parser
+}
+
+func New(path string, opts ...Option) (*Store, error) {
+	o := &Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	l, err := layout.New(path, o.LayoutOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("could not created oci layout: %w", err)
 	}
-	return &Store{layout: l}, nil
+	return &Store{
+		layout: l,
+		parser: ref.Parser{DefaultRegistry: o.DefaultRegistry},
+	}, nil
 }
@@ -0,0 +1,469 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	ocicontent "github.com/onmetal/onmetal-image/oci/content"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/oci/processor"
+	. "github.com/onmetal/onmetal-image/oci/store"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	"github.com/onmetal/onmetal-image/utils/sets"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// unsizedLayer is a layer whose descriptor has no size information, as written by some legacy tools.
+// If corrupt is set, its content does not match its digest.
+type unsizedLayer struct {
+	ociimage.Layer
+	corrupt bool
+}
+
+func (l unsizedLayer) Descriptor() ocispec.Descriptor {
+	desc := l.Layer.Descriptor()
+	desc.Size = 0
+	return desc
+}
+
+func (l unsizedLayer) Content(ctx context.Context) (io.ReadCloser, error) {
+	if l.corrupt {
+		return io.NopCloser(bytes.NewReader([]byte("corrupt"))), nil
+	}
+	return l.Layer.Content(ctx)
+}
+
+var _ = Describe("Store", func() {
+	var (
+		ctx    context.Context
+		store  *Store
+		remote *Store
+	)
+
+	newImage := func(name string) ociimage.Image {
+		img, err := imageutil.NewBytesConfigBuilder([]byte(name), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer([]byte(name+"-layer"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		s, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		store = s
+
+		r, err := New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		remote = r
+	})
+
+	pull := func(ref string) {
+		_, err := ociimage.Copy(ctx, store, remote, ref)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("should resolve, tag, untag and delete entries with names written before normalization", func() {
+		img := newImage("legacy")
+		Expect(store.Put(ctx, img)).To(Succeed())
+
+		By("rewriting the index like older releases wrote it, with the names as given")
+		indexPath := filepath.Join(store.Layout().Path(), indexer.Filename)
+		data, err := os.ReadFile(indexPath)
+		Expect(err).NotTo(HaveOccurred())
+		index := &ocispec.Index{}
+		Expect(json.Unmarshal(data, index)).To(Succeed())
+		Expect(index.Manifests).To(HaveLen(1))
+		unnamed := index.Manifests[0]
+		for _, name := range []string{"my-image:latest", "my-image:old", "example.org/Other:v1"} {
+			entry := unnamed
+			entry.Annotations = map[string]string{ocispec.AnnotationRefName: name}
+			index.Manifests = append(index.Manifests, entry)
+		}
+		data, err = json.Marshal(index)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(indexPath, data, 0666)).To(Succeed())
+
+		s, err := New(store.Layout().Path())
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, ref := range []string{"my-image", "my-image:latest", "docker.io/library/my-image:latest", "example.org/other:v1"} {
+			resolved, err := s.Resolve(ctx, ref)
+			Expect(err).NotTo(HaveOccurred(), ref)
+			Expect(resolved.Descriptor().Digest).To(Equal(img.Descriptor().Digest))
+		}
+
+		names := func() []string {
+			descs, err := s.Layout().Indexer().List(ctx, descriptormatcher.HasAnnotation(ocispec.AnnotationRefName))
+			Expect(err).NotTo(HaveOccurred())
+			var names []string
+			for _, desc := range descs {
+				names = append(names, desc.Annotations[ocispec.AnnotationRefName])
+			}
+			return names
+		}
+
+		By("replacing the legacy entry when tagging the same name again")
+		Expect(s.Tag(ctx, img.Descriptor().Digest.String(), "my-image:latest")).To(Succeed())
+		Expect(names()).To(ConsistOf("docker.io/library/my-image:latest", "my-image:old", "example.org/Other:v1"))
+
+		Expect(s.Untag(ctx, "my-image:old")).To(Succeed())
+		Expect(s.Delete(ctx, "example.org/other:v1")).To(Succeed())
+		Expect(names()).To(ConsistOf("docker.io/library/my-image:latest"))
+	})
+
+	It("should keep the tag and its annotations across pull-update cycles", func() {
+		const ref = "example.org/foo:latest"
+		first, second := newImage("first"), newImage("second")
+
+		By("pulling the first image and pinning it")
+		Expect(remote.Push(ctx, ref, first)).To(Succeed())
+		pull(ref)
+		Expect(store.Layout().Indexer().Update(ctx, descriptormatcher.Name(ref), func(desc ocispec.Descriptor) ocispec.Descriptor {
+			return indexer.WithAnnotation(desc, layout.PinnedAnnotation, "true")
+		})).To(Succeed())
+
+		By("pulling the same image again")
+		pull(ref)
+
+		By("pulling an updated image")
+		Expect(remote.Push(ctx, ref, second)).To(Succeed())
+		pull(ref)
+
+		img, err := store.Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(img.Descriptor().Digest).To(Equal(second.Descriptor().Digest))
+		Expect(layout.IsPinned(img.Descriptor())).To(BeTrue())
+
+		descs, err := store.Layout().Indexer().List(ctx, descriptormatcher.Name(ref))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(descs).To(HaveLen(1))
+	})
+
+	It("should keep index annotations set via Annotate across pulls", func() {
+		const (
+			ref     = "example.org/foo:latest"
+			channel = "example.org/channel"
+		)
+		first, second := newImage("first"), newImage("second")
+		Expect(remote.Push(ctx, ref, first)).To(Succeed())
+		pull(ref)
+
+		Expect(store.Annotate(ctx, ref, map[string]string{channel: "stable", "example.org/remove": "me"}, nil)).To(Succeed())
+		Expect(store.Annotate(ctx, ref, nil, []string{"example.org/remove"})).To(Succeed())
+		Expect(store.Annotate(ctx, ref, map[string]string{ocispec.AnnotationRefName: "other"}, nil)).NotTo(Succeed())
+
+		Expect(remote.Push(ctx, ref, second)).To(Succeed())
+		pull(ref)
+
+		desc, err := store.Layout().Indexer().Find(ctx, descriptormatcher.Annotation(channel, "stable"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(desc.Digest).To(Equal(second.Descriptor().Digest))
+		Expect(desc.Annotations).NotTo(HaveKey("example.org/remove"))
+	})
+
+	It("should free the processed blobs of an image once its tag moved and it is pruned", func() {
+		const ref = "example.org/foo:latest"
+		newRootFSImage := func(seed string) ociimage.Image {
+			img, err := fixtures.Image{
+				Seed:   seed,
+				Layers: []fixtures.Layer{{Role: "rootfs", Size: 1 << 10, Compression: fixtures.Gzip}},
+			}.Build()
+			Expect(err).NotTo(HaveOccurred())
+			return img
+		}
+		first, second := newRootFSImage("first"), newRootFSImage("second")
+
+		By("pulling the first image with a processor")
+		Expect(store.Pull(ctx, ref, first, WithLayerProcessors(processor.Decompress(onmetalimage.RootFSLayerMediaType)))).To(Succeed())
+		desc, err := store.Layout().Indexer().Find(ctx, descriptormatcher.Name(ref))
+		Expect(err).NotTo(HaveOccurred())
+		layers, err := first.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		decompressed, ok := layout.ProcessedLayers(desc)[layers[0].Descriptor().Digest]
+		Expect(ok).To(BeTrue())
+		Expect(ocicontent.Exists(ctx, store.Layout().Store(), decompressed)).To(BeTrue())
+
+		By("pulling another image to the same tag without one")
+		Expect(store.Pull(ctx, ref, second)).To(Succeed())
+		desc, err = store.Layout().Indexer().Find(ctx, descriptormatcher.Name(ref))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(desc.Digest).To(Equal(second.Descriptor().Digest))
+		Expect(desc.Annotations).NotTo(HaveKey(layout.ProcessedLayersAnnotation))
+
+		By("pruning the first image")
+		results, _, err := store.Layout().PruneUnlisted(ctx, sets.New(second.Descriptor().Digest))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].Err).NotTo(HaveOccurred())
+		Expect(results[0].Digest).To(Equal(first.Descriptor().Digest))
+		Expect(ocicontent.Exists(ctx, store.Layout().Store(), decompressed)).To(BeFalse())
+	})
+
+	It("should record the operations in the audit log", func() {
+		const (
+			ref   = "example.org/foo:latest"
+			other = "example.org/foo:other"
+		)
+		Expect(remote.Push(ctx, ref, newImage("first"))).To(Succeed())
+		pull(ref)
+		Expect(store.Annotate(ctx, ref, map[string]string{layout.PinnedAnnotation: "true"}, nil)).To(Succeed())
+		Expect(store.Tag(ctx, ref, other)).To(Succeed())
+		Expect(store.Untag(ctx, other)).To(Succeed())
+		Expect(store.Delete(ctx, ref)).To(Succeed())
+
+		entries, err := store.Layout().AuditLog(ctx, time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		var (
+			operations []layout.AuditOperation
+			refs       []string
+		)
+		for _, entry := range entries {
+			Expect(entry.Outcome).To(Equal(layout.AuditSucceeded))
+			operations = append(operations, entry.Operation)
+			refs = append(refs, entry.Reference)
+		}
+		Expect(operations).To(Equal([]layout.AuditOperation{
+			layout.AuditAdd, layout.AuditTag, layout.AuditPin, layout.AuditTag, layout.AuditUntag, layout.AuditDelete,
+		}))
+		Expect(refs).To(Equal([]string{ref, ref, ref, other, other, ref}))
+	})
+
+	It("should push an image into multiple stores and tag it in each", func() {
+		const ref = "example.org/foo:latest"
+		img := newImage("fan-out")
+
+		results := PushAll(ctx, ref, img, store, remote)
+		Expect(results).To(HaveLen(2))
+		for i, s := range []*Store{store, remote} {
+			Expect(results[i].Err).NotTo(HaveOccurred())
+			Expect(results[i].Name).To(Equal(s.Layout().Path()))
+
+			resolved, err := s.Resolve(ctx, ref)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved.Descriptor().Digest).To(Equal(img.Descriptor().Digest))
+		}
+	})
+
+	It("should store only the blob of an index and tag it", func() {
+		const ref = "example.org/foo:multi"
+		child := newImage("remote-only")
+		index, err := imageutil.IndexLayer([]ocispec.Descriptor{child.Descriptor()}, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(store.PushIndex(ctx, ref, index)).To(Succeed())
+		desc, err := store.Descriptor(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(desc.MediaType).To(Equal(ocispec.MediaTypeImageIndex))
+		Expect(desc.Digest).To(Equal(index.Descriptor().Digest))
+
+		_, err = store.Layout().Store().Info(ctx, child.Descriptor().Digest)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should pull only the metadata of an image and complete it later", func() {
+		const ref = "example.org/foo:latest"
+		img := newImage("metadata")
+
+		By("pushing only the metadata")
+		Expect(store.PushMetadata(ctx, ref, img)).To(Succeed())
+
+		partial, err := store.Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layout.IsPartial(partial.Descriptor())).To(BeTrue())
+		Expect(partial.Manifest(ctx)).NotTo(BeNil())
+
+		layers, err := partial.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layers).To(HaveLen(1))
+		_, err = layers[0].Content(ctx)
+		Expect(err).To(MatchError(layout.ErrPartialImage))
+
+		By("pruning the partial image")
+		Expect(store.Layout().Indexer().Update(ctx, descriptormatcher.Name(ref), func(desc ocispec.Descriptor) ocispec.Descriptor {
+			return indexer.WithAnnotation(desc, layout.PinnedAnnotation, "true")
+		})).To(Succeed())
+		plan, err := store.Layout().ApplyRetention(ctx, &layout.RetentionPolicy{Rules: []layout.RetentionRule{{KeepLast: 1}}}, time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		results, err := store.Layout().PruneRetention(ctx, plan)
+		Expect(err).NotTo(HaveOccurred())
+		for _, result := range results {
+			Expect(result.Err).NotTo(HaveOccurred())
+		}
+
+		By("pushing the full image")
+		Expect(store.Push(ctx, ref, img)).To(Succeed())
+		complete, err := store.Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layout.IsPartial(complete.Descriptor())).To(BeFalse())
+		layers, err = complete.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imageutil.ReadLayerContent(ctx, layers[0])).To(Equal([]byte("metadata-layer")))
+	})
+
+	It("should prune partial images without treating missing layers as errors", func() {
+		const ref = "example.org/foo:expired"
+		img, err := imageutil.NewBytesConfigBuilder([]byte("expired"), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer([]byte("expired-layer"), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Annotations(map[string]string{imageutil.ExpiresAtAnnotation: time.Now().Add(-time.Hour).Format(time.RFC3339)}).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.PushMetadata(ctx, ref, img)).To(Succeed())
+
+		results, err := store.Layout().PruneExpired(ctx, time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].Err).NotTo(HaveOccurred())
+		Expect(results[0].Bytes).To(BeNumerically(">", 0))
+
+		_, err = store.Resolve(ctx, ref)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should derive the platform from the config and keep it across pulls", func() {
+		const ref = "example.org/foo:container"
+		img, err := imageutil.NewJSONConfigBuilder(ocispec.Image{
+			Platform: ocispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		}, imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).Complete()
+		Expect(err).NotTo(HaveOccurred())
+
+		platform, err := imageutil.ConfigPlatform(ctx, img)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(platform).To(Equal(&ocispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}))
+		onmetalImg, err := imageutil.NewJSONConfigBuilder(onmetalimage.Config{}, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).Complete()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imageutil.ConfigPlatform(ctx, onmetalImg)).To(BeNil())
+
+		By("setting the platform on the index entries")
+		Expect(store.Push(ctx, ref, img)).To(Succeed())
+		Expect(store.Layout().Indexer().Update(ctx, descriptormatcher.Digests(img.Descriptor().Digest), func(desc ocispec.Descriptor) ocispec.Descriptor {
+			desc.Platform = platform
+			return desc
+		})).To(Succeed())
+
+		By("pulling the image again")
+		Expect(store.Push(ctx, ref, img)).To(Succeed())
+		descs, err := store.Layout().Indexer().List(ctx, descriptormatcher.Digests(img.Descriptor().Digest))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(descs).To(HaveLen(2))
+		for _, desc := range descs {
+			Expect(desc.Platform).To(Equal(platform))
+		}
+	})
+
+	Context("legacy images without blob sizes", func() {
+		const ref = "example.org/foo:legacy"
+		content := []byte("legacy-layer")
+
+		newLegacyImage := func(corrupt bool) ociimage.Image {
+			img, err := imageutil.NewBytesConfigBuilder([]byte("legacy"), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+				Layers(unsizedLayer{imageutil.BytesLayer(content, imageutil.WithMediaType(ocispec.MediaTypeImageLayer)), corrupt}).
+				Complete()
+			Expect(err).NotTo(HaveOccurred())
+			return img
+		}
+
+		It("should detect the missing sizes", func() {
+			Expect(imageutil.CheckSizes(ctx, newLegacyImage(false))).To(MatchError(imageutil.ErrUnknownSize))
+			Expect(imageutil.CheckSizes(ctx, newImage("sized"))).To(Succeed())
+		})
+
+		It("should store the image and record the actual sizes", func() {
+			img := newLegacyImage(false)
+			Expect(store.Push(ctx, ref, img)).To(Succeed())
+
+			stored, err := store.Resolve(ctx, ref)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(layout.IsPartial(stored.Descriptor())).To(BeFalse())
+			Expect(layout.BlobSizes(stored.Descriptor())).To(HaveLen(1))
+
+			layers, err := stored.Layers(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(layers[0].Descriptor().Size).To(Equal(int64(len(content))))
+			Expect(imageutil.ReadLayerContent(ctx, layers[0])).To(Equal(content))
+
+			By("storing the image again")
+			Expect(store.Push(ctx, ref, img)).To(Succeed())
+			Expect(store.Layout().Indexer().List(ctx, descriptormatcher.Name(ref))).To(HaveLen(1))
+		})
+
+		It("should still verify the digests", func() {
+			Expect(store.Push(ctx, ref, newLegacyImage(true))).NotTo(Succeed())
+
+			By("writing the image to multiple stores at once")
+			for _, result := range PushAll(ctx, ref, newLegacyImage(true), store, remote) {
+				Expect(result.Err).To(HaveOccurred())
+			}
+			for _, result := range PushAll(ctx, ref, newLegacyImage(false), store, remote) {
+				Expect(result.Err).NotTo(HaveOccurred())
+				Expect(result.Bytes).To(BeNumerically(">=", len(content)))
+			}
+		})
+	})
+
+	It("should pull artifacts and keep their artifact type", func() {
+		const (
+			ref          = "example.org/ignition:latest"
+			artifactType = "application/vnd.onmetal.ignition.v1"
+		)
+		artifact, err := imageutil.NewArtifactBuilder(artifactType).
+			BytesLayer([]byte(`{"ignition":{}}`), imageutil.WithMediaType("application/octet-stream")).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(artifact.Descriptor().ArtifactType).To(Equal(artifactType))
+
+		Expect(remote.Push(ctx, ref, artifact)).To(Succeed())
+		pull(ref)
+
+		img, err := store.Resolve(ctx, ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(img.Descriptor().ArtifactType).To(Equal(artifactType))
+
+		manifest, err := img.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imageutil.IsArtifact(manifest)).To(BeTrue())
+		Expect(manifest.Config.MediaType).To(Equal(ocispec.MediaTypeEmptyJSON))
+
+		layers, err := img.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layers).To(HaveLen(1))
+		Expect(imageutil.ReadLayerContent(ctx, layers[0])).To(Equal([]byte(`{"ignition":{}}`)))
+
+		By("annotating the manifest")
+		annotated, err := imageutil.WithManifestAnnotations(ctx, img, map[string]string{"foo": "bar"})
+		Expect(err).NotTo(HaveOccurred())
+		annotatedManifest, err := annotated.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(annotatedManifest.ArtifactType).To(Equal(artifactType))
+	})
+})
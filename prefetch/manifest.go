@@ -0,0 +1,105 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package prefetch keeps the images listed in a manifest pulled into a store, e.g. to warm the image
+// cache of hypervisors at night, within a time window and optionally with throttled bandwidth.
+package prefetch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/containerd/containerd/platforms"
+	"gopkg.in/yaml.v3"
+)
+
+// Image is an image listed in a Manifest.
+type Image struct {
+	// Ref is the reference of the image, resolved at its registry on every cycle.
+	Ref string `yaml:"ref" json:"ref"`
+	// Platform restricts prefetching the image to hosts of the platform (e.g. linux/arm64). If empty,
+	// the image is prefetched on all hosts.
+	Platform string `yaml:"platform,omitempty" json:"platform,omitempty"`
+	// Priority orders prefetching, images with a higher priority are pulled first.
+	Priority int `yaml:"priority,omitempty" json:"priority,omitempty"`
+}
+
+// Manifest lists the images to prefetch.
+type Manifest struct {
+	Images []Image `yaml:"images"`
+}
+
+// Validate checks that all images have a reference and a valid platform, if any.
+func (m *Manifest) Validate() error {
+	for i, img := range m.Images {
+		if img.Ref == "" {
+			return fmt.Errorf("image %d: ref must not be empty", i)
+		}
+		if img.Platform != "" {
+			if _, err := platforms.Parse(img.Platform); err != nil {
+				return fmt.Errorf("image %s: invalid platform %q: %w", img.Ref, img.Platform, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseManifest parses and validates a Manifest in YAML format. Unknown fields are rejected.
+func ParseManifest(data []byte) (*Manifest, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	m := &Manifest{}
+	if err := dec.Decode(m); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error decoding prefetch manifest: %w", err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReadManifest reads and parses the manifest file at path.
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading prefetch manifest: %w", err)
+	}
+	m, err := ParseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefetch manifest %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// images returns the images to prefetch on hosts matching the platform matcher, by descending priority.
+func (m *Manifest) images(matcher platforms.Matcher) []Image {
+	var res []Image
+	for _, img := range m.Images {
+		if img.Platform != "" {
+			// The platform was validated when parsing the manifest.
+			p, _ := platforms.Parse(img.Platform)
+			if !matcher.Match(p) {
+				continue
+			}
+		}
+		res = append(res, img)
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Priority > res[j].Priority })
+	return res
+}
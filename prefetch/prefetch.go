@@ -0,0 +1,268 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prefetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/go-logr/logr"
+	"github.com/onmetal/onmetal-image/batch"
+	"github.com/onmetal/onmetal-image/client"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/opencontainers/go-digest"
+)
+
+// DefaultInterval is the time between the starts of two cycles without a window.
+const DefaultInterval = 24 * time.Hour
+
+// Options are options for a Prefetcher.
+type Options struct {
+	// Window restricts the cycles to a daily time window, one cycle per window. Pulls still running
+	// when it closes are aborted, leaving their ingests to be resumed by the next cycle. If nil, cycles
+	// start every Interval.
+	Window *Window
+	// Interval is the time between the starts of two cycles without Window. Defaults to DefaultInterval.
+	Interval time.Duration
+	// RetentionPolicy is applied to the store after every cycle, see layout.Layout.ApplyRetention.
+	// If nil, nothing is removed.
+	RetentionPolicy *layout.RetentionPolicy
+	// Platform matches the platforms of the images prefetched on the host. Defaults to platforms.Default().
+	Platform platforms.Matcher
+}
+
+// Prefetcher pulls the images of a Manifest into the store of a client on every cycle whose digest
+// changed at their registry. Its Status can be queried while it runs.
+type Prefetcher struct {
+	client   *client.Client
+	manifest *Manifest
+	opts     Options
+
+	mu     sync.Mutex
+	status Status
+}
+
+// New returns a new Prefetcher for the images of the manifest.
+func New(c *client.Client, manifest *Manifest, opts Options) *Prefetcher {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	if opts.Platform == nil {
+		opts.Platform = platforms.Default()
+	}
+	p := &Prefetcher{client: c, manifest: manifest, opts: opts, status: Status{State: StateIdle}}
+	if opts.Window != nil {
+		p.status.Window = opts.Window.String()
+	}
+	return p
+}
+
+// RunOnce waits for the window to open, if any, and runs a single cycle in it. It returns the error of
+// the cycle, or nil if ctx is done before.
+func (p *Prefetcher) RunOnce(ctx context.Context) error {
+	_, err := p.run(ctx, time.Now())
+	return err
+}
+
+// Run runs cycles until ctx is done, once per window or every Interval. Errors of a cycle are logged
+// and retried by the next one. Canceling ctx stops a cycle mid-transfer, leaving the ingests of the
+// blobs being pulled to be resumed. It returns nil when ctx is done.
+func (p *Prefetcher) Run(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx)
+	next := time.Now()
+	for ctx.Err() == nil {
+		var err error
+		next, err = p.run(ctx, next)
+		if err != nil {
+			log.Error(err, "Error prefetching images")
+		}
+	}
+	return nil
+}
+
+// run waits for the first cycle starting at or after the given time, runs it and returns the time to
+// look for the next cycle from.
+func (p *Prefetcher) run(ctx context.Context, from time.Time) (time.Time, error) {
+	start, end := from, time.Time{}
+	if p.opts.Window != nil {
+		start, end = p.opts.Window.Next(from)
+	}
+	p.update(func(s *Status) {
+		s.State = StateIdle
+		s.NextCycle = timePtr(start)
+	})
+	if !sleepUntil(ctx, start) {
+		p.update(func(s *Status) { s.State = StateStopped })
+		return start, nil
+	}
+
+	cycleStart := time.Now()
+	err := p.cycle(ctx, end)
+	if ctx.Err() != nil {
+		p.update(func(s *Status) { s.State = StateStopped })
+		return start, nil
+	}
+	if !end.IsZero() {
+		return end, err
+	}
+	return cycleStart.Add(p.opts.Interval), err
+}
+
+// sleepUntil waits until t, returning false if ctx is done before.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Cycle resolves all images of the manifest for the platform of the host at their registry, by
+// descending priority, and pulls those whose digest is not in the store yet. The retention policy
+// is applied afterwards. The returned error joins the errors of all images that failed.
+func (p *Prefetcher) Cycle(ctx context.Context) error {
+	return p.cycle(ctx, time.Time{})
+}
+
+// cycle runs a cycle like Cycle, deferring the images not pulled by end to the next cycle, if set.
+func (p *Prefetcher) cycle(ctx context.Context, end time.Time) error {
+	pullCtx := ctx
+	if !end.IsZero() {
+		var cancel context.CancelFunc
+		pullCtx, cancel = context.WithDeadline(ctx, end)
+		defer cancel()
+	}
+
+	images := p.manifest.images(p.opts.Platform)
+	p.update(func(s *Status) {
+		s.State = StateRunning
+		s.CycleStarted = timePtr(time.Now())
+		s.CycleFinished = nil
+		s.NextCycle = nil
+		s.Pruned = nil
+		s.Images = make([]ImageStatus, len(images))
+		for i, img := range images {
+			s.Images[i] = ImageStatus{Image: img, State: ImageStatePending}
+		}
+	})
+
+	var results []batch.Result
+	for i, img := range images {
+		if pullCtx.Err() != nil {
+			p.updateImage(i, func(s *ImageStatus) { s.State = ImageStateDeferred })
+			continue
+		}
+		dgst, err := p.prefetch(pullCtx, i, img.Ref)
+		results = append(results, batch.Result{Name: img.Ref, Digest: dgst, Err: err})
+	}
+
+	var errs []error
+	if err := batch.Err(results); err != nil {
+		errs = append(errs, err)
+	}
+	// Pruning is quick, so it is not bound to the window.
+	if p.opts.RetentionPolicy != nil && ctx.Err() == nil {
+		if err := p.prune(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	p.update(func(s *Status) {
+		s.State = StateIdle
+		s.CycleFinished = timePtr(time.Now())
+	})
+	return errors.Join(errs...)
+}
+
+// prefetch pulls the image with the given reference unless its digest at the registry is already in
+// the store, updating the status of the i-th image.
+func (p *Prefetcher) prefetch(ctx context.Context, i int, ref string) (digest.Digest, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("Ref", ref)
+
+	p.updateImage(i, func(s *ImageStatus) { s.State = ImageStateResolving })
+	img, err := p.client.ResolveRemote(ctx, ref)
+	if err != nil {
+		return "", p.fail(ctx, i, err)
+	}
+	dgst := img.Descriptor().Digest
+	p.updateImage(i, func(s *ImageStatus) { s.Digest = dgst })
+
+	if desc, err := p.client.Store().Descriptor(ctx, ref); err == nil && desc.Digest == dgst && !layout.IsPartial(desc) {
+		p.updateImage(i, func(s *ImageStatus) { s.State = ImageStateUpToDate })
+		return dgst, nil
+	}
+
+	log.Info("Prefetching image", "Digest", dgst)
+	p.updateImage(i, func(s *ImageStatus) { s.State = ImageStatePulling })
+	if _, err := p.client.Pull(progress.NewContext(ctx, p.tracker(i)), ref); err != nil {
+		return dgst, p.fail(ctx, i, err)
+	}
+	p.updateImage(i, func(s *ImageStatus) { s.State = ImageStatePulled })
+	return dgst, nil
+}
+
+// fail records the error of the i-th image. Images interrupted by the end of the window or by stopping
+// are deferred instead, their error is not returned.
+func (p *Prefetcher) fail(ctx context.Context, i int, err error) error {
+	if ctx.Err() != nil {
+		p.updateImage(i, func(s *ImageStatus) { s.State = ImageStateDeferred })
+		return nil
+	}
+	p.updateImage(i, func(s *ImageStatus) {
+		s.State = ImageStateFailed
+		s.Error = err.Error()
+	})
+	return err
+}
+
+func (p *Prefetcher) prune(ctx context.Context) error {
+	l := p.client.Store().Layout()
+	plan, err := l.ApplyRetention(ctx, p.opts.RetentionPolicy, time.Now())
+	if err != nil {
+		return fmt.Errorf("error applying retention policy: %w", err)
+	}
+	results, err := l.PruneRetention(ctx, plan)
+	if err != nil {
+		return fmt.Errorf("error pruning images: %w", err)
+	}
+
+	pruned := &PruneStatus{}
+	for _, result := range results {
+		if result.Err == nil {
+			pruned.Images++
+			pruned.Bytes += result.Bytes
+		}
+	}
+	p.update(func(s *Status) { s.Pruned = pruned })
+	if err := batch.Err(results); err != nil {
+		return fmt.Errorf("error pruning images: %w", err)
+	}
+	return nil
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
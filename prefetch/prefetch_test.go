@@ -0,0 +1,220 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prefetch_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/onmetal/onmetal-image/client"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	. "github.com/onmetal/onmetal-image/prefetch"
+	"github.com/onmetal/onmetal-image/testing/fixtures"
+	"github.com/onmetal/onmetal-image/testing/registryharness"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Manifest", func() {
+	It("should parse the images to prefetch", func() {
+		m, err := ParseManifest([]byte(`
+images:
+  - ref: ghcr.io/onmetal/gardenlinux:v1
+    platform: linux/amd64
+    priority: 10
+  - ref: ghcr.io/onmetal/gardenlinux:v2
+`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.Images).To(Equal([]Image{
+			{Ref: "ghcr.io/onmetal/gardenlinux:v1", Platform: "linux/amd64", Priority: 10},
+			{Ref: "ghcr.io/onmetal/gardenlinux:v2"},
+		}))
+	})
+
+	It("should reject images without ref, invalid platforms and unknown fields", func() {
+		_, err := ParseManifest([]byte("images:\n  - priority: 1\n"))
+		Expect(err).To(MatchError(ContainSubstring("ref must not be empty")))
+		_, err = ParseManifest([]byte("images:\n  - ref: foo\n    platform: linux/amd64/v8/x\n"))
+		Expect(err).To(MatchError(ContainSubstring("invalid platform")))
+		_, err = ParseManifest([]byte("images:\n  - ref: foo\n    tag: bar\n"))
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Window", func() {
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2023, time.May, day, hour, minute, 0, 0, time.Local)
+	}
+
+	It("should parse and format windows", func() {
+		w, err := ParseWindow("02:00-05:30")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(w).To(Equal(Window{Start: 120, End: 330}))
+		Expect(w.String()).To(Equal("02:00-05:30"))
+
+		for _, s := range []string{"02:00", "2-5", "02:00-02:00", "25:00-05:00"} {
+			_, err := ParseWindow(s)
+			Expect(err).To(HaveOccurred(), s)
+		}
+	})
+
+	DescribeTable("Next",
+		func(window string, t, expectedStart, expectedEnd time.Time) {
+			w, err := ParseWindow(window)
+			Expect(err).NotTo(HaveOccurred())
+			start, end := w.Next(t)
+			Expect(start).To(Equal(expectedStart))
+			Expect(end).To(Equal(expectedEnd))
+		},
+		Entry("before the window", "02:00-05:00", at(10, 1, 0), at(10, 2, 0), at(10, 5, 0)),
+		Entry("in the window", "02:00-05:00", at(10, 3, 0), at(10, 2, 0), at(10, 5, 0)),
+		Entry("after the window", "02:00-05:00", at(10, 5, 0), at(11, 2, 0), at(11, 5, 0)),
+		Entry("spanning midnight, after midnight", "22:00-04:00", at(10, 1, 0), at(9, 22, 0), at(10, 4, 0)),
+		Entry("spanning midnight, before midnight", "22:00-04:00", at(10, 23, 0), at(10, 22, 0), at(11, 4, 0)),
+		Entry("spanning midnight, before the window", "22:00-04:00", at(10, 12, 0), at(10, 22, 0), at(11, 4, 0)),
+	)
+})
+
+var _ = Describe("Prefetcher", func() {
+	var (
+		ctx     = context.Background()
+		harness *registryharness.Registry
+		c       *client.Client
+	)
+
+	BeforeEach(func() {
+		harness = registryharness.New()
+		DeferCleanup(harness.Close)
+
+		configPath := filepath.Join(GinkgoT().TempDir(), "config.json")
+		Expect(os.WriteFile(configPath, []byte("{}"), 0666)).To(Succeed())
+		var err error
+		c, err = client.New(client.Config{StorePath: GinkgoT().TempDir(), DockerConfigPaths: []string{configPath}})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	seed := func(repository, tag, rootfs string) ocispec.Descriptor {
+		img, err := fixtures.RootFS(rootfs).Build()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(harness.Seed(ctx, repository, tag, img)).To(Succeed())
+		return img.Descriptor()
+	}
+
+	states := func(p *Prefetcher) []ImageState {
+		var res []ImageState
+		for _, img := range p.Status().Images {
+			res = append(res, img.State)
+		}
+		return res
+	}
+
+	It("should pull new digests by priority and skip images already in the store", func() {
+		first := seed("first", "latest", "first")
+		seed("second", "latest", "second")
+		manifest := &Manifest{Images: []Image{
+			{Ref: harness.Reference("second", "latest")},
+			{Ref: harness.Reference("first", "latest"), Priority: 10},
+			{Ref: harness.Reference("other", "latest"), Platform: "windows/s390x"},
+		}}
+		p := New(c, manifest, Options{Platform: platforms.Only(platforms.MustParse("linux/amd64"))})
+
+		Expect(p.Cycle(ctx)).To(Succeed())
+		status := p.Status()
+		Expect(status.State).To(Equal(StateIdle))
+		Expect(status.Images).To(HaveLen(2))
+		Expect(status.Images[0].Ref).To(Equal(harness.Reference("first", "latest")))
+		Expect(status.Images[0].Digest).To(Equal(first.Digest))
+		Expect(status.Images[0].Bytes).To(BeNumerically(">", 0))
+		Expect(states(p)).To(Equal([]ImageState{ImageStatePulled, ImageStatePulled}))
+
+		By("only pulling changed digests in the next cycle")
+		updated := seed("second", "latest", "updated")
+		Expect(p.Cycle(ctx)).To(Succeed())
+		Expect(states(p)).To(Equal([]ImageState{ImageStateUpToDate, ImageStatePulled}))
+		desc, err := c.Store().Descriptor(ctx, harness.Reference("second", "latest"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(desc.Digest).To(Equal(updated.Digest))
+	})
+
+	It("should report failed images and continue with the others", func() {
+		seed("present", "latest", "present")
+		p := New(c, &Manifest{Images: []Image{
+			{Ref: harness.Reference("missing", "latest")},
+			{Ref: harness.Reference("present", "latest")},
+		}}, Options{})
+
+		Expect(p.Cycle(ctx)).To(MatchError(ContainSubstring("missing")))
+		Expect(states(p)).To(Equal([]ImageState{ImageStateFailed, ImageStatePulled}))
+		Expect(p.Status().Images[0].Error).NotTo(BeEmpty())
+	})
+
+	It("should defer the images when stopped", func() {
+		seed("image", "latest", "image")
+		p := New(c, &Manifest{Images: []Image{{Ref: harness.Reference("image", "latest")}}}, Options{})
+
+		stopped, cancel := context.WithCancel(ctx)
+		cancel()
+		Expect(p.Cycle(stopped)).To(Succeed())
+		Expect(states(p)).To(Equal([]ImageState{ImageStateDeferred}))
+		Expect(harness.Stats().Requests).To(BeZero())
+	})
+
+	It("should apply the retention policy after the cycle", func() {
+		seed("image", "v1", "v1")
+		seed("image", "v2", "v2")
+		policy, err := layout.ParseRetentionPolicy([]byte("rules:\n  - keepLast: 1\n"))
+		Expect(err).NotTo(HaveOccurred())
+		p := New(c, &Manifest{Images: []Image{
+			{Ref: harness.Reference("image", "v1"), Priority: 1},
+			{Ref: harness.Reference("image", "v2")},
+		}}, Options{RetentionPolicy: policy})
+
+		Expect(p.Cycle(ctx)).To(Succeed())
+		Expect(p.Status().Pruned).NotTo(BeNil())
+		Expect(p.Status().Pruned.Images).To(Equal(1))
+	})
+
+	It("should serve the status as JSON", func() {
+		p := New(c, &Manifest{}, Options{Window: &Window{Start: 120, End: 300}})
+		srv := httptest.NewServer(p.Handler())
+		DeferCleanup(srv.Close)
+
+		res, err := srv.Client().Get(srv.URL)
+		Expect(err).NotTo(HaveOccurred())
+		defer func() { _ = res.Body.Close() }()
+		var status Status
+		Expect(json.NewDecoder(res.Body).Decode(&status)).To(Succeed())
+		Expect(status.State).To(Equal(StateIdle))
+		Expect(status.Window).To(Equal("02:00-05:00"))
+	})
+
+	It("should serve the status on a unix socket until stopped", func() {
+		p := New(c, &Manifest{}, Options{})
+		path := filepath.Join(GinkgoT().TempDir(), "prefetch.sock")
+		ctx, cancel := context.WithCancel(ctx)
+		done := make(chan error)
+		go func() { done <- p.ServeStatus(ctx, path) }()
+
+		Eventually(func() error { _, err := os.Stat(path); return err }).Should(Succeed())
+		cancel()
+		Eventually(done).Should(Receive(BeNil()))
+	})
+})
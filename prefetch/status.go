@@ -0,0 +1,203 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prefetch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/onmetal/onmetal-image/progress"
+	"github.com/opencontainers/go-digest"
+)
+
+// State is the state of a Prefetcher.
+type State string
+
+const (
+	// StateIdle is the state while waiting for the next cycle.
+	StateIdle State = "idle"
+	// StateRunning is the state while a cycle runs.
+	StateRunning State = "running"
+	// StateStopped is the state after the Prefetcher was stopped.
+	StateStopped State = "stopped"
+)
+
+// ImageState is the state of an image in a cycle.
+type ImageState string
+
+const (
+	// ImageStatePending is the state of images not processed yet.
+	ImageStatePending ImageState = "pending"
+	// ImageStateResolving is the state while the image is resolved at its registry.
+	ImageStateResolving ImageState = "resolving"
+	// ImageStateUpToDate is the state of images whose digest is already in the store.
+	ImageStateUpToDate ImageState = "up-to-date"
+	// ImageStatePulling is the state while the image is pulled.
+	ImageStatePulling ImageState = "pulling"
+	// ImageStatePulled is the state of images pulled in the cycle.
+	ImageStatePulled ImageState = "pulled"
+	// ImageStateDeferred is the state of images not pulled because the window closed or the Prefetcher
+	// was stopped. An interrupted pull is resumed by the next cycle.
+	ImageStateDeferred ImageState = "deferred"
+	// ImageStateFailed is the state of images that could not be resolved or pulled, see ImageStatus.Error.
+	ImageStateFailed ImageState = "failed"
+)
+
+// ImageStatus is the status of an image in the current or last cycle.
+type ImageStatus struct {
+	Image
+	State ImageState `json:"state"`
+	// Digest is the digest the reference resolved to at the registry.
+	Digest digest.Digest `json:"digest,omitempty"`
+	// Bytes is the number of bytes of the image transferred so far.
+	Bytes int64 `json:"bytes,omitempty"`
+	// Total is the size of the blobs started to transfer, if known.
+	Total int64 `json:"total,omitempty"`
+	// Error is the error the image failed with.
+	Error string `json:"error,omitempty"`
+}
+
+// PruneStatus summarizes applying the retention policy after a cycle.
+type PruneStatus struct {
+	// Images is the number of images removed.
+	Images int `json:"images"`
+	// Bytes is the number of bytes freed.
+	Bytes int64 `json:"bytes"`
+}
+
+// Status is the status of a Prefetcher, see Prefetcher.Status.
+type Status struct {
+	State State `json:"state"`
+	// Window is the time window cycles run in, if any.
+	Window string `json:"window,omitempty"`
+	// NextCycle is the time the next cycle starts while idle.
+	NextCycle *time.Time `json:"nextCycle,omitempty"`
+	// CycleStarted and CycleFinished are the times the current or last cycle started and finished.
+	CycleStarted  *time.Time `json:"cycleStarted,omitempty"`
+	CycleFinished *time.Time `json:"cycleFinished,omitempty"`
+	// Images are the images of the current or last cycle by descending priority.
+	Images []ImageStatus `json:"images"`
+	// Pruned summarizes applying the retention policy after the last cycle, if any.
+	Pruned *PruneStatus `json:"pruned,omitempty"`
+}
+
+// Status returns the current status.
+func (p *Prefetcher) Status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := p.status
+	status.Images = append([]ImageStatus(nil), p.status.Images...)
+	return status
+}
+
+func (p *Prefetcher) update(fn func(s *Status)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn(&p.status)
+}
+
+func (p *Prefetcher) updateImage(i int, fn func(s *ImageStatus)) {
+	p.update(func(s *Status) { fn(&s.Images[i]) })
+}
+
+// tracker returns a progress reporter recording the transferred bytes of the i-th image.
+func (p *Prefetcher) tracker(i int) progress.Reporter {
+	var (
+		mu      sync.Mutex
+		offsets = make(map[digest.Digest]int64)
+	)
+	record := func(dgst digest.Digest, offset, total int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		_, started := offsets[dgst]
+		offsets[dgst] = offset
+		var bytes int64
+		for _, offset := range offsets {
+			bytes += offset
+		}
+		p.updateImage(i, func(s *ImageStatus) {
+			s.Bytes = bytes
+			if !started && total > 0 {
+				s.Total += total
+			}
+		})
+	}
+	return progress.ReporterFunc(func(event progress.Event) {
+		switch e := event.(type) {
+		case progress.BlobStarted:
+			record(e.Digest, 0, e.Total)
+		case progress.BlobResumed:
+			record(e.Digest, e.Offset, e.Total)
+		case progress.BlobProgress:
+			record(e.Digest, e.Offset, e.Total)
+		case progress.BlobDone:
+			if !e.Skipped {
+				record(e.Digest, e.Total, e.Total)
+			}
+		}
+	})
+}
+
+// Handler returns an http.Handler serving the Status as JSON.
+func (p *Prefetcher) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(p.Status())
+	})
+}
+
+// ServeStatus serves the Status as JSON on the unix socket at path until ctx is done, replacing a stale
+// socket left behind there.
+func (p *Prefetcher) ServeStatus(ctx context.Context, path string) error {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("status socket path %s exists and is no socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("error removing stale status socket: %w", err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("error listening on status socket: %w", err)
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		_ = l.Close()
+		return fmt.Errorf("error setting status socket permissions: %w", err)
+	}
+
+	srv := &http.Server{Handler: p.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("error serving status: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prefetch
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a daily time window of the local time, e.g. 02:00-05:00. A window ending before it starts
+// spans midnight, e.g. 22:00-04:00.
+type Window struct {
+	// Start and End are the minutes after midnight the window starts and ends at.
+	Start, End int
+}
+
+// ParseWindow parses a window in the format HH:MM-HH:MM.
+func ParseWindow(s string) (Window, error) {
+	startStr, endStr, ok := strings.Cut(s, "-")
+	if !ok {
+		return Window{}, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", s)
+	}
+	start, err := parseClock(startStr)
+	if err != nil {
+		return Window{}, fmt.Errorf("invalid window start: %w", err)
+	}
+	end, err := parseClock(endStr)
+	if err != nil {
+		return Window{}, fmt.Errorf("invalid window end: %w", err)
+	}
+	if start == end {
+		return Window{}, fmt.Errorf("invalid window %q: must not be empty", s)
+	}
+	return Window{Start: start, End: end}, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w Window) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
+
+// Next returns the start and end of the window open at t or, if it is closed, of the next one.
+// If the window is open, the returned start is not after t.
+func (w Window) Next(t time.Time) (start, end time.Time) {
+	year, month, day := t.Date()
+	// Start at the previous day, whose window may span midnight into t.
+	for offset := -1; ; offset++ {
+		start = time.Date(year, month, day+offset, w.Start/60, w.Start%60, 0, 0, t.Location())
+		end = time.Date(year, month, day+offset, w.End/60, w.End%60, 0, 0, t.Location())
+		if w.End < w.Start {
+			end = end.AddDate(0, 0, 1)
+		}
+		if t.Before(end) {
+			return start, end
+		}
+	}
+}
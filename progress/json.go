@@ -0,0 +1,109 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Marshal returns the JSON encoding of the event: an object with the event type as "type" field
+// followed by the fields of the event.
+func Marshal(event Event) ([]byte, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2 || data[0] != '{' {
+		return nil, fmt.Errorf("event %s is not encoded as json object", event.Type())
+	}
+
+	typ, err := json.Marshal(event.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"type":`)
+	buf.Write(typ)
+	if len(data) > 2 {
+		buf.WriteByte(',')
+	}
+	buf.Write(data[1:])
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes an event encoded with Marshal.
+func Unmarshal(data []byte) (Event, error) {
+	var header struct {
+		Type EventType `json:"type"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("error decoding event type: %w", err)
+	}
+
+	switch header.Type {
+	case EventTypeOperationStarted:
+		return unmarshal[OperationStarted](data)
+	case EventTypeBlobStarted:
+		return unmarshal[BlobStarted](data)
+	case EventTypeBlobResumed:
+		return unmarshal[BlobResumed](data)
+	case EventTypeBlobProgress:
+		return unmarshal[BlobProgress](data)
+	case EventTypeBlobDone:
+		return unmarshal[BlobDone](data)
+	case EventTypeSummary:
+		return unmarshal[Summary](data)
+	default:
+		return nil, fmt.Errorf("unknown event type %q", header.Type)
+	}
+}
+
+func unmarshal[E Event](data []byte) (Event, error) {
+	var event E
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, fmt.Errorf("error decoding %s event: %w", event.Type(), err)
+	}
+	return event, nil
+}
+
+// JSONReporter writes events as newline-delimited JSON, see Marshal.
+type JSONReporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONReporter returns a new JSONReporter writing to w.
+func NewJSONReporter(w io.Writer) *JSONReporter {
+	return &JSONReporter{w: w}
+}
+
+// Report writes the event. Events that cannot be written are dropped, progress reporting must not fail
+// the operation.
+func (r *JSONReporter) Report(event Event) {
+	data, err := Marshal(event)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, _ = r.w.Write(data)
+}
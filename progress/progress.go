@@ -0,0 +1,329 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package progress provides the events reported while transferring images, e.g. to show a progress bar.
+// The events have a stable JSON encoding, see Marshal.
+package progress
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// EventType is the type of an Event, used as "type" field in its JSON encoding.
+type EventType string
+
+const (
+	// EventTypeOperationStarted is the type of OperationStarted events.
+	EventTypeOperationStarted EventType = "operation-started"
+	// EventTypeBlobStarted is the type of BlobStarted events.
+	EventTypeBlobStarted EventType = "blob-started"
+	// EventTypeBlobResumed is the type of BlobResumed events.
+	EventTypeBlobResumed EventType = "blob-resumed"
+	// EventTypeBlobProgress is the type of BlobProgress events.
+	EventTypeBlobProgress EventType = "blob-progress"
+	// EventTypeBlobDone is the type of BlobDone events.
+	EventTypeBlobDone EventType = "blob-done"
+	// EventTypeSummary is the type of Summary events.
+	EventTypeSummary EventType = "summary"
+)
+
+// Event is an event reported while transferring an image.
+type Event interface {
+	// Type returns the type of the event.
+	Type() EventType
+}
+
+// OperationStarted is reported when an operation on an image, e.g. a pull, starts.
+type OperationStarted struct {
+	// Operation is the name of the operation, e.g. "pull" or "push".
+	Operation string `json:"operation"`
+	// Ref is the reference the operation is performed on.
+	Ref string `json:"ref"`
+}
+
+func (OperationStarted) Type() EventType { return EventTypeOperationStarted }
+
+// UnknownTotal is the total of blobs whose size is not known in advance because their descriptor has no
+// size information, see imageutil.HasKnownSize.
+const UnknownTotal int64 = -1
+
+// Total returns the size of the blob described by the descriptor, or UnknownTotal if it is not known.
+func Total(desc ocispec.Descriptor) int64 {
+	if !imageutil.HasKnownSize(desc) {
+		return UnknownTotal
+	}
+	return desc.Size
+}
+
+// BlobStarted is reported when the transfer of a blob starts.
+type BlobStarted struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+	// Total is the size of the blob in bytes, or UnknownTotal if it is not known in advance.
+	Total int64 `json:"total"`
+}
+
+func (BlobStarted) Type() EventType { return EventTypeBlobStarted }
+
+// BlobResumed is reported after BlobStarted if the transfer continues an interrupted one, e.g. of a
+// previous process, instead of starting from scratch.
+type BlobResumed struct {
+	Digest digest.Digest `json:"digest"`
+	// Offset is the number of bytes already transferred before.
+	Offset int64 `json:"offset"`
+	// Total is the size of the blob in bytes.
+	Total int64 `json:"total"`
+}
+
+func (BlobResumed) Type() EventType { return EventTypeBlobResumed }
+
+// BlobProgress is reported while a blob is transferred, at most every ReportInterval bytes.
+type BlobProgress struct {
+	Digest digest.Digest `json:"digest"`
+	// Offset is the number of bytes transferred so far.
+	Offset int64 `json:"offset"`
+	// Total is the size of the blob in bytes, or UnknownTotal if it is not known in advance.
+	Total int64 `json:"total"`
+}
+
+func (BlobProgress) Type() EventType { return EventTypeBlobProgress }
+
+// BlobDone is reported when a blob was transferred completely or did not need to be transferred.
+type BlobDone struct {
+	Digest digest.Digest `json:"digest"`
+	// Total is the size of the blob in bytes. It is only UnknownTotal for skipped blobs of unknown size.
+	Total int64 `json:"total"`
+	// Skipped is true if the blob already existed at the destination and was not transferred.
+	Skipped bool `json:"skipped"`
+}
+
+func (BlobDone) Type() EventType { return EventTypeBlobDone }
+
+// Summary is reported when an operation finished.
+type Summary struct {
+	Operation string `json:"operation"`
+	Ref       string `json:"ref"`
+	// Digest is the manifest digest of the image, if known.
+	Digest digest.Digest `json:"digest,omitempty"`
+	// Blobs is the number of blobs transferred.
+	Blobs int `json:"blobs"`
+	// Skipped is the number of blobs that already existed at the destination.
+	Skipped int `json:"skipped"`
+	// Bytes is the number of bytes transferred.
+	Bytes int64 `json:"bytes"`
+	// Error is the error the operation failed with. Empty if it succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+func (Summary) Type() EventType { return EventTypeSummary }
+
+// Reporter receives progress events. Implementations have to be safe for concurrent use.
+type Reporter interface {
+	Report(event Event)
+}
+
+// ReporterFunc is a function implementing Reporter.
+type ReporterFunc func(event Event)
+
+func (f ReporterFunc) Report(event Event) {
+	f(event)
+}
+
+// Discard is a Reporter dropping all events.
+var Discard Reporter = ReporterFunc(func(Event) {})
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the reporter. Library functions transferring blobs report their
+// events to the reporter of their context.
+func NewContext(ctx context.Context, reporter Reporter) context.Context {
+	return context.WithValue(ctx, contextKey{}, reporter)
+}
+
+// FromContext returns the reporter of the context, or Discard if there is none.
+func FromContext(ctx context.Context) Reporter {
+	if reporter, ok := ctx.Value(contextKey{}).(Reporter); ok {
+		return reporter
+	}
+	return Discard
+}
+
+// ReportInterval is the minimum number of bytes between two BlobProgress events of a blob.
+const ReportInterval = 1 << 20
+
+// NewReader returns a reader reporting BlobProgress events for the blob with the given descriptor
+// while reading from r.
+func NewReader(r io.Reader, reporter Reporter, desc ocispec.Descriptor) io.Reader {
+	return &reader{r: r, reporter: reporter, desc: desc}
+}
+
+// BlobProgressFunc returns a function reporting BlobProgress events of the blob of the descriptor at the
+// offsets it is called with, e.g. for ioutils.WithProgress with ReportInterval.
+func BlobProgressFunc(reporter Reporter, desc ocispec.Descriptor) func(offset int64) {
+	return func(offset int64) {
+		reporter.Report(BlobProgress{Digest: desc.Digest, Offset: offset, Total: Total(desc)})
+	}
+}
+
+// NewReaderAt is like NewReader for a transfer resumed at the given offset, which r continues from.
+func NewReaderAt(r io.Reader, reporter Reporter, desc ocispec.Descriptor, offset int64) io.Reader {
+	return &reader{r: r, reporter: reporter, desc: desc, offset: offset, reported: offset}
+}
+
+type reader struct {
+	r        io.Reader
+	reporter Reporter
+	desc     ocispec.Descriptor
+	offset   int64
+	reported int64
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.offset += int64(n)
+	if r.offset-r.reported >= ReportInterval {
+		r.reported = r.offset
+		r.reporter.Report(BlobProgress{Digest: r.desc.Digest, Offset: r.offset, Total: Total(r.desc)})
+	}
+	return n, err
+}
+
+// BlobTransfer is the state of the transfer of a blob recorded by a Recorder.
+type BlobTransfer struct {
+	Digest digest.Digest `json:"digest"`
+	// Total is the size of the blob in bytes, or UnknownTotal if it is not known in advance.
+	Total int64 `json:"total"`
+	// Offset is the number of bytes of the blob at the destination, including resumed ones.
+	Offset int64 `json:"offset"`
+	// Transferred is the number of bytes transferred by the operation, excluding resumed ones.
+	Transferred int64 `json:"transferred"`
+	// Done is set if the blob was transferred completely or skipped.
+	Done bool `json:"done"`
+	// Skipped is set if the blob already existed at the destination.
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// Recorder passes events on to another Reporter and aggregates them for a Summary.
+type Recorder struct {
+	next Reporter
+
+	mu        sync.Mutex
+	blobs     int
+	skipped   int
+	bytes     int64
+	order     []digest.Digest
+	transfers map[digest.Digest]*BlobTransfer
+	resumed   map[digest.Digest]int64
+}
+
+// NewRecorder returns a new Recorder passing events on to next.
+func NewRecorder(next Reporter) *Recorder {
+	return &Recorder{
+		next:      next,
+		transfers: make(map[digest.Digest]*BlobTransfer),
+		resumed:   make(map[digest.Digest]int64),
+	}
+}
+
+func (r *Recorder) Report(event Event) {
+	r.mu.Lock()
+	switch event := event.(type) {
+	case BlobStarted:
+		r.transfer(event.Digest).Total = event.Total
+	case BlobResumed:
+		t := r.transfer(event.Digest)
+		t.Total, t.Offset = event.Total, event.Offset
+		r.resumed[event.Digest] = event.Offset
+	case BlobProgress:
+		t := r.transfer(event.Digest)
+		t.Total, t.Offset = event.Total, event.Offset
+		t.Transferred = event.Offset - r.resumed[event.Digest]
+	case BlobDone:
+		t := r.transfer(event.Digest)
+		t.Total, t.Done, t.Skipped = event.Total, true, event.Skipped
+		if event.Skipped {
+			r.skipped++
+		} else {
+			t.Offset = event.Total
+			t.Transferred = event.Total - r.resumed[event.Digest]
+			r.blobs++
+			r.bytes += event.Total
+		}
+	}
+	r.mu.Unlock()
+	r.next.Report(event)
+}
+
+// transfer returns the transfer of the blob, adding it if it is not recorded yet. r.mu has to be held.
+func (r *Recorder) transfer(dgst digest.Digest) *BlobTransfer {
+	t, ok := r.transfers[dgst]
+	if !ok {
+		t = &BlobTransfer{Digest: dgst}
+		r.transfers[dgst] = t
+		r.order = append(r.order, dgst)
+	}
+	return t
+}
+
+// Transfers returns the transfers of the blobs recorded so far, in the order they were first reported.
+// Unlike the Summary, they include blobs whose transfer did not finish.
+func (r *Recorder) Transfers() []BlobTransfer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make([]BlobTransfer, 0, len(r.order))
+	for _, dgst := range r.order {
+		res = append(res, *r.transfers[dgst])
+	}
+	return res
+}
+
+// Summary returns the summary of the operation from the events recorded so far.
+func (r *Recorder) Summary(operation, ref string, dgst digest.Digest, err error) Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	summary := Summary{
+		Operation: operation,
+		Ref:       ref,
+		Digest:    dgst,
+		Blobs:     r.blobs,
+		Skipped:   r.skipped,
+		Bytes:     r.bytes,
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	return summary
+}
+
+// RecorderFromContext returns the Recorder of the operation started with the context, see StartOperation.
+func RecorderFromContext(ctx context.Context) (*Recorder, bool) {
+	recorder, ok := FromContext(ctx).(*Recorder)
+	return recorder, ok
+}
+
+// StartOperation reports the start of the operation to the reporter of the context. The returned
+// context records the reported blobs, and the returned function reports the summary of the operation.
+func StartOperation(ctx context.Context, operation, ref string) (context.Context, func(dgst digest.Digest, err error)) {
+	recorder := NewRecorder(FromContext(ctx))
+	recorder.Report(OperationStarted{Operation: operation, Ref: ref})
+	return NewContext(ctx, recorder), func(dgst digest.Digest, err error) {
+		recorder.Report(recorder.Summary(operation, ref, dgst, err))
+	}
+}
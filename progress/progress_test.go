@@ -0,0 +1,167 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package progress_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/progress"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var update = flag.Bool("update", false, "Update the golden files in testdata.")
+
+// expectGolden compares data to the golden file with the given name, or updates it if -update is passed.
+func expectGolden(name string, data []byte) {
+	path := filepath.Join("testdata", name)
+	if *update {
+		Expect(os.WriteFile(path, data, 0666)).To(Succeed())
+	}
+	golden, err := os.ReadFile(path)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(string(data)).To(Equal(string(golden)), "run go test ./progress -update to update the golden file after intended schema changes")
+}
+
+var _ = Describe("Progress", func() {
+	var (
+		ctx    context.Context
+		blob   = digest.FromString("blob")
+		events = []progress.Event{
+			progress.OperationStarted{Operation: "pull", Ref: "ghcr.io/onmetal/onmetal-image/my-image:latest"},
+			progress.BlobStarted{Digest: blob, MediaType: ocispec.MediaTypeImageLayer, Total: 3 << 20},
+			progress.BlobProgress{Digest: blob, Offset: 1 << 20, Total: 3 << 20},
+			progress.BlobDone{Digest: blob, Total: 3 << 20},
+			progress.BlobDone{Digest: digest.FromString("config"), Total: 6, Skipped: true},
+			progress.Summary{Operation: "pull", Ref: "ghcr.io/onmetal/onmetal-image/my-image:latest", Digest: digest.FromString("manifest"), Blobs: 1, Skipped: 1, Bytes: 3 << 20},
+			progress.Summary{Operation: "push", Ref: "ghcr.io/onmetal/onmetal-image/my-image:latest", Error: "unauthorized"},
+		}
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+	})
+
+	It("should encode events as newline-delimited json matching the golden file", func() {
+		var buf bytes.Buffer
+		r := progress.NewJSONReporter(&buf)
+		for _, event := range events {
+			r.Report(event)
+		}
+		expectGolden("events.ndjson", buf.Bytes())
+	})
+
+	It("should decode encoded events", func() {
+		for _, event := range events {
+			data, err := progress.Marshal(event)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(progress.Unmarshal(data)).To(Equal(event))
+		}
+
+		_, err := progress.Unmarshal([]byte(`{"type":"unknown"}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should report the events of adding an image to a layout matching the golden file", func() {
+		l, err := layout.New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		img, err := imageutil.NewBytesConfigBuilder([]byte("config"), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer(make([]byte, 5<<19), imageutil.WithMediaType(ocispec.MediaTypeImageLayer)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+
+		var buf bytes.Buffer
+		ctx := progress.NewContext(ctx, progress.NewJSONReporter(&buf))
+		Expect(l.AddImage(ctx, img)).To(Succeed())
+
+		By("adding the image again")
+		Expect(l.AddImage(ctx, img)).To(Succeed())
+		expectGolden("add-image.ndjson", buf.Bytes())
+	})
+
+	It("should report progress at most every report interval", func() {
+		var reported []progress.Event
+		reporter := progress.ReporterFunc(func(event progress.Event) { reported = append(reported, event) })
+		desc := ocispec.Descriptor{Digest: blob, Size: 3*progress.ReportInterval + 1}
+
+		r := progress.NewReader(io.LimitReader(bytes.NewReader(make([]byte, desc.Size)), desc.Size), reporter, desc)
+		Expect(io.Copy(io.Discard, r)).To(Equal(desc.Size))
+		Expect(reported).To(HaveLen(3))
+		Expect(reported[2]).To(Equal(progress.BlobProgress{Digest: blob, Offset: 3 * progress.ReportInterval, Total: desc.Size}))
+	})
+
+	It("should report an unknown total for blobs without size information", func() {
+		var reported []progress.Event
+		reporter := progress.ReporterFunc(func(event progress.Event) { reported = append(reported, event) })
+		desc := ocispec.Descriptor{Digest: blob}
+
+		r := progress.NewReader(bytes.NewReader(make([]byte, progress.ReportInterval)), reporter, desc)
+		Expect(io.Copy(io.Discard, r)).To(Equal(int64(progress.ReportInterval)))
+		Expect(reported).To(Equal([]progress.Event{
+			progress.BlobProgress{Digest: blob, Offset: progress.ReportInterval, Total: progress.UnknownTotal},
+		}))
+	})
+
+	It("should summarize the recorded blobs", func() {
+		var last progress.Event
+		recorder := progress.NewRecorder(progress.ReporterFunc(func(event progress.Event) { last = event }))
+		for _, event := range events[:5] {
+			recorder.Report(event)
+		}
+		Expect(last).To(Equal(events[4]))
+		Expect(recorder.Summary("pull", "foo", "", errors.New("failed"))).To(Equal(progress.Summary{
+			Operation: "pull",
+			Ref:       "foo",
+			Blobs:     1,
+			Skipped:   1,
+			Bytes:     3 << 20,
+			Error:     "failed",
+		}))
+	})
+
+	It("should record the transfers of unfinished and resumed blobs", func() {
+		resumed := digest.FromString("resumed")
+		recorder := progress.NewRecorder(progress.Discard)
+		for _, event := range []progress.Event{
+			progress.BlobStarted{Digest: blob, Total: 3 << 20},
+			progress.BlobProgress{Digest: blob, Offset: 1 << 20, Total: 3 << 20},
+			progress.BlobStarted{Digest: resumed, Total: 4 << 20},
+			progress.BlobResumed{Digest: resumed, Offset: 2 << 20, Total: 4 << 20},
+			progress.BlobDone{Digest: resumed, Total: 4 << 20},
+		} {
+			recorder.Report(event)
+		}
+		Expect(recorder.Transfers()).To(Equal([]progress.BlobTransfer{
+			{Digest: blob, Total: 3 << 20, Offset: 1 << 20, Transferred: 1 << 20},
+			{Digest: resumed, Total: 4 << 20, Offset: 4 << 20, Transferred: 2 << 20, Done: true},
+		}))
+	})
+
+	It("should carry the reporter in the context and default to discarding events", func() {
+		Expect(progress.FromContext(ctx)).NotTo(BeNil())
+		reporter := progress.NewJSONReporter(io.Discard)
+		Expect(progress.FromContext(progress.NewContext(ctx, reporter))).To(BeIdenticalTo(reporter))
+	})
+})
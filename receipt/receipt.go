@@ -0,0 +1,183 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package receipt implements signed transparency log receipts for image manifests and the offline
+// verification of local images against them.
+package receipt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/opencontainers/go-digest"
+)
+
+// Version is the version of the receipt format. It is changed on incompatible changes only.
+const Version = "v1"
+
+// ErrInvalidSignature is returned if the signature of a receipt does not verify with the log key.
+var ErrInvalidSignature = errors.New("invalid receipt signature")
+
+// Receipt is the statement of a transparency log that it recorded an image manifest digest.
+//
+// The signature covers the canonical JSON (see imageutil.MarshalCanonical) of the object with the version,
+// digest, timestamp (RFC 3339 in UTC with nanoseconds) and log index, see Payload. Ed25519 keys sign the
+// payload itself, ECDSA keys its SHA-256 hash (ASN.1 encoded signature).
+type Receipt struct {
+	// Version is the version of the receipt format, see Version.
+	Version string `json:"version"`
+	// Digest is the digest of the image manifest.
+	Digest digest.Digest `json:"digest"`
+	// Timestamp is when the log recorded the digest.
+	Timestamp time.Time `json:"timestamp"`
+	// LogIndex is the index of the entry in the log.
+	LogIndex int64 `json:"logIndex"`
+	// Signature is the signature of the log key over the payload.
+	Signature []byte `json:"signature"`
+}
+
+type payload struct {
+	Version   string        `json:"version"`
+	Digest    digest.Digest `json:"digest"`
+	Timestamp string        `json:"timestamp"`
+	LogIndex  int64         `json:"logIndex"`
+}
+
+// Payload returns the bytes the signature of the receipt is computed over.
+func (r *Receipt) Payload() ([]byte, error) {
+	return imageutil.MarshalCanonical(payload{
+		Version:   r.Version,
+		Digest:    r.Digest,
+		Timestamp: r.Timestamp.UTC().Format(time.RFC3339Nano),
+		LogIndex:  r.LogIndex,
+	})
+}
+
+// New returns a receipt for the manifest digest recorded at the given time and log index, signed by the
+// signer, which has to be an ed25519 or ECDSA key.
+func New(dgst digest.Digest, timestamp time.Time, logIndex int64, signer crypto.Signer) (*Receipt, error) {
+	r := &Receipt{
+		Version:   Version,
+		Digest:    dgst,
+		Timestamp: timestamp.UTC(),
+		LogIndex:  logIndex,
+	}
+	data, err := r.Payload()
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling payload: %w", err)
+	}
+
+	switch signer.Public().(type) {
+	case ed25519.PublicKey:
+		r.Signature, err = signer.Sign(rand.Reader, data, crypto.Hash(0))
+	case *ecdsa.PublicKey:
+		sum := sha256.Sum256(data)
+		r.Signature, err = signer.Sign(rand.Reader, sum[:], crypto.SHA256)
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, expected ed25519 or ECDSA", signer.Public())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error signing receipt: %w", err)
+	}
+	return r, nil
+}
+
+// Verify verifies the signature of the receipt with the public key of the log.
+func (r *Receipt) Verify(pub crypto.PublicKey) error {
+	if r.Version != Version {
+		return fmt.Errorf("unsupported receipt version %q, expected %q", r.Version, Version)
+	}
+	data, err := r.Payload()
+	if err != nil {
+		return fmt.Errorf("error marshaling payload: %w", err)
+	}
+
+	var ok bool
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, data, r.Signature)
+	case *ecdsa.PublicKey:
+		sum := sha256.Sum256(data)
+		ok = ecdsa.VerifyASN1(pub, sum[:], r.Signature)
+	default:
+		return fmt.Errorf("unsupported key type %T, expected ed25519 or ECDSA", pub)
+	}
+	if !ok {
+		return fmt.Errorf("%w for %s at log index %d", ErrInvalidSignature, r.Digest, r.LogIndex)
+	}
+	return nil
+}
+
+// ReadFile reads a receipt from the given JSON file.
+func ReadFile(filename string) (*Receipt, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading receipt: %w", err)
+	}
+	r := &Receipt{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("error decoding receipt: %w", err)
+	}
+	return r, nil
+}
+
+// WriteFile writes the receipt as indented JSON to the given file.
+func WriteFile(filename string, r *Receipt) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling receipt: %w", err)
+	}
+	if err := os.WriteFile(filename, append(data, '\n'), 0666); err != nil {
+		return fmt.Errorf("error writing receipt: %w", err)
+	}
+	return nil
+}
+
+// ReadPublicKeyFile reads a PEM encoded PKIX ed25519 or ECDSA public key of a log from the given file.
+func ReadPublicKeyFile(filename string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading public key: %w", err)
+	}
+	return ParsePublicKey(data)
+}
+
+// ParsePublicKey parses a PEM encoded PKIX ed25519 or ECDSA public key.
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing public key: %w", err)
+	}
+	switch pub.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return pub, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, expected ed25519 or ECDSA", pub)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receipt_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"time"
+
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/store"
+	"github.com/onmetal/onmetal-image/receipt"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Receipt", func() {
+	var (
+		ctx       = context.Background()
+		timestamp = time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	)
+
+	newEd25519Key := func() crypto.Signer {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		return priv
+	}
+
+	DescribeTable("should round-trip signed receipts",
+		func(newKey func() crypto.Signer) {
+			key := newKey()
+			dgst := digest.FromString("manifest")
+
+			r, err := receipt.New(dgst, timestamp, 42, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Version).To(Equal(receipt.Version))
+
+			filename := filepath.Join(GinkgoT().TempDir(), "receipt.json")
+			Expect(receipt.WriteFile(filename, r)).To(Succeed())
+			read, err := receipt.ReadFile(filename)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(read.Verify(key.Public())).To(Succeed())
+
+			pkix, err := x509.MarshalPKIXPublicKey(key.Public())
+			Expect(err).NotTo(HaveOccurred())
+			pub, err := receipt.ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(read.Verify(pub)).To(Succeed())
+
+			By("tampering with the log index")
+			read.LogIndex++
+			Expect(read.Verify(pub)).To(MatchError(receipt.ErrInvalidSignature))
+		},
+		Entry("ed25519", newEd25519Key),
+		Entry("ecdsa", func() crypto.Signer {
+			priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).NotTo(HaveOccurred())
+			return priv
+		}),
+	)
+
+	Describe("VerifyImage", func() {
+		var (
+			s   *store.Store
+			key crypto.Signer
+		)
+
+		BeforeEach(func() {
+			var err error
+			s, err = store.New(GinkgoT().TempDir())
+			Expect(err).NotTo(HaveOccurred())
+			key = newEd25519Key()
+		})
+
+		putImage := func() (digest.Digest, digest.Digest) {
+			img, err := imageutil.NewJSONConfigBuilder(&onmetalimage.Config{}, imageutil.WithMediaType(onmetalimage.ConfigMediaType)).
+				BytesLayer([]byte("rootfs"), imageutil.WithMediaType(onmetalimage.RootFSLayerMediaType)).
+				Complete()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.Put(ctx, img)).To(Succeed())
+			layers, err := img.Layers(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			return img.Descriptor().Digest, layers[0].Descriptor().Digest
+		}
+
+		verify := func(r *receipt.Receipt, dgst digest.Digest) *receipt.Report {
+			img, err := s.Resolve(ctx, dgst.String())
+			Expect(err).NotTo(HaveOccurred())
+			report, err := receipt.VerifyImage(ctx, "image", img, r, key.Public())
+			Expect(err).NotTo(HaveOccurred())
+			return report
+		}
+
+		It("should verify an intact image", func() {
+			dgst, _ := putImage()
+			r, err := receipt.New(dgst, timestamp, 1, key)
+			Expect(err).NotTo(HaveOccurred())
+
+			report := verify(r, dgst)
+			Expect(report.Verified).To(BeTrue())
+			Expect(report.DigestMatches).To(BeTrue())
+			Expect(report.SignatureValid).To(BeTrue())
+			Expect(report.Blobs).To(HaveLen(2))
+			for _, blob := range report.Blobs {
+				Expect(blob.Valid).To(BeTrue(), "blob %s", blob.Digest)
+			}
+		})
+
+		It("should report a receipt for a different digest", func() {
+			dgst, _ := putImage()
+			r, err := receipt.New(digest.FromString("other"), timestamp, 1, key)
+			Expect(err).NotTo(HaveOccurred())
+
+			report := verify(r, dgst)
+			Expect(report.Verified).To(BeFalse())
+			Expect(report.DigestMatches).To(BeFalse())
+			Expect(report.SignatureValid).To(BeTrue())
+		})
+
+		It("should report a receipt signed by another key", func() {
+			dgst, _ := putImage()
+			r, err := receipt.New(dgst, timestamp, 1, newEd25519Key())
+			Expect(err).NotTo(HaveOccurred())
+
+			report := verify(r, dgst)
+			Expect(report.Verified).To(BeFalse())
+			Expect(report.SignatureValid).To(BeFalse())
+			Expect(report.SignatureError).NotTo(BeEmpty())
+		})
+
+		It("should report corrupted blobs", func() {
+			dgst, layerDigest := putImage()
+			r, err := receipt.New(dgst, timestamp, 1, key)
+			Expect(err).NotTo(HaveOccurred())
+
+			blobPath := filepath.Join(s.Layout().Path(), "blobs", layerDigest.Algorithm().String(), layerDigest.Encoded())
+			Expect(os.WriteFile(blobPath, []byte("r00tfs"), 0644)).To(Succeed())
+
+			report := verify(r, dgst)
+			Expect(report.Verified).To(BeFalse())
+			Expect(report.DigestMatches).To(BeTrue())
+			Expect(report.Blobs[0].Valid).To(BeTrue())
+			Expect(report.Blobs[1].Digest).To(Equal(layerDigest))
+			Expect(report.Blobs[1].Valid).To(BeFalse())
+			Expect(report.Blobs[1].Error).NotTo(BeEmpty())
+		})
+
+		It("should not re-hash blobs the kernel vouches for", func() {
+			dgst, layerDigest := putImage()
+			r, err := receipt.New(dgst, timestamp, 1, key)
+			Expect(err).NotTo(HaveOccurred())
+
+			img, err := s.Resolve(ctx, dgst.String())
+			Expect(err).NotTo(HaveOccurred())
+			report, err := receipt.VerifyImage(ctx, "image", img, r, key.Public(), receipt.WithVerityVerified(func(_ context.Context, desc ocispec.Descriptor) (bool, error) {
+				return desc.Digest == layerDigest, nil
+			}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Verified).To(BeTrue())
+			Expect(report.Blobs[0].FSVerity).To(BeFalse())
+			Expect(report.Blobs[1].Valid).To(BeTrue())
+			Expect(report.Blobs[1].FSVerity).To(BeTrue())
+		})
+	})
+})
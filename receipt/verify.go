@@ -0,0 +1,174 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receipt
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"io"
+	"time"
+
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Report is the result of verifying an image against a receipt. Its JSON form is stable and meant to be
+// consumed by downstream tools.
+type Report struct {
+	// Reference is the reference of the verified image.
+	Reference string `json:"reference"`
+	// Digest is the digest of the local manifest content.
+	Digest digest.Digest `json:"digest"`
+	// ReceiptDigest is the manifest digest stated by the receipt.
+	ReceiptDigest digest.Digest `json:"receiptDigest"`
+	// LogIndex is the log index stated by the receipt.
+	LogIndex int64 `json:"logIndex"`
+	// Timestamp is the time the receipt states the digest was recorded.
+	Timestamp time.Time `json:"timestamp"`
+	// DigestMatches is set if the local manifest digest equals the digest of the receipt.
+	DigestMatches bool `json:"digestMatches"`
+	// SignatureValid is set if the receipt signature verifies with the log key.
+	SignatureValid bool `json:"signatureValid"`
+	// SignatureError is the reason the signature is invalid.
+	SignatureError string `json:"signatureError,omitempty"`
+	// Blobs are the results of re-hashing the config and layers, in manifest order.
+	Blobs []BlobReport `json:"blobs"`
+	// Verified is set if the digest matches, the signature is valid and all blobs are valid.
+	Verified bool `json:"verified"`
+}
+
+// BlobReport is the result of re-hashing a blob of the manifest.
+type BlobReport struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+	Size      int64         `json:"size"`
+	// Valid is set if the content has the size and digest stated by the manifest.
+	Valid bool `json:"valid"`
+	// FSVerity is set if the content was not re-hashed since fsverity vouches for it, see
+	// WithVerityVerified.
+	FSVerity bool `json:"fsverity,omitempty"`
+	// Error is the reason the blob is invalid.
+	Error string `json:"error,omitempty"`
+}
+
+// VerifyOptions are options for VerifyImage.
+type VerifyOptions struct {
+	// VerityVerified reports whether the kernel vouches for the content of a blob, see WithVerityVerified.
+	VerityVerified func(ctx context.Context, desc ocispec.Descriptor) (bool, error)
+}
+
+// VerifyOption is an option for VerifyImage.
+type VerifyOption func(o *VerifyOptions)
+
+// WithVerityVerified checks blobs with the given function before re-hashing them. Blobs it reports as
+// verified, e.g. by layout.Layout.VerityVerified for blobs protected with fsverity, are not re-hashed.
+func WithVerityVerified(verified func(ctx context.Context, desc ocispec.Descriptor) (bool, error)) VerifyOption {
+	return func(o *VerifyOptions) {
+		o.VerityVerified = verified
+	}
+}
+
+// VerifyImage verifies the local image against the receipt, checking the manifest digest, the receipt
+// signature with the log key and re-hashing the config and layer blobs. It only reads local content.
+// An invalid image is reported in the returned report, errors are only returned if the image cannot be
+// read at all.
+func VerifyImage(ctx context.Context, ref string, img ociimage.Image, r *Receipt, pub crypto.PublicKey, opts ...VerifyOption) (*Report, error) {
+	o := &VerifyOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	report := &Report{
+		Reference:     ref,
+		ReceiptDigest: r.Digest,
+		LogIndex:      r.LogIndex,
+		Timestamp:     r.Timestamp,
+	}
+
+	dgst, _, err := hash(ctx, img, img.Descriptor().Digest.Algorithm())
+	if err != nil {
+		return nil, fmt.Errorf("error hashing manifest: %w", err)
+	}
+	report.Digest = dgst
+	report.DigestMatches = dgst == r.Digest
+
+	if err := r.Verify(pub); err != nil {
+		report.SignatureError = err.Error()
+	} else {
+		report.SignatureValid = true
+	}
+
+	config, err := img.Config(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting config: %w", err)
+	}
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting layers: %w", err)
+	}
+
+	valid := true
+	for _, layer := range append([]ociimage.Layer{config}, layers...) {
+		blob := verifyBlob(ctx, layer, o)
+		valid = valid && blob.Valid
+		report.Blobs = append(report.Blobs, blob)
+	}
+
+	report.Verified = report.DigestMatches && report.SignatureValid && valid
+	return report, nil
+}
+
+func verifyBlob(ctx context.Context, layer ociimage.Layer, o *VerifyOptions) BlobReport {
+	desc := layer.Descriptor()
+	blob := BlobReport{Digest: desc.Digest, MediaType: desc.MediaType, Size: desc.Size}
+	if o.VerityVerified != nil {
+		if ok, err := o.VerityVerified(ctx, desc); err == nil && ok {
+			blob.Valid = true
+			blob.FSVerity = true
+			return blob
+		}
+	}
+
+	dgst, size, err := hash(ctx, layer, desc.Digest.Algorithm())
+	switch {
+	case err != nil:
+		blob.Error = err.Error()
+	case size != desc.Size:
+		blob.Error = fmt.Sprintf("size %d does not match the manifest", size)
+	case dgst != desc.Digest:
+		blob.Error = fmt.Sprintf("digest %s does not match the manifest", dgst)
+	default:
+		blob.Valid = true
+	}
+	return blob
+}
+
+// hash returns the digest and size of the content of the layer.
+func hash(ctx context.Context, layer ociimage.Layer, algorithm digest.Algorithm) (digest.Digest, int64, error) {
+	rc, err := layer.Content(ctx)
+	if err != nil {
+		return "", 0, fmt.Errorf("error opening content: %w", err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	hashed, err := ioutils.CopyVerify(ctx, io.Discard, rc, ocispec.Descriptor{}, ioutils.WithAlgorithm(algorithm))
+	if err != nil {
+		return "", 0, fmt.Errorf("error reading content: %w", err)
+	}
+	return hashed.Digest, hashed.Size, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ref
+
+import (
+	"fmt"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// Pinned is a reference pinned to the digest of the manifest it points to, the form to put into machine
+// specs so they keep referring to the same image even if the tag moves.
+type Pinned struct {
+	// Digested is the pinned reference without tag, registry/repository@digest.
+	Digested string `json:"digested"`
+	// Tagged is the pinned reference including the tag it was given with, registry/repository:tag@digest.
+	// It is empty if no tag was involved.
+	Tagged string `json:"tagged,omitempty"`
+}
+
+// Pin pins the named reference to the given digest. If the reference already carries a digest, it has
+// to be the given one.
+func Pin(named reference.Named, dgst digest.Digest) (Pinned, error) {
+	if err := dgst.Validate(); err != nil {
+		return Pinned{}, fmt.Errorf("invalid digest %q: %w", dgst, err)
+	}
+	if digested, ok := named.(reference.Digested); ok && digested.Digest() != dgst {
+		return Pinned{}, fmt.Errorf("reference %s does not point to %s", named, dgst)
+	}
+
+	repository := reference.TrimNamed(named)
+	digested, err := reference.WithDigest(repository, dgst)
+	if err != nil {
+		return Pinned{}, err
+	}
+	pinned := Pinned{Digested: digested.String()}
+
+	if tagged, ok := named.(reference.Tagged); ok {
+		withTag, err := reference.WithTag(repository, tagged.Tag())
+		if err != nil {
+			return Pinned{}, err
+		}
+		withDigest, err := reference.WithDigest(withTag, dgst)
+		if err != nil {
+			return Pinned{}, err
+		}
+		pinned.Tagged = withDigest.String()
+	}
+	return pinned, nil
+}
+
+// Pin parses the given string (see ParseNamed) and pins it to the given digest.
+func (p Parser) Pin(s string, dgst digest.Digest) (Pinned, error) {
+	named, err := p.ParseNamed(s)
+	if err != nil {
+		return Pinned{}, err
+	}
+	return Pin(named, dgst)
+}
@@ -0,0 +1,138 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ref parses image references the way docker / nerdctl users expect:
+// A default registry is applied to references without a registry, the latest tag
+// is added if neither tag nor digest is given and repository names are lowercased.
+package ref
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// DefaultRegistry is the registry used for references that do not specify a registry.
+	DefaultRegistry = "docker.io"
+	// DefaultTag is the tag used for references that specify neither tag nor digest.
+	DefaultTag = "latest"
+
+	legacyDefaultDomain = "index.docker.io"
+	officialRepoPrefix  = "library/"
+)
+
+var identifierRegexp = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// Parser parses image references. The zero value is ready to use and applies DefaultRegistry.
+type Parser struct {
+	// DefaultRegistry is the registry applied to references without a registry.
+	// If empty, DefaultRegistry is used.
+	DefaultRegistry string
+}
+
+func (p Parser) defaultRegistry() string {
+	if p.DefaultRegistry != "" {
+		return p.DefaultRegistry
+	}
+	return DefaultRegistry
+}
+
+// splitDomain splits the name into domain and remainder. The first path component is considered
+// a domain if it contains a '.' or ':' (a port) or if it is 'localhost'.
+func splitDomain(name string) (domain, remainder string) {
+	i := strings.IndexRune(name, '/')
+	if i == -1 {
+		return "", name
+	}
+
+	first := name[:i]
+	if !strings.ContainsAny(first, ".:") && first != "localhost" {
+		return "", name
+	}
+	return first, name[i+1:]
+}
+
+// ParseNamed parses the given string into a fully qualified, normalized named reference.
+//
+// If no registry is given, the default registry is applied. If the default registry is docker.io,
+// single-component names are prefixed with 'library/'. If neither tag nor digest is given, DefaultTag is added.
+// Registry and repository names are lowercased, tags are kept as-is.
+func (p Parser) ParseNamed(s string) (reference.Named, error) {
+	if s == "" {
+		return nil, fmt.Errorf("invalid reference: %w", reference.ErrNameEmpty)
+	}
+
+	name, dgst, hasDigest := strings.Cut(s, "@")
+
+	var tag string
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, tag = name[:i], name[i+1:]
+	}
+
+	domain, remainder := splitDomain(name)
+	domain, remainder = strings.ToLower(domain), strings.ToLower(remainder)
+	if domain == legacyDefaultDomain {
+		domain = DefaultRegistry
+	}
+	if domain == "" {
+		domain = p.defaultRegistry()
+	}
+	if domain == DefaultRegistry && !strings.ContainsRune(remainder, '/') {
+		remainder = officialRepoPrefix + remainder
+	}
+
+	normalized := domain + "/" + remainder
+	if tag != "" {
+		normalized += ":" + tag
+	}
+	if hasDigest {
+		normalized += "@" + dgst
+	}
+
+	named, err := reference.ParseNamed(normalized)
+	if err != nil {
+		if errors.Is(err, reference.ErrReferenceInvalidFormat) {
+			return nil, fmt.Errorf("invalid reference %q: repository names may only contain lowercase letters, digits and the separators '.', '_', '-' and '/': %w", s, err)
+		}
+		return nil, fmt.Errorf("invalid reference %q: %w", s, err)
+	}
+	return reference.TagNameOnly(named), nil
+}
+
+// ParseAny parses the given string either as digest (with or without algorithm prefix) or as named reference
+// (see ParseNamed).
+func (p Parser) ParseAny(s string) (reference.Reference, error) {
+	if identifierRegexp.MatchString(s) {
+		s = digest.Canonical.String() + ":" + s
+	}
+	if dgst, err := digest.Parse(s); err == nil {
+		return reference.ParseAnyReference(dgst.String())
+	}
+	return p.ParseNamed(s)
+}
+
+// ParseNamed parses the given string using a Parser with the DefaultRegistry.
+func ParseNamed(s string) (reference.Named, error) {
+	return Parser{}.ParseNamed(s)
+}
+
+// ParseAny parses the given string using a Parser with the DefaultRegistry.
+func ParseAny(s string) (reference.Reference, error) {
+	return Parser{}.ParseAny(s)
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ref_test
+
+import (
+	"strings"
+
+	. "github.com/onmetal/onmetal-image/ref"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+)
+
+const testDigest = "sha256:a1db18dba462bcb46990df82ec6caad910753052714f83dff63a34a4e85958c9"
+
+var _ = Describe("Parser", func() {
+	DescribeTable("ParseNamed",
+		func(defaultRegistry, s, expected string) {
+			named, err := Parser{DefaultRegistry: defaultRegistry}.ParseNamed(s)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(named.String()).To(Equal(expected))
+		},
+		Entry("official image", "", "alpine", "docker.io/library/alpine:latest"),
+		Entry("user image", "", "onmetal/gardenlinux:v1", "docker.io/onmetal/gardenlinux:v1"),
+		Entry("custom default registry", "ghcr.io", "onmetal/gardenlinux:v1", "ghcr.io/onmetal/gardenlinux:v1"),
+		Entry("single component with custom default registry", "ghcr.io", "gardenlinux", "ghcr.io/gardenlinux:latest"),
+		Entry("explicit registry", "ghcr.io", "example.org/foo/bar:1.0", "example.org/foo/bar:1.0"),
+		Entry("legacy docker hub domain", "", "index.docker.io/onmetal/foo", "docker.io/onmetal/foo:latest"),
+		Entry("localhost with port", "", "localhost:5000/name", "localhost:5000/name:latest"),
+		Entry("localhost with port and tag", "", "localhost:5000/name:v1", "localhost:5000/name:v1"),
+		Entry("localhost without port", "", "localhost/name", "localhost/name:latest"),
+		Entry("uppercase name", "", "Example.org/Onmetal/Foo:V1", "example.org/onmetal/foo:V1"),
+		Entry("digest", "", "example.org/foo@"+testDigest, "example.org/foo@"+testDigest),
+		Entry("tag and digest", "", "example.org/foo:v1@"+testDigest, "example.org/foo:v1@"+testDigest),
+	)
+
+	DescribeTable("ParseNamed errors",
+		func(s string) {
+			_, err := ParseNamed(s)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("empty", ""),
+		Entry("invalid characters", "example.org/foo$bar"),
+		Entry("invalid tag", "example.org/foo:-v1"),
+	)
+
+	DescribeTable("Pin",
+		func(s string, expected Pinned) {
+			pinned, err := Parser{DefaultRegistry: "ghcr.io"}.Pin(s, testDigest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pinned).To(Equal(expected))
+		},
+		Entry("default tag", "onmetal/foo", Pinned{
+			Digested: "ghcr.io/onmetal/foo@" + testDigest,
+			Tagged:   "ghcr.io/onmetal/foo:latest@" + testDigest,
+		}),
+		Entry("explicit tag", "example.org/foo:v1", Pinned{
+			Digested: "example.org/foo@" + testDigest,
+			Tagged:   "example.org/foo:v1@" + testDigest,
+		}),
+		Entry("digest only", "example.org/foo@"+testDigest, Pinned{
+			Digested: "example.org/foo@" + testDigest,
+		}),
+		Entry("tag and digest", "example.org/foo:v1@"+testDigest, Pinned{
+			Digested: "example.org/foo@" + testDigest,
+			Tagged:   "example.org/foo:v1@" + testDigest,
+		}),
+	)
+
+	It("should refuse pinning a reference to another digest", func() {
+		named, err := ParseNamed("example.org/foo@" + testDigest)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = Pin(named, digest.Digest("sha256:"+strings.Repeat("0", 64)))
+		Expect(err).To(MatchError(ContainSubstring("does not point to")))
+	})
+
+	It("should parse digests and identifiers in ParseAny", func() {
+		r, err := ParseAny(testDigest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.String()).To(Equal(testDigest))
+
+		r, err = ParseAny(testDigest[len("sha256:"):])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.String()).To(Equal(testDigest))
+	})
+})
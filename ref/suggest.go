@@ -0,0 +1,126 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ref
+
+import (
+	"sort"
+	"strings"
+)
+
+// MaxSuggestions is the maximum number of repositories SuggestRepositories returns.
+const MaxSuggestions = 3
+
+// SuggestRepositories returns the known repositories most similar to the given one, e.g. to suggest
+// them if it does not exist, most similar first. Repositories are fully qualified names without tag or
+// digest, see ParseNamed. A known repository is similar if the edit distance (counting a transposition
+// of adjacent characters as one edit) of the names is small relative to their length, or if it is on
+// the same registry and ends with a similar name, e.g. with an organization segment the given one
+// misses. The given repository itself is never suggested.
+// The suggestions are computed from the given names only, without any network access.
+func SuggestRepositories(repository string, known []string) []string {
+	type candidate struct {
+		name     string
+		distance int
+	}
+
+	var (
+		domain, path = splitDomain(repository)
+		last         = lastSegment(path)
+		seen         = make(map[string]bool)
+		candidates   []candidate
+	)
+	for _, name := range known {
+		if name == repository || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		distance := editDistance(repository, name)
+		if knownDomain, knownPath := splitDomain(name); knownDomain == domain && strings.Count(knownPath, "/") != strings.Count(path, "/") {
+			// A missing or superfluous segment counts as a single edit.
+			if d := editDistance(last, lastSegment(knownPath)) + 1; d < distance {
+				distance = d
+			}
+		}
+		if distance <= maxEditDistance(path) {
+			candidates = append(candidates, candidate{name: name, distance: distance})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].name < candidates[j].name
+	})
+	if len(candidates) > MaxSuggestions {
+		candidates = candidates[:MaxSuggestions]
+	}
+	res := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		res = append(res, c.name)
+	}
+	return res
+}
+
+func lastSegment(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// maxEditDistance is the maximum edit distance of similar repositories: one edit for short paths and
+// one more per 8 characters, up to 3.
+func maxEditDistance(path string) int {
+	d := 1 + len(path)/8
+	if d > 3 {
+		return 3
+	}
+	return d
+}
+
+// editDistance returns the optimal string alignment distance of a and b: the number of insertions,
+// deletions, substitutions and transpositions of adjacent bytes turning a into b.
+func editDistance(a, b string) int {
+	// rows i-2, i-1 and i of the distance matrix.
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = minInt(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+func minInt(v int, vs ...int) int {
+	for _, w := range vs {
+		if w < v {
+			v = w
+		}
+	}
+	return v
+}
@@ -0,0 +1,53 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ref_test
+
+import (
+	. "github.com/onmetal/onmetal-image/ref"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SuggestRepositories", func() {
+	known := []string{
+		"ghcr.io/onmetal/gardenlinux",
+		"ghcr.io/onmetal/onmetal-image",
+		"ghcr.io/onmetal/ipxe",
+		"docker.io/library/alpine",
+		"registry.example.com/team/gardenlinux",
+	}
+
+	DescribeTable("near misses",
+		func(repository string, expected []string) {
+			Expect(SuggestRepositories(repository, known)).To(Equal(expected))
+		},
+		Entry("missing character", "ghcr.io/onmetal/gardenlinx", []string{"ghcr.io/onmetal/gardenlinux"}),
+		Entry("transposed characters", "ghcr.io/onmetal/gardenlinxu", []string{"ghcr.io/onmetal/gardenlinux"}),
+		Entry("transposed characters in the organization", "ghcr.io/onmteal/onmetal-image", []string{"ghcr.io/onmetal/onmetal-image"}),
+		Entry("missing organization segment", "ghcr.io/gardenlinux", []string{"ghcr.io/onmetal/gardenlinux"}),
+		Entry("superfluous segment", "ghcr.io/onmetal/os/gardenlinux", []string{"ghcr.io/onmetal/gardenlinux"}),
+		Entry("typo in the registry", "ghcr.oi/onmetal/ipxe", []string{"ghcr.io/onmetal/ipxe"}),
+		Entry("transposed characters in an official image", "docker.io/library/alipne", []string{"docker.io/library/alpine"}),
+		Entry("unrelated repository", "ghcr.io/onmetal/metal-api", []string{}),
+		Entry("known repository", "ghcr.io/onmetal/ipxe", []string{}),
+		Entry("missing segment on another registry", "quay.io/gardenlinux", []string{}),
+	)
+
+	It("should rank the most similar repositories first and limit the suggestions", func() {
+		Expect(SuggestRepositories("example.org/app", []string{
+			"example.org/apps", "example.org/ap", "example.org/aqq", "example.org/team/app", "example.org/xpp",
+		})).To(Equal([]string{"example.org/ap", "example.org/apps", "example.org/team/app"}))
+	})
+})
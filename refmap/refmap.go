@@ -0,0 +1,137 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package refmap translates references to the digests of images already present in the local store,
+// e.g. with the translation files distributed to air-gapped sites, so pulling them needs no network access.
+package refmap
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/distribution/reference"
+	onmetalref "github.com/onmetal/onmetal-image/ref"
+	"github.com/opencontainers/go-digest"
+	"gopkg.in/yaml.v3"
+)
+
+// ResolvedFromAnnotation is the index entry annotation recording the source of the translation a
+// reference was pulled with, e.g. the path of a ref map file.
+const ResolvedFromAnnotation = "image.onmetal.de/resolved-from"
+
+// Resolution is the translation of a reference.
+type Resolution struct {
+	// Digest is the digest of the manifest the reference translates to.
+	Digest digest.Digest
+	// Source describes where the translation came from, see ResolvedFromAnnotation.
+	Source string
+}
+
+// Resolver translates references before they are resolved at their registry.
+type Resolver interface {
+	// Resolve returns the translation of the reference and whether the resolver has one.
+	Resolve(ctx context.Context, ref string) (Resolution, bool, error)
+}
+
+// ResolverFunc is a function implementing Resolver.
+type ResolverFunc func(ctx context.Context, ref string) (Resolution, bool, error)
+
+func (f ResolverFunc) Resolve(ctx context.Context, ref string) (Resolution, bool, error) {
+	return f(ctx, ref)
+}
+
+// Chain is a Resolver consulting its resolvers in order. The first one translating a reference wins.
+type Chain []Resolver
+
+func (c Chain) Resolve(ctx context.Context, ref string) (Resolution, bool, error) {
+	for _, r := range c {
+		res, ok, err := r.Resolve(ctx, ref)
+		if err != nil || ok {
+			return res, ok, err
+		}
+	}
+	return Resolution{}, false, nil
+}
+
+// File is a Resolver translating the references listed in a ref map file.
+type File struct {
+	source string
+	parser onmetalref.Parser
+	refs   map[string]digest.Digest
+}
+
+// ReadFile reads the ref map file at path, see Parse.
+func ReadFile(path string, parser onmetalref.Parser) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ref map: %w", err)
+	}
+	f, err := Parse(data, path, parser)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ref map %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Parse parses a ref map, a YAML mapping of references to manifest digests:
+//
+//	ghcr.io/onmetal/gardenlinux:v1: sha256:...
+//
+// The references are normalized with the parser, so they match however they are written when pulling.
+// The source is recorded on the translations, see Resolution.
+func Parse(data []byte, source string, parser onmetalref.Parser) (*File, error) {
+	var entries map[string]string
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("error decoding ref map: %w", err)
+	}
+
+	f := &File{source: source, parser: parser, refs: make(map[string]digest.Digest, len(entries))}
+	for ref, value := range entries {
+		dgst, err := digest.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest %q of %s: %w", value, ref, err)
+		}
+		name, err := f.normalize(ref)
+		if err != nil {
+			return nil, err
+		}
+		if existing, ok := f.refs[name]; ok && existing != dgst {
+			return nil, fmt.Errorf("%s is mapped to both %s and %s", name, existing, dgst)
+		}
+		f.refs[name] = dgst
+	}
+	return f, nil
+}
+
+func (f *File) normalize(ref string) (string, error) {
+	named, err := f.parser.ParseNamed(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid ref %s: %w", ref, err)
+	}
+	return reference.TagNameOnly(named).String(), nil
+}
+
+// Resolve returns the digest the reference is mapped to, if any.
+func (f *File) Resolve(_ context.Context, ref string) (Resolution, bool, error) {
+	name, err := f.normalize(ref)
+	if err != nil {
+		return Resolution{}, false, err
+	}
+	dgst, ok := f.refs[name]
+	if !ok {
+		return Resolution{}, false, nil
+	}
+	return Resolution{Digest: dgst, Source: f.source}, true, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package refmap_test
+
+import (
+	"context"
+
+	onmetalref "github.com/onmetal/onmetal-image/ref"
+	. "github.com/onmetal/onmetal-image/refmap"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	digestA = digest.Digest("sha256:a1db18dba462bcb46990df82ec6caad910753052714f83dff63a34a4e85958c9")
+	digestB = digest.Digest("sha256:b5b2b2c507a0944348e0303114d8d93aaaa081732b86451d9bce1f432a537bc7")
+)
+
+var _ = Describe("Refmap", func() {
+	ctx := context.Background()
+
+	Describe("File", func() {
+		It("should translate references however they are written", func() {
+			f, err := Parse([]byte(`
+ghcr.io/onmetal/gardenlinux:v1: `+digestA.String()+`
+alpine: `+digestB.String()+`
+`), "refs.yaml", onmetalref.Parser{})
+			Expect(err).NotTo(HaveOccurred())
+
+			res, ok, err := f.Resolve(ctx, "ghcr.io/onmetal/gardenlinux:v1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(res).To(Equal(Resolution{Digest: digestA, Source: "refs.yaml"}))
+
+			res, ok, err = f.Resolve(ctx, "docker.io/library/alpine:latest")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(res.Digest).To(Equal(digestB))
+
+			_, ok, err = f.Resolve(ctx, "ghcr.io/onmetal/gardenlinux:v2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should reject invalid digests and conflicting translations", func() {
+			_, err := Parse([]byte("alpine: latest\n"), "refs.yaml", onmetalref.Parser{})
+			Expect(err).To(MatchError(ContainSubstring("invalid digest")))
+
+			_, err = Parse([]byte("alpine: "+digestA.String()+"\ndocker.io/library/alpine: "+digestB.String()+"\n"), "refs.yaml", onmetalref.Parser{})
+			Expect(err).To(MatchError(ContainSubstring("is mapped to both")))
+		})
+	})
+
+	Describe("Chain", func() {
+		It("should return the translation of the first resolver having one", func() {
+			var consulted []string
+			resolver := func(name string, res *Resolution) Resolver {
+				return ResolverFunc(func(ctx context.Context, ref string) (Resolution, bool, error) {
+					consulted = append(consulted, name)
+					if res == nil {
+						return Resolution{}, false, nil
+					}
+					return *res, true, nil
+				})
+			}
+			chain := Chain{
+				resolver("first", nil),
+				resolver("second", &Resolution{Digest: digestA, Source: "second"}),
+				resolver("third", &Resolution{Digest: digestB, Source: "third"}),
+			}
+
+			res, ok, err := chain.Resolve(ctx, "alpine")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(res.Source).To(Equal("second"))
+			Expect(consulted).To(Equal([]string{"first", "second"}))
+		})
+	})
+})
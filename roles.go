@@ -0,0 +1,216 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package onmetalimage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/onmetal/onmetal-image/mediatypes"
+	"github.com/onmetal/onmetal-image/oci/image"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// RoleAnnotation is the layer annotation denoting the role of a layer among several layers of the same
+// kind, e.g. rootfs-a and rootfs-b of an image for an A/B partition scheme. See LayerRole.
+const RoleAnnotation = "image.onmetal.de/role"
+
+// ErrNoRoleLayer is matched by the image.LayerNotPresentError LayerByRole returns if an image has no layer
+// with the requested role.
+var ErrNoRoleLayer = errors.New("image has no layer with the requested role")
+
+// RoleKind returns the kind of the given role: Roles are either a kind, i.e. the role of a registered media
+// type (rootfs, initramfs, kernel, ignition, cloud-init, uki or esp for the built-in ones, see
+// mediatypes.Register), or a kind with a dash and a suffix, e.g. rootfs-b.
+func RoleKind(role string) (string, bool) {
+	if _, ok := mediatypes.LookupRole(role); ok {
+		return role, true
+	}
+	for _, kind := range mediatypes.Roles() {
+		if suffix, ok := strings.CutPrefix(role, kind+"-"); ok && suffix != "" {
+			return kind, true
+		}
+	}
+	return "", false
+}
+
+// RoleMediaType returns the layer media type of layers with the given role, see RoleKind.
+func RoleMediaType(role string) (string, bool) {
+	kind, ok := RoleKind(role)
+	if !ok {
+		return "", false
+	}
+	info, _ := mediatypes.LookupRole(kind)
+	return info.MediaType, true
+}
+
+// LayerRole returns the role of the layer with the given descriptor: its RoleAnnotation or, if it has
+// none, the kind of its media type. It is empty for unknown media types.
+func LayerRole(desc ocispec.Descriptor) string {
+	if role := desc.Annotations[RoleAnnotation]; role != "" {
+		return role
+	}
+	info, _ := mediatypes.Lookup(desc.MediaType)
+	return info.Role
+}
+
+// AvailableRoles returns the roles of the layers with the given descriptors in order, or the media type
+// for layers of unknown media types, e.g. to report which layers an image has.
+func AvailableRoles(layers []ocispec.Descriptor) []string {
+	res := make([]string, 0, len(layers))
+	for _, layer := range layers {
+		role := LayerRole(layer)
+		if role == "" {
+			role = layer.MediaType
+		}
+		res = append(res, role)
+	}
+	return res
+}
+
+// layerDescriptors returns the descriptors of the layers.
+func layerDescriptors(layers []image.Layer) []ocispec.Descriptor {
+	res := make([]ocispec.Descriptor, 0, len(layers))
+	for _, layer := range layers {
+		res = append(res, layer.Descriptor())
+	}
+	return res
+}
+
+// RoleLayer is a layer of an onmetal image along with its role.
+type RoleLayer struct {
+	// Role is the role of the layer, see LayerRole.
+	Role string
+	// Layer is the layer.
+	Layer image.Layer
+}
+
+// matchesRole reports whether a layer with the given role is selected by role: either both are equal or
+// role is a kind without suffix and layerRole is of that kind.
+func matchesRole(layerRole, role string) bool {
+	if layerRole == role {
+		return true
+	}
+	kind, _ := RoleKind(layerRole)
+	return kind == role
+}
+
+// LayersByRole returns the layers of the image with the given role in the order of the manifest, which is
+// the order consumers apply them in. A kind without suffix, e.g. rootfs, selects all layers of that kind,
+// e.g. both rootfs-a and rootfs-b.
+func (i *Image) LayersByRole(role string) []image.Layer {
+	var res []image.Layer
+	for _, layer := range i.Layers {
+		if matchesRole(layer.Role, role) {
+			res = append(res, layer.Layer)
+		}
+	}
+	return res
+}
+
+// LayerByRole returns the layer of the image with the given role. Unlike ResolveImage, the image does not
+// need to be a complete onmetal image. A kind without suffix selects the single layer of that kind or,
+// for rootfs, the default rootfs of the config if the image has several. It fails with an
+// image.LayerNotPresentError (matching ErrNoRoleLayer) if no layer matches and with an
+// image.AmbiguousLayerError if the role is ambiguous, e.g. because several layers have the role.
+func LayerByRole(ctx context.Context, img image.Image, role string) (image.Layer, error) {
+	kind, ok := RoleKind(role)
+	if !ok {
+		return nil, fmt.Errorf("unknown layer role %q", role)
+	}
+
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting image layers: %w", err)
+	}
+	var exact, candidates []RoleLayer
+	for _, layer := range layers {
+		layerRole := LayerRole(layer.Descriptor())
+		if layerRole == role {
+			exact = append(exact, RoleLayer{Role: layerRole, Layer: layer})
+		}
+		if matchesRole(layerRole, role) {
+			candidates = append(candidates, RoleLayer{Role: layerRole, Layer: layer})
+		}
+	}
+	if len(exact) > 0 {
+		candidates = exact
+	}
+
+	switch len(candidates) {
+	case 0:
+		info, _ := mediatypes.LookupRole(kind)
+		return nil, &image.LayerNotPresentError{
+			Digest:    img.Descriptor().Digest,
+			Role:      role,
+			MediaType: info.MediaType,
+			Available: AvailableRoles(layerDescriptors(layers)),
+			Err:       ErrNoRoleLayer,
+		}
+	case 1:
+		return candidates[0].Layer, nil
+	}
+	if role == "rootfs" && len(exact) == 0 {
+		if config, err := ReadConfig(ctx, img); err == nil && config.DefaultRootFS != "" {
+			for _, candidate := range candidates {
+				if candidate.Role == config.DefaultRootFS {
+					return candidate.Layer, nil
+				}
+			}
+		}
+	}
+	return nil, &image.AmbiguousLayerError{Digest: img.Descriptor().Digest, Role: role, Candidates: roles(candidates)}
+}
+
+// roles returns the sorted roles of the given layers.
+func roles(layers []RoleLayer) []string {
+	res := make([]string, 0, len(layers))
+	for _, layer := range layers {
+		res = append(res, layer.Role)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// resolveRootFS selects the rootfs layer of the single-rootfs accessors among the given ones: the default
+// rootfs of the config or, as before roles existed, the last one. Selecting the last one of several is
+// returned as warning.
+func resolveRootFS(config Config, rootFSs []RoleLayer) (image.Layer, string, error) {
+	if config.DefaultRootFS != "" {
+		if kind, _ := RoleKind(config.DefaultRootFS); kind != "rootfs" {
+			return nil, "", fmt.Errorf("default rootfs %q is no rootfs role", config.DefaultRootFS)
+		}
+		for _, layer := range rootFSs {
+			if layer.Role == config.DefaultRootFS {
+				return layer.Layer, "", nil
+			}
+		}
+		return nil, "", fmt.Errorf("config denotes default rootfs %s but the image has no such layer", config.DefaultRootFS)
+	}
+
+	switch len(rootFSs) {
+	case 0:
+		return nil, "", nil
+	case 1:
+		return rootFSs[0].Layer, "", nil
+	}
+	last := rootFSs[len(rootFSs)-1]
+	warning := fmt.Sprintf("image has %d rootfs layers (%s) but its config denotes no default rootfs, using the last one %s",
+		len(rootFSs), strings.Join(roles(rootFSs), ", "), last.Role)
+	return last.Layer, warning, nil
+}
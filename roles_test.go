@@ -0,0 +1,173 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package onmetalimage_test
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Roles", func() {
+	var ctx context.Context
+
+	rootFSLayer := func(role, data string) image.Layer {
+		opts := []imageutil.DescriptorOpt{imageutil.WithMediaType(RootFSLayerMediaType)}
+		if role != "" {
+			opts = append(opts, imageutil.WithAnnotations(map[string]string{RoleAnnotation: role}))
+		}
+		return imageutil.BytesLayer([]byte(data), opts...)
+	}
+
+	newImage := func(config Config, layers ...image.Layer) image.Image {
+		configLayer, err := imageutil.JSONValueLayer(config, imageutil.WithMediaType(ConfigMediaType))
+		Expect(err).NotTo(HaveOccurred())
+		img, err := imageutil.NewBuilder(configLayer).
+			Layers(append([]image.Layer{
+				imageutil.BytesLayer([]byte("kernel"), imageutil.WithMediaType(KernelLayerMediaType)),
+				imageutil.BytesLayer([]byte("initramfs"), imageutil.WithMediaType(InitRAMFSLayerMediaType)),
+			}, layers...)...).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+	})
+
+	It("should derive roles from the role annotation or the media type", func() {
+		kind := func(role string) string {
+			kind, _ := RoleKind(role)
+			return kind
+		}
+		Expect(kind("rootfs-b")).To(Equal("rootfs"))
+		Expect(kind("cloud-init-b")).To(Equal("cloud-init"))
+		Expect(kind("rootfs-")).To(BeEmpty())
+
+		Expect(LayerRole(rootFSLayer("rootfs-a", "a").Descriptor())).To(Equal("rootfs-a"))
+		Expect(LayerRole(rootFSLayer("", "a").Descriptor())).To(Equal("rootfs"))
+	})
+
+	It("should resolve images with several rootfs layers in apply order", func() {
+		img := newImage(Config{DefaultRootFS: "rootfs-a"}, rootFSLayer("rootfs-a", "a"), rootFSLayer("rootfs-b", "b"))
+
+		res, err := ResolveImage(ctx, img)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Warnings).To(BeEmpty())
+		Expect(imageutil.ReadLayerContent(ctx, res.RootFS)).To(Equal([]byte("a")))
+
+		rootFSs := res.LayersByRole("rootfs")
+		Expect(rootFSs).To(HaveLen(2))
+		Expect(imageutil.ReadLayerContent(ctx, rootFSs[1])).To(Equal([]byte("b")))
+		Expect(res.LayersByRole("rootfs-b")).To(Equal(rootFSs[1:]))
+		Expect(res.LayersByRole("kernel")).To(HaveLen(1))
+
+		By("selecting layers by role")
+		layer, err := LayerByRole(ctx, img, "rootfs-b")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layer.Descriptor()).To(Equal(rootFSs[1].Descriptor()))
+		layer, err = LayerByRole(ctx, img, "rootfs")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layer.Descriptor()).To(Equal(rootFSs[0].Descriptor()), "the default rootfs should be selected")
+		_, err = LayerByRole(ctx, img, "initramfs-b")
+		Expect(err).To(MatchError(ErrNoRoleLayer))
+	})
+
+	It("should warn about several rootfs layers without a default", func() {
+		img := newImage(Config{}, rootFSLayer("rootfs-a", "a"), rootFSLayer("rootfs-b", "b"))
+
+		res, err := ResolveImage(ctx, img)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Warnings).To(ConsistOf(ContainSubstring("no default rootfs")))
+		Expect(imageutil.ReadLayerContent(ctx, res.RootFS)).To(Equal([]byte("b")))
+
+		_, err = LayerByRole(ctx, img, "rootfs")
+		Expect(err).To(MatchError(ContainSubstring("rootfs-a, rootfs-b")))
+	})
+
+	It("should report missing and duplicate layers with dedicated errors", func() {
+		layer := func(mediaType, data string) image.Layer {
+			return imageutil.BytesLayer([]byte(data), imageutil.WithMediaType(mediaType))
+		}
+		build := func(layers ...image.Layer) image.Image {
+			configLayer, err := imageutil.JSONValueLayer(Config{}, imageutil.WithMediaType(ConfigMediaType))
+			Expect(err).NotTo(HaveOccurred())
+			img, err := imageutil.NewBuilder(configLayer).Layers(layers...).Complete()
+			Expect(err).NotTo(HaveOccurred())
+			return img
+		}
+
+		By("selecting from an image without layers")
+		img := build()
+		_, err := LayerByRole(ctx, img, "initramfs")
+		var notPresent *image.LayerNotPresentError
+		Expect(errors.As(err, &notPresent)).To(BeTrue())
+		Expect(notPresent.Digest).To(Equal(img.Descriptor().Digest))
+		Expect(notPresent.Role).To(Equal("initramfs"))
+		Expect(notPresent.MediaType).To(Equal(InitRAMFSLayerMediaType))
+		Expect(err).To(MatchError(image.ErrLayerNotPresent))
+		Expect(err).To(MatchError(ErrNoRoleLayer))
+		Expect(err).To(MatchError(ContainSubstring("has no initramfs layer; available layers: none")))
+		_, err = ResolveImage(ctx, img)
+		Expect(err).To(MatchError(image.ErrLayerNotPresent))
+		_, err = UKILayer(ctx, img)
+		Expect(err).To(MatchError(image.ErrLayerNotPresent))
+		Expect(err).To(MatchError(ErrNoUEFILayer))
+
+		By("selecting from an image with one layer per role")
+		img = build(layer(KernelLayerMediaType, "kernel"), layer(RootFSLayerMediaType, "rootfs"))
+		kernel, err := LayerByRole(ctx, img, "kernel")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imageutil.ReadLayerContent(ctx, kernel)).To(Equal([]byte("kernel")))
+		_, err = LayerByRole(ctx, img, "initramfs")
+		Expect(err).To(MatchError(ContainSubstring("has no initramfs layer; available layers: kernel, rootfs")))
+		_, err = ResolveImage(ctx, img)
+		Expect(errors.As(err, &notPresent)).To(BeTrue())
+		Expect(notPresent.Role).To(Equal("initramfs"))
+
+		By("selecting from an image with duplicate layers of a role")
+		img = build(layer(KernelLayerMediaType, "kernel a"), layer(KernelLayerMediaType, "kernel b"),
+			layer(InitRAMFSLayerMediaType, "initramfs"), layer(RootFSLayerMediaType, "rootfs"),
+			layer(UKILayerMediaType, "uki a"), layer(UKILayerMediaType, "uki b"))
+		_, err = LayerByRole(ctx, img, "kernel")
+		var ambiguous *image.AmbiguousLayerError
+		Expect(errors.As(err, &ambiguous)).To(BeTrue())
+		Expect(ambiguous.Role).To(Equal("kernel"))
+		Expect(ambiguous.Candidates).To(Equal([]string{"kernel", "kernel"}))
+		_, err = ResolveImage(ctx, img)
+		Expect(err).To(MatchError(image.ErrAmbiguousLayer))
+		_, err = UKILayer(ctx, img)
+		Expect(err).To(MatchError(image.ErrAmbiguousLayer))
+	})
+
+	It("should error on invalid roles", func() {
+		_, err := ResolveImage(ctx, newImage(Config{}, rootFSLayer("rootfs-a", "a"), rootFSLayer("rootfs-a", "b")))
+		Expect(err).To(MatchError(image.ErrAmbiguousLayer))
+
+		_, err = ResolveImage(ctx, newImage(Config{}, rootFSLayer("kernel-b", "a")))
+		Expect(err).To(MatchError(ContainSubstring("does not match its media type")))
+
+		_, err = ResolveImage(ctx, newImage(Config{DefaultRootFS: "rootfs-c"}, rootFSLayer("rootfs-a", "a")))
+		Expect(err).To(MatchError(ContainSubstring("no such layer")))
+	})
+})
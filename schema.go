@@ -0,0 +1,245 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package onmetalimage
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//go:generate go run ./hack/genschema -o config.schema.json -source image.go
+
+// ConfigSchemaVersion is the version of the config schema this version writes to Config.SchemaVersion and
+// validates against. It is bumped whenever fields are added to or constrained in Config.
+const ConfigSchemaVersion = 1
+
+//go:embed config.schema.json
+var configSchema []byte
+
+// ConfigSchema returns the JSON Schema of the config, generated from Config.
+func ConfigSchema() []byte {
+	return append([]byte(nil), configSchema...)
+}
+
+// FieldError is a violation of the config schema by the field at Pointer.
+type FieldError struct {
+	// Pointer is the JSON pointer (RFC 6901) to the offending field, empty for the document itself.
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	if e.Pointer == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Pointer, e.Message)
+}
+
+// ConfigValidationError is returned by ValidateConfigJSON if a config violates the config schema.
+type ConfigValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ConfigValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, fieldErr := range e.Errors {
+		msgs = append(msgs, fieldErr.Error())
+	}
+	return fmt.Sprintf("invalid config: %s", strings.Join(msgs, "; "))
+}
+
+// schema is the subset of JSON Schema the config schema is made of.
+type schema struct {
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Const                interface{}        `json:"const"`
+	Enum                 []interface{}      `json:"enum"`
+	Pattern              string             `json:"pattern"`
+	MaxLength            *int               `json:"maxLength"`
+
+	pattern *regexp.Regexp
+}
+
+func (s *schema) compile() error {
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("error compiling pattern %q: %w", s.Pattern, err)
+		}
+		s.pattern = pattern
+	}
+	for _, prop := range s.Properties {
+		if err := prop.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var configSchemaRoot = func() *schema {
+	s := &schema{}
+	if err := decodeJSON(configSchema, s); err != nil {
+		panic(fmt.Sprintf("error decoding config schema: %v", err))
+	}
+	if err := s.compile(); err != nil {
+		panic(fmt.Sprintf("error compiling config schema: %v", err))
+	}
+	return s
+}()
+
+func decodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after JSON value")
+	}
+	return nil
+}
+
+// validate appends the violations of the value at the given pointer to errs.
+func (s *schema) validate(pointer string, value interface{}, errs *[]FieldError) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, FieldError{Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			fail("must be an object")
+			return
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldPointer := pointer + "/" + escapePointer(key)
+			prop, ok := s.Properties[key]
+			switch {
+			case ok:
+				prop.validate(fieldPointer, obj[key], errs)
+			case s.AdditionalProperties != nil && !*s.AdditionalProperties:
+				*errs = append(*errs, FieldError{Pointer: fieldPointer, Message: "unknown field"})
+			}
+		}
+		return
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			fail("must be a string")
+			return
+		}
+		if s.MaxLength != nil && utf8.RuneCountInString(str) > *s.MaxLength {
+			fail("must be at most %d characters long", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			fail("must match pattern %s", s.Pattern)
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				fail("must be an RFC 3339 date-time")
+			}
+		}
+	case "integer":
+		num, ok := value.(json.Number)
+		if !ok {
+			fail("must be an integer")
+			return
+		}
+		if _, err := num.Int64(); err != nil {
+			fail("must be an integer")
+			return
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("must be a boolean")
+			return
+		}
+	}
+
+	if s.Const != nil && !reflect.DeepEqual(value, s.Const) {
+		fail("must be %v", s.Const)
+	}
+	if len(s.Enum) > 0 {
+		for _, allowed := range s.Enum {
+			if reflect.DeepEqual(value, allowed) {
+				return
+			}
+		}
+		allowed := make([]string, 0, len(s.Enum))
+		for _, value := range s.Enum {
+			allowed = append(allowed, fmt.Sprintf("%q", value))
+		}
+		fail("must be one of %s", strings.Join(allowed, ", "))
+	}
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+func escapePointer(token string) string {
+	return pointerEscaper.Replace(token)
+}
+
+// ValidateConfigJSON validates the given config document against the config schema (see ConfigSchema) and
+// the constraints the schema cannot express, e.g. the byte length of the command line. Violations are
+// returned as *ConfigValidationError.
+func ValidateConfigJSON(data []byte) error {
+	var value interface{}
+	if err := decodeJSON(data, &value); err != nil {
+		return &ConfigValidationError{Errors: []FieldError{{Message: fmt.Sprintf("invalid JSON: %v", err)}}}
+	}
+
+	var errs []FieldError
+	configSchemaRoot.validate("", value, &errs)
+	if len(errs) > 0 {
+		return &ConfigValidationError{Errors: errs}
+	}
+
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return &ConfigValidationError{Errors: []FieldError{{Message: fmt.Sprintf("error decoding config: %v", err)}}}
+	}
+	if err := ValidateCommandLine(config.CommandLine); err != nil {
+		errs = append(errs, FieldError{Pointer: "/commandLine", Message: err.Error()})
+	}
+	if len(errs) > 0 {
+		return &ConfigValidationError{Errors: errs}
+	}
+	return nil
+}
+
+// ValidateConfig validates the given config like ValidateConfigJSON validates its JSON encoding.
+func ValidateConfig(config *Config) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("error encoding config: %w", err)
+	}
+	return ValidateConfigJSON(data)
+}
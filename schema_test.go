@@ -0,0 +1,90 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package onmetalimage_test
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	. "github.com/onmetal/onmetal-image"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Schema", func() {
+	fieldErrors := func(err error) []FieldError {
+		var validationErr *ConfigValidationError
+		ExpectWithOffset(1, err).To(BeAssignableToTypeOf(validationErr))
+		return err.(*ConfigValidationError).Errors
+	}
+
+	It("should embed the schema of the current schema version", func() {
+		var schema struct {
+			Properties map[string]struct {
+				Const int `json:"const"`
+			} `json:"properties"`
+		}
+		Expect(json.Unmarshal(ConfigSchema(), &schema)).To(Succeed())
+		Expect(schema.Properties).To(HaveKey("commandLine"))
+		Expect(schema.Properties["schemaVersion"].Const).To(Equal(ConfigSchemaVersion))
+	})
+
+	It("should accept valid configs and configs without schema version", func() {
+		created := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+		Expect(ValidateConfig(&Config{
+			SchemaVersion: ConfigSchemaVersion,
+			CommandLine:   "console=ttyS0",
+			Provisioning:  ProvisioningIgnition,
+			BootMethod:    BootMethodUKI,
+			DefaultRootFS: "rootfs-b",
+			Created:       &created,
+		})).To(Succeed())
+		Expect(ValidateConfigJSON([]byte(`{"commandLine":"quiet","bootMethod":""}`))).To(Succeed())
+	})
+
+	It("should report the violations with JSON pointers to the offending fields", func() {
+		err := ValidateConfigJSON([]byte(`{
+			"schemaVersion": 2,
+			"commandLine": 42,
+			"bootMethod": "pxe",
+			"defaultRootFS": "kernel",
+			"created": "yesterday",
+			"foo/bar": true
+		}`))
+		Expect(err).To(HaveOccurred())
+		Expect(fieldErrors(err)).To(ConsistOf(
+			HaveField("Pointer", "/schemaVersion"),
+			HaveField("Pointer", "/commandLine"),
+			HaveField("Pointer", "/bootMethod"),
+			HaveField("Pointer", "/defaultRootFS"),
+			HaveField("Pointer", "/created"),
+			FieldError{Pointer: "/foo~1bar", Message: "unknown field"},
+		))
+	})
+
+	It("should report command lines exceeding the maximum length in bytes", func() {
+		err := ValidateConfig(&Config{CommandLine: strings.Repeat("ä", MaxCommandLineLength/2+1)})
+		Expect(fieldErrors(err)).To(ConsistOf(HaveField("Pointer", "/commandLine")))
+
+		err = ValidateConfig(&Config{CommandLine: "quiet\n"})
+		Expect(fieldErrors(err)).To(ConsistOf(HaveField("Pointer", "/commandLine")))
+	})
+
+	It("should report documents that are no JSON object", func() {
+		Expect(fieldErrors(ValidateConfigJSON([]byte(`[]`)))).To(ConsistOf(FieldError{Message: "must be an object"}))
+		Expect(fieldErrors(ValidateConfigJSON([]byte(`{`)))).To(HaveLen(1))
+	})
+})
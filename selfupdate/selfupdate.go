@@ -0,0 +1,312 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package selfupdate updates the onmetal-image binary from its releases.
+//
+// A release consists of one binary per platform named onmetal-image-<os>-<arch> (with an .exe suffix on
+// windows), a SHA256SUMS file in the format of sha256sum listing their checksums, and SHA256SUMS.sig, the
+// base64 encoded ed25519 signature of SHA256SUMS. A channel is a release whose VERSION asset names the
+// release it currently points to. The stable channel is the latest release.
+//
+// The public key verifying the signature is embedded at build time via ldflags, e.g.
+//
+//	go build -ldflags "-X github.com/onmetal/onmetal-image/selfupdate.PublicKey=<base64 ed25519 public key>"
+package selfupdate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PublicKey is the base64 encoded ed25519 public key release checksums are signed with.
+var PublicKey = ""
+
+const (
+	// DefaultBaseURL is the URL of the onmetal-image GitHub releases.
+	DefaultBaseURL = "https://github.com/onmetal/onmetal-image/releases"
+	// DefaultChannel is the channel updates are fetched from by default.
+	DefaultChannel = "stable"
+
+	checksumsAsset = "SHA256SUMS"
+	signatureAsset = "SHA256SUMS.sig"
+	versionAsset   = "VERSION"
+
+	// maxMetadataSize bounds the size of the VERSION, SHA256SUMS and SHA256SUMS.sig assets.
+	maxMetadataSize = 1 << 20
+)
+
+var (
+	// ErrNoPublicKey is returned if no public key to verify releases with is configured.
+	ErrNoPublicKey = errors.New("no release public key configured")
+	// ErrInvalidSignature is returned if the signature of the checksums of a release does not verify.
+	ErrInvalidSignature = errors.New("invalid release signature")
+	// ErrChecksumMismatch is returned if a downloaded binary does not match its signed checksum.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// ParsePublicKey parses a base64 encoded ed25519 public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	if s == "" {
+		return nil, ErrNoPublicKey
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding public key: %w", err)
+	}
+	if len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key size %d, expected %d", len(data), ed25519.PublicKeySize)
+	}
+	return data, nil
+}
+
+// AssetName returns the name of the release binary for the given platform.
+func AssetName(goos, goarch string) string {
+	name := fmt.Sprintf("onmetal-image-%s-%s", goos, goarch)
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// Updater fetches and verifies onmetal-image releases.
+type Updater struct {
+	// BaseURL is the URL releases are fetched from, laid out like GitHub releases. Defaults to DefaultBaseURL.
+	BaseURL string
+	// Client is the http.Client to fetch releases with. Defaults to http.DefaultClient.
+	Client *http.Client
+	// PublicKey is the key verifying the signature of the release checksums. Required.
+	PublicKey ed25519.PublicKey
+	// OS and Arch are the platform to fetch the binary for. Default to the current platform.
+	OS, Arch string
+}
+
+func (u *Updater) baseURL() string {
+	if u.BaseURL != "" {
+		return strings.TrimSuffix(u.BaseURL, "/")
+	}
+	return DefaultBaseURL
+}
+
+func (u *Updater) client() *http.Client {
+	if u.Client != nil {
+		return u.Client
+	}
+	return http.DefaultClient
+}
+
+func (u *Updater) assetName() string {
+	goos, goarch := u.OS, u.Arch
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+	return AssetName(goos, goarch)
+}
+
+// assetURL returns the URL of the asset of the release with the given tag.
+func (u *Updater) assetURL(tag, asset string) string {
+	return fmt.Sprintf("%s/download/%s/%s", u.baseURL(), tag, asset)
+}
+
+// get fetches the given URL. The caller is responsible for closing the returned body.
+func (u *Updater) get(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := u.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s: %w", url, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("erroneous response status: %s for url %s", res.Status, url)
+	}
+	return res.Body, nil
+}
+
+// getSmall fetches the given URL, failing if its content exceeds maxMetadataSize.
+func (u *Updater) getSmall(ctx context.Context, url string) ([]byte, error) {
+	body, err := u.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = body.Close() }()
+
+	data, err := io.ReadAll(io.LimitReader(body, maxMetadataSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", url, err)
+	}
+	if len(data) > maxMetadataSize {
+		return nil, fmt.Errorf("%s exceeds %d bytes", url, maxMetadataSize)
+	}
+	return data, nil
+}
+
+// Latest returns the version the given channel currently points to.
+func (u *Updater) Latest(ctx context.Context, channel string) (string, error) {
+	url := u.assetURL(channel, versionAsset)
+	if channel == DefaultChannel {
+		url = fmt.Sprintf("%s/latest/download/%s", u.baseURL(), versionAsset)
+	}
+
+	data, err := u.getSmall(ctx, url)
+	if err != nil {
+		return "", fmt.Errorf("error getting version of channel %s: %w", channel, err)
+	}
+	v := strings.TrimSpace(string(data))
+	if v == "" || strings.ContainsAny(v, "/ \t\n") {
+		return "", fmt.Errorf("invalid version %q of channel %s", v, channel)
+	}
+	return v, nil
+}
+
+// checksum returns the signed checksum of the binary of the given release.
+func (u *Updater) checksum(ctx context.Context, version string) ([]byte, error) {
+	if len(u.PublicKey) == 0 {
+		return nil, ErrNoPublicKey
+	}
+
+	sums, err := u.getSmall(ctx, u.assetURL(version, checksumsAsset))
+	if err != nil {
+		return nil, err
+	}
+	sig, err := u.getSmall(ctx, u.assetURL(version, signatureAsset))
+	if err != nil {
+		return nil, err
+	}
+	rawSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: error decoding signature: %v", ErrInvalidSignature, err)
+	}
+	if !ed25519.Verify(u.PublicKey, sums, rawSig) {
+		return nil, fmt.Errorf("%w for checksums of %s", ErrInvalidSignature, version)
+	}
+
+	asset := u.assetName()
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.TrimPrefix(fields[1], "*") != asset {
+			continue
+		}
+		sum, err := hex.DecodeString(fields[0])
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid checksum of %s in %s", asset, checksumsAsset)
+		}
+		return sum, nil
+	}
+	return nil, fmt.Errorf("release %s has no binary %s", version, asset)
+}
+
+// Download downloads the binary of the given release to a new executable file in dir, verifying it
+// against the signed checksums of the release. It returns the path of the file, which is removed again
+// if the download fails.
+func (u *Updater) Download(ctx context.Context, version, dir string) (path string, retErr error) {
+	sum, err := u.checksum(ctx, version)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := u.get(ctx, u.assetURL(version, u.assetName()))
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = body.Close() }()
+
+	f, err := os.CreateTemp(dir, ".onmetal-image-update-*")
+	if err != nil {
+		return "", fmt.Errorf("error creating file: %w", err)
+	}
+	defer func() {
+		if retErr != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	expected := digest.NewDigestFromBytes(digest.SHA256, sum)
+	if _, err := ioutils.CopyVerify(ctx, f, body, ocispec.Descriptor{Digest: expected}); err != nil {
+		if errors.Is(err, ioutils.ErrDigestMismatch) {
+			return "", fmt.Errorf("%w: %s of %s: %v", ErrChecksumMismatch, u.assetName(), version, err)
+		}
+		return "", fmt.Errorf("error downloading %s: %w", u.assetName(), err)
+	}
+	if err := f.Chmod(0755); err != nil {
+		return "", fmt.Errorf("error making %s executable: %w", f.Name(), err)
+	}
+	if err := f.Sync(); err != nil {
+		return "", fmt.Errorf("error syncing %s: %w", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("error closing %s: %w", f.Name(), err)
+	}
+	return f.Name(), nil
+}
+
+// Replace atomically replaces the executable with the file at path, which has to be on the same file
+// system. The original is kept until check, e.g. running the new binary, succeeds and restored otherwise.
+// A nil check skips verifying the new executable.
+func Replace(executable, path string, check func(executable string) error) error {
+	fi, err := os.Stat(executable)
+	if err != nil {
+		return fmt.Errorf("error checking executable: %w", err)
+	}
+	if err := os.Chmod(path, fi.Mode().Perm()); err != nil {
+		return fmt.Errorf("error setting mode of new executable: %w", err)
+	}
+
+	backup := filepath.Join(filepath.Dir(executable), "."+filepath.Base(executable)+".old")
+	if err := os.Rename(executable, backup); err != nil {
+		return fmt.Errorf("error backing up executable: %w", err)
+	}
+	if err := os.Rename(path, executable); err != nil {
+		if rollbackErr := os.Rename(backup, executable); rollbackErr != nil {
+			return fmt.Errorf("error replacing executable: %w; restoring the original from %s failed: %v", err, backup, rollbackErr)
+		}
+		return fmt.Errorf("error replacing executable: %w", err)
+	}
+
+	if check != nil {
+		if err := check(executable); err != nil {
+			if rollbackErr := os.Rename(backup, executable); rollbackErr != nil {
+				return fmt.Errorf("new executable failed its check: %w; restoring the original from %s failed: %v", err, backup, rollbackErr)
+			}
+			return fmt.Errorf("new executable failed its check, restored the original: %w", err)
+		}
+	}
+
+	// Removing the backup fails on windows while the original is still running, which is harmless.
+	_ = os.Remove(backup)
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selfupdate_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onmetal/onmetal-image/selfupdate"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Updater", func() {
+	var (
+		ctx     = context.Background()
+		assets  map[string][]byte
+		server  *httptest.Server
+		updater *Updater
+		private ed25519.PrivateKey
+	)
+
+	asset := AssetName("linux", "amd64")
+
+	publish := func(version string, binary []byte) {
+		sums := []byte(fmt.Sprintf("%x  %s\n%x  %s\n", sha256.Sum256([]byte("other")), AssetName("darwin", "arm64"), sha256.Sum256(binary), asset))
+		assets["/download/"+version+"/"+asset] = binary
+		assets["/download/"+version+"/SHA256SUMS"] = sums
+		assets["/download/"+version+"/SHA256SUMS.sig"] = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(private, sums)))
+	}
+
+	BeforeEach(func() {
+		var (
+			public ed25519.PublicKey
+			err    error
+		)
+		public, private, err = ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+
+		assets = make(map[string][]byte)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			data, ok := assets[req.URL.Path]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			_, _ = w.Write(data)
+		}))
+		DeferCleanup(server.Close)
+
+		updater = &Updater{BaseURL: server.URL, PublicKey: public, OS: "linux", Arch: "amd64"}
+	})
+
+	It("should resolve the version of a channel", func() {
+		assets["/latest/download/VERSION"] = []byte("v1.2.3\n")
+		assets["/download/beta/VERSION"] = []byte("v1.3.0-rc.1\n")
+
+		Expect(updater.Latest(ctx, DefaultChannel)).To(Equal("v1.2.3"))
+		Expect(updater.Latest(ctx, "beta")).To(Equal("v1.3.0-rc.1"))
+		_, err := updater.Latest(ctx, "unknown")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should download and verify a release binary", func() {
+		publish("v1.2.3", []byte("binary"))
+
+		path, err := updater.Download(ctx, "v1.2.3", GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.ReadFile(path)).To(Equal([]byte("binary")))
+		fi, err := os.Stat(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fi.Mode().Perm() & 0100).NotTo(BeZero())
+	})
+
+	It("should reject checksums signed with another key", func() {
+		publish("v1.2.3", []byte("binary"))
+		other, _, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		updater.PublicKey = other
+
+		dir := GinkgoT().TempDir()
+		_, err = updater.Download(ctx, "v1.2.3", dir)
+		Expect(err).To(MatchError(ErrInvalidSignature))
+		Expect(os.ReadDir(dir)).To(BeEmpty())
+	})
+
+	It("should reject a binary not matching its checksum", func() {
+		publish("v1.2.3", []byte("binary"))
+		assets["/download/v1.2.3/"+asset] = []byte("tampered")
+
+		dir := GinkgoT().TempDir()
+		_, err := updater.Download(ctx, "v1.2.3", dir)
+		Expect(err).To(MatchError(ErrChecksumMismatch))
+		Expect(os.ReadDir(dir)).To(BeEmpty())
+	})
+
+	It("should require a public key", func() {
+		publish("v1.2.3", []byte("binary"))
+		updater.PublicKey = nil
+
+		_, err := updater.Download(ctx, "v1.2.3", GinkgoT().TempDir())
+		Expect(err).To(MatchError(ErrNoPublicKey))
+	})
+})
+
+var _ = Describe("Replace", func() {
+	var executable, path string
+
+	BeforeEach(func() {
+		dir := GinkgoT().TempDir()
+		executable = filepath.Join(dir, "onmetal-image")
+		path = filepath.Join(dir, "new")
+		Expect(os.WriteFile(executable, []byte("old"), 0755)).To(Succeed())
+		Expect(os.WriteFile(path, []byte("new"), 0600)).To(Succeed())
+	})
+
+	It("should replace the executable", func() {
+		Expect(Replace(executable, path, func(string) error { return nil })).To(Succeed())
+		Expect(os.ReadFile(executable)).To(Equal([]byte("new")))
+		fi, err := os.Stat(executable)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fi.Mode().Perm()).To(Equal(os.FileMode(0755)))
+		Expect(os.ReadDir(filepath.Dir(executable))).To(HaveLen(1))
+	})
+
+	It("should restore the original if the check fails", func() {
+		Expect(Replace(executable, path, func(string) error { return errors.New("broken") })).To(MatchError(ContainSubstring("broken")))
+		Expect(os.ReadFile(executable)).To(Equal([]byte("old")))
+		Expect(os.ReadDir(filepath.Dir(executable))).To(HaveLen(1))
+	})
+})
+
+var _ = DescribeTable("Newer",
+	func(candidate, current string, newer bool) {
+		Expect(Newer(candidate, current)).To(Equal(newer))
+	},
+	Entry("newer patch", "v1.2.4", "v1.2.3", true),
+	Entry("newer minor", "v1.10.0", "v1.9.9", true),
+	Entry("older", "v1.2.3", "v1.3.0", false),
+	Entry("equal", "v1.2.3", "1.2.3", false),
+	Entry("release of a pre-release", "v1.2.3", "v1.2.3-rc.1", true),
+	Entry("pre-release of a release", "v1.2.3-rc.1", "v1.2.3", false),
+	Entry("development build", "v1.2.3", "dev", true),
+)
@@ -0,0 +1,69 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selfupdate
+
+import (
+	"strconv"
+	"strings"
+)
+
+// parseVersion parses a semantic version of the form [v]MAJOR.MINOR.PATCH[-PRERELEASE][+BUILD].
+func parseVersion(v string) (core [3]int, prerelease string, ok bool) {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexByte(v, '+'); i >= 0 {
+		v = v[:i]
+	}
+	v, prerelease, _ = strings.Cut(v, "-")
+
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return core, "", false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return core, "", false
+		}
+		core[i] = n
+	}
+	return core, prerelease, true
+}
+
+// Newer reports whether version candidate is newer than current. If either is no semantic version,
+// e.g. a development build, candidate counts as newer if it differs from current.
+func Newer(candidate, current string) bool {
+	candidateCore, candidatePre, ok1 := parseVersion(candidate)
+	currentCore, currentPre, ok2 := parseVersion(current)
+	if !ok1 || !ok2 {
+		return strings.TrimPrefix(candidate, "v") != strings.TrimPrefix(current, "v")
+	}
+
+	for i := range candidateCore {
+		if candidateCore[i] != currentCore[i] {
+			return candidateCore[i] > currentCore[i]
+		}
+	}
+	// A release is newer than its pre-releases. Pre-releases are compared lexically for simplicity.
+	switch {
+	case candidatePre == currentPre:
+		return false
+	case candidatePre == "":
+		return true
+	case currentPre == "":
+		return false
+	default:
+		return candidatePre > currentPre
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fixtures builds synthetic onmetal images, artifacts and image indexes with deterministic content
+// for tests, and installs them into layouts and the registry harness (see registryharness). The built images
+// are held in memory, so they can be used wherever an image.Image is expected without any store. Images
+// without compressed layers have stable digests, the golden ones of the predefined fixtures are constants.
+package fixtures
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/mediatypes"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/indexer"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	"github.com/onmetal/onmetal-image/testing/registryharness"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Content returns size bytes of pseudo-random content derived from seed. The same seed and size always
+// yield the same content, content of different seeds does not compress.
+func Content(seed string, size int) []byte {
+	res := make([]byte, 0, size+sha256.Size)
+	var block [8]byte
+	for i := uint64(0); len(res) < size; i++ {
+		binary.BigEndian.PutUint64(block[:], i)
+		sum := sha256.Sum256(append([]byte(seed), block[:]...))
+		res = append(res, sum[:]...)
+	}
+	return res[:size]
+}
+
+// TarContent returns a tar archive of the given number of regular files holding size bytes of content in
+// total (rounded down to a multiple of files), generated from seed like Content, e.g. as content of a
+// rootfs layer to unpack. The files are spread over one directory per 16 files.
+func TarContent(seed string, size, files int) ([]byte, error) {
+	if files < 1 {
+		files = 1
+	}
+	var (
+		buf      bytes.Buffer
+		w        = tar.NewWriter(&buf)
+		fileSize = size / files
+		dirs     = make(map[string]bool)
+	)
+	for i := 0; i < files; i++ {
+		dir := fmt.Sprintf("dir-%d", i/16)
+		if !dirs[dir] {
+			dirs[dir] = true
+			if err := w.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0755}); err != nil {
+				return nil, err
+			}
+		}
+		name := fmt.Sprintf("%s/file-%d", dir, i)
+		data := Content(seed+"/"+name, fileSize)
+		if err := w.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Compression is the compression a fixture layer is stored with.
+type Compression string
+
+const (
+	// Uncompressed stores the layer content verbatim.
+	Uncompressed Compression = ""
+	// Gzip stores the layer gzip compressed with a GzipMediaTypeSuffix on its media type.
+	Gzip Compression = "gzip"
+	// Zstd stores the layer zstd compressed with a ZstdMediaTypeSuffix on its media type.
+	Zstd Compression = "zstd"
+)
+
+// Layer is a layer of a fixture Image.
+type Layer struct {
+	// Role is the role of the layer, e.g. rootfs, rootfs-b or a registered custom layer kind, see
+	// onmetalimage.RoleKind. Layers with a suffixed role carry the onmetalimage.RoleAnnotation.
+	Role string
+	// Content is the uncompressed content of the layer. If nil, Size bytes of content are generated from
+	// the seed of the image and the role, see Content.
+	Content []byte
+	// Size is the size of the generated content.
+	Size int
+	// Compression is the compression the layer is stored with. Compressed layers have no golden digests
+	// as the compressors may change their output.
+	Compression Compression
+	// Annotations are set on the layer descriptor.
+	Annotations map[string]string
+}
+
+// Image describes a synthetic onmetal image.
+type Image struct {
+	// Seed tells the generated content of images with otherwise equal layers apart.
+	Seed string
+	// Config is the onmetal image config.
+	Config onmetalimage.Config
+	// Layers are the layers of the image, in order.
+	Layers []Layer
+	// Annotations are set on the manifest.
+	Annotations map[string]string
+}
+
+// Build builds the image in memory.
+func (i Image) Build() (ociimage.Image, error) {
+	b := imageutil.NewJSONConfigBuilder(&i.Config, imageutil.WithMediaType(onmetalimage.ConfigMediaType))
+	for _, l := range i.Layers {
+		kind, ok := onmetalimage.RoleKind(l.Role)
+		if !ok {
+			return nil, fmt.Errorf("unknown layer role %q", l.Role)
+		}
+		info, _ := mediatypes.LookupRole(kind)
+
+		content := l.Content
+		if content == nil {
+			content = Content(i.Seed+"/"+l.Role, l.Size)
+		}
+		data, suffix, err := compress(content, l.Compression)
+		if err != nil {
+			return nil, fmt.Errorf("error compressing %s layer: %w", l.Role, err)
+		}
+
+		annotations := make(map[string]string, len(l.Annotations)+1)
+		if l.Role != kind {
+			annotations[onmetalimage.RoleAnnotation] = l.Role
+		}
+		for key, value := range l.Annotations {
+			annotations[key] = value
+		}
+		if len(annotations) == 0 {
+			annotations = nil
+		}
+		b = b.BytesLayer(data, imageutil.WithMediaType(info.MediaType+suffix), imageutil.WithAnnotations(annotations))
+	}
+	return b.Annotations(i.Annotations).Complete()
+}
+
+func compress(data []byte, compression Compression) ([]byte, string, error) {
+	var buf bytes.Buffer
+	switch compression {
+	case Uncompressed:
+		return data, "", nil
+	case Gzip:
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, "", err
+		}
+		if err := w.Close(); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), onmetalimage.GzipMediaTypeSuffix, nil
+	case Zstd:
+		w, err := zstd.NewWriter(&buf, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, "", err
+		}
+		if err := w.Close(); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), onmetalimage.ZstdMediaTypeSuffix, nil
+	default:
+		return nil, "", fmt.Errorf("unknown compression %q", compression)
+	}
+}
+
+// Artifact describes a synthetic artifact with a single blob, optionally referring to a subject, e.g. a
+// signature of an image.
+type Artifact struct {
+	// ArtifactType is the artifact type of the manifest.
+	ArtifactType string
+	// MediaType is the media type of the blob.
+	MediaType string
+	// Seed is the seed the content of the blob is generated from.
+	Seed string
+	// Size is the size of the blob.
+	Size int
+	// Subject is the manifest the artifact refers to, if any.
+	Subject *ocispec.Descriptor
+	// Annotations are set on the manifest.
+	Annotations map[string]string
+}
+
+// Build builds the artifact in memory.
+func (a Artifact) Build(ctx context.Context) (ociimage.Image, error) {
+	img, err := imageutil.NewArtifactBuilder(a.ArtifactType).
+		BytesLayer(Content(a.Seed, a.Size), imageutil.WithMediaType(a.MediaType)).
+		Annotations(a.Annotations).
+		Complete()
+	if err != nil || a.Subject == nil {
+		return img, err
+	}
+
+	subject := *a.Subject
+	return imageutil.TransformManifest(ctx, img, func(manifest ocispec.Manifest) (ocispec.Manifest, error) {
+		manifest.Subject = &subject
+		return manifest, nil
+	})
+}
+
+// IndexEntry is an image of a fixture image index and the platform it is for.
+type IndexEntry struct {
+	Platform ocispec.Platform
+	Image    ociimage.Image
+}
+
+// Index is an image index built by BuildIndex.
+type Index struct {
+	// Descriptor is the descriptor of the index document.
+	Descriptor ocispec.Descriptor
+	// Data is the index document.
+	Data []byte
+	// Images are the images of the index, in order.
+	Images []ociimage.Image
+}
+
+// BuildIndex builds an image index of the entries.
+func BuildIndex(entries ...IndexEntry) (*Index, error) {
+	index := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+	}
+	res := &Index{}
+	for _, entry := range entries {
+		desc := entry.Image.Descriptor()
+		platform := entry.Platform
+		desc.Platform = &platform
+		index.Manifests = append(index.Manifests, desc)
+		res.Images = append(res.Images, entry.Image)
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling index: %w", err)
+	}
+	res.Data = data
+	res.Descriptor = ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	return res, nil
+}
+
+// MultiArch builds an index of the image for each of the platforms, e.g. linux/amd64. The images of the
+// platforms have different content, derived from the seed of the image and the platform.
+func MultiArch(img Image, platforms ...ocispec.Platform) (*Index, error) {
+	entries := make([]IndexEntry, 0, len(platforms))
+	for _, platform := range platforms {
+		platformImg := img
+		platformImg.Seed = fmt.Sprintf("%s/%s/%s%s", img.Seed, platform.OS, platform.Architecture, platform.Variant)
+		built, err := platformImg.Build()
+		if err != nil {
+			return nil, fmt.Errorf("error building image for %s/%s: %w", platform.OS, platform.Architecture, err)
+		}
+		entries = append(entries, IndexEntry{Platform: platform, Image: built})
+	}
+	return BuildIndex(entries...)
+}
+
+// AddToLayout adds the image to the layout with the given reference name, or untagged if name is empty.
+func AddToLayout(ctx context.Context, l *layout.Layout, name string, img ociimage.Image) error {
+	if err := l.AddImage(ctx, img); err != nil {
+		return err
+	}
+	if name == "" {
+		return nil
+	}
+	return l.Indexer().Update(ctx, descriptormatcher.Digests(img.Descriptor().Digest), func(desc ocispec.Descriptor) ocispec.Descriptor {
+		return indexer.WithAnnotation(desc, ocispec.AnnotationRefName, name)
+	})
+}
+
+// SeedIndex stores the index with all its images in the repository of the registry and tags the index,
+// if tag is not empty.
+func SeedIndex(ctx context.Context, registry *registryharness.Registry, repository, tag string, index *Index) error {
+	for _, img := range index.Images {
+		if err := registry.Seed(ctx, repository, "", img); err != nil {
+			return err
+		}
+	}
+	registry.SeedManifest(repository, tag, ocispec.MediaTypeImageIndex, index.Data)
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fixtures_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/oci/descriptormatcher"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/oci/layout"
+	. "github.com/onmetal/onmetal-image/testing/fixtures"
+	"github.com/onmetal/onmetal-image/testing/registryharness"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Fixtures", func() {
+	var ctx context.Context
+
+	BeforeEach(func() {
+		ctx = context.Background()
+	})
+
+	It("should generate deterministic content", func() {
+		Expect(Content("seed", 100)).To(HaveLen(100))
+		Expect(Content("seed", 100)).To(Equal(Content("seed", 100)))
+		Expect(Content("seed", 10)).To(Equal(Content("seed", 100)[:10]))
+		Expect(Content("other", 100)).NotTo(Equal(Content("seed", 100)))
+	})
+
+	It("should generate deterministic tar archives", func() {
+		data, err := TarContent("seed", 40<<10, 20)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(TarContent("seed", 40<<10, 20)).To(Equal(data))
+
+		var (
+			r     = tar.NewReader(bytes.NewReader(data))
+			files int
+			size  int64
+		)
+		for {
+			hdr, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			Expect(err).NotTo(HaveOccurred())
+			if hdr.Typeflag == tar.TypeReg {
+				files++
+				size += hdr.Size
+			}
+		}
+		Expect(files).To(Equal(20))
+		Expect(size).To(BeEquivalentTo(40 << 10))
+	})
+
+	// The golden digests must only change on intended changes, as tests assert them.
+	It("should produce the golden digests", func() {
+		img, err := Bootable().Build()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(img.Descriptor().Digest).To(Equal(BootableDigest))
+		config, err := img.Config(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Descriptor().Digest).To(Equal(BootableConfigDigest))
+		rootFS, err := onmetalimage.LayerByRole(ctx, img, "rootfs")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rootFS.Descriptor().Digest).To(Equal(BootableRootFSDigest))
+		Expect(rootFS.Descriptor().Size).To(BeEquivalentTo(4 << 10))
+
+		img, err = RootFS("v1").Build()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(img.Descriptor().Digest).To(Equal(RootFSV1Digest))
+	})
+
+	It("should build layers with roles and compression", func() {
+		img, err := Image{Seed: "layers", Layers: []Layer{
+			{Role: "rootfs-a", Size: 512, Compression: Gzip},
+			{Role: "rootfs-b", Size: 512, Compression: Zstd},
+		}}.Build()
+		Expect(err).NotTo(HaveOccurred())
+
+		layers, err := img.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layers).To(HaveLen(2))
+		Expect(layers[0].Descriptor().MediaType).To(Equal(onmetalimage.RootFSLayerMediaType + onmetalimage.GzipMediaTypeSuffix))
+		Expect(layers[0].Descriptor().Annotations).To(HaveKeyWithValue(onmetalimage.RoleAnnotation, "rootfs-a"))
+		Expect(layers[1].Descriptor().MediaType).To(Equal(onmetalimage.RootFSLayerMediaType + onmetalimage.ZstdMediaTypeSuffix))
+
+		data, err := imageutil.ReadLayerContent(ctx, layers[0])
+		Expect(err).NotTo(HaveOccurred())
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(io.ReadAll(gr)).To(Equal(Content("layers/rootfs-a", 512)))
+
+		data, err = imageutil.ReadLayerContent(ctx, layers[1])
+		Expect(err).NotTo(HaveOccurred())
+		zr, err := zstd.NewReader(bytes.NewReader(data))
+		Expect(err).NotTo(HaveOccurred())
+		defer zr.Close()
+		Expect(io.ReadAll(zr)).To(Equal(Content("layers/rootfs-b", 512)))
+
+		By("rejecting unknown roles")
+		_, err = Image{Layers: []Layer{{Role: "unknown"}}}.Build()
+		Expect(err).To(MatchError(ContainSubstring("unknown layer role")))
+	})
+
+	It("should build artifacts referring to a subject", func() {
+		img, err := Bootable().Build()
+		Expect(err).NotTo(HaveOccurred())
+		subject := img.Descriptor()
+
+		artifact, err := Artifact{
+			ArtifactType: "application/vnd.example.signature",
+			MediaType:    "application/vnd.example.signature.v1",
+			Seed:         "signature",
+			Size:         64,
+			Subject:      &subject,
+		}.Build(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		manifest, err := artifact.Manifest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imageutil.IsArtifact(manifest)).To(BeTrue())
+		Expect(manifest.Subject).To(Equal(&subject))
+	})
+
+	It("should install images into layouts and multi-arch indexes into the registry harness", func() {
+		l, err := layout.New(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		img, err := Bootable().Build()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(AddToLayout(ctx, l, "example.org/bootable:v1", img)).To(Succeed())
+		desc, err := l.Indexer().Find(ctx, descriptormatcher.Name("example.org/bootable:v1"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(desc.Digest).To(Equal(BootableDigest))
+
+		index, err := MultiArch(Bootable(),
+			ocispec.Platform{OS: "linux", Architecture: "amd64"},
+			ocispec.Platform{OS: "linux", Architecture: "arm64"},
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(index.Images).To(HaveLen(2))
+		Expect(index.Images[0].Descriptor().Digest).NotTo(Equal(index.Images[1].Descriptor().Digest))
+
+		harness := registryharness.New()
+		DeferCleanup(harness.Close)
+		Expect(SeedIndex(ctx, harness, "bootable", "v1", index)).To(Succeed())
+		seeded, ok := harness.Manifest("bootable", "v1")
+		Expect(ok).To(BeTrue())
+		Expect(seeded.Digest).To(Equal(index.Descriptor.Digest))
+		for _, img := range index.Images {
+			_, ok := harness.Manifest("bootable", img.Descriptor().Digest.String())
+			Expect(ok).To(BeTrue())
+		}
+	})
+})
@@ -0,0 +1,112 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fixtures
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ForeignEntry is an image of a layout written by WriteForeignLayout.
+type ForeignEntry struct {
+	// Name is the ref.name annotation of the index entry. skopeo and buildah record the name given after
+	// the layout path, typically only a tag, instead of a full reference. Empty means untagged.
+	Name string
+	// Image is the image of the entry.
+	Image ociimage.Image
+}
+
+// WriteForeignLayout writes the images to dir as an OCI layout the way tools built on containers/image
+// (skopeo copy, buildah push) lay it out: an oci-layout file, the blobs under blobs/sha256/ and an index
+// whose entries carry no other annotation than ref.name. None of the files or annotations of a store
+// are written.
+func WriteForeignLayout(ctx context.Context, dir string, entries ...ForeignEntry) error {
+	blobDir := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return err
+	}
+	writeBlob := func(layer ociimage.Layer) error {
+		rc, err := layer.Content(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = rc.Close() }()
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(blobDir, layer.Descriptor().Digest.Encoded()), data, 0644)
+	}
+
+	index := ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ocispec.MediaTypeImageIndex}
+	for _, entry := range entries {
+		config, err := entry.Image.Config(ctx)
+		if err != nil {
+			return err
+		}
+		layers, err := entry.Image.Layers(ctx)
+		if err != nil {
+			return err
+		}
+		for _, layer := range append([]ociimage.Layer{entry.Image, config}, layers...) {
+			if err := writeBlob(layer); err != nil {
+				return fmt.Errorf("error writing blob %s: %w", layer.Descriptor().Digest, err)
+			}
+		}
+
+		desc := entry.Image.Descriptor()
+		indexEntry := ocispec.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: desc.Size}
+		if entry.Name != "" {
+			indexEntry.Annotations = map[string]string{ocispec.AnnotationRefName: entry.Name}
+		}
+		index.Manifests = append(index.Manifests, indexEntry)
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.json"), data, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion": "1.0.0"}`), 0644)
+}
+
+// ContainerImage builds a container image as produced by buildah: an OCI image config with created time
+// and a single gzip compressed layer, which is no onmetal image.
+func ContainerImage(seed string, created time.Time) (ociimage.Image, error) {
+	config := ocispec.Image{
+		Created:  &created,
+		Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		RootFS:   ocispec.RootFS{Type: "layers"},
+	}
+	data, _, err := compress(Content(seed, 1<<10), Gzip)
+	if err != nil {
+		return nil, err
+	}
+	return imageutil.NewJSONConfigBuilder(&config, imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+		BytesLayer(data, imageutil.WithMediaType(ocispec.MediaTypeImageLayerGzip)).
+		Complete()
+}
@@ -0,0 +1,49 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fixtures
+
+import (
+	onmetalimage "github.com/onmetal/onmetal-image"
+	"github.com/opencontainers/go-digest"
+)
+
+// Bootable returns a bootable onmetal image with a kernel, an initramfs and a rootfs layer of a few KiB.
+// Its digests are BootableDigest, BootableConfigDigest and BootableRootFSDigest.
+func Bootable() Image {
+	return Image{
+		Seed:   "bootable",
+		Config: onmetalimage.Config{CommandLine: "console=ttyS0 root=/dev/vda"},
+		Layers: []Layer{
+			{Role: "kernel", Size: 1 << 10},
+			{Role: "initramfs", Size: 2 << 10},
+			{Role: "rootfs", Size: 4 << 10},
+		},
+	}
+}
+
+// RootFS returns an onmetal image with only a rootfs layer of the given content, e.g. to tell versions of an
+// image apart by their content. The digest of RootFS("v1") is RootFSV1Digest.
+func RootFS(content string) Image {
+	return Image{Layers: []Layer{{Role: "rootfs", Content: []byte(content)}}}
+}
+
+// The golden digests of the predefined fixtures. They must only change on intended changes of the fixtures
+// or of the serialization of images, see imageutil.MarshalCanonical.
+const (
+	BootableDigest       digest.Digest = "sha256:1320d22dc141ab13d4d060bfaacd0f1400e5603b0a80de70377b7fdd5bb3b5d6"
+	BootableConfigDigest digest.Digest = "sha256:7b9741d36cbba6b3c0a4ec092f58f8b6cb8142e0fbfc83c390f25469b3d00412"
+	BootableRootFSDigest digest.Digest = "sha256:0fbceea704e3235677a1646a7da3e7840520e1096e2ae940fd9c2fc19a5717c1"
+	RootFSV1Digest       digest.Digest = "sha256:ea48b95d24dd5454ceee77a9d1a29b75ef543a0dfa3bae379b77e86276ba5a67"
+)
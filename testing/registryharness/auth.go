@@ -0,0 +1,181 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registryharness
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// AuthScheme is the scheme a Registry challenges unauthenticated clients with.
+type AuthScheme string
+
+const (
+	// AuthSchemeBasic requires HTTP basic authentication on every request.
+	AuthSchemeBasic AuthScheme = "Basic"
+	// AuthSchemeBearer requires bearer tokens issued by the token endpoint of the registry, like most public registries.
+	AuthSchemeBearer AuthScheme = "Bearer"
+)
+
+// Auth configures the authentication required by a Registry.
+type Auth struct {
+	Scheme   AuthScheme
+	Username string
+	Password string
+	// AnonymousPull allows pulling without credentials. With AuthSchemeBasic, pulls without credentials are
+	// served; with AuthSchemeBearer, they are challenged and anonymous tokens are issued, like by public
+	// registries. Invalid credentials are still rejected.
+	AnonymousPull bool
+}
+
+const tokenPath = "/token"
+
+// SetAuth requires the given authentication. A nil auth allows anonymous access again.
+func (r *Registry) SetAuth(auth *Auth) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.auth = auth
+}
+
+// ExpireTokens invalidates all bearer tokens issued so far, like tokens expiring in the middle of an operation.
+func (r *Registry) ExpireTokens() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tokens = make(map[string]bool)
+}
+
+// DockerConfig returns a docker config file authenticating with the given credentials at the registry.
+func (r *Registry) DockerConfig(username, password string) []byte {
+	data, _ := json.Marshal(map[string]any{
+		"auths": map[string]any{
+			r.Host(): map[string]string{
+				"auth": base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+			},
+		},
+	})
+	return data
+}
+
+// WriteDockerConfig writes the DockerConfig with the given credentials to path.
+func (r *Registry) WriteDockerConfig(path, username, password string) error {
+	return os.WriteFile(path, r.DockerConfig(username, password), 0600)
+}
+
+// authorized reports whether the request may access the distribution API.
+// If not, it writes the challenge or rejection to w.
+func (r *Registry) authorized(w http.ResponseWriter, req *http.Request, repository string) bool {
+	auth := r.auth
+	if auth == nil {
+		return true
+	}
+
+	var (
+		header = req.Header.Get("Authorization")
+		pull   = req.Method == http.MethodGet || req.Method == http.MethodHead
+	)
+	if header == "" && auth.AnonymousPull && pull && auth.Scheme == AuthSchemeBasic {
+		return true
+	}
+
+	switch auth.Scheme {
+	case AuthSchemeBasic:
+		if username, password, ok := req.BasicAuth(); ok && username == auth.Username && password == auth.Password {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="registryharness"`)
+	default:
+		if token, ok := bearerToken(header); ok {
+			if push, ok := r.tokens[token]; ok && (push || pull) {
+				return true
+			}
+		}
+		scope := "registry:catalog:*"
+		if repository != "" {
+			scope = fmt.Sprintf("repository:%s:pull,push", repository)
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s%s",service="registryharness",scope="%s"`, r.URL(), tokenPath, scope))
+	}
+	writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+	return false
+}
+
+func bearerToken(header string) (string, bool) {
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || header[:len(prefix)] != prefix {
+		return "", false
+	}
+	return header[len(prefix):], true
+}
+
+// serveToken issues bearer tokens, either via GET with basic authentication or via the OAuth2 password grant.
+func (r *Registry) serveToken(w http.ResponseWriter, req *http.Request) {
+	r.stats.TokenRequests++
+	auth := r.auth
+	if auth == nil || auth.Scheme != AuthSchemeBearer {
+		http.NotFound(w, req)
+		return
+	}
+
+	var (
+		username, password string
+		hasCredentials     bool
+		oauth              = req.Method == http.MethodPost
+	)
+	switch req.Method {
+	case http.MethodGet:
+		username, password, hasCredentials = req.BasicAuth()
+	case http.MethodPost:
+		if err := req.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		username, password = req.PostForm.Get("username"), req.PostForm.Get("password")
+		hasCredentials = req.PostForm.Get("grant_type") == "password"
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case hasCredentials && (username != auth.Username || password != auth.Password):
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid credentials")
+		return
+	case !hasCredentials && !auth.AnonymousPull:
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "credentials required")
+		return
+	}
+
+	// Anonymous tokens only allow pulling.
+	token := newToken()
+	r.tokens[token] = hasCredentials
+
+	key := "token"
+	if oauth {
+		key = "access_token"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{key: token, "expires_in": 300})
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
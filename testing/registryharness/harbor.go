@@ -0,0 +1,67 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registryharness
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// harborAPIPrefix is the path prefix of the Harbor v2 API.
+const harborAPIPrefix = "/api/v2.0/"
+
+// SetQuota sets the storage quota of the given project, i.e. the first path component of its
+// repositories, and makes the registry serve the project summary of the Harbor API reporting it.
+// A negative limit means unlimited storage. The used bytes are reported as given, they do not change with
+// pushes.
+func (r *Registry) SetQuota(project string, limit, used int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.quotas[project] = [2]int64{limit, used}
+}
+
+// serveHarbor serves the parts of the Harbor API needed to query project quotas. The API is only served
+// if a quota has been set, see SetQuota.
+func (r *Registry) serveHarbor(w http.ResponseWriter, req *http.Request) {
+	if len(r.quotas) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, harborAPIPrefix)
+	if path == "ping" {
+		_, _ = w.Write([]byte("Pong"))
+		return
+	}
+
+	project, ok := strings.CutPrefix(path, "projects/")
+	if project, ok = strings.CutSuffix(project, "/summary"); !ok {
+		http.NotFound(w, req)
+		return
+	}
+	quota, ok := r.quotas[project]
+	if !ok {
+		quota = [2]int64{-1, 0}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"quota": map[string]any{
+			"hard": map[string]int64{"storage": quota[0]},
+			"used": map[string]int64{"storage": quota[1]},
+		},
+	})
+}
@@ -0,0 +1,382 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package registryharness provides an in-process OCI distribution server keeping all content in memory,
+// for testing code that talks to registries. Knobs allow injecting authentication, rate limits, latency,
+// truncated blobs, interrupted uploads, missing APIs and Harbor project quotas.
+package registryharness
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ociimage "github.com/onmetal/onmetal-image/oci/image"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// API is an optional part of the distribution API that can be disabled to mimic registries lacking it.
+type API string
+
+const (
+	// APITagsList is listing the tags of a repository.
+	APITagsList API = "tags-list"
+	// APIManifestDelete is deleting manifests by digest.
+	APIManifestDelete API = "manifest-delete"
+	// APITagDelete is deleting tags without deleting the manifest they point to.
+	APITagDelete API = "tag-delete"
+	// APIBlobDelete is deleting blobs.
+	APIBlobDelete API = "blob-delete"
+	// APIBlobMount is mounting blobs from other repositories. If disabled, mount requests start a regular upload.
+	APIBlobMount API = "blob-mount"
+	// APIChunkedUpload is uploading blobs in chunks via PATCH.
+	APIChunkedUpload API = "chunked-upload"
+	// APIRangeRequests is serving parts of blobs and manifests for Range requests. If disabled, Range
+	// headers are ignored and the content is served in full.
+	APIRangeRequests API = "range-requests"
+)
+
+// Stats are the counters of the requests served by a Registry.
+type Stats struct {
+	// Requests is the number of requests to the distribution API, including rejected ones.
+	Requests int
+	// TagResolves is the number of manifest requests by tag.
+	TagResolves int
+	// ManifestPuts is the number of manifests pushed.
+	ManifestPuts int
+	// BlobFetches are the digests of the blobs fetched (GET), in order.
+	BlobFetches []digest.Digest
+	// RangeRequests is the number of blob and manifest fetches served partially for a Range request.
+	RangeRequests int
+	// Uploaded are the digests of the completed blob uploads, in order.
+	Uploaded []digest.Digest
+	// Mounted are the digests of the blobs mounted from other repositories, in order.
+	Mounted []digest.Digest
+	// TokenRequests is the number of requests to the token endpoint.
+	TokenRequests int
+}
+
+type manifest struct {
+	mediaType string
+	data      []byte
+}
+
+type repository struct {
+	blobs     map[digest.Digest][]byte
+	manifests map[digest.Digest]manifest
+	tags      map[string]digest.Digest
+}
+
+func newRepository() *repository {
+	return &repository{
+		blobs:     make(map[digest.Digest][]byte),
+		manifests: make(map[digest.Digest]manifest),
+		tags:      make(map[string]digest.Digest),
+	}
+}
+
+// Registry is an in-process OCI distribution server keeping all content in memory.
+// All knobs may be changed while the registry is serving.
+type Registry struct {
+	server *httptest.Server
+
+	mu           sync.Mutex
+	repositories map[string]*repository
+	uploads      map[string][]byte
+	lastUpload   int
+	stats        Stats
+
+	auth *Auth
+	// tokens are the issued bearer tokens and whether they allow pushing.
+	tokens map[string]bool
+
+	rateLimit       int
+	rateLimitWindow time.Duration
+	windowStart     time.Time
+	windowRequests  int
+
+	latency      time.Duration
+	truncated    map[digest.Digest]int64
+	resets       map[digest.Digest][]int64
+	uploadBudget int
+	disabled     map[API]struct{}
+	// quotas are the storage limits and used bytes by project, see SetQuota.
+	quotas map[string][2]int64
+}
+
+// New starts a new Registry. Close it once done.
+func New() *Registry {
+	r := &Registry{
+		repositories: make(map[string]*repository),
+		uploads:      make(map[string][]byte),
+		tokens:       make(map[string]bool),
+		truncated:    make(map[digest.Digest]int64),
+		resets:       make(map[digest.Digest][]int64),
+		uploadBudget: -1,
+		disabled:     make(map[API]struct{}),
+		quotas:       make(map[string][2]int64),
+	}
+	r.server = httptest.NewServer(r)
+	return r
+}
+
+// Close shuts the registry down.
+func (r *Registry) Close() {
+	r.server.Close()
+}
+
+// URL returns the base URL of the registry, e.g. http://127.0.0.1:12345.
+func (r *Registry) URL() string {
+	return r.server.URL
+}
+
+// Host returns the host of the registry to be used in references, e.g. 127.0.0.1:12345.
+func (r *Registry) Host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+// Reference returns the reference of the given repository and tag or digest in the registry.
+func (r *Registry) Reference(repository, tagOrDigest string) string {
+	if _, err := digest.Parse(tagOrDigest); err == nil {
+		return fmt.Sprintf("%s/%s@%s", r.Host(), repository, tagOrDigest)
+	}
+	return fmt.Sprintf("%s/%s:%s", r.Host(), repository, tagOrDigest)
+}
+
+// SetRateLimit limits the registry to the given number of requests per window.
+// Exceeding requests are rejected with 429 Too Many Requests and a Retry-After header.
+// A limit of zero removes the rate limit.
+func (r *Registry) SetRateLimit(limit int, window time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rateLimit = limit
+	r.rateLimitWindow = window
+	r.windowStart = time.Time{}
+	r.windowRequests = 0
+}
+
+// SetLatency delays every response by the given duration.
+func (r *Registry) SetLatency(latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latency = latency
+}
+
+// TruncateBlob makes fetches of the blob or manifest with the given digest end after size bytes
+// while still announcing the full length, like a connection dropped mid-transfer.
+// A negative size serves the content in full again.
+func (r *Registry) TruncateBlob(dgst digest.Digest, size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if size < 0 {
+		delete(r.truncated, dgst)
+		return
+	}
+	r.truncated[dgst] = size
+}
+
+// ResetBlob makes the next fetches of the blob or manifest with the given digest reset the connection once
+// the given offsets into the content are reached, one offset per fetch, like a load balancer resetting
+// the stream mid-transfer. An offset equal to the start of a ranged fetch resets it before sending any
+// content, offsets before it are skipped.
+func (r *Registry) ResetBlob(dgst digest.Digest, offsets ...int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resets[dgst] = append(r.resets[dgst], offsets...)
+}
+
+// FailUploadsAfter makes all blob uploads after the next n fail, like a push that is interrupted.
+// A negative n lets all uploads succeed again.
+func (r *Registry) FailUploadsAfter(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.uploadBudget = n
+}
+
+// Disable disables the given APIs, mimicking registries that do not implement them.
+func (r *Registry) Disable(apis ...API) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, api := range apis {
+		r.disabled[api] = struct{}{}
+	}
+}
+
+// Enable re-enables the given APIs.
+func (r *Registry) Enable(apis ...API) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, api := range apis {
+		delete(r.disabled, api)
+	}
+}
+
+func (r *Registry) isDisabled(api API) bool {
+	_, ok := r.disabled[api]
+	return ok
+}
+
+// Stats returns a snapshot of the request counters.
+func (r *Registry) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	stats.BlobFetches = append([]digest.Digest(nil), stats.BlobFetches...)
+	stats.Uploaded = append([]digest.Digest(nil), stats.Uploaded...)
+	stats.Mounted = append([]digest.Digest(nil), stats.Mounted...)
+	return stats
+}
+
+// ResetStats resets all request counters.
+func (r *Registry) ResetStats() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats = Stats{}
+}
+
+func (r *Registry) repository(name string) *repository {
+	repo, ok := r.repositories[name]
+	if !ok {
+		repo = newRepository()
+		r.repositories[name] = repo
+	}
+	return repo
+}
+
+// SeedBlob stores the data as blob in the repository and returns its digest.
+func (r *Registry) SeedBlob(repository string, data []byte) digest.Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dgst := digest.FromBytes(data)
+	r.repository(repository).blobs[dgst] = data
+	return dgst
+}
+
+// Seed stores the image with all its blobs in the repository and tags it, if tag is not empty.
+func (r *Registry) Seed(ctx context.Context, repository, tag string, img ociimage.Image) error {
+	layers, err := ociimage.AsWriteLayers(ctx, img)
+	if err != nil {
+		return fmt.Errorf("error getting layers: %w", err)
+	}
+
+	contents := make([][]byte, len(layers))
+	for i, layer := range layers {
+		if contents[i], err = readLayer(ctx, layer); err != nil {
+			return fmt.Errorf("error reading layer %s: %w", layer.Descriptor().Digest, err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	repo := r.repository(repository)
+	// AsWriteLayers returns the blobs followed by the manifest.
+	for i, layer := range layers[:len(layers)-1] {
+		repo.blobs[layer.Descriptor().Digest] = contents[i]
+	}
+
+	desc := img.Descriptor()
+	repo.manifests[desc.Digest] = manifest{mediaType: desc.MediaType, data: contents[len(contents)-1]}
+	if tag != "" {
+		repo.tags[tag] = desc.Digest
+	}
+	return nil
+}
+
+// SeedManifest stores the manifest or index document with the given media type in the repository and tags
+// it, if tag is not empty. Unlike Seed, the blobs it references are not stored.
+func (r *Registry) SeedManifest(repository, tag, mediaType string, data []byte) ocispec.Descriptor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	repo := r.repository(repository)
+	dgst := digest.FromBytes(data)
+	repo.manifests[dgst] = manifest{mediaType: mediaType, data: data}
+	if tag != "" {
+		repo.tags[tag] = dgst
+	}
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+}
+
+func readLayer(ctx context.Context, layer ociimage.Layer) ([]byte, error) {
+	rc, err := layer.Content(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rc.Close() }()
+	return io.ReadAll(rc)
+}
+
+// Manifest returns the descriptor of the manifest the tag or digest refers to in the repository.
+func (r *Registry) Manifest(repository, tagOrDigest string) (ocispec.Descriptor, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	repo, ok := r.repositories[repository]
+	if !ok {
+		return ocispec.Descriptor{}, false
+	}
+	dgst, m, ok := repo.manifest(tagOrDigest)
+	if !ok {
+		return ocispec.Descriptor{}, false
+	}
+	return ocispec.Descriptor{MediaType: m.mediaType, Digest: dgst, Size: int64(len(m.data))}, true
+}
+
+// HasBlob reports whether the repository contains the blob.
+func (r *Registry) HasBlob(repository string, dgst digest.Digest) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	repo, ok := r.repositories[repository]
+	if !ok {
+		return false
+	}
+	_, ok = repo.blobs[dgst]
+	return ok
+}
+
+// Tags returns the sorted tags of the repository.
+func (r *Registry) Tags(repository string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	repo, ok := r.repositories[repository]
+	if !ok {
+		return nil
+	}
+	return repo.sortedTags()
+}
+
+func (r *repository) manifest(tagOrDigest string) (digest.Digest, manifest, bool) {
+	dgst, err := digest.Parse(tagOrDigest)
+	if err != nil {
+		var ok bool
+		if dgst, ok = r.tags[tagOrDigest]; !ok {
+			return "", manifest{}, false
+		}
+	}
+	m, ok := r.manifests[dgst]
+	return dgst, m, ok
+}
+
+func (r *repository) sortedTags() []string {
+	tags := make([]string, 0, len(r.tags))
+	for tag := range r.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
@@ -0,0 +1,179 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registryharness_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	. "github.com/onmetal/onmetal-image/testing/registryharness"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+)
+
+var _ = Describe("Registry", func() {
+	var registry *Registry
+
+	BeforeEach(func() {
+		registry = New()
+		DeferCleanup(registry.Close)
+	})
+
+	do := func(method, path string, body []byte) *http.Response {
+		req, err := http.NewRequest(method, registry.URL()+path, bytes.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(res.Body.Close)
+		return res
+	}
+
+	It("should upload blobs in chunks and mount them into other repositories", func() {
+		data := []byte("some blob")
+		dgst := digest.FromBytes(data)
+
+		res := do(http.MethodPost, "/v2/foo/bar/blobs/uploads/", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusAccepted))
+		location := res.Header.Get("Location")
+
+		res = do(http.MethodPatch, location, data[:4])
+		Expect(res.StatusCode).To(Equal(http.StatusAccepted))
+		Expect(res.Header.Get("Range")).To(Equal("0-3"))
+
+		res = do(http.MethodPut, location+"?digest="+dgst.String(), data[4:])
+		Expect(res.StatusCode).To(Equal(http.StatusCreated))
+		Expect(registry.HasBlob("foo/bar", dgst)).To(BeTrue())
+		Expect(registry.Stats().Uploaded).To(Equal([]digest.Digest{dgst}))
+
+		res = do(http.MethodPost, "/v2/baz/blobs/uploads/?mount="+dgst.String()+"&from=foo/bar", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusCreated))
+		Expect(registry.HasBlob("baz", dgst)).To(BeTrue())
+
+		By("disabling chunked uploads and mounts")
+		registry.Disable(APIChunkedUpload, APIBlobMount)
+		res = do(http.MethodPost, "/v2/qux/blobs/uploads/?mount="+dgst.String()+"&from=foo/bar", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusAccepted))
+		res = do(http.MethodPatch, res.Header.Get("Location"), data)
+		Expect(res.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+	})
+
+	It("should paginate tags and allow disabling the tag list", func() {
+		manifest := []byte("{}")
+		for _, tag := range []string{"c", "a", "b"} {
+			Expect(do(http.MethodPut, "/v2/repo/manifests/"+tag, manifest).StatusCode).To(Equal(http.StatusCreated))
+		}
+		Expect(registry.Tags("repo")).To(Equal([]string{"a", "b", "c"}))
+
+		res := do(http.MethodGet, "/v2/repo/tags/list?n=2", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(res.Header.Get("Link")).To(Equal(`</v2/repo/tags/list?last=b&n=2>; rel="next"`))
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		Expect(json.NewDecoder(res.Body).Decode(&list)).To(Succeed())
+		Expect(list.Tags).To(Equal([]string{"a", "b"}))
+
+		registry.Disable(APITagsList)
+		Expect(do(http.MethodGet, "/v2/repo/tags/list", nil).StatusCode).To(Equal(http.StatusMethodNotAllowed))
+	})
+
+	It("should rate limit requests", func() {
+		registry.SetRateLimit(2, time.Minute)
+		Expect(do(http.MethodGet, "/v2/", nil).StatusCode).To(Equal(http.StatusOK))
+		Expect(do(http.MethodGet, "/v2/", nil).StatusCode).To(Equal(http.StatusOK))
+
+		res := do(http.MethodGet, "/v2/", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusTooManyRequests))
+		Expect(res.Header.Get("Retry-After")).To(Equal("60"))
+
+		registry.SetRateLimit(0, 0)
+		Expect(do(http.MethodGet, "/v2/", nil).StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should delay responses", func() {
+		registry.SetLatency(50 * time.Millisecond)
+		start := time.Now()
+		do(http.MethodGet, "/v2/", nil)
+		Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+	})
+
+	It("should truncate blobs", func() {
+		dgst := registry.SeedBlob("repo", []byte("0123456789"))
+		registry.TruncateBlob(dgst, 4)
+
+		res := do(http.MethodGet, "/v2/repo/blobs/"+dgst.String(), nil)
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(res.ContentLength).To(Equal(int64(10)))
+		data, err := io.ReadAll(res.Body)
+		Expect(err).To(MatchError(io.ErrUnexpectedEOF))
+		Expect(data).To(Equal([]byte("0123")))
+	})
+
+	It("should require basic authentication", func() {
+		registry.SetAuth(&Auth{Scheme: AuthSchemeBasic, Username: "user", Password: "secret", AnonymousPull: true})
+		dgst := registry.SeedBlob("repo", []byte("blob"))
+
+		Expect(do(http.MethodGet, "/v2/repo/blobs/"+dgst.String(), nil).StatusCode).To(Equal(http.StatusOK))
+
+		res := do(http.MethodDelete, "/v2/repo/blobs/"+dgst.String(), nil)
+		Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(res.Header.Get("WWW-Authenticate")).To(Equal(`Basic realm="registryharness"`))
+
+		req, err := http.NewRequest(http.MethodDelete, registry.URL()+"/v2/repo/blobs/"+dgst.String(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.SetBasicAuth("user", "secret")
+		res, err = http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer func() { _ = res.Body.Close() }()
+		Expect(res.StatusCode).To(Equal(http.StatusAccepted))
+		Expect(registry.HasBlob("repo", dgst)).To(BeFalse())
+	})
+
+	It("should issue bearer tokens via the OAuth2 password grant and anonymously", func() {
+		registry.SetAuth(&Auth{Scheme: AuthSchemeBearer, Username: "user", Password: "secret", AnonymousPull: true})
+		dgst := registry.SeedBlob("repo", []byte("blob"))
+
+		res := do(http.MethodGet, "/v2/repo/blobs/"+dgst.String(), nil)
+		Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(res.Header.Get("WWW-Authenticate")).To(HavePrefix(`Bearer realm="` + registry.URL() + `/token"`))
+
+		token := func(username, password string) (int, string) {
+			form := url.Values{"grant_type": {"password"}, "username": {username}, "password": {password}}
+			res, err := http.PostForm(registry.URL()+"/token", form)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { _ = res.Body.Close() }()
+			var body struct {
+				AccessToken string `json:"access_token"`
+			}
+			_ = json.NewDecoder(res.Body).Decode(&body)
+			return res.StatusCode, body.AccessToken
+		}
+		status, _ := token("user", "wrong")
+		Expect(status).To(Equal(http.StatusUnauthorized))
+		status, accessToken := token("user", "secret")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(accessToken).NotTo(BeEmpty())
+
+		res, err := http.PostForm(registry.URL()+"/token", url.Values{"grant_type": {"refresh_token"}})
+		Expect(err).NotTo(HaveOccurred())
+		defer func() { _ = res.Body.Close() }()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+	})
+})
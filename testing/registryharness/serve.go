@@ -0,0 +1,484 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registryharness
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+func writeUnsupported(w http.ResponseWriter, api API) {
+	writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", fmt.Sprintf("%s is not supported", api))
+}
+
+// route splits a distribution API path below /v2/ into the repository name, the endpoint and its argument.
+// The endpoint is one of "tags", "manifests", "uploads" or "blobs", or empty if the path is unknown.
+func route(path string) (name, endpoint, arg string) {
+	if name, ok := strings.CutSuffix(path, "/tags/list"); ok {
+		return name, "tags", ""
+	}
+	for _, e := range []struct{ sep, endpoint string }{
+		{"/blobs/uploads", "uploads"},
+		{"/manifests/", "manifests"},
+		{"/blobs/", "blobs"},
+	} {
+		if i := strings.LastIndex(path, e.sep); i > 0 {
+			return path[:i], e.endpoint, strings.TrimPrefix(path[i+len(e.sep):], "/")
+		}
+	}
+	return "", "", ""
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Read the body and wait out the latency before locking so slow clients do not block other requests.
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	latency := r.latency
+	r.mu.Unlock()
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.URL.Path == tokenPath {
+		// The OAuth2 password grant is a form in the body read above.
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		r.serveToken(w, req)
+		return
+	}
+	if strings.HasPrefix(req.URL.Path, harborAPIPrefix) {
+		r.serveHarbor(w, req)
+		return
+	}
+
+	path, ok := strings.CutPrefix(req.URL.Path, "/v2")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	r.stats.Requests++
+	if r.rateLimited(w) {
+		return
+	}
+
+	path = strings.TrimPrefix(path, "/")
+	if path == "" {
+		if r.authorized(w, req, "") {
+			w.WriteHeader(http.StatusOK)
+		}
+		return
+	}
+
+	name, endpoint, arg := route(path)
+	if endpoint == "" {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "unknown endpoint")
+		return
+	}
+	if !r.authorized(w, req, name) {
+		return
+	}
+
+	switch endpoint {
+	case "tags":
+		r.serveTags(w, req, name)
+	case "manifests":
+		r.serveManifest(w, req, name, arg, body)
+	case "uploads":
+		r.serveUpload(w, req, name, arg, body)
+	case "blobs":
+		r.serveBlob(w, req, name, digest.Digest(arg))
+	}
+}
+
+// rateLimited reports whether the request exceeds the rate limit, in which case the rejection is written to w.
+func (r *Registry) rateLimited(w http.ResponseWriter) bool {
+	if r.rateLimit <= 0 {
+		return false
+	}
+
+	now := time.Now()
+	if now.Sub(r.windowStart) >= r.rateLimitWindow {
+		r.windowStart = now
+		r.windowRequests = 0
+	}
+	r.windowRequests++
+	if r.windowRequests <= r.rateLimit {
+		return false
+	}
+
+	retryAfter := r.windowStart.Add(r.rateLimitWindow).Sub(now)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, "TOOMANYREQUESTS", "rate limit exceeded")
+	return true
+}
+
+// writeContent writes the content of a blob or manifest, honoring TruncateBlob, ResetBlob and APIRangeRequests.
+func (r *Registry) writeContent(w http.ResponseWriter, req *http.Request, dgst digest.Digest, mediaType string, data []byte) {
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	if req.Method == http.MethodHead {
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+		return
+	}
+	if r.isDisabled(APIRangeRequests) {
+		req.Header.Del("Range")
+	}
+
+	if size, truncated := r.truncated[dgst]; truncated {
+		// Announce the full length but end early, the server then closes the connection.
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		if size < int64(len(data)) {
+			data = data[:size]
+		}
+		_, _ = w.Write(data)
+		return
+	}
+
+	start := rangeStart(req, int64(len(data)))
+	if start > 0 {
+		r.stats.RangeRequests++
+	}
+	for len(r.resets[dgst]) > 0 {
+		offset := r.resets[dgst][0]
+		r.resets[dgst] = r.resets[dgst][1:]
+		if offset >= start && offset < int64(len(data)) {
+			r.writeAndReset(w, data, start, offset)
+			return
+		}
+	}
+
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+}
+
+// rangeStart returns the start offset of a satisfiable "bytes=<start>-" Range request, or zero.
+func rangeStart(req *http.Request, size int64) int64 {
+	spec, ok := strings.CutPrefix(req.Header.Get("Range"), "bytes=")
+	if !ok {
+		return 0
+	}
+	startSpec, endSpec, ok := strings.Cut(spec, "-")
+	if !ok || endSpec != "" {
+		return 0
+	}
+	start, err := strconv.ParseInt(startSpec, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0
+	}
+	return start
+}
+
+// writeAndReset serves data from start (as partial content if start is non-zero) until offset and then
+// resets the connection.
+func (r *Registry) writeAndReset(w http.ResponseWriter, data []byte, start, offset int64) {
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(len(data))-start, 10))
+	if start > 0 {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	_, _ = w.Write(data[start:offset])
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	// Closing with a zero linger time sends a TCP RST instead of a regular FIN.
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+	}
+	_ = conn.Close()
+}
+
+func (r *Registry) serveTags(w http.ResponseWriter, req *http.Request, name string) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.isDisabled(APITagsList) {
+		writeUnsupported(w, APITagsList)
+		return
+	}
+	repo, ok := r.repositories[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+		return
+	}
+
+	var (
+		tags  = repo.sortedTags()
+		query = req.URL.Query()
+	)
+	if last := query.Get("last"); last != "" {
+		tags = tags[sort.SearchStrings(tags, last):]
+		if len(tags) > 0 && tags[0] == last {
+			tags = tags[1:]
+		}
+	}
+	if n, err := strconv.Atoi(query.Get("n")); err == nil && n >= 0 && n < len(tags) {
+		tags = tags[:n]
+		if n > 0 {
+			next := url.Values{"n": {strconv.Itoa(n)}, "last": {tags[n-1]}}
+			w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?%s>; rel="next"`, name, next.Encode()))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"name": name, "tags": tags})
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, name, ref string, body []byte) {
+	_, err := digest.Parse(ref)
+	isDigest := err == nil
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		if !isDigest {
+			r.stats.TagResolves++
+		}
+		repo, ok := r.repositories[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+			return
+		}
+		dgst, m, ok := repo.manifest(ref)
+		if !ok {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+		r.writeContent(w, req, dgst, m.mediaType, m.data)
+	case http.MethodPut:
+		r.stats.ManifestPuts++
+		dgst := digest.FromBytes(body)
+		if isDigest && digest.Digest(ref) != dgst {
+			writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "manifest digest does not match")
+			return
+		}
+		repo := r.repository(name)
+		repo.manifests[dgst] = manifest{mediaType: req.Header.Get("Content-Type"), data: body}
+		if !isDigest {
+			repo.tags[ref] = dgst
+		}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, dgst))
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if isDigest && r.isDisabled(APIManifestDelete) {
+			writeUnsupported(w, APIManifestDelete)
+			return
+		}
+		if !isDigest && r.isDisabled(APITagDelete) {
+			writeUnsupported(w, APITagDelete)
+			return
+		}
+		repo, ok := r.repositories[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+			return
+		}
+		dgst, _, ok := repo.manifest(ref)
+		if !ok {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+		if !isDigest {
+			delete(repo.tags, ref)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		// Deleting a manifest by digest removes all tags pointing to it.
+		delete(repo.manifests, dgst)
+		for tag, tagDigest := range repo.tags {
+			if tagDigest == dgst {
+				delete(repo.tags, tag)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, name string, dgst digest.Digest) {
+	repo, ok := r.repositories[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		data, ok := repo.blobs[dgst]
+		if !ok {
+			writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+			return
+		}
+		if req.Method == http.MethodGet {
+			r.stats.BlobFetches = append(r.stats.BlobFetches, dgst)
+		}
+		r.writeContent(w, req, dgst, "application/octet-stream", data)
+	case http.MethodDelete:
+		if r.isDisabled(APIBlobDelete) {
+			writeUnsupported(w, APIBlobDelete)
+			return
+		}
+		if _, ok := repo.blobs[dgst]; !ok {
+			writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+			return
+		}
+		delete(repo.blobs, dgst)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *Registry) serveUpload(w http.ResponseWriter, req *http.Request, name, id string, body []byte) {
+	query := req.URL.Query()
+	if req.Method == http.MethodPost {
+		if r.mount(w, name, digest.Digest(query.Get("mount")), query.Get("from")) {
+			return
+		}
+		if dgst := query.Get("digest"); dgst != "" {
+			r.finishUpload(w, name, digest.Digest(dgst), body)
+			return
+		}
+
+		r.lastUpload++
+		id = strconv.Itoa(r.lastUpload)
+		r.uploads[id] = body
+		writeUploadStatus(w, name, id, http.StatusAccepted, len(body))
+		return
+	}
+
+	data, ok := r.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry")
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeUploadStatus(w, name, id, http.StatusNoContent, len(data))
+	case http.MethodPatch:
+		if r.isDisabled(APIChunkedUpload) {
+			writeUnsupported(w, APIChunkedUpload)
+			return
+		}
+		r.uploads[id] = append(data, body...)
+		writeUploadStatus(w, name, id, http.StatusAccepted, len(r.uploads[id]))
+	case http.MethodPut:
+		delete(r.uploads, id)
+		r.finishUpload(w, name, digest.Digest(query.Get("digest")), append(data, body...))
+	case http.MethodDelete:
+		delete(r.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeUploadStatus(w http.ResponseWriter, name, id string, status, size int) {
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id))
+	w.Header().Set("Docker-Upload-UUID", id)
+	end := size - 1
+	if end < 0 {
+		end = 0
+	}
+	w.Header().Set("Range", fmt.Sprintf("0-%d", end))
+	w.WriteHeader(status)
+}
+
+// mount mounts the blob from the repository from into the repository name.
+// It reports whether the blob was mounted, otherwise a regular upload has to be started.
+func (r *Registry) mount(w http.ResponseWriter, name string, dgst digest.Digest, from string) bool {
+	if dgst == "" || r.isDisabled(APIBlobMount) {
+		return false
+	}
+	src, ok := r.repositories[from]
+	if !ok {
+		return false
+	}
+	data, ok := src.blobs[dgst]
+	if !ok {
+		return false
+	}
+
+	r.repository(name).blobs[dgst] = data
+	r.stats.Mounted = append(r.stats.Mounted, dgst)
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, dgst))
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.WriteHeader(http.StatusCreated)
+	return true
+}
+
+func (r *Registry) finishUpload(w http.ResponseWriter, name string, dgst digest.Digest, data []byte) {
+	if r.uploadBudget == 0 {
+		http.Error(w, "upload interrupted", http.StatusInternalServerError)
+		return
+	}
+	if err := dgst.Validate(); err != nil || dgst != digest.FromBytes(data) {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "provided digest did not match uploaded content")
+		return
+	}
+	if r.uploadBudget > 0 {
+		r.uploadBudget--
+	}
+
+	r.repository(name).blobs[dgst] = data
+	r.stats.Uploaded = append(r.stats.Uploaded, dgst)
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, dgst))
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package onmetalimage
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// efiSubsystems are the PE subsystems of EFI binaries.
+var efiSubsystems = map[uint16]struct{}{
+	pe.IMAGE_SUBSYSTEM_EFI_APPLICATION:         {},
+	pe.IMAGE_SUBSYSTEM_EFI_BOOT_SERVICE_DRIVER: {},
+	pe.IMAGE_SUBSYSTEM_EFI_RUNTIME_DRIVER:      {},
+	pe.IMAGE_SUBSYSTEM_EFI_ROM:                 {},
+}
+
+// ValidateUKI checks that r contains a PE/COFF binary with an EFI subsystem, as unified kernel images
+// and EFI bootloaders (such as systemd-boot) are.
+func ValidateUKI(r io.ReaderAt) error {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return fmt.Errorf("not a PE/COFF binary: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var subsystem uint16
+	switch header := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		subsystem = header.Subsystem
+	case *pe.OptionalHeader64:
+		subsystem = header.Subsystem
+	default:
+		return fmt.Errorf("PE/COFF binary has no optional header")
+	}
+	if _, ok := efiSubsystems[subsystem]; !ok {
+		return fmt.Errorf("PE/COFF binary has subsystem %d, which is no EFI subsystem", subsystem)
+	}
+	return nil
+}
+
+// ValidateESP checks that r starts with a FAT boot sector, as EFI system partition images do.
+func ValidateESP(r io.ReaderAt) error {
+	sector := make([]byte, 512)
+	if _, err := r.ReadAt(sector, 0); err != nil {
+		return fmt.Errorf("error reading boot sector: %w", err)
+	}
+
+	if sector[510] != 0x55 || sector[511] != 0xaa {
+		return fmt.Errorf("not a FAT image: boot sector signature is missing")
+	}
+	switch bytesPerSector := binary.LittleEndian.Uint16(sector[11:13]); bytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return fmt.Errorf("not a FAT image: invalid sector size %d", bytesPerSector)
+	}
+	// FAT12 and FAT16 record their type at offset 54, FAT32 at offset 82.
+	if !bytes.HasPrefix(sector[54:], []byte("FAT")) && !bytes.HasPrefix(sector[82:], []byte("FAT32")) {
+		return fmt.Errorf("not a FAT image: file system type is missing")
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package onmetalimage_test
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+
+	. "github.com/onmetal/onmetal-image"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// peBinary returns a minimal PE32+ binary without sections with the given subsystem.
+func peBinary(subsystem uint16) []byte {
+	var buf bytes.Buffer
+	dosHeader := make([]byte, 64)
+	copy(dosHeader, "MZ")
+	binary.LittleEndian.PutUint32(dosHeader[0x3c:], uint32(len(dosHeader)))
+	buf.Write(dosHeader)
+	buf.WriteString("PE\x00\x00")
+	Expect(binary.Write(&buf, binary.LittleEndian, pe.FileHeader{
+		Machine:              pe.IMAGE_FILE_MACHINE_AMD64,
+		SizeOfOptionalHeader: uint16(binary.Size(pe.OptionalHeader64{})),
+	})).To(Succeed())
+	Expect(binary.Write(&buf, binary.LittleEndian, pe.OptionalHeader64{
+		Magic:               0x20b,
+		Subsystem:           subsystem,
+		NumberOfRvaAndSizes: 16,
+	})).To(Succeed())
+	return buf.Bytes()
+}
+
+// fatImage returns a boot sector of a FAT32 file system.
+func fatImage() []byte {
+	sector := make([]byte, 512)
+	binary.LittleEndian.PutUint16(sector[11:], 512)
+	copy(sector[82:], "FAT32   ")
+	sector[510], sector[511] = 0x55, 0xaa
+	return sector
+}
+
+var _ = Describe("UEFI", func() {
+	Describe("ValidateUKI", func() {
+		It("should accept EFI applications", func() {
+			Expect(ValidateUKI(bytes.NewReader(peBinary(pe.IMAGE_SUBSYSTEM_EFI_APPLICATION)))).To(Succeed())
+		})
+
+		It("should reject binaries that are no EFI binaries", func() {
+			Expect(ValidateUKI(bytes.NewReader(peBinary(pe.IMAGE_SUBSYSTEM_WINDOWS_CUI)))).To(MatchError(ContainSubstring("no EFI subsystem")))
+			Expect(ValidateUKI(bytes.NewReader([]byte("#!/bin/sh")))).To(HaveOccurred())
+			Expect(ValidateUKI(bytes.NewReader(fatImage()))).To(HaveOccurred())
+		})
+	})
+
+	Describe("ValidateESP", func() {
+		It("should accept FAT images", func() {
+			Expect(ValidateESP(bytes.NewReader(fatImage()))).To(Succeed())
+		})
+
+		It("should reject images that are no FAT images", func() {
+			Expect(ValidateESP(bytes.NewReader(make([]byte, 512)))).To(HaveOccurred())
+			Expect(ValidateESP(bytes.NewReader(peBinary(pe.IMAGE_SUBSYSTEM_EFI_APPLICATION)))).To(HaveOccurred())
+		})
+	})
+})
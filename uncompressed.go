@@ -0,0 +1,140 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package onmetalimage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	"github.com/onmetal/onmetal-image/unpack"
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DiffIDAnnotation is the layer annotation denoting the digest of the layer content after decompression,
+// i.e. its entry in rootfs.diff_ids of an OCI image config.
+const DiffIDAnnotation = "image.onmetal.de/diff-id"
+
+// Uncompressed describes the content of a layer after decompression.
+type Uncompressed struct {
+	// Size is the size of the decompressed content.
+	Size int64 `json:"size"`
+	// DiffID is the digest of the decompressed content.
+	DiffID digest.Digest `json:"diffID"`
+}
+
+// UncompressedFromAnnotations returns the uncompressed size and diff ID recorded on the layer descriptor,
+// see UncompressedSizeAnnotation and DiffIDAnnotation. The diff ID is empty if only the size is recorded.
+func UncompressedFromAnnotations(desc ocispec.Descriptor) (Uncompressed, bool) {
+	v, ok := desc.Annotations[UncompressedSizeAnnotation]
+	if !ok {
+		return Uncompressed{}, false
+	}
+	size, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || size < 0 {
+		return Uncompressed{}, false
+	}
+	dgst, err := digest.Parse(desc.Annotations[DiffIDAnnotation])
+	if err != nil {
+		dgst = ""
+	}
+	return Uncompressed{Size: size, DiffID: dgst}, true
+}
+
+// WithUncompressed returns the descriptor with the annotations recording the uncompressed size and diff ID.
+// The annotations of desc are not modified.
+func WithUncompressed(desc ocispec.Descriptor, uncompressed Uncompressed) ocispec.Descriptor {
+	annotations := make(map[string]string, len(desc.Annotations)+2)
+	for key, value := range desc.Annotations {
+		annotations[key] = value
+	}
+	annotations[UncompressedSizeAnnotation] = strconv.FormatInt(uncompressed.Size, 10)
+	if uncompressed.DiffID != "" {
+		annotations[DiffIDAnnotation] = uncompressed.DiffID.String()
+	}
+	desc.Annotations = annotations
+	return desc
+}
+
+// MeasureUncompressed reads and decompresses the whole content of the layer (see unpack.Decompress)
+// to determine its uncompressed size and diff ID.
+func MeasureUncompressed(ctx context.Context, layer image.Layer) (Uncompressed, error) {
+	rc, err := layer.Content(ctx)
+	if err != nil {
+		return Uncompressed{}, fmt.Errorf("error getting layer content: %w", err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	dr, err := unpack.Decompress(rc)
+	if err != nil {
+		return Uncompressed{}, err
+	}
+	defer func() { _ = dr.Close() }()
+
+	measured, err := ioutils.CopyVerify(ctx, io.Discard, dr, ocispec.Descriptor{})
+	if err != nil {
+		return Uncompressed{}, fmt.Errorf("error decompressing layer %s: %w", layer.Descriptor().Digest, err)
+	}
+	return Uncompressed{Size: measured.Size, DiffID: measured.Digest}, nil
+}
+
+// UncompressedSize returns the size of the layer content after decompression from its
+// UncompressedSizeAnnotation. Without the annotation, the whole layer is streamed and decompressed to
+// count its bytes, which costs as much as downloading and extracting it; computed reports whether that
+// was necessary, so callers can warn about it.
+func UncompressedSize(ctx context.Context, layer image.Layer) (size int64, computed bool, err error) {
+	if uncompressed, ok := UncompressedFromAnnotations(layer.Descriptor()); ok {
+		return uncompressed.Size, false, nil
+	}
+	uncompressed, err := MeasureUncompressed(ctx, layer)
+	if err != nil {
+		return 0, true, err
+	}
+	return uncompressed.Size, true, nil
+}
+
+// ValidateDiffIDs checks the given diff IDs by layer digest against the rootfs.diff_ids of the image
+// config. Images whose config is no OCI or docker image config or has no diff IDs for all layers are
+// not checked.
+func ValidateDiffIDs(ctx context.Context, img image.Image, diffIDs map[digest.Digest]digest.Digest) error {
+	if len(diffIDs) == 0 {
+		return nil
+	}
+	expected, err := imageutil.ConfigDiffIDs(ctx, img)
+	if err != nil {
+		return err
+	}
+	layers, err := img.Layers(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting layers: %w", err)
+	}
+	if len(expected) != len(layers) {
+		return nil
+	}
+
+	for i, layer := range layers {
+		dgst := layer.Descriptor().Digest
+		actual, ok := diffIDs[dgst]
+		if ok && actual != expected[i] {
+			return fmt.Errorf("diff id %s of layer %s does not match %s of the image config", actual, dgst, expected[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package onmetalimage_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+
+	. "github.com/onmetal/onmetal-image"
+	"github.com/onmetal/onmetal-image/oci/imageutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("UncompressedSize", func() {
+	ctx := context.Background()
+
+	It("should use the recorded size", func() {
+		layer := imageutil.BytesLayer([]byte("compressed"), imageutil.WithAnnotations(map[string]string{
+			UncompressedSizeAnnotation: "1024",
+		}))
+		size, computed, err := UncompressedSize(ctx, layer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(size).To(BeEquivalentTo(1024))
+		Expect(computed).To(BeFalse())
+	})
+
+	It("should decompress the layer without a recorded size", func() {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		_, err := gw.Write([]byte("rootfs"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gw.Close()).To(Succeed())
+
+		layer := imageutil.BytesLayer(buf.Bytes())
+		size, computed, err := UncompressedSize(ctx, layer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(size).To(BeEquivalentTo(6))
+		Expect(computed).To(BeTrue())
+
+		uncompressed, err := MeasureUncompressed(ctx, layer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(uncompressed.DiffID).To(Equal(digest.FromString("rootfs")))
+
+		desc := WithUncompressed(layer.Descriptor(), uncompressed)
+		Expect(desc.Annotations).To(HaveKeyWithValue(DiffIDAnnotation, digest.FromString("rootfs").String()))
+		Expect(layer.Descriptor().Annotations).To(BeEmpty())
+	})
+})
+
+var _ = Describe("ValidateDiffIDs", func() {
+	ctx := context.Background()
+
+	It("should compare the diff ids with the image config", func() {
+		diffID := digest.FromString("rootfs")
+		config := `{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":["` + diffID.String() + `"]}}`
+		img, err := imageutil.NewBytesConfigBuilder([]byte(config), imageutil.WithMediaType(ocispec.MediaTypeImageConfig)).
+			BytesLayer([]byte("layer"), imageutil.WithMediaType(ocispec.MediaTypeImageLayerGzip)).
+			Complete()
+		Expect(err).NotTo(HaveOccurred())
+		layers, err := img.Layers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		dgst := layers[0].Descriptor().Digest
+
+		Expect(ValidateDiffIDs(ctx, img, map[digest.Digest]digest.Digest{dgst: diffID})).To(Succeed())
+		Expect(ValidateDiffIDs(ctx, img, map[digest.Digest]digest.Digest{dgst: digest.FromString("other")})).
+			To(MatchError(ContainSubstring("does not match")))
+	})
+})
@@ -0,0 +1,30 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !darwin
+
+package unpack_test
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+)
+
+// owner is not supported on this platform, where files have no numeric owners. Specs using it only run as
+// root, which the platform has no notion of either.
+func owner(fi os.FileInfo) (uid, gid uint32) {
+	Fail("file ownership is not supported on this platform")
+	return 0, 0
+}
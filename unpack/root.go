@@ -0,0 +1,99 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unpack
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks is the maximum number of symlinks followed when resolving a path, matching Linux' limit.
+const maxSymlinks = 255
+
+// resolveInRoot returns the host path of name as if root were the file system root.
+// Symlinks in all but the last path component are followed, but never outside of root.
+func resolveInRoot(root, name string) (string, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return root, nil
+	}
+
+	parent, base := path.Split(name)
+	resolved, err := resolveDir(root, parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, filepath.FromSlash(path.Join(resolved, base))), nil
+}
+
+// resolveDirInRoot returns the host path of the directory p as if root were the file system root,
+// following all symlinks but never outside of root.
+func resolveDirInRoot(root, p string) (string, error) {
+	resolved, err := resolveDir(root, p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, filepath.FromSlash(resolved)), nil
+}
+
+// resolveDir resolves all symlinks of the directory p inside root and returns the resolved path relative to root.
+// Components that do not exist (yet) are taken as-is.
+func resolveDir(root, p string) (string, error) {
+	var (
+		resolved  = "/"
+		remaining = strings.TrimPrefix(path.Clean("/"+p), "/")
+		links     int
+	)
+	for remaining != "" {
+		component, rest, _ := strings.Cut(remaining, "/")
+		remaining = rest
+
+		next := path.Join(resolved, component)
+		hostPath := filepath.Join(root, filepath.FromSlash(next))
+		fi, err := os.Lstat(hostPath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many symlinks resolving %s", p)
+		}
+		target, err := os.Readlink(hostPath)
+		if err != nil {
+			return "", err
+		}
+		if !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+		// resolved does not contain any symlinks, so cleaning '..' lexically is correct. As the joined path is
+		// rooted, '..' can never escape root.
+		remaining = strings.TrimPrefix(path.Join("/", target, remaining), "/")
+		resolved = "/"
+	}
+	return resolved, nil
+}
@@ -0,0 +1,658 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package unpack implements unpacking of tar layers (optionally gzip or zstd compressed) onto a directory,
+// preserving ownership, extended attributes, hardlinks and device nodes.
+package unpack
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/klauspost/compress/zstd"
+	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/onmetal/onmetal-image/utils/ioutils"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrNotTar is returned if the content to unpack is not a (compressed) tar archive.
+var ErrNotTar = errors.New("not a tar archive")
+
+// ErrPrivileged is returned in strict mode if an entry requires privileges the process does not have.
+var ErrPrivileged = errors.New("operation requires privileges")
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+	xattrPAXPrefix = "SCHILY.xattr."
+)
+
+// WhiteoutMode determines how whiteout entries (.wh.<name>) are handled.
+type WhiteoutMode string
+
+const (
+	// WhiteoutModeApply applies whiteouts by removing the whited-out paths, as when applying a layer onto its parent.
+	WhiteoutModeApply WhiteoutMode = "apply"
+	// WhiteoutModeOverlay converts whiteouts into overlayfs whiteouts, i.e. 0/0 character devices and opaque
+	// directory xattrs, so the target can be used as an overlayfs lower / upper directory.
+	WhiteoutModeOverlay WhiteoutMode = "overlay"
+)
+
+// Options are options for unpacking.
+type Options struct {
+	// NumericIDs uses the numeric user / group ids of the entries instead of looking up their names.
+	NumericIDs bool
+	// WhiteoutMode determines how whiteouts are handled. Defaults to WhiteoutModeApply.
+	WhiteoutMode WhiteoutMode
+	// Strict fails instead of skipping (with a warning) operations that require privileges,
+	// such as changing ownership or creating device nodes.
+	Strict bool
+	// OnFile, if set, is called for each regular file (including hardlinks) written.
+	OnFile func(f File)
+}
+
+// File describes a regular file written while unpacking.
+type File struct {
+	// Name is the slash-separated path of the file relative to the target directory.
+	Name string
+	// Size is the size of the file in bytes.
+	Size int64
+	// Digest is the sha256 digest of the file content.
+	Digest digest.Digest
+}
+
+// Option is an option for unpacking.
+type Option func(o *Options)
+
+// WithNumericIDs uses the numeric user / group ids of the entries.
+func WithNumericIDs() Option {
+	return func(o *Options) {
+		o.NumericIDs = true
+	}
+}
+
+// WithWhiteoutMode sets how whiteouts are handled.
+func WithWhiteoutMode(mode WhiteoutMode) Option {
+	return func(o *Options) {
+		o.WhiteoutMode = mode
+	}
+}
+
+// WithStrict fails on operations that require privileges instead of skipping them.
+func WithStrict() Option {
+	return func(o *Options) {
+		o.Strict = true
+	}
+}
+
+// WithOnFile sets a function called for each regular file written, e.g. to record checksums.
+func WithOnFile(onFile func(f File)) Option {
+	return func(o *Options) {
+		o.OnFile = onFile
+	}
+}
+
+// Compression is a compression format detected by DetectCompression.
+type Compression string
+
+const (
+	// CompressionNone denotes uncompressed content.
+	CompressionNone Compression = ""
+	// CompressionGzip denotes gzip compressed content.
+	CompressionGzip Compression = "gzip"
+	// CompressionZstd denotes zstd compressed content.
+	CompressionZstd Compression = "zstd"
+	// CompressionXz denotes xz compressed content, which can be detected but not decompressed.
+	CompressionXz Compression = "xz"
+)
+
+// ErrUnsupportedCompression is returned by Decompress for compression formats it cannot decompress.
+var ErrUnsupportedCompression = errors.New("unsupported compression")
+
+// DetectCompression detects the compression of r by its magic bytes. The returned reader yields the
+// full content.
+func DetectCompression(r io.Reader) (io.Reader, Compression, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(6)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, CompressionNone, fmt.Errorf("error reading magic: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return br, CompressionGzip, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return br, CompressionZstd, nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return br, CompressionXz, nil
+	default:
+		return br, CompressionNone, nil
+	}
+}
+
+// Decompress returns a reader for the decompressed content of r, detecting gzip and zstd compression.
+// Uncompressed content is returned as-is, xz compressed content fails with ErrUnsupportedCompression.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	r, compression, err := DetectCompression(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("%w %s", ErrUnsupportedCompression, compression)
+	}
+}
+
+// IsTar reports whether the given (decompressed) content starts with a tar header.
+// The returned reader yields the full content.
+func IsTar(r io.Reader) (io.Reader, bool, error) {
+	br := bufio.NewReaderSize(r, 512)
+	header, err := br.Peek(512)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, false, fmt.Errorf("error reading header: %w", err)
+	}
+	// ustar magic ("ustar\x0000" for POSIX, "ustar  \x00" for GNU) at offset 257.
+	return br, len(header) >= 262 && string(header[257:262]) == "ustar", nil
+}
+
+// Layer unpacks the given (optionally compressed) tar layer onto dir.
+func Layer(ctx context.Context, layer image.Layer, dir string, opts ...Option) error {
+	rc, err := layer.Content(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting layer content: %w", err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	return Tar(ctx, rc, dir, opts...)
+}
+
+// Tar unpacks the (optionally compressed) tar archive read from r onto dir.
+func Tar(ctx context.Context, r io.Reader, dir string, opts ...Option) error {
+	o := &Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.WhiteoutMode == "" {
+		o.WhiteoutMode = WhiteoutModeApply
+	}
+	if o.WhiteoutMode == WhiteoutModeOverlay && runtime.GOOS != "linux" {
+		return fmt.Errorf("whiteout mode %q is only supported on linux", WhiteoutModeOverlay)
+	}
+
+	dr, err := Decompress(r)
+	if err != nil {
+		return fmt.Errorf("error decompressing: %w", err)
+	}
+	defer func() { _ = dr.Close() }()
+
+	tr, ok, err := IsTar(dr)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotTar
+	}
+
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("error making target absolute: %w", err)
+	}
+
+	u := &unpacker{
+		log:        logr.FromContextOrDiscard(ctx),
+		root:       root,
+		opts:       *o,
+		privileged: os.Geteuid() == 0,
+		created:    make(map[string]struct{}),
+		files:      make(map[string]File),
+		uids:       make(map[string]int),
+		gids:       make(map[string]int),
+	}
+	return u.unpack(ctx, tar.NewReader(tr))
+}
+
+type dirTimes struct {
+	path  string
+	atime time.Time
+	mtime time.Time
+}
+
+type unpacker struct {
+	log        logr.Logger
+	root       string
+	opts       Options
+	privileged bool
+
+	// created are the paths (relative to root) created by this archive, used to apply opaque whiteouts
+	// only to content that existed before.
+	created map[string]struct{}
+	// files are the regular files written, by name, to report hardlinks.
+	files map[string]File
+	// dirs are the directories whose times have to be set after all their content was written.
+	dirs []dirTimes
+
+	warnedChown bool
+	warnedLink  bool
+	uids        map[string]int
+	gids        map[string]int
+}
+
+func (u *unpacker) unpack(ctx context.Context, tr *tar.Reader) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("error reading tar entry: %w", err)
+		}
+
+		if err := u.entry(ctx, hdr, tr); err != nil {
+			return fmt.Errorf("error unpacking %s: %w", hdr.Name, err)
+		}
+	}
+
+	for i := len(u.dirs) - 1; i >= 0; i-- {
+		d := u.dirs[i]
+		if err := lchtimes(d.path, d.atime, d.mtime); err != nil {
+			return fmt.Errorf("error setting times of %s: %w", d.path, err)
+		}
+	}
+	return nil
+}
+
+// skipPrivileged handles an operation that could not be done due to missing privileges.
+func (u *unpacker) skipPrivileged(name, op string) error {
+	if u.opts.Strict {
+		return fmt.Errorf("%w: %s %s", ErrPrivileged, op, name)
+	}
+	u.log.Info("Skipping operation requiring privileges", "Name", name, "Operation", op)
+	return nil
+}
+
+// skipUnsupported handles an operation that is not supported on this platform.
+func (u *unpacker) skipUnsupported(name, op string, err error) error {
+	if u.opts.Strict {
+		return err
+	}
+	u.log.Info("Skipping operation not supported on this platform", "Name", name, "Operation", op)
+	return nil
+}
+
+// link hardlinks target to linkTarget. If the file system does not support hardlinks (e.g. FAT / exFAT
+// or some network shares), the content, mode and times of linkTarget are copied instead.
+func (u *unpacker) link(name, linkTarget, target string) error {
+	linkErr := link(linkTarget, target)
+	if linkErr == nil {
+		return nil
+	}
+	if err := copyFile(linkTarget, target); err != nil {
+		return fmt.Errorf("%w (copying instead failed: %v)", linkErr, err)
+	}
+	if !u.warnedLink {
+		u.warnedLink = true
+		u.log.Info("Could not create hardlink, copying instead", "Name", name, "Error", linkErr.Error())
+	}
+	return nil
+}
+
+// link creates hardlinks, it is a variable so tests can simulate file systems without hardlink support.
+var link = os.Link
+
+// copyFile copies the content, mode and times of the regular file src to the new file dst.
+// src must not be a symlink, as it could point anywhere on the host.
+func copyFile(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is no regular file", src)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	// Make sure src was not replaced by a symlink since checking it.
+	opened, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(fi, opened) {
+		return fmt.Errorf("%s changed while copying it", src)
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	if err := os.Chmod(dst, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+func (u *unpacker) entry(ctx context.Context, hdr *tar.Header, r io.Reader) error {
+	name := path.Clean("/" + hdr.Name)
+	parent, base := path.Split(name)
+
+	if strings.HasPrefix(base, whiteoutPrefix) {
+		return u.whiteout(parent, base)
+	}
+
+	target, err := resolveInRoot(u.root, name)
+	if err != nil {
+		return err
+	}
+
+	if name != "/" {
+		if err := u.prepare(target, hdr); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		copied, err := ioutils.CopyVerify(ctx, f, r, ocispec.Descriptor{Size: hdr.Size}, ioutils.WithAlgorithm(digest.SHA256))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		u.file(File{Name: strings.TrimPrefix(name, "/"), Size: copied.Size, Digest: copied.Digest})
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			// Creating symlinks requires a privilege on Windows, unless developer mode is enabled.
+			if isPrivilegeError(err) {
+				return u.skipPrivileged(name, "symlink")
+			}
+			return err
+		}
+	case tar.TypeLink:
+		linkTarget, err := resolveInRoot(u.root, path.Clean("/"+hdr.Linkname))
+		if err != nil {
+			return err
+		}
+		if err := u.link(name, linkTarget, target); err != nil {
+			return err
+		}
+		u.created[name] = struct{}{}
+		if f, ok := u.files[strings.TrimPrefix(path.Clean("/"+hdr.Linkname), "/")]; ok {
+			f.Name = strings.TrimPrefix(name, "/")
+			u.file(f)
+		}
+		// Hardlinks share the metadata of their target, which was already applied.
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if hdr.Typeflag != tar.TypeFifo && !u.privileged {
+			return u.skipPrivileged(name, "mknod")
+		}
+		if err := mknod(target, hdr.Typeflag, hdr.Devmajor, hdr.Devminor); err != nil {
+			if errors.Is(err, os.ErrPermission) {
+				return u.skipPrivileged(name, "mknod")
+			}
+			if errors.Is(err, errNotSupported) {
+				return u.skipUnsupported(name, "mknod", err)
+			}
+			return err
+		}
+	case tar.TypeXGlobalHeader:
+		return nil
+	default:
+		u.log.Info("Skipping unsupported tar entry", "Name", name, "Type", string(hdr.Typeflag))
+		return nil
+	}
+
+	u.created[name] = struct{}{}
+	return u.metadata(name, target, hdr)
+}
+
+func (u *unpacker) file(f File) {
+	u.files[f.Name] = f
+	if u.opts.OnFile != nil {
+		u.opts.OnFile(f)
+	}
+}
+
+// prepare ensures the parent directory of target exists and removes any conflicting existing entry.
+func (u *unpacker) prepare(target string, hdr *tar.Header) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("error creating parent directory: %w", err)
+	}
+
+	fi, err := os.Lstat(target)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if fi.IsDir() && hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return os.RemoveAll(target)
+}
+
+// whiteout handles the whiteout entry base in the directory parent.
+func (u *unpacker) whiteout(parent, base string) error {
+	dir, err := resolveDirInRoot(u.root, parent)
+	if err != nil {
+		return err
+	}
+
+	var target string
+	if base != whiteoutOpaque {
+		// The whited-out name must be a single entry of parent, otherwise e.g. .wh.. would remove parent
+		// itself and .wh... its parent, which may be outside of root.
+		name := strings.TrimPrefix(base, whiteoutPrefix)
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return fmt.Errorf("invalid whiteout %s", path.Join(parent, base))
+		}
+		if target, err = resolveInRoot(u.root, path.Join(parent, name)); err != nil {
+			return err
+		}
+		if filepath.Dir(target) != dir {
+			return fmt.Errorf("whiteout %s resolves outside of its directory", path.Join(parent, base))
+		}
+	}
+
+	switch u.opts.WhiteoutMode {
+	case WhiteoutModeOverlay:
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("error creating parent directory: %w", err)
+		}
+		if !u.privileged {
+			return u.skipPrivileged(path.Join(parent, base), "create overlay whiteout")
+		}
+		if base == whiteoutOpaque {
+			return lsetxattr(dir, "trusted.overlay.opaque", []byte("y"))
+		}
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		return mknod(target, tar.TypeChar, 0, 0)
+	case WhiteoutModeApply:
+		if base == whiteoutOpaque {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			for _, entry := range entries {
+				if _, ok := u.created[path.Join(parent, entry.Name())]; ok {
+					continue
+				}
+				if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return os.RemoveAll(target)
+	default:
+		return fmt.Errorf("unknown whiteout mode %q", u.opts.WhiteoutMode)
+	}
+}
+
+// metadata applies ownership, mode, extended attributes and times of the entry.
+// The order matters: Changing ownership clears setuid bits and security.capability.
+func (u *unpacker) metadata(name, target string, hdr *tar.Header) error {
+	if err := u.chown(name, target, hdr); err != nil {
+		return err
+	}
+
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(target, hdr.FileInfo().Mode()); err != nil {
+			return fmt.Errorf("error changing mode: %w", err)
+		}
+	}
+
+	for key, value := range hdr.PAXRecords {
+		attr, ok := strings.CutPrefix(key, xattrPAXPrefix)
+		if !ok {
+			continue
+		}
+		if err := lsetxattr(target, attr, []byte(value)); err != nil {
+			if errors.Is(err, os.ErrPermission) || errors.Is(err, errNotSupported) {
+				if err := u.skipPrivileged(name, "set xattr "+attr); err != nil {
+					return err
+				}
+				continue
+			}
+			return fmt.Errorf("error setting xattr %s: %w", attr, err)
+		}
+	}
+
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		u.dirs = append(u.dirs, dirTimes{path: target, atime: atime, mtime: hdr.ModTime})
+		return nil
+	}
+	if err := lchtimes(target, atime, hdr.ModTime); err != nil {
+		return fmt.Errorf("error setting times: %w", err)
+	}
+	return nil
+}
+
+func (u *unpacker) chown(name, target string, hdr *tar.Header) error {
+	if !u.privileged {
+		if u.opts.Strict {
+			return fmt.Errorf("%w: chown %s", ErrPrivileged, name)
+		}
+		if !u.warnedChown {
+			u.log.Info("Not running as root, skipping changing ownership of unpacked files")
+			u.warnedChown = true
+		}
+		return nil
+	}
+
+	uid, gid := hdr.Uid, hdr.Gid
+	if !u.opts.NumericIDs {
+		uid = u.lookupID(u.uids, hdr.Uname, hdr.Uid, func(name string) (string, error) {
+			usr, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return usr.Uid, nil
+		})
+		gid = u.lookupID(u.gids, hdr.Gname, hdr.Gid, func(name string) (string, error) {
+			grp, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return grp.Gid, nil
+		})
+	}
+
+	if err := os.Lchown(target, uid, gid); err != nil {
+		return fmt.Errorf("error changing ownership: %w", err)
+	}
+	return nil
+}
+
+// lookupID resolves the id of the given user / group name, falling back to the numeric id of the entry.
+func (u *unpacker) lookupID(cache map[string]int, name string, id int, lookup func(name string) (string, error)) int {
+	if name == "" {
+		return id
+	}
+	if cached, ok := cache[name]; ok {
+		return cached
+	}
+
+	res := id
+	if s, err := lookup(name); err == nil {
+		if parsed, err := strconv.Atoi(s); err == nil {
+			res = parsed
+		}
+	}
+	cache[name] = res
+	return res
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package unpack
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var errNotSupported = unix.ENOTSUP
+
+func mknod(path string, typ byte, major, minor int64) error {
+	mode := uint32(0600)
+	switch typ {
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	case tar.TypeFifo:
+		mode |= unix.S_IFIFO
+	default:
+		return fmt.Errorf("unsupported node type %q", string(typ))
+	}
+
+	if err := unix.Mknod(path, mode, int(unix.Mkdev(uint32(major), uint32(minor)))); err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
+
+func lsetxattr(path, attr string, value []byte) error {
+	if err := unix.Lsetxattr(path, attr, value, 0); err != nil {
+		return &os.PathError{Op: "lsetxattr", Path: path, Err: err}
+	}
+	return nil
+}
+
+func lchtimes(path string, atime, mtime time.Time) error {
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "utimensat", Path: path, Err: err}
+	}
+	return nil
+}
+
+// MountDevice mounts the block device with the given file system type onto a temporary directory.
+// The returned function unmounts the device and removes the directory.
+func MountDevice(device, fsType string) (string, func() error, error) {
+	dir, err := os.MkdirTemp("", "onmetal-image-unpack-")
+	if err != nil {
+		return "", nil, fmt.Errorf("error creating mount point: %w", err)
+	}
+
+	if err := unix.Mount(device, dir, fsType, 0, ""); err != nil {
+		_ = os.Remove(dir)
+		return "", nil, fmt.Errorf("error mounting %s (%s): %w", device, fsType, err)
+	}
+
+	return dir, func() error {
+		if err := unix.Unmount(dir, 0); err != nil && !errors.Is(err, unix.EINVAL) {
+			return fmt.Errorf("error unmounting %s: %w", dir, err)
+		}
+		return os.Remove(dir)
+	}, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package unpack
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+var errNotSupported = errors.New("not supported on this platform")
+
+func mknod(path string, typ byte, major, minor int64) error {
+	return &os.PathError{Op: "mknod", Path: path, Err: errNotSupported}
+}
+
+func lsetxattr(path, attr string, value []byte) error {
+	return &os.PathError{Op: "lsetxattr", Path: path, Err: errNotSupported}
+}
+
+func lchtimes(path string, atime, mtime time.Time) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	// Changing the times of a symlink itself is not supported here, so leave them as-is.
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chtimes(path, atime, mtime)
+}
+
+// MountDevice mounts the block device with the given file system type onto a temporary directory.
+// It is only supported on Linux.
+func MountDevice(device, fsType string) (string, func() error, error) {
+	return "", nil, errNotSupported
+}
@@ -0,0 +1,259 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unpack_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	. "github.com/onmetal/onmetal-image/unpack"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+)
+
+type entry struct {
+	hdr  tar.Header
+	data string
+}
+
+func archive(entries ...entry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		Expect(tw.WriteHeader(&hdr)).To(Succeed())
+		_, err := io.WriteString(tw, e.data)
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(tw.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+func file(name, data string) entry {
+	return entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: name}, data: data}
+}
+
+func dir(name string) entry {
+	return entry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0755}}
+}
+
+var _ = Describe("Tar", func() {
+	var (
+		ctx    context.Context
+		target string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		target = GinkgoT().TempDir()
+	})
+
+	readFile := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(target, name))
+		Expect(err).NotTo(HaveOccurred())
+		return string(data)
+	}
+
+	It("should unpack files, directories, symlinks and hardlinks", func() {
+		Expect(Tar(ctx, bytes.NewReader(archive(
+			dir("etc/"),
+			entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0640}, data: "host"},
+			entry{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "etc/name", Linkname: "hostname"}},
+			entry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "etc/hostname.bak", Linkname: "etc/hostname"}},
+		)), target)).To(Succeed())
+
+		Expect(readFile("etc/hostname")).To(Equal("host"))
+		fi, err := os.Stat(filepath.Join(target, "etc/hostname"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fi.Mode().Perm()).To(Equal(os.FileMode(0640)))
+
+		link, err := os.Readlink(filepath.Join(target, "etc/name"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link).To(Equal("hostname"))
+
+		bak, err := os.Stat(filepath.Join(target, "etc/hostname.bak"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.SameFile(fi, bak)).To(BeTrue())
+	})
+
+	It("should copy hardlinked files if the file system does not support hardlinks", func() {
+		DeferCleanup(SetLink(func(oldname, newname string) error {
+			return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errors.New("not supported")}
+		}))
+
+		Expect(Tar(ctx, bytes.NewReader(archive(
+			entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "foo", Mode: 0640}, data: "bar"},
+			entry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "baz", Linkname: "foo"}},
+		)), target)).To(Succeed())
+
+		Expect(readFile("baz")).To(Equal("bar"))
+		foo, err := os.Stat(filepath.Join(target, "foo"))
+		Expect(err).NotTo(HaveOccurred())
+		baz, err := os.Stat(filepath.Join(target, "baz"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.SameFile(foo, baz)).To(BeFalse())
+		Expect(baz.Mode().Perm()).To(Equal(os.FileMode(0640)))
+		Expect(baz.ModTime()).To(Equal(foo.ModTime()))
+	})
+
+	It("should not copy hardlinks to symlinks pointing outside of the target", func() {
+		DeferCleanup(SetLink(func(oldname, newname string) error {
+			return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errors.New("not supported")}
+		}))
+		secret := filepath.Join(GinkgoT().TempDir(), "secret")
+		Expect(os.WriteFile(secret, []byte("secret"), 0600)).To(Succeed())
+
+		Expect(Tar(ctx, bytes.NewReader(archive(
+			entry{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "shadow", Linkname: secret}},
+			entry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "copy", Linkname: "shadow"}},
+		)), target)).To(MatchError(ContainSubstring("is no regular file")))
+
+		Expect(filepath.Join(target, "copy")).NotTo(BeAnExistingFile())
+	})
+
+	It("should report written files including hardlinks", func() {
+		var files []File
+		Expect(Tar(ctx, bytes.NewReader(archive(
+			file("foo", "bar"),
+			entry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "baz", Linkname: "foo"}},
+		)), target, WithOnFile(func(f File) {
+			files = append(files, f)
+		}))).To(Succeed())
+
+		Expect(files).To(Equal([]File{
+			{Name: "foo", Size: 3, Digest: digest.FromString("bar")},
+			{Name: "baz", Size: 3, Digest: digest.FromString("bar")},
+		}))
+	})
+
+	It("should detect gzip and zstd compression", func() {
+		data := archive(file("foo", "bar"))
+
+		var gz bytes.Buffer
+		gw := gzip.NewWriter(&gz)
+		_, err := gw.Write(data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gw.Close()).To(Succeed())
+		Expect(Tar(ctx, &gz, filepath.Join(target, "gzip"))).To(Succeed())
+		Expect(readFile("gzip/foo")).To(Equal("bar"))
+
+		enc, err := zstd.NewWriter(nil)
+		Expect(err).NotTo(HaveOccurred())
+		zst := enc.EncodeAll(data, nil)
+		Expect(Tar(ctx, bytes.NewReader(zst), filepath.Join(target, "zstd"))).To(Succeed())
+		Expect(readFile("zstd/foo")).To(Equal("bar"))
+	})
+
+	It("should detect xz compression without decompressing it", func() {
+		xz := []byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x42}
+		r, compression, err := DetectCompression(bytes.NewReader(xz))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(compression).To(Equal(CompressionXz))
+		Expect(io.ReadAll(r)).To(Equal(xz))
+
+		_, err = Decompress(bytes.NewReader(xz))
+		Expect(err).To(MatchError(ErrUnsupportedCompression))
+	})
+
+	It("should fail on content that is no tar archive", func() {
+		Expect(Tar(ctx, bytes.NewReader(bytes.Repeat([]byte{0x42}, 1024)), target)).To(MatchError(ErrNotTar))
+	})
+
+	It("should not write outside of the target", func() {
+		outside := GinkgoT().TempDir()
+		Expect(Tar(ctx, bytes.NewReader(archive(
+			file("../../escape", "nope"),
+			entry{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "link", Linkname: outside}},
+			file("link/escape", "nope"),
+		)), target)).To(Succeed())
+
+		Expect(readFile("escape")).To(Equal("nope"))
+		Expect(filepath.Join(outside, "escape")).NotTo(BeAnExistingFile())
+		Expect(readFile(filepath.Join(outside, "escape"))).To(Equal("nope"))
+	})
+
+	It("should apply whiteouts", func() {
+		Expect(Tar(ctx, bytes.NewReader(archive(
+			file("gone", "x"),
+			dir("opaque/"),
+			file("opaque/old", "x"),
+		)), target)).To(Succeed())
+
+		Expect(Tar(ctx, bytes.NewReader(archive(
+			file(".wh.gone", ""),
+			dir("opaque/"),
+			file("opaque/.wh..wh..opq", ""),
+			file("opaque/new", "y"),
+		)), target)).To(Succeed())
+
+		Expect(filepath.Join(target, "gone")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(target, "opaque/old")).NotTo(BeAnExistingFile())
+		Expect(readFile("opaque/new")).To(Equal("y"))
+	})
+
+	DescribeTable("should reject whiteouts not naming an entry of their directory",
+		func(name string) {
+			sibling := filepath.Join(target, "sibling")
+			Expect(os.WriteFile(sibling, []byte("x"), 0644)).To(Succeed())
+			root := filepath.Join(target, "root")
+			Expect(Tar(ctx, bytes.NewReader(archive(file("a/keep", "x"))), root)).To(Succeed())
+
+			Expect(Tar(ctx, bytes.NewReader(archive(file(name, ""))), root)).To(MatchError(ContainSubstring("invalid whiteout")))
+
+			Expect(filepath.Join(root, "a/keep")).To(BeAnExistingFile())
+			Expect(sibling).To(BeAnExistingFile())
+		},
+		Entry("the root", ".wh.."),
+		Entry("the root via a subdirectory", "a/.wh.."),
+		Entry("the parent of the root", ".wh..."),
+	)
+
+	It("should preserve numeric ownership when running as root", func() {
+		if os.Geteuid() != 0 {
+			Skip("requires root")
+		}
+
+		Expect(Tar(ctx, bytes.NewReader(archive(
+			entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "owned", Uid: 1234, Gid: 5678, Uname: "does-not-exist"}},
+		)), target, WithNumericIDs())).To(Succeed())
+
+		fi, err := os.Lstat(filepath.Join(target, "owned"))
+		Expect(err).NotTo(HaveOccurred())
+		uid, gid := owner(fi)
+		Expect(uid).To(BeEquivalentTo(1234))
+		Expect(gid).To(BeEquivalentTo(5678))
+	})
+
+	It("should fail in strict mode when not running as root", func() {
+		if os.Geteuid() == 0 {
+			Skip("requires running as non-root")
+		}
+
+		Expect(Tar(ctx, bytes.NewReader(archive(file("owned", "x"))), target, WithStrict())).To(MatchError(ErrPrivileged))
+		Expect(Tar(ctx, bytes.NewReader(archive(file("owned", "x"))), target)).To(Succeed())
+	})
+})
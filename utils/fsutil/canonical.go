@@ -0,0 +1,100 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fsutil
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// CanonicalPath returns the absolute path with all symlinks resolved, so the same directory reached via
+// different symlinks yields the same path. Trailing components that do not exist yet are kept as they are.
+// Bind mounts are not resolved, see KeyOf to identify files across them.
+func CanonicalPath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	var missing []string
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		missing = append([]string{filepath.Base(path)}, missing...)
+		path = parent
+	}
+}
+
+// FileKey identifies a file independently of the path it is reached by, e.g. to key process-local locks
+// of a file. It is comparable.
+type FileKey struct {
+	// Device and Inode identify the file on platforms reporting them, also across bind mounts.
+	Device, Inode uint64
+	// Path is the canonical path of the file (see CanonicalPath) on platforms not reporting inodes.
+	Path string
+}
+
+// KeyOf returns the FileKey of the existing file at path.
+func KeyOf(path string) (FileKey, error) {
+	canonical, err := CanonicalPath(path)
+	if err != nil {
+		return FileKey{}, err
+	}
+	fi, err := os.Stat(canonical)
+	if err != nil {
+		return FileKey{}, err
+	}
+
+	key := FileKey{Device: DeviceID(fi), Inode: FileID(fi)}
+	if key.Inode == 0 {
+		key = FileKey{Path: canonical}
+	}
+	return key, nil
+}
+
+// SameFileSystem reports whether the existing files at the paths a and b are on the same file system, so
+// renaming between them is atomic. On platforms not reporting device numbers, it compares the volumes of
+// their canonical paths instead.
+func SameFileSystem(a, b string) (bool, error) {
+	var (
+		paths   = [2]string{a, b}
+		devices [2]uint64
+	)
+	for i, path := range paths {
+		canonical, err := CanonicalPath(path)
+		if err != nil {
+			return false, err
+		}
+		fi, err := os.Stat(canonical)
+		if err != nil {
+			return false, err
+		}
+		paths[i], devices[i] = canonical, DeviceID(fi)
+	}
+	if devices[0] == 0 || devices[1] == 0 {
+		return filepath.VolumeName(paths[0]) == filepath.VolumeName(paths[1]), nil
+	}
+	return devices[0] == devices[1], nil
+}
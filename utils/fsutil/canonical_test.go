@@ -0,0 +1,82 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fsutil_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/onmetal/onmetal-image/utils/fsutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CanonicalPath", func() {
+	var (
+		dir  string
+		link string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = CanonicalPath(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Mkdir(filepath.Join(dir, "store"), 0777)).To(Succeed())
+		link = filepath.Join(GinkgoT().TempDir(), "link")
+		if err := os.Symlink(filepath.Join(dir, "store"), link); err != nil {
+			Skip(fmt.Sprintf("symlinks are not supported: %v", err))
+		}
+	})
+
+	It("should resolve symlinks and keep missing components", func() {
+		Expect(CanonicalPath(link)).To(Equal(filepath.Join(dir, "store")))
+		Expect(CanonicalPath(filepath.Join(link, "blobs", "sha256"))).To(Equal(filepath.Join(dir, "store", "blobs", "sha256")))
+
+		By("resolving relative paths against the working directory")
+		wd, err := os.Getwd()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Chdir(filepath.Dir(link))).To(Succeed())
+		DeferCleanup(os.Chdir, wd)
+		Expect(CanonicalPath("link")).To(Equal(filepath.Join(dir, "store")))
+	})
+
+	It("should key files identically regardless of the path they are reached by", func() {
+		Expect(os.WriteFile(filepath.Join(dir, "store", "index.json.lock"), nil, 0666)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "store", "other.lock"), nil, 0666)).To(Succeed())
+
+		key, err := KeyOf(filepath.Join(dir, "store", "index.json.lock"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(KeyOf(filepath.Join(link, "index.json.lock"))).To(Equal(key))
+		Expect(KeyOf(filepath.Join(link, "other.lock"))).NotTo(Equal(key))
+
+		_, err = KeyOf(filepath.Join(link, "missing.lock"))
+		Expect(err).To(MatchError(os.ErrNotExist))
+	})
+
+	It("should report directories behind symlinks on the same file system", func() {
+		Expect(SameFileSystem(link, dir)).To(BeTrue())
+		_, err := SameFileSystem(filepath.Join(link, "missing"), dir)
+		Expect(err).To(MatchError(os.ErrNotExist))
+	})
+})
+
+var _ = Describe("IsCrossDevice", func() {
+	It("should detect renames across file systems", func() {
+		Expect(IsCrossDevice(&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.EXDEV})).To(BeTrue())
+		Expect(IsCrossDevice(fmt.Errorf("error committing blob: %w", os.ErrNotExist))).To(BeFalse())
+	})
+})
@@ -0,0 +1,31 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !darwin
+
+package fsutil
+
+import "os"
+
+// FileID returns the inode number of the file. It is always zero on this platform, where os.FileInfo
+// does not expose it.
+func FileID(fi os.FileInfo) uint64 {
+	return 0
+}
+
+// DeviceID returns the device number of the file system holding the file. It is always zero on this
+// platform.
+func DeviceID(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,38 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !darwin && !windows
+
+package fsutil
+
+import "os"
+
+// FlockSupported reports whether the platform supports advisory file locks. Callers fall back to
+// process-local locks or lock files (see TryLockFile) where it does not.
+const FlockSupported = false
+
+// Flock returns ErrFlockNotSupported, as the platform has no advisory file locks.
+func Flock(f *os.File) error {
+	return ErrFlockNotSupported
+}
+
+// TryFlock returns ErrFlockNotSupported, as the platform has no advisory file locks.
+func TryFlock(f *os.File) (bool, error) {
+	return false, ErrFlockNotSupported
+}
+
+// Funlock returns ErrFlockNotSupported, as the platform has no advisory file locks.
+func Funlock(f *os.File) error {
+	return ErrFlockNotSupported
+}
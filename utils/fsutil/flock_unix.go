@@ -0,0 +1,56 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || darwin
+
+package fsutil
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// FlockSupported reports whether the platform supports advisory file locks, via flock(2) here.
+const FlockSupported = true
+
+// Flock exclusively locks the file, blocking until the lock is available.
+func Flock(f *os.File) error {
+	return flockError(syscall.Flock(int(f.Fd()), syscall.LOCK_EX))
+}
+
+// TryFlock exclusively locks the file without blocking. It reports false if another process (or another
+// open file of this process) holds the lock.
+func TryFlock(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, flockError(err)
+}
+
+// Funlock releases the lock taken by Flock or TryFlock.
+func Funlock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// flockError wraps the errors of file systems without flock support, i.e. ENOTSUP / EOPNOTSUPP or, like
+// NFS without a lock manager, ENOLCK, with ErrFlockNotSupported.
+func flockError(err error) error {
+	if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOLCK) {
+		return fmt.Errorf("%w: %v", ErrFlockNotSupported, err)
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fsutil
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// TryLockFile takes the lock at path without blocking by exclusively creating it, for file systems
+// without flock support (see Capabilities.Flock). It reports whether the lock was taken. Unlike flock
+// locks, lock files are not released if their holder crashes, so a lock file older than staleAfter is
+// considered abandoned and taken over.
+func TryLockFile(path string, staleAfter time.Duration) (unlock func() error, ok bool, err error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err == nil {
+			_, _ = fmt.Fprintf(f, "%d\n", os.Getpid())
+			_ = f.Close()
+			return func() error {
+				if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return err
+				}
+				return nil
+			}, true, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, false, err
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// Released in the meantime.
+				continue
+			}
+			return nil, false, err
+		}
+		if time.Since(fi.ModTime()) < staleAfter {
+			return nil, false, nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, false, fmt.Errorf("error removing stale lock file: %w", err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fsutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoAtomicRename is returned by Capabilities.Check if the file system does not support atomically
+// replacing a file via rename, which cannot be worked around.
+var ErrNoAtomicRename = errors.New("file system does not support atomic renames")
+
+// Capabilities are the capabilities of a file system a store relies on, as detected by Probe. Probing them
+// when opening a store lets unsupported file systems (e.g. NFS or FAT) fail or degrade early and with a
+// clear message instead of with obscure errors or corruption later.
+type Capabilities struct {
+	// Flock reports whether the file system supports advisory file locks (flock(2), or LockFileEx on
+	// Windows). If not, lock files are used instead, see TryLockFile. It is always true on platforms
+	// without advisory locks, where locks are process-local, see FlockSupported.
+	Flock bool `json:"flock"`
+	// AtomicRename reports whether renaming a file onto an existing one replaces it.
+	AtomicRename bool `json:"atomicRename"`
+	// TmpFile reports whether the file system supports unnamed temporary files (O_TMPFILE). It is always
+	// false on platforms other than linux.
+	TmpFile bool `json:"tmpFile"`
+}
+
+// Limitations returns human-readable descriptions of the missing capabilities the store degrades for.
+// Missing O_TMPFILE support is not a limitation since the store does not rely on it.
+func (c Capabilities) Limitations() []string {
+	var res []string
+	if !c.Flock {
+		res = append(res, "flock is not supported, falling back to lock files")
+	}
+	if !c.AtomicRename {
+		res = append(res, "renames are not atomic")
+	}
+	return res
+}
+
+// Check returns an error wrapping ErrNoAtomicRename if the file system cannot host a store.
+func (c Capabilities) Check() error {
+	if !c.AtomicRename {
+		return ErrNoAtomicRename
+	}
+	return nil
+}
+
+// Probe probes the capabilities of the file system of the existing directory dir by creating and
+// removing temporary files in it.
+func Probe(dir string) (Capabilities, error) {
+	flock, err := probeFlock(dir)
+	if err != nil {
+		return Capabilities{}, fmt.Errorf("error probing flock: %w", err)
+	}
+	rename, err := probeRename(dir)
+	if err != nil {
+		return Capabilities{}, fmt.Errorf("error probing rename: %w", err)
+	}
+	return Capabilities{
+		Flock:        flock,
+		AtomicRename: rename,
+		TmpFile:      probeTmpFile(dir),
+	}, nil
+}
+
+// String returns a short summary of the capabilities.
+func (c Capabilities) String() string {
+	var parts []string
+	for _, capability := range []struct {
+		name string
+		ok   bool
+	}{
+		{"flock", c.Flock},
+		{"atomic rename", c.AtomicRename},
+		{"O_TMPFILE", c.TmpFile},
+	} {
+		state := "yes"
+		if !capability.ok {
+			state = "no"
+		}
+		parts = append(parts, capability.name+": "+state)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// probeFlock reports whether a file in dir can be locked, see Flock.
+func probeFlock(dir string) (bool, error) {
+	if !FlockSupported {
+		return true, nil
+	}
+	f, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	ok, err := TryFlock(f)
+	switch {
+	case errors.Is(err, ErrFlockNotSupported):
+		return false, nil
+	case err != nil:
+		return false, err
+	case !ok:
+		return false, fmt.Errorf("temporary file %s is locked by another process", f.Name())
+	}
+	return true, Funlock(f)
+}
+
+// probeRename reports whether renaming a file onto an existing one replaces its content.
+func probeRename(dir string) (bool, error) {
+	src, err := writeTempFile(dir, "new")
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = os.Remove(src) }()
+	dst, err := writeTempFile(dir, "old")
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = os.Remove(dst) }()
+
+	if err := os.Rename(src, dst); err != nil {
+		return false, nil
+	}
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(src); !errors.Is(err, os.ErrNotExist) || !bytes.Equal(data, []byte("new")) {
+		return false, nil
+	}
+	return true, nil
+}
+
+func writeTempFile(dir, content string) (string, error) {
+	f, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return filepath.Clean(f.Name()), nil
+}
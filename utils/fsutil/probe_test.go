@@ -0,0 +1,158 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fsutil_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	. "github.com/onmetal/onmetal-image/utils/fsutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Probe", func() {
+	It("should detect the capabilities of the file system without leaving files behind", func() {
+		dir := GinkgoT().TempDir()
+
+		capabilities, err := Probe(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(capabilities.Flock).To(BeTrue())
+		Expect(capabilities.AtomicRename).To(BeTrue())
+		Expect(capabilities.Check()).To(Succeed())
+		Expect(capabilities.Limitations()).To(BeEmpty())
+
+		entries, err := os.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+
+	It("should report missing capabilities", func() {
+		capabilities := Capabilities{Flock: false, AtomicRename: false}
+		Expect(capabilities.Check()).To(MatchError(ErrNoAtomicRename))
+		Expect(capabilities.Limitations()).To(HaveLen(2))
+		Expect(capabilities.String()).To(Equal("flock: no, atomic rename: no, O_TMPFILE: no"))
+		if runtime.GOOS == "linux" {
+			capabilities, err := Probe(GinkgoT().TempDir())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(capabilities.TmpFile).To(BeTrue())
+		}
+	})
+})
+
+var _ = Describe("ProbeProtection", func() {
+	It("should detect the supported protections without leaving files behind", func() {
+		dir := GinkgoT().TempDir()
+
+		support, err := ProbeProtection(dir)
+		Expect(err).NotTo(HaveOccurred())
+		if runtime.GOOS != "linux" {
+			Expect(support).To(Equal(ProtectionSupport{}))
+		}
+
+		entries, err := os.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+
+	It("should make files immutable where supported", func() {
+		dir := GinkgoT().TempDir()
+		support, err := ProbeProtection(dir)
+		Expect(err).NotTo(HaveOccurred())
+		if !support.Immutable {
+			Skip("the immutable attribute is not supported or permitted")
+		}
+
+		path := filepath.Join(dir, "file")
+		Expect(os.WriteFile(path, []byte("content"), 0666)).To(Succeed())
+		Expect(SetImmutable(path, true)).To(Succeed())
+		Expect(IsImmutable(path)).To(BeTrue())
+		Expect(os.Remove(path)).NotTo(Succeed())
+
+		Expect(SetImmutable(path, false)).To(Succeed())
+		Expect(IsImmutable(path)).To(BeFalse())
+		Expect(os.Remove(path)).To(Succeed())
+	})
+})
+
+var _ = Describe("TryLockFile", func() {
+	It("should take the lock exclusively until it is released", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "lock")
+
+		unlock, ok, err := TryLockFile(path, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		_, ok, err = TryLockFile(path, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeFalse())
+
+		Expect(unlock()).To(Succeed())
+		Expect(path).NotTo(BeAnExistingFile())
+
+		unlock, ok, err = TryLockFile(path, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(unlock()).To(Succeed())
+	})
+
+	It("should take over stale lock files", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "lock")
+		Expect(os.WriteFile(path, nil, 0666)).To(Succeed())
+		stale := time.Now().Add(-2 * time.Hour)
+		Expect(os.Chtimes(path, stale, stale)).To(Succeed())
+
+		unlock, ok, err := TryLockFile(path, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(unlock()).To(Succeed())
+	})
+})
+
+var _ = Describe("TryFlock", func() {
+	It("should lock a file exclusively across open files until it is unlocked", func() {
+		if !FlockSupported {
+			Skip("advisory file locks are not supported on this platform")
+		}
+		path := filepath.Join(GinkgoT().TempDir(), "lock")
+		open := func() *os.File {
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(f.Close)
+			return f
+		}
+		f1, f2 := open(), open()
+
+		Expect(TryFlock(f1)).To(BeTrue())
+		Expect(TryFlock(f2)).To(BeFalse())
+
+		Expect(Funlock(f1)).To(Succeed())
+		Expect(TryFlock(f2)).To(BeTrue())
+		Expect(Funlock(f2)).To(Succeed())
+	})
+})
+
+var _ = Describe("IsNoSpace", func() {
+	It("should detect out of space errors, also when wrapped", func() {
+		Expect(IsNoSpace(&os.PathError{Op: "write", Path: "blob", Err: syscall.ENOSPC})).To(BeTrue())
+		Expect(IsNoSpace(fmt.Errorf("error writing blob: %w", syscall.ENOSPC))).To(BeTrue())
+		Expect(IsNoSpace(os.ErrNotExist)).To(BeFalse())
+		Expect(IsNoSpace(nil)).To(BeFalse())
+	})
+})
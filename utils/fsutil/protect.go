@@ -0,0 +1,70 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fsutil
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// ErrProtectionNotSupported is returned by the functions protecting files against tampering if the file
+// system (or the platform) does not support the protection or the process lacks the privileges to apply
+// it, e.g. CAP_LINUX_IMMUTABLE for the immutable attribute.
+var ErrProtectionNotSupported = errors.New("file protection is not supported")
+
+// ProtectionSupport reports which protections against tampering the file system of a directory supports,
+// as detected by ProbeProtection.
+type ProtectionSupport struct {
+	// Verity reports whether fsverity can be enabled on files, see EnableVerity.
+	Verity bool `json:"verity"`
+	// Immutable reports whether files can be made immutable by this process, see SetImmutable.
+	Immutable bool `json:"immutable"`
+}
+
+// String returns a short summary of the supported protections.
+func (p ProtectionSupport) String() string {
+	var parts []string
+	if p.Verity {
+		parts = append(parts, "fsverity")
+	}
+	if p.Immutable {
+		parts = append(parts, "immutable attribute")
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ProbeProtection probes which protections can be applied to files in the existing directory dir by
+// protecting a temporary file, which is removed again.
+func ProbeProtection(dir string) (ProtectionSupport, error) {
+	path, err := writeTempFile(dir, "probe")
+	if err != nil {
+		return ProtectionSupport{}, err
+	}
+	defer func() { _ = os.Remove(path) }()
+
+	var support ProtectionSupport
+	if err := SetImmutable(path, true); err == nil {
+		support.Immutable = true
+		if err := SetImmutable(path, false); err != nil {
+			return ProtectionSupport{}, err
+		}
+	}
+	support.Verity = EnableVerity(path) == nil
+	return support, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fsutil
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// immutableFlag is FS_IMMUTABLE_FL of linux/fs.h, which golang.org/x/sys/unix does not define.
+const immutableFlag = 0x10
+
+// maxVerityDigestSize is the size of the largest fsverity digest, the one of SHA-512.
+const maxVerityDigestSize = 64
+
+// verityAlgorithms are the names of the fsverity hash algorithms, as printed by fsverity measure.
+var verityAlgorithms = map[uint16]string{
+	unix.FS_VERITY_HASH_ALG_SHA256: "sha256",
+	unix.FS_VERITY_HASH_ALG_SHA512: "sha512",
+}
+
+// protectionError wraps the errors of file systems not supporting a protection and of processes not
+// allowed to apply it with ErrProtectionNotSupported.
+func protectionError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.ENOTTY), errors.Is(err, unix.EOPNOTSUPP), errors.Is(err, unix.EINVAL), errors.Is(err, unix.EPERM):
+		return fmt.Errorf("%w: %v", ErrProtectionNotSupported, err)
+	default:
+		return err
+	}
+}
+
+func fileFlags(f *os.File) (uint32, error) {
+	return unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+}
+
+// EnableVerity enables fsverity with SHA-256 on the file at path, after which the kernel verifies all
+// reads of it and rejects opening it for writing. The file must not be open for writing. Enabling it
+// on a file that already has fsverity enabled succeeds.
+func EnableVerity(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	arg := unix.FsverityEnableArg{
+		Version:        1,
+		Hash_algorithm: unix.FS_VERITY_HASH_ALG_SHA256,
+		Block_size:     uint32(os.Getpagesize()),
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_ENABLE_VERITY, uintptr(unsafe.Pointer(&arg)))
+	if errno != 0 && errno != unix.EEXIST {
+		return protectionError(errno)
+	}
+	return nil
+}
+
+// MeasureVerity returns the fsverity digest of the file at path as <algorithm>:<hex> like fsverity
+// measure prints it, e.g. sha256:ab12... Note that this is not the digest of the file content but the
+// root of its Merkle tree. It reports false if fsverity is not enabled on the file.
+func MeasureVerity(path string) (string, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var measurement struct {
+		unix.FsverityDigest
+		digest [maxVerityDigestSize]byte
+	}
+	measurement.Size = maxVerityDigestSize
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_MEASURE_VERITY, uintptr(unsafe.Pointer(&measurement)))
+	switch {
+	case errno == unix.ENODATA:
+		return "", false, nil
+	case errno != 0:
+		return "", false, protectionError(errno)
+	}
+	algorithm, ok := verityAlgorithms[measurement.Algorithm]
+	if !ok {
+		algorithm = fmt.Sprintf("alg%d", measurement.Algorithm)
+	}
+	return algorithm + ":" + hex.EncodeToString(measurement.digest[:measurement.Size]), true, nil
+}
+
+// SetImmutable sets or clears the immutable attribute of the file at path. Immutable files cannot be
+// written, renamed or removed, not even by root without clearing the attribute first, which requires
+// CAP_LINUX_IMMUTABLE.
+func SetImmutable(path string, immutable bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	flags, err := fileFlags(f)
+	if err != nil {
+		return protectionError(err)
+	}
+	updated := flags &^ immutableFlag
+	if immutable {
+		updated |= immutableFlag
+	}
+	if updated == flags {
+		return nil
+	}
+	return protectionError(unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(updated)))
+}
+
+// IsImmutable reports whether the file at path has the immutable attribute, see SetImmutable.
+func IsImmutable(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+
+	flags, err := fileFlags(f)
+	if err != nil {
+		return false, protectionError(err)
+	}
+	return flags&immutableFlag != 0, nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package fsutil
+
+// EnableVerity enables fsverity on the file at path. It always fails with ErrProtectionNotSupported on
+// platforms other than linux.
+func EnableVerity(path string) error {
+	return ErrProtectionNotSupported
+}
+
+// MeasureVerity returns the fsverity digest of the file at path. fsverity is never enabled on platforms
+// other than linux.
+func MeasureVerity(path string) (string, bool, error) {
+	return "", false, nil
+}
+
+// SetImmutable sets or clears the immutable attribute of the file at path. Setting it always fails with
+// ErrProtectionNotSupported on platforms other than linux, clearing it is a no-op.
+func SetImmutable(path string, immutable bool) error {
+	if immutable {
+		return ErrProtectionNotSupported
+	}
+	return nil
+}
+
+// IsImmutable reports whether the file at path has the immutable attribute, which is never the case on
+// platforms other than linux.
+func IsImmutable(path string) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,28 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fsutil
+
+import "errors"
+
+// IsNotWritable reports whether the error is caused by a read-only file system or missing write
+// permissions, i.e. EROFS, EACCES or their equivalents of the platform.
+func IsNotWritable(err error) bool {
+	for _, target := range notWritableErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,283 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ioutils provides the copy loop shared by all transfers of content, handling cancellation,
+// digest and size verification, progress and bandwidth limiting in one place.
+package ioutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var (
+	// ErrDigestMismatch is returned if the content read does not match the expected digest.
+	ErrDigestMismatch = errors.New("digest mismatch")
+	// ErrSizeMismatch is returned if the content read is shorter or longer than the expected size.
+	ErrSizeMismatch = errors.New("size mismatch")
+)
+
+// bufferSize is the size of the buffer of CopyVerify.
+const bufferSize = 32 << 10
+
+// emptyDigest is the digest of empty content.
+var emptyDigest = digest.FromBytes(nil)
+
+// Limiter limits the rate content is read at, e.g. remote.BandwidthLimiter.
+type Limiter interface {
+	// Reader returns a reader reading from r at the rate of the limiter, aborting waits when ctx is done.
+	Reader(ctx context.Context, r io.Reader) io.Reader
+}
+
+// Options are options for reading content, see NewReader.
+type Options struct {
+	// Offset is the number of bytes of the content already transferred before, which the source
+	// continues from.
+	Offset int64
+	// Digester holds the state of the digest of the first Offset bytes. If nil while Offset is set, the
+	// digest is neither computed nor verified.
+	Digester digest.Digester
+	// Algorithm is the algorithm to compute the digest with if no digest is expected, digest.Canonical
+	// if empty.
+	Algorithm digest.Algorithm
+	// ProgressInterval is the minimum number of bytes between two calls of Progress.
+	ProgressInterval int64
+	// Progress is called with the offset of the content read so far, see WithProgress.
+	Progress func(offset int64)
+	// Limiter limits the rate the content is read at.
+	Limiter Limiter
+}
+
+// Option is an option for reading content.
+type Option func(o *Options)
+
+// WithOffset continues a transfer resumed at offset. digester holds the state of the digest of the
+// content before offset, nil skips verifying the digest, e.g. if the destination verifies it on commit.
+// The expected size still covers the whole content.
+func WithOffset(offset int64, digester digest.Digester) Option {
+	return func(o *Options) {
+		o.Offset = offset
+		o.Digester = digester
+	}
+}
+
+// WithAlgorithm computes the digest of content without expected digest with the given algorithm.
+func WithAlgorithm(algorithm digest.Algorithm) Option {
+	return func(o *Options) {
+		o.Algorithm = algorithm
+	}
+}
+
+// WithProgress calls fn with the offset of the content read so far at most every interval bytes, e.g.
+// with progress.BlobProgressFunc.
+func WithProgress(interval int64, fn func(offset int64)) Option {
+	return func(o *Options) {
+		o.ProgressInterval = interval
+		o.Progress = fn
+	}
+}
+
+// WithLimiter reads the content at the rate of the limiter. A nil limiter does not limit.
+func WithLimiter(limiter Limiter) Option {
+	return func(o *Options) {
+		o.Limiter = limiter
+	}
+}
+
+// Reader reads content, verifying it against an expected descriptor. Once the source is exhausted, Read
+// returns an error wrapping ErrSizeMismatch or ErrDigestMismatch instead of io.EOF if the content does
+// not match. Reading beyond the expected size fails with ErrSizeMismatch before any excess byte is
+// returned. Reading stops with the error of the context once it is done.
+type Reader struct {
+	ctx      context.Context
+	r        io.Reader
+	expect   ocispec.Descriptor
+	sized    bool
+	digester digest.Digester
+
+	offset   int64
+	interval int64
+	reported int64
+	progress func(offset int64)
+
+	err error
+}
+
+// NewReader returns a Reader reading src and verifying it against the size and digest of expect, if any.
+// A size of zero only counts as expected size for the empty digest, since some legacy tools wrote
+// descriptors with a zero size despite non-empty content, see imageutil.HasKnownSize.
+func NewReader(ctx context.Context, src io.Reader, expect ocispec.Descriptor, opts ...Option) (*Reader, error) {
+	o := &Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	r := &Reader{
+		ctx:      ctx,
+		r:        src,
+		expect:   expect,
+		sized:    expect.Size > 0 || (expect.Size == 0 && expect.Digest == emptyDigest),
+		offset:   o.Offset,
+		reported: o.Offset,
+		interval: o.ProgressInterval,
+		progress: o.Progress,
+	}
+	if o.Limiter != nil {
+		r.r = o.Limiter.Reader(ctx, src)
+	}
+
+	switch {
+	case o.Offset > 0:
+		r.digester = o.Digester
+	case expect.Digest != "":
+		if err := expect.Digest.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid expected digest %q: %w", expect.Digest, err)
+		}
+		r.digester = expect.Digest.Algorithm().Digester()
+	default:
+		algorithm := o.Algorithm
+		if algorithm == "" {
+			algorithm = digest.Canonical
+		}
+		if !algorithm.Available() {
+			return nil, fmt.Errorf("unsupported digest algorithm %s", algorithm)
+		}
+		r.digester = algorithm.Digester()
+	}
+	if r.sized && r.offset > expect.Size {
+		return nil, fmt.Errorf("%w: resuming at offset %d beyond expected size %d", ErrSizeMismatch, r.offset, expect.Size)
+	}
+	return r, nil
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if err := r.ctx.Err(); err != nil {
+		r.err = err
+		return 0, err
+	}
+
+	// Read at most the remaining bytes, probing with a single byte for excess content once all are read.
+	var probe [1]byte
+	if r.sized {
+		switch remaining := r.expect.Size - r.offset; {
+		case remaining == 0:
+			p = probe[:]
+		case int64(len(p)) > remaining:
+			p = p[:remaining]
+		}
+	}
+
+	n, err := r.r.Read(p)
+	if r.sized && r.offset == r.expect.Size && n > 0 {
+		r.err = fmt.Errorf("%w: content exceeds expected size %d", ErrSizeMismatch, r.expect.Size)
+		return 0, r.err
+	}
+	if n > 0 {
+		if r.digester != nil {
+			_, _ = r.digester.Hash().Write(p[:n])
+		}
+		r.offset += int64(n)
+		if r.progress != nil && r.offset-r.reported >= r.interval {
+			r.reported = r.offset
+			r.progress(r.offset)
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		if verifyErr := r.verify(); verifyErr != nil {
+			r.err = verifyErr
+			return n, verifyErr
+		}
+		r.err = io.EOF
+	} else if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// verify verifies the content read against the expected descriptor.
+func (r *Reader) verify() error {
+	if r.sized && r.offset != r.expect.Size {
+		return fmt.Errorf("%w: got %d bytes, expected %d", ErrSizeMismatch, r.offset, r.expect.Size)
+	}
+	if r.expect.Digest != "" && r.digester != nil {
+		if dgst := r.digester.Digest(); dgst != r.expect.Digest {
+			return fmt.Errorf("%w: got %s, expected %s", ErrDigestMismatch, dgst, r.expect.Digest)
+		}
+	}
+	return nil
+}
+
+// Size returns the number of bytes of the content read so far, including those before the offset the
+// transfer was resumed at, see WithOffset.
+func (r *Reader) Size() int64 {
+	return r.offset
+}
+
+// Digest returns the digest of the content read so far, empty if it is not computed, see WithOffset.
+func (r *Reader) Digest() digest.Digest {
+	if r.digester == nil {
+		return ""
+	}
+	return r.digester.Digest()
+}
+
+// CopyVerify copies src to dst until EOF, verifying the content against the size and digest of expect
+// (see NewReader), and returns expect with the digest and size of the copied content. Content written
+// to dst before a mismatch is detected is not taken back, so dst has to be discarded on error, e.g. by
+// not committing it. The number of bytes written is the size of the returned descriptor minus the
+// offset of resumed transfers, also on error.
+func CopyVerify(ctx context.Context, dst io.Writer, src io.Reader, expect ocispec.Descriptor, opts ...Option) (ocispec.Descriptor, error) {
+	r, err := NewReader(ctx, src, expect, opts...)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	res := expect
+	buf := make([]byte, bufferSize)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			written, writeErr := dst.Write(buf[:n])
+			if writeErr == nil && written != n {
+				writeErr = io.ErrShortWrite
+			}
+			if writeErr != nil {
+				res.Size = r.Size() - int64(n-written)
+				return res, writeErr
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			res.Size = r.Size()
+			return res, readErr
+		}
+	}
+
+	res.Size = r.Size()
+	if dgst := r.Digest(); dgst != "" {
+		res.Digest = dgst
+	}
+	return res, nil
+}
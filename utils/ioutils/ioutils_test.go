@@ -0,0 +1,209 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ioutils_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing/iotest"
+
+	. "github.com/onmetal/onmetal-image/utils/ioutils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// cancelingReader cancels the context once the given number of bytes were read.
+type cancelingReader struct {
+	r      io.Reader
+	after  int
+	read   int
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += n
+	if r.read >= r.after {
+		r.cancel()
+	}
+	return n, err
+}
+
+// countingLimiter counts the readers it limited.
+type countingLimiter struct {
+	readers int
+}
+
+func (l *countingLimiter) Reader(_ context.Context, r io.Reader) io.Reader {
+	l.readers++
+	return r
+}
+
+var _ = Describe("CopyVerify", func() {
+	var (
+		ctx     = context.Background()
+		content []byte
+		desc    ocispec.Descriptor
+	)
+
+	BeforeEach(func() {
+		content = bytes.Repeat([]byte("onmetal-image "), 10000)
+		desc = ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(content), Size: int64(len(content))}
+	})
+
+	It("should copy and verify content of the expected size", func() {
+		var dst bytes.Buffer
+		res, err := CopyVerify(ctx, &dst, bytes.NewReader(content), desc)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(desc))
+		Expect(dst.Bytes()).To(Equal(content))
+	})
+
+	It("should handle short reads", func() {
+		for _, r := range []io.Reader{
+			iotest.OneByteReader(bytes.NewReader(content)),
+			iotest.HalfReader(bytes.NewReader(content)),
+			iotest.DataErrReader(bytes.NewReader(content)),
+		} {
+			var dst bytes.Buffer
+			res, err := CopyVerify(ctx, &dst, r, desc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal(desc))
+			Expect(dst.Bytes()).To(Equal(content))
+		}
+	})
+
+	It("should compute digest and size without expectations", func() {
+		res, err := CopyVerify(ctx, io.Discard, bytes.NewReader(content), ocispec.Descriptor{}, WithAlgorithm(digest.SHA512))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Digest).To(Equal(digest.SHA512.FromBytes(content)))
+		Expect(res.Size).To(Equal(int64(len(content))))
+	})
+
+	It("should fail on streams shorter than expected", func() {
+		var dst bytes.Buffer
+		res, err := CopyVerify(ctx, &dst, bytes.NewReader(content[:len(content)-1]), desc)
+		Expect(err).To(MatchError(ErrSizeMismatch))
+		Expect(res.Size).To(Equal(desc.Size - 1))
+	})
+
+	It("should fail on oversize streams without writing the excess", func() {
+		var dst bytes.Buffer
+		oversize := append(append([]byte(nil), content...), "excess"...)
+		_, err := CopyVerify(ctx, &dst, iotest.HalfReader(bytes.NewReader(oversize)), desc)
+		Expect(err).To(MatchError(ErrSizeMismatch))
+		Expect(dst.Len()).To(Equal(len(content)))
+	})
+
+	It("should detect a digest mismatch at the last byte", func() {
+		corrupt := append([]byte(nil), content...)
+		corrupt[len(corrupt)-1] ^= 0xff
+		_, err := CopyVerify(ctx, io.Discard, bytes.NewReader(corrupt), desc)
+		Expect(err).To(MatchError(ErrDigestMismatch))
+	})
+
+	It("should only enforce zero sizes for the empty digest", func() {
+		legacy := desc
+		legacy.Size = 0
+		res, err := CopyVerify(ctx, io.Discard, bytes.NewReader(content), legacy)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Size).To(Equal(int64(len(content))))
+
+		empty := ocispec.Descriptor{Digest: digest.FromBytes(nil)}
+		_, err = CopyVerify(ctx, io.Discard, bytes.NewReader(content), empty)
+		Expect(err).To(MatchError(ErrSizeMismatch))
+		_, err = CopyVerify(ctx, io.Discard, bytes.NewReader(nil), empty)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should stop when the context is cancelled mid-copy", func() {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		var dst bytes.Buffer
+		r := &cancelingReader{r: iotest.OneByteReader(bytes.NewReader(content)), after: 100, cancel: cancel}
+		_, err := CopyVerify(ctx, &dst, r, desc)
+		Expect(err).To(MatchError(context.Canceled))
+		Expect(dst.Len()).To(Equal(100))
+	})
+
+	It("should fail on short writes and write errors", func() {
+		_, err := CopyVerify(ctx, shortWriter{}, bytes.NewReader(content), desc)
+		Expect(err).To(MatchError(io.ErrShortWrite))
+
+		writeErr := errors.New("disk on fire")
+		_, err = CopyVerify(ctx, errWriter{writeErr}, bytes.NewReader(content), desc)
+		Expect(err).To(MatchError(writeErr))
+	})
+
+	It("should continue resumed transfers", func() {
+		const offset = 1000
+		digester := digest.Canonical.Digester()
+		_, _ = digester.Hash().Write(content[:offset])
+
+		var dst bytes.Buffer
+		res, err := CopyVerify(ctx, &dst, bytes.NewReader(content[offset:]), desc, WithOffset(offset, digester))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(desc))
+		Expect(dst.Bytes()).To(Equal(content[offset:]))
+
+		By("only verifying the size without the digest state")
+		corrupt := append([]byte(nil), content[offset:]...)
+		corrupt[0] ^= 0xff
+		res, err = CopyVerify(ctx, io.Discard, bytes.NewReader(corrupt), desc, WithOffset(offset, nil))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(desc))
+		_, err = CopyVerify(ctx, io.Discard, bytes.NewReader(corrupt[1:]), desc, WithOffset(offset, nil))
+		Expect(err).To(MatchError(ErrSizeMismatch))
+	})
+
+	It("should report progress and read through the limiter", func() {
+		var (
+			offsets []int64
+			limiter = &countingLimiter{}
+		)
+		_, err := CopyVerify(ctx, io.Discard, iotest.OneByteReader(bytes.NewReader(content)), desc,
+			WithOffset(0, nil),
+			WithProgress(50000, func(offset int64) { offsets = append(offsets, offset) }),
+			WithLimiter(limiter),
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(offsets).To(Equal([]int64{50000, 100000}))
+		Expect(limiter.readers).To(Equal(1))
+	})
+
+	It("should reject invalid expected digests", func() {
+		_, err := CopyVerify(ctx, io.Discard, bytes.NewReader(content), ocispec.Descriptor{Digest: "sha256:nope"})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+type shortWriter struct{}
+
+func (shortWriter) Write(p []byte) (int, error) {
+	return len(p) / 2, nil
+}
+
+type errWriter struct {
+	err error
+}
+
+func (w errWriter) Write([]byte) (int, error) {
+	return 0, w.err
+}
@@ -0,0 +1,246 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package yamlpath finds scalars in YAML (and thus JSON) documents by path expressions such as
+// .spec.image and replaces them in place, keeping comments and formatting of the document.
+package yamlpath
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// segment is a segment of a path: a mapping key or, if index is set, a sequence index, -1 for all
+// elements.
+type segment struct {
+	key   string
+	index *int
+}
+
+// Path is a parsed path expression, see Parse.
+type Path struct {
+	expr     string
+	segments []segment
+}
+
+func (p Path) String() string {
+	return p.expr
+}
+
+// Parse parses a path expression: a sequence of mapping keys each prefixed with a dot, each optionally
+// followed by sequence indexes in brackets, where [] selects all elements, e.g. .spec.image or
+// .items[].spec.volumes[0].image. The path "." selects the document root.
+func Parse(expr string) (Path, error) {
+	if !strings.HasPrefix(expr, ".") {
+		return Path{}, fmt.Errorf("invalid path %q: has to start with a dot", expr)
+	}
+	p := Path{expr: expr}
+	if expr == "." {
+		return p, nil
+	}
+	rest := expr
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[]")
+			if end == -1 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return Path{}, fmt.Errorf("invalid path %q: empty key", expr)
+			}
+			p.segments = append(p.segments, segment{key: key})
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return Path{}, fmt.Errorf("invalid path %q: unterminated index", expr)
+			}
+			i := -1
+			if idx := rest[1:end]; idx != "" {
+				n, err := strconv.Atoi(idx)
+				if err != nil || n < 0 {
+					return Path{}, fmt.Errorf("invalid path %q: invalid index %q", expr, idx)
+				}
+				i = n
+			}
+			p.segments = append(p.segments, segment{index: &i})
+			rest = rest[end+1:]
+		default:
+			return Path{}, fmt.Errorf("invalid path %q: unexpected %q", expr, rest[0])
+		}
+	}
+	return p, nil
+}
+
+// Scalar is a scalar value found in a document.
+type Scalar struct {
+	// Path is the path the scalar was found by.
+	Path Path
+	// Value is the value of the scalar.
+	Value string
+	// Line and Column are the 1-based position of the scalar in the data.
+	Line, Column int
+
+	// offset and raw are the byte offset and the text of the scalar in the data, including quotes.
+	offset int
+	raw    string
+}
+
+// ErrUnsupportedScalar is returned by Find for scalars that cannot be replaced in place, i.e. literal and
+// folded block scalars and quoted scalars with escape sequences.
+var ErrUnsupportedScalar = errors.New("scalar cannot be replaced in place")
+
+// Find returns the scalars selected by the paths in all documents of the data, in the order they appear.
+// Paths not matching a document are skipped, paths selecting a collection fail.
+func Find(data []byte, paths ...Path) ([]Scalar, error) {
+	var res []Scalar
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yaml.Node
+		if err := dec.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("error parsing document: %w", err)
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+		for _, path := range paths {
+			for _, node := range lookup(doc.Content[0], path.segments) {
+				scalar, err := newScalar(data, path, node)
+				if err != nil {
+					return nil, err
+				}
+				res = append(res, scalar)
+			}
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].offset < res[j].offset })
+	return res, nil
+}
+
+// lookup returns the nodes selected by the segments below node.
+func lookup(node *yaml.Node, segments []segment) []*yaml.Node {
+	if len(segments) == 0 {
+		return []*yaml.Node{node}
+	}
+	seg, rest := segments[0], segments[1:]
+
+	var res []*yaml.Node
+	switch {
+	case seg.index == nil && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == seg.key {
+				res = append(res, lookup(node.Content[i+1], rest)...)
+			}
+		}
+	case seg.index != nil && node.Kind == yaml.SequenceNode:
+		for i, elem := range node.Content {
+			if *seg.index == -1 || *seg.index == i {
+				res = append(res, lookup(elem, rest)...)
+			}
+		}
+	}
+	return res
+}
+
+func newScalar(data []byte, path Path, node *yaml.Node) (Scalar, error) {
+	s := Scalar{Path: path, Value: node.Value, Line: node.Line, Column: node.Column}
+	if node.Kind != yaml.ScalarNode {
+		return Scalar{}, fmt.Errorf("path %s selects no scalar at line %d", path, node.Line)
+	}
+
+	offset, ok := byteOffset(data, node.Line, node.Column)
+	if !ok {
+		return Scalar{}, fmt.Errorf("position %d:%d of path %s is out of range", node.Line, node.Column, path)
+	}
+	s.offset = offset
+
+	switch node.Style {
+	case 0:
+		s.raw = node.Value
+	case yaml.DoubleQuotedStyle:
+		s.raw = `"` + node.Value + `"`
+	case yaml.SingleQuotedStyle:
+		s.raw = "'" + node.Value + "'"
+	}
+	if s.raw == "" || !bytes.HasPrefix(data[offset:], []byte(s.raw)) {
+		return Scalar{}, fmt.Errorf("%w: %s at line %d", ErrUnsupportedScalar, path, node.Line)
+	}
+	return s, nil
+}
+
+// byteOffset returns the byte offset of the 1-based line and (character) column in data.
+func byteOffset(data []byte, line, column int) (int, bool) {
+	offset := 0
+	for i := 1; i < line; i++ {
+		nl := bytes.IndexByte(data[offset:], '\n')
+		if nl == -1 {
+			return 0, false
+		}
+		offset += nl + 1
+	}
+	for i := 1; i < column; i++ {
+		if offset >= len(data) || data[offset] == '\n' {
+			return 0, false
+		}
+		_, size := utf8.DecodeRune(data[offset:])
+		offset += size
+	}
+	return offset, offset <= len(data)
+}
+
+// Replace returns the data with each of the scalars replaced by the corresponding value, keeping their
+// quoting. The scalars have to be found in the same data by Find.
+func Replace(data []byte, scalars []Scalar, values []string) ([]byte, error) {
+	if len(scalars) != len(values) {
+		return nil, fmt.Errorf("got %d values for %d scalars", len(values), len(scalars))
+	}
+
+	var (
+		buf  bytes.Buffer
+		last int
+	)
+	for i, s := range scalars {
+		if s.offset < last {
+			return nil, fmt.Errorf("scalars at line %d overlap or are out of order", s.Line)
+		}
+		if !bytes.HasPrefix(data[s.offset:], []byte(s.raw)) {
+			return nil, fmt.Errorf("scalar %s at line %d is not part of the data", s.Path, s.Line)
+		}
+		raw := values[i]
+		if quote := s.raw[0]; quote == '"' || quote == '\'' {
+			if strings.ContainsAny(raw, `"'\`) {
+				return nil, fmt.Errorf("%w: value %q of %s at line %d would have to be escaped", ErrUnsupportedScalar, raw, s.Path, s.Line)
+			}
+			raw = string(quote) + raw + string(quote)
+		}
+		buf.Write(data[last:s.offset])
+		buf.WriteString(raw)
+		last = s.offset + len(s.raw)
+	}
+	buf.Write(data[last:])
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package yamlpath_test
+
+import (
+	. "github.com/onmetal/onmetal-image/utils/yamlpath"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Yamlpath", func() {
+	mustParse := func(expr string) Path {
+		path, err := Parse(expr)
+		Expect(err).NotTo(HaveOccurred())
+		return path
+	}
+
+	values := func(scalars []Scalar) []string {
+		var res []string
+		for _, scalar := range scalars {
+			res = append(res, scalar.Value)
+		}
+		return res
+	}
+
+	It("should reject invalid paths", func() {
+		for _, expr := range []string{"", "spec", ".spec..image", ".items[", ".items[-1]", ".items[x]", ".items]"} {
+			_, err := Parse(expr)
+			Expect(err).To(HaveOccurred(), expr)
+		}
+	})
+
+	It("should find scalars in all documents and replace them keeping comments and quotes", func() {
+		data := []byte(`# machines
+spec:
+  image: ghcr.io/a/b:v1 # the image
+---
+spec:
+  image: "ghcr.io/a/c:v1"
+  volumes:
+  - image: 'ghcr.io/a/d:v1'
+  - image: ghcr.io/a/e:v1
+---
+kind: Other
+`)
+		scalars, err := Find(data, mustParse(".spec.image"), mustParse(".spec.volumes[].image"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(values(scalars)).To(Equal([]string{"ghcr.io/a/b:v1", "ghcr.io/a/c:v1", "ghcr.io/a/d:v1", "ghcr.io/a/e:v1"}))
+		Expect(scalars[0].Line).To(Equal(3))
+
+		updated, err := Replace(data, scalars, []string{"x:1", "y:2", "z:3", "e:4"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(updated)).To(Equal(`# machines
+spec:
+  image: x:1 # the image
+---
+spec:
+  image: "y:2"
+  volumes:
+  - image: 'z:3'
+  - image: e:4
+---
+kind: Other
+`))
+	})
+
+	It("should select single sequence elements and work on JSON", func() {
+		data := []byte(`{"items": [{"image": "a:1"}, {"image": "b:1"}]}`)
+		scalars, err := Find(data, mustParse(".items[1].image"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(values(scalars)).To(Equal([]string{"b:1"}))
+
+		updated, err := Replace(data, scalars, []string{"b:1@sha256:0000"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(updated)).To(Equal(`{"items": [{"image": "a:1"}, {"image": "b:1@sha256:0000"}]}`))
+	})
+
+	It("should refuse scalars it cannot replace in place", func() {
+		_, err := Find([]byte("image: |\n  a:1\n"), mustParse(".image"))
+		Expect(err).To(MatchError(ErrUnsupportedScalar))
+
+		_, err = Find([]byte("spec:\n  image: a:1\n"), mustParse(".spec"))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,160 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package version provides the version, build information and supported features of onmetal-image.
+//
+// The values are set at build time via ldflags, e.g.
+//
+//	go build -ldflags "-X github.com/onmetal/onmetal-image/version.Version=v0.1.0 \
+//	  -X github.com/onmetal/onmetal-image/version.GitCommit=$(git rev-parse HEAD) \
+//	  -X github.com/onmetal/onmetal-image/version.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// If they are not set, they are derived from the build information of the binary where possible,
+// so binaries embedding onmetal-image as a library report the version of the onmetal-image module.
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+const modulePath = "github.com/onmetal/onmetal-image"
+
+var (
+	// Version is the semantic version of onmetal-image.
+	Version = ""
+	// GitCommit is the git commit onmetal-image was built from.
+	GitCommit = ""
+	// BuildDate is the date onmetal-image was built at in RFC 3339 format.
+	BuildDate = ""
+)
+
+// Features supported by this version of onmetal-image.
+const (
+	// FeatureZstd is unpacking zstd compressed rootfs layers.
+	FeatureZstd = "zstd"
+	// FeatureArtifacts is pushing and pulling OCI artifacts.
+	FeatureArtifacts = "artifacts"
+	// FeatureFlatten is flattening tar rootfs layers.
+	FeatureFlatten = "flatten"
+	// FeatureExpiry is expiring and pruning images.
+	FeatureExpiry = "expiry"
+	// FeatureLayerEncryption is encrypting layers on push and decrypting them on pull.
+	FeatureLayerEncryption = "layer-encryption"
+	// FeatureStoreEncryption is encrypting blobs of the local store at rest.
+	FeatureStoreEncryption = "store-encryption"
+	// FeatureAnonymousFallback is retrying pulls anonymously if stored credentials are rejected.
+	FeatureAnonymousFallback = "anonymous-fallback"
+)
+
+// Features are all features supported by this version of onmetal-image.
+var Features = []string{
+	FeatureZstd,
+	FeatureArtifacts,
+	FeatureFlatten,
+	FeatureExpiry,
+	FeatureLayerEncryption,
+	FeatureStoreEncryption,
+	FeatureAnonymousFallback,
+}
+
+// Info is the version and build information of onmetal-image.
+type Info struct {
+	Version   string   `json:"version"`
+	GitCommit string   `json:"gitCommit,omitempty"`
+	BuildDate string   `json:"buildDate,omitempty"`
+	GoVersion string   `json:"goVersion"`
+	Platform  string   `json:"platform"`
+	Features  []string `json:"features"`
+}
+
+// HasFeature reports whether the given feature is supported.
+func (i Info) HasFeature(feature string) bool {
+	for _, f := range i.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func (i Info) String() string {
+	s := i.Version
+	if i.GitCommit != "" {
+		s += " (" + i.GitCommit + ")"
+	}
+	return s
+}
+
+// Get returns the version and build information of onmetal-image.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		GitCommit: GitCommit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Platform:  fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH),
+		Features:  append([]string(nil), Features...),
+	}
+
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		fillFromBuildInfo(&info, buildInfo)
+	}
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	return info
+}
+
+func fillFromBuildInfo(info *Info, buildInfo *debug.BuildInfo) {
+	var (
+		module = &buildInfo.Main
+		isMain = module.Path == modulePath
+	)
+	if !isMain {
+		module = nil
+		for _, dep := range buildInfo.Deps {
+			if dep.Path == modulePath {
+				module = dep
+				break
+			}
+		}
+	}
+	if module == nil {
+		return
+	}
+	if module.Replace != nil {
+		module = module.Replace
+	}
+
+	if info.Version == "" && module.Version != "(devel)" {
+		info.Version = module.Version
+	}
+
+	// VCS information is only recorded for the main module.
+	if !isMain || info.GitCommit != "" {
+		return
+	}
+	for _, setting := range buildInfo.Settings {
+		if setting.Key == "vcs.revision" {
+			info.GitCommit = setting.Value
+		}
+	}
+}
+
+// UserAgent returns the User-Agent onmetal-image sends to registries, onmetal-image/<version>.
+func UserAgent() string {
+	return "onmetal-image/" + Get().Version
+}
@@ -0,0 +1,44 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version_test
+
+import (
+	. "github.com/onmetal/onmetal-image/version"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Version", func() {
+	It("should report the version set via ldflags", func() {
+		defer func(version, gitCommit string) { Version, GitCommit = version, gitCommit }(Version, GitCommit)
+		Version, GitCommit = "v1.2.3", "abc123"
+
+		info := Get()
+		Expect(info.Version).To(Equal("v1.2.3"))
+		Expect(info.GitCommit).To(Equal("abc123"))
+		Expect(info.String()).To(Equal("v1.2.3 (abc123)"))
+		Expect(UserAgent()).To(Equal("onmetal-image/v1.2.3"))
+	})
+
+	It("should fall back to a dev version", func() {
+		Expect(Get().Version).NotTo(BeEmpty())
+	})
+
+	It("should report the supported features", func() {
+		info := Get()
+		Expect(info.HasFeature(FeatureZstd)).To(BeTrue())
+		Expect(info.HasFeature("referrers")).To(BeFalse())
+	})
+})